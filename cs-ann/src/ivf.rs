@@ -0,0 +1,203 @@
+//! Inverted-file (IVF) index: vectors are clustered around centroids learned
+//! with spherical k-means, and a query only scores the vectors of the lists
+//! whose centroids are nearest it. The index holds ids, not vectors, so it
+//! sits next to wherever the vectors are already kept.
+
+use anyhow::{Result, bail};
+use rayon::prelude::*;
+use serde::{Deserialize, Serialize};
+
+use crate::simd::dot;
+
+/// k-means rounds over the training sample.
+const TRAINING_ITERATIONS: usize = 10;
+
+/// Vectors sampled per list to train the centroids on.
+const SAMPLES_PER_LIST: usize = 64;
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct IvfIndex {
+    dim: usize,
+    /// Unit-length, one per list
+    centroids: Vec<Vec<f32>>,
+    lists: Vec<Vec<u32>>,
+}
+
+impl IvfIndex {
+    /// Cluster `vectors` into `lists` lists. Ids are positions in `vectors`.
+    pub fn build(vectors: &[&[f32]], lists: usize) -> Result<Self> {
+        let Some(dim) = vectors.first().map(|vector| vector.len()) else {
+            return Ok(Self::default());
+        };
+        if dim == 0 {
+            bail!(
+                "Embedding vectors are empty; rebuild the index with a supported embedding model"
+            );
+        }
+        if let Some(i) = vectors.iter().position(|vector| vector.len() != dim) {
+            bail!(
+                "Embedding size mismatch while building the ANN index: expected {} values but vector #{} has {}",
+                dim,
+                i,
+                vectors[i].len()
+            );
+        }
+        let lists = lists.clamp(1, vectors.len());
+
+        // Train on an evenly spaced sample, seeded with evenly spaced vectors of it
+        let step = (vectors.len() / (lists * SAMPLES_PER_LIST)).max(1);
+        let sample: Vec<&[f32]> = vectors.iter().step_by(step).copied().collect();
+        let seed_step = sample.len() / lists;
+        let mut centroids: Vec<Vec<f32>> = (0..lists)
+            .map(|i| normalized(sample[i * seed_step].to_vec()))
+            .collect();
+        for _ in 0..TRAINING_ITERATIONS {
+            let assignments: Vec<usize> = sample
+                .par_iter()
+                .map(|vector| nearest(&centroids, vector))
+                .collect();
+            let mut sums = vec![vec![0f32; dim]; lists];
+            for (vector, &list) in sample.iter().zip(&assignments) {
+                for (sum, value) in sums[list].iter_mut().zip(vector.iter()) {
+                    *sum += value;
+                }
+            }
+            for (centroid, sum) in centroids.iter_mut().zip(sums) {
+                // A list nothing was assigned to keeps its centroid
+                if sum.iter().any(|&value| value != 0.0) {
+                    *centroid = normalized(sum);
+                }
+            }
+        }
+
+        let assignments: Vec<usize> = vectors
+            .par_iter()
+            .map(|vector| nearest(&centroids, vector))
+            .collect();
+        let mut ids = vec![Vec::new(); lists];
+        for (id, &list) in assignments.iter().enumerate() {
+            ids[list].push(id as u32);
+        }
+        Ok(Self {
+            dim,
+            centroids,
+            lists: ids,
+        })
+    }
+
+    /// Number of vectors indexed.
+    pub fn len(&self) -> usize {
+        self.lists.iter().map(Vec::len).sum()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    pub fn dim(&self) -> usize {
+        self.dim
+    }
+
+    pub fn list_count(&self) -> usize {
+        self.lists.len()
+    }
+
+    /// The ids in each list; a list nothing was nearest may be empty.
+    pub fn lists(&self) -> &[Vec<u32>] {
+        &self.lists
+    }
+
+    /// Each list's centroid, unit length.
+    pub fn centroids(&self) -> &[Vec<f32>] {
+        &self.centroids
+    }
+
+    /// Ids in the `probes` lists whose centroids are nearest `query`.
+    pub fn candidates(&self, query: &[f32], probes: usize) -> Result<Vec<u32>> {
+        if query.len() != self.dim {
+            bail!(
+                "Embedding size mismatch during search: the ANN index holds vectors with {} values, but the query has {}",
+                self.dim,
+                query.len()
+            );
+        }
+        let mut nearest: Vec<(f32, usize)> = self
+            .centroids
+            .iter()
+            .enumerate()
+            .map(|(list, centroid)| (dot(query, centroid), list))
+            .collect();
+        nearest.sort_by(|a, b| b.0.partial_cmp(&a.0).unwrap_or(std::cmp::Ordering::Equal));
+        Ok(nearest
+            .iter()
+            .take(probes)
+            .flat_map(|&(_, list)| self.lists[list].iter().copied())
+            .collect())
+    }
+}
+
+fn normalized(mut vector: Vec<f32>) -> Vec<f32> {
+    let norm = dot(&vector, &vector).sqrt();
+    if norm > 0.0 {
+        for value in &mut vector {
+            *value /= norm;
+        }
+    }
+    vector
+}
+
+/// The list whose centroid is nearest `vector`. Centroids are unit length,
+/// so the largest dot product is the largest cosine similarity.
+fn nearest(centroids: &[Vec<f32>], vector: &[f32]) -> usize {
+    centroids
+        .iter()
+        .map(|centroid| dot(vector, centroid))
+        .enumerate()
+        .max_by(|a, b| a.1.partial_cmp(&b.1).unwrap_or(std::cmp::Ordering::Equal))
+        .map_or(0, |(list, _)| list)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Points scattered around three directions.
+    fn clustered() -> Vec<Vec<f32>> {
+        let directions = [[1.0, 0.0, 0.0], [0.0, 1.0, 0.0], [0.0, 0.0, 1.0]];
+        (0..300)
+            .map(|i| {
+                let jitter = (i % 10) as f32 * 0.01;
+                let mut vector = directions[i % 3].to_vec();
+                vector[(i + 1) % 3] += jitter;
+                vector
+            })
+            .collect()
+    }
+
+    #[test]
+    fn probing_the_nearest_list_finds_the_querys_cluster() {
+        let vectors = clustered();
+        let refs: Vec<&[f32]> = vectors.iter().map(Vec::as_slice).collect();
+        let index = IvfIndex::build(&refs, 3).unwrap();
+        assert_eq!(index.len(), 300);
+        assert_eq!(index.list_count(), 3);
+
+        let candidates = index.candidates(&[0.0, 0.9, 0.1], 1).unwrap();
+        assert_eq!(candidates.len(), 100);
+        assert!(candidates.iter().all(|&id| id % 3 == 1));
+        assert_eq!(index.candidates(&[0.0, 0.9, 0.1], 3).unwrap().len(), 300);
+    }
+
+    #[test]
+    fn mismatched_dimensions_are_rejected() {
+        let mixed: [&[f32]; 2] = [&[1.0, 0.0], &[1.0, 0.0, 0.0]];
+        let err = IvfIndex::build(&mixed, 1).unwrap_err();
+        assert!(err.to_string().contains("Embedding size mismatch"));
+
+        let vectors = clustered();
+        let refs: Vec<&[f32]> = vectors.iter().map(Vec::as_slice).collect();
+        let index = IvfIndex::build(&refs, 3).unwrap();
+        assert!(index.candidates(&[1.0, 0.0], 1).is_err());
+        assert!(IvfIndex::build(&[], 8).unwrap().is_empty());
+    }
+}
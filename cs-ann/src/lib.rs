@@ -2,6 +2,10 @@ use anyhow::{Result, bail};
 use serde::{Deserialize, Serialize};
 use std::path::Path;
 
+mod ivf;
+pub mod simd;
+pub use ivf::IvfIndex;
+
 pub trait AnnIndex: Send + Sync {
     fn build(vectors: &[Vec<f32>]) -> Result<Self>
     where
@@ -35,15 +39,7 @@ impl SimpleIndex {
     }
 
     fn cosine_similarity(&self, a: &[f32], b: &[f32]) -> f32 {
-        let dot_product: f32 = a.iter().zip(b.iter()).map(|(x, y)| x * y).sum();
-        let norm_a: f32 = a.iter().map(|x| x * x).sum::<f32>().sqrt();
-        let norm_b: f32 = b.iter().map(|x| x * x).sum::<f32>().sqrt();
-
-        if norm_a == 0.0 || norm_b == 0.0 {
-            0.0
-        } else {
-            dot_product / (norm_a * norm_b)
-        }
+        simd::cosine(a, b)
     }
 }
 
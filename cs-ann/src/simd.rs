@@ -0,0 +1,357 @@
+//! Vector similarity kernels. Scoring a brute-force scan is almost all dot
+//! products, so they use the widest SIMD the CPU has: AVX-512 or AVX2 with
+//! FMA, detected at runtime on x86-64, and NEON, which every aarch64 CPU has.
+//! Elsewhere a portable kernel with independent accumulators lets the
+//! compiler vectorize for the baseline target.
+//!
+//! `CS_SIMD=portable` forces the portable kernel, to rule the others out
+//! when comparing scores across machines; lanes sum in a different order,
+//! so scores can differ in the last bits between kernels.
+
+use std::sync::LazyLock;
+
+/// The kernels one instruction set provides.
+struct Kernel {
+    name: &'static str,
+    dot: fn(&[f32], &[f32]) -> f32,
+    /// Dot product and the squared norms of both vectors, in one pass
+    dot_and_norms: fn(&[f32], &[f32]) -> [f32; 3],
+}
+
+static KERNEL: LazyLock<Kernel> = LazyLock::new(|| {
+    if std::env::var("CS_SIMD").is_ok_and(|value| value.eq_ignore_ascii_case("portable")) {
+        return PORTABLE;
+    }
+    detect()
+});
+
+const PORTABLE: Kernel = Kernel {
+    name: "portable",
+    dot: portable::dot,
+    dot_and_norms: portable::dot_and_norms,
+};
+
+#[cfg(target_arch = "x86_64")]
+fn detect() -> Kernel {
+    if is_x86_feature_detected!("avx512f") {
+        Kernel {
+            name: "avx512",
+            dot: x86::dot_avx512,
+            dot_and_norms: x86::dot_and_norms_avx512,
+        }
+    } else if is_x86_feature_detected!("avx2") && is_x86_feature_detected!("fma") {
+        Kernel {
+            name: "avx2",
+            dot: x86::dot_avx2,
+            dot_and_norms: x86::dot_and_norms_avx2,
+        }
+    } else {
+        PORTABLE
+    }
+}
+
+#[cfg(target_arch = "aarch64")]
+fn detect() -> Kernel {
+    Kernel {
+        name: "neon",
+        dot: neon::dot,
+        dot_and_norms: neon::dot_and_norms,
+    }
+}
+
+#[cfg(not(any(target_arch = "x86_64", target_arch = "aarch64")))]
+fn detect() -> Kernel {
+    PORTABLE
+}
+
+/// Name of the kernel in use: `avx512`, `avx2`, `neon` or `portable`.
+pub fn kernel() -> &'static str {
+    KERNEL.name
+}
+
+/// Dot product over the length of the shorter vector.
+pub fn dot(a: &[f32], b: &[f32]) -> f32 {
+    let len = a.len().min(b.len());
+    (KERNEL.dot)(&a[..len], &b[..len])
+}
+
+/// Cosine similarity; 0 for vectors of different lengths or a zero vector.
+pub fn cosine(a: &[f32], b: &[f32]) -> f32 {
+    if a.len() != b.len() {
+        return 0.0;
+    }
+    let [dot, norm_a, norm_b] = (KERNEL.dot_and_norms)(a, b);
+    if norm_a == 0.0 || norm_b == 0.0 {
+        0.0
+    } else {
+        dot / (norm_a.sqrt() * norm_b.sqrt())
+    }
+}
+
+mod portable {
+    /// Independent accumulators, so the sums don't serialize on one register.
+    const LANES: usize = 8;
+
+    pub fn dot(a: &[f32], b: &[f32]) -> f32 {
+        let mut sums = [0f32; LANES];
+        let (a_chunks, a_rest) = a.as_chunks::<LANES>();
+        let (b_chunks, b_rest) = b.as_chunks::<LANES>();
+        for (x, y) in a_chunks.iter().zip(b_chunks) {
+            for ((sum, x), y) in sums.iter_mut().zip(x).zip(y) {
+                *sum += x * y;
+            }
+        }
+        let tail: f32 = a_rest.iter().zip(b_rest).map(|(x, y)| x * y).sum();
+        sums.iter().sum::<f32>() + tail
+    }
+
+    pub fn dot_and_norms(a: &[f32], b: &[f32]) -> [f32; 3] {
+        // Per lane: a·b, a·a and b·b
+        let mut lanes = [[0f32; 3]; LANES];
+        let (a_chunks, a_rest) = a.as_chunks::<LANES>();
+        let (b_chunks, b_rest) = b.as_chunks::<LANES>();
+        for (x, y) in a_chunks.iter().zip(b_chunks) {
+            for ((sums, x), y) in lanes.iter_mut().zip(x).zip(y) {
+                sums[0] += x * y;
+                sums[1] += x * x;
+                sums[2] += y * y;
+            }
+        }
+        let mut sums = [0f32; 3];
+        for lane in lanes {
+            for (sum, value) in sums.iter_mut().zip(lane) {
+                *sum += value;
+            }
+        }
+        for (x, y) in a_rest.iter().zip(b_rest) {
+            sums[0] += x * y;
+            sums[1] += x * x;
+            sums[2] += y * y;
+        }
+        sums
+    }
+}
+
+#[cfg(target_arch = "x86_64")]
+mod x86 {
+    use std::arch::x86_64::*;
+
+    // The safe wrappers are only selected once `detect` has seen the features.
+
+    pub fn dot_avx2(a: &[f32], b: &[f32]) -> f32 {
+        // SAFETY: AVX2 and FMA were detected
+        unsafe { dot_avx2_impl(a, b) }
+    }
+
+    pub fn dot_and_norms_avx2(a: &[f32], b: &[f32]) -> [f32; 3] {
+        // SAFETY: AVX2 and FMA were detected
+        unsafe { dot_and_norms_avx2_impl(a, b) }
+    }
+
+    pub fn dot_avx512(a: &[f32], b: &[f32]) -> f32 {
+        // SAFETY: AVX-512F was detected
+        unsafe { dot_avx512_impl(a, b) }
+    }
+
+    pub fn dot_and_norms_avx512(a: &[f32], b: &[f32]) -> [f32; 3] {
+        // SAFETY: AVX-512F was detected
+        unsafe { dot_and_norms_avx512_impl(a, b) }
+    }
+
+    #[target_feature(enable = "avx2,fma")]
+    fn sum256(v: __m256) -> f32 {
+        let pair = _mm_add_ps(_mm256_castps256_ps128(v), _mm256_extractf128_ps::<1>(v));
+        let pair = _mm_add_ps(pair, _mm_movehl_ps(pair, pair));
+        _mm_cvtss_f32(_mm_add_ss(pair, _mm_shuffle_ps::<1>(pair, pair)))
+    }
+
+    #[target_feature(enable = "avx2,fma")]
+    fn dot_avx2_impl(a: &[f32], b: &[f32]) -> f32 {
+        let len = a.len().min(b.len());
+        let blocks = len / 16;
+        let (mut s0, mut s1) = (_mm256_setzero_ps(), _mm256_setzero_ps());
+        for i in 0..blocks {
+            // SAFETY: 16 values from i * 16 are within both slices
+            unsafe {
+                let (pa, pb) = (a.as_ptr().add(i * 16), b.as_ptr().add(i * 16));
+                s0 = _mm256_fmadd_ps(_mm256_loadu_ps(pa), _mm256_loadu_ps(pb), s0);
+                s1 = _mm256_fmadd_ps(_mm256_loadu_ps(pa.add(8)), _mm256_loadu_ps(pb.add(8)), s1);
+            }
+        }
+        let tail = super::portable::dot(&a[blocks * 16..len], &b[blocks * 16..len]);
+        sum256(_mm256_add_ps(s0, s1)) + tail
+    }
+
+    #[target_feature(enable = "avx2,fma")]
+    fn dot_and_norms_avx2_impl(a: &[f32], b: &[f32]) -> [f32; 3] {
+        let len = a.len().min(b.len());
+        let blocks = len / 8;
+        let (mut ab, mut aa, mut bb) = (
+            _mm256_setzero_ps(),
+            _mm256_setzero_ps(),
+            _mm256_setzero_ps(),
+        );
+        for i in 0..blocks {
+            // SAFETY: 8 values from i * 8 are within both slices
+            let (x, y) = unsafe {
+                (
+                    _mm256_loadu_ps(a.as_ptr().add(i * 8)),
+                    _mm256_loadu_ps(b.as_ptr().add(i * 8)),
+                )
+            };
+            ab = _mm256_fmadd_ps(x, y, ab);
+            aa = _mm256_fmadd_ps(x, x, aa);
+            bb = _mm256_fmadd_ps(y, y, bb);
+        }
+        let tail = super::portable::dot_and_norms(&a[blocks * 8..len], &b[blocks * 8..len]);
+        [
+            sum256(ab) + tail[0],
+            sum256(aa) + tail[1],
+            sum256(bb) + tail[2],
+        ]
+    }
+
+    #[target_feature(enable = "avx512f")]
+    fn dot_avx512_impl(a: &[f32], b: &[f32]) -> f32 {
+        let len = a.len().min(b.len());
+        let blocks = len / 32;
+        let (mut s0, mut s1) = (_mm512_setzero_ps(), _mm512_setzero_ps());
+        for i in 0..blocks {
+            // SAFETY: 32 values from i * 32 are within both slices
+            unsafe {
+                let (pa, pb) = (a.as_ptr().add(i * 32), b.as_ptr().add(i * 32));
+                s0 = _mm512_fmadd_ps(_mm512_loadu_ps(pa), _mm512_loadu_ps(pb), s0);
+                s1 = _mm512_fmadd_ps(_mm512_loadu_ps(pa.add(16)), _mm512_loadu_ps(pb.add(16)), s1);
+            }
+        }
+        let tail = super::portable::dot(&a[blocks * 32..len], &b[blocks * 32..len]);
+        _mm512_reduce_add_ps(_mm512_add_ps(s0, s1)) + tail
+    }
+
+    #[target_feature(enable = "avx512f")]
+    fn dot_and_norms_avx512_impl(a: &[f32], b: &[f32]) -> [f32; 3] {
+        let len = a.len().min(b.len());
+        let blocks = len / 16;
+        let (mut ab, mut aa, mut bb) = (
+            _mm512_setzero_ps(),
+            _mm512_setzero_ps(),
+            _mm512_setzero_ps(),
+        );
+        for i in 0..blocks {
+            // SAFETY: 16 values from i * 16 are within both slices
+            let (x, y) = unsafe {
+                (
+                    _mm512_loadu_ps(a.as_ptr().add(i * 16)),
+                    _mm512_loadu_ps(b.as_ptr().add(i * 16)),
+                )
+            };
+            ab = _mm512_fmadd_ps(x, y, ab);
+            aa = _mm512_fmadd_ps(x, x, aa);
+            bb = _mm512_fmadd_ps(y, y, bb);
+        }
+        let tail = super::portable::dot_and_norms(&a[blocks * 16..len], &b[blocks * 16..len]);
+        [
+            _mm512_reduce_add_ps(ab) + tail[0],
+            _mm512_reduce_add_ps(aa) + tail[1],
+            _mm512_reduce_add_ps(bb) + tail[2],
+        ]
+    }
+}
+
+#[cfg(target_arch = "aarch64")]
+mod neon {
+    use std::arch::aarch64::*;
+
+    pub fn dot(a: &[f32], b: &[f32]) -> f32 {
+        let len = a.len().min(b.len());
+        let blocks = len / 8;
+        // SAFETY: NEON is part of every aarch64 target, and 8 values from
+        // i * 8 are within both slices
+        let sum = unsafe {
+            let (mut s0, mut s1) = (vdupq_n_f32(0.0), vdupq_n_f32(0.0));
+            for i in 0..blocks {
+                let (pa, pb) = (a.as_ptr().add(i * 8), b.as_ptr().add(i * 8));
+                s0 = vfmaq_f32(s0, vld1q_f32(pa), vld1q_f32(pb));
+                s1 = vfmaq_f32(s1, vld1q_f32(pa.add(4)), vld1q_f32(pb.add(4)));
+            }
+            vaddvq_f32(vaddq_f32(s0, s1))
+        };
+        sum + super::portable::dot(&a[blocks * 8..len], &b[blocks * 8..len])
+    }
+
+    pub fn dot_and_norms(a: &[f32], b: &[f32]) -> [f32; 3] {
+        let len = a.len().min(b.len());
+        let blocks = len / 4;
+        // SAFETY: as in `dot`, for 4 values from i * 4
+        let sums = unsafe {
+            let (mut ab, mut aa, mut bb) = (vdupq_n_f32(0.0), vdupq_n_f32(0.0), vdupq_n_f32(0.0));
+            for i in 0..blocks {
+                let x = vld1q_f32(a.as_ptr().add(i * 4));
+                let y = vld1q_f32(b.as_ptr().add(i * 4));
+                ab = vfmaq_f32(ab, x, y);
+                aa = vfmaq_f32(aa, x, x);
+                bb = vfmaq_f32(bb, y, y);
+            }
+            [vaddvq_f32(ab), vaddvq_f32(aa), vaddvq_f32(bb)]
+        };
+        let tail = super::portable::dot_and_norms(&a[blocks * 4..len], &b[blocks * 4..len]);
+        [sums[0] + tail[0], sums[1] + tail[1], sums[2] + tail[2]]
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Lengths around every block size, with values that don't cancel out.
+    fn pairs() -> Vec<(Vec<f32>, Vec<f32>)> {
+        [0, 1, 3, 4, 7, 8, 15, 16, 17, 31, 32, 33, 384, 1023]
+            .into_iter()
+            .map(|len| {
+                let a = (0..len)
+                    .map(|i| ((i * 7 % 11) as f32 - 5.0) / 5.0)
+                    .collect();
+                let b = (0..len)
+                    .map(|i| ((i * 3 % 13) as f32 - 6.0) / 6.0)
+                    .collect();
+                (a, b)
+            })
+            .collect()
+    }
+
+    fn naive_dot(a: &[f32], b: &[f32]) -> f32 {
+        a.iter().zip(b).map(|(x, y)| x * y).sum()
+    }
+
+    #[test]
+    fn kernels_agree_with_a_naive_sum() {
+        let mut kernels = vec![PORTABLE];
+        #[cfg(any(target_arch = "x86_64", target_arch = "aarch64"))]
+        kernels.push(detect());
+        for kernel in kernels {
+            for (a, b) in pairs() {
+                let tolerance = 1e-4 * (a.len() as f32).max(1.0);
+                let expected = naive_dot(&a, &b);
+                assert!(
+                    ((kernel.dot)(&a, &b) - expected).abs() < tolerance,
+                    "{} dot of {} values",
+                    kernel.name,
+                    a.len()
+                );
+                let [dot, norm_a, norm_b] = (kernel.dot_and_norms)(&a, &b);
+                assert!((dot - expected).abs() < tolerance, "{}", kernel.name);
+                assert!((norm_a - naive_dot(&a, &a)).abs() < tolerance);
+                assert!((norm_b - naive_dot(&b, &b)).abs() < tolerance);
+            }
+        }
+    }
+
+    #[test]
+    fn cosine_handles_degenerate_vectors() {
+        assert!((cosine(&[1.0, 2.0, 3.0], &[2.0, 4.0, 6.0]) - 1.0).abs() < 1e-6);
+        assert!((cosine(&[1.0, 0.0], &[-1.0, 0.0]) + 1.0).abs() < 1e-6);
+        assert_eq!(cosine(&[0.0, 0.0], &[1.0, 2.0]), 0.0);
+        assert_eq!(cosine(&[1.0, 0.0], &[1.0, 0.0, 0.0]), 0.0);
+        assert_eq!(dot(&[1.0, 2.0, 3.0], &[1.0, 1.0]), 3.0);
+    }
+}
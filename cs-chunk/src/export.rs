@@ -0,0 +1,144 @@
+//! Chunks as plain records for pipelines outside cs (`cs --chunk`): the
+//! boundaries, symbols and text that indexing would embed, with nothing
+//! embedded.
+
+use crate::{Chunk, ChunkType};
+use anyhow::{Result, bail};
+use cs_core::Language;
+use serde::Serialize;
+use std::path::Path;
+
+/// Lines of a whole declaration, of which a chunk is the outline or a
+/// section.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct ParentLines {
+    pub line_start: usize,
+    pub line_end: usize,
+}
+
+/// Where a chunk falls among the strides of one too long to embed whole.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct Stride {
+    /// From 0
+    pub index: usize,
+    pub total: usize,
+}
+
+/// One chunk of a file.
+#[derive(Debug, Clone, Serialize)]
+pub struct ChunkRecord {
+    /// The file as it was named
+    pub file: String,
+    pub language: Option<String>,
+    /// Position among the file's chunks, from 0
+    pub index: usize,
+    /// `function`, `class`, `method`, `module` or `text`
+    pub chunk_type: &'static str,
+    /// Name of what the chunk declares
+    pub symbol: Option<String>,
+    /// Enclosing declarations, outermost first, as `a::b`
+    pub breadcrumb: Option<String>,
+    pub line_start: usize,
+    pub line_end: usize,
+    pub byte_start: usize,
+    pub byte_end: usize,
+    pub parent: Option<ParentLines>,
+    pub stride: Option<Stride>,
+    pub estimated_tokens: usize,
+    /// Doc comments and attributes the chunk starts with
+    pub leading_trivia: Vec<String>,
+    pub text: String,
+}
+
+pub fn chunk_type_name(chunk_type: &ChunkType) -> &'static str {
+    match chunk_type {
+        ChunkType::Function => "function",
+        ChunkType::Class => "class",
+        ChunkType::Method => "method",
+        ChunkType::Module => "module",
+        ChunkType::Text => "text",
+    }
+}
+
+impl ChunkRecord {
+    fn new(file: &str, language: Option<Language>, index: usize, chunk: Chunk) -> Self {
+        Self {
+            file: file.to_string(),
+            language: language.map(|language| language.to_string()),
+            index,
+            chunk_type: chunk_type_name(&chunk.chunk_type),
+            symbol: chunk.metadata.name,
+            breadcrumb: chunk.metadata.breadcrumb,
+            line_start: chunk.span.line_start,
+            line_end: chunk.span.line_end,
+            byte_start: chunk.span.byte_start,
+            byte_end: chunk.span.byte_end,
+            parent: chunk.metadata.parent.map(|parent| ParentLines {
+                line_start: parent.line_start,
+                line_end: parent.line_end,
+            }),
+            stride: chunk.stride_info.map(|stride| Stride {
+                index: stride.stride_index,
+                total: stride.total_strides,
+            }),
+            estimated_tokens: chunk.metadata.estimated_tokens,
+            leading_trivia: chunk.metadata.leading_trivia,
+            text: chunk.text,
+        }
+    }
+}
+
+/// The chunks of `text`, the content of `file`, as indexing with
+/// `model_name` cuts them.
+pub fn records(
+    file: &str,
+    text: &str,
+    language: Option<Language>,
+    model_name: Option<&str>,
+) -> Result<Vec<ChunkRecord>> {
+    Ok(crate::chunk_text_with_model(text, language, model_name)?
+        .into_iter()
+        .enumerate()
+        .map(|(index, chunk)| ChunkRecord::new(file, language, index, chunk))
+        .collect())
+}
+
+/// The chunks of the file at `path`, decoded as indexing decodes it.
+pub fn chunk_file(path: &Path, model_name: Option<&str>) -> Result<Vec<ChunkRecord>> {
+    if cs_core::pdf::is_pdf_file(path) {
+        bail!(
+            "{} is a PDF; chunk the text extracted from it instead",
+            path.display()
+        );
+    }
+    let text = cs_core::text::read_text(path)
+        .map_err(|e| anyhow::anyhow!("Could not read {}: {}", path.display(), e))?;
+    records(
+        &cs_core::paths::to_slash(path),
+        &text,
+        Language::from_path(path),
+        model_name,
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn records_carry_boundaries_symbols_and_text() {
+        let source = "/// Adds two numbers.\nfn add(a: i32, b: i32) -> i32 {\n    a + b\n}\n";
+        let records = records("src/math.rs", source, Some(Language::Rust), None).unwrap();
+        let add = records
+            .iter()
+            .find(|record| record.symbol.as_deref() == Some("add"))
+            .expect("a chunk for add");
+        assert_eq!(add.file, "src/math.rs");
+        assert_eq!(add.chunk_type, "function");
+        assert_eq!(add.language.as_deref(), Some("rust"));
+        assert!(add.text.contains("a + b"));
+        assert_eq!(&source[add.byte_start..add.byte_end], add.text);
+        assert!(add.line_start <= 2 && add.line_end >= 4);
+        assert_eq!(records[0].index, 0);
+    }
+}
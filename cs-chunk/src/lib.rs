@@ -2,6 +2,7 @@ use anyhow::Result;
 use cs_core::Span;
 use serde::{Deserialize, Serialize};
 
+pub mod export;
 mod query_chunker;
 
 /// Import token estimation from cc-embed
@@ -56,17 +57,25 @@ pub struct StrideInfo {
 
 #[derive(Debug, Clone, Serialize, Deserialize, Default)]
 pub struct ChunkMetadata {
+    /// Name of the function, method, class or module the chunk declares
+    #[serde(default)]
+    pub name: Option<String>,
     pub ancestry: Vec<String>,
     pub breadcrumb: Option<String>,
     pub leading_trivia: Vec<String>,
     pub trailing_trivia: Vec<String>,
     pub byte_length: usize,
     pub estimated_tokens: usize,
+    /// Span of the whole declaration when a long one was split into an
+    /// outline and sections (see `split_hierarchically`)
+    #[serde(default)]
+    pub parent: Option<Span>,
 }
 
 impl ChunkMetadata {
     fn from_context(
         text: &str,
+        name: Option<String>,
         ancestry: Vec<String>,
         leading_trivia: Vec<String>,
         trailing_trivia: Vec<String>,
@@ -78,23 +87,27 @@ impl ChunkMetadata {
         };
 
         Self {
+            name,
             ancestry,
             breadcrumb,
             leading_trivia,
             trailing_trivia,
             byte_length: text.len(),
             estimated_tokens: estimate_tokens(text),
+            parent: None,
         }
     }
 
     fn from_text(text: &str) -> Self {
         Self {
+            name: None,
             ancestry: Vec::new(),
             breadcrumb: None,
             leading_trivia: Vec::new(),
             trailing_trivia: Vec::new(),
             byte_length: text.len(),
             estimated_tokens: estimate_tokens(text),
+            parent: None,
         }
     }
 
@@ -228,6 +241,7 @@ pub fn chunk_text_with_config(
     chunk_text_with_config_and_model(text, language, config, None)
 }
 
+#[tracing::instrument(name = "chunk", skip_all, fields(language = ?language))]
 fn chunk_text_with_config_and_model(
     text: &str,
     language: Option<cs_core::Language>,
@@ -368,8 +382,8 @@ fn chunk_language(text: &str, language: ParseableLanguage) -> Result<Vec<Chunk>>
     let ts_language = tree_sitter_language(language)?;
     parser.set_language(&ts_language)?;
 
-    let tree = parser
-        .parse(text, None)
+    let tree = tracing::info_span!("parse", bytes = text.len())
+        .in_scope(|| parser.parse(text, None))
         .ok_or_else(|| anyhow::anyhow!("Failed to parse {} code", language))?;
 
     let mut chunks = match query_chunker::chunk_with_queries(language, ts_language, &tree, text)? {
@@ -894,10 +908,12 @@ pub(crate) fn build_chunk(
     }
 
     let chunk_type = adjust_chunk_type_for_context(target_node, initial_type, language);
+    let name = chunk_name(node, target_node, language, source, chunk_type);
     let ancestry = collect_ancestry(target_node, language, source);
     let leading_trivia = segments_to_strings(&leading_segments, source);
     let trailing_trivia = segments_to_strings(&trailing_segments, source);
-    let metadata = ChunkMetadata::from_context(&text, ancestry, leading_trivia, trailing_trivia);
+    let metadata =
+        ChunkMetadata::from_context(&text, name, ancestry, leading_trivia, trailing_trivia);
 
     Some(Chunk {
         span: Span {
@@ -1072,6 +1088,34 @@ fn collect_ancestry(
     parts
 }
 
+/// The name `node` declares. An arrow function has none of its own: it is
+/// named by the variable or field it is assigned to, found on the way up to
+/// `target_node`, the node its chunk was expanded to.
+fn chunk_name(
+    node: tree_sitter::Node<'_>,
+    target_node: tree_sitter::Node<'_>,
+    language: ParseableLanguage,
+    source: &str,
+    chunk_type: ChunkType,
+) -> Option<String> {
+    if node.id() == target_node.id() {
+        return display_name_for_node(node, language, source, chunk_type);
+    }
+    let mut current = node.parent()?;
+    loop {
+        if let Some(name) = current
+            .child_by_field_name("name")
+            .and_then(|name| text_for_node(name, source))
+        {
+            return Some(name);
+        }
+        if current.id() == target_node.id() {
+            return None;
+        }
+        current = current.parent()?;
+    }
+}
+
 fn display_name_for_node(
     node: tree_sitter::Node<'_>,
     language: ParseableLanguage,
@@ -1249,7 +1293,12 @@ fn apply_striding(chunks: Vec<Chunk>, config: &ChunkConfig) -> Result<Vec<Chunk>
                 config.max_tokens
             );
 
-            let strided_chunks = stride_large_chunk(chunk, config)?;
+            let strided_chunks =
+                if matches!(chunk.chunk_type, ChunkType::Function | ChunkType::Method) {
+                    split_hierarchically(chunk, config)?
+                } else {
+                    stride_large_chunk(chunk, config)?
+                };
             result.extend(strided_chunks);
         }
     }
@@ -1373,6 +1422,124 @@ fn stride_large_chunk(chunk: Chunk, config: &ChunkConfig) -> Result<Vec<Chunk>>
     Ok(strided_chunks)
 }
 
+/// Lines of a declaration searched for the one opening its body.
+const MAX_SIGNATURE_LINES: usize = 8;
+
+/// Split a function or method too long for one chunk into an outline chunk
+/// followed by line-aligned sections. The outline spans the whole
+/// declaration but holds only its signature and the first line of each
+/// section, so a query about what the function does finds it as a whole;
+/// each section keeps the detail of its own lines. All of them carry the
+/// declaration's span in `metadata.parent`, which searches use to fold
+/// sibling hits back into one result. A declaration with a line too long for
+/// a section, such as minified code, is strided instead.
+fn split_hierarchically(chunk: Chunk, config: &ChunkConfig) -> Result<Vec<Chunk>> {
+    let window_tokens = ((config.max_tokens as f32 * 0.9) as usize).max(1); // 10% buffer
+
+    // (byte start, byte end, line offset) of each section within the chunk
+    let mut sections: Vec<(usize, usize, usize)> = Vec::new();
+    let (mut start, mut start_line, mut offset, mut tokens) = (0, 0, 0, 0);
+    for (line_index, line) in chunk.text.split_inclusive('\n').enumerate() {
+        let line_tokens = estimate_tokens(line);
+        if line_tokens > window_tokens {
+            return stride_large_chunk(chunk, config);
+        }
+        if tokens + line_tokens > window_tokens && offset > start {
+            sections.push((start, offset, start_line));
+            (start, start_line, tokens) = (offset, line_index, 0);
+        }
+        tokens += line_tokens;
+        offset += line.len();
+        // A blank line past the middle of a section is a natural place to end it
+        if line.trim().is_empty() && tokens >= window_tokens / 2 {
+            sections.push((start, offset, start_line));
+            (start, start_line, tokens) = (offset, line_index + 1, 0);
+        }
+    }
+    if offset > start {
+        sections.push((start, offset, start_line));
+    }
+    sections.retain(|&(start, end, _)| !chunk.text[start..end].trim().is_empty());
+    if sections.len() < 2 {
+        return stride_large_chunk(chunk, config);
+    }
+
+    let parent = Some(chunk.span.clone());
+    let mut outline = signature(&chunk.text).to_string();
+    let mut outline_tokens = estimate_tokens(&outline);
+    for &(start, end, _) in &sections[1..] {
+        let Some(first_line) = chunk.text[start..end]
+            .lines()
+            .find(|line| !line.trim().is_empty())
+        else {
+            continue;
+        };
+        let line = format!("\n    …\n{}", first_line.trim_end());
+        outline_tokens += estimate_tokens(&line);
+        if outline_tokens > window_tokens {
+            break;
+        }
+        outline.push_str(&line);
+    }
+    let mut outline_metadata = chunk.metadata.with_updated_text(&outline);
+    outline_metadata.parent = parent.clone();
+
+    let original_chunk_id = format!("{}:{}", chunk.span.byte_start, chunk.span.byte_end);
+    let total_strides = sections.len();
+    let mut chunks = vec![Chunk {
+        span: chunk.span.clone(),
+        text: outline,
+        chunk_type: chunk.chunk_type.clone(),
+        stride_info: None,
+        metadata: outline_metadata,
+    }];
+    for (stride_index, (start, end, line_offset)) in sections.into_iter().enumerate() {
+        let text = &chunk.text[start..end];
+        let mut metadata = chunk.metadata.with_updated_text(text);
+        metadata.parent = parent.clone();
+        let line_start = chunk.span.line_start + line_offset;
+        chunks.push(Chunk {
+            span: Span {
+                byte_start: chunk.span.byte_start + start,
+                byte_end: chunk.span.byte_start + end,
+                line_start,
+                line_end: line_start + text.lines().count().saturating_sub(1),
+            },
+            text: text.to_string(),
+            chunk_type: chunk.chunk_type.clone(),
+            stride_info: Some(StrideInfo {
+                original_chunk_id: original_chunk_id.clone(),
+                stride_index,
+                total_strides,
+                overlap_start: 0,
+                overlap_end: 0,
+            }),
+            metadata,
+        });
+    }
+
+    tracing::debug!(
+        "Split a declaration of {} tokens into an outline and {} sections",
+        estimate_tokens(&chunk.text),
+        total_strides
+    );
+    Ok(chunks)
+}
+
+/// The lines of a declaration up to the one opening its body, or its first
+/// line when none does within [`MAX_SIGNATURE_LINES`].
+fn signature(text: &str) -> &str {
+    let mut end = 0;
+    for line in text.split_inclusive('\n').take(MAX_SIGNATURE_LINES) {
+        end += line.len();
+        let trimmed = line.trim_end();
+        if trimmed.ends_with('{') || trimmed.ends_with(':') || trimmed.ends_with("=>") {
+            return text[..end].trim_end();
+        }
+    }
+    text.lines().next().unwrap_or_default()
+}
+
 // Removed duplicate estimate_tokens function - using the one from cc-embed via TokenEstimator
 
 #[cfg(test)]
@@ -2174,6 +2341,80 @@ public class Calculator
         }
     }
 
+    #[test]
+    fn long_functions_split_into_an_outline_and_sections() {
+        let body: String = (1..=40)
+            .map(|i| {
+                format!(
+                    "    let value_{} = compute_something_expensive({}, {});\n",
+                    i,
+                    i,
+                    i * 2
+                )
+            })
+            .collect();
+        let text = format!(
+            "fn process_everything(input: &str) -> u32 {{\n{}    0\n}}\n",
+            body
+        );
+        let mut metadata = ChunkMetadata::from_text(&text);
+        metadata.name = Some("process_everything".to_string());
+        let chunk = Chunk {
+            span: Span {
+                byte_start: 10,
+                byte_end: 10 + text.len(),
+                line_start: 3,
+                line_end: 3 + text.lines().count() - 1,
+            },
+            text: text.clone(),
+            chunk_type: ChunkType::Function,
+            stride_info: None,
+            metadata,
+        };
+        let config = ChunkConfig {
+            max_tokens: 100,
+            stride_overlap: 10,
+            ..Default::default()
+        };
+
+        let chunks = apply_striding(vec![chunk.clone()], &config).unwrap();
+        assert!(chunks.len() > 2);
+        let outline = &chunks[0];
+        assert_eq!(outline.span, chunk.span);
+        assert!(outline.stride_info.is_none());
+        assert!(
+            outline
+                .text
+                .starts_with("fn process_everything(input: &str) -> u32 {")
+        );
+        assert!(outline.text.contains("…"));
+
+        let sections = &chunks[1..];
+        assert_eq!(sections[0].span.byte_start, chunk.span.byte_start);
+        assert_eq!(sections.last().unwrap().span.byte_end, chunk.span.byte_end);
+        for pair in sections.windows(2) {
+            // Sections meet on line boundaries, without overlap
+            assert_eq!(pair[0].span.byte_end, pair[1].span.byte_start);
+            assert_eq!(pair[0].span.line_end + 1, pair[1].span.line_start);
+        }
+        for section in sections {
+            let start = section.span.byte_start - chunk.span.byte_start;
+            let end = section.span.byte_end - chunk.span.byte_start;
+            assert_eq!(section.text, text[start..end]);
+            assert!(section.text.ends_with('\n'));
+        }
+        assert!(
+            chunks
+                .iter()
+                .all(|c| c.metadata.parent.as_ref() == Some(&chunk.span))
+        );
+        assert!(
+            chunks
+                .iter()
+                .all(|c| c.metadata.name.as_deref() == Some("process_everything"))
+        );
+    }
+
     #[test]
     fn test_gap_filling_coverage() {
         // Test that all non-whitespace content gets chunked
@@ -169,11 +169,13 @@ mod tests {
             method_chunk.metadata.ancestry,
             vec!["sample".to_string(), "Thing".to_string()]
         );
+        assert_eq!(method_chunk.metadata.name.as_deref(), Some("new"));
         let util_chunk = chunks
             .iter()
             .find(|chunk| chunk.chunk_type == ChunkType::Function && chunk.text.contains("fn util"))
             .expect("util chunk present");
         assert!(util_chunk.metadata.ancestry.is_empty());
+        assert_eq!(util_chunk.metadata.name.as_deref(), Some("util"));
     }
 
     #[test]
@@ -298,6 +300,7 @@ const compute = (x: number) => x * 2;
             .expect("arrow chunk present");
         assert!(arrow_chunk.text.contains("return 42"));
         assert!(arrow_chunk.metadata.ancestry.is_empty());
+        assert_eq!(arrow_chunk.metadata.name.as_deref(), Some("util"));
 
         let method_chunk = chunks
             .iter()
@@ -306,6 +309,7 @@ const compute = (x: number) => x * 2;
             })
             .expect("method chunk");
         assert_eq!(method_chunk.metadata.ancestry, vec!["Example".to_string()]);
+        assert_eq!(method_chunk.metadata.name.as_deref(), Some("run"));
         assert!(
             method_chunk
                 .metadata
@@ -0,0 +1,105 @@
+//! `--queries-file`: many queries in one run. Agents often fan a question out
+//! into a dozen related searches; batched, the index is updated and loaded
+//! once, the queries are embedded in one provider call, and semantic queries
+//! share one pass over the chunks (see [`cs_engine::search_batch`]).
+
+use anyhow::{Context, Result};
+use console::style;
+use cs_core::{SearchOptions, SearchResults};
+use std::io::Read;
+use std::path::Path;
+
+/// Queries in `path`, or stdin for `-`: one per line, blank lines skipped.
+pub fn read_queries(path: &Path) -> Result<Vec<String>> {
+    let text = if path == Path::new("-") {
+        let mut text = String::new();
+        std::io::stdin().read_to_string(&mut text)?;
+        text
+    } else {
+        std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read queries from {}", path.display()))?
+    };
+    let queries: Vec<String> = parse_queries(&text);
+    if queries.is_empty() {
+        anyhow::bail!("No queries in {}", path.display());
+    }
+    Ok(queries)
+}
+
+fn parse_queries(text: &str) -> Vec<String> {
+    text.lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty())
+        .map(str::to_string)
+        .collect()
+}
+
+/// Print the results of each query in order, returning whether any matched.
+/// JSON output is one line per query: `{"query": …, "results": [...]}`, each
+/// result with its anchor (see [`cs_engine::anchors`]).
+pub fn print(queries: &[String], batch: &[SearchResults], options: &SearchOptions) -> Result<bool> {
+    let index_root =
+        cs_engine::find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+    let mut anchors = cs_engine::anchors::AnchorLookup::new(&index_root);
+    let mut had_matches = false;
+    for (query, results) in queries.iter().zip(batch) {
+        had_matches |= !results.matches.is_empty();
+        if options.json_output || options.jsonl_output {
+            let results = results
+                .matches
+                .iter()
+                .map(|result| {
+                    let mut value = serde_json::to_value(
+                        cs_core::JsonlSearchResult::from_search_result(result, !options.no_snippet),
+                    )?;
+                    if let Some(anchor) = anchors.anchor_for(result) {
+                        value["anchor"] = serde_json::Value::String(anchor.to_string());
+                    }
+                    Ok(value)
+                })
+                .collect::<Result<Vec<_>>>()?;
+            println!(
+                "{}",
+                serde_json::json!({ "query": query, "results": results })
+            );
+            continue;
+        }
+
+        println!(
+            "{} {} {}",
+            style("==>").dim(),
+            style(query).bold(),
+            style(format!("({} results)", results.matches.len())).dim()
+        );
+        for result in &results.matches {
+            let score = if options.show_scores {
+                format!("[{:.3}] ", result.score)
+            } else {
+                String::new()
+            };
+            println!(
+                "{}{}:{}: {}",
+                score,
+                style(result.file.display()).cyan().bold(),
+                style(result.span.line_start).yellow(),
+                result.preview.lines().next().unwrap_or_default().trim()
+            );
+        }
+        println!();
+    }
+    Ok(had_matches)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn queries_are_trimmed_lines() {
+        assert_eq!(
+            parse_queries("token refresh\n\n  retry policy  \r\nrate limiter"),
+            ["token refresh", "retry policy", "rate limiter"]
+        );
+        assert!(parse_queries("\n  \n").is_empty());
+    }
+}
@@ -0,0 +1,457 @@
+//! `cs --doctor`: checks what searching depends on, from the embedding model
+//! to disk space, and says how to fix whatever is wrong.
+
+use serde::Serialize;
+use std::path::Path;
+use std::time::Duration;
+use walkdir::WalkDir;
+
+/// How long a provider gets to accept a connection.
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(3);
+
+/// Free space below which indexing may run out of room.
+const MIN_FREE_BYTES: u64 = 1024 * 1024 * 1024;
+
+const JINA_API_HOST: &str = "api.jina.ai:443";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CheckStatus {
+    Ok,
+    Warn,
+    Fail,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct Check {
+    pub name: &'static str,
+    pub status: CheckStatus,
+    pub detail: String,
+    /// What to run or change, when the check didn't pass
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub fix: Option<String>,
+}
+
+impl Check {
+    fn ok(name: &'static str, detail: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: CheckStatus::Ok,
+            detail: detail.into(),
+            fix: None,
+        }
+    }
+
+    fn warn(name: &'static str, detail: impl Into<String>, fix: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: CheckStatus::Warn,
+            detail: detail.into(),
+            fix: Some(fix.into()),
+        }
+    }
+
+    fn fail(name: &'static str, detail: impl Into<String>, fix: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: CheckStatus::Fail,
+            detail: detail.into(),
+            fix: Some(fix.into()),
+        }
+    }
+}
+
+/// Run every check for searching `path`, in the order they're reported.
+pub async fn run_checks(
+    path: &Path,
+    cli_model: Option<&str>,
+    llm: &cs_core::LlmConfig,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+) -> Vec<Check> {
+    let index_root = cs_engine::find_nearest_index_root(path);
+    let root = index_root.clone().unwrap_or_else(|| path.to_path_buf());
+
+    let mut checks = Vec::new();
+    let provider = check_model(path, cli_model, &mut checks);
+    checks.push(Check::ok(
+        "simd",
+        format!("Scoring vectors with the {} kernel", cs_ann::simd::kernel()),
+    ));
+    let proxy = cs_core::network::describe_proxy();
+    if let Some(check) = check_network(proxy.as_deref()).await {
+        checks.push(check);
+    }
+    // Behind a proxy the API is only reachable through it
+    if provider.as_deref() == Some("jina-api") && proxy.is_none() {
+        checks.push(check_reachable("jina_api", JINA_API_HOST).await);
+    }
+    if llm.model.is_some() {
+        let url = llm
+            .url
+            .as_deref()
+            .unwrap_or(cs_engine::answer::DEFAULT_LLM_URL);
+        checks.push(match host_port(url) {
+            Some(address) => check_reachable("llm", &address).await,
+            None => Check::fail(
+                "llm",
+                format!("Can't parse the [llm] url {}", url),
+                "Set url under [llm] in config.toml to e.g. http://localhost:11434/v1/chat/completions",
+            ),
+        });
+    }
+    match index_root {
+        Some(ref index_root) => {
+            checks.extend(check_index(index_root, respect_gitignore, exclude_patterns))
+        }
+        None => checks.push(Check::warn(
+            "index",
+            format!("No index at {}", path.display()),
+            format!("cs --index {}", path.display()),
+        )),
+    }
+    // The index may live on another filesystem than the sources
+    let index_dir = cs_core::locations::index_dir(&root);
+    checks.push(check_disk_space(if index_dir.exists() {
+        &index_dir
+    } else {
+        &root
+    }));
+    if let Some(check) = check_watch_limit(&root) {
+        checks.push(check);
+    }
+    checks
+}
+
+/// Check the model searches would use, returning its provider.
+fn check_model(path: &Path, cli_model: Option<&str>, checks: &mut Vec<Check>) -> Option<String> {
+    let model = match cs_engine::resolve_model_for_path(path, cli_model) {
+        Ok(model) => model,
+        Err(e) => {
+            checks.push(Check::fail(
+                "model",
+                e.to_string(),
+                "cs --switch-model <name> --force (see --help for the available models)",
+            ));
+            return None;
+        }
+    };
+    let registry = cs_models::ModelRegistry::default();
+    let provider = registry
+        .models
+        .values()
+        .find(|config| config.name == model.canonical_name)
+        .map(|config| config.provider.clone())
+        .unwrap_or_else(|| "fastembed".to_string());
+
+    checks.push(if provider == "jina-api" {
+        if std::env::var("JINA_API_KEY").is_ok_and(|key| !key.is_empty()) {
+            Check::ok(
+                "model",
+                format!("{} (Jina API, key set)", model.canonical_name),
+            )
+        } else {
+            Check::fail(
+                "model",
+                format!(
+                    "{} needs JINA_API_KEY, which isn't set",
+                    model.canonical_name
+                ),
+                "export JINA_API_KEY=... (get a key at https://jina.ai/?sui=apikey)",
+            )
+        }
+    } else if cs_embed::is_model_cached(&model.canonical_name) {
+        Check::ok(
+            "model",
+            format!(
+                "{} ({} dims) cached in {}",
+                model.canonical_name,
+                model.dimensions,
+                cs_embed::model_cache_dir().display()
+            ),
+        )
+    } else {
+        Check::warn(
+            "model",
+            format!(
+                "{} isn't downloaded yet, so the first semantic search needs network access",
+                model.canonical_name
+            ),
+            format!(
+                "Run cs --index {} once while online to download it",
+                path.display()
+            ),
+        )
+    });
+    Some(provider)
+}
+
+/// Check the proxy and CA certificates remote providers are reached with,
+/// when either is set.
+async fn check_network(proxy: Option<&str>) -> Option<Check> {
+    let ca_cert = cs_core::network::network_config().ca_cert;
+    if let Some(path) = &ca_cert
+        && let Err(e) = cs_core::network::load_ca_certificates(path)
+    {
+        return Some(Check::fail(
+            "network",
+            format!("{:#}", e),
+            "Point --ca-cert (or CS_CA_CERT, or ca_cert under [network] in config.toml) at a PEM file of CA certificates",
+        ));
+    }
+    if let Some(proxy) = proxy {
+        let address = cs_core::network::env_proxy()
+            .map(|(_, url)| url)
+            .or_else(|| cs_core::network::network_config().proxy)
+            .and_then(|url| host_port(&url));
+        let Some(address) = address else {
+            return Some(Check::fail(
+                "network",
+                format!("Can't parse the proxy {}", proxy),
+                "Set HTTPS_PROXY (or proxy under [network] in config.toml) to e.g. http://proxy.example.com:3128",
+            ));
+        };
+        let check = check_reachable("network", &address).await;
+        if check.status != CheckStatus::Ok {
+            return Some(check);
+        }
+    }
+    let mut detail = Vec::new();
+    if let Some(proxy) = proxy {
+        detail.push(format!("Remote providers are reached through {}", proxy));
+    }
+    if let Some(path) = &ca_cert {
+        detail.push(format!(
+            "Trusting the CA certificates in {}",
+            path.display()
+        ));
+    }
+    (!detail.is_empty()).then(|| Check::ok("network", detail.join("; ")))
+}
+
+async fn check_reachable(name: &'static str, address: &str) -> Check {
+    match tokio::time::timeout(CONNECT_TIMEOUT, tokio::net::TcpStream::connect(address)).await {
+        Ok(Ok(_)) => Check::ok(name, format!("{} is reachable", address)),
+        Ok(Err(e)) => Check::fail(
+            name,
+            format!("Can't connect to {}: {}", address, e),
+            "Check the network, proxy and firewall settings, or that the server is running",
+        ),
+        Err(_) => Check::fail(
+            name,
+            format!(
+                "{} didn't answer within {}s",
+                address,
+                CONNECT_TIMEOUT.as_secs()
+            ),
+            "Check the network, proxy and firewall settings, or that the server is running",
+        ),
+    }
+}
+
+/// `host:port` of an http(s) URL.
+fn host_port(url: &str) -> Option<String> {
+    let (default_port, rest) = if let Some(rest) = url.strip_prefix("https://") {
+        (443, rest)
+    } else if let Some(rest) = url.strip_prefix("http://") {
+        (80, rest)
+    } else {
+        return None;
+    };
+    let authority = rest.split(['/', '?', '#']).next()?;
+    let authority = authority.rsplit('@').next()?;
+    if authority.is_empty() {
+        return None;
+    }
+    let has_port = match authority.rfind(':') {
+        Some(colon) => !authority[colon..].contains(']'),
+        None => false,
+    };
+    Some(if has_port {
+        authority.to_string()
+    } else {
+        format!("{}:{}", authority, default_port)
+    })
+}
+
+fn check_index(
+    index_root: &Path,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+) -> Vec<Check> {
+    let consistency = match cs_index::check_index_consistency(index_root) {
+        Ok(consistency) => consistency,
+        Err(e) => {
+            return vec![Check::fail(
+                "index",
+                format!("Can't read the index at {}: {}", index_root.display(), e),
+                format!("cs --clean {0} && cs --index {0}", index_root.display()),
+            )];
+        }
+    };
+
+    let mut checks = Vec::new();
+    let mut problems = Vec::new();
+    if consistency.broken_entries > 0 {
+        problems.push(format!(
+            "{} entries with missing or unreadable chunks",
+            consistency.broken_entries
+        ));
+    }
+    if consistency.orphaned_sidecars > 0 {
+        problems.push(format!(
+            "{} chunk files not in the manifest",
+            consistency.orphaned_sidecars
+        ));
+    }
+    if consistency.missing_files > 0 {
+        problems.push(format!(
+            "{} entries for deleted files",
+            consistency.missing_files
+        ));
+    }
+    if consistency.damaged_segments > 0 {
+        problems.push(format!(
+            "{} unreadable segments",
+            consistency.damaged_segments
+        ));
+    }
+    checks.push(if problems.is_empty() {
+        Check::ok(
+            "index",
+            format!(
+                "{} files indexed at {}",
+                consistency.manifest_entries,
+                index_root.display()
+            ),
+        )
+    } else {
+        Check::warn(
+            "index",
+            format!("Manifest and index disagree: {}", problems.join(", ")),
+            format!(
+                "cs --clean-orphans {0}, then cs --index {0}",
+                index_root.display()
+            ),
+        )
+    });
+
+    match cs_index::find_dirty_files(index_root, respect_gitignore, exclude_patterns) {
+        Ok(dirty) if dirty.is_empty() => {
+            checks.push(Check::ok("freshness", "Index is up to date"));
+        }
+        Ok(dirty) => checks.push(Check::warn(
+            "freshness",
+            format!("{} files changed since they were indexed", dirty.len()),
+            format!("cs --index {}", index_root.display()),
+        )),
+        Err(e) => tracing::debug!("Skipping the freshness check: {}", e),
+    }
+    checks
+}
+
+fn check_disk_space(path: &Path) -> Check {
+    let Some(available) = available_bytes(path) else {
+        return Check::ok("disk", "Free space unknown on this platform");
+    };
+    let detail = format!(
+        "{:.1} GB free at {}",
+        available as f64 / (1024.0 * 1024.0 * 1024.0),
+        path.display()
+    );
+    if available < MIN_FREE_BYTES {
+        Check::warn(
+            "disk",
+            detail,
+            "Free up space; indexing needs room for chunks, vectors and a temporary copy of the manifest",
+        )
+    } else {
+        Check::ok("disk", detail)
+    }
+}
+
+#[cfg(unix)]
+fn available_bytes(path: &Path) -> Option<u64> {
+    // POSIX output: Filesystem 1024-blocks Used Available Capacity Mounted
+    let output = std::process::Command::new("df")
+        .arg("-Pk")
+        .arg(path)
+        .output()
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let kilobytes: u64 = stdout
+        .lines()
+        .nth(1)?
+        .split_whitespace()
+        .nth(3)?
+        .parse()
+        .ok()?;
+    Some(kilobytes * 1024)
+}
+
+#[cfg(not(unix))]
+fn available_bytes(_path: &Path) -> Option<u64> {
+    None
+}
+
+/// Compare inotify's per-user watch limit with the directories under `root`,
+/// which editors and file watchers each need a watch for. Linux only.
+fn check_watch_limit(root: &Path) -> Option<Check> {
+    let limit: usize = std::fs::read_to_string("/proc/sys/fs/inotify/max_user_watches")
+        .ok()?
+        .trim()
+        .parse()
+        .ok()?;
+    let directories = WalkDir::new(root)
+        .into_iter()
+        .filter_entry(|entry| {
+            !matches!(
+                entry.file_name().to_str(),
+                Some(".git" | ".cs" | "node_modules" | "target")
+            )
+        })
+        .flatten()
+        .filter(|entry| entry.file_type().is_dir())
+        .count();
+
+    let detail = format!(
+        "inotify allows {} watches; {} has {} directories",
+        limit,
+        root.display(),
+        directories
+    );
+    Some(if directories > limit / 2 {
+        Check::warn(
+            "watch_limit",
+            detail,
+            "sudo sysctl fs.inotify.max_user_watches=524288 (add it to /etc/sysctl.conf to keep it)",
+        )
+    } else {
+        Check::ok("watch_limit", detail)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn host_ports_default_by_scheme() {
+        assert_eq!(
+            host_port(cs_engine::answer::DEFAULT_LLM_URL).as_deref(),
+            Some("localhost:11434")
+        );
+        assert_eq!(
+            host_port("https://api.openai.com/v1/chat/completions").as_deref(),
+            Some("api.openai.com:443")
+        );
+        assert_eq!(
+            host_port("http://user:pw@[::1]/v1").as_deref(),
+            Some("[::1]:80")
+        );
+        assert_eq!(host_port("localhost:11434"), None);
+    }
+}
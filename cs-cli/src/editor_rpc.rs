@@ -0,0 +1,1201 @@
+//! JSON-RPC 2.0 interface for editor extensions, served by `cs --editor-rpc`
+//! over stdio or by `cs --editor-socket PATH` on a Unix socket.
+//!
+//! Messages are framed as in the Language Server Protocol base protocol: a
+//! `Content-Length` header, a blank line, then the JSON body. That lets
+//! `vscode-jsonrpc` or a JetBrains LSP client talk to it unchanged.
+//!
+//! A `live` search is meant to be sent on every keystroke of a picker: it runs
+//! in the background after a short debounce, and the next live search cancels
+//! it, so only the latest query's results arrive.
+//!
+//! The MCP server is shaped for agents. This is a fixed contract for editor
+//! plugins: search, jump to a result, index status and watch notifications.
+//! [`PROTOCOL_VERSION`] is bumped only when a method or field is removed or
+//! changes meaning; new optional fields may appear at any time. The contract
+//! is documented in `docs/reference/editor-rpc.md`.
+
+use anyhow::{Result, bail};
+use cs_core::{SearchMode, SearchOptions, SearchResult, TenantConfig};
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use serde_json::{Value, json};
+use std::path::{Component, Path, PathBuf};
+use std::time::{Duration, Instant};
+use tokio::io::{AsyncBufReadExt, AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, BufReader};
+use tokio::sync::mpsc::{UnboundedSender, unbounded_channel};
+use tokio::task::JoinHandle;
+use tokio_util::sync::CancellationToken;
+
+use crate::watch_events::{self, Batch, Coalescer};
+
+pub const PROTOCOL_VERSION: u32 = 1;
+
+pub const METHODS: &[&str] = &[
+    "initialize",
+    "search",
+    "open_at_result",
+    "index_status",
+    "watch",
+    "unwatch",
+    "shutdown",
+];
+
+pub const NOTIFICATIONS: &[&str] = &["index_changed", "files_changed"];
+
+const PARSE_ERROR: i64 = -32700;
+const INVALID_REQUEST: i64 = -32600;
+const METHOD_NOT_FOUND: i64 = -32601;
+const INVALID_PARAMS: i64 = -32602;
+const INTERNAL_ERROR: i64 = -32603;
+/// LSP's code for a request the client or a newer request cancelled
+const REQUEST_CANCELLED: i64 = -32800;
+/// A search refused by the server's `[limits]`
+const RATE_LIMITED: i64 = -32001;
+/// A client of a multi-tenant daemon without a tenant's key
+const UNKNOWN_TENANT: i64 = -32002;
+
+const DEFAULT_WATCH_INTERVAL_MS: u64 = 2000;
+const MIN_WATCH_INTERVAL_MS: u64 = 250;
+
+/// File system events closer together than this are checked together.
+const DEFAULT_SETTLE_MS: u64 = 300;
+
+/// Keystrokes closer together than this only search for the last one.
+const DEFAULT_DEBOUNCE_MS: u64 = 50;
+
+/// Largest message body accepted.
+const MAX_MESSAGE_BYTES: usize = 16 * 1024 * 1024;
+
+#[derive(Debug)]
+struct RpcError {
+    code: i64,
+    message: String,
+}
+
+impl RpcError {
+    fn invalid_params(message: impl std::fmt::Display) -> Self {
+        Self {
+            code: INVALID_PARAMS,
+            message: message.to_string(),
+        }
+    }
+
+    fn internal(message: impl std::fmt::Display) -> Self {
+        Self {
+            code: INTERNAL_ERROR,
+            message: message.to_string(),
+        }
+    }
+}
+
+/// Count a search by the client holding `api_key` against the server's limits.
+fn admit(api_key: Option<&str>) -> std::result::Result<(), RpcError> {
+    crate::quota::admit(api_key).map_err(|denied| RpcError {
+        code: RATE_LIMITED,
+        message: denied.message,
+    })
+}
+
+type RpcResult = std::result::Result<Value, RpcError>;
+
+/// Run a search the client holding `api_key` is admitted to, recording it in
+/// the daemon's usage log.
+async fn admitted_search(
+    root: PathBuf,
+    params: SearchParams,
+    tenant: Option<TenantConfig>,
+    api_key: Option<&str>,
+    connection: &str,
+) -> RpcResult {
+    let started = Instant::now();
+    let query = params.query.clone();
+    let tenant_name = tenant.as_ref().map(|tenant| tenant.name.clone());
+    let outcome = match admit(api_key) {
+        Ok(()) => search(root, params, tenant).await,
+        Err(e) => Err(e),
+    };
+    crate::usage::record(crate::usage::Request {
+        surface: "editor",
+        operation: "search",
+        api_key,
+        connection: Some(connection),
+        tenant: tenant_name.as_deref(),
+        query: Some(&query),
+        started,
+        results: outcome
+            .as_ref()
+            .ok()
+            .and_then(|reply| reply["results"].as_array())
+            .map(Vec::len),
+        outcome: match &outcome {
+            Ok(_) => crate::usage::Outcome::Ok,
+            Err(e) if e.code == RATE_LIMITED => crate::usage::Outcome::RateLimited,
+            Err(_) => crate::usage::Outcome::Error,
+        },
+    });
+    outcome
+}
+
+fn parse_params<T: DeserializeOwned>(params: Value) -> std::result::Result<T, RpcError> {
+    // Omitted params are the same as an empty object
+    let params = if params.is_null() { json!({}) } else { params };
+    serde_json::from_value(params)
+        .map_err(|e| RpcError::invalid_params(format!("Invalid params: {}", e)))
+}
+
+#[derive(Deserialize)]
+struct InitializeParams {
+    root: Option<PathBuf>,
+    /// Identifies the client to the server's `[limits]` and `[[tenant]]`s
+    api_key: Option<String>,
+}
+
+#[derive(Deserialize)]
+struct SearchParams {
+    query: String,
+    /// `semantic` (default), `lexical`, `hybrid` or `regex`
+    mode: Option<String>,
+    path: Option<PathBuf>,
+    top_k: Option<usize>,
+    threshold: Option<f32>,
+    #[serde(default)]
+    case_insensitive: bool,
+    /// How much of each result `preview` holds; the `[snippets]` editor
+    /// policy when unset
+    snippet: Option<cs_core::SnippetPolicy>,
+    /// The file open in the editor: results near it rank higher
+    focus: Option<PathBuf>,
+    /// Run in the background, superseded by the next live search
+    #[serde(default)]
+    live: bool,
+    debounce_ms: Option<u64>,
+}
+
+#[derive(Deserialize)]
+struct CancelParams {
+    id: Value,
+}
+
+#[derive(Deserialize)]
+struct OpenAtResultParams {
+    /// A result `id` from `search`, i.e. `path:line` relative to the index root
+    id: Option<String>,
+    path: Option<PathBuf>,
+    line: Option<usize>,
+    end_line: Option<usize>,
+}
+
+#[derive(Deserialize)]
+struct PathParams {
+    path: Option<PathBuf>,
+}
+
+#[derive(Deserialize)]
+struct WatchParams {
+    path: Option<PathBuf>,
+    interval_ms: Option<u64>,
+    settle_ms: Option<u64>,
+}
+
+#[derive(Serialize)]
+struct EditorResult {
+    id: String,
+    path: String,
+    relative_path: String,
+    line_start: usize,
+    line_end: usize,
+    byte_start: usize,
+    byte_end: usize,
+    score: f32,
+    preview: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    language: Option<String>,
+}
+
+struct EditorServer {
+    root: PathBuf,
+    outgoing: UnboundedSender<Value>,
+    watcher: Option<JoinHandle<()>>,
+    /// The request id and cancellation of the live search in flight
+    live_search: Option<(Value, CancellationToken)>,
+    /// The key the client initialized with
+    api_key: Option<String>,
+    /// The tenant the key belongs to, when the daemon serves tenants
+    tenant: Option<TenantConfig>,
+    /// Who the client is in the usage log when it has no key
+    connection: String,
+}
+
+/// Serve editor requests on stdin/stdout for the workspace at `root`.
+pub async fn serve_stdio(root: PathBuf) -> Result<()> {
+    serve(root, tokio::io::stdin(), tokio::io::stdout()).await
+}
+
+/// Serve editor requests for the workspace at `root` to every client that
+/// connects to the Unix socket at `socket_path`, each in its own session.
+#[cfg(unix)]
+pub async fn serve_unix(root: PathBuf, socket_path: &Path) -> Result<()> {
+    use std::os::unix::fs::{DirBuilderExt, FileTypeExt, PermissionsExt};
+
+    // A socket left behind by a server that didn't exit cleanly
+    if let Ok(metadata) = std::fs::symlink_metadata(socket_path) {
+        if !metadata.file_type().is_socket() {
+            bail!("{} exists and isn't a socket", socket_path.display());
+        }
+        if std::os::unix::net::UnixStream::connect(socket_path).is_ok() {
+            bail!("A server is already listening on {}", socket_path.display());
+        }
+        std::fs::remove_file(socket_path)?;
+    }
+    // Only this user may search the workspace, unless tenants' keys decide
+    // who may search what
+    let mode = if crate::tenants::current().is_some() {
+        0o666
+    } else {
+        0o600
+    };
+    // Bound in a directory only this user can enter, and moved into place
+    // once it has its permissions, so nobody connects in between
+    let parent = socket_path
+        .parent()
+        .filter(|parent| !parent.as_os_str().is_empty())
+        .unwrap_or(Path::new("."));
+    let name = socket_path
+        .file_name()
+        .ok_or_else(|| anyhow::anyhow!("{} isn't a socket path", socket_path.display()))?;
+    let staging = parent.join(format!(
+        ".{}.{}",
+        name.to_string_lossy(),
+        std::process::id()
+    ));
+    std::fs::DirBuilder::new()
+        .mode(0o700)
+        .create(&staging)
+        .map_err(|e| anyhow::anyhow!("Failed to create {}: {}", staging.display(), e))?;
+    let staged = staging.join(name);
+    let bound = tokio::net::UnixListener::bind(&staged)
+        .map_err(anyhow::Error::from)
+        .and_then(|listener| {
+            std::fs::set_permissions(&staged, std::fs::Permissions::from_mode(mode))?;
+            std::fs::rename(&staged, socket_path)?;
+            Ok(listener)
+        });
+    let _ = std::fs::remove_file(&staged);
+    let _ = std::fs::remove_dir(&staging);
+    let listener = bound?;
+    tracing::info!("Editor JSON-RPC listening on {}", socket_path.display());
+
+    loop {
+        let (stream, _) = listener.accept().await?;
+        let root = root.clone();
+        tokio::spawn(async move {
+            let (reader, writer) = stream.into_split();
+            if let Err(e) = serve(root, reader, writer).await {
+                tracing::warn!("Editor session ended: {}", e);
+            }
+        });
+    }
+}
+
+/// Serve editor requests read from `reader`, replying on `writer`, until
+/// `shutdown` or the end of input.
+pub async fn serve<R, W>(root: PathBuf, reader: R, writer: W) -> Result<()>
+where
+    R: AsyncRead + Unpin,
+    W: AsyncWrite + Unpin + Send + 'static,
+{
+    // Replies and watch notifications share one writer
+    let (outgoing, mut queue) = unbounded_channel::<Value>();
+    let writer_task = tokio::spawn(async move {
+        let mut writer = writer;
+        while let Some(message) = queue.recv().await {
+            if write_message(&mut writer, &message).await.is_err() {
+                break;
+            }
+        }
+    });
+
+    let mut server = EditorServer {
+        root: cs_core::paths::canonicalize_lossy(&root),
+        outgoing: outgoing.clone(),
+        watcher: None,
+        live_search: None,
+        api_key: None,
+        tenant: None,
+        connection: uuid::Uuid::new_v4().to_string(),
+    };
+    let mut reader = BufReader::new(reader);
+    while let Some(body) = read_message(&mut reader).await? {
+        let message: Value = match serde_json::from_slice(&body) {
+            Ok(message) => message,
+            Err(e) => {
+                let _ = outgoing.send(error_reply(Value::Null, PARSE_ERROR, &e.to_string()));
+                continue;
+            }
+        };
+        let id = message.get("id").cloned();
+        let Some(method) = message.get("method").and_then(Value::as_str) else {
+            if let Some(id) = id {
+                let _ = outgoing.send(error_reply(id, INVALID_REQUEST, "Missing method"));
+            }
+            continue;
+        };
+        let params = message.get("params").cloned().unwrap_or(Value::Null);
+        if method == "$/cancelRequest" {
+            if let Ok(params) = parse_params::<CancelParams>(params) {
+                server.cancel_live_search(Some(&params.id));
+            }
+            continue;
+        }
+        // Live searches reply from their own task
+        if method == "search"
+            && let Some(id) = &id
+            && params.get("live").and_then(Value::as_bool) == Some(true)
+        {
+            match server.check_tenant().and_then(|()| parse_params(params)) {
+                Ok(params) => server.start_live_search(id.clone(), params),
+                Err(e) => {
+                    let _ = outgoing.send(error_reply(id.clone(), e.code, &e.message));
+                }
+            }
+            continue;
+        }
+        let outcome = server.handle(method, params).await;
+
+        // Notifications from the client get no reply
+        if let Some(id) = id {
+            let _ = outgoing.send(reply(id, outcome));
+        }
+        if method == "shutdown" {
+            break;
+        }
+    }
+
+    server.stop_watching();
+    server.cancel_live_search(None);
+    drop(server);
+    drop(outgoing);
+    let _ = writer_task.await;
+    Ok(())
+}
+
+fn reply(id: Value, outcome: RpcResult) -> Value {
+    match outcome {
+        Ok(result) => json!({ "jsonrpc": "2.0", "id": id, "result": result }),
+        Err(e) => error_reply(id, e.code, &e.message),
+    }
+}
+
+fn error_reply(id: Value, code: i64, message: &str) -> Value {
+    json!({
+        "jsonrpc": "2.0",
+        "id": id,
+        "error": { "code": code, "message": message },
+    })
+}
+
+/// The next message body, or `None` at the end of input.
+async fn read_message<R: AsyncRead + Unpin>(reader: &mut BufReader<R>) -> Result<Option<Vec<u8>>> {
+    let mut content_length = None;
+    let mut line = String::new();
+    loop {
+        line.clear();
+        if reader.read_line(&mut line).await? == 0 {
+            if content_length.is_none() {
+                return Ok(None);
+            }
+            bail!("Input ended inside a message header");
+        }
+        let header = line.trim_end();
+        if header.is_empty() {
+            if content_length.is_some() {
+                break;
+            }
+            // Tolerate blank lines between messages
+            continue;
+        }
+        if let Some((name, value)) = header.split_once(':')
+            && name.trim().eq_ignore_ascii_case("content-length")
+        {
+            content_length = Some(value.trim().parse::<usize>()?);
+        }
+    }
+
+    let length = content_length.unwrap_or_default();
+    if length > MAX_MESSAGE_BYTES {
+        bail!(
+            "Message of {} bytes exceeds the {} byte limit",
+            length,
+            MAX_MESSAGE_BYTES
+        );
+    }
+    let mut body = vec![0; length];
+    reader.read_exact(&mut body).await?;
+    Ok(Some(body))
+}
+
+async fn write_message<W: AsyncWrite + Unpin>(writer: &mut W, message: &Value) -> Result<()> {
+    let body = serde_json::to_vec(message)?;
+    writer
+        .write_all(format!("Content-Length: {}\r\n\r\n", body.len()).as_bytes())
+        .await?;
+    writer.write_all(&body).await?;
+    writer.flush().await?;
+    Ok(())
+}
+
+impl EditorServer {
+    async fn handle(&mut self, method: &str, params: Value) -> RpcResult {
+        if !matches!(method, "initialize" | "shutdown") {
+            self.check_tenant()?;
+        }
+        match method {
+            "initialize" => self.initialize(parse_params(params)?),
+            "search" => {
+                let params = parse_params(params)?;
+                admitted_search(
+                    self.root.clone(),
+                    params,
+                    self.tenant.clone(),
+                    self.api_key.as_deref(),
+                    &self.connection,
+                )
+                .await
+            }
+            "open_at_result" => self.open_at_result(parse_params(params)?),
+            "index_status" => self.index_status(parse_params(params)?),
+            "watch" => self.watch(parse_params(params)?),
+            "unwatch" => {
+                self.stop_watching();
+                Ok(json!({ "watching": false }))
+            }
+            "shutdown" => {
+                self.stop_watching();
+                self.cancel_live_search(None);
+                Ok(json!({}))
+            }
+            _ => Err(RpcError {
+                code: METHOD_NOT_FOUND,
+                message: format!("Unknown method '{}'", method),
+            }),
+        }
+    }
+
+    /// A multi-tenant daemon only serves clients that named their tenant.
+    /// It's looked up again for every request, so reloaded tenant settings
+    /// apply to open sessions and a removed key loses its access.
+    fn check_tenant(&mut self) -> std::result::Result<(), RpcError> {
+        let tenants = crate::tenants::current();
+        if self.tenant.is_some() {
+            self.tenant = tenants
+                .as_ref()
+                .and_then(|tenants| tenants.find(self.api_key.as_deref()))
+                .cloned();
+        }
+        if tenants.is_some() && self.tenant.is_none() {
+            return Err(RpcError {
+                code: UNKNOWN_TENANT,
+                message: "Initialize with a tenant's api_key first".to_string(),
+            });
+        }
+        Ok(())
+    }
+
+    fn resolve(&self, path: Option<&Path>) -> std::result::Result<PathBuf, RpcError> {
+        resolve_within(&self.root, self.tenant.as_ref(), path)
+    }
+
+    fn index_root(&self, path: &Path) -> Option<PathBuf> {
+        cs_engine::find_nearest_index_root(path)
+    }
+
+    fn initialize(&mut self, params: InitializeParams) -> RpcResult {
+        if let Some(tenants) = crate::tenants::current() {
+            let tenant = tenants
+                .find(params.api_key.as_deref())
+                .ok_or_else(|| RpcError {
+                    code: UNKNOWN_TENANT,
+                    message: "No tenant of this server has that api_key".to_string(),
+                })?;
+            self.root = tenant.root.clone();
+            self.tenant = Some(tenant.clone());
+        }
+        if let Some(root) = params.root {
+            self.root = cs_core::paths::canonicalize_lossy(&self.resolve(Some(&root))?);
+        }
+        if params.api_key.is_some() {
+            self.api_key = params.api_key;
+        }
+        Ok(json!({
+            "protocol_version": PROTOCOL_VERSION,
+            "server_version": env!("CARGO_PKG_VERSION"),
+            "root": self.root.to_string_lossy(),
+            "methods": METHODS,
+            "notifications": NOTIFICATIONS,
+        }))
+    }
+
+    fn start_live_search(&mut self, id: Value, params: SearchParams) {
+        self.cancel_live_search(None);
+        let token = CancellationToken::new();
+        self.live_search = Some((id.clone(), token.clone()));
+
+        let root = self.root.clone();
+        let api_key = self.api_key.clone();
+        let tenant = self.tenant.clone();
+        let connection = self.connection.clone();
+        let outgoing = self.outgoing.clone();
+        let debounce = Duration::from_millis(params.debounce_ms.unwrap_or(DEFAULT_DEBOUNCE_MS));
+        tokio::spawn(async move {
+            let outcome = tokio::select! {
+                _ = token.cancelled() => Err(RpcError {
+                    code: REQUEST_CANCELLED,
+                    message: "Superseded by a newer search".to_string(),
+                }),
+                outcome = async {
+                    tokio::time::sleep(debounce).await;
+                    // Only keystrokes that get searched count
+                    admitted_search(root, params, tenant, api_key.as_deref(), &connection).await
+                } => outcome,
+            };
+            let _ = outgoing.send(reply(id, outcome));
+        });
+    }
+
+    /// Cancel the live search in flight, if it is `id` or `id` is `None`. The
+    /// cancelled search still gets an error reply.
+    fn cancel_live_search(&mut self, id: Option<&Value>) {
+        if let Some((live_id, _)) = &self.live_search
+            && id.is_some_and(|id| id != live_id)
+        {
+            return;
+        }
+        if let Some((_, token)) = self.live_search.take() {
+            token.cancel();
+        }
+    }
+
+    fn open_at_result(&self, params: OpenAtResultParams) -> RpcResult {
+        let (file, line) = match (&params.id, &params.path, params.line) {
+            (Some(id), _, _) => {
+                let (path, line) = id
+                    .rsplit_once(':')
+                    .and_then(|(path, line)| Some((path, line.parse::<usize>().ok()?)))
+                    .ok_or_else(|| {
+                        RpcError::invalid_params(format!("Invalid result id '{}'", id))
+                    })?;
+                let base = self
+                    .index_root(&self.root)
+                    .unwrap_or_else(|| self.root.clone());
+                (
+                    resolve_within(&base, self.tenant.as_ref(), Some(Path::new(path)))?,
+                    line,
+                )
+            }
+            (None, Some(path), Some(line)) => (self.resolve(Some(path))?, line),
+            _ => {
+                return Err(RpcError::invalid_params(
+                    "open_at_result needs an id, or a path and a line",
+                ));
+            }
+        };
+        let end_line = params.end_line.unwrap_or(line).max(line);
+
+        let content = std::fs::read(&file)
+            .map_err(|e| RpcError::invalid_params(format!("{}: {}", file.display(), e)))?;
+        let content = String::from_utf8_lossy(&content);
+        let lines: Vec<&str> = content.lines().collect();
+        if line == 0 || end_line > lines.len().max(1) {
+            return Err(RpcError::invalid_params(format!(
+                "Lines {}-{} are outside {} ({} lines)",
+                line,
+                end_line,
+                file.display(),
+                lines.len()
+            )));
+        }
+
+        // LSP positions: 0-based lines, UTF-16 columns
+        let line_text = |number: usize| lines.get(number - 1).copied().unwrap_or_default();
+        let indent = line_text(line).len() - line_text(line).trim_start().len();
+        let start_character = utf16_len(&line_text(line)[..indent]);
+        let end_character = utf16_len(line_text(end_line));
+        Ok(json!({
+            "uri": file_uri(&file),
+            "path": file.to_string_lossy(),
+            "range": {
+                "start": { "line": line - 1, "character": start_character },
+                "end": { "line": end_line - 1, "character": end_character },
+            },
+        }))
+    }
+
+    fn index_status(&self, params: PathParams) -> RpcResult {
+        let path = self.resolve(params.path.as_deref())?;
+        let Some(index_root) = self.index_root(&path) else {
+            return Ok(json!({ "indexed": false, "root": path.to_string_lossy() }));
+        };
+        let stats = cs_index::get_index_stats(&index_root).map_err(RpcError::internal)?;
+        let (generation, stale_files) = poll_index(&index_root);
+        Ok(json!({
+            "indexed": true,
+            "root": index_root.to_string_lossy(),
+            "generation": generation,
+            "total_files": stats.total_files,
+            "total_chunks": stats.total_chunks,
+            "embedded_chunks": stats.embedded_chunks,
+            "index_size_bytes": stats.index_size_bytes,
+            "index_updated": stats.index_updated,
+            "stale_files": stale_files.len(),
+        }))
+    }
+
+    fn watch(&mut self, params: WatchParams) -> RpcResult {
+        self.stop_watching();
+        let path = self.resolve(params.path.as_deref())?;
+        let index_root = self.index_root(&path).ok_or_else(|| {
+            RpcError::invalid_params(format!(
+                "No index found for {}; run `cs --index` first",
+                path.display()
+            ))
+        })?;
+        let interval_ms = params
+            .interval_ms
+            .unwrap_or(DEFAULT_WATCH_INTERVAL_MS)
+            .max(MIN_WATCH_INTERVAL_MS);
+        let settle_ms = params.settle_ms.unwrap_or(DEFAULT_SETTLE_MS);
+        let (generation, stale_files) = poll_index(&index_root);
+
+        let outgoing = self.outgoing.clone();
+        let root = index_root.clone();
+        let last = (generation.clone(), stale_files);
+        // The index may be kept outside the tree
+        let index_dir = cs_core::locations::index_dir(&index_root);
+        let mut watched = vec![index_root.as_path()];
+        if !index_dir.starts_with(&index_root) {
+            watched.push(&index_dir);
+        }
+        let mode = match watch_events::EventStream::watch(&watched) {
+            Ok(events) => {
+                let settle = Duration::from_millis(settle_ms);
+                self.watcher = Some(tokio::spawn(watch_events_loop(
+                    root, events, settle, last, outgoing,
+                )));
+                "events"
+            }
+            Err(e) => {
+                tracing::warn!(
+                    "Can't watch {} for changes ({}); polling every {}ms instead",
+                    index_root.display(),
+                    e,
+                    interval_ms
+                );
+                let interval = Duration::from_millis(interval_ms);
+                self.watcher = Some(tokio::spawn(poll_loop(root, interval, last, outgoing)));
+                "polling"
+            }
+        };
+
+        Ok(json!({
+            "watching": true,
+            "root": index_root.to_string_lossy(),
+            "generation": generation,
+            "mode": mode,
+            "interval_ms": interval_ms,
+            "settle_ms": settle_ms,
+        }))
+    }
+
+    fn stop_watching(&mut self) {
+        if let Some(watcher) = self.watcher.take() {
+            watcher.abort();
+        }
+    }
+}
+
+fn resolve(root: &Path, path: Option<&Path>) -> PathBuf {
+    match path {
+        Some(path) if path.is_absolute() => path.to_path_buf(),
+        Some(path) => root.join(path),
+        None => root.to_path_buf(),
+    }
+}
+
+/// `path` resolved against `root`, refused when it leads out of `tenant`'s
+/// repository.
+fn resolve_within(
+    root: &Path,
+    tenant: Option<&TenantConfig>,
+    path: Option<&Path>,
+) -> std::result::Result<PathBuf, RpcError> {
+    let resolved = resolve(root, path);
+    let Some(tenant) = tenant else {
+        return Ok(resolved);
+    };
+    // Symlinks and `..` are followed before the check, so neither escapes
+    let canonical = cs_core::paths::canonicalize_lossy(&resolved);
+    if canonical.components().any(|c| c == Component::ParentDir)
+        || !canonical.starts_with(&tenant.root)
+    {
+        return Err(RpcError::invalid_params(format!(
+            "{} is outside tenant '{}'",
+            resolved.display(),
+            tenant.name
+        )));
+    }
+    Ok(canonical)
+}
+
+#[tracing::instrument(name = "editor_search", skip_all, fields(live = params.live))]
+async fn search(root: PathBuf, params: SearchParams, tenant: Option<TenantConfig>) -> RpcResult {
+    let mode = match params.mode.as_deref().unwrap_or("semantic") {
+        "semantic" => SearchMode::Semantic,
+        "lexical" => SearchMode::Lexical,
+        "hybrid" => SearchMode::Hybrid,
+        "regex" => SearchMode::Regex,
+        other => {
+            return Err(RpcError::invalid_params(format!(
+                "Unknown mode '{}': expected semantic, lexical, hybrid or regex",
+                other
+            )));
+        }
+    };
+    let path = resolve_within(&root, tenant.as_ref(), params.path.as_deref())?;
+    // An unsaved buffer has no file to be near yet
+    let focus = params
+        .focus
+        .as_deref()
+        .map(|focus| resolve_within(&root, tenant.as_ref(), Some(focus)))
+        .transpose()?
+        .filter(|focus| focus.is_file());
+    let settings = crate::reload::settings();
+    // The TUI's defaults, unless the tenant has its own: enough results to
+    // browse, semantic ones above the configured threshold
+    let threshold = params
+        .threshold
+        .or(tenant.as_ref().and_then(|tenant| tenant.threshold))
+        .or(match mode {
+            SearchMode::Semantic => Some(settings.threshold),
+            _ => None,
+        });
+    let top_k = params
+        .top_k
+        .or(tenant.as_ref().and_then(|tenant| tenant.top_k))
+        .unwrap_or(50);
+    let tenant_exclude = tenant.map(|tenant| tenant.exclude).unwrap_or_default();
+    let options = SearchOptions {
+        mode,
+        query: params.query,
+        path: path.clone(),
+        top_k: Some(top_k),
+        threshold,
+        case_insensitive: params.case_insensitive,
+        line_numbers: true,
+        show_scores: true,
+        show_filenames: true,
+        exclude_patterns: cs_core::build_exclude_patterns(Some(&root), &tenant_exclude, true, true),
+        boost_rules: settings.boost_rules.clone(),
+        stop_symbol_rules: settings.stop_symbol_rules.clone(),
+        max_typos: settings.max_typos,
+        fusion: settings.fusion.clone(),
+        snippet: params.snippet.or(settings.snippets.editor),
+        focus,
+        ..Default::default()
+    };
+
+    let results = cs_engine::search_enhanced(&options)
+        .await
+        .map_err(RpcError::internal)?;
+    let index_root = cs_engine::find_nearest_index_root(&path).unwrap_or_else(|| root.clone());
+    let to_editor = |result: &SearchResult| editor_result(&root, result, &index_root);
+    Ok(json!({
+        "results": results.matches.iter().map(to_editor).collect::<Vec<_>>(),
+        "closest_below_threshold": results.closest_below_threshold.as_ref().map(to_editor),
+        "warnings": results.warnings,
+    }))
+}
+
+fn editor_result(root: &Path, result: &SearchResult, index_root: &Path) -> EditorResult {
+    let file = resolve(root, Some(&result.file));
+    let relative = file.strip_prefix(index_root).unwrap_or(&file);
+    EditorResult {
+        id: cs_engine::feedback::result_id_for(result, index_root),
+        path: file.to_string_lossy().into_owned(),
+        relative_path: cs_core::paths::to_relative_slash(relative),
+        line_start: result.span.line_start,
+        line_end: result.span.line_end,
+        byte_start: result.span.byte_start,
+        byte_end: result.span.byte_end,
+        score: result.score,
+        preview: result.preview.clone(),
+        language: result.lang.map(|lang| lang.to_string()),
+    }
+}
+
+/// What `watch` reports on: the index generation and the stale files.
+type IndexState = (String, Vec<PathBuf>);
+
+/// The index generation and the files changed since the last index update.
+fn poll_index(index_root: &Path) -> IndexState {
+    let generation = cs_index::index_generation(index_root);
+    let exclude_patterns = cs_core::build_exclude_patterns(Some(index_root), &[], true, true);
+    let mut stale_files =
+        cs_index::find_dirty_files(index_root, true, &exclude_patterns).unwrap_or_default();
+    stale_files.sort();
+    (generation, stale_files)
+}
+
+/// The index generation and the stale files, updated for a batch of
+/// changed paths: those in it are checked again, the rest keep their state.
+fn recheck_index(index_root: &Path, last: &IndexState, batch: Batch) -> IndexState {
+    let changed = match batch {
+        Batch::Rescan => return poll_index(index_root),
+        Batch::Paths(changed) => changed,
+    };
+    let index_dir = cs_core::locations::index_dir(index_root);
+    let changed: Vec<PathBuf> = changed
+        .into_iter()
+        .filter(|path| !path.starts_with(&index_dir))
+        .collect();
+    let generation = cs_index::index_generation(index_root);
+    // An update makes any file clean
+    if generation != last.0 {
+        return poll_index(index_root);
+    }
+    if changed.is_empty() {
+        return (generation, last.1.clone());
+    }
+    let exclude_patterns = cs_core::build_exclude_patterns(Some(index_root), &[], true, true);
+    let mut stale_files: Vec<PathBuf> = last
+        .1
+        .iter()
+        .filter(|file| !changed.iter().any(|path| file.starts_with(path)))
+        .cloned()
+        .collect();
+    match cs_index::find_dirty_among(index_root, &changed, true, &exclude_patterns) {
+        Ok(dirty) => stale_files.extend(dirty),
+        Err(_) => return poll_index(index_root),
+    }
+    stale_files.sort();
+    stale_files.dedup();
+    (generation, stale_files)
+}
+
+/// Check the index after each settled batch of file system events.
+async fn watch_events_loop(
+    root: PathBuf,
+    mut events: watch_events::EventStream,
+    settle: Duration,
+    mut last: IndexState,
+    outgoing: UnboundedSender<Value>,
+) {
+    let mut coalescer = Coalescer::new(settle);
+    loop {
+        let deadline = coalescer.deadline();
+        tokio::select! {
+            event = events.next() => match event {
+                Some(path) => coalescer.push(path, Instant::now()),
+                None => break,
+            },
+            _ = sleep_until(deadline) => {}
+        }
+        if events.lost_events() {
+            coalescer.rescan_all(Instant::now());
+        }
+        let Some(batch) = coalescer.take(Instant::now()) else {
+            continue;
+        };
+        let (check_root, previous) = (root.clone(), last.clone());
+        let Ok(current) =
+            tokio::task::spawn_blocking(move || recheck_index(&check_root, &previous, batch)).await
+        else {
+            break;
+        };
+        send_changes(&outgoing, &root, &last, &current);
+        last = current;
+    }
+}
+
+async fn sleep_until(deadline: Option<Instant>) {
+    match deadline {
+        Some(deadline) => tokio::time::sleep_until(deadline.into()).await,
+        None => std::future::pending().await,
+    }
+}
+
+/// Check the whole index every `interval`, where file system events aren't
+/// available.
+async fn poll_loop(
+    root: PathBuf,
+    interval: Duration,
+    mut last: IndexState,
+    outgoing: UnboundedSender<Value>,
+) {
+    let mut interval = tokio::time::interval(interval);
+    interval.tick().await;
+    loop {
+        interval.tick().await;
+        let poll_root = root.clone();
+        let Ok(current) = tokio::task::spawn_blocking(move || poll_index(&poll_root)).await else {
+            break;
+        };
+        send_changes(&outgoing, &root, &last, &current);
+        last = current;
+    }
+}
+
+/// Notify the client of what differs between `last` and `current`.
+fn send_changes(
+    outgoing: &UnboundedSender<Value>,
+    root: &Path,
+    last: &IndexState,
+    current: &IndexState,
+) {
+    let root_text = root.to_string_lossy();
+    if current.0 != last.0 {
+        let _ = outgoing.send(json!({
+            "jsonrpc": "2.0",
+            "method": "index_changed",
+            "params": { "root": root_text, "generation": current.0 },
+        }));
+    }
+    if current.1 != last.1 {
+        let stale: Vec<String> = current
+            .1
+            .iter()
+            .map(|file| cs_core::paths::to_relative_slash(file.strip_prefix(root).unwrap_or(file)))
+            .collect();
+        let _ = outgoing.send(json!({
+            "jsonrpc": "2.0",
+            "method": "files_changed",
+            "params": { "root": root_text, "stale_files": stale },
+        }));
+    }
+}
+
+fn utf16_len(text: &str) -> usize {
+    text.encode_utf16().count()
+}
+
+fn file_uri(path: &Path) -> String {
+    let path = path.to_string_lossy().replace('\\', "/");
+    let mut uri = String::from("file://");
+    if !path.starts_with('/') {
+        uri.push('/');
+    }
+    for byte in path.bytes() {
+        if byte.is_ascii_alphanumeric() || b"-._~/:".contains(&byte) {
+            uri.push(byte as char);
+        } else {
+            uri.push_str(&format!("%{:02X}", byte));
+        }
+    }
+    uri
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+    use tokio::io::duplex;
+
+    async fn request(
+        client: &mut (impl AsyncWrite + Unpin),
+        replies: &mut BufReader<impl AsyncRead + Unpin>,
+        id: u64,
+        method: &str,
+        params: Value,
+    ) -> Value {
+        let message = json!({ "jsonrpc": "2.0", "id": id, "method": method, "params": params });
+        write_message(client, &message).await.unwrap();
+        let body = read_message(replies).await.unwrap().unwrap();
+        serde_json::from_slice(&body).unwrap()
+    }
+
+    #[tokio::test]
+    async fn editor_requests_follow_the_documented_contract() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path().to_path_buf();
+        fs::create_dir_all(root.join("src")).unwrap();
+        fs::write(root.join("src/my lib.rs"), "// header\n    fn retry() {}\n").unwrap();
+
+        let (mut client, server_input) = duplex(64 * 1024);
+        let (server_output, replies) = duplex(64 * 1024);
+        let server = tokio::spawn(serve(root.clone(), server_input, server_output));
+        let mut replies = BufReader::new(replies);
+
+        let initialized = request(&mut client, &mut replies, 1, "initialize", json!({})).await;
+        assert_eq!(initialized["result"]["protocol_version"], PROTOCOL_VERSION);
+        assert!(
+            initialized["result"]["methods"]
+                .as_array()
+                .unwrap()
+                .contains(&json!("open_at_result"))
+        );
+
+        let opened = request(
+            &mut client,
+            &mut replies,
+            2,
+            "open_at_result",
+            json!({ "path": "src/my lib.rs", "line": 2 }),
+        )
+        .await;
+        let range = &opened["result"]["range"];
+        assert_eq!(range["start"], json!({ "line": 1, "character": 4 }));
+        assert_eq!(range["end"], json!({ "line": 1, "character": 17 }));
+        assert!(
+            opened["result"]["uri"]
+                .as_str()
+                .unwrap()
+                .ends_with("/src/my%20lib.rs")
+        );
+
+        let past_end = request(
+            &mut client,
+            &mut replies,
+            3,
+            "open_at_result",
+            json!({ "path": "src/my lib.rs", "line": 9 }),
+        )
+        .await;
+        assert_eq!(past_end["error"]["code"], INVALID_PARAMS);
+
+        let status = request(&mut client, &mut replies, 4, "index_status", Value::Null).await;
+        assert_eq!(status["result"]["indexed"], false);
+
+        let unknown = request(
+            &mut client,
+            &mut replies,
+            5,
+            "reindex_everything",
+            json!({}),
+        )
+        .await;
+        assert_eq!(unknown["error"]["code"], METHOD_NOT_FOUND);
+
+        let shutdown = request(&mut client, &mut replies, 6, "shutdown", Value::Null).await;
+        assert_eq!(shutdown["result"], json!({}));
+        client.shutdown().await.unwrap();
+        server.await.unwrap().unwrap();
+    }
+
+    #[tokio::test]
+    async fn a_live_search_supersedes_the_one_in_flight() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path().to_path_buf();
+        fs::write(root.join("lib.rs"), "fn retry() {}\nfn backoff() {}\n").unwrap();
+
+        let (mut client, server_input) = duplex(64 * 1024);
+        let (server_output, replies) = duplex(64 * 1024);
+        let server = tokio::spawn(serve(root, server_input, server_output));
+        let mut replies = BufReader::new(replies);
+
+        let live = |id: u64, query: &str, debounce_ms: u64| {
+            json!({
+                "jsonrpc": "2.0",
+                "id": id,
+                "method": "search",
+                "params": { "query": query, "mode": "regex", "live": true, "debounce_ms": debounce_ms },
+            })
+        };
+        // Typed faster than the debounce: only the last keystroke is searched
+        write_message(&mut client, &live(1, "re", 60_000))
+            .await
+            .unwrap();
+        write_message(&mut client, &live(2, "retry", 0))
+            .await
+            .unwrap();
+        let mut by_id = std::collections::HashMap::new();
+        for _ in 0..2 {
+            let body = read_message(&mut replies).await.unwrap().unwrap();
+            let reply: Value = serde_json::from_slice(&body).unwrap();
+            by_id.insert(reply["id"].as_u64().unwrap(), reply);
+        }
+        assert_eq!(by_id[&1]["error"]["code"], REQUEST_CANCELLED);
+        let results = by_id[&2]["result"]["results"].as_array().unwrap();
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0]["line_start"], 1);
+
+        // The client can cancel it too
+        write_message(&mut client, &live(3, "backoff", 60_000))
+            .await
+            .unwrap();
+        let cancel =
+            json!({ "jsonrpc": "2.0", "method": "$/cancelRequest", "params": { "id": 3 } });
+        write_message(&mut client, &cancel).await.unwrap();
+        let body = read_message(&mut replies).await.unwrap().unwrap();
+        let cancelled: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(cancelled["id"], 3);
+        assert_eq!(cancelled["error"]["code"], REQUEST_CANCELLED);
+
+        client.shutdown().await.unwrap();
+        server.await.unwrap().unwrap();
+    }
+
+    #[test]
+    fn tenant_sessions_stay_inside_their_repository() {
+        let temp_dir = TempDir::new().unwrap();
+        let base = cs_core::paths::canonicalize_lossy(temp_dir.path());
+        let repo = base.join("payments");
+        fs::create_dir_all(repo.join("src")).unwrap();
+        fs::write(base.join("other.rs"), "fn other() {}\n").unwrap();
+        let tenant = TenantConfig {
+            name: "payments".to_string(),
+            key: "k1".to_string(),
+            root: repo.clone(),
+            top_k: None,
+            threshold: None,
+            exclude: Vec::new(),
+            rate_per_minute: None,
+            daily_queries: None,
+        };
+
+        let inside = resolve_within(&repo, Some(&tenant), Some(Path::new("src"))).unwrap();
+        assert_eq!(inside, repo.join("src"));
+        for escape in [
+            "../other.rs",
+            "src/../../other.rs",
+            "/etc/passwd",
+            "../missing.rs",
+        ] {
+            assert!(resolve_within(&repo, Some(&tenant), Some(Path::new(escape))).is_err());
+        }
+        // Without tenants, paths resolve as the client gives them
+        assert!(resolve_within(&repo, None, Some(Path::new("../other.rs"))).is_ok());
+    }
+
+    #[tokio::test]
+    async fn a_batch_rechecks_only_its_paths() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = cs_core::paths::canonicalize_lossy(temp_dir.path());
+        fs::write(root.join("edited.rs"), "fn before() {}\n").unwrap();
+        fs::write(root.join("pending.rs"), "fn pending() {}\n").unwrap();
+        cs_index::smart_update_index(&root, false, true, &[])
+            .await
+            .unwrap();
+        let indexed = poll_index(&root);
+        assert!(indexed.1.is_empty());
+
+        fs::write(root.join("edited.rs"), "fn after_the_edit() {}\n").unwrap();
+        // Stale from an earlier batch, and not in this one
+        let last = (indexed.0.clone(), vec![root.join("pending.rs")]);
+        let current = recheck_index(&root, &last, Batch::Paths(vec![root.join("edited.rs")]));
+        assert_eq!(current.0, indexed.0);
+        assert_eq!(
+            current.1,
+            vec![root.join("edited.rs"), root.join("pending.rs")]
+        );
+
+        let index_only = Batch::Paths(vec![
+            cs_core::locations::index_dir(&root).join("manifest.json"),
+        ]);
+        assert_eq!(recheck_index(&root, &current, index_only).1, current.1);
+        assert_eq!(
+            recheck_index(&root, &current, Batch::Rescan).1,
+            vec![root.join("edited.rs")]
+        );
+    }
+}
@@ -0,0 +1,22 @@
+//! Exit codes, grep-style, so shell scripts and git hooks can branch on the
+//! outcome of a search: 0 when results were found (or a command other than a
+//! search succeeded), [`NO_MATCHES`] and [`ERROR`]. Clap exits with 2 on bad
+//! arguments too.
+
+/// The search ran, but nothing matched above the threshold.
+pub const NO_MATCHES: i32 = 1;
+/// A `--hook` check failed, which stops the git operation.
+pub const BLOCKED: i32 = 1;
+/// `--bench-latency` measured worse than `--fail-above` allows against its
+/// `--baseline`.
+pub const REGRESSED: i32 = 1;
+/// Bad arguments, an unreadable index, a failed check or any other error.
+pub const ERROR: i32 = 2;
+
+/// Report that nothing matched, unless `--quiet`, and exit with [`NO_MATCHES`].
+pub fn no_matches(quiet: bool) -> ! {
+    if !quiet {
+        eprintln!("No matches found");
+    }
+    std::process::exit(NO_MATCHES)
+}
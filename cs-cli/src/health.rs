@@ -0,0 +1,239 @@
+//! Supervision for the long-running daemons (`cs --serve`, `cs --editor-rpc`
+//! and `--editor-socket`): `--health-addr` serves `/healthz` and `/readyz` for
+//! Kubernetes probes, and under systemd (`Type=notify`) `READY=1` is sent to
+//! `$NOTIFY_SOCKET`.
+//!
+//! `/healthz` answers as long as the process does. Readiness waits for the
+//! index to load: its manifest and every sidecar read, and the embedding model
+//! it was built with loaded, so the first search doesn't stall on a model
+//! download. Until then `/readyz` answers 503 with the reason, and loading is
+//! retried, since a daemon may be started before its index is built.
+
+use anyhow::Result;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+/// How often loading the index is retried until it succeeds.
+const RETRY_INTERVAL: Duration = Duration::from_secs(30);
+
+/// Requests are a request line and a few headers; anything longer is cut off.
+const MAX_REQUEST_BYTES: usize = 8192;
+
+#[derive(Debug, Default)]
+pub struct Health {
+    ready: AtomicBool,
+    /// What was loaded, or why loading failed
+    detail: Mutex<String>,
+}
+
+impl Health {
+    fn set(&self, ready: bool, detail: String) {
+        *self.detail.lock().unwrap() = detail;
+        self.ready.store(ready, Ordering::SeqCst);
+    }
+
+    fn detail(&self) -> String {
+        self.detail.lock().unwrap().clone()
+    }
+}
+
+/// Load the index at `root` in the background, reporting readiness to
+/// systemd and on `addr` once it has. Does nothing when neither is asked for.
+pub async fn start(root: PathBuf, addr: Option<&str>) -> Result<Option<Arc<Health>>> {
+    let notify_socket = std::env::var("NOTIFY_SOCKET").ok();
+    if addr.is_none() && notify_socket.is_none() {
+        return Ok(None);
+    }
+    let health = Arc::new(Health {
+        detail: Mutex::new("Loading the index".to_string()),
+        ..Health::default()
+    });
+
+    if let Some(addr) = addr {
+        let listener = tokio::net::TcpListener::bind(addr)
+            .await
+            .map_err(|e| anyhow::anyhow!("Can't serve health checks on {}: {}", addr, e))?;
+        tracing::info!("Health checks on http://{}/healthz and /readyz", addr);
+        let health = health.clone();
+        tokio::spawn(async move {
+            while let Ok((stream, _)) = listener.accept().await {
+                let health = health.clone();
+                tokio::spawn(async move {
+                    if let Err(e) = answer(stream, &health).await {
+                        tracing::debug!("Health check connection failed: {}", e);
+                    }
+                });
+            }
+        });
+    }
+
+    let loading = health.clone();
+    tokio::spawn(async move {
+        loop {
+            let load_root = root.clone();
+            let loaded = tokio::task::spawn_blocking(move || load_index(&load_root))
+                .await
+                .map_err(anyhow::Error::from)
+                .and_then(|loaded| loaded);
+            match loaded {
+                Ok(detail) => {
+                    tracing::info!("Ready: {}", detail);
+                    if let Some(socket) = &notify_socket {
+                        notify(socket, &format!("READY=1\nSTATUS={}", detail));
+                    }
+                    loading.set(true, detail);
+                    return;
+                }
+                Err(e) => {
+                    let detail = e.to_string();
+                    if let Some(socket) = &notify_socket {
+                        notify(socket, &format!("STATUS=Not ready: {}", detail));
+                    }
+                    loading.set(false, detail);
+                }
+            }
+            tokio::time::sleep(RETRY_INTERVAL).await;
+        }
+    });
+    Ok(Some(health))
+}
+
+/// Read the index at `root` and load its embedding model, describing what
+/// was loaded.
+fn load_index(root: &Path) -> Result<String> {
+    let root = cs_index::find_repo_root(root)?;
+    let manifest = match cs_index::load_manifest(&root)? {
+        Some(manifest) => manifest,
+        None if cs_index::shards::is_sharded(&root) => cs_index::shards::combined_manifest(&root)?,
+        None => anyhow::bail!("No index at {}; run cs --index", root.display()),
+    };
+    cs_index::validate_manifest_model(&manifest)?;
+    let consistency = cs_index::check_index_consistency(&root)?;
+    if consistency.broken_entries > 0 {
+        tracing::warn!(
+            "{} index entries are unreadable; run cs --index to rebuild them",
+            consistency.broken_entries
+        );
+    }
+    let model = manifest.embedding_model.as_deref();
+    if let Some(model) = model {
+        cs_embed::create_embedder(Some(model))?;
+    }
+    Ok(format!(
+        "{} files indexed{}",
+        consistency.manifest_entries,
+        model.map(|m| format!(" with {}", m)).unwrap_or_default()
+    ))
+}
+
+/// Status code and body for a probe of `path`.
+fn route(path: &str, health: &Health) -> (u16, String) {
+    match path {
+        "/healthz" => (200, "ok\n".to_string()),
+        "/readyz" if health.ready.load(Ordering::SeqCst) => (200, "ready\n".to_string()),
+        "/readyz" => (503, format!("not ready: {}\n", health.detail())),
+        _ => (404, "not found\n".to_string()),
+    }
+}
+
+async fn answer(mut stream: tokio::net::TcpStream, health: &Health) -> Result<()> {
+    let mut request = Vec::new();
+    let mut buffer = [0u8; 1024];
+    while !request.windows(4).any(|w| w == b"\r\n\r\n") && request.len() < MAX_REQUEST_BYTES {
+        let read = stream.read(&mut buffer).await?;
+        if read == 0 {
+            break;
+        }
+        request.extend_from_slice(&buffer[..read]);
+    }
+    let request = String::from_utf8_lossy(&request);
+    // `GET /readyz HTTP/1.1`, ignoring any query string
+    let mut parts = request.split_whitespace();
+    let (status, body) = match (parts.next(), parts.next()) {
+        (Some("GET" | "HEAD"), Some(target)) => {
+            route(target.split('?').next().unwrap_or(target), health)
+        }
+        _ => (405, "method not allowed\n".to_string()),
+    };
+    let reason = match status {
+        200 => "OK",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        _ => "Service Unavailable",
+    };
+    let response = format!(
+        "HTTP/1.1 {} {}\r\nContent-Type: text/plain\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        status,
+        reason,
+        body.len(),
+        if request.starts_with("HEAD") {
+            ""
+        } else {
+            &body
+        }
+    );
+    stream.write_all(response.as_bytes()).await?;
+    stream.shutdown().await?;
+    Ok(())
+}
+
+/// Send `state` to systemd's notification socket: a path, or an abstract
+/// socket name starting with `@`.
+#[cfg(unix)]
+fn notify(socket: &str, state: &str) {
+    use std::os::unix::net::UnixDatagram;
+
+    let sent = UnixDatagram::unbound().and_then(|datagram| {
+        #[cfg(target_os = "linux")]
+        if let Some(name) = socket.strip_prefix('@') {
+            use std::os::linux::net::SocketAddrExt;
+            let addr = std::os::unix::net::SocketAddr::from_abstract_name(name)?;
+            return datagram.send_to_addr(state.as_bytes(), &addr);
+        }
+        datagram.send_to(state.as_bytes(), socket)
+    });
+    if let Err(e) = sent {
+        tracing::warn!("Failed to notify systemd at {}: {}", socket, e);
+    }
+}
+
+#[cfg(not(unix))]
+fn notify(_socket: &str, _state: &str) {}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn readiness_follows_the_index() {
+        let health = Health::default();
+        health.set(false, "No index at /repo; run cs --index".to_string());
+        assert_eq!(route("/healthz", &health).0, 200);
+        assert_eq!(
+            route("/readyz", &health),
+            (
+                503,
+                "not ready: No index at /repo; run cs --index\n".to_string()
+            )
+        );
+        health.set(true, "12 files indexed".to_string());
+        assert_eq!(route("/readyz", &health), (200, "ready\n".to_string()));
+        assert_eq!(route("/metrics", &health).0, 404);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn systemd_receives_ready() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("notify.sock");
+        let systemd = std::os::unix::net::UnixDatagram::bind(&path).unwrap();
+        notify(path.to_str().unwrap(), "READY=1\nSTATUS=12 files indexed");
+
+        let mut buffer = [0u8; 64];
+        let read = systemd.recv(&mut buffer).unwrap();
+        assert_eq!(&buffer[..read], b"READY=1\nSTATUS=12 files indexed");
+    }
+}
@@ -1,8 +1,14 @@
 // Library interface for testing internal modules
 
+pub mod editor_rpc;
 pub mod mcp;
 pub mod mcp_server;
 pub mod path_utils;
+pub mod quota;
+pub mod reload;
+pub mod tenants;
+pub mod usage;
+pub mod watch_events;
 // TUI is now in its own crate: cc-tui
 
 // Re-export commonly used types for testing
@@ -9,10 +9,26 @@ use owo_colors::{OwoColorize, Rgb};
 use regex::RegexBuilder;
 use std::path::{Path, PathBuf};
 
+mod batch;
+mod doctor;
+mod editor_rpc;
+mod exit_code;
+mod health;
 mod mcp;
 mod mcp_server;
+mod offline_bundle;
+mod onboarding;
 mod path_utils;
 mod progress;
+mod quota;
+mod reload;
+mod schedule;
+mod telemetry;
+mod tenants;
+mod tool_schema;
+mod usage;
+mod warm;
+mod watch_events;
 // TUI is now in its own crate: cs-tui
 
 use path_utils::{build_include_patterns, expand_glob_patterns};
@@ -61,6 +77,7 @@ QUICK START EXAMPLES:
     cs --clean-orphans .               # Clean up orphaned files
     cs --clean .                       # Remove entire index
     cs --switch-model nomic-v1.5       # Clean + rebuild with a different embedding model
+    cs --migrate-model nomic-v1.5      # Or move to it a batch of files per run, searchable throughout
     cs --add file.rs                   # Add single file to index
     cs --index .                       # Optional: pre-build before CI runs
 
@@ -83,11 +100,81 @@ QUICK START EXAMPLES:
   Model and embedding options:
     cs --index --model nomic-v1.5      # Index with higher-quality model (8k context)
     cs --index --model jina-code       # Index with code-specialized model
+    cs --index --device cuda           # Local embedding on GPU (build with --features cuda/metal)
     cs --sem "auth" --rerank           # Enable reranking for better relevance
     cs --sem "login" --rerank-model bge # Use specific reranking model
+    cs --sem "auth" --truncate-dims 256 # Fast Matryoshka first pass, full-dim re-score
+    cs --sem "auth" --remote-index gs://team-index/repo  # Query the team's shared index
+    cs --fetch-index http://buildbox:8000 .               # Warm start from a peer's index
+    cs --publish-index oci://ghcr.io/acme/shop-index      # Push the index, tagged with HEAD
+    cs --sem "auth" --store postgres://db/cs --store-repo api  # Query a pgvector store
+    cs --feedback src/auth.rs:42 --relevant "token refresh"  # Boost this result for similar queries
+    cs --note-add src/http.rs:88 "this is the retry hotfix"  # Attach a note to a code location
+    cs --pin-add pkg/retry/retry.go:Backoff               # Mark the canonical implementation
+    cs --notes "why do we retry twice"   # Search notes by meaning
+    cs --remember "run make db before the integration tests" --ttl 14d  # A memory for later sessions
+    cs --index --encrypt-index         # Encrypt the index at rest (key in CS_INDEX_KEY)
+    cs --index --multi-vector          # A vector per statement too: finer matches, more storage
+    cs --index --sparse                # SPLADE term weights too: rare identifiers and typos
+    cs --index --summarize --llm-model qwen2.5-coder:7b  # One-line summary under each result
+    cs --index --dry-run --model jina-v4 --token-price 0.05  # Files, chunks, tokens and cost first
+    cs --sem "retry" --facets --facet dir=internal        # Facet counts + drill-down
+    cs --sem "lru cache" --license '!GPL-3.0'             # Skip code under licenses you can't copy
+    cs --sem "refund flow" --meta service=billing         # Chunks your .csextract.toml tagged
+    cs --sem "refund flow" --tag billing                  # Chunks your .cstags.toml classified as billing
+    cs --sem "retry logic" --must-match 'DeadlineExceeded'  # About retries, and mentions the error
+    cs --hybrid "token refresh" --rerank --explain-scores  # Dense, lexical, rerank and boost parts of each score
+    cs --sem "create user" --with-tests                   # Show the Go tests covering each hit
+    cs --impls UserService                                # Go types implementing an interface
+    cs --trace "user with ID %d not found"                # Call sites printing a message
+    cs --sym imusrsvc                                     # Go to symbol: InMemoryUserService
+    cs --sig 'func(context.Context, int) (*User, error)'  # Functions by the types they take and return
+    cs --deadcode . --exclude 'pkg/api/**'                # Exported Go code nothing references
+    cs --audit go-security --sarif . > cs.sarif           # Dangerous patterns, for code scanning
+    cs --map --map-format dot . | dot -Tsvg > map.svg     # Clusters of related code, as a graph
+    cs --drift docs/                                      # Doc sections whose code changed since
+    cs --related main                                     # Code a reviewer should see next to a diff
+    cs --pr-comment origin/main > comment.md              # Markdown review summary for CI to post
+    cs --resolve 'src/auth.rs#3f9a2b1c0d4e5f67+4'         # Where a result anchor points now
+    cs --chunk src/ > chunks.jsonl                        # Chunks for your own RAG pipeline, unembedded
+    cs --index-diff /tmp/before.cs .                      # What changed since a saved index
+    cs --compare ./upstream ./fork --threshold 0.95       # Near-identical code across repos
+    cs --eval-compare --config-a bge.toml --config-b hybrid.toml  # Golden-query metrics, side by side
+    cs --hook pre-commit --dupe-threshold 0.95            # Block commits duplicating existing functions
+    cs --ask "how does user deletion cascade?"            # Cited answer from a chat model ([llm] config)
+    cs --index --index-commits .                          # Also make commit messages searchable
+    cat notes.txt | cs --index --stdin --collection notes # Search meeting notes with the code
+    cs --index --collection docs ~/wiki                   # Docs kept outside the repository
+    cs --sem "rollback procedure" --collection docs       # Search one collection
+    cs --index --collection tickets --issues github:o/r   # GitHub issues and comments, linked back
+    cs --index --collection chat --chats ~/slack-export   # Slack or Discord conversations
+    cs --index --with-deps                                # Go module dependencies, searched as 'deps'
+    cs --index --with-stdlib                              # Go standard library, searched as 'stdlib'
+    cs --secrets                                          # Review chunks withheld from remote embedders
+    cs --query-stats                                      # Slow, empty and frequent searches (opt-in)
+    cs --usage-export --dp-epsilon 1 > usage.json         # Daemon usage, no one's searches in it
+    cs --index --max-file-size 10M --include-minified     # Loosen the read limits
+    cs --skipped                                          # Files skipped as too large or minified
+    cs --index --symlinks follow --submodules skip        # Walk symlinks, leave submodules out
+    cs --index --max-index-size 2G                        # Evict files to keep the index under 2 GB
+    cs --sem "user store mock" --include-generated        # Also search generated code (mocks, protobufs)
+    cs --sem "token refresh" --open 1                     # Open the best result in $EDITOR
+    cs --sem "token refresh" --open                       # Pick a result to open from a numbered list
+    cs --doctor                                           # Diagnose model, index, disk and network problems
+    cs --init                                             # Recommend excludes and a model, then index
+    cs --index --index-location data .                    # Keep the index out of the checkout
+    cs --projects                                         # Projects found in a monorepo
+    cs --sem "rate limiter" --project api-server          # Search one of them
+    cs --index --project-shards .                         # One shard per project
+    cs --seal-index repo.csbundle --signing-key review.pk8  # Signed read-only bundle
+    cs --bundle repo.csbundle --trusted-key review.pk8.pub "auth"  # Search it air-gapped
+    cs --offline-bundle cs-offline.tar --bundle-model bge-small  # Binary and models for offline installs
 
   AI agent integration (MCP):
     cs --serve                         # Start MCP server for Claude/Cursor integration
+    cs --editor-rpc                    # JSON-RPC over stdio for VS Code/JetBrains extensions
+    cs --editor-socket $XDG_RUNTIME_DIR/cs.sock    # The same on a Unix socket, e.g. for Neovim pickers
+    cs --tool-schema openai > tools.json  # The same tools as function definitions for chat APIs
     # Provides tools: semantic_search, regex_search, hybrid_search, index_status, reindex, health_check
     # Connect with Claude Desktop, Cursor, or any MCP-compatible client
 
@@ -194,6 +281,21 @@ struct Cli {
     )]
     lexical: bool,
 
+    #[arg(
+        long = "max-typos",
+        value_name = "N",
+        value_parser = clap::value_parser!(u8).range(0..=2),
+        help = "Edits (0 to 2) a lexical search word may be from the word it matches, so InMemoryUserServce still finds InMemoryUserService (default 1, or max_typos in config)"
+    )]
+    max_typos: Option<u8>,
+
+    #[arg(
+        long = "fusion",
+        value_name = "STRATEGY",
+        help = "How hybrid search merges its result lists: rrf, weighted or linear (default rrf, or [fusion] in config)"
+    )]
+    fusion: Option<cs_core::FusionStrategy>,
+
     #[arg(
         long = "hybrid",
         help = "Hybrid search - combines regex and semantic results (auto-includes AST if pattern contains $)"
@@ -250,12 +352,129 @@ struct Cli {
     #[arg(long = "jsonl", help = "Output results as JSONL for agent workflows")]
     jsonl: bool,
 
+    #[arg(
+        long = "format",
+        value_name = "FORMAT",
+        conflicts_with_all = ["json", "json_v1", "jsonl"],
+        help = "Export the results for review and triage tools: sarif (SARIF 2.1.0, one note per result) or csv (a row per result)"
+    )]
+    format: Option<cs_engine::export::ExportFormat>,
+
     #[arg(long = "no-snippet", help = "Exclude code snippets from JSONL output")]
     no_snippet: bool,
 
+    #[arg(
+        long = "snippet",
+        value_name = "POLICY",
+        help = "How much code each result shows: lines:N, tokens:N or symbol for the whole function or class (default: the search's preview, or [snippets] terminal in config)"
+    )]
+    snippet: Option<cs_core::SnippetPolicy>,
+
+    #[arg(
+        long = "focus",
+        value_name = "FILE",
+        help = "Rank results near FILE higher: from its package, packages it imports and files importing it (imports resolved for Go)"
+    )]
+    focus: Option<PathBuf>,
+
+    #[arg(
+        long = "multi-query",
+        value_name = "HOW",
+        num_args = 0..=1,
+        default_missing_value = "split",
+        help = "Split a long question asking for several things into 2-4 sub-queries, search each and fuse the rankings: split at conjunctions (default) or llm, asking the [llm] chat model"
+    )]
+    multi_query: Option<cs_engine::multi_query::Decomposer>,
+
+    #[arg(
+        long = "infer-lang",
+        value_name = "MODE",
+        help = "What a query whose syntax gives its language away (func (s *T), def __init__) does: bias ranks that language's code higher (default), restrict searches only it, off ignores it; -t turns it off"
+    )]
+    infer_lang: Option<cs_core::LanguageInference>,
+
     #[arg(long = "reindex", help = "Force index update before searching")]
     reindex: bool,
 
+    #[arg(
+        long = "remote-index",
+        value_name = "LOCATION",
+        env = "CS_REMOTE_INDEX",
+        help = "Search a team-shared index (s3://bucket/prefix, gs://bucket/prefix or https:// URL), cached locally in .cs/",
+        conflicts_with = "reindex"
+    )]
+    remote_index: Option<String>,
+
+    #[arg(
+        long = "fetch-index",
+        value_name = "URL",
+        help = "Start this checkout's index from a copy a teammate or CI already built: download the .cs/ directory served at URL (http://peer:8000, s3://, gs://, or oci://registry/repository[:tag] as --publish-index pushes it), keep the sidecars of files whose contents match, then index the rest; an interrupted fetch resumes",
+        conflicts_with_all = ["remote_index", "model"]
+    )]
+    fetch_index: Option<String>,
+
+    #[arg(
+        long = "publish-index",
+        value_name = "REFERENCE",
+        conflicts_with_all = ["fetch_index", "remote_index"],
+        help = "Push the index to an OCI registry as oci://registry/repository[:tag], tagged with the checkout's commit unless a tag is given; --fetch-index pulls it"
+    )]
+    publish_index: Option<String>,
+
+    #[arg(
+        long = "store",
+        value_name = "URL",
+        env = "CS_STORE_URL",
+        help = "Use an external vector store (postgres://, qdrant:// or milvus:// URL): '--index' pushes the local index to it and semantic searches query it"
+    )]
+    store: Option<String>,
+
+    #[arg(
+        long = "store-repo",
+        value_name = "NAME",
+        requires = "store",
+        help = "Repository name in the vector store (defaults to the index root's directory name; repeat to search several repos)"
+    )]
+    store_repo: Vec<String>,
+
+    #[arg(
+        long = "no-index-update",
+        help = "Don't update the index before searching; files changed since the last index are embedded in memory and merged into semantic results",
+        conflicts_with = "reindex"
+    )]
+    no_index_update: bool,
+
+    #[arg(
+        long = "no-query-cache",
+        help = "Don't reuse cached results for a query already run against this version of the index"
+    )]
+    no_query_cache: bool,
+
+    #[arg(
+        long = "explain-plan",
+        help = "Show whether a semantic search scanned every chunk or used the ANN index, and why"
+    )]
+    explain_plan: bool,
+
+    #[arg(
+        long = "explain-scores",
+        help = "Show what each result's score is made of: dense, sparse and lexical scores, fused ranks, rerank change and boosts"
+    )]
+    explain_scores: bool,
+
+    #[arg(
+        long = "queries-file",
+        value_name = "FILE",
+        help = "Run every query in FILE (one per line, - for stdin) as one batch: the index is loaded once and semantic queries are embedded together and scored in a single pass"
+    )]
+    queries_file: Option<PathBuf>,
+
+    #[arg(
+        long = "include-generated",
+        help = "Include code from files with a generated-code header (e.g. \"Code generated ... DO NOT EDIT.\"), left out of semantic, lexical and hybrid results by default"
+    )]
+    include_generated: bool,
+
     #[arg(
         long = "exclude",
         value_name = "PATTERN",
@@ -275,6 +494,64 @@ struct Cli {
     #[arg(long = "no-csignore", help = "Don't respect .csignore file")]
     no_csignore: bool,
 
+    #[arg(
+        long = "project",
+        value_name = "NAME",
+        help = "Only search this project of a monorepo, by name or path (see --projects); searches cover every project otherwise"
+    )]
+    project: Option<String>,
+
+    // ripgrep compatibility
+    #[arg(
+        short = 'g',
+        long = "glob",
+        value_name = "GLOB",
+        allow_hyphen_values = true,
+        help = "Only search files matching GLOB, or skip them with '!GLOB' (ripgrep syntax; repeatable)"
+    )]
+    glob: Vec<String>,
+
+    #[arg(
+        short = 't',
+        long = "type",
+        value_name = "TYPE",
+        help = "Only search files of TYPE, e.g. go, rust, py (ripgrep type names; repeatable)"
+    )]
+    file_type: Vec<String>,
+
+    #[arg(
+        short = 'T',
+        long = "type-not",
+        value_name = "TYPE",
+        help = "Don't search files of TYPE (repeatable)"
+    )]
+    type_not: Vec<String>,
+
+    #[arg(
+        long = "ignore-path-case",
+        help = "Ignore case in --glob, --exclude and path globs on every platform, not only where the filesystem does"
+    )]
+    ignore_path_case: bool,
+
+    #[arg(
+        long = "ignore-path-accents",
+        help = "Ignore accents in --glob, --exclude and path globs, so 'resume/**' matches résumé/"
+    )]
+    ignore_path_accents: bool,
+
+    #[arg(
+        long = "type-list",
+        help = "Print the file types accepted by -t and exit"
+    )]
+    type_list: bool,
+
+    #[arg(
+        long = "rg",
+        help = "Plain regex search over the files in the index, like ripgrep: no embeddings, no index update",
+        conflicts_with_all = ["semantic", "lexical", "hybrid", "ast"]
+    )]
+    rg: bool,
+
     #[arg(
         long = "print-default-csignore",
         help = "Print the default .csignore content that cs generates and exit"
@@ -290,7 +567,7 @@ struct Cli {
     #[arg(
         short = 'q',
         long = "quiet",
-        help = "Suppress status messages and progress indicators"
+        help = "Print only results and errors: no status messages, progress, search parameters or \"No matches found\"; the exit code tells scripts whether anything matched"
     )]
     quiet: bool,
 
@@ -301,6 +578,398 @@ struct Cli {
     )]
     index: bool,
 
+    #[arg(
+        long = "encrypt-index",
+        help = "Encrypt the index at rest with AES-256-GCM, keyed from CS_INDEX_KEY or CS_INDEX_KEY_COMMAND; with --index, before anything is written"
+    )]
+    encrypt_index: bool,
+
+    #[arg(
+        long = "multi-vector",
+        requires = "index",
+        help = "Also store a vector per statement group of each chunk and score chunks by their best one; more storage for finer matches. Rebuilds an existing index once"
+    )]
+    multi_vector: bool,
+
+    #[arg(
+        long = "sparse",
+        requires = "index",
+        help = "Also store learned sparse (SPLADE) term weights per chunk and fuse them with dense scores, for rare identifiers and typos. Rebuilds an existing index once"
+    )]
+    sparse: bool,
+
+    #[arg(
+        long = "hot-model",
+        value_name = "MODEL",
+        requires = "index",
+        help = "Re-embed the chunks searches match most with this better model on each --index, and order them by it when they're among the top results; 'off' stops it"
+    )]
+    hot_model: Option<String>,
+
+    #[arg(
+        long = "hot-min-matches",
+        value_name = "N",
+        requires = "hot_model",
+        help = "Recent matches a chunk needs before --hot-model re-embeds it (default 3; a match counts half after two weeks)"
+    )]
+    hot_min_matches: Option<u32>,
+
+    #[arg(
+        long = "hot-max-chunks",
+        value_name = "N",
+        requires = "hot_model",
+        help = "Chunks --hot-model re-embeds at most, hottest first (default 2000)"
+    )]
+    hot_max_chunks: Option<usize>,
+
+    #[arg(
+        long = "summarize",
+        requires = "index",
+        help = "Have the --ask chat model write a one-sentence summary of each new chunk, shown under search results; later --index runs keep summaries up to date"
+    )]
+    summarize: bool,
+
+    #[arg(
+        long = "dry-run",
+        requires = "index",
+        help = "Report the files and chunks an --index run would add, change and remove, with estimated embedding tokens, time and cost, without indexing"
+    )]
+    dry_run: bool,
+
+    #[arg(
+        long = "token-price",
+        value_name = "USD",
+        env = "CS_TOKEN_PRICE",
+        requires = "dry_run",
+        help = "Embedding API price per million tokens, for the --dry-run cost estimate"
+    )]
+    token_price: Option<f64>,
+
+    #[arg(
+        long = "index-commits",
+        value_name = "N",
+        num_args = 0..=1,
+        default_missing_value = "1000",
+        requires = "index",
+        help = "Also embed the last N commit messages (default 1000) so searches can surface them"
+    )]
+    index_commits: Option<usize>,
+
+    #[arg(
+        long = "with-deps",
+        value_name = "SCOPE",
+        num_args = 0..=1,
+        default_missing_value = "direct",
+        requires = "index",
+        help = "Also index the Go modules go.mod requires, read from the module cache, into the 'deps' collection: direct (default) or all, adding the indirect ones"
+    )]
+    with_deps: Option<cs_index::go_deps::DepsScope>,
+
+    #[arg(
+        long = "with-stdlib",
+        requires = "index",
+        help = "Also index the Go standard library's exported API, read from GOROOT, into the 'stdlib' collection"
+    )]
+    with_stdlib: bool,
+
+    #[arg(
+        long = "stdin",
+        requires_all = ["index", "collection"],
+        help = "Embed text read from stdin into the collection named by --collection"
+    )]
+    stdin: bool,
+
+    #[arg(
+        long = "collection",
+        alias = "name",
+        value_name = "NAME",
+        help = "With --index, embed the given files or directories (or --stdin) into a named collection, replacing what it held; with a search, search only these collections, 'code' being the repository's files (can be used multiple times)"
+    )]
+    collection: Vec<String>,
+
+    #[arg(
+        long = "issues",
+        value_name = "TRACKER",
+        requires_all = ["index", "collection"],
+        conflicts_with = "stdin",
+        help = "Fetch issues and their comments into the --collection: github:OWNER/REPO (GITHUB_TOKEN) or jira:https://SITE/PROJECT (JIRA_EMAIL and JIRA_API_TOKEN, or JIRA_TOKEN)"
+    )]
+    issues: Option<String>,
+
+    #[arg(
+        long = "chats",
+        value_name = "EXPORT",
+        requires_all = ["index", "collection"],
+        conflicts_with_all = ["stdin", "issues"],
+        help = "Index the conversations of a chat export into the --collection: an unzipped Slack export directory, or DiscordChatExporter JSON files"
+    )]
+    chats: Option<PathBuf>,
+
+    #[arg(
+        long = "collections",
+        help = "List the collections searched with the code: name, model, chunks and sources"
+    )]
+    collections: bool,
+
+    #[arg(
+        long = "drop-collection",
+        value_name = "NAME",
+        help = "Delete a collection from the index"
+    )]
+    drop_collection: Option<String>,
+
+    #[arg(
+        long = "shards",
+        requires = "index",
+        help = "Index each top-level directory as its own shard under .cs/shards"
+    )]
+    shards: bool,
+
+    #[arg(
+        long = "shard",
+        value_name = "DIR",
+        requires = "index",
+        help = "Build or refresh only the shard for this top-level directory, or project with --project-shards (repeatable; implies --shards)"
+    )]
+    shard: Vec<String>,
+
+    #[arg(
+        long = "project-shards",
+        requires = "index",
+        help = "Shard by project (directories with a go.mod, Cargo.toml or package.json) instead of top-level directory (implies --shards)"
+    )]
+    project_shards: bool,
+
+    #[arg(
+        long = "shard-jobs",
+        value_name = "N",
+        default_value_t = 2,
+        help = "Shards built in parallel by --shards"
+    )]
+    shard_jobs: usize,
+
+    #[arg(
+        long = "coordinate",
+        value_name = "ADDR",
+        requires = "index",
+        help = "Embed changed files on workers that join at ADDR (e.g. 127.0.0.1:7878, or 0.0.0.0:7878 with --worker-token) instead of locally"
+    )]
+    coordinate: Option<String>,
+
+    #[arg(
+        long = "min-workers",
+        value_name = "N",
+        default_value_t = 1,
+        help = "Workers --coordinate waits for before handing out files"
+    )]
+    min_workers: usize,
+
+    #[arg(
+        long = "worker",
+        requires = "join",
+        help = "Run as an embedding worker for a coordinator (see --join)"
+    )]
+    worker: bool,
+
+    #[arg(
+        long = "join",
+        value_name = "ADDR",
+        requires = "worker",
+        help = "Coordinator to pull batches from, as host:port"
+    )]
+    join: Option<String>,
+
+    #[arg(
+        long = "worker-token",
+        value_name = "TOKEN",
+        env = "CS_WORKER_TOKEN",
+        hide_env_values = true,
+        help = "Shared secret workers must present to the coordinator; required unless it listens on loopback"
+    )]
+    worker_token: Option<String>,
+
+    #[arg(
+        long = "merge-shards",
+        value_name = "PATH",
+        num_args = 1..,
+        help = "Copy shards built in other checkouts (or single .cs/shards/<name> directories) into this index"
+    )]
+    merge_shards: Vec<PathBuf>,
+
+    #[arg(
+        long = "secret-policy",
+        value_name = "POLICY",
+        env = "CS_SECRET_POLICY",
+        default_value = "redact",
+        help = "What to do with chunks containing secrets before they reach a remote embedder: redact or skip"
+    )]
+    secret_policy: cs_index::secrets::SecretPolicy,
+
+    #[arg(
+        long = "secrets",
+        help = "List the chunks withheld or redacted from remote embedders because they contained secrets, and the placeholders substituted by [[redact]] rules"
+    )]
+    secrets: bool,
+
+    #[arg(
+        long = "query-stats",
+        help = "Report searches recorded with query_analytics = true in config: latency, queries that found nothing and the most searched directories (--top-k sets list lengths)"
+    )]
+    query_stats: bool,
+
+    #[arg(
+        long = "usage-export",
+        help = "Print the usage a daemon recorded with [usage] enabled = true as JSON: request counts by day, tool, tenant and latency, leaving out figures fewer than --k-anonymity clients contributed to"
+    )]
+    usage_export: bool,
+
+    #[arg(
+        long = "usage-days",
+        value_name = "DAYS",
+        default_value_t = 30,
+        help = "Days of usage --usage-export covers, today included"
+    )]
+    usage_days: u32,
+
+    #[arg(
+        long = "k-anonymity",
+        value_name = "K",
+        value_parser = clap::value_parser!(u64).range(1..),
+        help = "Distinct clients an exported usage row must cover; [usage] k_anonymity, else 5"
+    )]
+    k_anonymity: Option<u64>,
+
+    #[arg(
+        long = "dp-epsilon",
+        value_name = "EPSILON",
+        value_parser = parse_epsilon,
+        help = "Add Laplace noise to exported usage counts with this privacy budget per row, split across its figures; smaller is noisier"
+    )]
+    dp_epsilon: Option<f64>,
+
+    #[arg(
+        long = "max-file-size",
+        value_name = "SIZE",
+        env = "CS_MAX_FILE_SIZE",
+        default_value = "2M",
+        value_parser = cs_index::read_limits::parse_size,
+        help = "Skip files larger than this when indexing, e.g. 512K or 10M; 0 for no limit (PDFs get 8x)"
+    )]
+    max_file_size: u64,
+
+    #[arg(
+        long = "include-minified",
+        help = "Index minified files (*.min.js, or very long lines) instead of skipping them"
+    )]
+    include_minified: bool,
+
+    #[arg(
+        long = "allow-extractors",
+        help = "Run the .csextract.toml commands of any repository, not only those under trusted_extractor_roots"
+    )]
+    allow_extractors: bool,
+
+    #[arg(
+        long = "symlinks",
+        value_name = "POLICY",
+        env = "CS_SYMLINKS",
+        default_value = "skip",
+        help = "Symlinks when walking files: skip, or follow (each real file once, loops cut)"
+    )]
+    symlinks: cs_index::traversal::SymlinkPolicy,
+
+    #[arg(
+        long = "submodules",
+        value_name = "POLICY",
+        env = "CS_SUBMODULES",
+        default_value = "include",
+        help = "Git submodules: include them in the superproject's index, or skip them"
+    )]
+    submodules: cs_index::traversal::SubmodulePolicy,
+
+    #[arg(
+        long = "worktrees",
+        value_name = "POLICY",
+        env = "CS_WORKTREES",
+        default_value = "separate",
+        help = "Git worktrees nested in a checkout: separate (their own index, the default) or include"
+    )]
+    worktrees: cs_index::traversal::WorktreePolicy,
+
+    #[arg(
+        long = "skipped",
+        help = "List the files indexing skipped because they were too large or minified"
+    )]
+    skipped: bool,
+
+    #[arg(
+        long = "max-index-size",
+        value_name = "SIZE",
+        env = "CS_MAX_INDEX_SIZE",
+        default_value = "0",
+        value_parser = cs_index::read_limits::parse_size,
+        help = "Keep each index under this size, e.g. 2G, evicting files by --evict-policy after indexing; 0 for no limit"
+    )]
+    max_index_size: u64,
+
+    #[arg(
+        long = "evict-policy",
+        value_name = "POLICY",
+        env = "CS_EVICT_POLICY",
+        value_delimiter = ',',
+        default_value = cs_index::eviction::DEFAULT_POLICIES,
+        help = "What --max-index-size evicts first, in order: largest-generated, least-recently-matched, oldest-commit"
+    )]
+    evict_policy: Vec<cs_index::eviction::EvictionPolicy>,
+
+    #[arg(
+        long = "evicted",
+        help = "List the files evicted from the index to keep it under --max-index-size"
+    )]
+    evicted: bool,
+
+    #[arg(
+        long = "index-location",
+        value_name = "WHERE",
+        env = "CS_INDEX_LOCATION",
+        help = "Where indexes are kept: repo (.cs/ in the repository, the default) or data (under $CS_DATA_DIR or $XDG_DATA_HOME/cs, leaving the checkout untouched)"
+    )]
+    index_location: Option<cs_core::locations::IndexLocation>,
+
+    #[arg(
+        long = "index-dir",
+        value_name = "DIR",
+        env = "CS_INDEX_DIR",
+        help = "Keep the index of the repository being searched or indexed in DIR"
+    )]
+    index_dir: Option<PathBuf>,
+
+    #[arg(
+        long = "ca-cert",
+        value_name = "PEM",
+        env = "CS_CA_CERT",
+        help = "Trust the CA certificates in PEM for remote providers, besides the built-in ones (for TLS-inspecting proxies and private CAs); proxies come from HTTPS_PROXY and NO_PROXY"
+    )]
+    ca_cert: Option<PathBuf>,
+
+    #[arg(
+        long = "doctor",
+        help = "Check the embedding model, index consistency, disk space, provider reachability and file watch limits, and suggest fixes"
+    )]
+    doctor: bool,
+
+    #[arg(
+        long = "init",
+        help = "Set up a repository for its first index: report its languages and size, suggest excludes for generated and vendored code, recommend a model, estimate the indexing time, write .cs.toml and .csignore, and offer to index (--index does without asking)"
+    )]
+    init: bool,
+
+    #[arg(
+        long = "projects",
+        help = "List the projects of a monorepo: directories with a go.mod, Cargo.toml or package.json"
+    )]
+    projects: bool,
+
     #[arg(long = "clean", help = "Clean up search index")]
     clean: bool,
 
@@ -331,6 +1000,22 @@ struct Cli {
     )]
     force: bool,
 
+    #[arg(
+        long = "migrate-model",
+        value_name = "NAME",
+        help = "Move the index to this embedding model gradually: each run re-embeds the next --migrate-batch files, searches meanwhile score every file with its own model, and the run that migrates the last file switches the index over; 'off' drops the migration",
+        conflicts_with_all = ["index", "switch_model", "clean", "clean_orphans", "add"]
+    )]
+    migrate_model: Option<String>,
+
+    #[arg(
+        long = "migrate-batch",
+        value_name = "N",
+        requires = "migrate_model",
+        help = "Files a --migrate-model run re-embeds (default 500)"
+    )]
+    migrate_batch: Option<usize>,
+
     #[arg(long = "add", help = "Add a single file to the index")]
     add: bool,
 
@@ -352,6 +1037,12 @@ struct Cli {
     )]
     dump_chunks: bool,
 
+    #[arg(
+        long = "chunk",
+        help = "Print the chunks indexing makes of the given files and directories, one JSON line each (--json for one array): boundaries, symbols and text, with nothing embedded; --model sets the chunk size"
+    )]
+    chunk: bool,
+
     // Model selection (index-time only)
     #[arg(
         long = "model",
@@ -360,6 +1051,13 @@ struct Cli {
     )]
     model: Option<String>,
 
+    #[arg(
+        long = "device",
+        value_name = "DEVICE",
+        help = "Inference device for local embedding models (auto, cpu, cuda, metal) [default: auto, or $CS_DEVICE]"
+    )]
+    device: Option<String>,
+
     // Search-time enhancement options
     #[arg(
         long = "rerank",
@@ -374,6 +1072,510 @@ struct Cli {
     )]
     rerank_model: Option<String>,
 
+    #[arg(
+        long = "truncate-dims",
+        value_name = "N",
+        help = "Score on the first N embedding dimensions (Matryoshka models, e.g. 256/512), then re-score top candidates at full dimension"
+    )]
+    truncate_dims: Option<usize>,
+
+    // Relevance feedback
+    #[arg(
+        long = "feedback",
+        value_name = "RESULT_ID",
+        help = "Record relevance feedback for a result (path:line as printed in search output, or the anchor from JSON output, which survives edits) and the query given as PATTERN"
+    )]
+    feedback: Option<String>,
+
+    #[arg(
+        long = "relevant",
+        help = "Mark the --feedback result as relevant (boosted for similar queries)",
+        requires = "feedback",
+        conflicts_with = "irrelevant"
+    )]
+    relevant: bool,
+
+    #[arg(
+        long = "irrelevant",
+        help = "Mark the --feedback result as irrelevant (demoted for similar queries)",
+        requires = "feedback"
+    )]
+    irrelevant: bool,
+
+    // Notes on code locations
+    #[arg(
+        long = "note-add",
+        value_name = "LOCATION",
+        help = "Attach the note given as PATTERN to a code location (path:line, or a result anchor from JSON output); notes are stored in .csnotes.json at the index root"
+    )]
+    note_add: Option<String>,
+
+    #[arg(
+        long = "note-remove",
+        value_name = "ID",
+        help = "Remove a note by its id (or a unique prefix of it)"
+    )]
+    note_remove: Option<String>,
+
+    #[arg(
+        long = "notes",
+        help = "List notes with their current locations, or with PATTERN, search them by meaning",
+        conflicts_with_all = ["note_add", "note_remove"]
+    )]
+    notes: bool,
+
+    // Agent memories
+    #[arg(
+        long = "remember",
+        help = "Keep the text given as PATTERN as a memory for later sessions, searched with the code as collection 'memory' until its --ttl passes; memories are stored in .cs/memories.json",
+        conflicts_with_all = ["note_add", "notes"]
+    )]
+    remember: bool,
+
+    #[arg(
+        long = "ttl",
+        value_name = "DURATION",
+        requires = "remember",
+        help = "How long a --remember memory is kept: 30d (default), 12h, 90m, 2w or never"
+    )]
+    ttl: Option<String>,
+
+    #[arg(
+        long = "about",
+        value_name = "FILE",
+        requires = "remember",
+        help = "File a --remember memory is about, recorded with it (repeatable)"
+    )]
+    about: Vec<String>,
+
+    #[arg(
+        long = "agent",
+        value_name = "NAME",
+        env = "CS_AGENT",
+        help = "Who a --remember memory is from, like the agent running cs"
+    )]
+    agent: Option<String>,
+
+    #[arg(
+        long = "agent-session",
+        value_name = "ID",
+        env = "CS_AGENT_SESSION",
+        help = "Agent session a --remember memory is from"
+    )]
+    agent_session: Option<String>,
+
+    #[arg(
+        long = "memories",
+        help = "List the memories kept with --remember: id, expiry, who wrote them, about what, and their text",
+        conflicts_with = "remember"
+    )]
+    memories: bool,
+
+    #[arg(
+        long = "forget",
+        value_name = "ID",
+        help = "Delete a memory kept with --remember by its id (or a unique prefix of it)"
+    )]
+    forget: Option<String>,
+
+    // Canonical implementations
+    #[arg(
+        long = "pin-add",
+        value_name = "LOCATION",
+        help = "Pin a symbol as the canonical implementation (path:Symbol, e.g. pkg/retry/retry.go:Backoff): results overlapping it rank higher and are marked pinned; pins are stored in .cspins.json at the index root"
+    )]
+    pin_add: Option<String>,
+
+    #[arg(
+        long = "pin-remove",
+        value_name = "LOCATION",
+        help = "Unpin a symbol pinned with --pin-add (path:Symbol)"
+    )]
+    pin_remove: Option<String>,
+
+    #[arg(
+        long = "pins",
+        help = "List pinned symbols with their current lines",
+        conflicts_with_all = ["pin_add", "pin_remove"]
+    )]
+    pins: bool,
+
+    // Faceted results
+    #[arg(
+        long = "facets",
+        help = "Summarize results by language, directory, symbol kind and CODEOWNERS owner"
+    )]
+    facets: bool,
+
+    #[arg(
+        long = "facet",
+        value_name = "KEY=VALUE",
+        help = "Keep only results in a facet (lang=go, dir=internal, kind=function, owner=@team); repeatable"
+    )]
+    facet: Vec<cs_core::FacetFilter>,
+
+    #[arg(
+        long = "license",
+        value_name = "SPDX",
+        help = "Keep only code under this license (MIT, Apache-2.0), or leave it out with a leading ! ('!GPL-3.0'), from file license headers; repeatable"
+    )]
+    license: Vec<String>,
+
+    #[arg(
+        long = "meta",
+        value_name = "KEY=VALUE",
+        help = "Keep only chunks a .csextract.toml extractor tagged KEY=VALUE, with KEY alone for any value or a leading ! to exclude; repeatable"
+    )]
+    meta: Vec<cs_core::MetadataFilter>,
+
+    #[arg(
+        long = "tag",
+        value_name = "NAME",
+        help = "Keep only chunks classified under this .cstags.toml intent tag at index time; repeatable, and every tag must match"
+    )]
+    tag: Vec<String>,
+
+    #[arg(
+        long = "must-match",
+        value_name = "REGEX",
+        help = "Keep only results whose code contains a match for REGEX (case-insensitive with -i), e.g. --sem \"retry logic\" --must-match 'context\\.DeadlineExceeded'"
+    )]
+    must_match: Option<String>,
+
+    // Test awareness
+    #[arg(
+        long = "with-tests",
+        help = "List the Go tests, benchmarks and examples that cover each result"
+    )]
+    with_tests: bool,
+
+    #[arg(
+        long = "neighbors",
+        help = "Show the spans of the chunks before and after each result in its file (metadata only)"
+    )]
+    neighbors: bool,
+
+    // Context packing
+    #[arg(
+        long = "pack-tokens",
+        value_name = "TOKENS",
+        help = "Print one context block for LLM prompts: the best results within TOKENS, deduplicated and trimmed to fit"
+    )]
+    pack_tokens: Option<usize>,
+
+    #[arg(
+        long = "open",
+        value_name = "N",
+        num_args = 0..=1,
+        default_missing_value = "0",
+        conflicts_with_all = ["ask", "pack_tokens"],
+        help = "Open result N (1-based) in your editor instead of printing results; without N, pick one from a numbered list"
+    )]
+    open: Option<usize>,
+
+    #[arg(
+        long = "open-command",
+        value_name = "TEMPLATE",
+        env = "CS_OPEN_COMMAND",
+        help = "Command --open runs instead of $EDITOR, with {file} and {line} placeholders, e.g. \"idea --line {line} {file}\"; the TUI reads CS_OPEN_COMMAND"
+    )]
+    open_command: Option<String>,
+
+    // Answer synthesis
+    #[arg(
+        long = "ask",
+        help = "Answer the pattern as a question with a chat model, citing file:line from the best semantic results (configure [llm] in config.toml)",
+        conflicts_with_all = ["rg", "ast", "regex"]
+    )]
+    ask: bool,
+
+    #[arg(
+        long = "llm-url",
+        value_name = "URL",
+        env = "CS_LLM_URL",
+        help = "OpenAI-compatible chat completions endpoint for --ask (default: Ollama on localhost)"
+    )]
+    llm_url: Option<String>,
+
+    #[arg(
+        long = "llm-model",
+        value_name = "MODEL",
+        env = "CS_LLM_MODEL",
+        help = "Chat model for --ask and --summarize, e.g. qwen2.5-coder:7b"
+    )]
+    llm_model: Option<String>,
+
+    #[arg(
+        long = "impls",
+        value_name = "INTERFACE",
+        help = "List the Go types implementing an interface (UserService or users.UserService)"
+    )]
+    impls: Option<String>,
+
+    #[arg(
+        long = "trace",
+        value_name = "MESSAGE",
+        help = "Find the call sites printing a log or error message, pasted as printed or as a format string (\"user with ID %d not found\")"
+    )]
+    trace: Option<String>,
+
+    #[arg(
+        long = "sym",
+        value_name = "QUERY",
+        help = "Fuzzy-find indexed functions, methods and types by name, camelCase and snake_case aware (imusrsvc finds InMemoryUserService); --topk caps the list (default 20)"
+    )]
+    sym: Option<String>,
+
+    #[arg(
+        long = "sig",
+        value_name = "SIGNATURE",
+        help = "Find functions and methods by the types they take and return, e.g. 'func(context.Context, int) (*User, error)'; pointers, qualifiers and aliases like any/interface{} match loosely, _ matches any type; --topk caps the list (default 20)"
+    )]
+    sig: Option<String>,
+
+    #[arg(
+        long = "deadcode",
+        help = "List exported Go functions, types, vars and consts nothing in the index refers to (tests aside) as dead-code candidates; --exclude globs keep library entry points out of the report"
+    )]
+    deadcode: bool,
+
+    #[arg(
+        long = "audit",
+        value_name = "PACK",
+        help = "Run a pack of security rules over the index and list what each finds: go-security (SQL injection sinks, insecure TLS, hardcoded credentials, ...) or a TOML file of [[rule]] tables, each a semantic query and a regex the code must contain"
+    )]
+    audit: Option<String>,
+
+    #[arg(
+        long = "sarif",
+        requires = "audit",
+        conflicts_with = "format",
+        help = "Print --audit findings as SARIF 2.1.0, for upload to code scanning dashboards (same as --format sarif)"
+    )]
+    sarif: bool,
+
+    #[arg(
+        long = "map",
+        help = "Export a map of the codebase's semantic structure: chunk embeddings clustered with k-means, each cluster labelled by its most central symbols and linked to its nearest clusters"
+    )]
+    map: bool,
+
+    #[arg(
+        long = "map-format",
+        value_name = "FORMAT",
+        default_value = "json",
+        requires = "map",
+        help = "Format of --map: json (clusters, their chunks and links) or dot (Graphviz: cs --map --map-format dot | dot -Tsvg > map.svg)"
+    )]
+    map_format: cs_engine::semantic_map::MapFormat,
+
+    #[arg(
+        long = "clusters",
+        value_name = "N",
+        requires = "map",
+        help = "Clusters for --map (default about the square root of half the chunk count, at most 50)"
+    )]
+    clusters: Option<usize>,
+
+    #[arg(
+        long = "drift",
+        help = "Report doc sections (Markdown, reStructuredText, AsciiDoc) whose code changed after them: each is paired with the code it names or resembles, and git blame says which changed last"
+    )]
+    drift: bool,
+
+    #[arg(
+        long = "drift-days",
+        value_name = "DAYS",
+        requires = "drift",
+        help = "Only count code changes from the last DAYS days for --drift (default 90)"
+    )]
+    drift_days: Option<u64>,
+
+    #[arg(
+        long = "related",
+        value_name = "REV",
+        help = "Review context for a diff: for each hunk changed since REV (e.g. HEAD~1 or main), the most related code elsewhere, namely similar logic, callers and tests; --topk caps each list (default 5)"
+    )]
+    related: Option<String>,
+
+    #[arg(
+        long = "pr-comment",
+        value_name = "REV",
+        conflicts_with = "related",
+        help = "Sum up the changes since REV as Markdown for CI to post on the pull request: near-duplicate code they introduce (see --dupe-threshold), the most related existing modules and the CODEOWNERS owners of similar code; --json prints the summary as JSON"
+    )]
+    pr_comment: Option<String>,
+
+    #[arg(
+        long = "resolve",
+        value_name = "ANCHOR",
+        help = "Print where a result anchor from JSON output (src/auth.rs#3f9a2b1c0d4e5f67+4) points now, after edits moved its code"
+    )]
+    resolve: Option<String>,
+
+    #[arg(
+        long = "index-diff",
+        value_names = ["OLD", "NEW"],
+        num_args = 2,
+        help = "Report the files and chunks added, removed or modified between two indexes (checkouts or index directories)"
+    )]
+    index_diff: Vec<PathBuf>,
+
+    #[arg(
+        long = "compare",
+        value_names = ["REPO_A", "REPO_B"],
+        num_args = 2,
+        help = "Report chunks of REPO_A highly similar to chunks of REPO_B (--threshold, default 0.9), for license checks and fork drift"
+    )]
+    compare: Vec<PathBuf>,
+
+    #[arg(
+        long = "eval-compare",
+        requires_all = ["config_a", "config_b"],
+        help = "Run the golden queries (.csgolden.toml at the index root, or --golden) under --config-a and --config-b and print their retrieval metrics side by side"
+    )]
+    eval_compare: bool,
+
+    #[arg(
+        long = "config-a",
+        value_name = "TOML",
+        requires = "eval_compare",
+        help = "Search settings of the first configuration --eval-compare runs: mode, path, model, topk, threshold, rerank, truncate_dims, [[boost]]"
+    )]
+    config_a: Option<PathBuf>,
+
+    #[arg(
+        long = "config-b",
+        value_name = "TOML",
+        requires = "eval_compare",
+        help = "Search settings of the second configuration --eval-compare runs"
+    )]
+    config_b: Option<PathBuf>,
+
+    #[arg(
+        long = "golden",
+        value_name = "TOML",
+        requires = "eval_compare",
+        help = "Golden queries for --eval-compare: [[query]] tables with query and the relevant files or file:line locations"
+    )]
+    golden: Option<PathBuf>,
+
+    #[arg(
+        long = "bench-latency",
+        help = "Time searches over the local index: the --bench-queries (or the golden set's) run --bench-runs times in the chosen mode (--sem by default). --json prints a report to keep as a --baseline"
+    )]
+    bench_latency: bool,
+
+    #[arg(
+        long = "bench-queries",
+        value_name = "FILE",
+        requires = "bench_latency",
+        help = "Queries for --bench-latency, one per line with # comments, or a golden set .toml (default: .csgolden.toml at the index root)"
+    )]
+    bench_queries: Option<PathBuf>,
+
+    #[arg(
+        long = "bench-runs",
+        value_name = "N",
+        requires = "bench_latency",
+        help = "Timed passes --bench-latency makes over its queries (default 5)"
+    )]
+    bench_runs: Option<usize>,
+
+    #[arg(
+        long = "baseline",
+        value_name = "JSON",
+        requires = "bench_latency",
+        help = "Report of an earlier --bench-latency --json run to compare with"
+    )]
+    baseline: Option<PathBuf>,
+
+    #[arg(
+        long = "fail-above",
+        value_name = "PERCENT",
+        requires = "baseline",
+        help = "Exit with 1 when mean, p50, p90 or p99 latency or the throughput is more than PERCENT (e.g. 20%) worse than --baseline"
+    )]
+    fail_above: Option<String>,
+
+    #[arg(
+        long = "hook",
+        value_name = "HOOK",
+        value_parser = ["pre-commit"],
+        help = "Run as a git hook. pre-commit: block the commit when staged functions nearly duplicate code already in the index"
+    )]
+    hook: Option<String>,
+
+    #[arg(
+        long = "dupe-threshold",
+        value_name = "SIMILARITY",
+        help = "Similarity at which --hook pre-commit and --pr-comment flag new code as a duplicate (default 0.95)"
+    )]
+    dupe_threshold: Option<f32>,
+
+    #[arg(
+        long = "warn-only",
+        requires = "hook",
+        help = "With --hook, report duplicates but let the commit go ahead"
+    )]
+    warn_only: bool,
+
+    // Sealed index bundles
+    #[arg(
+        long = "seal-index",
+        value_name = "BUNDLE",
+        requires = "signing_key",
+        help = "Pack the index and indexed sources into a signed, read-only bundle file"
+    )]
+    seal_index: Option<PathBuf>,
+
+    #[arg(
+        long = "signing-key",
+        value_name = "KEYFILE",
+        help = "Ed25519 private key (PKCS#8) used by --seal-index"
+    )]
+    signing_key: Option<PathBuf>,
+
+    // Offline installs
+    #[arg(
+        long = "offline-bundle",
+        value_name = "TARBALL",
+        help = "Pack this cs binary and local embedding models into a tarball that installs with no network access"
+    )]
+    offline_bundle: Option<PathBuf>,
+
+    #[arg(
+        long = "bundle-model",
+        value_name = "MODEL",
+        requires = "offline_bundle",
+        help = "Local model to put in the --offline-bundle; repeat for several (default: bge-small)"
+    )]
+    bundle_models: Vec<String>,
+
+    #[arg(
+        long = "generate-signing-key",
+        value_name = "KEYFILE",
+        help = "Create an Ed25519 signing key at KEYFILE and its public key at KEYFILE.pub"
+    )]
+    generate_signing_key: Option<PathBuf>,
+
+    #[arg(
+        long = "bundle",
+        value_name = "BUNDLE",
+        requires = "trusted_key",
+        conflicts_with_all = ["reindex", "index", "remote_index"],
+        help = "Search a sealed bundle: verify its signature, extract it read-only and never update it"
+    )]
+    bundle: Option<PathBuf>,
+
+    #[arg(
+        long = "trusted-key",
+        value_name = "KEY",
+        env = "CS_TRUSTED_KEY",
+        help = "Public key (hex or .pub file) a --bundle must be signed with"
+    )]
+    trusted_key: Option<String>,
+
     // MCP Server mode
     #[arg(
         long = "serve",
@@ -390,15 +1592,92 @@ struct Cli {
     )]
     serve: bool,
 
+    #[arg(
+        long = "schedule",
+        value_name = "TASK=CRON",
+        help = "With --serve or --editor-rpc, run index upkeep on a cron schedule: update, revalidate or compact, e.g. 'revalidate=0 3 * * *' (can be used multiple times; adds to [[schedule]] in config.toml)"
+    )]
+    schedule: Vec<String>,
+
+    #[arg(
+        long = "health-addr",
+        value_name = "ADDR",
+        help = "With --serve or --editor-rpc, answer /healthz and /readyz on ADDR (e.g. 127.0.0.1:9090); /readyz succeeds once the index and its model are loaded"
+    )]
+    health_addr: Option<String>,
+
+    #[arg(
+        long = "rate-limit",
+        value_name = "PER_MINUTE",
+        help = "With --serve or --editor-rpc, allow each client PER_MINUTE searches a minute (overrides rate_per_minute in [limits] in config.toml)"
+    )]
+    rate_limit: Option<f64>,
+
+    #[arg(
+        long = "daily-quota",
+        value_name = "N",
+        help = "With --serve or --editor-rpc, allow each client N searches a day (overrides daily_queries in [limits] in config.toml)"
+    )]
+    daily_quota: Option<u64>,
+
+    #[arg(
+        long = "preload",
+        help = "With --serve or --editor-rpc, read the index and its embedding model into memory at startup, so the first query is as fast as the rest"
+    )]
+    preload: bool,
+
+    #[arg(
+        long = "mlock",
+        help = "Like --preload, and lock the preloaded index and model in RAM so they are never paged out (needs a high enough ulimit -l)"
+    )]
+    mlock: bool,
+
+    #[arg(
+        long = "otlp-endpoint",
+        value_name = "URL",
+        help = "Export OpenTelemetry spans of indexing and search stages to an OTLP/HTTP collector at URL, e.g. http://localhost:4318 (defaults to OTEL_EXPORTER_OTLP_ENDPOINT; needs the otel build feature)"
+    )]
+    otlp_endpoint: Option<String>,
+
+    #[arg(
+        long = "editor-rpc",
+        help = "Serve the JSON-RPC interface for editor extensions over stdio (see docs/reference/editor-rpc.md)",
+        conflicts_with_all = ["serve", "tui"]
+    )]
+    editor_rpc: bool,
+
+    #[arg(
+        long = "editor-socket",
+        value_name = "PATH",
+        help = "Serve the editor JSON-RPC interface on a Unix socket at PATH, one session per connection",
+        conflicts_with_all = ["serve", "tui", "editor_rpc"]
+    )]
+    editor_socket: Option<PathBuf>,
+
+    #[arg(
+        long = "tool-schema",
+        value_name = "FORMAT",
+        value_parser = ["openai", "anthropic"],
+        help = "Print the MCP server's tools as OpenAI or Anthropic function definitions (JSON), to register cs with an agent framework"
+    )]
+    tool_schema: Option<String>,
+
     // Configuration management
     #[arg(
         long = "config",
         value_name = "COMMAND",
         num_args = 0..,
-        help = "Configuration management: init, list, get KEY, set KEY VALUE, path"
+        help = "Configuration management: init, list, show, get KEY, set KEY VALUE, path"
     )]
     config: Vec<String>,
 
+    #[arg(
+        long = "origin",
+        requires = "config",
+        help = "With --config show: say which layer (default, system, user, project or env) set each value"
+    )]
+    origin: bool,
+
     // TUI mode
     #[arg(
         long = "tui",
@@ -416,16 +1695,6 @@ struct Cli {
     tui: bool,
 }
 
-fn canonicalize_for_comparison(path: &Path) -> PathBuf {
-    if let Ok(canonical) = path.canonicalize() {
-        return canonical;
-    }
-
-    std::env::current_dir()
-        .map(|cwd| cwd.join(path))
-        .unwrap_or_else(|_| path.to_path_buf())
-}
-
 fn find_search_root(include_patterns: &[IncludePattern]) -> PathBuf {
     if include_patterns.is_empty() {
         return PathBuf::from(".");
@@ -532,17 +1801,183 @@ fn resolve_model_selection(
     }
 }
 
-async fn run_index_workflow(
+/// Copy the local index at `path` into the vector store at `url`.
+async fn push_to_store(
     status: &StatusReporter,
     path: &Path,
-    cli: &Cli,
-    model_alias: &str,
-    model_config: &cs_models::ModelConfig,
-    heading: &str,
-    clean_first: bool,
+    url: &str,
+    repo_names: &[String],
 ) -> Result<()> {
-    status.section_header(heading);
-    status.info(&format!("Scanning files in {}", path.display()));
+    let repo_root = cs_index::find_repo_root(path)?;
+    let repo = match repo_names {
+        [] => cs_store::default_repo_name(&repo_root),
+        [name] => name.clone(),
+        _ => anyhow::bail!("'--index --store' pushes one repository; pass a single --store-repo"),
+    };
+
+    use cs_store::VectorStore;
+
+    let local = cs_store::read_local_index(&repo_root)?;
+    let spinner = status.create_spinner(&format!("Pushing '{}' to vector store...", repo));
+    let store = cs_store::connect(url).await?;
+    let stats = store.sync_repo(&repo, &local.model, &local.files).await?;
+    status.finish_progress(spinner, "Vector store updated");
+
+    status.success(&format!(
+        "Pushed '{}': {} files uploaded ({} chunks), {} unchanged, {} removed",
+        repo,
+        stats.files_uploaded,
+        stats.chunks_uploaded,
+        stats.files_unchanged,
+        stats.files_removed
+    ));
+    Ok(())
+}
+
+/// `--index --coordinate`: embed the changed files of `path` on workers
+/// joining at `listen`.
+fn run_coordinator(
+    status: &StatusReporter,
+    path: &Path,
+    cli: &Cli,
+    model_alias: &str,
+    listen: &str,
+) -> Result<()> {
+    use cs_index::distributed::CoordinatorEvent;
+
+    status.section_header("Coordinating Workers");
+    let repo_root = cs_index::find_repo_root(path)?;
+    let exclude_patterns = build_exclude_patterns(cli, Some(path));
+    let options = cs_index::distributed::CoordinatorOptions {
+        listen,
+        token: cli.worker_token.as_deref(),
+        respect_gitignore: !cli.no_ignore,
+        exclude_patterns: &exclude_patterns,
+        model: cli.model.is_some().then_some(model_alias),
+        min_workers: cli.min_workers,
+    };
+    if options.token.is_none() {
+        status.warn("No --worker-token set; any process on this machine may join");
+    }
+
+    let start_time = std::time::Instant::now();
+    let progress = status.create_file_progress(0, "Embedding on workers");
+    let report = |msg: String| match &progress {
+        Some(pb) => pb.println(msg),
+        None => status.info(&msg),
+    };
+    let on_event = |event: CoordinatorEvent<'_>| match event {
+        CoordinatorEvent::Listening(addr) => report(format!(
+            "Listening on {}; start workers with 'cs --worker --join <host>:{}'",
+            addr,
+            addr.port()
+        )),
+        CoordinatorEvent::WorkerJoined { peer, workers } => {
+            report(format!("Worker {} joined ({} connected)", peer, workers))
+        }
+        CoordinatorEvent::WorkerLeft {
+            peer,
+            workers,
+            error,
+        } => report(match error {
+            Some(error) => format!("Worker {} dropped ({} connected): {}", peer, workers, error),
+            None => format!("Worker {} finished ({} connected)", peer, workers),
+        }),
+        CoordinatorEvent::FileIndexed { path, done, total } => {
+            if let Some(pb) = &progress {
+                pb.set_length(total as u64);
+                pb.set_position(done as u64);
+                pb.set_message(cs_core::paths::to_relative_slash(
+                    path.strip_prefix(&repo_root).unwrap_or(path),
+                ));
+            }
+        }
+    };
+    let stats = cs_index::distributed::coordinate_index(&repo_root, &options, &on_event)?;
+    status.finish_progress(progress, "Distributed indexing complete");
+
+    status.success(&format!(
+        "Indexed {} files on {} worker(s) in {:.1}s ({} up to date, {} removed)",
+        stats.files_indexed,
+        stats.workers_joined,
+        start_time.elapsed().as_secs_f64(),
+        stats.files_up_to_date,
+        stats.files_removed
+    ));
+    if stats.files_errored > 0 {
+        status.warn(&format!("{} files failed to index", stats.files_errored));
+    }
+    Ok(())
+}
+
+/// `--index --shards`: build or refresh the per-directory shards of `path`.
+fn run_shard_build(
+    status: &StatusReporter,
+    path: &Path,
+    cli: &Cli,
+    model_alias: &str,
+) -> Result<()> {
+    status.section_header("Indexing Shards");
+    let repo_root = cs_index::find_repo_root(path)?;
+    let exclude_patterns = build_exclude_patterns(cli, Some(path));
+    let only: Vec<String> = cli
+        .shard
+        .iter()
+        .map(|name| name.trim_end_matches(['/', '\\']).to_string())
+        .collect();
+    let options = cs_index::shards::ShardBuildOptions {
+        only: &only,
+        compute_embeddings: true,
+        respect_gitignore: !cli.no_ignore,
+        exclude_patterns: &exclude_patterns,
+        // Without --model, existing shards keep the model they were built with
+        model: cli.model.is_some().then_some(model_alias),
+        jobs: cli.shard_jobs,
+        prune: true,
+        by_project: cli.project_shards,
+    };
+
+    let start_time = std::time::Instant::now();
+    let spinner = status.create_spinner(&format!(
+        "Building shards ({} at a time)...",
+        cli.shard_jobs.max(1)
+    ));
+    let results = cs_index::shards::build_shards(&repo_root, &options)?;
+    status.finish_progress(spinner, "Shards built");
+
+    for shard in &results {
+        status.info(&format!(
+            "  {}: {} indexed, {} up to date, {} removed{}",
+            shard.name,
+            shard.files_indexed,
+            shard.files_up_to_date,
+            shard.files_removed,
+            if shard.files_errored > 0 {
+                format!(", {} errors", shard.files_errored)
+            } else {
+                String::new()
+            }
+        ));
+    }
+    status.success(&format!(
+        "{} shard(s) updated in {:.1}s",
+        results.len(),
+        start_time.elapsed().as_secs_f64()
+    ));
+    Ok(())
+}
+
+async fn run_index_workflow(
+    status: &StatusReporter,
+    path: &Path,
+    cli: &Cli,
+    model_alias: &str,
+    model_config: &cs_models::ModelConfig,
+    heading: &str,
+    clean_first: bool,
+) -> Result<()> {
+    status.section_header(heading);
+    status.info(&format!("Scanning files in {}", path.display()));
 
     if model_alias == model_config.name {
         status.info(&format!(
@@ -576,8 +2011,19 @@ async fn run_index_workflow(
 
     let exclude_patterns = build_exclude_patterns(cli, Some(path));
 
+    // A rebuild keeps an index's extra vectors
+    let multi_vector = cli.multi_vector || cs_index::multi_vector::is_enabled(path);
+    let sparse_model = cs_index::sparse::sparse_model(path).or_else(|| {
+        cli.sparse
+            .then(|| cs_embed::sparse::DEFAULT_SPARSE_MODEL.to_string())
+    });
+    // Summaries describe the code, not its vectors, so a rebuild keeps them too
+    let summaries_path = cs_engine::summaries::summaries_path(path);
+    let summaries = clean_first
+        .then(|| std::fs::read(&summaries_path).ok())
+        .flatten();
     if clean_first {
-        let index_dir = path.join(".cs");
+        let index_dir = cs_core::locations::index_dir(path);
         if index_dir.exists() {
             let spinner = status.create_spinner("Removing existing index...");
             cs_index::clean_index(path)?;
@@ -586,6 +2032,26 @@ async fn run_index_workflow(
             status.info("No existing index detected; creating a fresh one");
         }
     }
+    if let Some(data) = summaries {
+        std::fs::create_dir_all(cs_core::locations::index_dir(path))?;
+        std::fs::write(&summaries_path, data)?;
+    }
+    if multi_vector && !cs_index::multi_vector::is_enabled(path) {
+        cs_index::multi_vector::enable(path)?;
+        status.info(&format!(
+            "🧩 Multi-vector: up to {} statement vectors per chunk",
+            cs_index::multi_vector::MAX_SUB_VECTORS
+        ));
+    }
+    if let Some(model) = &sparse_model
+        && cs_index::sparse::sparse_model(path).is_none()
+    {
+        cs_index::sparse::enable(path, model)?;
+        status.info(&format!(
+            "🔤 Sparse: {} term weights per chunk, fused with dense scores",
+            model
+        ));
+    }
 
     let start_time = std::time::Instant::now();
 
@@ -739,6 +2205,12 @@ async fn run_index_workflow(
     if stats.files_modified > 0 {
         status.info(&format!("  🔄 {} files updated", stats.files_modified));
     }
+    if stats.files_renamed > 0 {
+        status.info(&format!(
+            "  🔀 {} renamed files kept their chunks",
+            stats.files_renamed
+        ));
+    }
     if stats.files_up_to_date > 0 {
         status.info(&format!(
             "  ✅ {} files already current",
@@ -762,6 +2234,57 @@ async fn run_index_workflow(
     Ok(())
 }
 
+/// `--chunk`: the chunks of the files named, and of those indexing would
+/// collect under the directories named, as records for other pipelines.
+fn run_chunk_export(cli: &Cli, status: &StatusReporter) -> Result<()> {
+    let paths: Vec<PathBuf> = cli
+        .pattern
+        .iter()
+        .map(PathBuf::from)
+        .chain(cli.files.iter().cloned())
+        .collect();
+    if paths.is_empty() {
+        anyhow::bail!("--chunk requires a file or directory");
+    }
+    let registry = cs_models::ModelRegistry::default();
+    let (_, model_config) = resolve_model_selection(&registry, cli.model.as_deref())?;
+
+    let mut records = Vec::new();
+    for path in &paths {
+        let walked = path.is_dir();
+        let files = if walked {
+            let exclude_patterns = build_exclude_patterns(cli, Some(path));
+            let mut files = cs_index::collect_files(path, !cli.no_ignore, &exclude_patterns)?;
+            files.sort();
+            files
+        } else {
+            vec![path.clone()]
+        };
+        for file in files {
+            let chunks = match cs_chunk::export::chunk_file(&file, Some(&model_config.name)) {
+                Ok(chunks) => chunks,
+                // One unreadable file doesn't spoil a directory's worth
+                Err(e) if walked => {
+                    status.warn(&format!("Skipping {}: {:#}", file.display(), e));
+                    continue;
+                }
+                Err(e) => return Err(e),
+            };
+            if cli.json {
+                records.extend(chunks);
+            } else {
+                for chunk in chunks {
+                    println!("{}", serde_json::to_string(&chunk)?);
+                }
+            }
+        }
+    }
+    if cli.json {
+        println!("{}", serde_json::to_string_pretty(&records)?);
+    }
+    Ok(())
+}
+
 async fn dump_file_chunks(file_path: &PathBuf) -> Result<()> {
     use std::path::Path;
 
@@ -770,7 +2293,7 @@ async fn dump_file_chunks(file_path: &PathBuf) -> Result<()> {
     // Use the shared live chunking function
     let (lines, chunk_metas) = cs_tui::chunk_file_live(path).map_err(|err| {
         eprintln!("Error: {}", err);
-        std::process::exit(1);
+        std::process::exit(exit_code::ERROR);
     })?;
 
     // Display chunks for entire file
@@ -892,6 +2415,13 @@ async fn inspect_file_metadata(file_path: &PathBuf, status: &StatusReporter) ->
                     stride.total_strides
                 )
             })
+            .or_else(|| {
+                chunk
+                    .metadata
+                    .parent
+                    .is_some()
+                    .then(|| " [outline]".to_string())
+            })
             .unwrap_or_default();
 
         // Simple preview - first 80 chars
@@ -942,7 +2472,18 @@ async fn inspect_file_metadata(file_path: &PathBuf, status: &StatusReporter) ->
 
 #[tokio::main]
 async fn main() {
-    if let Err(e) = run_main().await {
+    let cli = Cli::parse();
+    let quiet = cli.quiet;
+    if let Err(e) = run_main(cli).await {
+        // Failed requests to remote providers say what to check
+        let hint = cs_core::network::explain(&format!("{:#}", e));
+        if quiet {
+            eprintln!("Error: {:#}", e);
+            if let Some(hint) = &hint {
+                eprintln!("Hint: {}", hint);
+            }
+            std::process::exit(exit_code::ERROR);
+        }
         eprintln!("DETAILED ERROR: {:#}", e);
         eprintln!("DEBUG: Error occurred in main");
 
@@ -952,22 +2493,69 @@ async fn main() {
             eprintln!("CAUSED BY: {}", err);
             source = err.source();
         }
+        if let Some(hint) = hint {
+            eprintln!("HINT: {}", hint);
+        }
 
-        std::process::exit(1);
+        std::process::exit(exit_code::ERROR);
     }
 }
 
-async fn run_main() -> Result<()> {
-    let cli = Cli::parse();
-
+async fn run_main(cli: Cli) -> Result<()> {
     if cli.print_default_csignore {
         print!("{}", get_default_csignore_content());
         return Ok(());
     }
 
+    if cli.type_list {
+        for name in cs_index::file_filter::type_names() {
+            println!("{}", name);
+        }
+        return Ok(());
+    }
+
+    if let Some(format) = cli.tool_schema.as_deref() {
+        let format: tool_schema::ToolFormat = format.parse().map_err(anyhow::Error::msg)?;
+        let tools = mcp_server::CcMcpServer::tool_definitions();
+        println!(
+            "{}",
+            serde_json::to_string_pretty(&tool_schema::manifest(&tools, format))?
+        );
+        return Ok(());
+    }
+
+    if let Some(ref device) = cli.device {
+        cs_embed::set_device(device.parse()?)?;
+    }
+
+    configure_index_location(&cli)?;
+    configure_network(&cli);
+    configure_path_matching(&cli);
+    cs_index::extractors::set_allow_all(cli.allow_extractors);
+    cs_index::extractors::set_trusted_roots(load_trusted_extractor_roots());
+
     // Handle MCP server mode first
     if cli.serve {
-        return run_mcp_server().await;
+        return run_mcp_server(
+            schedule_rules(&cli)?,
+            LimitFlags::new(&cli)?,
+            warm::Preload::from_flags(cli.preload, cli.mlock),
+            cli.health_addr.as_deref(),
+            cli.otlp_endpoint.as_deref(),
+        )
+        .await;
+    }
+
+    if cli.editor_rpc || cli.editor_socket.is_some() {
+        return run_editor_rpc(
+            cli.editor_socket.as_deref(),
+            schedule_rules(&cli)?,
+            LimitFlags::new(&cli)?,
+            warm::Preload::from_flags(cli.preload, cli.mlock),
+            cli.health_addr.as_deref(),
+            cli.otlp_endpoint.as_deref(),
+        )
+        .await;
     }
 
     // Handle TUI mode
@@ -983,23 +2571,24 @@ async fn run_main() -> Result<()> {
 
     // Handle configuration command
     if !cli.config.is_empty() {
-        return handle_config_command(&cli.config);
+        return handle_config_command(&cli.config, cli.origin);
     }
 
     // Regular CLI mode
     run_cli_mode(cli).await
 }
 
-fn handle_config_command(args: &[String]) -> Result<()> {
+fn handle_config_command(args: &[String], show_origin: bool) -> Result<()> {
     if args.is_empty() {
         eprintln!("Error: --config requires a subcommand");
         eprintln!("Usage:");
         eprintln!("  cs --config init");
         eprintln!("  cs --config list");
+        eprintln!("  cs --config show [--origin]");
         eprintln!("  cs --config get KEY");
         eprintln!("  cs --config set KEY VALUE");
         eprintln!("  cs --config path");
-        std::process::exit(1);
+        std::process::exit(exit_code::ERROR);
     }
 
     let subcmd = &args[0];
@@ -1012,7 +2601,7 @@ fn handle_config_command(args: &[String]) -> Result<()> {
                 }
                 Err(e) => {
                     eprintln!("Error: Failed to determine config path: {}", e);
-                    std::process::exit(1);
+                    std::process::exit(exit_code::ERROR);
                 }
             }
         }
@@ -1022,7 +2611,7 @@ fn handle_config_command(args: &[String]) -> Result<()> {
                     if path.exists() {
                         eprintln!("⚠️  Config file already exists at: {}", path.display());
                         eprintln!("Use 'cs --config set' to modify existing configuration");
-                        std::process::exit(1);
+                        std::process::exit(exit_code::ERROR);
                     }
 
                     let config = cs_models::UserConfig::default();
@@ -1042,13 +2631,13 @@ fn handle_config_command(args: &[String]) -> Result<()> {
                         }
                         Err(e) => {
                             eprintln!("Error: Failed to save config: {}", e);
-                            std::process::exit(1);
+                            std::process::exit(exit_code::ERROR);
                         }
                     }
                 }
                 Err(e) => {
                     eprintln!("Error: Failed to determine config path: {}", e);
-                    std::process::exit(1);
+                    std::process::exit(exit_code::ERROR);
                 }
             }
         }
@@ -1056,7 +2645,7 @@ fn handle_config_command(args: &[String]) -> Result<()> {
             if args.len() < 2 {
                 eprintln!("Error: 'get' requires a KEY argument");
                 eprintln!("Usage: cs --config get KEY");
-                std::process::exit(1);
+                std::process::exit(exit_code::ERROR);
             }
             let key = &args[1];
 
@@ -1067,13 +2656,13 @@ fn handle_config_command(args: &[String]) -> Result<()> {
                         Ok(())
                     } else {
                         eprintln!("Error: Unknown configuration key: {}", key);
-                        std::process::exit(1);
+                        std::process::exit(exit_code::ERROR);
                     }
                 }
                 Err(e) => {
                     eprintln!("Error: Failed to load config: {}", e);
                     eprintln!("Run 'cs --config init' to create a config file");
-                    std::process::exit(1);
+                    std::process::exit(exit_code::ERROR);
                 }
             }
         }
@@ -1081,12 +2670,13 @@ fn handle_config_command(args: &[String]) -> Result<()> {
             if args.len() < 3 {
                 eprintln!("Error: 'set' requires KEY and VALUE arguments");
                 eprintln!("Usage: cs --config set KEY VALUE");
-                std::process::exit(1);
+                std::process::exit(exit_code::ERROR);
             }
             let key = &args[1];
             let value = &args[2];
 
-            match cs_models::UserConfig::load() {
+            // Only the user's file is written, not what other layers merged in
+            match cs_models::UserConfig::load_user() {
                 Ok(mut config) => {
                     match config.set(key, value) {
                         Ok(()) => {
@@ -1097,20 +2687,20 @@ fn handle_config_command(args: &[String]) -> Result<()> {
                                 }
                                 Err(e) => {
                                     eprintln!("Error: Failed to save config: {}", e);
-                                    std::process::exit(1);
+                                    std::process::exit(exit_code::ERROR);
                                 }
                             }
                         }
                         Err(e) => {
                             eprintln!("Error: {}", e);
-                            std::process::exit(1);
+                            std::process::exit(exit_code::ERROR);
                         }
                     }
                 }
                 Err(e) => {
                     eprintln!("Error: Failed to load config: {}", e);
                     eprintln!("Run 'cs --config init' to create a config file");
-                    std::process::exit(1);
+                    std::process::exit(exit_code::ERROR);
                 }
             }
         }
@@ -1127,13 +2717,20 @@ fn handle_config_command(args: &[String]) -> Result<()> {
                     println!("  query-model: {}", config.query_model);
                     println!("  default-topk: {}", config.default_topk);
                     println!("  default-threshold: {}", config.default_threshold);
+                    println!(
+                        "  default-hybrid-threshold: {}",
+                        config.default_hybrid_threshold
+                    );
                     println!("  default-search-mode: {}", config.default_search_mode);
+                    println!("  max-typos: {}", config.max_typos);
                     println!("  default-output-format: {}", config.default_output_format);
                     println!("  show-scores-default: {}", config.show_scores_default);
                     println!("  line-numbers-default: {}", config.line_numbers_default);
                     println!("  rerank-enabled: {}", config.rerank_enabled);
                     println!("  rerank-model: {}", config.rerank_model);
                     println!("  quiet-mode: {}", config.quiet_mode);
+                    println!("  query-analytics: {}", config.query_analytics);
+                    println!("  index-segments: {}", config.index_segments);
                     Ok(())
                 }
                 Err(_) => {
@@ -1143,475 +2740,3557 @@ fn handle_config_command(args: &[String]) -> Result<()> {
                 }
             }
         }
+        "show" => {
+            let dir = std::env::current_dir().unwrap_or_else(|_| PathBuf::from("."));
+            let layered = match cs_models::UserConfig::load_layered(&dir) {
+                Ok(layered) => layered,
+                Err(e) => {
+                    eprintln!("Error: Failed to load config: {}", e);
+                    std::process::exit(exit_code::ERROR);
+                }
+            };
+            print_layered_config(&layered, show_origin);
+            Ok(())
+        }
         _ => {
             eprintln!("Error: Unknown config subcommand: {}", subcmd);
-            eprintln!("Valid subcommands: init, list, get, set, path");
-            std::process::exit(1);
+            eprintln!("Valid subcommands: init, list, show, get, set, path");
+            std::process::exit(exit_code::ERROR);
+        }
+    }
+}
+
+/// `--config show`: every effective value, and with `--origin` the layer
+/// that set it.
+fn print_layered_config(layered: &cs_models::LayeredConfig, show_origin: bool) {
+    if layered.files.is_empty() {
+        println!("📄 No config files; built-in defaults apply");
+    } else {
+        println!("📄 Config files, lowest precedence first:");
+        for file in &layered.files {
+            println!("  {}", file);
+        }
+    }
+    println!("\n📋 Effective configuration (command-line flags override it):");
+    let width = layered.values.keys().map(String::len).max().unwrap_or(0);
+    for (key, value) in &layered.values {
+        let rules = match value {
+            toml::Value::Array(items) if items.iter().all(toml::Value::is_table) => {
+                Some(items.len())
+            }
+            _ => None,
+        };
+        let shown = match rules {
+            Some(count) => format!("{} rule{}", count, if count == 1 { "" } else { "s" }),
+            None => value.to_string(),
+        };
+        if !show_origin {
+            println!("  {:<width$} = {}", key, shown, width = width);
+            continue;
+        }
+        let origins = layered
+            .origins
+            .get(key)
+            .map(Vec::as_slice)
+            .unwrap_or_default();
+        // Every layer adds to a rule list; for a value the last one wins
+        let origin = if rules.is_some() {
+            origins
+                .iter()
+                .map(ToString::to_string)
+                .collect::<Vec<_>>()
+                .join(" + ")
+        } else {
+            origins.last().map(ToString::to_string).unwrap_or_default()
+        };
+        println!(
+            "  {:<width$} = {}  {}",
+            key,
+            shown,
+            style(format!("({})", origin)).dim(),
+            width = width
+        );
+    }
+}
+
+/// `--notes`: every note in file order, or with a PATTERN, the best matches.
+fn list_notes(
+    cli: &Cli,
+    index_root: &Path,
+    store: &mut cs_engine::notes::NoteStore,
+    status: &StatusReporter,
+) -> Result<()> {
+    use cs_engine::notes::NoteLocation;
+
+    let locations = store.relocate(index_root);
+    if locations
+        .iter()
+        .any(|location| matches!(location, NoteLocation::Moved(_)))
+    {
+        // Keep the shared file in step with the code it annotates
+        store.save(index_root)?;
+    }
+
+    let ranked: Vec<(usize, Option<f32>)> = match cli.pattern.as_deref() {
+        Some(query) => {
+            cs_engine::notes::search_notes(index_root, store, query, cli.model.as_deref())?
+                .into_iter()
+                .take(cli.top_k.unwrap_or(10))
+                .map(|(i, score)| (i, Some(score)))
+                .collect()
+        }
+        None => {
+            let mut order: Vec<usize> = (0..store.notes.len()).collect();
+            order.sort_by(|&a, &b| {
+                let (a, b) = (&store.notes[a], &store.notes[b]);
+                (&a.path, a.line).cmp(&(&b.path, b.line))
+            });
+            order.into_iter().map(|i| (i, None)).collect()
+        }
+    };
+
+    for (i, score) in &ranked {
+        let note = &store.notes[*i];
+        let location = locations[*i];
+        if cli.json || cli.jsonl {
+            println!(
+                "{}",
+                serde_json::json!({
+                    "id": note.id,
+                    "path": note.path,
+                    "line": location.line(),
+                    "text": note.text,
+                    "status": match location {
+                        NoteLocation::InPlace(_) => "in_place",
+                        NoteLocation::Moved(_) => "moved",
+                        NoteLocation::Orphaned => "orphaned",
+                    },
+                    "score": score,
+                    "created": note.created,
+                })
+            );
+            continue;
+        }
+        let score = score.map_or(String::new(), |score| format!("[{:.3}] ", score));
+        let marker = match location {
+            NoteLocation::InPlace(_) => String::new(),
+            NoteLocation::Moved(_) => format!(" {}", style("(moved)").dim()),
+            NoteLocation::Orphaned => format!(" {}", style("(orphaned: code not found)").red()),
+        };
+        println!(
+            "{}{}:{}{} {}",
+            score,
+            style(&note.path).cyan().bold(),
+            style(note.line).yellow(),
+            marker,
+            style(format!("[{}]", note.id)).dim()
+        );
+        println!("    {}", note.text);
+    }
+    if ranked.is_empty() && !cli.json && !cli.jsonl {
+        status.info(&format!(
+            "No notes yet; add one with cs --note-add path:line \"text\" ({})",
+            index_root.join(cs_engine::notes::NOTES_FILE).display()
+        ));
+    }
+    Ok(())
+}
+
+/// A span of `seconds` as whole days, or hours under a day.
+fn format_memory_age(seconds: u64) -> String {
+    match seconds {
+        0..86_400 => format!("{}h", seconds.div_ceil(3600)),
+        _ => format!("{}d", seconds.div_ceil(86_400)),
+    }
+}
+
+/// `--memories`: the live memories of `repo_root`, oldest first.
+fn list_memories(cli: &Cli, repo_root: &Path, status: &StatusReporter) -> Result<()> {
+    let store = cs_index::memories::load(repo_root)?;
+    let now = std::time::SystemTime::now()
+        .duration_since(std::time::SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0);
+    let mut listed = 0;
+    for memory in store.live() {
+        listed += 1;
+        if cli.json || cli.jsonl {
+            println!(
+                "{}",
+                serde_json::json!({
+                    "id": memory.id,
+                    "text": memory.text,
+                    "created": memory.created,
+                    "expires": memory.expires,
+                    "provenance": memory.provenance,
+                })
+            );
+            continue;
+        }
+        let source = &memory.provenance;
+        let mut details = vec![format!(
+            "{} ago",
+            format_memory_age(now.saturating_sub(memory.created))
+        )];
+        details.push(match memory.expires {
+            Some(expires) => format!("expires in {}", format_memory_age(expires - now)),
+            None => "never expires".to_string(),
+        });
+        if let Some(agent) = &source.agent {
+            details.push(format!("by {}", agent));
+        }
+        if !source.files.is_empty() {
+            details.push(format!("about {}", source.files.join(", ")));
+        }
+        println!(
+            "{} {}",
+            style(format!("[{}]", memory.id)).dim(),
+            style(details.join(", ")).cyan()
+        );
+        println!("    {}", memory.text);
+    }
+    if listed == 0 && !cli.json && !cli.jsonl {
+        status.info("No memories yet; keep one with cs --remember \"text\"");
+    }
+    Ok(())
+}
+
+/// `[[schedule]]` rules from config.toml followed by `--schedule` ones.
+fn schedule_rules(cli: &Cli) -> Result<Vec<cs_core::ScheduleRule>> {
+    let mut rules = match cs_models::UserConfig::load() {
+        Ok(config) => config.schedule,
+        Err(e) => {
+            tracing::warn!("Ignoring [[schedule]] config: {}", e);
+            Vec::new()
+        }
+    };
+    for rule in &cli.schedule {
+        rules.push(schedule::parse_rule(rule)?);
+    }
+    Ok(rules)
+}
+
+/// `--rate-limit` and `--daily-quota`, which override the defaults of
+/// `[limits]` in config.toml each time it is read.
+#[derive(Debug, Clone, Copy)]
+struct LimitFlags {
+    rate_per_minute: Option<f64>,
+    daily_queries: Option<u64>,
+}
+
+impl LimitFlags {
+    fn new(cli: &Cli) -> Result<Self> {
+        if let Some(rate) = cli.rate_limit
+            && (!rate.is_finite() || rate <= 0.0)
+        {
+            anyhow::bail!("--rate-limit must be a positive number of searches per minute");
+        }
+        Ok(Self {
+            rate_per_minute: cli.rate_limit,
+            daily_queries: cli.daily_quota,
+        })
+    }
+
+    fn apply(self, mut limits: cs_core::LimitsConfig) -> cs_core::LimitsConfig {
+        if self.rate_per_minute.is_some() {
+            limits.rate_per_minute = self.rate_per_minute;
+        }
+        if self.daily_queries.is_some() {
+            limits.daily_queries = self.daily_queries;
+        }
+        limits
+    }
+}
+
+/// The user config a daemon starts with; an unreadable one shouldn't keep
+/// it from serving.
+fn daemon_user_config() -> cs_models::UserConfig {
+    cs_models::UserConfig::load().unwrap_or_else(|e| {
+        tracing::warn!("Ignoring the user config: {}", e);
+        cs_models::UserConfig::default()
+    })
+}
+
+/// Apply what a daemon takes from the user config: search settings,
+/// `[[redact]]` rules, `[limits]`, `[usage]` and, for the editor daemon,
+/// `[[tenant]]`s.
+/// Done at start and again on every SIGHUP; nothing is applied if any of it
+/// is invalid. Returns a summary for the log.
+fn apply_daemon_config(
+    config: cs_models::UserConfig,
+    flags: LimitFlags,
+    repo_root: &Path,
+    with_tenants: bool,
+) -> Result<String> {
+    let mut limits = flags.apply(config.limits.clone().unwrap_or_default());
+    let tenants = if with_tenants {
+        tenants::Tenants::new(config.tenant.clone())?
+    } else {
+        tenants::Tenants::default()
+    };
+    limits
+        .keys
+        .extend(tenants.iter().map(cs_core::TenantConfig::api_key));
+    let tenant_roots = tenants
+        .iter()
+        .map(|tenant| (tenant.name.clone(), tenant.root.clone()))
+        .collect();
+    let settings = reload::Settings::from_config(&config);
+
+    let summary = format!(
+        "{} boost, {} stop-symbol and {} redaction rules, {} API keys",
+        settings.boost_rules.len(),
+        settings.stop_symbol_rules.len(),
+        config.redact.len(),
+        limits.keys.len()
+    );
+    reload::set(settings);
+    cs_index::redaction::set_user_rules(config.redact);
+    cs_index::fixtures::set_rules(config.fixture);
+    cs_index::extractors::set_trusted_roots(config.trusted_extractor_roots);
+    cs_index::segments::set_enabled(config.index_segments);
+    quota::configure(limits, repo_root, tenant_roots);
+    usage::configure(config.usage, repo_root);
+    if with_tenants {
+        tenants::configure(tenants);
+    }
+    Ok(summary)
+}
+
+/// Preload the daemon's index as `--preload` or `--mlock` asked, before it
+/// takes queries.
+async fn preload_index(root: &Path, preload: warm::Preload) -> Result<warm::Preloaded> {
+    let root = root.to_path_buf();
+    let preloaded = tokio::task::spawn_blocking(move || warm::preload(&root, preload)).await??;
+    if preload != warm::Preload::Off {
+        tracing::info!("{}", preloaded.summary());
+    }
+    Ok(preloaded)
+}
+
+async fn run_editor_rpc(
+    socket_path: Option<&Path>,
+    schedule: Vec<cs_core::ScheduleRule>,
+    limit_flags: LimitFlags,
+    preload: warm::Preload,
+    health_addr: Option<&str>,
+    otlp_endpoint: Option<&str>,
+) -> Result<()> {
+    // stdout carries the protocol, so logs go to stderr
+    let _telemetry = telemetry::init(std::io::stderr, tracing::Level::WARN, otlp_endpoint)?;
+    // Updates from watching the tree return without waiting on merges
+    cs_index::segments::merge_in_background();
+
+    let root = std::env::current_dir()?;
+    let repo_root = cs_index::find_repo_root(&root).unwrap_or_else(|_| root.clone());
+    apply_daemon_config(daemon_user_config(), limit_flags, &repo_root, true)?;
+    let served_tenants = tenants::current();
+    // Each tenant's own repositories are kept up to date instead
+    let repositories: Vec<PathBuf> = match &served_tenants {
+        Some(tenants) => tenants.iter().map(|tenant| tenant.root.clone()).collect(),
+        None => vec![root.clone()],
+    };
+    let serves_tenants = served_tenants.is_some();
+    let _reload = reload::on_hangup(move || {
+        let config = cs_models::UserConfig::load()?;
+        // Tenants decide who may connect to the socket at all
+        if config.tenant.is_empty() == serves_tenants {
+            anyhow::bail!(
+                "Adding the first [[tenant]] or removing the last needs a restart of the daemon"
+            );
         }
+        apply_daemon_config(config, limit_flags, &repo_root, true)
+    })?;
+    // Held until the daemon exits
+    let mut preloaded = Vec::new();
+    let mut upkeep = Vec::new();
+    for repository in &repositories {
+        preloaded.push(preload_index(repository, preload).await?);
+        upkeep.push(schedule::spawn(repository.clone(), schedule.clone())?);
+    }
+    let _health = health::start(root.clone(), health_addr).await?;
+    match socket_path {
+        #[cfg(unix)]
+        Some(socket_path) => editor_rpc::serve_unix(root, socket_path).await,
+        #[cfg(not(unix))]
+        Some(_) => anyhow::bail!("--editor-socket needs Unix sockets; use --editor-rpc over stdio"),
+        None => editor_rpc::serve_stdio(root).await,
     }
 }
 
-async fn run_mcp_server() -> Result<()> {
+async fn run_mcp_server(
+    schedule: Vec<cs_core::ScheduleRule>,
+    limit_flags: LimitFlags,
+    preload: warm::Preload,
+    health_addr: Option<&str>,
+    otlp_endpoint: Option<&str>,
+) -> Result<()> {
     // Configure service-safe logging for MCP mode (no stdout pollution)
-    tracing_subscriber::fmt()
-        .with_writer(std::io::stderr)
-        .with_env_filter(
-            tracing_subscriber::EnvFilter::from_default_env()
-                .add_directive(tracing::Level::INFO.into()),
-        )
-        .init();
+    let _telemetry = telemetry::init(std::io::stderr, tracing::Level::INFO, otlp_endpoint)?;
+    cs_index::segments::merge_in_background();
 
     let cwd = std::env::current_dir()?;
+    let repo_root = cs_index::find_repo_root(&cwd).unwrap_or_else(|_| cwd.clone());
+    apply_daemon_config(daemon_user_config(), limit_flags, &repo_root, false)?;
+    let _reload = reload::on_hangup(move || {
+        let config = cs_models::UserConfig::load()?;
+        apply_daemon_config(config, limit_flags, &repo_root, false)
+    })?;
+    let _preloaded = preload_index(&cwd, preload).await?;
+    let _upkeep = schedule::spawn(cwd.clone(), schedule)?;
+    let _health = health::start(cwd.clone(), health_addr).await?;
     let server = mcp_server::CcMcpServer::new(cwd)?;
     server.run().await
 }
 
-async fn run_cli_mode(cli: Cli) -> Result<()> {
+async fn run_cli_mode(mut cli: Cli) -> Result<()> {
     // Regular CLI mode logging
-    tracing_subscriber::fmt()
-        .with_env_filter(
-            tracing_subscriber::EnvFilter::from_default_env()
-                .add_directive(tracing::Level::WARN.into()),
-        )
-        .init();
+    let _telemetry = telemetry::init(
+        std::io::stdout,
+        tracing::Level::WARN,
+        cli.otlp_endpoint.as_deref(),
+    )?;
 
     let status = StatusReporter::new(cli.quiet);
+    cs_index::secrets::set_policy(cli.secret_policy);
+    cs_index::redaction::set_user_rules(load_redaction_rules());
+    cs_index::fixtures::set_rules(load_fixture_rules());
+    cs_index::segments::set_enabled(load_index_segments());
+    cs_index::read_limits::set_max_file_size(cli.max_file_size);
+    cs_index::read_limits::set_skip_minified(!cli.include_minified);
+    cs_index::traversal::set_symlink_policy(cli.symlinks);
+    cs_index::traversal::set_submodule_policy(cli.submodules);
+    cs_index::traversal::set_worktree_policy(cli.worktrees);
+    cs_index::eviction::set_budget(cli.max_index_size, cli.evict_policy.clone());
 
     // Handle command flags first (these take precedence over search)
-    if let Some(model_name) = cli.switch_model.as_deref() {
+    if let Some(result_id) = cli.feedback.as_deref() {
+        if !cli.relevant && !cli.irrelevant {
+            return Err(anyhow::anyhow!(
+                "--feedback requires either --relevant or --irrelevant"
+            ));
+        }
+        let query = cli.pattern.as_deref().ok_or_else(|| {
+            anyhow::anyhow!("--feedback requires the query the result was returned for, e.g. cs --feedback src/auth.rs:42 --relevant \"token refresh\"")
+        })?;
         let path = cli
             .files
             .first()
             .cloned()
             .unwrap_or_else(|| PathBuf::from("."));
 
-        let registry = cs_models::ModelRegistry::default();
-        let (model_alias, model_config) = resolve_model_selection(&registry, Some(model_name))?;
+        let index_root = cs_engine::feedback::record_feedback(&path, result_id, query, cli.relevant)?;
+        status.success(&format!(
+            "Marked {} as {} for \"{}\"",
+            result_id,
+            if cli.relevant { "relevant" } else { "irrelevant" },
+            query
+        ));
+        status.info(&format!(
+            "Feedback stored in {}",
+            cs_core::locations::index_dir(&index_root)
+                .join("feedback.json")
+                .display()
+        ));
+        return Ok(());
+    }
 
-        if !cli.force {
-            let manifest_path = path.join(".cs").join("manifest.json");
-            if manifest_path.exists()
-                && let Ok(data) = std::fs::read(&manifest_path)
-                && let Ok(manifest) = serde_json::from_slice::<cs_index::IndexManifest>(&data)
-                && let Some(existing_model) = manifest.embedding_model.clone()
-                && let Ok((existing_alias, existing_config)) =
-                    resolve_model_selection(&registry, Some(existing_model.as_str()))
-                && existing_config.name == model_config.name
-            {
-                status.section_header("Switching Embedding Model");
-                let dims = manifest
-                    .embedding_dimensions
-                    .unwrap_or(existing_config.dimensions);
+    if let Some(location) = cli.note_add.as_deref() {
+        let text = cli.pattern.as_deref().ok_or_else(|| {
+            anyhow::anyhow!("--note-add requires the note text, e.g. cs --note-add src/http.rs:88 \"this is the retry hotfix\"")
+        })?;
+        let (index_root, note) = cs_engine::notes::add_note(location, text)?;
+        status.success(&format!(
+            "Added note {} at {}:{}",
+            note.id, note.path, note.line
+        ));
+        status.info(&format!(
+            "Notes stored in {}",
+            index_root.join(cs_engine::notes::NOTES_FILE).display()
+        ));
+        return Ok(());
+    }
 
-                if existing_alias == existing_config.name {
-                    status.info(&format!(
-                        "Index already uses {} ({} dims)",
-                        existing_config.name, dims
-                    ));
-                } else {
-                    status.info(&format!(
-                        "Index already uses {} (alias '{}', {} dims)",
-                        existing_config.name, existing_alias, dims
-                    ));
-                }
+    if let Some(location) = cli.pin_add.as_deref() {
+        let (index_root, pin) = cs_engine::pins::add_pin(location)?;
+        status.success(&format!("Pinned {}", pin.location()));
+        status.info(&format!(
+            "Pins stored in {}",
+            index_root.join(cs_engine::pins::PINS_FILE).display()
+        ));
+        return Ok(());
+    }
 
-                status.success("No rebuild required; index already on requested model");
-                status.info(&format!(
-                    "Use '--switch-model {} --force' to rebuild anyway",
-                    model_name
-                ));
-                return Ok(());
+    if let Some(location) = cli.pin_remove.as_deref() {
+        let (_, pin) = cs_engine::pins::remove_pin(location)?;
+        status.success(&format!("Unpinned {}", pin.location()));
+        return Ok(());
+    }
+
+    if cli.pins {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::pins::pins_root(&path)?;
+        let store = cs_engine::pins::PinStore::load(&index_root)?;
+        for pin in &store.pins {
+            let lines = cs_engine::pins::symbol_lines(&index_root, &pin.path, &pin.symbol);
+            let span = lines
+                .iter()
+                .map(|&(start, _)| start)
+                .min()
+                .zip(lines.iter().map(|&(_, end)| end).max());
+            if cli.json || cli.jsonl {
+                println!(
+                    "{}",
+                    serde_json::json!({
+                        "path": pin.path,
+                        "symbol": pin.symbol,
+                        "line_start": span.map(|(start, _)| start),
+                        "line_end": span.map(|(_, end)| end),
+                        "added": pin.added,
+                    })
+                );
+                continue;
             }
+            let lines = match span {
+                Some((start, end)) => format!("{}-{}", style(start).yellow(), style(end).yellow()),
+                None => style("(not in the index)").red().to_string(),
+            };
+            println!(
+                "{}:{} {}",
+                style(&pin.path).cyan().bold(),
+                lines,
+                style(&pin.symbol).bold()
+            );
+        }
+        if store.pins.is_empty() && !cli.json && !cli.jsonl {
+            status.info(&format!(
+                "Nothing pinned yet; pin a symbol with cs --pin-add path:Symbol ({})",
+                index_root.join(cs_engine::pins::PINS_FILE).display()
+            ));
         }
-
-        run_index_workflow(
-            &status,
-            &path,
-            &cli,
-            model_alias.as_str(),
-            &model_config,
-            "Switching Embedding Model",
-            true,
-        )
-        .await?;
         return Ok(());
     }
 
-    if cli.index {
+    if cli.notes || cli.note_remove.is_some() {
         let path = cli
             .files
             .first()
             .cloned()
             .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::notes::notes_root(&path)?;
+        let mut store = cs_engine::notes::NoteStore::load(&index_root)?;
+        if let Some(id) = cli.note_remove.as_deref() {
+            let note = store.remove(id)?;
+            store.save(&index_root)?;
+            status.success(&format!(
+                "Removed note {} at {}:{}",
+                note.id, note.path, note.line
+            ));
+            return Ok(());
+        }
+        return list_notes(&cli, &index_root, &mut store, &status);
+    }
 
-        let registry = cs_models::ModelRegistry::default();
-        let (model_alias, model_config) = resolve_model_selection(&registry, cli.model.as_deref())?;
+    if cli.remember || cli.memories || cli.forget.is_some() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        if let Some(id) = cli.forget.as_deref() {
+            let memory = cs_index::memories::forget(&repo_root, id)?;
+            status.success(&format!("Forgot memory {}", memory.id));
+            return Ok(());
+        }
+        if cli.memories {
+            return list_memories(&cli, &repo_root, &status);
+        }
+        let text = cli.pattern.as_deref().ok_or_else(|| {
+            anyhow::anyhow!("--remember requires the memory text, e.g. cs --remember \"run make db before the integration tests\"")
+        })?;
+        let ttl = match cli.ttl.as_deref() {
+            Some(ttl) => cs_index::memories::parse_ttl(ttl).map_err(|e| anyhow::anyhow!(e))?,
+            None => Some(cs_index::memories::DEFAULT_TTL_SECS),
+        };
+        let provenance = cs_index::memories::Provenance {
+            agent: cli.agent.clone(),
+            session: cli.agent_session.clone(),
+            files: cli.about.clone(),
+            commit: None,
+        };
+        let memory =
+            cs_index::memories::remember(&repo_root, text, ttl, provenance, cli.model.as_deref())?;
+        status.success(&format!("Remembered {}", memory.id));
+        status.info(&match memory.expires {
+            Some(expires) => format!(
+                "Searched with the code as collection:memory for {}",
+                format_memory_age(expires - memory.created)
+            ),
+            None => "Searched with the code as collection:memory until forgotten".to_string(),
+        });
+        return Ok(());
+    }
 
-        run_index_workflow(
-            &status,
-            &path,
-            &cli,
-            model_alias.as_str(),
-            &model_config,
-            "Indexing Repository",
-            false,
-        )
-        .await?;
+    if cli.worker
+        && let Some(coordinator) = cli.join.as_deref()
+    {
+        status.section_header("Embedding Worker");
+        let spinner = status.create_spinner(&format!("Joining coordinator at {}...", coordinator));
+        let spinner_ref = &spinner;
+        let stats =
+            cs_index::distributed::run_worker(coordinator, cli.worker_token.as_deref(), |model| {
+                if let Some(pb) = spinner_ref {
+                    pb.set_message(format!("Embedding batches with {}...", model));
+                }
+            })?;
+        status.finish_progress(spinner, "Coordinator finished");
+        status.success(&format!(
+            "Embedded {} chunks in {} batches with {}",
+            stats.chunks, stats.batches, stats.model
+        ));
         return Ok(());
     }
 
-    if cli.clean || cli.clean_orphans {
-        // Handle --clean and --clean-orphans flags
-        let clean_path = cli
+    if !cli.merge_shards.is_empty() {
+        let path = cli
             .files
             .first()
             .cloned()
             .unwrap_or_else(|| PathBuf::from("."));
-        let orphans_only = cli.clean_orphans;
-
-        if orphans_only {
-            status.section_header("Cleaning Orphaned Files");
-            status.info(&format!("Scanning for orphans in {}", clean_path.display()));
-
-            // Build exclusion patterns using unified builder
-            let exclude_patterns = build_exclude_patterns(&cli, Some(&clean_path));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let spinner = status.create_spinner("Merging shards...");
+        let merged = cs_index::shards::merge_shards(&repo_root, &cli.merge_shards)?;
+        status.finish_progress(spinner, "Shards merged");
+        if merged.is_empty() {
+            status.info("No shards to merge");
+        } else {
+            status.success(&format!(
+                "Merged {} shard(s): {}",
+                merged.len(),
+                merged.join(", ")
+            ));
+        }
+        return Ok(());
+    }
 
-            let cleanup_spinner = status.create_spinner("Removing orphaned entries...");
-            let cleanup_stats =
-                cs_index::cleanup_index(&clean_path, !cli.no_ignore, &exclude_patterns)?;
-            status.finish_progress(cleanup_spinner, "Cleanup complete");
+    if cli.secrets {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let log = cs_index::secrets::load_secrets_log(&repo_root)?.unwrap_or_default();
+        let placeholders = cs_index::redaction::load_redaction_map(&repo_root)?;
+
+        if cli.json || cli.jsonl {
+            for (file, chunks) in &log.files {
+                for chunk in chunks {
+                    println!(
+                        "{}",
+                        serde_json::json!({
+                            "file": file,
+                            "line_start": chunk.line_start,
+                            "line_end": chunk.line_end,
+                            "rules": chunk.rules,
+                            "action": chunk.action,
+                        })
+                    );
+                }
+            }
+            for (placeholder, original) in &placeholders {
+                println!(
+                    "{}",
+                    serde_json::json!({
+                        "placeholder": placeholder,
+                        "original": original,
+                    })
+                );
+            }
+        } else {
+            for (file, chunks) in &log.files {
+                for chunk in chunks {
+                    let action = match chunk.action {
+                        cs_index::secrets::SecretPolicy::Redact => "redacted",
+                        cs_index::secrets::SecretPolicy::Skip => "skipped",
+                    };
+                    println!(
+                        "{}:{}-{}: {} ({})",
+                        style(file).cyan().bold(),
+                        style(chunk.line_start).yellow(),
+                        style(chunk.line_end).yellow(),
+                        action,
+                        chunk.rules.join(", ")
+                    );
+                }
+            }
+            for (placeholder, original) in &placeholders {
+                println!("{} = {}", style(placeholder).yellow(), original);
+            }
+        }
+        if log.files.is_empty() && placeholders.is_empty() {
+            status.info("Nothing was withheld from remote embedders");
+        }
+        return Ok(());
+    }
 
-            if cleanup_stats.orphaned_entries_removed > 0
-                || cleanup_stats.orphaned_sidecars_removed > 0
-            {
-                status.success(&format!(
-                    "Removed {} orphaned entries and {} orphaned sidecars",
-                    cleanup_stats.orphaned_entries_removed, cleanup_stats.orphaned_sidecars_removed
-                ));
+    if cli.usage_export {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path).unwrap_or(path);
+        let config = cs_models::UserConfig::load().unwrap_or_default();
+        let mut settings = usage::ExportSettings::from_config(config.usage.as_ref());
+        if let Some(k) = cli.k_anonymity {
+            settings.k_anonymity = k as usize;
+        }
+        if cli.dp_epsilon.is_some() {
+            settings.epsilon = cli.dp_epsilon;
+        }
+        let since = chrono::Local::now().date_naive()
+            - chrono::Days::new(u64::from(cli.usage_days.max(1)) - 1);
+        let events = usage::load(&repo_root, &since.format("%Y-%m-%d").to_string())?;
+        if events.is_empty() {
+            if config.usage.is_some_and(|usage| usage.enabled) {
+                status.warn("No daemon requests recorded in that time");
             } else {
-                status.info("No orphaned files found");
+                status.warn(
+                    "No usage recorded; enable it with [usage] enabled = true in config.toml",
+                );
             }
-        } else {
-            status.section_header("Cleaning Index");
+            std::process::exit(exit_code::NO_MATCHES);
+        }
+        let export = usage::export(&events, settings)?;
+        if export.total.is_none() {
             status.warn(&format!(
-                "Removing entire index for {}",
-                clean_path.display()
+                "Fewer than {} clients used the daemon in that time; nothing exported",
+                settings.k_anonymity
             ));
-
-            let clean_spinner = status.create_spinner("Removing index files...");
-            cs_index::clean_index(&clean_path)?;
-            status.finish_progress(clean_spinner, "Index removed");
-
-            status.success("Index cleaned successfully");
         }
+        println!("{}", serde_json::to_string_pretty(&export)?);
         return Ok(());
     }
 
-    if cli.add {
-        // Handle --add flag
-        // When using --add, the file path might be in pattern or files
-        let file = if let Some(ref pattern) = cli.pattern {
-            // If pattern is provided and no files, use pattern as the file path
-            if cli.files.is_empty() {
-                PathBuf::from(pattern)
+    if cli.query_stats {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let (_, report) = cs_engine::analytics::query_report(&path, cli.top_k.unwrap_or(10))?;
+        if report.queries == 0 {
+            if load_query_analytics() {
+                status.warn("No searches recorded yet");
             } else {
-                // Otherwise use the first file
-                cli.files
-                    .first()
-                    .cloned()
-                    .ok_or_else(|| anyhow::anyhow!("No file specified. Usage: cs --add <file>"))?
+                status.warn(
+                    "No searches recorded; enable with 'cs --config set query-analytics true'",
+                );
             }
-        } else {
-            // No pattern, must be in files
-            cli.files
-                .first()
-                .cloned()
-                .ok_or_else(|| anyhow::anyhow!("No file specified. Usage: cs --add <file>"))?
-        };
-        status.section_header("Adding File to Index");
-        status.info(&format!("Processing {}", file.display()));
-
-        let add_spinner = status.create_spinner("Updating index...");
-        cs_index::index_file(&file, true).await?;
-        status.finish_progress(add_spinner, "File indexed");
+            std::process::exit(exit_code::NO_MATCHES);
+        }
 
-        status.success(&format!("Added {} to index", file.display()));
+        if cli.json || cli.jsonl {
+            println!("{}", serde_json::to_string(&report)?);
+        } else {
+            let days = (report.last_recorded.unwrap_or(0) - report.first_recorded.unwrap_or(0))
+                .div_ceil(86_400)
+                .max(1);
+            println!(
+                "{} searches over {} day{}: p50 {}ms, p95 {}ms, max {}ms",
+                style(report.queries).green().bold(),
+                days,
+                if days == 1 { "" } else { "s" },
+                report.latency_p50_ms,
+                report.latency_p95_ms,
+                report.latency_max_ms
+            );
+            let modes: Vec<String> = report
+                .by_mode
+                .iter()
+                .map(|mode| format!("{} {}", mode.name, mode.count))
+                .collect();
+            println!("  by mode: {}", modes.join(", "));
+
+            let sections = [
+                (
+                    format!("Found nothing ({} searches)", report.zero_result_queries),
+                    &report.zero_result,
+                ),
+                ("Most repeated".to_string(), &report.top_queries),
+                ("Most searched areas".to_string(), &report.top_areas),
+            ];
+            for (title, counts) in sections {
+                if counts.is_empty() {
+                    continue;
+                }
+                println!("\n{}", style(title).bold());
+                for count in counts {
+                    println!("  {:>5}  {}", style(count.count).yellow(), count.name);
+                }
+            }
+        }
         return Ok(());
     }
 
-    if cli.status || cli.status_verbose {
-        // Handle --status and --status-verbose flags
-        let status_path = cli
+    if cli.doctor {
+        let path = cli
             .files
             .first()
             .cloned()
             .unwrap_or_else(|| PathBuf::from("."));
-        let verbose = cli.status_verbose;
-
-        status.section_header("Index Status");
-        let check_spinner = status.create_spinner("Reading index...");
-        let stats = cs_index::get_index_stats(&status_path)?;
-        status.finish_progress(check_spinner, "Status retrieved");
+        let exclude_patterns = build_exclude_patterns(&cli, Some(&path));
+        let checks = doctor::run_checks(
+            &path,
+            cli.model.as_deref(),
+            &load_llm_config(&cli),
+            !cli.no_ignore,
+            &exclude_patterns,
+        )
+        .await;
 
-        if stats.total_files == 0 {
-            status.warn(&format!("No index found at {}", status_path.display()));
-            status.info("Run 'cs --index .' to create an index");
+        if cli.json || cli.jsonl {
+            for check in &checks {
+                println!("{}", serde_json::to_string(check)?);
+            }
         } else {
-            status.info(&format!("Index location: {}", status_path.display()));
-            status.success(&format!("Files indexed: {}", stats.total_files));
-            status.info(&format!("  Total chunks: {}", stats.total_chunks));
-            status.info(&format!("  Embedded chunks: {}", stats.embedded_chunks));
-
-            let manifest_path = status_path.join(".cs").join("manifest.json");
-            if let Ok(data) = std::fs::read(&manifest_path)
-                && let Ok(manifest) = serde_json::from_slice::<cs_index::IndexManifest>(&data)
-                && let Some(model_name) = manifest.embedding_model
-            {
-                let registry = cs_models::ModelRegistry::default();
-                let alias = registry
-                    .models
-                    .iter()
-                    .find(|(_, config)| config.name == model_name)
-                    .map(|(alias, _)| alias.clone())
-                    .unwrap_or_else(|| model_name.clone());
-                let dims = manifest
-                    .embedding_dimensions
-                    .or_else(|| {
-                        registry
-                            .models
-                            .iter()
-                            .find(|(_, config)| config.name == model_name)
-                            .map(|(_, config)| config.dimensions)
-                    })
-                    .unwrap_or(0);
-
-                if alias == model_name {
-                    status.info(&format!("  Model: {} ({} dims)", model_name, dims));
-                } else {
-                    status.info(&format!(
-                        "  Model: {} (alias '{}', {} dims)",
-                        model_name, alias, dims
-                    ));
+            for check in &checks {
+                let mark = match check.status {
+                    doctor::CheckStatus::Ok => style("✓").green().bold(),
+                    doctor::CheckStatus::Warn => style("!").yellow().bold(),
+                    doctor::CheckStatus::Fail => style("✗").red().bold(),
+                };
+                println!("{} {}: {}", mark, style(check.name).bold(), check.detail);
+                if let Some(fix) = &check.fix {
+                    println!("    {} {}", style("fix:").cyan(), fix);
                 }
             }
+        }
+        if checks
+            .iter()
+            .any(|check| check.status == doctor::CheckStatus::Fail)
+        {
+            std::process::exit(exit_code::ERROR);
+        }
+        return Ok(());
+    }
 
-            if verbose {
-                let size_mb = stats.total_size_bytes as f64 / (1024.0 * 1024.0);
-                let index_size_mb = stats.index_size_bytes as f64 / (1024.0 * 1024.0);
-                status.info(&format!("  Source size: {:.1} MB", size_mb));
-                status.info(&format!("  Index size: {:.1} MB", index_size_mb));
+    if cli.init {
+        return run_init(&status, &cli).await;
+    }
 
-                use std::time::UNIX_EPOCH;
-                if stats.index_created > 0
-                    && let Some(created) =
-                        UNIX_EPOCH.checked_add(std::time::Duration::from_secs(stats.index_created))
-                    && let Ok(datetime) = created.elapsed()
-                {
-                    status.info(&format!(
-                        "  Created: {:.1} hours ago",
-                        datetime.as_secs() as f64 / 3600.0
-                    ));
-                }
-                if stats.index_updated > 0
-                    && let Some(updated) =
-                        UNIX_EPOCH.checked_add(std::time::Duration::from_secs(stats.index_updated))
-                    && let Ok(datetime) = updated.elapsed()
-                {
-                    status.info(&format!(
-                        "  Updated: {:.1} hours ago",
-                        datetime.as_secs() as f64 / 3600.0
-                    ));
-                }
+    if cli.projects {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let sharded = cs_index::projects::saved_projects(&repo_root).is_some();
+        let projects = monorepo_projects(&cli, &repo_root)?;
 
-                // Show compression ratio
-                if stats.total_size_bytes > 0 {
-                    let compression_ratio =
-                        stats.index_size_bytes as f64 / stats.total_size_bytes as f64;
-                    status.info(&format!(
-                        "  Compression: {:.1}x ({:.1}%)",
-                        1.0 / compression_ratio,
-                        compression_ratio * 100.0
-                    ));
-                }
+        if cli.json || cli.jsonl {
+            for project in &projects {
+                println!("{}", serde_json::to_string(project)?);
+            }
+        } else if projects.is_empty() {
+            status.info(&format!("No projects found in {}", repo_root.display()));
+        } else {
+            let width = projects.iter().map(|p| p.name.len()).max().unwrap_or(0);
+            for project in &projects {
+                println!(
+                    "{}  {} ({})",
+                    style(format!("{:width$}", project.name)).bold(),
+                    project.path,
+                    project.marker
+                );
+            }
+            if sharded {
+                status.info("The index is sharded by project");
             }
         }
         return Ok(());
     }
 
-    if cli.inspect {
-        // Handle --inspect flag
-        // For inspect, the file path could be in pattern or files
-        let file_path = if let Some(pattern) = &cli.pattern {
-            PathBuf::from(pattern)
-        } else if !cli.files.is_empty() {
-            cli.files[0].clone()
+    if cli.collections {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let collections = cs_index::collections::load_collections(&repo_root)?;
+
+        if cli.json || cli.jsonl {
+            for collection in &collections {
+                let text_bytes: usize = collection.chunks.iter().map(|c| c.text.len()).sum();
+                let stored_bytes: usize =
+                    collection.chunks.iter().map(|c| c.text.stored_len()).sum();
+                println!(
+                    "{}",
+                    serde_json::json!({
+                        "name": collection.name,
+                        "model": collection.embedding_model,
+                        "chunks": collection.chunks.len(),
+                        "text_bytes": text_bytes,
+                        "stored_bytes": stored_bytes,
+                        "sources": collection.sources,
+                    })
+                );
+            }
+        } else if collections.is_empty() {
+            status.info(&format!(
+                "No collections in {}; add one with cs --index --collection NAME PATH",
+                repo_root.display()
+            ));
         } else {
-            eprintln!("Error: --inspect requires a file path");
-            std::process::exit(1);
-        };
-
-        status.section_header("File Inspection");
-
-        // Inspect the file metadata
-        inspect_file_metadata(&file_path, &status).await?;
+            let width = collections.iter().map(|c| c.name.len()).max().unwrap_or(0);
+            for collection in &collections {
+                let sources: Vec<String> = collection
+                    .sources
+                    .iter()
+                    .map(|source| source.display().to_string())
+                    .collect();
+                println!(
+                    "{}  {} chunks, {}  {}",
+                    style(format!("{:width$}", collection.name)).bold(),
+                    collection.chunks.len(),
+                    collection.embedding_model.as_deref().unwrap_or("no model"),
+                    if sources.is_empty() {
+                        // Read from a tracker, chat export or go.mod, or else stdin
+                        style(
+                            collection
+                                .connector
+                                .clone()
+                                .unwrap_or_else(|| cs_index::collections::STDIN_SOURCE.to_string()),
+                        )
+                        .dim()
+                    } else {
+                        style(sources.join(", ")).dim()
+                    }
+                );
+            }
+        }
         return Ok(());
     }
 
-    if cli.dump_chunks {
-        // Handle --dump-chunks flag
-        let file_path = if let Some(pattern) = &cli.pattern {
-            PathBuf::from(pattern)
-        } else if !cli.files.is_empty() {
-            cli.files[0].clone()
+    if let Some(name) = cli.drop_collection.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        if cs_index::collections::remove_collection(&repo_root, name)? {
+            status.success(&format!("Collection {} deleted", name));
         } else {
-            eprintln!("Error: --dump-chunks requires a file path");
-            std::process::exit(1);
-        };
-
-        dump_file_chunks(&file_path).await?;
+            status.warn(&format!("No collection named {}", name));
+        }
         return Ok(());
     }
 
-    // Validate conflicting flags
-    if cli.files_with_matches && cli.files_without_matches {
-        eprintln!("Error: Cannot use -l and -L together");
-        std::process::exit(1);
-    }
-
-    // Default behavior: search with pattern
-    if let Some(ref pattern) = cli.pattern {
-        let reindex = cli.reindex;
-
-        // Determine repo root for .csignore loading
-        let repo_root_path = cli
+    if cli.skipped {
+        let path = cli
             .files
             .first()
-            .map(|p| {
-                if p.is_dir() {
-                    p.clone()
-                } else {
-                    p.parent().unwrap_or(p).to_path_buf()
-                }
-            })
+            .cloned()
             .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let log = cs_index::read_limits::load_skipped_log(&repo_root)?.unwrap_or_default();
 
-        let repo_root = Some(repo_root_path.as_path());
+        if cli.json || cli.jsonl {
+            for (file, skipped) in &log.files {
+                println!(
+                    "{}",
+                    serde_json::json!({
+                        "file": file,
+                        "reason": skipped.reason,
+                        "size": skipped.size,
+                    })
+                );
+            }
+        } else {
+            for (file, skipped) in &log.files {
+                println!(
+                    "{}: {} ({})",
+                    style(file).cyan().bold(),
+                    skip_reason_label(skipped.reason),
+                    style(format!("{:.1} MB", skipped.size as f64 / (1024.0 * 1024.0))).yellow()
+                );
+            }
+        }
+        if log.files.is_empty() {
+            status.info("No files were skipped");
+        }
+        return Ok(());
+    }
 
-        // Build options to get exclusion patterns
-        let temp_options = build_options(&cli, reindex, repo_root);
+    if cli.evicted {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let log = cs_index::eviction::load_evicted_log(&repo_root)?.unwrap_or_default();
 
-        let expanded_targets = if cli.files.is_empty() {
-            vec![PathBuf::from(".")]
+        if cli.json || cli.jsonl {
+            for (file, evicted) in &log.files {
+                println!(
+                    "{}",
+                    serde_json::json!({
+                        "file": file,
+                        "policy": evicted.policy,
+                        "bytes": evicted.bytes,
+                        "evicted": evicted.evicted,
+                    })
+                );
+            }
         } else {
-            expand_glob_patterns(&cli.files, &temp_options.exclude_patterns)?
-        };
+            for (file, evicted) in &log.files {
+                println!(
+                    "{}: {} ({})",
+                    style(file).cyan().bold(),
+                    evicted.policy,
+                    style(format!(
+                        "{:.1} MB",
+                        evicted.bytes as f64 / (1024.0 * 1024.0)
+                    ))
+                    .yellow()
+                );
+            }
+        }
+        if log.files.is_empty() {
+            status.info("No files were evicted");
+        }
+        return Ok(());
+    }
 
-        let include_patterns = if cli.files.is_empty() {
-            Vec::new()
+    if let Some(interface) = cli.impls.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let index = cs_index::go_types::load_go_types(&repo_root)?.ok_or_else(|| {
+            anyhow::anyhow!(
+                "No Go type index in {}. Run cs --index first.",
+                repo_root.display()
+            )
+        })?;
+
+        let implementations = index.implementations(interface);
+        if cli.json || cli.jsonl {
+            for implementation in &implementations {
+                println!("{}", serde_json::to_string(implementation)?);
+            }
         } else {
-            build_include_patterns(&expanded_targets)
-        };
+            for implementation in &implementations {
+                let receiver = if implementation.pointer_receiver {
+                    format!("*{}", implementation.type_name)
+                } else {
+                    implementation.type_name.clone()
+                };
+                println!(
+                    "{}:{}: {} implements {}",
+                    style(implementation.file.display()).cyan().bold(),
+                    style(implementation.line).yellow(),
+                    receiver,
+                    implementation.interface
+                );
+            }
+        }
+        if implementations.is_empty() {
+            status.warn(&format!("No implementations of {} found", interface));
+        }
+        return Ok(());
+    }
 
-        let mut search_root = if include_patterns.is_empty() {
-            PathBuf::from(".")
+    if let Some(message) = cli.trace.as_deref() {
+        // The message is the flag's value, so a lone path lands in pattern
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let hits = cs_engine::trace::trace_message(&index_root, &path, message)?;
+
+        if cli.json || cli.jsonl {
+            for hit in &hits {
+                println!("{}", serde_json::to_string(hit)?);
+            }
         } else {
-            find_search_root(&include_patterns)
-        };
-
-        if expanded_targets.len() == 1 && !expanded_targets[0].exists() {
-            search_root = expanded_targets[0].clone();
+            for hit in &hits {
+                let kind = match hit.kind {
+                    cs_index::literals::FormatMatch::Exact => String::new(),
+                    cs_index::literals::FormatMatch::Filled => {
+                        format!("  {}", style(format!("({})", hit.literal)).dim())
+                    }
+                    cs_index::literals::FormatMatch::Partial => {
+                        format!("  {}", style("(partial match)").dim())
+                    }
+                };
+                println!(
+                    "{}:{}: {}{}",
+                    style(hit.file.display()).cyan().bold(),
+                    style(hit.line).yellow(),
+                    hit.code,
+                    kind
+                );
+            }
+        }
+        if hits.is_empty() {
+            status.warn(&format!(
+                "No string literal matches \"{}\"; files indexed before this cs version need cs --clean . && cs --index .",
+                message
+            ));
+            std::process::exit(exit_code::NO_MATCHES);
         }
+        return Ok(());
+    }
 
-        let include_patterns = if include_patterns.len() > 1 {
-            include_patterns
-                .into_iter()
-                .filter(|pattern| !(pattern.is_dir && pattern.path == search_root))
-                .collect()
+    if let Some(query) = cli.sym.as_deref() {
+        // The query is the flag's value, so a lone path lands in pattern
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let symbols =
+            cs_engine::symbols::search_symbols(&index_root, &path, query, cli.top_k.unwrap_or(20))?;
+
+        if cli.json || cli.jsonl {
+            for symbol in &symbols {
+                println!("{}", serde_json::to_string(symbol)?);
+            }
         } else {
-            include_patterns
-        };
+            for symbol in &symbols {
+                let kind = symbol.kind.as_deref().unwrap_or("symbol");
+                let container = symbol
+                    .container
+                    .as_ref()
+                    .map(|container| format!("  {}", style(format!("in {}", container)).dim()))
+                    .unwrap_or_default();
+                println!(
+                    "{}:{}: {} {}{}",
+                    style(symbol.file.display()).cyan().bold(),
+                    style(symbol.line).yellow(),
+                    style(kind).dim(),
+                    style(&symbol.name).bold(),
+                    container
+                );
+            }
+        }
+        if symbols.is_empty() {
+            status.warn(&format!(
+                "No indexed symbol matches \"{}\"; files indexed before this cs version need cs --clean . && cs --index .",
+                query
+            ));
+            std::process::exit(exit_code::NO_MATCHES);
+        }
+        return Ok(());
+    }
 
-        // Handle multiple files like grep; allow -h/-H overrides
-        let mut show_filenames = if include_patterns.is_empty() {
-            expanded_targets.len() > 1 || expanded_targets.iter().any(|p| p.is_dir())
+    if cli.deadcode {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let candidates = cs_engine::deadcode::find_dead_code(&index_root, &path, &cli.exclude)?;
+
+        if cli.json || cli.jsonl {
+            for candidate in &candidates {
+                println!("{}", serde_json::to_string(candidate)?);
+            }
         } else {
-            include_patterns.len() > 1 || include_patterns.iter().any(|p| p.is_dir)
-        };
-        if cli.no_filenames {
-            show_filenames = false;
+            for candidate in &candidates {
+                let kind = match candidate.kind {
+                    cs_engine::go_refs::GoDeclKind::Func => "func",
+                    cs_engine::go_refs::GoDeclKind::Type => "type",
+                    cs_engine::go_refs::GoDeclKind::Var => "var",
+                    cs_engine::go_refs::GoDeclKind::Const => "const",
+                };
+                let tests = match candidate.test_references {
+                    0 => String::new(),
+                    1 => format!("  {}", style("used by 1 test file").dim()),
+                    n => format!("  {}", style(format!("used by {} test files", n)).dim()),
+                };
+                println!(
+                    "{}:{}: {} {}{}",
+                    style(candidate.file.display()).cyan().bold(),
+                    style(candidate.line).yellow(),
+                    style(kind).dim(),
+                    style(&candidate.name).bold(),
+                    tests
+                );
+            }
         }
-        if cli.with_filenames {
-            show_filenames = true;
+        if candidates.is_empty() {
+            status.warn("No unreferenced exported Go declarations found");
+            std::process::exit(exit_code::NO_MATCHES);
         }
-        let mut options = build_options(&cli, reindex, repo_root);
-        options.show_filenames = show_filenames;
-        options.include_patterns = include_patterns.clone();
-        options.path = search_root.clone();
-
-        let summary = run_search(pattern.clone(), search_root, options, &status).await?;
+        return Ok(());
+    }
 
-        if cli.files_without_matches {
-            let matched_canon: Vec<PathBuf> = summary
-                .matched_paths
+    if cli.map {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let map = cs_engine::semantic_map::build_map(&index_root, &path, cli.clusters)?;
+        match cli.map_format {
+            cs_engine::semantic_map::MapFormat::Json => {
+                println!("{}", serde_json::to_string_pretty(&map)?)
+            }
+            cs_engine::semantic_map::MapFormat::Dot => print!("{}", map.to_dot()),
+        }
+        status.info(&format!(
+            "Mapped {} chunks into {} clusters",
+            map.clusters
                 .iter()
-                .map(|p| canonicalize_for_comparison(p))
-                .collect();
-
-            for target in &expanded_targets {
-                let canonical_target = canonicalize_for_comparison(target);
-                let target_is_dir = target.is_dir();
-                let has_match = matched_canon.iter().any(|matched| {
-                    if target_is_dir {
-                        matched.starts_with(&canonical_target)
-                    } else {
-                        matched == &canonical_target
-                    }
-                });
+                .map(|cluster| cluster.size)
+                .sum::<usize>(),
+            map.clusters.len()
+        ));
+        return Ok(());
+    }
 
-                if !has_match {
-                    println!("{}", target.display());
+    if cli.drift {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let days = cli
+            .drift_days
+            .unwrap_or(cs_engine::drift::DEFAULT_DRIFT_DAYS);
+        let drifts = cs_engine::drift::find_drift(&index_root, &path, days)?;
+
+        if cli.json || cli.jsonl {
+            for drift in &drifts {
+                println!("{}", serde_json::to_string(drift)?);
+            }
+        } else {
+            let date = |secs: u64| {
+                chrono::DateTime::from_timestamp(secs as i64, 0)
+                    .map(|time| time.format("%Y-%m-%d").to_string())
+                    .unwrap_or_default()
+            };
+            for drift in &drifts {
+                let section = drift
+                    .section
+                    .as_ref()
+                    .map(|section| format!(" {}", style(format!("({})", section)).bold()))
+                    .unwrap_or_default();
+                println!(
+                    "{}:{}{}  {}",
+                    style(drift.doc.file.display()).cyan().bold(),
+                    style(drift.doc.line_start).yellow(),
+                    section,
+                    style(format!("last changed {}", date(drift.doc_changed))).dim()
+                );
+                for code in &drift.code {
+                    println!(
+                        "  {}:{} {}  {}",
+                        style(code.location.file.display()).cyan(),
+                        style(code.location.line_start).yellow(),
+                        code.symbol.as_deref().unwrap_or(""),
+                        style(format!(
+                            "changed {}{}",
+                            date(code.changed),
+                            if code.named { ", named in the doc" } else { "" }
+                        ))
+                        .dim()
+                    );
                 }
             }
         }
-
-        // grep-like exit codes: 0 if matches found, 1 if none
-        if !summary.had_matches {
-            eprintln!("No matches found");
-
-            // Show the closest match below threshold if available
-            if let Some(closest) = summary.closest_below_threshold {
-                // Format like a regular result but in red
-                let score_text = format!("[{:.3}] ", closest.score);
-                let file_text = format!("{}:", closest.file.display());
-
-                // Get the pattern as a string
-                let options = build_options(&cli, false, repo_root);
-                let highlighted_preview = highlight_matches(&closest.preview, pattern, &options);
-
-                // Print in red with same format as regular results, with header
-                eprintln!();
-                eprintln!("{}", style("(nearest match beneath the threshold)").dim());
-                eprintln!(
-                    "{}{}{}:{}",
-                    style(score_text).red(),
-                    style(file_text).red(),
-                    style(closest.span.line_start).red(),
-                    style(highlighted_preview).red()
+        if drifts.is_empty() {
+            status.warn(&format!(
+                "No doc sections with code changed after them in the last {} days",
+                days
+            ));
+            std::process::exit(exit_code::NO_MATCHES);
+        }
+        return Ok(());
+    }
+
+    if let Some(rev) = cli.related.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let limit = cli.top_k.unwrap_or(cs_engine::related::DEFAULT_RELATED);
+        let spinner =
+            status.create_spinner(&format!("Finding code related to changes since {}...", rev));
+        let contexts = cs_engine::related::related_to_diff(&index_root, rev, limit)?;
+        status.finish_progress(spinner, "Changes embedded");
+
+        if cli.json || cli.jsonl {
+            for context in &contexts {
+                println!("{}", serde_json::to_string(context)?);
+            }
+        } else {
+            for context in &contexts {
+                let symbols = if context.symbols.is_empty() {
+                    String::new()
+                } else {
+                    format!(
+                        " {}",
+                        style(format!("({})", context.symbols.join(", "))).bold()
+                    )
+                };
+                println!(
+                    "{}:{}-{}{}",
+                    style(context.hunk.file.display()).cyan().bold(),
+                    style(context.hunk.line_start).yellow(),
+                    style(context.hunk.line_end).yellow(),
+                    symbols
+                );
+                for related in &context.related {
+                    let relation = match related.relation {
+                        cs_engine::related::Relation::Similar => "similar",
+                        cs_engine::related::Relation::Caller => "caller",
+                        cs_engine::related::Relation::Test => "test",
+                    };
+                    println!(
+                        "  {}  {}:{} {}  {}",
+                        style(format!("{:.3}", related.similarity)).yellow(),
+                        style(related.location.file.display()).cyan(),
+                        style(related.location.line_start).yellow(),
+                        related.symbol.as_deref().unwrap_or(""),
+                        style(relation).dim()
+                    );
+                }
+            }
+        }
+        if contexts.iter().all(|context| context.related.is_empty()) {
+            status.warn(&format!("No related code found for changes since {}", rev));
+            std::process::exit(exit_code::NO_MATCHES);
+        }
+        return Ok(());
+    }
+
+    if let Some(rev) = cli.pr_comment.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let threshold = cli
+            .dupe_threshold
+            .unwrap_or(cs_engine::dupes::DEFAULT_DUPE_THRESHOLD);
+        let spinner = status.create_spinner(&format!("Summing up the changes since {}...", rev));
+        let summary = cs_engine::pr_comment::summarize(&index_root, rev, threshold)?;
+        status.finish_progress(spinner, "Changes summed up");
+        if cli.json || cli.jsonl {
+            println!("{}", serde_json::to_string_pretty(&summary)?);
+        } else {
+            print!("{}", cs_engine::pr_comment::to_markdown(&summary));
+        }
+        return Ok(());
+    }
+
+    if let Some(query) = cli.sig.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let matches = cs_engine::signature_search::search_signatures(
+            &index_root,
+            &path,
+            query,
+            cli.top_k.unwrap_or(20),
+        )?;
+
+        if cli.json || cli.jsonl {
+            for found in &matches {
+                println!("{}", serde_json::to_string(found)?);
+            }
+        } else {
+            for found in &matches {
+                let loose = if found.score < 1.0 {
+                    format!("  {}", style("(loose match)").dim())
+                } else {
+                    String::new()
+                };
+                println!(
+                    "{}:{}: {}{}",
+                    style(found.file.display()).cyan().bold(),
+                    style(found.line).yellow(),
+                    found.signature,
+                    loose
+                );
+            }
+        }
+        if matches.is_empty() {
+            status.warn(&format!(
+                "No indexed signature matches \"{}\"; files indexed before this cs version need cs --index . to record signatures",
+                query
+            ));
+            std::process::exit(exit_code::NO_MATCHES);
+        }
+        return Ok(());
+    }
+
+    if let Some(anchor) = cli.resolve.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).ok_or_else(|| {
+            anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+        })?;
+        let resolved = match cs_engine::anchors::resolve_anchor(&index_root, anchor) {
+            Ok(resolved) => resolved,
+            Err(e) => {
+                status.warn(&format!("{:#}", e));
+                std::process::exit(exit_code::NO_MATCHES);
+            }
+        };
+        if cli.json || cli.jsonl {
+            println!("{}", serde_json::to_string(&resolved)?);
+        } else {
+            println!(
+                "{}:{}",
+                style(resolved.file.display()).cyan().bold(),
+                style(resolved.line).yellow()
+            );
+        }
+        return Ok(());
+    }
+
+    if let [old, new] = cli.index_diff.as_slice() {
+        let old = cs_index::diff::Snapshot::open(old)?;
+        let new = cs_index::diff::Snapshot::open(new)?;
+        let diff = cs_index::diff::diff_snapshots(&old, &new);
+
+        if cli.json || cli.jsonl {
+            for file in &diff.files {
+                println!("{}", serde_json::to_string(file)?);
+            }
+            println!("{}", serde_json::json!({ "summary": diff.summary }));
+            return Ok(());
+        }
+        let mark = |change: cs_index::diff::Change| match change {
+            cs_index::diff::Change::Added => style("+").green(),
+            cs_index::diff::Change::Removed => style("-").red(),
+            cs_index::diff::Change::Modified => style("~").yellow(),
+        };
+        for file in &diff.files {
+            println!("{} {}", mark(file.change), style(&file.file).cyan().bold());
+            for chunk in &file.chunks {
+                let lines = chunk
+                    .new_lines
+                    .or(chunk.old_lines)
+                    .map(|(start, end)| format!("{}-{}", start, end))
+                    .unwrap_or_default();
+                let drift = chunk
+                    .drift
+                    .map(|drift| format!("  {}", style(format!("(drift {:.3})", drift)).dim()))
+                    .unwrap_or_default();
+                println!(
+                    "    {} {} {}{}",
+                    mark(chunk.change),
+                    style(lines).yellow(),
+                    chunk
+                        .symbol
+                        .as_deref()
+                        .or(chunk.chunk_type.as_deref())
+                        .unwrap_or("chunk"),
+                    drift
+                );
+            }
+        }
+        let summary = &diff.summary;
+        println!(
+            "{} files added, {} removed, {} modified; {} chunks added, {} removed, {} modified",
+            summary.files_added,
+            summary.files_removed,
+            summary.files_modified,
+            summary.chunks_added,
+            summary.chunks_removed,
+            summary.chunks_modified
+        );
+        if !diff.same_model {
+            status.info("The indexes use different models, so drift isn't shown");
+        }
+        return Ok(());
+    }
+
+    if let [left, right] = cli.compare.as_slice() {
+        let root = |path: &PathBuf| {
+            cs_engine::find_nearest_index_root(path).ok_or_else(|| {
+                anyhow::anyhow!("No index at {}. Run cs --index first.", path.display())
+            })
+        };
+        let (left_root, right_root) = (root(left)?, root(right)?);
+        let threshold = cli
+            .threshold
+            .unwrap_or(cs_engine::compare::DEFAULT_THRESHOLD);
+        let mut pairs = cs_engine::compare::compare_indexes(&left_root, &right_root, threshold)?;
+        if let Some(top_k) = cli.top_k {
+            pairs.truncate(top_k);
+        }
+
+        if cli.json || cli.jsonl {
+            for pair in &pairs {
+                println!("{}", serde_json::to_string(pair)?);
+            }
+        } else {
+            for pair in &pairs {
+                let copy = if pair.identical {
+                    format!("  {}", style("(identical)").dim())
+                } else {
+                    String::new()
+                };
+                println!(
+                    "{}  {}:{}  {}:{}{}",
+                    style(format!("{:.3}", pair.similarity)).yellow(),
+                    style(pair.left.file.display()).cyan().bold(),
+                    pair.left.line_start,
+                    style(pair.right.file.display()).cyan().bold(),
+                    pair.right.line_start,
+                    copy
+                );
+            }
+        }
+        if pairs.is_empty() {
+            status.info(&format!("No chunks are at least {} similar", threshold));
+        } else if !(cli.json || cli.jsonl) {
+            let identical = pairs.iter().filter(|pair| pair.identical).count();
+            status.info(&format!(
+                "{} similar chunks, {} of them identical",
+                pairs.len(),
+                identical
+            ));
+        }
+        return Ok(());
+    }
+
+    if cli.eval_compare {
+        return run_eval_compare(&cli, &status).await;
+    }
+
+    if cli.bench_latency {
+        return run_bench_latency(&cli, &status).await;
+    }
+
+    if cli.hook.as_deref() == Some("pre-commit") {
+        return run_pre_commit_hook(&cli, &status);
+    }
+
+    if let Some(pack) = cli.audit.as_deref() {
+        return run_audit(&cli, &status, pack).await;
+    }
+
+    if let Some(key_path) = cli.generate_signing_key.as_deref() {
+        let public_key = cs_index::bundle::generate_signing_key(key_path)?;
+        status.success(&format!("Signing key written to {}", key_path.display()));
+        status.info(&format!("Public key: {}", public_key));
+        return Ok(());
+    }
+
+    if let Some(output) = cli.offline_bundle.as_deref() {
+        let registry = cs_models::ModelRegistry::default();
+        let requested: Vec<Option<&str>> = if cli.bundle_models.is_empty() {
+            vec![None]
+        } else {
+            cli.bundle_models
+                .iter()
+                .map(|name| Some(name.as_str()))
+                .collect()
+        };
+        let mut models = Vec::new();
+        for name in requested {
+            let (alias, config) = resolve_model_selection(&registry, name)?;
+            if config.provider != "fastembed" {
+                anyhow::bail!(
+                    "{} runs behind the {} API and can't be bundled; pick a local model",
+                    alias,
+                    config.provider
                 );
             }
+            if !models.contains(&config.name) {
+                models.push(config.name);
+            }
+        }
+
+        let spinner = status.create_spinner("Bundling cs and its models...");
+        let stats = offline_bundle::create_bundle(output, &models, &|file| {
+            if let Some(spinner) = &spinner {
+                spinner.set_message(format!("Bundling {}", file));
+            }
+        })?;
+        status.finish_progress(spinner, "Offline bundle written");
+        status.success(&format!(
+            "Packed cs and {} into {} ({} files, {:.1} MB)",
+            models.join(", "),
+            output.display(),
+            stats.files,
+            stats.bytes as f64 / (1024.0 * 1024.0)
+        ));
+        status.info(&format!(
+            "Install on the offline machine with: tar -xf {} && ./cs-*/install.sh",
+            output
+                .file_name()
+                .map(|name| name.to_string_lossy().to_string())
+                .unwrap_or_default()
+        ));
+        return Ok(());
+    }
+
+    if let Some(output) = cli.seal_index.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let signing_key = cli
+            .signing_key
+            .as_deref()
+            .ok_or_else(|| anyhow::anyhow!("--seal-index requires --signing-key"))?;
+
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let spinner = status.create_spinner("Sealing index bundle...");
+        let stats = cs_index::bundle::seal_index(&repo_root, output, signing_key)?;
+        status.finish_progress(spinner, "Bundle sealed");
+        status.success(&format!(
+            "Sealed {} files into {} ({} bytes)",
+            stats.files,
+            output.display(),
+            stats.bytes
+        ));
+        status.info(&format!(
+            "Reviewers open it with: cs --bundle {} --trusted-key {} \"<query>\"",
+            output.display(),
+            stats.public_key
+        ));
+        return Ok(());
+    }
+
+    if let Some(bundle) = cli.bundle.as_deref() {
+        let trusted_key = cli
+            .trusted_key
+            .as_deref()
+            .ok_or_else(|| anyhow::anyhow!("--bundle requires --trusted-key"))?;
+        let stem = bundle
+            .file_stem()
+            .map(|s| s.to_string_lossy().to_string())
+            .unwrap_or_else(|| "index".to_string());
+        // Extracted where only this user can write, never a shared /tmp
+        let bundles_dir = cs_core::locations::cache_dir().join("bundles");
+        std::fs::create_dir_all(&bundles_dir)?;
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&bundles_dir, std::fs::Permissions::from_mode(0o700))?;
+        }
+        let dest = bundles_dir.join(stem);
+        // A bundle carries its index in-tree, whatever --index-location says
+        cs_core::locations::set_index_dir(&dest, &dest.join(cs_core::locations::INDEX_DIR_NAME));
+
+        let info = cs_index::bundle::open_bundle(bundle, trusted_key, &dest)?;
+        status.info(&format!(
+            "Verified bundle {} ({} files, signed by {})",
+            bundle.display(),
+            info.files,
+            info.public_key
+        ));
+        // Resolve search paths inside the bundle so results print repo-relative paths
+        std::env::set_current_dir(&dest)?;
+    }
+
+    // Handle command flags first (these take precedence over search)
+    if let Some(model_name) = cli.switch_model.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+
+        let registry = cs_models::ModelRegistry::default();
+        let (model_alias, model_config) = resolve_model_selection(&registry, Some(model_name))?;
+
+        if !cli.force {
+            let manifest_path = cs_core::locations::index_dir(&path).join("manifest.json");
+            if manifest_path.exists()
+                && let Ok(manifest) = cs_index::manifest_format::read_header(&manifest_path)
+                && let Some(existing_model) = manifest.embedding_model.clone()
+                && let Ok((existing_alias, existing_config)) =
+                    resolve_model_selection(&registry, Some(existing_model.as_str()))
+                && existing_config.name == model_config.name
+            {
+                status.section_header("Switching Embedding Model");
+                let dims = manifest
+                    .embedding_dimensions
+                    .unwrap_or(existing_config.dimensions);
+
+                if existing_alias == existing_config.name {
+                    status.info(&format!(
+                        "Index already uses {} ({} dims)",
+                        existing_config.name, dims
+                    ));
+                } else {
+                    status.info(&format!(
+                        "Index already uses {} (alias '{}', {} dims)",
+                        existing_config.name, existing_alias, dims
+                    ));
+                }
+
+                status.success("No rebuild required; index already on requested model");
+                status.info(&format!(
+                    "Use '--switch-model {} --force' to rebuild anyway",
+                    model_name
+                ));
+                return Ok(());
+            }
+        }
+
+        run_index_workflow(
+            &status,
+            &path,
+            &cli,
+            model_alias.as_str(),
+            &model_config,
+            "Switching Embedding Model",
+            true,
+        )
+        .await?;
+        return Ok(());
+    }
+
+    if let Some(model_name) = cli.migrate_model.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).unwrap_or(path);
+        return run_model_migration(&status, &index_root, model_name, cli.migrate_batch);
+    }
+
+    if cli.encrypt_index {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let index_root = cs_engine::find_nearest_index_root(&path).unwrap_or(path);
+        let spinner = status.create_spinner("Encrypting index...");
+        let stats = match cs_index::encryption::encrypt_index(&index_root) {
+            Ok(stats) => stats,
+            Err(e) => {
+                if let Some(spinner) = spinner {
+                    spinner.finish_and_clear();
+                }
+                return Err(e);
+            }
+        };
+        status.finish_progress(spinner, "Index encrypted");
+        status.success(&format!(
+            "{} files encrypted, {} plaintext caches removed in {}",
+            stats.files_encrypted,
+            stats.caches_removed,
+            cs_core::locations::index_dir(&index_root).display()
+        ));
+        status.info("Searches need the same key in CS_INDEX_KEY or CS_INDEX_KEY_COMMAND");
+        if !cli.index {
+            return Ok(());
+        }
+    }
+
+    if let Some(location) = cli.publish_index.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let spinner = status.create_spinner(&format!("Publishing index to {}...", location));
+        let stats = match cs_index::oci::publish_index(location, &repo_root).await {
+            Ok(stats) => stats,
+            Err(e) => {
+                if let Some(spinner) = spinner {
+                    spinner.finish_and_clear();
+                }
+                return Err(e);
+            }
+        };
+        status.finish_progress(spinner, "Index published");
+        status.success(&format!(
+            "{} ({}): {} sidecars, {:.1} MB{}",
+            stats.reference,
+            stats.digest,
+            stats.files,
+            stats.bytes as f64 / 1_000_000.0,
+            if stats.uploaded {
+                ""
+            } else {
+                ", already in the registry"
+            }
+        ));
+        return Ok(());
+    }
+
+    if let Some(location) = cli.fetch_index.as_deref() {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let spinner = status.create_spinner(&format!("Fetching index from {}...", location));
+        let stats = match cs_index::peer::fetch_index(location, &repo_root).await {
+            Ok(stats) => stats,
+            Err(e) => {
+                if let Some(spinner) = spinner {
+                    spinner.finish_and_clear();
+                }
+                return Err(e);
+            }
+        };
+        status.finish_progress(spinner, "Index fetched");
+        status.success(&format!(
+            "{} sidecars downloaded ({:.1} MB), {} kept from an earlier fetch",
+            stats.files_downloaded,
+            stats.bytes_downloaded as f64 / 1_000_000.0,
+            stats.files_resumed
+        ));
+        if stats.files_changed + stats.files_missing > 0 {
+            status.info(&format!(
+                "{} files differ from the peer's and {} aren't in this checkout; indexing local changes",
+                stats.files_changed, stats.files_missing
+            ));
+        }
+
+        // Local edits and files the peer didn't index are embedded as usual
+        let registry = cs_models::ModelRegistry::default();
+        let (model_alias, model_config) =
+            resolve_model_selection(&registry, stats.embedding_model.as_deref())?;
+        run_index_workflow(
+            &status,
+            &repo_root,
+            &cli,
+            model_alias.as_str(),
+            &model_config,
+            "Updating Fetched Index",
+            false,
+        )
+        .await?;
+        return Ok(());
+    }
+
+    if cli.index {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+
+        if !cli.collection.is_empty() {
+            return run_collection_index(&status, &cli).await;
+        }
+
+        let registry = cs_models::ModelRegistry::default();
+        let (model_alias, model_config) = resolve_model_selection(&registry, cli.model.as_deref())?;
+
+        let sharded = cli.shards || cli.project_shards || !cli.shard.is_empty();
+        if cli.dry_run {
+            if sharded || cli.coordinate.is_some() {
+                anyhow::bail!("--dry-run is not supported for sharded or distributed indexing yet");
+            }
+            return report_index_plan(&status, &cli, &path, &model_config);
+        }
+        let index_started = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        if sharded {
+            run_shard_build(&status, &path, &cli, model_alias.as_str())?;
+            if cli.index_commits.is_some() {
+                status.warn("--index-commits is not supported for sharded indexes yet");
+            }
+        } else if let Some(listen) = cli.coordinate.as_deref() {
+            run_coordinator(&status, &path, &cli, model_alias.as_str(), listen)?;
+        } else {
+            // Files embedded before would lack the new vectors
+            let adds_vectors = (cli.multi_vector && !cs_index::multi_vector::is_enabled(&path))
+                || (cli.sparse && cs_index::sparse::sparse_model(&path).is_none());
+            let rebuild = adds_vectors && cs_index::load_manifest(&path)?.is_some();
+            if rebuild && cs_index::encryption::is_encrypted(&path) {
+                anyhow::bail!(
+                    "An encrypted index can't be rebuilt with new vectors in place; run cs --clean, then cs --index --encrypt-index with the same flags"
+                );
+            }
+            run_index_workflow(
+                &status,
+                &path,
+                &cli,
+                model_alias.as_str(),
+                &model_config,
+                if rebuild {
+                    "Rebuilding Index with New Vectors"
+                } else {
+                    "Indexing Repository"
+                },
+                rebuild,
+            )
+            .await?;
+        }
+
+        if !sharded
+            && let Some(log) =
+                cs_index::read_limits::load_skipped_log(&cs_index::find_repo_root(&path)?)?
+            && !log.files.is_empty()
+        {
+            let counts: Vec<String> = log
+                .counts()
+                .into_iter()
+                .map(|(reason, count)| format!("{} {}", count, skip_reason_label(reason)))
+                .collect();
+            status.info(&format!(
+                "Skipped {} files ({}); list them with cs --skipped",
+                log.files.len(),
+                counts.join(", ")
+            ));
+        }
+
+        if !sharded
+            && cli.max_index_size > 0
+            && let Some(log) =
+                cs_index::eviction::load_evicted_log(&cs_index::find_repo_root(&path)?)?
+        {
+            let evicted: Vec<_> = log.evicted_since(index_started).collect();
+            if !evicted.is_empty() {
+                let bytes: u64 = evicted.iter().map(|(_, file)| file.bytes).sum();
+                status.info(&format!(
+                    "Evicted {} files ({:.1} MB) to stay under --max-index-size; list them with cs --evicted",
+                    evicted.len(),
+                    bytes as f64 / (1024.0 * 1024.0)
+                ));
+            }
+        }
+
+        // Once an index has summaries, every --index run keeps them current
+        if !sharded && (cli.summarize || cs_engine::summaries::has_summaries(&path)) {
+            let index_root = cs_index::find_repo_root(&path)?;
+            let progress = status.create_file_progress(0, "Summarizing chunks");
+            let on_progress = |done: usize, total: usize| {
+                if let Some(pb) = &progress {
+                    pb.set_length(total as u64);
+                    pb.set_position(done as u64);
+                }
+            };
+            match cs_engine::summaries::summarize_index(
+                &index_root,
+                &load_llm_config(&cli),
+                &on_progress,
+            )
+            .await
+            {
+                Ok(stats) => {
+                    status.finish_progress(progress, "Chunks summarized");
+                    status.success(&format!(
+                        "Summaries: {} written, {} unchanged, {} failed, {} dropped",
+                        stats.summarized, stats.cached, stats.failed, stats.removed
+                    ));
+                }
+                Err(e) if !cli.summarize => {
+                    if let Some(pb) = progress {
+                        pb.finish_and_clear();
+                    }
+                    status.warn(&format!("Chunk summaries not updated: {:#}", e));
+                }
+                Err(e) => return Err(e),
+            }
+        }
+
+        if let Some(limit) = cli.index_commits
+            && !sharded
+        {
+            let repo_root = cs_index::find_repo_root(&path)?;
+            let spinner = status.create_spinner("Embedding commit messages...");
+            let stats = cs_index::commits::index_commits(&repo_root, limit)?;
+            status.finish_progress(spinner, "Commit messages indexed");
+            status.success(&format!(
+                "Commits: {} embedded, {} unchanged, {} dropped",
+                stats.commits_embedded, stats.commits_unchanged, stats.commits_dropped
+            ));
+        }
+
+        // Once dependencies are indexed, every --index run keeps them current
+        let repo_root = cs_index::find_repo_root(&path)?;
+        let deps = match cli.with_deps {
+            Some(scope) => {
+                let go_mod = if path.join("go.mod").is_file() {
+                    path.join("go.mod")
+                } else {
+                    repo_root.join("go.mod")
+                };
+                Some((scope, go_mod))
+            }
+            None => cs_index::collections::load_collection(
+                &repo_root,
+                cs_index::go_deps::DEPS_COLLECTION,
+            )?
+            .and_then(|c| c.connector)
+            .and_then(|c| cs_index::go_deps::parse_connector(&c)),
+        };
+        if let Some((scope, go_mod)) = deps {
+            match run_deps_index(&status, &repo_root, &go_mod, scope) {
+                Err(e) if cli.with_deps.is_none() => {
+                    status.warn(&format!("Dependencies not updated: {:#}", e));
+                }
+                result => result?,
+            }
+        }
+
+        // Likewise the standard library, embedded again after a Go upgrade
+        let stdlib = cli.with_stdlib
+            || cs_index::collections::load_collection(
+                &repo_root,
+                cs_index::go_stdlib::STDLIB_COLLECTION,
+            )?
+            .and_then(|c| c.connector)
+            .is_some_and(|c| c.starts_with(cs_index::go_stdlib::GOROOT_CONNECTOR));
+        if stdlib {
+            match run_stdlib_index(&status, &repo_root) {
+                Err(e) if !cli.with_stdlib => {
+                    status.warn(&format!("Standard library not updated: {:#}", e));
+                }
+                result => result?,
+            }
+        }
+
+        if let Some(model) = cli.hot_model.as_deref() {
+            configure_hot_model(&status, &cli, &repo_root, model)?;
+        }
+        if cs_index::hot_chunks::is_enabled(&repo_root) {
+            match run_hot_refresh(&status, &repo_root) {
+                Err(e) if cli.hot_model.is_none() => {
+                    status.warn(&format!("Hot chunks not updated: {:#}", e));
+                }
+                result => result?,
+            }
+        }
+
+        if let Some(url) = cli.store.as_deref() {
+            push_to_store(&status, &path, url, &cli.store_repo).await?;
+        }
+        return Ok(());
+    }
+
+    if cli.clean || cli.clean_orphans {
+        // Handle --clean and --clean-orphans flags
+        let clean_path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let orphans_only = cli.clean_orphans;
+
+        if orphans_only {
+            status.section_header("Cleaning Orphaned Files");
+            status.info(&format!("Scanning for orphans in {}", clean_path.display()));
+
+            // Build exclusion patterns using unified builder
+            let exclude_patterns = build_exclude_patterns(&cli, Some(&clean_path));
+
+            let cleanup_spinner = status.create_spinner("Removing orphaned entries...");
+            let cleanup_stats =
+                cs_index::cleanup_index(&clean_path, !cli.no_ignore, &exclude_patterns)?;
+            status.finish_progress(cleanup_spinner, "Cleanup complete");
+
+            if cleanup_stats.orphaned_entries_removed > 0
+                || cleanup_stats.orphaned_sidecars_removed > 0
+            {
+                status.success(&format!(
+                    "Removed {} orphaned entries and {} orphaned sidecars",
+                    cleanup_stats.orphaned_entries_removed, cleanup_stats.orphaned_sidecars_removed
+                ));
+            } else {
+                status.info("No orphaned files found");
+            }
+            if cleanup_stats.damaged_segments_removed > 0 {
+                status.success(&format!(
+                    "Removed {} unreadable index segments",
+                    cleanup_stats.damaged_segments_removed
+                ));
+            }
+        } else {
+            status.section_header("Cleaning Index");
+            status.warn(&format!(
+                "Removing entire index for {}",
+                clean_path.display()
+            ));
+
+            let clean_spinner = status.create_spinner("Removing index files...");
+            cs_index::clean_index(&clean_path)?;
+            status.finish_progress(clean_spinner, "Index removed");
+
+            status.success("Index cleaned successfully");
+        }
+        return Ok(());
+    }
+
+    if cli.add {
+        // Handle --add flag
+        // When using --add, the file path might be in pattern or files
+        let file = if let Some(ref pattern) = cli.pattern {
+            // If pattern is provided and no files, use pattern as the file path
+            if cli.files.is_empty() {
+                PathBuf::from(pattern)
+            } else {
+                // Otherwise use the first file
+                cli.files
+                    .first()
+                    .cloned()
+                    .ok_or_else(|| anyhow::anyhow!("No file specified. Usage: cs --add <file>"))?
+            }
+        } else {
+            // No pattern, must be in files
+            cli.files
+                .first()
+                .cloned()
+                .ok_or_else(|| anyhow::anyhow!("No file specified. Usage: cs --add <file>"))?
+        };
+        status.section_header("Adding File to Index");
+        status.info(&format!("Processing {}", file.display()));
+
+        let add_spinner = status.create_spinner("Updating index...");
+        cs_index::index_file(&file, true).await?;
+        status.finish_progress(add_spinner, "File indexed");
+
+        status.success(&format!("Added {} to index", file.display()));
+        return Ok(());
+    }
+
+    if cli.status || cli.status_verbose {
+        // Handle --status and --status-verbose flags
+        let status_path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let verbose = cli.status_verbose;
+
+        status.section_header("Index Status");
+        let check_spinner = status.create_spinner("Reading index...");
+        let stats = cs_index::get_index_stats(&status_path)?;
+        status.finish_progress(check_spinner, "Status retrieved");
+
+        if stats.total_files == 0 {
+            status.warn(&format!("No index found at {}", status_path.display()));
+            status.info("Run 'cs --index .' to create an index");
+        } else {
+            status.info(&format!("Index location: {}", status_path.display()));
+            status.success(&format!("Files indexed: {}", stats.total_files));
+            status.info(&format!("  Total chunks: {}", stats.total_chunks));
+            status.info(&format!("  Embedded chunks: {}", stats.embedded_chunks));
+            if cs_index::shards::is_sharded(&status_path) {
+                let shards = cs_index::shards::list_shards(&status_path)?;
+                let names: Vec<&str> = shards.iter().map(|shard| shard.name.as_str()).collect();
+                status.info(&format!("  Shards: {} ({})", names.len(), names.join(", ")));
+            }
+
+            let manifest_path = cs_core::locations::index_dir(&status_path).join("manifest.json");
+            if let Ok(manifest) = cs_index::manifest_format::read_header(&manifest_path) {
+                use cs_index::index_format::{FormatStatus, INDEX_FORMAT_VERSION};
+                match cs_index::index_format::status(&manifest.version) {
+                    FormatStatus::Current => {
+                        status.info(&format!("  Index format: v{}", INDEX_FORMAT_VERSION))
+                    }
+                    FormatStatus::Upgradable { from } => status.info(&format!(
+                        "  Index format: v{} (upgraded to v{} on the next search or update)",
+                        from, INDEX_FORMAT_VERSION
+                    )),
+                    _ => {
+                        if let Err(e) = cs_index::index_format::check(&manifest.version) {
+                            status.warn(&format!("  Index format: {}", e));
+                        }
+                    }
+                }
+            }
+            if let Ok(manifest) = cs_index::manifest_format::read_header(&manifest_path)
+                && let Some(model_name) = manifest.embedding_model
+            {
+                let registry = cs_models::ModelRegistry::default();
+                let alias = registry
+                    .models
+                    .iter()
+                    .find(|(_, config)| config.name == model_name)
+                    .map(|(alias, _)| alias.clone())
+                    .unwrap_or_else(|| model_name.clone());
+                let dims = manifest
+                    .embedding_dimensions
+                    .or_else(|| {
+                        registry
+                            .models
+                            .iter()
+                            .find(|(_, config)| config.name == model_name)
+                            .map(|(_, config)| config.dimensions)
+                    })
+                    .unwrap_or(0);
+
+                if alias == model_name {
+                    status.info(&format!("  Model: {} ({} dims)", model_name, dims));
+                } else {
+                    status.info(&format!(
+                        "  Model: {} (alias '{}', {} dims)",
+                        model_name, alias, dims
+                    ));
+                }
+            }
+
+            if verbose {
+                let size_mb = stats.total_size_bytes as f64 / (1024.0 * 1024.0);
+                let index_size_mb = stats.index_size_bytes as f64 / (1024.0 * 1024.0);
+                status.info(&format!("  Source size: {:.1} MB", size_mb));
+                status.info(&format!("  Index size: {:.1} MB", index_size_mb));
+
+                use std::time::UNIX_EPOCH;
+                if stats.index_created > 0
+                    && let Some(created) =
+                        UNIX_EPOCH.checked_add(std::time::Duration::from_secs(stats.index_created))
+                    && let Ok(datetime) = created.elapsed()
+                {
+                    status.info(&format!(
+                        "  Created: {:.1} hours ago",
+                        datetime.as_secs() as f64 / 3600.0
+                    ));
+                }
+                if stats.index_updated > 0
+                    && let Some(updated) =
+                        UNIX_EPOCH.checked_add(std::time::Duration::from_secs(stats.index_updated))
+                    && let Ok(datetime) = updated.elapsed()
+                {
+                    status.info(&format!(
+                        "  Updated: {:.1} hours ago",
+                        datetime.as_secs() as f64 / 3600.0
+                    ));
+                }
+
+                // Show compression ratio
+                if stats.total_size_bytes > 0 {
+                    let compression_ratio =
+                        stats.index_size_bytes as f64 / stats.total_size_bytes as f64;
+                    status.info(&format!(
+                        "  Compression: {:.1}x ({:.1}%)",
+                        1.0 / compression_ratio,
+                        compression_ratio * 100.0
+                    ));
+                }
+            }
+        }
+        return Ok(());
+    }
+
+    if cli.inspect {
+        // Handle --inspect flag
+        // For inspect, the file path could be in pattern or files
+        let file_path = if let Some(pattern) = &cli.pattern {
+            PathBuf::from(pattern)
+        } else if !cli.files.is_empty() {
+            cli.files[0].clone()
+        } else {
+            eprintln!("Error: --inspect requires a file path");
+            std::process::exit(exit_code::ERROR);
+        };
+
+        status.section_header("File Inspection");
+
+        // Inspect the file metadata
+        inspect_file_metadata(&file_path, &status).await?;
+        return Ok(());
+    }
+
+    if cli.dump_chunks {
+        // Handle --dump-chunks flag
+        let file_path = if let Some(pattern) = &cli.pattern {
+            PathBuf::from(pattern)
+        } else if !cli.files.is_empty() {
+            cli.files[0].clone()
+        } else {
+            eprintln!("Error: --dump-chunks requires a file path");
+            std::process::exit(exit_code::ERROR);
+        };
+
+        dump_file_chunks(&file_path).await?;
+        return Ok(());
+    }
+
+    if cli.chunk {
+        return run_chunk_export(&cli, &status);
+    }
+
+    scope_to_project(&mut cli)?;
+
+    // Validate conflicting flags
+    if cli.files_with_matches && cli.files_without_matches {
+        eprintln!("Error: Cannot use -l and -L together");
+        std::process::exit(exit_code::ERROR);
+    }
+    if !cli.collection.is_empty() && !(cli.semantic || cli.hybrid || cli.ask) {
+        status.warn("--collection only applies to --sem, --hybrid and --ask searches");
+    }
+
+    // A batch takes its queries from the file, so a positional is a path
+    if let Some(queries_file) = cli.queries_file.clone() {
+        if let Some(path) = cli.pattern.take() {
+            cli.files.insert(0, PathBuf::from(path));
+        }
+        let queries = batch::read_queries(&queries_file)?;
+        if !run_batch_search(&cli, &queries, &status).await? {
+            exit_code::no_matches(cli.quiet);
+        }
+        return Ok(());
+    }
+
+    // Default behavior: search with pattern
+    if let Some(ref pattern) = cli.pattern {
+        let reindex = cli.reindex;
+
+        // Determine repo root for .csignore loading
+        let repo_root_path = cli
+            .files
+            .first()
+            .map(|p| {
+                if p.is_dir() {
+                    p.clone()
+                } else {
+                    p.parent().unwrap_or(p).to_path_buf()
+                }
+            })
+            .unwrap_or_else(|| PathBuf::from("."));
+
+        let repo_root = Some(repo_root_path.as_path());
+
+        // Build options to get exclusion patterns
+        let temp_options = build_options(&cli, reindex, repo_root);
+
+        let expanded_targets = if cli.files.is_empty() {
+            vec![PathBuf::from(".")]
+        } else {
+            expand_glob_patterns(&cli.files, &temp_options.exclude_patterns)?
+        };
+
+        let include_patterns = if cli.files.is_empty() {
+            Vec::new()
+        } else {
+            build_include_patterns(&expanded_targets)
+        };
+
+        let mut search_root = if include_patterns.is_empty() {
+            PathBuf::from(".")
+        } else {
+            find_search_root(&include_patterns)
+        };
+
+        if expanded_targets.len() == 1 && !expanded_targets[0].exists() {
+            search_root = expanded_targets[0].clone();
+        }
+
+        let include_patterns = if include_patterns.len() > 1 {
+            include_patterns
+                .into_iter()
+                .filter(|pattern| !(pattern.is_dir && pattern.path == search_root))
+                .collect()
+        } else {
+            include_patterns
+        };
+
+        // Handle multiple files like grep; allow -h/-H overrides
+        let mut show_filenames = if include_patterns.is_empty() {
+            expanded_targets.len() > 1 || expanded_targets.iter().any(|p| p.is_dir())
+        } else {
+            include_patterns.len() > 1 || include_patterns.iter().any(|p| p.is_dir)
+        };
+        if cli.no_filenames {
+            show_filenames = false;
+        }
+        if cli.with_filenames {
+            show_filenames = true;
+        }
+
+        // ripgrep-style filters narrow the search to a list of files
+        let include_patterns = match rg_filtered_files(
+            &cli,
+            &expanded_targets,
+            &temp_options.exclude_patterns,
+            &status,
+        )? {
+            Some(files) if files.is_empty() => exit_code::no_matches(cli.quiet),
+            Some(files) => build_include_patterns(&files),
+            None => include_patterns,
+        };
+
+        let mut options = build_options(&cli, reindex, repo_root);
+        options.show_filenames = show_filenames;
+        options.include_patterns = include_patterns.clone();
+        options.path = search_root.clone();
+
+        if let Some(location) = cli.remote_index.as_deref() {
+            let cache_root = cs_index::find_repo_root(&search_root)?;
+            let sync = cs_index::remote::sync_remote_index(location, &cache_root).await?;
+            if sync.up_to_date {
+                status.info(&format!("Remote index {} is up to date", location));
+            } else {
+                status.info(&format!(
+                    "Synced remote index {}: {} downloaded, {} unchanged, {} removed",
+                    location, sync.files_downloaded, sync.files_unchanged, sync.files_removed
+                ));
+                if sync.files_missing > 0 {
+                    status.warn(&format!(
+                        "{} sidecars couldn't be downloaded; their files are indexed in memory",
+                        sync.files_missing
+                    ));
+                }
+            }
+            // The shared index is read-only here; local edits are overlaid in memory
+            options.no_index_update = true;
+        }
+
+        if let Some(decomposer) = cli.multi_query {
+            options.sub_queries =
+                sub_queries(&pattern, decomposer, &cli, &search_root, &status).await;
+            if !options.sub_queries.is_empty() {
+                status.info(&format!(
+                    "Searching for: {}",
+                    options.sub_queries.join(" | ")
+                ));
+            }
+        }
+
+        let mut diagnose_options = options.clone();
+        diagnose_options.query = pattern.clone();
+        let summary = run_search(
+            pattern.clone(),
+            search_root,
+            options,
+            cli.facets,
+            cli.with_tests,
+            cli.neighbors,
+            cli.pack_tokens,
+            cli.format,
+            cli.ask.then(|| load_llm_config(&cli)),
+            cli.open.map(|n| (n, cli.open_command.as_deref())),
+            &status,
+        )
+        .await?;
+
+        if cli.files_without_matches {
+            let matched_canon: Vec<PathBuf> = summary
+                .matched_paths
+                .iter()
+                .map(|p| cs_core::paths::canonicalize_lossy(p))
+                .collect();
+
+            for target in &expanded_targets {
+                let canonical_target = cs_core::paths::canonicalize_lossy(target);
+                let target_is_dir = target.is_dir();
+                let has_match = matched_canon.iter().any(|matched| {
+                    if target_is_dir {
+                        cs_core::paths::starts_with(matched, &canonical_target)
+                    } else {
+                        cs_core::paths::paths_equal(matched, &canonical_target)
+                    }
+                });
+
+                if !has_match {
+                    println!("{}", target.display());
+                }
+            }
+        }
+
+        // grep-like exit codes: 0 if matches found, 1 if none
+        if !summary.had_matches {
+            // Say what to try: near misses, filters, files out of the index
+            if !cli.quiet && diagnose_options.mode != cs_core::SearchMode::Ast {
+                eprintln!("No matches found");
+                let mut diagnosis = cs_engine::diagnostics::diagnose(&diagnose_options)
+                    .await
+                    .unwrap_or_else(|e| {
+                        tracing::warn!("Couldn't diagnose the empty search: {}", e);
+                        Default::default()
+                    });
+                if diagnosis.nearest.is_empty() {
+                    diagnosis.nearest.extend(summary.closest_below_threshold);
+                }
+                print_diagnosis(&diagnosis, pattern, &diagnose_options);
+                std::process::exit(exit_code::NO_MATCHES);
+            }
+            exit_code::no_matches(cli.quiet);
+        }
+    } else {
+        eprintln!("Error: No pattern specified");
+        std::process::exit(exit_code::ERROR);
+    }
+
+    Ok(())
+}
+
+/// Why a search found nothing, on stderr: the nearest results beneath the
+/// threshold in red, the filters that ruled out every result, and files out
+/// of the index that mention the query.
+fn print_diagnosis(
+    diagnosis: &cs_engine::diagnostics::Diagnosis,
+    pattern: &str,
+    options: &SearchOptions,
+) {
+    if !diagnosis.nearest.is_empty() {
+        eprintln!();
+        eprintln!(
+            "{}",
+            style(if diagnosis.nearest.len() == 1 {
+                "(nearest match beneath the threshold)"
+            } else {
+                "(nearest matches beneath the threshold)"
+            })
+            .dim()
+        );
+        // Formatted like regular results, in red
+        for closest in &diagnosis.nearest {
+            let score_text = format!("[{:.3}] ", closest.score);
+            let file_text = format!("{}:", closest.file.display());
+            let highlighted_preview = highlight_matches(&closest.preview, pattern, options);
+            eprintln!(
+                "{}{}{}:{}",
+                style(score_text).red(),
+                style(file_text).red(),
+                style(closest.span.line_start).red(),
+                style(highlighted_preview).red()
+            );
+        }
+    }
+
+    if !diagnosis.filters.is_empty() {
+        eprintln!();
+        eprintln!("{}", style("(filters that ruled out every result)").dim());
+        for finding in &diagnosis.filters {
+            let change = if finding.filter == "--include-generated" {
+                "with --include-generated".to_string()
+            } else {
+                format!("without {}", finding.filter)
+            };
+            eprintln!(
+                "  {}: {} result{}",
+                style(change).yellow(),
+                finding.results,
+                if finding.results == 1 { "" } else { "s" }
+            );
+        }
+    }
+
+    if !diagnosis.excluded.is_empty() {
+        eprintln!();
+        eprintln!(
+            "{}",
+            style("(files left out of the index that mention the query)").dim()
+        );
+        for hit in &diagnosis.excluded {
+            let why = match &hit.exclusion {
+                cs_index::Exclusion::Gitignore => {
+                    "ignored by .gitignore; --no-ignore searches it".to_string()
+                }
+                cs_index::Exclusion::Pattern(pattern) => format!("excluded by '{}'", pattern),
+            };
+            eprintln!(
+                "  {}:{}  {}",
+                style(cs_core::paths::to_relative_slash(&hit.file)).cyan(),
+                style(hit.line).yellow(),
+                style(why).dim()
+            );
+        }
+    }
+}
+
+/// Files to search when `-g`, `-t`, `-T` or `--rg` is given, or `None` to
+/// search `targets` as usual. Files named explicitly are always searched, as
+/// ripgrep does.
+fn rg_filtered_files(
+    cli: &Cli,
+    targets: &[PathBuf],
+    exclude_patterns: &[String],
+    status: &StatusReporter,
+) -> Result<Option<Vec<PathBuf>>> {
+    if !cli.rg && cli.glob.is_empty() && cli.file_type.is_empty() && cli.type_not.is_empty() {
+        return Ok(None);
+    }
+    let filter = cs_index::file_filter::FileFilter::new(
+        Path::new("."),
+        &cli.glob,
+        &cli.file_type,
+        &cli.type_not,
+    )?;
+
+    let mut files = Vec::new();
+    for target in targets {
+        if !target.is_dir() {
+            files.push(target.clone());
+            continue;
+        }
+        let indexed = if cli.rg {
+            indexed_files_under(target, status)?
+        } else {
+            None
+        };
+        let candidates = match indexed {
+            Some(indexed) => indexed,
+            None => cs_index::collect_files(target, !cli.no_ignore, exclude_patterns)?,
+        };
+        files.extend(candidates.into_iter().filter(|file| filter.matches(file)));
+    }
+    Ok(Some(files))
+}
+
+/// Indexed files under `dir`, or `None` (after a warning) if it isn't indexed.
+fn indexed_files_under(dir: &Path, status: &StatusReporter) -> Result<Option<Vec<PathBuf>>> {
+    let repo_root = cs_index::find_repo_root(dir)?;
+    let Some(mut files) = cs_index::indexed_files(&repo_root)? else {
+        status.warn(&format!(
+            "{} isn't indexed; --rg is searching every file",
+            dir.display()
+        ));
+        return Ok(None);
+    };
+    let dir = cs_core::paths::canonicalize_lossy(dir);
+    files.retain(|file| {
+        cs_core::paths::starts_with(&cs_core::paths::canonicalize_lossy(file), &dir)
+    });
+    Ok(Some(files))
+}
+
+/// `[[boost]]` rules from the user config; an unreadable config shouldn't block searching.
+fn load_boost_rules() -> Vec<cs_core::BoostRule> {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.boost,
+        Err(e) => {
+            tracing::warn!("Ignoring boost rules: {}", e);
+            Vec::new()
+        }
+    }
+}
+
+/// `[[stop_symbol]]` rules from the user config.
+fn load_stop_symbol_rules() -> Vec<cs_core::StopSymbolRule> {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.stop_symbol,
+        Err(e) => {
+            tracing::warn!("Ignoring stop-symbol rules: {}", e);
+            Vec::new()
+        }
+    }
+}
+
+/// `max_typos` from the user config, for lexical searches that don't pass
+/// `--max-typos`.
+fn load_max_typos() -> u8 {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.max_typos,
+        Err(e) => {
+            tracing::warn!("Ignoring max_typos: {}", e);
+            cs_core::DEFAULT_MAX_TYPOS
+        }
+    }
+}
+
+/// `[fusion]` from the user config, with `--fusion` in place of its
+/// strategy when given.
+fn load_fusion(strategy: Option<cs_core::FusionStrategy>) -> cs_core::FusionConfig {
+    let mut fusion = match cs_models::UserConfig::load() {
+        Ok(config) => config.fusion.unwrap_or_default(),
+        Err(e) => {
+            tracing::warn!("Ignoring [fusion]: {}", e);
+            cs_core::FusionConfig::default()
+        }
+    };
+    if let Some(strategy) = strategy {
+        fusion.strategy = strategy;
+    }
+    fusion
+}
+
+/// `--snippet`, or the terminal policy under `[snippets]` in the user
+/// config.
+fn load_snippet_policy(policy: Option<cs_core::SnippetPolicy>) -> Option<cs_core::SnippetPolicy> {
+    policy.or_else(|| match cs_models::UserConfig::load() {
+        Ok(config) => config.snippets.and_then(|snippets| snippets.terminal),
+        Err(e) => {
+            tracing::warn!("Ignoring [snippets]: {}", e);
+            None
+        }
+    })
+}
+
+/// Parse a `--dp-epsilon` privacy budget, which must be positive.
+fn parse_epsilon(text: &str) -> std::result::Result<f64, String> {
+    match text.trim().parse::<f64>() {
+        Ok(epsilon) if epsilon > 0.0 && epsilon.is_finite() => Ok(epsilon),
+        _ => Err(format!(
+            "Invalid epsilon '{}'; expected a positive number like 1 or 0.5",
+            text
+        )),
+    }
+}
+
+/// `query_analytics` from the user config; searches aren't recorded unless
+/// it is set.
+fn load_query_analytics() -> bool {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.query_analytics,
+        Err(e) => {
+            tracing::warn!("Ignoring query_analytics: {}", e);
+            false
+        }
+    }
+}
+
+/// `cs --index --collection NAME [PATHS]`, or with `--stdin`. Collections
+/// belong to the index of the repository holding the current directory, so
+/// the paths are the collection's sources.
+async fn run_collection_index(status: &StatusReporter, cli: &Cli) -> Result<()> {
+    let [name] = cli.collection.as_slice() else {
+        anyhow::bail!("--index takes a single --collection");
+    };
+    let sources: Vec<PathBuf> = cli
+        .pattern
+        .iter()
+        .map(PathBuf::from)
+        .chain(cli.files.iter().cloned())
+        .collect();
+    // The model is validated up front, so a typo doesn't surface mid-stream
+    let model = match cli.model.as_deref() {
+        Some(model) => {
+            let registry = cs_models::ModelRegistry::default();
+            Some(resolve_model_selection(&registry, Some(model))?.1.name)
+        }
+        None => None,
+    };
+    let repo_root = cs_index::find_repo_root(Path::new("."))?;
+    // Without paths, a collection read from a tracker or chat export is read
+    // from it again
+    let connector = match (&cli.issues, &cli.chats) {
+        (Some(tracker), _) => Some(tracker.clone()),
+        (_, Some(export)) => Some(format!(
+            "{}{}",
+            cs_index::chats::CHATS_CONNECTOR,
+            cs_core::paths::canonicalize_lossy(export).display()
+        )),
+        _ if sources.is_empty() && !cli.stdin => {
+            cs_index::collections::load_collection(&repo_root, name)?.and_then(|c| c.connector)
+        }
+        _ => None,
+    };
+    if connector.is_some() && !sources.is_empty() {
+        anyhow::bail!("--issues and --chats read the collection from elsewhere; drop the paths");
+    }
+
+    if let Some((scope, go_mod)) = connector
+        .as_deref()
+        .and_then(cs_index::go_deps::parse_connector)
+    {
+        return run_deps_index(status, &repo_root, &go_mod, scope);
+    }
+    if connector
+        .as_deref()
+        .is_some_and(|c| c.starts_with(cs_index::go_stdlib::GOROOT_CONNECTOR))
+    {
+        return run_stdlib_index(status, &repo_root);
+    }
+    let chat_export = connector
+        .as_deref()
+        .and_then(|c| c.strip_prefix(cs_index::chats::CHATS_CONNECTOR));
+    let read = match (&connector, chat_export) {
+        (_, Some(_)) => "conversations",
+        (Some(_), None) => "issues",
+        _ => "files",
+    };
+    let stats = if let (Some(connector), Some(export)) = (connector.as_deref(), chat_export) {
+        let spinner = status.create_spinner(&format!("Embedding {} into {}...", export, name));
+        let conversations = cs_index::chats::read_chat_export(Path::new(export))?;
+        let stats = cs_index::collections::index_collection_documents(
+            &repo_root,
+            name,
+            connector,
+            &conversations,
+            model.as_deref(),
+        )?;
+        status.finish_progress(spinner, "Collection indexed");
+        stats
+    } else if let Some(tracker) = connector.as_deref() {
+        let spinner = status.create_spinner(&format!("Fetching issues from {}...", tracker));
+        let issues = cs_index::tickets::fetch_issues(tracker).await?;
+        status.finish_progress(spinner, &format!("Fetched {} issues", issues.len()));
+        let spinner = status.create_spinner(&format!("Embedding issues into {}...", name));
+        let stats = cs_index::collections::index_collection_documents(
+            &repo_root,
+            name,
+            tracker,
+            &issues,
+            model.as_deref(),
+        )?;
+        status.finish_progress(spinner, "Collection indexed");
+        stats
+    } else if cli.stdin {
+        if !sources.is_empty() {
+            anyhow::bail!("--stdin reads the collection from stdin; drop the paths");
+        }
+        let spinner = status.create_spinner(&format!("Embedding stdin into {}...", name));
+        let stats = cs_index::collections::index_collection(
+            &repo_root,
+            name,
+            std::io::stdin().lock(),
+            model.as_deref(),
+        )?;
+        status.finish_progress(spinner, "Collection indexed");
+        stats
+    } else {
+        let spinner = status.create_spinner(&format!("Embedding files into {}...", name));
+        let stats = cs_index::collections::index_collection_files(
+            &repo_root,
+            name,
+            &sources,
+            model.as_deref(),
+        )?;
+        status.finish_progress(spinner, "Collection indexed");
+        stats
+    };
+    status.success(&format!(
+        "Collection {}: {} {}, {} lines, {} chunks embedded",
+        name, stats.files_read, read, stats.lines_read, stats.chunks_embedded
+    ));
+    if stats.chunks_withheld > 0 {
+        status.warn(&format!(
+            "{} chunks withheld from the remote embedder",
+            stats.chunks_withheld
+        ));
+    }
+    Ok(())
+}
+
+/// `--with-deps`: index the modules `go_mod` requires into the deps
+/// collection, unless they're in it already.
+fn run_deps_index(
+    status: &StatusReporter,
+    repo_root: &Path,
+    go_mod: &Path,
+    scope: cs_index::go_deps::DepsScope,
+) -> Result<()> {
+    let name = cs_index::go_deps::DEPS_COLLECTION;
+    let spinner = status.create_spinner(&format!("Indexing Go dependencies into {}...", name));
+    let stats = cs_index::go_deps::index_deps(repo_root, name, go_mod, scope, None)?;
+    status.finish_progress(spinner, "Dependencies indexed");
+    match &stats.collection {
+        Some(collection) => status.success(&format!(
+            "Dependencies: {} modules, {} files, {} chunks embedded into {}",
+            stats.modules, collection.files_read, collection.chunks_embedded, name
+        )),
+        None => status.info(&format!(
+            "Dependencies: {} modules, already indexed in {}",
+            stats.modules, name
+        )),
+    }
+    if !stats.missing.is_empty() {
+        status.warn(&format!(
+            "{} modules aren't in the module cache ({}); run go mod download, then cs --index again",
+            stats.missing.len(),
+            stats.missing.join(", ")
+        ));
+    }
+    if !stats.local.is_empty() {
+        status.info(&format!(
+            "Skipped modules replaced with local directories: {}",
+            stats.local.join(", ")
+        ));
+    }
+    Ok(())
+}
+
+/// `--with-stdlib`: index the standard library of the Go installation into
+/// the stdlib collection, unless that Go version's is in it already.
+fn run_stdlib_index(status: &StatusReporter, repo_root: &Path) -> Result<()> {
+    let name = cs_index::go_stdlib::STDLIB_COLLECTION;
+    let spinner = status.create_spinner(&format!(
+        "Indexing the Go standard library into {}...",
+        name
+    ));
+    let stats = cs_index::go_stdlib::index_stdlib(repo_root, name, None, None)?;
+    status.finish_progress(spinner, "Standard library indexed");
+    match &stats.collection {
+        Some(collection) => status.success(&format!(
+            "Standard library ({}): {} packages, {} chunks embedded into {}",
+            stats.version, stats.packages, collection.chunks_embedded, name
+        )),
+        None => status.info(&format!(
+            "Standard library ({}): {} packages, already indexed in {}",
+            stats.version, stats.packages, name
+        )),
+    }
+    Ok(())
+}
+
+/// `--hot-model`: embed the most matched chunks of the index at `repo_root`
+/// with `model` from now on, or stop with `off`.
+fn configure_hot_model(
+    status: &StatusReporter,
+    cli: &Cli,
+    repo_root: &Path,
+    model: &str,
+) -> Result<()> {
+    if model == "off" {
+        if cs_index::hot_chunks::disable(repo_root)? {
+            status.info("🔥 Hot chunks: off; their vectors and match counts are removed");
+        }
+        return Ok(());
+    }
+    let registry = cs_models::ModelRegistry::default();
+    let (alias, config) = resolve_model_selection(&registry, Some(model))?;
+    let index_model = cs_index::load_manifest(repo_root)?.and_then(|m| m.embedding_model);
+    if index_model.as_deref() == Some(config.name.as_str()) {
+        anyhow::bail!(
+            "{} is already the index's model; pick a better one for --hot-model",
+            alias
+        );
+    }
+    let previous = cs_index::hot_chunks::settings(repo_root);
+    let min_matches = cli
+        .hot_min_matches
+        .or(previous.as_ref().map(|p| p.min_matches))
+        .unwrap_or(cs_index::hot_chunks::DEFAULT_MIN_MATCHES);
+    let max_chunks = cli
+        .hot_max_chunks
+        .or(previous.as_ref().map(|p| p.max_chunks))
+        .unwrap_or(cs_index::hot_chunks::DEFAULT_MAX_CHUNKS);
+    let unchanged = previous.as_ref().is_some_and(|p| {
+        p.model == config.name && p.min_matches == min_matches && p.max_chunks == max_chunks
+    });
+    if !unchanged {
+        cs_index::hot_chunks::enable(repo_root, &config.name, min_matches, max_chunks)?;
+        status.info(&format!(
+            "🔥 Hot chunks: up to {} chunks matched {}+ times are re-embedded with {}",
+            max_chunks, min_matches, alias
+        ));
+    }
+    Ok(())
+}
+
+/// Re-embed the chunks searches of the index at `repo_root` matched most
+/// with its hot model, and drop the vectors of those that cooled off.
+fn run_hot_refresh(status: &StatusReporter, repo_root: &Path) -> Result<()> {
+    let spinner = status.create_spinner("Re-embedding hot chunks...");
+    let refresh = cs_index::hot_chunks::refresh(repo_root)?;
+    status.finish_progress(spinner, "Hot chunks updated");
+    let Some(refresh) = refresh else {
+        return Ok(());
+    };
+    if refresh.hot == 0 && refresh.dropped == 0 {
+        status.info(&format!(
+            "Hot chunks: none yet; chunks searches keep matching are re-embedded with {} on a later --index",
+            refresh.model
+        ));
+    } else {
+        status.success(&format!(
+            "Hot chunks: {} on {} ({} embedded, {} unchanged, {} cooled off or changed)",
+            refresh.hot, refresh.model, refresh.embedded, refresh.unchanged, refresh.dropped
+        ));
+    }
+    Ok(())
+}
+
+/// `--migrate-model`: re-embed the next `batch` files of the index at
+/// `index_root` with `model`, starting the migration to it if need be, or
+/// drop the migration with `off`.
+fn run_model_migration(
+    status: &StatusReporter,
+    index_root: &Path,
+    model: &str,
+    batch: Option<usize>,
+) -> Result<()> {
+    status.section_header("Migrating Embedding Model");
+    if model == "off" {
+        if cs_index::model_migration::abort(index_root)? {
+            status.info("Model migration dropped; the index stays on its model");
+        } else {
+            status.info("The index isn't migrating");
+        }
+        return Ok(());
+    }
+    let registry = cs_models::ModelRegistry::default();
+    let (alias, config) = resolve_model_selection(&registry, Some(model))?;
+    let migration = cs_index::model_migration::start(index_root, &config.name, config.dimensions)?;
+    status.info(&format!("From {} to {}", migration.from, migration.to));
+
+    let batch_files = batch.unwrap_or(cs_index::model_migration::DEFAULT_BATCH_FILES);
+    let spinner = status.create_spinner(&format!("Re-embedding files with {}...", alias));
+    let report = |done: usize, total: usize| {
+        if let Some(spinner) = &spinner {
+            spinner.set_message(format!(
+                "Re-embedding files with {} ({}/{})...",
+                alias, done, total
+            ));
+        }
+    };
+    let progress = cs_index::model_migration::migrate(index_root, batch_files, Some(&report))?;
+    status.finish_progress(
+        spinner,
+        &format!("Re-embedded {} files with {}", progress.migrated, alias),
+    );
+    if progress.skipped > 0 {
+        status.warn(&format!(
+            "{} files changed or went away since the last update; they're migrated once 'cs --index' has caught up",
+            progress.skipped
+        ));
+    }
+    if progress.switched {
+        // Its lists cluster the old model's vectors
+        let ann = cs_core::locations::index_dir(index_root).join(cs_engine::query_plan::ANN_FILE);
+        let _ = std::fs::remove_file(ann);
+        status.success(&format!(
+            "Migration complete: the index now uses {} ({} files)",
+            alias, progress.total
+        ));
+    } else {
+        status.success(&format!(
+            "{} of {} files on {}; searches score each file with its own model until the rest are",
+            progress.done, progress.total, alias
+        ));
+        status.info(&format!(
+            "Run 'cs --migrate-model {}' again to migrate the next {} files",
+            model, batch_files
+        ));
+    }
+    Ok(())
+}
+
+/// The projects of the monorepo at `repo_root`: those its index was sharded
+/// by, else the ones there now.
+fn monorepo_projects(cli: &Cli, repo_root: &Path) -> Result<Vec<cs_index::projects::Project>> {
+    if let Some(saved) = cs_index::projects::saved_projects(repo_root) {
+        return Ok(saved.to_vec());
+    }
+    let exclude_patterns = build_exclude_patterns(cli, Some(repo_root));
+    cs_index::projects::discover_projects(repo_root, !cli.no_ignore, &exclude_patterns)
+}
+
+/// `--project`: search that project of the monorepo the paths are in,
+/// instead of the paths themselves.
+fn scope_to_project(cli: &mut Cli) -> Result<()> {
+    let Some(name) = cli.project.as_deref() else {
+        return Ok(());
+    };
+    let path = cli
+        .files
+        .first()
+        .cloned()
+        .unwrap_or_else(|| PathBuf::from("."));
+    let repo_root = cs_index::find_repo_root(&path)?;
+    let projects = monorepo_projects(cli, &repo_root)?;
+    let Some(project) = cs_index::projects::find_project(&projects, name) else {
+        let names: Vec<&str> = projects.iter().map(|p| p.name.as_str()).collect();
+        anyhow::bail!(
+            "No project '{}' in {}; found: {}",
+            name,
+            repo_root.display(),
+            if names.is_empty() {
+                "none".to_string()
+            } else {
+                names.join(", ")
+            }
+        );
+    };
+    cli.files = vec![repo_root.join(&project.path)];
+    Ok(())
+}
+
+/// Apply `--index-location` (or `index_location` in config.toml) and
+/// `--index-dir` for the rest of the process.
+fn configure_index_location(cli: &Cli) -> Result<()> {
+    let location = cli
+        .index_location
+        .unwrap_or_else(|| match cs_models::UserConfig::load() {
+            Ok(config) => config.index_location.unwrap_or_default(),
+            Err(e) => {
+                tracing::warn!("Ignoring index_location config: {}", e);
+                cs_core::locations::IndexLocation::default()
+            }
+        });
+    cs_core::locations::set_index_location(location);
+
+    if let Some(dir) = &cli.index_dir {
+        let path = cli
+            .files
+            .first()
+            .cloned()
+            .unwrap_or_else(|| PathBuf::from("."));
+        let repo_root = cs_index::find_repo_root(&path)?;
+        cs_core::locations::set_index_dir(&repo_root, dir);
+    }
+    Ok(())
+}
+
+/// Apply `--ca-cert` and `[network]` in config.toml to the HTTP clients
+/// talking to remote providers.
+fn configure_network(cli: &Cli) {
+    let mut network = match cs_models::UserConfig::load() {
+        Ok(config) => config.network.unwrap_or_default(),
+        Err(e) => {
+            tracing::warn!("Ignoring network config: {}", e);
+            cs_core::network::NetworkConfig::default()
+        }
+    };
+    if let Some(ca_cert) = &cli.ca_cert {
+        network.ca_cert = Some(ca_cert.clone());
+    }
+    cs_core::network::set_network_config(network);
+}
+
+/// Apply `--ignore-path-case`, `--ignore-path-accents` and `[path_matching]`
+/// in config.toml to path filters.
+fn configure_path_matching(cli: &Cli) {
+    let mut matching = match cs_models::UserConfig::load() {
+        Ok(config) => config.path_matching.unwrap_or_default(),
+        Err(e) => {
+            tracing::warn!("Ignoring path_matching config: {}", e);
+            cs_core::paths::PathMatching::default()
+        }
+    };
+    matching.ignore_case |= cli.ignore_path_case;
+    matching.ignore_accents |= cli.ignore_path_accents;
+    cs_core::paths::set_path_matching(matching);
+}
+
+/// `--index --dry-run`: what the run would embed, and roughly how long it
+/// would take and cost.
+fn report_index_plan(
+    status: &StatusReporter,
+    cli: &Cli,
+    path: &Path,
+    model_config: &cs_models::ModelConfig,
+) -> Result<()> {
+    // An existing index keeps embedding with its own model
+    let manifest = cs_index::load_manifest(path)?;
+    let model_name = manifest
+        .as_ref()
+        .and_then(|manifest| manifest.embedding_model.clone())
+        .unwrap_or_else(|| model_config.name.clone());
+    let provider = cs_models::ModelRegistry::default()
+        .models
+        .values()
+        .find(|config| config.name == model_name)
+        .map(|config| config.provider.clone())
+        .unwrap_or_else(|| model_config.provider.clone());
+    let adds_vectors = (cli.multi_vector && !cs_index::multi_vector::is_enabled(path))
+        || (cli.sparse && cs_index::sparse::sparse_model(path).is_none());
+    let rebuild = adds_vectors && manifest.is_some();
+    let multi_vector = cli.multi_vector || cs_index::multi_vector::is_enabled(path);
+
+    let spinner = status.create_spinner("Planning index run...");
+    let plan = cs_index::dry_run::plan_index(
+        path,
+        !cli.no_ignore,
+        &build_exclude_patterns(cli, Some(path)),
+        &model_name,
+        rebuild,
+        multi_vector,
+    )?;
+    if let Some(pb) = spinner {
+        pb.finish_and_clear();
+    }
+    let seconds = plan.estimated_seconds(&provider);
+    let remote = cs_index::dry_run::is_remote_provider(&provider);
+    let cost = if remote {
+        cli.token_price.map(|price| plan.estimated_cost(price))
+    } else {
+        Some(0.0)
+    };
+
+    if cli.json || cli.jsonl {
+        let mut value = serde_json::to_value(&plan)?;
+        value["model"] = serde_json::Value::String(model_name);
+        value["rebuild"] = serde_json::Value::Bool(rebuild);
+        value["estimated_seconds"] = serde_json::json!(seconds.round());
+        value["estimated_cost_usd"] = serde_json::json!(cost);
+        println!("{}", serde_json::to_string(&value)?);
+        return Ok(());
+    }
+
+    println!("{}", style("Index dry run (nothing was written)").bold());
+    println!("  Model:   {} ({})", model_name, provider);
+    if rebuild {
+        println!("  Every file is re-embedded: the index gets new vectors");
+    }
+    println!(
+        "  Files:   {} added, {} changed, {} removed, {} unchanged",
+        plan.files_added, plan.files_changed, plan.files_removed, plan.files_unchanged
+    );
+    println!(
+        "  Chunks:  {} to embed, {} dropped",
+        plan.chunks_embedded, plan.chunks_dropped
+    );
+    if plan.sub_vectors_embedded > 0 {
+        println!(
+            "           {} statement vectors on top (multi-vector)",
+            plan.sub_vectors_embedded
+        );
+    }
+    println!("  Tokens:  ~{}", plan.estimated_tokens);
+    println!("  Time:    ~{} (rough)", format_estimated_duration(seconds));
+    match cost {
+        Some(cost) if remote => println!("  Cost:    ~${:.2}", cost),
+        Some(_) => println!("  Cost:    none, the model runs locally"),
+        None => println!("  Cost:    pass --token-price USD (per million tokens) to estimate it"),
+    }
+    if plan.files_removed > 0 {
+        println!(
+            "  {} removed files stay in the index until cs --clean-orphans",
+            plan.files_removed
+        );
+    }
+    Ok(())
+}
+
+/// `--init`: look the repository over, write the `.cs.toml` and `.csignore`
+/// its recommendations call for, and index it on `--index` or when the
+/// user agrees.
+async fn run_init(status: &StatusReporter, cli: &Cli) -> Result<()> {
+    let path = cli
+        .files
+        .first()
+        .cloned()
+        .unwrap_or_else(|| PathBuf::from("."));
+    let root = cs_index::find_repo_root(&path)?;
+    let exclude_patterns = build_exclude_patterns(cli, Some(&root));
+
+    let spinner = status.create_spinner("Looking the repository over...");
+    let survey = onboarding::survey(&root, !cli.no_ignore, &exclude_patterns)?;
+    let model = onboarding::recommend_model(
+        &survey,
+        std::env::var("JINA_API_KEY").is_ok_and(|key| !key.is_empty()),
+    );
+    let registry = cs_models::ModelRegistry::default();
+    let (model_alias, model_config) = resolve_model_selection(&registry, Some(model.alias))?;
+    let mut planned_excludes = exclude_patterns;
+    planned_excludes.extend(
+        survey
+            .suggested_excludes
+            .iter()
+            .map(|exclude| exclude.pattern.clone()),
+    );
+    let plan = cs_index::dry_run::plan_index(
+        &root,
+        !cli.no_ignore,
+        &planned_excludes,
+        &model_config.name,
+        false,
+        false,
+    )?;
+    if let Some(pb) = spinner {
+        pb.finish_and_clear();
+    }
+    let (chunk_tokens, overlap_tokens) =
+        cs_chunk::get_model_chunk_config(Some(model_config.name.as_str()));
+    let seconds = plan.estimated_seconds(&model_config.provider);
+    let indexed = cs_index::load_manifest(&root)?.is_some();
+
+    let mut written = Vec::new();
+    let config_path = root.join(cs_models::PROJECT_CONFIG_FILE);
+    if !config_path.exists() {
+        std::fs::write(&config_path, onboarding::project_config(&model))?;
+        written.push(cs_models::PROJECT_CONFIG_FILE);
+    }
+    if !cli.no_csignore {
+        let csignore_path = root.join(".csignore");
+        let existing = match std::fs::read_to_string(&csignore_path) {
+            Ok(existing) => Some(existing),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => None,
+            Err(e) => return Err(e.into()),
+        };
+        let csignore = onboarding::csignore_with(
+            existing
+                .as_deref()
+                .unwrap_or(cs_core::get_default_csignore_content()),
+            &survey.suggested_excludes,
+        );
+        if existing.as_deref() != Some(csignore.as_str()) {
+            std::fs::write(&csignore_path, csignore)?;
+            written.push(".csignore");
+        }
+    }
+
+    if cli.json || cli.jsonl {
+        let value = serde_json::json!({
+            "root": root,
+            "survey": survey,
+            "model": model,
+            "chunk_tokens": chunk_tokens,
+            "overlap_tokens": overlap_tokens,
+            "plan": plan,
+            "estimated_seconds": seconds.round(),
+            "written": written,
+        });
+        println!("{}", serde_json::to_string(&value)?);
+    } else {
+        println!("{}", style(format!("Repository {}", root.display())).bold());
+        println!(
+            "  Files:     {} ({:.1} MB)",
+            survey.files,
+            survey.bytes as f64 / (1024.0 * 1024.0)
+        );
+        let languages: Vec<String> = survey
+            .languages
+            .iter()
+            .take(5)
+            .map(|share| {
+                format!(
+                    "{} {:.0}%",
+                    share.language,
+                    share.bytes as f64 * 100.0 / survey.bytes.max(1) as f64
+                )
+            })
+            .collect();
+        println!("  Languages: {}", languages.join(", "));
+        for exclude in &survey.suggested_excludes {
+            println!(
+                "  Exclude:   {} ({} files): {}",
+                style(&exclude.pattern).cyan(),
+                exclude.files,
+                exclude.reason
+            );
+        }
+        println!("\n{}", style("Recommended").bold());
+        println!(
+            "  Model:     {}: {}",
+            style(model.alias).cyan(),
+            model.reason
+        );
+        println!(
+            "  Chunks:    split along the syntax tree, up to {} tokens with {} tokens of overlap",
+            chunk_tokens, overlap_tokens
+        );
+        println!(
+            "  Index:     {} chunks, ~{} tokens, ~{} (rough)",
+            plan.chunks_embedded,
+            plan.estimated_tokens,
+            format_estimated_duration(seconds)
+        );
+        if cs_index::dry_run::is_remote_provider(&model_config.provider) {
+            println!(
+                "  Cost:      cs --index --dry-run --model {} --token-price USD estimates it",
+                model.alias
+            );
+        } else {
+            println!("  Cost:      none, the model runs locally");
+        }
+        println!();
+        if written.is_empty() {
+            status.info("Kept the existing .cs.toml and .csignore");
+        } else {
+            status.success(&format!("Wrote {}", written.join(" and ")));
+        }
+    }
+
+    if indexed {
+        status.info(
+            "Already indexed; cs --index updates it, and cs --switch-model changes its model",
+        );
+        return Ok(());
+    }
+    let index_now = cli.index
+        || (!cli.json && !cli.jsonl && confirm(&format!("Index now with {}?", model.alias))?);
+    if !index_now {
+        status.info(&format!(
+            "Index it with: cs --index --model {} {}",
+            model.alias,
+            root.display()
+        ));
+        return Ok(());
+    }
+    run_index_workflow(
+        status,
+        &root,
+        cli,
+        &model_alias,
+        &model_config,
+        "Indexing Repository",
+        false,
+    )
+    .await
+}
+
+/// Ask `question` on the terminal, yes by default. Without a terminal
+/// there's no one to answer, so it's no.
+fn confirm(question: &str) -> Result<bool> {
+    use std::io::{BufRead, IsTerminal, Write};
+
+    if !std::io::stdin().is_terminal() {
+        return Ok(false);
+    }
+    eprint!("{} [Y/n] ", question);
+    std::io::stderr().flush()?;
+    let mut answer = String::new();
+    std::io::stdin().lock().read_line(&mut answer)?;
+    Ok(matches!(
+        answer.trim().to_lowercase().as_str(),
+        "" | "y" | "yes"
+    ))
+}
+
+fn format_estimated_duration(seconds: f64) -> String {
+    let seconds = seconds.ceil() as u64;
+    match seconds {
+        0..60 => format!("{}s", seconds.max(1)),
+        60..3600 => format!("{}m", seconds.div_ceil(60)),
+        _ => format!("{}h {}m", seconds / 3600, (seconds % 3600).div_ceil(60)),
+    }
+}
+
+/// The `[llm]` config for `--ask`, overridden by `--llm-url`/`--llm-model`.
+/// The parts `--multi-query` splits `query` into, none when it asks for one
+/// thing. A chat model that can't be reached leaves the split to
+/// conjunctions.
+async fn sub_queries(
+    query: &str,
+    decomposer: cs_engine::multi_query::Decomposer,
+    cli: &Cli,
+    search_root: &Path,
+    status: &StatusReporter,
+) -> Vec<String> {
+    use cs_engine::multi_query::{self, Decomposer};
+
+    if !multi_query::is_long(query) {
+        return Vec::new();
+    }
+    if decomposer == Decomposer::Llm {
+        let repo_root =
+            cs_index::find_repo_root(search_root).unwrap_or_else(|_| search_root.to_path_buf());
+        match multi_query::decompose_with_llm(query, &load_llm_config(cli), &repo_root).await {
+            Ok(sub_queries) => return sub_queries,
+            Err(e) => status.warn(&format!(
+                "Couldn't split the query with the chat model ({}); splitting at conjunctions",
+                e
+            )),
+        }
+    }
+    multi_query::split_query(query)
+}
+
+fn load_llm_config(cli: &Cli) -> cs_core::LlmConfig {
+    let mut config = match cs_models::UserConfig::load() {
+        Ok(config) => config.llm.unwrap_or_default(),
+        Err(e) => {
+            tracing::warn!("Ignoring [llm] config: {}", e);
+            cs_core::LlmConfig::default()
+        }
+    };
+    if let Some(url) = &cli.llm_url {
+        config.url = Some(url.clone());
+    }
+    if let Some(model) = &cli.llm_model {
+        config.model = Some(model.clone());
+    }
+    config
+}
+
+fn skip_reason_label(reason: cs_index::read_limits::SkipReason) -> &'static str {
+    match reason {
+        cs_index::read_limits::SkipReason::TooLarge => "too large",
+        cs_index::read_limits::SkipReason::Minified => "minified",
+        cs_index::read_limits::SkipReason::FixtureBudget => "over fixture budget",
+    }
+}
+
+fn load_redaction_rules() -> Vec<cs_core::RedactionRule> {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.redact,
+        Err(e) => {
+            tracing::warn!("Ignoring redaction rules: {}", e);
+            Vec::new()
+        }
+    }
+}
+
+fn load_fixture_rules() -> Vec<cs_core::FixtureRule> {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.fixture,
+        Err(e) => {
+            tracing::warn!("Ignoring fixture rules: {}", e);
+            Vec::new()
+        }
+    }
+}
 
-            std::process::exit(1);
+fn load_trusted_extractor_roots() -> Vec<PathBuf> {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.trusted_extractor_roots,
+        Err(e) => {
+            tracing::warn!("Ignoring trusted extractor roots: {}", e);
+            Vec::new()
         }
-    } else {
-        eprintln!("Error: No pattern specified");
-        std::process::exit(1);
     }
+}
 
-    Ok(())
+fn load_index_segments() -> bool {
+    match cs_models::UserConfig::load() {
+        Ok(config) => config.index_segments,
+        Err(e) => {
+            tracing::warn!("Ignoring index_segments: {}", e);
+            false
+        }
+    }
 }
 
 fn build_options(cli: &Cli, reindex: bool, repo_root: Option<&Path>) -> SearchOptions {
-    let mode = if cli.semantic {
+    let mode = if cli.rg {
+        SearchMode::Regex
+    } else if cli.semantic || (cli.ask && !cli.lexical && !cli.hybrid) {
         SearchMode::Semantic
     } else if cli.lexical {
         SearchMode::Lexical
@@ -1631,7 +6310,9 @@ fn build_options(cli: &Cli, reindex: bool, repo_root: Option<&Path>) -> SearchOp
     let exclude_patterns = build_exclude_patterns(cli, repo_root);
 
     // Set intelligent defaults for semantic search
+    // Packing needs more candidates than fit, to fill the budget
     let default_topk = match mode {
+        SearchMode::Semantic if cli.pack_tokens.is_some() || cli.ask => Some(50),
         SearchMode::Semantic => Some(10),
         _ => None,
     };
@@ -1675,6 +6356,34 @@ fn build_options(cli: &Cli, reindex: bool, repo_root: Option<&Path>) -> SearchOp
         ast_lang: cli.ast_lang.clone(),
         ast_selector: None,
         ast_strictness: cli.ast_strictness.clone(),
+        truncate_dims: cli.truncate_dims,
+        no_index_update: cli.no_index_update,
+        vector_store: cli.store.clone(),
+        store_repos: cli.store_repo.clone(),
+        boost_rules: load_boost_rules(),
+        stop_symbol_rules: load_stop_symbol_rules(),
+        include_generated: cli.include_generated,
+        facet_filters: cli.facet.clone(),
+        facet_summary: cli.facets,
+        no_query_cache: cli.no_query_cache,
+        explain_plan: cli.explain_plan,
+        collections: cli.collection.clone(),
+        license_filters: cli.license.clone(),
+        metadata_filters: cli.meta.clone(),
+        must_match: cli.must_match.clone(),
+        explain_scores: cli.explain_scores,
+        tag_filters: cli.tag.clone(),
+        max_typos: cli.max_typos.unwrap_or_else(load_max_typos),
+        fusion: load_fusion(cli.fusion),
+        snippet: load_snippet_policy(cli.snippet),
+        focus: cli.focus.clone(),
+        sub_queries: Vec::new(),
+        // -t already says which languages to search
+        infer_language: if cli.file_type.is_empty() {
+            cli.infer_lang.unwrap_or_default()
+        } else {
+            cs_core::LanguageInference::Off
+        },
     }
 }
 
@@ -1760,21 +6469,609 @@ fn apply_heatmap_color(token: &str, score: f32) -> String {
     }
 }
 
+/// Facet counts go to stderr so stdout stays grep-compatible.
+fn print_facet_summary(facets: &cs_engine::facets::FacetSummary) {
+    use cs_core::FacetKind;
+
+    eprintln!();
+    eprintln!("{}", style(format!("Facets ({} results)", facets.total)).bold());
+    for (label, kind) in [
+        ("lang", FacetKind::Language),
+        ("dir", FacetKind::Directory),
+        ("kind", FacetKind::SymbolKind),
+        ("owner", FacetKind::Owner),
+    ] {
+        let counts = facets.get(kind);
+        if counts.is_empty() {
+            continue;
+        }
+        let values: Vec<String> = counts
+            .iter()
+            .map(|c| format!("{} {}", c.value, style(c.count).yellow()))
+            .collect();
+        eprintln!("  {:<6} {}", label, values.join(" · "));
+    }
+    eprintln!("  Narrow with --facet KEY=VALUE, e.g. --facet lang=go");
+}
+
+/// Serialize a JSON result, adding `tests`, `implements` and `references` arrays
+/// when non-empty, the chunk's `summary` when it has one, and the symbol it's
+/// `pinned` as when it overlaps a pin.
+fn result_json<T: serde::Serialize>(
+    result: &T,
+    anchor: Option<cs_engine::anchors::Anchor>,
+    tests: Vec<cs_engine::go_tests::GoTest>,
+    implements: Vec<String>,
+    references: Vec<cs_engine::go_refs::GoReference>,
+    neighbors: Option<cs_engine::neighbors::ChunkNeighbors>,
+    summary: Option<String>,
+    tags: Vec<String>,
+    pinned: Option<&str>,
+    best_match: Option<cs_core::Span>,
+    explanation: Option<&cs_core::ScoreExplanation>,
+) -> Result<String> {
+    let mut value = serde_json::to_value(result)?;
+    if let Some(best_match) = best_match {
+        value["best_match"] = serde_json::to_value(best_match)?;
+    }
+    if let Some(anchor) = anchor {
+        value["anchor"] = serde_json::Value::String(anchor.to_string());
+    }
+    if let Some(summary) = summary {
+        value["summary"] = serde_json::Value::String(summary);
+    }
+    if !tags.is_empty() {
+        value["tags"] = serde_json::to_value(tags)?;
+    }
+    if let Some(symbol) = pinned {
+        value["pinned"] = serde_json::Value::String(symbol.to_string());
+    }
+    if !tests.is_empty() {
+        value["tests"] = serde_json::to_value(tests)?;
+    }
+    if !implements.is_empty() {
+        value["implements"] = serde_json::to_value(implements)?;
+    }
+    if !references.is_empty() {
+        value["references"] = serde_json::to_value(references)?;
+    }
+    if let Some(neighbors) = neighbors {
+        value["neighbors"] = serde_json::to_value(neighbors)?;
+    }
+    if let Some(explanation) = explanation {
+        value["score_explanation"] = serde_json::to_value(explanation)?;
+    }
+    Ok(serde_json::to_string(&value)?)
+}
+
+/// `--eval-compare`: run the golden queries under `--config-a` and
+/// `--config-b` and print their metrics side by side, then the queries whose
+/// first relevant result moved.
+async fn run_eval_compare(cli: &Cli, status: &StatusReporter) -> Result<()> {
+    let (Some(config_a), Some(config_b)) = (cli.config_a.as_deref(), cli.config_b.as_deref())
+    else {
+        anyhow::bail!("--eval-compare needs --config-a and --config-b");
+    };
+    // No pattern is searched, so a lone path lands in pattern
+    let path = cli
+        .files
+        .first()
+        .cloned()
+        .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+        .unwrap_or_else(|| PathBuf::from("."));
+    let golden_path = cli.golden.clone().unwrap_or_else(|| {
+        cs_engine::find_nearest_index_root(&path)
+            .unwrap_or_else(|| path.clone())
+            .join(cs_engine::eval::GOLDEN_FILE)
+    });
+    let golden = cs_engine::eval::load_golden_set(&golden_path)?;
+    let mut base = build_options(cli, cli.reindex, Some(path.as_path()));
+    base.path = path;
+
+    let mut reports = Vec::new();
+    for config_path in [config_a, config_b] {
+        let config = cs_engine::eval::EvalConfig::load(config_path)?;
+        let options = config.apply(&base)?;
+        let name = config.name.unwrap_or_default();
+        let spinner = status.create_spinner(&format!(
+            "Running {} golden queries with {}...",
+            golden.len(),
+            name
+        ));
+        let report = cs_engine::eval::evaluate(&name, &golden, &options).await?;
+        status.finish_progress(spinner, &format!("Evaluated {}", name));
+        reports.push(report);
+    }
+    let (a, b) = (&reports[0], &reports[1]);
+
+    if cli.json || cli.jsonl {
+        println!("{}", serde_json::json!({ "a": a, "b": b }));
+        return Ok(());
+    }
+
+    let width = a.name.len().max(b.name.len()).max(8);
+    println!(
+        "{:<14} {:>width$} {:>width$} {:>9}",
+        style("metric").bold(),
+        style(&a.name).bold(),
+        style(&b.name).bold(),
+        style("change").bold()
+    );
+    let rows: [(&str, fn(&cs_engine::eval::Metrics) -> f64, bool); 6] = [
+        ("P@1", |m| m.precision_at_1, true),
+        ("P@5", |m| m.precision_at_5, true),
+        ("Recall@10", |m| m.recall_at_10, true),
+        ("MRR", |m| m.mrr, true),
+        ("nDCG@10", |m| m.ndcg_at_10, true),
+        ("latency (ms)", |m| m.latency_ms, false),
+    ];
+    for (label, metric, higher_is_better) in rows {
+        let (value_a, value_b) = (metric(&a.mean), metric(&b.mean));
+        let change = value_b - value_a;
+        let change_text = format!("{:+.3}", change);
+        let change_text = if change.abs() < 1e-9 {
+            style(change_text).dim()
+        } else if (change > 0.0) == higher_is_better {
+            style(change_text).green()
+        } else {
+            style(change_text).red()
+        };
+        println!(
+            "{:<14} {:>width$.3} {:>width$.3} {:>9}",
+            label, value_a, value_b, change_text
+        );
+    }
+
+    let rank = |first: Option<usize>| first.map_or("-".to_string(), |rank| format!("#{}", rank));
+    let moved: Vec<_> = a
+        .queries
+        .iter()
+        .zip(&b.queries)
+        .filter(|(query_a, query_b)| query_a.first_relevant != query_b.first_relevant)
+        .collect();
+    if !moved.is_empty() {
+        println!();
+        println!("{}", style("First relevant result moved:").bold());
+        for (query_a, query_b) in moved {
+            println!(
+                "  {:>4} → {:<4} {}",
+                rank(query_a.first_relevant),
+                rank(query_b.first_relevant),
+                query_a.query
+            );
+        }
+    }
+    status.info(&format!(
+        "{} golden queries from {}",
+        golden.len(),
+        golden_path.display()
+    ));
+    Ok(())
+}
+
+/// `--bench-latency`: time the benchmark queries, and with `--baseline`
+/// compare the numbers, exiting with [`exit_code::REGRESSED`] past
+/// `--fail-above`.
+async fn run_bench_latency(cli: &Cli, status: &StatusReporter) -> Result<()> {
+    let fail_above = cli
+        .fail_above
+        .as_deref()
+        .map(cs_engine::bench::parse_percent)
+        .transpose()?;
+    let baseline = cli
+        .baseline
+        .as_deref()
+        .map(cs_engine::bench::LatencyReport::load)
+        .transpose()?;
+    // No pattern is searched, so a lone path lands in pattern
+    let path = cli
+        .files
+        .first()
+        .cloned()
+        .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+        .unwrap_or_else(|| PathBuf::from("."));
+    let queries_path = cli.bench_queries.clone().unwrap_or_else(|| {
+        cs_engine::find_nearest_index_root(&path)
+            .unwrap_or_else(|| path.clone())
+            .join(cs_engine::eval::GOLDEN_FILE)
+    });
+    let queries = cs_engine::bench::load_queries(&queries_path)?;
+
+    let mut options = build_options(cli, cli.reindex, Some(path.as_path()));
+    options.path = path;
+    // Regex searches don't read the index, so a benchmark without a mode times semantic ones
+    if options.mode == SearchMode::Regex && !(cli.regex || cli.rg) {
+        options.mode = SearchMode::Semantic;
+        options.top_k = cli.top_k.or(Some(10));
+        options.threshold = cli.threshold.or(Some(0.6));
+    }
+    let runs = cli.bench_runs.unwrap_or(cs_engine::bench::DEFAULT_RUNS);
+
+    let spinner = status.create_spinner(&format!(
+        "Timing {} queries, {} runs...",
+        queries.len(),
+        runs
+    ));
+    let report = cs_engine::bench::measure(&queries, &options, runs).await?;
+    status.finish_progress(spinner, "Benchmark finished");
+
+    let changes = baseline.as_ref().map(|baseline| {
+        cs_engine::bench::compare(baseline, &report, fail_above.unwrap_or(f64::INFINITY))
+    });
+    if let Some(baseline) = &baseline
+        && let Some(reason) = cs_engine::bench::mismatch(baseline, &report)
+    {
+        status.warn(&format!("Comparing unlike runs: {}", reason));
+    }
+    let regressed = changes
+        .iter()
+        .flatten()
+        .filter(|change| change.regressed)
+        .count();
+
+    if cli.json || cli.jsonl {
+        // Still a report, so this run can be the next baseline
+        let mut json = serde_json::to_value(&report)?;
+        if let Some(changes) = &changes {
+            json["comparison"] = serde_json::json!({
+                "baseline": cli.baseline,
+                "fail_above": fail_above,
+                "changes": changes,
+                "regressed": regressed > 0,
+            });
+        }
+        println!("{}", json);
+    } else {
+        let latency = &report.latency;
+        println!(
+            "{} {} queries x {} runs, {}",
+            style("Timed").bold(),
+            report.queries,
+            report.runs,
+            report.mode
+        );
+        let rows = [
+            ("mean_ms", "mean", latency.mean_ms),
+            ("p50_ms", "p50", latency.p50_ms),
+            ("p90_ms", "p90", latency.p90_ms),
+            ("p99_ms", "p99", latency.p99_ms),
+            ("max_ms", "max", latency.max_ms),
+            ("queries_per_sec", "queries/s", report.queries_per_sec),
+        ];
+        for (metric, label, value) in rows {
+            let change = changes
+                .iter()
+                .flatten()
+                .find(|change| change.metric == metric);
+            let Some(change) = change else {
+                println!("  {:<10} {:>10.2}", label, value);
+                continue;
+            };
+            let direction = if change.worse_by > 0.0 {
+                "worse"
+            } else {
+                "better"
+            };
+            let change_text = format!(
+                "{:.1}% {} than {:.2}",
+                change.worse_by.abs(),
+                direction,
+                change.baseline
+            );
+            let change_text = if change.regressed {
+                style(change_text).red().bold()
+            } else if change.worse_by > 0.0 {
+                style(change_text).yellow()
+            } else {
+                style(change_text).green()
+            };
+            println!("  {:<10} {:>10.2}  {}", label, value, change_text);
+        }
+    }
+
+    status.info(&format!(
+        "{} queries from {}",
+        queries.len(),
+        queries_path.display()
+    ));
+    if regressed > 0 {
+        if !cli.quiet {
+            eprintln!(
+                "{} of the numbers are more than {}% worse than {}",
+                regressed,
+                fail_above.unwrap_or_default(),
+                cli.baseline
+                    .as_deref()
+                    .map(|path| path.display().to_string())
+                    .unwrap_or_default()
+            );
+        }
+        std::process::exit(exit_code::REGRESSED);
+    }
+    Ok(())
+}
+
+/// `--audit PACK`: run the pack's rules over the index and print what they
+/// find, as `file:line` lines, JSON lines or a SARIF log.
+async fn run_audit(cli: &Cli, status: &StatusReporter, pack: &str) -> Result<()> {
+    let pack = cs_engine::audit::load_pack(pack)?;
+    // No pattern is searched, so a lone path lands in pattern
+    let path = cli
+        .files
+        .first()
+        .cloned()
+        .or_else(|| cli.pattern.as_ref().map(PathBuf::from))
+        .unwrap_or_else(|| PathBuf::from("."));
+    if cs_engine::find_nearest_index_root(&path).is_none() {
+        anyhow::bail!("No index at {}. Run cs --index first.", path.display());
+    }
+    let mut options = build_options(cli, cli.reindex, Some(path.as_path()));
+    options.path = path;
+    // The rules' own unless asked for
+    options.top_k = cli.top_k;
+    options.threshold = cli.threshold;
+
+    let spinner = status.create_spinner(&format!(
+        "Running {} rules of {}...",
+        pack.rules.len(),
+        pack.name
+    ));
+    let findings = cs_engine::audit::run_audit(&pack, &options).await?;
+    status.finish_progress(spinner, &format!("Audited with {}", pack.name));
+
+    let format = cli
+        .format
+        .or(cli.sarif.then_some(cs_engine::export::ExportFormat::Sarif));
+    match format {
+        Some(cs_engine::export::ExportFormat::Sarif) => {
+            // An empty log still tells the dashboard the alerts were fixed
+            println!(
+                "{}",
+                serde_json::to_string_pretty(&cs_engine::audit::to_sarif(&pack, &findings))?
+            );
+            return Ok(());
+        }
+        Some(cs_engine::export::ExportFormat::Csv) => {
+            print!("{}", cs_engine::audit::to_csv(&findings));
+            return Ok(());
+        }
+        None => {}
+    }
+    for finding in &findings {
+        if cli.json || cli.jsonl {
+            println!("{}", serde_json::to_string(finding)?);
+            continue;
+        }
+        let severity = match finding.severity {
+            cs_engine::audit::Severity::Error => style(finding.severity.as_str()).red().bold(),
+            cs_engine::audit::Severity::Warning => style(finding.severity.as_str()).yellow(),
+            cs_engine::audit::Severity::Note => style(finding.severity.as_str()).dim(),
+        };
+        println!(
+            "{}:{}: {} {}  {}",
+            style(&finding.file).cyan().bold(),
+            style(finding.line).yellow(),
+            severity,
+            style(&finding.rule).bold(),
+            style(&finding.snippet).dim()
+        );
+    }
+    if findings.is_empty() {
+        status.warn(&format!("No findings for the {} rules", pack.name));
+        std::process::exit(exit_code::NO_MATCHES);
+    }
+    Ok(())
+}
+
+/// `--hook pre-commit`: report staged code that duplicates indexed code, and
+/// fail the commit over it unless `--warn-only`.
+fn run_pre_commit_hook(cli: &Cli, status: &StatusReporter) -> Result<()> {
+    let path = cli
+        .files
+        .first()
+        .cloned()
+        .unwrap_or_else(|| PathBuf::from("."));
+    // A hook mustn't stand in the way of repositories nobody has indexed
+    let Some(index_root) = cs_engine::find_nearest_index_root(&path) else {
+        status.warn("No index here, so staged code wasn't checked for duplicates");
+        return Ok(());
+    };
+    let threshold = cli
+        .dupe_threshold
+        .unwrap_or(cs_engine::dupes::DEFAULT_DUPE_THRESHOLD);
+    let spinner = status.create_spinner("Checking staged changes for duplicated code...");
+    let duplicates = cs_engine::dupes::staged_duplicates(&index_root, threshold)?;
+    status.finish_progress(spinner, "Staged changes checked");
+
+    for duplicate in &duplicates {
+        if cli.json || cli.jsonl {
+            println!("{}", serde_json::to_string(duplicate)?);
+            continue;
+        }
+        let existing = duplicate
+            .existing
+            .file
+            .strip_prefix(&index_root)
+            .unwrap_or(&duplicate.existing.file);
+        eprintln!(
+            "{}  {}:{}-{} {} {}:{}-{}",
+            style(format!("{:.3}", duplicate.similarity)).yellow(),
+            style(duplicate.staged.file.display()).cyan().bold(),
+            duplicate.staged.line_start,
+            duplicate.staged.line_end,
+            style("resembles").dim(),
+            style(existing.display()).cyan(),
+            duplicate.existing.line_start,
+            duplicate.existing.line_end
+        );
+    }
+    if duplicates.is_empty() {
+        return Ok(());
+    }
+    if cli.warn_only {
+        status.warn(&format!(
+            "{} staged chunks nearly duplicate existing code; consider reusing it",
+            duplicates.len()
+        ));
+        return Ok(());
+    }
+    if !cli.quiet {
+        eprintln!(
+            "{} staged chunks nearly duplicate existing code. Reuse it, raise --dupe-threshold, or commit with --no-verify.",
+            duplicates.len()
+        );
+    }
+    std::process::exit(exit_code::BLOCKED);
+}
+
+/// Open result `n` (1-based) in the editor, or one picked from a numbered
+/// list when `n` is 0. Returns whether there was anything to open.
+fn open_result(
+    results: &[cs_core::SearchResult],
+    n: usize,
+    template: Option<&str>,
+    status: &StatusReporter,
+) -> Result<bool> {
+    if results.is_empty() {
+        status.warn("No results to open");
+        return Ok(false);
+    }
+    let n = if n == 0 { pick_result(results)? } else { n };
+    let Some(result) = results.get(n - 1) else {
+        anyhow::bail!(
+            "--open {} is out of range: there are {} results",
+            n,
+            results.len()
+        );
+    };
+
+    status.info(&format!(
+        "Opening {}:{}",
+        result.file.display(),
+        result.span.line_start
+    ));
+    let exit =
+        cs_tui::editor::open_in_editor(&[(result.file.clone(), result.span.line_start)], template)?;
+    if !exit.success() {
+        status.warn("Editor exited with error");
+    }
+    Ok(true)
+}
+
+/// Ask on the terminal which of `results` to open.
+fn pick_result(results: &[cs_core::SearchResult]) -> Result<usize> {
+    use std::io::{BufRead, IsTerminal, Write};
+
+    if !std::io::stdin().is_terminal() {
+        anyhow::bail!("--open without a number needs a terminal; pass one, e.g. --open 1");
+    }
+    for (i, result) in results.iter().enumerate() {
+        eprintln!(
+            "{:>3}. {}:{} {}",
+            style(i + 1).bold(),
+            style(result.file.display()).cyan(),
+            style(result.span.line_start).yellow(),
+            result.preview.lines().next().unwrap_or_default().trim()
+        );
+    }
+    loop {
+        eprint!("Open which result [1-{}]? ", results.len());
+        std::io::stderr().flush()?;
+        let mut answer = String::new();
+        if std::io::stdin().lock().read_line(&mut answer)? == 0 || answer.trim().is_empty() {
+            anyhow::bail!("No result picked");
+        }
+        match answer.trim().parse::<usize>() {
+            Ok(n) if (1..=results.len()).contains(&n) => return Ok(n),
+            _ => eprintln!("Enter a number from 1 to {}", results.len()),
+        }
+    }
+}
+
+/// `--queries-file`: run `queries` over the search targets in one batch.
+/// Returns whether any query matched.
+async fn run_batch_search(cli: &Cli, queries: &[String], status: &StatusReporter) -> Result<bool> {
+    let repo_root_path = cli
+        .files
+        .first()
+        .map(|p| {
+            if p.is_dir() {
+                p.clone()
+            } else {
+                p.parent().unwrap_or(p).to_path_buf()
+            }
+        })
+        .unwrap_or_else(|| PathBuf::from("."));
+    let mut options = build_options(cli, cli.reindex, Some(repo_root_path.as_path()));
+    if !cli.files.is_empty() {
+        let targets = expand_glob_patterns(&cli.files, &options.exclude_patterns)?;
+        options.include_patterns = build_include_patterns(&targets);
+        options.path = find_search_root(&options.include_patterns);
+        options.show_filenames = true;
+    }
+
+    let spinner = status.create_spinner(&format!("Searching for {} queries...", queries.len()));
+    let progress_callback = spinner.as_ref().map(|spinner| {
+        let spinner = spinner.clone();
+        Box::new(move |msg: &str| spinner.set_message(msg.to_string()))
+            as cs_engine::SearchProgressCallback
+    });
+    let batch = cs_engine::search_batch(&options, queries, progress_callback).await?;
+    status.finish_progress(spinner, &format!("Searched for {} queries", queries.len()));
+
+    batch::print(queries, &batch, &options)
+}
+
 struct SearchSummary {
     had_matches: bool,
     closest_below_threshold: Option<cs_core::SearchResult>,
     matched_paths: Vec<PathBuf>,
 }
 
+#[allow(clippy::too_many_arguments)]
 async fn run_search(
     pattern: String,
     path: PathBuf,
     mut options: SearchOptions,
+    show_facets: bool,
+    with_tests: bool,
+    with_neighbors: bool,
+    pack_tokens: Option<usize>,
+    export: Option<cs_engine::export::ExportFormat>,
+    ask_with: Option<cs_core::LlmConfig>,
+    open: Option<(usize, Option<&str>)>,
     status: &StatusReporter,
 ) -> Result<SearchSummary> {
     options.query = pattern;
     options.path = path;
 
+    // A follow-up question is searched for with the previous turn's subject
+    let question = options.query.clone();
+    let mut conversation = ask_with.as_ref().map(|_| {
+        let index_root = cs_engine::find_nearest_index_root(&options.path)
+            .unwrap_or_else(|| options.path.clone());
+        (
+            cs_engine::conversation::Conversation::load(&index_root),
+            index_root,
+        )
+    });
+    if let Some((conversation, _)) = &conversation
+        && let Some(rewritten) = conversation.rewrite(&question)
+    {
+        status.info(&format!("Follow-up, searching for: {}", rewritten));
+        options.query = rewritten;
+    }
+    if let Some(language) = cs_engine::query_language::inferred(&options) {
+        let effect = match options.infer_language {
+            cs_core::LanguageInference::Restrict => "searching only it",
+            _ => "ranking it higher",
+        };
+        status.info(&format!(
+            "Query looks like {} code; {} (--infer-lang off to stop)",
+            language, effect
+        ));
+    }
+
     if options.reindex {
         let reindex_spinner = status.create_spinner("Updating index...");
         cs_index::update_index(
@@ -1788,10 +7085,12 @@ async fn run_search(
     }
 
     // Show search parameters for semantic mode
-    if matches!(
-        options.mode,
-        cs_core::SearchMode::Semantic | cs_core::SearchMode::Hybrid
-    ) {
+    if !status.quiet
+        && matches!(
+            options.mode,
+            cs_core::SearchMode::Semantic | cs_core::SearchMode::Hybrid
+        )
+    {
         let topk_info = options
             .top_k
             .map_or("unlimited".to_string(), |k| k.to_string());
@@ -1921,6 +7220,7 @@ async fn run_search(
         (None, None)
     };
 
+    let started = std::time::Instant::now();
     let search_results = cs_engine::search_enhanced_with_indexing_progress(
         &options,
         search_progress_callback,
@@ -1929,9 +7229,245 @@ async fn run_search(
     )
     .await?;
     let results = &search_results.matches;
+    if load_query_analytics()
+        && let Err(e) = cs_engine::analytics::record_search(&options, results, started.elapsed())
+    {
+        tracing::warn!("Failed to record search for --query-stats: {}", e);
+    }
     let matched_paths: Vec<PathBuf> = results.iter().map(|result| result.file.clone()).collect();
 
     status.finish_progress(search_spinner, &format!("Found {} results", results.len()));
+    for warning in &search_results.warnings {
+        status.warn(warning);
+    }
+    if options.explain_plan {
+        match &search_results.plan {
+            Some(plan) => eprintln!("{} {}", style("Plan:").bold(), plan),
+            None => eprintln!(
+                "{} none; only local semantic searches choose between a scan and the ANN index",
+                style("Plan:").bold()
+            ),
+        }
+    }
+
+    if let Some((n, template)) = open {
+        return Ok(SearchSummary {
+            had_matches: open_result(results, n, template, status)?,
+            closest_below_threshold: search_results.closest_below_threshold,
+            matched_paths,
+        });
+    }
+
+    if let (Some(llm), Some((conversation, index_root))) = (ask_with, conversation.as_mut()) {
+        if results.is_empty() {
+            status.warn("No relevant code found to answer from");
+            return Ok(SearchSummary {
+                had_matches: false,
+                closest_below_threshold: search_results.closest_below_threshold,
+                matched_paths,
+            });
+        }
+        // Earlier turns only matter to a follow-up
+        let history = if options.query == question {
+            &[][..]
+        } else {
+            conversation.turns.as_slice()
+        };
+        let budget = pack_tokens.unwrap_or(cs_engine::answer::DEFAULT_CONTEXT_TOKENS);
+        let ask_spinner = status.create_spinner("Asking the chat model...");
+        let asked =
+            cs_engine::answer::ask(&question, history, results, &llm, budget, index_root).await;
+        let answer = match asked {
+            Ok(answer) => {
+                status.finish_progress(ask_spinner, &format!("Answered by {}", answer.model));
+                answer
+            }
+            Err(e) => {
+                if let Some(spinner) = ask_spinner {
+                    spinner.finish_and_clear();
+                }
+                return Err(e);
+            }
+        };
+        conversation.record(
+            &question,
+            &options.query,
+            results,
+            Some(answer.text.clone()),
+        );
+        if let Err(e) = conversation.save(index_root) {
+            tracing::warn!("Failed to save the conversation: {}", e);
+        }
+        if options.json_output || options.jsonl_output {
+            println!("{}", serde_json::to_string(&answer)?);
+        } else {
+            println!("{}\n", answer.text);
+            println!("{}", style("Sources:").bold());
+            for source in &answer.sources {
+                println!(
+                    "  {}:{}-{}",
+                    style(cs_core::paths::to_relative_slash(&source.file)).cyan(),
+                    source.line_start,
+                    source.line_end
+                );
+            }
+        }
+        return Ok(SearchSummary {
+            had_matches: true,
+            closest_below_threshold: search_results.closest_below_threshold,
+            matched_paths,
+        });
+    }
+
+    if let Some(budget) = pack_tokens {
+        let packed = cs_engine::context_pack::pack_results(results, budget);
+        print!("{}", packed.text);
+        status.info(&format!(
+            "Packed {} results from {} files into ~{} tokens ({} trimmed, {} duplicates dropped, {} did not fit)",
+            packed.results_packed,
+            packed.files,
+            packed.tokens,
+            packed.results_trimmed,
+            packed.results_deduplicated,
+            packed.results_skipped
+        ));
+        return Ok(SearchSummary {
+            had_matches: packed.results_packed > 0,
+            closest_below_threshold: search_results.closest_below_threshold,
+            matched_paths,
+        });
+    }
+
+    if let Some(format) = export {
+        let index_root = cs_engine::find_nearest_index_root(&options.path)
+            .unwrap_or_else(|| options.path.clone());
+        let root = cs_core::paths::canonicalize_lossy(&index_root);
+        match format {
+            cs_engine::export::ExportFormat::Sarif => println!(
+                "{}",
+                serde_json::to_string_pretty(&cs_engine::export::to_sarif(
+                    results,
+                    &root,
+                    &options.query,
+                    &options.mode
+                ))?
+            ),
+            cs_engine::export::ExportFormat::Csv => {
+                print!("{}", cs_engine::export::to_csv(results, &root))
+            }
+        }
+        return Ok(SearchSummary {
+            had_matches: !results.is_empty(),
+            closest_below_threshold: search_results.closest_below_threshold,
+            matched_paths,
+        });
+    }
+
+    let mut test_linker = with_tests.then(cs_engine::go_tests::GoTestLinker::new);
+    let mut tests_for = |result: &cs_core::SearchResult| {
+        test_linker
+            .as_mut()
+            .map(|linker| linker.tests_for(result))
+            .unwrap_or_default()
+    };
+
+    // Go results carry the interfaces their types implement in JSON output
+    let go_types = if options.json_output || options.jsonl_output {
+        cs_index::find_repo_root(&options.path)
+            .ok()
+            .and_then(|root| {
+                let index = cs_index::go_types::load_go_types(&root).ok().flatten()?;
+                Some((index, root))
+            })
+    } else {
+        None
+    };
+    let implements_for = |result: &cs_core::SearchResult| -> Vec<String> {
+        let Some((index, root)) = go_types.as_ref() else {
+            return Vec::new();
+        };
+        let relative = result.file.strip_prefix(root).unwrap_or(&result.file);
+        index.implemented_by(relative, result.span.line_start, result.span.line_end)
+    };
+
+    // ...and where the package-qualified names they use are declared
+    let mut reference_resolver = (options.json_output || options.jsonl_output)
+        .then(cs_engine::go_refs::GoReferenceResolver::new);
+    let mut references_for = |result: &cs_core::SearchResult| {
+        reference_resolver
+            .as_mut()
+            .map(|resolver| resolver.references_for(result))
+            .unwrap_or_default()
+    };
+
+    // JSON results carry anchors that still name them after edits shift lines
+    let mut anchor_lookup = (options.json_output || options.jsonl_output).then(|| {
+        let index_root = cs_engine::find_nearest_index_root(&options.path)
+            .unwrap_or_else(|| options.path.clone());
+        cs_engine::anchors::AnchorLookup::new(&index_root)
+    });
+    let mut anchor_for = |result: &cs_core::SearchResult| {
+        anchor_lookup
+            .as_mut()
+            .and_then(|lookup| lookup.anchor_for(result))
+    };
+
+    let mut neighbor_lookup = with_neighbors.then(|| {
+        let index_root = cs_engine::find_nearest_index_root(&options.path)
+            .unwrap_or_else(|| options.path.clone());
+        cs_engine::neighbors::NeighborLookup::new(&index_root)
+    });
+    let mut neighbors_of = |result: &cs_core::SearchResult| {
+        neighbor_lookup
+            .as_mut()
+            .and_then(|lookup| lookup.neighbors(result))
+    };
+
+    let mut summary_lookup = {
+        let index_root = cs_engine::find_nearest_index_root(&options.path)
+            .unwrap_or_else(|| options.path.clone());
+        cs_engine::summaries::SummaryLookup::new(&index_root)
+    };
+    let mut summary_for = |result: &cs_core::SearchResult| {
+        summary_lookup
+            .as_mut()
+            .and_then(|lookup| lookup.summary_for(result))
+            .map(str::to_string)
+    };
+
+    // Results show their intent tags when the repository defines any
+    let mut tag_resolver = {
+        let index_root = cs_engine::find_nearest_index_root(&options.path)
+            .unwrap_or_else(|| options.path.clone());
+        cs_index::intent_tags::tags_for(&index_root)
+            .is_ok_and(|tags| !tags.is_empty())
+            .then(|| cs_engine::facets::FacetResolver::new(&index_root))
+    };
+    let mut tags_of = |result: &cs_core::SearchResult| {
+        tag_resolver
+            .as_mut()
+            .map(|resolver| resolver.tags(result).to_vec())
+            .unwrap_or_default()
+    };
+
+    // Pinned canonical implementations are marked as such
+    let pin_lookup = {
+        let index_root = cs_engine::find_nearest_index_root(&options.path)
+            .unwrap_or_else(|| options.path.clone());
+        cs_engine::pins::PinLookup::new(&index_root)
+    };
+
+    // ...and the byte range inside each that best matches the query
+    let mut snippet_extractor = (options.json_output || options.jsonl_output)
+        .then(|| cs_engine::snippets::Matcher::for_search(&options).ok())
+        .flatten()
+        .map(cs_engine::snippets::SnippetExtractor::new);
+    let mut best_match_in = |result: &cs_core::SearchResult| {
+        snippet_extractor
+            .as_mut()
+            .and_then(|extractor| extractor.snippet(result))
+            .and_then(|snippet| snippet.best_match)
+    };
 
     let mut has_matches = false;
     if options.jsonl_output {
@@ -1939,26 +7475,60 @@ async fn run_search(
             has_matches = true;
             let jsonl_result =
                 cs_core::JsonlSearchResult::from_search_result(result, !options.no_snippet);
-            println!("{}", serde_json::to_string(&jsonl_result)?);
+            println!(
+                "{}",
+                result_json(
+                    &jsonl_result,
+                    anchor_for(result),
+                    tests_for(result),
+                    implements_for(result),
+                    references_for(result),
+                    neighbors_of(result),
+                    summary_for(result),
+                    tags_of(result),
+                    pin_lookup.pinned(result),
+                    best_match_in(result),
+                    search_results.explanation(result)
+                )?
+            );
         }
     } else if options.json_output {
         for result in results {
             has_matches = true;
             let json_result = cs_core::JsonSearchResult {
                 file: result.file.display().to_string(),
-                span: result.span.clone(),
+                span: cs_core::text::original_span(&result.file, &result.span),
                 lang: result.lang,
                 symbol: result.symbol.clone(),
                 score: result.score,
                 signals: cs_core::SearchSignals {
-                    lex_rank: None,
-                    vec_rank: None,
+                    lex_rank: search_results
+                        .explanation(result)
+                        .and_then(|explanation| explanation.lexical_rank),
+                    vec_rank: search_results
+                        .explanation(result)
+                        .and_then(|explanation| explanation.dense_rank),
                     rrf_score: result.score,
                 },
                 preview: result.preview.clone(),
                 model: "none".to_string(),
             };
-            println!("{}", serde_json::to_string(&json_result)?);
+            println!(
+                "{}",
+                result_json(
+                    &json_result,
+                    anchor_for(result),
+                    tests_for(result),
+                    implements_for(result),
+                    references_for(result),
+                    neighbors_of(result),
+                    summary_for(result),
+                    tags_of(result),
+                    pin_lookup.pinned(result),
+                    best_match_in(result),
+                    search_results.explanation(result)
+                )?
+            );
         }
     } else if options.files_with_matches {
         // For -l flag: print only unique filenames that have matches
@@ -2015,6 +7585,71 @@ async fn run_search(
                 // No filename or line number
                 println!("{}{}", score_text, highlighted_preview);
             }
+
+            if let Some(summary) = summary_for(result) {
+                println!("  {} {}", style("↳ summary").dim(), summary);
+            }
+
+            let tags = tags_of(result);
+            if !tags.is_empty() {
+                println!("  {} {}", style("↳ tags").dim(), tags.join(", "));
+            }
+
+            if let Some(symbol) = pin_lookup.pinned(result) {
+                println!(
+                    "  {} canonical {}",
+                    style("↳ 📌 pinned").green().bold(),
+                    symbol
+                );
+            }
+
+            if let Some(explanation) = search_results.explanation(result) {
+                println!(
+                    "  {} {:.3} = {}",
+                    style("↳ score").dim(),
+                    result.score,
+                    explanation
+                );
+            }
+
+            for test in tests_for(result) {
+                println!(
+                    "  {} {}:{} {}",
+                    style("↳ test").dim(),
+                    style(test.file.display()).cyan(),
+                    style(test.span.line_start).yellow(),
+                    test.name
+                );
+            }
+
+            if let Some(neighbors) = neighbors_of(result) {
+                for (label, chunk) in [("previous", neighbors.previous), ("next", neighbors.next)] {
+                    let Some(chunk) = chunk else { continue };
+                    println!(
+                        "  {} {}-{} {}",
+                        style(format!("↳ {}", label)).dim(),
+                        style(chunk.span.line_start).yellow(),
+                        style(chunk.span.line_end).yellow(),
+                        chunk.breadcrumb.or(chunk.chunk_type).unwrap_or_default()
+                    );
+                }
+            }
+        }
+    }
+
+    if show_facets {
+        // Searches count their candidates before `--topk` cuts them; counting
+        // what's left covers the ones that don't
+        let facets = search_results.facets.clone().unwrap_or_else(|| {
+            let index_root = cs_engine::find_nearest_index_root(&options.path)
+                .unwrap_or_else(|| options.path.clone());
+            cs_engine::facets::summarize(results, &index_root)
+        });
+        // Like the text summary, kept off stdout so it holds only results
+        if options.json_output || options.jsonl_output {
+            eprintln!("{}", serde_json::json!({ "facets": facets }));
+        } else {
+            print_facet_summary(&facets);
         }
     }
 
@@ -8,6 +8,7 @@ use cs_core::{SearchOptions, get_default_exclude_patterns};
 
 use super::McpResult;
 use super::cache::StatsCache;
+use super::ephemeral::EphemeralIndexes;
 use super::session::SessionManager;
 
 /// Shared context for the MCP server managing resources and configuration
@@ -16,6 +17,7 @@ pub struct McpContext {
     pub cwd: PathBuf,
     pub stats_cache: StatsCache,
     pub session_manager: SessionManager,
+    pub ephemeral_indexes: EphemeralIndexes,
     #[allow(dead_code)]
     pub index_locks: Arc<RwLock<HashMap<PathBuf, Arc<Mutex<()>>>>>,
     #[allow(dead_code)]
@@ -61,12 +63,36 @@ impl McpContext {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: Vec::new(),
+            stop_symbol_rules: Vec::new(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: cs_core::DEFAULT_MAX_TYPOS,
+            fusion: cs_core::FusionConfig::default(),
+            snippet: None,
+            focus: None,
+            sub_queries: Vec::new(),
+            infer_language: cs_core::LanguageInference::default(),
         };
 
         Ok(Self {
             cwd,
             stats_cache: StatsCache::default(), // 30-second TTL for MCP responsiveness
             session_manager: SessionManager::default(), // 5-minute TTL for search sessions
+            ephemeral_indexes: EphemeralIndexes::default(), // 30-minute TTL, dropped by agents
             #[allow(dead_code)]
             index_locks: Arc::new(RwLock::new(HashMap::new())),
             #[allow(dead_code)]
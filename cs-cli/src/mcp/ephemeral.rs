@@ -0,0 +1,78 @@
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime};
+use tokio::sync::RwLock;
+use tracing::debug;
+use uuid::Uuid;
+
+use cs_engine::ephemeral::EphemeralIndex;
+
+/// Ephemeral indexes unused for this long are dropped (30 minutes)
+const EPHEMERAL_INDEX_TTL: Duration = Duration::from_secs(30 * 60);
+
+/// Maximum number of ephemeral indexes held at once; each keeps an embedder
+/// and its working set's embeddings in memory
+const MAX_EPHEMERAL_INDEXES: usize = 8;
+
+struct EphemeralEntry {
+    index: Arc<Mutex<EphemeralIndex>>,
+    last_accessed: SystemTime,
+}
+
+/// Ephemeral indexes created by `create_ephemeral_index`, by id, until an
+/// agent drops them or they go unused for [`EPHEMERAL_INDEX_TTL`].
+#[derive(Clone, Default)]
+pub struct EphemeralIndexes {
+    indexes: Arc<RwLock<HashMap<Uuid, EphemeralEntry>>>,
+}
+
+impl EphemeralIndexes {
+    /// Hold `index`, evicting expired indexes and then the least recently
+    /// used one if there's no room.
+    pub async fn insert(&self, index: EphemeralIndex) -> Uuid {
+        let id = Uuid::new_v4();
+        let mut indexes = self.indexes.write().await;
+        indexes.retain(|_, entry| !is_expired(entry));
+        if indexes.len() >= MAX_EPHEMERAL_INDEXES
+            && let Some(oldest) = indexes
+                .iter()
+                .min_by_key(|(_, entry)| entry.last_accessed)
+                .map(|(id, _)| *id)
+        {
+            indexes.remove(&oldest);
+            debug!("Evicted ephemeral index {}", oldest);
+        }
+        indexes.insert(
+            id,
+            EphemeralEntry {
+                index: Arc::new(Mutex::new(index)),
+                last_accessed: SystemTime::now(),
+            },
+        );
+        id
+    }
+
+    /// The index with `id`, unless it was dropped or has expired.
+    pub async fn get(&self, id: Uuid) -> Option<Arc<Mutex<EphemeralIndex>>> {
+        let mut indexes = self.indexes.write().await;
+        let entry = indexes.get_mut(&id)?;
+        if is_expired(entry) {
+            indexes.remove(&id);
+            return None;
+        }
+        entry.last_accessed = SystemTime::now();
+        Some(entry.index.clone())
+    }
+
+    /// Drop the index with `id`, returning whether there was one.
+    pub async fn remove(&self, id: Uuid) -> bool {
+        self.indexes.write().await.remove(&id).is_some()
+    }
+}
+
+fn is_expired(entry: &EphemeralEntry) -> bool {
+    SystemTime::now()
+        .duration_since(entry.last_accessed)
+        .unwrap_or_default()
+        > EPHEMERAL_INDEX_TTL
+}
@@ -1,5 +1,6 @@
 pub mod cache;
 pub mod context;
+pub mod ephemeral;
 pub mod errors;
 pub mod session;
 pub mod tools;
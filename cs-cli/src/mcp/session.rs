@@ -79,7 +79,9 @@ pub struct SearchPage {
 pub struct PaginationConfig {
     pub page_size: usize,
     pub include_snippet: bool,
-    pub snippet_length: usize,
+    /// Characters a preview is cut to; `None` when a snippet policy sized
+    /// the previews and no length was asked for as well
+    pub snippet_length: Option<usize>,
     pub context_lines: usize,
 }
 
@@ -88,7 +90,7 @@ impl Default for PaginationConfig {
         Self {
             page_size: DEFAULT_PAGE_SIZE,
             include_snippet: true,
-            snippet_length: DEFAULT_SNIPPET_LENGTH,
+            snippet_length: Some(DEFAULT_SNIPPET_LENGTH),
             context_lines: 0,
         }
     }
@@ -98,7 +100,9 @@ impl PaginationConfig {
     /// Validate and clamp configuration values
     pub fn validate(mut self) -> Self {
         self.page_size = self.page_size.clamp(1, MAX_PAGE_SIZE);
-        self.snippet_length = self.snippet_length.min(MAX_SNIPPET_LENGTH);
+        self.snippet_length = self
+            .snippet_length
+            .map(|length| length.min(MAX_SNIPPET_LENGTH));
         self.context_lines = self.context_lines.min(10);
         self
     }
@@ -210,8 +214,10 @@ impl SessionManager {
         // Apply snippet configuration
         if config.include_snippet {
             for result in &mut page_results {
-                if result.preview.len() > config.snippet_length {
-                    result.preview.truncate(config.snippet_length);
+                if let Some(length) = config.snippet_length
+                    && result.preview.len() > length
+                {
+                    result.preview.truncate(length);
                     result.preview.push_str("...");
                 }
             }
@@ -471,6 +477,29 @@ mod tests {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: Vec::new(),
+            stop_symbol_rules: Vec::new(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: cs_core::DEFAULT_MAX_TYPOS,
+            fusion: cs_core::FusionConfig::default(),
+            snippet: None,
+            focus: None,
+            sub_queries: Vec::new(),
+            infer_language: cs_core::LanguageInference::default(),
         }
     }
 
@@ -581,7 +610,7 @@ mod tests {
         results[0].preview = long_content;
 
         let config = PaginationConfig {
-            snippet_length: 100,
+            snippet_length: Some(100),
             ..Default::default()
         };
 
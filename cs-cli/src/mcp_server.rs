@@ -3,8 +3,8 @@ use rmcp::handler::server::router::tool::ToolRouter;
 use rmcp::handler::server::tool::{ToolCallContext, ToolRoute};
 use rmcp::model::{
     CallToolRequestParam, CallToolResult, Content, Implementation, InitializeResult,
-    ListToolsResult, Meta, PaginatedRequestParam, ProgressNotificationParam, ProtocolVersion, Tool,
-    ToolsCapability,
+    ListToolsResult, Meta, PaginatedRequestParam, ProgressNotificationParam, ProgressToken,
+    ProtocolVersion, Tool, ToolsCapability,
 };
 use rmcp::service::RequestContext;
 use rmcp::transport;
@@ -32,7 +32,67 @@ use cs_core::{
 /// Align with CLI default for semantic search to avoid heavy responses
 const DEFAULT_MCP_TOP_K: usize = 10;
 
+/// Tools that run a query, and so count against `[limits]`.
+const SEARCH_TOOLS: &[&str] = &[
+    "semantic_search",
+    "regex_search",
+    "lexical_search",
+    "hybrid_search",
+    "search_ephemeral_index",
+];
+
 /// Filter out search results from missing files to prevent errors during result processing
+/// Sends MCP progress notifications for one request, numbering them in order.
+#[derive(Clone)]
+struct ProgressNotifier {
+    token: ProgressToken,
+    peer: Peer<RoleServer>,
+    step_count: Arc<AtomicUsize>,
+}
+
+impl ProgressNotifier {
+    fn new(token: ProgressToken, peer: Peer<RoleServer>) -> Self {
+        Self {
+            token,
+            peer,
+            step_count: Arc::new(AtomicUsize::new(0)),
+        }
+    }
+
+    fn notify(&self, message: String) {
+        let token = self.token.clone();
+        let peer = self.peer.clone();
+        let current_step = self.step_count.fetch_add(1, Ordering::SeqCst) + 1;
+        tokio::spawn(async move {
+            let _ = peer
+                .notify_progress(ProgressNotificationParam {
+                    progress_token: token,
+                    progress: current_step as f64,
+                    total: None,
+                    message: Some(message),
+                })
+                .await;
+        });
+    }
+}
+
+/// Progress message carrying provisional hits of a streaming semantic search.
+/// Later messages supersede earlier ones; the tool result is the final list.
+fn partial_results_message(results: &[cs_core::SearchResult]) -> String {
+    let hits: Vec<Value> = results
+        .iter()
+        .map(|result| {
+            json!({
+                "path": result.file.to_string_lossy(),
+                "line_start": result.span.line_start,
+                "line_end": result.span.line_end,
+                "score": result.score,
+            })
+        })
+        .collect();
+    json!({ "partial_results": hits }).to_string()
+}
+
 fn filter_valid_results(mut results: Vec<cs_core::SearchResult>) -> Vec<cs_core::SearchResult> {
     results.retain(|result| result.file.exists());
     results
@@ -74,6 +134,49 @@ mod tests {
         assert!(saw_rs, "lib.rs should be included via glob");
         assert!(saw_ts, "file.ts should be included explicitly");
     }
+
+    #[test]
+    fn page_token_is_accepted_as_a_cursor() {
+        let request: SemanticSearchRequest = serde_json::from_value(json!({
+            "query": "retry",
+            "path": ".",
+            "page_token": "abc"
+        }))
+        .unwrap();
+        assert_eq!(request.get_cursor(), Some("abc"));
+
+        let request = SemanticSearchRequest {
+            cursor: Some("cursor".to_string()),
+            page_token: Some("token".to_string()),
+            ..Default::default()
+        };
+        assert_eq!(request.get_cursor(), Some("cursor"));
+    }
+
+    #[test]
+    fn partial_results_message_lists_hits_without_content() {
+        let result = cs_core::SearchResult {
+            file: PathBuf::from("src/lib.rs"),
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 10,
+                line_start: 3,
+                line_end: 5,
+            },
+            score: 0.75,
+            preview: "fn retry() {}".to_string(),
+            lang: None,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        };
+        let message: Value = serde_json::from_str(&partial_results_message(&[result])).unwrap();
+        let hits = message["partial_results"].as_array().unwrap();
+        assert_eq!(hits.len(), 1);
+        assert_eq!(hits[0]["path"], "src/lib.rs");
+        assert_eq!(hits[0]["line_start"], 3);
+        assert!(hits[0].get("content").is_none());
+    }
 }
 
 fn resolve_exclude_patterns(
@@ -130,13 +233,38 @@ fn resolve_include_patterns(
 
 /// Trait for extracting pagination parameters from request structures
 trait PaginationParams {
+    fn get_cursor(&self) -> Option<&str>;
+    fn get_path(&self) -> &str;
+    fn get_include_neighbors(&self) -> Option<bool>;
     fn get_page_size(&self) -> Option<usize>;
     fn get_include_snippet(&self) -> Option<bool>;
     fn get_snippet_length(&self) -> Option<usize>;
+    fn get_snippet(&self) -> Option<&str>;
     fn get_context_lines(&self) -> Option<usize>;
     fn get_search_mode(&self) -> String;
     fn get_query(&self) -> String;
     fn get_search_params(&self) -> serde_json::Value;
+
+    /// Lookup for `include_neighbors`, over the index being searched
+    fn neighbor_lookup(&self) -> Option<cs_engine::neighbors::NeighborLookup> {
+        self.get_include_neighbors().unwrap_or(false).then(|| {
+            let path = Path::new(self.get_path());
+            let index_root =
+                cs_engine::find_nearest_index_root(path).unwrap_or_else(|| path.to_path_buf());
+            cs_engine::neighbors::NeighborLookup::new(&index_root)
+        })
+    }
+
+    /// The `snippet` policy asked for, or the agent one from `[snippets]`
+    fn snippet_policy(&self) -> Result<Option<cs_core::SnippetPolicy>, ErrorData> {
+        match self.get_snippet() {
+            Some(policy) => policy
+                .parse()
+                .map(Some)
+                .map_err(|e: String| ErrorData::invalid_params(e, None)),
+            None => Ok(crate::reload::settings().snippets.agent),
+        }
+    }
 }
 
 #[derive(Serialize, Deserialize, JsonSchema, Default)]
@@ -158,10 +286,18 @@ pub struct SemanticSearchRequest {
     pub after_context_lines: Option<usize>,
     // Pagination parameters
     pub cursor: Option<String>,
+    /// Same as `cursor`
+    pub page_token: Option<String>,
     pub page_size: Option<usize>,
     pub include_snippet: Option<bool>,
     pub snippet_length: Option<usize>,
+    /// Snippet policy: "lines:N", "tokens:N" or "symbol" for the whole function or class
+    pub snippet: Option<String>,
+    /// Add the spans of the chunks before and after each match
+    pub include_neighbors: Option<bool>,
     pub context_lines: Option<usize>,
+    /// Send provisional hits in progress notifications while scoring
+    pub stream: Option<bool>,
 }
 
 #[derive(Serialize, Deserialize, JsonSchema, Default)]
@@ -178,9 +314,15 @@ pub struct RegexSearchRequest {
     pub fixed_string: Option<bool>,
     // Pagination parameters
     pub cursor: Option<String>,
+    /// Same as `cursor`
+    pub page_token: Option<String>,
     pub page_size: Option<usize>,
     pub include_snippet: Option<bool>,
     pub snippet_length: Option<usize>,
+    /// Snippet policy: "lines:N", "tokens:N" or "symbol" for the whole function or class
+    pub snippet: Option<String>,
+    /// Add the spans of the chunks before and after each match
+    pub include_neighbors: Option<bool>,
 }
 
 #[derive(Serialize, Deserialize, JsonSchema, Default)]
@@ -202,9 +344,15 @@ pub struct HybridSearchRequest {
     pub after_context_lines: Option<usize>,
     // Pagination parameters
     pub cursor: Option<String>,
+    /// Same as `cursor`
+    pub page_token: Option<String>,
     pub page_size: Option<usize>,
     pub include_snippet: Option<bool>,
     pub snippet_length: Option<usize>,
+    /// Snippet policy: "lines:N", "tokens:N" or "symbol" for the whole function or class
+    pub snippet: Option<String>,
+    /// Add the spans of the chunks before and after each match
+    pub include_neighbors: Option<bool>,
     pub context_lines: Option<usize>,
 }
 
@@ -225,9 +373,15 @@ pub struct LexicalSearchRequest {
     pub after_context_lines: Option<usize>,
     // Pagination parameters
     pub cursor: Option<String>,
+    /// Same as `cursor`
+    pub page_token: Option<String>,
     pub page_size: Option<usize>,
     pub include_snippet: Option<bool>,
     pub snippet_length: Option<usize>,
+    /// Snippet policy: "lines:N", "tokens:N" or "symbol" for the whole function or class
+    pub snippet: Option<String>,
+    /// Add the spans of the chunks before and after each match
+    pub include_neighbors: Option<bool>,
     pub context_lines: Option<usize>,
 }
 
@@ -242,7 +396,67 @@ pub struct ReindexRequest {
     pub force: Option<bool>,
 }
 
+#[derive(Serialize, Deserialize, JsonSchema)]
+pub struct CreateEphemeralIndexRequest {
+    /// Files to index, relative to `path`
+    pub files: Option<Vec<String>>,
+    /// Unified diffs (e.g. a pull request's); the lines each hunk leaves in the new file are indexed
+    pub patches: Option<Vec<String>>,
+    /// Directory the files and patches are relative to (default: the server's working directory)
+    pub path: Option<String>,
+    /// Embedding model (default: the model of the index `path` is in)
+    pub model: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, JsonSchema)]
+pub struct SearchEphemeralIndexRequest {
+    /// Id returned by create_ephemeral_index
+    pub index_id: String,
+    pub query: String,
+    pub top_k: Option<usize>,
+    pub threshold: Option<f32>,
+}
+
+#[derive(Serialize, Deserialize, JsonSchema)]
+pub struct DropEphemeralIndexRequest {
+    /// Id returned by create_ephemeral_index
+    pub index_id: String,
+}
+
+#[derive(Serialize, Deserialize, JsonSchema)]
+pub struct RememberRequest {
+    /// What to remember, in a sentence or two; searched with the code from then on
+    pub text: String,
+    /// How long to keep it: 30d (default), 12h, 90m, 2w or never
+    pub ttl: Option<String>,
+    /// Files the memory is about, relative to the repository root
+    pub files: Option<Vec<String>>,
+    /// Who is remembering (default: the MCP client's name)
+    pub agent: Option<String>,
+    /// Session the memory comes from, to tell sessions' memories apart
+    pub session: Option<String>,
+    /// Repository the memory is about (default: the server's working directory)
+    pub path: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, JsonSchema)]
+pub struct ForgetMemoryRequest {
+    /// Memory id, from a `collection:memory/<id>` result (or a unique prefix of it)
+    pub id: String,
+    /// Repository the memory is about (default: the server's working directory)
+    pub path: Option<String>,
+}
+
 impl PaginationParams for SemanticSearchRequest {
+    fn get_cursor(&self) -> Option<&str> {
+        self.cursor.as_deref().or(self.page_token.as_deref())
+    }
+    fn get_path(&self) -> &str {
+        &self.path
+    }
+    fn get_include_neighbors(&self) -> Option<bool> {
+        self.include_neighbors
+    }
     fn get_page_size(&self) -> Option<usize> {
         self.page_size
     }
@@ -252,6 +466,9 @@ impl PaginationParams for SemanticSearchRequest {
     fn get_snippet_length(&self) -> Option<usize> {
         self.snippet_length
     }
+    fn get_snippet(&self) -> Option<&str> {
+        self.snippet.as_deref()
+    }
     fn get_context_lines(&self) -> Option<usize> {
         self.context_lines
     }
@@ -264,7 +481,7 @@ impl PaginationParams for SemanticSearchRequest {
     fn get_search_params(&self) -> serde_json::Value {
         json!({
             "top_k": self.top_k,
-            "threshold": self.threshold.unwrap_or(0.6),
+            "threshold": self.threshold.unwrap_or(crate::reload::settings().threshold),
             "rerank": self.rerank.unwrap_or(false),
             "rerank_model": self.rerank_model,
             "case_insensitive": self.case_insensitive.unwrap_or(false),
@@ -278,12 +495,22 @@ impl PaginationParams for SemanticSearchRequest {
             "before_context_lines": self.before_context_lines,
             "after_context_lines": self.after_context_lines,
             "include_snippet": self.include_snippet.unwrap_or(true),
-            "snippet_length": self.snippet_length
+            "snippet_length": self.snippet_length,
+            "snippet": self.snippet
         })
     }
 }
 
 impl PaginationParams for RegexSearchRequest {
+    fn get_cursor(&self) -> Option<&str> {
+        self.cursor.as_deref().or(self.page_token.as_deref())
+    }
+    fn get_path(&self) -> &str {
+        &self.path
+    }
+    fn get_include_neighbors(&self) -> Option<bool> {
+        self.include_neighbors
+    }
     fn get_page_size(&self) -> Option<usize> {
         self.page_size
     }
@@ -293,6 +520,9 @@ impl PaginationParams for RegexSearchRequest {
     fn get_snippet_length(&self) -> Option<usize> {
         self.snippet_length
     }
+    fn get_snippet(&self) -> Option<&str> {
+        self.snippet.as_deref()
+    }
     fn get_context_lines(&self) -> Option<usize> {
         Some(self.context.unwrap_or(0))
     }
@@ -313,12 +543,22 @@ impl PaginationParams for RegexSearchRequest {
             "respect_gitignore": self.respect_gitignore.unwrap_or(true),
             "use_default_excludes": self.use_default_excludes.unwrap_or(true),
             "include_snippet": self.include_snippet.unwrap_or(true),
-            "snippet_length": self.snippet_length
+            "snippet_length": self.snippet_length,
+            "snippet": self.snippet
         })
     }
 }
 
 impl PaginationParams for HybridSearchRequest {
+    fn get_cursor(&self) -> Option<&str> {
+        self.cursor.as_deref().or(self.page_token.as_deref())
+    }
+    fn get_path(&self) -> &str {
+        &self.path
+    }
+    fn get_include_neighbors(&self) -> Option<bool> {
+        self.include_neighbors
+    }
     fn get_page_size(&self) -> Option<usize> {
         self.page_size
     }
@@ -328,6 +568,9 @@ impl PaginationParams for HybridSearchRequest {
     fn get_snippet_length(&self) -> Option<usize> {
         self.snippet_length
     }
+    fn get_snippet(&self) -> Option<&str> {
+        self.snippet.as_deref()
+    }
     fn get_context_lines(&self) -> Option<usize> {
         self.context_lines
     }
@@ -340,7 +583,9 @@ impl PaginationParams for HybridSearchRequest {
     fn get_search_params(&self) -> serde_json::Value {
         json!({
             "top_k": self.top_k,
-            "threshold": self.threshold.unwrap_or(0.02),
+            "threshold": self
+                .threshold
+                .unwrap_or(crate::reload::settings().hybrid_threshold),
             "rerank": self.rerank.unwrap_or(false),
             "rerank_model": self.rerank_model,
             "case_insensitive": self.case_insensitive.unwrap_or(false),
@@ -354,12 +599,22 @@ impl PaginationParams for HybridSearchRequest {
             "before_context_lines": self.before_context_lines,
             "after_context_lines": self.after_context_lines,
             "include_snippet": self.include_snippet.unwrap_or(true),
-            "snippet_length": self.snippet_length
+            "snippet_length": self.snippet_length,
+            "snippet": self.snippet
         })
     }
 }
 
 impl PaginationParams for LexicalSearchRequest {
+    fn get_cursor(&self) -> Option<&str> {
+        self.cursor.as_deref().or(self.page_token.as_deref())
+    }
+    fn get_path(&self) -> &str {
+        &self.path
+    }
+    fn get_include_neighbors(&self) -> Option<bool> {
+        self.include_neighbors
+    }
     fn get_page_size(&self) -> Option<usize> {
         self.page_size
     }
@@ -369,6 +624,9 @@ impl PaginationParams for LexicalSearchRequest {
     fn get_snippet_length(&self) -> Option<usize> {
         self.snippet_length
     }
+    fn get_snippet(&self) -> Option<&str> {
+        self.snippet.as_deref()
+    }
     fn get_context_lines(&self) -> Option<usize> {
         self.context_lines
     }
@@ -393,7 +651,8 @@ impl PaginationParams for LexicalSearchRequest {
             "before_context_lines": self.before_context_lines,
             "after_context_lines": self.after_context_lines,
             "include_snippet": self.include_snippet.unwrap_or(true),
-            "snippet_length": self.snippet_length
+            "snippet_length": self.snippet_length,
+            "snippet": self.snippet
         })
     }
 }
@@ -447,8 +706,11 @@ All search tools support:
 - **page_size** (default: 50, max: 200) - Results per page
 - **include_snippet** (default: true) - Include code snippets
 - **snippet_length** (default: 500) - Max characters per snippet
-- **cursor** - Opaque cursor for subsequent pages
+- **snippet** - Size snippets by `lines:N`, `tokens:N` or `symbol` (the whole function or class) instead; snippet_length then only applies when given too
+- **cursor** (or **page_token**) - Opaque cursor for subsequent pages
 - **context_lines** - Lines of context (semantic/hybrid only)
+- **include_neighbors** - Add the spans of the chunks before and after each match, to widen context without re-reading files
+- **stream** - Semantic search only: send provisional hits as `{"partial_results": [...]}` progress messages while scoring (needs a progress token)
 
 ## Examples:
 
@@ -459,19 +721,69 @@ All search tools support:
         }
     }
 
+    #[tracing::instrument(name = "mcp_tool", skip_all, fields(tool = %request.name))]
     async fn call_tool(
         &self,
         request: CallToolRequestParam,
         context: RequestContext<RoleServer>,
     ) -> Result<CallToolResult, ErrorData> {
+        let started = std::time::Instant::now();
+        let api_key = std::env::var("CS_API_KEY").ok();
+        let operation = request.name.to_string();
+        let query = request
+            .arguments
+            .as_ref()
+            .and_then(|arguments| arguments.get("query").or_else(|| arguments.get("pattern")))
+            .and_then(|query| query.as_str())
+            .map(str::to_string);
+        let usage = |results: Option<usize>, outcome: crate::usage::Outcome| {
+            crate::usage::record(crate::usage::Request {
+                surface: "mcp",
+                operation: &operation,
+                api_key: api_key.as_deref(),
+                connection: None,
+                tenant: None,
+                query: query.as_deref(),
+                started,
+                results,
+                outcome,
+            })
+        };
+
+        if SEARCH_TOOLS.contains(&request.name.as_ref())
+            && let Err(denied) = crate::quota::admit(api_key.as_deref())
+        {
+            usage(None, crate::usage::Outcome::RateLimited);
+            return Ok(CallToolResult {
+                content: vec![Content::text(denied.message.clone())],
+                structured_content: Some(json!({
+                    "error": "rate_limited",
+                    "message": denied.message,
+                    "retry_after_secs": denied.retry_after.map(|wait| wait.as_secs_f64().ceil()),
+                })),
+                is_error: Some(true),
+                meta: None,
+            });
+        }
         let tool_context = ToolCallContext::new(self, request, context);
-        if let Some(route) = self.tool_router.map.get(&tool_context.name) {
-            (route.call)(tool_context).await
-        } else {
-            Err(ErrorData::method_not_found::<
+        let Some(route) = self.tool_router.map.get(&tool_context.name) else {
+            return Err(ErrorData::method_not_found::<
                 rmcp::model::CallToolRequestMethod,
-            >())
+            >());
+        };
+        let result = (route.call)(tool_context).await;
+        match &result {
+            Ok(result) if result.is_error != Some(true) => usage(
+                result
+                    .structured_content
+                    .as_ref()
+                    .and_then(|content| content["results"]["total_count"].as_u64())
+                    .map(|count| count as usize),
+                crate::usage::Outcome::Ok,
+            ),
+            _ => usage(None, crate::usage::Outcome::Error),
         }
+        result
     }
 
     async fn list_tools(
@@ -508,11 +820,13 @@ impl CcMcpServer {
         include_snippet: Option<bool>,
         snippet_length: Option<usize>,
         context_lines: Option<usize>,
+        snippet: Option<cs_core::SnippetPolicy>,
     ) -> PaginationConfig {
         PaginationConfig {
             page_size: page_size.unwrap_or(50),
             include_snippet: include_snippet.unwrap_or(true),
-            snippet_length: snippet_length.unwrap_or(500),
+            // A snippet policy sized the previews already
+            snippet_length: snippet_length.or(snippet.is_none().then_some(500)),
             context_lines: context_lines.unwrap_or(0),
         }
         .validate()
@@ -525,9 +839,11 @@ impl CcMcpServer {
         mode: &str,
         search_params: serde_json::Value,
         search_time_ms: u64,
+        mut neighbors: Option<cs_engine::neighbors::NeighborLookup>,
     ) -> serde_json::Value {
         let results: Vec<serde_json::Value> = page.matches.iter().map(|result| {
             let match_type = format!("{}_match", mode);
+            let span = cs_core::text::original_span(&result.file, &result.span);
             let mut match_obj = json!({
                 "file": {
                     "path": result.file.to_string_lossy(),
@@ -535,8 +851,8 @@ impl CcMcpServer {
                 },
                 "match": {
                     "span": {
-                        "byte_start": result.span.byte_start,
-                        "byte_end": result.span.byte_end,
+                        "byte_start": span.byte_start,
+                        "byte_end": span.byte_end,
                         "line_start": result.span.line_start,
                         "line_end": result.span.line_end
                     },
@@ -555,6 +871,10 @@ impl CcMcpServer {
 
             match_obj["match"]["line_number"] = json!(result.span.line_start);
 
+            if let Some(chunks) = neighbors.as_mut().and_then(|lookup| lookup.neighbors(result)) {
+                match_obj["neighbors"] = json!(chunks);
+            }
+
             match_obj
         }).collect();
 
@@ -572,6 +892,7 @@ impl CcMcpServer {
                 "truncated": page.truncated
             },
             "pagination": {
+                "next_page_token": page.next_cursor,
                 "next_cursor": page.next_cursor,
                 "page_size": page.original_page_size,
                 "current_page": page.current_page
@@ -583,6 +904,19 @@ impl CcMcpServer {
         })
     }
 
+    /// Report what went wrong without failing the search, such as part of the
+    /// index being unreadable, in the metadata and after the summary.
+    fn add_warnings(summary: &mut String, structured_result: &mut Value, warnings: &[String]) {
+        if warnings.is_empty() {
+            return;
+        }
+        structured_result["metadata"]["warnings"] = json!(warnings);
+        for warning in warnings {
+            summary.push_str("\nWarning: ");
+            summary.push_str(warning);
+        }
+    }
+
     /// Handle paginated search request (when cursor is provided)
     async fn handle_paginated_request<T>(
         &self,
@@ -597,6 +931,7 @@ impl CcMcpServer {
             request.get_include_snippet(),
             request.get_snippet_length(),
             request.get_context_lines(),
+            request.snippet_policy()?,
         );
 
         let page = self
@@ -610,7 +945,14 @@ impl CcMcpServer {
         let query = request.get_query();
         let search_params = request.get_search_params();
 
-        let structured_result = Self::search_page_to_json(page, &query, &mode, search_params, 0);
+        let structured_result = Self::search_page_to_json(
+            page,
+            &query,
+            &mode,
+            search_params,
+            0,
+            request.neighbor_lookup(),
+        );
 
         let summary = format!(
             "Retrieved page {} of {} search results for '{}'",
@@ -620,6 +962,17 @@ impl CcMcpServer {
         Ok((summary, structured_result))
     }
 
+    /// The tools `list_tools` advertises, in name order.
+    pub fn tool_definitions() -> Vec<Tool> {
+        let mut tools: Vec<Tool> = Self::create_tool_router()
+            .map
+            .values()
+            .map(|route| route.attr.clone())
+            .collect();
+        tools.sort_by(|a, b| a.name.cmp(&b.name));
+        tools
+    }
+
     fn create_tool_router() -> ToolRouter<Self> {
         let mut router = ToolRouter::new();
         router.add_route(Self::health_check_route());
@@ -630,6 +983,11 @@ impl CcMcpServer {
         router.add_route(Self::index_status_route());
         router.add_route(Self::reindex_route());
         router.add_route(Self::default_csignore_route());
+        router.add_route(Self::create_ephemeral_index_route());
+        router.add_route(Self::search_ephemeral_index_route());
+        router.add_route(Self::drop_ephemeral_index_route());
+        router.add_route(Self::remember_route());
+        router.add_route(Self::forget_memory_route());
         router
     }
 
@@ -973,6 +1331,219 @@ impl CcMcpServer {
         })
     }
 
+    fn create_ephemeral_index_route() -> ToolRoute<Self> {
+        let schema = schemars::schema_for!(CreateEphemeralIndexRequest);
+        let input_schema = serde_json::to_value(schema).unwrap();
+        let tool = Tool {
+            name: "create_ephemeral_index".into(),
+            title: Some("Create Ephemeral Index".into()),
+            description: Some(
+                "Embed a working set of files and/or unified diffs in memory, without touching any index on disk, and return an index_id to query with search_ephemeral_index".into(),
+            ),
+            input_schema: Arc::new(input_schema.as_object().unwrap().clone()),
+            output_schema: None,
+            annotations: None,
+            icons: None,
+        };
+
+        ToolRoute::new_dyn(tool, |context: ToolCallContext<'_, CcMcpServer>| {
+            Box::pin(async move {
+                let arguments = context.arguments.clone().unwrap_or_default();
+                let request: CreateEphemeralIndexRequest =
+                    serde_json::from_value(serde_json::Value::Object(arguments)).map_err(|e| {
+                        rmcp::ErrorData::invalid_params(format!("Invalid parameters: {}", e), None)
+                    })?;
+
+                let service: &CcMcpServer = context.service;
+                match service.handle_create_ephemeral_index(request).await {
+                    Ok((summary, result)) => Ok(CallToolResult {
+                        content: vec![
+                            Content::text(summary),
+                            Content::json(result.clone())
+                                .map_err(|e| ErrorData::internal_error(e.to_string(), None))?,
+                        ],
+                        structured_content: Some(result),
+                        is_error: Some(false),
+                        meta: None,
+                    }),
+                    Err(e) => Err(e),
+                }
+            })
+        })
+    }
+
+    fn search_ephemeral_index_route() -> ToolRoute<Self> {
+        let schema = schemars::schema_for!(SearchEphemeralIndexRequest);
+        let input_schema = serde_json::to_value(schema).unwrap();
+        let tool = Tool {
+            name: "search_ephemeral_index".into(),
+            title: Some("Search Ephemeral Index".into()),
+            description: Some(
+                "Semantic search over an index made by create_ephemeral_index".into(),
+            ),
+            input_schema: Arc::new(input_schema.as_object().unwrap().clone()),
+            output_schema: None,
+            annotations: None,
+            icons: None,
+        };
+
+        ToolRoute::new_dyn(tool, |context: ToolCallContext<'_, CcMcpServer>| {
+            Box::pin(async move {
+                let arguments = context.arguments.clone().unwrap_or_default();
+                let request: SearchEphemeralIndexRequest =
+                    serde_json::from_value(serde_json::Value::Object(arguments)).map_err(|e| {
+                        rmcp::ErrorData::invalid_params(format!("Invalid parameters: {}", e), None)
+                    })?;
+
+                let service: &CcMcpServer = context.service;
+                match service.handle_search_ephemeral_index(request).await {
+                    Ok((summary, result)) => Ok(CallToolResult {
+                        content: vec![
+                            Content::text(summary),
+                            Content::json(result.clone())
+                                .map_err(|e| ErrorData::internal_error(e.to_string(), None))?,
+                        ],
+                        structured_content: Some(result),
+                        is_error: Some(false),
+                        meta: None,
+                    }),
+                    Err(e) => Err(e),
+                }
+            })
+        })
+    }
+
+    fn drop_ephemeral_index_route() -> ToolRoute<Self> {
+        let schema = schemars::schema_for!(DropEphemeralIndexRequest);
+        let input_schema = serde_json::to_value(schema).unwrap();
+        let tool = Tool {
+            name: "drop_ephemeral_index".into(),
+            title: Some("Drop Ephemeral Index".into()),
+            description: Some(
+                "Discard an index made by create_ephemeral_index; unused ones are dropped after 30 minutes".into(),
+            ),
+            input_schema: Arc::new(input_schema.as_object().unwrap().clone()),
+            output_schema: None,
+            annotations: None,
+            icons: None,
+        };
+
+        ToolRoute::new_dyn(tool, |context: ToolCallContext<'_, CcMcpServer>| {
+            Box::pin(async move {
+                let arguments = context.arguments.clone().unwrap_or_default();
+                let request: DropEphemeralIndexRequest =
+                    serde_json::from_value(serde_json::Value::Object(arguments)).map_err(|e| {
+                        rmcp::ErrorData::invalid_params(format!("Invalid parameters: {}", e), None)
+                    })?;
+
+                let service: &CcMcpServer = context.service;
+                match service.handle_drop_ephemeral_index(request).await {
+                    Ok((summary, result)) => Ok(CallToolResult {
+                        content: vec![
+                            Content::text(summary),
+                            Content::json(result.clone())
+                                .map_err(|e| ErrorData::internal_error(e.to_string(), None))?,
+                        ],
+                        structured_content: Some(result),
+                        is_error: Some(false),
+                        meta: None,
+                    }),
+                    Err(e) => Err(e),
+                }
+            })
+        })
+    }
+
+    fn remember_route() -> ToolRoute<Self> {
+        let schema = schemars::schema_for!(RememberRequest);
+        let input_schema = serde_json::to_value(schema).unwrap();
+        let tool = Tool {
+            name: "remember".into(),
+            title: Some("Remember".into()),
+            description: Some(
+                "Keep a short note about the repository for later sessions, such as how to run its tests or where a behavior lives; it is returned by semantic searches (as collection:memory/<id>) until its TTL passes".into(),
+            ),
+            input_schema: Arc::new(input_schema.as_object().unwrap().clone()),
+            output_schema: None,
+            annotations: None,
+            icons: None,
+        };
+
+        ToolRoute::new_dyn(tool, |context: ToolCallContext<'_, CcMcpServer>| {
+            Box::pin(async move {
+                let arguments = context.arguments.clone().unwrap_or_default();
+                let mut request: RememberRequest =
+                    serde_json::from_value(serde_json::Value::Object(arguments)).map_err(|e| {
+                        rmcp::ErrorData::invalid_params(format!("Invalid parameters: {}", e), None)
+                    })?;
+                if request.agent.is_none() {
+                    request.agent = context
+                        .request_context
+                        .peer
+                        .peer_info()
+                        .map(|info| info.client_info.name.clone());
+                }
+
+                let service: &CcMcpServer = context.service;
+                match service.handle_remember(request).await {
+                    Ok((summary, result)) => Ok(CallToolResult {
+                        content: vec![
+                            Content::text(summary),
+                            Content::json(result.clone())
+                                .map_err(|e| ErrorData::internal_error(e.to_string(), None))?,
+                        ],
+                        structured_content: Some(result),
+                        is_error: Some(false),
+                        meta: None,
+                    }),
+                    Err(e) => Err(e),
+                }
+            })
+        })
+    }
+
+    fn forget_memory_route() -> ToolRoute<Self> {
+        let schema = schemars::schema_for!(ForgetMemoryRequest);
+        let input_schema = serde_json::to_value(schema).unwrap();
+        let tool = Tool {
+            name: "forget_memory".into(),
+            title: Some("Forget Memory".into()),
+            description: Some(
+                "Delete a memory kept with remember, such as one the code no longer bears out"
+                    .into(),
+            ),
+            input_schema: Arc::new(input_schema.as_object().unwrap().clone()),
+            output_schema: None,
+            annotations: None,
+            icons: None,
+        };
+
+        ToolRoute::new_dyn(tool, |context: ToolCallContext<'_, CcMcpServer>| {
+            Box::pin(async move {
+                let arguments = context.arguments.clone().unwrap_or_default();
+                let request: ForgetMemoryRequest =
+                    serde_json::from_value(serde_json::Value::Object(arguments)).map_err(|e| {
+                        rmcp::ErrorData::invalid_params(format!("Invalid parameters: {}", e), None)
+                    })?;
+
+                let service: &CcMcpServer = context.service;
+                match service.handle_forget_memory(request).await {
+                    Ok((summary, result)) => Ok(CallToolResult {
+                        content: vec![
+                            Content::text(summary),
+                            Content::json(result.clone())
+                                .map_err(|e| ErrorData::internal_error(e.to_string(), None))?,
+                        ],
+                        structured_content: Some(result),
+                        is_error: Some(false),
+                        meta: None,
+                    }),
+                    Err(e) => Err(e),
+                }
+            })
+        })
+    }
+
     pub async fn run(&self) -> Result<()> {
         info!("Starting cc MCP server");
 
@@ -989,9 +1560,10 @@ impl CcMcpServer {
         peer: Option<Peer<RoleServer>>,
     ) -> Result<(String, Value), ErrorData> {
         // Handle pagination via cursor
-        if let Some(cursor) = &request.cursor {
+        if let Some(cursor) = request.get_cursor() {
             return self.handle_paginated_request(cursor, &request).await;
         }
+        let neighbors = request.neighbor_lookup();
 
         let query = request.query.clone();
         let path = request.path;
@@ -1032,41 +1604,40 @@ impl CcMcpServer {
             ));
         }
 
+        let snippet = request.snippet_policy()?;
+
         // Extract pagination config
         let config = Self::extract_pagination_config(
             request.page_size,
             request.include_snippet,
             request.snippet_length,
             request.context_lines,
+            snippet,
         );
 
+        // Progress notifications need a progress token and peer; indexing
+        // messages and streamed hits share one step count so progress only grows
+        let notifier = match (&meta, &peer) {
+            (Some(meta), Some(peer)) => meta
+                .get_progress_token()
+                .map(|token| ProgressNotifier::new(token, peer.clone())),
+            _ => None,
+        };
+
         // Create progress callback for indexing if we have a progress token and peer
-        let indexing_progress_callback = if let (Some(meta), Some(peer)) = (&meta, &peer) {
-            if let Some(progress_token) = meta.get_progress_token() {
-                let token = progress_token.clone();
-                let peer = peer.clone();
-                let step_count = Arc::new(AtomicUsize::new(0));
-                Some(Box::new(move |message: &str| {
-                    let token = token.clone();
-                    let peer = peer.clone();
-                    let message = message.to_string();
-                    let current_step = step_count.fetch_add(1, Ordering::SeqCst) + 1;
-                    tokio::spawn(async move {
-                        let _ = peer
-                            .notify_progress(ProgressNotificationParam {
-                                progress_token: token,
-                                progress: current_step as f64,
-                                total: None, // Unknown total for indexing
-                                message: Some(message),
-                            })
-                            .await;
-                    });
-                }) as cs_engine::IndexingProgressCallback)
-            } else {
-                None
+        let indexing_progress_callback = notifier.clone().map(|notifier| {
+            Box::new(move |message: &str| notifier.notify(message.to_string()))
+                as cs_engine::IndexingProgressCallback
+        });
+
+        // Stream provisional hits so clients can render them before the final page
+        let partial_results_callback = match notifier {
+            Some(notifier) if request.stream.unwrap_or(false) => {
+                Some(Box::new(move |results: &[cs_core::SearchResult]| {
+                    notifier.notify(partial_results_message(results))
+                }) as cs_engine::PartialResultsCallback)
             }
-        } else {
-            None
+            _ => None,
         };
 
         let include_snippet = request.include_snippet.unwrap_or(true);
@@ -1074,12 +1645,13 @@ impl CcMcpServer {
         let before_context_lines = request.before_context_lines.unwrap_or(context_lines);
         let after_context_lines = request.after_context_lines.unwrap_or(context_lines);
 
+        let settings = crate::reload::settings();
         let options = SearchOptions {
             mode: SearchMode::Semantic,
             query,
             path: path_buf,
             top_k: top_k.or(Some(DEFAULT_MCP_TOP_K)),
-            threshold: threshold.or(Some(0.6)),
+            threshold: threshold.or(Some(settings.threshold)),
             case_insensitive: request.case_insensitive.unwrap_or(false),
             whole_word: request.whole_word.unwrap_or(false),
             fixed_string: request.fixed_string.unwrap_or(false),
@@ -1107,6 +1679,26 @@ impl CcMcpServer {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: settings.boost_rules.clone(),
+            stop_symbol_rules: settings.stop_symbol_rules.clone(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: settings.max_typos,
+            fusion: settings.fusion.clone(),
+            snippet,
         };
 
         // Note: Embedders are created fresh for each request by cs-engine
@@ -1116,11 +1708,12 @@ impl CcMcpServer {
         let mut indexing_progress_callback = indexing_progress_callback;
         let mut effective_mode: Option<String> = None;
         let started = Instant::now();
-        let search_results = match cs_engine::search_enhanced_with_indexing_progress(
+        let search_results = match cs_engine::search_enhanced_streaming(
             &options,
             None,
             indexing_progress_callback.take(),
             None,
+            partial_results_callback,
         )
         .await
         {
@@ -1198,12 +1791,18 @@ impl CcMcpServer {
 
         let search_params = json!({
             "top_k": top_k.unwrap_or(DEFAULT_MCP_TOP_K),
-            "threshold": threshold.unwrap_or(0.6)
+            "threshold": threshold.unwrap_or(settings.threshold)
         });
 
         let current_page = page.current_page;
-        let mut structured_result =
-            Self::search_page_to_json(page, &query_clone, "semantic", search_params, elapsed_ms);
+        let mut structured_result = Self::search_page_to_json(
+            page,
+            &query_clone,
+            "semantic",
+            search_params,
+            elapsed_ms,
+            neighbors,
+        );
 
         if let Some(ref note) = effective_mode
             && let Some(metadata) = structured_result.get_mut("metadata")
@@ -1216,16 +1815,21 @@ impl CcMcpServer {
             .map(|s| format!(" [{}]", s))
             .unwrap_or_default();
 
-        let summary = format!(
+        let mut summary = format!(
             "Semantic search for '{}' found {} matches in {} (threshold: {:.2}, top_k: {}) - Page {}{}",
             query_clone,
             structured_result["results"]["count"],
             path_clone.display(),
-            threshold.unwrap_or(0.6),
+            threshold.unwrap_or(settings.threshold),
             top_k.unwrap_or(DEFAULT_MCP_TOP_K),
             current_page,
             summary_suffix
         );
+        Self::add_warnings(
+            &mut summary,
+            &mut structured_result,
+            &search_results.warnings,
+        );
 
         Ok((summary, structured_result))
     }
@@ -1234,9 +1838,10 @@ impl CcMcpServer {
         &self,
         request: LexicalSearchRequest,
     ) -> Result<(String, Value), ErrorData> {
-        if let Some(cursor) = &request.cursor {
+        if let Some(cursor) = request.get_cursor() {
             return self.handle_paginated_request(cursor, &request).await;
         }
+        let neighbors = request.neighbor_lookup();
 
         let query = request.query.clone();
         let path = request.path;
@@ -1275,11 +1880,13 @@ impl CcMcpServer {
             ));
         }
 
+        let snippet = request.snippet_policy()?;
         let config = Self::extract_pagination_config(
             request.page_size,
             request.include_snippet,
             request.snippet_length,
             request.context_lines,
+            snippet,
         );
 
         let include_snippet = request.include_snippet.unwrap_or(true);
@@ -1287,6 +1894,7 @@ impl CcMcpServer {
         let before_context_lines = request.before_context_lines.unwrap_or(context_lines);
         let after_context_lines = request.after_context_lines.unwrap_or(context_lines);
 
+        let settings = crate::reload::settings();
         let options = SearchOptions {
             mode: SearchMode::Lexical,
             query,
@@ -1320,6 +1928,26 @@ impl CcMcpServer {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: settings.boost_rules.clone(),
+            stop_symbol_rules: settings.stop_symbol_rules.clone(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: settings.max_typos,
+            fusion: settings.fusion.clone(),
+            snippet,
         };
 
         let started = Instant::now();
@@ -1349,8 +1977,14 @@ impl CcMcpServer {
         });
 
         let current_page = page.current_page;
-        let structured_result =
-            Self::search_page_to_json(page, &query_clone, "lexical", search_params, elapsed_ms);
+        let structured_result = Self::search_page_to_json(
+            page,
+            &query_clone,
+            "lexical",
+            search_params,
+            elapsed_ms,
+            neighbors,
+        );
 
         let summary = format!(
             "Lexical search for '{}' found {} matches in {} (top_k: {}, threshold: {}) - Page {}",
@@ -1374,9 +2008,10 @@ impl CcMcpServer {
         request: RegexSearchRequest,
     ) -> Result<(String, Value), ErrorData> {
         // Handle pagination via cursor
-        if let Some(cursor) = &request.cursor {
+        if let Some(cursor) = request.get_cursor() {
             return self.handle_paginated_request(cursor, &request).await;
         }
+        let neighbors = request.neighbor_lookup();
         let pattern = request.pattern.clone();
         let path = request.path;
         let ignore_case = request.ignore_case;
@@ -1418,16 +2053,20 @@ impl CcMcpServer {
 
         let context_lines = context.unwrap_or(0);
 
+        let snippet = request.snippet_policy()?;
+
         // Extract pagination config
         let config = Self::extract_pagination_config(
             request.page_size,
             request.include_snippet,
             request.snippet_length,
             Some(context_lines),
+            snippet,
         );
 
         let include_snippet = request.include_snippet.unwrap_or(true);
 
+        let settings = crate::reload::settings();
         let options = SearchOptions {
             mode: SearchMode::Regex,
             query: pattern,
@@ -1461,6 +2100,26 @@ impl CcMcpServer {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: settings.boost_rules.clone(),
+            stop_symbol_rules: settings.stop_symbol_rules.clone(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: settings.max_typos,
+            fusion: settings.fusion.clone(),
+            snippet,
         };
 
         // Perform the search (no indexing needed for regex)
@@ -1494,8 +2153,14 @@ impl CcMcpServer {
             "context_lines": context.unwrap_or(0)
         });
 
-        let structured_result =
-            Self::search_page_to_json(page, &pattern_clone, "regex", search_params, elapsed_ms);
+        let structured_result = Self::search_page_to_json(
+            page,
+            &pattern_clone,
+            "regex",
+            search_params,
+            elapsed_ms,
+            neighbors,
+        );
 
         let summary = format!(
             "Regex search for pattern '{}' found {} matches in {} (case_sensitive: {}, context: {} lines) - Page 1",
@@ -1514,9 +2179,10 @@ impl CcMcpServer {
         request: HybridSearchRequest,
     ) -> Result<(String, Value), ErrorData> {
         // Handle pagination via cursor
-        if let Some(cursor) = &request.cursor {
+        if let Some(cursor) = request.get_cursor() {
             return self.handle_paginated_request(cursor, &request).await;
         }
+        let neighbors = request.neighbor_lookup();
         let query = request.query.clone();
         let path = request.path;
         let top_k = request.top_k;
@@ -1556,12 +2222,15 @@ impl CcMcpServer {
             ));
         }
 
+        let snippet = request.snippet_policy()?;
+
         // Extract pagination config
         let config = Self::extract_pagination_config(
             request.page_size,
             request.include_snippet,
             request.snippet_length,
             request.context_lines,
+            snippet,
         );
 
         let include_snippet = request.include_snippet.unwrap_or(true);
@@ -1569,12 +2238,13 @@ impl CcMcpServer {
         let before_context_lines = request.before_context_lines.unwrap_or(context_lines);
         let after_context_lines = request.after_context_lines.unwrap_or(context_lines);
 
+        let settings = crate::reload::settings();
         let options = SearchOptions {
             mode: SearchMode::Hybrid,
             query,
             path: path_buf,
             top_k: top_k.or(Some(DEFAULT_MCP_TOP_K)), // User-defined or MCP default
-            threshold: threshold.or(Some(0.02)),      // Lower threshold for hybrid (RRF scores)
+            threshold: threshold.or(Some(settings.hybrid_threshold)), // Lower threshold for hybrid (RRF scores)
             case_insensitive: request.case_insensitive.unwrap_or(false),
             whole_word: request.whole_word.unwrap_or(false),
             fixed_string: request.fixed_string.unwrap_or(false),
@@ -1602,6 +2272,26 @@ impl CcMcpServer {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: settings.boost_rules.clone(),
+            stop_symbol_rules: settings.stop_symbol_rules.clone(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: settings.max_typos,
+            fusion: settings.fusion.clone(),
+            snippet,
         };
 
         // Perform the search (suppress progress callbacks for MCP)
@@ -1632,22 +2322,33 @@ impl CcMcpServer {
 
         let search_params = json!({
             "top_k": top_k.unwrap_or(DEFAULT_MCP_TOP_K),
-            "threshold": threshold.unwrap_or(0.02)
+            "threshold": threshold.unwrap_or(settings.hybrid_threshold)
         });
 
         let current_page = page.current_page;
-        let structured_result =
-            Self::search_page_to_json(page, &query_clone, "hybrid", search_params, elapsed_ms);
+        let mut structured_result = Self::search_page_to_json(
+            page,
+            &query_clone,
+            "hybrid",
+            search_params,
+            elapsed_ms,
+            neighbors,
+        );
 
-        let summary = format!(
+        let mut summary = format!(
             "Hybrid search for '{}' found {} matches in {} (threshold: {:.3}, top_k: {}, combines semantic + regex) - Page {}",
             query_clone,
             structured_result["results"]["count"],
             path_clone.display(),
-            threshold.unwrap_or(0.02),
+            threshold.unwrap_or(settings.hybrid_threshold),
             top_k.unwrap_or(DEFAULT_MCP_TOP_K),
             current_page
         );
+        Self::add_warnings(
+            &mut summary,
+            &mut structured_result,
+            &search_results.warnings,
+        );
 
         Ok((summary, structured_result))
     }
@@ -1674,7 +2375,7 @@ impl CcMcpServer {
         let _guard = lock.lock().await;
 
         // Check if index exists and get stats
-        let index_path = path_buf.join(".cs");
+        let index_path = cs_core::locations::index_dir(&path_buf);
         let index_exists = index_path.exists();
 
         let mut index_info = json!({
@@ -1827,6 +2528,7 @@ impl CcMcpServer {
         };
 
         // Create search options for reindexing
+        let settings = crate::reload::settings();
         let options = SearchOptions {
             mode: SearchMode::Semantic, // Use semantic mode to ensure embeddings are computed
             query: String::new(),       // Empty query for reindexing only
@@ -1860,6 +2562,29 @@ impl CcMcpServer {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: settings.boost_rules.clone(),
+            stop_symbol_rules: settings.stop_symbol_rules.clone(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: settings.max_typos,
+            fusion: settings.fusion.clone(),
+            snippet: None,
+            focus: None,
+            sub_queries: Vec::new(),
+            infer_language: cs_core::LanguageInference::default(),
         };
 
         // Perform reindexing
@@ -1909,4 +2634,228 @@ impl CcMcpServer {
 
         Ok((summary, structured_result))
     }
+
+    async fn handle_create_ephemeral_index(
+        &self,
+        request: CreateEphemeralIndexRequest,
+    ) -> Result<(String, Value), ErrorData> {
+        let root = request
+            .path
+            .map(PathBuf::from)
+            .unwrap_or_else(|| self.context.cwd.clone());
+        if !root.is_dir() {
+            return Err(ErrorData::invalid_params(
+                format!("Path is not a directory: {}", root.display()),
+                None,
+            ));
+        }
+        let files: Vec<PathBuf> = request
+            .files
+            .unwrap_or_default()
+            .into_iter()
+            .map(PathBuf::from)
+            .collect();
+        let patches = request.patches.unwrap_or_default();
+        if files.is_empty() && patches.is_empty() {
+            return Err(ErrorData::invalid_params(
+                "Provide files, patches or both to index".to_string(),
+                None,
+            ));
+        }
+
+        let started = Instant::now();
+        let build_root = root.clone();
+        let index = tokio::task::spawn_blocking(move || {
+            cs_engine::ephemeral::EphemeralIndex::build(
+                &build_root,
+                &files,
+                &patches,
+                request.model.as_deref(),
+            )
+        })
+        .await
+        .map_err(|e| ErrorData::internal_error(e.to_string(), None))?
+        .map_err(|e| ErrorData::internal_error(e.to_string(), None))?;
+
+        let file_count = index.file_count();
+        let chunk_count = index.chunk_count();
+        let skipped: Vec<Value> = index
+            .skipped()
+            .iter()
+            .map(|(file, reason)| json!({ "path": file.to_string_lossy(), "reason": reason }))
+            .collect();
+        let index_id = self.context.ephemeral_indexes.insert(index).await;
+
+        let structured_result = json!({
+            "index_id": index_id.to_string(),
+            "path": root.to_string_lossy(),
+            "files": file_count,
+            "chunks": chunk_count,
+            "skipped": skipped,
+            "build_time_ms": started.elapsed().as_millis() as u64,
+        });
+        let summary = format!(
+            "Created ephemeral index {} with {} chunks from {} files",
+            index_id, chunk_count, file_count
+        );
+
+        Ok((summary, structured_result))
+    }
+
+    async fn handle_search_ephemeral_index(
+        &self,
+        request: SearchEphemeralIndexRequest,
+    ) -> Result<(String, Value), ErrorData> {
+        let index_id = parse_ephemeral_index_id(&request.index_id)?;
+        let index = self
+            .context
+            .ephemeral_indexes
+            .get(index_id)
+            .await
+            .ok_or_else(|| {
+                ErrorData::invalid_params(
+                    format!("Ephemeral index not found or expired: {}", index_id),
+                    None,
+                )
+            })?;
+
+        let top_k = request.top_k.unwrap_or(DEFAULT_MCP_TOP_K);
+        let threshold = request.threshold;
+        let query = request.query.clone();
+        let started = Instant::now();
+        let matches = tokio::task::spawn_blocking(move || {
+            index
+                .lock()
+                .unwrap_or_else(|e| e.into_inner())
+                .search(&query, top_k, threshold)
+        })
+        .await
+        .map_err(|e| ErrorData::internal_error(e.to_string(), None))?
+        .map_err(|e| ErrorData::internal_error(e.to_string(), None))?;
+        let elapsed_ms = started.elapsed().as_millis() as u64;
+
+        let count = matches.len();
+        let page = SearchPage {
+            matches,
+            count,
+            total_count: Some(count),
+            has_more: false,
+            truncated: false,
+            next_cursor: None,
+            current_page: 1,
+            original_page_size: top_k,
+        };
+        let search_params = json!({
+            "top_k": top_k,
+            "threshold": threshold,
+        });
+        let mut structured_result = Self::search_page_to_json(
+            page,
+            &request.query,
+            "semantic",
+            search_params,
+            elapsed_ms,
+            None,
+        );
+        structured_result["search"]["index_id"] = json!(index_id.to_string());
+
+        let summary = format!(
+            "Semantic search for '{}' found {} matches in ephemeral index {}",
+            request.query, count, index_id
+        );
+
+        Ok((summary, structured_result))
+    }
+
+    async fn handle_drop_ephemeral_index(
+        &self,
+        request: DropEphemeralIndexRequest,
+    ) -> Result<(String, Value), ErrorData> {
+        let index_id = parse_ephemeral_index_id(&request.index_id)?;
+        let dropped = self.context.ephemeral_indexes.remove(index_id).await;
+        let summary = if dropped {
+            format!("Dropped ephemeral index {}", index_id)
+        } else {
+            format!("No ephemeral index {}; it may have expired", index_id)
+        };
+        Ok((
+            summary,
+            json!({ "index_id": index_id.to_string(), "dropped": dropped }),
+        ))
+    }
+
+    async fn handle_remember(
+        &self,
+        request: RememberRequest,
+    ) -> Result<(String, Value), ErrorData> {
+        let repo_root = memory_repo_root(&self.context.cwd, request.path.as_deref())?;
+        let ttl = match request.ttl.as_deref() {
+            Some(ttl) => cs_index::memories::parse_ttl(ttl)
+                .map_err(|e| ErrorData::invalid_params(e, None))?,
+            None => Some(cs_index::memories::DEFAULT_TTL_SECS),
+        };
+        let provenance = cs_index::memories::Provenance {
+            agent: request.agent,
+            session: request.session,
+            files: request.files.unwrap_or_default(),
+            commit: None,
+        };
+        let text = request.text;
+        let memory = tokio::task::spawn_blocking(move || {
+            cs_index::memories::remember(&repo_root, &text, ttl, provenance, None)
+        })
+        .await
+        .map_err(|e| ErrorData::internal_error(e.to_string(), None))?
+        .map_err(|e| ErrorData::internal_error(e.to_string(), None))?;
+
+        let summary = match memory.expires {
+            Some(expires) => format!(
+                "Remembered {}, kept for {} days",
+                memory.id,
+                (expires - memory.created).div_ceil(86_400)
+            ),
+            None => format!("Remembered {} until it's forgotten", memory.id),
+        };
+        Ok((
+            summary,
+            json!({
+                "id": memory.id,
+                "result": format!(
+                    "{}{}/{}",
+                    cs_engine::collection_search::COLLECTION_RESULT_PREFIX,
+                    cs_index::memories::MEMORY_COLLECTION,
+                    memory.id
+                ),
+                "created": memory.created,
+                "expires": memory.expires,
+                "provenance": memory.provenance,
+            }),
+        ))
+    }
+
+    async fn handle_forget_memory(
+        &self,
+        request: ForgetMemoryRequest,
+    ) -> Result<(String, Value), ErrorData> {
+        let repo_root = memory_repo_root(&self.context.cwd, request.path.as_deref())?;
+        let memory = cs_index::memories::forget(&repo_root, &request.id)
+            .map_err(|e| ErrorData::invalid_params(e.to_string(), None))?;
+        Ok((
+            format!("Forgot memory {}", memory.id),
+            json!({ "id": memory.id, "text": memory.text }),
+        ))
+    }
+}
+
+/// The repository a memory request is about: `path`, or the server's
+/// working directory.
+fn memory_repo_root(cwd: &Path, path: Option<&str>) -> Result<PathBuf, ErrorData> {
+    let path = path.map(PathBuf::from).unwrap_or_else(|| cwd.to_path_buf());
+    cs_index::find_repo_root(&path).map_err(|e| ErrorData::invalid_params(e.to_string(), None))
+}
+
+fn parse_ephemeral_index_id(index_id: &str) -> Result<uuid::Uuid, ErrorData> {
+    uuid::Uuid::parse_str(index_id).map_err(|_| {
+        ErrorData::invalid_params(format!("Invalid ephemeral index id: {}", index_id), None)
+    })
 }
@@ -0,0 +1,373 @@
+//! `cs --offline-bundle cs-offline.tar`: this cs binary and the local
+//! embedding models it searches with, in one tarball that installs with no
+//! network access, for machines that can't reach Hugging Face or a package
+//! registry.
+//!
+//! Everything sits under `cs-<version>-<os>-<arch>/`:
+//! - `bin/cs`, the running binary; tree-sitter grammars are compiled into it
+//! - `models/`, the models' directories from the model cache, as they are
+//! - `install.sh`, which copies both into place after checking `SHA256SUMS`
+//! - `bundle.json`, the version, platform and models
+//!
+//! Models that aren't downloaded yet are downloaded first, so the bundle is
+//! built on a connected machine of the target platform.
+
+use anyhow::{Context, Result, bail};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use std::fs::{self, File};
+use std::io::{self, BufWriter, Read, Write};
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+use walkdir::WalkDir;
+
+const FORMAT_VERSION: u32 = 1;
+
+const BLOCK: usize = 512;
+
+const INSTALL_SCRIPT: &str = r#"#!/bin/sh
+# Install cs and its models from this bundle, with no network access.
+# Usage: ./install.sh [PREFIX]    (default $HOME/.local; cs goes to PREFIX/bin)
+set -eu
+cd "$(dirname "$0")"
+
+if command -v sha256sum >/dev/null 2>&1; then
+    sha256sum -c --quiet SHA256SUMS
+elif command -v shasum >/dev/null 2>&1; then
+    shasum -a 256 -c SHA256SUMS >/dev/null
+else
+    echo "warning: neither sha256sum nor shasum found; not checking SHA256SUMS" >&2
+fi
+
+prefix="${1:-$HOME/.local}"
+models="${XDG_CACHE_HOME:-$HOME/.cache}/cs/models"
+mkdir -p "$prefix/bin" "$models"
+cp bin/cs "$prefix/bin/cs"
+chmod 755 "$prefix/bin/cs"
+cp -R models/. "$models/"
+echo "Installed $prefix/bin/cs and its models in $models"
+"#;
+
+#[derive(Serialize)]
+struct BundleInfo<'a> {
+    format_version: u32,
+    version: &'static str,
+    os: &'static str,
+    arch: &'static str,
+    models: &'a [String],
+}
+
+#[derive(Debug, Default)]
+pub struct BundleStats {
+    pub files: usize,
+    pub bytes: u64,
+}
+
+/// Write the bundle of this binary and `models` (full model names, e.g.
+/// `BAAI/bge-small-en-v1.5`) to `output`, calling `on_file` with each file
+/// added.
+pub fn create_bundle(
+    output: &Path,
+    models: &[String],
+    on_file: &dyn Fn(&str),
+) -> Result<BundleStats> {
+    let cache_dir = cs_embed::model_cache_dir();
+    let mut model_dirs = Vec::new();
+    for model in models {
+        if !cs_embed::is_model_cached(model) {
+            on_file(&format!("downloading {}", model));
+            cs_embed::create_embedder(Some(model))?;
+        }
+        let dirs: Vec<PathBuf> = crate::warm::model_dirs(&cache_dir, model)
+            .into_iter()
+            .filter(|dir| dir.is_dir())
+            .collect();
+        if dirs.is_empty() {
+            bail!(
+                "Model {} isn't in the model cache ({}); this build can't download it",
+                model,
+                cache_dir.display()
+            );
+        }
+        model_dirs.extend(dirs);
+    }
+
+    let exe = std::env::current_exe().context("Can't find the running cs binary")?;
+    let root = format!(
+        "cs-{}-{}-{}",
+        env!("CARGO_PKG_VERSION"),
+        std::env::consts::OS,
+        std::env::consts::ARCH
+    );
+    let info = BundleInfo {
+        format_version: FORMAT_VERSION,
+        version: env!("CARGO_PKG_VERSION"),
+        os: std::env::consts::OS,
+        arch: std::env::consts::ARCH,
+        models,
+    };
+
+    let temp = output.with_extension("tar.tmp");
+    let result = (|| {
+        let mut tar = TarWriter::new(BufWriter::new(File::create(&temp)?));
+        let mut sums = String::new();
+        let mut append = |tar: &mut TarWriter<_>, name: String, source: &Path, mode: u32| {
+            on_file(&name);
+            let digest = tar.append_file(&format!("{}/{}", root, name), source, mode)?;
+            sums.push_str(&format!("{}  {}\n", digest, name));
+            anyhow::Ok(())
+        };
+
+        append(
+            &mut tar,
+            format!("bin/cs{}", std::env::consts::EXE_SUFFIX),
+            &exe,
+            0o755,
+        )?;
+        for dir in &model_dirs {
+            let Some(parent) = dir.parent() else {
+                continue;
+            };
+            for entry in WalkDir::new(dir).sort_by_file_name() {
+                let entry = entry?;
+                let relative = entry.path().strip_prefix(parent)?;
+                let name = format!("models/{}", cs_core::paths::to_relative_slash(relative));
+                if entry.path_is_symlink() {
+                    // The hub's snapshots link into its blobs
+                    let target = fs::read_link(entry.path())?;
+                    tar.append_symlink(
+                        &format!("{}/{}", root, name),
+                        &cs_core::paths::to_relative_slash(&target),
+                    )?;
+                } else if entry.file_type().is_dir() {
+                    tar.append_dir(&format!("{}/{}", root, name))?;
+                } else if entry.file_type().is_file() {
+                    append(&mut tar, name, entry.path(), 0o644)?;
+                }
+            }
+        }
+        tar.append_data(
+            &format!("{}/bundle.json", root),
+            &serde_json::to_vec_pretty(&info)?,
+            0o644,
+        )?;
+        tar.append_data(
+            &format!("{}/install.sh", root),
+            INSTALL_SCRIPT.as_bytes(),
+            0o755,
+        )?;
+        tar.append_data(&format!("{}/SHA256SUMS", root), sums.as_bytes(), 0o644)?;
+        tar.finish()
+    })();
+    let stats = match result {
+        Ok(stats) => stats,
+        Err(e) => {
+            let _ = fs::remove_file(&temp);
+            return Err(e);
+        }
+    };
+    fs::rename(&temp, output).with_context(|| format!("Failed to write {}", output.display()))?;
+    Ok(stats)
+}
+
+/// Writes a POSIX ustar archive.
+struct TarWriter<W: Write> {
+    out: W,
+    mtime: u64,
+    stats: BundleStats,
+}
+
+impl<W: Write> TarWriter<W> {
+    fn new(out: W) -> Self {
+        let mtime = SystemTime::now()
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        Self {
+            out,
+            mtime,
+            stats: BundleStats::default(),
+        }
+    }
+
+    /// Add the file at `source` as `name`, returning its SHA-256.
+    fn append_file(&mut self, name: &str, source: &Path, mode: u32) -> Result<String> {
+        let mut file =
+            File::open(source).with_context(|| format!("Failed to read {}", source.display()))?;
+        let size = file.metadata()?.len();
+        self.write_header(name, b'0', size, mode, "")?;
+        let mut hasher = Sha256::new();
+        let mut buffer = vec![0; 64 * 1024];
+        let mut written = 0;
+        loop {
+            let read = file.read(&mut buffer)?;
+            if read == 0 {
+                break;
+            }
+            hasher.update(&buffer[..read]);
+            self.out.write_all(&buffer[..read])?;
+            written += read as u64;
+        }
+        if written != size {
+            bail!("{} changed while it was being bundled", source.display());
+        }
+        self.pad(size)?;
+        self.stats.files += 1;
+        self.stats.bytes += size;
+        Ok(format!("{:x}", hasher.finalize()))
+    }
+
+    fn append_data(&mut self, name: &str, data: &[u8], mode: u32) -> Result<()> {
+        self.write_header(name, b'0', data.len() as u64, mode, "")?;
+        self.out.write_all(data)?;
+        self.pad(data.len() as u64)?;
+        self.stats.files += 1;
+        self.stats.bytes += data.len() as u64;
+        Ok(())
+    }
+
+    fn append_dir(&mut self, name: &str) -> Result<()> {
+        self.write_header(&format!("{}/", name), b'5', 0, 0o755, "")
+    }
+
+    fn append_symlink(&mut self, name: &str, target: &str) -> Result<()> {
+        self.write_header(name, b'2', 0, 0o777, target)
+    }
+
+    fn finish(mut self) -> Result<BundleStats> {
+        // Two zero blocks end the archive
+        self.out.write_all(&[0; BLOCK * 2])?;
+        self.out.flush()?;
+        Ok(self.stats)
+    }
+
+    fn pad(&mut self, size: u64) -> io::Result<()> {
+        let rest = (BLOCK - (size as usize % BLOCK)) % BLOCK;
+        self.out.write_all(&vec![0; rest])
+    }
+
+    fn write_header(
+        &mut self,
+        name: &str,
+        kind: u8,
+        size: u64,
+        mode: u32,
+        link: &str,
+    ) -> Result<()> {
+        let header = header(name, kind, size, mode, self.mtime, link)?;
+        self.out.write_all(&header)?;
+        Ok(())
+    }
+}
+
+/// A ustar header block. Names longer than 100 bytes are split between the
+/// prefix and name fields at a `/`.
+fn header(
+    name: &str,
+    kind: u8,
+    size: u64,
+    mode: u32,
+    mtime: u64,
+    link: &str,
+) -> Result<[u8; BLOCK]> {
+    let (prefix, name) = split_name(name)
+        .ok_or_else(|| anyhow::anyhow!("Path too long for a tar archive: {}", name))?;
+    if link.len() > 100 {
+        bail!("Link target too long for a tar archive: {}", link);
+    }
+    let mut block = [0u8; BLOCK];
+    block[..name.len()].copy_from_slice(name.as_bytes());
+    write_octal(&mut block[100..108], mode as u64);
+    write_octal(&mut block[108..116], 0);
+    write_octal(&mut block[116..124], 0);
+    write_octal(&mut block[124..136], size);
+    write_octal(&mut block[136..148], mtime);
+    block[156] = kind;
+    block[157..157 + link.len()].copy_from_slice(link.as_bytes());
+    block[257..263].copy_from_slice(b"ustar\0");
+    block[263..265].copy_from_slice(b"00");
+    block[345..345 + prefix.len()].copy_from_slice(prefix.as_bytes());
+
+    // The checksum is taken with its own field as spaces
+    block[148..156].fill(b' ');
+    let checksum: u32 = block.iter().map(|&b| b as u32).sum();
+    block[148..155].copy_from_slice(format!("{:06o}\0", checksum).as_bytes());
+    Ok(block)
+}
+
+/// `(prefix, name)` fields for `path`: the name fits in 100 bytes and the
+/// prefix in 155.
+fn split_name(path: &str) -> Option<(&str, &str)> {
+    if path.len() <= 100 {
+        return Some(("", path));
+    }
+    path.char_indices()
+        .filter(|&(_, c)| c == '/')
+        .map(|(i, _)| (&path[..i], &path[i + 1..]))
+        .find(|(prefix, name)| prefix.len() <= 155 && name.len() <= 100 && !name.is_empty())
+}
+
+/// Zero-padded octal filling `field` but for its trailing NUL.
+fn write_octal(field: &mut [u8], value: u64) {
+    let digits = format!("{:0width$o}\0", value, width = field.len() - 1);
+    field.copy_from_slice(digits.as_bytes());
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn field(block: &[u8], range: std::ops::Range<usize>) -> String {
+        String::from_utf8_lossy(&block[range])
+            .trim_end_matches('\0')
+            .to_string()
+    }
+
+    #[test]
+    fn headers_are_valid_ustar() {
+        let block = header("cs-1.0/bin/cs", b'0', 1234, 0o755, 0, "").unwrap();
+        assert_eq!(field(&block, 0..100), "cs-1.0/bin/cs");
+        assert_eq!(field(&block, 124..136), format!("{:011o}", 1234));
+        assert_eq!(field(&block, 100..108), "0000755");
+        assert_eq!(&block[257..263], b"ustar\0");
+
+        let stored = u32::from_str_radix(field(&block, 148..155).trim(), 8).unwrap();
+        let mut blank = block;
+        blank[148..156].fill(b' ');
+        assert_eq!(stored, blank.iter().map(|&b| b as u32).sum::<u32>());
+    }
+
+    #[test]
+    fn long_paths_split_into_prefix_and_name() {
+        let path = format!(
+            "cs-1.0/models/models--BAAI--bge-small-en-v1.5/snapshots/{}/onnx/model.onnx",
+            "a".repeat(40)
+        );
+        assert!(path.len() > 100);
+        let block = header(&path, b'0', 0, 0o644, 0, "").unwrap();
+        let (prefix, name) = (field(&block, 345..500), field(&block, 0..100));
+        assert_eq!(format!("{}/{}", prefix, name), path);
+        assert!(header(&"x".repeat(300), b'0', 0, 0o644, 0, "").is_err());
+    }
+
+    #[test]
+    fn archives_pad_entries_and_end_with_zero_blocks() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let source = temp_dir.path().join("model.onnx");
+        fs::write(&source, b"weights").unwrap();
+
+        let mut tar = TarWriter::new(Vec::new());
+        let digest = tar.append_file("b/model.onnx", &source, 0o644).unwrap();
+        tar.append_symlink("b/link", "../blobs/abc").unwrap();
+        assert_eq!(
+            digest,
+            "9a129038d9a00aed0cf6a7ea059ca50a813449061ab87848cf1a13eafdf33b2c"
+        );
+        assert_eq!(tar.out.len(), BLOCK * 3);
+        assert_eq!(&tar.out[BLOCK..BLOCK + 7], b"weights");
+        assert_eq!(tar.out[BLOCK * 2 + 156], b'2');
+
+        let stats = tar.finish().unwrap();
+        assert_eq!((stats.files, stats.bytes), (1, 7));
+    }
+}
@@ -0,0 +1,318 @@
+//! `cs --init`: looks a repository over before its first index, and
+//! recommends what to leave out and which model to embed it with.
+
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+
+/// Generated files a directory needs before it's worth excluding.
+const MIN_GENERATED_FILES: usize = 3;
+
+/// Share of a directory's files that must be generated to exclude it.
+const GENERATED_SHARE: f64 = 0.9;
+
+/// Source above which a local code model takes hours on a laptop CPU.
+const LARGE_REPO_BYTES: u64 = 100 * 1024 * 1024;
+
+/// Share of the bytes below which a repository is mostly prose.
+const CODE_SHARE: f64 = 0.5;
+
+/// Label of files in no language cs parses.
+const OTHER: &str = "other";
+
+#[derive(Debug, Clone, Serialize)]
+pub struct LanguageShare {
+    pub language: String,
+    pub files: usize,
+    pub bytes: u64,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SuggestedExclude {
+    pub pattern: String,
+    pub files: usize,
+    pub reason: String,
+}
+
+#[derive(Debug, Default, Clone, Serialize)]
+pub struct Survey {
+    /// Files an index would embed, once the suggested excludes are added
+    pub files: usize,
+    pub bytes: u64,
+    /// Most bytes first
+    pub languages: Vec<LanguageShare>,
+    pub suggested_excludes: Vec<SuggestedExclude>,
+}
+
+impl Survey {
+    /// Share of the bytes in a language cs parses, PDFs aside.
+    pub fn code_share(&self) -> f64 {
+        if self.bytes == 0 {
+            return 0.0;
+        }
+        let code: u64 = self
+            .languages
+            .iter()
+            .filter(|share| share.language != OTHER && share.language != "pdf")
+            .map(|share| share.bytes)
+            .sum();
+        code as f64 / self.bytes as f64
+    }
+}
+
+struct SurveyedFile {
+    relative: PathBuf,
+    bytes: u64,
+    language: Option<cs_core::Language>,
+    generated: bool,
+}
+
+/// Look over the files an index of `root` would embed.
+pub fn survey(root: &Path, respect_gitignore: bool, exclude_patterns: &[String]) -> Result<Survey> {
+    let files: Vec<SurveyedFile> =
+        cs_index::collect_files(root, respect_gitignore, exclude_patterns)?
+            .into_iter()
+            .map(|path| SurveyedFile {
+                relative: path.strip_prefix(root).unwrap_or(&path).to_path_buf(),
+                bytes: path.metadata().map(|m| m.len()).unwrap_or(0),
+                language: cs_core::Language::from_path(&path),
+                generated: cs_index::generated::is_generated_file(&path),
+            })
+            .collect();
+
+    let mut excluded: Vec<(PathBuf, String)> = generated_dirs(
+        &files
+            .iter()
+            .map(|file| (file.relative.clone(), file.generated))
+            .collect::<Vec<_>>(),
+    )
+    .into_iter()
+    .map(|dir| (dir, "Generated code".to_string()))
+    .collect();
+    // What `go mod vendor` copies is better left to --with-deps
+    if root.join("go.mod").is_file() && root.join("vendor/modules.txt").is_file() {
+        excluded.push((
+            PathBuf::from("vendor"),
+            "Vendored Go modules; cs --index --with-deps indexes dependencies into their own collection".to_string(),
+        ));
+    }
+
+    let mut survey = Survey::default();
+    let mut languages: HashMap<String, (usize, u64)> = HashMap::new();
+    let mut excluded_files = vec![0; excluded.len()];
+    for file in &files {
+        if let Some(i) = excluded
+            .iter()
+            .position(|(dir, _)| file.relative.starts_with(dir))
+        {
+            excluded_files[i] += 1;
+            continue;
+        }
+        survey.files += 1;
+        survey.bytes += file.bytes;
+        let language = file
+            .language
+            .map_or_else(|| OTHER.to_string(), |language| language.to_string());
+        let share = languages.entry(language).or_default();
+        share.0 += 1;
+        share.1 += file.bytes;
+    }
+    survey.languages = languages
+        .into_iter()
+        .map(|(language, (files, bytes))| LanguageShare {
+            language,
+            files,
+            bytes,
+        })
+        .collect();
+    survey.languages.sort_by(|a, b| {
+        b.bytes
+            .cmp(&a.bytes)
+            .then_with(|| a.language.cmp(&b.language))
+    });
+    survey.suggested_excludes = excluded
+        .into_iter()
+        .zip(excluded_files)
+        .filter(|(_, files)| *files > 0)
+        .map(|((dir, reason), files)| SuggestedExclude {
+            pattern: format!("{}/**", cs_core::paths::to_slash(&dir)),
+            files,
+            reason,
+        })
+        .collect();
+    Ok(survey)
+}
+
+/// The outermost directories of `files` (relative paths, and whether each
+/// is generated) that hold little but generated code.
+fn generated_dirs(files: &[(PathBuf, bool)]) -> Vec<PathBuf> {
+    let mut dirs: BTreeMap<&Path, (usize, usize)> = BTreeMap::new();
+    for (file, generated) in files {
+        for dir in file.ancestors().skip(1) {
+            if dir.as_os_str().is_empty() {
+                break;
+            }
+            let counts = dirs.entry(dir).or_default();
+            counts.0 += 1;
+            counts.1 += usize::from(*generated);
+        }
+    }
+    let mut chosen: Vec<PathBuf> = Vec::new();
+    // Parents sort before their children
+    for (dir, (total, generated)) in dirs {
+        if generated >= MIN_GENERATED_FILES
+            && generated as f64 >= total as f64 * GENERATED_SHARE
+            && !chosen.iter().any(|parent| dir.starts_with(parent))
+        {
+            chosen.push(dir.to_path_buf());
+        }
+    }
+    chosen
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct ModelChoice {
+    /// Registry alias, as `--model` takes it
+    pub alias: &'static str,
+    pub reason: String,
+}
+
+/// The model to embed the repository `survey` describes with, given
+/// whether a Jina API key is set.
+pub fn recommend_model(survey: &Survey, jina_api_key: bool) -> ModelChoice {
+    if jina_api_key {
+        return ModelChoice {
+            alias: "jina-v4",
+            reason: "JINA_API_KEY is set: the hosted model embeds large files of code best, at a per-token price".to_string(),
+        };
+    }
+    if survey.bytes > LARGE_REPO_BYTES {
+        return ModelChoice {
+            alias: "bge-small",
+            reason: format!(
+                "{:.0} MB to embed: the small local model keeps the first index to a fraction of the time",
+                survey.bytes as f64 / (1024.0 * 1024.0)
+            ),
+        };
+    }
+    if survey.code_share() < CODE_SHARE {
+        return ModelChoice {
+            alias: "nomic-v1.5",
+            reason: "Mostly documentation and other text: a general local model with a large context window".to_string(),
+        };
+    }
+    ModelChoice {
+        alias: "jina-code",
+        reason: "Mostly code: the local model trained for code search".to_string(),
+    }
+}
+
+/// Contents of the `.cs.toml` that `cs --init` writes.
+pub fn project_config(model: &ModelChoice) -> String {
+    format!(
+        "# Written by cs --init. The index keeps the model it was first built with;\n\
+         # cs --switch-model rebuilds it with another.\n\
+         index_model = \"{alias}\"\n\
+         query_model = \"{alias}\"\n",
+        alias = model.alias
+    )
+}
+
+/// `.csignore` with `excludes` added under a heading, unless it has them.
+pub fn csignore_with(existing: &str, excludes: &[SuggestedExclude]) -> String {
+    let present: Vec<&str> = existing.lines().map(str::trim).collect();
+    let missing: Vec<&SuggestedExclude> = excludes
+        .iter()
+        .filter(|exclude| !present.contains(&exclude.pattern.as_str()))
+        .collect();
+    let mut csignore = existing.to_string();
+    if missing.is_empty() {
+        return csignore;
+    }
+    if !csignore.is_empty() && !csignore.ends_with('\n') {
+        csignore.push('\n');
+    }
+    csignore.push_str("\n# Suggested by cs --init\n");
+    for exclude in missing {
+        // Patterns can't share a line with a comment
+        csignore.push_str(&format!("# {}\n{}\n", exclude.reason, exclude.pattern));
+    }
+    csignore
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn directories_of_generated_code_are_excluded_outermost_first() {
+        let files: Vec<(PathBuf, bool)> = [
+            ("api/gen/v1/user.pb.go", true),
+            ("api/gen/v1/order.pb.go", true),
+            ("api/gen/v2/user.pb.go", true),
+            ("api/handler.go", false),
+            ("internal/mocks/store.go", true),
+            ("internal/mocks/cache.go", true),
+            ("internal/store.go", false),
+            ("main.go", false),
+        ]
+        .iter()
+        .map(|(file, generated)| (PathBuf::from(file), *generated))
+        .collect();
+        // internal/mocks has two generated files, too few to bother
+        assert_eq!(generated_dirs(&files), vec![PathBuf::from("api/gen")]);
+    }
+
+    #[test]
+    fn models_follow_the_repository() {
+        let mut survey = Survey {
+            files: 2,
+            bytes: 1000,
+            languages: vec![
+                LanguageShare {
+                    language: "go".to_string(),
+                    files: 1,
+                    bytes: 800,
+                },
+                LanguageShare {
+                    language: OTHER.to_string(),
+                    files: 1,
+                    bytes: 200,
+                },
+            ],
+            suggested_excludes: Vec::new(),
+        };
+        assert_eq!(recommend_model(&survey, false).alias, "jina-code");
+        assert_eq!(recommend_model(&survey, true).alias, "jina-v4");
+
+        survey.languages[0].bytes = 200;
+        survey.languages[1].bytes = 800;
+        assert_eq!(recommend_model(&survey, false).alias, "nomic-v1.5");
+
+        survey.bytes = LARGE_REPO_BYTES + 1;
+        assert_eq!(recommend_model(&survey, false).alias, "bge-small");
+    }
+
+    #[test]
+    fn csignore_gains_only_missing_excludes() {
+        let excludes = [
+            SuggestedExclude {
+                pattern: "api/gen/**".to_string(),
+                files: 3,
+                reason: "Generated code".to_string(),
+            },
+            SuggestedExclude {
+                pattern: "vendor/**".to_string(),
+                files: 40,
+                reason: "Vendored Go modules".to_string(),
+            },
+        ];
+        assert_eq!(
+            csignore_with("*.png\nvendor/**", &excludes),
+            "*.png\nvendor/**\n\n# Suggested by cs --init\n# Generated code\napi/gen/**\n"
+        );
+        let done = csignore_with("", &excludes);
+        assert_eq!(csignore_with(&done, &excludes), done);
+    }
+}
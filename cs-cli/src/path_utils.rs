@@ -1,8 +1,9 @@
 use anyhow::Result;
 use cs_core::IncludePattern;
-use glob::glob;
-use globset::{Glob, GlobSet, GlobSetBuilder};
+use glob::{MatchOptions, glob_with};
+use globset::{Glob, GlobBuilder, GlobSet, GlobSetBuilder};
 use std::path::{Component, Path, PathBuf};
+use walkdir::WalkDir;
 
 /// Expand user-provided glob patterns, mimicking shell behaviour while tolerating
 /// unmatched globs by keeping the original pattern. Bare filename globs (e.g.
@@ -28,12 +29,15 @@ pub fn build_include_patterns(paths: &[PathBuf]) -> Vec<IncludePattern> {
     let mut includes: Vec<IncludePattern> = Vec::new();
 
     for path in paths {
-        let canonical = canonicalize_lossy(path);
+        let canonical = cs_core::paths::canonicalize_lossy(path);
         let is_dir = std::fs::metadata(&canonical)
             .map(|meta| meta.is_dir())
             .unwrap_or(false);
 
-        if let Some(existing) = includes.iter_mut().find(|inc| inc.path == canonical) {
+        if let Some(existing) = includes
+            .iter_mut()
+            .find(|inc| cs_core::paths::paths_equal(&inc.path, &canonical))
+        {
             if is_dir {
                 existing.is_dir = true;
             }
@@ -119,7 +123,11 @@ fn run_glob(
     expanded: &mut Vec<PathBuf>,
 ) -> Result<bool> {
     let mut matched = false;
-    match glob(pattern) {
+    let options = MatchOptions {
+        case_sensitive: !cs_core::paths::filters_ignore_case(),
+        ..MatchOptions::new()
+    };
+    match glob_with(pattern, options) {
         Ok(glob_paths) => {
             for glob_result in glob_paths {
                 match glob_result {
@@ -140,40 +148,101 @@ fn run_glob(
             eprintln!("Warning: invalid glob pattern '{}': {}", pattern, e);
         }
     }
+    if !matched && cs_core::paths::folding_matters(&[pattern.to_string()]) {
+        matched = run_folded_glob(pattern, globset, base_dir, expanded);
+    }
     Ok(matched)
 }
 
+/// `glob` compares names byte for byte, so one spelled `é` misses files
+/// macOS named `e` + accent (and, with accents ignored, `e` misses `é`).
+/// Walk from the pattern's plain ASCII directories instead and match
+/// folded paths (see [`cs_core::paths::fold`]).
+fn run_folded_glob(
+    pattern: &str,
+    globset: &GlobSet,
+    base_dir: Option<&Path>,
+    expanded: &mut Vec<PathBuf>,
+) -> bool {
+    let mut root = PathBuf::new();
+    let mut rest: Vec<String> = Vec::new();
+    for component in Path::new(pattern).components() {
+        let text = component.as_os_str().to_string_lossy();
+        if rest.is_empty() && text.is_ascii() && !text.contains(['*', '?', '[', '{']) {
+            root.push(component);
+        } else {
+            rest.push(text.into_owned());
+        }
+    }
+    if rest.is_empty() {
+        return false;
+    }
+    let max_depth = if rest.iter().any(|part| part.contains("**")) {
+        usize::MAX
+    } else {
+        rest.len()
+    };
+    let Ok(glob) = GlobBuilder::new(&cs_core::paths::filter_pattern(pattern))
+        .case_insensitive(cs_core::paths::filters_ignore_case())
+        .literal_separator(true)
+        .build()
+    else {
+        return false;
+    };
+    let matcher = glob.compile_matcher();
+
+    let relative = root.as_os_str().is_empty();
+    let walk_root = if relative { Path::new(".") } else { &root };
+    let mut matched = false;
+    for entry in WalkDir::new(walk_root)
+        .min_depth(1)
+        .max_depth(max_depth)
+        .into_iter()
+        .filter_map(Result::ok)
+    {
+        let path = if relative {
+            entry.path().strip_prefix(".").unwrap_or(entry.path())
+        } else {
+            entry.path()
+        };
+        if !matcher.is_match(cs_core::paths::filter_path(path))
+            || should_exclude_path(path, globset, base_dir)
+        {
+            continue;
+        }
+        matched = true;
+        push_if_new(expanded, path.to_path_buf());
+    }
+    matched
+}
+
 fn push_if_new(acc: &mut Vec<PathBuf>, candidate: PathBuf) {
     if !acc.iter().any(|existing| existing == &candidate) {
         acc.push(candidate);
     }
 }
 
-fn canonicalize_lossy(path: &Path) -> PathBuf {
-    if let Ok(canonical) = path.canonicalize() {
-        return canonical;
-    }
-
-    std::env::current_dir()
-        .map(|cwd| cwd.join(path))
-        .unwrap_or_else(|_| path.to_path_buf())
+/// Whether `path` (or a name in it) matches `globset`, as path filters
+/// compare names.
+fn is_match(globset: &GlobSet, path: &Path) -> bool {
+    globset.is_match(cs_core::paths::filter_path(path))
 }
 
 fn should_exclude_path(path: &Path, globset: &GlobSet, base_dir: Option<&Path>) -> bool {
-    if globset.is_match(path) {
+    if is_match(globset, path) {
         return true;
     }
 
     if let Some(base) = base_dir
         && let Ok(relative) = path.strip_prefix(base)
     {
-        if !relative.as_os_str().is_empty() && globset.is_match(relative) {
+        if !relative.as_os_str().is_empty() && is_match(globset, relative) {
             return true;
         }
 
         for component in relative.components() {
             if let Component::Normal(name) = component
-                && globset.is_match(name)
+                && is_match(globset, Path::new(name))
             {
                 return true;
             }
@@ -182,7 +251,7 @@ fn should_exclude_path(path: &Path, globset: &GlobSet, base_dir: Option<&Path>)
 
     for component in path.components() {
         if let Component::Normal(name) = component
-            && globset.is_match(name)
+            && is_match(globset, Path::new(name))
         {
             return true;
         }
@@ -191,24 +260,33 @@ fn should_exclude_path(path: &Path, globset: &GlobSet, base_dir: Option<&Path>)
     false
 }
 
+/// Globs ignore case where the filesystem does (Windows), or everywhere
+/// with `--ignore-path-case`.
+fn new_glob(pattern: &str) -> Result<Glob, globset::Error> {
+    GlobBuilder::new(pattern)
+        .case_insensitive(cs_core::paths::filters_ignore_case())
+        .build()
+}
+
 fn build_globset(patterns: &[String]) -> GlobSet {
     let mut builder = GlobSetBuilder::new();
 
     for pattern in patterns {
-        if let Ok(glob) = Glob::new(pattern) {
+        let pattern = &cs_core::paths::filter_pattern(pattern);
+        if let Ok(glob) = new_glob(pattern) {
             builder.add(glob);
         }
 
         if let Some(stripped) = pattern.strip_suffix("/**") {
             if !stripped.is_empty()
-                && let Ok(glob) = Glob::new(stripped)
+                && let Ok(glob) = new_glob(stripped)
             {
                 builder.add(glob);
             }
         } else if let Some(stripped) = pattern.strip_suffix("\\**") {
             // Support Windows-style globstar suffixes as well.
             if !stripped.is_empty()
-                && let Ok(glob) = Glob::new(stripped)
+                && let Ok(glob) = new_glob(stripped)
             {
                 builder.add(glob);
             }
@@ -339,4 +417,40 @@ mod tests {
         assert!(!includes_foo, "foo/** should exclude everything under foo");
         assert!(includes_root, "root.txt should still be present");
     }
+
+    #[test]
+    fn matches_names_in_either_unicode_form() {
+        let temp_dir = tempdir().unwrap();
+        let base = temp_dir.path();
+
+        // Decomposed, as macOS hands names out
+        write_file(&base.join("cafe\u{301}/menu.md"), "# Menu");
+        write_file(&base.join("cafe\u{301}/dra\u{301}ft.md"), "# Draft");
+        write_file(&base.join("re\u{301}sume\u{301}.txt"), "resume");
+
+        let expanded = expand_glob_patterns_with_base(
+            base,
+            &[PathBuf::from("caf\u{e9}/*.md")],
+            &[
+                "dr\u{e1}ft.md".to_string(),
+                "r\u{e9}sum\u{e9}.txt".to_string(),
+            ],
+        )
+        .expect("expand composed pattern");
+        assert_eq!(expanded.len(), 1, "{expanded:?}");
+        assert!(expanded[0].ends_with("menu.md"));
+
+        let expanded = expand_glob_patterns_with_base(
+            base,
+            &[PathBuf::from("**/*")],
+            &["r\u{e9}sum\u{e9}.txt".to_string()],
+        )
+        .expect("expand with composed exclude");
+        assert!(
+            !expanded
+                .iter()
+                .any(|p| p.ends_with("re\u{301}sume\u{301}.txt"))
+        );
+        assert!(expanded.iter().any(|p| p.ends_with("menu.md")));
+    }
 }
@@ -0,0 +1,526 @@
+//! Query limits for daemon clients, so one misbehaving agent can't starve an
+//! index the team shares. Configured as `[limits]` in config.toml, or with
+//! `--rate-limit` and `--daily-quota`:
+//!
+//! ```toml
+//! [limits]
+//! rate_per_minute = 60
+//! daily_queries = 5000
+//!
+//! [[limits.keys]]
+//! name = "ci-agent"
+//! key = "4f1c..."
+//! daily_queries = 500
+//! ```
+//!
+//! Each client gets a token bucket holding `burst` queries (a minute's worth
+//! by default), refilled at `rate_per_minute`, and a daily allowance. Once
+//! keys are listed, clients must present one: MCP clients through the
+//! `CS_API_KEY` environment variable of the server they launch, editor
+//! clients as `api_key` in `initialize`. Without keys they share one
+//! allowance.
+//!
+//! Daily counts are kept in `.cs/quota_usage.json`, so they hold across the
+//! separate `cs --serve` processes agents start against the same index. Each
+//! count is read and written under a lock on `.cs/quota_usage.json.lock`, so
+//! two processes can't both take a client's last query. A tenant's counts
+//! are kept the same way in its own repository's index, so they stay with
+//! its data rather than the daemon's workspace.
+//!
+//! Keys are compared through an HMAC under a key made at startup, so how
+//! long a comparison takes says nothing about how much of a guess was right.
+
+use cs_core::LimitsConfig;
+use ring::hmac;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{LazyLock, Mutex};
+use std::time::{Duration, Instant};
+
+pub const USAGE_FILE: &str = "quota_usage.json";
+
+/// The client name shared by everyone when no keys are configured.
+const ANONYMOUS: &str = "anonymous";
+
+static LIMITER: LazyLock<Mutex<Option<Limiter>>> = LazyLock::new(Default::default);
+
+static KEY_MAC: LazyLock<hmac::Key> = LazyLock::new(|| {
+    let rng = ring::rand::SystemRandom::new();
+    hmac::Key::generate(hmac::HMAC_SHA256, &rng).expect("Failed to generate a key")
+});
+
+/// Whether `presented` is the API key `expected`, in time that doesn't
+/// depend on where they differ.
+pub fn key_matches(expected: &str, presented: &str) -> bool {
+    let tag = hmac::sign(&KEY_MAC, expected.as_bytes());
+    hmac::verify(&KEY_MAC, presented.as_bytes(), tag.as_ref()).is_ok()
+}
+
+/// Why a query was refused.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Denied {
+    pub message: String,
+    /// When trying again may succeed; `None` if it won't without a valid key
+    pub retry_after: Option<Duration>,
+}
+
+impl std::fmt::Display for Denied {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+/// Limit queries from now on, counting daily use in the index at
+/// `repo_root`, or for the clients in `tenant_roots`, in the index of the
+/// repository named there. Limits without any rate, quota or key do nothing.
+/// When a daemon's limits change, clients keep what they've used of their
+/// allowances.
+pub fn configure(limits: LimitsConfig, repo_root: &Path, tenant_roots: HashMap<String, PathBuf>) {
+    let tenant_usage_files = tenant_roots
+        .into_iter()
+        .map(|(client, root)| {
+            (
+                client,
+                cs_core::locations::index_dir(&root).join(USAGE_FILE),
+            )
+        })
+        .collect();
+    let mut limiter = LIMITER.lock().unwrap_or_else(|e| e.into_inner());
+    match limiter.as_mut() {
+        Some(current) if limits_anything(&limits) => {
+            current.reconfigure(limits);
+            current.tenant_usage_files = tenant_usage_files;
+        }
+        _ => *limiter = new_limiter(limits, repo_root, tenant_usage_files),
+    }
+}
+
+fn limits_anything(limits: &LimitsConfig) -> bool {
+    limits.rate_per_minute.is_some() || limits.daily_queries.is_some() || !limits.keys.is_empty()
+}
+
+fn new_limiter(
+    limits: LimitsConfig,
+    repo_root: &Path,
+    tenant_usage_files: HashMap<String, PathBuf>,
+) -> Option<Limiter> {
+    limits_anything(&limits).then(|| Limiter {
+        limits,
+        buckets: HashMap::new(),
+        usage_file: Some(cs_core::locations::index_dir(repo_root).join(USAGE_FILE)),
+        tenant_usage_files,
+        usage: Usage::default(),
+    })
+}
+
+/// Count a query from the client holding `api_key` against its limits.
+pub fn admit(api_key: Option<&str>) -> Result<(), Denied> {
+    match LIMITER.lock().unwrap_or_else(|e| e.into_inner()).as_mut() {
+        Some(limiter) => limiter.admit(
+            api_key,
+            Instant::now(),
+            &chrono::Local::now().format("%Y-%m-%d").to_string(),
+        ),
+        None => Ok(()),
+    }
+}
+
+/// The name of the key `api_key` is, when keys are configured.
+pub fn key_name(api_key: Option<&str>) -> Option<String> {
+    let limiter = LIMITER.lock().unwrap_or_else(|e| e.into_inner());
+    let api_key = api_key?;
+    limiter
+        .as_ref()?
+        .limits
+        .keys
+        .iter()
+        .find(|key| key_matches(&key.key, api_key))
+        .map(|key| key.name.clone())
+}
+
+struct TokenBucket {
+    tokens: f64,
+    capacity: f64,
+    per_second: f64,
+    refilled: Instant,
+}
+
+impl TokenBucket {
+    fn new(per_minute: f64, burst: Option<u32>, now: Instant) -> Self {
+        let capacity = burst.map_or(per_minute.ceil(), f64::from).max(1.0);
+        Self {
+            tokens: capacity,
+            capacity,
+            per_second: per_minute / 60.0,
+            refilled: now,
+        }
+    }
+
+    /// Take a token, or say how long until one is available.
+    fn take(&mut self, now: Instant) -> Result<(), Duration> {
+        let elapsed = now.saturating_duration_since(self.refilled).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * self.per_second).min(self.capacity);
+        self.refilled = now;
+        if self.tokens >= 1.0 {
+            self.tokens -= 1.0;
+            return Ok(());
+        }
+        if self.per_second <= 0.0 {
+            return Err(Duration::MAX);
+        }
+        Err(Duration::from_secs_f64(
+            (1.0 - self.tokens) / self.per_second,
+        ))
+    }
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct Usage {
+    /// Local date the counts are for
+    date: String,
+    queries: HashMap<String, u64>,
+}
+
+struct Limiter {
+    limits: LimitsConfig,
+    buckets: HashMap<String, TokenBucket>,
+    /// Where daily counts are shared with other processes
+    usage_file: Option<PathBuf>,
+    /// Where the counts of tenants are, in their own indexes, by client
+    tenant_usage_files: HashMap<String, PathBuf>,
+    usage: Usage,
+}
+
+impl Limiter {
+    /// Switch to `limits`. Each client's bucket keeps the tokens it holds,
+    /// up to its new burst, and refills at its new rate; daily counts are
+    /// kept in the usage file regardless.
+    fn reconfigure(&mut self, limits: LimitsConfig) {
+        self.limits = limits;
+        let buckets = std::mem::take(&mut self.buckets);
+        for (client, old) in buckets {
+            let Some(rate) = self.rate_of(&client) else {
+                continue;
+            };
+            let mut bucket = TokenBucket::new(rate, self.limits.burst, old.refilled);
+            bucket.tokens = old.tokens.min(bucket.capacity);
+            self.buckets.insert(client, bucket);
+        }
+    }
+
+    /// The rate of the client named `client`, if it still has one.
+    fn rate_of(&self, client: &str) -> Option<f64> {
+        if self.limits.keys.is_empty() {
+            return (client == ANONYMOUS)
+                .then_some(self.limits.rate_per_minute)
+                .flatten();
+        }
+        let key = self.limits.keys.iter().find(|key| key.name == client)?;
+        key.rate_per_minute.or(self.limits.rate_per_minute)
+    }
+
+    fn admit(&mut self, api_key: Option<&str>, now: Instant, today: &str) -> Result<(), Denied> {
+        let (client, rate, daily) = if self.limits.keys.is_empty() {
+            (
+                ANONYMOUS.to_string(),
+                self.limits.rate_per_minute,
+                self.limits.daily_queries,
+            )
+        } else {
+            let Some(key) = api_key.and_then(|api_key| {
+                self.limits
+                    .keys
+                    .iter()
+                    .find(|key| key_matches(&key.key, api_key))
+            }) else {
+                return Err(Denied {
+                    message:
+                        "Missing or unknown API key; set CS_API_KEY or pass api_key to initialize"
+                            .to_string(),
+                    retry_after: None,
+                });
+            };
+            (
+                key.name.clone(),
+                key.rate_per_minute.or(self.limits.rate_per_minute),
+                key.daily_queries.or(self.limits.daily_queries),
+            )
+        };
+
+        if let Some(rate) = rate {
+            let burst = self.limits.burst;
+            let bucket = self
+                .buckets
+                .entry(client.clone())
+                .or_insert_with(|| TokenBucket::new(rate, burst, now));
+            if let Err(wait) = bucket.take(now) {
+                return Err(Denied {
+                    message: format!(
+                        "Rate limit of {} queries per minute reached for {}; retry in {:.1}s",
+                        rate,
+                        client,
+                        wait.as_secs_f64()
+                    ),
+                    retry_after: Some(wait),
+                });
+            }
+        }
+
+        if let Some(daily) = daily {
+            let usage_file = self
+                .tenant_usage_files
+                .get(&client)
+                .or(self.usage_file.as_ref())
+                .cloned();
+            // Released when the count is saved, or the query denied
+            let _lock = usage_file.as_deref().and_then(lock_usage);
+            if let Some(file) = &usage_file {
+                self.usage = load_usage(file);
+            }
+            if self.usage.date != today {
+                self.usage = Usage {
+                    date: today.to_string(),
+                    queries: HashMap::new(),
+                };
+            }
+            let used = self.usage.queries.entry(client.clone()).or_default();
+            if *used >= daily {
+                return Err(Denied {
+                    message: format!(
+                        "Daily quota of {} queries used up for {}; it resets at midnight",
+                        daily, client
+                    ),
+                    retry_after: Some(until_midnight()),
+                });
+            }
+            *used += 1;
+            if let Some(file) = &usage_file
+                && let Err(e) = save_usage(file, &self.usage)
+            {
+                tracing::warn!("Failed to record query quota use: {}", e);
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Take the lock held while the usage file at `path` is read and written, if
+/// there is an index to keep it in.
+fn lock_usage(path: &Path) -> Option<fs::File> {
+    let dir = path.parent().filter(|dir| dir.is_dir())?;
+    let lock = fs::OpenOptions::new()
+        .create(true)
+        .truncate(false)
+        .write(true)
+        .open(dir.join(format!("{}.lock", USAGE_FILE)))
+        .and_then(|file| file.lock().map(|()| file));
+    match lock {
+        Ok(file) => Some(file),
+        Err(e) => {
+            tracing::warn!("Failed to lock query quota use: {}", e);
+            None
+        }
+    }
+}
+
+fn load_usage(path: &Path) -> Usage {
+    fs::read(path)
+        .ok()
+        .and_then(|data| serde_json::from_slice(&data).ok())
+        .unwrap_or_default()
+}
+
+fn save_usage(path: &Path, usage: &Usage) -> anyhow::Result<()> {
+    let Some(dir) = path.parent().filter(|dir| dir.is_dir()) else {
+        // No index yet, so nothing to share counts through
+        return Ok(());
+    };
+    let temp = dir.join(format!("{}.{}.tmp", USAGE_FILE, std::process::id()));
+    fs::write(&temp, serde_json::to_vec(usage)?)?;
+    fs::rename(&temp, path)?;
+    Ok(())
+}
+
+fn until_midnight() -> Duration {
+    let now = chrono::Local::now();
+    now.date_naive()
+        .succ_opt()
+        .and_then(|tomorrow| tomorrow.and_hms_opt(0, 0, 0))
+        .and_then(|midnight| (midnight - now.naive_local()).to_std().ok())
+        .unwrap_or_default()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::ApiKey;
+
+    fn limiter(limits: LimitsConfig) -> Limiter {
+        Limiter {
+            limits,
+            buckets: HashMap::new(),
+            usage_file: None,
+            tenant_usage_files: HashMap::new(),
+            usage: Usage::default(),
+        }
+    }
+
+    #[test]
+    fn buckets_refill_at_the_configured_rate() {
+        let mut limiter = limiter(LimitsConfig {
+            rate_per_minute: Some(60.0),
+            burst: Some(2),
+            ..LimitsConfig::default()
+        });
+        let start = Instant::now();
+        assert!(limiter.admit(None, start, "2026-01-10").is_ok());
+        assert!(limiter.admit(None, start, "2026-01-10").is_ok());
+        let denied = limiter.admit(None, start, "2026-01-10").unwrap_err();
+        assert_eq!(denied.retry_after, Some(Duration::from_secs(1)));
+        assert!(
+            limiter
+                .admit(None, start + Duration::from_secs(1), "2026-01-10")
+                .is_ok()
+        );
+    }
+
+    #[test]
+    fn a_reload_keeps_what_clients_have_used() {
+        let mut limiter = limiter(LimitsConfig {
+            rate_per_minute: Some(60.0),
+            burst: Some(2),
+            ..LimitsConfig::default()
+        });
+        let start = Instant::now();
+        assert!(limiter.admit(None, start, "2026-01-10").is_ok());
+        assert!(limiter.admit(None, start, "2026-01-10").is_ok());
+
+        // A bigger burst isn't a fresh one, and the new rate applies
+        limiter.reconfigure(LimitsConfig {
+            rate_per_minute: Some(6.0),
+            burst: Some(10),
+            ..LimitsConfig::default()
+        });
+        let denied = limiter.admit(None, start, "2026-01-10").unwrap_err();
+        assert_eq!(denied.retry_after, Some(Duration::from_secs(10)));
+
+        // Clients whose key is gone lose their bucket with it
+        limiter.reconfigure(LimitsConfig {
+            keys: vec![ApiKey {
+                name: "ci-agent".to_string(),
+                key: "k1".to_string(),
+                rate_per_minute: None,
+                daily_queries: None,
+            }],
+            ..LimitsConfig::default()
+        });
+        assert!(limiter.buckets.is_empty());
+        assert!(limiter.admit(None, start, "2026-01-10").is_err());
+    }
+
+    #[test]
+    fn keys_carry_their_own_daily_quota() {
+        let mut limiter = limiter(LimitsConfig {
+            daily_queries: Some(100),
+            keys: vec![ApiKey {
+                name: "ci-agent".to_string(),
+                key: "secret".to_string(),
+                rate_per_minute: None,
+                daily_queries: Some(2),
+            }],
+            ..LimitsConfig::default()
+        });
+        let now = Instant::now();
+        assert!(limiter.admit(None, now, "2026-01-10").is_err());
+        assert!(limiter.admit(Some("guess"), now, "2026-01-10").is_err());
+        assert!(limiter.admit(Some("secret"), now, "2026-01-10").is_ok());
+        assert!(limiter.admit(Some("secret"), now, "2026-01-10").is_ok());
+        let denied = limiter
+            .admit(Some("secret"), now, "2026-01-10")
+            .unwrap_err();
+        assert!(denied.message.contains("ci-agent"));
+        // A new day, a new allowance
+        assert!(limiter.admit(Some("secret"), now, "2026-01-11").is_ok());
+    }
+
+    #[test]
+    fn processes_sharing_counts_never_overspend() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let usage_file = temp_dir.path().join(USAGE_FILE);
+        let limits = LimitsConfig {
+            daily_queries: Some(30),
+            ..LimitsConfig::default()
+        };
+
+        // Separate limiters stand in for separate server processes
+        let admitted: usize = std::thread::scope(|scope| {
+            let servers: Vec<_> = (0..4)
+                .map(|_| {
+                    let mut limiter = Limiter {
+                        usage_file: Some(usage_file.clone()),
+                        ..limiter(limits.clone())
+                    };
+                    scope.spawn(move || {
+                        (0..20)
+                            .filter(|_| limiter.admit(None, Instant::now(), "2026-01-10").is_ok())
+                            .count()
+                    })
+                })
+                .collect();
+            servers
+                .into_iter()
+                .map(|server| server.join().unwrap())
+                .sum()
+        });
+        assert_eq!(admitted, 30);
+        assert_eq!(load_usage(&usage_file).queries[ANONYMOUS], 30);
+    }
+
+    #[test]
+    fn tenants_count_in_their_own_index() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let workspace = temp_dir.path().join("workspace");
+        let payments = temp_dir.path().join("payments");
+        fs::create_dir_all(&workspace).unwrap();
+        fs::create_dir_all(&payments).unwrap();
+        let key = |name: &str, key: &str| ApiKey {
+            name: name.to_string(),
+            key: key.to_string(),
+            rate_per_minute: None,
+            daily_queries: Some(5),
+        };
+        let mut limiter = Limiter {
+            usage_file: Some(workspace.join(USAGE_FILE)),
+            tenant_usage_files: HashMap::from([(
+                "payments".to_string(),
+                payments.join(USAGE_FILE),
+            )]),
+            ..limiter(LimitsConfig {
+                keys: vec![key("ci-agent", "k1"), key("payments", "k2")],
+                ..LimitsConfig::default()
+            })
+        };
+        let now = Instant::now();
+        assert!(limiter.admit(Some("k1"), now, "2026-01-10").is_ok());
+        assert!(limiter.admit(Some("k2"), now, "2026-01-10").is_ok());
+        assert!(limiter.admit(Some("k2"), now, "2026-01-10").is_ok());
+
+        let workspace_usage = load_usage(&workspace.join(USAGE_FILE));
+        assert_eq!(workspace_usage.queries["ci-agent"], 1);
+        assert!(!workspace_usage.queries.contains_key("payments"));
+        assert_eq!(
+            load_usage(&payments.join(USAGE_FILE)).queries["payments"],
+            2
+        );
+    }
+
+    #[test]
+    fn keys_match_only_themselves() {
+        assert!(key_matches("4f1c9e", "4f1c9e"));
+        assert!(!key_matches("4f1c9e", "4f1c9"));
+        assert!(!key_matches("4f1c9e", "4f1c9f"));
+        assert!(!key_matches("4f1c9e", ""));
+    }
+}
@@ -0,0 +1,114 @@
+//! Configuration a running daemon re-reads on `SIGHUP` (`systemctl reload`,
+//! or `kill -HUP`), so tuning `[[boost]]` rules or `[limits]` doesn't mean
+//! restarting `cs --serve` and loading its index and model again.
+//!
+//! Searches take a snapshot of the [`Settings`] as they start: a search in
+//! flight during a reload finishes with the settings it began with, and the
+//! next one uses the new ones. A config that fails to load or check is
+//! reported and leaves the running configuration as it was.
+//!
+//! `.csignore` and `.gitignore` need no reload; they are read by every
+//! search.
+
+use anyhow::Result;
+use cs_core::{BoostRule, StopSymbolRule};
+use std::sync::{Arc, LazyLock, RwLock};
+use tokio::task::JoinHandle;
+
+/// The search settings a daemon takes from the user config.
+#[derive(Debug, Clone)]
+pub struct Settings {
+    pub boost_rules: Vec<BoostRule>,
+    pub stop_symbol_rules: Vec<StopSymbolRule>,
+    pub max_typos: u8,
+    /// Minimum score of semantic results when a request sets none
+    pub threshold: f32,
+    /// Minimum fused score of hybrid results when a request sets none
+    pub hybrid_threshold: f32,
+    pub fusion: cs_core::FusionConfig,
+    pub snippets: cs_core::SnippetDefaults,
+}
+
+impl Default for Settings {
+    fn default() -> Self {
+        Self {
+            boost_rules: Vec::new(),
+            stop_symbol_rules: Vec::new(),
+            max_typos: cs_core::DEFAULT_MAX_TYPOS,
+            threshold: 0.6,
+            hybrid_threshold: 0.02,
+            fusion: cs_core::FusionConfig::default(),
+            snippets: cs_core::SnippetDefaults::default(),
+        }
+    }
+}
+
+impl Settings {
+    pub fn from_config(config: &cs_models::UserConfig) -> Self {
+        Self {
+            boost_rules: config.boost.clone(),
+            stop_symbol_rules: config.stop_symbol.clone(),
+            max_typos: config.max_typos,
+            threshold: config.default_threshold,
+            hybrid_threshold: config.default_hybrid_threshold,
+            fusion: config.fusion.clone().unwrap_or_default(),
+            snippets: config.snippets.clone().unwrap_or_default(),
+        }
+    }
+}
+
+static SETTINGS: LazyLock<RwLock<Arc<Settings>>> = LazyLock::new(Default::default);
+
+/// The settings for a search starting now.
+pub fn settings() -> Arc<Settings> {
+    SETTINGS.read().unwrap_or_else(|e| e.into_inner()).clone()
+}
+
+/// Use `settings` for searches from now on.
+pub fn set(settings: Settings) {
+    *SETTINGS.write().unwrap_or_else(|e| e.into_inner()) = Arc::new(settings);
+}
+
+/// Run `reload` on every `SIGHUP` until the process exits, logging what it
+/// reports.
+#[cfg(unix)]
+pub fn on_hangup<F>(reload: F) -> Result<Option<JoinHandle<()>>>
+where
+    F: Fn() -> Result<String> + Send + 'static,
+{
+    use tokio::signal::unix::{SignalKind, signal};
+
+    let mut hangups = signal(SignalKind::hangup())?;
+    Ok(Some(tokio::spawn(async move {
+        while hangups.recv().await.is_some() {
+            match reload() {
+                Ok(summary) => tracing::info!("Reloaded configuration: {}", summary),
+                Err(e) => tracing::warn!("Keeping the current configuration: {}", e),
+            }
+        }
+    })))
+}
+
+#[cfg(not(unix))]
+pub fn on_hangup<F>(_reload: F) -> Result<Option<JoinHandle<()>>>
+where
+    F: Fn() -> Result<String> + Send + 'static,
+{
+    Ok(None)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn settings_come_from_the_config() {
+        let config: cs_models::UserConfig =
+            toml::from_str("max_typos = 2\n\n[[boost]]\npath = \"src/core/**\"\nfactor = 1.5\n")
+                .unwrap();
+        let settings = Settings::from_config(&config);
+        assert_eq!(settings.boost_rules.len(), 1);
+        assert_eq!(settings.max_typos, 2);
+        assert!(settings.stop_symbol_rules.is_empty());
+    }
+}
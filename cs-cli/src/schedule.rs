@@ -0,0 +1,354 @@
+//! Index upkeep on a schedule for the long-running `cs --serve` and editor
+//! RPC daemons, so deployments keep their index healthy without an external
+//! scheduler. Rules come from `[[schedule]]` in config.toml and
+//! `--schedule TASK=CRON`:
+//!
+//! ```toml
+//! [[schedule]]
+//! cron = "0 3 * * *"    # nightly
+//! task = "revalidate"
+//!
+//! [[schedule]]
+//! cron = "30 4 * * sun" # weekly
+//! task = "compact"
+//! ```
+//!
+//! Expressions have the usual five fields (minute, hour, day of month, month
+//! and day of week) in local time, each `*`, a number, a name (`jan`, `mon`),
+//! a range or a list, optionally with a `/` step; or `@hourly`, `@daily`,
+//! `@weekly` or `@monthly`.
+
+use anyhow::{Result, bail};
+use chrono::{DateTime, Datelike, Duration, Local, NaiveDateTime, TimeZone, Timelike};
+use cs_core::{MaintenanceTask, ScheduleRule};
+use std::path::{Path, PathBuf};
+use tokio::task::JoinHandle;
+
+/// Longest the scheduler sleeps before checking the clock again, so a
+/// suspended machine or a clock change doesn't delay a run for long.
+const MAX_SLEEP: std::time::Duration = std::time::Duration::from_secs(60);
+
+/// Minutes searched for the next match; enough for any valid expression,
+/// `0 0 29 2 *` included.
+const SEARCH_MINUTES: usize = 8 * 366 * 24 * 60;
+
+const MONTHS: [&str; 12] = [
+    "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec",
+];
+const WEEKDAYS: [&str; 7] = ["sun", "mon", "tue", "wed", "thu", "fri", "sat"];
+
+/// A parsed cron expression: one bit per allowed value of each field.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Cron {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    /// Sunday is bit 0
+    weekdays: u64,
+    /// Day of month and day of week both restricted: either may match
+    either_day: bool,
+}
+
+impl Cron {
+    pub fn parse(expression: &str) -> Result<Self> {
+        let expression = match expression.trim() {
+            "@hourly" => "0 * * * *",
+            "@daily" | "@midnight" => "0 0 * * *",
+            "@weekly" => "0 0 * * 0",
+            "@monthly" => "0 0 1 * *",
+            other => other,
+        };
+        let fields: Vec<&str> = expression.split_whitespace().collect();
+        let [minute, hour, day, month, weekday] = fields.as_slice() else {
+            bail!(
+                "Cron expression '{}' needs five fields: minute hour day month weekday",
+                expression
+            );
+        };
+        let weekdays = parse_field(weekday, 0, 7, &WEEKDAYS)?;
+        Ok(Self {
+            minutes: parse_field(minute, 0, 59, &[])?,
+            hours: parse_field(hour, 0, 23, &[])?,
+            days: parse_field(day, 1, 31, &[])?,
+            months: parse_field(month, 1, 12, &MONTHS)?,
+            // 7 is Sunday too
+            weekdays: (weekdays | (weekdays >> 7)) & 0x7f,
+            either_day: !day.starts_with('*') && !weekday.starts_with('*'),
+        })
+    }
+
+    fn matches(&self, time: &NaiveDateTime) -> bool {
+        let bit = |mask: u64, value: u32| mask & (1 << value) != 0;
+        let day = bit(self.days, time.day());
+        let weekday = bit(self.weekdays, time.weekday().num_days_from_sunday());
+        let day_matches = if self.either_day {
+            day || weekday
+        } else {
+            day && weekday
+        };
+        bit(self.minutes, time.minute())
+            && bit(self.hours, time.hour())
+            && bit(self.months, time.month())
+            && day_matches
+    }
+
+    /// The first minute after `after` the expression matches.
+    pub fn next_after(&self, after: DateTime<Local>) -> Option<DateTime<Local>> {
+        let mut time =
+            after.naive_local().with_second(0)?.with_nanosecond(0)? + Duration::minutes(1);
+        for _ in 0..SEARCH_MINUTES {
+            if self.matches(&time) {
+                // Times skipped by a daylight saving change never happen
+                if let Some(local) = Local.from_local_datetime(&time).earliest() {
+                    return Some(local);
+                }
+            }
+            time += Duration::minutes(1);
+        }
+        None
+    }
+}
+
+/// The bits of `min..=max` a field allows.
+fn parse_field(field: &str, min: u32, max: u32, names: &[&str]) -> Result<u64> {
+    let value = |text: &str| -> Result<u32> {
+        let lower = text.to_ascii_lowercase();
+        // Names count from the field's first value (jan = 1, sun = 0)
+        if let Some(index) = names.iter().position(|name| *name == lower) {
+            return Ok(min + index as u32);
+        }
+        match text.parse::<u32>() {
+            Ok(value) if (min..=max).contains(&value) => Ok(value),
+            _ => bail!(
+                "'{}' in cron field '{}' isn't between {} and {}",
+                text,
+                field,
+                min,
+                max
+            ),
+        }
+    };
+
+    let mut mask = 0u64;
+    for part in field.split(',') {
+        let (range, step) = match part.split_once('/') {
+            Some((range, step)) => match step.parse::<u32>() {
+                Ok(step) if step > 0 => (range, Some(step)),
+                _ => bail!("Invalid step '{}' in cron field '{}'", step, field),
+            },
+            None => (part, None),
+        };
+        let (start, end) = match range.split_once('-') {
+            _ if range == "*" => (min, max),
+            Some((start, end)) => (value(start)?, value(end)?),
+            // `5/15` runs from 5 to the end
+            None if step.is_some() => (value(range)?, max),
+            None => {
+                let value = value(range)?;
+                (value, value)
+            }
+        };
+        if start > end {
+            bail!("Range '{}' in cron field '{}' runs backwards", range, field);
+        }
+        for value in (start..=end).step_by(step.unwrap_or(1) as usize) {
+            mask |= 1 << value;
+        }
+    }
+    Ok(mask)
+}
+
+/// A `--schedule TASK=CRON` rule, like `revalidate=0 3 * * *`.
+pub fn parse_rule(text: &str) -> Result<ScheduleRule> {
+    let Some((task, cron)) = text.split_once('=') else {
+        bail!(
+            "Expected --schedule TASK=CRON, like 'revalidate=0 3 * * *', got '{}'",
+            text
+        );
+    };
+    let task: MaintenanceTask = task.parse().map_err(anyhow::Error::msg)?;
+    Cron::parse(cron)?;
+    Ok(ScheduleRule {
+        cron: cron.trim().to_string(),
+        task,
+    })
+}
+
+/// Run `rules` against the index at `root` until the daemon exits. Returns
+/// `None` when there are no rules.
+pub fn spawn(root: PathBuf, rules: Vec<ScheduleRule>) -> Result<Option<JoinHandle<()>>> {
+    if rules.is_empty() {
+        return Ok(None);
+    }
+    let schedule: Vec<(Cron, MaintenanceTask)> = rules
+        .iter()
+        .map(|rule| Ok((Cron::parse(&rule.cron)?, rule.task)))
+        .collect::<Result<_>>()?;
+    for rule in &rules {
+        tracing::info!("Scheduled {:?} at '{}'", rule.task, rule.cron);
+    }
+
+    Ok(Some(tokio::spawn(async move {
+        loop {
+            let now = Local::now();
+            let Some(when) = schedule
+                .iter()
+                .filter_map(|(cron, _)| cron.next_after(now))
+                .min()
+            else {
+                return;
+            };
+            loop {
+                let left = (when - Local::now()).to_std().unwrap_or_default();
+                if left.is_zero() {
+                    break;
+                }
+                tokio::time::sleep(left.min(MAX_SLEEP)).await;
+            }
+
+            let mut due: Vec<MaintenanceTask> = Vec::new();
+            for (cron, task) in &schedule {
+                if cron.next_after(now) == Some(when) && !due.contains(task) {
+                    due.push(*task);
+                }
+            }
+            for task in due {
+                if let Err(e) = run_task(&root, task).await {
+                    tracing::warn!("Scheduled {:?} of {} failed: {}", task, root.display(), e);
+                }
+            }
+        }
+    })))
+}
+
+async fn run_task(root: &Path, task: MaintenanceTask) -> Result<()> {
+    let root = cs_index::find_repo_root(root)?;
+    if cs_index::load_manifest(&root)?.is_none() {
+        tracing::info!(
+            "Skipping scheduled {:?}: {} has no index",
+            task,
+            root.display()
+        );
+        return Ok(());
+    }
+    match task {
+        MaintenanceTask::Update => {
+            let stats = cs_index::smart_update_index(&root, true, true, &[]).await?;
+            tracing::info!(
+                "Scheduled update: {} files re-indexed, {} up to date",
+                stats.files_indexed,
+                stats.files_up_to_date
+            );
+        }
+        MaintenanceTask::Revalidate => {
+            let consistency = cs_index::check_index_consistency(&root)?;
+            let cleanup = cs_index::cleanup_index(&root, true, &[])?;
+            let stats = cs_index::smart_update_index(&root, true, true, &[]).await?;
+            tracing::info!(
+                "Scheduled revalidation: {} missing files and {} broken entries found, {} entries dropped, {} files re-indexed",
+                consistency.missing_files,
+                consistency.broken_entries,
+                cleanup.orphaned_entries_removed,
+                stats.files_indexed
+            );
+        }
+        MaintenanceTask::Compact => {
+            let cleanup = cs_index::cleanup_index(&root, true, &[])?;
+            let leftovers = remove_leftover_temp_files(&cs_core::locations::index_dir(&root));
+            tracing::info!(
+                "Scheduled compaction: {} orphaned sidecars and {} leftover temporary files removed",
+                cleanup.orphaned_sidecars_removed,
+                leftovers
+            );
+        }
+    }
+    Ok(())
+}
+
+/// Delete `*.tmp` files in `index_dir` older than an hour, left behind by
+/// writes that were interrupted midway.
+fn remove_leftover_temp_files(index_dir: &Path) -> usize {
+    let cutoff = std::time::SystemTime::now() - std::time::Duration::from_secs(3600);
+    walkdir::WalkDir::new(index_dir)
+        .into_iter()
+        .flatten()
+        .filter(|entry| {
+            entry.file_type().is_file()
+                && entry.path().extension().is_some_and(|ext| ext == "tmp")
+                && entry
+                    .metadata()
+                    .ok()
+                    .and_then(|metadata| metadata.modified().ok())
+                    .is_some_and(|modified| modified < cutoff)
+        })
+        .filter(|entry| std::fs::remove_file(entry.path()).is_ok())
+        .count()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn at(text: &str) -> DateTime<Local> {
+        let naive = NaiveDateTime::parse_from_str(text, "%Y-%m-%d %H:%M").unwrap();
+        Local.from_local_datetime(&naive).earliest().unwrap()
+    }
+
+    fn next(expression: &str, after: &str) -> String {
+        Cron::parse(expression)
+            .unwrap()
+            .next_after(at(after))
+            .unwrap()
+            .format("%Y-%m-%d %H:%M %a")
+            .to_string()
+    }
+
+    #[test]
+    fn cron_expressions_find_the_next_run() {
+        assert_eq!(
+            next("0 3 * * *", "2026-01-10 02:59"),
+            "2026-01-10 03:00 Sat"
+        );
+        assert_eq!(
+            next("0 3 * * *", "2026-01-10 03:00"),
+            "2026-01-11 03:00 Sun"
+        );
+        assert_eq!(
+            next("30 4 * * sun", "2026-01-10 12:00"),
+            "2026-01-11 04:30 Sun"
+        );
+        assert_eq!(
+            next("*/15 9-17 * * 1-5", "2026-01-09 17:50"),
+            "2026-01-12 09:00 Mon"
+        );
+        assert_eq!(next("@monthly", "2026-01-31 23:00"), "2026-02-01 00:00 Sun");
+        assert_eq!(
+            next("0 0 29 feb *", "2026-03-01 00:00"),
+            "2028-02-29 00:00 Tue"
+        );
+        // Either the 1st or a Monday when both are restricted
+        assert_eq!(
+            next("0 0 1 * mon", "2026-01-02 00:00"),
+            "2026-01-05 00:00 Mon"
+        );
+        assert_eq!(
+            next("0 0 * * 7", "2026-01-10 00:00"),
+            "2026-01-11 00:00 Sun"
+        );
+    }
+
+    #[test]
+    fn invalid_schedules_are_rejected() {
+        assert!(Cron::parse("0 3 * *").is_err());
+        assert!(Cron::parse("60 * * * *").is_err());
+        assert!(Cron::parse("0 5-3 * * *").is_err());
+        assert!(Cron::parse("*/0 * * * *").is_err());
+
+        let rule = parse_rule("compact=0 4 * * 0").unwrap();
+        assert_eq!(rule.task, MaintenanceTask::Compact);
+        assert_eq!(rule.cron, "0 4 * * 0");
+        assert!(parse_rule("vacuum=0 4 * * 0").is_err());
+        assert!(parse_rule("0 4 * * 0").is_err());
+    }
+}
@@ -0,0 +1,135 @@
+//! Logging, plus OpenTelemetry export of the index and query pipelines when
+//! cs is built with the `otel` feature.
+//!
+//! With `--otlp-endpoint URL`, or the standard `OTEL_EXPORTER_OTLP_ENDPOINT`,
+//! spans go to an OTLP/HTTP collector. A semantic query is `search`, then
+//! `semantic_search` holding `embed_query`, `retrieve`, `score` and `rerank`;
+//! indexing is `index_directory` or `index_update`, with an `index_file`
+//! (`read`, `chunk` and its tree-sitter `parse`, `embed`) and a `store` per
+//! file. MCP tool calls and editor searches get a span of their own above
+//! these.
+//! `OTEL_SERVICE_NAME` overrides the `cs` service name.
+
+use anyhow::Result;
+use tracing::Level;
+use tracing_subscriber::fmt::MakeWriter;
+use tracing_subscriber::prelude::*;
+
+/// Flushes spans still buffered for export when dropped.
+pub struct Telemetry {
+    #[cfg(feature = "otel")]
+    provider: Option<opentelemetry_sdk::trace::TracerProvider>,
+}
+
+impl Drop for Telemetry {
+    fn drop(&mut self) {
+        #[cfg(feature = "otel")]
+        if let Some(provider) = self.provider.take()
+            && let Err(e) = provider.shutdown()
+        {
+            eprintln!("Failed to export traces: {}", e);
+        }
+    }
+}
+
+/// Install the process's subscriber: logs at `default_level` (or `RUST_LOG`)
+/// to `writer`, and spans to `otlp_endpoint` or `OTEL_EXPORTER_OTLP_ENDPOINT`
+/// if either is set.
+pub fn init<W>(writer: W, default_level: Level, otlp_endpoint: Option<&str>) -> Result<Telemetry>
+where
+    W: for<'w> MakeWriter<'w> + Send + Sync + 'static,
+{
+    let logs = tracing_subscriber::fmt::layer()
+        .with_writer(writer)
+        .with_filter(
+            tracing_subscriber::EnvFilter::from_default_env().add_directive(default_level.into()),
+        );
+
+    #[cfg(feature = "otel")]
+    {
+        let (provider, spans) = if otlp_endpoint.is_some()
+            || std::env::var_os("OTEL_EXPORTER_OTLP_ENDPOINT").is_some()
+        {
+            let (provider, spans) = otlp_layer(otlp_endpoint)?;
+            (Some(provider), Some(spans))
+        } else {
+            (None, None)
+        };
+        tracing_subscriber::registry().with(spans).with(logs).init();
+        Ok(Telemetry { provider })
+    }
+
+    #[cfg(not(feature = "otel"))]
+    {
+        // The standard variable may be set for other programs, so only the flag errors
+        if otlp_endpoint.is_some() {
+            anyhow::bail!(
+                "cs was built without OpenTelemetry support. Rebuild with `cargo install cs-search --features otel`"
+            );
+        }
+        tracing_subscriber::registry().with(logs).init();
+        Ok(Telemetry {})
+    }
+}
+
+/// A layer exporting cs's own spans over OTLP/HTTP, to `endpoint` or where
+/// the `OTEL_EXPORTER_OTLP_*` variables say.
+#[cfg(feature = "otel")]
+fn otlp_layer(
+    endpoint: Option<&str>,
+) -> Result<(
+    opentelemetry_sdk::trace::TracerProvider,
+    Box<dyn tracing_subscriber::Layer<tracing_subscriber::Registry> + Send + Sync>,
+)> {
+    use opentelemetry::trace::TracerProvider as _;
+    use opentelemetry_otlp::WithExportConfig;
+
+    let mut exporter = opentelemetry_otlp::SpanExporter::builder().with_http();
+    if let Some(endpoint) = endpoint {
+        exporter = exporter.with_endpoint(traces_url(endpoint));
+    }
+    let service = std::env::var("OTEL_SERVICE_NAME").unwrap_or_else(|_| "cs".to_string());
+    let provider = opentelemetry_sdk::trace::TracerProvider::builder()
+        .with_batch_exporter(exporter.build()?, opentelemetry_sdk::runtime::Tokio)
+        .with_resource(opentelemetry_sdk::Resource::new([
+            opentelemetry::KeyValue::new("service.name", service),
+            opentelemetry::KeyValue::new("service.version", env!("CARGO_PKG_VERSION")),
+        ]))
+        .build();
+    let layer = tracing_opentelemetry::layer()
+        .with_tracer(provider.tracer("cs"))
+        .with_filter(tracing_subscriber::filter::filter_fn(|metadata| {
+            metadata.target().starts_with("cs") && *metadata.level() <= Level::INFO
+        }))
+        .boxed();
+    Ok((provider, layer))
+}
+
+/// The traces URL for a collector at `endpoint`. Like the standard variable,
+/// the flag names the collector, and `/v1/traces` is added unless given.
+#[cfg(any(feature = "otel", test))]
+fn traces_url(endpoint: &str) -> String {
+    let endpoint = endpoint.trim_end_matches('/');
+    if endpoint.ends_with("/v1/traces") {
+        endpoint.to_string()
+    } else {
+        format!("{}/v1/traces", endpoint)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn endpoints_point_at_the_traces_path() {
+        assert_eq!(
+            traces_url("http://collector:4318/"),
+            "http://collector:4318/v1/traces"
+        );
+        assert_eq!(
+            traces_url("http://collector:4318/v1/traces"),
+            "http://collector:4318/v1/traces"
+        );
+    }
+}
@@ -0,0 +1,171 @@
+//! Tenants of a shared editor daemon, so one `cs --editor-socket` can serve
+//! several teams' repositories. Configured as `[[tenant]]` in config.toml:
+//!
+//! ```toml
+//! [[tenant]]
+//! name = "payments"
+//! key = "9b2e..."
+//! root = "/srv/repos/payments"
+//! top_k = 20
+//! exclude = ["legacy/**"]
+//! daily_queries = 5000
+//! ```
+//!
+//! A client names its tenant with `api_key` in `initialize`. Its session is
+//! then rooted at the tenant's repository, searches with the tenant's
+//! defaults, and can't reach a path outside the repository. Each tenant's
+//! index is its repository's own, and its limits are counted like those of
+//! a `[[limits.keys]]` entry, with its daily count kept in that index, so
+//! tenants share nothing but the process.
+
+use anyhow::{Result, bail};
+use cs_core::TenantConfig;
+use std::collections::HashSet;
+use std::sync::{Arc, LazyLock, RwLock};
+
+static TENANTS: LazyLock<RwLock<Option<Arc<Tenants>>>> = LazyLock::new(Default::default);
+
+#[derive(Debug, Default)]
+pub struct Tenants {
+    tenants: Vec<TenantConfig>,
+}
+
+impl Tenants {
+    /// Check `tenants` can be told and kept apart: unique names and keys,
+    /// and repositories that exist and don't contain one another.
+    pub fn new(mut tenants: Vec<TenantConfig>) -> Result<Self> {
+        let mut names = HashSet::new();
+        let mut keys = HashSet::new();
+        for tenant in &mut tenants {
+            if !names.insert(tenant.name.clone()) {
+                bail!("Tenant '{}' is configured twice", tenant.name);
+            }
+            if tenant.key.is_empty() || !keys.insert(tenant.key.clone()) {
+                bail!("Tenant '{}' needs a key of its own", tenant.name);
+            }
+            if !tenant.root.is_dir() {
+                bail!(
+                    "Tenant '{}' root {} is not a directory",
+                    tenant.name,
+                    tenant.root.display()
+                );
+            }
+            tenant.root = cs_core::paths::canonicalize_lossy(&tenant.root);
+        }
+        for a in &tenants {
+            // One index root inside another would be found for both
+            if let Some(b) = tenants
+                .iter()
+                .find(|b| b.name != a.name && b.root.starts_with(&a.root))
+            {
+                bail!(
+                    "Tenant '{}' root {} is inside tenant '{}' root {}",
+                    b.name,
+                    b.root.display(),
+                    a.name,
+                    a.root.display()
+                );
+            }
+        }
+        Ok(Self { tenants })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.tenants.is_empty()
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &TenantConfig> {
+        self.tenants.iter()
+    }
+
+    /// The tenant holding `api_key`.
+    pub fn find(&self, api_key: Option<&str>) -> Option<&TenantConfig> {
+        let api_key = api_key?;
+        self.tenants
+            .iter()
+            .find(|tenant| crate::quota::key_matches(&tenant.key, api_key))
+    }
+}
+
+/// Serve `tenants` from now on; sessions already open keep the tenant they
+/// initialized with. Without any, every client searches the daemon's own
+/// workspace.
+pub fn configure(tenants: Tenants) {
+    *TENANTS.write().unwrap_or_else(|e| e.into_inner()) =
+        (!tenants.is_empty()).then(|| Arc::new(tenants));
+}
+
+/// The tenants being served, if the daemon has any.
+pub fn current() -> Option<Arc<Tenants>> {
+    TENANTS.read().unwrap_or_else(|e| e.into_inner()).clone()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use std::path::{Path, PathBuf};
+    use tempfile::TempDir;
+
+    fn tenant(name: &str, key: &str, root: &Path) -> TenantConfig {
+        TenantConfig {
+            name: name.to_string(),
+            key: key.to_string(),
+            root: root.to_path_buf(),
+            top_k: None,
+            threshold: None,
+            exclude: Vec::new(),
+            rate_per_minute: None,
+            daily_queries: None,
+        }
+    }
+
+    #[test]
+    fn tenants_are_found_by_key_and_kept_apart() {
+        let temp_dir = TempDir::new().unwrap();
+        let payments = temp_dir.path().join("payments");
+        let search = temp_dir.path().join("search");
+        fs::create_dir_all(payments.join("vendor")).unwrap();
+        fs::create_dir_all(&search).unwrap();
+
+        let tenants = Tenants::new(vec![
+            tenant("payments", "k1", &payments),
+            tenant("search", "k2", &search),
+        ])
+        .unwrap();
+        assert_eq!(tenants.find(Some("k2")).unwrap().name, "search");
+        assert!(tenants.find(Some("k3")).is_none());
+        assert!(tenants.find(None).is_none());
+
+        assert!(
+            Tenants::new(vec![
+                tenant("payments", "k1", &payments),
+                tenant("payments", "k2", &search)
+            ])
+            .is_err()
+        );
+        assert!(
+            Tenants::new(vec![
+                tenant("payments", "k1", &payments),
+                tenant("search", "k1", &search)
+            ])
+            .is_err()
+        );
+        assert!(
+            Tenants::new(vec![tenant(
+                "missing",
+                "k1",
+                &PathBuf::from("/nonexistent/repo")
+            )])
+            .is_err()
+        );
+        // A repository inside another's would share its index
+        assert!(
+            Tenants::new(vec![
+                tenant("payments", "k1", &payments),
+                tenant("vendor", "k2", &payments.join("vendor")),
+            ])
+            .is_err()
+        );
+    }
+}
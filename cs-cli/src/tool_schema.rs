@@ -0,0 +1,112 @@
+//! `--tool-schema openai|anthropic`: the MCP server's tools as function
+//! definitions for chat APIs, so a framework that calls a model directly can
+//! register cs as a tool without writing schemas by hand.
+//!
+//! The parameters are the input schemas `--serve` advertises, so arguments a
+//! model fills in can be passed to the MCP tool of the same name unchanged.
+
+use rmcp::model::Tool;
+use serde_json::{Map, Value, json};
+
+/// The chat API a manifest is shaped for.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ToolFormat {
+    /// `tools` of the Chat Completions and Responses APIs
+    OpenAi,
+    /// `tools` of the Messages API
+    Anthropic,
+}
+
+impl std::str::FromStr for ToolFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "openai" => Ok(ToolFormat::OpenAi),
+            "anthropic" => Ok(ToolFormat::Anthropic),
+            other => Err(format!(
+                "Unknown tool schema format '{}'; use openai or anthropic",
+                other
+            )),
+        }
+    }
+}
+
+/// `tools` as a JSON array of `format` tool definitions.
+pub fn manifest(tools: &[Tool], format: ToolFormat) -> Value {
+    let definitions = tools
+        .iter()
+        .map(|tool| {
+            let name = tool.name.as_ref();
+            let description = tool.description.as_deref().unwrap_or(name);
+            let parameters = parameters(&tool.input_schema);
+            match format {
+                ToolFormat::OpenAi => json!({
+                    "type": "function",
+                    "function": {
+                        "name": name,
+                        "description": description,
+                        "parameters": parameters,
+                    },
+                }),
+                ToolFormat::Anthropic => json!({
+                    "name": name,
+                    "description": description,
+                    "input_schema": parameters,
+                }),
+            }
+        })
+        .collect();
+    Value::Array(definitions)
+}
+
+/// An MCP input schema as function parameters: an object schema without
+/// the `$schema` and `title` keys chat APIs don't take.
+fn parameters(schema: &Map<String, Value>) -> Value {
+    let mut parameters = schema.clone();
+    parameters.remove("$schema");
+    parameters.remove("title");
+    parameters
+        .entry("type")
+        .or_insert_with(|| Value::String("object".to_string()));
+    parameters
+        .entry("properties")
+        .or_insert_with(|| Value::Object(Map::new()));
+    Value::Object(parameters)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::mcp_server::CcMcpServer;
+
+    #[test]
+    fn manifests_carry_the_mcp_input_schemas() {
+        let tools = CcMcpServer::tool_definitions();
+
+        let openai = manifest(&tools, ToolFormat::OpenAi);
+        let openai = openai.as_array().unwrap();
+        assert_eq!(openai.len(), tools.len());
+        let semantic = openai
+            .iter()
+            .find(|tool| tool["function"]["name"] == "semantic_search")
+            .unwrap();
+        assert_eq!(semantic["type"], "function");
+        let parameters = &semantic["function"]["parameters"];
+        assert_eq!(parameters["type"], "object");
+        assert!(parameters["properties"]["query"].is_object());
+        assert!(parameters.get("$schema").is_none());
+
+        let anthropic = manifest(&tools, ToolFormat::Anthropic);
+        let health = anthropic
+            .as_array()
+            .unwrap()
+            .iter()
+            .find(|tool| tool["name"] == "health_check")
+            .unwrap();
+        assert_eq!(health["input_schema"]["type"], "object");
+        assert!(health["description"].is_string());
+
+        assert!("gemini".parse::<ToolFormat>().is_err());
+    }
+}
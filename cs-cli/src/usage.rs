@@ -0,0 +1,571 @@
+//! Aggregated usage of a shared daemon, for the platform team running it:
+//! how many requests it serves, to how many clients, how fast, and how often
+//! they find nothing. Configured as `[usage]` in config.toml:
+//!
+//! ```toml
+//! [usage]
+//! enabled = true
+//! k_anonymity = 10
+//! epsilon = 1.0
+//! ```
+//!
+//! Each MCP tool call and editor search appends a line to `.cs/usage.jsonl`:
+//! the day, the tool or method, how long it took, how many results it found
+//! and a client id, the API key's name (or, without keys, the MCP process or
+//! editor connection) hashed with a salt kept beside the log. Query text is
+//! only recorded with `include_queries = true`.
+//!
+//! `cs --usage-export` sums the log by day, operation, tenant and latency,
+//! and leaves out every row fewer than `k_anonymity` distinct clients
+//! contributed to, so no row describes one person. With `epsilon`, each
+//! exported count also gets Laplace noise: a client's requests count at
+//! most [`CONTRIBUTION_CAP`] times in any figure, and the [`ROW_FIGURES`]
+//! figures of a row split `epsilon` between them, so no row tells whether
+//! any one client used the daemon. Rows are then left out by their noised
+//! client count, so being left out doesn't tell either.
+//!
+//! `epsilon` is the budget of one row. A client appears in the total and in
+//! a row of each breakdown for every day, surface, operation, tenant,
+//! latency band and exported query they had requests in, and each of those
+//! rows spends `epsilon` again: an export costs a client `epsilon` times
+//! the number of rows they're in.
+
+use anyhow::{Result, bail};
+use cs_core::UsageConfig;
+use ring::rand::{SecureRandom, SystemRandom};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::{LazyLock, Mutex};
+use std::time::Instant;
+
+pub const USAGE_LOG_FILE: &str = "usage.jsonl";
+
+/// The salt client ids are hashed with, so they can't be matched to key
+/// names without it.
+const SALT_FILE: &str = "usage_salt";
+
+/// Distinct clients a row needs unless `[usage]` says otherwise.
+pub const DEFAULT_K_ANONYMITY: usize = 5;
+
+/// Requests of one client counted in one exported figure, when noised.
+pub const CONTRIBUTION_CAP: u64 = 50;
+
+/// Noised figures in a row of an export, which split its `epsilon`.
+pub const ROW_FIGURES: usize = 5;
+
+/// Size past which the log is cut to its newer half.
+const MAX_LOG_BYTES: u64 = 16 * 1024 * 1024;
+
+/// Latency bands exported requests are counted in, by upper bound.
+const LATENCY_BANDS: &[(u64, &str)] = &[
+    (100, "<100ms"),
+    (1000, "100ms-1s"),
+    (5000, "1s-5s"),
+    (u64::MAX, ">5s"),
+];
+
+static RECORDER: LazyLock<Mutex<Option<Recorder>>> = LazyLock::new(Default::default);
+
+/// Who an MCP server's clients are when they present no key: the process,
+/// which serves one agent.
+static PROCESS_CLIENT: LazyLock<String> = LazyLock::new(|| uuid::Uuid::new_v4().to_string());
+
+struct Recorder {
+    include_queries: bool,
+    log: PathBuf,
+    salt: String,
+}
+
+/// How a request ended.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Outcome {
+    Ok,
+    Error,
+    /// Refused by `[limits]`
+    RateLimited,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct UsageEvent {
+    /// Local date, `YYYY-MM-DD`; nothing finer is kept
+    pub day: String,
+    /// `mcp` or `editor`
+    pub surface: String,
+    /// The MCP tool or editor method
+    pub operation: String,
+    /// Salted hash of the client
+    pub client: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tenant: Option<String>,
+    pub latency_ms: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub results: Option<usize>,
+    pub outcome: Outcome,
+    /// Only with `include_queries = true`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub query: Option<String>,
+}
+
+/// One request to record.
+pub struct Request<'a> {
+    pub surface: &'static str,
+    pub operation: &'a str,
+    /// The key the client presented
+    pub api_key: Option<&'a str>,
+    /// Who the client is without a key; the MCP process when `None`
+    pub connection: Option<&'a str>,
+    pub tenant: Option<&'a str>,
+    pub query: Option<&'a str>,
+    pub started: Instant,
+    pub results: Option<usize>,
+    pub outcome: Outcome,
+}
+
+/// Record requests to the log of the index at `repo_root` from now on, or
+/// stop, as `usage` says.
+pub fn configure(usage: Option<UsageConfig>, repo_root: &Path) {
+    let mut recorder = RECORDER.lock().unwrap_or_else(|e| e.into_inner());
+    *recorder = usage
+        .filter(|usage| usage.enabled)
+        .and_then(|usage| match salt(repo_root) {
+            Ok(salt) => Some(Recorder {
+                include_queries: usage.include_queries,
+                log: log_path(repo_root),
+                salt,
+            }),
+            Err(e) => {
+                tracing::warn!("Not recording usage: {}", e);
+                None
+            }
+        });
+}
+
+fn log_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(USAGE_LOG_FILE)
+}
+
+/// The salt of the index at `repo_root`, made the first time it's needed.
+fn salt(repo_root: &Path) -> Result<String> {
+    let path = cs_core::locations::index_dir(repo_root).join(SALT_FILE);
+    if let Ok(salt) = fs::read_to_string(&path)
+        && !salt.trim().is_empty()
+    {
+        return Ok(salt.trim().to_string());
+    }
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    let salt = uuid::Uuid::new_v4().simple().to_string();
+    fs::write(&path, &salt)?;
+    Ok(salt)
+}
+
+fn client_id(salt: &str, client: &str) -> String {
+    let mut hasher = Sha256::new();
+    hasher.update(salt.as_bytes());
+    hasher.update(b"\0");
+    hasher.update(client.as_bytes());
+    format!("{:x}", hasher.finalize())[..16].to_string()
+}
+
+/// Record `request` if usage is being recorded.
+pub fn record(request: Request) {
+    let recorder = RECORDER.lock().unwrap_or_else(|e| e.into_inner());
+    let Some(recorder) = recorder.as_ref() else {
+        return;
+    };
+    let client = crate::quota::key_name(request.api_key)
+        .map(|name| format!("key:{}", name))
+        .unwrap_or_else(|| {
+            let connection = request.connection.unwrap_or(PROCESS_CLIENT.as_str());
+            format!("connection:{}", connection)
+        });
+    let event = UsageEvent {
+        day: chrono::Local::now().format("%Y-%m-%d").to_string(),
+        surface: request.surface.to_string(),
+        operation: request.operation.to_string(),
+        client: client_id(&recorder.salt, &client),
+        tenant: request.tenant.map(str::to_string),
+        latency_ms: request.started.elapsed().as_millis() as u64,
+        results: request.results,
+        outcome: request.outcome,
+        query: request
+            .query
+            .filter(|_| recorder.include_queries)
+            .map(|query| query.trim().to_string()),
+    };
+    if let Err(e) = append(&recorder.log, &event) {
+        tracing::warn!("Failed to record usage: {}", e);
+    }
+}
+
+fn append(path: &Path, event: &UsageEvent) -> Result<()> {
+    let Some(dir) = path.parent().filter(|dir| dir.is_dir()) else {
+        return Ok(());
+    };
+    if fs::metadata(path).is_ok_and(|meta| meta.len() > MAX_LOG_BYTES) {
+        let events = read(path)?;
+        let mut data = Vec::new();
+        for event in &events[events.len() / 2..] {
+            serde_json::to_writer(&mut data, event)?;
+            data.push(b'\n');
+        }
+        let temp = dir.join(format!("{}.{}.tmp", USAGE_LOG_FILE, std::process::id()));
+        fs::write(&temp, data)?;
+        fs::rename(&temp, path)?;
+    }
+    let mut line = serde_json::to_vec(event)?;
+    line.push(b'\n');
+    OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)?
+        .write_all(&line)?;
+    Ok(())
+}
+
+fn read(path: &Path) -> Result<Vec<UsageEvent>> {
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+    Ok(fs::read_to_string(path)?
+        .lines()
+        .filter_map(|line| serde_json::from_str(line).ok())
+        .collect())
+}
+
+/// The events recorded for the index at `repo_root` on `since` (a
+/// `YYYY-MM-DD` date) or later, oldest first.
+pub fn load(repo_root: &Path, since: &str) -> Result<Vec<UsageEvent>> {
+    let mut events = read(&log_path(repo_root))?;
+    events.retain(|event| event.day.as_str() >= since);
+    Ok(events)
+}
+
+/// How an export protects the clients it counts.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct ExportSettings {
+    pub k_anonymity: usize,
+    pub epsilon: Option<f64>,
+    pub include_queries: bool,
+}
+
+impl ExportSettings {
+    pub fn from_config(usage: Option<&UsageConfig>) -> Self {
+        Self {
+            k_anonymity: usage
+                .and_then(|usage| usage.k_anonymity)
+                .unwrap_or(DEFAULT_K_ANONYMITY),
+            epsilon: usage.and_then(|usage| usage.epsilon),
+            include_queries: usage.is_some_and(|usage| usage.include_queries),
+        }
+    }
+}
+
+/// Requests in one row of an export.
+#[derive(Debug, Clone, Default, Serialize, PartialEq)]
+pub struct Group {
+    pub name: String,
+    pub requests: u64,
+    pub clients: u64,
+    pub zero_results: u64,
+    pub errors: u64,
+    pub rate_limited: u64,
+}
+
+#[derive(Debug, Clone, Default, Serialize, PartialEq)]
+pub struct UsageExport {
+    pub first_day: Option<String>,
+    pub last_day: Option<String>,
+    pub k_anonymity: usize,
+    /// Spent by each row; see the module docs for a whole export's cost
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub epsilon: Option<f64>,
+    /// Every request, unless fewer than `k_anonymity` clients sent them
+    pub total: Option<Group>,
+    pub by_day: Vec<Group>,
+    pub by_surface: Vec<Group>,
+    pub by_operation: Vec<Group>,
+    pub by_tenant: Vec<Group>,
+    pub by_latency: Vec<Group>,
+    /// Normalized query text, most sent first
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub queries: Vec<Group>,
+    /// Rows left out for covering too few clients
+    pub suppressed: usize,
+}
+
+/// Aggregate `events` as `settings` protect them, with Laplace noise drawn
+/// from the system's randomness. Fails rather than export counts noised by
+/// anything weaker.
+pub fn export(events: &[UsageEvent], settings: ExportSettings) -> Result<UsageExport> {
+    let random = SystemRandom::new();
+    let mut failed = false;
+    let export = aggregate(events, settings, &mut |scale| {
+        laplace(&random, scale).unwrap_or_else(|| {
+            failed = true;
+            0.0
+        })
+    });
+    if failed {
+        bail!("The system's random number generator failed; nothing exported");
+    }
+    Ok(export)
+}
+
+/// A sample of the Laplace distribution of `scale` around 0, or `None` if
+/// `random` failed.
+fn laplace(random: &dyn SecureRandom, scale: f64) -> Option<f64> {
+    let mut bytes = [0u8; 8];
+    random.fill(&mut bytes).ok()?;
+    // Uniform in (-0.5, 0.5), never at either end
+    let bits = (u64::from_le_bytes(bytes) >> 11) as f64;
+    let uniform = (bits + 0.5) / (1u64 << 53) as f64 - 0.5;
+    Some(-scale * uniform.signum() * (1.0 - 2.0 * uniform.abs()).ln())
+}
+
+/// [`export`], drawing noise of a given scale from `noise`.
+fn aggregate(
+    events: &[UsageEvent],
+    settings: ExportSettings,
+    noise: &mut dyn FnMut(f64) -> f64,
+) -> UsageExport {
+    let mut export = UsageExport {
+        first_day: events.iter().map(|e| e.day.clone()).min(),
+        last_day: events.iter().map(|e| e.day.clone()).max(),
+        k_anonymity: settings.k_anonymity,
+        epsilon: settings.epsilon,
+        ..UsageExport::default()
+    };
+    let all: Vec<&UsageEvent> = events.iter().collect();
+    export.total = group("all", &all, settings, noise);
+    if export.total.is_none() {
+        export.suppressed += usize::from(!events.is_empty());
+        return export;
+    }
+
+    let mut grouped = |key: &dyn Fn(&UsageEvent) -> Option<String>| {
+        let mut groups: BTreeMap<String, Vec<&UsageEvent>> = BTreeMap::new();
+        for event in events {
+            if let Some(name) = key(event) {
+                groups.entry(name).or_default().push(event);
+            }
+        }
+        let mut kept = Vec::new();
+        for (name, events) in groups {
+            match group(&name, &events, settings, noise) {
+                Some(group) => kept.push(group),
+                None => export.suppressed += 1,
+            }
+        }
+        kept
+    };
+    let by_day = grouped(&|event| Some(event.day.clone()));
+    let by_surface = grouped(&|event| Some(event.surface.clone()));
+    let by_operation = grouped(&|event| Some(event.operation.clone()));
+    let by_tenant = grouped(&|event| event.tenant.clone());
+    let mut by_latency = grouped(&|event| Some(latency_band(event.latency_ms).to_string()));
+    let mut queries = if settings.include_queries {
+        grouped(&|event| {
+            event
+                .query
+                .as_deref()
+                .map(cs_engine::analytics::normalize_query)
+                .filter(|query| !query.is_empty())
+        })
+    } else {
+        Vec::new()
+    };
+
+    by_latency.sort_by_key(|group| {
+        LATENCY_BANDS
+            .iter()
+            .position(|(_, name)| *name == group.name)
+    });
+    queries.sort_by(|a, b| b.requests.cmp(&a.requests).then(a.name.cmp(&b.name)));
+    export.by_day = by_day;
+    export.by_surface = by_surface;
+    export.by_operation = by_operation;
+    export.by_tenant = by_tenant;
+    export.by_latency = by_latency;
+    export.queries = queries;
+    export
+}
+
+fn latency_band(latency_ms: u64) -> &'static str {
+    LATENCY_BANDS
+        .iter()
+        .find(|(bound, _)| latency_ms < *bound)
+        .map_or(">5s", |(_, name)| name)
+}
+
+/// The row for `events`, or `None` if fewer than `k_anonymity` clients sent
+/// them, by the noised count when noised.
+fn group(
+    name: &str,
+    events: &[&UsageEvent],
+    settings: ExportSettings,
+    noise: &mut dyn FnMut(f64) -> f64,
+) -> Option<Group> {
+    // The row's figures share its budget
+    let mut noised = |count: u64, sensitivity: f64| match settings.epsilon {
+        Some(epsilon) if epsilon > 0.0 => (count as f64
+            + noise(sensitivity * ROW_FIGURES as f64 / epsilon))
+        .round()
+        .max(0.0) as u64,
+        _ => count,
+    };
+    let clients: HashSet<&str> = events.iter().map(|e| e.client.as_str()).collect();
+    let noised_clients = noised(clients.len() as u64, 1.0);
+    if noised_clients < settings.k_anonymity.max(1) as u64 {
+        return None;
+    }
+    // Each client's requests, clipped when noised so no client moves a
+    // figure by more than the noise hides
+    let count = |matches: &dyn Fn(&UsageEvent) -> bool| {
+        let mut per_client: HashMap<&str, u64> = HashMap::new();
+        for event in events.iter().filter(|event| matches(event)) {
+            *per_client.entry(event.client.as_str()).or_default() += 1;
+        }
+        per_client
+            .values()
+            .map(|&count| match settings.epsilon {
+                Some(_) => count.min(CONTRIBUTION_CAP),
+                None => count,
+            })
+            .sum::<u64>()
+    };
+    let cap = CONTRIBUTION_CAP as f64;
+    Some(Group {
+        name: name.to_string(),
+        requests: noised(count(&|_| true), cap),
+        clients: noised_clients,
+        zero_results: noised(count(&|e| e.results == Some(0)), cap),
+        errors: noised(count(&|e| e.outcome == Outcome::Error), cap),
+        rate_limited: noised(count(&|e| e.outcome == Outcome::RateLimited), cap),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn event(client: &str, operation: &str, query: Option<&str>) -> UsageEvent {
+        UsageEvent {
+            day: "2026-10-01".to_string(),
+            surface: "mcp".to_string(),
+            operation: operation.to_string(),
+            client: client.to_string(),
+            tenant: None,
+            latency_ms: 40,
+            results: Some(0),
+            outcome: Outcome::Ok,
+            query: query.map(str::to_string),
+        }
+    }
+
+    fn settings(k_anonymity: usize) -> ExportSettings {
+        ExportSettings {
+            k_anonymity,
+            epsilon: None,
+            include_queries: false,
+        }
+    }
+
+    #[test]
+    fn rows_need_k_clients() {
+        let mut events: Vec<UsageEvent> = ["a", "b", "c"]
+            .iter()
+            .map(|client| event(client, "semantic_search", None))
+            .collect();
+        events.push(event("a", "regex_search", None));
+
+        let export = aggregate(&events, settings(3), &mut |_| 0.0);
+        let total = export.total.unwrap();
+        assert_eq!((total.requests, total.clients), (4, 3));
+        assert_eq!(total.zero_results, 4);
+        let operations: Vec<&str> = export
+            .by_operation
+            .iter()
+            .map(|group| group.name.as_str())
+            .collect();
+        // Only one client searched by regex
+        assert_eq!(operations, ["semantic_search"]);
+        assert_eq!(export.suppressed, 1);
+        assert_eq!(export.by_latency[0].name, "<100ms");
+
+        // Too few clients in all, and nothing is exported
+        let export = aggregate(&events, settings(4), &mut |_| 0.0);
+        assert!(export.total.is_none());
+        assert!(export.by_day.is_empty());
+    }
+
+    #[test]
+    fn queries_are_exported_only_when_included() {
+        let events: Vec<UsageEvent> = ["a", "b"]
+            .iter()
+            .flat_map(|client| {
+                let own = format!("{} secret", client);
+                [
+                    event(client, "semantic_search", Some("Retry Backoff")),
+                    event(client, "semantic_search", Some(own.as_str())),
+                ]
+            })
+            .collect();
+        assert!(
+            aggregate(&events, settings(2), &mut |_| 0.0)
+                .queries
+                .is_empty()
+        );
+
+        let included = ExportSettings {
+            include_queries: true,
+            ..settings(2)
+        };
+        let export = aggregate(&events, included, &mut |_| 0.0);
+        let queries: Vec<&str> = export.queries.iter().map(|q| q.name.as_str()).collect();
+        // What one client alone searched stays out
+        assert_eq!(queries, ["retry backoff"]);
+        assert_eq!(export.suppressed, 2);
+    }
+
+    #[test]
+    fn noise_covers_clipped_contributions() {
+        let mut events: Vec<UsageEvent> = (0..200).map(|_| event("a", "search", None)).collect();
+        events.push(event("b", "search", None));
+        let noised = ExportSettings {
+            epsilon: Some(0.5),
+            ..settings(2)
+        };
+        // The five figures of a row split its epsilon
+        let client_scale = ROW_FIGURES as f64 / 0.5;
+        let mut scales = Vec::new();
+        let export = aggregate(&events, noised, &mut |scale| {
+            scales.push(scale);
+            if scale == client_scale { 0.4 } else { -3.4 }
+        });
+        let total = export.total.unwrap();
+        // One heavy client counts CONTRIBUTION_CAP times at most
+        assert_eq!(total.requests, CONTRIBUTION_CAP + 1 - 3);
+        assert_eq!(total.clients, 2);
+        assert_eq!(total.errors, 0);
+        assert!(scales.contains(&(CONTRIBUTION_CAP as f64 * client_scale)));
+        assert!(scales.contains(&client_scale));
+
+        // Rows are kept or left out by their noised client count
+        let export = aggregate(&events, noised, &mut |_| -0.6);
+        assert!(export.total.is_none());
+        assert_eq!(export.suppressed, 1);
+
+        let random = SystemRandom::new();
+        let draws: Vec<f64> = (0..2000).map(|_| laplace(&random, 1.0).unwrap()).collect();
+        let mean = draws.iter().sum::<f64>() / draws.len() as f64;
+        assert!(mean.abs() < 0.2);
+        assert!(draws.iter().all(|draw| draw.is_finite()));
+    }
+}
@@ -0,0 +1,195 @@
+//! Warm start for the daemons. A freshly deployed server otherwise faults
+//! the index and model in from disk during its first queries, which then run
+//! many times slower than the rest. `--preload` reads them into memory at
+//! startup instead: everything under `.cs/` (manifest, sidecars, lexical and
+//! ANN indexes, shards) and the files of the embedding model the index was
+//! built with, which is then loaded once. `--mlock` also locks those files
+//! in RAM, so memory pressure can't evict them between queries.
+//!
+//! Locking pins the files as they were at startup; files an index update
+//! later replaces are read through the page cache as usual until the daemon
+//! restarts.
+
+use anyhow::Result;
+use memmap2::Mmap;
+use std::fs::File;
+use std::path::{Path, PathBuf};
+use walkdir::WalkDir;
+
+/// Bytes between the reads that fault a mapped file in.
+const PAGE_SIZE: usize = 4096;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Preload {
+    Off,
+    /// Read the index and model into the page cache
+    Read,
+    /// Read them and lock them in RAM
+    Lock,
+}
+
+impl Preload {
+    pub fn from_flags(preload: bool, mlock: bool) -> Self {
+        if mlock {
+            Preload::Lock
+        } else if preload {
+            Preload::Read
+        } else {
+            Preload::Off
+        }
+    }
+}
+
+/// What was preloaded. Locked files stay locked while this is alive.
+#[derive(Default)]
+pub struct Preloaded {
+    pub files: usize,
+    pub bytes: u64,
+    locked: Vec<Mmap>,
+}
+
+impl Preloaded {
+    pub fn summary(&self) -> String {
+        format!(
+            "Preloaded {} files ({:.1} MiB){}",
+            self.files,
+            self.bytes as f64 / (1024.0 * 1024.0),
+            if self.locked.is_empty() {
+                ""
+            } else {
+                ", locked in memory"
+            }
+        )
+    }
+}
+
+/// Preload the index at `root` and its embedding model as `mode` says.
+pub fn preload(root: &Path, mode: Preload) -> Result<Preloaded> {
+    let mut preloaded = Preloaded::default();
+    if mode == Preload::Off {
+        return Ok(preloaded);
+    }
+    #[cfg(not(unix))]
+    if mode == Preload::Lock {
+        anyhow::bail!("--mlock needs a Unix system; use --preload");
+    }
+
+    let root = cs_index::find_repo_root(root).unwrap_or_else(|_| root.to_path_buf());
+    let model = cs_index::load_manifest(&root)
+        .ok()
+        .flatten()
+        .and_then(|manifest| manifest.embedding_model);
+    let mut dirs = vec![cs_core::locations::index_dir(&root)];
+    if let Some(model) = &model {
+        dirs.extend(model_dirs(&cs_embed::model_cache_dir(), model));
+    }
+
+    let mut lock = mode == Preload::Lock;
+    for file in dirs.iter().flat_map(|dir| files_under(dir)) {
+        let Some(map) = map_file(&file) else {
+            continue;
+        };
+        preloaded.files += 1;
+        preloaded.bytes += map.len() as u64;
+        if lock {
+            match lock_map(&map) {
+                Ok(()) => {
+                    preloaded.locked.push(map);
+                    continue;
+                }
+                Err(e) => {
+                    tracing::warn!(
+                        "Can't lock the index in memory ({}); preloading without locking. Raise the locked memory limit (ulimit -l, or LimitMEMLOCK= under systemd)",
+                        e
+                    );
+                    lock = false;
+                }
+            }
+        }
+        touch(&map);
+    }
+
+    // A model's first load also builds its runtime session; do it now
+    if let Some(model) = &model {
+        cs_embed::create_embedder(Some(model))?;
+    }
+    Ok(preloaded)
+}
+
+/// Where the model may have been downloaded: our own layout or the Hugging
+/// Face hub's.
+pub(crate) fn model_dirs(cache_dir: &Path, model: &str) -> Vec<PathBuf> {
+    vec![
+        cache_dir.join(model.replace('/', "_")),
+        cache_dir.join(format!("models--{}", model.replace('/', "--"))),
+    ]
+}
+
+fn files_under(dir: &Path) -> Vec<PathBuf> {
+    WalkDir::new(dir)
+        .into_iter()
+        .filter_map(|entry| entry.ok())
+        .filter(|entry| entry.file_type().is_file())
+        .map(|entry| entry.into_path())
+        // Half-written files of an update in progress
+        .filter(|path| path.extension().is_none_or(|ext| ext != "tmp"))
+        .collect()
+}
+
+fn map_file(path: &Path) -> Option<Mmap> {
+    let file = File::open(path).ok()?;
+    if file.metadata().ok()?.len() == 0 {
+        return None;
+    }
+    // SAFETY: the map is only read, and files are replaced by renaming a new
+    // file over them, never truncated in place
+    unsafe { Mmap::map(&file) }.ok()
+}
+
+#[cfg(unix)]
+fn lock_map(map: &Mmap) -> std::io::Result<()> {
+    map.lock()
+}
+
+#[cfg(not(unix))]
+fn lock_map(_map: &Mmap) -> std::io::Result<()> {
+    Err(std::io::Error::from(std::io::ErrorKind::Unsupported))
+}
+
+/// Fault every page of `map` into the page cache.
+fn touch(map: &Mmap) {
+    #[cfg(unix)]
+    let _ = map.advise(memmap2::Advice::WillNeed);
+    let mut sum = 0u8;
+    for offset in (0..map.len()).step_by(PAGE_SIZE) {
+        sum = sum.wrapping_add(map[offset]);
+    }
+    std::hint::black_box(sum);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn preloads_the_index_but_not_temp_files() {
+        let dir = tempfile::tempdir().unwrap();
+        let index_dir = cs_core::locations::index_dir(dir.path());
+        std::fs::create_dir_all(index_dir.join("sidecars")).unwrap();
+        std::fs::write(index_dir.join("sidecars/lib.rs.json"), vec![b'x'; 10_000]).unwrap();
+        std::fs::write(index_dir.join("manifest.json.123.tmp"), "{").unwrap();
+        std::fs::write(index_dir.join("empty"), "").unwrap();
+
+        let preloaded = preload(dir.path(), Preload::Read).unwrap();
+        assert_eq!(preloaded.files, 1);
+        assert_eq!(preloaded.bytes, 10_000);
+        assert_eq!(preload(dir.path(), Preload::Off).unwrap().files, 0);
+    }
+
+    #[test]
+    fn mlock_implies_preload() {
+        assert_eq!(Preload::from_flags(false, false), Preload::Off);
+        assert_eq!(Preload::from_flags(true, false), Preload::Read);
+        assert_eq!(Preload::from_flags(false, true), Preload::Lock);
+    }
+}
@@ -0,0 +1,235 @@
+//! File system events for `watch`, coalesced so that a storm of them (a
+//! branch switch, `gofmt -w ./...`, a formatter run on save) is checked once
+//! after it settles instead of once per event or poll.
+//!
+//! Events go through a bounded queue. When that overflows, the platform
+//! reports it dropped events, or a batch touches more paths than are worth
+//! checking one by one, the batch becomes a single re-scan of the tree.
+
+use anyhow::Result;
+use notify::{EventKind, RecursiveMode, Watcher};
+use std::collections::BTreeSet;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+use tokio::sync::mpsc::{Receiver, channel};
+
+/// Events waiting to be coalesced at most; more mean a re-scan.
+const EVENT_QUEUE: usize = 4096;
+
+/// Paths a batch checks one by one at most; more mean a re-scan.
+const MAX_BATCH_PATHS: usize = 512;
+
+/// A batch that keeps being extended is flushed after this many settle
+/// periods anyway, so a long storm still reports as it goes.
+const MAX_DELAY_SETTLES: u32 = 10;
+
+/// What changed in a settled batch of events.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Batch {
+    /// Check these paths; a directory stands for everything under it
+    Paths(Vec<PathBuf>),
+    /// Too much changed, or events were lost: check the whole tree
+    Rescan,
+}
+
+/// Collects changed paths until no event arrived for `settle`, or the
+/// batch is `settle * MAX_DELAY_SETTLES` old.
+#[derive(Debug)]
+pub struct Coalescer {
+    settle: Duration,
+    max_delay: Duration,
+    max_paths: usize,
+    paths: BTreeSet<PathBuf>,
+    rescan: bool,
+    first: Option<Instant>,
+    last: Option<Instant>,
+}
+
+impl Coalescer {
+    pub fn new(settle: Duration) -> Self {
+        Self {
+            settle,
+            max_delay: settle * MAX_DELAY_SETTLES,
+            max_paths: MAX_BATCH_PATHS,
+            paths: BTreeSet::new(),
+            rescan: false,
+            first: None,
+            last: None,
+        }
+    }
+
+    pub fn push(&mut self, path: PathBuf, now: Instant) {
+        self.touch(now);
+        if self.rescan {
+            return;
+        }
+        self.paths.insert(path);
+        if self.paths.len() > self.max_paths {
+            self.rescan_all(now);
+        }
+    }
+
+    /// Events were lost; the batch re-scans everything.
+    pub fn rescan_all(&mut self, now: Instant) {
+        self.touch(now);
+        self.rescan = true;
+        self.paths.clear();
+    }
+
+    fn touch(&mut self, now: Instant) {
+        self.first.get_or_insert(now);
+        self.last = Some(now);
+    }
+
+    /// When the pending batch is due, if there is one.
+    pub fn deadline(&self) -> Option<Instant> {
+        let (first, last) = (self.first?, self.last?);
+        Some((last + self.settle).min(first + self.max_delay))
+    }
+
+    /// The pending batch, once it's due.
+    pub fn take(&mut self, now: Instant) -> Option<Batch> {
+        if now < self.deadline()? {
+            return None;
+        }
+        self.first = None;
+        self.last = None;
+        if std::mem::take(&mut self.rescan) {
+            return Some(Batch::Rescan);
+        }
+        Some(Batch::Paths(
+            std::mem::take(&mut self.paths).into_iter().collect(),
+        ))
+    }
+}
+
+/// Changed paths under a watched tree, as they're reported.
+pub struct EventStream {
+    // Events stop when this is dropped
+    _watcher: notify::RecommendedWatcher,
+    events: Receiver<PathBuf>,
+    lost: Arc<AtomicBool>,
+}
+
+impl EventStream {
+    /// Watch every directory under each of `roots`. Fails where the platform
+    /// can't, such as past Linux's inotify watch limit; poll instead then.
+    pub fn watch(roots: &[&Path]) -> Result<Self> {
+        let (sender, events) = channel(EVENT_QUEUE);
+        let lost = Arc::new(AtomicBool::new(false));
+        let lost_events = lost.clone();
+        let mut watcher =
+            notify::recommended_watcher(move |event: notify::Result<notify::Event>| {
+                let event = match event {
+                    Ok(event) if !event.need_rescan() => event,
+                    _ => {
+                        lost_events.store(true, Ordering::Relaxed);
+                        return;
+                    }
+                };
+                // Reads, such as the ones checking a batch, change nothing
+                if matches!(event.kind, EventKind::Access(_)) {
+                    return;
+                }
+                for path in event.paths {
+                    if is_vcs_path(&path) {
+                        continue;
+                    }
+                    if sender.try_send(path).is_err() {
+                        lost_events.store(true, Ordering::Relaxed);
+                    }
+                }
+            })?;
+        for root in roots {
+            watcher.watch(root, RecursiveMode::Recursive)?;
+        }
+        Ok(Self {
+            _watcher: watcher,
+            events,
+            lost,
+        })
+    }
+
+    /// The next changed path, `None` when the watcher stopped.
+    pub async fn next(&mut self) -> Option<PathBuf> {
+        self.events.recv().await
+    }
+
+    /// Whether events were lost since the last call.
+    pub fn lost_events(&self) -> bool {
+        self.lost.swap(false, Ordering::Relaxed)
+    }
+}
+
+/// Git's own files change by the thousand on a checkout and are never indexed.
+fn is_vcs_path(path: &Path) -> bool {
+    path.components()
+        .any(|component| component.as_os_str() == ".git")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SETTLE: Duration = Duration::from_millis(300);
+
+    #[test]
+    fn a_burst_is_one_batch_once_it_settles() {
+        let start = Instant::now();
+        let mut coalescer = Coalescer::new(SETTLE);
+        assert_eq!(coalescer.deadline(), None);
+        for (ms, name) in [(0, "b.go"), (100, "a.go"), (200, "b.go")] {
+            coalescer.push(PathBuf::from(name), start + Duration::from_millis(ms));
+        }
+        assert_eq!(
+            coalescer.deadline(),
+            Some(start + Duration::from_millis(500))
+        );
+        assert_eq!(coalescer.take(start + Duration::from_millis(450)), None);
+        assert_eq!(
+            coalescer.take(start + Duration::from_millis(500)),
+            Some(Batch::Paths(vec![
+                PathBuf::from("a.go"),
+                PathBuf::from("b.go")
+            ]))
+        );
+        assert_eq!(coalescer.deadline(), None);
+    }
+
+    #[test]
+    fn a_storm_that_never_settles_is_flushed_anyway() {
+        let start = Instant::now();
+        let mut coalescer = Coalescer::new(SETTLE);
+        for ms in (0..5000).step_by(100) {
+            coalescer.push(PathBuf::from("gen.go"), start + Duration::from_millis(ms));
+        }
+        assert_eq!(
+            coalescer.deadline(),
+            Some(start + SETTLE * MAX_DELAY_SETTLES)
+        );
+    }
+
+    #[test]
+    fn too_many_paths_or_lost_events_rescan() {
+        let now = Instant::now();
+        let mut coalescer = Coalescer::new(SETTLE);
+        for n in 0..=MAX_BATCH_PATHS {
+            coalescer.push(PathBuf::from(format!("{}.go", n)), now);
+        }
+        assert_eq!(coalescer.take(now + SETTLE), Some(Batch::Rescan));
+
+        coalescer.push(PathBuf::from("a.go"), now);
+        coalescer.rescan_all(now);
+        coalescer.push(PathBuf::from("b.go"), now);
+        assert_eq!(coalescer.take(now + SETTLE), Some(Batch::Rescan));
+        assert_eq!(coalescer.take(now + SETTLE * 2), None);
+    }
+
+    #[test]
+    fn git_internals_are_ignored() {
+        assert!(is_vcs_path(Path::new("/repo/.git/index.lock")));
+        assert!(!is_vcs_path(Path::new("/repo/src/git.rs")));
+    }
+}
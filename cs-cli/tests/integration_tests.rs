@@ -133,12 +133,9 @@ fn test_index_command() {
 
 fn read_manifest_updated(dir: &Path) -> u64 {
     let manifest_path = dir.join(".cs").join("manifest.json");
-    let data = fs::read(manifest_path).expect("manifest should exist");
-    let manifest: serde_json::Value = serde_json::from_slice(&data).expect("valid json");
-    manifest
-        .get("updated")
-        .and_then(|v| v.as_u64())
-        .expect("updated timestamp")
+    cs_index::manifest_format::read_header(&manifest_path)
+        .expect("manifest should exist")
+        .updated
 }
 
 #[test]
@@ -480,6 +477,27 @@ fn test_nonexistent_directory_error() {
     let stderr = String::from_utf8(output.stderr).unwrap();
     assert!(stderr.contains("Path does not exist"));
     assert!(stderr.contains("/nonexistent/directory"));
+    // Errors exit with 2, distinct from an empty search
+    assert_eq!(output.status.code(), Some(2));
+}
+
+#[test]
+fn test_quiet_no_matches_prints_nothing() {
+    let temp_dir = TempDir::new().unwrap();
+    fs::write(temp_dir.path().join("test.txt"), "hello world").unwrap();
+
+    let output = Command::new(cs_binary())
+        .args([
+            "-q",
+            "nonexistent_pattern",
+            temp_dir.path().to_str().unwrap(),
+        ])
+        .output()
+        .expect("Failed to run cc");
+
+    assert_eq!(output.status.code(), Some(1));
+    assert!(output.stdout.is_empty());
+    assert!(output.stderr.is_empty());
 }
 
 #[test]
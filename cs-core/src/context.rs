@@ -0,0 +1,150 @@
+//! Cancellation and progress for the long-running library operations:
+//! indexing, searching and upgrading an index's format.
+//!
+//! An application embedding cs passes an [`OperationContext`] to the
+//! `*_with_context` entry points. Cancelling its [`CancelToken`], from any
+//! thread or task, stops the operation at its next checkpoint (between
+//! files, or between index directories when upgrading) with
+//! [`CcError::Cancelled`], leaving what was finished saved; the progress
+//! callback hears about each step first, so a progress bar can follow along.
+
+use crate::CcError;
+use std::fmt;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+/// A cancellation flag shared by the clones of a token.
+#[derive(Debug, Clone, Default)]
+pub struct CancelToken {
+    cancelled: Arc<AtomicBool>,
+}
+
+impl CancelToken {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Ask every operation holding a clone of this token to stop.
+    pub fn cancel(&self) {
+        self.cancelled.store(true, Ordering::SeqCst);
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        self.cancelled.load(Ordering::SeqCst)
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Operation {
+    Index,
+    Search,
+    /// Upgrading an index to the current format
+    Migrate,
+}
+
+/// How far an operation has got: `done` of `total` steps, and the file or
+/// directory it's starting on.
+#[derive(Debug, Clone)]
+pub struct Progress {
+    pub operation: Operation,
+    pub done: usize,
+    pub total: usize,
+    pub item: Option<String>,
+}
+
+pub type ProgressFn = Arc<dyn Fn(&Progress) + Send + Sync>;
+
+/// What a long-running operation is given to check for cancellation and
+/// report progress through. The default is neither cancellable nor observed.
+#[derive(Clone, Default)]
+pub struct OperationContext {
+    cancel: CancelToken,
+    progress: Option<ProgressFn>,
+}
+
+impl OperationContext {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Stop when `token` is cancelled.
+    pub fn with_cancel(mut self, token: CancelToken) -> Self {
+        self.cancel = token;
+        self
+    }
+
+    pub fn with_progress(mut self, progress: impl Fn(&Progress) + Send + Sync + 'static) -> Self {
+        self.progress = Some(Arc::new(progress));
+        self
+    }
+
+    pub fn cancel_token(&self) -> &CancelToken {
+        &self.cancel
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        self.cancel.is_cancelled()
+    }
+
+    /// A checkpoint: `Err(CcError::Cancelled)` once the token is cancelled.
+    pub fn check(&self) -> Result<(), CcError> {
+        if self.is_cancelled() {
+            Err(CcError::Cancelled)
+        } else {
+            Ok(())
+        }
+    }
+
+    pub fn report(&self, operation: Operation, done: usize, total: usize, item: Option<String>) {
+        if let Some(progress) = &self.progress {
+            progress(&Progress {
+                operation,
+                done,
+                total,
+                item,
+            });
+        }
+    }
+}
+
+impl fmt::Debug for OperationContext {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("OperationContext")
+            .field("cancel", &self.cancel)
+            .field("progress", &self.progress.is_some())
+            .finish()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+
+    #[test]
+    fn clones_share_cancellation_and_progress() {
+        let seen = Arc::new(Mutex::new(Vec::new()));
+        let recorded = seen.clone();
+        let token = CancelToken::new();
+        let ctx = OperationContext::new()
+            .with_cancel(token.clone())
+            .with_progress(move |progress| {
+                recorded
+                    .lock()
+                    .unwrap()
+                    .push((progress.operation, progress.done, progress.total));
+            });
+        let worker = ctx.clone();
+
+        worker.report(Operation::Index, 0, 2, Some("src/lib.rs".to_string()));
+        assert!(worker.check().is_ok());
+        token.cancel();
+        assert!(matches!(worker.check(), Err(CcError::Cancelled)));
+        assert!(ctx.is_cancelled());
+        assert_eq!(*seen.lock().unwrap(), [(Operation::Index, 0, 2)]);
+
+        // Nothing to cancel or observe by default
+        OperationContext::default().report(Operation::Search, 1, 1, None);
+        assert!(OperationContext::default().check().is_ok());
+    }
+}
@@ -1,4 +1,9 @@
+pub mod context;
 pub mod heatmap;
+pub mod locations;
+pub mod network;
+pub mod paths;
+pub mod text;
 
 use serde::{Deserialize, Serialize};
 use std::path::{Path, PathBuf};
@@ -32,6 +37,9 @@ pub enum CcError {
 
     #[error("Other error: {0}")]
     Other(String),
+
+    #[error("Operation cancelled")]
+    Cancelled,
 }
 
 pub type Result<T> = std::result::Result<T, CcError>;
@@ -112,7 +120,7 @@ impl std::fmt::Display for Language {
     }
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, PartialEq, Eq, Hash, Serialize, Deserialize)]
 pub struct Span {
     pub byte_start: usize,
     pub byte_end: usize,
@@ -207,7 +215,7 @@ impl Span {
     }
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
 pub struct FileMetadata {
     pub path: PathBuf,
     pub hash: String,
@@ -231,12 +239,197 @@ pub struct SearchResult {
     pub index_epoch: Option<u64>,
 }
 
+impl SearchResult {
+    /// The order results are listed in: highest score first, ties broken by
+    /// path and then start line, so identical searches list results identically.
+    pub fn rank_cmp(&self, other: &Self) -> std::cmp::Ordering {
+        other
+            .score
+            .total_cmp(&self.score)
+            .then_with(|| self.file.cmp(&other.file))
+            .then_with(|| self.span.line_start.cmp(&other.span.line_start))
+    }
+}
+
+#[cfg(any(test, feature = "test-util"))]
+impl SearchResult {
+    /// A result for tests covering `line_start..=line_end` of `file`, in the
+    /// language its extension names, with nothing else filled in.
+    pub fn for_lines(
+        file: impl Into<PathBuf>,
+        line_start: usize,
+        line_end: usize,
+        score: f32,
+    ) -> Self {
+        let file = file.into();
+        SearchResult {
+            lang: Language::from_path(&file),
+            file,
+            span: Span {
+                byte_start: 0,
+                byte_end: 0,
+                line_start,
+                line_end,
+            },
+            score,
+            preview: String::new(),
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        }
+    }
+}
+
 /// Enhanced search results that include near-miss information for threshold queries
 #[derive(Debug, Clone)]
 pub struct SearchResults {
     pub matches: Vec<SearchResult>,
     /// The highest scoring result below the threshold (if any)
     pub closest_below_threshold: Option<SearchResult>,
+    /// How a semantic search was executed, when it planned one
+    pub plan: Option<QueryPlan>,
+    /// Where each result's score came from, with `--explain-scores`
+    pub explanations: Option<ScoreExplanations>,
+    /// What went wrong without stopping the search, such as part of the
+    /// index being unreadable
+    pub warnings: Vec<String>,
+    /// Candidates counted per facet before `top_k` cut them, with `--facets`
+    pub facets: Option<FacetSummary>,
+}
+
+impl SearchResults {
+    /// How `result`'s score came about, when the search explained its scores.
+    pub fn explanation(&self, result: &SearchResult) -> Option<&ScoreExplanation> {
+        self.explanations
+            .as_ref()?
+            .get(&(result.file.clone(), result.span.line_start))
+    }
+}
+
+/// How a semantic query scores the index.
+#[derive(Debug, Clone, PartialEq)]
+pub enum QueryStrategy {
+    /// Score every chunk left after filters
+    BruteForce,
+    /// Score only the chunks in the ANN index's lists nearest the query
+    Ann { lists: usize, probes: usize },
+}
+
+/// The strategy chosen for a semantic query and why, for `--explain-plan`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct QueryPlan {
+    pub strategy: QueryStrategy,
+    /// Chunks left after filters
+    pub candidates: usize,
+    /// Of those, the chunks that were scored
+    pub scored: usize,
+    pub top_k: Option<usize>,
+    pub reason: String,
+}
+
+/// Score explanations by result file and start line.
+pub type ScoreExplanations = std::collections::HashMap<(PathBuf, usize), ScoreExplanation>;
+
+/// A change to a result's score after retrieval, for `--explain-scores`.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct ScoreAdjustment {
+    /// What changed it: "stop symbols", "boost rules" or "feedback"
+    pub source: String,
+    pub delta: f32,
+}
+
+/// The parts of a result's score, for `--explain-scores`: what retrieval
+/// scored it, how hybrid search fused the lists it ranked in, and what
+/// reranking and boosts changed afterwards.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct ScoreExplanation {
+    /// Similarity of the query and chunk embeddings
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub dense: Option<f32>,
+    /// What the learned sparse score added to the dense one (`--sparse` indexes)
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub sparse: Option<f32>,
+    /// Score of the regex or BM25 match
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub lexical: Option<f32>,
+    /// Score of the AST pattern match
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub ast: Option<f32>,
+    /// What the reranking model changed the score by
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub rerank: Option<f32>,
+    // Hybrid search: ranks in the fused lists, and the fused score
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub dense_rank: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub lexical_rank: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub ast_rank: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub fused: Option<f32>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub adjustments: Vec<ScoreAdjustment>,
+}
+
+impl std::fmt::Display for ScoreExplanation {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let mut parts = Vec::new();
+        if let Some(dense) = self.dense {
+            parts.push(format!("dense {:.3}", dense));
+        }
+        if let Some(sparse) = self.sparse {
+            parts.push(format!("sparse {:+.3}", sparse));
+        }
+        if let Some(rerank) = self.rerank {
+            parts.push(format!("rerank {:+.3}", rerank));
+        }
+        if let Some(lexical) = self.lexical {
+            parts.push(format!("lexical {:.3}", lexical));
+        }
+        if let Some(ast) = self.ast {
+            parts.push(format!("ast {:.3}", ast));
+        }
+        if let Some(fused) = self.fused {
+            let ranks: Vec<String> = [
+                ("dense", self.dense_rank),
+                ("lexical", self.lexical_rank),
+                ("ast", self.ast_rank),
+            ]
+            .into_iter()
+            .filter_map(|(list, rank)| Some(format!("{} #{}", list, rank?)))
+            .collect();
+            parts.push(format!("fused {:.4} from {}", fused, ranks.join(", ")));
+        }
+        for adjustment in &self.adjustments {
+            parts.push(format!("{} {:+.3}", adjustment.source, adjustment.delta));
+        }
+        if parts.is_empty() {
+            return write!(f, "no score components recorded");
+        }
+        write!(f, "{}", parts.join(", "))
+    }
+}
+
+impl std::fmt::Display for QueryPlan {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match &self.strategy {
+            QueryStrategy::BruteForce => write!(f, "brute force")?,
+            QueryStrategy::Ann { lists, probes } => {
+                write!(f, "ANN, probing {} of {} lists", probes, lists)?
+            }
+        }
+        write!(
+            f,
+            ": scored {} of {} candidate chunks for {}; {}",
+            self.scored,
+            self.candidates,
+            match self.top_k {
+                Some(k) => format!("top {}", k),
+                None => "all matches".to_string(),
+            },
+            self.reason
+        )
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -279,7 +472,7 @@ pub enum SearchMode {
     Lexical,
     Semantic,
     Hybrid,
-    Ast,  // AST structural search using ast-grep
+    Ast, // AST structural search using ast-grep
 }
 
 #[derive(Debug, Clone)]
@@ -288,6 +481,550 @@ pub struct IncludePattern {
     pub is_dir: bool,
 }
 
+/// Query-time score multiplier, declared as `[[boost]]` in config.
+///
+/// Every condition that is set must match; a rule with no conditions matches nothing.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct BoostRule {
+    /// Glob relative to the index root, e.g. `internal/**`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub path: Option<String>,
+    /// Language name as shown in results, e.g. `go`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub language: Option<String>,
+    /// Match files modified within this many days
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub modified_within_days: Option<u64>,
+    /// Score multiplier: >1 boosts, <1 demotes
+    pub factor: f32,
+}
+
+/// Query-time rule for boilerplate chunks such as getters, setters and
+/// generated `String()` methods, declared as `[[stop_symbol]]` in config or
+/// `.csstop.toml`.
+///
+/// A rule matches chunks declaring a function or method; every condition
+/// that is set must match, and a rule with no `names` or `max_tokens` matches
+/// nothing.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct StopSymbolRule {
+    /// Language name as shown in results, e.g. `go`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub language: Option<String>,
+    /// Globs over the declared name, e.g. `String` or `get*`
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub names: Vec<String>,
+    /// Match chunks of at most this many (estimated) tokens
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_tokens: Option<usize>,
+    /// Score multiplier below 1; leave out to drop matching results
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub factor: Option<f32>,
+}
+
+/// Rank constant of reciprocal rank fusion, from the original paper.
+pub const DEFAULT_RRF_K: f32 = 60.0;
+
+/// How hybrid search combines its lexical, semantic and AST results into one
+/// ranking, and what reranks results afterwards, declared as `[fusion]` in
+/// config.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct FusionConfig {
+    pub strategy: FusionStrategy,
+    /// `rrf`: higher evens out the difference between top and lower ranks
+    pub k: f32,
+    /// `weighted`: weight of each list's scores, scaled to 0..1 within it
+    pub weights: FusionWeights,
+    /// `linear`: the model scoring each result's features
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub linear: Option<LinearFusion>,
+    /// Command reranking the results of ranked searches: it reads them as
+    /// JSON on stdin and writes their new scores to stdout
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub reranker: Vec<String>,
+}
+
+impl Default for FusionConfig {
+    fn default() -> Self {
+        Self {
+            strategy: FusionStrategy::default(),
+            k: DEFAULT_RRF_K,
+            weights: FusionWeights::default(),
+            linear: None,
+            reranker: Vec::new(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum FusionStrategy {
+    /// Reciprocal rank fusion: the sum of 1/(k + rank) over the lists
+    #[default]
+    Rrf,
+    /// Weighted sum of the lists' scaled scores
+    Weighted,
+    /// Linear model over each result's features
+    Linear,
+}
+
+impl std::str::FromStr for FusionStrategy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim().to_lowercase().as_str() {
+            "rrf" => Ok(FusionStrategy::Rrf),
+            "weighted" => Ok(FusionStrategy::Weighted),
+            "linear" => Ok(FusionStrategy::Linear),
+            other => Err(format!(
+                "Unknown fusion strategy '{}'. Use rrf, weighted or linear",
+                other
+            )),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct FusionWeights {
+    pub lexical: f32,
+    pub dense: f32,
+    pub ast: f32,
+}
+
+impl Default for FusionWeights {
+    fn default() -> Self {
+        Self {
+            lexical: 1.0,
+            dense: 1.0,
+            ast: 1.0,
+        }
+    }
+}
+
+/// A linear model over the features of a fused result, such as one fitted
+/// to `--explain-scores` output and relevance judgments.
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct LinearFusion {
+    #[serde(default)]
+    pub bias: f32,
+    /// By feature: `lexical`, `dense` and `ast` for a list's raw score,
+    /// `_scaled` for it scaled to 0..1, `_rr` for 1/(k + rank) and `_hit`
+    /// for 1 when the result is in the list
+    pub weights: std::collections::BTreeMap<String, f32>,
+}
+
+/// How much of each result's code a search returns as its preview, so a
+/// terminal, an agent and an editor can each ask for what fits them.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(try_from = "String", into = "String")]
+pub enum SnippetPolicy {
+    /// At most this many lines: `lines:10`
+    Lines(usize),
+    /// Whole lines up to this many estimated tokens: `tokens:400`
+    Tokens(usize),
+    /// The whole function, method or class the result starts in: `symbol`
+    Symbol,
+}
+
+impl std::str::FromStr for SnippetPolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        let s = s.trim().to_lowercase();
+        if s == "symbol" {
+            return Ok(SnippetPolicy::Symbol);
+        }
+        let limit = |value: &str| match value.trim().parse::<usize>() {
+            Ok(limit) if limit > 0 => Ok(limit),
+            _ => Err(format!(
+                "Snippet limit '{}' must be a positive whole number",
+                value
+            )),
+        };
+        match s.split_once(':') {
+            Some(("lines", value)) => Ok(SnippetPolicy::Lines(limit(value)?)),
+            Some(("tokens", value)) => Ok(SnippetPolicy::Tokens(limit(value)?)),
+            _ => Err(format!(
+                "Unknown snippet policy '{}'. Use lines:N, tokens:N or symbol",
+                s
+            )),
+        }
+    }
+}
+
+impl std::fmt::Display for SnippetPolicy {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            SnippetPolicy::Lines(lines) => write!(f, "lines:{}", lines),
+            SnippetPolicy::Tokens(tokens) => write!(f, "tokens:{}", tokens),
+            SnippetPolicy::Symbol => f.write_str("symbol"),
+        }
+    }
+}
+
+impl TryFrom<String> for SnippetPolicy {
+    type Error = String;
+
+    fn try_from(s: String) -> std::result::Result<Self, Self::Error> {
+        s.parse()
+    }
+}
+
+impl From<SnippetPolicy> for String {
+    fn from(policy: SnippetPolicy) -> Self {
+        policy.to_string()
+    }
+}
+
+/// The snippet policy of each kind of consumer when a request doesn't pick
+/// one, declared as `[snippets]` in config. Unset, previews are as the
+/// search builds them.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct SnippetDefaults {
+    /// Searches printed by `cs`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub terminal: Option<SnippetPolicy>,
+    /// MCP tool calls
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub agent: Option<SnippetPolicy>,
+    /// Editor RPC searches
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub editor: Option<SnippetPolicy>,
+}
+
+/// Rewrites text before it is sent to a remote embedder, declared as
+/// `[[redact]]` in config or `.csredact.toml`.
+///
+/// Set either `pattern` (a regex whose matches become `replacement`) or
+/// `identifiers` (names mapped to numbered placeholders such as `CUSTOMER_1`).
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct RedactionRule {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pattern: Option<String>,
+    /// Defaults to `[REDACTED]`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub replacement: Option<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub identifiers: Vec<String>,
+    /// Placeholder prefix for `identifiers`; defaults to `ENTITY`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub placeholder: Option<String>,
+}
+
+/// How much of the test fixtures, golden files or other bulky trees matching
+/// `pattern` indexing takes, declared as `[[fixture]]` in config.
+///
+/// Sizes are written like `--max-file-size`: `64K`, `2M` or a byte count.
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct FixtureRule {
+    /// A `.gitignore` line, relative to the repository root
+    pub pattern: String,
+    /// Largest file indexed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_file_size: Option<String>,
+    /// Bytes indexed per fixture directory
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_dir_size: Option<String>,
+    /// Files indexed per fixture directory
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_files: Option<usize>,
+}
+
+/// The chat model `--ask` sends questions to, declared as `[llm]` in config.
+///
+/// Any OpenAI-compatible chat completions endpoint works: Ollama, a llama.cpp
+/// or vLLM server, or a hosted API.
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct LlmConfig {
+    /// Defaults to Ollama on localhost
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub url: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub model: Option<String>,
+    /// Environment variable holding the API key; defaults to `CS_LLM_API_KEY`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub api_key_env: Option<String>,
+}
+
+/// Index upkeep a daemon can run on a schedule.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum MaintenanceTask {
+    /// Re-index files changed since the last update
+    Update,
+    /// Drop entries whose files are gone, then re-check every file's hash
+    Revalidate,
+    /// Remove orphaned sidecars, empty directories and leftovers of
+    /// interrupted writes
+    Compact,
+}
+
+impl std::str::FromStr for MaintenanceTask {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim().to_lowercase().as_str() {
+            "update" => Ok(MaintenanceTask::Update),
+            "revalidate" => Ok(MaintenanceTask::Revalidate),
+            "compact" => Ok(MaintenanceTask::Compact),
+            other => Err(format!(
+                "Unknown maintenance task '{}'. Use update, revalidate or compact",
+                other
+            )),
+        }
+    }
+}
+
+/// A `[[schedule]]` rule in config: run `task` whenever `cron` matches.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ScheduleRule {
+    /// Five-field cron expression in local time, or `@daily` and friends
+    pub cron: String,
+    pub task: MaintenanceTask,
+}
+
+/// `[limits]` in config: how hard clients of a daemon may query it, so one
+/// agent can't starve a shared index.
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct LimitsConfig {
+    /// Sustained queries per minute per client; unlimited when unset
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rate_per_minute: Option<f64>,
+    /// Queries a client may send at once; defaults to a minute's worth
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub burst: Option<u32>,
+    /// Queries per client per day
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub daily_queries: Option<u64>,
+    /// When any are listed, clients must present one of these keys
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub keys: Vec<ApiKey>,
+}
+
+/// A `[[limits.keys]]` entry: a client's key, with limits of its own.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ApiKey {
+    /// Who the key belongs to, for logs and quota accounting
+    pub name: String,
+    pub key: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rate_per_minute: Option<f64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub daily_queries: Option<u64>,
+}
+
+/// `[usage]` in config: a daemon's aggregated usage log, exported with
+/// `cs --usage-export` so platform teams can size and tune a shared
+/// deployment without seeing what anyone searched.
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct UsageConfig {
+    /// Record daemon requests: counts, latency and outcome, not queries
+    #[serde(default)]
+    pub enabled: bool,
+    /// Distinct clients a figure must cover to be exported; 5 when unset
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub k_anonymity: Option<usize>,
+    /// Also record query text, exported only for queries `k_anonymity`
+    /// clients sent
+    #[serde(default)]
+    pub include_queries: bool,
+    /// Privacy budget of each exported figure; exports are noised when set
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub epsilon: Option<f64>,
+}
+
+/// A `[[tenant]]` of a shared daemon: a team's key, the repository its
+/// clients search, and that team's search defaults and limits.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct TenantConfig {
+    /// Who the tenant is, for logs and quota accounting
+    pub name: String,
+    pub key: String,
+    /// The repository the tenant's clients search, and nothing outside it
+    pub root: PathBuf,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub top_k: Option<usize>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub threshold: Option<f32>,
+    /// Patterns left out of the tenant's searches on top of the defaults
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub exclude: Vec<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rate_per_minute: Option<f64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub daily_queries: Option<u64>,
+}
+
+impl TenantConfig {
+    /// The tenant's key and limits, as `[[limits.keys]]` would give them.
+    pub fn api_key(&self) -> ApiKey {
+        ApiKey {
+            name: self.name.clone(),
+            key: self.key.clone(),
+            rate_per_minute: self.rate_per_minute,
+            daily_queries: self.daily_queries,
+        }
+    }
+}
+
+/// Dimension results are grouped by in a faceted summary.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum FacetKind {
+    Language,
+    Directory,
+    SymbolKind,
+    Owner,
+}
+
+impl std::str::FromStr for FacetKind {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim().to_lowercase().as_str() {
+            "lang" | "language" => Ok(FacetKind::Language),
+            "dir" | "directory" => Ok(FacetKind::Directory),
+            "kind" | "symbol_kind" | "symbol-kind" => Ok(FacetKind::SymbolKind),
+            "owner" => Ok(FacetKind::Owner),
+            other => Err(format!(
+                "Unknown facet '{}'. Use lang, dir, kind or owner",
+                other
+            )),
+        }
+    }
+}
+
+/// How often a facet value occurs among results.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct FacetCount {
+    pub value: String,
+    pub count: usize,
+}
+
+/// Results counted per facet value, most common first.
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct FacetSummary {
+    pub total: usize,
+    pub language: Vec<FacetCount>,
+    pub directory: Vec<FacetCount>,
+    pub symbol_kind: Vec<FacetCount>,
+    pub owner: Vec<FacetCount>,
+}
+
+impl FacetSummary {
+    pub fn get(&self, kind: FacetKind) -> &[FacetCount] {
+        match kind {
+            FacetKind::Language => &self.language,
+            FacetKind::Directory => &self.directory,
+            FacetKind::SymbolKind => &self.symbol_kind,
+            FacetKind::Owner => &self.owner,
+        }
+    }
+}
+
+/// Narrow results to one facet value, e.g. `lang=go` or `owner=@search-team`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct FacetFilter {
+    pub kind: FacetKind,
+    pub value: String,
+}
+
+impl std::str::FromStr for FacetFilter {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        let (kind, value) = s
+            .split_once('=')
+            .ok_or_else(|| format!("Facet filter '{}' must look like KEY=VALUE", s))?;
+        Ok(FacetFilter {
+            kind: kind.parse()?,
+            value: value.trim().to_string(),
+        })
+    }
+}
+
+/// Narrow results by metadata a `.csextract.toml` extractor recorded on their
+/// chunks: `KEY=VALUE`, `KEY` for any value, `!` in front to exclude.
+#[derive(Debug, Clone, PartialEq)]
+pub struct MetadataFilter {
+    pub key: String,
+    pub value: Option<String>,
+    pub exclude: bool,
+}
+
+impl MetadataFilter {
+    /// Whether a chunk tagged with `metadata` passes this filter.
+    pub fn matches(&self, metadata: &std::collections::BTreeMap<String, String>) -> bool {
+        let found = metadata
+            .get(&self.key)
+            .is_some_and(|value| self.value.as_ref().is_none_or(|wanted| wanted == value));
+        found != self.exclude
+    }
+}
+
+impl std::str::FromStr for MetadataFilter {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        let s = s.trim();
+        let (exclude, filter) = match s.strip_prefix('!') {
+            Some(filter) => (true, filter),
+            None => (false, s),
+        };
+        let (key, value) = match filter.split_once('=') {
+            Some((key, value)) => (key.trim(), Some(value.trim().to_string())),
+            None => (filter.trim(), None),
+        };
+        if key.is_empty() {
+            return Err(format!(
+                "Metadata filter '{}' must look like KEY=VALUE or KEY",
+                s
+            ));
+        }
+        Ok(MetadataFilter {
+            key: key.to_string(),
+            value,
+            exclude,
+        })
+    }
+}
+
+/// Edits a lexical search word may be from the word it matches, unless the
+/// config or `--max-typos` says otherwise.
+pub const DEFAULT_MAX_TYPOS: u8 = 1;
+
+/// What a search does with the language a query's syntax gives away, such
+/// as Go for `func (s *Server)` (`--infer-lang`).
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LanguageInference {
+    /// Rank chunks in that language higher
+    #[default]
+    Bias,
+    /// Search only chunks in that language
+    Restrict,
+    Off,
+}
+
+impl std::str::FromStr for LanguageInference {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "bias" => Ok(Self::Bias),
+            "restrict" => Ok(Self::Restrict),
+            "off" => Ok(Self::Off),
+            other => Err(format!(
+                "Unknown language inference '{}'; expected bias, restrict or off",
+                other
+            )),
+        }
+    }
+}
+
 #[derive(Debug, Clone)]
 pub struct SearchOptions {
     pub mode: SearchMode,
@@ -320,17 +1057,62 @@ pub struct SearchOptions {
     pub rerank_model: Option<String>,
     pub embedding_model: Option<String>,
     // AST-specific options (for --ast mode)
-    pub ast_pattern: Option<String>,      // AST pattern (overrides query if set)
-    pub ast_lang: Option<String>,         // Force language for AST search
-    pub ast_selector: Option<String>,     // AST kind selector
-    pub ast_strictness: Option<String>,   // Matching strictness (cst/smart/ast/relaxed/signature)
+    pub ast_pattern: Option<String>, // AST pattern (overrides query if set)
+    pub ast_lang: Option<String>,    // Force language for AST search
+    pub ast_selector: Option<String>, // AST kind selector
+    pub ast_strictness: Option<String>, // Matching strictness (cst/smart/ast/relaxed/signature)
+    // Matryoshka first-pass: score on the first N dims, then re-score top candidates at full dims
+    pub truncate_dims: Option<usize>,
+    // Skip the pre-search index update; semantic search embeds dirty files in memory instead
+    pub no_index_update: bool,
+    // External vector store (e.g. postgres:// URL) queried instead of local sidecars
+    pub vector_store: Option<String>,
+    pub store_repos: Vec<String>,
+    // Boost rules from user config; the repo's .csboost.toml is added at search time
+    pub boost_rules: Vec<BoostRule>,
+    // Stop-symbol rules from user config; the repo's .csstop.toml is added at search time
+    pub stop_symbol_rules: Vec<StopSymbolRule>,
+    // Search chunks from files with a generated-code header too
+    pub include_generated: bool,
+    pub facet_filters: Vec<FacetFilter>,
+    // Count results per facet, before `top_k` cuts them
+    pub facet_summary: bool,
+    // Bypass the per-generation cache of semantic search results
+    pub no_query_cache: bool,
+    // Report the plan of a semantic search in its results (bypasses the query cache)
+    pub explain_plan: bool,
+    // Collections searched ("code" is the repository's files); empty searches all
+    pub collections: Vec<String>,
+    // SPDX licenses to require, or to exclude with a leading '!' (--license)
+    pub license_filters: Vec<String>,
+    // Metadata recorded by .csextract.toml extractors that chunks must match (--meta)
+    pub metadata_filters: Vec<MetadataFilter>,
+    // Regex every result's code must contain (--must-match)
+    pub must_match: Option<String>,
+    // Report what each result's score is made of (bypasses the query cache)
+    pub explain_scores: bool,
+    // .cstags.toml intent tags every result's chunk must carry (--tag)
+    pub tag_filters: Vec<String>,
+    // Edits a lexical query word may be from an indexed word and still match (--max-typos, 0 to 2)
+    pub max_typos: u8,
+    // How hybrid results are fused and reranked ([fusion] in config; --fusion picks the strategy)
+    pub fusion: FusionConfig,
+    // How much code each result's preview holds (--snippet; the search's own preview when unset)
+    pub snippet: Option<SnippetPolicy>,
+    // File whose package, imports and importers rank higher (--focus)
+    pub focus: Option<PathBuf>,
+    // Parts of a compound query searched alongside it, rankings fused (--multi-query)
+    pub sub_queries: Vec<String>,
+    // What the language the query's syntax gives away does to the search (--infer-lang)
+    pub infer_language: LanguageInference,
 }
 
 impl JsonlSearchResult {
     pub fn from_search_result(result: &SearchResult, include_snippet: bool) -> Self {
         Self {
             path: result.file.to_string_lossy().to_string(),
-            span: result.span.clone(),
+            // Byte offsets as a consumer reading the file itself counts them
+            span: text::original_span(&result.file, &result.span),
             language: result.lang.as_ref().map(|l| l.to_string()),
             snippet: if include_snippet {
                 Some(result.preview.clone())
@@ -385,6 +1167,29 @@ impl Default for SearchOptions {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: Vec::new(),
+            stop_symbol_rules: Vec::new(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: DEFAULT_MAX_TYPOS,
+            fusion: FusionConfig::default(),
+            snippet: None,
+            focus: None,
+            sub_queries: Vec::new(),
+            infer_language: LanguageInference::default(),
         }
     }
 }
@@ -394,7 +1199,7 @@ impl Default for SearchOptions {
 pub fn get_default_exclude_patterns() -> Vec<String> {
     vec![
         // cs's own index directory
-        ".cs".to_string(),
+        locations::INDEX_DIR_NAME.to_string(),
         // AI/ML model cache directories
         ".fastembed_cache".to_string(),
         ".cache".to_string(),
@@ -580,7 +1385,7 @@ pub fn build_exclude_patterns(
 
 pub fn get_sidecar_path(repo_root: &Path, file_path: &Path) -> PathBuf {
     let relative = file_path.strip_prefix(repo_root).unwrap_or(file_path);
-    let mut sidecar = repo_root.join(".cs");
+    let mut sidecar = locations::index_dir(repo_root);
     sidecar.push(relative);
     let ext = relative
         .extension()
@@ -625,7 +1430,7 @@ pub mod pdf {
     /// Get path for cached PDF content
     pub fn get_content_cache_path(repo_root: &Path, file_path: &Path) -> PathBuf {
         let relative = file_path.strip_prefix(repo_root).unwrap_or(file_path);
-        let mut cache_path = repo_root.join(".cs").join("content");
+        let mut cache_path = crate::locations::index_dir(repo_root).join("content");
         cache_path.push(relative);
 
         // Add .txt extension to the cached file
@@ -951,6 +1756,66 @@ mod tests {
         assert_eq!(jsonl_no_snippet.path, "src/auth.rs");
     }
 
+    #[test]
+    fn tied_scores_rank_by_path_then_line() {
+        let result = |file: &str, line: usize, score: f32| SearchResult {
+            file: PathBuf::from(file),
+            span: Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: line,
+                line_end: line,
+            },
+            score,
+            preview: String::new(),
+            lang: None,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        };
+        let mut results = vec![
+            result("src/b.rs", 3, 0.5),
+            result("src/a.rs", 9, 0.5),
+            result("src/c.rs", 1, 0.9),
+            result("src/a.rs", 2, 0.5),
+        ];
+        results.sort_by(SearchResult::rank_cmp);
+        let order: Vec<(String, usize)> = results
+            .iter()
+            .map(|r| (r.file.display().to_string(), r.span.line_start))
+            .collect();
+        assert_eq!(
+            order,
+            [
+                ("src/c.rs".to_string(), 1),
+                ("src/a.rs".to_string(), 2),
+                ("src/a.rs".to_string(), 9),
+                ("src/b.rs".to_string(), 3),
+            ]
+        );
+    }
+
+    #[test]
+    fn metadata_filters_parse_and_match() {
+        let tags: std::collections::BTreeMap<String, String> =
+            [("service".to_string(), "billing".to_string())].into();
+
+        let billing: MetadataFilter = "service=billing".parse().unwrap();
+        assert!(billing.matches(&tags));
+        assert!(!billing.matches(&Default::default()));
+
+        let any_service: MetadataFilter = "service".parse().unwrap();
+        assert_eq!(any_service.value, None);
+        assert!(any_service.matches(&tags));
+
+        let not_billing: MetadataFilter = "!service=billing".parse().unwrap();
+        assert!(not_billing.exclude);
+        assert!(!not_billing.matches(&tags));
+        assert!(not_billing.matches(&Default::default()));
+
+        assert!("=billing".parse::<MetadataFilter>().is_err());
+    }
+
     #[test]
     fn test_get_sidecar_path() {
         let repo_root = PathBuf::from("/home/user/project");
@@ -1377,4 +2242,25 @@ mod tests {
         // Check for issue reference
         assert!(content.contains("issue #27"));
     }
+
+    #[test]
+    fn test_snippet_policy_parsing() {
+        assert_eq!("lines:10".parse(), Ok(SnippetPolicy::Lines(10)));
+        assert_eq!(" Tokens:400".parse(), Ok(SnippetPolicy::Tokens(400)));
+        assert_eq!("symbol".parse(), Ok(SnippetPolicy::Symbol));
+        assert!("lines:0".parse::<SnippetPolicy>().is_err());
+        assert!("lines".parse::<SnippetPolicy>().is_err());
+        assert!("chars:80".parse::<SnippetPolicy>().is_err());
+
+        // Requests and config spell policies the way --snippet does
+        let defaults: SnippetDefaults =
+            serde_json::from_str(r#"{"agent": "symbol", "editor": "lines:3"}"#).unwrap();
+        assert_eq!(defaults.terminal, None);
+        assert_eq!(defaults.agent, Some(SnippetPolicy::Symbol));
+        assert_eq!(
+            serde_json::to_string(&defaults).unwrap(),
+            r#"{"agent":"symbol","editor":"lines:3"}"#
+        );
+        assert!(serde_json::from_str::<SnippetPolicy>(r#""lines:x""#).is_err());
+    }
 }
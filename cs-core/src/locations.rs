@@ -0,0 +1,221 @@
+//! Where cs keeps its files, following the XDG base directory spec.
+//!
+//! - the index of a repository: `.cs/` in it by default; with
+//!   [`IndexLocation::Data`], under the data directory instead, so read-only
+//!   checkouts can be indexed and working trees stay clean; or any directory
+//!   given with `--index-dir`
+//! - data: `$CS_DATA_DIR`, else `$XDG_DATA_HOME/cs`, else `~/.local/share/cs`
+//! - cache (downloaded models): `$XDG_CACHE_HOME/cs`, else `~/.cache/cs`
+//!
+//! Relative `XDG_*` values are ignored, as the spec requires.
+
+use crate::paths;
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::RwLock;
+
+/// Name of the index directory inside a repository.
+pub const INDEX_DIR_NAME: &str = ".cs";
+
+pub const DATA_DIR_ENV: &str = "CS_DATA_DIR";
+
+/// Subdirectory of the data directory holding out-of-tree indexes.
+pub const INDEXES_DIR: &str = "indexes";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum IndexLocation {
+    /// `.cs/` at the repository root
+    #[default]
+    Repo,
+    /// `<data dir>/indexes/<name>-<hash>/`, keyed by the repository's path
+    Data,
+}
+
+impl FromStr for IndexLocation {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "repo" => Ok(Self::Repo),
+            "data" => Ok(Self::Data),
+            other => Err(format!(
+                "Unknown index location '{}'; expected repo or data",
+                other
+            )),
+        }
+    }
+}
+
+impl fmt::Display for IndexLocation {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::Repo => "repo",
+            Self::Data => "data",
+        })
+    }
+}
+
+struct Settings {
+    location: IndexLocation,
+    /// Index directory of one repository: (comparison key of its root, dir)
+    index_dir: Option<(String, PathBuf)>,
+}
+
+static SETTINGS: RwLock<Settings> = RwLock::new(Settings {
+    location: IndexLocation::Repo,
+    index_dir: None,
+});
+
+/// Set where indexes are kept for the rest of the process.
+pub fn set_index_location(location: IndexLocation) {
+    SETTINGS.write().unwrap_or_else(|e| e.into_inner()).location = location;
+}
+
+/// Keep the index of `repo_root` in `dir` for the rest of the process.
+pub fn set_index_dir(repo_root: &Path, dir: &Path) {
+    let key = paths::comparison_key(&canonical_root(repo_root));
+    SETTINGS
+        .write()
+        .unwrap_or_else(|e| e.into_inner())
+        .index_dir = Some((key, canonical_root(dir)));
+}
+
+/// The canonical form of `path`, resolving its parent if it doesn't exist
+/// yet so it compares equal once it does.
+fn canonical_root(path: &Path) -> PathBuf {
+    if let Ok(canonical) = paths::canonicalize(path) {
+        return canonical;
+    }
+    match (path.parent(), path.file_name()) {
+        (Some(parent), Some(name)) if !parent.as_os_str().is_empty() => {
+            paths::canonicalize_lossy(parent).join(name)
+        }
+        _ => paths::canonicalize_lossy(path),
+    }
+}
+
+/// The directory holding the index of the repository at `repo_root`.
+pub fn index_dir(repo_root: &Path) -> PathBuf {
+    let settings = SETTINGS.read().unwrap_or_else(|e| e.into_inner());
+    if settings.location == IndexLocation::Repo && settings.index_dir.is_none() {
+        return repo_root.join(INDEX_DIR_NAME);
+    }
+
+    let canonical = canonical_root(repo_root);
+    if let Some((root, dir)) = &settings.index_dir
+        && paths::comparison_key(&canonical) == *root
+    {
+        return dir.clone();
+    }
+    match settings.location {
+        IndexLocation::Repo => repo_root.join(INDEX_DIR_NAME),
+        IndexLocation::Data => data_dir().join(INDEXES_DIR).join(repo_key(&canonical)),
+    }
+}
+
+/// Whether `dir` is where some repository's index is kept.
+pub fn is_index_dir(dir: &Path) -> bool {
+    if dir.file_name().is_some_and(|name| name == INDEX_DIR_NAME) {
+        return true;
+    }
+    let settings = SETTINGS.read().unwrap_or_else(|e| e.into_inner());
+    if let Some((_, index_dir)) = &settings.index_dir
+        && paths::paths_equal(dir, index_dir)
+    {
+        return true;
+    }
+    settings.location == IndexLocation::Data
+        && dir
+            .parent()
+            .is_some_and(|parent| paths::paths_equal(parent, &data_dir().join(INDEXES_DIR)))
+}
+
+/// Directory name of an out-of-tree index: readable, and unique per path.
+fn repo_key(canonical_root: &Path) -> String {
+    let name: String = canonical_root
+        .file_name()
+        .map(|name| name.to_string_lossy())
+        .unwrap_or_default()
+        .chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.') {
+                c
+            } else {
+                '_'
+            }
+        })
+        .collect();
+    let hash = blake3::hash(paths::comparison_key(canonical_root).as_bytes()).to_hex();
+    let name = if name.is_empty() { "root" } else { &name };
+    format!("{}-{}", name, &hash[..16])
+}
+
+/// An absolute path from environment variable `var`, if set.
+fn env_dir(var: &str) -> Option<PathBuf> {
+    std::env::var_os(var)
+        .filter(|value| !value.is_empty())
+        .map(PathBuf::from)
+        .filter(|path| path.is_absolute())
+}
+
+fn home_dir() -> Option<PathBuf> {
+    env_dir("HOME")
+}
+
+/// Where cs keeps data that should persist, such as out-of-tree indexes.
+pub fn data_dir() -> PathBuf {
+    if let Some(dir) = std::env::var_os(DATA_DIR_ENV).filter(|value| !value.is_empty()) {
+        PathBuf::from(dir)
+    } else if let Some(data_home) = env_dir("XDG_DATA_HOME") {
+        data_home.join("cs")
+    } else if let Some(home) = home_dir() {
+        home.join(".local").join("share").join("cs")
+    } else if let Some(appdata) = env_dir("LOCALAPPDATA") {
+        appdata.join("cs").join("data")
+    } else {
+        PathBuf::from(".cs_data")
+    }
+}
+
+/// Where cs keeps data it can download again, such as models.
+pub fn cache_dir() -> PathBuf {
+    if let Some(cache_home) = env_dir("XDG_CACHE_HOME") {
+        cache_home.join("cs")
+    } else if let Some(home) = home_dir() {
+        home.join(".cache").join("cs")
+    } else if let Some(appdata) = env_dir("LOCALAPPDATA") {
+        appdata.join("cs").join("cache")
+    } else {
+        // Fallback to current directory if no home found
+        PathBuf::from(".cs_cache")
+    }
+}
+
+/// `$XDG_CONFIG_HOME/cs`, if `XDG_CONFIG_HOME` is set.
+pub fn xdg_config_dir() -> Option<PathBuf> {
+    env_dir("XDG_CONFIG_HOME").map(|config_home| config_home.join("cs"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn out_of_tree_index_names_are_readable_and_unique() {
+        let a = repo_key(Path::new("/home/dev/src/my repo"));
+        let b = repo_key(Path::new("/home/dev/other/my repo"));
+        assert!(a.starts_with("my_repo-"), "{}", a);
+        assert_eq!(a.len(), "my_repo-".len() + 16);
+        assert_ne!(a, b);
+        assert_eq!(a, repo_key(Path::new("/home/dev/src/my repo")));
+        assert!(repo_key(Path::new("/")).starts_with("root-"));
+
+        assert!(is_index_dir(Path::new("/repo/.cs")));
+        assert!(!is_index_dir(Path::new("/repo/src")));
+        assert_eq!("data".parse(), Ok(IndexLocation::Data));
+        assert!("elsewhere".parse::<IndexLocation>().is_err());
+    }
+}
@@ -0,0 +1,308 @@
+//! Platform-aware path normalization.
+//!
+//! Windows paths differ from Unix ones in three ways that matter for indexing:
+//! separators may be `\` or `/`, `fs::canonicalize` returns verbatim paths
+//! (`\\?\C:\repo`) that don't compare equal to the `C:\repo` users type, and
+//! the filesystem is case-insensitive. Code that compares, stores or displays
+//! paths goes through these helpers so both platforms behave the same.
+//!
+//! Path filters (`--glob`, `--exclude`, glob path arguments) compare names
+//! as [`filter_path`] folds them: in composed Unicode form, since macOS
+//! stores `é` decomposed where Linux and Windows keep it as typed, and
+//! without case or accents when [`PathMatching`] says so, so a filter
+//! matches the same files on every platform.
+
+use serde::{Deserialize, Serialize};
+use std::borrow::Cow;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::RwLock;
+use unicode_normalization::UnicodeNormalization;
+use unicode_normalization::char::is_combining_mark;
+
+/// Whether paths compare case-insensitively, as the filesystem does.
+pub const CASE_INSENSITIVE: bool = cfg!(windows);
+
+/// `path` with `/` separators, for keys stored on disk and shown to users.
+pub fn to_slash(path: &Path) -> String {
+    to_slash_str(&path.to_string_lossy())
+}
+
+fn to_slash_str(path: &str) -> String {
+    path.replace('\\', "/")
+}
+
+/// `path` without its `./` or `.\` prefix and with `/` separators.
+pub fn to_relative_slash(path: &Path) -> String {
+    let path = to_slash(path);
+    match path.strip_prefix("./") {
+        Some(stripped) => stripped.to_string(),
+        None => path,
+    }
+}
+
+/// The non-verbatim form of a verbatim Windows path, or `None` if `path`
+/// isn't one or the verbatim prefix is needed to address it.
+fn strip_verbatim(path: &str) -> Option<String> {
+    if let Some(unc) = path.strip_prefix(r"\\?\UNC\") {
+        return Some(format!(r"\\{}", unc));
+    }
+    let rest = path.strip_prefix(r"\\?\")?;
+    let bytes = rest.as_bytes();
+    let is_drive = bytes.len() >= 2 && bytes[0].is_ascii_alphabetic() && bytes[1] == b':';
+    // Longer paths and reserved names only resolve in verbatim form
+    if !is_drive || rest.len() >= 260 || rest.contains('/') {
+        return None;
+    }
+    Some(rest.to_string())
+}
+
+/// `path` in the form users type: verbatim prefixes are dropped on Windows.
+pub fn simplify(path: PathBuf) -> PathBuf {
+    if !cfg!(windows) {
+        return path;
+    }
+    match path.to_str().and_then(strip_verbatim) {
+        Some(simplified) => PathBuf::from(simplified),
+        None => path,
+    }
+}
+
+/// Like [`std::fs::canonicalize`], without Windows verbatim prefixes.
+pub fn canonicalize(path: &Path) -> io::Result<PathBuf> {
+    path.canonicalize().map(simplify)
+}
+
+/// The canonical form of `path` if it exists, else `path` made absolute.
+pub fn canonicalize_lossy(path: &Path) -> PathBuf {
+    if let Ok(canonical) = canonicalize(path) {
+        return canonical;
+    }
+    if path.is_absolute() {
+        return path.to_path_buf();
+    }
+    std::env::current_dir()
+        .map(|cwd| cwd.join(path))
+        .unwrap_or_else(|_| path.to_path_buf())
+}
+
+/// The string two paths are compared by: `/` separators, no trailing
+/// separator, and lowercase where the filesystem ignores case.
+pub fn comparison_key(path: &Path) -> String {
+    comparison_key_str(&path.to_string_lossy(), CASE_INSENSITIVE)
+}
+
+fn comparison_key_str(path: &str, case_insensitive: bool) -> String {
+    let mut key = to_slash_str(path);
+    while key.len() > 1 && key.ends_with('/') && !key.ends_with(":/") {
+        key.pop();
+    }
+    if case_insensitive {
+        key = key.to_lowercase();
+    }
+    key
+}
+
+/// Whether `a` and `b` name the same path on this platform.
+pub fn paths_equal(a: &Path, b: &Path) -> bool {
+    comparison_key(a) == comparison_key(b)
+}
+
+/// Whether `path` is `base` or lies under it, comparing whole components.
+pub fn starts_with(path: &Path, base: &Path) -> bool {
+    key_starts_with(&comparison_key(path), &comparison_key(base))
+}
+
+fn key_starts_with(path: &str, base: &str) -> bool {
+    match path.strip_prefix(base) {
+        Some(rest) => rest.is_empty() || rest.starts_with('/') || base.ends_with('/'),
+        None => false,
+    }
+}
+
+/// An exclude or glob pattern in the form the matchers expect: on Windows `\`
+/// is a separator there, not the escape character it is in gitignore syntax.
+pub fn normalize_pattern(pattern: &str) -> String {
+    if cfg!(windows) {
+        to_slash_str(pattern)
+    } else {
+        pattern.to_string()
+    }
+}
+
+/// How path filters compare names, beyond what the filesystem does: set by
+/// `--ignore-path-case` and `--ignore-path-accents`, or `[path_matching]`
+/// in config.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct PathMatching {
+    /// Ignore case everywhere, not only where the filesystem does
+    pub ignore_case: bool,
+    /// Match `é` with `e`, `ü` with `u` and so on
+    pub ignore_accents: bool,
+}
+
+static MATCHING: RwLock<PathMatching> = RwLock::new(PathMatching {
+    ignore_case: false,
+    ignore_accents: false,
+});
+
+/// Compare names in path filters as `matching` says for the rest of the
+/// process.
+pub fn set_path_matching(matching: PathMatching) {
+    *MATCHING.write().unwrap_or_else(|e| e.into_inner()) = matching;
+}
+
+pub fn path_matching() -> PathMatching {
+    *MATCHING.read().unwrap_or_else(|e| e.into_inner())
+}
+
+/// Whether path filters ignore case: where the filesystem does, or
+/// everywhere when asked to.
+pub fn filters_ignore_case() -> bool {
+    CASE_INSENSITIVE || path_matching().ignore_case
+}
+
+/// `text` as path filters compare it: composed, without accents when they're
+/// ignored, and lowercase when case is, since the glob matchers only ignore
+/// ASCII case.
+pub fn fold(text: &str) -> Cow<'_, str> {
+    fold_with(text, path_matching().ignore_accents, filters_ignore_case())
+}
+
+fn fold_with(text: &str, ignore_accents: bool, ignore_case: bool) -> Cow<'_, str> {
+    if text.is_ascii() {
+        return Cow::Borrowed(text);
+    }
+    let folded: String = if ignore_accents {
+        text.nfd().filter(|c| !is_combining_mark(*c)).collect()
+    } else {
+        text.nfc().collect()
+    };
+    Cow::Owned(if ignore_case {
+        folded.to_lowercase()
+    } else {
+        folded
+    })
+}
+
+/// `path` as path filters compare it (see [`fold`]).
+pub fn filter_path(path: &Path) -> Cow<'_, Path> {
+    match path.to_str().map(fold) {
+        Some(Cow::Owned(folded)) => Cow::Owned(PathBuf::from(folded)),
+        _ => Cow::Borrowed(path),
+    }
+}
+
+/// A glob or exclude pattern as path filters compare it: normalized (see
+/// [`normalize_pattern`]) and folded like the paths it's matched against.
+pub fn filter_pattern(pattern: &str) -> String {
+    fold(&normalize_pattern(pattern)).into_owned()
+}
+
+/// Whether names may fold to something other than what the matchers see,
+/// so they have to be folded before they're matched against `patterns`.
+pub fn folding_matters(patterns: &[String]) -> bool {
+    path_matching().ignore_accents || patterns.iter().any(|pattern| !pattern.is_ascii())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn strips_verbatim_prefixes() {
+        assert_eq!(
+            strip_verbatim(r"\\?\C:\repo\src").as_deref(),
+            Some(r"C:\repo\src")
+        );
+        assert_eq!(
+            strip_verbatim(r"\\?\UNC\server\share\repo").as_deref(),
+            Some(r"\\server\share\repo")
+        );
+        assert_eq!(strip_verbatim(r"C:\repo"), None);
+        // Device paths and overlong paths need the prefix to resolve
+        assert_eq!(strip_verbatim(r"\\?\Volume{1234}\repo"), None);
+        assert_eq!(
+            strip_verbatim(&format!(r"\\?\C:\{}", "a".repeat(300))),
+            None
+        );
+    }
+
+    #[test]
+    fn compares_windows_paths_by_component() {
+        let key = |p: &str| comparison_key_str(p, true);
+        assert_eq!(key(r"C:\Repo\Src\"), key("c:/repo/src"));
+        assert_eq!(key(r"C:\"), "c:/");
+        assert!(key_starts_with(
+            &key(r"C:\Repo\src\main.rs"),
+            &key(r"c:\repo")
+        ));
+        assert!(!key_starts_with(&key(r"C:\Repository"), &key(r"C:\Repo")));
+        assert!(key_starts_with(&key(r"C:\Repo"), &key(r"C:\")));
+    }
+
+    #[test]
+    fn unix_paths_stay_case_sensitive() {
+        assert_ne!(
+            comparison_key_str("/repo/Src", false),
+            comparison_key_str("/repo/src", false)
+        );
+        assert!(key_starts_with("/repo/src/a.rs", "/repo"));
+        assert!(key_starts_with("/repo", "/"));
+        assert!(!key_starts_with("/repository", "/repo"));
+    }
+
+    #[test]
+    fn relative_slash_drops_dot_prefix() {
+        assert_eq!(to_relative_slash(Path::new("./src/main.rs")), "src/main.rs");
+        assert_eq!(
+            to_relative_slash(Path::new(r".\src\main.rs")),
+            "src/main.rs"
+        );
+        assert_eq!(to_relative_slash(Path::new("src/main.rs")), "src/main.rs");
+    }
+
+    #[test]
+    fn filters_fold_unicode_forms_and_accents() {
+        let composed = "r\u{e9}sum\u{e9}/caf\u{e9}.md";
+        let decomposed = "re\u{301}sume\u{301}/cafe\u{301}.md";
+        // macOS hands out decomposed names, Linux the ones typed
+        assert_eq!(fold_with(decomposed, false, false), composed);
+        assert_eq!(fold_with(composed, false, false), composed);
+        assert_eq!(fold_with(decomposed, true, false), "resume/cafe.md");
+        assert_eq!(fold_with(composed, true, false), "resume/cafe.md");
+        assert_eq!(fold_with("Straße/Ärger.go", true, false), "Straße/Arger.go");
+        assert_eq!(
+            fold_with("CAFE\u{301}/Ärger.go", false, true),
+            "caf\u{e9}/ärger.go"
+        );
+        assert!(matches!(
+            fold_with("CMD/main.go", true, true),
+            Cow::Borrowed(_)
+        ));
+
+        assert_eq!(path_matching(), PathMatching::default());
+        assert_eq!(filters_ignore_case(), CASE_INSENSITIVE);
+        assert!(!folding_matters(&["CMD/**".to_string()]));
+        assert!(folding_matters(&["caf\u{e9}/**".to_string()]));
+    }
+
+    #[cfg(windows)]
+    #[test]
+    fn windows_paths_match_case_insensitively() {
+        assert!(paths_equal(
+            Path::new(r"C:\Repo\A.rs"),
+            Path::new("c:/repo/a.rs")
+        ));
+        assert!(starts_with(
+            Path::new(r"C:\REPO\src"),
+            Path::new(r"c:\repo")
+        ));
+        assert_eq!(normalize_pattern(r"target\**"), "target/**");
+
+        let dir = tempfile::tempdir().unwrap();
+        let canonical = canonicalize(dir.path()).unwrap();
+        assert!(!canonical.to_string_lossy().starts_with(r"\\?\"));
+    }
+}
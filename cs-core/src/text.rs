@@ -0,0 +1,281 @@
+//! Source text as chunking and search see it: UTF-8 with LF line endings,
+//! whatever the file is stored as.
+//!
+//! Reading a file detects and normalizes:
+//!
+//! - a UTF-8 byte order mark, which is dropped
+//! - UTF-16, little or big endian, by its byte order mark or (without one)
+//!   by the zero bytes ASCII text has in every other position
+//! - bytes that aren't valid UTF-8, read as Windows-1252, the superset of
+//!   Latin-1 legacy Windows and Western European files are written in
+//! - CRLF line endings, which become LF (a lone CR is kept)
+//!
+//! Line numbers are those of the file either way. Byte offsets in spans are
+//! offsets into the normalized text, so everything slicing a chunk out of a
+//! file must read it with [`read_text`]; [`Decoded::original_offset`] maps
+//! them back to the file's own bytes for output that reports them.
+
+use crate::Span;
+use std::fs;
+use std::io;
+use std::path::Path;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Encoding {
+    Utf8,
+    /// UTF-8 after a byte order mark
+    Utf8Bom,
+    Utf16Le,
+    Utf16Be,
+    Windows1252,
+}
+
+impl Encoding {
+    /// Bytes the stored form of `c` takes.
+    fn width(self, c: char) -> usize {
+        match self {
+            Self::Utf8 | Self::Utf8Bom => c.len_utf8(),
+            Self::Utf16Le | Self::Utf16Be => 2 * c.len_utf16(),
+            Self::Windows1252 => 1,
+        }
+    }
+
+    /// Bytes of the byte order mark in front of the text.
+    fn bom_len(self, bytes: &[u8]) -> usize {
+        match self {
+            Self::Utf8Bom => UTF8_BOM.len(),
+            Self::Utf16Le if bytes.starts_with(UTF16_LE_BOM) => 2,
+            Self::Utf16Be if bytes.starts_with(UTF16_BE_BOM) => 2,
+            _ => 0,
+        }
+    }
+}
+
+const UTF8_BOM: &[u8] = b"\xEF\xBB\xBF";
+const UTF16_LE_BOM: &[u8] = b"\xFF\xFE";
+const UTF16_BE_BOM: &[u8] = b"\xFE\xFF";
+
+/// Windows-1252 characters for bytes 0x80 to 0x9F; the five bytes it leaves
+/// undefined map to the control characters of the same value, as in Latin-1.
+const WINDOWS_1252_HIGH: [char; 32] = [
+    '\u{20AC}', '\u{81}', '\u{201A}', '\u{192}', '\u{201E}', '\u{2026}', '\u{2020}', '\u{2021}',
+    '\u{2C6}', '\u{2030}', '\u{160}', '\u{2039}', '\u{152}', '\u{8D}', '\u{17D}', '\u{8F}',
+    '\u{90}', '\u{2018}', '\u{2019}', '\u{201C}', '\u{201D}', '\u{2022}', '\u{2013}', '\u{2014}',
+    '\u{2DC}', '\u{2122}', '\u{161}', '\u{203A}', '\u{153}', '\u{9D}', '\u{17E}', '\u{178}',
+];
+
+/// A file's text, normalized, with what it takes to find its offsets in the
+/// original bytes.
+#[derive(Debug, Clone)]
+pub struct Decoded {
+    pub text: String,
+    pub encoding: Encoding,
+    bom_len: usize,
+    /// Offsets in `text` of the LFs that were CRLFs
+    crlf_at: Vec<usize>,
+}
+
+impl Decoded {
+    /// Whether the text is the file's bytes as they are.
+    pub fn is_verbatim(&self) -> bool {
+        self.encoding == Encoding::Utf8 && self.crlf_at.is_empty()
+    }
+
+    /// The offset in the file's bytes of `offset` in the normalized text.
+    pub fn original_offset(&self, offset: usize) -> usize {
+        if self.is_verbatim() {
+            return offset;
+        }
+        let chars: usize = self
+            .text
+            .char_indices()
+            .take_while(|&(index, _)| index < offset)
+            .map(|(_, c)| self.encoding.width(c))
+            .sum();
+        let crs = self.crlf_at.partition_point(|&lf| lf < offset);
+        self.bom_len + chars + crs * self.encoding.width('\r')
+    }
+
+    /// `span` with its byte offsets in the file's bytes.
+    pub fn original_span(&self, span: &Span) -> Span {
+        Span {
+            byte_start: self.original_offset(span.byte_start),
+            byte_end: self.original_offset(span.byte_end),
+            ..span.clone()
+        }
+    }
+}
+
+/// The UTF-16 encoding `prefix`, the start of a file, is in, if it looks
+/// like UTF-16 at all.
+pub fn detect_utf16(prefix: &[u8]) -> Option<Encoding> {
+    if prefix.starts_with(UTF16_LE_BOM) {
+        return Some(Encoding::Utf16Le);
+    }
+    if prefix.starts_with(UTF16_BE_BOM) {
+        return Some(Encoding::Utf16Be);
+    }
+    // ASCII text without a byte order mark: every high byte is zero, and
+    // the low bytes aren't
+    let pairs = prefix.chunks_exact(2);
+    if pairs.len() < 2 {
+        return None;
+    }
+    let (mut le, mut be) = (true, true);
+    for pair in pairs {
+        le &= pair[0] != 0 && pair[1] == 0;
+        be &= pair[0] == 0 && pair[1] != 0;
+    }
+    match (le, be) {
+        (true, _) => Some(Encoding::Utf16Le),
+        (_, true) => Some(Encoding::Utf16Be),
+        _ => None,
+    }
+}
+
+/// Decode a file's bytes and normalize its line endings.
+pub fn decode(bytes: &[u8]) -> Decoded {
+    let (encoding, text) = if let Some(encoding) = detect_utf16(bytes) {
+        let body = &bytes[encoding.bom_len(bytes)..];
+        let units = body.chunks_exact(2).map(|pair| match encoding {
+            Encoding::Utf16Be => u16::from_be_bytes([pair[0], pair[1]]),
+            _ => u16::from_le_bytes([pair[0], pair[1]]),
+        });
+        let text: String = char::decode_utf16(units)
+            .map(|c| c.unwrap_or(char::REPLACEMENT_CHARACTER))
+            .collect();
+        (encoding, text)
+    } else if let Some(body) = bytes.strip_prefix(UTF8_BOM)
+        && let Ok(text) = std::str::from_utf8(body)
+    {
+        (Encoding::Utf8Bom, text.to_string())
+    } else {
+        match std::str::from_utf8(bytes) {
+            Ok(text) => (Encoding::Utf8, text.to_string()),
+            Err(_) => (
+                Encoding::Windows1252,
+                bytes.iter().map(|&b| windows_1252(b)).collect(),
+            ),
+        }
+    };
+    let bom_len = encoding.bom_len(bytes);
+
+    if !text.contains("\r\n") {
+        return Decoded {
+            text,
+            encoding,
+            bom_len,
+            crlf_at: Vec::new(),
+        };
+    }
+    let mut normalized = String::with_capacity(text.len());
+    let mut crlf_at = Vec::new();
+    let mut rest = text.as_str();
+    while let Some(cr) = rest.find("\r\n") {
+        normalized.push_str(&rest[..cr]);
+        crlf_at.push(normalized.len());
+        normalized.push('\n');
+        rest = &rest[cr + 2..];
+    }
+    normalized.push_str(rest);
+    Decoded {
+        text: normalized,
+        encoding,
+        bom_len,
+        crlf_at,
+    }
+}
+
+fn windows_1252(byte: u8) -> char {
+    match byte {
+        0x80..=0x9F => WINDOWS_1252_HIGH[(byte - 0x80) as usize],
+        _ => byte as char,
+    }
+}
+
+/// The normalized text of the file at `path`.
+pub fn read_text(path: &Path) -> io::Result<String> {
+    Ok(decode(&fs::read(path)?).text)
+}
+
+/// `span`, from text read with [`read_text`], with its byte offsets in the
+/// bytes of the file at `path`; unchanged if the file can't be read.
+pub fn original_span(path: &Path, span: &Span) -> Span {
+    match fs::read(path) {
+        Ok(bytes) => decode(&bytes).original_span(span),
+        Err(_) => span.clone(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn utf16le(text: &str, bom: bool) -> Vec<u8> {
+        let mut bytes = if bom {
+            UTF16_LE_BOM.to_vec()
+        } else {
+            Vec::new()
+        };
+        bytes.extend(text.encode_utf16().flat_map(u16::to_le_bytes));
+        bytes
+    }
+
+    #[test]
+    fn files_are_decoded_to_utf8_with_lf_endings() {
+        let plain = decode(b"fn main() {}\n");
+        assert_eq!(plain.encoding, Encoding::Utf8);
+        assert!(plain.is_verbatim());
+
+        let bom = decode(b"\xEF\xBB\xBFfn main() {}\r\n");
+        assert_eq!(
+            (bom.encoding, bom.text.as_str()),
+            (Encoding::Utf8Bom, "fn main() {}\n")
+        );
+
+        let windows = utf16le("// caf\u{e9}\r\nint x;\r\n", true);
+        let decoded = decode(&windows);
+        assert_eq!(decoded.encoding, Encoding::Utf16Le);
+        assert_eq!(decoded.text, "// caf\u{e9}\nint x;\n");
+        assert_eq!(decode(&utf16le("int x;\n", false)).text, "int x;\n");
+        let big_endian: Vec<u8> = [UTF16_BE_BOM.to_vec(), b"\0x\0\n".to_vec()].concat();
+        assert_eq!(decode(&big_endian).text, "x\n");
+
+        // Latin-1 é, and a Windows-1252 curly quote
+        let latin = decode(b"# caf\xE9 \x93menu\x94\n");
+        assert_eq!(latin.encoding, Encoding::Windows1252);
+        assert_eq!(latin.text, "# caf\u{e9} \u{201C}menu\u{201D}\n");
+
+        // A lone CR isn't a line ending to merge
+        assert_eq!(decode(b"a\rb\r\nc").text, "a\rb\nc");
+        assert_eq!(detect_utf16(b"plain ascii"), None);
+    }
+
+    #[test]
+    fn offsets_map_back_to_the_original_bytes() {
+        // "ab\r\ncd": c is at 3 in the text and 4 in the file
+        let crlf = decode(b"ab\r\ncd\r\n");
+        assert_eq!(crlf.text, "ab\ncd\n");
+        assert_eq!(crlf.original_offset(3), 4);
+        assert_eq!(crlf.original_offset(6), 8);
+
+        let bom = decode(b"\xEF\xBB\xBFx = 1\n");
+        assert_eq!(bom.original_offset(0), 3);
+
+        // é is two bytes in the text, one in the file
+        let latin = decode(b"caf\xE9\r\nx");
+        assert_eq!(latin.text, "caf\u{e9}\nx");
+        assert_eq!(latin.original_offset(latin.text.len() - 1), 6);
+
+        let wide = decode(&utf16le("ab\r\nc", true));
+        let span = Span {
+            byte_start: 3,
+            byte_end: 4,
+            line_start: 2,
+            line_end: 2,
+        };
+        let original = wide.original_span(&span);
+        assert_eq!((original.byte_start, original.byte_end), (10, 12));
+        assert_eq!(original.line_start, 2);
+    }
+}
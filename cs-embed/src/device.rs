@@ -0,0 +1,176 @@
+//! Inference device selection for local (fastembed/ONNX Runtime) embedding.
+//!
+//! GPU support is opt-in at build time (`--features cuda` or `--features metal`).
+//! At runtime the device is picked automatically, or overridden via `--device`
+//! on the CLI or the `CS_DEVICE` environment variable.
+
+use anyhow::{Result, bail};
+use std::fmt;
+use std::str::FromStr;
+use std::sync::atomic::{AtomicU8, Ordering};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum Device {
+    /// Use a GPU when this build supports one, otherwise the CPU
+    #[default]
+    Auto,
+    Cpu,
+    /// NVIDIA GPU via the ONNX Runtime CUDA execution provider
+    Cuda,
+    /// Apple GPU/Neural Engine via the ONNX Runtime CoreML execution provider
+    Metal,
+}
+
+impl Device {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Device::Auto => "auto",
+            Device::Cpu => "cpu",
+            Device::Cuda => "cuda",
+            Device::Metal => "metal",
+        }
+    }
+
+    /// Whether this binary was compiled with support for the device.
+    pub fn is_compiled_in(&self) -> bool {
+        match self {
+            Device::Auto | Device::Cpu => true,
+            Device::Cuda => cfg!(feature = "cuda"),
+            Device::Metal => cfg!(all(feature = "metal", target_os = "macos")),
+        }
+    }
+
+    /// Resolve `Auto` to the concrete device this build will try first.
+    pub fn resolve(&self) -> Device {
+        match self {
+            Device::Auto if Device::Cuda.is_compiled_in() => Device::Cuda,
+            Device::Auto if Device::Metal.is_compiled_in() => Device::Metal,
+            Device::Auto => Device::Cpu,
+            other => *other,
+        }
+    }
+
+    fn to_u8(self) -> u8 {
+        match self {
+            Device::Auto => 0,
+            Device::Cpu => 1,
+            Device::Cuda => 2,
+            Device::Metal => 3,
+        }
+    }
+
+    fn from_u8(value: u8) -> Device {
+        match value {
+            1 => Device::Cpu,
+            2 => Device::Cuda,
+            3 => Device::Metal,
+            _ => Device::Auto,
+        }
+    }
+}
+
+impl fmt::Display for Device {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+impl FromStr for Device {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "auto" => Ok(Device::Auto),
+            "cpu" => Ok(Device::Cpu),
+            "cuda" | "gpu" => Ok(Device::Cuda),
+            "metal" | "coreml" | "mps" => Ok(Device::Metal),
+            other => bail!(
+                "Unknown device '{}'. Expected one of: auto, cpu, cuda, metal",
+                other
+            ),
+        }
+    }
+}
+
+static SELECTED_DEVICE: AtomicU8 = AtomicU8::new(u8::MAX);
+
+/// Select the device used by embedders created after this call.
+///
+/// Fails if the device was not compiled into this binary, so the user gets a
+/// clear message instead of a silent CPU fallback.
+pub fn set_device(device: Device) -> Result<()> {
+    if !device.is_compiled_in() {
+        bail!(
+            "cs was built without {} support. Rebuild with `cargo install cs-search --features {}` or use --device cpu",
+            device,
+            device.as_str()
+        );
+    }
+    SELECTED_DEVICE.store(device.to_u8(), Ordering::SeqCst);
+    Ok(())
+}
+
+/// The device embedders should use: explicit selection, then `CS_DEVICE`, then `Auto`.
+pub fn selected_device() -> Device {
+    match SELECTED_DEVICE.load(Ordering::SeqCst) {
+        u8::MAX => std::env::var("CS_DEVICE")
+            .ok()
+            .and_then(|value| value.parse::<Device>().ok())
+            .filter(|device| device.is_compiled_in())
+            .unwrap_or_default(),
+        value => Device::from_u8(value),
+    }
+}
+
+/// ONNX Runtime execution providers for the selected device.
+///
+/// ORT falls back to the CPU provider if a GPU provider fails to register
+/// (e.g. missing driver), so `Auto` is always safe.
+#[cfg(feature = "fastembed")]
+pub(crate) fn execution_providers(device: Device) -> Vec<fastembed::ExecutionProviderDispatch> {
+    #[allow(unused_mut)]
+    let mut providers = Vec::new();
+
+    match device.resolve() {
+        #[cfg(feature = "cuda")]
+        Device::Cuda => {
+            providers.push(ort::execution_providers::CUDAExecutionProvider::default().build());
+        }
+        #[cfg(all(feature = "metal", target_os = "macos"))]
+        Device::Metal => {
+            providers.push(ort::execution_providers::CoreMLExecutionProvider::default().build());
+        }
+        _ => {}
+    }
+
+    providers
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_device_names_and_aliases() {
+        assert_eq!("auto".parse::<Device>().unwrap(), Device::Auto);
+        assert_eq!("CPU".parse::<Device>().unwrap(), Device::Cpu);
+        assert_eq!("gpu".parse::<Device>().unwrap(), Device::Cuda);
+        assert_eq!("mps".parse::<Device>().unwrap(), Device::Metal);
+        assert!("tpu".parse::<Device>().is_err());
+    }
+
+    #[test]
+    fn cpu_is_always_available() {
+        assert!(Device::Cpu.is_compiled_in());
+        assert_eq!(Device::Cpu.resolve(), Device::Cpu);
+        assert!(set_device(Device::Cpu).is_ok());
+        assert_eq!(selected_device(), Device::Cpu);
+    }
+
+    #[test]
+    fn auto_resolves_to_compiled_device() {
+        let resolved = Device::Auto.resolve();
+        assert_ne!(resolved, Device::Auto);
+        assert!(resolved.is_compiled_in());
+    }
+}
@@ -68,7 +68,7 @@ impl JinaApiEmbedder {
         let api_key = std::env::var("JINA_API_KEY")
             .context("JINA_API_KEY environment variable not set. Get your key at: https://jina.ai/?sui=apikey")?;
 
-        let client = reqwest::Client::builder()
+        let client = cs_core::network::client_builder()?
             .timeout(std::time::Duration::from_secs(1800)) // 30 minutes for large indexing operations
             .build()
             .context("Failed to create HTTP client")?;
@@ -299,6 +299,10 @@ impl Embedder for JinaApiEmbedder {
         &self.model_name
     }
 
+    fn is_remote(&self) -> bool {
+        true
+    }
+
     fn embed(&mut self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
         if texts.is_empty() {
             return Ok(vec![]);
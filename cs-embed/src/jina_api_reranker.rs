@@ -59,7 +59,7 @@ impl JinaApiReranker {
         let api_key = std::env::var("JINA_API_KEY")
             .context("JINA_API_KEY environment variable not set. Get your key at: https://jina.ai/?sui=apikey")?;
 
-        let client = reqwest::Client::builder()
+        let client = cs_core::network::client_builder()?
             .timeout(std::time::Duration::from_secs(60)) // 1 minute for reranking
             .build()
             .context("Failed to create HTTP client")?;
@@ -1,9 +1,10 @@
 use anyhow::Result;
 
-#[cfg(feature = "fastembed")]
 use std::path::{Path, PathBuf};
 
+pub mod device;
 pub mod reranker;
+pub mod sparse;
 pub mod tokenizer;
 
 #[cfg(feature = "jina-api")]
@@ -12,7 +13,9 @@ pub mod jina_api;
 #[cfg(feature = "jina-api")]
 pub mod jina_api_reranker;
 
+pub use device::{Device, selected_device, set_device};
 pub use reranker::{RerankResult, Reranker, create_reranker, create_reranker_with_progress};
+pub use sparse::{SparseEmbedder, SparseVector, create_sparse_embedder};
 pub use tokenizer::TokenEstimator;
 
 #[cfg(feature = "jina-api")]
@@ -21,15 +24,44 @@ pub use jina_api::JinaApiEmbedder;
 #[cfg(feature = "jina-api")]
 pub use jina_api_reranker::JinaApiReranker;
 
+/// Version of the embedding pipeline (input preparation, pooling, normalisation).
+/// Stored in the index manifest; bump it whenever vectors produced by a new
+/// release are no longer comparable with vectors stored by an older one.
+pub const EMBEDDING_PIPELINE_VERSION: &str = "1";
+
 pub trait Embedder: Send + Sync {
     fn id(&self) -> &'static str;
     fn dim(&self) -> usize;
     fn model_name(&self) -> &str;
     fn embed(&mut self, texts: &[String]) -> Result<Vec<Vec<f32>>>;
+
+    /// Whether texts leave the machine (hosted embedding APIs).
+    fn is_remote(&self) -> bool {
+        false
+    }
 }
 
 pub type ModelDownloadCallback = Box<dyn Fn(&str) + Send + Sync>;
 
+/// Where local models are downloaded to.
+pub fn model_cache_dir() -> PathBuf {
+    cs_core::locations::cache_dir().join("models")
+}
+
+/// Whether local model `model_name` (e.g. `BAAI/bge-small-en-v1.5`) has
+/// been downloaded, so embedding works offline.
+pub fn is_model_cached(model_name: &str) -> bool {
+    model_cached_in(&model_cache_dir(), model_name)
+}
+
+fn model_cached_in(cache_dir: &Path, model_name: &str) -> bool {
+    // Either our own layout or the Hugging Face hub's
+    cache_dir.join(model_name.replace('/', "_")).exists()
+        || cache_dir
+            .join(format!("models--{}", model_name.replace('/', "--")))
+            .exists()
+}
+
 pub fn create_embedder(model_name: Option<&str>) -> Result<Box<dyn Embedder>> {
     create_embedder_with_progress(model_name, None)
 }
@@ -172,14 +204,14 @@ impl FastEmbedder {
         };
 
         // Configure permanent model cache directory
-        let model_cache_dir = Self::get_model_cache_dir()?;
+        let model_cache_dir = model_cache_dir();
         std::fs::create_dir_all(&model_cache_dir)?;
 
         if let Some(ref callback) = progress_callback {
             callback(&format!("Initializing model: {}", model_name));
 
             // Check if model already exists
-            let model_exists = Self::check_model_exists(&model_cache_dir, model_name);
+            let model_exists = model_cached_in(&model_cache_dir, model_name);
             if !model_exists {
                 callback(&format!(
                     "Downloading model {} to {}",
@@ -207,10 +239,16 @@ impl FastEmbedder {
             _ => 512, // Safe default
         };
 
+        let device = device::selected_device();
+        if let Some(ref callback) = progress_callback {
+            callback(&format!("Embedding device: {}", device.resolve()));
+        }
+
         let init_options = InitOptions::new(model.clone())
             .with_show_download_progress(progress_callback.is_some())
             .with_cache_dir(model_cache_dir)
-            .with_max_length(max_length);
+            .with_max_length(max_length)
+            .with_execution_providers(device::execution_providers(device));
 
         let embedding = TextEmbedding::try_new(init_options)?;
 
@@ -241,28 +279,6 @@ impl FastEmbedder {
             model_name: model_name.to_string(),
         })
     }
-
-    fn get_model_cache_dir() -> Result<PathBuf> {
-        // Use platform-appropriate cache directory
-        let cache_dir = if let Some(cache_home) = std::env::var_os("XDG_CACHE_HOME") {
-            PathBuf::from(cache_home).join("cs")
-        } else if let Some(home) = std::env::var_os("HOME") {
-            PathBuf::from(home).join(".cache").join("cs")
-        } else if let Some(appdata) = std::env::var_os("LOCALAPPDATA") {
-            PathBuf::from(appdata).join("cs").join("cache")
-        } else {
-            // Fallback to current directory if no home found
-            PathBuf::from(".cs_models")
-        };
-
-        Ok(cache_dir.join("models"))
-    }
-
-    fn check_model_exists(cache_dir: &Path, model_name: &str) -> bool {
-        // Simple heuristic - check if model directory exists
-        let model_dir = cache_dir.join(model_name.replace("/", "_"));
-        model_dir.exists()
-    }
 }
 
 #[cfg(feature = "fastembed")]
@@ -170,7 +170,10 @@ impl FastReranker {
 
         let init_options = RerankInitOptions::new(model.clone())
             .with_show_download_progress(progress_callback.is_some())
-            .with_cache_dir(model_cache_dir);
+            .with_cache_dir(model_cache_dir)
+            .with_execution_providers(crate::device::execution_providers(
+                crate::device::selected_device(),
+            ));
 
         let reranker = TextRerank::try_new(init_options)?;
 
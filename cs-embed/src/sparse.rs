@@ -0,0 +1,180 @@
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+
+/// SPLADE model used unless the index says otherwise.
+pub const DEFAULT_SPARSE_MODEL: &str = "prithivida/Splade_PP_en_v1";
+
+/// Weights of the vocabulary terms a text activates, most of the vocabulary
+/// being zero. Indices are sorted and unique.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct SparseVector {
+    pub indices: Vec<u32>,
+    pub values: Vec<f32>,
+}
+
+impl SparseVector {
+    /// Builds a vector from `(term, weight)` pairs in any order, summing
+    /// repeated terms and dropping zero weights.
+    pub fn from_pairs(pairs: impl IntoIterator<Item = (u32, f32)>) -> Self {
+        let mut pairs: Vec<(u32, f32)> = pairs.into_iter().collect();
+        pairs.sort_by_key(|&(index, _)| index);
+        let mut vector = Self::default();
+        for (index, value) in pairs {
+            if vector.indices.last() == Some(&index) {
+                *vector.values.last_mut().unwrap() += value;
+            } else {
+                vector.indices.push(index);
+                vector.values.push(value);
+            }
+        }
+        let (indices, values) = vector
+            .indices
+            .into_iter()
+            .zip(vector.values)
+            .filter(|&(_, value)| value != 0.0)
+            .unzip();
+        Self { indices, values }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.indices.is_empty()
+    }
+
+    pub fn dot(&self, other: &SparseVector) -> f32 {
+        let (mut i, mut j, mut sum) = (0, 0, 0.0);
+        while i < self.indices.len() && j < other.indices.len() {
+            match self.indices[i].cmp(&other.indices[j]) {
+                std::cmp::Ordering::Less => i += 1,
+                std::cmp::Ordering::Greater => j += 1,
+                std::cmp::Ordering::Equal => {
+                    sum += self.values[i] * other.values[j];
+                    i += 1;
+                    j += 1;
+                }
+            }
+        }
+        sum
+    }
+}
+
+/// A learned sparse embedder (SPLADE-style): each text becomes weights over
+/// the model's vocabulary, expanded to related terms, so rare identifiers
+/// and near-miss spellings still meet.
+pub trait SparseEmbedder: Send {
+    fn id(&self) -> &'static str;
+    fn model_name(&self) -> &str;
+    fn embed(&mut self, texts: &[String]) -> Result<Vec<SparseVector>>;
+}
+
+pub fn create_sparse_embedder(model_name: Option<&str>) -> Result<Box<dyn SparseEmbedder>> {
+    let model = model_name.unwrap_or(DEFAULT_SPARSE_MODEL);
+
+    #[cfg(feature = "fastembed")]
+    {
+        Ok(Box::new(FastSparseEmbedder::new(model)?))
+    }
+
+    #[cfg(not(feature = "fastembed"))]
+    {
+        Ok(Box::new(DummySparseEmbedder {
+            model_name: model.to_string(),
+        }))
+    }
+}
+
+pub struct DummySparseEmbedder {
+    model_name: String,
+}
+
+impl SparseEmbedder for DummySparseEmbedder {
+    fn id(&self) -> &'static str {
+        "dummy_sparse"
+    }
+
+    fn model_name(&self) -> &str {
+        &self.model_name
+    }
+
+    fn embed(&mut self, texts: &[String]) -> Result<Vec<SparseVector>> {
+        Ok(vec![SparseVector::default(); texts.len()])
+    }
+}
+
+#[cfg(feature = "fastembed")]
+pub struct FastSparseEmbedder {
+    model: fastembed::SparseTextEmbedding,
+    model_name: String,
+}
+
+#[cfg(feature = "fastembed")]
+impl FastSparseEmbedder {
+    pub fn new(model_name: &str) -> Result<Self> {
+        use fastembed::{SparseInitOptions, SparseModel, SparseTextEmbedding};
+
+        let model = match model_name {
+            DEFAULT_SPARSE_MODEL => SparseModel::SPLADEPPV1,
+            other => anyhow::bail!(
+                "Unknown sparse model '{}'; supported: {}",
+                other,
+                DEFAULT_SPARSE_MODEL
+            ),
+        };
+        let model_cache_dir = crate::model_cache_dir();
+        std::fs::create_dir_all(&model_cache_dir)?;
+        let init_options = SparseInitOptions::new(model)
+            .with_show_download_progress(false)
+            .with_cache_dir(model_cache_dir)
+            .with_execution_providers(crate::device::execution_providers(
+                crate::device::selected_device(),
+            ));
+        Ok(Self {
+            model: SparseTextEmbedding::try_new(init_options)?,
+            model_name: model_name.to_string(),
+        })
+    }
+}
+
+#[cfg(feature = "fastembed")]
+impl SparseEmbedder for FastSparseEmbedder {
+    fn id(&self) -> &'static str {
+        "fastembed_sparse"
+    }
+
+    fn model_name(&self) -> &str {
+        &self.model_name
+    }
+
+    fn embed(&mut self, texts: &[String]) -> Result<Vec<SparseVector>> {
+        let text_refs: Vec<&str> = texts.iter().map(|s| s.as_str()).collect();
+        let embeddings = self.model.embed(text_refs, None)?;
+        Ok(embeddings
+            .into_iter()
+            .map(|embedding| {
+                SparseVector::from_pairs(
+                    embedding
+                        .indices
+                        .into_iter()
+                        .map(|index| index as u32)
+                        .zip(embedding.values),
+                )
+            })
+            .collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn sparse_vectors_merge_terms_and_dot_on_shared_ones() {
+        let a = SparseVector::from_pairs([(7, 0.5), (2, 1.0), (7, 0.5), (9, 0.0)]);
+        assert_eq!(a.indices, vec![2, 7]);
+        assert_eq!(a.values, vec![1.0, 1.0]);
+
+        let b = SparseVector::from_pairs([(7, 2.0), (3, 4.0)]);
+        assert_eq!(a.dot(&b), 2.0);
+        assert_eq!(b.dot(&a), 2.0);
+        assert_eq!(a.dot(&SparseVector::default()), 0.0);
+    }
+}
@@ -0,0 +1,305 @@
+//! Local query analytics: `cs --query-stats`.
+//!
+//! With `query_analytics = true` in the user config (or
+//! `CS_QUERY_ANALYTICS=true`), every search of an index appends its query,
+//! mode, latency, result count and the directories of its top results to
+//! `.cs/analytics.jsonl`. Nothing is sent anywhere; the log is for index
+//! owners tuning chunking, boosts and stop symbols by what people actually
+//! look for, and what they don't find. A repository's `.cs.toml` can't turn
+//! recording on. Queries say what the code does as plainly as the code, so
+//! searches of an encrypted index aren't recorded.
+
+use anyhow::Result;
+use cs_core::{CcError, SearchMode, SearchOptions, SearchResult};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
+
+pub const ANALYTICS_FILE: &str = "analytics.jsonl";
+
+/// Top results whose directories count as the area a query searched.
+const AREA_RESULTS: usize = 3;
+/// Size past which the log is cut to its newer half.
+const MAX_LOG_BYTES: u64 = 8 * 1024 * 1024;
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct QueryEvent {
+    pub query: String,
+    pub mode: String,
+    pub latency_ms: u64,
+    pub results: usize,
+    /// Directories of the top results, relative to the index root
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub areas: Vec<String>,
+    pub recorded: u64,
+}
+
+impl QueryEvent {
+    pub fn new(
+        options: &SearchOptions,
+        index_root: &Path,
+        results: &[SearchResult],
+        latency: Duration,
+    ) -> Self {
+        let mut areas: Vec<String> = Vec::new();
+        for result in results.iter().take(AREA_RESULTS) {
+            let relative = result.file.strip_prefix(index_root).unwrap_or(&result.file);
+            let area = relative
+                .parent()
+                .map(cs_core::paths::to_relative_slash)
+                .filter(|dir| !dir.is_empty())
+                .unwrap_or_else(|| ".".to_string());
+            if !areas.contains(&area) {
+                areas.push(area);
+            }
+        }
+        Self {
+            query: options.query.trim().to_string(),
+            mode: mode_name(&options.mode).to_string(),
+            latency_ms: latency.as_millis() as u64,
+            results: results.len(),
+            areas,
+            recorded: SystemTime::now()
+                .duration_since(SystemTime::UNIX_EPOCH)
+                .map(|d| d.as_secs())
+                .unwrap_or(0),
+        }
+    }
+}
+
+fn mode_name(mode: &SearchMode) -> &'static str {
+    match mode {
+        SearchMode::Regex => "regex",
+        SearchMode::Lexical => "lexical",
+        SearchMode::Semantic => "semantic",
+        SearchMode::Hybrid => "hybrid",
+        SearchMode::Ast => "ast",
+    }
+}
+
+fn log_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(ANALYTICS_FILE)
+}
+
+/// Append `event` to the log of the index at `index_root`.
+pub fn record(index_root: &Path, event: &QueryEvent) -> Result<()> {
+    let path = log_path(index_root);
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    if fs::metadata(&path).is_ok_and(|meta| meta.len() > MAX_LOG_BYTES) {
+        let events = load(index_root)?;
+        let kept = &events[events.len() / 2..];
+        let mut data = Vec::new();
+        for event in kept {
+            serde_json::to_writer(&mut data, event)?;
+            data.push(b'\n');
+        }
+        fs::write(&path, data)?;
+    }
+    let mut line = serde_json::to_vec(event)?;
+    line.push(b'\n');
+    OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)?
+        .write_all(&line)?;
+    Ok(())
+}
+
+/// Record a search of `options.query` if the index covering `options.path`
+/// exists and isn't encrypted; searches outside an index have nothing to
+/// tune.
+pub fn record_search(
+    options: &SearchOptions,
+    results: &[SearchResult],
+    latency: Duration,
+) -> Result<()> {
+    let Some(index_root) = super::find_nearest_index_root(&options.path) else {
+        return Ok(());
+    };
+    if cs_index::encryption::is_encrypted(&index_root) {
+        return Ok(());
+    }
+    record(
+        &index_root,
+        &QueryEvent::new(options, &index_root, results, latency),
+    )
+}
+
+/// Every recorded event, oldest first. Lines that don't parse (a write cut
+/// short) are skipped.
+pub fn load(index_root: &Path) -> Result<Vec<QueryEvent>> {
+    let path = log_path(index_root);
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+    Ok(fs::read_to_string(&path)?
+        .lines()
+        .filter_map(|line| serde_json::from_str(line).ok())
+        .collect())
+}
+
+#[derive(Debug, Clone, Serialize, PartialEq)]
+pub struct Count {
+    pub name: String,
+    pub count: usize,
+}
+
+#[derive(Debug, Clone, Default, Serialize, PartialEq)]
+pub struct QueryReport {
+    pub queries: usize,
+    pub first_recorded: Option<u64>,
+    pub last_recorded: Option<u64>,
+    pub latency_p50_ms: u64,
+    pub latency_p95_ms: u64,
+    pub latency_max_ms: u64,
+    pub by_mode: Vec<Count>,
+    pub zero_result_queries: usize,
+    /// Queries that found nothing, most repeated first
+    pub zero_result: Vec<Count>,
+    pub top_queries: Vec<Count>,
+    /// Directories of top results, most searched first
+    pub top_areas: Vec<Count>,
+}
+
+/// Aggregate `events`, listing up to `limit` of each ranking.
+pub fn report(events: &[QueryEvent], limit: usize) -> QueryReport {
+    if events.is_empty() {
+        return QueryReport::default();
+    }
+    let mut latencies: Vec<u64> = events.iter().map(|e| e.latency_ms).collect();
+    latencies.sort_unstable();
+    let percentile = |p: usize| latencies[(latencies.len() * p).div_ceil(100).max(1) - 1];
+
+    let mut by_mode = HashMap::new();
+    let mut zero_result = HashMap::new();
+    let mut queries = HashMap::new();
+    let mut areas = HashMap::new();
+    for event in events {
+        *by_mode.entry(event.mode.clone()).or_default() += 1;
+        let query = normalize_query(&event.query);
+        if event.results == 0 {
+            *zero_result.entry(query.clone()).or_default() += 1;
+        }
+        *queries.entry(query).or_default() += 1;
+        for area in &event.areas {
+            *areas.entry(area.clone()).or_default() += 1;
+        }
+    }
+
+    QueryReport {
+        queries: events.len(),
+        first_recorded: events.iter().map(|e| e.recorded).min(),
+        last_recorded: events.iter().map(|e| e.recorded).max(),
+        latency_p50_ms: percentile(50),
+        latency_p95_ms: percentile(95),
+        latency_max_ms: latencies[latencies.len() - 1],
+        by_mode: ranked(by_mode, usize::MAX),
+        zero_result_queries: events.iter().filter(|e| e.results == 0).count(),
+        zero_result: ranked(zero_result, limit),
+        top_queries: ranked(queries, limit),
+        top_areas: ranked(areas, limit),
+    }
+}
+
+/// The same query typed with different case or spacing counts once.
+pub fn normalize_query(query: &str) -> String {
+    query
+        .split_whitespace()
+        .map(str::to_lowercase)
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+fn ranked(counts: HashMap<String, usize>, limit: usize) -> Vec<Count> {
+    let mut counts: Vec<Count> = counts
+        .into_iter()
+        .map(|(name, count)| Count { name, count })
+        .collect();
+    counts.sort_by(|a, b| b.count.cmp(&a.count).then_with(|| a.name.cmp(&b.name)));
+    counts.truncate(limit);
+    counts
+}
+
+/// The report of the index covering `search_path`. Returns the index root
+/// too.
+pub fn query_report(search_path: &Path, limit: usize) -> Result<(PathBuf, QueryReport)> {
+    let index_root = super::find_nearest_index_root(search_path).ok_or_else(|| {
+        CcError::Index(format!(
+            "No index found for {}. Run 'cs --index' first.",
+            search_path.display()
+        ))
+    })?;
+    let events = load(&index_root)?;
+    Ok((index_root, report(&events, limit)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn event(query: &str, latency_ms: u64, results: usize, areas: &[&str]) -> QueryEvent {
+        QueryEvent {
+            query: query.to_string(),
+            mode: "semantic".to_string(),
+            latency_ms,
+            results,
+            areas: areas.iter().map(|a| a.to_string()).collect(),
+            recorded: latency_ms,
+        }
+    }
+
+    #[test]
+    fn report_ranks_zero_result_queries_and_areas() {
+        let mut events = vec![
+            event("retry budget", 40, 0, &[]),
+            event("Retry  budget", 60, 0, &[]),
+            event("token refresh", 20, 5, &["src/auth", "src"]),
+            event("session store", 900, 3, &["src/auth"]),
+        ];
+        events[3].mode = "lexical".to_string();
+        let report = report(&events, 10);
+
+        assert_eq!(report.queries, 4);
+        assert_eq!(report.zero_result_queries, 2);
+        assert_eq!(
+            report.zero_result,
+            [Count {
+                name: "retry budget".to_string(),
+                count: 2
+            }]
+        );
+        assert_eq!(report.top_areas[0].name, "src/auth");
+        assert_eq!(report.top_areas[0].count, 2);
+        assert_eq!(report.by_mode[0].name, "semantic");
+        assert_eq!(report.latency_p50_ms, 40);
+        assert_eq!(report.latency_max_ms, 900);
+        assert_eq!(
+            (report.first_recorded, report.last_recorded),
+            (Some(20), Some(900))
+        );
+    }
+
+    #[test]
+    fn events_roundtrip_through_the_log() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        record(root, &event("parse config", 12, 1, &["."])).unwrap();
+        record(root, &event("load manifest", 30, 2, &[])).unwrap();
+        // A line cut short by a crash doesn't lose the others
+        let path = log_path(root);
+        let mut data = fs::read_to_string(&path).unwrap();
+        data.push_str("{\"query\":\"trunc");
+        fs::write(&path, data).unwrap();
+
+        let events = load(root).unwrap();
+        assert_eq!(events.len(), 2);
+        assert_eq!(events[0].query, "parse config");
+        assert_eq!(events[0].areas, ["."]);
+    }
+}
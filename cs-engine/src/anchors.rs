@@ -0,0 +1,242 @@
+//! Result ids that survive edits: `src/auth.rs#3f9a2b1c0d4e5f67+4` names
+//! line 4 of the chunk of `src/auth.rs` whose text hashes to `3f9a…`, rather
+//! than a line number that every edit above it shifts.
+//!
+//! Anchors are printed with JSON results and accepted by `--resolve`,
+//! `--feedback` and `--note-add`. Resolving re-chunks the file as it is now
+//! and finds the chunk with the same hash, wherever it has moved to within
+//! the file, or in the file it was renamed to (see `cs_index::renames`);
+//! once that code itself changes the anchor is stale, and says so instead
+//! of pointing at whatever took its place.
+
+use cs_core::SearchResult;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+/// Hex digits of the chunk hash kept in an anchor.
+const HASH_LEN: usize = 16;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Anchor {
+    /// Relative to the index root, with `/` separators
+    pub path: String,
+    pub chunk_hash: String,
+    /// Lines from the start of the chunk to the anchored line
+    pub offset: usize,
+}
+
+impl fmt::Display for Anchor {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}#{}+{}", self.path, self.chunk_hash, self.offset)
+    }
+}
+
+impl std::str::FromStr for Anchor {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = || {
+            format!(
+                "'{}' is not an anchor like src/auth.rs#3f9a2b1c0d4e5f67+4",
+                s
+            )
+        };
+        let (path, rest) = s.trim().rsplit_once('#').ok_or_else(invalid)?;
+        let (chunk_hash, offset) = rest.split_once('+').ok_or_else(invalid)?;
+        if path.is_empty()
+            || chunk_hash.len() != HASH_LEN
+            || !chunk_hash.bytes().all(|b| b.is_ascii_hexdigit())
+        {
+            return Err(invalid());
+        }
+        Ok(Anchor {
+            path: path.replace('\\', "/").trim_start_matches("./").to_string(),
+            chunk_hash: chunk_hash.to_ascii_lowercase(),
+            offset: offset.parse().map_err(|_| invalid())?,
+        })
+    }
+}
+
+/// Where an anchor points in the current tree.
+#[derive(Debug, Clone, Serialize)]
+pub struct ResolvedAnchor {
+    pub file: PathBuf,
+    pub line: usize,
+    /// Lines of the anchored chunk
+    pub chunk_start: usize,
+    pub chunk_end: usize,
+}
+
+struct HashedChunk {
+    line_start: usize,
+    line_end: usize,
+    hash: String,
+}
+
+/// Computes and resolves anchors, chunking each file once.
+pub struct AnchorLookup {
+    index_root: PathBuf,
+    /// Chunks per file as it is now; `None` when it can't be read
+    chunks: HashMap<PathBuf, Option<Vec<HashedChunk>>>,
+}
+
+impl AnchorLookup {
+    pub fn new(index_root: &Path) -> Self {
+        Self {
+            index_root: cs_core::paths::canonicalize_lossy(index_root),
+            chunks: HashMap::new(),
+        }
+    }
+
+    /// The anchor of `result`: its start line in the innermost chunk holding it.
+    pub fn anchor_for(&mut self, result: &SearchResult) -> Option<Anchor> {
+        self.anchor_at(&result.file, result.span.line_start)
+    }
+
+    /// The anchor of `line` of `file`, in the innermost chunk holding it.
+    pub fn anchor_at(&mut self, file: &Path, line: usize) -> Option<Anchor> {
+        let file = cs_core::paths::canonicalize_lossy(file);
+        let path =
+            cs_core::paths::to_relative_slash(file.strip_prefix(&self.index_root).unwrap_or(&file));
+        let chunk = self
+            .chunks_of(&file)?
+            .iter()
+            .filter(|chunk| chunk.line_start <= line && line <= chunk.line_end)
+            .min_by_key(|chunk| chunk.line_end - chunk.line_start)?;
+        Some(Anchor {
+            path,
+            chunk_hash: chunk.hash.clone(),
+            offset: line - chunk.line_start,
+        })
+    }
+
+    /// Where `anchor` points now, in its file or where the file was renamed
+    /// to, or `None` if its code has changed or its file is gone.
+    pub fn resolve(&mut self, anchor: &Anchor) -> Option<ResolvedAnchor> {
+        let mut file = self.index_root.join(&anchor.path);
+        if !file.is_file()
+            && let Some(renamed) =
+                cs_index::renames::RenameLog::load(&self.index_root).current_path(&anchor.path)
+        {
+            file = self.index_root.join(renamed);
+        }
+        let chunk = self
+            .chunks_of(&file)?
+            .iter()
+            .find(|chunk| chunk.hash == anchor.chunk_hash)?;
+        Some(ResolvedAnchor {
+            line: (chunk.line_start + anchor.offset).min(chunk.line_end),
+            chunk_start: chunk.line_start,
+            chunk_end: chunk.line_end,
+            file,
+        })
+    }
+
+    fn chunks_of(&mut self, file: &Path) -> Option<&Vec<HashedChunk>> {
+        self.chunks
+            .entry(file.to_path_buf())
+            .or_insert_with(|| hashed_chunks(file))
+            .as_ref()
+    }
+}
+
+/// Resolve `anchor` against the index at `index_root`, with a message
+/// saying why when it can't be.
+pub fn resolve_anchor(index_root: &Path, anchor: &str) -> anyhow::Result<ResolvedAnchor> {
+    let anchor: Anchor = anchor.parse().map_err(anyhow::Error::msg)?;
+    AnchorLookup::new(index_root)
+        .resolve(&anchor)
+        .ok_or_else(|| {
+            anyhow::anyhow!(
+                "Anchor {} is stale: {} no longer has that code",
+                anchor,
+                anchor.path
+            )
+        })
+}
+
+/// Chunks of `file` with their hashes. The chunking is the same whatever the
+/// index's model, so anchors don't depend on it.
+fn hashed_chunks(file: &Path) -> Option<Vec<HashedChunk>> {
+    let content = cs_core::text::read_text(file).ok()?;
+    let chunks = cs_chunk::chunk_text(&content, cs_core::Language::from_path(file)).ok()?;
+    Some(
+        chunks
+            .iter()
+            .map(|chunk| HashedChunk {
+                line_start: chunk.span.line_start,
+                line_end: chunk.span.line_end,
+                hash: chunk_hash(&chunk.text),
+            })
+            .collect(),
+    )
+}
+
+pub(crate) fn chunk_hash(text: &str) -> String {
+    // A checkout with CRLF line endings holds the same code
+    let text = text.replace("\r\n", "\n");
+    blake3::hash(text.as_bytes()).to_hex()[..HASH_LEN].to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+
+    #[test]
+    fn anchors_roundtrip_and_reject_locations() {
+        let anchor: Anchor = "./src/auth.rs#3F9A2B1C0D4E5F67+4".parse().unwrap();
+        assert_eq!(anchor.path, "src/auth.rs");
+        assert_eq!(anchor.offset, 4);
+        assert_eq!(anchor.to_string(), "src/auth.rs#3f9a2b1c0d4e5f67+4");
+
+        assert!("src/auth.rs:42".parse::<Anchor>().is_err());
+        assert!("src/auth.rs#abc+1".parse::<Anchor>().is_err());
+        assert!("src/auth.rs#3f9a2b1c0d4e5f67+x".parse::<Anchor>().is_err());
+    }
+
+    #[test]
+    fn anchors_follow_code_that_moved() {
+        let temp_dir = TempDir::new().unwrap();
+        let file = temp_dir.path().join("lib.rs");
+        let refresh = "fn refresh_token(token: &str) -> String {\n    let fresh = token.trim();\n    fresh.to_string()\n}\n";
+        fs::write(&file, format!("fn login() {{}}\n\n{}", refresh)).unwrap();
+
+        let result = SearchResult {
+            file: file.clone(),
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 0,
+                line_start: 4,
+                line_end: 4,
+            },
+            score: 1.0,
+            preview: String::new(),
+            lang: None,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        };
+        let anchor = AnchorLookup::new(temp_dir.path())
+            .anchor_for(&result)
+            .unwrap();
+        assert_eq!(anchor.path, "lib.rs");
+        assert_eq!(anchor.offset, 1);
+
+        // Code added above shifts the function down three lines
+        fs::write(
+            &file,
+            format!("use std::fmt;\n\n\nfn login() {{}}\n\n{}", refresh),
+        )
+        .unwrap();
+        let resolved = resolve_anchor(temp_dir.path(), &anchor.to_string()).unwrap();
+        assert_eq!((resolved.line, resolved.chunk_start), (7, 6));
+
+        // Once the function itself changes, the anchor is stale
+        fs::write(&file, refresh.replace("trim", "trim_end")).unwrap();
+        assert!(resolve_anchor(temp_dir.path(), &anchor.to_string()).is_err());
+    }
+}
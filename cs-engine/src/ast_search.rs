@@ -54,10 +54,7 @@ pub async fn ast_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
     cmd.arg("run");
 
     // Pattern (use ast_pattern if set, otherwise use query)
-    let pattern = options
-        .ast_pattern
-        .as_ref()
-        .unwrap_or(&options.query);
+    let pattern = options.ast_pattern.as_ref().unwrap_or(&options.query);
     cmd.arg("--pattern").arg(pattern);
 
     // JSON output
@@ -0,0 +1,338 @@
+//! `cs --bench-latency`: time a fixed set of queries over the local index,
+//! for numbers that can be kept and compared between releases or machines.
+//!
+//! Every query runs once untimed, which brings the index up to date, loads
+//! the model and warms the page cache. Then the whole set runs `runs` times
+//! with the query cache off and the index left as it is. The report is plain
+//! JSON: kept as a baseline, a later report is checked against it and
+//! regresses when a latency percentile or the throughput is more than a
+//! given percentage worse.
+//!
+//! Queries come from a text file, one per line (`#` starts a comment), or
+//! from a golden set (`.csgolden.toml`, see [`super::eval`]).
+
+use anyhow::{Context, Result};
+use cs_core::SearchOptions;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::Path;
+use std::time::Instant;
+
+/// Timed passes over the queries unless `--bench-runs` says otherwise.
+pub const DEFAULT_RUNS: usize = 5;
+
+/// Search latency over every timed search, in milliseconds.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Serialize, Deserialize)]
+pub struct Latency {
+    pub mean_ms: f64,
+    pub p50_ms: f64,
+    pub p90_ms: f64,
+    pub p99_ms: f64,
+    pub max_ms: f64,
+}
+
+impl Latency {
+    fn of(samples: &mut [f64]) -> Self {
+        if samples.is_empty() {
+            return Self::default();
+        }
+        samples.sort_by(f64::total_cmp);
+        // Nearest rank
+        let percentile = |p: f64| {
+            let rank = (p / 100.0 * samples.len() as f64).ceil() as usize;
+            samples[rank.clamp(1, samples.len()) - 1]
+        };
+        Latency {
+            mean_ms: samples.iter().sum::<f64>() / samples.len() as f64,
+            p50_ms: percentile(50.0),
+            p90_ms: percentile(90.0),
+            p99_ms: percentile(99.0),
+            max_ms: samples[samples.len() - 1],
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LatencyReport {
+    /// Version of cs that measured
+    pub version: String,
+    /// Search mode: semantic, lexical, hybrid or regex
+    pub mode: String,
+    /// Query model asked for; unset for the index's own
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub model: Option<String>,
+    pub queries: usize,
+    pub runs: usize,
+    pub latency: Latency,
+    /// Searches completed per second over the timed passes
+    pub queries_per_sec: f64,
+}
+
+impl LatencyReport {
+    pub fn load(path: &Path) -> Result<Self> {
+        let content = fs::read_to_string(path)
+            .with_context(|| format!("Failed to read baseline {}", path.display()))?;
+        serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse baseline {}", path.display()))
+    }
+}
+
+/// How one number moved against the baseline.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Change {
+    pub metric: &'static str,
+    pub baseline: f64,
+    pub current: f64,
+    /// Percent worse than the baseline; negative when better
+    pub worse_by: f64,
+    /// Worse by more than the allowed percentage
+    pub regressed: bool,
+}
+
+/// Compare `current` with `baseline`, a change of more than `fail_above`
+/// percent for the worse counting as a regression.
+pub fn compare(baseline: &LatencyReport, current: &LatencyReport, fail_above: f64) -> Vec<Change> {
+    // (metric, baseline, current, whether higher is worse)
+    let metrics = [
+        (
+            "mean_ms",
+            baseline.latency.mean_ms,
+            current.latency.mean_ms,
+            true,
+        ),
+        (
+            "p50_ms",
+            baseline.latency.p50_ms,
+            current.latency.p50_ms,
+            true,
+        ),
+        (
+            "p90_ms",
+            baseline.latency.p90_ms,
+            current.latency.p90_ms,
+            true,
+        ),
+        (
+            "p99_ms",
+            baseline.latency.p99_ms,
+            current.latency.p99_ms,
+            true,
+        ),
+        (
+            "queries_per_sec",
+            baseline.queries_per_sec,
+            current.queries_per_sec,
+            false,
+        ),
+    ];
+    metrics
+        .into_iter()
+        .map(|(metric, before, now, higher_is_worse)| {
+            let worse_by = if before > 0.0 {
+                let change = (now - before) / before * 100.0;
+                if higher_is_worse { change } else { -change }
+            } else {
+                0.0
+            };
+            Change {
+                metric,
+                baseline: before,
+                current: now,
+                worse_by,
+                regressed: worse_by > fail_above,
+            }
+        })
+        .collect()
+}
+
+/// Why `current` may not be comparable with `baseline`, if it may not.
+pub fn mismatch(baseline: &LatencyReport, current: &LatencyReport) -> Option<String> {
+    if baseline.mode != current.mode {
+        Some(format!(
+            "the baseline timed {} searches, this run {}",
+            baseline.mode, current.mode
+        ))
+    } else if baseline.model != current.model {
+        Some(format!(
+            "the baseline used model {}, this run {}",
+            baseline.model.as_deref().unwrap_or("(index default)"),
+            current.model.as_deref().unwrap_or("(index default)")
+        ))
+    } else if baseline.queries != current.queries {
+        Some(format!(
+            "the baseline timed {} queries, this run {}",
+            baseline.queries, current.queries
+        ))
+    } else {
+        None
+    }
+}
+
+/// A percentage such as `20%` or `20`.
+pub fn parse_percent(s: &str) -> Result<f64> {
+    let trimmed = s.trim();
+    let number = trimmed.strip_suffix('%').unwrap_or(trimmed).trim();
+    match number.parse::<f64>() {
+        Ok(percent) if percent.is_finite() && percent >= 0.0 => Ok(percent),
+        _ => anyhow::bail!("'{}' is not a percentage such as 20%", s),
+    }
+}
+
+/// The queries in `path`: a golden set's when it's a `.toml` file,
+/// otherwise one per non-empty line.
+pub fn load_queries(path: &Path) -> Result<Vec<String>> {
+    if path.extension().is_some_and(|ext| ext == "toml") {
+        let golden = super::eval::load_golden_set(path)?;
+        return Ok(golden.into_iter().map(|query| query.query).collect());
+    }
+    let content = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read queries from {}", path.display()))?;
+    let queries: Vec<String> = content
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(str::to_string)
+        .collect();
+    if queries.is_empty() {
+        anyhow::bail!("No queries in {}", path.display());
+    }
+    Ok(queries)
+}
+
+/// Run every query once untimed, then `runs` times timed, with `options`.
+pub async fn measure(
+    queries: &[String],
+    options: &SearchOptions,
+    runs: usize,
+) -> Result<LatencyReport> {
+    if queries.is_empty() {
+        anyhow::bail!("No queries to time");
+    }
+    let runs = runs.max(1);
+    let query_options = |query: &str, no_index_update| SearchOptions {
+        query: query.to_string(),
+        // Every timed search does the whole search
+        no_query_cache: true,
+        no_index_update: options.no_index_update || no_index_update,
+        ..options.clone()
+    };
+
+    for query in queries {
+        super::search(&query_options(query, false)).await?;
+    }
+
+    let mut samples = Vec::with_capacity(queries.len() * runs);
+    let started = Instant::now();
+    for _ in 0..runs {
+        for query in queries {
+            let options = query_options(query, true);
+            let searched = Instant::now();
+            super::search(&options).await?;
+            samples.push(searched.elapsed().as_secs_f64() * 1000.0);
+        }
+    }
+    let elapsed = started.elapsed().as_secs_f64();
+
+    Ok(LatencyReport {
+        version: env!("CARGO_PKG_VERSION").to_string(),
+        mode: format!("{:?}", options.mode).to_lowercase(),
+        model: options.embedding_model.clone(),
+        queries: queries.len(),
+        runs,
+        queries_per_sec: samples.len() as f64 / elapsed.max(f64::EPSILON),
+        latency: Latency::of(&mut samples),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn report(p50_ms: f64, p99_ms: f64, queries_per_sec: f64) -> LatencyReport {
+        LatencyReport {
+            version: "0.0.0".to_string(),
+            mode: "semantic".to_string(),
+            model: None,
+            queries: 10,
+            runs: 5,
+            latency: Latency {
+                mean_ms: p50_ms,
+                p50_ms,
+                p90_ms: p99_ms,
+                p99_ms,
+                max_ms: p99_ms,
+            },
+            queries_per_sec,
+        }
+    }
+
+    #[test]
+    fn percentiles_are_nearest_rank() {
+        let mut samples: Vec<f64> = (1..=100).rev().map(f64::from).collect();
+        let latency = Latency::of(&mut samples);
+        assert_eq!(latency.p50_ms, 50.0);
+        assert_eq!(latency.p90_ms, 90.0);
+        assert_eq!(latency.p99_ms, 99.0);
+        assert_eq!(latency.max_ms, 100.0);
+        assert_eq!(latency.mean_ms, 50.5);
+
+        let one = Latency::of(&mut [7.0]);
+        assert_eq!((one.p50_ms, one.p99_ms), (7.0, 7.0));
+        assert_eq!(Latency::of(&mut [0.0; 0]), Latency::default());
+    }
+
+    #[test]
+    fn regressions_are_changes_for_the_worse_past_the_limit() {
+        let baseline = report(40.0, 100.0, 25.0);
+        let current = report(44.0, 130.0, 18.0);
+        let changes = compare(&baseline, &current, 20.0);
+        let regressed: Vec<_> = changes
+            .iter()
+            .filter(|change| change.regressed)
+            .map(|change| change.metric)
+            .collect();
+        assert_eq!(regressed, ["p90_ms", "p99_ms", "queries_per_sec"]);
+        let p50 = changes.iter().find(|c| c.metric == "p50_ms").unwrap();
+        assert!((p50.worse_by - 10.0).abs() < 1e-9);
+
+        // Faster is never a regression
+        let faster = compare(&baseline, &report(20.0, 50.0, 50.0), 0.0);
+        assert!(faster.iter().all(|change| !change.regressed));
+        assert!(faster.iter().all(|change| change.worse_by < 0.0));
+
+        let json = serde_json::to_string(&baseline).unwrap();
+        assert_eq!(
+            serde_json::from_str::<LatencyReport>(&json).unwrap(),
+            baseline
+        );
+        assert_eq!(mismatch(&baseline, &current), None);
+        let lexical = LatencyReport {
+            mode: "lexical".to_string(),
+            ..current
+        };
+        assert!(mismatch(&baseline, &lexical).is_some());
+    }
+
+    #[test]
+    fn percentages_and_query_files_parse() {
+        assert_eq!(parse_percent("20%").unwrap(), 20.0);
+        assert_eq!(parse_percent(" 7.5 ").unwrap(), 7.5);
+        assert!(parse_percent("-5%").is_err());
+        assert!(parse_percent("fast").is_err());
+
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("queries.txt");
+        fs::write(
+            &path,
+            "# hot paths\nretry with backoff\n\n  parse config  \n",
+        )
+        .unwrap();
+        assert_eq!(
+            load_queries(&path).unwrap(),
+            ["retry with backoff", "parse config"]
+        );
+        fs::write(&path, "# nothing\n").unwrap();
+        assert!(load_queries(&path).is_err());
+    }
+}
@@ -0,0 +1,246 @@
+//! Query-time boosting by path, language or recency.
+//!
+//! Rules come from `[[boost]]` tables in the user config (`cs --config`) and in
+//! a `.csboost.toml` committed at the index root, so a team can share them:
+//!
+//! ```toml
+//! [[boost]]
+//! path = "internal/**"
+//! factor = 1.2
+//!
+//! [[boost]]
+//! path = "**/generated/**"
+//! factor = 0.5
+//!
+//! [[boost]]
+//! modified_within_days = 30
+//! factor = 1.1
+//! ```
+
+use anyhow::Result;
+use cs_core::{BoostRule, CcError, SearchResult};
+use globset::{Glob, GlobMatcher};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::fs;
+use std::path::Path;
+use std::time::{Duration, SystemTime};
+
+pub const BOOST_FILE: &str = ".csboost.toml";
+
+const SECONDS_PER_DAY: u64 = 24 * 60 * 60;
+
+#[derive(Debug, Default, Deserialize)]
+struct BoostFile {
+    #[serde(default)]
+    boost: Vec<BoostRule>,
+}
+
+/// Rules from `.csboost.toml` at `index_root`, or none if the file is absent.
+pub fn load_repo_boost_rules(index_root: &Path) -> Result<Vec<BoostRule>> {
+    let path = index_root.join(BOOST_FILE);
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+    let content = fs::read_to_string(&path)?;
+    let file: BoostFile = toml::from_str(&content)
+        .map_err(|e| CcError::Search(format!("Failed to parse {}: {}", path.display(), e)))?;
+    Ok(file.boost)
+}
+
+struct CompiledRule<'a> {
+    rule: &'a BoostRule,
+    path: Option<GlobMatcher>,
+    max_age: Option<Duration>,
+}
+
+impl CompiledRule<'_> {
+    fn matches(
+        &self,
+        relative: &Path,
+        result: &SearchResult,
+        modified: &mut HashMap<std::path::PathBuf, Option<SystemTime>>,
+    ) -> bool {
+        if self.rule.path.is_none()
+            && self.rule.language.is_none()
+            && self.rule.modified_within_days.is_none()
+        {
+            return false;
+        }
+        if let Some(ref matcher) = self.path
+            && !matcher.is_match(relative)
+        {
+            return false;
+        }
+        if let Some(ref language) = self.rule.language
+            && !result
+                .lang
+                .is_some_and(|lang| lang.to_string().eq_ignore_ascii_case(language))
+        {
+            return false;
+        }
+        if let Some(max_age) = self.max_age {
+            let mtime = *modified
+                .entry(result.file.clone())
+                .or_insert_with(|| fs::metadata(&result.file).and_then(|m| m.modified()).ok());
+            let recent = mtime
+                .and_then(|t| SystemTime::now().duration_since(t).ok())
+                .is_some_and(|age| age <= max_age);
+            if !recent {
+                return false;
+            }
+        }
+        true
+    }
+}
+
+/// Multiply the score of every result by each matching rule's factor, then
+/// re-sort. Returns the number of results whose score changed.
+pub fn apply_boosts(
+    rules: &[BoostRule],
+    index_root: &Path,
+    results: &mut [SearchResult],
+) -> Result<usize> {
+    if rules.is_empty() || results.is_empty() {
+        return Ok(0);
+    }
+
+    let compiled = rules
+        .iter()
+        .map(|rule| {
+            if !rule.factor.is_finite() || rule.factor <= 0.0 {
+                return Err(CcError::Search(format!(
+                    "Boost factor must be a positive number, got {}",
+                    rule.factor
+                )));
+            }
+            let path = rule
+                .path
+                .as_deref()
+                .map(|pattern| {
+                    Glob::new(pattern)
+                        .map(|glob| glob.compile_matcher())
+                        .map_err(|e| {
+                            CcError::Search(format!("Invalid boost path '{}': {}", pattern, e))
+                        })
+                })
+                .transpose()?;
+            Ok(CompiledRule {
+                rule,
+                path,
+                max_age: rule
+                    .modified_within_days
+                    .map(|days| Duration::from_secs(days * SECONDS_PER_DAY)),
+            })
+        })
+        .collect::<std::result::Result<Vec<_>, CcError>>()?;
+
+    let mut modified = HashMap::new();
+    let mut adjusted = 0;
+    for result in results.iter_mut() {
+        let relative = result
+            .file
+            .strip_prefix(index_root)
+            .unwrap_or(&result.file)
+            .to_path_buf();
+        let relative = relative
+            .strip_prefix(".")
+            .unwrap_or(&relative)
+            .to_path_buf();
+
+        let factor: f32 = compiled
+            .iter()
+            .filter(|rule| rule.matches(&relative, result, &mut modified))
+            .map(|rule| rule.rule.factor)
+            .product();
+        if factor != 1.0 {
+            result.score *= factor;
+            adjusted += 1;
+        }
+    }
+
+    if adjusted > 0 {
+        results.sort_by(SearchResult::rank_cmp);
+    }
+    Ok(adjusted)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+    use tempfile::TempDir;
+
+    fn rule(path: Option<&str>, language: Option<&str>, factor: f32) -> BoostRule {
+        BoostRule {
+            path: path.map(str::to_string),
+            language: language.map(str::to_string),
+            modified_within_days: None,
+            factor,
+        }
+    }
+
+    #[test]
+    fn path_and_language_rules_reorder_results() {
+        let root = Path::new("/repo");
+        let rules = vec![
+            rule(Some("internal/**"), None, 1.2),
+            rule(Some("**/generated/**"), None, 0.5),
+            rule(None, Some("Go"), 1.1),
+        ];
+        let mut results = vec![
+            SearchResult::for_lines("/repo/api/generated/types.go", 1, 1, 0.9),
+            SearchResult::for_lines("/repo/internal/auth/token.rs", 1, 1, 0.8),
+        ];
+
+        assert_eq!(apply_boosts(&rules, root, &mut results).unwrap(), 2);
+        assert_eq!(
+            results[0].file,
+            PathBuf::from("/repo/internal/auth/token.rs")
+        );
+        assert!((results[0].score - 0.96).abs() < 1e-5);
+        assert!((results[1].score - 0.495).abs() < 1e-5);
+    }
+
+    #[test]
+    fn recency_rules_use_file_mtime() {
+        let temp_dir = TempDir::new().unwrap();
+        let file = temp_dir.path().join("fresh.rs");
+        fs::write(&file, "fn fresh() {}").unwrap();
+
+        let rules = vec![BoostRule {
+            path: None,
+            language: None,
+            modified_within_days: Some(30),
+            factor: 2.0,
+        }];
+        let mut results = vec![SearchResult::for_lines(file, 1, 1, 0.4)];
+        assert_eq!(
+            apply_boosts(&rules, temp_dir.path(), &mut results).unwrap(),
+            1
+        );
+        assert!((results[0].score - 0.8).abs() < 1e-5);
+    }
+
+    #[test]
+    fn repo_boost_file_is_parsed_and_bad_factors_rejected() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(
+            temp_dir.path().join(BOOST_FILE),
+            "[[boost]]\npath = \"internal/**\"\nfactor = 1.2\n",
+        )
+        .unwrap();
+        let rules = load_repo_boost_rules(temp_dir.path()).unwrap();
+        assert_eq!(rules, vec![rule(Some("internal/**"), None, 1.2)]);
+
+        let mut results = vec![SearchResult::for_lines("a.rs", 1, 1, 0.5)];
+        assert!(
+            apply_boosts(
+                &[rule(Some("**"), None, 0.0)],
+                temp_dir.path(),
+                &mut results
+            )
+            .is_err()
+        );
+    }
+}
@@ -0,0 +1,341 @@
+//! Hits from named text collections (`cs --index --collection NAME`) for
+//! semantic search, reported as `collection:<name>` for text read from stdin
+//! and `collection:<name>/<file>` for files, with the lines they came from.
+//! Issues fetched from a tracker lead their preview with a link back to it.
+//! Agents' memories are the collection `memory`, reported as
+//! `collection:memory/<id>` with who wrote them and about what.
+//!
+//! A collection embedded with another model than the index's is searched
+//! with the query embedded by that model too. Chunk text is stored
+//! compressed, so only the hits kept after ranking are decompressed.
+
+use cs_core::{SearchOptions, SearchResult, Span};
+use cs_index::collections::{Collection, CollectionChunk, STDIN_SOURCE};
+use cs_index::memories::{MEMORY_COLLECTION, Memory};
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+pub const COLLECTION_RESULT_PREFIX: &str = "collection:";
+
+/// Lines of a chunk shown in a preview before eliding the rest.
+const PREVIEW_LINES: usize = 6;
+
+fn preview(text: &str, full: bool) -> String {
+    if full {
+        return text.to_string();
+    }
+    let lines: Vec<&str> = text.lines().collect();
+    let mut preview = lines
+        .iter()
+        .take(PREVIEW_LINES)
+        .copied()
+        .collect::<Vec<_>>()
+        .join("\n");
+    if lines.len() > PREVIEW_LINES {
+        preview.push_str(&format!("\n(+{} more lines)", lines.len() - PREVIEW_LINES));
+    }
+    preview
+}
+
+fn result_file(collection: &Collection, chunk: &CollectionChunk) -> PathBuf {
+    if chunk.source == STDIN_SOURCE {
+        PathBuf::from(format!("{}{}", COLLECTION_RESULT_PREFIX, collection.name))
+    } else {
+        PathBuf::from(format!(
+            "{}{}/{}",
+            COLLECTION_RESULT_PREFIX, collection.name, chunk.source
+        ))
+    }
+}
+
+/// The query embedded with `model`, or `None` if the model can't be loaded.
+fn embed_query(index_root: &Path, model: &str, query: &str) -> Option<Vec<f32>> {
+    let embed = || -> anyhow::Result<Vec<f32>> {
+        let mut embedder = cs_embed::create_embedder(Some(model))?;
+        let query = cs_index::redaction::prepare_query(&*embedder, index_root, query)?;
+        embedder
+            .embed(std::slice::from_ref(&query))?
+            .into_iter()
+            .next()
+            .ok_or_else(|| anyhow::anyhow!("no embedding returned"))
+    };
+    match embed() {
+        Ok(embedding) => Some(embedding),
+        Err(e) => {
+            tracing::warn!("Skipping collections embedded with {}: {}", model, e);
+            None
+        }
+    }
+}
+
+/// Collection chunks scoring at least the threshold against the query, best
+/// first. `query_embedding` is the query embedded with the index's `model`;
+/// collections embedded with other models get the query embedded again.
+/// When `options.collections` names any, only those are searched; otherwise
+/// every collection is, unless the search is scoped to a path or include
+/// pattern, which collections aren't under.
+pub(crate) fn collection_matches(
+    options: &SearchOptions,
+    index_root: &Path,
+    model: &str,
+    query_embedding: &[f32],
+) -> Vec<SearchResult> {
+    let scoped = options.path != Path::new(".") || !options.include_patterns.is_empty();
+    if scoped && options.collections.is_empty() {
+        return Vec::new();
+    }
+    let collections = match cs_index::collections::load_collections(index_root) {
+        Ok(collections) => collections,
+        Err(e) => {
+            tracing::warn!("Failed to load text collections: {}", e);
+            Vec::new()
+        }
+    };
+
+    let mut query_embeddings: HashMap<String, Option<Vec<f32>>> = HashMap::new();
+    query_embeddings.insert(model.to_string(), Some(query_embedding.to_vec()));
+    let mut candidates: Vec<(&Collection, &CollectionChunk, f32)> = Vec::new();
+    for collection in &collections {
+        if !options.collections.is_empty() && !options.collections.contains(&collection.name) {
+            continue;
+        }
+        let Some(collection_model) = collection.embedding_model.as_deref() else {
+            continue;
+        };
+        let Some(query_embedding) = query_embeddings
+            .entry(collection_model.to_string())
+            .or_insert_with(|| embed_query(index_root, collection_model, &options.query))
+            .as_deref()
+        else {
+            continue;
+        };
+        for chunk in &collection.chunks {
+            if chunk.embedding.len() != query_embedding.len() {
+                continue;
+            }
+            let score = super::semantic_v3::cosine_similarity(query_embedding, &chunk.embedding);
+            if options.threshold.is_some_and(|threshold| score < threshold) {
+                continue;
+            }
+            candidates.push((collection, chunk, score));
+        }
+    }
+
+    candidates.sort_by(|a, b| {
+        b.2.total_cmp(&a.2)
+            .then_with(|| a.0.name.cmp(&b.0.name))
+            .then_with(|| a.1.source.cmp(&b.1.source))
+            .then_with(|| a.1.line_start.cmp(&b.1.line_start))
+    });
+    if let Some(limit) = options.top_k {
+        candidates.truncate(limit);
+    }
+    let mut results: Vec<SearchResult> = candidates
+        .into_iter()
+        .filter_map(|(collection, chunk, score)| {
+            let text = match collection.text(chunk) {
+                Ok(text) => text,
+                Err(e) => {
+                    tracing::warn!(
+                        "Skipping unreadable chunk of collection {}: {}",
+                        collection.name,
+                        e
+                    );
+                    return None;
+                }
+            };
+            Some(SearchResult {
+                file: result_file(collection, chunk),
+                span: Span {
+                    byte_start: 0,
+                    byte_end: chunk.text.len(),
+                    line_start: chunk.line_start,
+                    line_end: chunk.line_end,
+                },
+                score,
+                preview: match &chunk.url {
+                    Some(url) => format!("{}\n{}", url, preview(&text, options.full_section)),
+                    None => preview(&text, options.full_section),
+                },
+                lang: None,
+                symbol: None,
+                chunk_hash: None,
+                index_epoch: None,
+            })
+        })
+        .collect();
+
+    let memories = memory_matches(options, index_root, &mut query_embeddings);
+    if !memories.is_empty() {
+        results.extend(memories);
+        results.sort_by(SearchResult::rank_cmp);
+        if let Some(limit) = options.top_k {
+            results.truncate(limit);
+        }
+    }
+    results
+}
+
+/// What a memory's preview leads with: who wrote it, and about what.
+fn provenance(memory: &Memory) -> String {
+    let source = &memory.provenance;
+    let mut line = format!(
+        "Remembered by {}",
+        source.agent.as_deref().unwrap_or("an agent")
+    );
+    if let Some(session) = &source.session {
+        line.push_str(&format!(" in session {}", session));
+    }
+    if !source.files.is_empty() {
+        line.push_str(&format!(" about {}", source.files.join(", ")));
+    }
+    if let Some(commit) = &source.commit {
+        line.push_str(&format!(" at {}", &commit[..commit.len().min(8)]));
+    }
+    line
+}
+
+/// Live memories scoring at least the threshold against the query, best
+/// first, unless `options.collections` leaves out [`MEMORY_COLLECTION`].
+fn memory_matches(
+    options: &SearchOptions,
+    index_root: &Path,
+    query_embeddings: &mut HashMap<String, Option<Vec<f32>>>,
+) -> Vec<SearchResult> {
+    if !options.collections.is_empty()
+        && !options
+            .collections
+            .iter()
+            .any(|name| name == MEMORY_COLLECTION)
+    {
+        return Vec::new();
+    }
+    let store = match cs_index::memories::load(index_root) {
+        Ok(store) => store,
+        Err(e) => {
+            tracing::warn!("Failed to load agent memories: {}", e);
+            return Vec::new();
+        }
+    };
+    let Some(model) = store.embedding_model.as_deref() else {
+        return Vec::new();
+    };
+    if store.live().next().is_none() {
+        return Vec::new();
+    }
+    let Some(query_embedding) = query_embeddings
+        .entry(model.to_string())
+        .or_insert_with(|| embed_query(index_root, model, &options.query))
+        .as_deref()
+    else {
+        return Vec::new();
+    };
+
+    let mut results: Vec<SearchResult> = store
+        .live()
+        .filter(|memory| memory.embedding.len() == query_embedding.len())
+        .map(|memory| {
+            let score = super::semantic_v3::cosine_similarity(query_embedding, &memory.embedding);
+            (memory, score)
+        })
+        .filter(|(_, score)| {
+            options
+                .threshold
+                .is_none_or(|threshold| *score >= threshold)
+        })
+        .map(|(memory, score)| SearchResult {
+            file: PathBuf::from(format!(
+                "{}{}/{}",
+                COLLECTION_RESULT_PREFIX, MEMORY_COLLECTION, memory.id
+            )),
+            span: Span {
+                byte_start: 0,
+                byte_end: memory.text.len(),
+                line_start: 1,
+                line_end: memory.text.lines().count().max(1),
+            },
+            score,
+            preview: format!(
+                "{}\n{}",
+                provenance(memory),
+                preview(&memory.text, options.full_section)
+            ),
+            lang: None,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        })
+        .collect();
+    results.sort_by(SearchResult::rank_cmp);
+    if let Some(limit) = options.top_k {
+        results.truncate(limit);
+    }
+    results
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn previews_elide_long_chunks() {
+        let text = (1..=8)
+            .map(|i| format!("line {}", i))
+            .collect::<Vec<_>>()
+            .join("\n");
+        assert_eq!(
+            preview(&text, false),
+            "line 1\nline 2\nline 3\nline 4\nline 5\nline 6\n(+2 more lines)"
+        );
+        assert_eq!(preview(&text, true), text);
+        assert_eq!(preview("short", false), "short");
+    }
+
+    #[test]
+    fn results_name_the_collection_and_file() {
+        let chunk = |source: &str| CollectionChunk {
+            source: source.to_string(),
+            line_start: 1,
+            line_end: 1,
+            text: String::new().into(),
+            url: None,
+            embedding: Vec::new(),
+        };
+        let collection = Collection {
+            name: "docs".to_string(),
+            ..Collection::default()
+        };
+        assert_eq!(
+            result_file(&collection, &chunk(STDIN_SOURCE)),
+            PathBuf::from("collection:docs")
+        );
+        assert_eq!(
+            result_file(&collection, &chunk("wiki/ops/deploy.md")),
+            PathBuf::from("collection:docs/wiki/ops/deploy.md")
+        );
+    }
+
+    #[test]
+    fn memories_say_who_wrote_them_and_about_what() {
+        let mut memory = Memory {
+            id: "a1b2c3d4".to_string(),
+            text: "run make db before the integration tests".to_string(),
+            created: 0,
+            expires: None,
+            provenance: Default::default(),
+            embedding: Vec::new(),
+        };
+        assert_eq!(provenance(&memory), "Remembered by an agent");
+
+        memory.provenance = cs_index::memories::Provenance {
+            agent: Some("claude-desktop".to_string()),
+            session: Some("s-42".to_string()),
+            files: vec!["Makefile".to_string(), "tests/db.rs".to_string()],
+            commit: Some("0123456789abcdef".to_string()),
+        };
+        assert_eq!(
+            provenance(&memory),
+            "Remembered by claude-desktop in session s-42 about Makefile, tests/db.rs at 01234567"
+        );
+    }
+}
@@ -0,0 +1,142 @@
+//! Commit-message hits for semantic search, from `.cs/commits.bin`.
+//!
+//! Hits are reported as `git:<short sha>` so they read naturally next to
+//! file results; the preview lists the paths the commit touched.
+
+use cs_core::{SearchOptions, SearchResult, Span};
+use std::path::{Path, PathBuf};
+
+/// Touched paths listed in a preview before eliding the rest.
+const PREVIEW_PATHS: usize = 3;
+
+pub const COMMIT_RESULT_PREFIX: &str = "git:";
+
+fn preview(commit: &cs_index::commits::CommitEntry, full: bool) -> String {
+    if full {
+        return commit.text();
+    }
+    let mut preview = commit.subject.clone();
+    if !commit.files.is_empty() {
+        let shown: Vec<&str> = commit
+            .files
+            .iter()
+            .take(PREVIEW_PATHS)
+            .map(String::as_str)
+            .collect();
+        preview.push_str("\nTouched: ");
+        preview.push_str(&shown.join(", "));
+        if commit.files.len() > PREVIEW_PATHS {
+            preview.push_str(&format!(" (+{} more)", commit.files.len() - PREVIEW_PATHS));
+        }
+    }
+    preview
+}
+
+/// Commits scoring at least the threshold against `query_embedding`, best
+/// first. Commits embedded with a different model are ignored, and when the
+/// search is scoped to a path only commits touching it are considered.
+pub(crate) fn commit_matches(
+    options: &SearchOptions,
+    index_root: &Path,
+    model: &str,
+    query_embedding: &[f32],
+) -> Vec<SearchResult> {
+    let index = match cs_index::commits::load_commits(index_root) {
+        Ok(Some(index)) => index,
+        Ok(None) => return Vec::new(),
+        Err(e) => {
+            tracing::warn!("Failed to load commit index: {}", e);
+            return Vec::new();
+        }
+    };
+    if index.embedding_model.as_deref() != Some(model) {
+        tracing::warn!(
+            "Commit index was built with {:?}, not {}; re-run 'cs --index --index-commits'",
+            index.embedding_model,
+            model
+        );
+        return Vec::new();
+    }
+
+    let canonical =
+        |path: &Path| cs_core::paths::canonicalize(path).unwrap_or_else(|_| path.to_path_buf());
+    let scope = (options.path != Path::new(".")).then(|| canonical(&options.path));
+    let scope_is_file = options.path.is_file();
+    let in_scope = |file: &str| {
+        let path = index_root.join(file);
+        if !super::path_matches_include(&path, &options.include_patterns) {
+            return false;
+        }
+        match &scope {
+            None => true,
+            Some(scope) if scope_is_file => cs_core::paths::paths_equal(&canonical(&path), scope),
+            Some(scope) => cs_core::paths::starts_with(&canonical(&path), scope),
+        }
+    };
+    let candidates: Vec<&cs_index::commits::CommitEntry> =
+        if scope.is_none() && options.include_patterns.is_empty() {
+            index.commits.iter().collect()
+        } else {
+            index.touching(in_scope).collect()
+        };
+
+    let mut matches: Vec<SearchResult> = candidates
+        .into_iter()
+        .filter(|commit| commit.embedding.len() == query_embedding.len())
+        .filter_map(|commit| {
+            let score = super::semantic_v3::cosine_similarity(query_embedding, &commit.embedding);
+            if options.threshold.is_some_and(|threshold| score < threshold) {
+                return None;
+            }
+            let preview = preview(commit, options.full_section);
+            Some(SearchResult {
+                file: PathBuf::from(format!("{}{}", COMMIT_RESULT_PREFIX, commit.short_sha())),
+                span: Span {
+                    byte_start: 0,
+                    byte_end: preview.len(),
+                    line_start: 1,
+                    line_end: preview.lines().count().max(1),
+                },
+                score,
+                preview,
+                lang: None,
+                symbol: Some(commit.sha.clone()),
+                chunk_hash: None,
+                index_epoch: None,
+            })
+        })
+        .collect();
+
+    matches.sort_by(SearchResult::rank_cmp);
+    if let Some(limit) = options.top_k {
+        matches.truncate(limit);
+    }
+    matches
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_index::commits::CommitEntry;
+
+    #[test]
+    fn previews_elide_long_path_lists() {
+        let commit = CommitEntry {
+            sha: "abc1234def".to_string(),
+            author: "Ada".to_string(),
+            timestamp: 0,
+            subject: "Add retry to user service".to_string(),
+            body: "Transient errors surfaced to callers.".to_string(),
+            files: vec!["a.go", "b.go", "c.go", "d.go"]
+                .into_iter()
+                .map(str::to_string)
+                .collect(),
+            embedding: Vec::new(),
+        };
+        assert_eq!(
+            preview(&commit, false),
+            "Add retry to user service\nTouched: a.go, b.go, c.go (+1 more)"
+        );
+        assert!(preview(&commit, true).contains("Transient errors"));
+    }
+}
@@ -0,0 +1,206 @@
+//! `cs --compare A B`: chunks of one repository that closely resemble chunks
+//! of another, for license compliance checks and for spotting where forks
+//! have drifted apart. Both repositories need an index built with the same
+//! embedding model; chunks are compared by their stored embeddings.
+
+use anyhow::{Result, bail};
+use rayon::prelude::*;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+/// Similarity a pair needs to be reported unless `--threshold` says otherwise.
+pub const DEFAULT_THRESHOLD: f32 = 0.9;
+
+/// Chunks shorter than this are imports, braces and one-liners, which look
+/// alike in every repository.
+pub(crate) const MIN_CHUNK_BYTES: usize = 120;
+
+#[derive(Debug, Clone, Serialize)]
+pub struct ChunkLocation {
+    pub file: PathBuf,
+    pub line_start: usize,
+    pub line_end: usize,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SimilarChunks {
+    pub left: ChunkLocation,
+    pub right: ChunkLocation,
+    pub similarity: f32,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub chunk_type: Option<String>,
+    /// Same text, ignoring whitespace
+    pub identical: bool,
+}
+
+pub(crate) struct IndexedChunk {
+    pub(crate) location: ChunkLocation,
+    pub(crate) chunk_type: Option<String>,
+    pub(crate) symbol: Option<String>,
+    pub(crate) byte_range: (usize, usize),
+    /// Normalized, so a dot product is the cosine similarity
+    pub(crate) embedding: Vec<f32>,
+}
+
+/// Pairs of chunks from the indexes at `left_root` and `right_root` at least
+/// `threshold` similar, most similar first. Each left chunk is reported with
+/// its closest right chunk only.
+pub fn compare_indexes(
+    left_root: &Path,
+    right_root: &Path,
+    threshold: f32,
+) -> Result<Vec<SimilarChunks>> {
+    let (left_model, right_model) = (embedding_model(left_root)?, embedding_model(right_root)?);
+    if left_model != right_model {
+        bail!(
+            "{} and {} were indexed with different models ({} and {}); rebuild one with cs --switch-model",
+            left_root.display(),
+            right_root.display(),
+            left_model.as_deref().unwrap_or("none"),
+            right_model.as_deref().unwrap_or("none")
+        );
+    }
+    let left = indexed_chunks(left_root)?;
+    let right = indexed_chunks(right_root)?;
+    if left.is_empty() || right.is_empty() {
+        bail!(
+            "{} has no embedded chunks; run cs --index on it first",
+            if left.is_empty() {
+                left_root
+            } else {
+                right_root
+            }
+            .display()
+        );
+    }
+
+    let mut pairs: Vec<(usize, usize, f32)> = left
+        .par_iter()
+        .enumerate()
+        .filter_map(|(i, chunk)| {
+            right
+                .iter()
+                .enumerate()
+                .map(|(j, other)| (j, dot(&chunk.embedding, &other.embedding)))
+                .filter(|(_, similarity)| *similarity >= threshold)
+                .max_by(|a, b| a.1.total_cmp(&b.1))
+                .map(|(j, similarity)| (i, j, similarity))
+        })
+        .collect();
+    pairs.sort_by(|a, b| b.2.total_cmp(&a.2));
+
+    let mut sources = Sources::default();
+    Ok(pairs
+        .into_iter()
+        .map(|(i, j, similarity)| {
+            let (l, r) = (&left[i], &right[j]);
+            let identical = match (sources.text(l), sources.text(r)) {
+                (Some(a), Some(b)) => same_ignoring_whitespace(&a, &b),
+                _ => false,
+            };
+            SimilarChunks {
+                left: l.location.clone(),
+                right: r.location.clone(),
+                similarity: similarity.min(1.0),
+                chunk_type: l.chunk_type.clone().or_else(|| r.chunk_type.clone()),
+                identical,
+            }
+        })
+        .collect())
+}
+
+pub(crate) fn embedding_model(root: &Path) -> Result<Option<String>> {
+    let manifest = match cs_index::load_manifest(root)? {
+        Some(manifest) => manifest,
+        None if cs_index::shards::is_sharded(root) => cs_index::shards::combined_manifest(root)?,
+        None => bail!("No index at {}. Run cs --index first.", root.display()),
+    };
+    Ok(manifest.embedding_model)
+}
+
+pub(crate) fn indexed_chunks(root: &Path) -> Result<Vec<IndexedChunk>> {
+    let files = cs_index::indexed_files(root)?
+        .ok_or_else(|| anyhow::anyhow!("No index at {}. Run cs --index first.", root.display()))?;
+    let mut chunks = Vec::new();
+    for file in files {
+        let relative = file.strip_prefix(root).unwrap_or(&file);
+        let sidecar = cs_index::shards::sidecar_path(root, relative);
+        let Ok(entry) = cs_index::load_index_entry(&sidecar) else {
+            continue;
+        };
+        for chunk in entry.chunks {
+            let length = chunk.span.byte_end.saturating_sub(chunk.span.byte_start);
+            if chunk.generated || length < MIN_CHUNK_BYTES {
+                continue;
+            }
+            let Some(embedding) = chunk.embedding.as_deref().and_then(normalized) else {
+                continue;
+            };
+            chunks.push(IndexedChunk {
+                location: ChunkLocation {
+                    file: file.clone(),
+                    line_start: chunk.span.line_start,
+                    line_end: chunk.span.line_end,
+                },
+                chunk_type: chunk.chunk_type,
+                symbol: chunk.symbol,
+                byte_range: (chunk.span.byte_start, chunk.span.byte_end),
+                embedding,
+            });
+        }
+    }
+    Ok(chunks)
+}
+
+pub(crate) fn normalized(vector: &[f32]) -> Option<Vec<f32>> {
+    let norm = vector.iter().map(|x| x * x).sum::<f32>().sqrt();
+    (norm > 0.0).then(|| vector.iter().map(|x| x / norm).collect())
+}
+
+pub(crate) fn dot(a: &[f32], b: &[f32]) -> f32 {
+    if a.len() != b.len() {
+        return 0.0;
+    }
+    cs_ann::simd::dot(a, b)
+}
+
+/// File contents read once each, for checking whether a pair is a copy.
+#[derive(Default)]
+pub(crate) struct Sources {
+    files: HashMap<PathBuf, Option<String>>,
+}
+
+impl Sources {
+    pub(crate) fn text(&mut self, chunk: &IndexedChunk) -> Option<String> {
+        let content = self
+            .files
+            .entry(chunk.location.file.clone())
+            .or_insert_with(|| cs_core::text::read_text(&chunk.location.file).ok());
+        let (start, end) = chunk.byte_range;
+        content.as_deref()?.get(start..end).map(str::to_string)
+    }
+}
+
+fn same_ignoring_whitespace(a: &str, b: &str) -> bool {
+    a.split_whitespace().eq(b.split_whitespace())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn copies_match_despite_reformatting() {
+        assert!(same_ignoring_whitespace(
+            "fn add(a: u32, b: u32) -> u32 {\n    a + b\n}",
+            "fn add(a: u32, b: u32) -> u32 {\n\ta + b\n}\n"
+        ));
+        assert!(!same_ignoring_whitespace("a + b", "a - b"));
+
+        let a = normalized(&[3.0, 4.0]).unwrap();
+        assert!((dot(&a, &a) - 1.0).abs() < 1e-6);
+        assert!(normalized(&[0.0, 0.0]).is_none());
+        assert_eq!(dot(&a, &[1.0]), 0.0);
+    }
+}
@@ -0,0 +1,285 @@
+//! Packs search results into one context block within a token budget, for
+//! `--pack-tokens`.
+//!
+//! Results are taken in rank order. Lines already packed from the same file
+//! aren't repeated, so an overlapping result only adds its new lines. A
+//! result that doesn't fit is trimmed to the lines that do, or skipped when
+//! too little of it would remain; smaller results further down can still
+//! fill the space. The block lists files in the order of their best result,
+//! each under a header, with the packed line ranges in file order. With line
+//! numbers, each line is prefixed with its number so a model can cite it.
+
+use cs_core::{Language, SearchResult};
+use cs_embed::TokenEstimator;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::fmt::Write;
+use std::path::{Path, PathBuf};
+
+/// A trimmed result must keep at least this many lines to be worth including.
+const MIN_TRIMMED_LINES: usize = 3;
+
+/// Marks a gap between packed ranges of the same file.
+const GAP_MARKER: &str = "...";
+
+#[derive(Debug, Clone, Default)]
+pub struct PackedContext {
+    /// Ready-to-paste Markdown
+    pub text: String,
+    /// Estimated tokens in `text`
+    pub tokens: usize,
+    /// Results included in full or in part
+    pub results_packed: usize,
+    /// Results that were cut to fit
+    pub results_trimmed: usize,
+    /// Results whose lines were all packed already
+    pub results_deduplicated: usize,
+    /// Results that didn't fit
+    pub results_skipped: usize,
+    pub files: usize,
+    /// What the block contains, in the order it appears
+    pub ranges: Vec<PackedRange>,
+}
+
+/// Lines of one file included in a packed block.
+#[derive(Debug, Clone, Serialize)]
+pub struct PackedRange {
+    pub file: PathBuf,
+    pub line_start: usize,
+    pub line_end: usize,
+}
+
+struct PackedFile {
+    path: PathBuf,
+    lang: Option<Language>,
+    lines: Vec<String>,
+    /// 1-based inclusive line ranges, in the order they were packed
+    ranges: Vec<(usize, usize)>,
+    line_numbers: bool,
+}
+
+impl PackedFile {
+    fn header(&self) -> String {
+        format!("### {}\n", cs_core::paths::to_relative_slash(&self.path))
+    }
+
+    fn fence(&self) -> String {
+        match self.lang {
+            Some(Language::Pdf) | None => "text".to_string(),
+            Some(lang) => lang.to_string(),
+        }
+    }
+
+    /// Parts of `start..=end` not packed yet.
+    fn unpacked(&self, start: usize, end: usize) -> Vec<(usize, usize)> {
+        let mut ranges = self.ranges.clone();
+        ranges.sort_unstable();
+        let mut parts = Vec::new();
+        let mut next = start;
+        for (packed_start, packed_end) in ranges {
+            if packed_end < next || packed_start > end {
+                continue;
+            }
+            if packed_start > next {
+                parts.push((next, packed_start - 1));
+            }
+            next = next.max(packed_end + 1);
+        }
+        if next <= end {
+            parts.push((next, end));
+        }
+        parts
+    }
+
+    fn text(&self, start: usize, end: usize) -> String {
+        if !self.line_numbers {
+            return self.lines[start - 1..end].join("\n");
+        }
+        (start..=end)
+            .map(|number| format!("{}: {}", number, self.lines[number - 1]))
+            .collect::<Vec<_>>()
+            .join("\n")
+    }
+
+    fn cost(&self, start: usize, end: usize) -> usize {
+        // Each range may need a gap marker line next to it
+        TokenEstimator::estimate_tokens(&self.text(start, end)) + 1
+    }
+
+    /// Packed ranges in file order, adjacent ones merged.
+    fn merged_ranges(&self) -> Vec<(usize, usize)> {
+        let mut ranges = self.ranges.clone();
+        ranges.sort_unstable();
+        let mut merged: Vec<(usize, usize)> = Vec::new();
+        for (start, end) in ranges {
+            match merged.last_mut() {
+                Some(last) if start <= last.1 + 1 => last.1 = last.1.max(end),
+                _ => merged.push((start, end)),
+            }
+        }
+        merged
+    }
+
+    fn render(&self, out: &mut String, packed: &mut Vec<PackedRange>) {
+        let ranges = self.merged_ranges();
+        let _ = writeln!(out, "{}```{}", self.header(), self.fence());
+        for (i, (start, end)) in ranges.iter().enumerate() {
+            if i > 0 || *start > 1 {
+                let _ = writeln!(out, "{}", GAP_MARKER);
+            }
+            let _ = writeln!(out, "{}", self.text(*start, *end));
+            packed.push(PackedRange {
+                file: self.path.clone(),
+                line_start: *start,
+                line_end: *end,
+            });
+        }
+        let last_packed = ranges.last().map_or(0, |&(_, end)| end);
+        if last_packed < self.lines.len() {
+            let _ = writeln!(out, "{}", GAP_MARKER);
+        }
+        out.push_str("```\n\n");
+    }
+}
+
+/// Pack `results` (best first) into at most about `budget` tokens.
+pub fn pack_results(results: &[SearchResult], budget: usize) -> PackedContext {
+    pack(results, budget, false)
+}
+
+/// Like [`pack_results`], with each line prefixed by its line number.
+pub fn pack_results_with_line_numbers(results: &[SearchResult], budget: usize) -> PackedContext {
+    pack(results, budget, true)
+}
+
+fn pack(results: &[SearchResult], budget: usize, line_numbers: bool) -> PackedContext {
+    let mut packed = PackedContext::default();
+    let mut files: Vec<PackedFile> = Vec::new();
+    let mut file_index: HashMap<PathBuf, Option<usize>> = HashMap::new();
+    let mut used = 0;
+
+    for result in results {
+        let index = *file_index.entry(result.file.clone()).or_insert_with(|| {
+            let lines = read_lines(&result.file)?;
+            files.push(PackedFile {
+                path: result.file.clone(),
+                lang: result.lang,
+                lines,
+                ranges: Vec::new(),
+                line_numbers,
+            });
+            Some(files.len() - 1)
+        });
+        let Some(index) = index else {
+            packed.results_skipped += 1;
+            continue;
+        };
+        let file = &mut files[index];
+
+        let last_line = file.lines.len();
+        let start = result.span.line_start.max(1);
+        let end = result.span.line_end.min(last_line);
+        if start > end {
+            packed.results_skipped += 1;
+            continue;
+        }
+        let parts = file.unpacked(start, end);
+        if parts.is_empty() {
+            packed.results_deduplicated += 1;
+            continue;
+        }
+
+        // A file's header and code fence are paid for with its first range
+        let overhead = if file.ranges.is_empty() {
+            TokenEstimator::estimate_tokens(&file.header()) + 4
+        } else {
+            0
+        };
+        let cost: usize = parts.iter().map(|&(s, e)| file.cost(s, e)).sum();
+        if used + overhead + cost <= budget {
+            used += overhead + cost;
+            file.ranges.extend(parts);
+            packed.results_packed += 1;
+            continue;
+        }
+
+        // Trim: keep the leading lines of the first new part that still fit
+        let (part_start, part_end) = parts[0];
+        let available = budget.saturating_sub(used + overhead);
+        let mut trimmed_end = None;
+        let mut line_end = part_start + MIN_TRIMMED_LINES - 1;
+        while line_end <= part_end && file.cost(part_start, line_end) <= available {
+            trimmed_end = Some(line_end);
+            line_end += 1;
+        }
+        match trimmed_end {
+            Some(trimmed_end) => {
+                used += overhead + file.cost(part_start, trimmed_end);
+                file.ranges.push((part_start, trimmed_end));
+                packed.results_packed += 1;
+                packed.results_trimmed += 1;
+            }
+            None => packed.results_skipped += 1,
+        }
+    }
+
+    for file in files.iter().filter(|file| !file.ranges.is_empty()) {
+        file.render(&mut packed.text, &mut packed.ranges);
+        packed.files += 1;
+    }
+    packed.tokens = used;
+    packed
+}
+
+fn read_lines(file: &Path) -> Option<Vec<String>> {
+    let repo_root = super::find_nearest_index_root(file)
+        .unwrap_or_else(|| file.parent().unwrap_or(file).to_path_buf());
+    let content = super::read_file_content(file, &repo_root).ok()?;
+    Some(content.lines().map(str::to_string).collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+
+    #[test]
+    fn packs_within_budget_without_repeating_lines() {
+        let temp_dir = TempDir::new().unwrap();
+        let file = temp_dir.path().join("lib.rs");
+        let source: Vec<String> = (1..=200)
+            .map(|n| format!("fn function_{n}() -> usize {{ {n} }}"))
+            .collect();
+        fs::write(&file, source.join("\n")).unwrap();
+
+        let results = vec![
+            SearchResult::for_lines(&file, 10, 20, 0.9),
+            // Overlaps the first result: only lines 21-25 are new
+            SearchResult::for_lines(&file, 15, 25, 0.9),
+            // Entirely packed already
+            SearchResult::for_lines(&file, 12, 18, 0.9),
+            SearchResult::for_lines(&file, 100, 200, 0.9),
+        ];
+        let packed = pack_results(&results, 200);
+
+        assert!(packed.tokens <= 200);
+        assert_eq!(packed.files, 1);
+        assert_eq!(packed.results_deduplicated, 1);
+        assert_eq!(packed.results_trimmed, 1);
+        assert_eq!(packed.text.matches("fn function_15()").count(), 1);
+        assert!(packed.text.contains("fn function_25()"));
+        assert!(packed.text.contains("fn function_100()"));
+        assert!(!packed.text.contains("fn function_200()"));
+        assert!(packed.text.starts_with("### "));
+        assert!(packed.text.contains("```rust\n"));
+        assert_eq!(packed.ranges.len(), 2);
+        assert_eq!(
+            (packed.ranges[0].line_start, packed.ranges[0].line_end),
+            (10, 25)
+        );
+
+        let numbered = pack_results_with_line_numbers(&results[..1], 200);
+        assert!(numbered.text.contains("\n10: fn function_10()"));
+    }
+}
@@ -0,0 +1,285 @@
+//! Follow-up questions rewritten from earlier turns, for `--ask` and the TUI.
+//!
+//! A follow-up such as "and where is it called from?" gives a search nothing
+//! to go on by itself. A conversation remembers each turn's search and the
+//! names defined by its best results. A question that reads as a follow-up
+//! (it opens with "and" or "what about", or with a pronoun like "it") has
+//! that pronoun replaced with the previous turn's subject before retrieval;
+//! any other question starts a new conversation, even if a pronoun turns up
+//! later in it.
+//!
+//! `--ask` keeps its conversation in `.cs/conversation.json`, forgets it after
+//! half an hour without questions, and replays earlier questions and answers
+//! to the chat model. The TUI keeps one in memory for its session.
+
+use anyhow::Result;
+use cs_core::SearchResult;
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+pub const CONVERSATION_FILE: &str = "conversation.json";
+
+/// A conversation left alone this long is over.
+const IDLE_TIMEOUT_SECS: u64 = 30 * 60;
+
+/// Turns remembered; the oldest are dropped first.
+const MAX_TURNS: usize = 8;
+
+/// Names from the best results that make up a turn's subject.
+const SUBJECT_NAMES: usize = 2;
+
+static LEADING_CONNECTIVE: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?i)^\s*(and|also|then|so|but|what about|how about)\b[\s,]*").unwrap()
+});
+
+static PRONOUN: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(?i)\b(it|its|this|these|those|they|them|their)\b").unwrap());
+
+static LEADING_PRONOUN: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(?i)^\s*(it|its|this|these|those|they|them|their)\b").unwrap());
+
+/// The name a chunk defines, in most languages' syntax; Go receivers are skipped.
+static DEFINITION: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"\b(?:fn|func|def|class|struct|interface|trait|enum|type|function|module)\s+(?:\([^)]*\)\s*)?([A-Za-z_][A-Za-z0-9_]*)",
+    )
+    .unwrap()
+});
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct Turn {
+    pub question: String,
+    /// What was searched for: the question, or its rewrite
+    pub search_query: String,
+    /// Names defined by the best results, best first
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub names: Vec<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub answer: Option<String>,
+}
+
+impl Turn {
+    /// What a pronoun in the next question most likely refers to.
+    fn subject(&self) -> String {
+        if self.names.is_empty() {
+            self.search_query.clone()
+        } else {
+            self.names.join(" ")
+        }
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct Conversation {
+    /// Oldest first
+    pub turns: Vec<Turn>,
+    /// Unix seconds of the last turn
+    updated_at: u64,
+}
+
+fn conversation_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(CONVERSATION_FILE)
+}
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |elapsed| elapsed.as_secs())
+}
+
+impl Conversation {
+    /// The conversation saved for `index_root`, or a new one if there is none
+    /// or it has gone idle.
+    pub fn load(index_root: &Path) -> Self {
+        let path = conversation_path(index_root);
+        let conversation: Self = fs::read(&path)
+            .ok()
+            .and_then(|data| cs_index::encryption::open_from(&path, data).ok())
+            .and_then(|data| serde_json::from_slice(&data).ok())
+            .unwrap_or_default();
+        if now().saturating_sub(conversation.updated_at) > IDLE_TIMEOUT_SECS {
+            return Self::default();
+        }
+        conversation
+    }
+
+    pub fn save(&self, index_root: &Path) -> Result<()> {
+        let path = conversation_path(index_root);
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        let data = cs_index::encryption::seal_for(&path, serde_json::to_vec_pretty(self)?)?;
+        fs::write(path, data)?;
+        Ok(())
+    }
+
+    /// `question` as a standalone search query, or `None` if it doesn't
+    /// depend on earlier turns.
+    pub fn rewrite(&self, question: &str) -> Option<String> {
+        let previous = self.turns.last()?;
+        if !is_follow_up(question) {
+            return None;
+        }
+        let subject = previous.subject();
+        let stripped = LEADING_CONNECTIVE.replace(question, "");
+        // After a connective the first pronoun is the reference; without one
+        // only the pronoun the question opens with is
+        let rewritten = if LEADING_PRONOUN.is_match(&stripped) {
+            LEADING_PRONOUN
+                .replace(&stripped, regex::NoExpand(&subject))
+                .into_owned()
+        } else if LEADING_CONNECTIVE.is_match(question) && PRONOUN.is_match(&stripped) {
+            PRONOUN
+                .replace(&stripped, regex::NoExpand(&subject))
+                .into_owned()
+        } else {
+            format!("{} {}", stripped.trim_end_matches('?').trim_end(), subject)
+        };
+        Some(rewritten.trim().to_string())
+    }
+
+    /// Record a turn that searched for `search_query` and found `results`. A
+    /// question that wasn't rewritten starts the conversation over.
+    pub fn record(
+        &mut self,
+        question: &str,
+        search_query: &str,
+        results: &[SearchResult],
+        answer: Option<String>,
+    ) {
+        if question == search_query {
+            self.turns.clear();
+        }
+        let mut names: Vec<String> = Vec::new();
+        for result in results {
+            if names.len() == SUBJECT_NAMES {
+                break;
+            }
+            if let Some(name) = defined_name(result)
+                && !names.contains(&name)
+            {
+                names.push(name);
+            }
+        }
+        self.turns.push(Turn {
+            question: question.to_string(),
+            search_query: search_query.to_string(),
+            names,
+            answer,
+        });
+        if self.turns.len() > MAX_TURNS {
+            let excess = self.turns.len() - MAX_TURNS;
+            self.turns.drain(..excess);
+        }
+        self.updated_at = now();
+    }
+}
+
+/// Whether `question` only makes sense after an earlier one: it opens with
+/// a connective or a pronoun.
+pub fn is_follow_up(question: &str) -> bool {
+    LEADING_CONNECTIVE.is_match(question) || LEADING_PRONOUN.is_match(question)
+}
+
+fn defined_name(result: &SearchResult) -> Option<String> {
+    if let Some(symbol) = &result.symbol {
+        return Some(symbol.clone());
+    }
+    DEFINITION
+        .captures(&result.preview)
+        .map(|captures| captures[1].to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn result(preview: &str) -> SearchResult {
+        SearchResult {
+            preview: preview.to_string(),
+            ..SearchResult::for_lines("users/service.go", 1, 1, 0.9)
+        }
+    }
+
+    #[test]
+    fn follow_ups_are_rewritten_with_the_previous_subject() {
+        let mut conversation = Conversation::default();
+        let question = "how does user deletion cascade?";
+        assert_eq!(conversation.rewrite(question), None);
+        conversation.record(
+            question,
+            question,
+            &[result(
+                "func (s *Service) DeleteUser(ctx context.Context, id string) error {",
+            )],
+            None,
+        );
+
+        assert_eq!(
+            conversation
+                .rewrite("and where is it called from?")
+                .as_deref(),
+            Some("where is DeleteUser called from?")
+        );
+        assert_eq!(
+            conversation.rewrite("what about tests?").as_deref(),
+            Some("tests DeleteUser")
+        );
+        assert_eq!(conversation.rewrite("how is config loaded?"), None);
+
+        // A new topic starts over
+        conversation.record(
+            "how is config loaded?",
+            "how is config loaded?",
+            &[result("def load_config(path):")],
+            None,
+        );
+        assert_eq!(conversation.turns.len(), 1);
+        assert_eq!(
+            conversation.rewrite("and who calls it?").as_deref(),
+            Some("who calls load_config?")
+        );
+        assert_eq!(
+            conversation.rewrite("its callers?").as_deref(),
+            Some("load_config callers?")
+        );
+    }
+
+    #[test]
+    fn pronouns_later_in_a_question_start_over() {
+        let mut conversation = Conversation::default();
+        conversation.record(
+            "how is config loaded?",
+            "how is config loaded?",
+            &[result("def load_config(path):")],
+            None,
+        );
+
+        for question in [
+            "how does the cache decide when it expires?",
+            "where are retries configured and who reads them?",
+            "what is this project's test runner?",
+        ] {
+            assert!(!is_follow_up(question), "{}", question);
+            assert_eq!(conversation.rewrite(question), None, "{}", question);
+        }
+    }
+
+    #[test]
+    fn idle_conversations_are_forgotten() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut conversation = Conversation::default();
+        conversation.record("how are retries configured?", "retries", &[], None);
+        conversation.save(temp_dir.path()).unwrap();
+        assert_eq!(Conversation::load(temp_dir.path()).turns.len(), 1);
+
+        conversation.updated_at -= IDLE_TIMEOUT_SECS + 1;
+        conversation.save(temp_dir.path()).unwrap();
+        assert!(Conversation::load(temp_dir.path()).turns.is_empty());
+    }
+}
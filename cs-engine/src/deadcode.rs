@@ -0,0 +1,332 @@
+//! `cs --deadcode`: exported Go declarations nothing in the indexed
+//! workspace refers to, as candidates for deletion.
+//!
+//! References are found the way `go_refs` resolves them: a package-qualified
+//! `service.GetUser` through the file's imports, and an unqualified
+//! `GetUser` within the declaring package's directory. A declaration only
+//! tests refer to is still a candidate; the report says how many test files
+//! use it. Packages other modules import (a library's public API, a plugin
+//! entry point) look unused from inside the workspace, so `--exclude` globs
+//! keep their files out of the report while their references still count.
+
+use anyhow::Result;
+use globset::GlobSet;
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use crate::go_refs::{
+    GoDecl, GoDeclKind, GoReferenceResolver, LITERAL_OR_COMMENT, qualified_names,
+};
+
+static EXPORTED_IDENT: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(^|[^\w.])([A-Z]\w*)\b").unwrap());
+
+/// `func (s *Service) GetUser`: the receiver's type (and the method's name,
+/// which no package-level declaration goes by) aren't references.
+static METHOD_HEAD: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"^func\s*\([^)]*\)\s*\w+").unwrap());
+
+#[derive(Debug, Clone, Serialize)]
+pub struct DeadCodeCandidate {
+    pub file: PathBuf,
+    pub line: usize,
+    pub line_end: usize,
+    pub name: String,
+    pub kind: GoDeclKind,
+    /// Test files referring to the declaration, which would need updating
+    /// with it
+    pub test_references: usize,
+}
+
+/// Where an identifier is written: its file, and the line (1-based).
+type Site = (usize, usize);
+
+#[derive(Default)]
+struct Uses {
+    /// Unqualified exported identifiers by package directory and name
+    unqualified: HashMap<(PathBuf, String), Vec<Site>>,
+    /// Package-qualified references resolved to a directory, by the files
+    /// writing them
+    qualified: HashMap<(PathBuf, String), HashSet<usize>>,
+}
+
+/// Exported declarations under `scope` in the index at `index_root` that
+/// nothing outside their own body refers to, by file and line. Files
+/// matching `exclude_patterns` are referrers but aren't reported.
+pub fn find_dead_code(
+    index_root: &Path,
+    scope: &Path,
+    exclude_patterns: &[String],
+) -> Result<Vec<DeadCodeCandidate>> {
+    let files = cs_index::indexed_files(index_root)?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No index in {}. Run cs --index first.",
+            index_root.display()
+        )
+    })?;
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let scope = cs_core::paths::canonicalize_lossy(scope);
+    let scope = scope.strip_prefix(&root).unwrap_or(Path::new(""));
+    let excluded = super::build_globset(exclude_patterns);
+    let files: Vec<PathBuf> = files
+        .into_iter()
+        .filter(|file| file.extension().is_some_and(|ext| ext == "go"))
+        .collect();
+    Ok(candidates(index_root, &files, scope, &excluded))
+}
+
+fn candidates(
+    index_root: &Path,
+    files: &[PathBuf],
+    scope: &Path,
+    excluded: &GlobSet,
+) -> Vec<DeadCodeCandidate> {
+    let is_test: Vec<bool> = files.iter().map(|file| is_test_file(file)).collect();
+    let mut resolver = GoReferenceResolver::new();
+    let uses = collect_uses(files, &mut resolver);
+
+    let mut reported_dirs: Vec<&Path> = files
+        .iter()
+        .zip(&is_test)
+        .filter(|(file, is_test)| !**is_test && reportable(index_root, file, scope, excluded))
+        .filter_map(|(file, _)| file.parent())
+        .collect();
+    reported_dirs.sort();
+    reported_dirs.dedup();
+    let reported: HashSet<&Path> = files
+        .iter()
+        .filter(|file| reportable(index_root, file, scope, excluded))
+        .map(PathBuf::as_path)
+        .collect();
+
+    let mut candidates = Vec::new();
+    for dir in reported_dirs {
+        let decls: Vec<GoDecl> = resolver.package(dir).decls.values().cloned().collect();
+        for decl in decls {
+            if !reported.contains(decl.file.as_path()) || is_cgo_export(&decl) {
+                continue;
+            }
+            let key = (dir.to_path_buf(), decl.name.clone());
+            let mut referrers: HashSet<usize> =
+                uses.qualified.get(&key).cloned().unwrap_or_default();
+            for &(file, line) in uses.unqualified.get(&key).into_iter().flatten() {
+                let within_decl = files[file] == decl.file
+                    && (decl.span.line_start..=decl.span.line_end).contains(&line);
+                if !within_decl {
+                    referrers.insert(file);
+                }
+            }
+            if referrers.iter().any(|&file| !is_test[file]) {
+                continue;
+            }
+            candidates.push(DeadCodeCandidate {
+                file: decl.file.clone(),
+                line: decl.span.line_start,
+                line_end: decl.span.line_end,
+                name: decl.name,
+                kind: decl.kind,
+                test_references: referrers.len(),
+            });
+        }
+    }
+    candidates.sort_by(|a, b| (&a.file, a.line).cmp(&(&b.file, b.line)));
+    candidates
+}
+
+/// Whether `file` is under `scope` and not excluded, relative to the index.
+fn reportable(index_root: &Path, file: &Path, scope: &Path, excluded: &GlobSet) -> bool {
+    let relative = file.strip_prefix(index_root).unwrap_or(file);
+    relative.starts_with(scope) && !super::should_exclude_path(relative, excluded)
+}
+
+fn is_test_file(file: &Path) -> bool {
+    file.file_name()
+        .and_then(|name| name.to_str())
+        .is_some_and(|name| name.ends_with("_test.go"))
+}
+
+/// Every exported identifier written in `files`, by the index of the file.
+fn collect_uses(files: &[PathBuf], resolver: &mut GoReferenceResolver) -> Uses {
+    let mut uses = Uses::default();
+    for (index, file) in files.iter().enumerate() {
+        let (Ok(content), Some(dir)) = (fs::read_to_string(file), file.parent()) else {
+            continue;
+        };
+        if let Some(module) = resolver.module_of(dir) {
+            let qualifiers = resolver.qualifiers(&module, &content);
+            for (qualifier, name) in qualified_names(content.lines()) {
+                if let Some(target) = qualifiers.get(&qualifier) {
+                    uses.qualified
+                        .entry((target.clone(), name))
+                        .or_default()
+                        .insert(index);
+                }
+            }
+        }
+        for (line_index, line) in content.lines().enumerate() {
+            let code = LITERAL_OR_COMMENT.replace_all(line, "\"\"");
+            let code = METHOD_HEAD.replace(&code, "");
+            for caps in EXPORTED_IDENT.captures_iter(&code) {
+                uses.unqualified
+                    .entry((dir.to_path_buf(), caps[2].to_string()))
+                    .or_default()
+                    .push((index, line_index + 1));
+            }
+        }
+    }
+    uses
+}
+
+/// A function cgo exports to C is called from outside Go.
+fn is_cgo_export(decl: &GoDecl) -> bool {
+    if decl.kind != GoDeclKind::Func || decl.span.line_start < 2 {
+        return false;
+    }
+    let Ok(content) = fs::read_to_string(&decl.file) else {
+        return false;
+    };
+    content
+        .lines()
+        .nth(decl.span.line_start - 2)
+        .is_some_and(|line| line.trim() == format!("//export {}", decl.name))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::build_globset;
+    use tempfile::TempDir;
+
+    const SERVICE: &str = "package service
+
+// Used by the handler.
+func GetUser(id string) *User {
+	return &User{}
+}
+
+type User struct{}
+
+// Only the tests call it.
+func Reset() {}
+
+// Calls itself, and nothing else does.
+func Walk(n int) {
+	if n > 0 {
+		Walk(n - 1)
+	}
+}
+
+func (u *User) Stale() {}
+
+//export Callback
+func Callback() {}
+
+const (
+	Limit  = 10
+	Unused = \"Limit\"
+)
+
+func clamp(n int) int {
+	if n > Limit {
+		return Limit
+	}
+	return n
+}
+";
+
+    const HANDLER: &str = "package api
+
+import svc \"example.com/shop/service\"
+
+func Show(id string) {
+	svc.GetUser(id)
+}
+";
+
+    const SERVICE_TEST: &str = "package service
+
+import \"testing\"
+
+func TestReset(t *testing.T) {
+	Reset()
+}
+";
+
+    fn write(root: &Path, relative: &str, content: &str) {
+        let path = root.join(relative);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, content).unwrap();
+    }
+
+    fn go_module() -> (TempDir, Vec<PathBuf>) {
+        let repo = TempDir::new().unwrap();
+        let root = repo.path();
+        write(root, "go.mod", "module example.com/shop\n\ngo 1.22\n");
+        write(root, "service/service.go", SERVICE);
+        write(root, "service/service_test.go", SERVICE_TEST);
+        write(root, "api/api.go", HANDLER);
+        let files = [
+            "api/api.go",
+            "service/service.go",
+            "service/service_test.go",
+        ]
+        .iter()
+        .map(|relative| root.join(relative))
+        .collect();
+        (repo, files)
+    }
+
+    #[test]
+    fn uses_are_collected_outside_literals_and_receivers() {
+        let (repo, files) = go_module();
+        let mut resolver = GoReferenceResolver::new();
+        let uses = collect_uses(&files, &mut resolver);
+        let service = repo.path().join("service");
+        let key = |name: &str| (service.clone(), name.to_string());
+
+        // The handler's qualified call resolves into the service package
+        assert_eq!(uses.qualified[&key("GetUser")], HashSet::from([0]));
+        // The method's receiver isn't a use of User, its body's literal is
+        assert_eq!(uses.unqualified[&key("User")], vec![(1, 4), (1, 5), (1, 8)]);
+        // Nor is a string that happens to spell a name
+        assert_eq!(
+            uses.unqualified[&key("Limit")],
+            vec![(1, 26), (1, 31), (1, 32)]
+        );
+        assert_eq!(uses.unqualified[&key("Reset")], vec![(1, 11), (2, 6)]);
+        assert!(!uses.unqualified.contains_key(&key("Stale")));
+    }
+
+    #[test]
+    fn candidates_are_declarations_only_tests_use() {
+        let (repo, files) = go_module();
+        let names = |scope: &str, exclude: &[&str]| {
+            let exclude: Vec<String> = exclude.iter().map(|glob| glob.to_string()).collect();
+            candidates(
+                repo.path(),
+                &files,
+                Path::new(scope),
+                &build_globset(&exclude),
+            )
+            .into_iter()
+            .map(|candidate| (candidate.name, candidate.test_references))
+            .collect::<Vec<_>>()
+        };
+
+        // Recursion isn't a use, a cgo export is called from C
+        let everything = [
+            ("Show".to_string(), 0),
+            ("Reset".to_string(), 1),
+            ("Walk".to_string(), 0),
+            ("Unused".to_string(), 0),
+        ];
+        assert_eq!(names("", &[]), everything);
+        // An excluded entry point isn't reported, its references still count
+        assert_eq!(names("", &["api/**"]), everything[1..]);
+        assert_eq!(names("api", &[]), everything[..1]);
+    }
+}
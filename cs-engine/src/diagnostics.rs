@@ -0,0 +1,255 @@
+//! Why a search found nothing. [`diagnose`] looks for what the searcher can
+//! act on: results just beneath the threshold, a filter that ruled out every
+//! result on its own, and files the index leaves out that mention the query.
+
+use anyhow::Result;
+use cs_core::{SearchMode, SearchOptions, SearchResult};
+use cs_index::Exclusion;
+use regex::RegexBuilder;
+use std::collections::HashSet;
+use std::fs;
+use std::path::PathBuf;
+
+/// Results beneath the threshold to show.
+pub const NEAREST_RESULTS: usize = 3;
+/// Files left out of the index to report that mention the query.
+const MAX_EXCLUDED_HITS: usize = 5;
+/// Excluded files read looking for the query, and the largest one read.
+const MAX_SCANNED_FILES: usize = 5_000;
+const MAX_SCANNED_BYTES: u64 = 1024 * 1024;
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct FilterFinding {
+    /// The flag, or for generated code the one that lifts it
+    pub filter: &'static str,
+    /// Results the search has without it
+    pub results: usize,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct ExcludedHit {
+    pub file: PathBuf,
+    /// First line mentioning the query
+    pub line: usize,
+    pub exclusion: Exclusion,
+}
+
+#[derive(Debug, Default)]
+pub struct Diagnosis {
+    /// Best results beneath the threshold, best first
+    pub nearest: Vec<SearchResult>,
+    /// Filters that alone ruled out every result
+    pub filters: Vec<FilterFinding>,
+    pub excluded: Vec<ExcludedHit>,
+}
+
+impl Diagnosis {
+    pub fn is_empty(&self) -> bool {
+        self.nearest.is_empty() && self.filters.is_empty() && self.excluded.is_empty()
+    }
+}
+
+/// What to try after `options` found nothing. Searches again without the
+/// threshold and without each filter in turn, and reads the files the index
+/// leaves out, so it costs a few searches.
+pub async fn diagnose(options: &SearchOptions) -> Result<Diagnosis> {
+    let mut options = options.clone();
+    options.reindex = false;
+    options.no_index_update = true;
+    options.explain_plan = false;
+    options.explain_scores = false;
+
+    let mut diagnosis = Diagnosis::default();
+    if options.threshold.is_some()
+        && matches!(options.mode, SearchMode::Semantic | SearchMode::Hybrid)
+    {
+        let mut unbounded = options.clone();
+        unbounded.threshold = None;
+        unbounded.top_k = Some(NEAREST_RESULTS);
+        diagnosis.nearest = super::search(&unbounded).await?;
+    }
+
+    for (filter, active, lift) in filters(&options) {
+        if !active {
+            continue;
+        }
+        let mut unfiltered = options.clone();
+        lift(&mut unfiltered);
+        let results = super::search(&unfiltered).await?.len();
+        if results > 0 {
+            diagnosis.filters.push(FilterFinding { filter, results });
+        }
+    }
+
+    if options.path.is_dir() {
+        diagnosis.excluded = excluded_hits(&options)?;
+    }
+    Ok(diagnosis)
+}
+
+type Lift = fn(&mut SearchOptions);
+
+/// The filters a search can be narrowed by, whether `options` sets them,
+/// and how to lift them.
+fn filters(options: &SearchOptions) -> [(&'static str, bool, Lift); 7] {
+    [
+        ("--facet", !options.facet_filters.is_empty(), |o| {
+            o.facet_filters.clear()
+        }),
+        ("--license", !options.license_filters.is_empty(), |o| {
+            o.license_filters.clear()
+        }),
+        ("--meta", !options.metadata_filters.is_empty(), |o| {
+            o.metadata_filters.clear()
+        }),
+        ("--tag", !options.tag_filters.is_empty(), |o| {
+            o.tag_filters.clear()
+        }),
+        ("--must-match", options.must_match.is_some(), |o| {
+            o.must_match = None
+        }),
+        ("--collection", !options.collections.is_empty(), |o| {
+            o.collections.clear()
+        }),
+        (
+            "--include-generated",
+            // Regex and AST searches don't leave generated code out
+            !options.include_generated
+                && !matches!(options.mode, SearchMode::Regex | SearchMode::Ast),
+            |o| o.include_generated = true,
+        ),
+    ]
+}
+
+/// Files under the search path that the index leaves out and that mention
+/// the query: match a regex search's pattern, or have a line with most of
+/// the words of any other.
+fn excluded_hits(options: &SearchOptions) -> Result<Vec<ExcludedHit>> {
+    let line_matches: Box<dyn Fn(&str) -> bool> = if options.mode == SearchMode::Regex {
+        let pattern = if options.fixed_string {
+            regex::escape(&options.query)
+        } else {
+            options.query.clone()
+        };
+        let Ok(regex) = RegexBuilder::new(&pattern)
+            .case_insensitive(options.case_insensitive)
+            .build()
+        else {
+            return Ok(Vec::new());
+        };
+        Box::new(move |line| regex.is_match(line))
+    } else {
+        let words = query_words(&options.query);
+        if words.is_empty() {
+            return Ok(Vec::new());
+        }
+        let needed = words.len().div_ceil(2);
+        Box::new(move |line| {
+            let line = line.to_lowercase();
+            words
+                .iter()
+                .filter(|word| line.contains(word.as_str()))
+                .count()
+                >= needed
+        })
+    };
+
+    let mut hits = Vec::new();
+    let excluded = cs_index::excluded_files(
+        &options.path,
+        options.respect_gitignore,
+        &options.exclude_patterns,
+    )?;
+    for (file, exclusion) in excluded.into_iter().take(MAX_SCANNED_FILES) {
+        if !fs::metadata(&file).is_ok_and(|meta| meta.len() <= MAX_SCANNED_BYTES) {
+            continue;
+        }
+        // Binary and unreadable files have nothing to show
+        let Ok(content) = fs::read_to_string(&file) else {
+            continue;
+        };
+        if let Some(line) = content.lines().position(|line| line_matches(line)) {
+            hits.push(ExcludedHit {
+                file,
+                line: line + 1,
+                exclusion,
+            });
+            if hits.len() == MAX_EXCLUDED_HITS {
+                break;
+            }
+        }
+    }
+    Ok(hits)
+}
+
+/// The distinct lowercase words of `query` long enough to mean something.
+fn query_words(query: &str) -> Vec<String> {
+    let mut seen = HashSet::new();
+    query
+        .split(|c: char| !c.is_alphanumeric() && c != '_')
+        .filter(|word| word.chars().count() >= 3)
+        .map(str::to_lowercase)
+        .filter(|word| seen.insert(word.clone()))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn excluded_files_mentioning_the_query_are_found() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join("third_party")).unwrap();
+        fs::write(
+            root.join("third_party").join("backoff.go"),
+            "package backoff\n\n// Retry with exponential backoff and a budget\nfunc Retry() {}\n",
+        )
+        .unwrap();
+        fs::write(root.join("main.go"), "package main\n").unwrap();
+
+        let mut options = SearchOptions {
+            mode: SearchMode::Semantic,
+            query: "retry budget".to_string(),
+            path: root.to_path_buf(),
+            exclude_patterns: vec!["third_party/".to_string()],
+            ..Default::default()
+        };
+        let hits = excluded_hits(&options).unwrap();
+        assert_eq!(hits.len(), 1);
+        assert_eq!(hits[0].file, root.join("third_party").join("backoff.go"));
+        assert_eq!(hits[0].line, 3);
+        assert_eq!(
+            hits[0].exclusion,
+            Exclusion::Pattern("third_party/".to_string())
+        );
+
+        // Regex searches look for the pattern itself
+        options.mode = SearchMode::Regex;
+        options.query = r"func \w+\(".to_string();
+        assert_eq!(excluded_hits(&options).unwrap()[0].line, 4);
+        options.query = "budget retry".to_string();
+        assert!(excluded_hits(&options).unwrap().is_empty());
+    }
+
+    #[test]
+    fn only_the_filters_a_search_sets_are_lifted() {
+        let options = SearchOptions {
+            mode: SearchMode::Regex,
+            tag_filters: vec!["auth".to_string()],
+            ..Default::default()
+        };
+        let active: Vec<&str> = filters(&options)
+            .into_iter()
+            .filter(|(_, active, _)| *active)
+            .map(|(filter, _, _)| filter)
+            .collect();
+        assert_eq!(active, ["--tag"]);
+        assert_eq!(
+            query_words("Retry the retry budget"),
+            ["retry", "the", "budget"]
+        );
+    }
+}
@@ -0,0 +1,378 @@
+//! `cs --drift`: documentation sections whose code changed after they were
+//! last written, so what the docs say may no longer be true.
+//!
+//! Each doc chunk (Markdown, reStructuredText, AsciiDoc) is paired with the
+//! code chunks it describes: ones it names, by a backticked symbol or a file
+//! path, that are at least loosely similar, and ones whose embeddings are
+//! close on their own. `git blame` says when each chunk's lines last
+//! changed; a section is reported when code paired with it changed within
+//! the window and after the section itself.
+
+use anyhow::{Context, Result, bail};
+use rayon::prelude::*;
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::sync::LazyLock;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use crate::compare::{ChunkLocation, IndexedChunk, Sources, dot, indexed_chunks};
+
+/// How recent a code change must be to count, unless `--drift-days` says
+/// otherwise.
+pub const DEFAULT_DRIFT_DAYS: u64 = 90;
+
+const DOC_EXTENSIONS: [&str; 5] = ["md", "markdown", "mdx", "rst", "adoc"];
+
+/// Similarity a doc chunk and a code chunk need to be paired when the doc
+/// doesn't name the code.
+const PAIR_THRESHOLD: f32 = 0.8;
+
+/// Similarity enough when the doc names the code's symbol or file.
+const NAMED_PAIR_THRESHOLD: f32 = 0.5;
+
+/// Code chunks each doc chunk is paired with at most.
+const MAX_PAIRS: usize = 3;
+
+/// Names written as code: `parse_config`, `Config::load()`
+static CODE_SPAN: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"`([^`\n]+)`").unwrap());
+
+static IDENTIFIER: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"[A-Za-z_][A-Za-z0-9_]{2,}").unwrap());
+
+#[derive(Debug, Clone, Serialize)]
+pub struct DriftedCode {
+    pub location: ChunkLocation,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    pub similarity: f32,
+    /// The doc names the code's symbol or file
+    pub named: bool,
+    /// When its lines last changed, in seconds since the epoch
+    pub changed: u64,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct DocDrift {
+    pub doc: ChunkLocation,
+    /// The heading the chunk is under
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub section: Option<String>,
+    pub doc_changed: u64,
+    /// Paired code that changed since, most recently changed first
+    pub code: Vec<DriftedCode>,
+}
+
+/// Doc sections under `scope` in the index at `index_root` whose paired
+/// code changed in the last `days` days and after they did, those with the
+/// most recent code change first.
+pub fn find_drift(index_root: &Path, scope: &Path, days: u64) -> Result<Vec<DocDrift>> {
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let scope = cs_core::paths::canonicalize_lossy(scope);
+    let scope = scope.strip_prefix(&root).unwrap_or(Path::new(""));
+    let relative = |chunk: &IndexedChunk| -> PathBuf {
+        chunk
+            .location
+            .file
+            .strip_prefix(index_root)
+            .unwrap_or(&chunk.location.file)
+            .to_path_buf()
+    };
+    let (docs, code): (Vec<IndexedChunk>, Vec<IndexedChunk>) = indexed_chunks(index_root)?
+        .into_iter()
+        .filter(|chunk| is_doc(&chunk.location.file) || is_code(&chunk.location.file))
+        .partition(|chunk| is_doc(&chunk.location.file));
+    let docs: Vec<IndexedChunk> = docs
+        .into_iter()
+        .filter(|chunk| relative(chunk).starts_with(scope))
+        .collect();
+    if docs.is_empty() || code.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let mut sources = Sources::default();
+    let doc_texts: Vec<String> = docs
+        .iter()
+        .map(|chunk| sources.text(chunk).unwrap_or_default())
+        .collect();
+    let code_paths: Vec<String> = code
+        .iter()
+        .map(|chunk| cs_core::paths::to_slash(&relative(chunk)))
+        .collect();
+    let pairs: Vec<Vec<(usize, f32, bool)>> = docs
+        .par_iter()
+        .zip(&doc_texts)
+        .map(|(doc, text)| pair(doc, text, &code, &code_paths))
+        .collect();
+
+    let mut blame = Blame::new(index_root)?;
+    let since = now().saturating_sub(days * 24 * 60 * 60);
+    let mut drifts = Vec::new();
+    for (doc, pairs) in docs.iter().zip(pairs) {
+        if pairs.is_empty() {
+            continue;
+        }
+        let doc_changed = blame.changed(doc);
+        let mut drifted: Vec<DriftedCode> = pairs
+            .into_iter()
+            .filter_map(|(j, similarity, named)| {
+                let changed = blame.changed(&code[j]);
+                (changed > doc_changed && changed >= since).then(|| DriftedCode {
+                    location: ChunkLocation {
+                        file: relative(&code[j]),
+                        ..code[j].location.clone()
+                    },
+                    symbol: code[j].symbol.clone(),
+                    similarity: similarity.min(1.0),
+                    named,
+                    changed,
+                })
+            })
+            .collect();
+        if drifted.is_empty() {
+            continue;
+        }
+        drifted.sort_by(|a, b| b.changed.cmp(&a.changed));
+        drifts.push(DocDrift {
+            doc: ChunkLocation {
+                file: relative(doc),
+                ..doc.location.clone()
+            },
+            section: fs::read(&doc.location.file).ok().and_then(|bytes| {
+                section_heading(&cs_core::text::decode(&bytes).text, doc.location.line_start)
+            }),
+            doc_changed,
+            code: drifted,
+        });
+    }
+    drifts.sort_by(|a, b| {
+        b.code[0]
+            .changed
+            .cmp(&a.code[0].changed)
+            .then_with(|| (&a.doc.file, a.doc.line_start).cmp(&(&b.doc.file, b.doc.line_start)))
+    });
+    Ok(drifts)
+}
+
+fn is_doc(file: &Path) -> bool {
+    file.extension()
+        .and_then(|ext| ext.to_str())
+        .is_some_and(|ext| DOC_EXTENSIONS.contains(&ext.to_ascii_lowercase().as_str()))
+}
+
+fn is_code(file: &Path) -> bool {
+    cs_core::Language::from_path(file).is_some_and(|lang| lang != cs_core::Language::Pdf)
+}
+
+/// The code chunks the doc chunk with `text` describes, as (index,
+/// similarity, named): named ones first, then the most similar.
+fn pair(
+    doc: &IndexedChunk,
+    text: &str,
+    code: &[IndexedChunk],
+    code_paths: &[String],
+) -> Vec<(usize, f32, bool)> {
+    let names = mentioned_names(text);
+    let mut pairs: Vec<(usize, f32, bool)> = code
+        .iter()
+        .enumerate()
+        .filter_map(|(j, chunk)| {
+            let similarity = dot(&doc.embedding, &chunk.embedding);
+            let named = chunk
+                .symbol
+                .as_ref()
+                .is_some_and(|symbol| names.contains(symbol.as_str()))
+                || text.contains(code_paths[j].as_str());
+            let threshold = if named {
+                NAMED_PAIR_THRESHOLD
+            } else {
+                PAIR_THRESHOLD
+            };
+            (similarity >= threshold).then_some((j, similarity, named))
+        })
+        .collect();
+    pairs.sort_by(|a, b| b.2.cmp(&a.2).then_with(|| b.1.total_cmp(&a.1)));
+    pairs.truncate(MAX_PAIRS);
+    pairs
+}
+
+/// Identifiers written as code in `text`; `Config::load()` names both
+/// `Config` and `load`.
+fn mentioned_names(text: &str) -> HashSet<&str> {
+    CODE_SPAN
+        .captures_iter(text)
+        .filter_map(|captures| captures.get(1))
+        .flat_map(|span| IDENTIFIER.find_iter(span.as_str()))
+        .map(|name| name.as_str())
+        .collect()
+}
+
+/// The Markdown heading above line `line` (1-based) of `text`, if any.
+fn section_heading(text: &str, line: usize) -> Option<String> {
+    let mut in_fence = false;
+    let mut heading = None;
+    for content in text.lines().take(line) {
+        if content.trim_start().starts_with("```") {
+            in_fence = !in_fence;
+        } else if !in_fence && content.starts_with('#') {
+            heading = Some(content.trim_start_matches('#').trim().to_string());
+        }
+    }
+    heading.filter(|heading| !heading.is_empty())
+}
+
+/// When each line of each file last changed, by `git blame`, read once per
+/// file.
+struct Blame {
+    root: PathBuf,
+    lines: HashMap<PathBuf, Vec<u64>>,
+}
+
+impl Blame {
+    fn new(root: &Path) -> Result<Self> {
+        let output = Command::new("git")
+            .arg("-C")
+            .arg(root)
+            .args(["rev-parse", "--is-inside-work-tree"])
+            .output()
+            .context("Failed to run git; --drift needs git on PATH")?;
+        if !output.status.success() {
+            bail!(
+                "{} isn't in a git checkout; --drift reads when code changed from git blame",
+                root.display()
+            );
+        }
+        Ok(Self {
+            root: root.to_path_buf(),
+            lines: HashMap::new(),
+        })
+    }
+
+    /// When the newest of `chunk`'s lines changed. Lines git doesn't know,
+    /// in a file not yet committed, changed when the file was last written.
+    fn changed(&mut self, chunk: &IndexedChunk) -> u64 {
+        let file = &chunk.location.file;
+        let root = &self.root;
+        let times = self
+            .lines
+            .entry(file.clone())
+            .or_insert_with(|| blame_times(root, file));
+        let (start, end) = (chunk.location.line_start, chunk.location.line_end);
+        times
+            .get(start.saturating_sub(1)..end.min(times.len()))
+            .and_then(|lines| lines.iter().max().copied())
+            .unwrap_or_else(|| modified(file))
+    }
+}
+
+fn blame_times(root: &Path, file: &Path) -> Vec<u64> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(root)
+        .args(["blame", "--line-porcelain", "--"])
+        .arg(file)
+        .output();
+    match output {
+        Ok(output) if output.status.success() => {
+            parse_blame(&String::from_utf8_lossy(&output.stdout))
+        }
+        _ => Vec::new(),
+    }
+}
+
+/// Commit time of each line, in order, from `git blame --line-porcelain`.
+fn parse_blame(porcelain: &str) -> Vec<u64> {
+    porcelain
+        .lines()
+        .filter_map(|line| line.strip_prefix("committer-time "))
+        .filter_map(|time| time.trim().parse().ok())
+        .collect()
+}
+
+fn modified(file: &Path) -> u64 {
+    fs::metadata(file)
+        .and_then(|metadata| metadata.modified())
+        .ok()
+        .and_then(|modified| modified.duration_since(UNIX_EPOCH).ok())
+        .map_or(0, |age| age.as_secs())
+}
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunk(file: &str, symbol: Option<&str>, embedding: [f32; 2]) -> IndexedChunk {
+        IndexedChunk {
+            location: ChunkLocation {
+                file: PathBuf::from(file),
+                line_start: 1,
+                line_end: 10,
+            },
+            chunk_type: None,
+            symbol: symbol.map(str::to_string),
+            byte_range: (0, 0),
+            embedding: crate::compare::normalized(&embedding).unwrap(),
+        }
+    }
+
+    #[test]
+    fn docs_pair_with_the_code_they_name_or_resemble() {
+        let doc = chunk("docs/config.md", None, [1.0, 0.2]);
+        let code = vec![
+            chunk("src/config.rs", Some("load_config"), [0.6, 0.8]),
+            chunk("src/cache.rs", Some("evict"), [1.0, 0.25]),
+            chunk("src/http.rs", Some("serve"), [0.0, 1.0]),
+        ];
+        let paths: Vec<String> = code
+            .iter()
+            .map(|chunk| cs_core::paths::to_slash(&chunk.location.file))
+            .collect();
+        let text = "Settings are read by `load_config()` at startup.";
+        let pairs = pair(&doc, text, &code, &paths);
+        // Named but only loosely similar, then unnamed but close
+        assert_eq!(
+            pairs
+                .iter()
+                .map(|&(j, _, named)| (j, named))
+                .collect::<Vec<_>>(),
+            [(0, true), (1, false)]
+        );
+        let by_path = pair(&doc, "See src/config.rs.", &code, &paths);
+        assert_eq!((by_path[0].0, by_path[0].2), (0, true));
+
+        let names = mentioned_names("Call `Config::load()` or `x`, not Config");
+        assert_eq!(names, HashSet::from(["Config", "load"]));
+    }
+
+    #[test]
+    fn blame_and_headings_are_read_per_line() {
+        let porcelain = "\
+a1b2c3 1 1 2
+author A
+committer-time 1700000000
+\tfn main() {
+a1b2c3 2 2
+committer-time 1700000000
+\t}
+0000000 3 3 1
+committer-time 1800000000
+\t// uncommitted
+";
+        assert_eq!(parse_blame(porcelain), [1700000000, 1700000000, 1800000000]);
+
+        let text = "# Guide\n\n## Configuration\n\n```sh\n# not a heading\n```\nSet it.\n";
+        assert_eq!(section_heading(text, 8).as_deref(), Some("Configuration"));
+        assert_eq!(section_heading(text, 1).as_deref(), Some("Guide"));
+        assert_eq!(section_heading("intro\n", 1), None);
+    }
+}
@@ -0,0 +1,295 @@
+//! `cs --hook pre-commit`: code added in the staged changes that nearly
+//! duplicates a function already in the index, so the commit can reuse it
+//! instead. Staged files are read from git's index, chunked and embedded in
+//! memory with the index's model; the index itself is left untouched.
+
+use anyhow::{Context, Result, bail};
+use rayon::prelude::*;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use crate::compare::{
+    ChunkLocation, IndexedChunk, MIN_CHUNK_BYTES, dot, embedding_model, indexed_chunks, normalized,
+};
+
+/// Similarity a staged chunk needs to be flagged unless `--dupe-threshold`
+/// says otherwise.
+pub const DEFAULT_DUPE_THRESHOLD: f32 = 0.95;
+
+/// Chunk types worth reusing; modules and plain text are left out.
+const REUSABLE_CHUNK_TYPES: [&str; 3] = ["function", "method", "class"];
+
+#[derive(Debug, Clone, Serialize)]
+pub struct StagedDuplicate {
+    /// The new code, in the staged (or, for a diff, working tree) version of
+    /// its file
+    pub staged: ChunkLocation,
+    /// The indexed code it resembles
+    pub existing: ChunkLocation,
+    pub similarity: f32,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub chunk_type: Option<String>,
+}
+
+/// Functions, methods and classes touched by the staged changes of the repo
+/// at `repo_root` that are at least `threshold` similar to one in another
+/// file of its index, most similar first. Each staged chunk is reported with
+/// its closest match only.
+pub fn staged_duplicates(repo_root: &Path, threshold: f32) -> Result<Vec<StagedDuplicate>> {
+    duplicates_in(repo_root, staged_additions(repo_root)?, threshold, |file| {
+        staged_text(repo_root, file)
+    })
+}
+
+/// As [`staged_duplicates`], for the working tree's changes since `rev`.
+pub fn diff_duplicates(
+    repo_root: &Path,
+    rev: &str,
+    threshold: f32,
+) -> Result<Vec<StagedDuplicate>> {
+    duplicates_in(
+        repo_root,
+        crate::related::diff_additions(repo_root, rev)?,
+        threshold,
+        |file| Ok(cs_core::text::read_text(&repo_root.join(file)).ok()),
+    )
+}
+
+/// Chunks touching `additions` that duplicate indexed code, reading each
+/// changed file's new version with `read`.
+fn duplicates_in(
+    repo_root: &Path,
+    additions: BTreeMap<PathBuf, Vec<(usize, usize)>>,
+    threshold: f32,
+    read: impl Fn(&Path) -> Result<Option<String>>,
+) -> Result<Vec<StagedDuplicate>> {
+    let Some(model) = embedding_model(repo_root)? else {
+        bail!(
+            "The index at {} has no embeddings; rebuild it with cs --index",
+            repo_root.display()
+        );
+    };
+    if additions.is_empty() {
+        return Ok(Vec::new());
+    }
+    let existing: Vec<IndexedChunk> = indexed_chunks(repo_root)?
+        .into_iter()
+        .filter(|chunk| is_reusable(chunk.chunk_type.as_deref()))
+        .collect();
+    if existing.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let mut embedder = cs_embed::create_embedder(Some(model.as_str()))?;
+    let mut staged = Vec::new();
+    let mut texts = Vec::new();
+    for (file, added) in &additions {
+        let Some(content) = read(file)? else {
+            continue;
+        };
+        let Some(lang) = cs_core::Language::from_path(file) else {
+            continue;
+        };
+        if cs_index::generated::is_generated(&content) {
+            continue;
+        }
+        for chunk in cs_chunk::chunk_text_with_model(&content, Some(lang), Some(model.as_str()))? {
+            let chunk_type = chunk_type_name(chunk.chunk_type);
+            if !is_reusable(chunk_type)
+                || chunk.text.len() < MIN_CHUNK_BYTES
+                || !touches(added, chunk.span.line_start, chunk.span.line_end)
+            {
+                continue;
+            }
+            // Only what a remote embedder may see leaves the machine
+            let Some(text) = cs_index::secrets::screen_chunk(
+                &*embedder,
+                repo_root,
+                file,
+                &chunk.text,
+                &chunk.span,
+            )?
+            else {
+                continue;
+            };
+            staged.push((
+                ChunkLocation {
+                    file: file.clone(),
+                    line_start: chunk.span.line_start,
+                    line_end: chunk.span.line_end,
+                },
+                chunk_type,
+            ));
+            texts.push(text);
+        }
+    }
+    if texts.is_empty() {
+        return Ok(Vec::new());
+    }
+    let embeddings = embedder.embed(&texts)?;
+    if embeddings.len() != texts.len() {
+        bail!(
+            "The embedder returned {} vectors for {} changed chunks",
+            embeddings.len(),
+            texts.len()
+        );
+    }
+
+    let mut duplicates: Vec<StagedDuplicate> = staged
+        .into_par_iter()
+        .zip(embeddings)
+        .filter_map(|((location, chunk_type), embedding)| {
+            let embedding = normalized(&embedding)?;
+            existing
+                .iter()
+                // The file's own indexed chunks are the code being changed
+                .filter(|other| {
+                    other.location.file.strip_prefix(repo_root).ok()
+                        != Some(location.file.as_path())
+                })
+                .map(|other| (other, dot(&embedding, &other.embedding)))
+                .filter(|(_, similarity)| *similarity >= threshold)
+                .max_by(|a, b| a.1.total_cmp(&b.1))
+                .map(|(other, similarity)| StagedDuplicate {
+                    staged: location.clone(),
+                    existing: other.location.clone(),
+                    similarity: similarity.min(1.0),
+                    chunk_type: chunk_type.map(str::to_string),
+                })
+        })
+        .collect();
+    duplicates.sort_by(|a, b| b.similarity.total_cmp(&a.similarity));
+    Ok(duplicates)
+}
+
+fn is_reusable(chunk_type: Option<&str>) -> bool {
+    chunk_type.is_some_and(|chunk_type| REUSABLE_CHUNK_TYPES.contains(&chunk_type))
+}
+
+pub(crate) fn chunk_type_name(chunk_type: cs_chunk::ChunkType) -> Option<&'static str> {
+    match chunk_type {
+        cs_chunk::ChunkType::Function => Some("function"),
+        cs_chunk::ChunkType::Class => Some("class"),
+        cs_chunk::ChunkType::Method => Some("method"),
+        cs_chunk::ChunkType::Module => Some("module"),
+        cs_chunk::ChunkType::Text => None,
+    }
+}
+
+/// Whether lines `start..=end` overlap one of the `added` ranges.
+pub(crate) fn touches(added: &[(usize, usize)], start: usize, end: usize) -> bool {
+    added.iter().any(|&(from, to)| from <= end && start <= to)
+}
+
+/// Lines added or changed per staged file, relative to `repo_root`.
+fn staged_additions(repo_root: &Path) -> Result<BTreeMap<PathBuf, Vec<(usize, usize)>>> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(repo_root)
+        .args([
+            "-c",
+            "core.quotePath=off",
+            "diff",
+            "--cached",
+            "--relative",
+            "--unified=0",
+            "--no-color",
+            "--no-ext-diff",
+            "--diff-filter=AM",
+        ])
+        .output()
+        .context("Failed to run git; --hook needs git on PATH")?;
+    if !output.status.success() {
+        bail!(
+            "git diff --cached failed in {}: {}",
+            repo_root.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(parse_additions(&String::from_utf8_lossy(&output.stdout)))
+}
+
+/// Added line ranges per file from a `--unified=0` diff.
+pub(crate) fn parse_additions(diff: &str) -> BTreeMap<PathBuf, Vec<(usize, usize)>> {
+    let mut additions: BTreeMap<PathBuf, Vec<(usize, usize)>> = BTreeMap::new();
+    let mut file = None;
+    let mut previous = "";
+    for line in diff.lines() {
+        // A header only right after `---`, not an added line that starts with "++"
+        if previous.starts_with("--- ")
+            && let Some(path) = line.strip_prefix("+++ ")
+        {
+            file = path.strip_prefix("b/").map(PathBuf::from);
+        } else if let Some(hunk) = line.strip_prefix("@@ ")
+            && let Some(file) = &file
+            && let Some(new) = hunk.split(' ').find_map(|range| range.strip_prefix('+'))
+        {
+            let (start, count) = new.split_once(',').unwrap_or((new, "1"));
+            let (Ok(start), Ok(count)) = (start.parse::<usize>(), count.parse::<usize>()) else {
+                continue;
+            };
+            if count > 0 {
+                additions
+                    .entry(file.clone())
+                    .or_default()
+                    .push((start, start + count - 1));
+            }
+        }
+        previous = line;
+    }
+    additions
+}
+
+/// The staged version of `file`, or `None` if it isn't text.
+fn staged_text(repo_root: &Path, file: &Path) -> Result<Option<String>> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(repo_root)
+        .arg("show")
+        .arg(format!(":./{}", file.display()))
+        .output()
+        .context("Failed to run git; --hook needs git on PATH")?;
+    if !output.status.success() {
+        bail!(
+            "Could not read the staged {}: {}",
+            file.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8(output.stdout).ok())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn added_ranges_come_from_new_side_of_hunks() {
+        let diff = "\
+diff --git a/src/auth.rs b/src/auth.rs
+--- a/src/auth.rs
++++ b/src/auth.rs
+@@ -10,0 +11,6 @@ fn login() {
++fn refresh() {
+@@ -40 +46 @@ fn logout() {
+-    old();
++    new();
+@@ -60,3 +65,0 @@
+diff --git a/src/new.rs b/src/new.rs
+--- /dev/null
++++ b/src/new.rs
+@@ -0,0 +1,20 @@
+";
+        let additions = parse_additions(diff);
+        assert_eq!(
+            additions[Path::new("src/auth.rs")],
+            vec![(11, 16), (46, 46)]
+        );
+        assert_eq!(additions[Path::new("src/new.rs")], vec![(1, 20)]);
+
+        assert!(touches(&additions[Path::new("src/auth.rs")], 40, 50));
+        assert!(!touches(&additions[Path::new("src/auth.rs")], 17, 45));
+    }
+}
@@ -0,0 +1,404 @@
+//! Ephemeral indexes: a working set of files and patches (a pull request's
+//! diff, say) chunked and embedded in memory, searched, then dropped, so an
+//! agent can retrieve over what it's reviewing without reading or writing
+//! an index on disk.
+//!
+//! Files are chunked the way indexing chunks them. Each hunk of a unified
+//! diff becomes a chunk of the lines it leaves in the new file, context
+//! included; hunks that only remove lines are left out. Results point at
+//! the new file's lines, which is where the patch puts them.
+
+use anyhow::{Context, Result};
+use cs_core::{SearchResult, Span};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Hunks longer than this are split, so a large one isn't a single blurred
+/// embedding.
+const MAX_HUNK_LINES: usize = 60;
+
+/// Lines of a chunk kept as its result's preview, as in semantic search.
+const PREVIEW_LINES: usize = 3;
+
+/// Lines of one file a patch adds or keeps.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PatchHunk {
+    /// The file as named on the patch's `+++` line, without git's `b/`
+    pub file: PathBuf,
+    /// 1-based lines in the new file
+    pub line_start: usize,
+    pub line_end: usize,
+    pub text: String,
+}
+
+/// A hunk being read: where it starts in the new file, the lines it has left
+/// to read on each side, and its new-file lines with whether each was added.
+struct OpenHunk<'a> {
+    line_start: usize,
+    old_left: usize,
+    new_left: usize,
+    lines: Vec<(&'a str, bool)>,
+}
+
+/// The hunks of the unified diff `patch` that add lines, split at
+/// [`MAX_HUNK_LINES`].
+pub fn patch_hunks(patch: &str) -> Vec<PatchHunk> {
+    let mut hunks = Vec::new();
+    let mut file: Option<PathBuf> = None;
+    let mut open: Option<OpenHunk> = None;
+
+    for line in patch.lines() {
+        if let Some(hunk) = open
+            .as_mut()
+            .filter(|hunk| hunk.old_left > 0 || hunk.new_left > 0)
+        {
+            match line.as_bytes().first() {
+                Some(b'+') => {
+                    hunk.lines.push((&line[1..], true));
+                    hunk.new_left = hunk.new_left.saturating_sub(1);
+                }
+                Some(b'-') => hunk.old_left = hunk.old_left.saturating_sub(1),
+                // "\ No newline at end of file"
+                Some(b'\\') => {}
+                _ => {
+                    hunk.lines.push((line.get(1..).unwrap_or(""), false));
+                    hunk.old_left = hunk.old_left.saturating_sub(1);
+                    hunk.new_left = hunk.new_left.saturating_sub(1);
+                }
+            }
+            continue;
+        }
+
+        if let Some(path) = line.strip_prefix("+++ ") {
+            close_hunk(file.as_deref(), open.take(), &mut hunks);
+            file = new_file_path(path);
+        } else if line.starts_with("@@ ") {
+            close_hunk(file.as_deref(), open.take(), &mut hunks);
+            open = parse_hunk_header(line);
+        }
+    }
+    close_hunk(file.as_deref(), open, &mut hunks);
+    hunks
+}
+
+/// The path on a `+++` line, `None` for a deleted file.
+fn new_file_path(path: &str) -> Option<PathBuf> {
+    // `diff -u` follows the name with a tab and a timestamp
+    let path = path.split('\t').next().unwrap_or(path).trim();
+    if path == "/dev/null" {
+        return None;
+    }
+    Some(PathBuf::from(path.strip_prefix("b/").unwrap_or(path)))
+}
+
+/// `@@ -12,5 +12,7 @@ ...` as a hunk starting at line 12 with 5 old and 7
+/// new lines to read.
+fn parse_hunk_header(line: &str) -> Option<OpenHunk<'_>> {
+    fn range(range: &str) -> Option<(usize, usize)> {
+        match range.split_once(',') {
+            Some((start, len)) => Some((start.parse().ok()?, len.parse().ok()?)),
+            None => Some((range.parse().ok()?, 1)),
+        }
+    }
+
+    let mut fields = line.split_whitespace().skip(1);
+    let (_, old_len) = range(fields.next()?.strip_prefix('-')?)?;
+    let (line_start, new_len) = range(fields.next()?.strip_prefix('+')?)?;
+    Some(OpenHunk {
+        line_start,
+        old_left: old_len,
+        new_left: new_len,
+        lines: Vec::new(),
+    })
+}
+
+fn close_hunk(file: Option<&Path>, hunk: Option<OpenHunk>, hunks: &mut Vec<PatchHunk>) {
+    let (Some(file), Some(hunk)) = (file, hunk) else {
+        return;
+    };
+    for (i, window) in hunk.lines.chunks(MAX_HUNK_LINES).enumerate() {
+        if !window.iter().any(|(_, added)| *added) {
+            continue;
+        }
+        let line_start = hunk.line_start + i * MAX_HUNK_LINES;
+        hunks.push(PatchHunk {
+            file: file.to_path_buf(),
+            line_start,
+            line_end: line_start + window.len() - 1,
+            text: window
+                .iter()
+                .map(|(text, _)| *text)
+                .collect::<Vec<_>>()
+                .join("\n"),
+        });
+    }
+}
+
+struct EphemeralChunk {
+    file: PathBuf,
+    span: Span,
+    preview: String,
+    embedding: Vec<f32>,
+}
+
+/// Files and patches embedded in memory for the length of a session.
+pub struct EphemeralIndex {
+    embedder: Box<dyn cs_embed::Embedder>,
+    root: PathBuf,
+    chunks: Vec<EphemeralChunk>,
+    files: usize,
+    skipped: Vec<(PathBuf, String)>,
+}
+
+impl EphemeralIndex {
+    /// Chunk and embed `files` and the unified diffs in `patches`, relative
+    /// to `root`, with `model` or else the model of the index `root` is in.
+    pub fn build(
+        root: &Path,
+        files: &[PathBuf],
+        patches: &[String],
+        model: Option<&str>,
+    ) -> Result<Self> {
+        let resolved = super::resolve_model_for_path(root, model)?;
+        let embedder = cs_embed::create_embedder(Some(&resolved.canonical_name))?;
+        Self::with_embedder(embedder, root, files, patches)
+    }
+
+    /// [`EphemeralIndex::build`] with an embedder of the caller's choosing.
+    pub fn with_embedder(
+        mut embedder: Box<dyn cs_embed::Embedder>,
+        root: &Path,
+        files: &[PathBuf],
+        patches: &[String],
+    ) -> Result<Self> {
+        let mut chunks = Vec::new();
+        let mut sources = std::collections::BTreeSet::new();
+        let mut skipped = Vec::new();
+
+        for file in files {
+            let path = root.join(file);
+            let entry = match cs_index::index_file_in_memory(&path, root, &mut embedder) {
+                Ok(entry) => entry,
+                Err(e) => {
+                    skipped.push((file.clone(), e.to_string()));
+                    continue;
+                }
+            };
+            let content = String::from_utf8_lossy(&fs::read(&path)?).into_owned();
+            for chunk in entry.chunks {
+                let Some(embedding) = chunk.embedding else {
+                    continue;
+                };
+                chunks.push(EphemeralChunk {
+                    file: path.clone(),
+                    preview: preview(&content, &chunk.span),
+                    span: chunk.span,
+                    embedding,
+                });
+            }
+            sources.insert(path);
+        }
+
+        let mut hunks = Vec::new();
+        let mut texts = Vec::new();
+        for hunk in patches.iter().flat_map(|patch| patch_hunks(patch)) {
+            let text = cs_index::normalizers::normalize(root, &hunk.text)?;
+            if let Some(text) = cs_index::secrets::screen(&*embedder, root, &text)? {
+                texts.push(text);
+                hunks.push(hunk);
+            } else {
+                skipped.push((hunk.file, "Hunk holds a secret".to_string()));
+            }
+        }
+        if !texts.is_empty() {
+            let embeddings = embedder.embed(&texts)?;
+            for (hunk, embedding) in hunks.into_iter().zip(embeddings) {
+                let file = root.join(&hunk.file);
+                chunks.push(EphemeralChunk {
+                    span: Span {
+                        // Offsets into the new file aren't known from the patch
+                        byte_start: 0,
+                        byte_end: 0,
+                        line_start: hunk.line_start,
+                        line_end: hunk.line_end,
+                    },
+                    preview: preview_lines(&hunk.text),
+                    embedding,
+                    file: file.clone(),
+                });
+                sources.insert(file);
+            }
+        }
+
+        Ok(Self {
+            embedder,
+            root: root.to_path_buf(),
+            chunks,
+            files: sources.len(),
+            skipped,
+        })
+    }
+
+    /// Files indexed, from `files` or a patch.
+    pub fn file_count(&self) -> usize {
+        self.files
+    }
+
+    pub fn chunk_count(&self) -> usize {
+        self.chunks.len()
+    }
+
+    /// Files and hunks left out, and why.
+    pub fn skipped(&self) -> &[(PathBuf, String)] {
+        &self.skipped
+    }
+
+    /// The `top_k` chunks closest to `query`, best first, leaving out those
+    /// scoring below `threshold`.
+    pub fn search(
+        &mut self,
+        query: &str,
+        top_k: usize,
+        threshold: Option<f32>,
+    ) -> Result<Vec<SearchResult>> {
+        let query = cs_index::redaction::prepare_query(&*self.embedder, &self.root, query)?;
+        let query_embedding = self
+            .embedder
+            .embed(&[query])?
+            .pop()
+            .context("Embedder returned no query embedding")?;
+
+        let mut scored: Vec<(f32, &EphemeralChunk)> = self
+            .chunks
+            .iter()
+            .map(|chunk| {
+                let score =
+                    super::semantic_v3::cosine_similarity(&query_embedding, &chunk.embedding);
+                (score, chunk)
+            })
+            .filter(|(score, _)| threshold.is_none_or(|threshold| *score >= threshold))
+            .collect();
+        scored.sort_by(|a, b| {
+            b.0.total_cmp(&a.0)
+                .then_with(|| a.1.file.cmp(&b.1.file))
+                .then_with(|| a.1.span.line_start.cmp(&b.1.span.line_start))
+        });
+        scored.truncate(top_k);
+
+        Ok(scored
+            .into_iter()
+            .map(|(score, chunk)| SearchResult {
+                file: chunk.file.clone(),
+                span: chunk.span.clone(),
+                score,
+                preview: chunk.preview.clone(),
+                lang: cs_core::Language::from_path(&chunk.file),
+                symbol: None,
+                chunk_hash: None,
+                index_epoch: None,
+            })
+            .collect())
+    }
+}
+
+fn preview(content: &str, span: &Span) -> String {
+    content
+        .get(span.byte_start..span.byte_end)
+        .map(preview_lines)
+        .unwrap_or_default()
+}
+
+fn preview_lines(text: &str) -> String {
+    text.lines()
+        .take(PREVIEW_LINES)
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PATCH: &str = "\
+diff --git a/src/retry.go b/src/retry.go
+index 3f2a9c1..77b01e2 100644
+--- a/src/retry.go
++++ b/src/retry.go
+@@ -10,5 +10,5 @@ func retry(ctx context.Context) error {
+ \tfor attempt := 0; ; attempt++ {
+-\t\ttime.Sleep(time.Second)
+--- not a file header
++\t\tdelay := backoff(attempt)
++\t\ttime.Sleep(delay)
+ \t}
+ }
+@@ -40,3 +42,2 @@ func backoff(n int) time.Duration {
+ \treturn time.Duration(n) * time.Second
+-\t// TODO: jitter
+ }
+diff --git a/src/old.go b/src/old.go
+deleted file mode 100644
+--- a/src/old.go
++++ /dev/null
+@@ -1,2 +0,0 @@
+-package src
+-func old() {}
+diff --git a/src/new.go b/src/new.go
+new file mode 100644
+--- /dev/null
++++ b/src/new.go
+@@ -0,0 +1,2 @@
++package src
++func jitter() {}
+\\ No newline at end of file
+";
+
+    #[test]
+    fn patches_become_new_file_hunks() {
+        let hunks = patch_hunks(PATCH);
+        assert_eq!(
+            hunks,
+            [
+                PatchHunk {
+                    file: PathBuf::from("src/retry.go"),
+                    line_start: 10,
+                    line_end: 14,
+                    text: "\tfor attempt := 0; ; attempt++ {\n\t\tdelay := backoff(attempt)\n\t\ttime.Sleep(delay)\n\t}\n}".to_string(),
+                },
+                PatchHunk {
+                    file: PathBuf::from("src/new.go"),
+                    line_start: 1,
+                    line_end: 2,
+                    text: "package src\nfunc jitter() {}".to_string(),
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn long_hunks_are_split() {
+        let added: String = (0..MAX_HUNK_LINES + 5)
+            .map(|i| format!("+line {}\n", i))
+            .collect();
+        let patch = format!(
+            "--- /dev/null\n+++ b/big.txt\n@@ -0,0 +1,{} @@\n{}",
+            MAX_HUNK_LINES + 5,
+            added
+        );
+        let hunks = patch_hunks(&patch);
+        assert_eq!(hunks.len(), 2);
+        assert_eq!(
+            (hunks[0].line_start, hunks[0].line_end),
+            (1, MAX_HUNK_LINES)
+        );
+        assert_eq!(
+            (hunks[1].line_start, hunks[1].line_end),
+            (MAX_HUNK_LINES + 1, MAX_HUNK_LINES + 5)
+        );
+        assert!(
+            hunks[1]
+                .text
+                .starts_with(&format!("line {}", MAX_HUNK_LINES))
+        );
+    }
+}
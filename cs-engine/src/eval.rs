@@ -0,0 +1,362 @@
+//! `cs --eval-compare`: run a golden query set under two search
+//! configurations and compare their retrieval metrics, to decide between
+//! models, index settings or fusion and boost settings on the team's own
+//! queries rather than a public benchmark.
+//!
+//! The golden set lives in `.csgolden.toml` at the index root (or `--golden`),
+//! each query with the code that should answer it, as a file or a line in it:
+//!
+//! ```toml
+//! [[query]]
+//! query = "retry with exponential backoff"
+//! relevant = ["internal/http/retry.go", "internal/http/client.go:88"]
+//! ```
+//!
+//! Each configuration is a TOML file of search settings (see
+//! [`EvalConfig`]). Index-time settings such as the index model or chunk
+//! sizes are compared by pointing `path` at a checkout indexed that way.
+
+use anyhow::{Context, Result};
+use cs_core::{BoostRule, SearchMode, SearchOptions, SearchResult, StopSymbolRule};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::Instant;
+
+pub const GOLDEN_FILE: &str = ".csgolden.toml";
+
+/// Results fetched per query unless a configuration sets `topk`.
+const DEFAULT_TOP_K: usize = 10;
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct GoldenQuery {
+    pub query: String,
+    /// Files relative to the index root, or `file:line` for the code at a line
+    pub relevant: Vec<String>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct GoldenFile {
+    #[serde(default)]
+    query: Vec<GoldenQuery>,
+}
+
+/// The golden queries in `path`, which must have at least one.
+pub fn load_golden_set(path: &Path) -> Result<Vec<GoldenQuery>> {
+    let content = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read golden queries from {}", path.display()))?;
+    let file: GoldenFile =
+        toml::from_str(&content).with_context(|| format!("Failed to parse {}", path.display()))?;
+    if let Some(query) = file.query.iter().find(|query| query.relevant.is_empty()) {
+        anyhow::bail!(
+            "Golden query '{}' in {} lists no relevant code",
+            query.query,
+            path.display()
+        );
+    }
+    if file.query.is_empty() {
+        anyhow::bail!("No [[query]] entries in {}", path.display());
+    }
+    Ok(file.query)
+}
+
+/// One side of a comparison: the search settings a configuration file
+/// changes. Anything it leaves out is the same for both sides.
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct EvalConfig {
+    /// Name in the report; defaults to the file name
+    pub name: Option<String>,
+    /// "sem" (default), "hybrid", "lex" or "regex"
+    pub mode: Option<String>,
+    /// Checkout to search instead, e.g. one indexed with another model or chunk size
+    pub path: Option<PathBuf>,
+    /// Query model
+    pub model: Option<String>,
+    pub topk: Option<usize>,
+    pub threshold: Option<f32>,
+    pub rerank: bool,
+    pub rerank_model: Option<String>,
+    pub truncate_dims: Option<usize>,
+    /// `[[boost]]` rules added to the repository's
+    pub boost: Vec<BoostRule>,
+    /// `[[stop_symbol]]` rules added to the repository's
+    pub stop_symbol: Vec<StopSymbolRule>,
+}
+
+impl EvalConfig {
+    pub fn load(path: &Path) -> Result<Self> {
+        let content = fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        let mut config: EvalConfig = toml::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display()))?;
+        if config.name.is_none() {
+            config.name = path
+                .file_stem()
+                .map(|stem| stem.to_string_lossy().to_string());
+        }
+        Ok(config)
+    }
+
+    /// `base` with this configuration's settings.
+    pub fn apply(&self, base: &SearchOptions) -> Result<SearchOptions> {
+        let mode = match self.mode.as_deref().unwrap_or("sem") {
+            "sem" | "semantic" => SearchMode::Semantic,
+            "hybrid" => SearchMode::Hybrid,
+            "lex" | "lexical" => SearchMode::Lexical,
+            "regex" => SearchMode::Regex,
+            other => anyhow::bail!(
+                "Unknown mode '{}' in {}; use sem, hybrid, lex or regex",
+                other,
+                self.name.as_deref().unwrap_or("the configuration")
+            ),
+        };
+        let mut options = SearchOptions {
+            mode,
+            path: self.path.clone().unwrap_or_else(|| base.path.clone()),
+            top_k: Some(self.topk.unwrap_or(DEFAULT_TOP_K)),
+            threshold: self.threshold,
+            rerank: self.rerank,
+            rerank_model: self.rerank_model.clone(),
+            embedding_model: self.model.clone().or_else(|| base.embedding_model.clone()),
+            truncate_dims: self.truncate_dims,
+            // Every query is timed doing the whole search
+            no_query_cache: true,
+            ..base.clone()
+        };
+        options.boost_rules.extend(self.boost.iter().cloned());
+        options
+            .stop_symbol_rules
+            .extend(self.stop_symbol.iter().cloned());
+        Ok(options)
+    }
+}
+
+/// Retrieval metrics of one query, or their means over the golden set.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Serialize)]
+pub struct Metrics {
+    pub precision_at_1: f64,
+    pub precision_at_5: f64,
+    pub recall_at_10: f64,
+    pub mrr: f64,
+    pub ndcg_at_10: f64,
+    pub latency_ms: f64,
+}
+
+impl Metrics {
+    /// The metrics of a ranked list where `gains[i]` is whether result `i`
+    /// found relevant code not found above it, out of `relevant` pieces.
+    fn from_gains(gains: &[bool], relevant: usize) -> Self {
+        let found = |k: usize| gains.iter().take(k).filter(|&&gain| gain).count() as f64;
+        let dcg = |gains: &mut dyn Iterator<Item = bool>| -> f64 {
+            gains
+                .enumerate()
+                .filter(|&(_, gain)| gain)
+                .map(|(i, _)| 1.0 / (i as f64 + 2.0).log2())
+                .sum()
+        };
+        let ideal = dcg(&mut std::iter::repeat_n(true, relevant.min(10)));
+        Metrics {
+            precision_at_1: found(1),
+            precision_at_5: found(5) / 5.0,
+            recall_at_10: found(10) / relevant.max(1) as f64,
+            mrr: gains
+                .iter()
+                .position(|&gain| gain)
+                .map_or(0.0, |i| 1.0 / (i as f64 + 1.0)),
+            ndcg_at_10: if ideal > 0.0 {
+                dcg(&mut gains.iter().copied().take(10)) / ideal
+            } else {
+                0.0
+            },
+            latency_ms: 0.0,
+        }
+    }
+
+    fn mean(all: &[Metrics]) -> Self {
+        let n = all.len().max(1) as f64;
+        let sum = |metric: fn(&Metrics) -> f64| all.iter().map(metric).sum::<f64>() / n;
+        Metrics {
+            precision_at_1: sum(|m| m.precision_at_1),
+            precision_at_5: sum(|m| m.precision_at_5),
+            recall_at_10: sum(|m| m.recall_at_10),
+            mrr: sum(|m| m.mrr),
+            ndcg_at_10: sum(|m| m.ndcg_at_10),
+            latency_ms: sum(|m| m.latency_ms),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct QueryOutcome {
+    pub query: String,
+    /// Rank of the first result that is relevant, from 1
+    pub first_relevant: Option<usize>,
+    pub metrics: Metrics,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct EvalReport {
+    pub name: String,
+    pub queries: Vec<QueryOutcome>,
+    pub mean: Metrics,
+}
+
+/// Whether `result`, relative to `root`, is the code `judgment` names.
+fn is_relevant(result: &SearchResult, root: &Path, judgment: &str) -> bool {
+    let relative = result.file.strip_prefix(root).unwrap_or(&result.file);
+    let file = cs_core::paths::to_relative_slash(relative);
+    match judgment.rsplit_once(':') {
+        Some((path, line)) if line.parse::<usize>().is_ok() => {
+            let line: usize = line.parse().unwrap_or_default();
+            file == path && (result.span.line_start..=result.span.line_end).contains(&line)
+        }
+        _ => file == judgment.trim_start_matches("./"),
+    }
+}
+
+/// For each of `results`, whether it found a piece of relevant code that no
+/// result above it did, so a file's second chunk isn't counted again.
+fn gains(results: &[SearchResult], root: &Path, relevant: &[String]) -> Vec<bool> {
+    let mut found = vec![false; relevant.len()];
+    results
+        .iter()
+        .map(|result| {
+            let mut gain = false;
+            for (judgment, found) in relevant.iter().zip(found.iter_mut()) {
+                if !*found && is_relevant(result, root, judgment) {
+                    *found = true;
+                    gain = true;
+                }
+            }
+            gain
+        })
+        .collect()
+}
+
+/// Run every golden query with `options` and measure the results.
+pub async fn evaluate(
+    name: &str,
+    golden: &[GoldenQuery],
+    options: &SearchOptions,
+) -> Result<EvalReport> {
+    let root = cs_core::paths::canonicalize_lossy(
+        &super::find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone()),
+    );
+    let mut queries = Vec::with_capacity(golden.len());
+    for golden_query in golden {
+        let options = SearchOptions {
+            query: golden_query.query.clone(),
+            ..options.clone()
+        };
+        let started = Instant::now();
+        let results = super::search(&options).await?;
+        let elapsed = started.elapsed();
+
+        let results: Vec<SearchResult> = results
+            .into_iter()
+            .map(|mut result| {
+                result.file = cs_core::paths::canonicalize_lossy(&result.file);
+                result
+            })
+            .collect();
+        let gains = gains(&results, &root, &golden_query.relevant);
+        let mut metrics = Metrics::from_gains(&gains, golden_query.relevant.len());
+        metrics.latency_ms = elapsed.as_secs_f64() * 1000.0;
+        queries.push(QueryOutcome {
+            query: golden_query.query.clone(),
+            first_relevant: gains.iter().position(|&gain| gain).map(|i| i + 1),
+            metrics,
+        });
+    }
+    let mean = Metrics::mean(&queries.iter().map(|q| q.metrics).collect::<Vec<_>>());
+    Ok(EvalReport {
+        name: name.to_string(),
+        queries,
+        mean,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn metrics_credit_each_relevant_piece_once() {
+        let relevant = vec![
+            "internal/http/retry.go".to_string(),
+            "internal/http/client.go:88".to_string(),
+        ];
+        let results = vec![
+            SearchResult::for_lines(
+                Path::new("/repo").join("internal/http/transport.go"),
+                1,
+                40,
+                0.5,
+            ),
+            SearchResult::for_lines(
+                Path::new("/repo").join("internal/http/retry.go"),
+                1,
+                30,
+                0.5,
+            ),
+            SearchResult::for_lines(
+                Path::new("/repo").join("internal/http/retry.go"),
+                31,
+                60,
+                0.5,
+            ),
+            SearchResult::for_lines(
+                Path::new("/repo").join("internal/http/client.go"),
+                70,
+                95,
+                0.5,
+            ),
+            SearchResult::for_lines(
+                Path::new("/repo").join("internal/http/client.go"),
+                1,
+                20,
+                0.5,
+            ),
+        ];
+        let gains = gains(&results, Path::new("/repo"), &relevant);
+        assert_eq!(gains, [false, true, false, true, false]);
+
+        let metrics = Metrics::from_gains(&gains, relevant.len());
+        assert_eq!(metrics.precision_at_1, 0.0);
+        assert!((metrics.precision_at_5 - 0.4).abs() < 1e-9);
+        assert_eq!(metrics.recall_at_10, 1.0);
+        assert_eq!(metrics.mrr, 0.5);
+        let dcg = 1.0 / 3f64.log2() + 1.0 / 5f64.log2();
+        let ideal = 1.0 + 1.0 / 3f64.log2();
+        assert!((metrics.ndcg_at_10 - dcg / ideal).abs() < 1e-9);
+
+        let none = Metrics::from_gains(&[false, false], relevant.len());
+        assert_eq!(none, Metrics::default());
+    }
+
+    #[test]
+    fn configurations_override_the_shared_options() {
+        let config: EvalConfig = toml::from_str(
+            "mode = \"hybrid\"\ntopk = 20\nrerank = true\n\n[[boost]]\npath = \"internal/**\"\nfactor = 1.2\n",
+        )
+        .unwrap();
+        let base = SearchOptions {
+            path: PathBuf::from("/repo"),
+            embedding_model: Some("bge-small".to_string()),
+            ..Default::default()
+        };
+        let options = config.apply(&base).unwrap();
+        assert_eq!(options.mode, SearchMode::Hybrid);
+        assert_eq!(options.top_k, Some(20));
+        assert!(options.rerank);
+        assert_eq!(options.embedding_model.as_deref(), Some("bge-small"));
+        assert_eq!(options.boost_rules.len(), 1);
+        assert!(options.no_query_cache);
+
+        let unknown = toml::from_str::<EvalConfig>("chunk_size = 512\n");
+        assert!(unknown.is_err());
+        let bad_mode: EvalConfig = toml::from_str("mode = \"fuzzy\"\n").unwrap();
+        assert!(bad_mode.apply(&base).is_err());
+    }
+}
@@ -0,0 +1,225 @@
+//! `--format sarif|csv`: a search's results in formats review and triage
+//! tools import. SARIF results are notes of one rule standing for the query,
+//! located relative to the repository root; CSV has a row per result.
+//! [`crate::audit`] builds its logs from the same pieces.
+
+use cs_core::{SearchMode, SearchResult};
+use serde_json::{Value, json};
+use std::path::Path;
+use std::str::FromStr;
+
+const SARIF_SCHEMA: &str = "https://json.schemastore.org/sarif-2.1.0.json";
+
+/// Id of the rule search results are reported under.
+const SEARCH_RULE: &str = "cs/search";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ExportFormat {
+    Sarif,
+    Csv,
+}
+
+impl FromStr for ExportFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "sarif" => Ok(Self::Sarif),
+            "csv" => Ok(Self::Csv),
+            other => Err(format!(
+                "Unknown export format '{}'; expected sarif or csv",
+                other
+            )),
+        }
+    }
+}
+
+/// `file` relative to `root`, with forward slashes.
+fn relative(root: &Path, file: &Path) -> String {
+    let file = cs_core::paths::canonicalize_lossy(file);
+    cs_core::paths::to_relative_slash(file.strip_prefix(root).unwrap_or(&file))
+}
+
+/// A SARIF 2.1.0 log of one cs run, whose `rules` the `results` refer to.
+/// `automation` tells runs of different searches or packs apart, so a
+/// dashboard doesn't close one's alerts when the other is uploaded.
+pub fn sarif_log(rules: Vec<Value>, results: Vec<Value>, automation: &str) -> Value {
+    json!({
+        "$schema": SARIF_SCHEMA,
+        "version": "2.1.0",
+        "runs": [{
+            "tool": {
+                "driver": {
+                    "name": "cs",
+                    "semanticVersion": env!("CARGO_PKG_VERSION"),
+                    "informationUri": "https://github.com/lwyBZss8924d/semcs",
+                    "rules": rules,
+                },
+            },
+            "automationDetails": { "id": format!("{}/", automation) },
+            "results": results,
+        }],
+    })
+}
+
+/// Where a SARIF result is: `file` relative to the repository root
+/// (`%SRCROOT%`), from `line_start` to `line_end`, showing `snippet`.
+pub fn sarif_location(file: &str, line_start: usize, line_end: usize, snippet: &str) -> Value {
+    json!({
+        "physicalLocation": {
+            "artifactLocation": { "uri": file, "uriBaseId": "%SRCROOT%" },
+            "region": {
+                "startLine": line_start,
+                "endLine": line_end.max(line_start),
+                "snippet": { "text": snippet },
+            },
+        },
+    })
+}
+
+/// The fingerprint that keeps an alert on a chunk when lines above it move.
+pub fn sarif_fingerprint(chunk_hash: &str) -> Value {
+    json!({ "csChunkHash/v1": chunk_hash })
+}
+
+/// `results` of the `mode` search for `query` as a SARIF log, with files
+/// relative to `root`.
+pub fn to_sarif(results: &[SearchResult], root: &Path, query: &str, mode: &SearchMode) -> Value {
+    let mode = format!("{:?}", mode).to_lowercase();
+    let rule = json!({
+        "id": SEARCH_RULE,
+        "name": "SearchMatch",
+        "shortDescription": { "text": format!("Matches the {} search \"{}\"", mode, query) },
+        "defaultConfiguration": { "level": "note" },
+        "properties": { "query": query, "mode": mode },
+    });
+    let results = results
+        .iter()
+        .map(|result| {
+            let message = match &result.symbol {
+                Some(symbol) => format!("{} matches \"{}\"", symbol, query),
+                None => format!("Matches \"{}\"", query),
+            };
+            let mut sarif = json!({
+                "ruleId": SEARCH_RULE,
+                "ruleIndex": 0,
+                "level": "note",
+                "message": { "text": message },
+                "locations": [sarif_location(
+                    &relative(root, &result.file),
+                    result.span.line_start,
+                    result.span.line_end,
+                    &result.preview,
+                )],
+                "properties": { "score": result.score },
+            });
+            if let Some(hash) = &result.chunk_hash {
+                sarif["partialFingerprints"] = sarif_fingerprint(hash);
+            }
+            sarif
+        })
+        .collect();
+    sarif_log(vec![rule], results, &format!("cs-search/{}", query))
+}
+
+/// A CSV field, quoted when it has to be (RFC 4180).
+pub(crate) fn csv_field(value: &str) -> String {
+    if value.contains([',', '"', '\n', '\r']) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+/// `results` as CSV with a header row, with files relative to `root`.
+pub fn to_csv(results: &[SearchResult], root: &Path) -> String {
+    let mut csv = String::from("file,line_start,line_end,score,language,symbol,preview\n");
+    for result in results {
+        let row = [
+            relative(root, &result.file),
+            result.span.line_start.to_string(),
+            result.span.line_end.to_string(),
+            format!("{:.4}", result.score),
+            result.lang.map(|lang| lang.to_string()).unwrap_or_default(),
+            result.symbol.clone().unwrap_or_default(),
+            result.preview.clone(),
+        ];
+        let row: Vec<String> = row.iter().map(|field| csv_field(field)).collect();
+        csv.push_str(&row.join(","));
+        csv.push('\n');
+    }
+    csv
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn result(file: &str, symbol: Option<&str>, preview: &str) -> SearchResult {
+        SearchResult {
+            preview: preview.to_string(),
+            symbol: symbol.map(str::to_string),
+            chunk_hash: Some("c0ffee".to_string()),
+            ..SearchResult::for_lines(Path::new("/repo").join(file), 12, 20, 0.8125)
+        }
+    }
+
+    #[test]
+    fn csv_quotes_fields_that_need_it() {
+        let results = [
+            result("internal/retry.go", Some("Backoff"), "func Backoff() {}"),
+            result("cmd/main.go", None, "fmt.Println(\"a, b\")\nreturn"),
+        ];
+        let csv = to_csv(&results, Path::new("/repo"));
+        let mut lines = csv.lines();
+        assert_eq!(
+            lines.next(),
+            Some("file,line_start,line_end,score,language,symbol,preview")
+        );
+        assert_eq!(
+            lines.next(),
+            Some("internal/retry.go,12,20,0.8125,go,Backoff,func Backoff() {}")
+        );
+        assert_eq!(
+            lines.next(),
+            Some("cmd/main.go,12,20,0.8125,go,,\"fmt.Println(\"\"a, b\"\")")
+        );
+        assert_eq!(lines.next(), Some("return\""));
+    }
+
+    #[test]
+    fn sarif_reports_results_as_notes_of_the_query() {
+        let results = [result(
+            "internal/retry.go",
+            Some("Backoff"),
+            "func Backoff() {}",
+        )];
+        let sarif = to_sarif(
+            &results,
+            Path::new("/repo"),
+            "retry with backoff",
+            &SearchMode::Semantic,
+        );
+        assert_eq!(sarif["version"], "2.1.0");
+        let run = &sarif["runs"][0];
+        assert_eq!(run["tool"]["driver"]["rules"][0]["id"], SEARCH_RULE);
+        assert_eq!(
+            run["automationDetails"]["id"],
+            "cs-search/retry with backoff/"
+        );
+        let result = &run["results"][0];
+        assert_eq!(result["level"], "note");
+        assert_eq!(
+            result["message"]["text"],
+            "Backoff matches \"retry with backoff\""
+        );
+        let location = &result["locations"][0]["physicalLocation"];
+        assert_eq!(location["artifactLocation"]["uri"], "internal/retry.go");
+        assert_eq!(location["region"]["startLine"], 12);
+        assert_eq!(location["region"]["endLine"], 20);
+        assert_eq!(result["partialFingerprints"]["csChunkHash/v1"], "c0ffee");
+
+        assert_eq!("SARIF".parse::<ExportFormat>(), Ok(ExportFormat::Sarif));
+        assert!("xml".parse::<ExportFormat>().is_err());
+    }
+}
@@ -0,0 +1,412 @@
+//! Faceted summaries of search results: counts by language, top-level
+//! directory, symbol kind and CODEOWNERS owner, plus `--facet KEY=VALUE`
+//! drill-down filters, `--meta` filters on extractor metadata and `--tag`
+//! filters on intent tags.
+
+pub use cs_core::{FacetCount, FacetSummary};
+use cs_core::{FacetFilter, FacetKind, Language, MetadataFilter, SearchResult};
+use globset::{GlobBuilder, GlobMatcher};
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Values shown per facet in a summary.
+const MAX_FACET_VALUES: usize = 8;
+
+/// Searched in order, as GitHub and GitLab do.
+const CODEOWNERS_LOCATIONS: &[&str] = &["CODEOWNERS", ".github/CODEOWNERS", "docs/CODEOWNERS"];
+
+/// CODEOWNERS rules; the last matching rule wins.
+struct CodeOwners {
+    rules: Vec<(GlobMatcher, Vec<String>)>,
+}
+
+impl CodeOwners {
+    fn load(index_root: &Path) -> Option<Self> {
+        let content = CODEOWNERS_LOCATIONS
+            .iter()
+            .find_map(|location| fs::read_to_string(index_root.join(location)).ok())?;
+        Some(Self::parse(&content))
+    }
+
+    fn parse(content: &str) -> Self {
+        let mut rules = Vec::new();
+        for line in content.lines() {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let mut parts = line.split_whitespace();
+            let Some(pattern) = parts.next() else {
+                continue;
+            };
+            let owners: Vec<String> = parts
+                .take_while(|part| !part.starts_with('#'))
+                .map(str::to_string)
+                .collect();
+            if let Some(matcher) = codeowners_glob(pattern) {
+                rules.push((matcher, owners));
+            }
+        }
+        Self { rules }
+    }
+
+    fn owners(&self, relative: &Path) -> &[String] {
+        self.rules
+            .iter()
+            .rev()
+            .find(|(matcher, _)| matcher.is_match(relative))
+            .map(|(_, owners)| owners.as_slice())
+            .unwrap_or_default()
+    }
+}
+
+/// Translate a gitignore-style CODEOWNERS pattern into a glob.
+fn codeowners_glob(pattern: &str) -> Option<GlobMatcher> {
+    let anchored = pattern.starts_with('/') || pattern.trim_end_matches('/').contains('/');
+    let mut glob = pattern.trim_start_matches('/').to_string();
+    if glob.ends_with('/') {
+        glob.push_str("**");
+    } else if !glob.ends_with("/**") && !glob.contains('*') {
+        // A bare name can be a file or a directory
+        glob = format!("{{{glob},{glob}/**}}");
+    }
+    if !anchored {
+        glob = format!("**/{}", glob);
+    }
+    GlobBuilder::new(&glob)
+        .literal_separator(true)
+        .build()
+        .ok()
+        .map(|g| g.compile_matcher())
+}
+
+/// Resolves facet values, caching CODEOWNERS and sidecar lookups.
+pub struct FacetResolver {
+    index_root: PathBuf,
+    owners: Option<CodeOwners>,
+    sidecars: HashMap<PathBuf, Option<cs_index::IndexEntry>>,
+}
+
+impl FacetResolver {
+    pub fn new(index_root: &Path) -> Self {
+        Self {
+            index_root: index_root.to_path_buf(),
+            owners: CodeOwners::load(index_root),
+            sidecars: HashMap::new(),
+        }
+    }
+
+    fn relative(&self, file: &Path) -> PathBuf {
+        let relative = file.strip_prefix(&self.index_root).unwrap_or(file);
+        relative.strip_prefix(".").unwrap_or(relative).to_path_buf()
+    }
+
+    /// Facet values of `result` for `kind`; a file can have several owners.
+    pub fn values(&mut self, result: &SearchResult, kind: FacetKind) -> Vec<String> {
+        match kind {
+            FacetKind::SymbolKind => self.symbol_kind(result).into_iter().collect(),
+            kind => self.file_values(&result.file, result.lang, kind),
+        }
+    }
+
+    /// CODEOWNERS owners of `file`.
+    pub fn owners(&self, file: &Path) -> Vec<String> {
+        self.file_values(file, None, FacetKind::Owner)
+    }
+
+    /// Values of the facets shared by every chunk of `file`; the symbol kind
+    /// is per chunk, so it has none here.
+    fn file_values(&self, file: &Path, lang: Option<Language>, kind: FacetKind) -> Vec<String> {
+        match kind {
+            FacetKind::Language => lang.map(|l| l.to_string()).into_iter().collect(),
+            FacetKind::Directory => {
+                let relative = self.relative(file);
+                let mut components = relative.components();
+                let first = components.next();
+                match (first, components.next()) {
+                    (Some(dir), Some(_)) => vec![dir.as_os_str().to_string_lossy().to_string()],
+                    _ => vec![".".to_string()],
+                }
+            }
+            FacetKind::SymbolKind => Vec::new(),
+            FacetKind::Owner => {
+                let relative = self.relative(file);
+                self.owners
+                    .as_ref()
+                    .map(|owners| owners.owners(&relative).to_vec())
+                    .unwrap_or_default()
+            }
+        }
+    }
+
+    /// Chunk type recorded in the sidecar for the chunk starting at the result's span.
+    fn symbol_kind(&mut self, result: &SearchResult) -> Option<String> {
+        self.sidecar(&result.file)?
+            .chunks
+            .iter()
+            .find(|chunk| chunk.span.byte_start == result.span.byte_start)
+            .and_then(|chunk| chunk.chunk_type.clone())
+    }
+
+    /// Extractor metadata of the indexed chunk the result starts in; a line
+    /// match from a regex search has a span of its own.
+    fn metadata(&mut self, result: &SearchResult) -> Option<&BTreeMap<String, String>> {
+        let start = result.span.byte_start;
+        self.sidecar(&result.file)?
+            .chunks
+            .iter()
+            .find(|chunk| chunk.span.byte_start <= start && start < chunk.span.byte_end)
+            .map(|chunk| &chunk.metadata)
+    }
+
+    /// Intent tags of the indexed chunk the result starts in, none when it's
+    /// outside every chunk.
+    pub fn tags(&mut self, result: &SearchResult) -> &[String] {
+        let start = result.span.byte_start;
+        self.sidecar(&result.file)
+            .and_then(|entry| {
+                entry
+                    .chunks
+                    .iter()
+                    .find(|chunk| chunk.span.byte_start <= start && start < chunk.span.byte_end)
+            })
+            .map(|chunk| chunk.tags.as_slice())
+            .unwrap_or_default()
+    }
+
+    fn sidecar(&mut self, file: &Path) -> Option<&cs_index::IndexEntry> {
+        let index_root = &self.index_root;
+        self.sidecars
+            .entry(file.to_path_buf())
+            .or_insert_with(|| {
+                let relative = file.strip_prefix(index_root).unwrap_or(file);
+                let sidecar = cs_index::shards::sidecar_path(index_root, relative);
+                cs_index::load_index_entry(&sidecar).ok()
+            })
+            .as_ref()
+    }
+}
+
+/// Count results per facet value, most common first.
+pub fn summarize(results: &[SearchResult], index_root: &Path) -> FacetSummary {
+    let mut resolver = FacetResolver::new(index_root);
+    let mut count = |kind: FacetKind| -> Vec<FacetCount> {
+        let mut counts: HashMap<String, usize> = HashMap::new();
+        for result in results {
+            for value in resolver.values(result, kind) {
+                *counts.entry(value).or_default() += 1;
+            }
+        }
+        let mut counts: Vec<FacetCount> = counts
+            .into_iter()
+            .map(|(value, count)| FacetCount { value, count })
+            .collect();
+        counts.sort_by(|a, b| b.count.cmp(&a.count).then_with(|| a.value.cmp(&b.value)));
+        counts.truncate(MAX_FACET_VALUES);
+        counts
+    };
+
+    FacetSummary {
+        total: results.len(),
+        language: count(FacetKind::Language),
+        directory: count(FacetKind::Directory),
+        symbol_kind: count(FacetKind::SymbolKind),
+        owner: count(FacetKind::Owner),
+    }
+}
+
+/// Keep only results matching every filter (values compare case-insensitively).
+pub fn apply_facet_filters(
+    filters: &[FacetFilter],
+    index_root: &Path,
+    results: &mut Vec<SearchResult>,
+) {
+    if filters.is_empty() {
+        return;
+    }
+    let mut resolver = FacetResolver::new(index_root);
+    results.retain(|result| {
+        filters
+            .iter()
+            .all(|filter| matches(&resolver.values(result, filter.kind), filter))
+    });
+}
+
+/// Keep only index chunks matching every filter. Semantic search applies the
+/// filters this way before scoring, so a selective filter still gets `top_k`
+/// results rather than whatever survives of the unfiltered top k.
+pub fn retain_matching_chunks(
+    filters: &[FacetFilter],
+    index_root: &Path,
+    chunks: &mut Vec<(PathBuf, cs_index::ChunkEntry)>,
+) {
+    if filters.is_empty() {
+        return;
+    }
+    let resolver = FacetResolver::new(index_root);
+    let (kind_filters, file_filters): (Vec<&FacetFilter>, Vec<&FacetFilter>) = filters
+        .iter()
+        .partition(|filter| filter.kind == FacetKind::SymbolKind);
+    let mut files: HashMap<PathBuf, bool> = HashMap::new();
+    chunks.retain(|(file, chunk)| {
+        let kind = chunk.chunk_type.as_deref();
+        if !kind_filters
+            .iter()
+            .all(|filter| kind.is_some_and(|kind| kind.eq_ignore_ascii_case(&filter.value)))
+        {
+            return false;
+        }
+        if let Some(&matched) = files.get(file) {
+            return matched;
+        }
+        let lang = Language::from_path(file);
+        let matched = file_filters
+            .iter()
+            .all(|filter| matches(&resolver.file_values(file, lang, filter.kind), filter));
+        files.insert(file.clone(), matched);
+        matched
+    });
+}
+
+/// Keep only results in chunks matching every `--meta` filter. Results
+/// outside any indexed chunk have no metadata.
+pub fn apply_metadata_filters(
+    filters: &[MetadataFilter],
+    index_root: &Path,
+    results: &mut Vec<SearchResult>,
+) {
+    if filters.is_empty() {
+        return;
+    }
+    let mut resolver = FacetResolver::new(index_root);
+    let untagged = BTreeMap::new();
+    results.retain(|result| {
+        let metadata = resolver.metadata(result).unwrap_or(&untagged);
+        filters.iter().all(|filter| filter.matches(metadata))
+    });
+}
+
+/// Keep only results in chunks carrying every `--tag`.
+pub fn apply_tag_filters(filters: &[String], index_root: &Path, results: &mut Vec<SearchResult>) {
+    if filters.is_empty() {
+        return;
+    }
+    let mut resolver = FacetResolver::new(index_root);
+    results.retain(|result| cs_index::intent_tags::carries(resolver.tags(result), filters));
+}
+
+fn matches(values: &[String], filter: &FacetFilter) -> bool {
+    values
+        .iter()
+        .any(|value| value.eq_ignore_ascii_case(&filter.value))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::Span;
+    use tempfile::TempDir;
+
+    #[test]
+    fn codeowners_last_match_wins() {
+        let owners = CodeOwners::parse(
+            "# comment\n*.go @go-team\n/internal/ @platform\ndocs @writers # trailing\n",
+        );
+        assert_eq!(owners.owners(Path::new("api/user.go")), ["@go-team"]);
+        assert_eq!(owners.owners(Path::new("internal/user.go")), ["@platform"]);
+        assert_eq!(owners.owners(Path::new("a/docs/guide.md")), ["@writers"]);
+        assert!(owners.owners(Path::new("README.md")).is_empty());
+    }
+
+    #[test]
+    fn summarizes_and_filters_by_facet() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::write(root.join("CODEOWNERS"), "internal/ @platform\n").unwrap();
+
+        let mut results = vec![
+            SearchResult::for_lines(root.join("internal/auth/token.go"), 1, 1, 0.5),
+            SearchResult::for_lines(root.join("internal/db.rs"), 1, 1, 0.5),
+            SearchResult::for_lines(root.join("main.go"), 1, 1, 0.5),
+        ];
+
+        let summary = summarize(&results, root);
+        assert_eq!(summary.total, 3);
+        assert_eq!(
+            summary.language[0],
+            FacetCount {
+                value: "go".to_string(),
+                count: 2
+            }
+        );
+        assert_eq!(summary.directory[0].value, "internal");
+        assert_eq!(summary.directory[1].value, ".");
+        assert_eq!(summary.owner[0].count, 2);
+
+        let filters = vec![
+            "dir=internal".parse::<FacetFilter>().unwrap(),
+            "lang=Go".parse::<FacetFilter>().unwrap(),
+        ];
+        apply_facet_filters(&filters, root, &mut results);
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].file, root.join("internal/auth/token.go"));
+    }
+
+    #[test]
+    fn chunks_are_filtered_before_scoring() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::write(root.join("CODEOWNERS"), "internal/ @platform\n").unwrap();
+        let chunk = |file: &str, chunk_type: Option<&str>| {
+            (
+                root.join(file),
+                cs_index::ChunkEntry {
+                    span: Span {
+                        byte_start: 0,
+                        byte_end: 1,
+                        line_start: 1,
+                        line_end: 1,
+                    },
+                    embedding: None,
+                    chunk_type: chunk_type.map(str::to_string),
+                    breadcrumb: None,
+                    ancestry: None,
+                    byte_length: None,
+                    estimated_tokens: None,
+                    leading_trivia: None,
+                    trailing_trivia: None,
+                    generated: false,
+                    literals: Vec::new(),
+                    literal_embedding: None,
+                    license: None,
+                    metadata: Default::default(),
+                    symbol: None,
+                    sub_embeddings: Vec::new(),
+                    sparse: None,
+                    parent: None,
+                    signature: None,
+                    signature_embedding: None,
+                    tags: Vec::new(),
+                },
+            )
+        };
+        let mut chunks = vec![
+            chunk("internal/auth/token.go", Some("function")),
+            chunk("internal/auth/token.go", Some("struct")),
+            chunk("internal/auth/token.go", None),
+            chunk("internal/db.rs", Some("function")),
+            chunk("main.go", Some("function")),
+        ];
+
+        let filters = vec![
+            "owner=@platform".parse::<FacetFilter>().unwrap(),
+            "lang=go".parse::<FacetFilter>().unwrap(),
+            "kind=Function".parse::<FacetFilter>().unwrap(),
+        ];
+        retain_matching_chunks(&filters, root, &mut chunks);
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].0, root.join("internal/auth/token.go"));
+        assert_eq!(chunks[0].1.chunk_type.as_deref(), Some("function"));
+    }
+}
@@ -0,0 +1,365 @@
+//! Local relevance feedback: `cs --feedback <result-id> --relevant|--irrelevant "query"`.
+//!
+//! Judgments are stored per index in `.cs/feedback.json` and applied to later
+//! searches whose query is similar to the one the judgment was made for.
+//! A result id is `path:line`, exactly as printed by regular search output,
+//! or the anchor printed with JSON output (see [`super::anchors`]). Either
+//! way the judgment is stored against the chunk at that line, by the hash of
+//! its text, so it stays with that code when edits above it shift its lines
+//! and applies to any result in the chunk. Only a line no chunk holds, or a
+//! file that can't be read, is kept as `path:line`.
+
+use anyhow::Result;
+use cs_core::{CcError, SearchResult};
+
+use crate::anchors::{Anchor, AnchorLookup};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+const FEEDBACK_FILE: &str = "feedback.json";
+
+/// Minimum query similarity for a judgment to influence a search.
+const MIN_QUERY_SIMILARITY: f32 = 0.5;
+/// Score multiplier at full similarity for relevant / irrelevant judgments.
+const RELEVANT_BOOST: f32 = 0.5;
+const IRRELEVANT_PENALTY: f32 = 0.5;
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct FeedbackEntry {
+    pub result_id: String,
+    pub query: String,
+    pub relevant: bool,
+    pub recorded: u64,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct FeedbackStore {
+    pub entries: Vec<FeedbackEntry>,
+}
+
+impl FeedbackStore {
+    fn path(index_root: &Path) -> PathBuf {
+        cs_core::locations::index_dir(index_root).join(FEEDBACK_FILE)
+    }
+
+    pub fn load(index_root: &Path) -> Result<Self> {
+        let path = Self::path(index_root);
+        if !path.exists() {
+            return Ok(Self::default());
+        }
+        let data = cs_index::encryption::open_from(&path, fs::read(&path)?)?;
+        let mut store: Self = serde_json::from_slice(&data)?;
+        store.follow_renames(index_root);
+        Ok(store)
+    }
+
+    /// Point judgments of files renamed since at their new paths.
+    fn follow_renames(&mut self, index_root: &Path) {
+        let mut renames = None;
+        for entry in &mut self.entries {
+            let path = match entry.result_id.parse::<Anchor>() {
+                Ok(anchor) => anchor.path,
+                Err(_) => match entry.result_id.rsplit_once(':') {
+                    Some((path, _)) => path.to_string(),
+                    None => continue,
+                },
+            };
+            if index_root.join(&path).exists() {
+                continue;
+            }
+            if let Some(renamed) = renames
+                .get_or_insert_with(|| cs_index::renames::RenameLog::load(index_root))
+                .current_path(&path)
+            {
+                entry.result_id = format!("{}{}", renamed, &entry.result_id[path.len()..]);
+            }
+        }
+    }
+
+    pub fn save(&self, index_root: &Path) -> Result<()> {
+        let path = Self::path(index_root);
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        let data = cs_index::encryption::seal_for(&path, serde_json::to_vec_pretty(self)?)?;
+        fs::write(&path, data)?;
+        Ok(())
+    }
+
+    /// Record a judgment, replacing any earlier one for the same result and query.
+    pub fn record(&mut self, result_id: &str, query: &str, relevant: bool) {
+        let result_id = normalize_result_id(result_id);
+        let query = query.trim().to_string();
+        self.entries
+            .retain(|e| !(e.result_id == result_id && e.query == query));
+
+        let recorded = SystemTime::now()
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        self.entries.push(FeedbackEntry {
+            result_id,
+            query,
+            relevant,
+            recorded,
+        });
+    }
+
+    /// Boost or demote results judged for similar queries, then re-sort.
+    /// Returns the number of results whose score changed.
+    pub fn apply(&self, query: &str, index_root: &Path, results: &mut [SearchResult]) -> usize {
+        if self.entries.is_empty() || results.is_empty() {
+            return 0;
+        }
+
+        let chunks: Vec<Option<Anchor>> = self
+            .entries
+            .iter()
+            .map(|e| e.result_id.parse::<Anchor>().ok())
+            .collect();
+        // Results are only re-chunked for their anchors if a judgment has one
+        let mut anchors = chunks
+            .iter()
+            .any(Option::is_some)
+            .then(|| AnchorLookup::new(index_root));
+        let mut adjusted = 0;
+        for result in results.iter_mut() {
+            let id = result_id_for(result, index_root);
+            let anchor = anchors
+                .as_mut()
+                .and_then(|anchors| anchors.anchor_for(result));
+            let mut factor = 1.0f32;
+            let mut touched = false;
+
+            let judged = self
+                .entries
+                .iter()
+                .zip(&chunks)
+                .filter(|(entry, chunk)| match chunk {
+                    // Any line of the judged chunk
+                    Some(chunk) => anchor.as_ref().is_some_and(|anchor| {
+                        anchor.path == chunk.path && anchor.chunk_hash == chunk.chunk_hash
+                    }),
+                    None => entry.result_id == id,
+                });
+            for (entry, _) in judged {
+                let similarity = query_similarity(query, &entry.query);
+                if similarity < MIN_QUERY_SIMILARITY {
+                    continue;
+                }
+                touched = true;
+                if entry.relevant {
+                    factor *= 1.0 + RELEVANT_BOOST * similarity;
+                } else {
+                    factor *= 1.0 - IRRELEVANT_PENALTY * similarity;
+                }
+            }
+
+            if touched {
+                result.score *= factor;
+                adjusted += 1;
+            }
+        }
+
+        if adjusted > 0 {
+            results.sort_by(SearchResult::rank_cmp);
+        }
+        adjusted
+    }
+}
+
+/// Record a judgment in the index that covers `search_path`.
+/// Returns the index root the feedback was stored under.
+pub fn record_feedback(
+    search_path: &Path,
+    result_id: &str,
+    query: &str,
+    relevant: bool,
+) -> Result<PathBuf> {
+    let index_root = super::find_nearest_index_root(search_path).ok_or_else(|| {
+        CcError::Index(format!(
+            "No index found for {}. Run 'cs --index' before recording feedback.",
+            search_path.display()
+        ))
+    })?;
+
+    let mut store = FeedbackStore::load(&index_root)?;
+    store.record(&chunk_id(&index_root, result_id), query, relevant);
+    store.save(&index_root)?;
+    Ok(index_root)
+}
+
+/// Stable id for a result: path relative to the index root, plus start line.
+pub fn result_id_for(result: &SearchResult, index_root: &Path) -> String {
+    let path = result
+        .file
+        .strip_prefix(index_root)
+        .unwrap_or(&result.file)
+        .to_string_lossy();
+    normalize_result_id(&format!("{}:{}", path, result.span.line_start))
+}
+
+/// The anchor of the chunk a `path:line` id names in the index at
+/// `index_root`; anchors, and lines no chunk holds, are kept as they are.
+fn chunk_id(index_root: &Path, result_id: &str) -> String {
+    let id = normalize_result_id(result_id);
+    let Some((path, line)) = id.rsplit_once(':') else {
+        return id;
+    };
+    let Ok(line) = line.parse::<usize>() else {
+        return id;
+    };
+    match AnchorLookup::new(index_root).anchor_at(&index_root.join(path), line) {
+        Some(anchor) => anchor.to_string(),
+        None => id,
+    }
+}
+
+fn normalize_result_id(id: &str) -> String {
+    if let Ok(anchor) = id.parse::<Anchor>() {
+        return anchor.to_string();
+    }
+    let id = id.trim().replace('\\', "/");
+    id.trim_start_matches("./").to_string()
+}
+
+/// Jaccard overlap of lowercase query terms.
+fn query_similarity(a: &str, b: &str) -> f32 {
+    let terms = |s: &str| -> HashSet<String> {
+        s.split(|c: char| !c.is_alphanumeric())
+            .filter(|t| !t.is_empty())
+            .map(|t| t.to_lowercase())
+            .collect()
+    };
+    let (a, b) = (terms(a), terms(b));
+    if a.is_empty() || b.is_empty() {
+        return 0.0;
+    }
+    let shared = a.intersection(&b).count() as f32;
+    let total = a.union(&b).count() as f32;
+    shared / total
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn feedback_reorders_results_for_similar_queries() {
+        let root = Path::new("/repo");
+        let mut store = FeedbackStore::default();
+        store.record("./src/auth.rs:10", "token refresh logic", true);
+        store.record("src/db.rs:5", "token refresh logic", false);
+
+        let mut results = vec![
+            SearchResult::for_lines("/repo/src/db.rs", 5, 5, 0.80),
+            SearchResult::for_lines("/repo/src/auth.rs", 10, 10, 0.70),
+        ];
+        assert_eq!(store.apply("token refresh", root, &mut results), 2);
+        assert_eq!(results[0].file, PathBuf::from("/repo/src/auth.rs"));
+
+        // Unrelated queries are not affected
+        let mut results = vec![
+            SearchResult::for_lines("/repo/src/db.rs", 5, 5, 0.80),
+            SearchResult::for_lines("/repo/src/auth.rs", 10, 10, 0.70),
+        ];
+        assert_eq!(store.apply("database pool", root, &mut results), 0);
+        assert_eq!(results[0].file, PathBuf::from("/repo/src/db.rs"));
+    }
+
+    #[test]
+    fn anchored_feedback_follows_moved_code() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        let validate = "fn validate(token: &str) -> bool {\n    !token.is_empty()\n}\n";
+        fs::write(root.join("auth.rs"), validate).unwrap();
+        let anchor = AnchorLookup::new(root)
+            .anchor_for(&SearchResult::for_lines(root.join("auth.rs"), 1, 1, 0.5))
+            .unwrap();
+
+        let mut store = FeedbackStore::default();
+        store.record(&anchor.to_string(), "token validation", true);
+        fs::write(
+            root.join("auth.rs"),
+            format!("use std::fmt;\n\n{}", validate),
+        )
+        .unwrap();
+
+        let mut results = vec![
+            SearchResult::for_lines(root.join("db.rs"), 1, 1, 0.8),
+            SearchResult::for_lines(root.join("auth.rs"), 3, 3, 0.7),
+        ];
+        assert_eq!(store.apply("token validation", root, &mut results), 1);
+        assert_eq!(results[0].file, root.join("auth.rs"));
+    }
+
+    #[test]
+    fn judged_lines_are_kept_by_their_chunk() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        let refresh = "fn refresh(token: &str) -> String {\n    token.to_string()\n}\n";
+        fs::write(root.join("auth.rs"), refresh).unwrap();
+        fs::create_dir_all(cs_core::locations::index_dir(root)).unwrap();
+        record_feedback(root, "auth.rs:1", "token refresh", true).unwrap();
+        let stored = &FeedbackStore::load(root).unwrap().entries[0].result_id;
+        assert!(stored.parse::<Anchor>().is_ok(), "{}", stored);
+
+        // Edits above the function move it; the judgment moves with it
+        fs::write(
+            root.join("auth.rs"),
+            format!("use std::fmt;\n\n{}", refresh),
+        )
+        .unwrap();
+        let store = FeedbackStore::load(root).unwrap();
+        let mut results = vec![
+            SearchResult::for_lines(root.join("db.rs"), 1, 1, 0.8),
+            SearchResult::for_lines(root.join("auth.rs"), 3, 3, 0.7),
+        ];
+        assert_eq!(store.apply("token refresh", root, &mut results), 1);
+        assert_eq!(results[0].file, root.join("auth.rs"));
+
+        // Lines that aren't in a readable file stay as they were given
+        assert_eq!(chunk_id(root, "./gone.rs:4"), "gone.rs:4");
+    }
+
+    #[test]
+    fn feedback_roundtrips_and_replaces_judgments() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut store = FeedbackStore::default();
+        store.record("a.rs:1", "parse config", true);
+        store.record("a.rs:1", "parse config", false);
+        store.save(temp_dir.path()).unwrap();
+
+        let loaded = FeedbackStore::load(temp_dir.path()).unwrap();
+        assert_eq!(loaded.entries.len(), 1);
+        assert!(!loaded.entries[0].relevant);
+    }
+
+    #[test]
+    fn feedback_follows_renamed_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::write(root.join("store.rs"), "fn connect() {}\n").unwrap();
+        let mut store = FeedbackStore::default();
+        store.record("db.rs:1", "database pool", true);
+        store.record("store.rs:1", "connection setup", true);
+        store.save(root).unwrap();
+        fs::write(
+            cs_core::locations::index_dir(root).join(cs_index::renames::RENAMES_LOG_FILE),
+            r#"{"renames":[{"from":"db.rs","to":"store.rs","renamed":0}]}"#,
+        )
+        .unwrap();
+
+        let loaded = FeedbackStore::load(root).unwrap();
+        let ids: Vec<&str> = loaded
+            .entries
+            .iter()
+            .map(|e| e.result_id.as_str())
+            .collect();
+        assert_eq!(ids, ["store.rs:1", "store.rs:1"]);
+    }
+}
@@ -0,0 +1,179 @@
+//! `--focus FILE`: ranks results near the file a developer has open above
+//! equally good ones elsewhere, since a question is usually about the code
+//! at hand. A result is near the focus file when it's in the same package,
+//! in a package the focus file imports, or in a file that imports the focus
+//! file's package.
+//!
+//! A package is a directory. Go imports are resolved through the nearest
+//! `go.mod`, the way [`crate::go_refs`] resolves references; for other
+//! languages only the directory counts.
+
+use anyhow::Result;
+use cs_core::{CcError, Language, SearchResult};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+
+use crate::go_refs::GoReferenceResolver;
+
+/// Score factor of results from the focus file's package.
+const SAME_PACKAGE_FACTOR: f32 = 1.25;
+
+/// Score factor of results from packages the focus file imports.
+const IMPORTED_FACTOR: f32 = 1.15;
+
+/// Score factor of results from files importing the focus file's package.
+const IMPORTER_FACTOR: f32 = 1.1;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Proximity {
+    SamePackage,
+    /// A package the focus file imports
+    Imported,
+    /// A file importing the focus file's package
+    Importer,
+}
+
+impl Proximity {
+    pub fn factor(self) -> f32 {
+        match self {
+            Proximity::SamePackage => SAME_PACKAGE_FACTOR,
+            Proximity::Imported => IMPORTED_FACTOR,
+            Proximity::Importer => IMPORTER_FACTOR,
+        }
+    }
+}
+
+/// What a focus file is near, resolved once per search.
+pub struct Focus {
+    dir: PathBuf,
+    imported: HashSet<PathBuf>,
+    resolver: GoReferenceResolver,
+    /// Whether each Go file looked at imports the focus file's package
+    importers: HashMap<PathBuf, bool>,
+}
+
+impl Focus {
+    pub fn new(file: &Path) -> Result<Self> {
+        if !file.is_file() {
+            return Err(CcError::Search(format!("--focus {} isn't a file", file.display())).into());
+        }
+        let file = cs_core::paths::canonicalize_lossy(file);
+        let mut resolver = GoReferenceResolver::new();
+        let imported = if is_go(&file) {
+            resolver.imported_dirs(&file).into_iter().collect()
+        } else {
+            HashSet::new()
+        };
+        Ok(Self {
+            dir: file.parent().unwrap_or(&file).to_path_buf(),
+            imported,
+            resolver,
+            importers: HashMap::new(),
+        })
+    }
+
+    /// How `file` is near the focus file, if it is.
+    pub fn proximity(&mut self, file: &Path) -> Option<Proximity> {
+        let file = cs_core::paths::canonicalize_lossy(file);
+        let dir = file.parent()?;
+        if dir == self.dir {
+            return Some(Proximity::SamePackage);
+        }
+        if self.imported.contains(dir) {
+            return Some(Proximity::Imported);
+        }
+        if !is_go(&file) {
+            return None;
+        }
+        let imports_focus = match self.importers.get(&file) {
+            Some(imports_focus) => *imports_focus,
+            None => {
+                let imports_focus = self.resolver.imported_dirs(&file).contains(&self.dir);
+                self.importers.insert(file.clone(), imports_focus);
+                imports_focus
+            }
+        };
+        imports_focus.then_some(Proximity::Importer)
+    }
+}
+
+fn is_go(file: &Path) -> bool {
+    Language::from_path(file) == Some(Language::Go)
+}
+
+/// Multiply the score of every result near `focus_file` by its
+/// [`Proximity::factor`], then re-sort. Returns the number of results whose
+/// score changed.
+pub fn apply_focus(focus_file: &Path, results: &mut [SearchResult]) -> Result<usize> {
+    if results.is_empty() {
+        return Ok(0);
+    }
+    let mut focus = Focus::new(focus_file)?;
+    let mut adjusted = 0;
+    for result in results.iter_mut() {
+        if let Some(proximity) = focus.proximity(&result.file) {
+            result.score *= proximity.factor();
+            adjusted += 1;
+        }
+    }
+    if adjusted > 0 {
+        results.sort_by(SearchResult::rank_cmp);
+    }
+    Ok(adjusted)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+
+    #[test]
+    fn results_near_the_focus_file_rank_first() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        let write = |path: &str, content: &str| {
+            let path = root.join(path);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(&path, content).unwrap();
+        };
+        write("go.mod", "module example.com/shop\n\ngo 1.22\n");
+        write(
+            "internal/service/user.go",
+            "package service\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/shop/internal/store\"\n)\n\nfunc GetUser() {}\n",
+        );
+        write("internal/service/order.go", "package service\n");
+        write("internal/store/store.go", "package store\n");
+        write(
+            "api/handler.go",
+            "package api\n\nimport \"example.com/shop/internal/service\"\n",
+        );
+        write("cmd/tool/main.go", "package main\n\nimport \"fmt\"\n");
+        write("docs/notes.md", "# Notes\n");
+
+        let mut results = vec![
+            SearchResult::for_lines(root.join("cmd/tool/main.go"), 1, 1, 0.8),
+            SearchResult::for_lines(root.join("docs/notes.md"), 1, 1, 0.8),
+            SearchResult::for_lines(root.join("api/handler.go"), 1, 1, 0.8),
+            SearchResult::for_lines(root.join("internal/store/store.go"), 1, 1, 0.8),
+            SearchResult::for_lines(root.join("internal/service/order.go"), 1, 1, 0.8),
+        ];
+        let adjusted = apply_focus(&root.join("internal/service/user.go"), &mut results).unwrap();
+        assert_eq!(adjusted, 3);
+        let order: Vec<PathBuf> = results
+            .iter()
+            .map(|result| result.file.strip_prefix(root).unwrap().to_path_buf())
+            .collect();
+        assert_eq!(
+            &order[..3],
+            [
+                PathBuf::from("internal/service/order.go"),
+                PathBuf::from("internal/store/store.go"),
+                PathBuf::from("api/handler.go"),
+            ]
+        );
+        assert!((results[0].score - 0.8 * SAME_PACKAGE_FACTOR).abs() < 1e-6);
+
+        assert!(apply_focus(&root.join("missing.go"), &mut results).is_err());
+    }
+}
@@ -0,0 +1,482 @@
+//! Rank fusion: how hybrid search turns the ranked lists of its lexical,
+//! semantic and AST searches into one ranking, chosen with `[fusion]` in
+//! config or `--fusion`:
+//!
+//! - `rrf` (the default): reciprocal rank fusion, the sum of 1/(k + rank)
+//!   over the lists a result is in. Ranks only, so lists whose scores aren't
+//!   comparable fuse fairly
+//! - `weighted`: a weighted sum of each list's scores, scaled to 0..1 within
+//!   the list
+//! - `linear`: a linear model over each result's [`Features`], such as one
+//!   fitted offline to `--explain-scores --json` output and relevance
+//!   judgments
+//!
+//! Library users can fuse with a [`Fusion`] of their own through [`fuse`].
+//!
+//! Any ranked search can also be reranked by an external command
+//! (`reranker` under `[fusion]`), which reads one JSON request on stdin:
+//!
+//! ```json
+//! {"query": "retry with backoff", "results": [{"file": "src/net.rs", "line": 40,
+//!   "end_line": 72, "score": 0.031, "text": "fn retry(...) {...}"}]}
+//! ```
+//!
+//! and writes one JSON response to stdout with a score per result, in order:
+//! `{"scores": [0.92]}`. Results are sorted by the new scores. A reranker
+//! that fails, answers with the wrong number of scores or takes longer than
+//! [`RERANKER_TIMEOUT`] leaves the results as they were.
+
+use anyhow::{Context, Result, bail};
+use cs_core::{FusionConfig, FusionStrategy, FusionWeights, LinearFusion, SearchResult};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::io::{Read, Write};
+use std::path::PathBuf;
+use std::process::{Command, Stdio};
+use std::time::{Duration, Instant};
+
+use super::score_explain;
+
+/// How long an external reranker may take per search.
+pub const RERANKER_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Where a result ranked in one of the fused lists.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Hit {
+    /// From 1
+    pub rank: usize,
+    pub score: f32,
+    /// The score scaled to 0..1 between the list's lowest and highest
+    pub scaled: f32,
+}
+
+/// How a result did in each list fused into it.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct Features {
+    pub lexical: Option<Hit>,
+    pub dense: Option<Hit>,
+    pub ast: Option<Hit>,
+}
+
+impl Features {
+    fn hits(&self) -> [Option<Hit>; 3] {
+        [self.lexical, self.dense, self.ast]
+    }
+}
+
+/// Scores a result from how it did in the fused lists; higher ranks first.
+pub trait Fusion: Send + Sync {
+    fn score(&self, features: &Features) -> f32;
+}
+
+pub struct Rrf {
+    pub k: f32,
+}
+
+impl Fusion for Rrf {
+    fn score(&self, features: &Features) -> f32 {
+        features
+            .hits()
+            .into_iter()
+            .flatten()
+            .map(|hit| 1.0 / (self.k + hit.rank as f32))
+            .sum()
+    }
+}
+
+pub struct WeightedSum {
+    pub weights: FusionWeights,
+}
+
+impl Fusion for WeightedSum {
+    fn score(&self, features: &Features) -> f32 {
+        let weights = [self.weights.lexical, self.weights.dense, self.weights.ast];
+        features
+            .hits()
+            .into_iter()
+            .zip(weights)
+            .filter_map(|(hit, weight)| Some(weight * hit?.scaled))
+            .sum()
+    }
+}
+
+/// What a [`Linear`] weight applies to.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Feature {
+    Score(usize),
+    Scaled(usize),
+    ReciprocalRank(usize),
+    Hit(usize),
+}
+
+const LISTS: [&str; 3] = ["lexical", "dense", "ast"];
+
+impl Feature {
+    fn parse(name: &str) -> Option<Self> {
+        let (list, kind) = name.split_once('_').unwrap_or((name, ""));
+        let list = LISTS.iter().position(|&known| known == list)?;
+        match kind {
+            "" => Some(Feature::Score(list)),
+            "scaled" => Some(Feature::Scaled(list)),
+            "rr" => Some(Feature::ReciprocalRank(list)),
+            "hit" => Some(Feature::Hit(list)),
+            _ => None,
+        }
+    }
+
+    fn value(self, features: &Features, k: f32) -> f32 {
+        let hits = features.hits();
+        match self {
+            Feature::Score(list) => hits[list].map_or(0.0, |hit| hit.score),
+            Feature::Scaled(list) => hits[list].map_or(0.0, |hit| hit.scaled),
+            Feature::ReciprocalRank(list) => {
+                hits[list].map_or(0.0, |hit| 1.0 / (k + hit.rank as f32))
+            }
+            Feature::Hit(list) => hits[list].map_or(0.0, |_| 1.0),
+        }
+    }
+}
+
+pub struct Linear {
+    bias: f32,
+    weights: Vec<(Feature, f32)>,
+    /// Rank constant of the `_rr` features
+    k: f32,
+}
+
+impl Linear {
+    pub fn new(model: &LinearFusion, k: f32) -> Result<Self> {
+        let weights = model
+            .weights
+            .iter()
+            .map(|(name, &weight)| match Feature::parse(name) {
+                Some(feature) => Ok((feature, weight)),
+                None => bail!(
+                    "Unknown fusion feature '{}'. Use lexical, dense or ast, optionally with _scaled, _rr or _hit",
+                    name
+                ),
+            })
+            .collect::<Result<_>>()?;
+        Ok(Self {
+            bias: model.bias,
+            weights,
+            k,
+        })
+    }
+}
+
+impl Fusion for Linear {
+    fn score(&self, features: &Features) -> f32 {
+        self.bias
+            + self
+                .weights
+                .iter()
+                .map(|(feature, weight)| weight * feature.value(features, self.k))
+                .sum::<f32>()
+    }
+}
+
+/// The fusion `config` asks for.
+pub fn from_config(config: &FusionConfig) -> Result<Box<dyn Fusion>> {
+    Ok(match config.strategy {
+        FusionStrategy::Rrf => Box::new(Rrf { k: config.k }),
+        FusionStrategy::Weighted => Box::new(WeightedSum {
+            weights: config.weights,
+        }),
+        FusionStrategy::Linear => {
+            let model = config
+                .linear
+                .as_ref()
+                .context("The linear fusion strategy needs weights in [fusion.linear]")?;
+            Box::new(Linear::new(model, config.k)?)
+        }
+    })
+}
+
+/// One ranking of the results of the `lexical`, `dense` and `ast` lists,
+/// each ranked best first, scored by `fusion`. A result in several lists
+/// (the same file and first line) appears once, as the first list has it.
+pub fn fuse(
+    lexical: &[SearchResult],
+    dense: &[SearchResult],
+    ast: &[SearchResult],
+    fusion: &dyn Fusion,
+) -> Vec<SearchResult> {
+    let mut fused: Vec<(SearchResult, Features)> = Vec::new();
+    let mut positions: HashMap<(PathBuf, usize), usize> = HashMap::new();
+    let lists: [(&[SearchResult], fn(&mut Features) -> &mut Option<Hit>); 3] = [
+        (lexical, |features| &mut features.lexical),
+        (dense, |features| &mut features.dense),
+        (ast, |features| &mut features.ast),
+    ];
+    for (results, slot) in lists {
+        let (low, high) = results
+            .iter()
+            .fold((f32::INFINITY, f32::NEG_INFINITY), |(low, high), result| {
+                (low.min(result.score), high.max(result.score))
+            });
+        for (rank, result) in results.iter().enumerate() {
+            let position = *positions
+                .entry(score_explain::key(result))
+                .or_insert_with(|| {
+                    fused.push((result.clone(), Features::default()));
+                    fused.len() - 1
+                });
+            let hit = slot(&mut fused[position].1);
+            // A list's own duplicates keep their best rank
+            if hit.is_none() {
+                *hit = Some(Hit {
+                    rank: rank + 1,
+                    score: result.score,
+                    scaled: if high > low {
+                        (result.score - low) / (high - low)
+                    } else {
+                        1.0
+                    },
+                });
+            }
+        }
+    }
+
+    fused
+        .into_iter()
+        .map(|(mut result, features)| {
+            result.score = fusion.score(&features);
+            result
+        })
+        .collect()
+}
+
+#[derive(Serialize)]
+struct RerankRequest<'a> {
+    query: &'a str,
+    results: Vec<RerankCandidate>,
+}
+
+#[derive(Serialize)]
+struct RerankCandidate {
+    file: String,
+    line: usize,
+    end_line: usize,
+    score: f32,
+    text: String,
+}
+
+#[derive(Deserialize)]
+struct RerankResponse {
+    scores: Vec<f32>,
+}
+
+/// Rescore `results` for `query` with the external reranker `command` (see
+/// the module docs), then sort them by the new scores.
+pub fn rerank_externally(
+    command: &[String],
+    query: &str,
+    results: &mut [SearchResult],
+) -> Result<()> {
+    let (program, args) = command
+        .split_first()
+        .context("The reranker command is empty")?;
+    let request = RerankRequest {
+        query,
+        results: results
+            .iter()
+            .map(|result| RerankCandidate {
+                file: cs_core::paths::to_slash(&result.file),
+                line: result.span.line_start,
+                end_line: result.span.line_end,
+                score: result.score,
+                text: text_of(result),
+            })
+            .collect(),
+    };
+    let mut request = serde_json::to_vec(&request)?;
+    request.push(b'\n');
+
+    let mut child = Command::new(program)
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::inherit())
+        .spawn()
+        .with_context(|| format!("Failed to start the reranker '{}'", program))?;
+    // Fed and drained from threads, so a reranker that answers before it
+    // has read everything can't block on a full pipe
+    let mut stdin = child.stdin.take().context("No stdin for the reranker")?;
+    let writer = std::thread::spawn(move || stdin.write_all(&request));
+    let mut stdout = child.stdout.take().context("No stdout for the reranker")?;
+    let reader = std::thread::spawn(move || {
+        let mut output = Vec::new();
+        stdout.read_to_end(&mut output).map(|_| output)
+    });
+
+    let deadline = Instant::now() + RERANKER_TIMEOUT;
+    let status = loop {
+        if let Some(status) = child.try_wait()? {
+            break status;
+        }
+        if Instant::now() >= deadline {
+            let _ = child.kill();
+            let _ = child.wait();
+            bail!(
+                "The reranker took longer than {}s",
+                RERANKER_TIMEOUT.as_secs()
+            );
+        }
+        std::thread::sleep(Duration::from_millis(5));
+    };
+    // A reranker that exits without reading its input is fine
+    let _ = writer.join();
+    let output = reader
+        .join()
+        .map_err(|_| anyhow::anyhow!("Reading the reranker's output panicked"))??;
+    if !status.success() {
+        bail!("The reranker exited with {}", status);
+    }
+
+    let response: RerankResponse = serde_json::from_slice(&output)
+        .context("The reranker's output isn't a JSON object with \"scores\"")?;
+    if response.scores.len() != results.len() {
+        bail!(
+            "The reranker returned {} scores for {} results",
+            response.scores.len(),
+            results.len()
+        );
+    }
+    for (result, score) in results.iter_mut().zip(response.scores) {
+        result.score = score;
+    }
+    results.sort_by(SearchResult::rank_cmp);
+    Ok(())
+}
+
+/// The result's code: its preview, or its lines read from the file.
+fn text_of(result: &SearchResult) -> String {
+    if !result.preview.is_empty() {
+        return result.preview.clone();
+    }
+    let Ok(content) = std::fs::read_to_string(&result.file) else {
+        return String::new();
+    };
+    content
+        .lines()
+        .skip(result.span.line_start.saturating_sub(1))
+        .take(result.span.line_end.saturating_sub(result.span.line_start) + 1)
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ranking(results: &[SearchResult]) -> Vec<(String, f32)> {
+        let mut results = results.to_vec();
+        results.sort_by(SearchResult::rank_cmp);
+        results
+            .into_iter()
+            .map(|result| (result.file.to_string_lossy().to_string(), result.score))
+            .collect()
+    }
+
+    #[test]
+    fn rrf_rewards_agreement_between_lists() {
+        let lexical = [
+            SearchResult::for_lines("a.rs", 1, 1, 9.0),
+            SearchResult::for_lines("b.rs", 1, 1, 5.0),
+        ];
+        let dense = [
+            SearchResult::for_lines("b.rs", 1, 1, 0.8),
+            SearchResult::for_lines("c.rs", 1, 1, 0.7),
+        ];
+        let fused = fuse(&lexical, &dense, &[], &Rrf { k: 60.0 });
+        let ranked = ranking(&fused);
+        assert_eq!(ranked[0].0, "b.rs");
+        assert!((ranked[0].1 - (1.0 / 62.0 + 1.0 / 61.0)).abs() < 1e-6);
+        assert_eq!(ranked.len(), 3);
+    }
+
+    #[test]
+    fn weighted_sums_scale_each_list() {
+        let lexical = [
+            SearchResult::for_lines("a.rs", 1, 1, 9.0),
+            SearchResult::for_lines("b.rs", 1, 1, 5.0),
+        ];
+        let dense = [
+            SearchResult::for_lines("b.rs", 1, 1, 0.9),
+            SearchResult::for_lines("a.rs", 1, 1, 0.5),
+        ];
+        let weights = FusionWeights {
+            lexical: 1.0,
+            dense: 3.0,
+            ast: 1.0,
+        };
+        let fused = fuse(&lexical, &dense, &[], &WeightedSum { weights });
+        // a: 1.0 + 3 * 0.0; b: 0.0 + 3 * 1.0
+        assert_eq!(
+            ranking(&fused),
+            vec![("b.rs".to_string(), 3.0), ("a.rs".to_string(), 1.0)]
+        );
+    }
+
+    #[test]
+    fn linear_models_name_their_features() {
+        let mut weights = std::collections::BTreeMap::new();
+        weights.insert("dense".to_string(), 2.0);
+        weights.insert("lexical_hit".to_string(), 0.5);
+        let model = LinearFusion { bias: 0.1, weights };
+        let linear = Linear::new(&model, 60.0).unwrap();
+        let features = Features {
+            lexical: Some(Hit {
+                rank: 3,
+                score: 4.0,
+                scaled: 0.2,
+            }),
+            dense: Some(Hit {
+                rank: 1,
+                score: 0.8,
+                scaled: 1.0,
+            }),
+            ast: None,
+        };
+        assert!((linear.score(&features) - (0.1 + 1.6 + 0.5)).abs() < 1e-6);
+
+        let mut typo = model.clone();
+        typo.weights.insert("densee".to_string(), 1.0);
+        assert!(Linear::new(&typo, 60.0).is_err());
+        assert!(
+            from_config(&FusionConfig {
+                strategy: FusionStrategy::Linear,
+                ..Default::default()
+            })
+            .is_err()
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn an_external_reranker_reorders_results() {
+        let mut results = vec![
+            SearchResult::for_lines("a.rs", 1, 1, 0.9),
+            SearchResult::for_lines("b.rs", 1, 1, 0.5),
+        ];
+        let command = [
+            "sh".to_string(),
+            "-c".to_string(),
+            "cat > /dev/null; echo '{\"scores\": [0.1, 0.7]}'".to_string(),
+        ];
+        rerank_externally(&command, "query", &mut results).unwrap();
+        assert_eq!(
+            ranking(&results),
+            vec![("b.rs".to_string(), 0.7), ("a.rs".to_string(), 0.1)]
+        );
+
+        let short = [
+            "sh".to_string(),
+            "-c".to_string(),
+            "echo '{\"scores\": [1.0]}'".to_string(),
+        ];
+        assert!(rerank_externally(&short, "query", &mut results).is_err());
+        assert_eq!(results[0].file, PathBuf::from("b.rs"));
+    }
+}
@@ -0,0 +1,558 @@
+//! Resolves the package-qualified references in Go results, such as a call
+//! to `service.GetUser`, to where they are declared, so JSON output can
+//! carry a `references` array and a consumer can follow a definition without
+//! another query.
+//!
+//! A qualifier is resolved through the result file's imports: an import of a
+//! package in the same module (found from the nearest `go.mod`) or vendored
+//! under it names a directory, whose declarations are scanned the same way
+//! `go_tests` scans test files. References into the standard library or
+//! modules that aren't checked out stay unresolved.
+
+use cs_core::{Language, SearchResult, Span};
+use regex::Regex;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+/// References listed per result; a large function can touch many packages.
+const MAX_REFERENCES_PER_RESULT: usize = 20;
+
+static IMPORT_LINE: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r#"^import\s+(?:([\w.]+)\s+)?"([^"]+)""#).unwrap());
+
+static IMPORT_SPEC: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r#"^\s*(?:([\w.]+)\s+)?"([^"]+)""#).unwrap());
+
+static PACKAGE_CLAUSE: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"^package\s+(\w+)").unwrap());
+
+static TOP_LEVEL_DECL: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"^(func|type|var|const)\s+(?:(\()|([A-Z]\w*)\b)").unwrap());
+
+static GROUPED_SPEC: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"^\s+([A-Z]\w*)\b").unwrap());
+
+static QUALIFIED: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"\b([a-zA-Z_]\w*)\.([A-Z]\w*)\b").unwrap());
+
+pub(crate) static LITERAL_OR_COMMENT: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r#""(?:[^"\\]|\\.)*"|`[^`]*`|'(?:[^'\\]|\\.)*'|//.*$"#).unwrap());
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum GoDeclKind {
+    Func,
+    Type,
+    Var,
+    Const,
+}
+
+/// Where a qualified reference in a result is declared.
+#[derive(Debug, Clone, Serialize)]
+pub struct GoReference {
+    /// As written in the result, e.g. `service.GetUser`
+    pub name: String,
+    pub kind: GoDeclKind,
+    pub file: PathBuf,
+    pub span: Span,
+}
+
+/// An exported top-level declaration of a package.
+#[derive(Debug, Clone)]
+pub(crate) struct GoDecl {
+    pub(crate) name: String,
+    pub(crate) kind: GoDeclKind,
+    pub(crate) file: PathBuf,
+    pub(crate) span: Span,
+}
+
+#[derive(Debug, Default)]
+pub(crate) struct GoPackage {
+    /// From the package clause, which unaliased imports are referred to by
+    name: Option<String>,
+    pub(crate) decls: HashMap<String, GoDecl>,
+}
+
+#[derive(Debug, Clone)]
+pub(crate) struct GoModule {
+    dir: PathBuf,
+    path: String,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct GoImport {
+    alias: Option<String>,
+    path: String,
+}
+
+/// The span of lines `start..=end`, from each line's byte offset.
+fn span_of(line_offsets: &[usize], len: usize, start: usize, end: usize) -> Span {
+    Span {
+        byte_start: line_offsets[start],
+        byte_end: line_offsets.get(end + 1).copied().unwrap_or(len),
+        line_start: start + 1,
+        line_end: end + 1,
+    }
+}
+
+/// The last line of the top-level construct starting on line `start`: gofmt
+/// puts the closing brace or parenthesis of one in column 0.
+fn end_of_block(lines: &[&str], start: usize) -> usize {
+    let close = match lines[start].trim_end().chars().last() {
+        Some('{') => '}',
+        Some('(') => ')',
+        _ => return start,
+    };
+    let mut end = start;
+    while end + 1 < lines.len() {
+        end += 1;
+        if lines[end].starts_with(close) {
+            break;
+        }
+    }
+    end
+}
+
+/// Scan a Go source for its package name and exported top-level
+/// declarations. Methods aren't reachable through a package qualifier and
+/// are left out.
+fn parse_declarations(file: &Path, content: &str, package: &mut GoPackage) {
+    let lines: Vec<&str> = content.lines().collect();
+    let mut line_offsets = Vec::with_capacity(lines.len());
+    let mut offset = 0;
+    for line in content.split_inclusive('\n') {
+        line_offsets.push(offset);
+        offset += line.len();
+    }
+    let mut add = |name: &str, kind: GoDeclKind, start: usize, end: usize| {
+        package
+            .decls
+            .entry(name.to_string())
+            .or_insert_with(|| GoDecl {
+                name: name.to_string(),
+                kind,
+                file: file.to_path_buf(),
+                span: span_of(&line_offsets, content.len(), start, end),
+            });
+    };
+
+    let mut name = None;
+    let mut i = 0;
+    while i < lines.len() {
+        if name.is_none()
+            && let Some(caps) = PACKAGE_CLAUSE.captures(lines[i])
+        {
+            name = Some(caps[1].to_string());
+        }
+        let Some(caps) = TOP_LEVEL_DECL.captures(lines[i]) else {
+            i += 1;
+            continue;
+        };
+        let kind = match &caps[1] {
+            "func" => GoDeclKind::Func,
+            "type" => GoDeclKind::Type,
+            "var" => GoDeclKind::Var,
+            _ => GoDeclKind::Const,
+        };
+        let grouped = caps.get(2).is_some();
+        if grouped && kind == GoDeclKind::Func {
+            // A method: `func (s *Service) GetUser(...)`
+            i = end_of_block(&lines, i) + 1;
+            continue;
+        }
+        if grouped {
+            // `type (...)`, `var (...)` and `const (...)` blocks
+            let end = end_of_block(&lines, i);
+            let mut j = i + 1;
+            while j < end {
+                let Some(spec) = GROUPED_SPEC.captures(lines[j]) else {
+                    j += 1;
+                    continue;
+                };
+                // Only one level in: a struct's fields are indented further
+                let spec_end = if lines[j].starts_with("\t\t") {
+                    j
+                } else {
+                    let mut spec_end = j;
+                    if lines[j].trim_end().ends_with('{') {
+                        while spec_end + 1 < end {
+                            spec_end += 1;
+                            if lines[spec_end].starts_with("\t}") {
+                                break;
+                            }
+                        }
+                    }
+                    add(&spec[1], kind, j, spec_end);
+                    spec_end
+                };
+                j = spec_end + 1;
+            }
+            i = end + 1;
+            continue;
+        }
+        let end = end_of_block(&lines, i);
+        add(&caps[3], kind, i, end);
+        i = end + 1;
+    }
+    package.name = package.name.take().or(name);
+}
+
+/// The imports of a Go source; blank and dot imports can't qualify anything.
+fn parse_imports(content: &str) -> Vec<GoImport> {
+    let mut imports = Vec::new();
+    let mut in_block = false;
+    for line in content.lines() {
+        let caps = if in_block {
+            if line.trim_start().starts_with(')') {
+                in_block = false;
+                continue;
+            }
+            IMPORT_SPEC.captures(line)
+        } else if line.starts_with("import") && line.trim_end().ends_with('(') {
+            in_block = true;
+            continue;
+        } else if line.starts_with("func ") || line.starts_with("type ") {
+            // Imports come before every declaration
+            break;
+        } else {
+            IMPORT_LINE.captures(line)
+        };
+        let Some(caps) = caps else {
+            continue;
+        };
+        let alias = caps.get(1).map(|m| m.as_str().to_string());
+        if matches!(alias.as_deref(), Some("_") | Some(".")) {
+            continue;
+        }
+        imports.push(GoImport {
+            alias,
+            path: caps[2].to_string(),
+        });
+    }
+    imports
+}
+
+/// `package.Name` pairs written in `lines`, first occurrence first, outside
+/// string literals and comments.
+pub(crate) fn qualified_names<'a>(lines: impl Iterator<Item = &'a str>) -> Vec<(String, String)> {
+    let mut names: Vec<(String, String)> = Vec::new();
+    for line in lines {
+        let code = LITERAL_OR_COMMENT.replace_all(line, "\"\"");
+        for caps in QUALIFIED.captures_iter(&code) {
+            // `a.b.Name` is a field or method of `a.b`, not a package member
+            let start = caps.get(0).map(|m| m.start()).unwrap_or_default();
+            if code[..start].ends_with('.') {
+                continue;
+            }
+            let name = (caps[1].to_string(), caps[2].to_string());
+            if !names.contains(&name) {
+                names.push(name);
+            }
+        }
+    }
+    names
+}
+
+fn is_go_source(path: &Path) -> bool {
+    path.extension().is_some_and(|ext| ext == "go")
+        && !path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .is_some_and(|name| name.ends_with("_test.go"))
+}
+
+/// Resolves references, caching each module and package it reads.
+#[derive(Default)]
+pub struct GoReferenceResolver {
+    /// The module enclosing each directory; `None` outside any module
+    modules: HashMap<PathBuf, Option<GoModule>>,
+    packages: HashMap<PathBuf, GoPackage>,
+}
+
+impl GoReferenceResolver {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub(crate) fn module_of(&mut self, dir: &Path) -> Option<GoModule> {
+        if let Some(module) = self.modules.get(dir) {
+            return module.clone();
+        }
+        let module = match fs::read_to_string(dir.join("go.mod")) {
+            Ok(content) => content.lines().find_map(|line| {
+                let path = line.trim().strip_prefix("module")?.trim();
+                Some(GoModule {
+                    dir: dir.to_path_buf(),
+                    path: path.trim_matches('"').to_string(),
+                })
+            }),
+            Err(_) => dir.parent().and_then(|parent| self.module_of(parent)),
+        };
+        self.modules.insert(dir.to_path_buf(), module.clone());
+        module
+    }
+
+    pub(crate) fn package(&mut self, dir: &Path) -> &GoPackage {
+        self.packages.entry(dir.to_path_buf()).or_insert_with(|| {
+            let mut package = GoPackage::default();
+            let Ok(entries) = fs::read_dir(dir) else {
+                return package;
+            };
+            let mut files: Vec<PathBuf> = entries
+                .filter_map(|entry| entry.ok().map(|e| e.path()))
+                .filter(|path| is_go_source(path))
+                .collect();
+            files.sort();
+            for file in files {
+                if let Ok(content) = fs::read_to_string(&file) {
+                    parse_declarations(&file, &content, &mut package);
+                }
+            }
+            package
+        })
+    }
+
+    /// The directory holding the package imported as `import_path`, if it's
+    /// part of `module` or vendored under it.
+    fn package_dir(module: &GoModule, import_path: &str) -> Option<PathBuf> {
+        let within = if import_path == module.path {
+            Some("")
+        } else {
+            import_path
+                .strip_prefix(&module.path)
+                .and_then(|rest| rest.strip_prefix('/'))
+        };
+        let dir = match within {
+            Some(within) => module.dir.join(within),
+            None => module.dir.join("vendor").join(import_path),
+        };
+        dir.is_dir().then_some(dir)
+    }
+
+    /// The package directories the Go source `file` imports from its own
+    /// module, or vendored under it.
+    pub(crate) fn imported_dirs(&mut self, file: &Path) -> Vec<PathBuf> {
+        let Some(module) = file.parent().and_then(|dir| self.module_of(dir)) else {
+            return Vec::new();
+        };
+        let Ok(content) = fs::read_to_string(file) else {
+            return Vec::new();
+        };
+        parse_imports(&content)
+            .iter()
+            .filter_map(|import| Self::package_dir(&module, &import.path))
+            .collect()
+    }
+
+    /// The package directory each qualifier in a Go source of `module`
+    /// names: an import's alias, or the imported package's name.
+    pub(crate) fn qualifiers(
+        &mut self,
+        module: &GoModule,
+        content: &str,
+    ) -> HashMap<String, PathBuf> {
+        let mut qualifiers: HashMap<String, PathBuf> = HashMap::new();
+        for import in parse_imports(content) {
+            let Some(dir) = Self::package_dir(module, &import.path) else {
+                continue;
+            };
+            let qualifier = match import.alias {
+                Some(alias) => Some(alias),
+                None => self.package(&dir).name.clone(),
+            };
+            if let Some(qualifier) = qualifier {
+                qualifiers.entry(qualifier).or_insert(dir);
+            }
+        }
+        qualifiers
+    }
+
+    /// Declarations the package-qualified references in the Go `result`
+    /// resolve to, in the order they're first written.
+    pub fn references_for(&mut self, result: &SearchResult) -> Vec<GoReference> {
+        if result.lang != Some(Language::Go) {
+            return Vec::new();
+        }
+        let Ok(content) = fs::read_to_string(&result.file) else {
+            return Vec::new();
+        };
+        let Some(module) = result.file.parent().and_then(|dir| self.module_of(dir)) else {
+            return Vec::new();
+        };
+        let names = qualified_names(
+            content
+                .lines()
+                .skip(result.span.line_start.saturating_sub(1))
+                .take(result.span.line_end.saturating_sub(result.span.line_start) + 1),
+        );
+        if names.is_empty() {
+            return Vec::new();
+        }
+
+        let qualifiers = self.qualifiers(&module, &content);
+        let mut references = Vec::new();
+        for (qualifier, name) in names {
+            let Some(dir) = qualifiers.get(&qualifier) else {
+                continue;
+            };
+            if let Some(decl) = self.package(dir).decls.get(&name) {
+                references.push(GoReference {
+                    name: format!("{}.{}", qualifier, decl.name),
+                    kind: decl.kind,
+                    file: decl.file.clone(),
+                    span: decl.span.clone(),
+                });
+            }
+            if references.len() == MAX_REFERENCES_PER_RESULT {
+                break;
+            }
+        }
+        references
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    const HANDLER: &str = "package api
+
+import (
+	\"fmt\"
+
+	svc \"example.com/shop/internal/service\"
+	\"example.com/shop/internal/store\"
+)
+
+// Show handles GET /users/{id}.
+func Show(id string) string {
+	u, err := svc.GetUser(store.Default, id) // svc.Missing(
+	if err != nil {
+		return fmt.Sprintf(\"svc.GetUser: %v\", err)
+	}
+	return u.Name
+}
+";
+
+    const SERVICE: &str = "package service
+
+import \"example.com/shop/internal/store\"
+
+type User struct {
+	Name string
+}
+
+// GetUser loads a user.
+func GetUser(db *store.DB, id string) (*User, error) {
+	return &User{Name: id}, nil
+}
+
+func (u *User) Rename(name string) {
+	u.Name = name
+}
+";
+
+    const STORE: &str = "package store
+
+type (
+	DB struct {
+		Path string
+	}
+	Tx struct{}
+)
+
+var (
+	Default = &DB{}
+	Other   = &DB{}
+)
+";
+
+    #[test]
+    fn parses_exported_declarations() {
+        let mut package = GoPackage::default();
+        parse_declarations(Path::new("service.go"), SERVICE, &mut package);
+        assert_eq!(package.name.as_deref(), Some("service"));
+        let get_user = &package.decls["GetUser"];
+        assert_eq!(get_user.kind, GoDeclKind::Func);
+        assert_eq!((get_user.span.line_start, get_user.span.line_end), (10, 12));
+        assert_eq!(package.decls["User"].span.line_end, 7);
+        assert!(!package.decls.contains_key("Rename"));
+
+        let mut package = GoPackage::default();
+        parse_declarations(Path::new("store.go"), STORE, &mut package);
+        let mut names: Vec<&str> = package.decls.keys().map(String::as_str).collect();
+        names.sort();
+        assert_eq!(names, ["DB", "Default", "Other", "Tx"]);
+        assert_eq!(package.decls["DB"].span.line_end, 6);
+        assert_eq!(package.decls["Default"].kind, GoDeclKind::Var);
+    }
+
+    #[test]
+    fn imports_and_qualified_names() {
+        let imports = parse_imports(HANDLER);
+        assert_eq!(imports.len(), 3);
+        assert_eq!(imports[1].alias.as_deref(), Some("svc"));
+        assert_eq!(imports[2].path, "example.com/shop/internal/store");
+
+        let names = qualified_names(HANDLER.lines().skip(10));
+        assert_eq!(
+            names,
+            [
+                ("svc".to_string(), "GetUser".to_string()),
+                ("store".to_string(), "Default".to_string()),
+                ("fmt".to_string(), "Sprintf".to_string()),
+                ("u".to_string(), "Name".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn resolves_references_within_the_module() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::write(root.join("go.mod"), "module example.com/shop\n\ngo 1.22\n").unwrap();
+        for (dir, file, content) in [
+            ("api", "users.go", HANDLER),
+            ("internal/service", "users.go", SERVICE),
+            ("internal/store", "store.go", STORE),
+        ] {
+            fs::create_dir_all(root.join(dir)).unwrap();
+            fs::write(root.join(dir).join(file), content).unwrap();
+        }
+
+        let mut resolver = GoReferenceResolver::new();
+        let references = resolver.references_for(&SearchResult::for_lines(
+            root.join("api/users.go"),
+            10,
+            17,
+            0.5,
+        ));
+        let names: Vec<(&str, GoDeclKind)> = references
+            .iter()
+            .map(|r| (r.name.as_str(), r.kind))
+            .collect();
+        assert_eq!(
+            names,
+            [
+                ("svc.GetUser", GoDeclKind::Func),
+                ("store.Default", GoDeclKind::Var)
+            ]
+        );
+        assert_eq!(references[0].file, root.join("internal/service/users.go"));
+        assert_eq!(references[0].span.line_start, 10);
+
+        // Lines without a qualified reference into the module
+        assert!(
+            resolver
+                .references_for(&SearchResult::for_lines(
+                    root.join("api/users.go"),
+                    1,
+                    9,
+                    0.5
+                ))
+                .is_empty()
+        );
+    }
+}
@@ -0,0 +1,374 @@
+//! Links Go functions to the tests, benchmarks, examples and fuzz targets that
+//! cover them, for `--with-tests`.
+//!
+//! A test is associated with a function in the same package directory when
+//! its name follows the `go test` conventions (`TestCreateUser`,
+//! `TestCreateUser_duplicate`, `TestUserService_CreateUser`,
+//! `ExampleUserService_CreateUser`) or when its body calls the function.
+
+use cs_core::{Language, SearchResult, Span};
+use regex::Regex;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+/// Tests listed per result; call analysis can match widely used helpers.
+const MAX_TESTS_PER_RESULT: usize = 10;
+
+static FUNC_DECL: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"^func\s+(?:\(\s*(?:\w+\s+)?\*?\s*(\w+)(?:\[[^\]]*\])?\s*\)\s*)?(\w+)\s*[\[(]")
+        .unwrap()
+});
+
+static TEST_DECL: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"^func\s+((Test|Benchmark|Example|Fuzz)(\w*))\s*\(").unwrap());
+
+static CALL: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"\b(\w+)\s*\(").unwrap());
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum GoTestKind {
+    Test,
+    Benchmark,
+    Example,
+    Fuzz,
+}
+
+/// Why a test was linked to a function.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TestLink {
+    /// The test name follows the function's name
+    Name,
+    /// The test body calls the function
+    Call,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct GoTest {
+    pub file: PathBuf,
+    pub name: String,
+    pub kind: GoTestKind,
+    pub span: Span,
+    pub link: TestLink,
+}
+
+/// A function or method declared in a Go source file.
+#[derive(Debug, Clone, PartialEq)]
+struct GoFunc {
+    receiver: Option<String>,
+    name: String,
+}
+
+#[derive(Debug, Clone)]
+struct TestFunc {
+    file: PathBuf,
+    name: String,
+    kind: GoTestKind,
+    /// Name with the kind prefix removed, e.g. `UserService_CreateUser`
+    subject: String,
+    span: Span,
+    calls: Vec<String>,
+}
+
+impl TestFunc {
+    fn link_to(&self, func: &GoFunc) -> Option<TestLink> {
+        if self.named_after(func) {
+            Some(TestLink::Name)
+        } else if self.calls.iter().any(|call| call == &func.name) {
+            Some(TestLink::Call)
+        } else {
+            None
+        }
+    }
+
+    fn named_after(&self, func: &GoFunc) -> bool {
+        // `Test_createUser` is the convention for unexported functions
+        let subject = self.subject.strip_prefix('_').unwrap_or(&self.subject);
+        let mut parts = subject.split('_');
+        let first = parts.next().unwrap_or_default();
+        if first.is_empty() {
+            return false;
+        }
+        if first == func.name {
+            return true;
+        }
+        // `TestUserService_CreateUser` / `ExampleUserService_CreateUser`
+        let second = parts.next();
+        match (&func.receiver, second) {
+            (Some(receiver), Some(method)) => first == receiver && method == func.name,
+            _ => false,
+        }
+    }
+}
+
+/// Scan a `_test.go` source for top-level test functions. gofmt puts the
+/// closing brace of a top-level function in column 0, which bounds the body.
+fn parse_test_file(file: &Path, content: &str) -> Vec<TestFunc> {
+    let lines: Vec<&str> = content.lines().collect();
+    let mut line_offsets = Vec::with_capacity(lines.len());
+    let mut offset = 0;
+    for line in content.split_inclusive('\n') {
+        line_offsets.push(offset);
+        offset += line.len();
+    }
+
+    let mut tests = Vec::new();
+    let mut i = 0;
+    while i < lines.len() {
+        let Some(caps) = TEST_DECL.captures(lines[i]) else {
+            i += 1;
+            continue;
+        };
+        let suffix = &caps[3];
+        // `Testable` is not a test: what follows the prefix can't be lowercase
+        if suffix.chars().next().is_some_and(char::is_lowercase) {
+            i += 1;
+            continue;
+        }
+        let kind = match &caps[2] {
+            "Test" => GoTestKind::Test,
+            "Benchmark" => GoTestKind::Benchmark,
+            "Example" => GoTestKind::Example,
+            _ => GoTestKind::Fuzz,
+        };
+
+        let start = i;
+        let mut end = i;
+        if !lines[i].trim_end().ends_with('}') {
+            while end + 1 < lines.len() {
+                end += 1;
+                if lines[end].starts_with('}') {
+                    break;
+                }
+            }
+        }
+
+        let name = caps[1].to_string();
+        let mut calls: Vec<String> = lines[start..=end]
+            .iter()
+            .flat_map(|line| CALL.captures_iter(line))
+            .map(|c| c[1].to_string())
+            .filter(|call| call != &name)
+            .collect();
+        calls.sort();
+        calls.dedup();
+
+        tests.push(TestFunc {
+            file: file.to_path_buf(),
+            subject: suffix.to_string(),
+            name,
+            kind,
+            span: Span {
+                byte_start: line_offsets[start],
+                byte_end: line_offsets.get(end + 1).copied().unwrap_or(content.len()),
+                line_start: start + 1,
+                line_end: end + 1,
+            },
+            calls,
+        });
+        i = end + 1;
+    }
+    tests
+}
+
+/// The first function declared within a result's lines (chunks can start with
+/// a doc comment).
+fn declared_func(content: &str, span: &Span) -> Option<GoFunc> {
+    content
+        .lines()
+        .skip(span.line_start.saturating_sub(1))
+        .take(span.line_end.saturating_sub(span.line_start) + 1)
+        .find_map(|line| FUNC_DECL.captures(line))
+        .map(|caps| GoFunc {
+            receiver: caps.get(1).map(|m| m.as_str().to_string()),
+            name: caps[2].to_string(),
+        })
+}
+
+fn is_test_file(path: &Path) -> bool {
+    path.file_name()
+        .and_then(|name| name.to_str())
+        .is_some_and(|name| name.ends_with("_test.go"))
+}
+
+/// Finds associated tests, caching parsed `_test.go` files per package directory.
+#[derive(Default)]
+pub struct GoTestLinker {
+    packages: HashMap<PathBuf, Vec<TestFunc>>,
+}
+
+impl GoTestLinker {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    fn package_tests(&mut self, dir: &Path) -> &[TestFunc] {
+        self.packages.entry(dir.to_path_buf()).or_insert_with(|| {
+            let Ok(entries) = fs::read_dir(dir) else {
+                return Vec::new();
+            };
+            let mut files: Vec<PathBuf> = entries
+                .filter_map(|entry| entry.ok().map(|e| e.path()))
+                .filter(|path| is_test_file(path))
+                .collect();
+            files.sort();
+            files
+                .iter()
+                .filter_map(|file| {
+                    fs::read_to_string(file)
+                        .ok()
+                        .map(|content| parse_test_file(file, &content))
+                })
+                .flatten()
+                .collect()
+        })
+    }
+
+    /// Tests covering the Go function in `result`, name matches first. Results
+    /// that aren't Go functions, or are tests themselves, have none.
+    pub fn tests_for(&mut self, result: &SearchResult) -> Vec<GoTest> {
+        if result.lang != Some(Language::Go) || is_test_file(&result.file) {
+            return Vec::new();
+        }
+        let Some(func) = fs::read_to_string(&result.file)
+            .ok()
+            .and_then(|content| declared_func(&content, &result.span))
+        else {
+            return Vec::new();
+        };
+        let Some(dir) = result.file.parent() else {
+            return Vec::new();
+        };
+
+        let mut linked: Vec<GoTest> = self
+            .package_tests(dir)
+            .iter()
+            .filter_map(|test| {
+                test.link_to(&func).map(|link| GoTest {
+                    file: test.file.clone(),
+                    name: test.name.clone(),
+                    kind: test.kind,
+                    span: test.span.clone(),
+                    link,
+                })
+            })
+            .collect();
+        linked.sort_by_key(|test| test.link == TestLink::Call);
+        linked.truncate(MAX_TESTS_PER_RESULT);
+        linked
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    const SOURCE: &str = "package users
+
+// CreateUser stores a new user.
+func CreateUser(name string) (*User, error) {
+	return &User{Name: name}, nil
+}
+
+func (s *UserService) CreateUser(name string) error {
+	return nil
+}
+
+func validate(name string) bool { return name != \"\" }
+";
+
+    const TESTS: &str = "package users
+
+import \"testing\"
+
+func TestCreateUser(t *testing.T) {
+	if _, err := CreateUser(\"ada\"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserService_CreateUser(t *testing.T) {
+	s := &UserService{}
+	_ = s.CreateUser(\"ada\")
+}
+
+func TestSignup(t *testing.T) {
+	if !validate(\"ada\") {
+		t.Fatal(\"rejected\")
+	}
+}
+
+func BenchmarkCreateUser(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		CreateUser(\"ada\")
+	}
+}
+
+func Testable() {}
+";
+
+    #[test]
+    fn parses_test_functions_and_their_calls() {
+        let tests = parse_test_file(Path::new("users_test.go"), TESTS);
+        let names: Vec<&str> = tests.iter().map(|t| t.name.as_str()).collect();
+        assert_eq!(
+            names,
+            [
+                "TestCreateUser",
+                "TestUserService_CreateUser",
+                "TestSignup",
+                "BenchmarkCreateUser"
+            ]
+        );
+        assert_eq!(tests[0].span.line_start, 5);
+        assert_eq!(tests[0].span.line_end, 9);
+        assert!(tests[2].calls.contains(&"validate".to_string()));
+        assert_eq!(tests[3].kind, GoTestKind::Benchmark);
+    }
+
+    #[test]
+    fn links_tests_by_name_and_call() {
+        let temp_dir = TempDir::new().unwrap();
+        let source = temp_dir.path().join("users.go");
+        fs::write(&source, SOURCE).unwrap();
+        fs::write(temp_dir.path().join("users_test.go"), TESTS).unwrap();
+
+        let mut linker = GoTestLinker::new();
+
+        // Doc comment on line 3, declaration on line 4
+        let linked = linker.tests_for(&SearchResult::for_lines(source.clone(), 3, 5, 0.5));
+        let names: Vec<(&str, TestLink)> =
+            linked.iter().map(|t| (t.name.as_str(), t.link)).collect();
+        assert_eq!(
+            names,
+            [
+                ("TestCreateUser", TestLink::Name),
+                ("BenchmarkCreateUser", TestLink::Name),
+                ("TestUserService_CreateUser", TestLink::Call),
+            ]
+        );
+
+        let method = linker.tests_for(&SearchResult::for_lines(source.clone(), 8, 10, 0.5));
+        assert!(
+            method
+                .iter()
+                .any(|t| t.name == "TestUserService_CreateUser" && t.link == TestLink::Name)
+        );
+
+        let helper = linker.tests_for(&SearchResult::for_lines(source.clone(), 12, 14, 0.5));
+        assert_eq!(helper.len(), 1);
+        assert_eq!(helper[0].name, "TestSignup");
+        assert_eq!(helper[0].link, TestLink::Call);
+
+        let test_file = temp_dir.path().join("users_test.go");
+        assert!(
+            linker
+                .tests_for(&SearchResult::for_lines(test_file, 5, 7, 0.5))
+                .is_empty()
+        );
+    }
+}
@@ -0,0 +1,145 @@
+//! Scores the hot chunks among a semantic search's top candidates again with
+//! the index's hot model (see [`cs_index::hot_chunks`]).
+//!
+//! Scores from two models can't be compared as they are, so the hot model's
+//! are rescaled to the mean and spread the index's model gave the same
+//! chunks. The hot chunks keep the band of scores they had among the cold
+//! ones, and the better model decides their order within it.
+
+use cs_core::SearchOptions;
+use cs_index::ChunkEntry;
+use std::path::{Path, PathBuf};
+
+use super::SearchProgressCallback;
+
+/// Top candidates looked at per result asked for.
+const OVERSAMPLE: usize = 4;
+
+/// Top candidates looked at with no top k, or a small one.
+const MIN_CANDIDATES: usize = 50;
+
+/// Spread assumed for the first scores when they're all the same.
+const MIN_SPREAD: f32 = 0.01;
+
+/// Score the hot chunks among the top of the ranked `similarities` again.
+/// Whether any score changed, so they need sorting again.
+pub(crate) fn rescore(
+    index_root: &Path,
+    options: &SearchOptions,
+    similarities: &mut [(f32, &PathBuf, &ChunkEntry)],
+    progress: Option<&SearchProgressCallback>,
+) -> bool {
+    let Some(settings) = cs_index::hot_chunks::settings(index_root) else {
+        return false;
+    };
+    let Some(vectors) = cs_index::hot_chunks::load_vectors(index_root)
+        .filter(|vectors| vectors.model == settings.model && !vectors.is_empty())
+    else {
+        return false;
+    };
+
+    let candidates = options
+        .top_k
+        .map_or(MIN_CANDIDATES, |k| k.saturating_mul(OVERSAMPLE))
+        .max(MIN_CANDIDATES)
+        .min(similarities.len());
+    let hot: Vec<(usize, &[f32])> = similarities[..candidates]
+        .iter()
+        .enumerate()
+        .filter_map(|(i, (_, file, chunk))| {
+            // Candidates are paths under the index root, as it was found
+            let relative = cs_core::paths::to_slash(file.strip_prefix(index_root).ok()?);
+            let key = cs_index::hot_chunks::chunk_key(&relative, &chunk.span);
+            Some((i, vectors.get(&key, chunk.embedding.as_deref()?)?))
+        })
+        .collect();
+    // One chunk has nothing to be ordered against
+    if hot.len() < 2 {
+        return false;
+    }
+
+    if let Some(callback) = progress {
+        callback(&format!(
+            "Re-scoring {} hot chunks with {}",
+            hot.len(),
+            settings.model
+        ));
+    }
+    let query = match cs_index::hot_chunks::embed_query(index_root, &settings.model, &options.query)
+    {
+        Ok(query) => query,
+        Err(e) => {
+            tracing::warn!("Skipping hot chunk scores: {}", e);
+            return false;
+        }
+    };
+    let first: Vec<f32> = hot.iter().map(|&(i, _)| similarities[i].0).collect();
+    let again: Vec<f32> = hot
+        .iter()
+        .map(|(_, vector)| super::semantic_v3::cosine_similarity(&query, vector))
+        .collect();
+    let Some(rescaled) = rescale(&first, &again) else {
+        return false;
+    };
+    for (&(i, _), score) in hot.iter().zip(rescaled) {
+        similarities[i].0 = score;
+    }
+    true
+}
+
+fn mean_and_spread(scores: &[f32]) -> (f32, f32) {
+    let mean = scores.iter().sum::<f32>() / scores.len() as f32;
+    let variance = scores
+        .iter()
+        .map(|score| (score - mean).powi(2))
+        .sum::<f32>()
+        / scores.len() as f32;
+    (mean, variance.sqrt())
+}
+
+/// The `again` scores moved to the mean and spread of the `first` ones.
+/// `None` when the second model can't tell the chunks apart.
+fn rescale(first: &[f32], again: &[f32]) -> Option<Vec<f32>> {
+    if first.is_empty() || first.len() != again.len() {
+        return None;
+    }
+    let (first_mean, first_spread) = mean_and_spread(first);
+    let (again_mean, again_spread) = mean_and_spread(again);
+    if again_spread <= f32::EPSILON {
+        return None;
+    }
+    let scale = first_spread.max(MIN_SPREAD) / again_spread;
+    Some(
+        again
+            .iter()
+            .map(|score| first_mean + (score - again_mean) * scale)
+            .collect(),
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn hot_scores_keep_the_band_of_the_first_ones() {
+        let first = [0.70, 0.66, 0.62];
+        // The hot model puts the last chunk first
+        let again = [0.40, 0.50, 0.90];
+        let rescaled = rescale(&first, &again).unwrap();
+        assert!(rescaled[2] > rescaled[1] && rescaled[1] > rescaled[0]);
+
+        let (mean, spread) = mean_and_spread(&rescaled);
+        let (first_mean, first_spread) = mean_and_spread(&first);
+        assert!((mean - first_mean).abs() < 1e-5);
+        assert!((spread - first_spread).abs() < 1e-5);
+
+        // Tied first scores still get ordered
+        let rescaled = rescale(&[0.5, 0.5], &[0.2, 0.4]).unwrap();
+        assert!(rescaled[1] > rescaled[0]);
+        assert!((rescaled[0] + rescaled[1] - 1.0).abs() < 1e-5);
+
+        assert_eq!(rescale(&first, &[0.3, 0.3, 0.3]), None);
+        assert_eq!(rescale(&first, &again[..2]), None);
+    }
+}
@@ -0,0 +1,106 @@
+//! Identifier words for the lexical index. Tantivy's tokenizer keeps
+//! `InMemoryUserService` as one token and cuts `in_memory_user_service` into
+//! four, so neither form finds the other and "in memory user service" finds
+//! only the snake_case spelling. Each compound identifier is therefore also
+//! indexed as its words and as its words run together, in a field of its
+//! own that queries search alongside the file's text.
+//!
+//! What makes a compound depends on the language: a `-` joins the words of
+//! kebab-case names in files without a programming language (Markdown,
+//! YAML, CSS, shell) and is an operator everywhere else.
+
+use cs_core::Language;
+
+/// The words of every compound identifier in `text`, then the identifier
+/// lowercased with its separators dropped, space-separated and in order.
+/// Identifiers of one word are left out; the text itself indexes them.
+pub fn identifier_terms(text: &str, lang: Option<Language>) -> String {
+    let kebab = lang.is_none();
+    let mut terms = String::new();
+    let mut push = |term: &str| {
+        if !terms.is_empty() {
+            terms.push(' ');
+        }
+        terms.push_str(term);
+    };
+    let is_part = |c: char| c.is_alphanumeric() || c == '_' || (kebab && c == '-');
+    for identifier in text.split(|c: char| !is_part(c)) {
+        let words = split_identifier(identifier);
+        if words.len() < 2 {
+            continue;
+        }
+        for word in &words {
+            push(&word.to_lowercase());
+        }
+        push(&words.concat().to_lowercase());
+    }
+    terms
+}
+
+/// The words of `identifier`: split at `_` and `-`, at a lowercase letter
+/// or digit followed by an uppercase one, and before the last capital of a
+/// run followed by lowercase, so `HTTPServer` is `HTTP` and `Server`.
+/// Digits stay with the word before them (`utf8`, `Vec3`).
+pub fn split_identifier(identifier: &str) -> Vec<&str> {
+    let mut words = Vec::new();
+    for part in identifier.split(['_', '-']) {
+        let chars: Vec<(usize, char)> = part.char_indices().collect();
+        let mut start = 0;
+        for i in 1..chars.len() {
+            let (index, current) = chars[i];
+            let previous = chars[i - 1].1;
+            let hump = current.is_uppercase() && (previous.is_lowercase() || previous.is_numeric());
+            let acronym_end = current.is_uppercase()
+                && previous.is_uppercase()
+                && chars
+                    .get(i + 1)
+                    .is_some_and(|&(_, next)| next.is_lowercase());
+            if hump || acronym_end {
+                words.push(&part[start..index]);
+                start = index;
+            }
+        }
+        if start < part.len() {
+            words.push(&part[start..]);
+        }
+    }
+    words
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn compound_identifiers_are_indexed_as_words_and_whole() {
+        assert_eq!(
+            split_identifier("InMemoryUserService"),
+            ["In", "Memory", "User", "Service"]
+        );
+        assert_eq!(
+            split_identifier("parseHTTPResponse"),
+            ["parse", "HTTP", "Response"]
+        );
+        assert_eq!(split_identifier("__init__"), ["init"]);
+        assert_eq!(split_identifier("utf8Decode"), ["utf8", "Decode"]);
+
+        assert_eq!(
+            identifier_terms(
+                "let svc = InMemoryUserService::new();",
+                Some(Language::Rust)
+            ),
+            "in memory user service inmemoryuserservice"
+        );
+        assert_eq!(
+            identifier_terms("def get_user(user_id):", Some(Language::Python)),
+            "get user getuser user id userid"
+        );
+
+        // `-` is subtraction in code and part of the name elsewhere
+        assert_eq!(identifier_terms("total = max-min", Some(Language::Go)), "");
+        assert_eq!(
+            identifier_terms("retry-after: 30", None),
+            "retry after retryafter"
+        );
+    }
+}
@@ -1,27 +1,88 @@
 use anyhow::Result;
+use cs_core::context::{Operation, OperationContext};
 use cs_core::{CcError, IncludePattern, SearchMode, SearchOptions, SearchResult, Span};
-use globset::{Glob, GlobSet, GlobSetBuilder};
+use globset::{GlobBuilder, GlobSet, GlobSetBuilder};
 use rayon::prelude::*;
 use regex::{Regex, RegexBuilder};
+use std::borrow::Cow;
 use std::collections::HashMap;
 use std::fs;
 use std::path::PathBuf as StdPathBuf;
 use std::path::{Path, PathBuf};
 use tantivy::collector::TopDocs;
-use tantivy::query::QueryParser;
-use tantivy::schema::{STORED, Schema, TEXT, Value};
-use tantivy::{Index, ReloadPolicy, TantivyDocument, doc};
+use tantivy::query::{BooleanQuery, BoostQuery, FuzzyTermQuery, Occur, Query, QueryParser};
+use tantivy::schema::{Field, STORED, Schema, TEXT, Value};
+use tantivy::tokenizer::TokenStream;
+use tantivy::{Index, ReloadPolicy, TantivyDocument, Term, doc};
 use walkdir::WalkDir;
 
 mod semantic_v3;
-pub use semantic_v3::{semantic_search_v3, semantic_search_v3_with_progress};
+pub use semantic_v3::{
+    semantic_search_v3, semantic_search_v3_batch, semantic_search_v3_streaming,
+    semantic_search_v3_with_progress,
+};
 
 mod ast_search;
 pub use ast_search::is_ast_pattern;
+mod must_match;
+mod score_explain;
+
+pub mod analytics;
+pub mod anchors;
+#[cfg(feature = "ask")]
+pub mod answer;
+pub mod audit;
+pub mod bench;
+pub mod boost;
+pub mod collection_search;
+pub mod commit_search;
+pub mod compare;
+pub mod context_pack;
+pub mod conversation;
+pub mod deadcode;
+pub mod diagnostics;
+pub mod drift;
+pub mod dupes;
+pub mod ephemeral;
+pub mod eval;
+pub mod export;
+pub mod facets;
+pub mod focus;
+pub mod fusion;
+pub mod go_refs;
+pub mod go_tests;
+pub mod identifiers;
+pub mod multi_query;
+pub mod neighbors;
+pub mod notes;
+pub mod pins;
+pub mod pr_comment;
+pub mod query_cache;
+pub mod query_language;
+pub mod query_plan;
+pub mod related;
+pub mod semantic_map;
+pub mod signature_search;
+pub mod snippets;
+pub mod stop_symbols;
+#[cfg(feature = "ask")]
+pub mod summaries;
+pub mod symbols;
+pub mod trace;
+
+pub mod feedback;
+pub use feedback::FeedbackStore;
+
+mod hot_search;
+mod model_migration;
+mod sparse_search;
+mod store_search;
 
 pub type SearchProgressCallback = Box<dyn Fn(&str) + Send + Sync>;
 pub type IndexingProgressCallback = Box<dyn Fn(&str) + Send + Sync>;
 pub type DetailedIndexingProgressCallback = Box<dyn Fn(cs_index::EmbeddingProgress) + Send + Sync>;
+/// Receives the provisional best hits while a semantic search is still scoring
+pub type PartialResultsCallback = Box<dyn Fn(&[SearchResult]) + Send + Sync>;
 
 /// Resolve the actual file path to read content from
 /// For PDFs: returns cache path and validates it exists
@@ -47,7 +108,7 @@ fn resolve_content_path(file_path: &Path, repo_root: &Path) -> Result<PathBuf> {
 /// PDFs: read from preprocessed cache
 fn read_file_content(file_path: &Path, repo_root: &Path) -> Result<String> {
     let content_path = resolve_content_path(file_path, repo_root)?;
-    Ok(fs::read_to_string(content_path)?)
+    Ok(cs_core::text::read_text(&content_path)?)
 }
 
 /// Extract content from a file using a span (streaming version)
@@ -63,40 +124,19 @@ async fn extract_content_from_span(file_path: &Path, span: &cs_core::Span) -> Re
     extract_lines_from_file(&content_path, span.line_start, span.line_end)
 }
 
-/// Stream-read specific lines from a file without loading the entire content
+/// Read specific lines from a file, decoded as it was for indexing
 fn extract_lines_from_file(file_path: &Path, line_start: usize, line_end: usize) -> Result<String> {
-    use std::io::{BufRead, BufReader};
-
     if line_start == 0 {
         return Ok(String::new());
     }
 
-    let file = fs::File::open(file_path)?;
-    let reader = BufReader::new(file);
-    let mut result = Vec::new();
-
-    // Convert to 0-based indexing
-    let start_idx = line_start.saturating_sub(1);
-    let end_idx = line_end.saturating_sub(1);
-
-    for (current_line, line_result) in reader.lines().enumerate() {
-        if current_line > end_idx {
-            break; // Stop reading once we've passed the needed lines
-        }
-
-        let line = line_result?;
-
-        if current_line >= start_idx {
-            result.push(line);
-        }
-    }
-
-    // Handle case where requested lines exceed file length
-    if result.is_empty() && line_start > 0 {
-        return Ok(String::new());
-    }
-
-    Ok(result.join("\n"))
+    let content = cs_core::text::read_text(file_path)?;
+    let lines: Vec<&str> = content
+        .lines()
+        .skip(line_start - 1)
+        .take((line_end + 1).saturating_sub(line_start))
+        .collect();
+    Ok(lines.join("\n"))
 }
 
 /// Split content into lines while preserving the exact number of trailing newline bytes per line.
@@ -142,31 +182,17 @@ fn split_lines_with_endings(content: &str) -> (Vec<String>, Vec<usize>) {
     (lines, endings)
 }
 
-fn canonicalize_for_matching(path: &Path) -> PathBuf {
-    if let Ok(canonical) = path.canonicalize() {
-        return canonical;
-    }
-
-    if path.is_absolute() {
-        path.to_path_buf()
-    } else {
-        std::env::current_dir()
-            .map(|cwd| cwd.join(path))
-            .unwrap_or_else(|_| path.to_path_buf())
-    }
-}
-
 fn path_matches_include(path: &Path, include_patterns: &[IncludePattern]) -> bool {
     if include_patterns.is_empty() {
         return true;
     }
 
-    let candidate = canonicalize_for_matching(path);
+    let candidate = cs_core::paths::canonicalize_lossy(path);
     include_patterns.iter().any(|pattern| {
         if pattern.is_dir {
-            candidate.starts_with(&pattern.path)
+            cs_core::paths::starts_with(&candidate, &pattern.path)
         } else {
-            candidate == pattern.path
+            cs_core::paths::paths_equal(&candidate, &pattern.path)
         }
     })
 }
@@ -185,14 +211,15 @@ fn filter_files_by_include(
         .collect()
 }
 
-fn find_nearest_index_root(path: &Path) -> Option<StdPathBuf> {
+/// Nearest ancestor of `path` (or `path` itself) that contains a `.cs` index.
+pub fn find_nearest_index_root(path: &Path) -> Option<StdPathBuf> {
     let mut current = if path.is_file() {
         path.parent().unwrap_or(path)
     } else {
         path
     };
     loop {
-        if current.join(".cs").exists() {
+        if cs_core::locations::index_dir(current).exists() {
             return Some(current.to_path_buf());
         }
         match current.parent() {
@@ -231,12 +258,28 @@ pub(crate) fn resolve_model_from_root(
     use cs_models::ModelRegistry;
 
     let registry = ModelRegistry::default();
-    let index_dir = index_root.join(".cs");
+    let index_dir = cs_core::locations::index_dir(index_root);
     let manifest_path = index_dir.join("manifest.json");
 
-    if manifest_path.exists() {
-        let data = std::fs::read(&manifest_path)?;
-        let manifest: cs_index::IndexManifest = serde_json::from_slice(&data)?;
+    // Shards of a sharded index all share one model
+    let manifest = if manifest_path.exists() {
+        Some(cs_index::manifest_format::read_header(&manifest_path)?)
+    } else {
+        cs_index::shards::list_shards(index_root)?
+            .into_iter()
+            .next()
+            .map(|shard| cs_index::manifest_format::Header::of(&shard.manifest))
+    };
+
+    if let Some(manifest) = manifest {
+        manifest.validate()?;
+        if matches!(
+            cs_index::index_format::status(&manifest.version),
+            cs_index::index_format::FormatStatus::Upgradable { .. }
+        ) && let Err(e) = cs_index::upgrade_index_format(index_root)
+        {
+            tracing::warn!("Failed to upgrade the index format: {}", e);
+        }
 
         if let Some(existing_model) = manifest.embedding_model {
             let (alias, config_opt) = find_model_entry(&registry, &existing_model)
@@ -270,7 +313,7 @@ pub(crate) fn resolve_model_from_root(
                     // Example: index with jina-v4 (1536d), query with jina-code-1.5b (1536d)
                     if requested_config.dimensions != dims {
                         return Err(CcError::Embedding(format!(
-                            "Index was built with embedding model '{}' (alias '{}', {} dims), but '--model {}' ({} dims) was requested. Dimension mismatch prevents cross-model queries. To switch models run `cc --clean .` then `cc --index --model {}`. To keep using this index rerun your command with '--model {}'.",
+                            "Index was built with embedding model '{}' (alias '{}', {} dims), but '--model {}' ({} dims) was requested. Dimension mismatch prevents cross-model queries. To switch models run `cs --switch-model {}`. To keep using this index rerun your command with '--model {}'.",
                             existing_model,
                             suggested_alias,
                             dims,
@@ -353,6 +396,17 @@ pub async fn search_with_progress(
     Ok(results.matches)
 }
 
+/// Search that stops once `ctx` is cancelled, with `CcError::Cancelled`:
+/// between the files of the index update it may start, and before and after
+/// searching. `ctx` hears about the update's files, then the search.
+pub async fn search_with_context(
+    options: &SearchOptions,
+    ctx: &OperationContext,
+) -> Result<Vec<SearchResult>> {
+    let results = search_enhanced_with_context(options, None, None, None, None, ctx).await?;
+    Ok(results.matches)
+}
+
 /// Enhanced search that includes near-miss information for threshold queries
 pub async fn search_enhanced(options: &SearchOptions) -> Result<cs_core::SearchResults> {
     search_enhanced_with_progress(options, None).await
@@ -373,6 +427,49 @@ pub async fn search_enhanced_with_indexing_progress(
     indexing_progress_callback: Option<IndexingProgressCallback>,
     detailed_indexing_progress_callback: Option<DetailedIndexingProgressCallback>,
 ) -> Result<cs_core::SearchResults> {
+    search_enhanced_streaming(
+        options,
+        progress_callback,
+        indexing_progress_callback,
+        detailed_indexing_progress_callback,
+        None,
+    )
+    .await
+}
+
+/// Enhanced search that also streams provisional semantic hits to
+/// `partial_results` before the final list is ready. Other modes only return
+/// the final results.
+pub async fn search_enhanced_streaming(
+    options: &SearchOptions,
+    progress_callback: Option<SearchProgressCallback>,
+    indexing_progress_callback: Option<IndexingProgressCallback>,
+    detailed_indexing_progress_callback: Option<DetailedIndexingProgressCallback>,
+    partial_results: Option<PartialResultsCallback>,
+) -> Result<cs_core::SearchResults> {
+    search_enhanced_with_context(
+        options,
+        progress_callback,
+        indexing_progress_callback,
+        detailed_indexing_progress_callback,
+        partial_results,
+        &OperationContext::default(),
+    )
+    .await
+}
+
+/// Enhanced streaming search that can be cancelled through `ctx` (see
+/// [`search_with_context`]).
+#[tracing::instrument(name = "search", skip_all, fields(mode = ?options.mode))]
+pub async fn search_enhanced_with_context(
+    options: &SearchOptions,
+    progress_callback: Option<SearchProgressCallback>,
+    indexing_progress_callback: Option<IndexingProgressCallback>,
+    detailed_indexing_progress_callback: Option<DetailedIndexingProgressCallback>,
+    partial_results: Option<PartialResultsCallback>,
+    ctx: &OperationContext,
+) -> Result<cs_core::SearchResults> {
+    ctx.check()?;
     // Validate that the search path exists
     if !options.path.exists() {
         return Err(cs_core::CcError::Search(format!(
@@ -382,8 +479,98 @@ pub async fn search_enhanced_with_indexing_progress(
         .into());
     }
 
-    // Auto-update index if needed (unless it's regex-only or AST-only mode)
-    if !matches!(options.mode, SearchMode::Regex | SearchMode::Ast) {
+    update_index_for_search(
+        options,
+        indexing_progress_callback,
+        detailed_indexing_progress_callback,
+        ctx,
+    )
+    .await?;
+    ctx.check()?;
+    ctx.report(Operation::Search, 0, 1, Some(options.query.clone()));
+
+    let candidates = candidate_options(options);
+    let mut search_results = match options.mode {
+        _ if multi_query::applies(options) => {
+            multi_query::search(&candidates, progress_callback).await?
+        }
+        SearchMode::Semantic => {
+            // Use v3 semantic search (reads pre-computed embeddings from sidecars using spans)
+            semantic_search_v3_streaming(&candidates, progress_callback, partial_results).await?
+        }
+        _ => search_mode(&candidates, progress_callback).await?,
+    };
+    ctx.check()?;
+    refine_results(options, &mut search_results)?;
+    record_matches(options, &search_results.matches);
+    ctx.report(Operation::Search, 1, 1, None);
+
+    Ok(search_results)
+}
+
+/// Run `queries` with otherwise identical `options`, returning their results
+/// in the same order. The index is brought up to date once; semantic queries
+/// are then embedded in one call and scored in one pass over it (see
+/// [`semantic_search_v3_batch`]), other modes run one query after another.
+#[tracing::instrument(name = "search_batch", skip_all, fields(mode = ?options.mode, queries = queries.len()))]
+pub async fn search_batch(
+    options: &SearchOptions,
+    queries: &[String],
+    progress_callback: Option<SearchProgressCallback>,
+) -> Result<Vec<cs_core::SearchResults>> {
+    if !options.path.exists() {
+        return Err(cs_core::CcError::Search(format!(
+            "Path does not exist: {}",
+            options.path.display()
+        ))
+        .into());
+    }
+    update_index_for_search(options, None, None, &OperationContext::default()).await?;
+
+    let candidates = candidate_options(options);
+    let mut batch = if options.mode == SearchMode::Semantic {
+        semantic_search_v3_batch(&candidates, queries, progress_callback).await?
+    } else {
+        let mut batch = Vec::with_capacity(queries.len());
+        for query in queries {
+            let options = SearchOptions {
+                query: query.clone(),
+                ..candidates.as_ref().clone()
+            };
+            batch.push(search_mode(&options, None).await?);
+        }
+        batch
+    };
+    for (query, results) in queries.iter().zip(&mut batch) {
+        let options = SearchOptions {
+            query: query.clone(),
+            ..options.clone()
+        };
+        refine_results(&options, results)?;
+        record_matches(&options, &results.matches);
+    }
+    Ok(batch)
+}
+
+/// Bring the index up to date before a search, unless the search doesn't read
+/// it (regex and AST modes, vector stores, sealed bundles) or asked to overlay
+/// dirty files instead.
+async fn update_index_for_search(
+    options: &SearchOptions,
+    indexing_progress_callback: Option<IndexingProgressCallback>,
+    detailed_indexing_progress_callback: Option<DetailedIndexingProgressCallback>,
+    ctx: &OperationContext,
+) -> Result<()> {
+    // Auto-update index if needed (unless it's regex-only or AST-only mode, or the
+    // caller asked to leave the index untouched and overlay dirty files instead)
+    // Searches served by an external vector store don't read local sidecars
+    let store_backed = options.vector_store.is_some()
+        && matches!(options.mode, SearchMode::Semantic | SearchMode::Hybrid);
+    if !matches!(options.mode, SearchMode::Regex | SearchMode::Ast)
+        && !options.no_index_update
+        && !store_backed
+        && !is_sealed_index(&options.path)
+    {
         let need_embeddings = matches!(options.mode, SearchMode::Semantic | SearchMode::Hybrid);
         ensure_index_updated_with_progress(
             &options.path,
@@ -394,16 +581,72 @@ pub async fn search_enhanced_with_indexing_progress(
             options.respect_gitignore,
             &options.exclude_patterns,
             options.embedding_model.as_deref(),
+            ctx,
         )
         .await?;
     }
+    Ok(())
+}
+
+/// How many times `--topk` candidates are retrieved for results that
+/// [`refine_results`] rescores, so one ranked just below the cut that a boost,
+/// feedback or a pin lifts can still make it.
+const RESCORED_CANDIDATES: usize = 4;
+
+/// The options a search retrieves its candidates with: in the modes whose
+/// results are rescored, a wider `--topk` and no `--threshold`, which
+/// [`refine_results`] applies to the final scores instead. Facet counts want
+/// the wider `--topk` in every mode.
+fn candidate_options(options: &SearchOptions) -> Cow<'_, SearchOptions> {
+    let rescored = !matches!(options.mode, SearchMode::Regex | SearchMode::Ast);
+    if !(rescored || options.facet_summary)
+        || (options.top_k.is_none() && options.threshold.is_none())
+    {
+        return Cow::Borrowed(options);
+    }
+    Cow::Owned(SearchOptions {
+        top_k: options
+            .top_k
+            .map(|top_k| top_k.saturating_mul(RESCORED_CANDIDATES)),
+        threshold: options.threshold.filter(|_| !rescored),
+        ..options.clone()
+    })
+}
 
+/// Keep the results scoring at least `threshold`, noting the best of the
+/// others as the closest below it.
+fn apply_threshold(threshold: f32, search_results: &mut cs_core::SearchResults) {
+    let (kept, below): (Vec<_>, Vec<_>) = std::mem::take(&mut search_results.matches)
+        .into_iter()
+        .partition(|result| result.score >= threshold);
+    search_results.matches = kept;
+    if let Some(best) = below.into_iter().min_by(SearchResult::rank_cmp) {
+        let closer = search_results
+            .closest_below_threshold
+            .as_ref()
+            .is_none_or(|closest| best.score > closest.score);
+        if closer {
+            search_results.closest_below_threshold = Some(best);
+        }
+    }
+}
+
+/// Results of `options.query` in the requested mode, before boosts,
+/// feedback and facet filters.
+async fn search_mode(
+    options: &SearchOptions,
+    progress_callback: Option<SearchProgressCallback>,
+) -> Result<cs_core::SearchResults> {
     let search_results = match options.mode {
         SearchMode::Regex => {
             let matches = regex_search(options)?;
             cs_core::SearchResults {
                 matches,
                 closest_below_threshold: None,
+                plan: None,
+                explanations: None,
+                warnings: Vec::new(),
+                facets: None,
             }
         }
         SearchMode::Lexical => {
@@ -411,6 +654,10 @@ pub async fn search_enhanced_with_indexing_progress(
             cs_core::SearchResults {
                 matches,
                 closest_below_threshold: None,
+                plan: None,
+                explanations: None,
+                warnings: Vec::new(),
+                facets: None,
             }
         }
         SearchMode::Ast => {
@@ -418,25 +665,286 @@ pub async fn search_enhanced_with_indexing_progress(
             cs_core::SearchResults {
                 matches,
                 closest_below_threshold: None,
+                plan: None,
+                explanations: None,
+                warnings: Vec::new(),
+                facets: None,
             }
         }
         SearchMode::Semantic => {
-            // Use v3 semantic search (reads pre-computed embeddings from sidecars using spans)
             semantic_search_v3_with_progress(options, progress_callback).await?
         }
-        SearchMode::Hybrid => {
-            let matches = hybrid_search_with_progress(options, progress_callback).await?;
-            cs_core::SearchResults {
+        SearchMode::Hybrid => hybrid_search_with_progress(options, progress_callback).await?,
+    };
+    Ok(search_results)
+}
+
+/// Apply the adjustments every mode's results get: generated-code and
+/// stop-symbol rules, boosts, `--focus`, the query's language, relevance
+/// feedback, pins, and license, metadata, facet and `--must-match` filters,
+/// then the `--snippet` policy. With
+/// `--explain-scores`, the score changes are noted in the explanations, and
+/// with `--facets` the results are counted per facet.
+///
+/// Outside regex and AST modes, results come from [`candidate_options`], so
+/// `--threshold` and `--topk` are applied here, to the adjusted scores. An
+/// external reranker scores on a scale of its own, so with one the threshold
+/// applies to the retrieval scores before it runs.
+fn refine_results(
+    options: &SearchOptions,
+    search_results: &mut cs_core::SearchResults,
+) -> Result<()> {
+    // Stores, cached and empty searches only know the score they were retrieved with
+    if options.explain_scores && search_results.explanations.is_none() {
+        search_results.explanations = Some(score_explain::from_scores(
+            &options.mode,
+            &search_results.matches,
+        ));
+    }
+
+    if !matches!(options.mode, SearchMode::Regex | SearchMode::Ast) {
+        // Semantic search leaves out generated chunks itself, except from a store
+        if !options.include_generated
+            && (options.mode != SearchMode::Semantic || options.vector_store.is_some())
+        {
+            drop_generated_results(&mut search_results.matches);
+        }
+        let reranked = !options.fusion.reranker.is_empty();
+        if let Some(threshold) = options.threshold.filter(|_| reranked) {
+            apply_threshold(threshold, search_results);
+        }
+        let explanations = &mut search_results.explanations;
+        let matches = &mut search_results.matches;
+        if reranked && !matches.is_empty() {
+            score_explain::adjust(explanations.as_mut(), "reranker", matches, |results| {
+                if let Err(e) =
+                    fusion::rerank_externally(&options.fusion.reranker, &options.query, results)
+                {
+                    tracing::warn!("External reranking failed, using original scores: {}", e);
+                }
+            });
+        }
+        score_explain::adjust(explanations.as_mut(), "stop symbols", matches, |results| {
+            apply_stop_symbol_rules(options, results)
+        })?;
+        score_explain::adjust(explanations.as_mut(), "boost rules", matches, |results| {
+            apply_boost_rules(options, results)
+        })?;
+        if let Some(focus) = &options.focus {
+            score_explain::adjust(explanations.as_mut(), "focus", matches, |results| {
+                focus::apply_focus(focus, results)
+            })?;
+        }
+        if let Some(language) = query_language::inferred(options) {
+            score_explain::adjust(
+                explanations.as_mut(),
+                "query language",
                 matches,
-                closest_below_threshold: None,
-            }
+                |results| query_language::apply(language, options.infer_language, results),
+            );
         }
+        score_explain::adjust(explanations.as_mut(), "feedback", matches, |results| {
+            apply_relevance_feedback(options, results)
+        });
+        score_explain::adjust(explanations.as_mut(), "pins", matches, |results| {
+            apply_pins(options, results)
+        });
+        if let Some(threshold) = options.threshold.filter(|_| !reranked) {
+            apply_threshold(threshold, search_results);
+        }
+    }
+
+    // Semantic search filtered its index chunks already by their stored
+    // license; other modes read the license headers of the files they matched
+    if !options.license_filters.is_empty()
+        && (options.mode != SearchMode::Semantic || options.vector_store.is_some())
+    {
+        let mut licenses: HashMap<PathBuf, Option<String>> = HashMap::new();
+        search_results.matches.retain(|result| {
+            let license = licenses
+                .entry(result.file.clone())
+                .or_insert_with(|| cs_index::licenses::detect_file(&result.file));
+            cs_index::licenses::permits(license.as_deref(), &options.license_filters)
+        });
+    }
+
+    // Like --license, semantic search matched --meta on the stored chunks
+    if !options.metadata_filters.is_empty()
+        && (options.mode != SearchMode::Semantic || options.vector_store.is_some())
+    {
+        let index_root =
+            find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+        facets::apply_metadata_filters(
+            &options.metadata_filters,
+            &index_root,
+            &mut search_results.matches,
+        );
+    }
+
+    // And --tag on the tags stored with them
+    if !options.tag_filters.is_empty()
+        && (options.mode != SearchMode::Semantic || options.vector_store.is_some())
+    {
+        let index_root =
+            find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+        facets::apply_tag_filters(
+            &options.tag_filters,
+            &index_root,
+            &mut search_results.matches,
+        );
+    }
+
+    // Semantic search filtered its candidates already; this covers the other
+    // modes, and commit and collection matches
+    if !options.facet_filters.is_empty() {
+        let index_root =
+            find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+        facets::apply_facet_filters(
+            &options.facet_filters,
+            &index_root,
+            &mut search_results.matches,
+        );
+    }
+
+    // Semantic search narrowed its candidates already; results are checked
+    // again by their lines, which covers the other modes and stores
+    if let Some(regex) = must_match::compile(options)? {
+        must_match::retain_matching_results(&regex, &mut search_results.matches);
+    }
+
+    // Counted over every candidate left, not just the ones `--topk` keeps
+    if options.facet_summary {
+        let index_root =
+            find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+        search_results.facets = Some(facets::summarize(&search_results.matches, &index_root));
+    }
+
+    if let Some(top_k) = options.top_k {
+        search_results.matches.truncate(top_k);
+    }
+
+    // Previews are sized last, for the results that are left
+    if let Some(policy) = options.snippet {
+        let index_root =
+            find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+        snippets::apply_policy(
+            policy,
+            &options.mode,
+            &index_root,
+            &mut search_results.matches,
+        );
+        if let Some(closest) = search_results.closest_below_threshold.as_mut() {
+            snippets::apply_policy(
+                policy,
+                &options.mode,
+                &index_root,
+                std::slice::from_mut(closest),
+            );
+        }
+    }
+    Ok(())
+}
+
+/// Note the files an index search matched, for an index size budget that
+/// evicts the least recently matched first, and the chunks, for a hot model
+/// that re-embeds the most matched.
+fn record_matches(options: &SearchOptions, results: &[SearchResult]) {
+    if results.is_empty() || matches!(options.mode, SearchMode::Regex | SearchMode::Ast) {
+        return;
+    }
+    let Some(index_root) = find_nearest_index_root(&options.path) else {
+        return;
     };
+    if cs_index::bundle::is_sealed(&index_root) {
+        return;
+    }
+    if cs_index::eviction::has_budget() {
+        let files = results.iter().map(|result| result.file.as_path());
+        if let Err(e) = cs_index::eviction::record_matches(&index_root, files) {
+            tracing::debug!("Failed to record matched files: {}", e);
+        }
+    }
+    if cs_index::hot_chunks::is_enabled(&index_root) {
+        let hits = results
+            .iter()
+            .take(cs_index::hot_chunks::MATCHED_RESULTS)
+            .map(|result| (result.file.as_path(), &result.span));
+        if let Err(e) = cs_index::hot_chunks::record_matches(&index_root, hits) {
+            tracing::debug!("Failed to record matched chunks: {}", e);
+        }
+    }
+}
 
-    Ok(search_results)
+/// Indexes opened from a sealed bundle are searched as-is, never updated.
+fn is_sealed_index(path: &Path) -> bool {
+    find_nearest_index_root(path).is_some_and(|root| cs_index::bundle::is_sealed(&root))
 }
 
-fn regex_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
+/// Apply `[[boost]]` rules from the user config and the repo's `.csboost.toml`.
+fn apply_boost_rules(options: &SearchOptions, results: &mut [SearchResult]) -> Result<()> {
+    let index_root = find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+    let mut rules = options.boost_rules.clone();
+    rules.extend(boost::load_repo_boost_rules(&index_root)?);
+
+    let adjusted = boost::apply_boosts(&rules, &index_root, results)?;
+    if adjusted > 0 {
+        tracing::debug!("Boost rules adjusted {} results", adjusted);
+    }
+    Ok(())
+}
+
+/// Drop results from files with a generated-code header.
+fn drop_generated_results(results: &mut Vec<SearchResult>) {
+    let mut generated: HashMap<PathBuf, bool> = HashMap::new();
+    results.retain(|result| {
+        !*generated
+            .entry(result.file.clone())
+            .or_insert_with(|| cs_index::generated::is_generated_file(&result.file))
+    });
+}
+
+/// Apply `[[stop_symbol]]` rules from the user config and the repo's `.csstop.toml`.
+fn apply_stop_symbol_rules(options: &SearchOptions, results: &mut Vec<SearchResult>) -> Result<()> {
+    let index_root = find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+    let mut rules = options.stop_symbol_rules.clone();
+    rules.extend(stop_symbols::load_repo_stop_symbol_rules(&index_root)?);
+
+    let stats = stop_symbols::apply_stop_symbols(&rules, results)?;
+    if stats.demoted + stats.dropped > 0 {
+        tracing::debug!(
+            "Stop-symbol rules demoted {} and dropped {} results",
+            stats.demoted,
+            stats.dropped
+        );
+    }
+    Ok(())
+}
+
+/// Boost/demote results using judgments recorded with `cs --feedback`.
+fn apply_relevance_feedback(options: &SearchOptions, results: &mut [SearchResult]) {
+    let index_root = find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+    match FeedbackStore::load(&index_root) {
+        Ok(store) => {
+            let adjusted = store.apply(&options.query, &index_root, results);
+            if adjusted > 0 {
+                tracing::debug!("Relevance feedback adjusted {} results", adjusted);
+            }
+        }
+        Err(e) => tracing::warn!("Ignoring unreadable feedback file: {}", e),
+    }
+}
+
+/// Boost results overlapping the symbols pinned with `cs --pin-add`.
+fn apply_pins(options: &SearchOptions, results: &mut [SearchResult]) {
+    let index_root = find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+    let boosted = pins::PinLookup::new(&index_root).apply(results);
+    if boosted > 0 {
+        tracing::debug!("Pins boosted {} results", boosted);
+    }
+}
+
+/// The regex a regex search of `options` matches lines with.
+pub(crate) fn query_regex(options: &SearchOptions) -> Result<Regex> {
     let pattern = if options.fixed_string {
         regex::escape(&options.query)
     } else if options.whole_word {
@@ -445,10 +953,15 @@ fn regex_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
         options.query.clone()
     };
 
-    let regex = RegexBuilder::new(&pattern)
+    Ok(RegexBuilder::new(&pattern)
         .case_insensitive(options.case_insensitive)
         .build()
-        .map_err(CcError::Regex)?;
+        .map_err(CcError::Regex)?)
+}
+
+#[tracing::instrument(name = "regex_search", skip_all)]
+fn regex_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
+    let regex = query_regex(options)?;
 
     // Default to recursive for directories (like grep) to maintain compatibility
     let should_recurse = options.path.is_dir() || options.recursive;
@@ -777,6 +1290,7 @@ fn process_streaming_line(
     }
 }
 
+#[tracing::instrument(name = "lexical_search", skip_all)]
 async fn lexical_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
     // Handle both files and directories and reuse nearest existing .cs index up the tree
     let index_root = find_nearest_index_root(&options.path).unwrap_or_else(|| {
@@ -787,24 +1301,35 @@ async fn lexical_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
         }
     });
 
-    let index_dir = index_root.join(".cs");
+    let index_dir = cs_core::locations::index_dir(&index_root);
     if !index_dir.exists() {
         return Err(CcError::Index("No index found. Run 'cs index' first.".to_string()).into());
     }
 
     let tantivy_index_path = index_dir.join("tantivy_index");
 
+    // The lexical index stores file contents, so an encrypted index rebuilds it in memory
+    if cs_index::encryption::is_encrypted(&index_root) {
+        return build_tantivy_index(options, true).await;
+    }
     if !tantivy_index_path.exists() {
-        return build_tantivy_index(options).await;
+        return build_tantivy_index(options, false).await;
     }
 
     let mut schema_builder = Schema::builder();
     let content_field = schema_builder.add_text_field("content", TEXT | STORED);
     let path_field = schema_builder.add_text_field("path", TEXT | STORED);
+    let identifiers_field = schema_builder.add_text_field("identifiers", TEXT);
     let _schema = schema_builder.build();
 
     let index = Index::open_in_dir(&tantivy_index_path)
         .map_err(|e| CcError::Index(format!("Failed to open tantivy index: {}", e)))?;
+    // Indexes from before identifier splitting have no field for the words
+    if index.schema().get_field("identifiers").is_err() {
+        drop(index);
+        fs::remove_dir_all(&tantivy_index_path)?;
+        return build_tantivy_index(options, false).await;
+    }
 
     let reader = index
         .reader_builder()
@@ -813,11 +1338,7 @@ async fn lexical_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
         .map_err(|e| CcError::Index(format!("Failed to create index reader: {}", e)))?;
 
     let searcher = reader.searcher();
-    let query_parser = QueryParser::for_index(&index, vec![content_field]);
-
-    let query = query_parser
-        .parse_query(&options.query)
-        .map_err(|e| CcError::Search(format!("Failed to parse query: {}", e)))?;
+    let query = lexical_query(&index, &[content_field, identifiers_field], options)?;
 
     let top_docs = if let Some(top_k) = options.top_k {
         searcher.search(&query, &TopDocs::with_limit(top_k))?
@@ -891,11 +1412,65 @@ async fn lexical_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
             }
         }
     }
+    results.sort_by(SearchResult::rank_cmp);
 
     Ok(results)
 }
 
-async fn build_tantivy_index(options: &SearchOptions) -> Result<Vec<SearchResult>> {
+/// Lexical query words shorter than this must be spelled exactly.
+const MIN_TYPO_WORD: usize = 4;
+
+/// Words at least this long may be two edits off, when two are allowed.
+const MIN_TWO_TYPO_WORD: usize = 8;
+
+/// The score a word matched despite typos adds, well under what BM25 gives
+/// an exact match, so correctly spelled matches rank first.
+const TYPO_MATCH_BOOST: f32 = 0.5;
+
+/// The query for a lexical search over `fields`: the query as parsed and,
+/// unless `max_typos` is 0, each of its words within that many edits
+/// (insertions, deletions, substitutions or swapped neighbours).
+fn lexical_query(
+    index: &Index,
+    fields: &[Field],
+    options: &SearchOptions,
+) -> Result<Box<dyn Query>> {
+    let exact = QueryParser::for_index(index, fields.to_vec())
+        .parse_query(&options.query)
+        .map_err(|e| CcError::Search(format!("Failed to parse query: {}", e)))?;
+    if options.max_typos == 0 {
+        return Ok(exact);
+    }
+
+    let mut clauses: Vec<(Occur, Box<dyn Query>)> = vec![(Occur::Should, exact)];
+    let mut analyzer = index.tokenizer_for_field(fields[0])?;
+    let mut tokens = analyzer.token_stream(&options.query);
+    while tokens.advance() {
+        let word = &tokens.token().text;
+        let length = word.chars().count();
+        if length < MIN_TYPO_WORD {
+            continue;
+        }
+        let distance = if length < MIN_TWO_TYPO_WORD {
+            1
+        } else {
+            options.max_typos.min(2)
+        };
+        for &field in fields {
+            let fuzzy = FuzzyTermQuery::new(Term::from_field_text(field, word), distance, true);
+            clauses.push((
+                Occur::Should,
+                Box::new(BoostQuery::new(Box::new(fuzzy), TYPO_MATCH_BOOST)),
+            ));
+        }
+    }
+    Ok(Box::new(BooleanQuery::new(clauses)))
+}
+
+async fn build_tantivy_index(
+    options: &SearchOptions,
+    in_memory: bool,
+) -> Result<Vec<SearchResult>> {
     // Handle both files and directories by finding the appropriate directory for indexing
     let index_root = if options.path.is_file() {
         options.path.parent().unwrap_or(&options.path)
@@ -903,18 +1478,22 @@ async fn build_tantivy_index(options: &SearchOptions) -> Result<Vec<SearchResult
         &options.path
     };
 
-    let index_dir = index_root.join(".cs");
+    let index_dir = cs_core::locations::index_dir(index_root);
     let tantivy_index_path = index_dir.join("tantivy_index");
 
-    fs::create_dir_all(&tantivy_index_path)?;
-
     let mut schema_builder = Schema::builder();
     let content_field = schema_builder.add_text_field("content", TEXT | STORED);
     let path_field = schema_builder.add_text_field("path", TEXT | STORED);
+    let identifiers_field = schema_builder.add_text_field("identifiers", TEXT);
     let schema = schema_builder.build();
 
-    let index = Index::create_in_dir(&tantivy_index_path, schema.clone())
-        .map_err(|e| CcError::Index(format!("Failed to create tantivy index: {}", e)))?;
+    let index = if in_memory {
+        Index::create_in_ram(schema.clone())
+    } else {
+        fs::create_dir_all(&tantivy_index_path)?;
+        Index::create_in_dir(&tantivy_index_path, schema.clone())
+            .map_err(|e| CcError::Index(format!("Failed to create tantivy index: {}", e)))?
+    };
 
     let mut index_writer = index
         .writer(50_000_000)
@@ -926,10 +1505,13 @@ async fn build_tantivy_index(options: &SearchOptions) -> Result<Vec<SearchResult
     );
 
     for file_path in &files {
-        if let Ok(content) = fs::read_to_string(file_path) {
+        if let Ok(content) = cs_core::text::read_text(file_path) {
+            let identifiers =
+                identifiers::identifier_terms(&content, cs_core::Language::from_path(file_path));
             let doc = doc!(
                 content_field => content,
-                path_field => file_path.display().to_string()
+                path_field => file_path.display().to_string(),
+                identifiers_field => identifiers
             );
             index_writer.add_document(doc)?;
         }
@@ -940,15 +1522,6 @@ async fn build_tantivy_index(options: &SearchOptions) -> Result<Vec<SearchResult
         .map_err(|e| CcError::Index(format!("Failed to commit index: {}", e)))?;
 
     // After building, search again with the same options
-    let tantivy_index_path = index_root.join(".cs").join("tantivy_index");
-    let mut schema_builder = Schema::builder();
-    let content_field = schema_builder.add_text_field("content", TEXT | STORED);
-    let path_field = schema_builder.add_text_field("path", TEXT | STORED);
-    let _schema = schema_builder.build();
-
-    let index = Index::open_in_dir(&tantivy_index_path)
-        .map_err(|e| CcError::Index(format!("Failed to open tantivy index: {}", e)))?;
-
     let reader = index
         .reader_builder()
         .reload_policy(ReloadPolicy::OnCommitWithDelay)
@@ -956,11 +1529,7 @@ async fn build_tantivy_index(options: &SearchOptions) -> Result<Vec<SearchResult
         .map_err(|e| CcError::Index(format!("Failed to create index reader: {}", e)))?;
 
     let searcher = reader.searcher();
-    let query_parser = QueryParser::for_index(&index, vec![content_field]);
-
-    let query = query_parser
-        .parse_query(&options.query)
-        .map_err(|e| CcError::Search(format!("Failed to parse query: {}", e)))?;
+    let query = lexical_query(&index, &[content_field, identifiers_field], options)?;
 
     let top_docs = if let Some(top_k) = options.top_k {
         searcher.search(&query, &TopDocs::with_limit(top_k))?
@@ -1031,19 +1600,20 @@ async fn build_tantivy_index(options: &SearchOptions) -> Result<Vec<SearchResult
             }
         }
     }
+    results.sort_by(SearchResult::rank_cmp);
 
     Ok(results)
 }
 
 #[allow(dead_code)]
 async fn hybrid_search(options: &SearchOptions) -> Result<Vec<SearchResult>> {
-    hybrid_search_with_progress(options, None).await
+    Ok(hybrid_search_with_progress(options, None).await?.matches)
 }
 
 async fn hybrid_search_with_progress(
     options: &SearchOptions,
     progress_callback: Option<SearchProgressCallback>,
-) -> Result<Vec<SearchResult>> {
+) -> Result<cs_core::SearchResults> {
     if let Some(ref callback) = progress_callback {
         callback("Running regex search...");
     }
@@ -1071,92 +1641,115 @@ async fn hybrid_search_with_progress(
         None
     };
 
-    let mut combined = HashMap::new();
-
-    for (rank, result) in regex_results.iter().enumerate() {
-        let key = format!("{}:{}", result.file.display(), result.span.line_start);
-        combined
-            .entry(key)
-            .or_insert(Vec::new())
-            .push((rank + 1, result.clone()));
-    }
-
-    for (rank, result) in semantic_results.matches.iter().enumerate() {
-        let key = format!("{}:{}", result.file.display(), result.span.line_start);
-        combined
-            .entry(key)
-            .or_insert(Vec::new())
-            .push((rank + 1, result.clone()));
-    }
-
-    // Add AST results if available
-    if let Some(ast_results) = ast_results {
-        for (rank, result) in ast_results.iter().enumerate() {
-            let key = format!("{}:{}", result.file.display(), result.span.line_start);
-            combined
-                .entry(key)
-                .or_insert(Vec::new())
-                .push((rank + 1, result.clone()));
-        }
+    let fusion = fusion::from_config(&options.fusion)?;
+    let mut rrf_results: Vec<SearchResult> = fusion::fuse(
+        &regex_results,
+        &semantic_results.matches,
+        ast_results.as_deref().unwrap_or_default(),
+        fusion.as_ref(),
+    );
+    // Thresholds apply to the fused score
+    if let Some(threshold) = options.threshold {
+        rrf_results.retain(|result| result.score >= threshold);
     }
 
-    // Calculate RRF scores according to original paper: RRFscore(d) = Σ(r∈R) 1/(k + r(d))
-    let mut rrf_results: Vec<SearchResult> = combined
-        .into_values()
-        .map(|ranks| {
-            let mut result = ranks[0].1.clone();
-            let rrf_score = ranks
-                .iter()
-                .map(|(rank, _)| 1.0 / (60.0 + *rank as f32))
-                .sum();
-            result.score = rrf_score;
-            result
-        })
-        .filter(|result| {
-            // Apply threshold filtering to raw RRF scores
-            if let Some(threshold) = options.threshold {
-                result.score >= threshold
-            } else {
-                true
-            }
-        })
-        .collect();
-
     rrf_results.retain(|result| path_matches_include(&result.file, &options.include_patterns));
 
-    // Sort by RRF score (highest first)
-    rrf_results.sort_by(|a, b| {
-        b.score
-            .partial_cmp(&a.score)
-            .unwrap_or(std::cmp::Ordering::Equal)
-    });
+    // Sort by fused score (highest first)
+    rrf_results.sort_by(SearchResult::rank_cmp);
 
     if let Some(top_k) = options.top_k {
         rrf_results.truncate(top_k);
     }
 
-    Ok(rrf_results)
+    let warnings = semantic_results.warnings.clone();
+    let explanations = options.explain_scores.then(|| {
+        explain_fusion(
+            &rrf_results,
+            &regex_results,
+            semantic_results,
+            ast_results.as_deref().unwrap_or_default(),
+        )
+    });
+    Ok(cs_core::SearchResults {
+        matches: rrf_results,
+        closest_below_threshold: None,
+        plan: None,
+        explanations,
+        warnings,
+        facets: None,
+    })
+}
+
+/// How each of the `fused` hybrid results ranked in the lists fused into it,
+/// on top of what the semantic search explained about its dense score.
+fn explain_fusion(
+    fused: &[SearchResult],
+    regex_results: &[SearchResult],
+    semantic_results: cs_core::SearchResults,
+    ast_results: &[SearchResult],
+) -> cs_core::ScoreExplanations {
+    let ranked = |results: &[SearchResult]| -> HashMap<(PathBuf, usize), (usize, f32)> {
+        let mut ranks = HashMap::new();
+        for (rank, result) in results.iter().enumerate() {
+            ranks
+                .entry(score_explain::key(result))
+                .or_insert((rank + 1, result.score));
+        }
+        ranks
+    };
+    let lexical = ranked(regex_results);
+    let dense = ranked(&semantic_results.matches);
+    let ast = ranked(ast_results);
+    let mut dense_explanations = semantic_results.explanations.unwrap_or_default();
+
+    fused
+        .iter()
+        .map(|result| {
+            let key = score_explain::key(result);
+            let mut explanation = dense_explanations.remove(&key).unwrap_or_default();
+            explanation.dense_rank = dense.get(&key).map(|&(rank, _)| rank);
+            if let Some(&(rank, score)) = lexical.get(&key) {
+                explanation.lexical_rank = Some(rank);
+                explanation.lexical = Some(score);
+            }
+            if let Some(&(rank, score)) = ast.get(&key) {
+                explanation.ast_rank = Some(rank);
+                explanation.ast = Some(score);
+            }
+            explanation.fused = Some(result.score);
+            (key, explanation)
+        })
+        .collect()
 }
 
 fn build_globset(patterns: &[String]) -> GlobSet {
     let mut builder = GlobSetBuilder::new();
     for pat in patterns {
         // Treat patterns as filename or directory globs
-        if let Ok(glob) = Glob::new(pat) {
+        if let Ok(glob) = GlobBuilder::new(&cs_core::paths::fold(pat))
+            .case_insensitive(cs_core::paths::filters_ignore_case())
+            .build()
+        {
             builder.add(glob);
         }
     }
     builder.build().unwrap_or_else(|_| GlobSet::empty())
 }
 
+/// Whether `path` matches `globset`, as path filters compare names.
+fn is_match(globset: &GlobSet, path: &Path) -> bool {
+    globset.is_match(cs_core::paths::filter_path(path))
+}
+
 fn should_exclude_path(path: &Path, globset: &GlobSet) -> bool {
     // Match against each path component and the full path
-    if globset.is_match(path) {
+    if is_match(globset, path) {
         return true;
     }
     for component in path.components() {
         if let std::path::Component::Normal(name) = component
-            && globset.is_match(name)
+            && is_match(globset, Path::new(name))
         {
             return true;
         }
@@ -1176,10 +1769,16 @@ fn collect_files(
         // Always add single files, even if they're excluded (user explicitly requested)
         files.push(path.to_path_buf());
     } else if recursive {
-        for entry in WalkDir::new(path).into_iter().filter_entry(|e| {
+        let follow_links =
+            cs_index::traversal::symlink_policy() == cs_index::traversal::SymlinkPolicy::Follow;
+        let walker = WalkDir::new(path).follow_links(follow_links);
+        for entry in walker.into_iter().filter_entry(|e| {
             // Skip excluded directories entirely for efficiency
             let name = e.file_name();
-            !globset.is_match(e.path()) && !globset.is_match(name)
+            let is_nested_dir = e.depth() > 0 && e.file_type().is_dir();
+            !is_match(&globset, e.path())
+                && !is_match(&globset, Path::new(name))
+                && (!is_nested_dir || cs_index::traversal::descends_into(e.path()))
         }) {
             match entry {
                 Ok(entry) => {
@@ -1194,6 +1793,9 @@ fn collect_files(
                 }
             }
         }
+        if follow_links {
+            files = cs_index::traversal::dedupe_linked(path, files);
+        }
     } else {
         match fs::read_dir(path) {
             Ok(read_dir) => {
@@ -1223,6 +1825,7 @@ fn collect_files(
 }
 
 #[allow(clippy::too_many_arguments)]
+#[tracing::instrument(name = "ensure_index_updated", skip_all)]
 async fn ensure_index_updated_with_progress(
     path: &Path,
     force_reindex: bool,
@@ -1232,6 +1835,7 @@ async fn ensure_index_updated_with_progress(
     respect_gitignore: bool,
     exclude_patterns: &[String],
     model_override: Option<&str>,
+    ctx: &OperationContext,
 ) -> Result<()> {
     // Find index root for .cs directory location
     let index_root_buf = find_nearest_index_root(path).unwrap_or_else(|| {
@@ -1246,7 +1850,7 @@ async fn ensure_index_updated_with_progress(
     // Pass the original path to indexing function so it can index just that file/directory
     // The indexing function will use collect_files() which now handles individual files correctly
     if force_reindex {
-        let stats = cs_index::smart_update_index_with_detailed_progress(
+        let stats = cs_index::smart_update_index_with_context(
             index_root,
             true,
             progress_callback,
@@ -1255,6 +1859,7 @@ async fn ensure_index_updated_with_progress(
             respect_gitignore,
             exclude_patterns, // Use search-specific exclude patterns
             model_override,
+            ctx,
         )
         .await?;
         if stats.files_indexed > 0 || stats.orphaned_files_removed > 0 {
@@ -1275,7 +1880,7 @@ async fn ensure_index_updated_with_progress(
         index_file(path, need_embeddings).await?;
     } else {
         // For directories, use the standard smart update
-        let stats = cs_index::smart_update_index_with_detailed_progress(
+        let stats = cs_index::smart_update_index_with_context(
             index_root,
             false,
             progress_callback,
@@ -1284,6 +1889,7 @@ async fn ensure_index_updated_with_progress(
             respect_gitignore,
             exclude_patterns,
             model_override,
+            ctx,
         )
         .await?;
         if stats.files_indexed > 0 || stats.orphaned_files_removed > 0 {
@@ -1653,6 +2259,112 @@ mod tests {
         assert!(results[0].preview.contains("line 4"));
     }
 
+    #[tokio::test]
+    async fn test_lexical_search_splits_identifiers_and_tolerates_typos() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(
+            temp_dir.path().join("memory.go"),
+            "type InMemoryUserService struct {\n\tusers map[int]*User\n}\n",
+        )
+        .unwrap();
+        fs::write(
+            temp_dir.path().join("notes.md"),
+            "Cache eviction runs hourly.\n",
+        )
+        .unwrap();
+
+        let options = |query: &str, max_typos| SearchOptions {
+            mode: SearchMode::Lexical,
+            query: query.to_string(),
+            path: temp_dir.path().to_path_buf(),
+            max_typos,
+            ..Default::default()
+        };
+        let files = |results: Vec<SearchResult>| -> Vec<String> {
+            results
+                .iter()
+                .map(|result| {
+                    result
+                        .file
+                        .file_name()
+                        .unwrap()
+                        .to_string_lossy()
+                        .to_string()
+                })
+                .collect()
+        };
+
+        let words = build_tantivy_index(&options("in memory user service", 0), true)
+            .await
+            .unwrap();
+        assert_eq!(files(words), ["memory.go"]);
+        let typo = build_tantivy_index(&options("InMemoryUserServce", 1), true)
+            .await
+            .unwrap();
+        assert_eq!(files(typo), ["memory.go"]);
+        let exact = build_tantivy_index(&options("InMemoryUserServce", 0), true)
+            .await
+            .unwrap();
+        assert!(exact.is_empty());
+    }
+
+    #[test]
+    fn boosts_apply_before_the_threshold_and_top_k_cut() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(temp_dir.path().join("a.rs"), "fn lookup() {}\n").unwrap();
+        fs::write(temp_dir.path().join("b.rs"), "fn lookup() {}\n").unwrap();
+        let result = |name: &str, score| SearchResult {
+            file: temp_dir.path().join(name),
+            span: Span {
+                byte_start: 0,
+                byte_end: 14,
+                line_start: 1,
+                line_end: 1,
+            },
+            score,
+            preview: String::new(),
+            lang: None,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        };
+        let options = SearchOptions {
+            mode: SearchMode::Lexical,
+            query: "lookup".to_string(),
+            path: temp_dir.path().to_path_buf(),
+            top_k: Some(1),
+            threshold: Some(1.0),
+            boost_rules: vec![cs_core::BoostRule {
+                path: Some("b.rs".to_string()),
+                language: None,
+                modified_within_days: None,
+                factor: 3.0,
+            }],
+            ..Default::default()
+        };
+
+        // Retrieved with a wider pool and no threshold, as the mode search would
+        let candidates = candidate_options(&options);
+        assert_eq!(candidates.top_k, Some(RESCORED_CANDIDATES));
+        assert_eq!(candidates.threshold, None);
+        let mut results = cs_core::SearchResults {
+            matches: vec![result("a.rs", 0.9), result("b.rs", 0.5)],
+            closest_below_threshold: None,
+            plan: None,
+            explanations: None,
+            warnings: Vec::new(),
+            facets: None,
+        };
+        refine_results(&options, &mut results).unwrap();
+
+        let files: Vec<_> = results.matches.iter().map(|r| r.file.clone()).collect();
+        assert_eq!(files, [temp_dir.path().join("b.rs")]);
+        assert_eq!(
+            results.closest_below_threshold.map(|r| r.file),
+            Some(temp_dir.path().join("a.rs"))
+        );
+    }
+
     #[tokio::test]
     async fn test_search_main_function() {
         let temp_dir = TempDir::new().unwrap();
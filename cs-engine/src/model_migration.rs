@@ -0,0 +1,194 @@
+//! Searching an index part way through `cs --migrate-model` (see
+//! [`cs_index::model_migration`]): some of its files are embedded with the
+//! new model, the rest with the old, so the query is embedded with both and
+//! each chunk is scored against the vector of its own model.
+//!
+//! Cosine scores of two models aren't on one scale: code one model scores
+//! 0.8 another may score 0.5. So the new model's scores are mapped onto the
+//! old one's, matching the mean and spread of each model's scores over a
+//! sample of the candidates. That keeps the ranking fair to both halves of
+//! the index and `--threshold` meaning what it did, for however long the
+//! migration takes.
+
+use anyhow::Result;
+use cs_index::ChunkEntry;
+use std::collections::HashSet;
+use std::path::{Path, PathBuf};
+
+use super::SearchProgressCallback;
+use super::semantic_v3::{dense_similarity, with_message_match};
+
+/// Chunks of each model scored to calibrate, at most.
+const CALIBRATION_SAMPLE: usize = 4096;
+
+/// Chunks of each model needed before their scores are calibrated; with
+/// fewer, the new model's scores are used as they are.
+const MIN_CALIBRATION_CHUNKS: usize = 32;
+
+/// Mean and standard deviation of one model's scores.
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct Moments {
+    mean: f32,
+    std_dev: f32,
+}
+
+impl Moments {
+    fn of(scores: &[f32]) -> Option<Self> {
+        if scores.len() < MIN_CALIBRATION_CHUNKS {
+            return None;
+        }
+        let count = scores.len() as f32;
+        let mean = scores.iter().sum::<f32>() / count;
+        let variance = scores.iter().map(|s| (s - mean).powi(2)).sum::<f32>() / count;
+        let std_dev = variance.sqrt();
+        (std_dev > 1e-6).then_some(Self { mean, std_dev })
+    }
+}
+
+/// The migration of the index being searched, with the query under its new
+/// model.
+pub(crate) struct Migrating {
+    /// Files whose chunks are embedded with the new model, as the candidates
+    /// name them
+    files: HashSet<PathBuf>,
+    /// Their chunks, until [`Migrating::replace_chunks`] takes them
+    chunks: Vec<(PathBuf, ChunkEntry)>,
+    query_embedding: Vec<f32>,
+    /// Old model's scores, then the new model's
+    calibration: Option<(Moments, Moments)>,
+}
+
+impl Migrating {
+    /// The migration of the index at `index_root`, with `query` embedded by
+    /// its new model, if the index is migrating.
+    pub(crate) fn load(
+        index_root: &Path,
+        query: &str,
+        progress_callback: Option<&SearchProgressCallback>,
+    ) -> Result<Option<Self>> {
+        let Some(migrated) = cs_index::model_migration::load_migrated(index_root)? else {
+            return Ok(None);
+        };
+        let model = migrated.migration.to;
+        if let Some(callback) = progress_callback {
+            callback(&format!(
+                "Index is migrating to {}: {} of {} files so far, scored by each model",
+                model,
+                migrated.entries.len(),
+                migrated.total
+            ));
+        }
+        let mut embedder = cs_embed::create_embedder(Some(&model))?;
+        let query = cs_index::redaction::prepare_query(&*embedder, index_root, query)?;
+        let Some(query_embedding) = embedder.embed(&[query])?.pop() else {
+            anyhow::bail!("Model '{}' returned no query vector", model);
+        };
+
+        let mut files = HashSet::new();
+        let mut chunks = Vec::new();
+        for (relative, entry) in migrated.entries {
+            let file = index_root.join(relative);
+            chunks.extend(
+                entry
+                    .chunks
+                    .into_iter()
+                    .filter(|chunk| chunk.embedding.is_some())
+                    .map(|chunk| (file.clone(), chunk)),
+            );
+            files.insert(file);
+        }
+        Ok(Some(Self {
+            files,
+            chunks,
+            query_embedding,
+            calibration: None,
+        }))
+    }
+
+    /// Whether the chunks of `file` are embedded with the new model.
+    pub(crate) fn covers(&self, file: &Path) -> bool {
+        self.files.contains(file)
+    }
+
+    /// Swap the chunks of migrated files among `file_chunks` for their
+    /// new-model ones, of the files `include` lets through.
+    pub(crate) fn replace_chunks(
+        &mut self,
+        include: impl Fn(&Path) -> bool,
+        file_chunks: &mut Vec<(PathBuf, ChunkEntry)>,
+    ) {
+        file_chunks.retain(|(file, _)| !self.files.contains(file));
+        file_chunks.extend(
+            std::mem::take(&mut self.chunks)
+                .into_iter()
+                .filter(|(file, _)| include(file)),
+        );
+    }
+
+    /// Score migrated files by their old model from now on, such as those
+    /// re-embedded from the working tree.
+    pub(crate) fn forget(&mut self, mut is_stale: impl FnMut(&Path) -> bool) {
+        self.files.retain(|file| !is_stale(file));
+    }
+
+    /// Learn how the two models' scores for this query compare, from a
+    /// sample of each model's chunks among `file_chunks`.
+    pub(crate) fn calibrate(
+        &mut self,
+        query_embedding: &[f32],
+        file_chunks: &[(PathBuf, ChunkEntry)],
+    ) {
+        let (new, old): (Vec<_>, Vec<_>) =
+            file_chunks.iter().partition(|(file, _)| self.covers(file));
+        let sample = |chunks: &[&(PathBuf, ChunkEntry)], query: &[f32]| -> Vec<f32> {
+            let step = chunks.len().div_ceil(CALIBRATION_SAMPLE).max(1);
+            chunks
+                .iter()
+                .step_by(step)
+                .filter_map(|(_, chunk)| dense_similarity(query, chunk, None))
+                .collect()
+        };
+        self.calibration = Moments::of(&sample(&old, query_embedding))
+            .zip(Moments::of(&sample(&new, &self.query_embedding)));
+    }
+
+    /// A new-model score on the old model's scale.
+    fn rescale(&self, similarity: f32) -> f32 {
+        match self.calibration {
+            Some((old, new)) => old.mean + (similarity - new.mean) / new.std_dev * old.std_dev,
+            None => similarity,
+        }
+    }
+
+    /// How close `chunk` of a migrated file is to `query`, on the old
+    /// model's scale.
+    pub(crate) fn similarity(&self, chunk: &ChunkEntry, query: &str) -> Option<f32> {
+        let similarity = dense_similarity(&self.query_embedding, chunk, None)?;
+        Some(with_message_match(self.rescale(similarity), chunk, query))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn new_model_scores_are_mapped_onto_the_old_models_scale() {
+        // The new model scores everything lower, and in a narrower band
+        let old: Vec<f32> = (0..64).map(|i| 0.6 + 0.3 * i as f32 / 63.0).collect();
+        let new: Vec<f32> = (0..64).map(|i| 0.3 + 0.15 * i as f32 / 63.0).collect();
+        let migrating = Migrating {
+            files: HashSet::new(),
+            chunks: Vec::new(),
+            query_embedding: Vec::new(),
+            calibration: Moments::of(&old).zip(Moments::of(&new)),
+        };
+        assert!((migrating.rescale(0.3) - 0.6).abs() < 1e-4);
+        assert!((migrating.rescale(0.375) - 0.75).abs() < 1e-4);
+        assert!((migrating.rescale(0.45) - 0.9).abs() < 1e-4);
+
+        // Too few chunks of a model to tell
+        assert!(Moments::of(&new[..MIN_CALIBRATION_CHUNKS - 1]).is_none());
+        assert!(Moments::of(&[0.5; 64]).is_none());
+    }
+}
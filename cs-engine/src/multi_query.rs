@@ -0,0 +1,332 @@
+//! `--multi-query`: a long question asking for several things, such as
+//! "where do we validate emails and send the welcome message", ranks code
+//! about all of it first and code about one part nowhere. Such a question is
+//! split into 2 to 4 sub-queries, each is searched alongside the whole
+//! question, and the rankings are fused by reciprocal rank (`k` from
+//! `[fusion]`), so the best code for each part makes the results too.
+//!
+//! [`split_query`] splits at conjunctions and punctuation, keeping parts of
+//! a single word with their neighbors ("emails and phones" stays whole).
+//! With a chat model configured, [`decompose_with_llm`] writes the
+//! sub-queries instead, which also handles questions with no conjunction.
+
+use anyhow::Result;
+use cs_core::{SearchMode, SearchOptions, SearchResult, SearchResults};
+use regex::Regex;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::str::FromStr;
+use std::sync::LazyLock;
+
+use super::{SearchProgressCallback, score_explain};
+
+/// Sub-queries a question is split into at most.
+pub const MAX_SUB_QUERIES: usize = 4;
+
+/// Words a question needs before it's worth splitting.
+const MIN_QUERY_WORDS: usize = 6;
+
+/// Words a part needs to be searched on its own.
+const MIN_PART_WORDS: usize = 2;
+
+static SEPARATOR: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?i)\s*[;?]\s*|\s*,\s*(?:and\s+|then\s+)?|\s+(?:and then|and also|as well as|and|then|plus)\s+")
+        .unwrap()
+});
+
+/// How `--multi-query` splits a question.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Decomposer {
+    /// At conjunctions and punctuation ([`split_query`])
+    #[default]
+    Split,
+    /// By the `[llm]` chat model ([`decompose_with_llm`])
+    Llm,
+}
+
+impl FromStr for Decomposer {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "split" => Ok(Decomposer::Split),
+            "llm" => Ok(Decomposer::Llm),
+            other => Err(format!(
+                "Unknown multi-query decomposer '{}': use split or llm",
+                other
+            )),
+        }
+    }
+}
+
+fn is_short(part: &str) -> bool {
+    part.split_whitespace().count() < MIN_PART_WORDS
+}
+
+/// Whether `query` is long enough to be split.
+pub fn is_long(query: &str) -> bool {
+    query.split_whitespace().count() >= MIN_QUERY_WORDS
+}
+
+/// The parts of the compound `query`, or none when it asks for one thing.
+pub fn split_query(query: &str) -> Vec<String> {
+    let query = query.trim().trim_end_matches(['?', '.', '!']);
+    if !is_long(query) {
+        return Vec::new();
+    }
+    let mut parts: Vec<String> = Vec::new();
+    let mut separator = "";
+    let mut last = 0;
+    let ends = SEPARATOR
+        .find_iter(query)
+        .map(|next| (next.start(), next.as_str(), next.end()))
+        .chain(std::iter::once((query.len(), "", query.len())));
+    for (end, next_separator, next_start) in ends {
+        let part = &query[last..end];
+        match parts.last_mut() {
+            // A short part and its neighbor stay one part, separator and all
+            Some(previous) if is_short(part) || is_short(previous) => {
+                previous.push_str(separator);
+                previous.push_str(part);
+            }
+            _ => parts.push(part.to_string()),
+        }
+        separator = next_separator;
+        last = next_start;
+    }
+
+    let mut parts: Vec<String> = parts
+        .iter()
+        .map(|part| part.trim().to_string())
+        .filter(|part| !part.is_empty())
+        .collect();
+    if parts.len() > MAX_SUB_QUERIES {
+        let rest = parts.split_off(MAX_SUB_QUERIES - 1).join(" ");
+        parts.push(rest);
+    }
+    if parts.len() < 2 { Vec::new() } else { parts }
+}
+
+/// The sub-queries in a chat model's reply: one per line, without list
+/// markers or quotes.
+pub fn parse_sub_queries(reply: &str) -> Vec<String> {
+    let mut queries: Vec<String> = Vec::new();
+    for line in reply.lines() {
+        let query = line
+            .trim()
+            .trim_start_matches(|c: char| c.is_ascii_digit())
+            .trim_start_matches(['-', '*', '.', ')', ' '])
+            .trim_matches(['"', '\'', '`', ' '])
+            .to_string();
+        if !query.is_empty() && !queries.contains(&query) {
+            queries.push(query);
+        }
+    }
+    queries.truncate(MAX_SUB_QUERIES);
+    if queries.len() < 2 {
+        Vec::new()
+    } else {
+        queries
+    }
+}
+
+#[cfg(feature = "ask")]
+const DECOMPOSE_PROMPT: &str = "You split code search requests into 2 to 4 short search queries, \
+each naming one thing to find in the code. Reply with the queries only, one per line. If the \
+request asks for one thing, reply with it unchanged on one line.";
+
+/// The sub-queries the `[llm]` chat model splits `query` into, or none when
+/// it asks for one thing. When the endpoint isn't on this machine, `query`
+/// is screened for secrets and redaction rules of `repo_root` first.
+#[cfg(feature = "ask")]
+pub async fn decompose_with_llm(
+    query: &str,
+    config: &cs_core::LlmConfig,
+    repo_root: &std::path::Path,
+) -> Result<Vec<String>> {
+    use super::answer::{self, ChatMessage};
+
+    let url = config.url.as_deref().unwrap_or(answer::DEFAULT_LLM_URL);
+    let Some(model) = config.model.as_deref() else {
+        anyhow::bail!(
+            "--multi-query llm needs a chat model: pass --llm-model, set CS_LLM_MODEL or add `model` under [llm] in config.toml"
+        );
+    };
+    let query = if answer::is_local(url) {
+        query.to_string()
+    } else {
+        answer::screen(repo_root, query)?
+    };
+    let messages = vec![
+        ChatMessage {
+            role: "system".to_string(),
+            content: DECOMPOSE_PROMPT.to_string(),
+        },
+        ChatMessage {
+            role: "user".to_string(),
+            content: query,
+        },
+    ];
+    let reply = answer::complete(&answer::chat_client()?, url, model, config, messages).await?;
+    Ok(parse_sub_queries(&reply))
+}
+
+/// Whether `options` asks for a fused search of sub-queries.
+pub(crate) fn applies(options: &SearchOptions) -> bool {
+    !options.sub_queries.is_empty() && !matches!(options.mode, SearchMode::Regex | SearchMode::Ast)
+}
+
+/// Search for `options.query` and each of its sub-queries, and fuse the
+/// rankings into `top_k` results.
+pub(crate) async fn search(
+    options: &SearchOptions,
+    progress_callback: Option<SearchProgressCallback>,
+) -> Result<SearchResults> {
+    let queries: Vec<String> = std::iter::once(options.query.clone())
+        .chain(options.sub_queries.iter().cloned())
+        .collect();
+    let single = SearchOptions {
+        sub_queries: Vec::new(),
+        ..options.clone()
+    };
+    let lists = if options.mode == SearchMode::Semantic {
+        super::semantic_search_v3_batch(&single, &queries, progress_callback).await?
+    } else {
+        let mut lists = Vec::with_capacity(queries.len());
+        for query in &queries {
+            let options = SearchOptions {
+                query: query.clone(),
+                ..single.clone()
+            };
+            lists.push(super::search_mode(&options, None).await?);
+        }
+        lists
+    };
+
+    let mut matches = fuse(&lists, options.fusion.k);
+    if let Some(top_k) = options.top_k {
+        matches.truncate(top_k);
+    }
+    let closest_below_threshold = if matches.is_empty() {
+        lists
+            .iter()
+            .filter_map(|list| list.closest_below_threshold.clone())
+            .max_by(|a, b| a.score.total_cmp(&b.score))
+    } else {
+        None
+    };
+    let mut warnings: Vec<String> = Vec::new();
+    for warning in lists.iter().flat_map(|list| &list.warnings) {
+        if !warnings.contains(warning) {
+            warnings.push(warning.clone());
+        }
+    }
+    Ok(SearchResults {
+        matches,
+        closest_below_threshold,
+        plan: lists.into_iter().next().and_then(|list| list.plan),
+        explanations: None,
+        warnings,
+        facets: None,
+    })
+}
+
+/// One ranking of `lists`, each best first, by the sum of 1/(k + rank) over
+/// the lists a result is in. A result keeps the first list's copy.
+fn fuse(lists: &[SearchResults], k: f32) -> Vec<SearchResult> {
+    let mut fused: Vec<SearchResult> = Vec::new();
+    let mut positions: HashMap<(PathBuf, usize), usize> = HashMap::new();
+    for list in lists {
+        let mut seen = Vec::new();
+        for (rank, result) in list.matches.iter().enumerate() {
+            let key = score_explain::key(result);
+            // A list's own duplicates keep their best rank
+            if seen.contains(&key) {
+                continue;
+            }
+            let position = *positions.entry(key.clone()).or_insert_with(|| {
+                let mut result = result.clone();
+                result.score = 0.0;
+                fused.push(result);
+                fused.len() - 1
+            });
+            fused[position].score += 1.0 / (k + (rank + 1) as f32);
+            seen.push(key);
+        }
+    }
+    fused.sort_by(SearchResult::rank_cmp);
+    fused
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn list(files: &[&str]) -> SearchResults {
+        SearchResults {
+            matches: files
+                .iter()
+                .map(|file| SearchResult::for_lines(*file, 1, 1, 0.8))
+                .collect(),
+            closest_below_threshold: None,
+            plan: None,
+            explanations: None,
+            warnings: Vec::new(),
+            facets: None,
+        }
+    }
+
+    #[test]
+    fn compound_questions_split_at_conjunctions() {
+        assert_eq!(
+            split_query("where do we validate emails and send the welcome message?"),
+            ["where do we validate emails", "send the welcome message"]
+        );
+        assert_eq!(
+            split_query("parse the config file, then open the database and start the workers"),
+            [
+                "parse the config file",
+                "open the database",
+                "start the workers"
+            ]
+        );
+        // One-word parts stay with their neighbors
+        assert_eq!(
+            split_query("how do we validate emails and phones and send the welcome message"),
+            [
+                "how do we validate emails and phones",
+                "send the welcome message"
+            ]
+        );
+        assert!(split_query("validate emails and phones").is_empty());
+        assert!(split_query("where is the retry loop with exponential backoff").is_empty());
+    }
+
+    #[test]
+    fn chat_replies_become_sub_queries() {
+        assert_eq!(
+            parse_sub_queries(
+                "1. email validation\n2) \"send welcome email\"\n- email validation\n\n"
+            ),
+            ["email validation", "send welcome email"]
+        );
+        assert!(parse_sub_queries("retry loop with backoff").is_empty());
+    }
+
+    #[test]
+    fn results_of_every_part_make_the_fused_ranking() {
+        let lists = [
+            list(&["both.rs", "validate.rs"]),
+            list(&["validate.rs", "both.rs"]),
+            list(&["welcome.rs", "both.rs", "both.rs"]),
+        ];
+        let fused = fuse(&lists, 60.0);
+        let files: Vec<&str> = fused
+            .iter()
+            .map(|result| result.file.to_str().unwrap())
+            .collect();
+        assert_eq!(files, ["both.rs", "validate.rs", "welcome.rs"]);
+        let both = 1.0 / 61.0 + 1.0 / 62.0 + 1.0 / 62.0;
+        assert!((fused[0].score - both).abs() < 1e-6);
+    }
+}
@@ -0,0 +1,151 @@
+//! `--must-match REGEX`: keep only results whose code contains a match, so a
+//! search can be about something conceptually ("retry with backoff") and
+//! literally mention something else (`context.DeadlineExceeded`).
+//!
+//! Semantic search applies it to the candidate chunks before ranking, the
+//! way `--license` and `--meta` are applied, so the top k is filled from
+//! chunks that match. Each candidate file is read once and files without a
+//! match anywhere are dropped whole. Every mode's results are checked again
+//! afterwards, which also covers remote stores, commits and collections,
+//! whose text is their preview.
+
+use anyhow::{Context, Result};
+use cs_core::{SearchOptions, SearchResult};
+use rayon::prelude::*;
+use regex::{Regex, RegexBuilder};
+use std::collections::{HashMap, HashSet};
+use std::path::PathBuf;
+
+/// The `--must-match` regex, case-insensitive with `-i`.
+pub(crate) fn compile(options: &SearchOptions) -> Result<Option<Regex>> {
+    let Some(pattern) = options.must_match.as_deref() else {
+        return Ok(None);
+    };
+    let regex = RegexBuilder::new(pattern)
+        .case_insensitive(options.case_insensitive)
+        .multi_line(true)
+        .build()
+        .with_context(|| format!("Invalid --must-match regex '{}'", pattern))?;
+    Ok(Some(regex))
+}
+
+/// Drop the candidate chunks whose text has no match for `regex`.
+pub(crate) fn retain_matching_chunks(
+    regex: &Regex,
+    chunks: &mut Vec<(PathBuf, cs_index::ChunkEntry)>,
+) {
+    let files: HashSet<&PathBuf> = chunks.iter().map(|(file, _)| file).collect();
+    let contents: HashMap<PathBuf, String> = files
+        .into_par_iter()
+        .filter_map(|file| {
+            let content = cs_core::text::read_text(file).ok()?;
+            regex.is_match(&content).then(|| (file.clone(), content))
+        })
+        .collect();
+    chunks.retain(|(file, chunk)| {
+        contents
+            .get(file)
+            .and_then(|content| content.get(chunk.span.byte_start..chunk.span.byte_end))
+            .is_some_and(|text| regex.is_match(text))
+    });
+}
+
+/// Drop the results whose lines have no match for `regex`. Results that
+/// aren't files on disk are matched on their preview.
+pub(crate) fn retain_matching_results(regex: &Regex, results: &mut Vec<SearchResult>) {
+    let mut contents: HashMap<PathBuf, Option<String>> = HashMap::new();
+    results.retain(|result| {
+        let content = contents
+            .entry(result.file.clone())
+            .or_insert_with(|| cs_core::text::read_text(&result.file).ok());
+        match content {
+            Some(content) => regex.is_match(&result_lines(content, result)),
+            None => regex.is_match(&result.preview),
+        }
+    });
+}
+
+fn result_lines(content: &str, result: &SearchResult) -> String {
+    content
+        .lines()
+        .skip(result.span.line_start.saturating_sub(1))
+        .take(result.span.line_end.saturating_sub(result.span.line_start) + 1)
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::Span;
+    use std::fs;
+    use tempfile::TempDir;
+
+    const SOURCE: &str = "func retry(ctx context.Context) error {\n\tfor {\n\t\tif ctx.Err() == context.DeadlineExceeded {\n\t\t\treturn ctx.Err()\n\t\t}\n\t}\n}\n\nfunc backoff(n int) time.Duration {\n\treturn time.Duration(n) * time.Second\n}\n";
+
+    fn span(source: &str, line_start: usize, line_end: usize) -> Span {
+        let offsets: Vec<usize> = std::iter::once(0)
+            .chain(source.match_indices('\n').map(|(i, _)| i + 1))
+            .collect();
+        Span {
+            byte_start: offsets[line_start - 1],
+            byte_end: offsets[line_end],
+            line_start,
+            line_end,
+        }
+    }
+
+    fn result(file: PathBuf, span: Span, preview: &str) -> SearchResult {
+        SearchResult {
+            span,
+            preview: preview.to_string(),
+            ..SearchResult::for_lines(file, 0, 0, 0.5)
+        }
+    }
+
+    #[test]
+    fn results_must_contain_the_regex() {
+        let temp_dir = TempDir::new().unwrap();
+        let file = temp_dir.path().join("retry.go");
+        fs::write(&file, SOURCE).unwrap();
+
+        let options = SearchOptions {
+            must_match: Some(r"context\.DEADLINEexceeded".to_string()),
+            case_insensitive: true,
+            ..Default::default()
+        };
+        let regex = compile(&options).unwrap().unwrap();
+        let mut results = vec![
+            result(file.clone(), span(SOURCE, 1, 7), ""),
+            result(file.clone(), span(SOURCE, 9, 11), ""),
+            result(
+                PathBuf::from("git:3f2a9c1"),
+                span(SOURCE, 1, 1),
+                "Retry on context.DeadlineExceeded",
+            ),
+            result(
+                PathBuf::from("git:77b01e2"),
+                span(SOURCE, 1, 1),
+                "Add backoff",
+            ),
+        ];
+        retain_matching_results(&regex, &mut results);
+        let kept: Vec<(String, usize)> = results
+            .iter()
+            .map(|r| (r.file.display().to_string(), r.span.line_start))
+            .collect();
+        assert_eq!(
+            kept,
+            [
+                (file.display().to_string(), 1),
+                ("git:3f2a9c1".to_string(), 1)
+            ]
+        );
+
+        let invalid = SearchOptions {
+            must_match: Some("(unclosed".to_string()),
+            ..Default::default()
+        };
+        assert!(compile(&invalid).is_err());
+    }
+}
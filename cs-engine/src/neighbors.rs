@@ -0,0 +1,152 @@
+//! The chunks before and after each result in the same file, for
+//! `--neighbors`.
+//!
+//! Neighbors are read from the file's sidecar and carry metadata only (span,
+//! chunk type, breadcrumb), so a consumer can widen a result's context by
+//! reading exactly those lines instead of guessing. A result that isn't a
+//! chunk itself, such as a regex match, is placed in the chunk containing it.
+
+use cs_core::{SearchResult, Span};
+use serde::Serialize;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+#[derive(Debug, Clone, Serialize)]
+pub struct NeighborChunk {
+    pub span: Span,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub chunk_type: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub breadcrumb: Option<String>,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ChunkNeighbors {
+    pub previous: Option<NeighborChunk>,
+    pub next: Option<NeighborChunk>,
+}
+
+/// Looks up neighbors, loading each file's sidecar once.
+pub struct NeighborLookup {
+    index_root: PathBuf,
+    /// Chunks per file in file order; `None` when the file isn't indexed
+    chunks: HashMap<PathBuf, Option<Vec<NeighborChunk>>>,
+}
+
+impl NeighborLookup {
+    pub fn new(index_root: &Path) -> Self {
+        Self {
+            index_root: index_root.to_path_buf(),
+            chunks: HashMap::new(),
+        }
+    }
+
+    /// Neighbors of `result`, or `None` if its file isn't indexed.
+    pub fn neighbors(&mut self, result: &SearchResult) -> Option<ChunkNeighbors> {
+        let index_root = &self.index_root;
+        let chunks = self
+            .chunks
+            .entry(result.file.clone())
+            .or_insert_with(|| load_chunks(index_root, &result.file))
+            .as_ref()?;
+        Some(neighbors_of(chunks, &result.span))
+    }
+}
+
+fn load_chunks(index_root: &Path, file: &Path) -> Option<Vec<NeighborChunk>> {
+    let relative = file.strip_prefix(index_root).unwrap_or(file);
+    let sidecar = cs_index::shards::sidecar_path(index_root, relative);
+    let entry = cs_index::load_index_entry(&sidecar).ok()?;
+
+    let mut chunks: Vec<NeighborChunk> = entry
+        .chunks
+        .into_iter()
+        .map(|chunk| NeighborChunk {
+            span: chunk.span,
+            chunk_type: chunk.chunk_type,
+            breadcrumb: chunk.breadcrumb,
+        })
+        .collect();
+    // A whole-file module chunk isn't a neighbor of the definitions inside it
+    if chunks
+        .iter()
+        .any(|chunk| chunk.chunk_type.as_deref() != Some("module"))
+    {
+        chunks.retain(|chunk| chunk.chunk_type.as_deref() != Some("module"));
+    }
+    chunks.sort_by_key(|chunk| (chunk.span.byte_start, chunk.span.byte_end));
+    Some(chunks)
+}
+
+fn neighbors_of(chunks: &[NeighborChunk], span: &Span) -> ChunkNeighbors {
+    let position = chunks
+        .iter()
+        .position(|chunk| chunk.span.byte_start == span.byte_start)
+        .or_else(|| {
+            chunks.iter().rposition(|chunk| {
+                chunk.span.byte_start <= span.byte_start && span.byte_start < chunk.span.byte_end
+            })
+        });
+
+    match position {
+        Some(position) => ChunkNeighbors {
+            previous: position
+                .checked_sub(1)
+                .and_then(|previous| chunks.get(previous))
+                .cloned(),
+            next: chunks.get(position + 1).cloned(),
+        },
+        // Between chunks: the nearest ones on either side
+        None => {
+            let next = chunks.partition_point(|chunk| chunk.span.byte_start <= span.byte_start);
+            ChunkNeighbors {
+                previous: next
+                    .checked_sub(1)
+                    .and_then(|previous| chunks.get(previous))
+                    .cloned(),
+                next: chunks.get(next).cloned(),
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunk(byte_start: usize, byte_end: usize, line_start: usize) -> NeighborChunk {
+        NeighborChunk {
+            span: Span {
+                byte_start,
+                byte_end,
+                line_start,
+                line_end: line_start + 1,
+            },
+            chunk_type: Some("function".to_string()),
+            breadcrumb: None,
+        }
+    }
+
+    #[test]
+    fn neighbors_are_the_adjacent_chunks_in_file_order() {
+        let chunks = vec![chunk(0, 10, 1), chunk(20, 30, 3), chunk(40, 50, 5)];
+
+        let middle = neighbors_of(&chunks, &chunks[1].span);
+        assert_eq!(middle.previous.unwrap().span.line_start, 1);
+        assert_eq!(middle.next.unwrap().span.line_start, 5);
+
+        let first = neighbors_of(&chunks, &chunks[0].span);
+        assert!(first.previous.is_none());
+        assert_eq!(first.next.unwrap().span.line_start, 3);
+
+        // A regex match inside the last chunk
+        let inside = neighbors_of(&chunks, &chunk(45, 47, 5).span);
+        assert_eq!(inside.previous.unwrap().span.line_start, 3);
+        assert!(inside.next.is_none());
+
+        // A match between chunks
+        let between = neighbors_of(&chunks, &chunk(15, 16, 2).span);
+        assert_eq!(between.previous.unwrap().span.line_start, 1);
+        assert_eq!(between.next.unwrap().span.line_start, 3);
+    }
+}
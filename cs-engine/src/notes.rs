@@ -0,0 +1,394 @@
+//! Notes attached to code locations: `cs --note-add src/retry.rs:42 "text"`.
+//!
+//! Notes live in `.csnotes.json` at the index root, meant to be committed so a
+//! team shares them. Each note remembers the lines it was attached to as its
+//! anchor. When the code above it changes and the lines move, the note
+//! follows them to the nearest place they still appear; a note whose lines
+//! are gone is reported as orphaned rather than pointing at the wrong code.
+//!
+//! `cs --notes "query"` ranks notes by the similarity of their text to the
+//! query, embedded with the index's model. Note embeddings are cached in
+//! `.cs/note_embeddings.json`, so notes pulled from teammates are embedded on
+//! the next search.
+
+use anyhow::{Context, Result, bail};
+use cs_core::CcError;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+use super::semantic_v3::cosine_similarity;
+
+pub const NOTES_FILE: &str = ".csnotes.json";
+pub const NOTE_EMBEDDINGS_FILE: &str = "note_embeddings.json";
+
+/// Non-blank lines, from the noted one on, that anchor a note.
+const ANCHOR_LINES: usize = 3;
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct Note {
+    pub id: String,
+    /// Relative to the index root, with `/` separators
+    pub path: String,
+    /// 1-based line the note was last seen at
+    pub line: usize,
+    pub text: String,
+    /// Trimmed non-blank lines starting at `line`
+    pub anchor: Vec<String>,
+    pub created: u64,
+}
+
+/// Where a note's anchor is in the current tree.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum NoteLocation {
+    /// At the line it was noted at
+    InPlace(usize),
+    /// The anchored lines moved here
+    Moved(usize),
+    /// The file or the anchored lines are gone
+    Orphaned,
+}
+
+impl NoteLocation {
+    pub fn line(self) -> Option<usize> {
+        match self {
+            Self::InPlace(line) | Self::Moved(line) => Some(line),
+            Self::Orphaned => None,
+        }
+    }
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct NoteStore {
+    pub notes: Vec<Note>,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct NoteEmbeddings {
+    model: String,
+    /// Keyed by note id
+    vectors: HashMap<String, Vec<f32>>,
+}
+
+impl NoteStore {
+    fn path(index_root: &Path) -> PathBuf {
+        index_root.join(NOTES_FILE)
+    }
+
+    pub fn load(index_root: &Path) -> Result<Self> {
+        let path = Self::path(index_root);
+        if !path.exists() {
+            return Ok(Self::default());
+        }
+        let data = fs::read(&path)?;
+        serde_json::from_slice(&data).with_context(|| format!("Failed to parse {}", path.display()))
+    }
+
+    pub fn save(&self, index_root: &Path) -> Result<()> {
+        let mut data = serde_json::to_vec_pretty(self)?;
+        data.push(b'\n');
+        fs::write(Self::path(index_root), data)?;
+        Ok(())
+    }
+
+    /// Attach `text` to `line` of `file` (relative to the index root).
+    pub fn add(&mut self, index_root: &Path, file: &str, line: usize, text: &str) -> Result<Note> {
+        let text = text.trim();
+        if text.is_empty() {
+            bail!("A note needs some text");
+        }
+        let lines = read_lines(&index_root.join(file))?;
+        if line == 0 || line > lines.len() {
+            bail!("{} has no line {} ({} lines)", file, line, lines.len());
+        }
+        let created = SystemTime::now()
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        let digest = blake3::hash(format!("{}\0{}\0{}\0{}", file, line, text, created).as_bytes());
+        let note = Note {
+            id: digest.to_hex()[..8].to_string(),
+            path: file.to_string(),
+            line,
+            text: text.to_string(),
+            anchor: anchor_at(&lines, line),
+            created,
+        };
+        self.notes.push(note.clone());
+        Ok(note)
+    }
+
+    /// Remove the note whose id is or starts with `id`.
+    pub fn remove(&mut self, id: &str) -> Result<Note> {
+        let matching: Vec<usize> = (0..self.notes.len())
+            .filter(|&i| self.notes[i].id.starts_with(id))
+            .collect();
+        match matching.as_slice() {
+            [] => bail!("No note with id {}", id),
+            [index] => Ok(self.notes.remove(*index)),
+            _ => bail!(
+                "{} matches {} notes; give more of the id",
+                id,
+                matching.len()
+            ),
+        }
+    }
+
+    /// Locate every note in the current tree, updating the lines of notes
+    /// whose code moved and the paths of notes whose file was renamed.
+    /// Returns the locations in note order.
+    pub fn relocate(&mut self, index_root: &Path) -> Vec<NoteLocation> {
+        let mut files: HashMap<String, Option<Vec<String>>> = HashMap::new();
+        let mut renames = None;
+        self.notes
+            .iter_mut()
+            .map(|note| {
+                let renamed = if index_root.join(&note.path).is_file() {
+                    None
+                } else {
+                    renames
+                        .get_or_insert_with(|| cs_index::renames::RenameLog::load(index_root))
+                        .current_path(&note.path)
+                };
+                let path = renamed.as_ref().unwrap_or(&note.path);
+                let lines = files
+                    .entry(path.clone())
+                    .or_insert_with(|| read_lines(&index_root.join(path)).ok());
+                let location = match lines {
+                    Some(lines) => locate(note, lines),
+                    None => NoteLocation::Orphaned,
+                };
+                let location = match (location, renamed) {
+                    (NoteLocation::Orphaned, _) | (_, None) => location,
+                    (location, Some(renamed)) => {
+                        note.path = renamed;
+                        NoteLocation::Moved(location.line().unwrap_or(note.line))
+                    }
+                };
+                if let NoteLocation::Moved(line) = location {
+                    note.line = line;
+                }
+                location
+            })
+            .collect()
+    }
+}
+
+/// The nearest place `note`'s anchor appears in `lines`.
+fn locate(note: &Note, lines: &[String]) -> NoteLocation {
+    if note.anchor.is_empty() {
+        return if note.line <= lines.len() {
+            NoteLocation::InPlace(note.line)
+        } else {
+            NoteLocation::Orphaned
+        };
+    }
+    if anchored_at(lines, note.line, &note.anchor) {
+        return NoteLocation::InPlace(note.line);
+    }
+    (1..=lines.len())
+        .filter(|&line| anchored_at(lines, line, &note.anchor))
+        .min_by_key(|&line| line.abs_diff(note.line))
+        .map_or(NoteLocation::Orphaned, NoteLocation::Moved)
+}
+
+fn anchor_at(lines: &[String], line: usize) -> Vec<String> {
+    lines[line - 1..]
+        .iter()
+        .map(|text| text.trim())
+        .filter(|text| !text.is_empty())
+        .take(ANCHOR_LINES)
+        .map(str::to_string)
+        .collect()
+}
+
+/// Whether the anchor starts at `line`, which must itself match.
+fn anchored_at(lines: &[String], line: usize, anchor: &[String]) -> bool {
+    line >= 1
+        && line <= lines.len()
+        && lines[line - 1].trim() == anchor[0]
+        && anchor_at(lines, line) == anchor
+}
+
+fn read_lines(file: &Path) -> Result<Vec<String>> {
+    let content = cs_core::text::read_text(file)
+        .with_context(|| format!("Failed to read {}", file.display()))?;
+    Ok(content.lines().map(str::to_string).collect())
+}
+
+/// The index root covering `search_path`, which notes are stored under.
+pub fn notes_root(search_path: &Path) -> Result<PathBuf> {
+    super::find_nearest_index_root(search_path).ok_or_else(|| {
+        CcError::Index(format!(
+            "No index found for {}. Run 'cs --index' before using notes.",
+            search_path.display()
+        ))
+        .into()
+    })
+}
+
+/// Attach `text` to a `path:line` location, with `path` relative to the
+/// working directory, or to where an anchor from search results points now
+/// (see [`super::anchors`]). Returns the index root and the new note.
+pub fn add_note(location: &str, text: &str) -> Result<(PathBuf, Note)> {
+    if let Ok(anchor) = location.parse::<super::anchors::Anchor>() {
+        let index_root = notes_root(Path::new("."))?;
+        let resolved = super::anchors::resolve_anchor(&index_root, location)?;
+
+        let mut store = NoteStore::load(&index_root)?;
+        let note = store.add(&index_root, &anchor.path, resolved.line, text)?;
+        store.save(&index_root)?;
+        return Ok((index_root, note));
+    }
+    let (path, line) = location
+        .rsplit_once(':')
+        .and_then(|(path, line)| Some((path, line.parse::<usize>().ok()?)))
+        .ok_or_else(|| anyhow::anyhow!("Expected a location as path:line, got '{}'", location))?;
+    let file = cs_core::paths::canonicalize_lossy(Path::new(path));
+    if !file.is_file() {
+        bail!("{} is not a file", path);
+    }
+    let index_root = notes_root(&file)?;
+    let relative = file.strip_prefix(&index_root).unwrap_or(&file);
+    let relative = cs_core::paths::to_relative_slash(relative);
+
+    let mut store = NoteStore::load(&index_root)?;
+    let note = store.add(&index_root, &relative, line, text)?;
+    store.save(&index_root)?;
+    Ok((index_root, note))
+}
+
+/// Notes ranked by how close their text is to `query`, best first, with
+/// their current locations.
+pub fn search_notes(
+    index_root: &Path,
+    store: &mut NoteStore,
+    query: &str,
+    model: Option<&str>,
+) -> Result<Vec<(usize, f32)>> {
+    if store.notes.is_empty() {
+        return Ok(Vec::new());
+    }
+    let resolved_model = super::resolve_model_from_root(index_root, model)?;
+    let mut embedder = cs_embed::create_embedder(Some(resolved_model.canonical_name.as_str()))?;
+
+    let cache_path = cs_core::locations::index_dir(index_root).join(NOTE_EMBEDDINGS_FILE);
+    let mut cache: NoteEmbeddings = fs::read(&cache_path)
+        .ok()
+        .and_then(|data| cs_index::encryption::open_from(&cache_path, data).ok())
+        .and_then(|data| serde_json::from_slice(&data).ok())
+        .filter(|cache: &NoteEmbeddings| cache.model == resolved_model.canonical_name)
+        .unwrap_or_else(|| NoteEmbeddings {
+            model: resolved_model.canonical_name.clone(),
+            vectors: HashMap::new(),
+        });
+
+    let missing: Vec<&Note> = store
+        .notes
+        .iter()
+        .filter(|note| !cache.vectors.contains_key(&note.id))
+        .collect();
+    if !missing.is_empty() {
+        // Hosted embedders get notes redacted like any other text
+        let texts = missing
+            .iter()
+            .map(|note| cs_index::redaction::prepare_query(&*embedder, index_root, &note.text))
+            .collect::<Result<Vec<_>>>()?;
+        let vectors = embedder.embed(&texts)?;
+        for (note, vector) in missing.iter().zip(vectors) {
+            cache.vectors.insert(note.id.clone(), vector);
+        }
+        cache
+            .vectors
+            .retain(|id, _| store.notes.iter().any(|note| &note.id == id));
+        if let Some(parent) = cache_path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(
+            &cache_path,
+            cs_index::encryption::seal_for(&cache_path, serde_json::to_vec(&cache)?)?,
+        )?;
+    }
+
+    let query = cs_index::redaction::prepare_query(&*embedder, index_root, query)?;
+    let query_embedding = embedder
+        .embed(std::slice::from_ref(&query))?
+        .into_iter()
+        .next()
+        .context("The embedder returned no vector for the query")?;
+
+    let mut ranked: Vec<(usize, f32)> = store
+        .notes
+        .iter()
+        .enumerate()
+        .filter_map(|(i, note)| {
+            let vector = cache.vectors.get(&note.id)?;
+            Some((i, cosine_similarity(&query_embedding, vector)))
+        })
+        .collect();
+    ranked.sort_by(|a, b| b.1.partial_cmp(&a.1).unwrap_or(std::cmp::Ordering::Equal));
+    Ok(ranked)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn notes_follow_their_code_and_are_orphaned_when_it_goes() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        let source = "fn main() {}\n\nfn retry() {\n    backoff();\n}\n";
+        fs::write(root.join("lib.rs"), source).unwrap();
+
+        let mut store = NoteStore::default();
+        let note = store
+            .add(root, "lib.rs", 3, "this is the retry hotfix")
+            .unwrap();
+        assert_eq!(note.anchor, vec!["fn retry() {", "backoff();", "}"]);
+        assert_eq!(store.relocate(root), vec![NoteLocation::InPlace(3)]);
+
+        // Code added above the note moves it down
+        fs::write(root.join("lib.rs"), format!("use std::io;\n\n{}", source)).unwrap();
+        assert_eq!(store.relocate(root), vec![NoteLocation::Moved(5)]);
+        assert_eq!(store.notes[0].line, 5);
+
+        fs::write(root.join("lib.rs"), "fn main() {}\n").unwrap();
+        assert_eq!(store.relocate(root), vec![NoteLocation::Orphaned]);
+
+        store.save(root).unwrap();
+        let mut loaded = NoteStore::load(root).unwrap();
+        assert_eq!(loaded.notes, store.notes);
+        assert!(loaded.remove(&note.id[..4]).is_ok());
+        assert!(loaded.remove(&note.id).is_err());
+        assert!(store.add(root, "lib.rs", 9, "past the end").is_err());
+    }
+
+    #[test]
+    fn notes_follow_their_file_when_it_is_renamed() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::write(root.join("lib.rs"), "fn retry() {\n    backoff();\n}\n").unwrap();
+        let mut store = NoteStore::default();
+        store
+            .add(root, "lib.rs", 1, "this is the retry hotfix")
+            .unwrap();
+
+        fs::create_dir_all(root.join("src")).unwrap();
+        fs::rename(root.join("lib.rs"), root.join("src/retry.rs")).unwrap();
+        let index_dir = cs_core::locations::index_dir(root);
+        fs::create_dir_all(&index_dir).unwrap();
+        fs::write(
+            index_dir.join(cs_index::renames::RENAMES_LOG_FILE),
+            r#"{"renames":[{"from":"lib.rs","to":"src/retry.rs","renamed":0}]}"#,
+        )
+        .unwrap();
+
+        assert_eq!(store.relocate(root), vec![NoteLocation::Moved(1)]);
+        assert_eq!(store.notes[0].path, "src/retry.rs");
+        assert_eq!(store.relocate(root), vec![NoteLocation::InPlace(1)]);
+    }
+}
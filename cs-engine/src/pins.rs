@@ -0,0 +1,310 @@
+//! Canonical implementations: `cs --pin-add pkg/retry/retry.go:Backoff`.
+//!
+//! Maintainers pin the functions and types contributors should reuse rather
+//! than write again. Pins live in `.cspins.json` at the index root, meant to
+//! be committed like notes. A pin names a symbol, not lines, so it keeps
+//! naming the same code as the file is edited; it's resolved against the
+//! symbols recorded at index time, and follows renamed files.
+//!
+//! Search results overlapping a pinned symbol rank higher and are marked as
+//! pinned. Only results the search returned are boosted, so a pin steers
+//! the queries its code is related to and leaves the others alone.
+
+use anyhow::{Context, Result, bail};
+use cs_core::{CcError, SearchResult};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+pub const PINS_FILE: &str = ".cspins.json";
+
+/// Score multiplier of results overlapping a pinned symbol.
+const PIN_BOOST: f32 = 1.25;
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct Pin {
+    /// Relative to the index root, with `/` separators
+    pub path: String,
+    pub symbol: String,
+    pub added: u64,
+}
+
+impl Pin {
+    /// `path:Symbol`, as pins are added and removed by.
+    pub fn location(&self) -> String {
+        format!("{}:{}", self.path, self.symbol)
+    }
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct PinStore {
+    pub pins: Vec<Pin>,
+}
+
+impl PinStore {
+    fn path(index_root: &Path) -> PathBuf {
+        index_root.join(PINS_FILE)
+    }
+
+    pub fn load(index_root: &Path) -> Result<Self> {
+        let path = Self::path(index_root);
+        if !path.exists() {
+            return Ok(Self::default());
+        }
+        let data = fs::read(&path)?;
+        let mut store: Self = serde_json::from_slice(&data)
+            .with_context(|| format!("Failed to parse {}", path.display()))?;
+        store.follow_renames(index_root);
+        Ok(store)
+    }
+
+    /// Point pins in files renamed since at their new paths.
+    fn follow_renames(&mut self, index_root: &Path) {
+        let mut renames = None;
+        for pin in &mut self.pins {
+            if index_root.join(&pin.path).exists() {
+                continue;
+            }
+            if let Some(renamed) = renames
+                .get_or_insert_with(|| cs_index::renames::RenameLog::load(index_root))
+                .current_path(&pin.path)
+            {
+                pin.path = renamed;
+            }
+        }
+    }
+
+    pub fn save(&self, index_root: &Path) -> Result<()> {
+        let mut data = serde_json::to_vec_pretty(self)?;
+        data.push(b'\n');
+        fs::write(Self::path(index_root), data)?;
+        Ok(())
+    }
+
+    /// Pin `symbol` of `file` (relative to the index root), which the index
+    /// must have recorded.
+    pub fn add(&mut self, index_root: &Path, file: &str, symbol: &str) -> Result<Pin> {
+        if self
+            .pins
+            .iter()
+            .any(|pin| pin.path == file && pin.symbol == symbol)
+        {
+            bail!("{}:{} is already pinned", file, symbol);
+        }
+        if symbol_lines(index_root, file, symbol).is_empty() {
+            bail!(
+                "The index has no symbol {} in {}; check the name, or index the file first",
+                symbol,
+                file
+            );
+        }
+        let added = SystemTime::now()
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        let pin = Pin {
+            path: file.to_string(),
+            symbol: symbol.to_string(),
+            added,
+        };
+        self.pins.push(pin.clone());
+        Ok(pin)
+    }
+
+    /// Remove the pin of `symbol` in `file`.
+    pub fn remove(&mut self, file: &str, symbol: &str) -> Result<Pin> {
+        match self
+            .pins
+            .iter()
+            .position(|pin| pin.path == file && pin.symbol == symbol)
+        {
+            Some(index) => Ok(self.pins.remove(index)),
+            None => bail!("{}:{} isn't pinned", file, symbol),
+        }
+    }
+}
+
+/// The line ranges of the chunks of `file` the index recorded as `symbol`;
+/// a long function is several.
+pub fn symbol_lines(index_root: &Path, file: &str, symbol: &str) -> Vec<(usize, usize)> {
+    let sidecar = cs_index::shards::sidecar_path(index_root, Path::new(file));
+    let Ok(entry) = cs_index::load_index_entry(&sidecar) else {
+        return Vec::new();
+    };
+    entry
+        .chunks
+        .iter()
+        .filter(|chunk| chunk.symbol.as_deref() == Some(symbol))
+        .map(|chunk| (chunk.span.line_start, chunk.span.line_end))
+        .collect()
+}
+
+/// Which results are pinned code, resolving each pinned file's symbols
+/// once.
+pub struct PinLookup {
+    index_root: PathBuf,
+    /// Pinned symbols and their line ranges, by file
+    files: HashMap<String, Vec<(String, Vec<(usize, usize)>)>>,
+}
+
+impl PinLookup {
+    /// The pins of the index at `index_root`; unreadable pins are none.
+    pub fn new(index_root: &Path) -> Self {
+        let store = PinStore::load(index_root).unwrap_or_else(|e| {
+            tracing::warn!("Ignoring unreadable pins file: {}", e);
+            PinStore::default()
+        });
+        let mut files: HashMap<String, Vec<(String, Vec<(usize, usize)>)>> = HashMap::new();
+        for pin in store.pins {
+            let lines = symbol_lines(index_root, &pin.path, &pin.symbol);
+            files.entry(pin.path).or_default().push((pin.symbol, lines));
+        }
+        Self {
+            index_root: index_root.to_path_buf(),
+            files,
+        }
+    }
+
+    /// The pinned symbol `result` overlaps, if any.
+    pub fn pinned(&self, result: &SearchResult) -> Option<&str> {
+        if self.files.is_empty() {
+            return None;
+        }
+        let relative = result
+            .file
+            .strip_prefix(&self.index_root)
+            .unwrap_or(&result.file);
+        let symbols = self
+            .files
+            .get(&cs_core::paths::to_relative_slash(relative))?;
+        symbols.iter().find_map(|(symbol, lines)| {
+            lines
+                .iter()
+                .any(|&(start, end)| result.span.line_start <= end && start <= result.span.line_end)
+                .then_some(symbol.as_str())
+        })
+    }
+
+    /// Boost pinned results, then re-sort. Returns the number boosted.
+    pub fn apply(&self, results: &mut [SearchResult]) -> usize {
+        let mut boosted = 0;
+        for result in results.iter_mut() {
+            if self.pinned(result).is_some() {
+                result.score *= PIN_BOOST;
+                boosted += 1;
+            }
+        }
+        if boosted > 0 {
+            results.sort_by(SearchResult::rank_cmp);
+        }
+        boosted
+    }
+}
+
+/// The index root covering `search_path`, which pins are stored under.
+pub fn pins_root(search_path: &Path) -> Result<PathBuf> {
+    super::find_nearest_index_root(search_path).ok_or_else(|| {
+        CcError::Index(format!(
+            "No index found for {}. Run 'cs --index' before pinning code.",
+            search_path.display()
+        ))
+        .into()
+    })
+}
+
+/// The index root, and the path relative to it and the symbol of a
+/// `path:Symbol` location, with `path` relative to the working directory.
+fn parse_location(location: &str) -> Result<(PathBuf, String, String)> {
+    let (path, symbol) = location
+        .rsplit_once(':')
+        .filter(|(path, symbol)| !path.is_empty() && !symbol.is_empty())
+        .ok_or_else(|| anyhow::anyhow!("Expected a location as path:Symbol, got '{}'", location))?;
+    let file = cs_core::paths::canonicalize_lossy(Path::new(path));
+    let index_root = pins_root(&file)?;
+    let relative = file.strip_prefix(&index_root).unwrap_or(&file);
+    Ok((
+        index_root.clone(),
+        cs_core::paths::to_relative_slash(relative),
+        symbol.to_string(),
+    ))
+}
+
+/// Pin the symbol of a `path:Symbol` location. Returns the index root and
+/// the new pin.
+pub fn add_pin(location: &str) -> Result<(PathBuf, Pin)> {
+    let (index_root, file, symbol) = parse_location(location)?;
+    if !index_root.join(&file).is_file() {
+        bail!("{} is not a file", file);
+    }
+    let mut store = PinStore::load(&index_root)?;
+    let pin = store.add(&index_root, &file, &symbol)?;
+    store.save(&index_root)?;
+    Ok((index_root, pin))
+}
+
+/// Unpin the symbol of a `path:Symbol` location.
+pub fn remove_pin(location: &str) -> Result<(PathBuf, Pin)> {
+    let (index_root, file, symbol) = parse_location(location)?;
+    let mut store = PinStore::load(&index_root)?;
+    let pin = store.remove(&file, &symbol)?;
+    store.save(&index_root)?;
+    Ok((index_root, pin))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn results_overlapping_pinned_symbols_rank_higher() {
+        let mut files = HashMap::new();
+        files.insert(
+            "pkg/retry/retry.go".to_string(),
+            vec![("Backoff".to_string(), vec![(10, 30), (31, 40)])],
+        );
+        let lookup = PinLookup {
+            index_root: PathBuf::from("/repo"),
+            files,
+        };
+
+        let mut results = vec![
+            SearchResult::for_lines("/repo/pkg/http/client.go", 5, 20, 0.80),
+            SearchResult::for_lines("/repo/pkg/retry/retry.go", 35, 45, 0.70),
+            SearchResult::for_lines("/repo/pkg/retry/retry.go", 1, 8, 0.60),
+        ];
+        assert_eq!(lookup.pinned(&results[1]), Some("Backoff"));
+        // Other code in a file with a pin isn't pinned
+        assert_eq!(lookup.pinned(&results[2]), None);
+
+        assert_eq!(lookup.apply(&mut results), 1);
+        assert_eq!(results[0].file, PathBuf::from("/repo/pkg/retry/retry.go"));
+        assert!((results[0].score - 0.875).abs() < 1e-6);
+    }
+
+    #[test]
+    fn pins_are_unique_and_removable() {
+        let mut store = PinStore::default();
+        store.pins.push(Pin {
+            path: "retry.go".to_string(),
+            symbol: "Backoff".to_string(),
+            added: 0,
+        });
+        assert!(
+            store
+                .add(Path::new("/nonexistent"), "retry.go", "Backoff")
+                .is_err()
+        );
+        // Names the index never recorded can't be pinned
+        assert!(
+            store
+                .add(Path::new("/nonexistent"), "retry.go", "Jitter")
+                .is_err()
+        );
+        assert_eq!(store.pins[0].location(), "retry.go:Backoff");
+        assert!(store.remove("retry.go", "Jitter").is_err());
+        store.remove("retry.go", "Backoff").unwrap();
+        assert!(store.pins.is_empty());
+    }
+}
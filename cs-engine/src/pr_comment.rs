@@ -0,0 +1,321 @@
+//! `cs --pr-comment REV`: what a reviewer should know about the changes
+//! since `REV`, as Markdown for CI to post on the pull request. It lists the
+//! near-duplicate code the changes introduce (as `--hook pre-commit` finds
+//! it), the existing modules most related to them (from `--related`), and
+//! the CODEOWNERS owners of similar code, who may want a say.
+//!
+//! The comment starts with [`COMMENT_MARKER`], so a bot can find the comment
+//! it posted before and edit it instead of adding another.
+
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::path::{Path, PathBuf};
+
+use crate::dupes::StagedDuplicate;
+use crate::facets::FacetResolver;
+use crate::related::{HunkContext, Relation};
+
+/// First line of every comment, invisible once rendered.
+pub const COMMENT_MARKER: &str = "<!-- cs-pr-comment -->";
+
+/// Related chunks looked at per hunk.
+const RELATED_PER_HUNK: usize = 10;
+
+/// Modules and owners listed at most.
+const MAX_LISTED: usize = 5;
+
+#[derive(Debug, Clone, Serialize)]
+pub struct RelatedModule {
+    /// Relative to the repository root
+    pub dir: PathBuf,
+    /// Changed hunks with related code here
+    pub hunks: usize,
+    pub best_similarity: f32,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SimilarCodeOwner {
+    pub owner: String,
+    /// Chunks of similar code they own
+    pub chunks: usize,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct PrSummary {
+    pub rev: String,
+    pub hunks: usize,
+    pub files: usize,
+    pub dupe_threshold: f32,
+    pub duplicates: Vec<StagedDuplicate>,
+    pub modules: Vec<RelatedModule>,
+    pub owners: Vec<SimilarCodeOwner>,
+}
+
+/// Sum up the working tree's changes since `rev` in the repo at
+/// `repo_root`, flagging new code at least `dupe_threshold` similar to
+/// existing code.
+pub fn summarize(repo_root: &Path, rev: &str, dupe_threshold: f32) -> Result<PrSummary> {
+    let contexts = crate::related::related_to_diff(repo_root, rev, RELATED_PER_HUNK)?;
+    let mut duplicates = crate::dupes::diff_duplicates(repo_root, rev, dupe_threshold)?;
+    for duplicate in &mut duplicates {
+        if let Ok(relative) = duplicate.existing.file.strip_prefix(repo_root) {
+            duplicate.existing.file = relative.to_path_buf();
+        }
+    }
+    let files: BTreeSet<&Path> = contexts
+        .iter()
+        .map(|context| context.hunk.file.as_path())
+        .collect();
+    Ok(PrSummary {
+        rev: rev.to_string(),
+        hunks: contexts.len(),
+        files: files.len(),
+        dupe_threshold,
+        modules: related_modules(&contexts),
+        owners: similar_code_owners(&FacetResolver::new(repo_root), &contexts, &duplicates),
+        duplicates,
+    })
+}
+
+/// Directories of related code, by the number of hunks they relate to.
+fn related_modules(contexts: &[HunkContext]) -> Vec<RelatedModule> {
+    let mut modules: BTreeMap<PathBuf, RelatedModule> = BTreeMap::new();
+    for context in contexts {
+        let mut seen = BTreeSet::new();
+        for related in &context.related {
+            let dir = related
+                .location
+                .file
+                .parent()
+                .filter(|dir| !dir.as_os_str().is_empty())
+                .unwrap_or(Path::new("."))
+                .to_path_buf();
+            let module = modules.entry(dir.clone()).or_insert(RelatedModule {
+                dir: dir.clone(),
+                hunks: 0,
+                best_similarity: 0.0,
+            });
+            module.best_similarity = module.best_similarity.max(related.similarity);
+            if seen.insert(dir) {
+                module.hunks += 1;
+            }
+        }
+    }
+    let mut modules: Vec<RelatedModule> = modules.into_values().collect();
+    modules.sort_by(|a, b| {
+        b.hunks
+            .cmp(&a.hunks)
+            .then_with(|| b.best_similarity.total_cmp(&a.best_similarity))
+    });
+    modules.truncate(MAX_LISTED);
+    modules
+}
+
+/// Owners of the code the changes resemble, by the chunks of it they own.
+fn similar_code_owners(
+    resolver: &FacetResolver,
+    contexts: &[HunkContext],
+    duplicates: &[StagedDuplicate],
+) -> Vec<SimilarCodeOwner> {
+    // Each chunk counts once, however many hunks it resembles
+    let similar: BTreeSet<(&Path, usize)> = contexts
+        .iter()
+        .flat_map(|context| &context.related)
+        .filter(|related| related.relation == Relation::Similar)
+        .map(|related| (related.location.file.as_path(), related.location.line_start))
+        .chain(duplicates.iter().map(|duplicate| {
+            (
+                duplicate.existing.file.as_path(),
+                duplicate.existing.line_start,
+            )
+        }))
+        .collect();
+    let mut owners: HashMap<String, usize> = HashMap::new();
+    for (file, _) in similar {
+        for owner in resolver.owners(file) {
+            *owners.entry(owner).or_default() += 1;
+        }
+    }
+    let mut owners: Vec<SimilarCodeOwner> = owners
+        .into_iter()
+        .map(|(owner, chunks)| SimilarCodeOwner { owner, chunks })
+        .collect();
+    owners.sort_by(|a, b| b.chunks.cmp(&a.chunks).then_with(|| a.owner.cmp(&b.owner)));
+    owners.truncate(MAX_LISTED);
+    owners
+}
+
+/// `path`, and `lines` if given, as code in a Markdown table cell.
+fn cell(path: &Path, lines: Option<(usize, usize)>) -> String {
+    let path = cs_core::paths::to_slash(path).replace('|', "\\|");
+    match lines {
+        Some((start, end)) => format!("`{}:{}-{}`", path, start, end),
+        None => format!("`{}`", path),
+    }
+}
+
+fn plural(count: usize, one: &str, many: &str) -> String {
+    format!("{} {}", count, if count == 1 { one } else { many })
+}
+
+/// The comment for `summary`.
+pub fn to_markdown(summary: &PrSummary) -> String {
+    let mut out = format!("{}\n### Semantic review context\n\n", COMMENT_MARKER);
+    if summary.hunks == 0 {
+        out.push_str(&format!(
+            "No changed code since `{}` that cs can compare with the index.\n",
+            summary.rev
+        ));
+        return out;
+    }
+    out.push_str(&format!(
+        "Changes since `{}`: {} in {}.\n\n",
+        summary.rev,
+        plural(summary.hunks, "hunk", "hunks"),
+        plural(summary.files, "file", "files")
+    ));
+
+    out.push_str("#### Near-duplicate code introduced\n\n");
+    if summary.duplicates.is_empty() {
+        out.push_str(&format!(
+            "None at {:.2} similarity or above.\n\n",
+            summary.dupe_threshold
+        ));
+    } else {
+        out.push_str("| New code | Resembles | Similarity |\n|---|---|---|\n");
+        for duplicate in &summary.duplicates {
+            out.push_str(&format!(
+                "| {} | {} | {:.3} |\n",
+                cell(
+                    &duplicate.staged.file,
+                    Some((duplicate.staged.line_start, duplicate.staged.line_end))
+                ),
+                cell(
+                    &duplicate.existing.file,
+                    Some((duplicate.existing.line_start, duplicate.existing.line_end))
+                ),
+                duplicate.similarity
+            ));
+        }
+        out.push('\n');
+    }
+
+    if !summary.modules.is_empty() {
+        out.push_str("#### Most related existing modules\n\n");
+        out.push_str("| Module | Related hunks | Best similarity |\n|---|---|---|\n");
+        for module in &summary.modules {
+            out.push_str(&format!(
+                "| {} | {} | {:.3} |\n",
+                cell(&module.dir, None),
+                module.hunks,
+                module.best_similarity
+            ));
+        }
+        out.push('\n');
+    }
+
+    if !summary.owners.is_empty() {
+        out.push_str("#### Owners of similar code\n\n");
+        for owner in &summary.owners {
+            out.push_str(&format!(
+                "- {} ({})\n",
+                owner.owner,
+                plural(owner.chunks, "chunk", "chunks")
+            ));
+        }
+        out.push('\n');
+    }
+    out.push_str("<sub>Generated by `cs --pr-comment`.</sub>\n");
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::compare::ChunkLocation;
+    use crate::related::RelatedChunk;
+
+    fn location(file: &str, line: usize) -> ChunkLocation {
+        ChunkLocation {
+            file: PathBuf::from(file),
+            line_start: line,
+            line_end: line + 9,
+        }
+    }
+
+    fn context(hunk: &str, related: &[(&str, f32)]) -> HunkContext {
+        HunkContext {
+            hunk: location(hunk, 1),
+            symbols: Vec::new(),
+            related: related
+                .iter()
+                .map(|(file, similarity)| RelatedChunk {
+                    location: location(file, 20),
+                    symbol: None,
+                    similarity: *similarity,
+                    relation: Relation::Similar,
+                })
+                .collect(),
+        }
+    }
+
+    #[test]
+    fn modules_rank_by_the_hunks_they_relate_to() {
+        let contexts = [
+            context(
+                "src/api/refresh.rs",
+                &[("src/auth/session.rs", 0.8), ("src/auth/login.rs", 0.7)],
+            ),
+            context(
+                "src/api/keys.rs",
+                &[("src/auth/login.rs", 0.6), ("main.rs", 0.9)],
+            ),
+        ];
+        let modules = related_modules(&contexts);
+        assert_eq!(modules[0].dir, PathBuf::from("src/auth"));
+        assert_eq!(modules[0].hunks, 2);
+        assert!((modules[0].best_similarity - 0.8).abs() < 1e-6);
+        assert_eq!(modules[1].dir, PathBuf::from("."));
+    }
+
+    #[test]
+    fn comments_list_duplicates_modules_and_owners() {
+        let summary = PrSummary {
+            rev: "main".to_string(),
+            hunks: 3,
+            files: 1,
+            dupe_threshold: 0.95,
+            duplicates: vec![StagedDuplicate {
+                staged: location("src/api/refresh.rs", 12),
+                existing: location("src/auth/session.rs", 88),
+                similarity: 0.971,
+                chunk_type: Some("function".to_string()),
+            }],
+            modules: vec![RelatedModule {
+                dir: PathBuf::from("src/auth"),
+                hunks: 2,
+                best_similarity: 0.812,
+            }],
+            owners: vec![SimilarCodeOwner {
+                owner: "@platform".to_string(),
+                chunks: 1,
+            }],
+        };
+        let markdown = to_markdown(&summary);
+        assert!(markdown.starts_with(COMMENT_MARKER));
+        assert!(markdown.contains("Changes since `main`: 3 hunks in 1 file."));
+        assert!(
+            markdown
+                .contains("| `src/api/refresh.rs:12-21` | `src/auth/session.rs:88-97` | 0.971 |")
+        );
+        assert!(markdown.contains("| `src/auth` | 2 | 0.812 |"));
+        assert!(markdown.contains("- @platform (1 chunk)"));
+
+        let quiet = PrSummary {
+            duplicates: Vec::new(),
+            ..summary
+        };
+        assert!(to_markdown(&quiet).contains("None at 0.95 similarity or above."));
+    }
+}
@@ -0,0 +1,292 @@
+//! Semantic search results cached per index generation.
+//!
+//! Agents often repeat a query between edits. Ranked results are kept in
+//! `.cs/query_cache.json`, keyed by a hash of the query embedding and the
+//! options that shape the list, and the whole cache belongs to one
+//! [`index generation`](cs_index::index_generation): the first search after
+//! the index changes discards it. Boosts and feedback run on top of the
+//! cached list, so they always reflect the current rules; facet filters
+//! narrow the chunks ranked, so they are part of the key. The search path is
+//! keyed relative to the index root and result files are kept relative to
+//! it, so `src`, `./src` and its absolute path share one entry.
+
+use anyhow::Result;
+use cs_core::{SearchOptions, SearchResult, SearchResults};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+pub const QUERY_CACHE_FILE: &str = "query_cache.json";
+
+/// Queries remembered per generation; the oldest are dropped first.
+const MAX_ENTRIES: usize = 256;
+
+/// Result lists longer than this (searches without `--topk`) aren't cached.
+const MAX_CACHED_RESULTS: usize = 200;
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct QueryCache {
+    generation: String,
+    /// Oldest first
+    entries: Vec<CacheEntry>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct CacheEntry {
+    key: String,
+    /// Files relative to the index root
+    matches: Vec<SearchResult>,
+    closest_below_threshold: Option<SearchResult>,
+}
+
+fn cache_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(QUERY_CACHE_FILE)
+}
+
+fn load(index_root: &Path) -> QueryCache {
+    fs::read(cache_path(index_root))
+        .ok()
+        .and_then(|data| serde_json::from_slice(&data).ok())
+        .unwrap_or_default()
+}
+
+/// Commit and collection results don't name files under the index root.
+fn is_file_result(result: &SearchResult) -> bool {
+    let file = result.file.to_string_lossy();
+    !file.starts_with(crate::commit_search::COMMIT_RESULT_PREFIX)
+        && !file.starts_with(crate::collection_search::COLLECTION_RESULT_PREFIX)
+}
+
+/// `result` with its file relative to `index_root`, as it's cached.
+fn relative_to(index_root: &Path, result: &SearchResult) -> SearchResult {
+    let mut result = result.clone();
+    if is_file_result(&result)
+        && let Ok(relative) = result.file.strip_prefix(index_root)
+    {
+        result.file = relative.to_path_buf();
+    }
+    result
+}
+
+/// A cached `result` with its file under `index_root` again.
+fn rooted_at(index_root: &Path, mut result: SearchResult) -> SearchResult {
+    if is_file_result(&result) {
+        result.file = index_root.join(&result.file);
+    }
+    result
+}
+
+/// Where `options.path` is in the index at `index_root`, however it was typed.
+fn scope_key(options: &SearchOptions, index_root: &Path) -> String {
+    let path = cs_core::paths::canonicalize_lossy(&options.path);
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let scope = path.strip_prefix(&root).unwrap_or(&path);
+    cs_core::paths::comparison_key(scope)
+}
+
+/// Key for the results of searching the index at `index_root` with
+/// `query_embedding` from `model`.
+pub fn cache_key(
+    model: &str,
+    query_embedding: &[f32],
+    options: &SearchOptions,
+    index_root: &Path,
+) -> String {
+    let mut hasher = blake3::Hasher::new();
+    hasher.update(model.as_bytes());
+    for value in query_embedding {
+        hasher.update(&value.to_le_bytes());
+    }
+    // Everything else that changes which chunks are ranked or how they're shown
+    let shape = format!(
+        "\0{}\0{:?}\0{:?}\0{}\0{:?}\0{}\0{:?}\0{:?}\0{}\0{:?}\0{:?}\0{:?}\0{:?}\0{:?}\0{:?}\0{}\0{:?}",
+        scope_key(options, index_root),
+        options.top_k,
+        options.threshold.map(f32::to_bits),
+        options.full_section,
+        options.truncate_dims,
+        options.rerank,
+        options.rerank_model,
+        options.include_patterns,
+        options.include_generated,
+        options.collections,
+        options.facet_filters,
+        options.license_filters,
+        options.metadata_filters,
+        options.tag_filters,
+        options.must_match,
+        options.case_insensitive,
+        crate::query_language::restricted_to(options),
+    );
+    hasher.update(shape.as_bytes());
+    if options.rerank {
+        // The reranker scores against the query text, not the embedding
+        hasher.update(options.query.as_bytes());
+    }
+    hasher.finalize().to_hex().to_string()
+}
+
+/// Results cached under `key` for `generation` of the index at `index_root`.
+pub fn lookup(index_root: &Path, generation: &str, key: &str) -> Option<SearchResults> {
+    let cache = load(index_root);
+    if cache.generation != generation {
+        return None;
+    }
+    let entry = cache.entries.into_iter().find(|entry| entry.key == key)?;
+    Some(SearchResults {
+        matches: entry
+            .matches
+            .into_iter()
+            .map(|result| rooted_at(index_root, result))
+            .collect(),
+        closest_below_threshold: entry
+            .closest_below_threshold
+            .map(|result| rooted_at(index_root, result)),
+        plan: None,
+        explanations: None,
+        warnings: Vec::new(),
+        facets: None,
+    })
+}
+
+/// Remember `results` under `key`, discarding entries from older generations.
+pub fn store(
+    index_root: &Path,
+    generation: &str,
+    key: &str,
+    results: &SearchResults,
+) -> Result<()> {
+    if results.matches.len() > MAX_CACHED_RESULTS {
+        return Ok(());
+    }
+    let mut cache = load(index_root);
+    if cache.generation != generation {
+        cache = QueryCache {
+            generation: generation.to_string(),
+            entries: Vec::new(),
+        };
+    }
+    cache.entries.retain(|entry| entry.key != key);
+    cache.entries.push(CacheEntry {
+        key: key.to_string(),
+        matches: results
+            .matches
+            .iter()
+            .map(|result| relative_to(index_root, result))
+            .collect(),
+        closest_below_threshold: results
+            .closest_below_threshold
+            .as_ref()
+            .map(|result| relative_to(index_root, result)),
+    });
+    if cache.entries.len() > MAX_ENTRIES {
+        let excess = cache.entries.len() - MAX_ENTRIES;
+        cache.entries.drain(..excess);
+    }
+
+    // Write to a temporary file first so concurrent searches never read a torn cache
+    let path = cache_path(index_root);
+    let temp = path.with_extension(format!("json.{}.tmp", std::process::id()));
+    fs::write(&temp, serde_json::to_vec(&cache)?)?;
+    fs::rename(&temp, &path)?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn results(file: &str) -> SearchResults {
+        SearchResults {
+            matches: vec![SearchResult {
+                file: PathBuf::from(file),
+                span: cs_core::Span {
+                    byte_start: 0,
+                    byte_end: 10,
+                    line_start: 1,
+                    line_end: 2,
+                },
+                score: 0.9,
+                preview: "fn retry() {}".to_string(),
+                lang: None,
+                symbol: None,
+                chunk_hash: None,
+                index_epoch: None,
+            }],
+            closest_below_threshold: None,
+            plan: None,
+            explanations: None,
+            warnings: Vec::new(),
+            facets: None,
+        }
+    }
+
+    #[test]
+    fn results_are_invalidated_by_a_new_generation() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join(".cs")).unwrap();
+
+        let options = SearchOptions {
+            top_k: Some(10),
+            ..Default::default()
+        };
+        let key = cache_key("model", &[0.1, 0.2], &options, root);
+        assert!(lookup(root, "gen-1", &key).is_none());
+
+        let file = |name: &str| root.join(name).to_string_lossy().to_string();
+        store(root, "gen-1", &key, &results(&file("src/a.rs"))).unwrap();
+        let cached = lookup(root, "gen-1", &key).unwrap();
+        assert_eq!(cached.matches[0].file, root.join("src/a.rs"));
+
+        // Another embedding or a different result limit is another entry
+        let other = cache_key("model", &[0.1, 0.3], &options, root);
+        assert!(lookup(root, "gen-1", &other).is_none());
+        let wider = SearchOptions {
+            top_k: Some(20),
+            ..Default::default()
+        };
+        let wider = cache_key("model", &[0.1, 0.2], &wider, root);
+        assert!(lookup(root, "gen-1", &wider).is_none());
+
+        assert!(lookup(root, "gen-2", &key).is_none());
+        store(root, "gen-2", &key, &results(&file("src/b.rs"))).unwrap();
+        assert!(lookup(root, "gen-1", &key).is_none());
+        assert_eq!(
+            lookup(root, "gen-2", &key).unwrap().matches[0].file,
+            root.join("src/b.rs")
+        );
+    }
+
+    #[test]
+    fn paths_typed_differently_share_an_entry() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join(".cs")).unwrap();
+        fs::create_dir_all(root.join("src")).unwrap();
+
+        let scoped = |path: PathBuf| SearchOptions {
+            path,
+            top_k: Some(10),
+            ..Default::default()
+        };
+        let key = cache_key("model", &[0.1], &scoped(root.join("src")), root);
+        assert_eq!(
+            key,
+            cache_key("model", &[0.1], &scoped(root.join("./src/")), root)
+        );
+        assert_ne!(
+            key,
+            cache_key("model", &[0.1], &scoped(root.to_path_buf()), root)
+        );
+
+        // Files are cached relative to the root and come back under it
+        let file = root.join("src/a.rs").to_string_lossy().to_string();
+        store(root, "gen-1", &key, &results(&file)).unwrap();
+        let cached = fs::read_to_string(cache_path(root)).unwrap();
+        assert!(!cached.contains(&*root.to_string_lossy()));
+        let found = lookup(root, "gen-1", &key).unwrap();
+        assert_eq!(found.matches[0].file, root.join("src/a.rs"));
+    }
+}
@@ -0,0 +1,300 @@
+//! The language a query is written in, when its syntax gives it away:
+//! `func (s *Server)` is Go, `def __init__` Python, `&mut self` Rust. Unless
+//! `--infer-lang off`, a search ranks chunks in that language higher, or
+//! with `--infer-lang restrict` searches only them. A `-t` type filter
+//! already says which files to search, so it turns inference off.
+//!
+//! Each language has telltale patterns with a weight, the strongest ones
+//! being syntax no other language shares. A query is taken to be in the
+//! language whose patterns weigh most, with at least [`MIN_EVIDENCE`] and
+//! twice what any other language's do; prose, and syntax common to several
+//! languages, infer nothing. JavaScript and TypeScript count as one
+//! language, as do C and C++.
+
+use cs_core::{Language, LanguageInference, SearchMode, SearchOptions, SearchResult};
+use regex::Regex;
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::LazyLock;
+
+/// Score factor of results in the query's language.
+const LANGUAGE_FACTOR: f32 = 1.2;
+
+/// Weight of telltale patterns a query needs to be taken for a language.
+const MIN_EVIDENCE: u32 = 3;
+
+/// Telltale patterns of each language, with their weights.
+const SIGNALS: &[(Language, &str, u32)] = &[
+    // Go
+    (Language::Go, r"\bfunc\s*\(\s*\w+\s+\*?\w+\s*\)", 3),
+    (Language::Go, r"\berr\s*!=\s*nil\b", 3),
+    (Language::Go, r"\bgo\s+func\b", 3),
+    (Language::Go, r"\binterface\s*\{\s*\}", 3),
+    (Language::Go, r"\bchan\s+\w+|<-\s*chan\b", 3),
+    (Language::Go, r"\w\s*:=", 2),
+    (Language::Go, r"\bdefer\s+\w", 2),
+    (Language::Go, r"\bfunc\s+\w+\s*\(", 1),
+    (Language::Go, r"\[\]\*?[a-z]\w*", 1),
+    // Python
+    (Language::Python, r"\bdef\s+__\w+__\s*\(", 3),
+    (
+        Language::Python,
+        r"\bdef\s+\w+\s*\([^)]*\)\s*(->[^:]+)?:",
+        3,
+    ),
+    (Language::Python, r"\bfrom\s+[\w.]+\s+import\b", 3),
+    (Language::Python, r"\bif\s+__name__\b", 3),
+    (Language::Python, r"\belif\b", 3),
+    (
+        Language::Python,
+        r"@(property|staticmethod|classmethod)\b",
+        3,
+    ),
+    (Language::Python, r"\blambda\s+\w*\s*:", 2),
+    (Language::Python, r"\bself\.\w+", 1),
+    // Rust
+    (Language::Rust, r"&\s*(mut\s+)?self\b", 3),
+    (Language::Rust, r"\blet\s+mut\b", 3),
+    (Language::Rust, r"#\[derive\b", 3),
+    (
+        Language::Rust,
+        r"\bimpl\s*<|\bimpl\s+\w+(<[^>]*>)?(\s+for\s+\w+|\s*\{)",
+        3,
+    ),
+    (Language::Rust, r"::<", 2),
+    (Language::Rust, r"\.unwrap\(\)|\.await\b|\?;", 2),
+    (Language::Rust, r"\bfn\s+\w+\s*[<(]", 2),
+    (Language::Rust, r"\bpub\s*\(crate\)", 3),
+    // JavaScript and TypeScript
+    (Language::JavaScript, r"===|!==", 3),
+    (Language::JavaScript, r"\bconsole\.log\b", 3),
+    (Language::JavaScript, r#"\brequire\(\s*['"]"#, 3),
+    (Language::JavaScript, r#"\bimport\s+.+\s+from\s+['"]"#, 3),
+    (
+        Language::JavaScript,
+        r"\b(const|let)\s+\w+\s*=\s*(async\s*)?\([^)]*\)\s*=>",
+        3,
+    ),
+    (
+        Language::JavaScript,
+        r"\bexport\s+(default\s+)?(function|class|const|interface|type)\b",
+        3,
+    ),
+    (
+        Language::JavaScript,
+        r":\s*(string|number|boolean|any|unknown)\b",
+        2,
+    ),
+    (Language::JavaScript, r"\bfunction\s*\w*\s*\(", 2),
+    (Language::JavaScript, r"=>", 1),
+    // Ruby
+    (Language::Ruby, r"\bdef\s+initialize\b", 3),
+    (Language::Ruby, r"\bdef\s+self\.\w+", 3),
+    (Language::Ruby, r"\battr_(accessor|reader|writer)\b", 3),
+    (Language::Ruby, r"\bdo\s*\|[^|]*\|", 3),
+    (Language::Ruby, r"\bputs\s", 2),
+    (Language::Ruby, r"\bend\s*$", 1),
+    // C#
+    (Language::CSharp, r"\busing\s+System\b", 3),
+    (Language::CSharp, r"\{\s*get;\s*(set;\s*)?\}", 3),
+    (Language::CSharp, r"\basync\s+Task\b", 3),
+    (
+        Language::CSharp,
+        r"\bpublic\s+(static\s+)?(void|string|int|bool)\b",
+        2,
+    ),
+    // Java
+    (Language::Java, r"\bpublic\s+static\s+void\s+main\b", 3),
+    (Language::Java, r"\bSystem\.out\.print", 3),
+    (Language::Java, r"@Override\b", 3),
+    (Language::Java, r"\bimport\s+java\.", 3),
+    (
+        Language::Java,
+        r"\bpublic\s+(static\s+)?(void|String|int|boolean)\b",
+        2,
+    ),
+    // Haskell
+    (Language::Haskell, r"\b\w+\s+::\s+[A-Z\[(a-z]", 3),
+    (Language::Haskell, r"\bimport\s+qualified\b", 3),
+    (Language::Haskell, r"\bderiving\s*\(", 3),
+    (Language::Haskell, r">>=", 3),
+    (Language::Haskell, r"\bdata\s+[A-Z]\w*(\s+\w+)*\s*=", 3),
+    // Zig
+    (Language::Zig, r"@import\(", 3),
+    (Language::Zig, r"\bcomptime\b", 3),
+    (Language::Zig, r"!void\b", 3),
+    // C and C++
+    (Language::Cpp, r"\bstd::\w+", 3),
+    (Language::Cpp, r"\btemplate\s*<", 3),
+    (Language::Cpp, r"#include\s*[<\x22]", 3),
+    (Language::Cpp, r"->\w+", 1),
+    // PHP
+    (Language::Php, r"\$this->", 3),
+    (Language::Php, r"<\?php", 3),
+    (Language::Php, r"\bfunction\s+\w+\s*\(\s*\$", 3),
+    // Kotlin
+    (Language::Kotlin, r"\bfun\s+\w+\s*\(", 3),
+    (Language::Kotlin, r"\bval\s+\w+\s*[:=]", 2),
+    // Swift
+    (Language::Swift, r"\bguard\s+let\b", 3),
+    (Language::Swift, r"\bfunc\s+\w+\s*\([^)]*\)\s*->", 3),
+];
+
+static COMPILED: LazyLock<Vec<(Language, Regex, u32)>> = LazyLock::new(|| {
+    SIGNALS
+        .iter()
+        .map(|(language, pattern, weight)| {
+            let regex = Regex::new(&format!("(?m){}", pattern)).expect("valid signal pattern");
+            (*language, regex, *weight)
+        })
+        .collect()
+});
+
+/// The language `language` counts as, for telling queries and chunks apart.
+fn family(language: Language) -> Language {
+    match language {
+        Language::TypeScript => Language::JavaScript,
+        Language::C => Language::Cpp,
+        other => other,
+    }
+}
+
+/// The language `query` is written in, if its syntax gives one away.
+pub fn infer(query: &str) -> Option<Language> {
+    let mut evidence: HashMap<Language, u32> = HashMap::new();
+    for (language, regex, weight) in COMPILED.iter() {
+        if regex.is_match(query) {
+            *evidence.entry(*language).or_default() += weight;
+        }
+    }
+    let mut ranked: Vec<(Language, u32)> = evidence.into_iter().collect();
+    ranked.sort_by(|a, b| b.1.cmp(&a.1));
+    let (language, best) = *ranked.first()?;
+    let runner_up = ranked.get(1).map_or(0, |(_, weight)| *weight);
+    (best >= MIN_EVIDENCE && best >= runner_up * 2).then_some(language)
+}
+
+/// The language the search of `options` infers from its query, if it
+/// infers one.
+pub fn inferred(options: &SearchOptions) -> Option<Language> {
+    if options.infer_language == LanguageInference::Off
+        || matches!(options.mode, SearchMode::Regex | SearchMode::Ast)
+    {
+        return None;
+    }
+    infer(&options.query)
+}
+
+/// The language the search of `options` is confined to under
+/// `--infer-lang restrict`, if its query gives one away.
+pub fn restricted_to(options: &SearchOptions) -> Option<Language> {
+    if options.infer_language != LanguageInference::Restrict {
+        return None;
+    }
+    inferred(options)
+}
+
+/// Whether `file` is in `language`, as [`infer`] tells languages apart.
+pub fn is_in(language: Language, file: &Path) -> bool {
+    Language::from_path(file).is_some_and(|lang| family(lang) == family(language))
+}
+
+/// Rank `results` in `language` higher, or drop the others under
+/// `--infer-lang restrict`; returns how many results were affected.
+pub fn apply(
+    language: Language,
+    inference: LanguageInference,
+    results: &mut Vec<SearchResult>,
+) -> usize {
+    let in_language = |result: &SearchResult| {
+        result
+            .lang
+            .is_some_and(|lang| family(lang) == family(language))
+    };
+    match inference {
+        LanguageInference::Off => 0,
+        LanguageInference::Restrict => {
+            let before = results.len();
+            results.retain(in_language);
+            before - results.len()
+        }
+        LanguageInference::Bias => {
+            let mut adjusted = 0;
+            for result in results.iter_mut().filter(|result| in_language(result)) {
+                result.score *= LANGUAGE_FACTOR;
+                adjusted += 1;
+            }
+            if adjusted > 0 {
+                results.sort_by(SearchResult::rank_cmp);
+            }
+            adjusted
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::Span;
+    use std::path::PathBuf;
+
+    #[test]
+    fn syntax_gives_the_language_away() {
+        assert_eq!(infer("func (s *Server) Handle"), Some(Language::Go));
+        assert_eq!(infer("if err != nil { return err }"), Some(Language::Go));
+        assert_eq!(infer("def __init__(self, config)"), Some(Language::Python));
+        assert_eq!(infer("fn parse(&mut self) -> Result"), Some(Language::Rust));
+        assert_eq!(
+            infer("const handler = async (req) => res.json()"),
+            Some(Language::JavaScript)
+        );
+        assert_eq!(infer("def initialize(name)"), Some(Language::Ruby));
+        assert_eq!(infer("std::vector<int> parse"), Some(Language::Cpp));
+
+        // Prose, and syntax several languages share, give nothing away
+        assert_eq!(infer("retry with exponential backoff"), None);
+        assert_eq!(infer("user authentication"), None);
+        assert_eq!(infer("public void save"), None);
+        assert_eq!(infer("x => x + 1"), None);
+    }
+
+    #[test]
+    fn results_in_the_language_rank_higher_or_alone() {
+        let result = |file: &str, score: f32| SearchResult {
+            lang: Language::from_path(Path::new(file)),
+            file: PathBuf::from(file),
+            span: Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: 1,
+                line_end: 1,
+            },
+            score,
+            preview: String::new(),
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        };
+        let results = vec![
+            result("server.py", 0.8),
+            result("server.go", 0.75),
+            result("README.md", 0.7),
+        ];
+
+        let mut biased = results.clone();
+        assert_eq!(apply(Language::Go, LanguageInference::Bias, &mut biased), 1);
+        assert_eq!(biased[0].file, PathBuf::from("server.go"));
+        assert!((biased[0].score - 0.9).abs() < 1e-6);
+
+        let mut restricted = results.clone();
+        assert_eq!(
+            apply(Language::Go, LanguageInference::Restrict, &mut restricted),
+            2
+        );
+        assert_eq!(restricted.len(), 1);
+
+        // TypeScript answers a JavaScript query
+        assert!(is_in(Language::JavaScript, Path::new("src/app.ts")));
+        assert!(!is_in(Language::JavaScript, Path::new("src/app.py")));
+    }
+}
@@ -0,0 +1,496 @@
+//! Chooses how a semantic query scores the index. Scanning every candidate
+//! chunk is exact and, for small indexes, fastest; large ones are better
+//! served by an IVF index ([`cs_ann::IvfIndex`]) that narrows the scan to the
+//! chunks clustered near the query. The planner decides per query from the
+//! number of candidates, how much of the index the filters keep, and the
+//! requested `top_k`, using per-chunk costs measured on earlier queries (kept
+//! in `.cs/query_profile.json`).
+//!
+//! The ANN index lives in `.cs/ann.ivf`. It is built by the first large
+//! unfiltered search, and rebuilt once a tenth of the chunks searched are
+//! missing from it; chunks it doesn't know yet are always scored. Chunks the
+//! ANN narrows to are scored exactly, as in a full scan. Path, `--include`
+//! and `--facet` filters are applied to the candidates beforehand, so the
+//! probed lists only yield matching chunks; when they hold fewer than
+//! `top_k` of them the query falls back to scanning every candidate.
+
+use anyhow::Result;
+use cs_ann::IvfIndex;
+use cs_core::{QueryPlan, QueryStrategy, SearchOptions};
+use cs_index::ChunkEntry;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+use std::time::{Duration, Instant, SystemTime};
+
+use super::SearchProgressCallback;
+
+pub const ANN_FILE: &str = "ann.ivf";
+pub const PROFILE_FILE: &str = "query_profile.json";
+
+/// Below this many candidates a scan is always cheap enough.
+const BRUTE_FORCE_MAX_CHUNKS: usize = 20_000;
+
+/// Candidates wanted from the probed lists for each requested result.
+const CANDIDATES_PER_RESULT: usize = 20;
+
+const MIN_PROBES: usize = 8;
+
+/// Probing more of the lists than this is a scan with extra steps.
+const MAX_PROBED_SHARE: f64 = 0.5;
+
+/// The ANN index is rebuilt when more of the candidates than this are missing from it.
+const MAX_UNINDEXED_SHARE: f64 = 0.1;
+
+/// Weight of the latest query in the measured costs.
+const PROFILE_WEIGHT: f64 = 0.2;
+
+/// Fewer chunks than this time too noisily to update the profile.
+const MIN_PROFILED_CHUNKS: usize = 1000;
+
+/// The ANN indexes loaded by this process, by index root, with the
+/// modification time of the file they were read from.
+static ANN_CACHE: LazyLock<Mutex<HashMap<PathBuf, (SystemTime, Arc<Ann>)>>> =
+    LazyLock::new(Default::default);
+
+/// Measured cost per chunk of scoring it, and of looking up its ANN id.
+#[derive(Debug, Clone, Copy, Serialize, Deserialize)]
+struct Profile {
+    score_ns: f64,
+    map_ns: f64,
+}
+
+impl Default for Profile {
+    fn default() -> Self {
+        Self {
+            score_ns: 400.0,
+            map_ns: 100.0,
+        }
+    }
+}
+
+impl Profile {
+    fn load(index_root: &Path) -> Self {
+        fs::read(cs_core::locations::index_dir(index_root).join(PROFILE_FILE))
+            .ok()
+            .and_then(|data| serde_json::from_slice(&data).ok())
+            .unwrap_or_default()
+    }
+
+    fn brute_force_ms(&self, candidates: usize) -> f64 {
+        candidates as f64 * self.score_ns / 1e6
+    }
+
+    /// Looking up every candidate, then scoring the centroids and the
+    /// candidates in the probed lists.
+    fn ann_ms(&self, candidates: usize, lists: usize, scanned: usize) -> f64 {
+        (candidates as f64 * self.map_ns + (lists + scanned) as f64 * self.score_ns) / 1e6
+    }
+}
+
+#[derive(Serialize, Deserialize)]
+struct AnnFile {
+    /// Per id: the chunk's file relative to the index root, and its byte span
+    keys: Vec<(String, usize, usize)>,
+    ivf: IvfIndex,
+}
+
+struct Ann {
+    ivf: IvfIndex,
+    /// Ids by file, then by byte span
+    ids: HashMap<PathBuf, HashMap<(usize, usize), u32>>,
+}
+
+impl Ann {
+    fn new(index_root: &Path, file: AnnFile) -> Self {
+        let mut ids: HashMap<PathBuf, HashMap<(usize, usize), u32>> = HashMap::new();
+        for (id, (path, start, end)) in file.keys.into_iter().enumerate() {
+            ids.entry(index_root.join(path))
+                .or_default()
+                .insert((start, end), id as u32);
+        }
+        Self { ivf: file.ivf, ids }
+    }
+
+    /// Positions in `chunks` by id (`usize::MAX` for ids not among them),
+    /// and the positions of chunks the index doesn't hold.
+    fn map(&self, chunks: &[(PathBuf, ChunkEntry)]) -> (Vec<usize>, Vec<usize>) {
+        let mut by_id = vec![usize::MAX; self.ivf.len()];
+        let mut unindexed = Vec::new();
+        let mut file_ids: Option<(&Path, Option<&HashMap<(usize, usize), u32>>)> = None;
+        for (position, (file, chunk)) in chunks.iter().enumerate() {
+            // Chunks of a file are next to each other
+            let ids = match file_ids {
+                Some((last, ids)) if last == file.as_path() => ids,
+                _ => {
+                    let ids = self.ids.get(file.as_path());
+                    file_ids = Some((file.as_path(), ids));
+                    ids
+                }
+            };
+            match ids.and_then(|ids| ids.get(&(chunk.span.byte_start, chunk.span.byte_end))) {
+                Some(&id) => by_id[id as usize] = position,
+                None => unindexed.push(position),
+            }
+        }
+        (by_id, unindexed)
+    }
+}
+
+/// How a query scores its candidates.
+pub(crate) struct Selection {
+    pub plan: QueryPlan,
+    /// Positions of the candidates to score, or `None` for all of them
+    pub positions: Option<Vec<usize>>,
+    /// Time spent looking up ANN ids, and for how many chunks
+    mapped: Option<(Duration, usize)>,
+}
+
+/// Plan the scoring of `chunks`, the candidates left after filters, for
+/// `query`. Never fails: without a usable ANN index the plan is a scan.
+pub(crate) fn select(
+    index_root: &Path,
+    chunks: &[(PathBuf, ChunkEntry)],
+    query: &[f32],
+    options: &SearchOptions,
+    progress: Option<&SearchProgressCallback>,
+) -> Selection {
+    let candidates = chunks.len();
+    let scan = |reason: String| Selection {
+        plan: QueryPlan {
+            strategy: QueryStrategy::BruteForce,
+            candidates,
+            scored: candidates,
+            top_k: options.top_k,
+            reason,
+        },
+        positions: None,
+        mapped: None,
+    };
+    let Some(top_k) = options.top_k else {
+        return scan("every match was asked for".to_string());
+    };
+    if candidates < BRUTE_FORCE_MAX_CHUNKS {
+        return scan(format!(
+            "under {} candidates are cheaper to scan than to narrow down",
+            BRUTE_FORCE_MAX_CHUNKS
+        ));
+    }
+    if cs_index::multi_vector::is_enabled(index_root) {
+        // The ANN index holds chunk vectors only, so it would miss chunks
+        // that one statement group matches
+        return scan("a multi-vector index scores every vector of each chunk".to_string());
+    }
+    if cs_index::model_migration::is_migrating(index_root) {
+        // The ANN index clusters vectors of one model
+        return scan("an index migrating between models is scored by both".to_string());
+    }
+    let profile = Profile::load(index_root);
+    // The ANN index is only built from searches that see the whole index,
+    // and never into a sealed bundle
+    let sealed = cs_index::bundle::is_sealed(index_root);
+    let can_build = is_unfiltered(index_root, options) && !sealed;
+
+    let ann = match load_ann(index_root) {
+        Ok(Some(ann)) if ann.ivf.dim() == query.len() => Some(ann),
+        Ok(_) => None,
+        Err(e) => {
+            tracing::warn!("Ignoring the ANN index: {}", e);
+            None
+        }
+    };
+    let mut ann = match ann {
+        Some(ann) => ann,
+        None if sealed => {
+            return scan("the sealed bundle has no ANN index".to_string());
+        }
+        None if !can_build => {
+            return scan(
+                "there's no ANN index yet; the next large unfiltered search builds one".to_string(),
+            );
+        }
+        None => {
+            // Only worth building if it would beat a scan even unfiltered
+            let lists = list_count(candidates);
+            let per_list = candidates / lists;
+            let probes = probe_count(top_k, 1.0, lists, per_list);
+            let ann_ms = profile.ann_ms(candidates, lists, probes * per_list);
+            let scan_ms = profile.brute_force_ms(candidates);
+            if ann_ms >= scan_ms {
+                return scan(format!(
+                    "an ANN index would cost about as much as a scan (~{:.0}ms vs ~{:.0}ms)",
+                    ann_ms, scan_ms
+                ));
+            }
+            match build_ann(index_root, chunks, progress) {
+                Ok(ann) => ann,
+                Err(e) => return scan(format!("building the ANN index failed: {}", e)),
+            }
+        }
+    };
+
+    let mut started = Instant::now();
+    let (mut by_id, mut unindexed) = ann.map(chunks);
+    if unindexed.len() as f64 > candidates as f64 * MAX_UNINDEXED_SHARE {
+        if !can_build {
+            return scan(
+                "the ANN index is out of date; the next large unfiltered search rebuilds it"
+                    .to_string(),
+            );
+        }
+        ann = match build_ann(index_root, chunks, progress) {
+            Ok(ann) => ann,
+            Err(e) => return scan(format!("rebuilding the ANN index failed: {}", e)),
+        };
+        started = Instant::now();
+        (by_id, unindexed) = ann.map(chunks);
+    }
+    let mapped = Some((started.elapsed(), candidates));
+
+    let lists = ann.ivf.list_count();
+    let indexed = candidates - unindexed.len();
+    let selectivity = indexed as f64 / ann.ivf.len().max(1) as f64;
+    let per_list = ann.ivf.len() / lists.max(1);
+    let probes = probe_count(top_k, selectivity, lists, per_list);
+    if probes as f64 > lists as f64 * MAX_PROBED_SHARE {
+        return Selection {
+            mapped,
+            ..scan(format!(
+                "filters keep {:.1}% of the index, so the ANN would probe most of its lists",
+                selectivity * 100.0
+            ))
+        };
+    }
+    let scanned = (probes as f64 * per_list as f64 * selectivity) as usize + unindexed.len();
+    let ann_ms = profile.ann_ms(candidates, lists, scanned);
+    let scan_ms = profile.brute_force_ms(candidates);
+    if ann_ms >= scan_ms {
+        return Selection {
+            mapped,
+            ..scan(format!(
+                "the ANN would cost about as much as a scan (~{:.0}ms vs ~{:.0}ms)",
+                ann_ms, scan_ms
+            ))
+        };
+    }
+
+    let ids = match ann.ivf.candidates(query, probes) {
+        Ok(ids) => ids,
+        Err(e) => return scan(format!("the ANN index can't be searched: {}", e)),
+    };
+    let mut positions: Vec<usize> = ids
+        .into_iter()
+        .map(|id| by_id[id as usize])
+        .filter(|&position| position != usize::MAX)
+        .collect();
+    positions.extend(unindexed);
+    // A filter can leave the nearest lists short of matches
+    if positions.len() < top_k {
+        return Selection {
+            mapped,
+            ..scan(format!(
+                "the probed lists held only {} matching chunks for top {}",
+                positions.len(),
+                top_k
+            ))
+        };
+    }
+    Selection {
+        plan: QueryPlan {
+            strategy: QueryStrategy::Ann { lists, probes },
+            candidates,
+            scored: positions.len(),
+            top_k: options.top_k,
+            reason: format!(
+                "filters keep {:.1}% of the index; ~{:.0}ms estimated vs ~{:.0}ms for a scan",
+                selectivity * 100.0,
+                ann_ms,
+                scan_ms
+            ),
+        },
+        positions: Some(positions),
+        mapped,
+    }
+}
+
+/// Fold the time the query took to score `scored` chunks, and to look up
+/// ANN ids, into the profile of the index at `index_root`.
+pub(crate) fn record(index_root: &Path, selection: &Selection, scoring: Duration, scored: usize) {
+    if cs_index::bundle::is_sealed(index_root) {
+        return;
+    }
+    let mut profile = Profile::load(index_root);
+    let mut changed = false;
+    let mut observe = |estimate: &mut f64, elapsed: Duration, chunks: usize| {
+        if chunks >= MIN_PROFILED_CHUNKS {
+            let measured = elapsed.as_nanos() as f64 / chunks as f64;
+            *estimate += (measured - *estimate) * PROFILE_WEIGHT;
+            changed = true;
+        }
+    };
+    observe(&mut profile.score_ns, scoring, scored);
+    if let Some((elapsed, chunks)) = selection.mapped {
+        observe(&mut profile.map_ns, elapsed, chunks);
+    }
+    if !changed {
+        return;
+    }
+    let path = cs_core::locations::index_dir(index_root).join(PROFILE_FILE);
+    let saved = serde_json::to_vec(&profile)
+        .map_err(anyhow::Error::from)
+        .and_then(|data| replace(&path, &data));
+    if let Err(e) = saved {
+        tracing::debug!("Failed to save the query profile: {}", e);
+    }
+}
+
+/// Whether the search sees every chunk of the index at `index_root`.
+pub(crate) fn is_unfiltered(index_root: &Path, options: &SearchOptions) -> bool {
+    let whole_tree = options.path == Path::new(".")
+        || cs_core::paths::canonicalize(&options.path).is_ok_and(|path| {
+            cs_core::paths::canonicalize(index_root)
+                .is_ok_and(|root| cs_core::paths::paths_equal(&path, &root))
+        });
+    whole_tree
+        && options.include_patterns.is_empty()
+        && options.facet_filters.is_empty()
+        && options.license_filters.is_empty()
+        && options.metadata_filters.is_empty()
+        && options.tag_filters.is_empty()
+        && options.must_match.is_none()
+}
+
+/// Lists for an index of `chunks`: enough to keep each list a few thousand
+/// chunks long, few enough that scoring the centroids stays cheap.
+fn list_count(chunks: usize) -> usize {
+    ((chunks as f64).sqrt() / 4.0).round().clamp(16.0, 4096.0) as usize
+}
+
+/// Lists to probe for `top_k` results when filters keep `selectivity` of the
+/// `per_list` chunks in each.
+fn probe_count(top_k: usize, selectivity: f64, lists: usize, per_list: usize) -> usize {
+    let wanted = (top_k * CANDIDATES_PER_RESULT) as f64;
+    let needed = (wanted / (selectivity * per_list as f64).max(1.0)).ceil() as usize;
+    needed.max(MIN_PROBES).max(lists / 16).min(lists)
+}
+
+fn ann_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(ANN_FILE)
+}
+
+fn load_ann(index_root: &Path) -> Result<Option<Arc<Ann>>> {
+    let path = ann_path(index_root);
+    let Ok(modified) = fs::metadata(&path).and_then(|metadata| metadata.modified()) else {
+        return Ok(None);
+    };
+    let mut cache = ANN_CACHE.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some((loaded, ann)) = cache.get(index_root)
+        && *loaded == modified
+    {
+        return Ok(Some(ann.clone()));
+    }
+    let data = cs_index::encryption::open_from(&path, fs::read(&path)?)?;
+    let ann = Arc::new(Ann::new(index_root, bincode::deserialize(&data)?));
+    cache.insert(index_root.to_path_buf(), (modified, ann.clone()));
+    Ok(Some(ann))
+}
+
+fn build_ann(
+    index_root: &Path,
+    chunks: &[(PathBuf, ChunkEntry)],
+    progress: Option<&SearchProgressCallback>,
+) -> Result<Arc<Ann>> {
+    let embedded: Vec<(&PathBuf, &ChunkEntry, &[f32])> = chunks
+        .iter()
+        .filter_map(|(file, chunk)| Some((file, chunk, chunk.embedding.as_deref()?)))
+        .collect();
+    if let Some(callback) = progress {
+        callback(&format!(
+            "Building the ANN index over {} chunks (once per index version)...",
+            embedded.len()
+        ));
+    }
+    let _span = tracing::info_span!("build_ann", chunks = embedded.len()).entered();
+    let vectors: Vec<&[f32]> = embedded.iter().map(|(_, _, vector)| *vector).collect();
+    let file = AnnFile {
+        keys: embedded
+            .iter()
+            .map(|(path, chunk, _)| {
+                let relative = path.strip_prefix(index_root).unwrap_or(path);
+                (
+                    relative.to_string_lossy().to_string(),
+                    chunk.span.byte_start,
+                    chunk.span.byte_end,
+                )
+            })
+            .collect(),
+        ivf: IvfIndex::build(&vectors, list_count(vectors.len()))?,
+    };
+
+    let path = ann_path(index_root);
+    let data = cs_index::encryption::seal_for(&path, bincode::serialize(&file)?)?;
+    if let Err(e) = replace(&path, &data) {
+        tracing::warn!("Failed to save the ANN index: {}", e);
+    }
+    let ann = Arc::new(Ann::new(index_root, file));
+    if let Ok(modified) = fs::metadata(&path).and_then(|metadata| metadata.modified()) {
+        ANN_CACHE
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .insert(index_root.to_path_buf(), (modified, ann.clone()));
+    }
+    Ok(ann)
+}
+
+/// Write `data` over `path` by renaming a complete file into place.
+pub(crate) fn replace(path: &Path, data: &[u8]) -> Result<()> {
+    let temp = path.with_extension(format!("{}.tmp", std::process::id()));
+    fs::write(&temp, data)?;
+    fs::rename(&temp, path)?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn probes_grow_as_filters_narrow_the_index() {
+        assert_eq!(list_count(1_000_000), 250);
+        assert_eq!(list_count(30_000), 43);
+        // 4000 chunks per list: top 10 needs few lists unfiltered
+        assert_eq!(probe_count(10, 1.0, 250, 4000), 15);
+        // ...and a filter keeping 0.1% of it more
+        assert_eq!(probe_count(10, 0.01, 250, 4000), 15);
+        assert_eq!(probe_count(10, 0.001, 250, 4000), 50);
+        assert!(probe_count(10, 0.0001, 250, 4000) as f64 > 250.0 * MAX_PROBED_SHARE);
+    }
+
+    #[test]
+    fn costs_favor_ann_only_when_it_scans_much_less() {
+        let profile = Profile::default();
+        assert!(profile.ann_ms(1_000_000, 250, 60_000) < profile.brute_force_ms(1_000_000));
+        assert!(profile.ann_ms(100_000, 80, 90_000) > profile.brute_force_ms(100_000));
+    }
+
+    #[test]
+    fn only_unfiltered_searches_build_the_ann_index() {
+        let dir = tempfile::tempdir().unwrap();
+        let root = dir.path();
+        std::fs::create_dir(root.join("src")).unwrap();
+        let options = |path: PathBuf, facets: &[&str]| SearchOptions {
+            path,
+            facet_filters: facets.iter().map(|facet| facet.parse().unwrap()).collect(),
+            ..Default::default()
+        };
+        assert!(is_unfiltered(root, &options(PathBuf::from("."), &[])));
+        assert!(is_unfiltered(root, &options(root.to_path_buf(), &[])));
+        assert!(!is_unfiltered(root, &options(root.join("src"), &[])));
+        assert!(!is_unfiltered(
+            root,
+            &options(PathBuf::from("."), &["lang=go"])
+        ));
+    }
+}
@@ -0,0 +1,400 @@
+//! `cs --related REV`: review context for a diff. For each hunk changed
+//! since `REV`, the existing code most related to it elsewhere in the
+//! repository: code with similar logic, callers of what it changes, and
+//! tests.
+//!
+//! The changed files are chunked and embedded as they are in the working
+//! tree, with the index's model, as for `--hook pre-commit`; the index
+//! itself is left untouched. Related chunks are ranked by similarity, with
+//! callers (chunks naming a symbol the hunk declares) and tests ranking a
+//! little higher, since a reviewer wants them even when they read
+//! differently.
+
+use anyhow::{Context, Result, bail};
+use rayon::prelude::*;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use crate::compare::{
+    ChunkLocation, IndexedChunk, Sources, dot, embedding_model, indexed_chunks, normalized,
+};
+use crate::dupes::{chunk_type_name, parse_additions, touches};
+
+/// Related chunks listed per hunk unless `--topk` says otherwise.
+pub const DEFAULT_RELATED: usize = 5;
+
+/// Added to the similarity of callers and tests when ranking.
+const RELATION_BONUS: f32 = 0.1;
+
+/// Similarity below which a chunk isn't related, whatever it is.
+const MIN_SIMILARITY: f32 = 0.3;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Relation {
+    Similar,
+    /// Names a symbol the hunk declares
+    Caller,
+    Test,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct RelatedChunk {
+    pub location: ChunkLocation,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    pub similarity: f32,
+    pub relation: Relation,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct HunkContext {
+    /// The hunk's lines in the working tree
+    pub hunk: ChunkLocation,
+    /// Functions, methods and types the hunk touches
+    pub symbols: Vec<String>,
+    pub related: Vec<RelatedChunk>,
+}
+
+/// The changed code of one hunk, embedded.
+struct ChangedCode {
+    hunk: ChunkLocation,
+    symbols: Vec<String>,
+    embeddings: Vec<Vec<f32>>,
+}
+
+/// For each hunk of the working tree's changes since `rev` in the repo at
+/// `repo_root`, the `limit` indexed chunks most related to it, in diff order.
+pub fn related_to_diff(repo_root: &Path, rev: &str, limit: usize) -> Result<Vec<HunkContext>> {
+    let Some(model) = embedding_model(repo_root)? else {
+        bail!(
+            "The index at {} has no embeddings; rebuild it with cs --index",
+            repo_root.display()
+        );
+    };
+    let changes = diff_additions(repo_root, rev)?;
+    if changes.is_empty() {
+        return Ok(Vec::new());
+    }
+    let existing = indexed_chunks(repo_root)?;
+    if existing.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let mut embedder = cs_embed::create_embedder(Some(model.as_str()))?;
+    let mut hunks: Vec<(ChunkLocation, Vec<String>)> = Vec::new();
+    // Embedded texts, and the hunk each is for
+    let mut texts = Vec::new();
+    let mut owners = Vec::new();
+    for (file, added) in &changes {
+        let Ok(content) = cs_core::text::read_text(&repo_root.join(file)) else {
+            continue;
+        };
+        let Some(lang) = cs_core::Language::from_path(file) else {
+            continue;
+        };
+        let chunks = cs_chunk::chunk_text_with_model(&content, Some(lang), Some(model.as_str()))?;
+        for &(line_start, line_end) in added {
+            let first = hunks.len();
+            let mut symbols = Vec::new();
+            // The whole-file module chunk says little about one hunk
+            let touching: Vec<&cs_chunk::Chunk> = chunks
+                .iter()
+                .filter(|chunk| {
+                    touches(
+                        &[(line_start, line_end)],
+                        chunk.span.line_start,
+                        chunk.span.line_end,
+                    )
+                })
+                .collect();
+            let specific = touching
+                .iter()
+                .any(|chunk| chunk_type_name(chunk.chunk_type.clone()) != Some("module"));
+            for chunk in touching {
+                if specific && chunk_type_name(chunk.chunk_type.clone()) == Some("module") {
+                    continue;
+                }
+                let Some(text) = cs_index::secrets::screen_chunk(
+                    &*embedder,
+                    repo_root,
+                    file,
+                    &chunk.text,
+                    &chunk.span,
+                )?
+                else {
+                    continue;
+                };
+                if let Some(name) = &chunk.metadata.name
+                    && !symbols.contains(name)
+                {
+                    symbols.push(name.clone());
+                }
+                texts.push(text);
+                owners.push(first);
+            }
+            hunks.push((
+                ChunkLocation {
+                    file: file.clone(),
+                    line_start,
+                    line_end,
+                },
+                symbols,
+            ));
+        }
+    }
+    if texts.is_empty() {
+        return Ok(Vec::new());
+    }
+    let embeddings = embedder.embed(&texts)?;
+    if embeddings.len() != texts.len() {
+        bail!(
+            "The embedder returned {} vectors for {} changed chunks",
+            embeddings.len(),
+            texts.len()
+        );
+    }
+
+    let mut changed: Vec<ChangedCode> = hunks
+        .into_iter()
+        .map(|(hunk, symbols)| ChangedCode {
+            hunk,
+            symbols,
+            embeddings: Vec::new(),
+        })
+        .collect();
+    for (owner, embedding) in owners.into_iter().zip(embeddings) {
+        if let Some(embedding) = normalized(&embedding) {
+            changed[owner].embeddings.push(embedding);
+        }
+    }
+
+    // Text is only needed to find callers
+    let mut sources = Sources::default();
+    let existing_texts: Vec<Option<String>> =
+        if changed.iter().any(|change| !change.symbols.is_empty()) {
+            existing.iter().map(|chunk| sources.text(chunk)).collect()
+        } else {
+            vec![None; existing.len()]
+        };
+
+    Ok(changed
+        .into_par_iter()
+        .filter(|change| !change.embeddings.is_empty())
+        .map(|change| {
+            let related = rank(repo_root, &change, &existing, &existing_texts, limit);
+            HunkContext {
+                hunk: change.hunk,
+                symbols: change.symbols,
+                related,
+            }
+        })
+        .collect())
+}
+
+fn rank(
+    repo_root: &Path,
+    change: &ChangedCode,
+    existing: &[IndexedChunk],
+    texts: &[Option<String>],
+    limit: usize,
+) -> Vec<RelatedChunk> {
+    let mut related: Vec<(f32, RelatedChunk)> = existing
+        .iter()
+        .zip(texts)
+        .filter_map(|(chunk, text)| {
+            let relative = chunk
+                .location
+                .file
+                .strip_prefix(repo_root)
+                .unwrap_or(&chunk.location.file);
+            // The indexed version of the code being changed isn't context for it
+            if relative == change.hunk.file
+                && touches(
+                    &[(change.hunk.line_start, change.hunk.line_end)],
+                    chunk.location.line_start,
+                    chunk.location.line_end,
+                )
+            {
+                return None;
+            }
+            let similarity = change
+                .embeddings
+                .iter()
+                .map(|embedding| dot(embedding, &chunk.embedding))
+                .fold(f32::MIN, f32::max);
+            if similarity < MIN_SIMILARITY {
+                return None;
+            }
+            let relation = if is_test_file(relative) {
+                Relation::Test
+            } else if text.as_deref().is_some_and(|text| {
+                change
+                    .symbols
+                    .iter()
+                    .any(|symbol| chunk.symbol.as_ref() != Some(symbol) && mentions(text, symbol))
+            }) {
+                Relation::Caller
+            } else {
+                Relation::Similar
+            };
+            let score = match relation {
+                Relation::Similar => similarity,
+                Relation::Caller | Relation::Test => similarity + RELATION_BONUS,
+            };
+            Some((
+                score,
+                RelatedChunk {
+                    location: ChunkLocation {
+                        file: relative.to_path_buf(),
+                        ..chunk.location.clone()
+                    },
+                    symbol: chunk.symbol.clone(),
+                    similarity: similarity.min(1.0),
+                    relation,
+                },
+            ))
+        })
+        .collect();
+    related.sort_by(|a, b| b.0.total_cmp(&a.0));
+    related
+        .into_iter()
+        .take(limit)
+        .map(|(_, related)| related)
+        .collect()
+}
+
+/// Whether `text` names `symbol` as a whole word.
+fn mentions(text: &str, symbol: &str) -> bool {
+    let is_ident = |c: char| c.is_alphanumeric() || c == '_';
+    text.match_indices(symbol).any(|(at, _)| {
+        let before = text[..at].chars().next_back();
+        let after = text[at + symbol.len()..].chars().next();
+        !before.is_some_and(is_ident) && !after.is_some_and(is_ident)
+    })
+}
+
+/// Test files by the naming conventions of the supported languages.
+fn is_test_file(file: &Path) -> bool {
+    let in_test_dir = file.components().any(|component| {
+        matches!(
+            component.as_os_str().to_str(),
+            Some("test" | "tests" | "spec" | "__tests__")
+        )
+    });
+    let name = file
+        .file_name()
+        .and_then(|name| name.to_str())
+        .unwrap_or_default();
+    let stem = name.split('.').next().unwrap_or_default();
+    in_test_dir
+        || stem.starts_with("test_")
+        || stem.ends_with("_test")
+        || stem.ends_with("Test")
+        || stem.ends_with("Tests")
+        || name.contains(".test.")
+        || name.contains(".spec.")
+}
+
+/// Lines added or changed per file in the working tree since `rev`.
+pub(crate) fn diff_additions(
+    repo_root: &Path,
+    rev: &str,
+) -> Result<BTreeMap<PathBuf, Vec<(usize, usize)>>> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(repo_root)
+        .args([
+            "-c",
+            "core.quotePath=off",
+            "diff",
+            "--relative",
+            "--unified=0",
+            "--no-color",
+            "--no-ext-diff",
+            "--diff-filter=AM",
+        ])
+        .arg(rev)
+        .arg("--")
+        .output()
+        .context("Failed to run git; diffs are read with git, which needs to be on PATH")?;
+    if !output.status.success() {
+        bail!(
+            "git diff {} failed in {}: {}",
+            rev,
+            repo_root.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(parse_additions(&String::from_utf8_lossy(&output.stdout)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunk(file: &str, line: usize, symbol: Option<&str>, embedding: [f32; 2]) -> IndexedChunk {
+        IndexedChunk {
+            location: ChunkLocation {
+                file: PathBuf::from(file),
+                line_start: line,
+                line_end: line + 9,
+            },
+            chunk_type: Some("function".to_string()),
+            symbol: symbol.map(str::to_string),
+            byte_range: (0, 0),
+            embedding: normalized(&embedding).unwrap(),
+        }
+    }
+
+    #[test]
+    fn callers_and_tests_rank_above_lookalikes() {
+        let change = ChangedCode {
+            hunk: ChunkLocation {
+                file: PathBuf::from("src/auth.rs"),
+                line_start: 12,
+                line_end: 14,
+            },
+            symbols: vec!["refresh_token".to_string()],
+            embeddings: vec![normalized(&[1.0, 0.0]).unwrap()],
+        };
+        let existing = vec![
+            // The code being changed, as indexed
+            chunk("src/auth.rs", 10, Some("refresh_token"), [1.0, 0.0]),
+            chunk("src/session.rs", 1, Some("renew"), [1.0, 0.4]),
+            chunk("src/api.rs", 1, Some("handle"), [1.0, 0.5]),
+            chunk("tests/auth_flow.rs", 1, None, [1.0, 0.6]),
+            chunk("src/http.rs", 1, Some("serve"), [0.0, 1.0]),
+        ];
+        let texts = vec![
+            None,
+            Some("fn renew() { /* refresh_tokens */ }".to_string()),
+            Some("fn handle() { refresh_token(&user)?; }".to_string()),
+            None,
+            None,
+        ];
+        let related = rank(Path::new(""), &change, &existing, &texts, 5);
+
+        let found: Vec<(&Path, Relation)> = related
+            .iter()
+            .map(|related| (related.location.file.as_path(), related.relation))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (Path::new("src/api.rs"), Relation::Caller),
+                (Path::new("tests/auth_flow.rs"), Relation::Test),
+                (Path::new("src/session.rs"), Relation::Similar),
+            ]
+        );
+        assert_eq!(rank(Path::new(""), &change, &existing, &texts, 1).len(), 1);
+
+        assert!(mentions("x = refresh_token();", "refresh_token"));
+        assert!(!mentions("refresh_tokens()", "refresh_token"));
+        assert!(is_test_file(Path::new("pkg/users_test.go")));
+        assert!(is_test_file(Path::new("web/login.spec.ts")));
+        assert!(!is_test_file(Path::new("src/contest.rs")));
+    }
+}
@@ -0,0 +1,137 @@
+//! `--explain-scores`: what each result's score is made of, so fusion weights,
+//! boosts and rerankers can be tuned against real queries.
+//!
+//! Each stage that changes scores notes its share as it runs: semantic search
+//! the dense score and what sparse scores and the reranker added, hybrid
+//! search the ranks it fused, and the refinements every mode gets the change
+//! each made. Explanations are keyed by result file and start line, which
+//! stays true as results are sorted, filtered and truncated.
+
+use cs_core::{ScoreAdjustment, ScoreExplanation, ScoreExplanations, SearchMode, SearchResult};
+use std::collections::HashMap;
+use std::path::PathBuf;
+
+/// Scores smaller than this aren't reported as changes.
+const EPSILON: f32 = 1e-6;
+
+pub(crate) fn key(result: &SearchResult) -> (PathBuf, usize) {
+    (result.file.clone(), result.span.line_start)
+}
+
+/// Explanations for results that only know their retrieval score, which in
+/// `mode` is a dense, lexical or AST score.
+pub(crate) fn from_scores(mode: &SearchMode, results: &[SearchResult]) -> ScoreExplanations {
+    results
+        .iter()
+        .map(|result| {
+            let score = Some(result.score);
+            let explanation = match mode {
+                SearchMode::Semantic | SearchMode::Hybrid => ScoreExplanation {
+                    dense: score,
+                    ..Default::default()
+                },
+                SearchMode::Regex | SearchMode::Lexical => ScoreExplanation {
+                    lexical: score,
+                    ..Default::default()
+                },
+                SearchMode::Ast => ScoreExplanation {
+                    ast: score,
+                    ..Default::default()
+                },
+            };
+            (key(result), explanation)
+        })
+        .collect()
+}
+
+/// Each result's score, to compare with after a stage changes them.
+pub(crate) fn scores(results: &[SearchResult]) -> HashMap<(PathBuf, usize), f32> {
+    results
+        .iter()
+        .map(|result| (key(result), result.score))
+        .collect()
+}
+
+/// The results whose score changed since `before`, and by how much.
+pub(crate) fn changes(
+    before: &HashMap<(PathBuf, usize), f32>,
+    results: &[SearchResult],
+) -> Vec<((PathBuf, usize), f32)> {
+    results
+        .iter()
+        .filter_map(|result| {
+            let key = key(result);
+            let delta = result.score - before.get(&key)?;
+            (delta.abs() > EPSILON).then_some((key, delta))
+        })
+        .collect()
+}
+
+/// Run `adjust` over `results`, noting in `explanations` what it changed
+/// each score by as an adjustment from `source`.
+pub(crate) fn adjust<T>(
+    explanations: Option<&mut ScoreExplanations>,
+    source: &str,
+    results: &mut Vec<SearchResult>,
+    adjust: impl FnOnce(&mut Vec<SearchResult>) -> T,
+) -> T {
+    let Some(explanations) = explanations else {
+        return adjust(results);
+    };
+    let before = scores(results);
+    let adjusted = adjust(results);
+    for (key, delta) in changes(&before, results) {
+        explanations
+            .entry(key)
+            .or_default()
+            .adjustments
+            .push(ScoreAdjustment {
+                source: source.to_string(),
+                delta,
+            });
+    }
+    adjusted
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn adjustments_are_noted_by_source() {
+        let mut results = vec![
+            SearchResult::for_lines("a.rs", 1, 1, 0.8),
+            SearchResult::for_lines("b.rs", 4, 4, 0.6),
+        ];
+        let mut explanations = from_scores(&SearchMode::Semantic, &results);
+
+        adjust(
+            Some(&mut explanations),
+            "boost rules",
+            &mut results,
+            |results| {
+                results[1].score *= 1.5;
+            },
+        );
+        adjust(
+            Some(&mut explanations),
+            "stop symbols",
+            &mut results,
+            |results| {
+                results.remove(0);
+            },
+        );
+        adjust(Some(&mut explanations), "feedback", &mut results, |_| {});
+
+        let unchanged = &explanations[&(PathBuf::from("a.rs"), 1)];
+        assert_eq!(unchanged.dense, Some(0.8));
+        assert!(unchanged.adjustments.is_empty());
+
+        let boosted = &explanations[&(PathBuf::from("b.rs"), 4)];
+        assert_eq!(boosted.dense, Some(0.6));
+        assert_eq!(boosted.adjustments.len(), 1);
+        assert_eq!(boosted.adjustments[0].source, "boost rules");
+        assert!((boosted.adjustments[0].delta - 0.3).abs() < 1e-6);
+        assert_eq!(boosted.to_string(), "dense 0.600, boost rules +0.300");
+    }
+}
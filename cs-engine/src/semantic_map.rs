@@ -0,0 +1,296 @@
+//! `cs --map`: the semantic structure of a codebase as a graph. Chunk
+//! embeddings are clustered with spherical k-means (the same clustering the
+//! ANN index trains its lists with), each cluster is labelled with the
+//! symbols of the chunks nearest its centre, and clusters are linked to the
+//! ones whose centres are most alike.
+//!
+//! The graph is exported as JSON, with every chunk's location for a web UI
+//! to drill into, or as Graphviz DOT (`cs --map --map-format dot | dot -Tsvg`).
+
+use anyhow::{Result, bail};
+use serde::Serialize;
+use std::collections::{BTreeSet, HashMap};
+use std::fmt::Write;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+use crate::compare::{ChunkLocation, IndexedChunk, dot, indexed_chunks};
+
+/// Symbols a cluster's label is made of.
+const LABEL_SYMBOLS: usize = 3;
+
+/// Files listed for each cluster, the ones most of its chunks are in.
+const TOP_FILES: usize = 3;
+
+/// Clusters each cluster is linked to, nearest first.
+const EDGES_PER_CLUSTER: usize = 2;
+
+/// Clusters at most, when `--clusters` doesn't say.
+const MAX_DEFAULT_CLUSTERS: usize = 50;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum MapFormat {
+    #[default]
+    Json,
+    Dot,
+}
+
+impl FromStr for MapFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "json" => Ok(Self::Json),
+            "dot" => Ok(Self::Dot),
+            other => Err(format!(
+                "Unknown map format '{}'; expected json or dot",
+                other
+            )),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct MapCluster {
+    pub id: usize,
+    pub label: String,
+    /// Chunks in the cluster
+    pub size: usize,
+    /// Names of the chunks nearest the cluster's centre, nearest first
+    pub symbols: Vec<String>,
+    /// Files most of the cluster's chunks are in, relative to the index root
+    pub files: Vec<PathBuf>,
+    pub chunks: Vec<ChunkLocation>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct MapEdge {
+    pub from: usize,
+    pub to: usize,
+    /// Cosine similarity of the two clusters' centres
+    pub similarity: f32,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SemanticMap {
+    pub clusters: Vec<MapCluster>,
+    pub edges: Vec<MapEdge>,
+}
+
+/// Map the embedded chunks under `scope` in the index at `index_root` into
+/// `clusters` clusters, or a number that suits how many chunks there are.
+pub fn build_map(index_root: &Path, scope: &Path, clusters: Option<usize>) -> Result<SemanticMap> {
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let scope = cs_core::paths::canonicalize_lossy(scope);
+    let scope = scope.strip_prefix(&root).unwrap_or(Path::new(""));
+    let mut chunks: Vec<IndexedChunk> = indexed_chunks(index_root)?
+        .into_iter()
+        .filter_map(|mut chunk| {
+            let relative = chunk
+                .location
+                .file
+                .strip_prefix(index_root)
+                .unwrap_or(&chunk.location.file)
+                .to_path_buf();
+            chunk.location.file = relative;
+            chunk.location.file.starts_with(scope).then_some(chunk)
+        })
+        .collect();
+    if chunks.is_empty() {
+        bail!(
+            "No embedded chunks under {}; run cs --index first",
+            index_root.join(scope).display()
+        );
+    }
+    chunks.sort_by(|a, b| {
+        (&a.location.file, a.location.line_start).cmp(&(&b.location.file, b.location.line_start))
+    });
+    let clusters = clusters.unwrap_or_else(|| default_clusters(chunks.len()));
+    map_chunks(&chunks, clusters)
+}
+
+/// About √(n/2) clusters for n chunks, the usual rule of thumb.
+fn default_clusters(chunks: usize) -> usize {
+    ((chunks as f64 / 2.0).sqrt().round() as usize).clamp(1, MAX_DEFAULT_CLUSTERS)
+}
+
+fn map_chunks(chunks: &[IndexedChunk], clusters: usize) -> Result<SemanticMap> {
+    let vectors: Vec<&[f32]> = chunks
+        .iter()
+        .map(|chunk| chunk.embedding.as_slice())
+        .collect();
+    let ivf = cs_ann::IvfIndex::build(&vectors, clusters)?;
+
+    // Largest first; lists nothing was nearest are dropped
+    let mut lists: Vec<(&[f32], &[u32])> = ivf
+        .centroids()
+        .iter()
+        .zip(ivf.lists())
+        .filter(|(_, ids)| !ids.is_empty())
+        .map(|(centroid, ids)| (centroid.as_slice(), ids.as_slice()))
+        .collect();
+    lists.sort_by(|a, b| b.1.len().cmp(&a.1.len()));
+
+    let clusters: Vec<MapCluster> = lists
+        .iter()
+        .enumerate()
+        .map(|(id, (centroid, ids))| cluster(id, centroid, ids, chunks))
+        .collect();
+
+    let mut linked = BTreeSet::new();
+    for (i, (centroid, _)) in lists.iter().enumerate() {
+        let mut nearest: Vec<(usize, f32)> = lists
+            .iter()
+            .enumerate()
+            .filter(|&(j, _)| j != i)
+            .map(|(j, (other, _))| (j, dot(centroid, other)))
+            .collect();
+        nearest.sort_by(|a, b| b.1.total_cmp(&a.1));
+        for &(j, _) in nearest.iter().take(EDGES_PER_CLUSTER) {
+            linked.insert((i.min(j), i.max(j)));
+        }
+    }
+    let edges = linked
+        .into_iter()
+        .map(|(from, to)| MapEdge {
+            from,
+            to,
+            similarity: dot(lists[from].0, lists[to].0).min(1.0),
+        })
+        .collect();
+
+    Ok(SemanticMap { clusters, edges })
+}
+
+fn cluster(id: usize, centroid: &[f32], ids: &[u32], chunks: &[IndexedChunk]) -> MapCluster {
+    let mut members: Vec<&IndexedChunk> = ids.iter().map(|&id| &chunks[id as usize]).collect();
+    members.sort_by(|a, b| dot(&b.embedding, centroid).total_cmp(&dot(&a.embedding, centroid)));
+
+    let mut symbols: Vec<String> = Vec::new();
+    for symbol in members.iter().filter_map(|chunk| chunk.symbol.as_ref()) {
+        if symbols.len() == LABEL_SYMBOLS {
+            break;
+        }
+        if !symbols.contains(symbol) {
+            symbols.push(symbol.clone());
+        }
+    }
+
+    let mut per_file: HashMap<&Path, usize> = HashMap::new();
+    for chunk in &members {
+        *per_file.entry(&chunk.location.file).or_default() += 1;
+    }
+    let mut files: Vec<(&Path, usize)> = per_file.into_iter().collect();
+    files.sort_by(|a, b| b.1.cmp(&a.1).then_with(|| a.0.cmp(b.0)));
+    let files: Vec<PathBuf> = files
+        .into_iter()
+        .take(TOP_FILES)
+        .map(|(file, _)| file.to_path_buf())
+        .collect();
+
+    // Chunks without names (plain text, config) are known by their file
+    let label = if symbols.is_empty() {
+        files
+            .iter()
+            .map(|file| file.display().to_string())
+            .collect::<Vec<_>>()
+            .join(", ")
+    } else {
+        symbols.join(", ")
+    };
+
+    let mut locations: Vec<ChunkLocation> =
+        members.iter().map(|chunk| chunk.location.clone()).collect();
+    locations.sort_by(|a, b| (&a.file, a.line_start).cmp(&(&b.file, b.line_start)));
+
+    MapCluster {
+        id,
+        label,
+        size: members.len(),
+        symbols,
+        files,
+        chunks: locations,
+    }
+}
+
+impl SemanticMap {
+    /// The map as an undirected Graphviz graph: a node per cluster, sized by
+    /// its chunks, and an edge per link, weighted by similarity.
+    pub fn to_dot(&self) -> String {
+        let mut dot = String::from("graph semantic_map {\n");
+        dot.push_str("    node [shape=box, style=rounded];\n");
+        for cluster in &self.clusters {
+            let _ = writeln!(
+                dot,
+                "    c{} [label=\"{}\\n{} chunks\"];",
+                cluster.id,
+                escape(&cluster.label),
+                cluster.size
+            );
+        }
+        for edge in &self.edges {
+            let _ = writeln!(
+                dot,
+                "    c{} -- c{} [weight={:.2}, label=\"{:.2}\"];",
+                edge.from, edge.to, edge.similarity, edge.similarity
+            );
+        }
+        dot.push_str("}\n");
+        dot
+    }
+}
+
+fn escape(label: &str) -> String {
+    label.replace('\\', "\\\\").replace('"', "\\\"")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunk(file: &str, line: usize, symbol: Option<&str>, embedding: [f32; 3]) -> IndexedChunk {
+        IndexedChunk {
+            location: ChunkLocation {
+                file: PathBuf::from(file),
+                line_start: line,
+                line_end: line + 5,
+            },
+            chunk_type: Some("function".to_string()),
+            symbol: symbol.map(str::to_string),
+            byte_range: (0, 0),
+            embedding: crate::compare::normalized(&embedding).unwrap(),
+        }
+    }
+
+    #[test]
+    fn chunks_cluster_by_meaning_and_are_labelled_by_symbol() {
+        let chunks = vec![
+            chunk("src/auth.rs", 1, Some("login"), [1.0, 0.0, 0.0]),
+            chunk("src/auth.rs", 10, Some("logout"), [0.9, 0.1, 0.0]),
+            chunk("src/db.rs", 1, Some("connect"), [0.0, 1.0, 0.0]),
+            chunk("src/db.rs", 10, None, [0.0, 0.9, 0.1]),
+            chunk("README.md", 1, None, [0.0, 0.0, 1.0]),
+            chunk("src/session.rs", 1, Some("login"), [0.95, 0.05, 0.0]),
+        ];
+        let map = map_chunks(&chunks, 3).unwrap();
+
+        assert_eq!(map.clusters.len(), 3);
+        let auth = &map.clusters[0];
+        assert_eq!((auth.size, auth.symbols.len()), (3, 2));
+        assert_eq!(auth.label, "login, logout");
+        assert_eq!(auth.files[0], Path::new("src/auth.rs"));
+        assert_eq!(map.clusters[1].label, "connect");
+        // Nothing in it has a name
+        assert_eq!(map.clusters[2].label, "README.md");
+        assert!(map.edges.iter().all(|edge| edge.from < edge.to));
+
+        let dot = map.to_dot();
+        assert!(dot.starts_with("graph semantic_map {"));
+        assert!(dot.contains("c0 [label=\"login, logout\\n3 chunks\"];"));
+        assert!(dot.contains(" -- "));
+
+        assert_eq!(default_clusters(1), 1);
+        assert_eq!(default_clusters(800), 20);
+        assert_eq!("DOT".parse::<MapFormat>(), Ok(MapFormat::Dot));
+    }
+}
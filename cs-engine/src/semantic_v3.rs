@@ -1,13 +1,25 @@
 use anyhow::Result;
 use cs_core::{CcError, SearchOptions, SearchResult};
-use std::path::Path;
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
 use walkdir::WalkDir;
 
+use super::model_migration::Migrating;
 use super::{
-    SearchProgressCallback, extract_content_from_span, find_nearest_index_root,
-    resolve_model_from_root,
+    PartialResultsCallback, SearchProgressCallback, extract_content_from_span,
+    find_nearest_index_root, resolve_model_from_root,
 };
 
+/// Chunks scored between provisional result snapshots when streaming.
+const STREAM_BATCH_SIZE: usize = 4096;
+
+/// Provisional hits streamed when the search has no `top_k`.
+const STREAMED_HITS_WITHOUT_TOP_K: usize = 50;
+
+/// Score of a chunk holding a string literal the query fills in, such as the
+/// format string of a pasted error message.
+const MESSAGE_MATCH_SCORE: f32 = 0.9;
+
 /// New semantic search implementation using span-based storage
 pub async fn semantic_search_v3(options: &SearchOptions) -> Result<cs_core::SearchResults> {
     semantic_search_v3_with_progress(options, None).await
@@ -17,7 +29,356 @@ pub async fn semantic_search_v3_with_progress(
     options: &SearchOptions,
     progress_callback: Option<SearchProgressCallback>,
 ) -> Result<cs_core::SearchResults> {
-    // Find the index root
+    semantic_search_v3_streaming(options, progress_callback, None).await
+}
+
+/// Like [`semantic_search_v3_with_progress`], also passing the best hits found
+/// so far to `partial_results` as scoring proceeds. Streamed hits carry no
+/// preview and come before reranking and commit matches; the returned results
+/// are the final list.
+#[tracing::instrument(name = "semantic_search", skip_all)]
+pub async fn semantic_search_v3_streaming(
+    options: &SearchOptions,
+    progress_callback: Option<SearchProgressCallback>,
+    partial_results: Option<PartialResultsCallback>,
+) -> Result<cs_core::SearchResults> {
+    if let Some(url) = options.vector_store.as_deref() {
+        return super::store_search::semantic_search_store(url, options, progress_callback).await;
+    }
+
+    let index_root = search_index_root(options)?;
+    let progress = progress_callback.as_ref();
+    let resolved_model = load_model(&index_root, options, progress)?;
+    let (mut embedder, query_embeddings) = embed_queries(
+        &index_root,
+        &resolved_model,
+        std::slice::from_ref(&options.query),
+    )?;
+
+    if query_embeddings.is_empty() {
+        return Ok(cs_core::SearchResults {
+            matches: Vec::new(),
+            closest_below_threshold: None,
+            plan: None,
+            explanations: None,
+            warnings: Vec::new(),
+            facets: None,
+        });
+    }
+
+    let query_embedding = &query_embeddings[0];
+
+    let cache = cache_slot(options, &index_root, &resolved_model, query_embedding);
+    if let Some((generation, key)) = &cache
+        && let Some(cached) = super::query_cache::lookup(&index_root, generation, key)
+    {
+        if let Some(callback) = progress {
+            callback("Using cached results for this query");
+        }
+        return Ok(cached);
+    }
+
+    let mut migrating = Migrating::load(&index_root, &options.query, progress)?;
+    let mut warnings = Vec::new();
+    let file_chunks = load_candidates(
+        options,
+        &index_root,
+        &mut embedder,
+        &resolved_model,
+        query_embedding.len(),
+        migrating.as_mut(),
+        progress,
+        &mut warnings,
+    )?;
+    if let Some(migrating) = migrating.as_mut() {
+        migrating.calibrate(query_embedding, &file_chunks);
+    }
+    let migrating = migrating.as_ref();
+
+    if let Some(callback) = progress {
+        callback("Computing similarity scores...");
+    }
+    let scoring = tracing::info_span!("score", chunks = file_chunks.len()).entered();
+
+    // Compute similarities
+    let mut similarities: Vec<(f32, &std::path::PathBuf, &cs_index::ChunkEntry)> = Vec::new();
+
+    // The two models of a migrating index share no prefix to score by
+    let truncate_dims = options
+        .truncate_dims
+        .filter(|&dims| migrating.is_none() && dims > 0 && dims < query_embedding.len());
+
+    let mut provisional = partial_results
+        .as_ref()
+        .map(|_| ProvisionalTopK::new(options.top_k.unwrap_or(STREAMED_HITS_WITHOUT_TOP_K)));
+
+    // Brute force or ANN (see `query_plan`)
+    let selection = super::query_plan::select(
+        &index_root,
+        &file_chunks,
+        query_embedding,
+        options,
+        progress,
+    );
+    let selected: Vec<&(PathBuf, cs_index::ChunkEntry)> = match &selection.positions {
+        Some(positions) => positions.iter().map(|&i| &file_chunks[i]).collect(),
+        None => file_chunks.iter().collect(),
+    };
+    let scoring_started = std::time::Instant::now();
+
+    for batch in selected.chunks(STREAM_BATCH_SIZE) {
+        let scored_before = similarities.len();
+        for &(file_path, chunk) in batch {
+            if let Some(similarity) = file_similarity(
+                query_embedding,
+                migrating,
+                file_path,
+                chunk,
+                truncate_dims,
+                &options.query,
+            ) {
+                similarities.push((similarity, file_path, chunk));
+            }
+        }
+
+        if let (Some(callback), Some(top)) = (&partial_results, provisional.as_mut())
+            && top.offer(options, &similarities[scored_before..])
+        {
+            callback(&top.snapshot());
+        }
+    }
+
+    super::query_plan::record(
+        &index_root,
+        &selection,
+        scoring_started.elapsed(),
+        selected.len(),
+    );
+
+    // Sort by similarity (highest first)
+    similarities.sort_by(by_rank);
+    if let Some(dims) = truncate_dims {
+        rescore_at_full_dimension(options, query_embedding, &mut similarities, dims, progress);
+    }
+    if super::hot_search::rescore(&index_root, options, &mut similarities, progress) {
+        similarities.sort_by(by_rank);
+    }
+    if super::sparse_search::fuse(
+        &index_root,
+        options,
+        &file_chunks,
+        &mut similarities,
+        |file, chunk| {
+            file_similarity(
+                query_embedding,
+                migrating,
+                file,
+                chunk,
+                None,
+                &options.query,
+            )
+        },
+        progress,
+    ) {
+        similarities.sort_by(by_rank);
+    }
+    drop(scoring);
+
+    // Results from a damaged index aren't worth caching
+    let cache = cache.filter(|_| warnings.is_empty());
+    let mut results = finish(
+        options,
+        &index_root,
+        &resolved_model,
+        query_embedding,
+        migrating,
+        similarities,
+        selection.plan,
+        cache,
+        progress,
+    )
+    .await?;
+    results.warnings = warnings;
+    Ok(results)
+}
+
+/// Semantic search for each of `queries`, with `options` otherwise shared.
+/// The queries are embedded in one call and scored in one pass over the
+/// candidate chunks, instead of loading and scanning the index once per
+/// query. Results come back in the order of `queries`, each as
+/// [`semantic_search_v3`] would return it.
+#[tracing::instrument(name = "semantic_search_batch", skip_all, fields(queries = queries.len()))]
+pub async fn semantic_search_v3_batch(
+    options: &SearchOptions,
+    queries: &[String],
+    progress_callback: Option<SearchProgressCallback>,
+) -> Result<Vec<cs_core::SearchResults>> {
+    let per_query: Vec<SearchOptions> = queries
+        .iter()
+        .map(|query| SearchOptions {
+            query: query.clone(),
+            ..options.clone()
+        })
+        .collect();
+    if let Some(url) = options.vector_store.as_deref() {
+        // The store scores on its side; there's no local pass to share
+        let mut results = Vec::with_capacity(per_query.len());
+        for options in &per_query {
+            results.push(super::store_search::semantic_search_store(url, options, None).await?);
+        }
+        return Ok(results);
+    }
+
+    let index_root = search_index_root(options)?;
+    if cs_index::model_migration::is_migrating(&index_root) {
+        // Each query is scored under both models of the migration
+        let mut results = Vec::with_capacity(per_query.len());
+        for options in &per_query {
+            results.push(semantic_search_v3(options).await?);
+        }
+        return Ok(results);
+    }
+    let progress = progress_callback.as_ref();
+    let resolved_model = load_model(&index_root, options, progress)?;
+    if let Some(callback) = progress {
+        callback(&format!("Embedding {} queries...", queries.len()));
+    }
+    let (mut embedder, query_embeddings) = embed_queries(&index_root, &resolved_model, queries)?;
+    if query_embeddings.len() != queries.len() {
+        return Err(CcError::Embedding(format!(
+            "Model '{}' returned {} vectors for {} queries",
+            resolved_model.alias,
+            query_embeddings.len(),
+            queries.len()
+        ))
+        .into());
+    }
+
+    let mut caches: Vec<Option<(String, String)>> = per_query
+        .iter()
+        .zip(&query_embeddings)
+        .map(|(options, embedding)| cache_slot(options, &index_root, &resolved_model, embedding))
+        .collect();
+    let mut results: Vec<Option<cs_core::SearchResults>> = caches
+        .iter()
+        .map(|cache| {
+            let (generation, key) = cache.as_ref()?;
+            super::query_cache::lookup(&index_root, generation, key)
+        })
+        .collect();
+    let pending: Vec<usize> = (0..queries.len())
+        .filter(|&i| results[i].is_none())
+        .collect();
+    if pending.is_empty() {
+        return Ok(results.into_iter().flatten().collect());
+    }
+
+    let query_dims = query_embeddings[0].len();
+    let mut warnings = Vec::new();
+    let file_chunks = load_candidates(
+        options,
+        &index_root,
+        &mut embedder,
+        &resolved_model,
+        query_dims,
+        None,
+        progress,
+        &mut warnings,
+    )?;
+
+    if let Some(callback) = progress {
+        callback(&format!(
+            "Scoring {} chunks for {} queries...",
+            file_chunks.len(),
+            pending.len()
+        ));
+    }
+    let scoring =
+        tracing::info_span!("score", chunks = file_chunks.len(), queries = pending.len()).entered();
+
+    let truncate_dims = options
+        .truncate_dims
+        .filter(|&dims| dims > 0 && dims < query_dims);
+    // Hits kept per query; everything when there's no top k
+    let keep = match (options.top_k, truncate_dims) {
+        (Some(_), Some(_)) => matryoshka_candidate_count(options.top_k, file_chunks.len()),
+        (Some(top_k), None) => top_k,
+        (None, _) => file_chunks.len(),
+    };
+    let mut similarities: Vec<Vec<(f32, &PathBuf, &cs_index::ChunkEntry)>> =
+        vec![Vec::new(); pending.len()];
+
+    // Each chunk is scored against every query while its vector is in cache
+    for (file_path, chunk) in &file_chunks {
+        for (hits, &i) in similarities.iter_mut().zip(&pending) {
+            if let Some(similarity) = chunk_similarity(
+                &query_embeddings[i],
+                chunk,
+                truncate_dims,
+                &per_query[i].query,
+            ) {
+                hits.push((similarity, file_path, chunk));
+                if hits.len() >= keep.saturating_mul(2).max(STREAM_BATCH_SIZE) {
+                    keep_best(hits, keep);
+                }
+            }
+        }
+    }
+    for hits in &mut similarities {
+        keep_best(hits, keep);
+        hits.sort_by(by_rank);
+    }
+    if let Some(dims) = truncate_dims {
+        for (hits, &i) in similarities.iter_mut().zip(&pending) {
+            rescore_at_full_dimension(&per_query[i], &query_embeddings[i], hits, dims, None);
+        }
+    }
+    for (hits, &i) in similarities.iter_mut().zip(&pending) {
+        if super::sparse_search::fuse(
+            &index_root,
+            &per_query[i],
+            &file_chunks,
+            hits,
+            |_, chunk| chunk_similarity(&query_embeddings[i], chunk, None, &per_query[i].query),
+            None,
+        ) {
+            hits.sort_by(by_rank);
+        }
+    }
+    drop(scoring);
+
+    for (hits, i) in similarities.into_iter().zip(pending) {
+        let plan = cs_core::QueryPlan {
+            strategy: cs_core::QueryStrategy::BruteForce,
+            candidates: file_chunks.len(),
+            scored: file_chunks.len(),
+            top_k: options.top_k,
+            reason: format!(
+                "scored in one pass over the index with {} other queries",
+                queries.len() - 1
+            ),
+        };
+        let cache = caches[i].take().filter(|_| warnings.is_empty());
+        let mut query_results = finish(
+            &per_query[i],
+            &index_root,
+            &resolved_model,
+            &query_embeddings[i],
+            None,
+            hits,
+            plan,
+            cache,
+            progress,
+        )
+        .await?;
+        query_results.warnings = warnings.clone();
+        results[i] = Some(query_results);
+    }
+    Ok(results.into_iter().flatten().collect())
+}
+
+/// The root of the index searching `options.path` reads, which must exist.
+fn search_index_root(options: &SearchOptions) -> Result<PathBuf> {
     let index_root = find_nearest_index_root(&options.path).unwrap_or_else(|| {
         if options.path.is_file() {
             options.path.parent().unwrap_or(&options.path).to_path_buf()
@@ -26,141 +387,351 @@ pub async fn semantic_search_v3_with_progress(
         }
     });
 
-    let index_dir = index_root.join(".cs");
-    if !index_dir.exists() {
+    if !cs_core::locations::index_dir(&index_root).exists() {
         return Err(CcError::Index(
             "Index creation failed. Please try running 'cs --index' explicitly.".to_string(),
         )
         .into());
     }
+    Ok(index_root)
+}
+
+fn load_model(
+    index_root: &Path,
+    options: &SearchOptions,
+    progress_callback: Option<&SearchProgressCallback>,
+) -> Result<super::ResolvedModel> {
+    if let Some(callback) = progress_callback {
+        callback("Loading embedding model...");
+    }
+
+    let resolved_model = resolve_model_from_root(index_root, options.embedding_model.as_deref())?;
+    if let Some(callback) = progress_callback {
+        callback(&format!(
+            "Using embedding model {} ({} dims)",
+            resolved_model.alias, resolved_model.dimensions
+        ));
+    }
+    Ok(resolved_model)
+}
+
+/// Create the index's embedder and embed `queries` with it in one call.
+fn embed_queries(
+    index_root: &Path,
+    resolved_model: &super::ResolvedModel,
+    queries: &[String],
+) -> Result<(Box<dyn cs_embed::Embedder>, Vec<Vec<f32>>)> {
+    let _span = tracing::info_span!(
+        "embed_query",
+        model = %resolved_model.canonical_name,
+        queries = queries.len()
+    )
+    .entered();
+    let mut embedder = cs_embed::create_embedder(Some(resolved_model.canonical_name.as_str()))?;
+
+    // Remote embedders saw redacted chunks, so they get the queries redacted the same way
+    let queries = queries
+        .iter()
+        .map(|query| cs_index::redaction::prepare_query(&*embedder, index_root, query))
+        .collect::<Result<Vec<_>>>()?;
+    let query_embeddings = embedder.embed(&queries)?;
+    Ok((embedder, query_embeddings))
+}
+
+/// Where the results of this query are cached, if they may be.
+fn cache_slot(
+    options: &SearchOptions,
+    index_root: &Path,
+    resolved_model: &super::ResolvedModel,
+    query_embedding: &[f32],
+) -> Option<(String, String)> {
+    // Results depend only on the index and the query, unless dirty files are overlaid.
+    // Cached previews are source text, which an encrypted index keeps off disk
+    (!options.no_query_cache
+        && !options.explain_plan
+        && !options.explain_scores
+        && !options.no_index_update
+        && !cs_index::bundle::is_sealed(index_root)
+        && !cs_index::encryption::is_encrypted(index_root))
+    .then(|| {
+        (
+            cs_index::index_generation(index_root),
+            super::query_cache::cache_key(
+                &resolved_model.canonical_name,
+                query_embedding,
+                options,
+                index_root,
+            ),
+        )
+    })
+}
 
-    if let Some(ref callback) = progress_callback {
+/// The embedded chunks the search scores: the index's, with the working tree
+/// overlaid when it wasn't updated, narrowed by every filter that can be
+/// decided before scoring. Parts of the index that couldn't be read are
+/// described in `warnings`.
+#[allow(clippy::too_many_arguments)]
+fn load_candidates(
+    options: &SearchOptions,
+    index_root: &Path,
+    embedder: &mut Box<dyn cs_embed::Embedder>,
+    resolved_model: &super::ResolvedModel,
+    query_dims: usize,
+    mut migrating: Option<&mut Migrating>,
+    progress_callback: Option<&SearchProgressCallback>,
+    warnings: &mut Vec<String>,
+) -> Result<Vec<(PathBuf, cs_index::ChunkEntry)>> {
+    if let Some(callback) = progress_callback {
         callback("Loading embeddings from sidecar files...");
     }
 
-    // Collect all sidecar files and their embeddings
-    let mut file_chunks: Vec<(std::path::PathBuf, cs_index::ChunkEntry)> = Vec::new();
+    let retrieve = tracing::info_span!("retrieve", chunks = tracing::field::Empty);
+    let retrieving = retrieve.enter();
 
-    for entry in WalkDir::new(&index_dir) {
-        let entry = entry?;
-        if entry.file_type().is_file() {
-            let path = entry.path();
-            if path.extension().and_then(|s| s.to_str()) == Some("cs") {
-                // Load the sidecar file
-                if let Ok(index_entry) = cs_index::load_index_entry(path) {
-                    let original_file = reconstruct_original_path(path, &index_dir, &index_root);
-                    if let Some(original_file) = original_file {
-                        if !super::path_matches_include(&original_file, &options.include_patterns) {
-                            continue;
-                        }
-                        for chunk in index_entry.chunks {
-                            if chunk.embedding.is_some() {
-                                file_chunks.push((original_file.clone(), chunk));
-                            }
-                        }
-                    }
-                }
-            }
+    // Collect all sidecar files and their embeddings. A damaged part of the
+    // index is skipped, so the search still returns what the rest holds
+    let index_dir = cs_core::locations::index_dir(index_root);
+    let mut damage = Vec::new();
+    let mut file_chunks = load_embedded_chunks(&index_dir, index_root, options, &mut damage)?;
+    // Files a model migration got to are searched by their new-model chunks
+    if let Some(migrating) = migrating.as_deref_mut() {
+        migrating.replace_chunks(
+            |file| super::path_matches_include(file, &options.include_patterns),
+            &mut file_chunks,
+        );
+    }
+
+    // Sharded index: scatter the load over the shards the search can reach
+    if cs_index::shards::is_sharded(index_root) {
+        use rayon::prelude::*;
+
+        let (shards, unreadable) = cs_index::shards::list_readable_shards(index_root)?;
+        let shards: Vec<cs_index::shards::Shard> = shards
+            .into_iter()
+            .filter(|shard| {
+                cs_index::shards::shard_in_scope(index_root, &shard.name, &options.path)
+            })
+            .collect();
+        damage.extend(
+            unreadable
+                .into_iter()
+                .filter(|name| cs_index::shards::shard_in_scope(index_root, name, &options.path))
+                .map(|name| format!("shard {} has an unreadable manifest and was skipped", name)),
+        );
+        if let Some(callback) = progress_callback {
+            callback(&format!("Loading {} index shards...", shards.len()));
+        }
+        let loaded: Vec<(Vec<(PathBuf, cs_index::ChunkEntry)>, Vec<String>)> = shards
+            .par_iter()
+            .map(|shard| {
+                let mut shard_damage = Vec::new();
+                let chunks =
+                    load_embedded_chunks(&shard.dir, index_root, options, &mut shard_damage)
+                        .unwrap_or_else(|e| {
+                            shard_damage.push(format!("shard {} was skipped: {}", shard.name, e));
+                            Vec::new()
+                        });
+                (chunks, shard_damage)
+            })
+            .collect();
+        for (chunks, shard_damage) in loaded {
+            file_chunks.extend(chunks);
+            damage.extend(shard_damage);
         }
     }
 
-    if file_chunks.is_empty() {
+    if file_chunks.is_empty() && !options.no_index_update {
+        if !damage.is_empty() {
+            return Err(CcError::Index(format!(
+                "The index couldn't be read: {}; {}",
+                damage.join("; "),
+                cs_index::REPAIR_HINT
+            ))
+            .into());
+        }
         return Err(CcError::Index(
             "No embeddings found. Run 'cs --index' first with embeddings.".to_string(),
         )
         .into());
     }
+    if !damage.is_empty() {
+        warnings.push(format!(
+            "Part of the index couldn't be read ({}), so results come from the rest; {}",
+            damage.join("; "),
+            cs_index::REPAIR_HINT
+        ));
+    }
 
-    if let Some(ref callback) = progress_callback {
+    if let Some(callback) = progress_callback {
         callback(&format!(
             "Found {} chunks with embeddings",
             file_chunks.len()
         ));
     }
 
-    // Create embedder and embed the query
-    if let Some(ref callback) = progress_callback {
-        callback("Loading embedding model...");
-    }
+    // The index wasn't refreshed before this search: embed files edited since
+    // the last update in memory so results still reflect the working tree
+    let search_code = cs_index::collections::includes_code(&options.collections);
+    if options.no_index_update && search_code {
+        overlay_dirty_files(
+            options,
+            index_root,
+            embedder,
+            &mut file_chunks,
+            migrating.as_deref_mut(),
+            progress_callback,
+        )?;
 
-    let resolved_model = resolve_model_from_root(&index_root, options.embedding_model.as_deref())?;
-    if let Some(ref callback) = progress_callback {
-        callback(&format!(
-            "Using embedding model {} ({} dims)",
-            resolved_model.alias, resolved_model.dimensions
-        ));
+        if file_chunks.is_empty() {
+            return Err(CcError::Index(
+                "No embeddings found. Run 'cs --index' first with embeddings.".to_string(),
+            )
+            .into());
+        }
     }
 
-    let mut embedder = cs_embed::create_embedder(Some(resolved_model.canonical_name.as_str()))?;
-    let query_embeddings = embedder.embed(std::slice::from_ref(&options.query))?;
-
-    if query_embeddings.is_empty() {
-        return Ok(cs_core::SearchResults {
-            matches: Vec::new(),
-            closest_below_threshold: None,
+    // Generated code is left out before ranking, so it can't crowd the top k
+    if !options.include_generated {
+        file_chunks.retain(|(_, chunk)| !chunk.generated);
+    }
+    // Only other collections were asked for
+    if !search_code {
+        file_chunks.clear();
+    }
+    // Path scope, --facet, --license, --meta, --tag, --must-match and
+    // --infer-lang restrict filters narrow the candidates too, so the top k is
+    // filled from chunks that match rather than emptied after ranking
+    retain_in_path(options, &mut file_chunks);
+    if let Some(language) = super::query_language::restricted_to(options) {
+        file_chunks.retain(|(file, _)| super::query_language::is_in(language, file));
+    }
+    super::facets::retain_matching_chunks(&options.facet_filters, index_root, &mut file_chunks);
+    if !options.license_filters.is_empty() {
+        file_chunks.retain(|(_, chunk)| {
+            cs_index::licenses::permits(chunk.license.as_deref(), &options.license_filters)
+        });
+    }
+    if !options.metadata_filters.is_empty() {
+        file_chunks.retain(|(_, chunk)| {
+            options
+                .metadata_filters
+                .iter()
+                .all(|filter| filter.matches(&chunk.metadata))
         });
     }
+    if !options.tag_filters.is_empty() {
+        file_chunks
+            .retain(|(_, chunk)| cs_index::intent_tags::carries(&chunk.tags, &options.tag_filters));
+    }
+    if let Some(regex) = super::must_match::compile(options)? {
+        super::must_match::retain_matching_chunks(&regex, &mut file_chunks);
+    }
 
-    let query_embedding = &query_embeddings[0];
+    check_embedding_dimensions(
+        &file_chunks,
+        query_dims,
+        resolved_model,
+        migrating.as_deref(),
+    )?;
+    retrieve.record("chunks", file_chunks.len());
+    drop(retrieving);
+    Ok(file_chunks)
+}
 
-    if let Some(ref callback) = progress_callback {
-        callback("Computing similarity scores...");
+/// Matryoshka second pass: re-score the best candidates of a truncated first
+/// pass with the full vectors.
+fn rescore_at_full_dimension(
+    options: &SearchOptions,
+    query_embedding: &[f32],
+    similarities: &mut Vec<(f32, &PathBuf, &cs_index::ChunkEntry)>,
+    dims: usize,
+    progress_callback: Option<&SearchProgressCallback>,
+) {
+    if let Some(callback) = progress_callback {
+        callback(&format!(
+            "Re-scoring top candidates at full dimension (first pass used {} dims)",
+            dims
+        ));
     }
 
-    // Compute similarities
-    let mut similarities: Vec<(f32, &std::path::PathBuf, &cs_index::ChunkEntry)> = Vec::new();
-
-    for (file_path, chunk) in &file_chunks {
-        if let Some(ref embedding) = chunk.embedding {
-            let similarity = cosine_similarity(query_embedding, embedding);
-            similarities.push((similarity, file_path, chunk));
+    let candidates = matryoshka_candidate_count(options.top_k, similarities.len());
+    similarities.truncate(candidates);
+    for (similarity, _, chunk) in similarities.iter_mut() {
+        if let Some(full) = chunk_similarity(query_embedding, chunk, None, &options.query) {
+            *similarity = full;
         }
     }
+    similarities.sort_by(by_rank);
+}
 
-    // Sort by similarity (highest first)
-    similarities.sort_by(|a, b| b.0.partial_cmp(&a.0).unwrap_or(std::cmp::Ordering::Equal));
+/// Drop all but the `keep` best of `hits`, in no particular order.
+fn keep_best(hits: &mut Vec<(f32, &PathBuf, &cs_index::ChunkEntry)>, keep: usize) {
+    if hits.len() > keep && keep > 0 {
+        hits.select_nth_unstable_by(keep - 1, by_rank);
+    }
+    hits.truncate(keep);
+}
+
+/// Scored chunks in result order (see [`SearchResult::rank_cmp`]), so ties at
+/// the top k cutoff keep the same chunks from run to run.
+fn by_rank(
+    a: &(f32, &PathBuf, &cs_index::ChunkEntry),
+    b: &(f32, &PathBuf, &cs_index::ChunkEntry),
+) -> std::cmp::Ordering {
+    b.0.total_cmp(&a.0)
+        .then_with(|| a.1.cmp(b.1))
+        .then_with(|| a.2.span.line_start.cmp(&b.2.span.line_start))
+}
+
+/// Ranked hits with the outline and sections of a long declaration folded
+/// into one hit on all of it, at the best of their scores.
+fn fold_sections<'a>(
+    similarities: Vec<(f32, &'a PathBuf, &'a cs_index::ChunkEntry)>,
+) -> Vec<(f32, &'a PathBuf, &'a cs_core::Span)> {
+    let mut declarations = std::collections::HashSet::new();
+    similarities
+        .into_iter()
+        .filter_map(|(similarity, file_path, chunk)| match &chunk.parent {
+            Some(parent) => declarations
+                .insert((file_path, parent))
+                .then_some((similarity, file_path, parent)),
+            None => Some((similarity, file_path, &chunk.span)),
+        })
+        .collect()
+}
+
+/// Turn ranked `similarities` into the final results: threshold and top k,
+/// previews, commit and collection matches, reranking, then the cache.
+#[allow(clippy::too_many_arguments)]
+async fn finish(
+    options: &SearchOptions,
+    index_root: &Path,
+    resolved_model: &super::ResolvedModel,
+    query_embedding: &[f32],
+    migrating: Option<&Migrating>,
+    similarities: Vec<(f32, &PathBuf, &cs_index::ChunkEntry)>,
+    plan: cs_core::QueryPlan,
+    cache: Option<(String, String)>,
+    progress_callback: Option<&SearchProgressCallback>,
+) -> Result<cs_core::SearchResults> {
+    let search_code = cs_index::collections::includes_code(&options.collections);
 
     // Apply threshold and top_k filtering
     let mut results = Vec::new();
     let mut closest_below_threshold: Option<SearchResult> = None;
     let limit = options.top_k.unwrap_or(similarities.len());
+    let mut explanations = options
+        .explain_scores
+        .then(|| explain_dense(options, query_embedding, migrating, &similarities, limit));
 
-    for (similarity, file_path, chunk) in similarities.into_iter().take(limit) {
+    for (similarity, file_path, span) in fold_sections(similarities).into_iter().take(limit) {
         let is_below_threshold = options
             .threshold
             .is_some_and(|threshold| similarity < threshold);
 
-        // Check if we're filtering by a specific file or directory (apply to both above/below threshold)
-        let passes_path_filter = if options.path.is_file() {
-            let target_file = options
-                .path
-                .canonicalize()
-                .unwrap_or_else(|_| options.path.clone());
-            let result_file = file_path
-                .canonicalize()
-                .unwrap_or_else(|_| file_path.clone());
-            result_file == target_file
-        } else if options.path != Path::new(".") {
-            // Filter by directory path - only include files within the specified directory
-            let target_dir = options
-                .path
-                .canonicalize()
-                .unwrap_or_else(|_| options.path.clone());
-            let result_file = file_path
-                .canonicalize()
-                .unwrap_or_else(|_| file_path.clone());
-            result_file.starts_with(&target_dir)
-        } else {
-            true
-        };
-
-        if !passes_path_filter {
-            continue;
-        }
-
         // Extract content from the file using the span, skip if file doesn't exist
         let content = if options.full_section {
-            match extract_content_from_span(file_path, &chunk.span).await {
+            match extract_content_from_span(file_path, span).await {
                 Ok(content) => content,
                 Err(_) => {
                     // Skip files that no longer exist (stale index entries)
@@ -168,7 +739,7 @@ pub async fn semantic_search_v3_with_progress(
                 }
             }
         } else {
-            match extract_content_from_span(file_path, &chunk.span).await {
+            match extract_content_from_span(file_path, span).await {
                 Ok(full_content) => {
                     // Take first 3 lines for preview
                     full_content.lines().take(3).collect::<Vec<_>>().join("\n")
@@ -182,7 +753,7 @@ pub async fn semantic_search_v3_with_progress(
 
         let search_result = SearchResult {
             file: file_path.clone(),
-            span: chunk.span.clone(),
+            span: span.clone(),
             score: similarity,
             preview: content,
             lang: cs_core::Language::from_path(file_path),
@@ -202,9 +773,41 @@ pub async fn semantic_search_v3_with_progress(
         }
     }
 
+    // Commit messages indexed with --index-commits and text collections
+    // piped in with --stdin compete for the same slots
+    let mut extra = if search_code {
+        super::commit_search::commit_matches(
+            options,
+            index_root,
+            &resolved_model.canonical_name,
+            query_embedding,
+        )
+    } else {
+        Vec::new()
+    };
+    extra.extend(super::collection_search::collection_matches(
+        options,
+        index_root,
+        &resolved_model.canonical_name,
+        query_embedding,
+    ));
+    if !extra.is_empty() {
+        if let Some(explanations) = explanations.as_mut() {
+            explanations.extend(super::score_explain::from_scores(&options.mode, &extra));
+        }
+        results.extend(extra);
+        results.sort_by(SearchResult::rank_cmp);
+        if let Some(limit) = options.top_k {
+            results.truncate(limit);
+        }
+    }
+    let before_rerank = explanations
+        .is_some()
+        .then(|| super::score_explain::scores(&results));
+
     // Apply reranking if enabled
     if options.rerank && !results.is_empty() {
-        if let Some(ref callback) = progress_callback {
+        if let Some(callback) = progress_callback {
             callback("Reranking results for improved relevance...");
         }
 
@@ -227,6 +830,9 @@ pub async fn semantic_search_v3_with_progress(
             None => Some("jina-reranker-v2-base-multilingual"),
         };
 
+        let _span =
+            tracing::info_span!("rerank", model = rerank_model_name, results = results.len())
+                .entered();
         match cs_embed::create_reranker(rerank_model_name) {
             Ok(mut reranker) => {
                 let documents: Vec<String> = results.iter().map(|r| r.preview.clone()).collect();
@@ -254,11 +860,7 @@ pub async fn semantic_search_v3_with_progress(
                         }
 
                         // Re-sort by reranked scores
-                        results.sort_by(|a, b| {
-                            b.score
-                                .partial_cmp(&a.score)
-                                .unwrap_or(std::cmp::Ordering::Equal)
-                        });
+                        results.sort_by(SearchResult::rank_cmp);
 
                         // Apply top_k limit again after reranking
                         if let Some(limit) = options.top_k {
@@ -276,10 +878,353 @@ pub async fn semantic_search_v3_with_progress(
         }
     }
 
-    Ok(cs_core::SearchResults {
+    if let (Some(explanations), Some(before)) = (explanations.as_mut(), &before_rerank) {
+        for (key, delta) in super::score_explain::changes(before, &results) {
+            explanations.entry(key).or_default().rerank = Some(delta);
+        }
+    }
+
+    let results = cs_core::SearchResults {
         matches: results,
         closest_below_threshold,
-    })
+        plan: Some(plan),
+        explanations,
+        warnings: Vec::new(),
+        facets: None,
+    };
+    if let Some((generation, key)) = &cache
+        && let Err(e) = super::query_cache::store(index_root, generation, key, &results)
+    {
+        tracing::debug!("Failed to cache query results: {}", e);
+    }
+    Ok(results)
+}
+
+/// The dense score of each hit among the first `limit` results, and what
+/// sparse scores added to it. Hits are keyed the way [`fold_sections`] keys
+/// them, at the best score of a folded declaration.
+fn explain_dense(
+    options: &SearchOptions,
+    query_embedding: &[f32],
+    migrating: Option<&Migrating>,
+    similarities: &[(f32, &PathBuf, &cs_index::ChunkEntry)],
+    limit: usize,
+) -> cs_core::ScoreExplanations {
+    let mut explanations = cs_core::ScoreExplanations::new();
+    for &(similarity, file_path, chunk) in similarities {
+        if explanations.len() >= limit {
+            break;
+        }
+        let span = chunk.parent.as_ref().unwrap_or(&chunk.span);
+        let key = (file_path.clone(), span.line_start);
+        if explanations.contains_key(&key) {
+            continue;
+        }
+        let dense = file_similarity(
+            query_embedding,
+            migrating,
+            file_path,
+            chunk,
+            None,
+            &options.query,
+        )
+        .unwrap_or(similarity);
+        let sparse = similarity - dense;
+        explanations.insert(
+            key,
+            cs_core::ScoreExplanation {
+                dense: Some(dense),
+                sparse: (sparse > 1e-6).then_some(sparse),
+                ..Default::default()
+            },
+        );
+    }
+    explanations
+}
+
+/// Replace stale sidecar chunks of working-tree files that changed since the
+/// last index update with freshly embedded in-memory chunks, and drop those of
+/// files deleted since.
+fn overlay_dirty_files(
+    options: &SearchOptions,
+    index_root: &Path,
+    embedder: &mut Box<dyn cs_embed::Embedder>,
+    file_chunks: &mut Vec<(std::path::PathBuf, cs_index::ChunkEntry)>,
+    migrating: Option<&mut Migrating>,
+    progress_callback: Option<&SearchProgressCallback>,
+) -> Result<()> {
+    let dirty_files = cs_index::find_dirty_files(
+        &options.path,
+        options.respect_gitignore,
+        &options.exclude_patterns,
+    )?;
+    let dirty_files = super::filter_files_by_include(dirty_files, &options.include_patterns);
+    if !dirty_files.is_empty()
+        && let Some(callback) = progress_callback
+    {
+        callback(&format!(
+            "Embedding {} files changed since the last index update...",
+            dirty_files.len()
+        ));
+    }
+
+    let canonical =
+        |path: &Path| cs_core::paths::canonicalize(path).unwrap_or_else(|_| path.to_path_buf());
+    let dirty_set: HashSet<PathBuf> = dirty_files.iter().map(|p| canonical(p)).collect();
+    // Files deleted since the last update go with their chunks
+    let is_stale = |file: &Path| {
+        dirty_set.contains(&canonical(file)) || (file.starts_with(index_root) && !file.exists())
+    };
+
+    let mut stale: HashMap<PathBuf, bool> = HashMap::new();
+    file_chunks.retain(|(file, _)| !*stale.entry(file.clone()).or_insert_with(|| is_stale(file)));
+    // Their new chunks are embedded with the index's model
+    if let Some(migrating) = migrating {
+        migrating.forget(is_stale);
+    }
+
+    for file in &dirty_files {
+        match cs_index::index_file_in_memory(file, index_root, embedder) {
+            Ok(entry) => file_chunks.extend(
+                entry
+                    .chunks
+                    .into_iter()
+                    .filter(|chunk| chunk.embedding.is_some())
+                    .map(|chunk| (file.clone(), chunk)),
+            ),
+            Err(e) => tracing::debug!("Skipping {:?} in working-tree overlay: {}", file, e),
+        }
+    }
+
+    Ok(())
+}
+
+/// Whether `file_path` lies within the file or directory being searched.
+fn passes_path_filter(options: &SearchOptions, file_path: &Path) -> bool {
+    if options.path.is_file() {
+        let target_file =
+            cs_core::paths::canonicalize(&options.path).unwrap_or_else(|_| options.path.clone());
+        let result_file =
+            cs_core::paths::canonicalize(file_path).unwrap_or_else(|_| file_path.to_path_buf());
+        cs_core::paths::paths_equal(&result_file, &target_file)
+    } else if options.path != Path::new(".") {
+        // Filter by directory path - only include files within the specified directory
+        let target_dir =
+            cs_core::paths::canonicalize(&options.path).unwrap_or_else(|_| options.path.clone());
+        let result_file =
+            cs_core::paths::canonicalize(file_path).unwrap_or_else(|_| file_path.to_path_buf());
+        cs_core::paths::starts_with(&result_file, &target_dir)
+    } else {
+        true
+    }
+}
+
+/// Keep the chunks of files within the file or directory being searched.
+fn retain_in_path(options: &SearchOptions, chunks: &mut Vec<(PathBuf, cs_index::ChunkEntry)>) {
+    if options.path == Path::new(".") {
+        return;
+    }
+    // Chunks of a file are next to each other, so one check covers them
+    let mut last: Option<(PathBuf, bool)> = None;
+    chunks.retain(|(file_path, _)| match &last {
+        Some((path, passes)) if path == file_path => *passes,
+        _ => {
+            let passes = passes_path_filter(options, file_path);
+            last = Some((file_path.clone(), passes));
+            passes
+        }
+    });
+}
+
+/// The best hits scored so far, kept while streaming provisional results.
+struct ProvisionalTopK<'a> {
+    limit: usize,
+    /// Highest score first
+    hits: Vec<(f32, &'a PathBuf, &'a cs_index::ChunkEntry)>,
+}
+
+impl<'a> ProvisionalTopK<'a> {
+    fn new(limit: usize) -> Self {
+        Self {
+            limit,
+            hits: Vec::new(),
+        }
+    }
+
+    /// Merge newly scored chunks, returning whether the best hits changed.
+    fn offer(
+        &mut self,
+        options: &SearchOptions,
+        scored: &[(f32, &'a PathBuf, &'a cs_index::ChunkEntry)],
+    ) -> bool {
+        let mut changed = false;
+        for &(score, file_path, chunk) in scored {
+            if self.limit == 0 || options.threshold.is_some_and(|threshold| score < threshold) {
+                continue;
+            }
+            let hit = (score, file_path, chunk);
+            let full = self.hits.len() >= self.limit;
+            if full
+                && self
+                    .hits
+                    .last()
+                    .is_some_and(|worst| by_rank(&hit, worst).is_ge())
+            {
+                continue;
+            }
+            let position = self
+                .hits
+                .partition_point(|better| by_rank(better, &hit).is_lt());
+            self.hits.insert(position, hit);
+            self.hits.truncate(self.limit);
+            changed = true;
+        }
+        changed
+    }
+
+    fn snapshot(&self) -> Vec<SearchResult> {
+        self.hits
+            .iter()
+            .map(|(score, file_path, chunk)| SearchResult {
+                file: (*file_path).clone(),
+                span: chunk.span.clone(),
+                score: *score,
+                preview: String::new(),
+                lang: cs_core::Language::from_path(file_path),
+                symbol: None,
+                chunk_hash: None,
+                index_epoch: None,
+            })
+            .collect()
+    }
+}
+
+/// Refuse to score vectors of a different length instead of silently returning zero scores.
+fn check_embedding_dimensions(
+    file_chunks: &[(std::path::PathBuf, cs_index::ChunkEntry)],
+    query_dims: usize,
+    resolved_model: &super::ResolvedModel,
+    migrating: Option<&Migrating>,
+) -> Result<()> {
+    if query_dims != resolved_model.dimensions {
+        return Err(CcError::Embedding(format!(
+            "Model '{}' produced {}-dim query vectors, but the index manifest records {} dims. Run `cs --switch-model {}` to re-index, or pass the '--model' the index was built with.",
+            resolved_model.alias, query_dims, resolved_model.dimensions, resolved_model.alias
+        ))
+        .into());
+    }
+
+    // Files a model migration got to have the new model's dimensions
+    let mismatched = file_chunks
+        .iter()
+        .filter(|(file, chunk)| {
+            !migrating.is_some_and(|migrating| migrating.covers(file))
+                && chunk
+                    .embedding
+                    .as_ref()
+                    .is_some_and(|embedding| embedding.len() != query_dims)
+        })
+        .count();
+
+    if mismatched > 0 {
+        return Err(CcError::Embedding(format!(
+            "{} indexed chunks have embeddings that don't match the {}-dim vectors of model '{}'. The index mixes embedding models. Run `cs --switch-model {} --force` to rebuild it.",
+            mismatched, query_dims, resolved_model.alias, resolved_model.alias
+        ))
+        .into());
+    }
+
+    Ok(())
+}
+
+/// Embedded chunks of the index in `index_dir` that pass the include filter,
+/// from its segments and sidecars. Shard directories nested in `index_dir`
+/// are left to the caller. What can't be read is skipped and described in
+/// `damage`.
+fn load_embedded_chunks(
+    index_dir: &Path,
+    index_root: &Path,
+    options: &SearchOptions,
+    damage: &mut Vec<String>,
+) -> Result<Vec<(PathBuf, cs_index::ChunkEntry)>> {
+    let shown = index_dir.strip_prefix(index_root).unwrap_or(index_dir);
+    let mut file_chunks = Vec::new();
+    let loaded = cs_index::segments::load_entries(index_dir).unwrap_or_else(|e| {
+        damage.push(format!(
+            "{}'s manifest is unreadable ({}), so only its sidecars were searched",
+            shown.display(),
+            e
+        ));
+        None
+    });
+    if let Some(loaded) = loaded {
+        if !loaded.damaged_segments.is_empty() {
+            damage.push(format!(
+                "{} unreadable segments in {} were skipped",
+                loaded.damaged_segments.len(),
+                shown.display()
+            ));
+        }
+        if !loaded.unreadable.is_empty() {
+            damage.push(format!(
+                "{} files indexed in {} couldn't be read and are missing from the results",
+                loaded.unreadable.len(),
+                shown.display()
+            ));
+        }
+        for (relative, index_entry) in loaded.entries {
+            let original_file = index_root.join(relative);
+            if !super::path_matches_include(&original_file, &options.include_patterns) {
+                continue;
+            }
+            for chunk in index_entry.chunks {
+                if chunk.embedding.is_some() {
+                    file_chunks.push((original_file.clone(), chunk));
+                }
+            }
+        }
+        return Ok(file_chunks);
+    }
+
+    // An index from before segments, until its next update packs one
+    let shards_dir = index_dir.join(cs_index::shards::SHARDS_DIR);
+    let mut unreadable = 0;
+    for entry in WalkDir::new(index_dir)
+        .into_iter()
+        .filter_entry(|e| e.path() != shards_dir)
+    {
+        let entry = entry?;
+        if entry.file_type().is_file() {
+            let path = entry.path();
+            if path.extension().and_then(|s| s.to_str()) == Some("cs") {
+                // Load the sidecar file
+                let Ok(index_entry) = cs_index::load_index_entry(path) else {
+                    unreadable += 1;
+                    continue;
+                };
+                let original_file = reconstruct_original_path(path, index_dir, index_root);
+                if let Some(original_file) = original_file {
+                    if !super::path_matches_include(&original_file, &options.include_patterns) {
+                        continue;
+                    }
+                    for chunk in index_entry.chunks {
+                        if chunk.embedding.is_some() {
+                            file_chunks.push((original_file.clone(), chunk));
+                        }
+                    }
+                }
+            }
+        }
+    }
+    if unreadable > 0 {
+        damage.push(format!(
+            "{} unreadable sidecars in {} were skipped",
+            unreadable,
+            shown.display()
+        ));
+    }
+
+    Ok(file_chunks)
 }
 
 fn reconstruct_original_path(
@@ -304,18 +1249,478 @@ fn reconstruct_original_path(
     Some(repo_root.join(original_path))
 }
 
-fn cosine_similarity(a: &[f32], b: &[f32]) -> f32 {
+/// Cosine similarity with the CPU's SIMD kernel (see [`cs_ann::simd`]).
+pub(crate) fn cosine_similarity(a: &[f32], b: &[f32]) -> f32 {
+    cs_ann::simd::cosine(a, b)
+}
+
+/// How close `chunk` is to the query: the best of its code, its string
+/// literals, its weighted signature and, on a multi-vector index, each of its
+/// statement groups (MaxSim), or [`MESSAGE_MATCH_SCORE`] when the query fills
+/// in one of its literals.
+fn chunk_similarity(
+    query_embedding: &[f32],
+    chunk: &cs_index::ChunkEntry,
+    truncate_dims: Option<usize>,
+    query: &str,
+) -> Option<f32> {
+    let similarity = dense_similarity(query_embedding, chunk, truncate_dims)?;
+    Some(with_message_match(similarity, chunk, query))
+}
+
+/// [`chunk_similarity`] against the query vector of the model `file` is
+/// embedded with, when the index is migrating between two.
+fn file_similarity(
+    query_embedding: &[f32],
+    migrating: Option<&Migrating>,
+    file: &Path,
+    chunk: &cs_index::ChunkEntry,
+    truncate_dims: Option<usize>,
+    query: &str,
+) -> Option<f32> {
+    match migrating {
+        Some(migrating) if migrating.covers(file) => migrating.similarity(chunk, query),
+        _ => chunk_similarity(query_embedding, chunk, truncate_dims, query),
+    }
+}
+
+/// The best similarity of `chunk`'s vectors to `query_embedding`.
+pub(crate) fn dense_similarity(
+    query_embedding: &[f32],
+    chunk: &cs_index::ChunkEntry,
+    truncate_dims: Option<usize>,
+) -> Option<f32> {
+    let similarity = |embedding: &[f32]| match truncate_dims {
+        Some(dims) => truncated_cosine_similarity(query_embedding, embedding, dims),
+        None => cosine_similarity(query_embedding, embedding),
+    };
+    let mut best = similarity(chunk.embedding.as_deref()?);
+    if let Some(ref literal_embedding) = chunk.literal_embedding {
+        best = best.max(similarity(literal_embedding));
+    }
+    if let Some(ref signature_embedding) = chunk.signature_embedding {
+        best = best.max(cs_index::signatures::SIGNATURE_WEIGHT * similarity(signature_embedding));
+    }
+    for sub_embedding in &chunk.sub_embeddings {
+        best = best.max(similarity(sub_embedding));
+    }
+    Some(best)
+}
+
+/// `similarity`, raised to [`MESSAGE_MATCH_SCORE`] when `query` fills in one
+/// of `chunk`'s literals.
+pub(crate) fn with_message_match(
+    similarity: f32,
+    chunk: &cs_index::ChunkEntry,
+    query: &str,
+) -> f32 {
+    if similarity < MESSAGE_MATCH_SCORE
+        && chunk
+            .literals
+            .iter()
+            .any(|literal| cs_index::literals::matches_message(literal, query))
+    {
+        return MESSAGE_MATCH_SCORE;
+    }
+    similarity
+}
+
+/// Cosine similarity over the first `dims` components (Matryoshka prefix).
+fn truncated_cosine_similarity(a: &[f32], b: &[f32], dims: usize) -> f32 {
     if a.len() != b.len() {
         return 0.0;
     }
+    let dims = dims.min(a.len());
+    cosine_similarity(&a[..dims], &b[..dims])
+}
 
-    let dot_product: f32 = a.iter().zip(b.iter()).map(|(x, y)| x * y).sum();
-    let norm_a: f32 = a.iter().map(|x| x * x).sum::<f32>().sqrt();
-    let norm_b: f32 = b.iter().map(|x| x * x).sum::<f32>().sqrt();
+/// Number of first-pass candidates kept for full-dimension re-scoring.
+fn matryoshka_candidate_count(top_k: Option<usize>, total: usize) -> usize {
+    const MIN_CANDIDATES: usize = 100;
+    const OVERSAMPLE: usize = 4;
 
-    if norm_a == 0.0 || norm_b == 0.0 {
-        0.0
-    } else {
-        dot_product / (norm_a * norm_b)
+    let wanted = top_k
+        .map(|k| k.saturating_mul(OVERSAMPLE).max(MIN_CANDIDATES))
+        .unwrap_or(total);
+    wanted.min(total)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn truncated_similarity_only_uses_prefix() {
+        let a = [1.0, 0.0, 5.0, -3.0];
+        let b = [1.0, 0.0, -5.0, 3.0];
+        assert!((truncated_cosine_similarity(&a, &b, 2) - 1.0).abs() < 1e-6);
+        assert!(cosine_similarity(&a, &b) < 0.0);
+        // Requesting more dims than available falls back to the full vector
+        assert_eq!(
+            truncated_cosine_similarity(&a, &b, 16),
+            cosine_similarity(&a, &b)
+        );
+    }
+
+    #[test]
+    fn matryoshka_candidates_oversample_top_k() {
+        assert_eq!(matryoshka_candidate_count(Some(10), 1000), 100);
+        assert_eq!(matryoshka_candidate_count(Some(50), 1000), 200);
+        assert_eq!(matryoshka_candidate_count(Some(50), 120), 120);
+        assert_eq!(matryoshka_candidate_count(None, 42), 42);
+    }
+
+    #[test]
+    fn provisional_top_k_keeps_the_best_hits_above_threshold() {
+        let chunk = |line: usize| cs_index::ChunkEntry {
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: line,
+                line_end: line,
+            },
+            embedding: None,
+            chunk_type: None,
+            breadcrumb: None,
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: Vec::new(),
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: None,
+            sub_embeddings: Vec::new(),
+            sparse: None,
+            parent: None,
+            signature: None,
+            signature_embedding: None,
+            tags: Vec::new(),
+        };
+        let file = PathBuf::from("src/lib.rs");
+        let chunks: Vec<_> = (1..=4).map(chunk).collect();
+        let options = SearchOptions {
+            threshold: Some(0.5),
+            ..Default::default()
+        };
+
+        let mut top = ProvisionalTopK::new(2);
+        assert!(top.offer(
+            &options,
+            &[(0.6, &file, &chunks[0]), (0.2, &file, &chunks[1])]
+        ));
+        assert!(top.offer(
+            &options,
+            &[(0.9, &file, &chunks[2]), (0.7, &file, &chunks[3])]
+        ));
+        let lines: Vec<usize> = top.snapshot().iter().map(|r| r.span.line_start).collect();
+        assert_eq!(lines, vec![3, 4]);
+
+        // Nothing better arrived, so there's nothing new to stream
+        assert!(!top.offer(&options, &[(0.65, &file, &chunks[0])]));
+    }
+
+    #[test]
+    fn overlay_drops_files_deleted_since_the_last_update() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let root = std::fs::canonicalize(dir.path()).unwrap();
+        let mut manifest = cs_index::IndexManifest::default();
+        for name in ["kept.rs", "gone.rs"] {
+            let file = root.join(name);
+            std::fs::write(&file, format!("fn {}() {{}}\n", name)).unwrap();
+            let key = PathBuf::from(".").join(name);
+            manifest.files.insert(
+                key.clone(),
+                cs_core::FileMetadata {
+                    path: key,
+                    hash: cs_core::compute_file_hash(&file).unwrap(),
+                    last_modified: 0,
+                    size: std::fs::metadata(&file).unwrap().len(),
+                },
+            );
+        }
+        let index_dir = cs_core::locations::index_dir(&root);
+        std::fs::create_dir_all(&index_dir).unwrap();
+        std::fs::write(
+            index_dir.join("manifest.json"),
+            serde_json::to_vec(&manifest).unwrap(),
+        )
+        .unwrap();
+        std::fs::remove_file(root.join("gone.rs")).unwrap();
+
+        let chunk = cs_index::ChunkEntry {
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: 1,
+                line_end: 1,
+            },
+            embedding: Some(vec![0.0; 384]),
+            chunk_type: None,
+            breadcrumb: None,
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: Vec::new(),
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: None,
+            sub_embeddings: Vec::new(),
+            sparse: None,
+            parent: None,
+            signature: None,
+            signature_embedding: None,
+            tags: Vec::new(),
+        };
+        let mut file_chunks = vec![
+            (root.join("kept.rs"), chunk.clone()),
+            (root.join("gone.rs"), chunk),
+        ];
+        let options = SearchOptions {
+            path: root.clone(),
+            no_index_update: true,
+            ..Default::default()
+        };
+        let mut embedder: Box<dyn cs_embed::Embedder> = Box::new(cs_embed::DummyEmbedder::new());
+        overlay_dirty_files(&options, &root, &mut embedder, &mut file_chunks, None, None).unwrap();
+
+        // The unchanged file keeps its indexed chunk; the deleted one is gone
+        let files: Vec<&PathBuf> = file_chunks.iter().map(|(file, _)| file).collect();
+        assert_eq!(files, vec![&root.join("kept.rs")]);
+    }
+
+    #[test]
+    fn keep_best_prunes_to_the_highest_scores() {
+        let chunk = cs_index::ChunkEntry {
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: 1,
+                line_end: 1,
+            },
+            embedding: None,
+            chunk_type: None,
+            breadcrumb: None,
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: Vec::new(),
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: None,
+            sub_embeddings: Vec::new(),
+            sparse: None,
+            parent: None,
+            signature: None,
+            signature_embedding: None,
+            tags: Vec::new(),
+        };
+        let file = PathBuf::from("src/lib.rs");
+        let mut hits: Vec<_> = [0.3, 0.9, 0.1, 0.7, 0.5]
+            .into_iter()
+            .map(|score| (score, &file, &chunk))
+            .collect();
+        keep_best(&mut hits, 2);
+        let mut scores: Vec<f32> = hits.iter().map(|hit| hit.0).collect();
+        scores.sort_by(|a, b| b.partial_cmp(a).unwrap());
+        assert_eq!(scores, vec![0.9, 0.7]);
+
+        keep_best(&mut hits, 5);
+        assert_eq!(hits.len(), 2);
+    }
+
+    #[test]
+    fn sections_of_a_long_function_fold_into_one_hit() {
+        let span = |line_start, line_end| cs_core::Span {
+            byte_start: line_start * 10,
+            byte_end: line_end * 10,
+            line_start,
+            line_end,
+        };
+        let chunk = |span: cs_core::Span, parent: Option<cs_core::Span>| cs_index::ChunkEntry {
+            span,
+            embedding: None,
+            chunk_type: Some("function".to_string()),
+            breadcrumb: None,
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: Vec::new(),
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: None,
+            sub_embeddings: Vec::new(),
+            sparse: None,
+            parent,
+            signature: None,
+            signature_embedding: None,
+            tags: Vec::new(),
+        };
+        let function = span(1, 90);
+        let outline = chunk(function.clone(), Some(function.clone()));
+        let first = chunk(span(1, 40), Some(function.clone()));
+        let second = chunk(span(41, 90), Some(function.clone()));
+        let other = chunk(span(92, 99), None);
+        assert!(outline.is_outline() && !first.is_outline());
+
+        let file = PathBuf::from("src/lib.rs");
+        let hits = fold_sections(vec![
+            (0.9, &file, &second),
+            (0.8, &file, &other),
+            (0.7, &file, &outline),
+            (0.6, &file, &first),
+        ]);
+        let folded: Vec<(f32, usize, usize)> = hits
+            .iter()
+            .map(|(score, _, span)| (*score, span.line_start, span.line_end))
+            .collect();
+        assert_eq!(folded, vec![(0.9, 1, 90), (0.8, 92, 99)]);
+    }
+
+    #[test]
+    fn string_literals_lift_a_chunk_score() {
+        let mut chunk = cs_index::ChunkEntry {
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: 1,
+                line_end: 1,
+            },
+            embedding: Some(vec![0.0, 1.0]),
+            chunk_type: None,
+            breadcrumb: None,
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: vec!["failed to open config %s: %w".to_string()],
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: None,
+            sub_embeddings: Vec::new(),
+            sparse: None,
+            parent: None,
+            signature: None,
+            signature_embedding: None,
+            tags: Vec::new(),
+        };
+        let query = [1.0, 0.0];
+        assert_eq!(
+            chunk_similarity(&query, &chunk, None, "open config"),
+            Some(0.0)
+        );
+        assert_eq!(
+            chunk_similarity(
+                &query,
+                &chunk,
+                None,
+                "failed to open config /etc/app.yaml: EACCES"
+            ),
+            Some(MESSAGE_MATCH_SCORE)
+        );
+
+        chunk.literal_embedding = Some(vec![1.0, 0.0]);
+        let score = chunk_similarity(&query, &chunk, None, "open config").unwrap();
+        assert!((score - 1.0).abs() < 1e-6);
+
+        chunk.embedding = None;
+        assert_eq!(chunk_similarity(&query, &chunk, None, "open config"), None);
+    }
+
+    #[test]
+    fn best_statement_vector_scores_a_multi_vector_chunk() {
+        let mut chunk = cs_index::ChunkEntry {
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: 1,
+                line_end: 1,
+            },
+            embedding: Some(vec![0.0, 1.0]),
+            chunk_type: None,
+            breadcrumb: None,
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: Vec::new(),
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: None,
+            sub_embeddings: vec![vec![0.6, 0.8], vec![1.0, 0.0], vec![-1.0, 0.0]],
+            sparse: None,
+            parent: None,
+            signature: None,
+            signature_embedding: None,
+            tags: Vec::new(),
+        };
+        let query = [1.0, 0.0];
+        let score = chunk_similarity(&query, &chunk, None, "retry").unwrap();
+        assert!((score - 1.0).abs() < 1e-6);
+        let truncated = chunk_similarity(&query, &chunk, Some(1), "retry").unwrap();
+        assert!((truncated - 1.0).abs() < 1e-6);
+
+        chunk.sub_embeddings.clear();
+        assert_eq!(chunk_similarity(&query, &chunk, None, "retry"), Some(0.0));
+    }
+
+    #[test]
+    fn signatures_score_below_an_equally_close_body() {
+        let mut chunk = cs_index::ChunkEntry {
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 1,
+                line_start: 1,
+                line_end: 1,
+            },
+            embedding: Some(vec![0.0, 1.0]),
+            chunk_type: Some("function".to_string()),
+            breadcrumb: None,
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: Vec::new(),
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: None,
+            sub_embeddings: Vec::new(),
+            sparse: None,
+            parent: None,
+            signature: Some("func GetUser(id int) (*User, error)".to_string()),
+            signature_embedding: Some(vec![1.0, 0.0]),
+            tags: Vec::new(),
+        };
+        let query = [1.0, 0.0];
+        let score = chunk_similarity(&query, &chunk, None, "takes an int").unwrap();
+        assert!((score - cs_index::signatures::SIGNATURE_WEIGHT).abs() < 1e-6);
+
+        chunk.embedding = Some(vec![1.0, 0.0]);
+        let score = chunk_similarity(&query, &chunk, None, "takes an int").unwrap();
+        assert!((score - 1.0).abs() < 1e-6);
     }
 }
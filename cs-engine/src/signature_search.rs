@@ -0,0 +1,275 @@
+//! `cs --sig 'func(context.Context, int) (*User, error)'`: find functions by
+//! the types they take and return, matched against the signatures recorded
+//! at index time (see [`cs_index::signatures`]). Embeddings blur types
+//! together, so this compares them one by one instead.
+//!
+//! Parameter names don't matter. Types match exactly, or loosely when the
+//! only difference is a pointer or reference (`*User` and `User`), a package
+//! or module qualifier (`context.Context`, `ctx.Context` and `Context`) or a
+//! builtin alias (`any` and `interface{}`, `byte` and `uint8`); each loose
+//! match costs a little score. `_` stands for any one type.
+
+use anyhow::Result;
+use cs_index::signatures::{SignatureParts, signature_parts};
+use rayon::prelude::*;
+use regex::Regex;
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+/// Score lost per type that only matches loosely.
+const LOOSE_PENALTY: f32 = 0.1;
+
+/// Go's builtin aliases, and the spellings they're compared as.
+static ALIASES: LazyLock<Vec<(Regex, &'static str)>> = LazyLock::new(|| {
+    [
+        (r"\binterface\{\}", "any"),
+        (r"\buint8\b", "byte"),
+        (r"\bint32\b", "rune"),
+    ]
+    .into_iter()
+    .map(|(pattern, canonical)| (Regex::new(pattern).unwrap(), canonical))
+    .collect()
+});
+
+static LIFETIME: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"'\w+\s*").unwrap());
+
+static QUALIFIER: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"\b\w+(?:\.|::)").unwrap());
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SignatureMatch {
+    pub file: PathBuf,
+    pub line: usize,
+    pub line_end: usize,
+    pub name: String,
+    pub signature: String,
+    /// 1.0 when every type matches exactly
+    pub score: f32,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum TypeMatch {
+    Exact,
+    Loose,
+}
+
+/// `ty` as it's compared exactly: without whitespace or lifetimes, aliases
+/// spelled one way, and Go's `...T` as the `[]T` it is.
+fn canonical(ty: &str) -> String {
+    let mut ty = LIFETIME.replace_all(ty, "").to_string();
+    for (alias, canonical) in ALIASES.iter() {
+        ty = alias.replace_all(&ty, *canonical).to_string();
+    }
+    let ty: String = ty.split_whitespace().collect();
+    match ty.strip_prefix("...") {
+        Some(element) => format!("[]{}", element),
+        None => ty,
+    }
+}
+
+/// `ty` as it's compared loosely: also without pointers, references and
+/// qualifiers.
+fn loose(ty: &str) -> String {
+    let mut ty = canonical(ty);
+    loop {
+        let stripped = ty
+            .strip_prefix("&mut")
+            .or_else(|| ty.strip_prefix(['*', '&']));
+        match stripped {
+            Some(rest) => ty = rest.to_string(),
+            None => break,
+        }
+    }
+    QUALIFIER.replace_all(&ty, "").to_string()
+}
+
+fn match_type(wanted: &str, found: &str) -> Option<TypeMatch> {
+    if wanted == "_" {
+        return Some(TypeMatch::Exact);
+    }
+    if found.is_empty() {
+        return None;
+    }
+    if canonical(wanted) == canonical(found) {
+        Some(TypeMatch::Exact)
+    } else if loose(wanted) == loose(found) {
+        Some(TypeMatch::Loose)
+    } else {
+        None
+    }
+}
+
+/// How well `found` fits `wanted`, `None` when a type doesn't match or the
+/// counts differ.
+fn match_signature(wanted: &SignatureParts, found: &SignatureParts) -> Option<f32> {
+    if wanted.param_types.len() != found.param_types.len()
+        || wanted.result_types.len() != found.result_types.len()
+    {
+        return None;
+    }
+    let mut loose = 0;
+    let pairs = wanted
+        .param_types
+        .iter()
+        .zip(&found.param_types)
+        .chain(wanted.result_types.iter().zip(&found.result_types));
+    for (wanted, found) in pairs {
+        if match_type(wanted, found)? == TypeMatch::Loose {
+            loose += 1;
+        }
+    }
+    Some((1.0 - LOOSE_PENALTY * loose as f32).max(LOOSE_PENALTY))
+}
+
+/// Parse a `cs --sig` query.
+pub fn parse_query(query: &str) -> Result<SignatureParts> {
+    signature_parts(query.trim(), None).ok_or_else(|| {
+        anyhow::anyhow!(
+            "'{}' is not a signature like 'func(context.Context, int) (*User, error)'",
+            query
+        )
+    })
+}
+
+/// Functions and methods under `scope` in the index at `index_root` whose
+/// signatures match `query`, best first, at most `limit` of them.
+pub fn search_signatures(
+    index_root: &Path,
+    scope: &Path,
+    query: &str,
+    limit: usize,
+) -> Result<Vec<SignatureMatch>> {
+    let wanted = parse_query(query)?;
+    let files = cs_index::indexed_files(index_root)?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No index in {}. Run cs --index first.",
+            index_root.display()
+        )
+    })?;
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let scope = cs_core::paths::canonicalize_lossy(scope);
+    let scope = scope.strip_prefix(&root).unwrap_or(Path::new(""));
+
+    let mut matches: Vec<SignatureMatch> = files
+        .par_iter()
+        .filter(|file| {
+            file.strip_prefix(index_root)
+                .unwrap_or(file)
+                .starts_with(scope)
+        })
+        .flat_map_iter(|file| {
+            let relative = file.strip_prefix(index_root).unwrap_or(file);
+            let sidecar = cs_index::shards::sidecar_path(index_root, relative);
+            match cs_index::load_index_entry(&sidecar) {
+                Ok(entry) => chunk_signatures(file, &entry.chunks, &wanted),
+                Err(_) => Vec::new(),
+            }
+        })
+        .collect();
+    matches.sort_by(|a, b| {
+        b.score
+            .total_cmp(&a.score)
+            .then_with(|| a.file.cmp(&b.file))
+            .then_with(|| a.line.cmp(&b.line))
+    });
+    matches.truncate(limit);
+    Ok(matches)
+}
+
+fn chunk_signatures(
+    file: &Path,
+    chunks: &[cs_index::ChunkEntry],
+    wanted: &SignatureParts,
+) -> Vec<SignatureMatch> {
+    let lang = cs_core::Language::from_path(file);
+    chunks
+        .iter()
+        .filter_map(|chunk| {
+            let signature = chunk.signature.as_ref()?;
+            let found = signature_parts(signature, lang)?;
+            let score = match_signature(wanted, &found)?;
+            Some(SignatureMatch {
+                file: file.to_path_buf(),
+                line: chunk.span.line_start,
+                line_end: chunk.parent.as_ref().unwrap_or(&chunk.span).line_end,
+                name: chunk.symbol.clone().unwrap_or(found.name),
+                signature: signature.clone(),
+                score,
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::Language;
+
+    fn score(query: &str, signature: &str, lang: Language) -> Option<f32> {
+        let wanted = parse_query(query).unwrap();
+        let found = signature_parts(signature, Some(lang)).unwrap();
+        match_signature(&wanted, &found)
+    }
+
+    #[test]
+    fn types_match_exactly_or_loosely() {
+        let go =
+            "func (s *InMemoryUserService) GetUser(ctx context.Context, id int) (*User, error)";
+        let query = "func(context.Context, int) (*User, error)";
+        assert_eq!(score(query, go, Language::Go), Some(1.0));
+        assert_eq!(
+            score(
+                "func(ctx context.Context, id int) (*User, error)",
+                go,
+                Language::Go
+            ),
+            Some(1.0)
+        );
+        assert_eq!(
+            score("func(_, int) (*User, _)", go, Language::Go),
+            Some(1.0)
+        );
+
+        // A value instead of a pointer, an unqualified type
+        let loose = score("func(Context, int) (User, error)", go, Language::Go).unwrap();
+        assert!((loose - 0.8).abs() < 1e-6);
+
+        assert_eq!(
+            score(
+                "func(context.Context, string) (*User, error)",
+                go,
+                Language::Go
+            ),
+            None
+        );
+        assert_eq!(
+            score("func(context.Context, int) error", go, Language::Go),
+            None
+        );
+        assert_eq!(
+            score("func(context.Context) (*User, error)", go, Language::Go),
+            None
+        );
+    }
+
+    #[test]
+    fn aliases_and_variadics_are_normalized() {
+        assert_eq!(
+            score(
+                "func(interface{}, ...uint8) []byte",
+                "func Encode(v any, extra []byte) []uint8",
+                Language::Go
+            ),
+            Some(1.0)
+        );
+        assert_eq!(
+            score(
+                "fn(&str) -> Result<User>",
+                "pub fn find<'a>(&self, name: &'a str) -> Result<User>",
+                Language::Rust
+            ),
+            Some(1.0)
+        );
+        assert!(parse_query("User").is_err());
+    }
+}
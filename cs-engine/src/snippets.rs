@@ -0,0 +1,356 @@
+//! Exact byte ranges of results, for tools that patch files rather than
+//! show them: the chunk a result spans and, inside it, the part that best
+//! matches the query.
+//!
+//! Offsets are into the file as stored on disk, whatever its encoding and
+//! line endings (see `cs_core::text`), so `byte_start..byte_end` can be
+//! spliced directly. The best match of a regex search is the first match of
+//! the regex in the chunk; for the other text modes it's the line whose words
+//! are most like the query's, the one the terminal output highlights
+//! brightest, without its indentation.
+//!
+//! A [`SnippetPolicy`] sizes the preview of each result for its consumer
+//! instead: a few lines for a picker, a token budget or the whole function
+//! for an agent (see [`apply_policy`]).
+
+use anyhow::Result;
+use cs_core::heatmap::{calculate_token_similarity, split_into_tokens};
+use cs_core::text::Decoded;
+use cs_core::{SearchMode, SearchOptions, SearchResult, SnippetPolicy, Span};
+use cs_embed::TokenEstimator;
+use regex::Regex;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::fs;
+use std::ops::Range;
+use std::path::{Path, PathBuf};
+
+use super::{extract_code_sections, find_containing_section, read_file_content};
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Snippet {
+    /// The whole chunk
+    pub span: Span,
+    /// The part of the chunk that best matches the query, if any of it does
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub best_match: Option<Span>,
+    /// The chunk's text, decoded
+    pub text: String,
+}
+
+/// What a search's best match inside a chunk is found with.
+#[derive(Debug, Clone)]
+pub enum Matcher {
+    Regex(Regex),
+    /// The words of a query, scored as for highlighting
+    Terms(String),
+    /// Structural matches are the whole chunk
+    None,
+}
+
+impl Matcher {
+    /// The matcher for the search `options` describe.
+    pub fn for_search(options: &SearchOptions) -> Result<Self> {
+        Ok(match options.mode {
+            SearchMode::Regex => Self::Regex(crate::query_regex(options)?),
+            SearchMode::Ast => Self::None,
+            SearchMode::Lexical | SearchMode::Semantic | SearchMode::Hybrid => {
+                Self::Terms(options.query.clone())
+            }
+        })
+    }
+
+    /// The byte range in `text` that best matches.
+    pub fn best_match(&self, text: &str) -> Option<Range<usize>> {
+        match self {
+            Self::Regex(regex) => regex.find(text).map(|found| found.range()),
+            Self::Terms(query) => best_line(text, query),
+            Self::None => None,
+        }
+    }
+}
+
+/// The line of `text` with the highest total token similarity to `query`,
+/// trimmed of surrounding whitespace; `None` if no line is like it at all.
+fn best_line(text: &str, query: &str) -> Option<Range<usize>> {
+    let mut best: Option<(f32, Range<usize>)> = None;
+    let mut start = 0;
+    for line in text.split_inclusive('\n') {
+        let score: f32 = split_into_tokens(line)
+            .iter()
+            .map(|token| calculate_token_similarity(token, query))
+            .sum();
+        if score > 0.0 && best.as_ref().is_none_or(|(top, _)| score > *top) {
+            let content = line.trim_start();
+            let offset = start + line.len() - content.len();
+            best = Some((score, offset..offset + content.trim_end().len()));
+        }
+        start += line.len();
+    }
+    best.map(|(_, range)| range)
+}
+
+/// Extracts snippets, decoding each file once for its run of results.
+pub struct SnippetExtractor {
+    matcher: Matcher,
+    file: Option<(PathBuf, Option<Decoded>)>,
+}
+
+impl SnippetExtractor {
+    pub fn new(matcher: Matcher) -> Self {
+        Self {
+            matcher,
+            file: None,
+        }
+    }
+
+    /// The snippet of `result`, or `None` if its file can't be read or has
+    /// changed so its span no longer fits.
+    pub fn snippet(&mut self, result: &SearchResult) -> Option<Snippet> {
+        if self
+            .file
+            .as_ref()
+            .is_none_or(|(file, _)| *file != result.file)
+        {
+            let decoded = fs::read(&result.file)
+                .ok()
+                .map(|bytes| cs_core::text::decode(&bytes));
+            self.file = Some((result.file.clone(), decoded));
+        }
+        let decoded = self.file.as_ref()?.1.as_ref()?;
+        let text = decoded
+            .text
+            .get(result.span.byte_start..result.span.byte_end)?;
+        let best_match = self.matcher.best_match(text).map(|range| {
+            let before = &text[..range.start];
+            let line_start = result.span.line_start + before.matches('\n').count();
+            let span = Span {
+                byte_start: result.span.byte_start + range.start,
+                byte_end: result.span.byte_start + range.end,
+                line_start,
+                line_end: line_start + text[range].matches('\n').count(),
+            };
+            decoded.original_span(&span)
+        });
+        Some(Snippet {
+            span: decoded.original_span(&result.span),
+            best_match,
+            text: text.to_string(),
+        })
+    }
+}
+
+/// A file's lines, and its functions and classes when a policy needs them.
+struct Source {
+    lines: Vec<String>,
+    sections: Option<Vec<(usize, usize, String)>>,
+}
+
+impl Source {
+    /// The function, method or class line `line` (from 1) is in.
+    fn symbol_at(&self, line: usize) -> Option<&String> {
+        find_containing_section(self.sections.as_ref()?, line.checked_sub(1)?)
+    }
+
+    fn lines_of(&self, span: &Span) -> Option<String> {
+        let lines = self
+            .lines
+            .get(span.line_start.checked_sub(1)?..span.line_end.min(self.lines.len()))?;
+        Some(lines.join("\n"))
+    }
+}
+
+/// Replace each result's preview with as much of its code as `policy`
+/// allows. What a result covers is its lines in the file, except for regex
+/// matches, which cover the preview the search built with its context
+/// lines; results whose file can't be read (commits, collections) are
+/// trimmed from their preview as well.
+pub fn apply_policy(
+    policy: SnippetPolicy,
+    mode: &SearchMode,
+    index_root: &Path,
+    results: &mut [SearchResult],
+) {
+    let mut sources: HashMap<PathBuf, Option<Source>> = HashMap::new();
+    for result in results {
+        let source = sources.entry(result.file.clone()).or_insert_with(|| {
+            let content = read_file_content(&result.file, index_root).ok()?;
+            let sections = (policy == SnippetPolicy::Symbol)
+                .then(|| extract_code_sections(&result.file, &content))
+                .flatten();
+            Some(Source {
+                lines: content.lines().map(str::to_string).collect(),
+                sections,
+            })
+        });
+
+        if policy == SnippetPolicy::Symbol
+            && let Some(symbol) = source
+                .as_ref()
+                .and_then(|source| source.symbol_at(result.span.line_start))
+        {
+            result.preview = symbol.clone();
+            continue;
+        }
+        // Outside any function, a symbol is the result's own lines
+        let covered = source
+            .as_ref()
+            .filter(|_| *mode != SearchMode::Regex)
+            .and_then(|source| source.lines_of(&result.span));
+        result.preview = trim(covered.as_deref().unwrap_or(&result.preview), policy);
+    }
+}
+
+/// `text` cut down to `policy`'s limit; the first line is always kept.
+fn trim(text: &str, policy: SnippetPolicy) -> String {
+    match policy {
+        SnippetPolicy::Lines(limit) => text.lines().take(limit).collect::<Vec<_>>().join("\n"),
+        SnippetPolicy::Tokens(limit) => {
+            let mut tokens = 0;
+            let mut kept = Vec::new();
+            for line in text.lines() {
+                tokens += TokenEstimator::estimate_tokens(line).max(1);
+                if tokens > limit && !kept.is_empty() {
+                    break;
+                }
+                kept.push(line);
+            }
+            kept.join("\n")
+        }
+        SnippetPolicy::Symbol => text.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn result_for(file: PathBuf, text: &str, chunk: &str, line_start: usize) -> SearchResult {
+        let byte_start = text.find(chunk).unwrap();
+        SearchResult {
+            file,
+            span: Span {
+                byte_start,
+                byte_end: byte_start + chunk.len(),
+                line_start,
+                line_end: line_start + chunk.matches('\n').count(),
+            },
+            score: 1.0,
+            preview: chunk.to_string(),
+            lang: None,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        }
+    }
+
+    #[test]
+    fn best_matches_are_located_in_the_stored_bytes() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("auth.rs");
+        let stored = "// auth\r\nfn login() {\r\n    check_password(user);\r\n}\r\n";
+        fs::write(&file, stored).unwrap();
+        let text = stored.replace("\r\n", "\n");
+        let chunk = "fn login() {\n    check_password(user);\n}";
+        let result = result_for(file, &text, chunk, 2);
+
+        let mut terms = SnippetExtractor::new(Matcher::Terms("check password".to_string()));
+        let snippet = terms.snippet(&result).unwrap();
+        assert_eq!(snippet.text, chunk);
+        assert_eq!(
+            &stored[snippet.span.byte_start..snippet.span.byte_end],
+            "fn login() {\r\n    check_password(user);\r\n}"
+        );
+        let best = snippet.best_match.unwrap();
+        assert_eq!(
+            &stored[best.byte_start..best.byte_end],
+            "check_password(user);"
+        );
+        assert_eq!((best.line_start, best.line_end), (3, 3));
+
+        let regex = Regex::new(r"login\(\)").unwrap();
+        let best = SnippetExtractor::new(Matcher::Regex(regex))
+            .snippet(&result)
+            .unwrap()
+            .best_match
+            .unwrap();
+        assert_eq!(&stored[best.byte_start..best.byte_end], "login()");
+        assert_eq!(best.line_start, 2);
+
+        // Nothing in the chunk is like the query
+        assert_eq!(best_line(chunk, "zz"), None);
+        let past_end = Span {
+            byte_end: text.len() + 10,
+            ..result.span.clone()
+        };
+        let stale = SearchResult {
+            span: past_end,
+            ..result
+        };
+        assert!(terms.snippet(&stale).is_none());
+    }
+
+    #[test]
+    fn policies_size_previews() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("retry.rs");
+        let text = "fn retry() {\n    let mut attempts = 0;\n    loop {\n        attempts += 1;\n    }\n}\n";
+        fs::write(&file, text).unwrap();
+        let chunk = "    let mut attempts = 0;\n    loop {\n        attempts += 1;\n    }";
+        let mut result = result_for(file, text, chunk, 2);
+        // As semantic search previews a chunk
+        result.preview = chunk.lines().next().unwrap().to_string();
+        let sized = |policy, mode, result: &SearchResult| {
+            let mut results = vec![result.clone()];
+            apply_policy(policy, &mode, dir.path(), &mut results);
+            results.remove(0).preview
+        };
+
+        assert_eq!(
+            sized(SnippetPolicy::Lines(2), SearchMode::Semantic, &result),
+            "    let mut attempts = 0;\n    loop {"
+        );
+        assert_eq!(
+            sized(SnippetPolicy::Tokens(1000), SearchMode::Semantic, &result),
+            chunk
+        );
+        // The first line even when it's over the budget on its own
+        assert_eq!(
+            sized(SnippetPolicy::Tokens(1), SearchMode::Semantic, &result),
+            "    let mut attempts = 0;"
+        );
+        let symbol = sized(SnippetPolicy::Symbol, SearchMode::Semantic, &result);
+        assert!(symbol.starts_with("fn retry() {"), "{}", symbol);
+        assert!(symbol.trim_end().ends_with('}'), "{}", symbol);
+
+        // Regex matches keep to their line and its context
+        let matched = SearchResult {
+            preview: "fn retry() {\n    let mut attempts = 0;\n    loop {".to_string(),
+            span: Span {
+                line_end: 2,
+                ..result.span.clone()
+            },
+            ..result.clone()
+        };
+        assert_eq!(
+            sized(SnippetPolicy::Lines(2), SearchMode::Regex, &matched),
+            "fn retry() {\n    let mut attempts = 0;"
+        );
+
+        // Unreadable files are trimmed from their preview
+        let gone = SearchResult {
+            file: dir.path().join("gone.rs"),
+            preview: "a\nb\nc".to_string(),
+            ..result
+        };
+        assert_eq!(
+            sized(SnippetPolicy::Lines(1), SearchMode::Semantic, &gone),
+            "a"
+        );
+        assert_eq!(
+            sized(SnippetPolicy::Symbol, SearchMode::Semantic, &gone),
+            "a\nb\nc"
+        );
+    }
+}
@@ -0,0 +1,305 @@
+//! Fuses learned sparse scores into semantic results on an index built with
+//! `--sparse` (see [`cs_index::sparse`]).
+//!
+//! The chunks' sparse vectors are gathered into an inverted index in
+//! `.cs/sparse.idx`, from each vocabulary term to the chunks weighting it, so
+//! a query only touches the postings of its own terms. Like the ANN index it
+//! is built by an unfiltered search, rebuilt once a tenth of the chunks
+//! searched are missing from it, and chunks newer than it are scored from
+//! their own vectors.
+//!
+//! A chunk's sparse score, relative to the best one for the query, closes up
+//! to [`SPARSE_WEIGHT`] of the gap between its dense score and a perfect
+//! match. Chunks the sparse model doesn't match keep their dense score, so
+//! thresholds mean what they did; chunks only it matches, such as one naming
+//! the misspelled identifier, join the results.
+
+use anyhow::Result;
+use cs_core::SearchOptions;
+use cs_embed::SparseVector;
+use cs_index::ChunkEntry;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+use std::time::SystemTime;
+
+use super::SearchProgressCallback;
+
+pub const SPARSE_INDEX_FILE: &str = "sparse.idx";
+
+/// Share of the gap to a perfect score the best sparse match closes.
+pub const SPARSE_WEIGHT: f32 = 0.5;
+
+/// Chunks only the sparse scores found, at most, added per query.
+const MAX_SPARSE_ONLY_HITS: usize = 200;
+
+/// The inverted index is rebuilt when more of the candidates than this are missing from it.
+const MAX_UNINDEXED_SHARE: f64 = 0.1;
+
+/// The inverted indexes loaded by this process, by index root, with the
+/// modification time of the file they were read from.
+static INDEX_CACHE: LazyLock<Mutex<HashMap<PathBuf, (SystemTime, Arc<SparseIndex>)>>> =
+    LazyLock::new(Default::default);
+
+#[derive(Serialize, Deserialize)]
+struct SparseIndexFile {
+    model: String,
+    /// Per id: the chunk's file relative to the index root, and its byte span
+    keys: Vec<(String, usize, usize)>,
+    /// Per vocabulary term: the ids of the chunks weighting it, and by how much
+    postings: HashMap<u32, Vec<(u32, f32)>>,
+}
+
+struct SparseIndex {
+    model: String,
+    len: usize,
+    postings: HashMap<u32, Vec<(u32, f32)>>,
+    /// Ids by file, then by byte span
+    ids: HashMap<PathBuf, HashMap<(usize, usize), u32>>,
+}
+
+impl SparseIndex {
+    fn new(index_root: &Path, file: SparseIndexFile) -> Self {
+        let mut ids: HashMap<PathBuf, HashMap<(usize, usize), u32>> = HashMap::new();
+        for (id, (path, start, end)) in file.keys.iter().enumerate() {
+            ids.entry(index_root.join(path))
+                .or_default()
+                .insert((*start, *end), id as u32);
+        }
+        Self {
+            model: file.model,
+            len: file.keys.len(),
+            postings: file.postings,
+            ids,
+        }
+    }
+
+    /// Positions in `chunks` by id (`usize::MAX` for ids not among them),
+    /// and the positions of chunks the index doesn't hold.
+    fn map(&self, chunks: &[(PathBuf, ChunkEntry)]) -> (Vec<usize>, Vec<usize>) {
+        let mut by_id = vec![usize::MAX; self.len];
+        let mut unindexed = Vec::new();
+        for (position, (file, chunk)) in chunks.iter().enumerate() {
+            match self
+                .ids
+                .get(file.as_path())
+                .and_then(|ids| ids.get(&(chunk.span.byte_start, chunk.span.byte_end)))
+            {
+                Some(&id) => by_id[id as usize] = position,
+                None if chunk.sparse.is_some() => unindexed.push(position),
+                None => {}
+            }
+        }
+        (by_id, unindexed)
+    }
+}
+
+/// Fuse the sparse scores of `query` over `chunks` into `similarities`, the
+/// dense hits among them, adding chunks only the sparse scores found with
+/// their `dense` score. Returns whether any score changed, so the caller
+/// re-sorts. Does nothing unless the index at `index_root` is sparse; a
+/// sparse model that fails to load is logged and the dense scores stand.
+pub(crate) fn fuse<'a>(
+    index_root: &Path,
+    options: &SearchOptions,
+    chunks: &'a [(PathBuf, ChunkEntry)],
+    similarities: &mut Vec<(f32, &'a PathBuf, &'a ChunkEntry)>,
+    dense: impl Fn(&Path, &ChunkEntry) -> Option<f32>,
+    progress: Option<&SearchProgressCallback>,
+) -> bool {
+    let Some(model) = cs_index::sparse::sparse_model(index_root) else {
+        return false;
+    };
+    let query = match cs_index::sparse::embed(&model, std::slice::from_ref(&options.query)) {
+        Ok(mut vectors) => vectors.pop().unwrap_or_default(),
+        Err(e) => {
+            tracing::warn!("Skipping sparse scores: {}", e);
+            return false;
+        }
+    };
+    if query.is_empty() {
+        return false;
+    }
+    let scores = sparse_scores(index_root, &model, options, chunks, &query, progress);
+    let best = scores.iter().copied().fold(0.0f32, f32::max);
+    if best <= 0.0 {
+        return false;
+    }
+
+    let mut positions: HashMap<*const ChunkEntry, usize> = similarities
+        .iter()
+        .enumerate()
+        .map(|(i, (_, _, chunk))| (*chunk as *const ChunkEntry, i))
+        .collect();
+    let mut sparse_only = Vec::new();
+    for (position, score) in scores.into_iter().enumerate() {
+        if score <= 0.0 {
+            continue;
+        }
+        let (file, chunk) = &chunks[position];
+        let relative = score / best;
+        match positions.remove(&(chunk as *const ChunkEntry)) {
+            Some(i) => similarities[i].0 = fused(similarities[i].0, relative),
+            None => sparse_only.push((relative, file, chunk)),
+        }
+    }
+    sparse_only.sort_by(|a, b| b.0.total_cmp(&a.0));
+    sparse_only.truncate(MAX_SPARSE_ONLY_HITS);
+    for (relative, file, chunk) in sparse_only {
+        let dense_score = dense(file, chunk).unwrap_or(0.0);
+        similarities.push((fused(dense_score, relative), file, chunk));
+    }
+    true
+}
+
+/// A dense score lifted by a sparse one relative to the query's best.
+fn fused(dense: f32, relative_sparse: f32) -> f32 {
+    dense + SPARSE_WEIGHT * relative_sparse * (1.0 - dense).max(0.0)
+}
+
+/// Sparse score of each of `chunks` for `query`.
+fn sparse_scores(
+    index_root: &Path,
+    model: &str,
+    options: &SearchOptions,
+    chunks: &[(PathBuf, ChunkEntry)],
+    query: &SparseVector,
+    progress: Option<&SearchProgressCallback>,
+) -> Vec<f32> {
+    let can_build = super::query_plan::is_unfiltered(index_root, options)
+        && !cs_index::bundle::is_sealed(index_root);
+    let mut index = match load_index(index_root) {
+        Ok(index) => index.filter(|index| index.model == model),
+        Err(e) => {
+            tracing::warn!("Ignoring the sparse index: {}", e);
+            None
+        }
+    };
+    let stale = |index: &SparseIndex| {
+        let (_, unindexed) = index.map(chunks);
+        unindexed.len() as f64 > chunks.len() as f64 * MAX_UNINDEXED_SHARE
+    };
+    if can_build && index.as_deref().is_none_or(stale) {
+        match build_index(index_root, model, chunks, progress) {
+            Ok(built) => index = Some(built),
+            Err(e) => tracing::warn!("Failed to build the sparse index: {}", e),
+        }
+    }
+
+    let mut scores = vec![0.0; chunks.len()];
+    let unindexed = match &index {
+        Some(index) => {
+            let (by_id, unindexed) = index.map(chunks);
+            for (term, weight) in query.indices.iter().zip(&query.values) {
+                for &(id, chunk_weight) in index.postings.get(term).into_iter().flatten() {
+                    let position = by_id[id as usize];
+                    if position != usize::MAX {
+                        scores[position] += weight * chunk_weight;
+                    }
+                }
+            }
+            unindexed
+        }
+        None => (0..chunks.len()).collect(),
+    };
+    for position in unindexed {
+        if let Some(vector) = &chunks[position].1.sparse {
+            scores[position] = vector.dot(query);
+        }
+    }
+    scores
+}
+
+fn index_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(SPARSE_INDEX_FILE)
+}
+
+fn load_index(index_root: &Path) -> Result<Option<Arc<SparseIndex>>> {
+    let path = index_path(index_root);
+    let Ok(modified) = fs::metadata(&path).and_then(|metadata| metadata.modified()) else {
+        return Ok(None);
+    };
+    let mut cache = INDEX_CACHE.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some((loaded, index)) = cache.get(index_root)
+        && *loaded == modified
+    {
+        return Ok(Some(index.clone()));
+    }
+    let data = cs_index::encryption::open_from(&path, fs::read(&path)?)?;
+    let index = Arc::new(SparseIndex::new(index_root, bincode::deserialize(&data)?));
+    cache.insert(index_root.to_path_buf(), (modified, index.clone()));
+    Ok(Some(index))
+}
+
+fn build_index(
+    index_root: &Path,
+    model: &str,
+    chunks: &[(PathBuf, ChunkEntry)],
+    progress: Option<&SearchProgressCallback>,
+) -> Result<Arc<SparseIndex>> {
+    let vectors: Vec<(&PathBuf, &ChunkEntry, &SparseVector)> = chunks
+        .iter()
+        .filter_map(|(file, chunk)| Some((file, chunk, chunk.sparse.as_ref()?)))
+        .collect();
+    if let Some(callback) = progress {
+        callback(&format!(
+            "Building the sparse index over {} chunks (once per index version)...",
+            vectors.len()
+        ));
+    }
+    let _span = tracing::info_span!("build_sparse_index", chunks = vectors.len()).entered();
+    let mut postings: HashMap<u32, Vec<(u32, f32)>> = HashMap::new();
+    for (id, (_, _, vector)) in vectors.iter().enumerate() {
+        for (term, weight) in vector.indices.iter().zip(&vector.values) {
+            postings
+                .entry(*term)
+                .or_default()
+                .push((id as u32, *weight));
+        }
+    }
+    let file = SparseIndexFile {
+        model: model.to_string(),
+        keys: vectors
+            .iter()
+            .map(|(path, chunk, _)| {
+                let relative = path.strip_prefix(index_root).unwrap_or(path);
+                (
+                    relative.to_string_lossy().to_string(),
+                    chunk.span.byte_start,
+                    chunk.span.byte_end,
+                )
+            })
+            .collect(),
+        postings,
+    };
+
+    let path = index_path(index_root);
+    let data = cs_index::encryption::seal_for(&path, bincode::serialize(&file)?)?;
+    if let Err(e) = super::query_plan::replace(&path, &data) {
+        tracing::warn!("Failed to save the sparse index: {}", e);
+    }
+    let index = Arc::new(SparseIndex::new(index_root, file));
+    if let Ok(modified) = fs::metadata(&path).and_then(|metadata| metadata.modified()) {
+        INDEX_CACHE
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .insert(index_root.to_path_buf(), (modified, index.clone()));
+    }
+    Ok(index)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn sparse_matches_close_part_of_the_gap_to_a_perfect_score() {
+        assert_eq!(fused(0.6, 0.0), 0.6);
+        assert!((fused(0.6, 1.0) - 0.8).abs() < 1e-6);
+        assert!((fused(0.0, 1.0) - SPARSE_WEIGHT).abs() < 1e-6);
+        assert!(fused(0.6, 0.5) < fused(0.6, 1.0));
+        assert!(fused(1.0, 1.0) <= 1.0);
+    }
+}
@@ -0,0 +1,297 @@
+//! Query-time rules for boilerplate: getters, setters, generated `String()`
+//! and `Error()` methods and other trivial functions that crowd out real
+//! results.
+//!
+//! Rules come from `[[stop_symbol]]` tables in the user config (`cs --config`)
+//! and in a `.csstop.toml` committed at the index root:
+//!
+//! ```toml
+//! [[stop_symbol]]
+//! language = "go"
+//! names = ["String", "Error"]     # dropped from results
+//!
+//! [[stop_symbol]]
+//! language = "java"
+//! names = ["get*", "set*", "is*"]
+//! max_tokens = 40                 # only short ones
+//! factor = 0.5                    # demoted instead
+//! ```
+//!
+//! A chunk's declared name is read from its first line of code, so rules see
+//! what the result shows rather than needing a reindex.
+
+use anyhow::Result;
+use cs_core::{CcError, SearchResult, StopSymbolRule};
+use globset::{Glob, GlobSet, GlobSetBuilder};
+use regex::Regex;
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+pub const STOP_SYMBOL_FILE: &str = ".csstop.toml";
+
+/// An identifier directly followed by a parameter list.
+static CALL_NAME: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"([A-Za-z_$][A-Za-z0-9_$]*)\s*(?:<[^()]*>)?\(").unwrap());
+
+/// Words that precede a parameter list without being the declared name.
+const KEYWORDS: &[&str] = &[
+    "func", "function", "fn", "def", "if", "for", "while", "switch", "match", "catch", "return",
+];
+
+#[derive(Debug, Default, Deserialize)]
+struct StopSymbolFile {
+    #[serde(default)]
+    stop_symbol: Vec<StopSymbolRule>,
+}
+
+/// Rules from `.csstop.toml` at `index_root`, or none if the file is absent.
+pub fn load_repo_stop_symbol_rules(index_root: &Path) -> Result<Vec<StopSymbolRule>> {
+    let path = index_root.join(STOP_SYMBOL_FILE);
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+    let content = fs::read_to_string(&path)?;
+    let file: StopSymbolFile = toml::from_str(&content)
+        .map_err(|e| CcError::Search(format!("Failed to parse {}: {}", path.display(), e)))?;
+    Ok(file.stop_symbol)
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub struct StopSymbolStats {
+    pub demoted: usize,
+    pub dropped: usize,
+}
+
+struct CompiledRule<'a> {
+    rule: &'a StopSymbolRule,
+    names: Option<GlobSet>,
+}
+
+impl CompiledRule<'_> {
+    fn matches(&self, result: &SearchResult, name: &str, text: &str) -> bool {
+        if self.names.is_none() && self.rule.max_tokens.is_none() {
+            return false;
+        }
+        if let Some(ref language) = self.rule.language
+            && !result
+                .lang
+                .is_some_and(|lang| lang.to_string().eq_ignore_ascii_case(language))
+        {
+            return false;
+        }
+        if let Some(ref names) = self.names
+            && !names.is_match(name)
+        {
+            return false;
+        }
+        if let Some(max_tokens) = self.rule.max_tokens
+            && cs_embed::TokenEstimator::estimate_tokens(text) > max_tokens
+        {
+            return false;
+        }
+        true
+    }
+}
+
+fn compile(rule: &StopSymbolRule) -> std::result::Result<CompiledRule<'_>, CcError> {
+    if let Some(factor) = rule.factor
+        && (!factor.is_finite() || factor <= 0.0 || factor >= 1.0)
+    {
+        return Err(CcError::Search(format!(
+            "Stop-symbol factor must be between 0 and 1, got {}",
+            factor
+        )));
+    }
+    let names = if rule.names.is_empty() {
+        None
+    } else {
+        let mut builder = GlobSetBuilder::new();
+        for pattern in &rule.names {
+            builder.add(Glob::new(pattern).map_err(|e| {
+                CcError::Search(format!("Invalid stop-symbol name '{}': {}", pattern, e))
+            })?);
+        }
+        Some(
+            builder
+                .build()
+                .map_err(|e| CcError::Search(format!("Invalid stop-symbol names: {}", e)))?,
+        )
+    };
+    Ok(CompiledRule { rule, names })
+}
+
+/// Drop or demote results whose chunk matches a rule, then re-sort. A result
+/// matching several rules is dropped if any says so, otherwise demoted by
+/// every matching factor.
+pub fn apply_stop_symbols(
+    rules: &[StopSymbolRule],
+    results: &mut Vec<SearchResult>,
+) -> Result<StopSymbolStats> {
+    let mut stats = StopSymbolStats::default();
+    if rules.is_empty() || results.is_empty() {
+        return Ok(stats);
+    }
+    let compiled = rules
+        .iter()
+        .map(compile)
+        .collect::<std::result::Result<Vec<_>, CcError>>()?;
+
+    let mut files: HashMap<PathBuf, Option<String>> = HashMap::new();
+    results.retain_mut(|result| {
+        let content = files
+            .entry(result.file.clone())
+            .or_insert_with(|| cs_core::text::read_text(&result.file).ok());
+        let Some(text) = content
+            .as_deref()
+            .and_then(|content| content.get(result.span.byte_start..result.span.byte_end))
+        else {
+            return true;
+        };
+        let Some(name) = declared_name(text) else {
+            return true;
+        };
+
+        let mut factor = 1.0;
+        for rule in compiled
+            .iter()
+            .filter(|rule| rule.matches(result, name, text))
+        {
+            match rule.rule.factor {
+                Some(f) => factor *= f,
+                None => {
+                    stats.dropped += 1;
+                    return false;
+                }
+            }
+        }
+        if factor != 1.0 {
+            result.score *= factor;
+            stats.demoted += 1;
+        }
+        true
+    });
+
+    if stats.demoted > 0 {
+        results.sort_by(SearchResult::rank_cmp);
+    }
+    Ok(stats)
+}
+
+/// The function or method a chunk declares: the first name before a
+/// parameter list on its first line of code, past comments and attributes.
+fn declared_name(text: &str) -> Option<&str> {
+    let line = text.lines().map(str::trim).find(|line| {
+        !line.is_empty()
+            && !["//", "/*", "*", "#", "@", "--", "\"\"\""]
+                .iter()
+                .any(|prefix| line.starts_with(prefix))
+    })?;
+    CALL_NAME
+        .captures_iter(line)
+        .map(|captures| captures.get(1).map_or("", |m| m.as_str()))
+        .find(|name| !KEYWORDS.contains(name))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::{Language, Span};
+    use tempfile::TempDir;
+
+    fn rule(names: &[&str], max_tokens: Option<usize>, factor: Option<f32>) -> StopSymbolRule {
+        StopSymbolRule {
+            language: Some("go".to_string()),
+            names: names.iter().map(|name| name.to_string()).collect(),
+            max_tokens,
+            factor,
+        }
+    }
+
+    #[test]
+    fn declared_names_skip_receivers_and_comments() {
+        let cases = [
+            (
+                "// String implements Stringer\nfunc (u User) String() string {",
+                "String",
+            ),
+            ("pub fn get_name(&self) -> &str {", "get_name"),
+            ("@property\ndef name(self):", "name"),
+            ("public <T> List<T> getItems() {", "getItems"),
+            ("function setName (name) {", "setName"),
+        ];
+        for (text, name) in cases {
+            assert_eq!(declared_name(text), Some(name), "{}", text);
+        }
+        assert_eq!(declared_name("package main\n\nimport \"fmt\""), None);
+    }
+
+    #[test]
+    fn matching_chunks_are_dropped_or_demoted() {
+        let temp_dir = TempDir::new().unwrap();
+        let file = temp_dir.path().join("user.go");
+        let stringer = "func (u User) String() string {\n\treturn u.Name\n}\n";
+        let getter = "func (u User) GetName() string {\n\treturn u.Name\n}\n";
+        let real = "func (u User) Validate() error {\n\tif u.Name == \"\" {\n\t\treturn errEmpty\n\t}\n\treturn nil\n}\n";
+        let source = format!("{}{}{}", stringer, getter, real);
+        fs::write(&file, &source).unwrap();
+
+        let result = |text: &str, score: f32| {
+            let byte_start = source.find(text).unwrap();
+            SearchResult {
+                lang: Language::from_path(&file),
+                file: file.clone(),
+                span: Span {
+                    byte_start,
+                    byte_end: byte_start + text.len(),
+                    line_start: 1,
+                    line_end: 1,
+                },
+                score,
+                preview: String::new(),
+                symbol: None,
+                chunk_hash: None,
+                index_epoch: None,
+            }
+        };
+        let mut results = vec![
+            result(stringer, 0.9),
+            result(getter, 0.85),
+            result(real, 0.7),
+        ];
+
+        let rules = vec![
+            rule(&["String", "Error"], None, None),
+            rule(&["Get*"], Some(20), Some(0.5)),
+            // Too long to be trivial
+            rule(&["Validate"], Some(5), None),
+        ];
+        let stats = apply_stop_symbols(&rules, &mut results).unwrap();
+        assert_eq!(
+            stats,
+            StopSymbolStats {
+                demoted: 1,
+                dropped: 1
+            }
+        );
+        assert_eq!(results.len(), 2);
+        assert!((results[0].score - 0.7).abs() < 1e-5);
+        assert!((results[1].score - 0.425).abs() < 1e-5);
+
+        assert!(apply_stop_symbols(&[rule(&["X"], None, Some(2.0))], &mut results).is_err());
+    }
+
+    #[test]
+    fn repo_stop_symbol_file_is_parsed() {
+        let temp_dir = TempDir::new().unwrap();
+        fs::write(
+            temp_dir.path().join(STOP_SYMBOL_FILE),
+            "[[stop_symbol]]\nlanguage = \"go\"\nnames = [\"String\"]\n",
+        )
+        .unwrap();
+        let rules = load_repo_stop_symbol_rules(temp_dir.path()).unwrap();
+        assert_eq!(rules, vec![rule(&["String"], None, None)]);
+    }
+}
@@ -0,0 +1,152 @@
+//! Semantic search against an external vector store (`cs --store <url>`).
+//!
+//! Chunks and embeddings live in the store, so no local sidecars are read and
+//! previews come from the chunk text saved when the repo was pushed.
+
+use anyhow::Result;
+use cs_core::{CcError, SearchOptions, SearchResult};
+use cs_store::VectorStore;
+use std::path::PathBuf;
+
+use super::{SearchProgressCallback, find_nearest_index_root};
+
+pub async fn semantic_search_store(
+    url: &str,
+    options: &SearchOptions,
+    progress_callback: Option<SearchProgressCallback>,
+) -> Result<cs_core::SearchResults> {
+    let index_root = find_nearest_index_root(&options.path).unwrap_or_else(|| options.path.clone());
+
+    // Default to the repository this search runs in, as pushed by `cs --index --store`
+    let repos = if options.store_repos.is_empty() {
+        vec![cs_store::default_repo_name(&index_root)]
+    } else {
+        options.store_repos.clone()
+    };
+
+    if let Some(ref callback) = progress_callback {
+        callback(&format!(
+            "Connecting to vector store for {}...",
+            repos.join(", ")
+        ));
+    }
+    let store = cs_store::connect(url).await?;
+
+    let mut model: Option<cs_store::RepoModel> = None;
+    for repo in &repos {
+        let repo_model = store.repo_model(repo).await?.ok_or_else(|| {
+            CcError::Index(format!(
+                "Repository '{}' is not in the store. Push it with 'cs --index --store <url> --store-repo {}'.",
+                repo, repo
+            ))
+        })?;
+        match &model {
+            Some(first) if *first != repo_model => {
+                return Err(CcError::Embedding(format!(
+                    "Repositories {} use different embedding models ('{}' vs '{}') and cannot be searched together.",
+                    repos.join(", "),
+                    first.embedding_model,
+                    repo_model.embedding_model
+                ))
+                .into());
+            }
+            Some(_) => {}
+            None => model = Some(repo_model),
+        }
+    }
+    let Some(model) = model else {
+        return Ok(cs_core::SearchResults {
+            matches: Vec::new(),
+            closest_below_threshold: None,
+            plan: None,
+            explanations: None,
+            warnings: Vec::new(),
+            facets: None,
+        });
+    };
+
+    if let Some(ref callback) = progress_callback {
+        callback(&format!(
+            "Using embedding model {} ({} dims)",
+            model.embedding_model, model.embedding_dimensions
+        ));
+    }
+
+    let mut embedder = cs_embed::create_embedder(Some(model.embedding_model.as_str()))?;
+    // Remote embedders saw redacted chunks, so they get the query redacted the same way
+    let query = cs_index::redaction::prepare_query(&*embedder, &index_root, &options.query)?;
+    let query_embeddings = embedder.embed(std::slice::from_ref(&query))?;
+    let Some(query_embedding) = query_embeddings.first() else {
+        return Ok(cs_core::SearchResults {
+            matches: Vec::new(),
+            closest_below_threshold: None,
+            plan: None,
+            explanations: None,
+            warnings: Vec::new(),
+            facets: None,
+        });
+    };
+
+    if let Some(ref callback) = progress_callback {
+        callback("Querying vector store...");
+    }
+
+    let limit = options.top_k.unwrap_or(100);
+    let hits = store.search(query_embedding, &model, &repos, limit).await?;
+
+    // A single-repo search maps back onto the local checkout; across repos the
+    // repo name is used as the path prefix so results stay distinguishable
+    let single_repo = repos.len() == 1;
+
+    let mut results = Vec::new();
+    let mut closest_below_threshold: Option<SearchResult> = None;
+
+    for hit in hits {
+        if !super::path_matches_include(&hit.path, &options.include_patterns) {
+            continue;
+        }
+
+        let file = if single_repo {
+            index_root.join(&hit.path)
+        } else {
+            PathBuf::from(&hit.repo).join(&hit.path)
+        };
+
+        let preview = if options.full_section {
+            hit.content
+        } else {
+            hit.content.lines().take(3).collect::<Vec<_>>().join("\n")
+        };
+
+        let search_result = SearchResult {
+            lang: cs_core::Language::from_path(&file),
+            file,
+            span: hit.span,
+            score: hit.score,
+            preview,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        };
+
+        if options
+            .threshold
+            .is_some_and(|threshold| hit.score < threshold)
+        {
+            if closest_below_threshold.is_none() {
+                closest_below_threshold = Some(search_result);
+            }
+        } else {
+            results.push(search_result);
+        }
+    }
+
+    Ok(cs_core::SearchResults {
+        matches: results,
+        closest_below_threshold,
+        plan: None,
+        explanations: None,
+        warnings: Vec::new(),
+        facets: None,
+    })
+}
@@ -0,0 +1,319 @@
+//! One-sentence summaries of indexed chunks, written by a chat model at
+//! index time (`cs --index --summarize`) and shown under search results, so
+//! a listing can be scan-read instead of reading every snippet.
+//!
+//! Summaries live in `.cs/summaries.json`, keyed by the hash of the chunk's
+//! text (the one in its [anchor](super::anchors)). A chunk is sent to the
+//! model once: unchanged and moved code keeps its summary, later
+//! `cs --index` runs summarize only new chunks, and summaries of code that is
+//! gone are dropped. The model is the one `--ask` uses (`[llm]` in
+//! config.toml); code bound for an endpoint off this machine is screened like
+//! an `--ask` context first.
+
+use anyhow::{Result, bail};
+use cs_core::{LlmConfig, SearchResult};
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use super::anchors::{AnchorLookup, chunk_hash};
+use super::answer::{self, ChatMessage};
+
+pub const SUMMARIES_FILE: &str = "summaries.json";
+
+/// Chunks shorter than this read as fast as a summary of them.
+const MIN_CHUNK_CHARS: usize = 80;
+
+/// Code sent per chunk at most; the start of a long chunk says what it is.
+const MAX_CHUNK_CHARS: usize = 6000;
+
+const MAX_SUMMARY_CHARS: usize = 200;
+
+const CONCURRENT_REQUESTS: usize = 4;
+
+/// Summaries are saved after this many requests, so an interrupted run keeps them.
+const SAVE_EVERY: usize = 40;
+
+const SYSTEM_PROMPT: &str = "You summarize code for a search result listing. Reply with one \
+sentence of at most 25 words saying what the code does, not how. No preamble, no quotes, no \
+markdown.";
+
+#[derive(Debug, Default)]
+pub struct SummaryStats {
+    /// Chunks the model summarized this run
+    pub summarized: usize,
+    /// Chunks that already had a summary
+    pub cached: usize,
+    /// Chunks the model failed to summarize; the next run retries them
+    pub failed: usize,
+    /// Summaries dropped because their code is gone
+    pub removed: usize,
+}
+
+/// Where the chunk summaries of the index at `index_root` are kept.
+pub fn summaries_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(SUMMARIES_FILE)
+}
+
+/// Whether the index at `index_root` has chunk summaries.
+pub fn has_summaries(index_root: &Path) -> bool {
+    summaries_path(index_root).exists()
+}
+
+fn load(index_root: &Path) -> Result<HashMap<String, String>> {
+    let path = summaries_path(index_root);
+    if !path.exists() {
+        return Ok(HashMap::new());
+    }
+    let data = cs_index::encryption::open_from(&path, fs::read(&path)?)?;
+    serde_json::from_slice(&data)
+        .map_err(|e| anyhow::anyhow!("Failed to parse {}: {}", path.display(), e))
+}
+
+fn save(index_root: &Path, summaries: &HashMap<String, String>) -> Result<()> {
+    let path = summaries_path(index_root);
+    let data = cs_index::encryption::seal_for(&path, serde_json::to_vec(summaries)?)?;
+    super::query_plan::replace(&path, &data)
+}
+
+struct PendingChunk {
+    hash: String,
+    file: String,
+    text: String,
+}
+
+/// Summarize the chunks of the index at `index_root` that have no summary
+/// yet with the chat model of `config`, calling `on_progress` with the
+/// chunks done and to do.
+pub async fn summarize_index(
+    index_root: &Path,
+    config: &LlmConfig,
+    on_progress: &(dyn Fn(usize, usize) + Sync),
+) -> Result<SummaryStats> {
+    let url = config.url.as_deref().unwrap_or(answer::DEFAULT_LLM_URL);
+    let Some(model) = config.model.as_deref() else {
+        bail!(
+            "No chat model configured for --summarize: pass --llm-model, set CS_LLM_MODEL or add `model` under [llm] in config.toml"
+        );
+    };
+    let Some(files) = cs_index::indexed_files(index_root)? else {
+        bail!(
+            "No index in {}. Run cs --index first.",
+            index_root.display()
+        );
+    };
+
+    let mut summaries = load(index_root)?;
+    let mut stats = SummaryStats::default();
+    let mut live = HashSet::new();
+    let mut pending = Vec::new();
+    for file in &files {
+        let Ok(content) = cs_core::text::read_text(file) else {
+            continue;
+        };
+        let Ok(chunks) = cs_chunk::chunk_text(&content, cs_core::Language::from_path(file)) else {
+            continue;
+        };
+        let relative =
+            cs_core::paths::to_relative_slash(file.strip_prefix(index_root).unwrap_or(file));
+        for chunk in chunks {
+            if chunk.text.trim().chars().count() < MIN_CHUNK_CHARS {
+                continue;
+            }
+            let hash = chunk_hash(&chunk.text);
+            if !live.insert(hash.clone()) {
+                continue;
+            }
+            if summaries.contains_key(&hash) {
+                stats.cached += 1;
+            } else {
+                pending.push(PendingChunk {
+                    hash,
+                    file: relative.clone(),
+                    text: chunk.text,
+                });
+            }
+        }
+    }
+    let before = summaries.len();
+    summaries.retain(|hash, _| live.contains(hash));
+    stats.removed = before - summaries.len();
+
+    let client = answer::chat_client()?;
+    let local = answer::is_local(url);
+    let (mut done, mut saved_at) = (0, 0);
+    on_progress(done, pending.len());
+    for batch in pending.chunks(CONCURRENT_REQUESTS) {
+        let mut tasks = tokio::task::JoinSet::new();
+        for chunk in batch {
+            let text: String = chunk.text.chars().take(MAX_CHUNK_CHARS).collect();
+            let text = if local {
+                text
+            } else {
+                answer::screen(index_root, &text)?
+            };
+            let messages = vec![
+                ChatMessage {
+                    role: "system".to_string(),
+                    content: SYSTEM_PROMPT.to_string(),
+                },
+                ChatMessage {
+                    role: "user".to_string(),
+                    content: format!("File: {}\n\n{}", chunk.file, text),
+                },
+            ];
+            let (client, url, model, config) = (
+                client.clone(),
+                url.to_string(),
+                model.to_string(),
+                config.clone(),
+            );
+            let hash = chunk.hash.clone();
+            tasks.spawn(async move {
+                let reply = answer::complete(&client, &url, &model, &config, messages).await;
+                (hash, reply)
+            });
+        }
+
+        let mut errors = Vec::new();
+        while let Some(joined) = tasks.join_next().await {
+            let (hash, reply) = joined?;
+            match reply.map(|reply| clean_summary(&reply)) {
+                Ok(summary) if !summary.is_empty() => {
+                    summaries.insert(hash, summary);
+                    stats.summarized += 1;
+                }
+                Ok(_) => stats.failed += 1,
+                Err(e) => {
+                    stats.failed += 1;
+                    errors.push(e);
+                }
+            }
+        }
+        // An endpoint that can't answer anything would fail every chunk the same way
+        if stats.summarized == 0
+            && errors.len() == batch.len()
+            && let Some(error) = errors.pop()
+        {
+            save(index_root, &summaries)?;
+            return Err(error);
+        }
+        for error in errors {
+            tracing::warn!("Failed to summarize a chunk: {:#}", error);
+        }
+
+        done += batch.len();
+        on_progress(done, pending.len());
+        if done - saved_at >= SAVE_EVERY {
+            save(index_root, &summaries)?;
+            saved_at = done;
+        }
+    }
+    save(index_root, &summaries)?;
+    Ok(stats)
+}
+
+/// The first line of a model's reply, without quotes or a label it was
+/// told not to add, cut to [`MAX_SUMMARY_CHARS`].
+fn clean_summary(reply: &str) -> String {
+    let line = reply
+        .lines()
+        .map(str::trim)
+        .find(|line| !line.is_empty())
+        .unwrap_or_default();
+    let line = line
+        .strip_prefix("Summary:")
+        .unwrap_or(line)
+        .trim()
+        .trim_matches(|c| c == '"' || c == '`' || c == '*')
+        .trim();
+    if line.chars().count() <= MAX_SUMMARY_CHARS {
+        return line.to_string();
+    }
+    let cut: String = line.chars().take(MAX_SUMMARY_CHARS - 1).collect();
+    format!("{}…", cut.trim_end())
+}
+
+/// Finds the summary of each search result's chunk.
+pub struct SummaryLookup {
+    summaries: HashMap<String, String>,
+    anchors: AnchorLookup,
+}
+
+impl SummaryLookup {
+    /// `None` when the index at `index_root` has no summaries.
+    pub fn new(index_root: &Path) -> Option<Self> {
+        let summaries = match load(index_root) {
+            Ok(summaries) if !summaries.is_empty() => summaries,
+            Ok(_) => return None,
+            Err(e) => {
+                tracing::warn!("Ignoring chunk summaries: {}", e);
+                return None;
+            }
+        };
+        Some(Self {
+            summaries,
+            anchors: AnchorLookup::new(index_root),
+        })
+    }
+
+    /// The summary of the innermost chunk holding `result`.
+    pub fn summary_for(&mut self, result: &SearchResult) -> Option<&str> {
+        let anchor = self.anchors.anchor_for(result)?;
+        self.summaries.get(&anchor.chunk_hash).map(String::as_str)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn replies_are_cut_to_one_clean_sentence() {
+        assert_eq!(
+            clean_summary("\n\"Refreshes an expired access token.\"\n\nIt calls the API."),
+            "Refreshes an expired access token."
+        );
+        assert_eq!(
+            clean_summary("Summary: **Parses CLI flags.**"),
+            "Parses CLI flags."
+        );
+        let long = clean_summary(&"word ".repeat(100));
+        assert_eq!(long.chars().count(), MAX_SUMMARY_CHARS);
+        assert!(long.ends_with('…'));
+    }
+
+    #[test]
+    fn results_find_the_summary_of_their_chunk() {
+        let temp_dir = TempDir::new().unwrap();
+        let file = temp_dir.path().join("lib.rs");
+        let refresh = "fn refresh_token(token: &str) -> String {\n    let fresh = token.trim();\n    fresh.to_string()\n}\n";
+        fs::write(&file, refresh).unwrap();
+        let summaries = cs_chunk::chunk_text(refresh, Some(cs_core::Language::Rust))
+            .unwrap()
+            .iter()
+            .map(|chunk| (chunk_hash(&chunk.text), "Trims a token.".to_string()))
+            .collect();
+        fs::create_dir_all(cs_core::locations::index_dir(temp_dir.path())).unwrap();
+        save(temp_dir.path(), &summaries).unwrap();
+
+        let result = SearchResult {
+            file,
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 0,
+                line_start: 2,
+                line_end: 2,
+            },
+            score: 1.0,
+            preview: String::new(),
+            lang: None,
+            symbol: None,
+            chunk_hash: None,
+            index_epoch: None,
+        };
+        let mut lookup = SummaryLookup::new(temp_dir.path()).unwrap();
+        assert_eq!(lookup.summary_for(&result), Some("Trims a token."));
+    }
+}
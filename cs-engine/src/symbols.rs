@@ -0,0 +1,262 @@
+//! `cs --sym QUERY`: fuzzy "Go to symbol" over the names of the functions,
+//! methods, classes and modules recorded at index time. Nothing is embedded,
+//! so it answers instantly, and abbreviations work the way editors taught
+//! everyone to type them: `imusrsvc` finds `InMemoryUserService`, `gtusr`
+//! finds `get_user`.
+
+use anyhow::Result;
+use rayon::prelude::*;
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+
+const SCORE_MATCH: i32 = 16;
+/// A match at the start of a word: the name's start, after `_`, `-`, `.` or
+/// `:`, or a camelCase hump
+const BONUS_BOUNDARY: i32 = 10;
+/// A match at the very start of the name
+const BONUS_FIRST_CHAR: i32 = 4;
+const BONUS_CONSECUTIVE: i32 = 6;
+/// The query's case matches too, so `getName` wins over `getname`
+const BONUS_CASE: i32 = 1;
+const PENALTY_GAP_START: i32 = 3;
+const PENALTY_GAP_EXTENSION: i32 = 1;
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SymbolMatch {
+    pub file: PathBuf,
+    pub line: usize,
+    pub line_end: usize,
+    pub name: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub kind: Option<String>,
+    /// Enclosing modules, types and impls, e.g. `users::UserService`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub container: Option<String>,
+    pub score: i32,
+}
+
+/// Symbols under `scope` in the index at `index_root` whose names fuzzily
+/// match `query`, best first, at most `limit` of them.
+pub fn search_symbols(
+    index_root: &Path,
+    scope: &Path,
+    query: &str,
+    limit: usize,
+) -> Result<Vec<SymbolMatch>> {
+    let files = cs_index::indexed_files(index_root)?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No index in {}. Run cs --index first.",
+            index_root.display()
+        )
+    })?;
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let scope = cs_core::paths::canonicalize_lossy(scope);
+    let scope = scope.strip_prefix(&root).unwrap_or(Path::new(""));
+    let query: Vec<char> = query
+        .chars()
+        .filter(|c| !c.is_whitespace() && !is_separator(*c))
+        .collect();
+    if query.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let mut matches: Vec<SymbolMatch> = files
+        .par_iter()
+        .filter(|file| {
+            file.strip_prefix(index_root)
+                .unwrap_or(file)
+                .starts_with(scope)
+        })
+        .flat_map_iter(|file| file_symbols(index_root, file, &query))
+        .collect();
+    matches.sort_by(|a, b| {
+        b.score
+            .cmp(&a.score)
+            .then_with(|| a.name.len().cmp(&b.name.len()))
+            .then_with(|| a.file.cmp(&b.file))
+            .then_with(|| a.line.cmp(&b.line))
+    });
+    matches.truncate(limit);
+    Ok(matches)
+}
+
+fn file_symbols(index_root: &Path, file: &Path, query: &[char]) -> Vec<SymbolMatch> {
+    let relative = file.strip_prefix(index_root).unwrap_or(file);
+    let sidecar = cs_index::shards::sidecar_path(index_root, relative);
+    let Ok(entry) = cs_index::load_index_entry(&sidecar) else {
+        return Vec::new();
+    };
+    chunk_symbols(file, &entry.chunks, query)
+}
+
+fn chunk_symbols(file: &Path, chunks: &[cs_index::ChunkEntry], query: &[char]) -> Vec<SymbolMatch> {
+    let mut chunks: Vec<&cs_index::ChunkEntry> = chunks
+        .iter()
+        .filter(|chunk| chunk.symbol.is_some())
+        .collect();
+    chunks.sort_by_key(|chunk| chunk.span.line_start);
+
+    let mut symbols: Vec<SymbolMatch> = Vec::new();
+    for chunk in chunks {
+        let name = chunk.symbol.as_deref().unwrap_or_default();
+        // A long function is indexed as several strides of one declaration
+        if let Some(last) = symbols.iter_mut().rev().find(|symbol| {
+            symbol.name == name
+                && symbol.container == chunk.breadcrumb
+                && chunk.span.line_start <= symbol.line_end + 1
+        }) {
+            last.line_end = last.line_end.max(chunk.span.line_end);
+            continue;
+        }
+        let Some(score) = fuzzy_score(query, name) else {
+            continue;
+        };
+        symbols.push(SymbolMatch {
+            file: file.to_path_buf(),
+            line: chunk.span.line_start,
+            line_end: chunk.span.line_end,
+            name: name.to_string(),
+            kind: chunk.chunk_type.clone(),
+            container: chunk.breadcrumb.clone(),
+            score,
+        });
+    }
+    symbols
+}
+
+fn is_separator(c: char) -> bool {
+    matches!(c, '_' | '-' | '.' | ':' | '/' | '$')
+}
+
+/// Bonus for matching the character at `index` of `name`.
+fn boundary_bonus(name: &[char], index: usize) -> i32 {
+    let Some(previous) = index.checked_sub(1).map(|i| name[i]) else {
+        return BONUS_BOUNDARY + BONUS_FIRST_CHAR;
+    };
+    let current = name[index];
+    let starts_word = is_separator(previous) || previous.is_whitespace();
+    let camel_hump = current.is_uppercase() && !previous.is_uppercase();
+    let starts_number = current.is_ascii_digit() && !previous.is_ascii_digit();
+    if starts_word || camel_hump || starts_number {
+        BONUS_BOUNDARY
+    } else {
+        0
+    }
+}
+
+/// How well `query` (separators removed) matches `name`, or `None` unless
+/// every character of the query appears in the name in order, ignoring case.
+/// The best alignment is found by dynamic programming, as fzf does: matches
+/// at word starts and runs of consecutive matches score, gaps cost.
+fn fuzzy_score(query: &[char], name: &str) -> Option<i32> {
+    let name: Vec<char> = name.chars().collect();
+    if query.is_empty() || query.len() > name.len() {
+        return None;
+    }
+    let lower = |c: char| c.to_lowercase().next().unwrap_or(c);
+    let unmatched = i32::MIN / 2;
+
+    // Best score with the previous query character matched exactly at j
+    let mut previous_row: Vec<i32> = Vec::new();
+    for (i, &q) in query.iter().enumerate() {
+        let mut row = vec![unmatched; name.len()];
+        // Best score of the previous row ending before j with a gap
+        let mut gapped = unmatched;
+        for j in i..name.len() {
+            if i > 0 && j >= 2 {
+                gapped =
+                    (previous_row[j - 2] - PENALTY_GAP_START).max(gapped - PENALTY_GAP_EXTENSION);
+            }
+            if lower(q) != lower(name[j]) {
+                continue;
+            }
+            let mut score = SCORE_MATCH + boundary_bonus(&name, j);
+            if q == name[j] {
+                score += BONUS_CASE;
+            }
+            if i > 0 {
+                let best = (previous_row[j - 1] + BONUS_CONSECUTIVE).max(gapped);
+                if best < unmatched / 2 {
+                    continue;
+                }
+                score += best;
+            }
+            row[j] = score;
+        }
+        previous_row = row;
+    }
+    previous_row
+        .into_iter()
+        .max()
+        .filter(|&score| score > unmatched / 2)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn score(query: &str, name: &str) -> Option<i32> {
+        fuzzy_score(&query.chars().collect::<Vec<_>>(), name)
+    }
+
+    #[test]
+    fn abbreviations_match_camel_and_snake_case_words() {
+        assert!(score("imusrsvc", "InMemoryUserService").is_some());
+        assert!(score("gtusr", "get_user").is_some());
+        assert!(score("usrsvc", "get_user").is_none());
+        assert!(score("xyz", "UserService").is_none());
+
+        // Word starts beat letters picked from the middle of words
+        assert!(score("us", "UserService") > score("us", "focus_set"));
+        assert!(score("gu", "get_user") > score("gu", "aguard"));
+        // A run of the query beats the same letters spread out
+        assert!(score("user", "UserRepo") > score("user", "UnsafeRenderer"));
+        // The query's own case breaks ties
+        assert!(score("getName", "getName") > score("getName", "getname"));
+    }
+
+    #[test]
+    fn strides_of_a_declaration_are_one_symbol() {
+        let chunk = |line_start, line_end, symbol: &str| cs_index::ChunkEntry {
+            span: cs_core::Span {
+                byte_start: 0,
+                byte_end: 0,
+                line_start,
+                line_end,
+            },
+            embedding: None,
+            chunk_type: Some("method".to_string()),
+            breadcrumb: Some("UserService".to_string()),
+            ancestry: None,
+            byte_length: None,
+            estimated_tokens: None,
+            leading_trivia: None,
+            trailing_trivia: None,
+            generated: false,
+            literals: Vec::new(),
+            literal_embedding: None,
+            license: None,
+            metadata: Default::default(),
+            symbol: Some(symbol.to_string()),
+            sub_embeddings: Vec::new(),
+            sparse: None,
+            parent: None,
+            signature: None,
+            signature_embedding: None,
+            tags: Vec::new(),
+        };
+        let chunks = [
+            chunk(41, 70, "FindUser"),
+            chunk(1, 40, "FindUser"),
+            chunk(72, 80, "FindUsers"),
+            chunk(82, 90, "Delete"),
+        ];
+        let query: Vec<char> = "fndusr".chars().collect();
+        let symbols = chunk_symbols(Path::new("service.go"), &chunks, &query);
+        let found: Vec<(&str, usize, usize)> = symbols
+            .iter()
+            .map(|symbol| (symbol.name.as_str(), symbol.line, symbol.line_end))
+            .collect();
+        assert_eq!(found, [("FindUser", 1, 70), ("FindUsers", 72, 80)]);
+    }
+}
@@ -0,0 +1,117 @@
+//! `cs --trace MESSAGE`: the call sites that print a log or error message,
+//! found among the string literals recorded at index time (see
+//! [`cs_index::literals`]). The message can be pasted as printed or given as
+//! a format string; `%d`, `%s`, `{}` and other placeholders match each other
+//! and whatever was filled in for them.
+
+use anyhow::Result;
+use cs_index::literals::{self, FormatMatch};
+use serde::Serialize;
+use std::collections::HashSet;
+use std::path::{Path, PathBuf};
+
+#[derive(Debug, Clone, Serialize)]
+pub struct TraceHit {
+    pub file: PathBuf,
+    pub line: usize,
+    #[serde(rename = "match")]
+    pub kind: FormatMatch,
+    pub literal: String,
+    /// The line holding the literal, trimmed
+    pub code: String,
+}
+
+/// Literals under `scope` in the index at `index_root` matching `message`,
+/// exact matches first.
+pub fn trace_message(index_root: &Path, scope: &Path, message: &str) -> Result<Vec<TraceHit>> {
+    let files = cs_index::indexed_files(index_root)?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No index in {}. Run cs --index first.",
+            index_root.display()
+        )
+    })?;
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let scope = cs_core::paths::canonicalize_lossy(scope);
+    let scope = scope.strip_prefix(&root).unwrap_or(Path::new(""));
+
+    let mut hits = Vec::new();
+    let mut seen = HashSet::new();
+    for file in files {
+        let relative = file.strip_prefix(index_root).unwrap_or(&file);
+        if !relative.starts_with(scope) {
+            continue;
+        }
+        let sidecar = cs_index::shards::sidecar_path(index_root, relative);
+        let Ok(entry) = cs_index::load_index_entry(&sidecar) else {
+            continue;
+        };
+        let mut content: Option<Option<String>> = None;
+        for chunk in &entry.chunks {
+            for literal in &chunk.literals {
+                let Some(kind) = literals::match_format(literal, message) else {
+                    continue;
+                };
+                let Some(text) = content
+                    .get_or_insert_with(|| cs_core::text::read_text(&file).ok())
+                    .as_deref()
+                    .and_then(|content| content.get(chunk.span.byte_start..chunk.span.byte_end))
+                else {
+                    continue;
+                };
+                let (line, code) = locate(text, chunk.span.line_start, literal);
+                // Nested chunks (a class and its methods) hold the same literal
+                if seen.insert((file.clone(), line, literal.clone())) {
+                    hits.push(TraceHit {
+                        file: file.clone(),
+                        line,
+                        kind,
+                        literal: literal.clone(),
+                        code,
+                    });
+                }
+            }
+        }
+    }
+    hits.sort_by(|a, b| (a.kind, &a.file, a.line).cmp(&(b.kind, &b.file, b.line)));
+    Ok(hits)
+}
+
+/// The line of `chunk` (starting at `line_start`) that holds `literal`, found
+/// by its longest stretch of text without placeholders or escapes.
+fn locate(chunk: &str, line_start: usize, literal: &str) -> (usize, String) {
+    let anchor = literals::fixed_segments(literal)
+        .into_iter()
+        .flat_map(|segment| segment.split(['"', '\'', '\\', '\n', '\t']))
+        .max_by_key(|piece| piece.len())
+        .unwrap_or("");
+    let offset = if anchor.is_empty() {
+        None
+    } else {
+        chunk.find(anchor)
+    };
+    let Some(offset) = offset else {
+        let first = chunk.lines().next().unwrap_or("");
+        return (line_start, first.trim().to_string());
+    };
+    let line_offset = chunk[..offset].matches('\n').count();
+    let code = chunk.lines().nth(line_offset).unwrap_or("").trim();
+    (line_start + line_offset, code.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn locates_the_line_of_a_literal() {
+        let chunk = "func Find(id int) (*User, error) {\n\tif u, ok := users[id]; ok {\n\t\treturn u, nil\n\t}\n\treturn nil, fmt.Errorf(\"user with ID %d not found\", id)\n}";
+        assert_eq!(
+            locate(chunk, 10, "user with ID %d not found"),
+            (
+                14,
+                "return nil, fmt.Errorf(\"user with ID %d not found\", id)".to_string()
+            )
+        );
+        assert_eq!(locate(chunk, 10, "missing").0, 10);
+    }
+}
@@ -0,0 +1,495 @@
+//! Sealed, signed, read-only index bundles for air-gapped review.
+//!
+//! `cs --seal-index out.csbundle --signing-key key.pk8` packs the manifest,
+//! the sidecars and the indexed source files into one Ed25519-signed file.
+//! `cs --bundle out.csbundle --trusted-key key.pub "query"` verifies the
+//! signature before anything is unpacked, extracts it read-only and marks the
+//! index sealed so no code path will update it.
+//!
+//! Layout: `MAGIC | payload length (u64 LE) | bincode payload | signature (64 bytes)`.
+
+use super::{IndexManifest, atomic_write, path_utils};
+use anyhow::Result;
+use ring::rand::SystemRandom;
+use ring::signature::{ED25519, Ed25519KeyPair, KeyPair, UnparsedPublicKey};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Component, Path, PathBuf};
+use std::time::SystemTime;
+use walkdir::WalkDir;
+
+const MAGIC: &[u8; 8] = b"CSBNDL01";
+const FORMAT_VERSION: u32 = 1;
+const SIGNATURE_LEN: usize = 64;
+const SEALED_MARKER: &str = "sealed.json";
+
+/// Per-checkout state that must not travel with a bundle.
+const LOCAL_STATE_FILES: &[&str] = &["feedback.json", "remote.json", SEALED_MARKER];
+
+#[derive(Serialize, Deserialize)]
+struct BundlePayload {
+    format_version: u32,
+    created: u64,
+    files: Vec<BundleFile>,
+}
+
+#[derive(Serialize, Deserialize)]
+struct BundleFile {
+    /// Relative to the repository root, `/`-separated
+    path: String,
+    data: Vec<u8>,
+}
+
+/// Written to `.cs/sealed.json` when a bundle is opened.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SealedInfo {
+    pub bundle_digest: String,
+    pub public_key: String,
+    pub created: u64,
+    pub files: usize,
+}
+
+#[derive(Debug, Clone)]
+pub struct SealStats {
+    pub files: usize,
+    pub bytes: u64,
+    pub public_key: String,
+}
+
+/// Create an Ed25519 signing key at `key_path` (PKCS#8) and its public key at
+/// `<key_path>.pub` (hex). Returns the public key.
+pub fn generate_signing_key(key_path: &Path) -> Result<String> {
+    if key_path.exists() {
+        return Err(anyhow::anyhow!(
+            "{} already exists; refusing to overwrite a signing key",
+            key_path.display()
+        ));
+    }
+    let pkcs8 = Ed25519KeyPair::generate_pkcs8(&SystemRandom::new())
+        .map_err(|_| anyhow::anyhow!("Failed to generate an Ed25519 key"))?;
+    let key_pair = Ed25519KeyPair::from_pkcs8(pkcs8.as_ref())
+        .map_err(|_| anyhow::anyhow!("Generated key could not be parsed"))?;
+    let public_key = to_hex(key_pair.public_key().as_ref());
+
+    atomic_write(key_path, pkcs8.as_ref())?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(key_path, fs::Permissions::from_mode(0o600))?;
+    }
+    atomic_write(
+        &public_key_path(key_path),
+        format!("{}\n", public_key).as_bytes(),
+    )?;
+    Ok(public_key)
+}
+
+fn public_key_path(key_path: &Path) -> PathBuf {
+    let mut path = key_path.as_os_str().to_owned();
+    path.push(".pub");
+    PathBuf::from(path)
+}
+
+/// Pack the index at `repo_root` and its source files into a signed bundle.
+pub fn seal_index(repo_root: &Path, output: &Path, signing_key: &Path) -> Result<SealStats> {
+    let manifest = super::load_manifest(repo_root)?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No index found at {}. Run 'cs --index' before sealing.",
+            repo_root.display()
+        )
+    })?;
+    if is_sealed(repo_root) {
+        return Err(anyhow::anyhow!(
+            "{} is an opened bundle; seal the original repository instead",
+            repo_root.display()
+        ));
+    }
+
+    let key_bytes = fs::read(signing_key)?;
+    let key_pair = Ed25519KeyPair::from_pkcs8(&key_bytes).map_err(|_| {
+        anyhow::anyhow!(
+            "{} is not an Ed25519 PKCS#8 key (create one with --generate-signing-key)",
+            signing_key.display()
+        )
+    })?;
+
+    let files = collect_bundle_files(repo_root, &manifest)?;
+    let payload = bincode::serialize(&BundlePayload {
+        format_version: FORMAT_VERSION,
+        created: now_secs(),
+        files,
+    })?;
+    let signature = key_pair.sign(&payload);
+
+    let mut bundle = Vec::with_capacity(MAGIC.len() + 8 + payload.len() + SIGNATURE_LEN);
+    bundle.extend_from_slice(MAGIC);
+    bundle.extend_from_slice(&(payload.len() as u64).to_le_bytes());
+    bundle.extend_from_slice(&payload);
+    bundle.extend_from_slice(signature.as_ref());
+    atomic_write(output, &bundle)?;
+
+    Ok(SealStats {
+        files: manifest.files.len(),
+        bytes: bundle.len() as u64,
+        public_key: to_hex(key_pair.public_key().as_ref()),
+    })
+}
+
+/// `.cs/` contents (minus local state) plus every indexed source file.
+fn collect_bundle_files(repo_root: &Path, manifest: &IndexManifest) -> Result<Vec<BundleFile>> {
+    let mut files = Vec::new();
+    let index_dir = cs_core::locations::index_dir(repo_root);
+
+    for entry in WalkDir::new(&index_dir) {
+        let entry = entry?;
+        if !entry.file_type().is_file() {
+            continue;
+        }
+        // Bundles always carry the index in-tree, wherever it is kept here
+        let relative = Path::new(cs_core::locations::INDEX_DIR_NAME)
+            .join(entry.path().strip_prefix(&index_dir)?);
+        let name = entry.file_name().to_string_lossy();
+        if entry.path().parent() == Some(index_dir.as_path())
+            && LOCAL_STATE_FILES.contains(&name.as_ref())
+        {
+            continue;
+        }
+        files.push(BundleFile {
+            path: bundle_path(&relative),
+            data: fs::read(entry.path())?,
+        });
+    }
+
+    for manifest_key in manifest.files.keys() {
+        let standard_path = path_utils::from_manifest_path(manifest_key);
+        let source = repo_root.join(&standard_path);
+        // Deleted since indexing; the sidecar alone still answers queries
+        let Ok(data) = fs::read(&source) else {
+            continue;
+        };
+        files.push(BundleFile {
+            path: bundle_path(&standard_path),
+            data,
+        });
+    }
+
+    Ok(files)
+}
+
+fn bundle_path(path: &Path) -> String {
+    cs_core::paths::to_slash(path)
+}
+
+/// Verify `bundle` against `trusted_key` (hex, or a path to a `.pub` file)
+/// and extract it read-only into `dest`. Nothing is written unless the
+/// signature is valid.
+pub fn open_bundle(bundle: &Path, trusted_key: &str, dest: &Path) -> Result<SealedInfo> {
+    let bytes = fs::read(bundle)?;
+    let public_key = parse_public_key(trusted_key)?;
+    let payload = verify_bundle(&bytes, &public_key)?;
+    let payload: BundlePayload = bincode::deserialize(payload)?;
+    if payload.format_version != FORMAT_VERSION {
+        return Err(anyhow::anyhow!(
+            "Bundle format v{} is not supported by this version of cs (v{})",
+            payload.format_version,
+            FORMAT_VERSION
+        ));
+    }
+
+    let info = SealedInfo {
+        bundle_digest: blake3::hash(&bytes).to_hex().to_string(),
+        public_key: to_hex(&public_key),
+        created: payload.created,
+        files: payload.files.len(),
+    };
+
+    // Reuse an earlier extraction of the same verified bundle, if what's on
+    // disk is still exactly what it holds: the marker alone proves nothing
+    if let Some(existing) = load_sealed_info(dest)
+        && existing.bundle_digest == info.bundle_digest
+        && extraction_matches(dest, &payload.files)
+    {
+        return Ok(existing);
+    }
+    if dest.exists() {
+        remove_read_only_tree(dest)?;
+    }
+
+    for file in &payload.files {
+        let target = dest.join(safe_relative_path(&file.path)?);
+        atomic_write(&target, &file.data)?;
+        set_read_only(&target)?;
+    }
+    let marker = cs_core::locations::index_dir(dest).join(SEALED_MARKER);
+    atomic_write(&marker, &serde_json::to_vec_pretty(&info)?)?;
+    set_read_only(&marker)?;
+
+    Ok(info)
+}
+
+/// Whether `dest` holds `files` and nothing else but the sealed marker.
+fn extraction_matches(dest: &Path, files: &[BundleFile]) -> bool {
+    let marker = cs_core::locations::index_dir(dest).join(SEALED_MARKER);
+    let mut expected: HashMap<PathBuf, &[u8]> = HashMap::new();
+    for file in files {
+        let Ok(path) = safe_relative_path(&file.path) else {
+            return false;
+        };
+        expected.insert(dest.join(path), &file.data);
+    }
+    let mut found = 0;
+    for entry in WalkDir::new(dest) {
+        let Ok(entry) = entry else {
+            return false;
+        };
+        if entry.file_type().is_dir() {
+            continue;
+        }
+        if entry.path() == marker {
+            continue;
+        }
+        match expected.get(entry.path()) {
+            Some(data)
+                if entry.file_type().is_file()
+                    && fs::read(entry.path()).is_ok_and(|on_disk| on_disk == *data) =>
+            {
+                found += 1
+            }
+            _ => return false,
+        }
+    }
+    found == expected.len()
+}
+
+/// Check the signature and return the signed payload.
+fn verify_bundle<'a>(bytes: &'a [u8], public_key: &[u8]) -> Result<&'a [u8]> {
+    let invalid = || anyhow::anyhow!("Not a cs index bundle (bad header or truncated)");
+    let body = bytes.strip_prefix(MAGIC.as_slice()).ok_or_else(invalid)?;
+    let (len, rest) = body.split_first_chunk::<8>().ok_or_else(invalid)?;
+    let len = usize::try_from(u64::from_le_bytes(*len)).map_err(|_| invalid())?;
+    if rest.len() != len.checked_add(SIGNATURE_LEN).ok_or_else(invalid)? {
+        return Err(invalid());
+    }
+    let (payload, signature) = rest.split_at(len);
+
+    UnparsedPublicKey::new(&ED25519, public_key)
+        .verify(payload, signature)
+        .map_err(|_| {
+            anyhow::anyhow!("Bundle signature does not match the trusted key; refusing to open it")
+        })?;
+    Ok(payload)
+}
+
+fn parse_public_key(trusted_key: &str) -> Result<Vec<u8>> {
+    let text = if Path::new(trusted_key).is_file() {
+        fs::read_to_string(trusted_key)?
+    } else {
+        trusted_key.to_string()
+    };
+    let key = from_hex(text.trim())
+        .filter(|key| key.len() == 32)
+        .ok_or_else(|| {
+            anyhow::anyhow!(
+                "Trusted key must be a 64-character hex Ed25519 public key or a .pub file"
+            )
+        })?;
+    Ok(key)
+}
+
+/// Reject absolute paths and `..` so a bundle can't write outside `dest`.
+pub(crate) fn safe_relative_path(path: &str) -> Result<PathBuf> {
+    let path = Path::new(path);
+    if path.components().all(|c| matches!(c, Component::Normal(_))) {
+        Ok(path.to_path_buf())
+    } else {
+        Err(anyhow::anyhow!(
+            "Bundle entry '{}' escapes the bundle root",
+            path.display()
+        ))
+    }
+}
+
+fn set_read_only(path: &Path) -> Result<()> {
+    let mut permissions = fs::metadata(path)?.permissions();
+    permissions.set_readonly(true);
+    fs::set_permissions(path, permissions)?;
+    Ok(())
+}
+
+fn remove_read_only_tree(path: &Path) -> Result<()> {
+    for entry in WalkDir::new(path).into_iter().filter_map(|e| e.ok()) {
+        if entry.file_type().is_file() {
+            let mut permissions = entry.metadata()?.permissions();
+            #[allow(clippy::permissions_set_readonly_false)]
+            permissions.set_readonly(false);
+            fs::set_permissions(entry.path(), permissions)?;
+        }
+    }
+    fs::remove_dir_all(path)?;
+    Ok(())
+}
+
+pub fn load_sealed_info(repo_root: &Path) -> Option<SealedInfo> {
+    let data = fs::read(cs_core::locations::index_dir(repo_root).join(SEALED_MARKER)).ok()?;
+    serde_json::from_slice(&data).ok()
+}
+
+/// True for indexes extracted from a bundle.
+pub fn is_sealed(repo_root: &Path) -> bool {
+    cs_core::locations::index_dir(repo_root)
+        .join(SEALED_MARKER)
+        .exists()
+}
+
+/// Error out before any write to a sealed index.
+pub fn ensure_writable(repo_root: &Path) -> Result<()> {
+    if is_sealed(repo_root) {
+        return Err(anyhow::anyhow!(
+            "The index at {} was opened from a sealed bundle and is read-only",
+            repo_root.display()
+        ));
+    }
+    Ok(())
+}
+
+fn now_secs() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+fn to_hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+fn from_hex(text: &str) -> Option<Vec<u8>> {
+    if text.len() % 2 != 0 || !text.is_ascii() {
+        return None;
+    }
+    (0..text.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(&text[i..i + 2], 16).ok())
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn write_index(root: &Path) {
+        fs::create_dir_all(root.join(".cs/src")).unwrap();
+        fs::create_dir_all(root.join("src")).unwrap();
+        fs::write(root.join("src/lib.rs"), "pub fn answer() -> u32 { 42 }\n").unwrap();
+        fs::write(root.join(".cs/src/lib.rs.cs"), b"sidecar").unwrap();
+        fs::write(root.join(".cs/feedback.json"), b"{}").unwrap();
+
+        let mut manifest = IndexManifest::default();
+        manifest.files.insert(
+            PathBuf::from("./src/lib.rs"),
+            cs_core::FileMetadata {
+                path: PathBuf::from("./src/lib.rs"),
+                hash: "h".to_string(),
+                last_modified: 0,
+                size: 30,
+            },
+        );
+        fs::write(
+            root.join(".cs/manifest.json"),
+            serde_json::to_vec(&manifest).unwrap(),
+        )
+        .unwrap();
+    }
+
+    #[test]
+    fn seal_and_open_roundtrip_read_only() {
+        let temp_dir = TempDir::new().unwrap();
+        let repo = temp_dir.path().join("repo");
+        write_index(&repo);
+
+        let key = temp_dir.path().join("review.pk8");
+        let public_key = generate_signing_key(&key).unwrap();
+        let bundle = temp_dir.path().join("repo.csbundle");
+        seal_index(&repo, &bundle, &key).unwrap();
+
+        let opened = temp_dir.path().join("opened");
+        let key_file = temp_dir.path().join("review.pk8.pub");
+        let info = open_bundle(&bundle, key_file.to_str().unwrap(), &opened).unwrap();
+        assert_eq!(info.public_key, public_key);
+        assert!(opened.join("src/lib.rs").exists());
+        assert!(opened.join(".cs/src/lib.rs.cs").exists());
+        assert!(!opened.join(".cs/feedback.json").exists());
+        assert!(is_sealed(&opened));
+        assert!(ensure_writable(&opened).is_err());
+        assert!(
+            fs::metadata(opened.join("src/lib.rs"))
+                .unwrap()
+                .permissions()
+                .readonly()
+        );
+    }
+
+    #[test]
+    fn open_rejects_tampered_or_untrusted_bundles() {
+        let temp_dir = TempDir::new().unwrap();
+        let repo = temp_dir.path().join("repo");
+        write_index(&repo);
+
+        let key = temp_dir.path().join("a.pk8");
+        generate_signing_key(&key).unwrap();
+        let other_public = generate_signing_key(&temp_dir.path().join("b.pk8")).unwrap();
+        let bundle = temp_dir.path().join("repo.csbundle");
+        seal_index(&repo, &bundle, &key).unwrap();
+
+        let opened = temp_dir.path().join("opened");
+        assert!(open_bundle(&bundle, &other_public, &opened).is_err());
+        assert!(!opened.exists());
+
+        let mut bytes = fs::read(&bundle).unwrap();
+        let middle = bytes.len() / 2;
+        bytes[middle] ^= 0xff;
+        fs::write(&bundle, bytes).unwrap();
+        let own_public = fs::read_to_string(temp_dir.path().join("a.pk8.pub")).unwrap();
+        assert!(open_bundle(&bundle, own_public.trim(), &opened).is_err());
+        assert!(!opened.exists());
+    }
+
+    #[test]
+    fn reopening_checks_the_extraction_not_just_its_marker() {
+        let temp_dir = TempDir::new().unwrap();
+        let repo = temp_dir.path().join("repo");
+        write_index(&repo);
+        let key = temp_dir.path().join("review.pk8");
+        let public_key = generate_signing_key(&key).unwrap();
+        let bundle = temp_dir.path().join("repo.csbundle");
+        seal_index(&repo, &bundle, &key).unwrap();
+
+        let opened = temp_dir.path().join("opened");
+        open_bundle(&bundle, &public_key, &opened).unwrap();
+
+        // Someone else's files behind a copied marker are replaced
+        let planted = opened.join("src/lib.rs");
+        let mut permissions = fs::metadata(&planted).unwrap().permissions();
+        #[allow(clippy::permissions_set_readonly_false)]
+        permissions.set_readonly(false);
+        fs::set_permissions(&planted, permissions).unwrap();
+        fs::write(&planted, "pub fn answer() -> u32 { 41 }\n").unwrap();
+        fs::write(opened.join("src/extra.rs"), "fn planted() {}\n").unwrap();
+
+        open_bundle(&bundle, &public_key, &opened).unwrap();
+        assert_eq!(
+            fs::read_to_string(&planted).unwrap(),
+            "pub fn answer() -> u32 { 42 }\n"
+        );
+        assert!(!opened.join("src/extra.rs").exists());
+    }
+
+    #[test]
+    fn rejects_escaping_entries() {
+        assert!(safe_relative_path("src/lib.rs").is_ok());
+        assert!(safe_relative_path("../etc/passwd").is_err());
+        assert!(safe_relative_path("/etc/passwd").is_err());
+    }
+}
@@ -0,0 +1,448 @@
+//! Chat exports as collection sources:
+//! `cs --index --collection chat --chats ~/exports/slack` reads a Slack
+//! workspace export or DiscordChatExporter JSON and indexes one document per
+//! conversation, so a search finds the thread where the team debated the code
+//! next to the code itself.
+//!
+//! A conversation is a thread, or for messages posted outside threads, a run
+//! of messages in a channel without a half-hour lull. Slack exports are read
+//! unzipped: a directory per channel holding a JSON file per day, plus
+//! `users.json` for names. Discord exports are the JSON files
+//! DiscordChatExporter writes, one per channel or thread; their results link
+//! back to the first message.
+
+use super::collections::Document;
+use anyhow::{Result, bail};
+use regex::Regex;
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+/// Prefix of the connector saved with a collection read from a chat export.
+pub const CHATS_CONNECTOR: &str = "chats:";
+
+/// Messages further apart than this outside a thread are separate
+/// conversations.
+const CONVERSATION_GAP_SECS: i64 = 30 * 60;
+
+/// Slack wraps mentions and links in angle brackets: `<@U024BE7LH>`,
+/// `<https://example.com|label>`, `<#C024BE7LR|deploys>`.
+static SLACK_MARKUP: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"<([@#!]?)([^<>|]+)(?:\|([^<>]*))?>").unwrap());
+
+#[derive(Debug, Clone)]
+struct Message {
+    id: String,
+    /// The message this one replies to, or the root of its thread
+    reply_to: Option<String>,
+    /// Whether replies are threaded under it (Slack)
+    starts_thread: bool,
+    time: i64,
+    author: String,
+    text: String,
+}
+
+/// The conversations of the export at `path`: a Slack export directory, or a
+/// DiscordChatExporter JSON file or directory of them.
+pub fn read_chat_export(path: &Path) -> Result<Vec<Document>> {
+    if path.is_dir() && is_slack_export(path) {
+        return read_slack(path);
+    }
+    let files: Vec<PathBuf> = if path.is_dir() {
+        let mut files: Vec<PathBuf> = fs::read_dir(path)?
+            .flatten()
+            .map(|entry| entry.path())
+            .filter(|file| file.extension().is_some_and(|ext| ext == "json"))
+            .collect();
+        files.sort();
+        files
+    } else if path.is_file() {
+        vec![path.to_path_buf()]
+    } else {
+        bail!("No such file or directory: {}", path.display());
+    };
+
+    let mut documents = Vec::new();
+    for file in &files {
+        let export: DiscordExport = serde_json::from_slice(&fs::read(file)?).map_err(|e| {
+            anyhow::anyhow!(
+                "{} is neither a Slack export nor a DiscordChatExporter JSON file: {}",
+                file.display(),
+                e
+            )
+        })?;
+        documents.extend(discord_documents(export));
+    }
+    Ok(documents)
+}
+
+fn is_slack_export(path: &Path) -> bool {
+    ["channels.json", "users.json"]
+        .iter()
+        .any(|file| path.join(file).is_file())
+}
+
+/// Group a channel's messages into conversations, oldest first.
+fn conversations(mut messages: Vec<Message>) -> Vec<Vec<Message>> {
+    messages.sort_by_key(|message| message.time);
+    let mut conversations: Vec<Vec<Message>> = Vec::new();
+    let mut by_id: HashMap<String, usize> = HashMap::new();
+    // The conversation messages outside threads are added to
+    let mut open: Option<usize> = None;
+    for message in messages {
+        let thread = message
+            .reply_to
+            .as_ref()
+            .and_then(|id| by_id.get(id))
+            .copied();
+        let index = match (thread, open) {
+            (Some(thread), _) => thread,
+            (None, Some(open))
+                if !message.starts_thread
+                    && conversations[open]
+                        .last()
+                        .is_some_and(|last| message.time - last.time <= CONVERSATION_GAP_SECS) =>
+            {
+                open
+            }
+            _ => {
+                conversations.push(Vec::new());
+                let index = conversations.len() - 1;
+                open = (!message.starts_thread).then_some(index);
+                index
+            }
+        };
+        by_id.insert(message.id.clone(), index);
+        conversations[index].push(message);
+    }
+    conversations
+}
+
+/// The text indexed for a conversation: each message as its own paragraph.
+fn conversation_text(messages: &[Message]) -> String {
+    messages
+        .iter()
+        .filter(|message| !message.text.trim().is_empty())
+        .map(|message| format!("{}: {}", message.author, message.text.trim()))
+        .collect::<Vec<_>>()
+        .join("\n\n")
+}
+
+/// `2023-04-11T1736`, the UTC minute a conversation started, for naming it.
+fn minute_label(secs: i64) -> String {
+    let (year, month, day) = civil_from_days(secs.div_euclid(86_400));
+    let minutes = secs.rem_euclid(86_400) / 60;
+    format!(
+        "{:04}-{:02}-{:02}T{:02}{:02}",
+        year,
+        month,
+        day,
+        minutes / 60,
+        minutes % 60
+    )
+}
+
+/// Year, month and day of a count of days since 1970-01-01.
+fn civil_from_days(days: i64) -> (i64, i64, i64) {
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let doe = z.rem_euclid(146_097);
+    let yoe = (doe - doe / 1460 + doe / 36_524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + i64::from(month <= 2);
+    (year, month, day)
+}
+
+/// Days since 1970-01-01 of a calendar date.
+fn days_from_civil(year: i64, month: i64, day: i64) -> i64 {
+    let year = if month <= 2 { year - 1 } else { year };
+    let era = year.div_euclid(400);
+    let yoe = year.rem_euclid(400);
+    let doy = (153 * ((month + 9) % 12) + 2) / 5 + day - 1;
+    let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    era * 146_097 + doe - 719_468
+}
+
+/// Seconds since the epoch of an ISO 8601 timestamp like
+/// `2023-04-11T17:36:12.123+02:00`.
+fn parse_timestamp(timestamp: &str) -> Option<i64> {
+    let field = |range: std::ops::Range<usize>| timestamp.get(range)?.parse::<i64>().ok();
+    let days = days_from_civil(field(0..4)?, field(5..7)?, field(8..10)?);
+    let secs = days * 86_400 + field(11..13)? * 3600 + field(14..16)? * 60 + field(17..19)?;
+    let zone = timestamp[19..].trim_start_matches(|c: char| c == '.' || c.is_ascii_digit());
+    let offset = match zone.as_bytes().first() {
+        Some(sign @ (b'+' | b'-')) => {
+            let offset = zone.get(1..3)?.parse::<i64>().ok()? * 3600
+                + zone.get(4..6)?.parse::<i64>().ok()? * 60;
+            if *sign == b'+' { offset } else { -offset }
+        }
+        _ => 0,
+    };
+    Some(secs - offset)
+}
+
+#[derive(Deserialize)]
+struct SlackUser {
+    id: String,
+    #[serde(default)]
+    name: String,
+    #[serde(default)]
+    real_name: Option<String>,
+}
+
+#[derive(Deserialize)]
+struct SlackMessage {
+    #[serde(default)]
+    ts: String,
+    thread_ts: Option<String>,
+    #[serde(default)]
+    reply_count: usize,
+    subtype: Option<String>,
+    user: Option<String>,
+    /// Set on bot messages
+    username: Option<String>,
+    user_profile: Option<SlackProfile>,
+    #[serde(default)]
+    text: String,
+}
+
+#[derive(Deserialize)]
+struct SlackProfile {
+    #[serde(default)]
+    real_name: String,
+}
+
+/// Replace Slack's mention and link markup with what it displays as.
+fn slack_text(text: &str, users: &HashMap<String, String>) -> String {
+    SLACK_MARKUP
+        .replace_all(text, |caps: &regex::Captures| {
+            let label = caps.get(3).map(|m| m.as_str());
+            match (&caps[1], label) {
+                ("@", _) => format!("@{}", users.get(&caps[2]).map_or(&caps[2], String::as_str)),
+                ("#", Some(label)) => format!("#{}", label),
+                (_, Some(label)) if !label.is_empty() => label.to_string(),
+                _ => caps[2].to_string(),
+            }
+        })
+        .replace("&lt;", "<")
+        .replace("&gt;", ">")
+        .replace("&amp;", "&")
+}
+
+fn read_slack(root: &Path) -> Result<Vec<Document>> {
+    let users: HashMap<String, String> = match fs::read(root.join("users.json")) {
+        Ok(data) => serde_json::from_slice::<Vec<SlackUser>>(&data)?
+            .into_iter()
+            .map(|user| (user.id, user.real_name.unwrap_or(user.name)))
+            .collect(),
+        Err(_) => HashMap::new(),
+    };
+
+    let mut channels: Vec<PathBuf> = fs::read_dir(root)?
+        .flatten()
+        .map(|entry| entry.path())
+        .filter(|path| path.is_dir())
+        .collect();
+    channels.sort();
+
+    let mut documents = Vec::new();
+    for channel in channels {
+        let name = channel
+            .file_name()
+            .map(|name| name.to_string_lossy().into_owned())
+            .unwrap_or_default();
+        let mut messages = Vec::new();
+        for day in fs::read_dir(&channel)?.flatten() {
+            let path = day.path();
+            if path.extension().is_none_or(|ext| ext != "json") {
+                continue;
+            }
+            let day: Vec<SlackMessage> = serde_json::from_slice(&fs::read(&path)?)
+                .map_err(|e| anyhow::anyhow!("Failed to read {}: {}", path.display(), e))?;
+            for message in day {
+                // Joins, leaves and topic changes aren't conversation
+                if message
+                    .subtype
+                    .as_deref()
+                    .is_some_and(|subtype| subtype.starts_with("channel_"))
+                {
+                    continue;
+                }
+                let Some(time) = message.ts.split('.').next().and_then(|s| s.parse().ok()) else {
+                    continue;
+                };
+                let author = message
+                    .user_profile
+                    .map(|profile| profile.real_name)
+                    .filter(|name| !name.is_empty())
+                    .or_else(|| message.user.as_ref().and_then(|id| users.get(id).cloned()))
+                    .or(message.username)
+                    .unwrap_or_else(|| "unknown".to_string());
+                messages.push(Message {
+                    reply_to: message.thread_ts.clone().filter(|ts| *ts != message.ts),
+                    starts_thread: message.reply_count > 0,
+                    id: message.ts,
+                    time,
+                    author,
+                    text: slack_text(&message.text, &users),
+                });
+            }
+        }
+        for conversation in conversations(messages) {
+            let text = conversation_text(&conversation);
+            if text.is_empty() {
+                continue;
+            }
+            documents.push(Document {
+                source: format!("{}/{}", name, minute_label(conversation[0].time)),
+                url: None,
+                text,
+            });
+        }
+    }
+    Ok(documents)
+}
+
+#[derive(Deserialize)]
+struct DiscordExport {
+    guild: DiscordEntity,
+    channel: DiscordEntity,
+    messages: Vec<DiscordMessage>,
+}
+
+#[derive(Deserialize)]
+struct DiscordEntity {
+    id: String,
+    #[serde(default)]
+    name: String,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct DiscordMessage {
+    id: String,
+    timestamp: String,
+    #[serde(default)]
+    content: String,
+    author: DiscordAuthor,
+    reference: Option<DiscordReference>,
+}
+
+#[derive(Deserialize)]
+struct DiscordAuthor {
+    #[serde(default)]
+    name: String,
+    nickname: Option<String>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct DiscordReference {
+    message_id: Option<String>,
+}
+
+fn discord_documents(export: DiscordExport) -> Vec<Document> {
+    let messages: Vec<Message> = export
+        .messages
+        .into_iter()
+        .filter_map(|message| {
+            Some(Message {
+                time: parse_timestamp(&message.timestamp)?,
+                reply_to: message.reference.and_then(|r| r.message_id),
+                starts_thread: false,
+                author: message.author.nickname.unwrap_or(message.author.name),
+                text: message.content,
+                id: message.id,
+            })
+        })
+        .collect();
+    conversations(messages)
+        .into_iter()
+        .filter_map(|conversation| {
+            let text = conversation_text(&conversation);
+            (!text.is_empty()).then(|| Document {
+                source: format!(
+                    "{}/{}",
+                    export.channel.name,
+                    minute_label(conversation[0].time)
+                ),
+                url: Some(format!(
+                    "https://discord.com/channels/{}/{}/{}",
+                    export.guild.id, export.channel.id, conversation[0].id
+                )),
+                text,
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn message(id: &str, reply_to: Option<&str>, time: i64, text: &str) -> Message {
+        Message {
+            id: id.to_string(),
+            reply_to: reply_to.map(str::to_string),
+            starts_thread: false,
+            time,
+            author: "dana".to_string(),
+            text: text.to_string(),
+        }
+    }
+
+    #[test]
+    fn messages_group_into_threads_and_runs() {
+        let mut root = message("1", None, 0, "should user deletion cascade?");
+        root.starts_thread = true;
+        let grouped = conversations(vec![
+            root,
+            message("2", None, 60, "lunch?"),
+            message("3", Some("1"), 120, "soft delete, then a nightly job"),
+            message("4", None, 600, "sure"),
+            message(
+                "5",
+                None,
+                600 + CONVERSATION_GAP_SECS + 1,
+                "deploy is green",
+            ),
+        ]);
+        let ids: Vec<Vec<&str>> = grouped
+            .iter()
+            .map(|c| c.iter().map(|m| m.id.as_str()).collect())
+            .collect();
+        assert_eq!(ids, vec![vec!["1", "3"], vec!["2", "4"], vec!["5"]]);
+        assert_eq!(
+            conversation_text(&grouped[0]),
+            "dana: should user deletion cascade?\n\ndana: soft delete, then a nightly job"
+        );
+    }
+
+    #[test]
+    fn timestamps_convert_to_utc() {
+        assert_eq!(parse_timestamp("1970-01-01T00:00:00Z"), Some(0));
+        assert_eq!(
+            parse_timestamp("2023-04-11T19:36:12.123+02:00"),
+            Some(1_681_234_572)
+        );
+        assert_eq!(minute_label(1_681_234_572), "2023-04-11T1736");
+        assert_eq!(parse_timestamp("yesterday"), None);
+    }
+
+    #[test]
+    fn slack_markup_reads_as_displayed() {
+        let users = HashMap::from([("U1".to_string(), "Lee".to_string())]);
+        assert_eq!(
+            slack_text(
+                "<@U1> see <https://ci.example.com/42|the run> in <#C9|deploys> &amp; <https://x.io>",
+                &users
+            ),
+            "@Lee see the run in #deploys & https://x.io"
+        );
+    }
+}
@@ -0,0 +1,593 @@
+//! Named collections of text searched next to the repository's code: meeting
+//! notes piped in with `cat notes.txt | cs --index --stdin --collection notes`,
+//! or docs and tickets kept outside the repository with
+//! `cs --index --collection docs ~/wiki`, issues fetched from a tracker with
+//! `cs --index --collection tickets --issues github:owner/repo`, or chat
+//! exports read with `cs --index --collection chat --chats ~/slack-export`.
+//!
+//! Text is split into paragraph-aligned chunks as it's read and embedded in
+//! batches, so a long stream never waits on the whole input. Each collection
+//! is stored in `.cs/collections/<name>.bin` with its own settings: the model
+//! it was embedded with, which needn't be the index's, and the paths or
+//! tracker it was built from, so `cs --index --collection docs` alone
+//! rebuilds it. Chunk text is stored compressed (see [`compression`]). The
+//! repository's files are the collection named [`CODE_COLLECTION`], and
+//! agents' memories (see [`super::memories`]) the one named `memory`.
+
+use super::compression::{self, ChunkText, Dictionary};
+use super::{atomic_write, bundle, collect_files, load_manifest, secrets};
+use anyhow::{Result, bail};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io::BufRead;
+use std::path::{Path, PathBuf};
+
+pub const COLLECTIONS_DIR: &str = "collections";
+
+/// The name searches use for the repository's own files.
+pub const CODE_COLLECTION: &str = "code";
+
+/// Source of chunks read from stdin.
+pub const STDIN_SOURCE: &str = "stdin";
+
+/// Chunks embedded per call to the embedder.
+const EMBED_BATCH: usize = 32;
+
+/// A chunk ends at the first paragraph break past this many bytes...
+const TARGET_CHUNK_BYTES: usize = 800;
+
+/// ...or wherever it reaches this many, for text without paragraph breaks.
+const MAX_CHUNK_BYTES: usize = 2000;
+
+/// Starts collection files written since chunk text is compressed; older
+/// ones hold it verbatim.
+const FORMAT_MAGIC: &[u8] = b"cs-collection-2\n";
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct CollectionChunk {
+    /// File the chunk was read from, from the source it was found under
+    /// (`wiki/ops/deploy.md`), or [`STDIN_SOURCE`]
+    pub source: String,
+    pub line_start: usize,
+    pub line_end: usize,
+    /// Read it with [`Collection::text`]
+    pub text: ChunkText,
+    /// Where the text can be read in full, for issues fetched from a tracker
+    pub url: Option<String>,
+    pub embedding: Vec<f32>,
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct Collection {
+    pub name: String,
+    pub embedding_model: Option<String>,
+    /// Files and directories the collection was built from; empty for stdin
+    pub sources: Vec<PathBuf>,
+    /// Issue tracker (`github:owner/repo`) or chat export (`chats:<path>`) the
+    /// collection was read from
+    pub connector: Option<String>,
+    pub chunks: Vec<CollectionChunk>,
+    /// Dictionaries the chunk text was compressed with
+    pub dictionaries: Vec<Dictionary>,
+}
+
+impl Collection {
+    /// The text of one of the collection's chunks.
+    pub fn text(&self, chunk: &CollectionChunk) -> Result<String> {
+        compression::decompress(&chunk.text, &self.dictionaries)
+    }
+}
+
+/// How collections were stored before chunk text was compressed.
+#[derive(Deserialize)]
+struct LegacyCollection {
+    name: String,
+    embedding_model: Option<String>,
+    sources: Vec<PathBuf>,
+    connector: Option<String>,
+    chunks: Vec<LegacyChunk>,
+}
+
+#[derive(Deserialize)]
+struct LegacyChunk {
+    source: String,
+    line_start: usize,
+    line_end: usize,
+    text: String,
+    url: Option<String>,
+    embedding: Vec<f32>,
+}
+
+impl From<LegacyCollection> for Collection {
+    fn from(legacy: LegacyCollection) -> Self {
+        Collection {
+            name: legacy.name,
+            embedding_model: legacy.embedding_model,
+            sources: legacy.sources,
+            connector: legacy.connector,
+            chunks: legacy
+                .chunks
+                .into_iter()
+                .map(|chunk| CollectionChunk {
+                    source: chunk.source,
+                    line_start: chunk.line_start,
+                    line_end: chunk.line_end,
+                    text: chunk.text.into(),
+                    url: chunk.url,
+                    embedding: chunk.embedding,
+                })
+                .collect(),
+            dictionaries: Vec::new(),
+        }
+    }
+}
+
+/// A text fetched from somewhere other than a file, like an issue and its
+/// comments.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Document {
+    /// Names the document in results (`owner/repo#42`)
+    pub source: String,
+    pub url: Option<String>,
+    pub text: String,
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct CollectionStats {
+    pub files_read: usize,
+    pub lines_read: usize,
+    pub chunks_embedded: usize,
+    pub chunks_withheld: usize,
+}
+
+fn collections_dir(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(COLLECTIONS_DIR)
+}
+
+fn collection_path(repo_root: &Path, name: &str) -> PathBuf {
+    collections_dir(repo_root).join(format!("{}.bin", name))
+}
+
+/// Collection names become file names and prefix search results.
+pub fn validate_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_');
+    if !valid {
+        bail!(
+            "Invalid collection name '{}': use letters, digits, '-' and '_'",
+            name
+        );
+    }
+    if name == CODE_COLLECTION {
+        bail!(
+            "'{}' is the repository's own files; pick another name for the collection",
+            CODE_COLLECTION
+        );
+    }
+    if name == crate::memories::MEMORY_COLLECTION {
+        bail!(
+            "'{}' holds agents' memories (cs --remember); pick another name for the collection",
+            name
+        );
+    }
+    Ok(())
+}
+
+/// Whether a search limited to `selected` collections covers the
+/// repository's files. Selecting none means searching everything.
+pub fn includes_code(selected: &[String]) -> bool {
+    selected.is_empty() || selected.iter().any(|name| name == CODE_COLLECTION)
+}
+
+/// Splits lines into chunks, ending each at a paragraph break once it's long
+/// enough.
+#[derive(Default)]
+struct Chunker {
+    text: String,
+    line_start: usize,
+    line: usize,
+}
+
+impl Chunker {
+    /// Add a line, returning the chunk it completes, if any.
+    fn push(&mut self, line: &str) -> Option<(usize, usize, String)> {
+        self.line += 1;
+        if line.trim().is_empty() {
+            if self.text.len() >= TARGET_CHUNK_BYTES {
+                return self.finish();
+            }
+            if !self.text.is_empty() {
+                self.text.push('\n');
+            }
+            return None;
+        }
+        if self.text.is_empty() {
+            self.line_start = self.line;
+        }
+        self.text.push_str(line);
+        self.text.push('\n');
+        if self.text.len() >= MAX_CHUNK_BYTES {
+            return self.finish();
+        }
+        None
+    }
+
+    fn finish(&mut self) -> Option<(usize, usize, String)> {
+        let text = std::mem::take(&mut self.text);
+        let text = text.trim_end();
+        if text.is_empty() {
+            return None;
+        }
+        let line_end = self.line_start + text.lines().count() - 1;
+        Some((self.line_start, line_end, text.to_string()))
+    }
+}
+
+/// Embeds chunks in batches as sources are read.
+struct Builder<'a> {
+    embedder: Box<dyn cs_embed::Embedder>,
+    repo_root: &'a Path,
+    name: &'a str,
+    pending: Vec<CollectionChunk>,
+    chunks: Vec<CollectionChunk>,
+    stats: CollectionStats,
+}
+
+impl<'a> Builder<'a> {
+    fn new(repo_root: &'a Path, name: &'a str, model: &str) -> Result<Self> {
+        Ok(Self {
+            embedder: cs_embed::create_embedder(Some(model))?,
+            repo_root,
+            name,
+            pending: Vec::new(),
+            chunks: Vec::new(),
+            stats: CollectionStats::default(),
+        })
+    }
+
+    /// Chunk and embed the lines of `input`, read from `source`.
+    fn read(&mut self, source: &str, url: Option<&str>, input: impl BufRead) -> Result<()> {
+        let mut chunker = Chunker::default();
+        for line in input.lines() {
+            let line = line?;
+            self.stats.lines_read += 1;
+            if let Some(chunk) = chunker.push(&line) {
+                self.add(source, url, chunk)?;
+            }
+        }
+        if let Some(chunk) = chunker.finish() {
+            self.add(source, url, chunk)?;
+        }
+        Ok(())
+    }
+
+    fn add(
+        &mut self,
+        source: &str,
+        url: Option<&str>,
+        chunk: (usize, usize, String),
+    ) -> Result<()> {
+        let (line_start, line_end, text) = chunk;
+        self.pending.push(CollectionChunk {
+            source: source.to_string(),
+            line_start,
+            line_end,
+            text: text.into(),
+            url: url.map(str::to_string),
+            embedding: Vec::new(),
+        });
+        if self.pending.len() >= EMBED_BATCH {
+            self.flush()?;
+        }
+        Ok(())
+    }
+
+    /// Embed the pending chunks, screening each for secrets first. Withheld
+    /// chunks are left out.
+    fn flush(&mut self) -> Result<()> {
+        let mut texts = Vec::new();
+        let mut kept = Vec::new();
+        for chunk in std::mem::take(&mut self.pending) {
+            let ChunkText::Plain(text) = &chunk.text else {
+                unreachable!("pending chunks aren't compressed yet");
+            };
+            match secrets::screen(&*self.embedder, self.repo_root, text)? {
+                Some(text) => {
+                    texts.push(text);
+                    kept.push(chunk);
+                }
+                None => {
+                    tracing::warn!(
+                        "Withheld {} lines {}-{} of collection {} from the remote embedder",
+                        chunk.source,
+                        chunk.line_start,
+                        chunk.line_end,
+                        self.name
+                    );
+                    self.stats.chunks_withheld += 1;
+                }
+            }
+        }
+        if texts.is_empty() {
+            return Ok(());
+        }
+        let embeddings = self.embedder.embed(&texts)?;
+        if embeddings.len() != kept.len() {
+            bail!(
+                "Embedder returned {} embeddings for {} chunks",
+                embeddings.len(),
+                kept.len()
+            );
+        }
+        for (mut chunk, embedding) in kept.into_iter().zip(embeddings) {
+            chunk.embedding = embedding;
+            self.chunks.push(chunk);
+            self.stats.chunks_embedded += 1;
+        }
+        Ok(())
+    }
+
+    fn save(
+        mut self,
+        model: String,
+        sources: Vec<PathBuf>,
+        connector: Option<String>,
+    ) -> Result<CollectionStats> {
+        self.flush()?;
+        let texts = self
+            .chunks
+            .iter_mut()
+            .map(|chunk| {
+                let ChunkText::Plain(text) =
+                    std::mem::replace(&mut chunk.text, String::new().into())
+                else {
+                    unreachable!("chunks are only compressed on save");
+                };
+                (compression::language_of(&chunk.source), text)
+            })
+            .collect();
+        let (texts, dictionaries) = compression::compress(texts)?;
+        for (chunk, text) in self.chunks.iter_mut().zip(texts) {
+            chunk.text = text;
+        }
+        let collection = Collection {
+            name: self.name.to_string(),
+            embedding_model: Some(model),
+            sources,
+            connector,
+            chunks: self.chunks,
+            dictionaries,
+        };
+        let path = collection_path(self.repo_root, self.name);
+        let mut data = FORMAT_MAGIC.to_vec();
+        data.extend(bincode::serialize(&collection)?);
+        let data = super::encryption::seal_for(&path, data)?;
+        atomic_write(&path, &data)?;
+        Ok(self.stats)
+    }
+}
+
+/// The model a collection is embedded with: `model` if given, else the one it
+/// was embedded with before, else the index's.
+pub(crate) fn collection_model(
+    repo_root: &Path,
+    previous: Option<&Collection>,
+    model: Option<&str>,
+) -> Result<String> {
+    if let Some(model) = model.or(previous.and_then(|c| c.embedding_model.as_deref())) {
+        return Ok(model.to_string());
+    }
+    let manifest = load_manifest(repo_root)?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No index found; run 'cs --index' before adding a collection, or pass --model"
+        )
+    })?;
+    manifest.embedding_model.ok_or_else(|| {
+        anyhow::anyhow!(
+            "The index has no embeddings; rebuild it with 'cs --index', or pass --model"
+        )
+    })
+}
+
+/// Embed the text read from `input` into the collection `name`, replacing
+/// what it held before.
+pub fn index_collection(
+    repo_root: &Path,
+    name: &str,
+    input: impl BufRead,
+    model: Option<&str>,
+) -> Result<CollectionStats> {
+    validate_name(name)?;
+    bundle::ensure_writable(repo_root)?;
+    let previous = load_collection(repo_root, name)?;
+    let model = collection_model(repo_root, previous.as_ref(), model)?;
+
+    let mut builder = Builder::new(repo_root, name, &model)?;
+    builder.read(STDIN_SOURCE, None, input)?;
+    builder.save(model, Vec::new(), None)
+}
+
+/// Embed the text files under `sources` into the collection `name`, replacing
+/// what it held before. Without sources, the collection is rebuilt from the
+/// ones it was last built from.
+pub fn index_collection_files(
+    repo_root: &Path,
+    name: &str,
+    sources: &[PathBuf],
+    model: Option<&str>,
+) -> Result<CollectionStats> {
+    validate_name(name)?;
+    bundle::ensure_writable(repo_root)?;
+    let previous = load_collection(repo_root, name)?;
+    let sources: Vec<PathBuf> = if sources.is_empty() {
+        match previous.as_ref().filter(|c| !c.sources.is_empty()) {
+            Some(previous) => previous.sources.clone(),
+            None => bail!(
+                "Collection {} has no saved sources; pass the files or directories to index, or pipe text with --stdin",
+                name
+            ),
+        }
+    } else {
+        sources
+            .iter()
+            .map(|source| cs_core::paths::canonicalize_lossy(source))
+            .collect()
+    };
+    let model = collection_model(repo_root, previous.as_ref(), model)?;
+
+    let mut builder = Builder::new(repo_root, name, &model)?;
+    for source in &sources {
+        let files = if source.is_dir() {
+            collect_files(source, true, &[])?
+        } else if source.is_file() {
+            vec![source.clone()]
+        } else {
+            bail!("No such file or directory: {}", source.display());
+        };
+        for file in files {
+            // Binary and non-UTF-8 files aren't text to search
+            let Ok(text) = fs::read_to_string(&file) else {
+                continue;
+            };
+            builder.stats.files_read += 1;
+            // Named from the source down, like `wiki/ops/deploy.md`
+            let parent = source.parent().unwrap_or(source);
+            let relative = file.strip_prefix(parent).unwrap_or(&file);
+            builder.read(&cs_core::paths::to_slash(relative), None, text.as_bytes())?;
+        }
+    }
+    builder.save(model, sources, None)
+}
+
+/// Embed `documents` fetched from `connector` into the collection `name`,
+/// replacing what it held before.
+pub fn index_collection_documents(
+    repo_root: &Path,
+    name: &str,
+    connector: &str,
+    documents: &[Document],
+    model: Option<&str>,
+) -> Result<CollectionStats> {
+    validate_name(name)?;
+    bundle::ensure_writable(repo_root)?;
+    let previous = load_collection(repo_root, name)?;
+    let model = collection_model(repo_root, previous.as_ref(), model)?;
+
+    let mut builder = Builder::new(repo_root, name, &model)?;
+    for document in documents {
+        builder.stats.files_read += 1;
+        builder.read(
+            &document.source,
+            document.url.as_deref(),
+            document.text.as_bytes(),
+        )?;
+    }
+    builder.save(model, Vec::new(), Some(connector.to_string()))
+}
+
+fn load_from(path: &Path) -> Result<Collection> {
+    let data = super::encryption::open_from(path, fs::read(path)?)?;
+    match data.strip_prefix(FORMAT_MAGIC) {
+        Some(data) => Ok(bincode::deserialize(data)?),
+        None => Ok(bincode::deserialize::<LegacyCollection>(&data)?.into()),
+    }
+}
+
+/// The collection `name`, or `None` if there's no such collection.
+pub fn load_collection(repo_root: &Path, name: &str) -> Result<Option<Collection>> {
+    let path = collection_path(repo_root, name);
+    if !path.exists() {
+        return Ok(None);
+    }
+    load_from(&path).map(Some)
+}
+
+/// Every collection of the index at `repo_root`, by name.
+pub fn load_collections(repo_root: &Path) -> Result<Vec<Collection>> {
+    let dir = collections_dir(repo_root);
+    if !dir.is_dir() {
+        return Ok(Vec::new());
+    }
+    let mut paths: Vec<PathBuf> = fs::read_dir(&dir)?
+        .flatten()
+        .map(|entry| entry.path())
+        .filter(|path| path.extension().is_some_and(|ext| ext == "bin"))
+        .collect();
+    paths.sort();
+    paths.iter().map(|path| load_from(path)).collect()
+}
+
+/// Files the collections of `repo_root` are stored in, for telling when they
+/// changed.
+pub fn collection_files(repo_root: &Path) -> Vec<PathBuf> {
+    let mut files: Vec<PathBuf> = fs::read_dir(collections_dir(repo_root))
+        .into_iter()
+        .flatten()
+        .flatten()
+        .map(|entry| entry.path())
+        .collect();
+    files.sort();
+    files
+}
+
+/// Delete the collection `name`, returning whether it existed.
+pub fn remove_collection(repo_root: &Path, name: &str) -> Result<bool> {
+    validate_name(name)?;
+    bundle::ensure_writable(repo_root)?;
+    let path = collection_path(repo_root, name);
+    if !path.exists() {
+        return Ok(false);
+    }
+    fs::remove_file(&path)?;
+    Ok(true)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunks(text: &str) -> Vec<(usize, usize, String)> {
+        let mut chunker = Chunker::default();
+        let mut chunks: Vec<_> = text.lines().filter_map(|line| chunker.push(line)).collect();
+        chunks.extend(chunker.finish());
+        chunks
+    }
+
+    #[test]
+    fn chunks_end_at_paragraph_breaks() {
+        let long = "word ".repeat(TARGET_CHUNK_BYTES / 5);
+        let text = format!(
+            "Standup notes\n\n{}\n\n\nNext paragraph\nsecond line\n",
+            long
+        );
+        let chunks = chunks(&text);
+        assert_eq!(chunks.len(), 2);
+        assert_eq!((chunks[0].0, chunks[0].1), (1, 3));
+        assert!(chunks[0].2.starts_with("Standup notes\n\nword"));
+        assert_eq!(chunks[1], (6, 7, "Next paragraph\nsecond line".to_string()));
+
+        let unbroken = "x".repeat(100);
+        let text = vec![unbroken.as_str(); 30].join("\n");
+        assert!(
+            chunks(&text)
+                .iter()
+                .all(|chunk| chunk.2.len() <= MAX_CHUNK_BYTES + 101)
+        );
+        assert!(chunks("\n\n").is_empty());
+    }
+
+    #[test]
+    fn names_are_file_safe() {
+        assert!(validate_name("design-docs_2024").is_ok());
+        assert!(validate_name("../notes").is_err());
+        assert!(validate_name("").is_err());
+        assert!(validate_name(CODE_COLLECTION).is_err());
+        assert!(validate_name(crate::memories::MEMORY_COLLECTION).is_err());
+
+        assert!(includes_code(&[]));
+        assert!(includes_code(&["docs".to_string(), "code".to_string()]));
+        assert!(!includes_code(&["docs".to_string()]));
+    }
+}
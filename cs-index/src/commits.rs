@@ -0,0 +1,270 @@
+//! Commit messages as searchable chunks (`cs --index --index-commits`).
+//!
+//! Each non-merge commit's subject, body and touched paths are embedded with
+//! the index's model and stored in `.cs/commits.bin`, so semantic searches
+//! can surface the commit that explains a piece of code next to the code.
+
+use super::{atomic_write, bundle, load_manifest, secrets};
+use anyhow::{Context, Result, bail};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+pub const COMMITS_FILE: &str = "commits.bin";
+
+/// Commits embedded per call to the embedder.
+const EMBED_BATCH: usize = 32;
+
+/// Touched paths included in the embedded text; large refactors list many more.
+const MAX_EMBEDDED_PATHS: usize = 20;
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct CommitEntry {
+    pub sha: String,
+    pub author: String,
+    pub timestamp: u64,
+    pub subject: String,
+    pub body: String,
+    /// Paths the commit touched, relative to the repository root
+    pub files: Vec<String>,
+    pub embedding: Vec<f32>,
+}
+
+impl CommitEntry {
+    pub fn short_sha(&self) -> &str {
+        &self.sha[..self.sha.len().min(7)]
+    }
+
+    /// Text that is embedded: the message followed by the touched paths.
+    pub fn text(&self) -> String {
+        let mut text = self.subject.clone();
+        if !self.body.is_empty() {
+            text.push_str("\n\n");
+            text.push_str(&self.body);
+        }
+        if !self.files.is_empty() {
+            text.push_str("\n\nFiles: ");
+            let shown: Vec<&str> = self
+                .files
+                .iter()
+                .take(MAX_EMBEDDED_PATHS)
+                .map(String::as_str)
+                .collect();
+            text.push_str(&shown.join(", "));
+        }
+        text
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct CommitIndex {
+    pub embedding_model: Option<String>,
+    /// Newest first
+    pub commits: Vec<CommitEntry>,
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct CommitIndexStats {
+    pub commits_embedded: usize,
+    pub commits_unchanged: usize,
+    pub commits_dropped: usize,
+}
+
+fn commits_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(COMMITS_FILE)
+}
+
+/// The commit index, or `None` if commits were never indexed.
+pub fn load_commits(repo_root: &Path) -> Result<Option<CommitIndex>> {
+    let path = commits_path(repo_root);
+    if !path.exists() {
+        return Ok(None);
+    }
+    let data = super::encryption::open_from(&path, fs::read(&path)?)?;
+    Ok(Some(bincode::deserialize(&data)?))
+}
+
+/// Parse `git log --name-only` output in the format used by [`read_git_log`].
+/// Embeddings are left empty.
+fn parse_git_log(output: &str) -> Vec<CommitEntry> {
+    output
+        .split('\x1e')
+        .filter_map(|record| {
+            let mut fields = record.splitn(6, '\x1f');
+            let sha = fields.next()?.trim();
+            if sha.is_empty() {
+                return None;
+            }
+            let author = fields.next()?;
+            let timestamp = fields.next()?.trim().parse().unwrap_or(0);
+            let subject = fields.next()?.trim();
+            let body = fields.next()?.trim();
+            let files = fields
+                .next()
+                .unwrap_or_default()
+                .lines()
+                .map(str::trim)
+                .filter(|line| !line.is_empty())
+                .map(str::to_string)
+                .collect();
+            Some(CommitEntry {
+                sha: sha.to_string(),
+                author: author.to_string(),
+                timestamp,
+                subject: subject.to_string(),
+                body: body.to_string(),
+                files,
+                embedding: Vec::new(),
+            })
+        })
+        .collect()
+}
+
+/// The newest `limit` non-merge commits reachable from HEAD.
+fn read_git_log(repo_root: &Path, limit: usize) -> Result<Vec<CommitEntry>> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(repo_root)
+        .args([
+            "log",
+            "--no-merges",
+            "--no-renames",
+            "--format=%x1e%H%x1f%an%x1f%at%x1f%s%x1f%b%x1f",
+            "--name-only",
+        ])
+        .arg(format!("--max-count={}", limit))
+        .output()
+        .context("Failed to run git; --index-commits needs git on PATH")?;
+    if !output.status.success() {
+        bail!(
+            "git log failed in {}: {}",
+            repo_root.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(parse_git_log(&String::from_utf8_lossy(&output.stdout)))
+}
+
+/// Embed the newest `limit` commits into `.cs/commits.bin` with the index's
+/// model. Commits already embedded with that model are reused; commits that
+/// fell out of the window are dropped.
+pub fn index_commits(repo_root: &Path, limit: usize) -> Result<CommitIndexStats> {
+    bundle::ensure_writable(repo_root)?;
+    let manifest = load_manifest(repo_root)?.ok_or_else(|| {
+        anyhow::anyhow!("No index found; run 'cs --index' before indexing commits")
+    })?;
+    let model = manifest.embedding_model.ok_or_else(|| {
+        anyhow::anyhow!("The index has no embeddings; rebuild it with 'cs --index'")
+    })?;
+
+    let mut previous: HashMap<String, CommitEntry> = match load_commits(repo_root) {
+        Ok(Some(index)) if index.embedding_model.as_deref() == Some(model.as_str()) => index
+            .commits
+            .into_iter()
+            .map(|commit| (commit.sha.clone(), commit))
+            .collect(),
+        _ => HashMap::new(),
+    };
+    let previous_count = previous.len();
+
+    let mut stats = CommitIndexStats::default();
+    let mut commits = read_git_log(repo_root, limit)?;
+    let mut pending = Vec::new();
+    for (position, commit) in commits.iter_mut().enumerate() {
+        match previous.remove(&commit.sha) {
+            Some(existing) => {
+                *commit = existing;
+                stats.commits_unchanged += 1;
+            }
+            None => pending.push(position),
+        }
+    }
+    stats.commits_dropped = previous_count - stats.commits_unchanged;
+
+    if !pending.is_empty() {
+        let mut embedder = cs_embed::create_embedder(Some(model.as_str()))?;
+        // Messages withheld from a remote embedder keep an empty embedding
+        let mut screened: Vec<(usize, String)> = Vec::new();
+        for &i in &pending {
+            match secrets::screen(&*embedder, repo_root, &commits[i].text())? {
+                Some(text) => screened.push((i, text)),
+                None => tracing::warn!(
+                    "Withheld commit {} from the remote embedder",
+                    commits[i].short_sha()
+                ),
+            }
+        }
+        for batch in screened.chunks(EMBED_BATCH) {
+            let texts: Vec<String> = batch.iter().map(|(_, text)| text.clone()).collect();
+            let embeddings = embedder.embed(&texts)?;
+            if embeddings.len() != batch.len() {
+                bail!(
+                    "Embedder returned {} embeddings for {} commits",
+                    embeddings.len(),
+                    batch.len()
+                );
+            }
+            for ((i, _), embedding) in batch.iter().zip(embeddings) {
+                commits[*i].embedding = embedding;
+            }
+        }
+        stats.commits_embedded = screened.len();
+    }
+
+    let index = CommitIndex {
+        embedding_model: Some(model),
+        commits,
+    };
+    let path = commits_path(repo_root);
+    let data = super::encryption::seal_for(&path, bincode::serialize(&index)?)?;
+    atomic_write(&path, &data)?;
+    Ok(stats)
+}
+
+impl CommitIndex {
+    /// Commits touching at least one path accepted by `keep`.
+    pub fn touching<'a>(
+        &'a self,
+        mut keep: impl FnMut(&str) -> bool + 'a,
+    ) -> impl Iterator<Item = &'a CommitEntry> + 'a {
+        self.commits
+            .iter()
+            .filter(move |commit| commit.files.iter().any(|file| keep(file)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_git_log_records() {
+        let output = "\x1eabc1234def\x1fAda\x1f1700000000\x1fAdd retry to user service\x1fTransient DB errors\nwere surfacing to callers.\x1f\n\ninternal/users/service.go\ninternal/users/retry.go\n\x1e0123456789\x1fGrace\x1f1690000000\x1fFix typo\x1f\x1f\n\nREADME.md\n";
+        let commits = parse_git_log(output);
+        assert_eq!(commits.len(), 2);
+        assert_eq!(commits[0].short_sha(), "abc1234");
+        assert_eq!(commits[0].timestamp, 1_700_000_000);
+        assert_eq!(
+            commits[0].files,
+            ["internal/users/service.go", "internal/users/retry.go"]
+        );
+        assert_eq!(
+            commits[0].text(),
+            "Add retry to user service\n\nTransient DB errors\nwere surfacing to callers.\n\nFiles: internal/users/service.go, internal/users/retry.go"
+        );
+        assert_eq!(commits[1].body, "");
+        assert_eq!(commits[1].text(), "Fix typo\n\nFiles: README.md");
+
+        let index = CommitIndex {
+            embedding_model: None,
+            commits,
+        };
+        let touching: Vec<&str> = index
+            .touching(|file| file.starts_with("internal/"))
+            .map(|c| c.subject.as_str())
+            .collect();
+        assert_eq!(touching, ["Add retry to user service"]);
+    }
+}
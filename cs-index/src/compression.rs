@@ -0,0 +1,248 @@
+//! zstd compression of the chunk text stored with collections, which is
+//! otherwise most of their size. Chunks of one language share a lot of
+//! vocabulary (Markdown headings, log prefixes, ticket boilerplate), so each
+//! language with enough chunks gets a dictionary trained on them, stored
+//! alongside; the chunks of the rest are compressed without one. Text is
+//! only decompressed for the results a search displays.
+
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::Path;
+
+/// Languages with fewer chunks than this compress without a dictionary.
+const MIN_DICTIONARY_SAMPLES: usize = 64;
+
+/// Largest dictionary trained, and at most a tenth of its samples.
+const MAX_DICTIONARY_BYTES: usize = 16 * 1024;
+
+const LEVEL: i32 = zstd::DEFAULT_COMPRESSION_LEVEL;
+
+/// Chunk text as stored.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub enum ChunkText {
+    /// Text that compressing wouldn't shrink
+    Plain(String),
+    Zstd {
+        /// Index of the dictionary it was compressed with
+        dictionary: Option<usize>,
+        /// Length of the text in bytes
+        len: usize,
+        data: Vec<u8>,
+    },
+}
+
+impl ChunkText {
+    /// Length of the text in bytes, without decompressing it.
+    pub fn len(&self) -> usize {
+        match self {
+            ChunkText::Plain(text) => text.len(),
+            ChunkText::Zstd { len, .. } => *len,
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Bytes the text takes up as stored.
+    pub fn stored_len(&self) -> usize {
+        match self {
+            ChunkText::Plain(text) => text.len(),
+            ChunkText::Zstd { data, .. } => data.len(),
+        }
+    }
+}
+
+impl From<String> for ChunkText {
+    fn from(text: String) -> Self {
+        ChunkText::Plain(text)
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Dictionary {
+    pub language: String,
+    pub data: Vec<u8>,
+}
+
+/// The language a chunk read from `source` is grouped with for training:
+/// its language, else its file extension, else `text`.
+pub fn language_of(source: &str) -> String {
+    let path = Path::new(source);
+    if let Some(language) = cs_core::Language::from_path(path) {
+        return language.to_string();
+    }
+    path.extension()
+        .map(|ext| ext.to_string_lossy().to_lowercase())
+        .unwrap_or_else(|| "text".to_string())
+}
+
+/// Compress `texts`, each with its language, returning the stored texts in
+/// the same order and the dictionaries they refer to.
+pub fn compress(texts: Vec<(String, String)>) -> Result<(Vec<ChunkText>, Vec<Dictionary>)> {
+    let mut by_language: HashMap<&str, Vec<&[u8]>> = HashMap::new();
+    for (language, text) in &texts {
+        by_language
+            .entry(language.as_str())
+            .or_default()
+            .push(text.as_bytes());
+    }
+    let mut languages: Vec<&str> = by_language
+        .iter()
+        .filter(|(_, samples)| samples.len() >= MIN_DICTIONARY_SAMPLES)
+        .map(|(language, _)| *language)
+        .collect();
+    languages.sort();
+
+    let mut dictionaries = Vec::new();
+    let mut compressors: HashMap<String, (usize, zstd::bulk::Compressor<'static>)> = HashMap::new();
+    for language in languages {
+        let samples = &by_language[language];
+        let sample_bytes: usize = samples.iter().map(|sample| sample.len()).sum();
+        let size = MAX_DICTIONARY_BYTES.min(sample_bytes / 10);
+        // Too uniform or too little text to learn from
+        let Ok(data) = zstd::dict::from_samples(samples, size) else {
+            continue;
+        };
+        compressors.insert(
+            language.to_string(),
+            (
+                dictionaries.len(),
+                zstd::bulk::Compressor::with_dictionary(LEVEL, &data)?,
+            ),
+        );
+        dictionaries.push(Dictionary {
+            language: language.to_string(),
+            data,
+        });
+    }
+
+    let mut plain = zstd::bulk::Compressor::new(LEVEL)?;
+    let mut stored = Vec::with_capacity(texts.len());
+    for (language, text) in texts {
+        let (dictionary, data) = match compressors.get_mut(&language) {
+            Some((index, compressor)) => (Some(*index), compressor.compress(text.as_bytes())?),
+            None => (None, plain.compress(text.as_bytes())?),
+        };
+        stored.push(if data.len() < text.len() {
+            ChunkText::Zstd {
+                dictionary,
+                len: text.len(),
+                data,
+            }
+        } else {
+            ChunkText::Plain(text)
+        });
+    }
+
+    // Dictionaries nothing ended up using would only take up space
+    let used: Vec<bool> = (0..dictionaries.len())
+        .map(|index| {
+            stored.iter().any(
+                |text| matches!(text, ChunkText::Zstd { dictionary: Some(i), .. } if *i == index),
+            )
+        })
+        .collect();
+    if used.iter().all(|&used| used) {
+        return Ok((stored, dictionaries));
+    }
+    let mut renumbered = Vec::with_capacity(dictionaries.len());
+    let mut kept = Vec::new();
+    for (dictionary, used) in dictionaries.into_iter().zip(&used) {
+        renumbered.push(kept.len());
+        if *used {
+            kept.push(dictionary);
+        }
+    }
+    for text in &mut stored {
+        if let ChunkText::Zstd {
+            dictionary: Some(index),
+            ..
+        } = text
+        {
+            *index = renumbered[*index];
+        }
+    }
+    Ok((stored, kept))
+}
+
+/// The text of a stored chunk.
+pub fn decompress(text: &ChunkText, dictionaries: &[Dictionary]) -> Result<String> {
+    let (dictionary, len, data) = match text {
+        ChunkText::Plain(text) => return Ok(text.clone()),
+        ChunkText::Zstd {
+            dictionary,
+            len,
+            data,
+        } => (dictionary, *len, data),
+    };
+    let bytes = match dictionary {
+        Some(index) => {
+            let dictionary = dictionaries.get(*index).ok_or_else(|| {
+                anyhow::anyhow!("Chunk text refers to missing dictionary {}", index)
+            })?;
+            zstd::bulk::Decompressor::with_dictionary(&dictionary.data)?.decompress(data, len)?
+        }
+        None => zstd::bulk::decompress(data, len)?,
+    };
+    Ok(String::from_utf8(bytes)?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn texts_round_trip_with_per_language_dictionaries() {
+        let mut texts: Vec<(String, String)> = (0..200)
+            .map(|i| {
+                (
+                    "markdown".to_string(),
+                    format!(
+                        "## Deploy step {}\n\nRun `make deploy ENV=staging` and watch the rollout dashboard for service {}.",
+                        i,
+                        i * 7
+                    ),
+                )
+            })
+            .collect();
+        texts.push(("text".to_string(), "ok".to_string()));
+        texts.push(("text".to_string(), "retry ".repeat(50)));
+
+        let (stored, dictionaries) = compress(texts.clone()).unwrap();
+        assert_eq!(dictionaries.len(), 1);
+        assert_eq!(dictionaries[0].language, "markdown");
+        assert!(matches!(
+            stored[0],
+            ChunkText::Zstd {
+                dictionary: Some(0),
+                ..
+            }
+        ));
+        // Too short to shrink
+        assert_eq!(stored[200], ChunkText::Plain("ok".to_string()));
+        assert!(matches!(
+            stored[201],
+            ChunkText::Zstd {
+                dictionary: None,
+                ..
+            }
+        ));
+
+        let original: usize = texts.iter().map(|(_, text)| text.len()).sum();
+        let compressed: usize = stored.iter().map(ChunkText::stored_len).sum();
+        assert!(compressed * 2 < original);
+        for ((_, text), stored) in texts.iter().zip(&stored) {
+            assert_eq!(stored.len(), text.len());
+            assert_eq!(&decompress(stored, &dictionaries).unwrap(), text);
+        }
+    }
+
+    #[test]
+    fn languages_come_from_the_source() {
+        assert_eq!(language_of("wiki/ops/deploy.MD"), "md");
+        assert_eq!(language_of("acme/api#42"), "text");
+        assert_eq!(language_of("src/lib.rs"), "rust");
+    }
+}
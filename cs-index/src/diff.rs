@@ -0,0 +1,491 @@
+//! Differences between two index snapshots, for `cs --index-diff OLD NEW`:
+//! the files and chunks added, removed or modified, and how far each
+//! modified chunk moved in embedding space. Useful for auditing what a
+//! dependency upgrade or a large refactor changed.
+//!
+//! A snapshot is a checkout with an index, or an index directory copied
+//! aside (`cp -r .cs /tmp/before.cs`). Chunks of a file are paired by kind,
+//! enclosing scope and first line of code (when the indexed sources are
+//! still there to read it from), then by embedding similarity.
+
+use super::{
+    ChunkEntry, IndexManifest, load_index_entry, load_or_create_manifest, normalize_manifest_paths,
+    path_utils, shards,
+};
+use anyhow::{Result, bail};
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Similarity below which two chunks of the same kind are a removal and an
+/// addition rather than one modified chunk.
+const PAIR_SIMILARITY: f32 = 0.75;
+
+/// Embedding movement below which a chunk counts as unchanged.
+const MIN_DRIFT: f32 = 1e-4;
+
+/// Longest first line of code kept as a chunk's symbol.
+const MAX_SYMBOL_LENGTH: usize = 120;
+
+pub struct Snapshot {
+    /// Index directory
+    pub dir: PathBuf,
+    /// Where the indexed sources are, if known
+    source_root: Option<PathBuf>,
+    manifest: IndexManifest,
+    /// Sidecar of each file, by standard path
+    sidecars: BTreeMap<PathBuf, PathBuf>,
+}
+
+impl Snapshot {
+    /// Open the index of the checkout at `path`, or the index directory `path`.
+    pub fn open(path: &Path) -> Result<Self> {
+        let is_index = |dir: &Path| {
+            dir.join("manifest.json").is_file() || dir.join(shards::SHARDS_DIR).is_dir()
+        };
+        let (dir, source_root) = if is_index(path) {
+            let source_root = path
+                .file_name()
+                .is_some_and(|name| name == cs_core::locations::INDEX_DIR_NAME)
+                .then(|| path.parent().map(Path::to_path_buf))
+                .flatten();
+            (path.to_path_buf(), source_root)
+        } else {
+            let dir = cs_core::locations::index_dir(path);
+            if !is_index(&dir) {
+                bail!(
+                    "No index at {}; pass a checkout with an index or an index directory",
+                    path.display()
+                );
+            }
+            (dir, Some(path.to_path_buf()))
+        };
+
+        let mut manifest = IndexManifest::default();
+        let mut sidecars = BTreeMap::new();
+        let mut add = |index_dir: &Path, mut part: IndexManifest| {
+            normalize_manifest_paths(&mut part, source_root.as_deref().unwrap_or(index_dir));
+            for key in part.files.keys() {
+                sidecars.insert(
+                    path_utils::from_manifest_path(key),
+                    super::sidecar_path_for_manifest_key(index_dir, key),
+                );
+            }
+            if manifest.embedding_model.is_none() {
+                manifest.embedding_model = part.embedding_model.clone();
+                manifest.embedding_dimensions = part.embedding_dimensions;
+            }
+            manifest.files.extend(part.files);
+        };
+        let manifest_path = dir.join("manifest.json");
+        if manifest_path.is_file() {
+            add(&dir, load_or_create_manifest(&manifest_path)?);
+        } else {
+            let mut shard_dirs: Vec<PathBuf> = fs::read_dir(dir.join(shards::SHARDS_DIR))?
+                .flatten()
+                .map(|entry| entry.path())
+                .filter(|shard| shard.join("manifest.json").is_file())
+                .collect();
+            shard_dirs.sort();
+            for shard in shard_dirs {
+                let part = load_or_create_manifest(&shard.join("manifest.json"))?;
+                add(&shard, part);
+            }
+        }
+
+        Ok(Self {
+            dir,
+            source_root,
+            manifest,
+            sidecars,
+        })
+    }
+
+    fn hash(&self, file: &Path) -> Option<&str> {
+        self.manifest
+            .files
+            .get(&path_utils::to_manifest_path(file))
+            .map(|metadata| metadata.hash.as_str())
+    }
+
+    fn chunks(&self, file: &Path) -> Vec<ChunkEntry> {
+        self.sidecars
+            .get(file)
+            .and_then(|sidecar| load_index_entry(sidecar).ok())
+            .map(|entry| entry.chunks)
+            .unwrap_or_default()
+    }
+
+    /// The source of `file` as it was indexed, if it's still unchanged.
+    fn source(&self, file: &Path) -> Option<String> {
+        let path = self.source_root.as_ref()?.join(file);
+        let hash = cs_core::compute_file_hash(&path).ok()?;
+        if Some(hash.as_str()) != self.hash(file) {
+            return None;
+        }
+        cs_core::text::read_text(&path).ok()
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Change {
+    Added,
+    Removed,
+    Modified,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct ChunkChange {
+    pub change: Change,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub chunk_type: Option<String>,
+    /// First line of code, else the enclosing scope
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub old_lines: Option<(usize, usize)>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub new_lines: Option<(usize, usize)>,
+    /// One minus the cosine similarity of the two embeddings
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub drift: Option<f32>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct FileDiff {
+    pub file: String,
+    pub change: Change,
+    pub chunks: Vec<ChunkChange>,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct DiffSummary {
+    pub files_added: usize,
+    pub files_removed: usize,
+    pub files_modified: usize,
+    pub chunks_added: usize,
+    pub chunks_removed: usize,
+    pub chunks_modified: usize,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct IndexDiff {
+    pub files: Vec<FileDiff>,
+    pub summary: DiffSummary,
+    /// Both snapshots use the same model, so drift can be measured
+    pub same_model: bool,
+}
+
+/// A chunk with what it's paired by.
+struct ChunkView {
+    entry: ChunkEntry,
+    symbol: Option<String>,
+    text: Option<String>,
+}
+
+impl ChunkView {
+    fn key(&self) -> (Option<&str>, Option<&str>) {
+        (self.entry.chunk_type.as_deref(), self.symbol.as_deref())
+    }
+
+    fn lines(&self) -> (usize, usize) {
+        (self.entry.span.line_start, self.entry.span.line_end)
+    }
+}
+
+fn chunk_views(snapshot: &Snapshot, file: &Path, source: Option<String>) -> Vec<ChunkView> {
+    snapshot
+        .chunks(file)
+        .into_iter()
+        .map(|entry| {
+            let text = source
+                .as_deref()
+                .and_then(|source| source.get(entry.span.byte_start..entry.span.byte_end))
+                .map(str::to_string);
+            let first_line = text.as_deref().and_then(|text| {
+                text.lines()
+                    .map(str::trim)
+                    .find(|line| !line.is_empty())
+                    .map(|line| line.chars().take(MAX_SYMBOL_LENGTH).collect::<String>())
+            });
+            ChunkView {
+                symbol: first_line.or_else(|| entry.breadcrumb.clone()),
+                text,
+                entry,
+            }
+        })
+        .collect()
+}
+
+pub(crate) fn cosine(a: &[f32], b: &[f32]) -> Option<f32> {
+    if a.len() != b.len() || a.is_empty() {
+        return None;
+    }
+    let dot: f32 = a.iter().zip(b).map(|(x, y)| x * y).sum();
+    let norm =
+        a.iter().map(|x| x * x).sum::<f32>().sqrt() * b.iter().map(|x| x * x).sum::<f32>().sqrt();
+    (norm > 0.0).then(|| dot / norm)
+}
+
+/// Pair the chunks of one file: same kind and symbol, the most similar first
+/// when embeddings are comparable, else in order.
+fn pair_chunks(
+    old: &[ChunkView],
+    new: &[ChunkView],
+    same_model: bool,
+) -> Vec<(Option<usize>, Option<usize>)> {
+    let similarity = |o: &ChunkView, n: &ChunkView| {
+        if !same_model {
+            return None;
+        }
+        cosine(o.entry.embedding.as_deref()?, n.entry.embedding.as_deref()?)
+    };
+
+    let mut groups: BTreeMap<(Option<&str>, Option<&str>), (Vec<usize>, Vec<usize>)> =
+        BTreeMap::new();
+    for (i, chunk) in old.iter().enumerate() {
+        groups.entry(chunk.key()).or_default().0.push(i);
+    }
+    for (i, chunk) in new.iter().enumerate() {
+        groups.entry(chunk.key()).or_default().1.push(i);
+    }
+
+    let mut pairs = Vec::new();
+    for (olds, news) in groups.into_values() {
+        let mut candidates: Vec<(f32, usize, usize)> = Vec::new();
+        let mut ordered = false;
+        for &o in &olds {
+            for &n in &news {
+                match similarity(&old[o], &new[n]) {
+                    Some(similarity) if similarity >= PAIR_SIMILARITY => {
+                        candidates.push((similarity, o, n))
+                    }
+                    Some(_) => {}
+                    None => ordered = true,
+                }
+            }
+        }
+        let mut used_old = BTreeSet::new();
+        let mut used_new = BTreeSet::new();
+        if ordered {
+            for (&o, &n) in olds.iter().zip(&news) {
+                used_old.insert(o);
+                used_new.insert(n);
+                pairs.push((Some(o), Some(n)));
+            }
+        } else {
+            candidates.sort_by(|a, b| b.0.partial_cmp(&a.0).unwrap_or(std::cmp::Ordering::Equal));
+            for (_, o, n) in candidates {
+                if !used_old.contains(&o) && !used_new.contains(&n) {
+                    used_old.insert(o);
+                    used_new.insert(n);
+                    pairs.push((Some(o), Some(n)));
+                }
+            }
+        }
+        pairs.extend(
+            olds.iter()
+                .filter(|o| !used_old.contains(*o))
+                .map(|&o| (Some(o), None)),
+        );
+        pairs.extend(
+            news.iter()
+                .filter(|n| !used_new.contains(*n))
+                .map(|&n| (None, Some(n))),
+        );
+    }
+    pairs.sort_by_key(|&(o, n)| {
+        (
+            n.map(|n| new[n].entry.span.line_start),
+            o.map(|o| old[o].entry.span.line_start),
+        )
+    });
+    pairs
+}
+
+fn change_of(
+    old: Option<&ChunkView>,
+    new: Option<&ChunkView>,
+    same_model: bool,
+) -> Option<ChunkChange> {
+    let (change, chunk) = match (old, new) {
+        (Some(old), None) => (Change::Removed, old),
+        (None, Some(new)) => (Change::Added, new),
+        (Some(_), Some(new)) => (Change::Modified, new),
+        (None, None) => return None,
+    };
+    let drift = match (old, new) {
+        (Some(old), Some(new)) if same_model => old
+            .entry
+            .embedding
+            .as_deref()
+            .zip(new.entry.embedding.as_deref())
+            .and_then(|(a, b)| cosine(a, b))
+            .map(|similarity| (1.0 - similarity).max(0.0)),
+        _ => None,
+    };
+    if let (Some(old), Some(new)) = (old, new) {
+        let unchanged = match (&old.text, &new.text) {
+            (Some(old_text), Some(new_text)) => old_text == new_text,
+            _ => {
+                old.entry.byte_length == new.entry.byte_length
+                    && drift.is_none_or(|drift| drift < MIN_DRIFT)
+            }
+        };
+        if unchanged {
+            return None;
+        }
+    }
+    Some(ChunkChange {
+        change,
+        chunk_type: chunk.entry.chunk_type.clone(),
+        symbol: chunk.symbol.clone(),
+        old_lines: old.map(ChunkView::lines),
+        new_lines: new.map(ChunkView::lines),
+        drift,
+    })
+}
+
+/// What changed from `old` to `new`, by file.
+pub fn diff_snapshots(old: &Snapshot, new: &Snapshot) -> IndexDiff {
+    let same_model = old.manifest.embedding_model.is_some()
+        && old.manifest.embedding_model == new.manifest.embedding_model
+        && old.manifest.embedding_dimensions == new.manifest.embedding_dimensions;
+
+    let files: BTreeSet<&PathBuf> = old.sidecars.keys().chain(new.sidecars.keys()).collect();
+    let mut diff = IndexDiff {
+        files: Vec::new(),
+        summary: DiffSummary::default(),
+        same_model,
+    };
+    for file in files {
+        let (old_hash, new_hash) = (old.hash(file), new.hash(file));
+        if old_hash.is_some() && old_hash == new_hash {
+            continue;
+        }
+        let change = match (old_hash, new_hash) {
+            (None, _) => Change::Added,
+            (_, None) => Change::Removed,
+            _ => Change::Modified,
+        };
+        // Chunks are keyed by their first line only when both sides have it
+        let (mut old_source, mut new_source) = (old.source(file), new.source(file));
+        if change == Change::Modified && (old_source.is_none() || new_source.is_none()) {
+            (old_source, new_source) = (None, None);
+        }
+        let old_chunks = if old_hash.is_some() {
+            chunk_views(old, file, old_source)
+        } else {
+            Vec::new()
+        };
+        let new_chunks = if new_hash.is_some() {
+            chunk_views(new, file, new_source)
+        } else {
+            Vec::new()
+        };
+        let chunks: Vec<ChunkChange> = pair_chunks(&old_chunks, &new_chunks, same_model)
+            .into_iter()
+            .filter_map(|(o, n)| {
+                change_of(
+                    o.map(|o| &old_chunks[o]),
+                    n.map(|n| &new_chunks[n]),
+                    same_model,
+                )
+            })
+            .collect();
+        if change == Change::Modified && chunks.is_empty() {
+            continue;
+        }
+
+        let summary = &mut diff.summary;
+        match change {
+            Change::Added => summary.files_added += 1,
+            Change::Removed => summary.files_removed += 1,
+            Change::Modified => summary.files_modified += 1,
+        }
+        for chunk in &chunks {
+            match chunk.change {
+                Change::Added => summary.chunks_added += 1,
+                Change::Removed => summary.chunks_removed += 1,
+                Change::Modified => summary.chunks_modified += 1,
+            }
+        }
+        diff.files.push(FileDiff {
+            file: cs_core::paths::to_slash(file),
+            change,
+            chunks,
+        });
+    }
+    diff
+}
+
+#[cfg(test)]
+mod tests {
+    use super::super::smart_update_index;
+    use super::*;
+    use tempfile::TempDir;
+
+    fn write(root: &Path, relative: &str, contents: &str) {
+        let path = root.join(relative);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, contents).unwrap();
+    }
+
+    #[tokio::test]
+    async fn reports_added_removed_and_modified_files() {
+        let before = TempDir::new().unwrap();
+        write(
+            before.path(),
+            "src/lib.rs",
+            "fn keep() -> u32 {\n    1\n}\n\nfn change() -> u32 {\n    2\n}\n",
+        );
+        write(before.path(), "src/old.rs", "fn old() {}\n");
+        write(before.path(), "README.md", "# Same\n");
+        smart_update_index(before.path(), false, false, &[])
+            .await
+            .unwrap();
+
+        let after = TempDir::new().unwrap();
+        write(
+            after.path(),
+            "src/lib.rs",
+            "fn keep() -> u32 {\n    1\n}\n\nfn change() -> u32 {\n    2 + 2\n}\n",
+        );
+        write(after.path(), "src/new.rs", "fn new() {}\n");
+        write(after.path(), "README.md", "# Same\n");
+        smart_update_index(after.path(), false, false, &[])
+            .await
+            .unwrap();
+
+        let old = Snapshot::open(before.path()).unwrap();
+        let new = Snapshot::open(&cs_core::locations::index_dir(after.path())).unwrap();
+        let diff = diff_snapshots(&old, &new);
+        let files: Vec<(&str, Change)> = diff
+            .files
+            .iter()
+            .map(|f| (f.file.as_str(), f.change))
+            .collect();
+        assert_eq!(
+            files,
+            [
+                ("src/lib.rs", Change::Modified),
+                ("src/new.rs", Change::Added),
+                ("src/old.rs", Change::Removed),
+            ]
+        );
+        assert!(
+            diff.files[0]
+                .chunks
+                .iter()
+                .all(|c| c.change == Change::Modified || c.symbol.is_some())
+        );
+        assert!(!diff.files[0].chunks.is_empty());
+        assert_eq!(diff.summary.files_added, 1);
+        assert_eq!(diff.summary.files_removed, 1);
+        assert!(diff.summary.chunks_added >= 1);
+
+        assert!(Snapshot::open(&before.path().join("src")).is_err());
+    }
+}
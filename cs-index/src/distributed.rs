@@ -0,0 +1,1119 @@
+//! Distributed embedding for very large repositories.
+//!
+//! `cs --index --coordinate ADDR` walks and chunks the repository locally and
+//! hands each changed file's chunks to whichever worker is free; workers
+//! started elsewhere with `cs --worker --join ADDR` load the coordinator's
+//! model, embed those batches and stream the vectors back. The coordinator
+//! writes sidecars and the manifest as a local build would, so the result is
+//! an ordinary index.
+//!
+//! Messages are length-prefixed bincode frames over plain TCP. Chunk text
+//! leaves the coordinator, so it is screened like text bound for a hosted
+//! embedder (see [`secrets`](super::secrets)), and workers must present the
+//! coordinator's token when one is set. Without a token the coordinator only
+//! listens on loopback addresses. There is no TLS: the token and chunk text
+//! cross the network in the clear, so beyond a trusted network workers join
+//! through an SSH tunnel (or similar) to a coordinator listening on
+//! `127.0.0.1`. Until a worker has presented the token, frames are capped at
+//! 64 KiB, and every vector a worker returns must have the index's
+//! dimensions and finite values.
+
+use super::{
+    INDEX_INTERRUPTED_MSG, INTERRUPTED, bundle, collect_files, index_single_file, journal::Journal,
+    load_or_create_manifest, normalize_manifest_paths, path_utils, refresh_derived_data,
+    reset_interrupt, save_index_entry, save_manifest, segments, shards, validate_manifest_model,
+};
+use anyhow::{Context, Result, bail};
+use ring::hmac;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashSet, VecDeque};
+use std::fs;
+use std::io::{self, Read, Write};
+use std::net::{SocketAddr, TcpListener, TcpStream, ToSocketAddrs};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::Ordering;
+use std::sync::{Arc, Condvar, Mutex, mpsc};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime};
+
+/// Bumped whenever a message changes shape.
+const PROTOCOL_VERSION: u32 = 1;
+
+/// Largest frame either side accepts.
+const MAX_FRAME_BYTES: usize = 256 * 1024 * 1024;
+
+/// Largest frame accepted during the handshake, before a worker has shown
+/// it holds the token.
+const MAX_HANDSHAKE_FRAME_BYTES: usize = 64 * 1024;
+
+/// How long a new connection has to introduce itself.
+const HELLO_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// How often blocked threads check for interrupts and shutdown.
+const POLL_INTERVAL: Duration = Duration::from_millis(200);
+
+/// Files chunked and awaiting vectors at once, to keep every worker busy.
+const FILES_IN_FLIGHT: usize = 32;
+
+/// How long batches wait for a worker to rejoin once every worker has left.
+const NO_WORKERS_TIMEOUT: Duration = Duration::from_secs(120);
+
+#[derive(Serialize, Deserialize)]
+enum Message {
+    /// Worker -> coordinator, first thing on connect
+    Hello {
+        protocol: u32,
+        token: Option<String>,
+    },
+    /// Coordinator -> worker: the model to load
+    Welcome {
+        model: String,
+    },
+    /// Worker -> coordinator once the model is loaded
+    Ready {
+        dimensions: usize,
+    },
+    Batch {
+        id: u64,
+        texts: Vec<String>,
+    },
+    Vectors {
+        id: u64,
+        embeddings: Vec<Vec<f32>>,
+    },
+    Failed {
+        id: u64,
+        error: String,
+    },
+    Rejected {
+        reason: String,
+    },
+    /// Coordinator -> worker: no more batches
+    Done,
+}
+
+impl Message {
+    fn kind(&self) -> &'static str {
+        match self {
+            Self::Hello { .. } => "hello",
+            Self::Welcome { .. } => "welcome",
+            Self::Ready { .. } => "ready",
+            Self::Batch { .. } => "batch",
+            Self::Vectors { .. } => "vectors",
+            Self::Failed { .. } => "failed",
+            Self::Rejected { .. } => "rejected",
+            Self::Done => "done",
+        }
+    }
+}
+
+fn write_message(stream: &mut impl Write, message: &Message) -> Result<()> {
+    let payload = bincode::serialize(message)?;
+    if payload.len() > MAX_FRAME_BYTES {
+        bail!("Message of {} bytes is too large to send", payload.len());
+    }
+    stream.write_all(&(payload.len() as u32).to_be_bytes())?;
+    stream.write_all(&payload)?;
+    stream.flush()?;
+    Ok(())
+}
+
+/// The next message on `stream`, refusing frames of more than `limit` bytes.
+fn read_message(stream: &mut impl Read, limit: usize) -> Result<Message> {
+    let mut len = [0u8; 4];
+    stream.read_exact(&mut len)?;
+    let len = u32::from_be_bytes(len) as usize;
+    if len > limit {
+        bail!("Peer sent a {} byte frame; the limit is {}", len, limit);
+    }
+    let mut payload = vec![0; len];
+    stream.read_exact(&mut payload)?;
+    Ok(bincode::deserialize(&payload)?)
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct WorkerStats {
+    pub model: String,
+    pub batches: usize,
+    pub chunks: usize,
+}
+
+/// Join the coordinator at `coordinator` (`host:port`) and embed batches
+/// until it has none left.
+pub fn run_worker(
+    coordinator: &str,
+    token: Option<&str>,
+    on_ready: impl FnOnce(&str),
+) -> Result<WorkerStats> {
+    let mut stream = TcpStream::connect(coordinator)
+        .with_context(|| format!("Failed to connect to coordinator at {}", coordinator))?;
+    stream.set_nodelay(true)?;
+    write_message(
+        &mut stream,
+        &Message::Hello {
+            protocol: PROTOCOL_VERSION,
+            token: token.map(str::to_string),
+        },
+    )?;
+    let model = match read_message(&mut stream, MAX_HANDSHAKE_FRAME_BYTES)? {
+        Message::Welcome { model } => model,
+        Message::Rejected { reason } => bail!("Coordinator rejected this worker: {}", reason),
+        other => bail!("Unexpected '{}' message from coordinator", other.kind()),
+    };
+
+    let mut embedder = cs_embed::create_embedder(Some(&model))?;
+    write_message(
+        &mut stream,
+        &Message::Ready {
+            dimensions: embedder.dim(),
+        },
+    )?;
+    on_ready(&model);
+
+    let mut stats = WorkerStats {
+        model,
+        ..Default::default()
+    };
+    loop {
+        match read_message(&mut stream, MAX_FRAME_BYTES)? {
+            Message::Batch { id, texts } => {
+                let reply = match embedder.embed(&texts) {
+                    Ok(embeddings) => {
+                        stats.batches += 1;
+                        stats.chunks += texts.len();
+                        Message::Vectors { id, embeddings }
+                    }
+                    Err(e) => Message::Failed {
+                        id,
+                        error: e.to_string(),
+                    },
+                };
+                write_message(&mut stream, &reply)?;
+            }
+            Message::Done => return Ok(stats),
+            Message::Rejected { reason } => bail!("Coordinator rejected this worker: {}", reason),
+            other => bail!("Unexpected '{}' message from coordinator", other.kind()),
+        }
+    }
+}
+
+struct Job {
+    id: u64,
+    texts: Vec<String>,
+    reply: mpsc::Sender<Result<Vec<Vec<f32>>>>,
+}
+
+#[derive(Default)]
+struct PoolState {
+    queue: VecDeque<Job>,
+    jobs: u64,
+    workers: usize,
+    joined: usize,
+    /// Those of the index, or else set by the first worker; every worker
+    /// must match
+    dimensions: Option<usize>,
+    closed: bool,
+    /// Gave up on batches after every worker left
+    stranded: bool,
+}
+
+/// Workers connected to the coordinator and the batches waiting for them.
+struct WorkerPool {
+    model: String,
+    /// The token workers must present, kept as its MAC under a key of the
+    /// pool's own so presented tokens compare in constant time
+    token: Option<(hmac::Key, hmac::Tag)>,
+    state: Mutex<PoolState>,
+    changed: Condvar,
+    no_workers_timeout: Duration,
+}
+
+impl WorkerPool {
+    /// Workers must embed with `model` into vectors of `dimensions`, when
+    /// the index has recorded them.
+    fn new(model: String, dimensions: Option<usize>, token: Option<String>) -> Result<Self> {
+        let token = match token {
+            Some(token) => {
+                let rng = ring::rand::SystemRandom::new();
+                let key = hmac::Key::generate(hmac::HMAC_SHA256, &rng)
+                    .map_err(|_| anyhow::anyhow!("Failed to generate a worker token key"))?;
+                let tag = hmac::sign(&key, token.as_bytes());
+                Some((key, tag))
+            }
+            None => None,
+        };
+        Ok(Self {
+            model,
+            token,
+            state: Mutex::new(PoolState {
+                dimensions,
+                ..PoolState::default()
+            }),
+            changed: Condvar::new(),
+            no_workers_timeout: NO_WORKERS_TIMEOUT,
+        })
+    }
+
+    /// Whether `presented` is the token workers must present, if one is set.
+    fn admits(&self, presented: Option<&str>) -> bool {
+        let Some((key, tag)) = &self.token else {
+            return true;
+        };
+        presented.is_some_and(|token| hmac::verify(key, token.as_bytes(), tag.as_ref()).is_ok())
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, PoolState> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Stop handing out batches; batches still queued fail.
+    fn close(&self) {
+        let mut state = self.lock();
+        state.closed = true;
+        state.queue.clear();
+        drop(state);
+        self.changed.notify_all();
+    }
+
+    /// Embed `texts` on the next free worker, waiting for one if necessary.
+    /// Once every worker has left, the pool waits [`NO_WORKERS_TIMEOUT`] for
+    /// one to rejoin, then fails this and every other batch.
+    fn submit(&self, texts: Vec<String>) -> Result<Vec<Vec<f32>>> {
+        let (reply, result) = mpsc::channel();
+        {
+            let mut state = self.lock();
+            if state.closed {
+                bail!("Worker pool is shut down");
+            }
+            state.jobs += 1;
+            let id = state.jobs;
+            state.queue.push_back(Job { id, texts, reply });
+        }
+        self.changed.notify_all();
+        let mut without_workers: Option<Instant> = None;
+        loop {
+            match result.recv_timeout(POLL_INTERVAL) {
+                Ok(embeddings) => return embeddings,
+                Err(mpsc::RecvTimeoutError::Timeout) => {
+                    if INTERRUPTED.load(Ordering::SeqCst) {
+                        bail!(INDEX_INTERRUPTED_MSG);
+                    }
+                    let mut state = self.lock();
+                    if state.workers > 0 {
+                        without_workers = None;
+                        continue;
+                    }
+                    let since = *without_workers.get_or_insert_with(Instant::now);
+                    if since.elapsed() >= self.no_workers_timeout {
+                        state.stranded = true;
+                        state.closed = true;
+                        state.queue.clear();
+                        drop(state);
+                        self.changed.notify_all();
+                        bail!(
+                            "No worker rejoined within {}s after every worker left",
+                            self.no_workers_timeout.as_secs()
+                        );
+                    }
+                }
+                Err(mpsc::RecvTimeoutError::Disconnected) => bail!("Worker pool is shut down"),
+            }
+        }
+    }
+
+    fn next_job(&self) -> Option<Job> {
+        let mut state = self.lock();
+        loop {
+            if state.closed {
+                return None;
+            }
+            if let Some(job) = state.queue.pop_front() {
+                return Some(job);
+            }
+            state = self
+                .changed
+                .wait_timeout(state, POLL_INTERVAL)
+                .unwrap_or_else(|e| e.into_inner())
+                .0;
+        }
+    }
+
+    /// Block until `count` workers are connected. Returns their dimensions.
+    fn wait_for_workers(&self, count: usize) -> Result<usize> {
+        let mut state = self.lock();
+        loop {
+            if INTERRUPTED.load(Ordering::SeqCst) {
+                bail!(INDEX_INTERRUPTED_MSG);
+            }
+            if state.workers >= count.max(1)
+                && let Some(dimensions) = state.dimensions
+            {
+                return Ok(dimensions);
+            }
+            state = self
+                .changed
+                .wait_timeout(state, POLL_INTERVAL)
+                .unwrap_or_else(|e| e.into_inner())
+                .0;
+        }
+    }
+
+    fn reject<T>(stream: &mut TcpStream, reason: String) -> Result<T> {
+        let _ = write_message(
+            stream,
+            &Message::Rejected {
+                reason: reason.clone(),
+            },
+        );
+        bail!(reason)
+    }
+
+    /// Wait for `stream` to have data, giving up if the pool closes first.
+    fn wait_readable(&self, stream: &mut TcpStream) -> Result<()> {
+        stream.set_read_timeout(Some(POLL_INTERVAL))?;
+        loop {
+            match stream.peek(&mut [0u8]) {
+                Ok(_) => break,
+                Err(e)
+                    if matches!(
+                        e.kind(),
+                        io::ErrorKind::WouldBlock | io::ErrorKind::TimedOut
+                    ) =>
+                {
+                    if self.lock().closed {
+                        bail!("coordinator finished before the worker was ready");
+                    }
+                }
+                Err(e) => return Err(e.into()),
+            }
+        }
+        stream.set_read_timeout(None)?;
+        Ok(())
+    }
+
+    /// Check a new worker's hello and wait for it to load the model.
+    fn handshake(&self, stream: &mut TcpStream) -> Result<usize> {
+        stream.set_read_timeout(Some(HELLO_TIMEOUT))?;
+        let Message::Hello { protocol, token } = read_message(stream, MAX_HANDSHAKE_FRAME_BYTES)?
+        else {
+            return Self::reject(stream, "expected hello".to_string());
+        };
+        if protocol != PROTOCOL_VERSION {
+            return Self::reject(
+                stream,
+                format!(
+                    "worker speaks protocol v{}, coordinator v{}; run the same cs version on both",
+                    protocol, PROTOCOL_VERSION
+                ),
+            );
+        }
+        if !self.admits(token.as_deref()) {
+            return Self::reject(stream, "invalid worker token".to_string());
+        }
+
+        write_message(
+            stream,
+            &Message::Welcome {
+                model: self.model.clone(),
+            },
+        )?;
+        // Loading the model may mean downloading it first
+        self.wait_readable(stream)?;
+        let Message::Ready { dimensions } = read_message(stream, MAX_HANDSHAKE_FRAME_BYTES)? else {
+            return Self::reject(stream, "expected ready".to_string());
+        };
+
+        let mut state = self.lock();
+        match state.dimensions {
+            Some(expected) if expected != dimensions => {
+                drop(state);
+                Self::reject(
+                    stream,
+                    format!(
+                        "worker produces {} dims but the index needs {}",
+                        dimensions, expected
+                    ),
+                )
+            }
+            _ => {
+                state.dimensions = Some(dimensions);
+                state.workers += 1;
+                state.joined += 1;
+                drop(state);
+                self.changed.notify_all();
+                Ok(dimensions)
+            }
+        }
+    }
+
+    /// Send `texts` to the worker, which must return one finite vector of
+    /// `dimensions` per text. The outer error means the connection failed;
+    /// the inner one that the worker couldn't embed the batch.
+    fn run_job(
+        stream: &mut TcpStream,
+        id: u64,
+        texts: &[String],
+        dimensions: usize,
+    ) -> Result<Result<Vec<Vec<f32>>>> {
+        write_message(
+            stream,
+            &Message::Batch {
+                id,
+                texts: texts.to_vec(),
+            },
+        )?;
+        match read_message(stream, MAX_FRAME_BYTES)? {
+            Message::Vectors {
+                id: reply,
+                embeddings,
+            } if reply == id => Ok(if embeddings.len() != texts.len() {
+                Err(anyhow::anyhow!(
+                    "Worker returned {} embeddings for {} chunks",
+                    embeddings.len(),
+                    texts.len()
+                ))
+            } else if let Some(bad) = embeddings.iter().find(|vector| {
+                vector.len() != dimensions || !vector.iter().all(|value| value.is_finite())
+            }) {
+                Err(anyhow::anyhow!(
+                    "Worker returned a {}-dim vector{} where the index needs {} finite values",
+                    bad.len(),
+                    if bad.iter().all(|value| value.is_finite()) {
+                        ""
+                    } else {
+                        " with non-finite values"
+                    },
+                    dimensions
+                ))
+            } else {
+                Ok(embeddings)
+            }),
+            Message::Failed { id: reply, error } if reply == id => Ok(Err(anyhow::anyhow!(
+                "Worker failed to embed batch: {}",
+                error
+            ))),
+            other => bail!("Unexpected '{}' reply from worker", other.kind()),
+        }
+    }
+
+    fn serve(
+        &self,
+        mut stream: TcpStream,
+        peer: SocketAddr,
+        on_event: &(dyn Fn(CoordinatorEvent) + Sync),
+    ) {
+        let joined = (|| {
+            stream.set_nonblocking(false)?;
+            stream.set_nodelay(true)?;
+            self.handshake(&mut stream)
+        })();
+        let dimensions = match joined {
+            Ok(dimensions) => dimensions,
+            Err(e) => {
+                tracing::warn!("Worker {} failed to join: {}", peer, e);
+                return;
+            }
+        };
+        on_event(CoordinatorEvent::WorkerJoined {
+            peer,
+            workers: self.lock().workers,
+        });
+
+        let mut next_id = 0;
+        let mut error = None;
+        while let Some(job) = self.next_job() {
+            next_id += 1;
+            match Self::run_job(&mut stream, next_id, &job.texts, dimensions) {
+                Ok(result) => {
+                    let _ = job.reply.send(result);
+                }
+                Err(e) => {
+                    // Another worker picks the batch up
+                    self.lock().queue.push_front(job);
+                    self.changed.notify_all();
+                    error = Some(e.to_string());
+                    break;
+                }
+            }
+        }
+        if error.is_none() {
+            let _ = write_message(&mut stream, &Message::Done);
+        }
+
+        let workers = {
+            let mut state = self.lock();
+            state.workers -= 1;
+            state.workers
+        };
+        self.changed.notify_all();
+        on_event(CoordinatorEvent::WorkerLeft {
+            peer,
+            workers,
+            error,
+        });
+    }
+
+    fn accept_workers<'scope>(
+        &'scope self,
+        listener: &'scope TcpListener,
+        scope: &'scope thread::Scope<'scope, '_>,
+        on_event: &'scope (dyn Fn(CoordinatorEvent) + Sync),
+    ) {
+        while !self.lock().closed {
+            match listener.accept() {
+                Ok((stream, peer)) => {
+                    scope.spawn(move || self.serve(stream, peer, on_event));
+                }
+                Err(e) if e.kind() == io::ErrorKind::WouldBlock => thread::sleep(POLL_INTERVAL),
+                Err(e) => {
+                    tracing::warn!("Failed to accept worker connection: {}", e);
+                    thread::sleep(POLL_INTERVAL);
+                }
+            }
+        }
+    }
+}
+
+/// Hands the chunks of each file to the pool as one batch.
+struct PoolEmbedder {
+    pool: Arc<WorkerPool>,
+    dimensions: usize,
+}
+
+impl cs_embed::Embedder for PoolEmbedder {
+    fn id(&self) -> &'static str {
+        "workers"
+    }
+
+    fn dim(&self) -> usize {
+        self.dimensions
+    }
+
+    fn model_name(&self) -> &str {
+        &self.pool.model
+    }
+
+    fn embed(&mut self, texts: &[String]) -> Result<Vec<Vec<f32>>> {
+        if texts.is_empty() {
+            return Ok(Vec::new());
+        }
+        self.pool.submit(texts.to_vec())
+    }
+
+    /// Chunks cross the network to other machines
+    fn is_remote(&self) -> bool {
+        true
+    }
+}
+
+pub struct CoordinatorOptions<'a> {
+    /// Address to listen on for workers, e.g. `0.0.0.0:7878`; only loopback
+    /// addresses without a token
+    pub listen: &'a str,
+    /// Token workers must present, if any
+    pub token: Option<&'a str>,
+    pub respect_gitignore: bool,
+    pub exclude_patterns: &'a [String],
+    pub model: Option<&'a str>,
+    /// Workers to wait for before handing out batches
+    pub min_workers: usize,
+}
+
+pub enum CoordinatorEvent<'a> {
+    Listening(SocketAddr),
+    WorkerJoined {
+        peer: SocketAddr,
+        workers: usize,
+    },
+    WorkerLeft {
+        peer: SocketAddr,
+        workers: usize,
+        error: Option<String>,
+    },
+    FileIndexed {
+        path: &'a Path,
+        done: usize,
+        total: usize,
+    },
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct CoordinatorStats {
+    pub files_indexed: usize,
+    pub files_up_to_date: usize,
+    pub files_removed: usize,
+    pub files_errored: usize,
+    pub workers_joined: usize,
+}
+
+/// The model to embed with, recorded in `manifest` if it has none yet.
+fn resolve_model(manifest: &mut super::IndexManifest, requested: Option<&str>) -> Result<String> {
+    let registry = cs_models::ModelRegistry::default();
+    let config = match requested {
+        Some(name) => registry.get_model(name).ok_or_else(|| {
+            anyhow::anyhow!(
+                "Unknown model '{}'. Available models: bge-small, nomic-v1.5, jina-code",
+                name
+            )
+        })?,
+        None => registry
+            .get_default_model()
+            .ok_or_else(|| anyhow::anyhow!("No default model available"))?,
+    };
+    match &manifest.embedding_model {
+        Some(existing) if requested.is_some() && existing != &config.name => bail!(
+            "Index was built with '{}', not '{}'. Run 'cs --switch-model {}' first, or drop '--model'.",
+            existing,
+            config.name,
+            requested.unwrap_or_default()
+        ),
+        Some(existing) => Ok(existing.clone()),
+        None => {
+            manifest.embedding_model = Some(config.name.clone());
+            manifest.embedding_dimensions = Some(config.dimensions);
+            manifest.embedding_model_version =
+                Some(cs_embed::EMBEDDING_PIPELINE_VERSION.to_string());
+            Ok(config.name.clone())
+        }
+    }
+}
+
+/// Refuse to listen beyond this machine without a token: whoever joins is
+/// sent chunk text.
+fn check_listen_address(listen: &str, token: Option<&str>) -> Result<()> {
+    if token.is_some() {
+        return Ok(());
+    }
+    let addrs: Vec<SocketAddr> = listen
+        .to_socket_addrs()
+        .with_context(|| format!("Invalid address to listen for workers on: {}", listen))?
+        .collect();
+    if addrs.is_empty() || addrs.iter().any(|addr| !addr.ip().is_loopback()) {
+        bail!(
+            "Listening on {} without a worker token would let any host that reaches it join and receive chunk text. Set --worker-token (or CS_WORKER_TOKEN), or listen on 127.0.0.1 and have workers join through an SSH tunnel",
+            listen
+        );
+    }
+    Ok(())
+}
+
+/// Update the index at `repo_root` incrementally, embedding changed files on
+/// workers that join at `options.listen`.
+pub fn coordinate_index(
+    repo_root: &Path,
+    options: &CoordinatorOptions,
+    on_event: &(dyn Fn(CoordinatorEvent) + Sync),
+) -> Result<CoordinatorStats> {
+    bundle::ensure_writable(repo_root)?;
+    check_listen_address(options.listen, options.token)?;
+    let index_dir = cs_core::locations::index_dir(repo_root);
+    let manifest_path = index_dir.join("manifest.json");
+    if shards::is_sharded(repo_root) && !manifest_path.exists() {
+        bail!(
+            "{} has a sharded index; build shards on separate machines and combine them with --merge-shards",
+            repo_root.display()
+        );
+    }
+    reset_interrupt();
+
+    fs::create_dir_all(&index_dir)?;
+    let mut journal = Journal::open(&manifest_path)?;
+    let mut manifest = load_or_create_manifest(&manifest_path)?;
+    normalize_manifest_paths(&mut manifest, repo_root);
+    validate_manifest_model(&manifest)?;
+    let model = resolve_model(&mut manifest, options.model)?;
+
+    let mut stats = CoordinatorStats::default();
+    let mut seen = HashSet::new();
+    let mut pending = Vec::new();
+    for file in collect_files(
+        repo_root,
+        options.respect_gitignore,
+        options.exclude_patterns,
+    )? {
+        let key = path_utils::to_manifest_path(&path_utils::to_standard_path(&file, repo_root));
+        if manifest
+            .files
+            .get(&key)
+            .is_some_and(|metadata| shards::is_unchanged(&file, metadata))
+        {
+            stats.files_up_to_date += 1;
+        } else {
+            pending.push(file);
+        }
+        seen.insert(key);
+    }
+
+    let stale: Vec<PathBuf> = manifest
+        .files
+        .keys()
+        .filter(|key| !seen.contains(*key))
+        .cloned()
+        .collect();
+    for key in stale {
+        manifest.files.remove(&key);
+        let sidecar = path_utils::get_sidecar_path_for_standard_path(
+            &index_dir,
+            &path_utils::from_manifest_path(&key),
+        );
+        if sidecar.exists() {
+            journal.removing(&key, &sidecar)?;
+            fs::remove_file(&sidecar)?;
+        }
+        stats.files_removed += 1;
+    }
+
+    let mut stranded = false;
+    if !pending.is_empty() {
+        let listener = TcpListener::bind(options.listen)
+            .with_context(|| format!("Failed to listen for workers on {}", options.listen))?;
+        listener.set_nonblocking(true)?;
+        on_event(CoordinatorEvent::Listening(listener.local_addr()?));
+
+        let pool = Arc::new(WorkerPool::new(
+            model,
+            manifest.embedding_dimensions,
+            options.token.map(str::to_string),
+        )?);
+        let result = thread::scope(|scope| {
+            scope.spawn({
+                let pool = &*pool;
+                let listener = &listener;
+                move || pool.accept_workers(listener, scope, on_event)
+            });
+            let result = embed_pending(
+                repo_root,
+                &pending,
+                &pool,
+                options.min_workers,
+                &mut manifest,
+                &mut journal,
+                &mut stats,
+                on_event,
+            );
+            pool.close();
+            result
+        });
+        stats.workers_joined = pool.lock().joined;
+        stranded = pool.lock().stranded;
+        result?;
+    }
+
+    manifest.updated = SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .unwrap()
+        .as_secs();
+    save_manifest(&manifest_path, &manifest)?;
+    let written = journal.commit()?;
+    segments::add(&index_dir, &manifest, &written);
+    refresh_derived_data(repo_root, &manifest);
+    if stranded {
+        // What the workers embedded before leaving is kept for the next run
+        bail!(
+            "Every worker left and none rejoined within {}s; {} files were not indexed. Start workers with 'cs --worker --join' and re-run",
+            NO_WORKERS_TIMEOUT.as_secs(),
+            stats.files_errored
+        );
+    }
+    Ok(stats)
+}
+
+fn embed_pending(
+    repo_root: &Path,
+    pending: &[PathBuf],
+    pool: &Arc<WorkerPool>,
+    min_workers: usize,
+    manifest: &mut super::IndexManifest,
+    journal: &mut Journal,
+    stats: &mut CoordinatorStats,
+    on_event: &(dyn Fn(CoordinatorEvent) + Sync),
+) -> Result<()> {
+    let dimensions = pool.wait_for_workers(min_workers)?;
+    let index_dir = cs_core::locations::index_dir(repo_root);
+
+    let queue = Mutex::new(pending.iter().rev().collect::<Vec<_>>());
+    let (tx, rx) = mpsc::channel();
+    thread::scope(|scope| {
+        for _ in 0..FILES_IN_FLIGHT.min(pending.len()) {
+            let tx = tx.clone();
+            let queue = &queue;
+            scope.spawn(move || {
+                let mut embedder: Box<dyn cs_embed::Embedder> = Box::new(PoolEmbedder {
+                    pool: pool.clone(),
+                    dimensions,
+                });
+                loop {
+                    if INTERRUPTED.load(Ordering::SeqCst) {
+                        break;
+                    }
+                    let Some(file) = queue.lock().unwrap_or_else(|e| e.into_inner()).pop() else {
+                        break;
+                    };
+                    let result = index_single_file(file, repo_root, Some(&mut embedder));
+                    if tx.send((file, result)).is_err() {
+                        break;
+                    }
+                }
+            });
+        }
+        drop(tx);
+
+        let result = collect_results(
+            &rx,
+            &index_dir,
+            pending.len(),
+            manifest,
+            journal,
+            stats,
+            on_event,
+        );
+        if result.is_err() {
+            // Unblock the pipelines before the scope waits for them
+            drop(rx);
+            pool.close();
+        }
+        result
+    })
+}
+
+/// Write each file's entry as its vectors arrive.
+fn collect_results(
+    rx: &mpsc::Receiver<(&PathBuf, Result<super::IndexEntry>)>,
+    index_dir: &Path,
+    total: usize,
+    manifest: &mut super::IndexManifest,
+    journal: &mut Journal,
+    stats: &mut CoordinatorStats,
+    on_event: &(dyn Fn(CoordinatorEvent) + Sync),
+) -> Result<()> {
+    let manifest_path = index_dir.join("manifest.json");
+    let mut done = 0;
+    for (file, result) in rx {
+        done += 1;
+        match result {
+            Ok(entry) => {
+                let sidecar = path_utils::get_sidecar_path_for_standard_path(
+                    index_dir,
+                    &path_utils::from_manifest_path(&entry.metadata.path),
+                );
+                journal.writing(&entry.metadata.path, &sidecar)?;
+                save_index_entry(&sidecar, &entry)?;
+                manifest
+                    .files
+                    .insert(entry.metadata.path.clone(), entry.metadata);
+                stats.files_indexed += 1;
+                if stats.files_indexed % shards::SAVE_EVERY == 0 {
+                    save_manifest(&manifest_path, manifest)?;
+                }
+            }
+            Err(e) => {
+                let message = e.to_string();
+                if !message.contains("Binary file, skipping")
+                    && !message.contains(INDEX_INTERRUPTED_MSG)
+                {
+                    tracing::warn!("Failed to index {:?}: {}", file, e);
+                }
+                stats.files_errored += 1;
+            }
+        }
+        on_event(CoordinatorEvent::FileIndexed {
+            path: file,
+            done,
+            total,
+        });
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_embed::Embedder;
+
+    fn hello(stream: &mut TcpStream, token: Option<&str>) {
+        write_message(
+            stream,
+            &Message::Hello {
+                protocol: PROTOCOL_VERSION,
+                token: token.map(str::to_string),
+            },
+        )
+        .unwrap();
+    }
+
+    /// Join `pool` as a worker presenting `token`; returns the handshake result.
+    fn join(pool: &WorkerPool, token: Option<&'static str>) -> Result<usize> {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let client = thread::spawn(move || {
+            let mut stream = TcpStream::connect(addr).unwrap();
+            hello(&mut stream, token);
+            if let Ok(Message::Welcome { .. }) = read_message(&mut stream, MAX_FRAME_BYTES) {
+                write_message(&mut stream, &Message::Ready { dimensions: 3 }).unwrap();
+            }
+            stream
+        });
+        let (mut server, _) = listener.accept().unwrap();
+        let result = pool.handshake(&mut server);
+        client.join().unwrap();
+        result
+    }
+
+    #[test]
+    fn rejects_workers_without_the_token() {
+        let pool = WorkerPool::new("model".to_string(), None, Some("secret".to_string())).unwrap();
+        let rejected = join(&pool, Some("guess")).unwrap_err();
+        assert!(rejected.to_string().contains("invalid worker token"));
+        assert!(join(&pool, None).is_err());
+        assert!(join(&pool, Some("secret-but-longer")).is_err());
+        assert_eq!(pool.lock().workers, 0);
+
+        assert_eq!(join(&pool, Some("secret")).unwrap(), 3);
+        assert_eq!(pool.lock().workers, 1);
+    }
+
+    #[test]
+    fn workers_must_match_the_index_dimensions() {
+        let pool = WorkerPool::new("model".to_string(), Some(384), None).unwrap();
+        let rejected = join(&pool, None).unwrap_err();
+        assert!(
+            rejected.to_string().contains("the index needs 384"),
+            "{}",
+            rejected
+        );
+        assert_eq!(pool.lock().workers, 0);
+    }
+
+    #[test]
+    fn large_frames_are_refused_before_the_token() {
+        let pool = WorkerPool::new("model".to_string(), None, Some("secret".to_string())).unwrap();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let client = thread::spawn(move || {
+            let mut stream = TcpStream::connect(addr).unwrap();
+            // Announces a frame it never sends; the coordinator mustn't wait for it
+            stream.write_all(&(64u32 << 20).to_be_bytes()).unwrap();
+            stream
+        });
+        let (mut server, _) = listener.accept().unwrap();
+        let error = pool.handshake(&mut server).unwrap_err();
+        assert!(
+            error.to_string().contains("the limit is 65536"),
+            "{}",
+            error
+        );
+        drop(client.join().unwrap());
+    }
+
+    #[test]
+    fn replies_must_hold_finite_vectors_of_the_index_dimensions() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let worker = thread::spawn(move || {
+            let mut stream = TcpStream::connect(addr).unwrap();
+            for embeddings in [
+                vec![vec![1.0, 2.0]],
+                vec![vec![1.0]],
+                vec![vec![f32::NAN, 2.0]],
+            ] {
+                let Message::Batch { id, .. } = read_message(&mut stream, MAX_FRAME_BYTES).unwrap()
+                else {
+                    panic!("expected a batch");
+                };
+                write_message(&mut stream, &Message::Vectors { id, embeddings }).unwrap();
+            }
+        });
+        let (mut server, _) = listener.accept().unwrap();
+        let texts = ["a".to_string()];
+        assert!(
+            WorkerPool::run_job(&mut server, 1, &texts, 2)
+                .unwrap()
+                .is_ok()
+        );
+        let short = WorkerPool::run_job(&mut server, 2, &texts, 2)
+            .unwrap()
+            .unwrap_err();
+        assert!(short.to_string().contains("1-dim vector"), "{}", short);
+        let nan = WorkerPool::run_job(&mut server, 3, &texts, 2)
+            .unwrap()
+            .unwrap_err();
+        assert!(nan.to_string().contains("non-finite"), "{}", nan);
+        worker.join().unwrap();
+    }
+
+    #[test]
+    fn only_loopback_addresses_listen_without_a_token() {
+        assert!(check_listen_address("127.0.0.1:7878", None).is_ok());
+        assert!(check_listen_address("[::1]:7878", None).is_ok());
+        let open = check_listen_address("0.0.0.0:7878", None).unwrap_err();
+        assert!(open.to_string().contains("--worker-token"), "{}", open);
+        assert!(check_listen_address("0.0.0.0:7878", Some("secret")).is_ok());
+    }
+
+    #[test]
+    fn batches_round_trip_through_a_worker() {
+        let pool = Arc::new(WorkerPool::new("model".to_string(), Some(1), None).unwrap());
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+
+        // A worker that embeds each text as its length
+        let worker = thread::spawn(move || {
+            let mut stream = TcpStream::connect(addr).unwrap();
+            hello(&mut stream, None);
+            assert!(matches!(
+                read_message(&mut stream, MAX_FRAME_BYTES).unwrap(),
+                Message::Welcome { .. }
+            ));
+            write_message(&mut stream, &Message::Ready { dimensions: 1 }).unwrap();
+            let mut batches = 0;
+            loop {
+                match read_message(&mut stream, MAX_FRAME_BYTES).unwrap() {
+                    Message::Batch { id, texts } => {
+                        let embeddings = texts.iter().map(|t| vec![t.len() as f32]).collect();
+                        write_message(&mut stream, &Message::Vectors { id, embeddings }).unwrap();
+                        batches += 1;
+                    }
+                    Message::Done => return batches,
+                    other => panic!("unexpected {}", other.kind()),
+                }
+            }
+        });
+
+        let (stream, peer) = listener.accept().unwrap();
+        let server = {
+            let pool = pool.clone();
+            thread::spawn(move || pool.serve(stream, peer, &|_| {}))
+        };
+        assert_eq!(pool.wait_for_workers(1).unwrap(), 1);
+
+        let mut embedder = PoolEmbedder {
+            pool: pool.clone(),
+            dimensions: 1,
+        };
+        let embeddings = embedder
+            .embed(&["a".to_string(), "abc".to_string()])
+            .unwrap();
+        assert_eq!(embeddings, vec![vec![1.0], vec![3.0]]);
+        assert!(embedder.is_remote());
+
+        pool.close();
+        server.join().unwrap();
+        assert_eq!(worker.join().unwrap(), 1);
+        assert_eq!(pool.lock().workers, 0);
+        assert!(embedder.embed(&["b".to_string()]).is_err());
+    }
+
+    #[test]
+    fn batches_fail_once_no_worker_rejoins() {
+        let mut pool = WorkerPool::new("model".to_string(), None, None).unwrap();
+        pool.no_workers_timeout = Duration::from_millis(300);
+
+        let error = pool.submit(vec!["a".to_string()]).unwrap_err();
+        assert!(error.to_string().contains("No worker rejoined"));
+        let state = pool.lock();
+        assert!(state.stranded && state.closed);
+        assert!(state.queue.is_empty());
+        drop(state);
+        assert!(pool.submit(vec!["b".to_string()]).is_err());
+    }
+}
@@ -0,0 +1,208 @@
+//! What an index run would do, without doing it (`cs --index --dry-run`).
+//!
+//! Files are compared with the manifest the way an incremental update
+//! compares them, and the ones it would embed are chunked, so the chunk and
+//! token counts are the run's own. Nothing is embedded and nothing is
+//! written, which makes it safe to check before a large run against a paid
+//! embedding API.
+
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::HashSet;
+use std::fs;
+use std::path::Path;
+use std::time::SystemTime;
+
+use super::{
+    collect_files, compute_file_hash, find_repo_root, get_sidecar_path, load_index_entry,
+    load_manifest, multi_vector, normalize_manifest_paths, path_utils,
+};
+
+/// Rough embedding throughput of a local model on a laptop CPU.
+const LOCAL_TOKENS_PER_SECOND: f64 = 3_000.0;
+
+/// Rough embedding throughput of a hosted API, requests and rate limits included.
+const API_TOKENS_PER_SECOND: f64 = 20_000.0;
+
+#[derive(Debug, Default, Clone, Serialize)]
+pub struct IndexPlan {
+    /// Files not in the index yet
+    pub files_added: usize,
+    /// Indexed files whose content changed
+    pub files_changed: usize,
+    /// Indexed files that are gone; `cs --clean-orphans` drops them
+    pub files_removed: usize,
+    pub files_unchanged: usize,
+    /// Chunks that would be embedded
+    pub chunks_embedded: usize,
+    /// Indexed chunks the run would replace or that belong to removed files
+    pub chunks_dropped: usize,
+    /// Statement groups embedded on top of the chunks of a multi-vector index
+    pub sub_vectors_embedded: usize,
+    /// Estimated tokens sent to the embedding model
+    pub estimated_tokens: usize,
+}
+
+impl IndexPlan {
+    /// Seconds the embedding would roughly take with a model from `provider`.
+    pub fn estimated_seconds(&self, provider: &str) -> f64 {
+        let rate = if is_remote_provider(provider) {
+            API_TOKENS_PER_SECOND
+        } else {
+            LOCAL_TOKENS_PER_SECOND
+        };
+        self.estimated_tokens as f64 / rate
+    }
+
+    /// Cost of the embedding at `price_per_million` tokens.
+    pub fn estimated_cost(&self, price_per_million: f64) -> f64 {
+        self.estimated_tokens as f64 / 1_000_000.0 * price_per_million
+    }
+}
+
+/// Whether models from `provider` run behind a paid API rather than locally.
+pub fn is_remote_provider(provider: &str) -> bool {
+    provider != "fastembed"
+}
+
+/// Plan an index run over `path` embedding with `model_name`. `rebuild`
+/// plans a run that re-embeds every file, like `--switch-model` does, and
+/// `multi_vector` counts the statement groups a multi-vector index embeds.
+pub fn plan_index(
+    path: &Path,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+    model_name: &str,
+    rebuild: bool,
+    multi_vector: bool,
+) -> Result<IndexPlan> {
+    let repo_root = find_repo_root(path)?;
+    let mut manifest = load_manifest(&repo_root)?.unwrap_or_default();
+    normalize_manifest_paths(&mut manifest, &repo_root);
+
+    let mut plan = IndexPlan::default();
+    let mut seen = HashSet::new();
+    for file_path in collect_files(path, respect_gitignore, exclude_patterns)? {
+        let manifest_key =
+            path_utils::to_manifest_path(&path_utils::to_standard_path(&file_path, &repo_root));
+        seen.insert(manifest_key.clone());
+
+        match manifest.files.get(&manifest_key) {
+            None => plan.files_added += 1,
+            Some(_) if rebuild => plan.files_changed += 1,
+            Some(metadata) => {
+                let Ok(fs_meta) = fs::metadata(&file_path) else {
+                    continue;
+                };
+                let fs_last_modified = fs_meta
+                    .modified()
+                    .ok()
+                    .and_then(|m| m.duration_since(SystemTime::UNIX_EPOCH).ok())
+                    .map(|d| d.as_secs());
+                let unchanged = (fs_last_modified == Some(metadata.last_modified)
+                    && fs_meta.len() == metadata.size)
+                    || compute_file_hash(&file_path).is_ok_and(|hash| hash == metadata.hash);
+                if unchanged {
+                    plan.files_unchanged += 1;
+                    continue;
+                }
+                plan.files_changed += 1;
+            }
+        }
+        if manifest.files.contains_key(&manifest_key) {
+            plan.chunks_dropped += indexed_chunks(&repo_root, &file_path);
+        }
+        count_chunks(&mut plan, &file_path, model_name, multi_vector);
+    }
+
+    for key in manifest.files.keys() {
+        if seen.contains(key) {
+            continue;
+        }
+        let file_path = repo_root.join(path_utils::from_manifest_path(key));
+        // Files outside `path` stay as they are
+        if !file_path.starts_with(path) || file_path.exists() {
+            continue;
+        }
+        plan.files_removed += 1;
+        plan.chunks_dropped += indexed_chunks(&repo_root, &file_path);
+    }
+    Ok(plan)
+}
+
+/// Chunks the index holds for `file_path`.
+fn indexed_chunks(repo_root: &Path, file_path: &Path) -> usize {
+    load_index_entry(&get_sidecar_path(repo_root, file_path))
+        .map(|entry| entry.chunks.len())
+        .unwrap_or(0)
+}
+
+fn count_chunks(plan: &mut IndexPlan, file_path: &Path, model_name: &str, multi_vector: bool) {
+    // Binary and unreadable files are skipped by the run too
+    let Ok(content) = fs::read_to_string(file_path) else {
+        return;
+    };
+    let lang = cs_core::Language::from_path(file_path);
+    let Ok(chunks) = cs_chunk::chunk_text_with_model(&content, lang, Some(model_name)) else {
+        return;
+    };
+    for chunk in chunks {
+        plan.chunks_embedded += 1;
+        plan.estimated_tokens += cs_chunk::TokenEstimator::estimate_tokens(&chunk.text);
+        if multi_vector {
+            for segment in multi_vector::segments(&chunk.text) {
+                plan.sub_vectors_embedded += 1;
+                plan.estimated_tokens += cs_chunk::TokenEstimator::estimate_tokens(&segment);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn dry_run_counts_what_an_update_would_embed() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::write(root.join("kept.rs"), "fn kept() -> u32 {\n    1\n}\n").unwrap();
+        fs::write(root.join("edited.rs"), "fn edited() -> u32 {\n    2\n}\n").unwrap();
+        fs::write(root.join("deleted.rs"), "fn deleted() -> u32 {\n    3\n}\n").unwrap();
+        super::super::index_directory(root, false, true, &[], None)
+            .await
+            .unwrap();
+
+        let model = "BAAI/bge-small-en-v1.5";
+        let fresh = plan_index(root, true, &[], model, false, false).unwrap();
+        assert_eq!(fresh.files_unchanged, 3);
+        assert_eq!(fresh.chunks_embedded, 0);
+
+        fs::write(
+            root.join("edited.rs"),
+            "fn edited() -> u32 {\n    let total = 2 + 2;\n    total\n}\n",
+        )
+        .unwrap();
+        fs::remove_file(root.join("deleted.rs")).unwrap();
+        fs::write(root.join("added.rs"), "fn added() -> u32 {\n    4\n}\n").unwrap();
+
+        let plan = plan_index(root, true, &[], model, false, false).unwrap();
+        assert_eq!(
+            (
+                plan.files_added,
+                plan.files_changed,
+                plan.files_removed,
+                plan.files_unchanged
+            ),
+            (1, 1, 1, 1)
+        );
+        assert!(plan.chunks_embedded >= 2);
+        assert!(plan.chunks_dropped >= 2);
+        assert!(plan.estimated_tokens > 0);
+
+        let rebuild = plan_index(root, true, &[], model, true, false).unwrap();
+        assert_eq!(rebuild.files_changed, 2);
+        assert_eq!(rebuild.files_unchanged, 0);
+    }
+}
@@ -0,0 +1,549 @@
+//! Optional AES-256-GCM encryption of the index at rest.
+//!
+//! `cs --index --encrypt-index` marks an index encrypted by writing
+//! `.cs/encryption.json`. From then on sidecars (vectors, spans and the
+//! comments kept with each chunk), the commit index and every other file
+//! holding code, vectors, queries or judgments (see `SEALED_FILES`) are
+//! written as `MAGIC | nonce (12 bytes) | ciphertext and tag`, and searches
+//! decrypt them in memory. Each file's path in the index directory is
+//! authenticated with it, so one sidecar can't be passed off as another. An
+//! index holding proprietary source can then sit on a shared or backed-up
+//! disk. The lexical index, the query cache and the query analytics log
+//! would store source text or queries in the clear, so an encrypted index
+//! keeps none of them on disk. The manifest stays readable: it holds file
+//! paths, hashes and sizes, but no code.
+//!
+//! Reads of an encrypted index accept only files sealed with their path:
+//! a file in the clear, or sealed without its path by format 1, is refused
+//! rather than trusted. Only `--encrypt-index` reads those, to seal them.
+//!
+//! The key is derived with PBKDF2-HMAC-SHA256 from a secret in
+//! `CS_INDEX_KEY`, or printed by the command in `CS_INDEX_KEY_COMMAND`, such as
+//! `security find-generic-password -s cs-index -w` for the macOS keychain or
+//! `secret-tool lookup service cs-index` for the Secret Service on Linux.
+//! The secret itself is never stored; `encryption.json` holds the salt and a
+//! check value that tells a wrong key from a corrupt file.
+
+use anyhow::{Context, Result, bail};
+use ring::aead::{AES_256_GCM, Aad, LessSafeKey, NONCE_LEN, Nonce, UnboundKey};
+use ring::rand::{SecureRandom, SystemRandom};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::num::NonZeroU32;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+use walkdir::WalkDir;
+
+use super::atomic_write;
+
+pub const ENCRYPTION_FILE: &str = "encryption.json";
+pub const KEY_ENV: &str = "CS_INDEX_KEY";
+pub const KEY_COMMAND_ENV: &str = "CS_INDEX_KEY_COMMAND";
+
+const MAGIC: &[u8; 8] = b"CSENC002";
+/// Sealed without their path, by format 1
+const LEGACY_MAGIC: &[u8; 8] = b"CSENC001";
+const FORMAT_VERSION: u32 = 2;
+/// From this format on an encrypted index holds nothing but files sealed
+/// with their path, so anything else is refused when read
+const STRICT_FORMAT: u32 = 2;
+const PBKDF2_ITERATIONS: u32 = 200_000;
+const SALT_LEN: usize = 16;
+
+/// Sealed with the key to recognize it again.
+const CHECK_PLAINTEXT: &[u8] = b"cs index key check";
+
+/// Derived keys by index directory; derivation is deliberately slow.
+static KEYS: LazyLock<Mutex<HashMap<PathBuf, Arc<LessSafeKey>>>> =
+    LazyLock::new(|| Mutex::new(HashMap::new()));
+
+#[derive(Serialize, Deserialize)]
+struct EncryptionInfo {
+    format_version: u32,
+    cipher: String,
+    kdf: String,
+    iterations: u32,
+    /// Hex
+    salt: String,
+    /// Hex: [`CHECK_PLAINTEXT`] sealed with the key
+    check: String,
+}
+
+#[derive(Debug, Default)]
+pub struct EncryptStats {
+    /// Files encrypted that were stored in the clear or sealed without
+    /// their path
+    pub files_encrypted: usize,
+    /// Plaintext caches deleted
+    pub caches_removed: usize,
+}
+
+fn info_path(index_dir: &Path) -> PathBuf {
+    index_dir.join(ENCRYPTION_FILE)
+}
+
+/// Whether the index at `index_root` is encrypted.
+pub fn is_encrypted(index_root: &Path) -> bool {
+    info_path(&cs_core::locations::index_dir(index_root)).exists()
+}
+
+/// The index directory a file is stored in, if any.
+fn index_dir_of(path: &Path) -> Option<&Path> {
+    path.ancestors()
+        .skip(1)
+        .find(|ancestor| cs_core::locations::is_index_dir(ancestor))
+}
+
+/// Encrypt the index at `index_root` with the configured key: mark it
+/// encrypted, encrypt what is stored in the clear and delete the plaintext
+/// caches. Running it again on an encrypted index checks the key and
+/// finishes the job.
+pub fn encrypt_index(index_root: &Path) -> Result<EncryptStats> {
+    // A new index is marked first, so no sidecar is ever written in the clear
+    let index_dir = cs_core::locations::index_dir(index_root);
+    fs::create_dir_all(&index_dir)?;
+    if !is_encrypted(index_root) {
+        let secret = read_secret()?.with_context(|| {
+            format!(
+                "--encrypt-index needs a key: set {} or {}",
+                KEY_ENV, KEY_COMMAND_ENV
+            )
+        })?;
+        let mut salt = [0u8; SALT_LEN];
+        SystemRandom::new()
+            .fill(&mut salt)
+            .map_err(|_| anyhow::anyhow!("Failed to generate a salt"))?;
+        let key = derive_key(&secret, &salt, PBKDF2_ITERATIONS)?;
+        let info = EncryptionInfo {
+            format_version: FORMAT_VERSION,
+            cipher: "aes-256-gcm".to_string(),
+            kdf: "pbkdf2-hmac-sha256".to_string(),
+            iterations: PBKDF2_ITERATIONS,
+            salt: to_hex(&salt),
+            check: to_hex(&seal_with(
+                &key,
+                ENCRYPTION_FILE.as_bytes(),
+                CHECK_PLAINTEXT,
+            )?),
+        };
+        atomic_write(&info_path(&index_dir), &serde_json::to_vec_pretty(&info)?)?;
+        KEYS.lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .insert(index_dir.clone(), Arc::new(key));
+    }
+    let key = key_for(&index_dir)?;
+    let mut info = read_info(&index_dir)?;
+    if info.format_version < FORMAT_VERSION {
+        info.format_version = FORMAT_VERSION;
+        atomic_write(&info_path(&index_dir), &serde_json::to_vec_pretty(&info)?)?;
+    }
+
+    let mut stats = EncryptStats::default();
+    for entry in WalkDir::new(&index_dir) {
+        let entry = entry?;
+        if !entry.file_type().is_file() {
+            continue;
+        }
+        let path = entry.path();
+        if !is_sealed_kind(path) {
+            continue;
+        }
+        let mut data = fs::read(path)?;
+        if data.starts_with(MAGIC) {
+            continue;
+        }
+        if data.starts_with(LEGACY_MAGIC) {
+            data = open_with(&key, &[], &data)
+                .with_context(|| format!("Failed to decrypt {}", path.display()))?;
+        }
+        atomic_write(path, &seal_with(&key, &aad_for(&index_dir, path), &data)?)?;
+        stats.files_encrypted += 1;
+    }
+
+    for cache in PLAINTEXT_CACHES {
+        let path = index_dir.join(cache);
+        if path.is_dir() {
+            fs::remove_dir_all(&path)?;
+            stats.caches_removed += 1;
+        } else if path.is_file() {
+            fs::remove_file(&path)?;
+            stats.caches_removed += 1;
+        }
+    }
+    Ok(stats)
+}
+
+/// Derived from the source or the queries and kept in the clear, so
+/// encrypted indexes don't keep them.
+const PLAINTEXT_CACHES: &[&str] = &["tantivy_index", "query_cache.json", "analytics.jsonl"];
+
+/// Files in the index directory, by name, that are always written through
+/// [`seal_for`]; some belong to `cs-engine`.
+const SEALED_FILES: &[&str] = &[
+    super::commits::COMMITS_FILE,
+    super::hot_chunks::HOT_VECTORS_FILE,
+    super::memories::MEMORIES_FILE,
+    super::go_types::GO_TYPES_FILE,
+    super::secrets::SECRETS_LOG_FILE,
+    super::redaction::REDACTION_MAP_FILE,
+    super::redaction::REDACTION_KEY_FILE,
+    "summaries.json",
+    "sparse.idx",
+    "ann.ivf",
+    "note_embeddings.json",
+    "conversation.json",
+    "feedback.json",
+];
+
+/// Whether `path` in an index directory is written through [`seal_for`], so
+/// `--encrypt-index` seals it and reads of an encrypted index refuse it in
+/// the clear.
+fn is_sealed_kind(path: &Path) -> bool {
+    let name = path
+        .file_name()
+        .map(|name| name.to_string_lossy())
+        .unwrap_or_default();
+    let parent = path
+        .parent()
+        .and_then(Path::file_name)
+        .map(|name| name.to_string_lossy())
+        .unwrap_or_default();
+    let extension = path.extension().and_then(|e| e.to_str());
+    name.ends_with(".cs")
+        || super::segments::is_segment(path)
+        || SEALED_FILES.contains(&name.as_ref())
+        || (parent == super::collections::COLLECTIONS_DIR && extension == Some("bin"))
+        || (parent == super::model_migration::MIGRATION_DIR && extension == Some("batch"))
+}
+
+/// Encrypt `data` bound for `path` if its index is encrypted.
+pub fn seal_for(path: &Path, data: Vec<u8>) -> Result<Vec<u8>> {
+    match index_dir_of(path) {
+        Some(index_dir) if info_path(index_dir).exists() => {
+            seal_with(&key_for(index_dir)?, &aad_for(index_dir, path), &data)
+        }
+        _ => Ok(data),
+    }
+}
+
+/// Decrypt `data` read from `path` if its index is encrypted. Files outside
+/// encrypted indexes pass through; in one, anything but a file sealed with
+/// its path is refused unless the index predates format 2.
+pub fn open_from(path: &Path, data: Vec<u8>) -> Result<Vec<u8>> {
+    let sealed = data.starts_with(MAGIC) || data.starts_with(LEGACY_MAGIC);
+    let index_dir = match index_dir_of(path) {
+        Some(index_dir) if info_path(index_dir).exists() => index_dir,
+        _ if !sealed => return Ok(data),
+        _ => bail!(
+            "{} is encrypted but not in an encrypted index",
+            path.display()
+        ),
+    };
+    if !data.starts_with(MAGIC) && read_info(index_dir)?.format_version >= STRICT_FORMAT {
+        bail!(
+            "{} is stored {} in an encrypted index; run 'cs --index --encrypt-index' to seal it",
+            path.display(),
+            if sealed {
+                "without its path"
+            } else {
+                "in the clear"
+            }
+        );
+    }
+    if !sealed {
+        // In an index an older cs is still encrypting
+        return Ok(data);
+    }
+    let key = key_for(index_dir)?;
+    open_with(&key, &aad_for(index_dir, path), &data).with_context(|| {
+        format!(
+            "Failed to decrypt {}: the file is damaged or was moved from another path",
+            path.display()
+        )
+    })
+}
+
+/// Authenticated with a file's contents: its path in `index_dir`.
+fn aad_for(index_dir: &Path, path: &Path) -> Vec<u8> {
+    let relative = path.strip_prefix(index_dir).unwrap_or(path);
+    cs_core::paths::to_slash(relative).into_bytes()
+}
+
+fn read_info(index_dir: &Path) -> Result<EncryptionInfo> {
+    serde_json::from_slice(&fs::read(info_path(index_dir))?)
+        .context("Failed to parse encryption.json")
+}
+
+/// The key for the encrypted index in `index_dir`, derived once per process.
+fn key_for(index_dir: &Path) -> Result<Arc<LessSafeKey>> {
+    // Held while deriving, so parallel sidecar writes derive the key once
+    let mut keys = KEYS.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(key) = keys.get(index_dir) {
+        return Ok(key.clone());
+    }
+    let info = read_info(index_dir)?;
+    if info.format_version > FORMAT_VERSION {
+        bail!(
+            "The index at {} was encrypted by a newer cs (format {}); upgrade to search it",
+            index_dir.display(),
+            info.format_version
+        );
+    }
+    let secret = read_secret()?.with_context(|| {
+        format!(
+            "The index at {} is encrypted: set {} or {} to its key",
+            index_dir.display(),
+            KEY_ENV,
+            KEY_COMMAND_ENV
+        )
+    })?;
+    let salt = from_hex(&info.salt).context("Invalid salt in encryption.json")?;
+    let check = from_hex(&info.check).context("Invalid check in encryption.json")?;
+    let key = derive_key(&secret, &salt, info.iterations)?;
+    if open_with(&key, ENCRYPTION_FILE.as_bytes(), &check)
+        .ok()
+        .as_deref()
+        != Some(CHECK_PLAINTEXT)
+    {
+        bail!(
+            "Wrong key for the encrypted index at {}",
+            index_dir.display()
+        );
+    }
+    let key = Arc::new(key);
+    keys.insert(index_dir.to_path_buf(), key.clone());
+    Ok(key)
+}
+
+/// The secret from the environment or the key command, if either is set.
+fn read_secret() -> Result<Option<String>> {
+    if let Ok(secret) = std::env::var(KEY_ENV)
+        && !secret.is_empty()
+    {
+        return Ok(Some(secret));
+    }
+    let Ok(command) = std::env::var(KEY_COMMAND_ENV) else {
+        return Ok(None);
+    };
+    if command.trim().is_empty() {
+        return Ok(None);
+    }
+    #[cfg(windows)]
+    let output = std::process::Command::new("cmd")
+        .args(["/C", &command])
+        .output();
+    #[cfg(not(windows))]
+    let output = std::process::Command::new("sh")
+        .args(["-c", &command])
+        .output();
+    let output = output.with_context(|| format!("Failed to run {}", KEY_COMMAND_ENV))?;
+    if !output.status.success() {
+        bail!(
+            "{} failed ({}): {}",
+            KEY_COMMAND_ENV,
+            output.status,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    let secret = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    if secret.is_empty() {
+        bail!("{} printed no key", KEY_COMMAND_ENV);
+    }
+    Ok(Some(secret))
+}
+
+fn derive_key(secret: &str, salt: &[u8], iterations: u32) -> Result<LessSafeKey> {
+    let iterations = NonZeroU32::new(iterations).context("Invalid PBKDF2 iteration count")?;
+    let mut key = [0u8; 32];
+    ring::pbkdf2::derive(
+        ring::pbkdf2::PBKDF2_HMAC_SHA256,
+        iterations,
+        salt,
+        secret.as_bytes(),
+        &mut key,
+    );
+    let key = UnboundKey::new(&AES_256_GCM, &key)
+        .map_err(|_| anyhow::anyhow!("Failed to create the index key"))?;
+    Ok(LessSafeKey::new(key))
+}
+
+/// `data` sealed with `aad` authenticated alongside it.
+fn seal_with(key: &LessSafeKey, aad: &[u8], data: &[u8]) -> Result<Vec<u8>> {
+    let mut nonce = [0u8; NONCE_LEN];
+    SystemRandom::new()
+        .fill(&mut nonce)
+        .map_err(|_| anyhow::anyhow!("Failed to generate a nonce"))?;
+    let mut sealed = Vec::with_capacity(MAGIC.len() + NONCE_LEN + data.len() + 16);
+    sealed.extend_from_slice(MAGIC);
+    sealed.extend_from_slice(&nonce);
+    let mut in_out = data.to_vec();
+    key.seal_in_place_append_tag(
+        Nonce::assume_unique_for_key(nonce),
+        Aad::from(aad),
+        &mut in_out,
+    )
+    .map_err(|_| anyhow::anyhow!("Encryption failed"))?;
+    sealed.extend_from_slice(&in_out);
+    Ok(sealed)
+}
+
+/// `data` opened with the `aad` it was sealed with; format 1 had none.
+fn open_with(key: &LessSafeKey, aad: &[u8], data: &[u8]) -> Result<Vec<u8>> {
+    let (body, aad) = match data.strip_prefix(MAGIC.as_slice()) {
+        Some(body) => (Some(body), aad),
+        None => (data.strip_prefix(LEGACY_MAGIC.as_slice()), &[][..]),
+    };
+    let body = body
+        .filter(|body| body.len() >= NONCE_LEN)
+        .context("Not an encrypted file")?;
+    let (nonce, ciphertext) = body.split_at(NONCE_LEN);
+    let nonce =
+        Nonce::try_assume_unique_for_key(nonce).map_err(|_| anyhow::anyhow!("Invalid nonce"))?;
+    let mut in_out = ciphertext.to_vec();
+    let plaintext = key
+        .open_in_place(nonce, Aad::from(aad), &mut in_out)
+        .map_err(|_| anyhow::anyhow!("Authentication failed"))?;
+    Ok(plaintext.to_vec())
+}
+
+pub(crate) fn to_hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+pub(crate) fn from_hex(text: &str) -> Option<Vec<u8>> {
+    if text.len() % 2 != 0 || !text.is_ascii() {
+        return None;
+    }
+    (0..text.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(&text[i..i + 2], 16).ok())
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn sealed_data_opens_only_with_the_same_key() {
+        let key = derive_key("correct horse", b"salt", 1000).unwrap();
+        let sealed = seal_with(&key, b"src/lib.rs.cs", b"fn secret() {}").unwrap();
+        assert!(sealed.starts_with(MAGIC));
+        assert!(!sealed.windows(6).any(|window| window == b"secret"));
+        assert_eq!(
+            open_with(&key, b"src/lib.rs.cs", &sealed).unwrap(),
+            b"fn secret() {}"
+        );
+
+        let wrong = derive_key("battery staple", b"salt", 1000).unwrap();
+        assert!(open_with(&wrong, b"src/lib.rs.cs", &sealed).is_err());
+
+        let mut tampered = sealed.clone();
+        *tampered.last_mut().unwrap() ^= 1;
+        assert!(open_with(&key, b"src/lib.rs.cs", &tampered).is_err());
+
+        // Copied over another file's sidecar, it no longer opens
+        assert!(open_with(&key, b"src/auth.rs.cs", &sealed).is_err());
+    }
+
+    #[test]
+    fn files_sealed_without_their_path_still_open() {
+        let key = derive_key("correct horse", b"salt", 1000).unwrap();
+        let mut legacy = seal_with(&key, &[], b"fn old() {}").unwrap();
+        legacy[..MAGIC.len()].copy_from_slice(LEGACY_MAGIC);
+        assert_eq!(
+            open_with(&key, b"src/lib.rs.cs", &legacy).unwrap(),
+            b"fn old() {}"
+        );
+    }
+
+    /// Mark `index_dir` encrypted at `format_version` with a key cached as
+    /// though it had been derived from the environment.
+    fn encrypted(index_dir: &Path, format_version: u32) -> Arc<LessSafeKey> {
+        let key = derive_key("correct horse", b"salt", 1000).unwrap();
+        let info = EncryptionInfo {
+            format_version,
+            cipher: "aes-256-gcm".to_string(),
+            kdf: "pbkdf2-hmac-sha256".to_string(),
+            iterations: 1000,
+            salt: to_hex(b"salt"),
+            check: to_hex(&seal_with(&key, ENCRYPTION_FILE.as_bytes(), CHECK_PLAINTEXT).unwrap()),
+        };
+        fs::create_dir_all(index_dir).unwrap();
+        fs::write(info_path(index_dir), serde_json::to_vec(&info).unwrap()).unwrap();
+        let key = Arc::new(key);
+        KEYS.lock()
+            .unwrap()
+            .insert(index_dir.to_path_buf(), key.clone());
+        key
+    }
+
+    #[test]
+    fn encrypted_indexes_refuse_files_not_sealed_with_their_path() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let index_dir = temp_dir.path().join(".cs");
+        let key = encrypted(&index_dir, FORMAT_VERSION);
+        let sidecar = index_dir.join("lib.rs.cs");
+        let mut legacy = seal_with(&key, &[], b"fn old() {}").unwrap();
+        legacy[..MAGIC.len()].copy_from_slice(LEGACY_MAGIC);
+
+        let plain = open_from(&sidecar, b"fn planted() {}".to_vec()).unwrap_err();
+        assert!(plain.to_string().contains("in the clear"), "{}", plain);
+        let unbound = open_from(&sidecar, legacy).unwrap_err();
+        assert!(
+            unbound.to_string().contains("without its path"),
+            "{}",
+            unbound
+        );
+
+        let sealed = seal_for(&sidecar, b"fn new() {}".to_vec()).unwrap();
+        assert_eq!(open_from(&sidecar, sealed).unwrap(), b"fn new() {}");
+    }
+
+    #[test]
+    fn encrypting_seals_what_was_left_in_the_clear() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let index_dir = temp_dir.path().join(".cs");
+        let key = encrypted(&index_dir, 1);
+        let mut legacy = seal_with(&key, &[], b"fn old() {}").unwrap();
+        legacy[..MAGIC.len()].copy_from_slice(LEGACY_MAGIC);
+        fs::write(index_dir.join("lib.rs.cs"), &legacy).unwrap();
+        fs::write(index_dir.join("feedback.json"), b"{\"entries\":[]}").unwrap();
+        fs::write(index_dir.join("manifest.json"), b"{}").unwrap();
+
+        // Still being encrypted, an older index reads as before
+        let feedback = index_dir.join("feedback.json");
+        assert!(open_from(&feedback, fs::read(&feedback).unwrap()).is_ok());
+
+        let stats = encrypt_index(temp_dir.path()).unwrap();
+        assert_eq!(stats.files_encrypted, 2);
+        assert_eq!(
+            read_info(&index_dir).unwrap().format_version,
+            FORMAT_VERSION
+        );
+        for (name, contents) in [
+            ("lib.rs.cs", &b"fn old() {}"[..]),
+            ("feedback.json", &b"{\"entries\":[]}"[..]),
+        ] {
+            let path = index_dir.join(name);
+            let data = fs::read(&path).unwrap();
+            assert!(data.starts_with(MAGIC));
+            assert_eq!(open_from(&path, data).unwrap(), contents);
+        }
+        // The manifest stays readable
+        assert_eq!(fs::read(index_dir.join("manifest.json")).unwrap(), b"{}");
+    }
+
+    #[test]
+    fn files_outside_encrypted_indexes_pass_through() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let sidecar = temp_dir.path().join(".cs").join("lib.rs.cs");
+        assert_eq!(
+            index_dir_of(&sidecar),
+            Some(temp_dir.path().join(".cs").as_path())
+        );
+        assert_eq!(seal_for(&sidecar, b"plain".to_vec()).unwrap(), b"plain");
+        assert_eq!(open_from(&sidecar, b"plain".to_vec()).unwrap(), b"plain");
+    }
+}
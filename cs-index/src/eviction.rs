@@ -0,0 +1,589 @@
+//! A size budget for the index (`--max-index-size`), so a laptop's disk use
+//! stays bounded however large the indexed trees grow.
+//!
+//! After each index run or update, an index over budget drops whole files,
+//! chunks and vectors alike, until it fits. Files are chosen by the
+//! [`EvictionPolicy`]s in order: each evicts what it ranks first until the
+//! index fits or it has nothing left to offer, then the next takes over.
+//!
+//! Sidecars are removed under the update journal, so an eviction killed
+//! part way leaves a manifest that agrees with them, and the files' entries
+//! go from the index segments too. The lexical index is dropped, to be
+//! rebuilt by the next lexical search without the evicted files.
+//!
+//! Evicted files are recorded in `.cs/evicted.json` for review with
+//! `cs --evicted`, and indexing passes them over while they stay as they
+//! were. A file that changes is indexed again, and may be evicted again.
+//! Which files searches matched, for the least-recently-matched policy, is
+//! kept in `.cs/matches.json` while a budget is set.
+
+use super::{
+    IndexManifest, atomic_write, bundle, generated, journal::Journal, path_utils, save_manifest,
+    segments,
+};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::str::FromStr;
+use std::sync::RwLock;
+use std::time::SystemTime;
+
+pub const EVICTED_LOG_FILE: &str = "evicted.json";
+
+pub const MATCHES_FILE: &str = "matches.json";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum EvictionPolicy {
+    /// Files no search matched for longest, never-matched ones first
+    LeastRecentlyMatched,
+    /// Files whose last commit is oldest; uncommitted files are kept
+    OldestCommit,
+    /// Generated files, largest first; other files are kept
+    LargestGenerated,
+}
+
+pub const DEFAULT_POLICIES: &str = "largest-generated,least-recently-matched";
+
+impl FromStr for EvictionPolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "least-recently-matched" | "lru" => Ok(Self::LeastRecentlyMatched),
+            "oldest-commit" => Ok(Self::OldestCommit),
+            "largest-generated" => Ok(Self::LargestGenerated),
+            other => Err(format!(
+                "Unknown eviction policy '{}'; expected least-recently-matched, oldest-commit or largest-generated",
+                other
+            )),
+        }
+    }
+}
+
+impl fmt::Display for EvictionPolicy {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::LeastRecentlyMatched => "least recently matched",
+            Self::OldestCommit => "oldest commit",
+            Self::LargestGenerated => "largest generated",
+        })
+    }
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct Budget {
+    max_bytes: u64,
+    policies: Vec<EvictionPolicy>,
+}
+
+static BUDGET: RwLock<Option<Budget>> = RwLock::new(None);
+
+/// Keep indexes under `max_bytes`, evicting by `policies`, for the rest of
+/// the process; 0 means no limit.
+pub fn set_budget(max_bytes: u64, policies: Vec<EvictionPolicy>) {
+    let budget = (max_bytes > 0).then_some(Budget {
+        max_bytes,
+        policies,
+    });
+    *BUDGET.write().unwrap_or_else(|e| e.into_inner()) = budget;
+}
+
+fn budget() -> Option<Budget> {
+    BUDGET.read().unwrap_or_else(|e| e.into_inner()).clone()
+}
+
+/// Whether a size budget is set, so matches are worth recording.
+pub fn has_budget() -> bool {
+    budget().is_some()
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct EvictedFile {
+    pub policy: EvictionPolicy,
+    /// Index bytes the file's sidecar took
+    pub bytes: u64,
+    /// Size and modification time (seconds) of the file when it was evicted
+    pub size: u64,
+    pub last_modified: u64,
+    /// When it was evicted (seconds since the epoch)
+    pub evicted: u64,
+}
+
+/// Evicted files by path (relative to the repository root).
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct EvictedLog {
+    pub files: BTreeMap<String, EvictedFile>,
+}
+
+impl EvictedLog {
+    /// Files evicted at or after `since` (seconds since the epoch).
+    pub fn evicted_since(&self, since: u64) -> impl Iterator<Item = (&String, &EvictedFile)> {
+        self.files
+            .iter()
+            .filter(move |(_, file)| file.evicted >= since)
+    }
+}
+
+fn log_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(EVICTED_LOG_FILE)
+}
+
+fn matches_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(MATCHES_FILE)
+}
+
+pub fn load_evicted_log(repo_root: &Path) -> Result<Option<EvictedLog>> {
+    let path = log_path(repo_root);
+    if !path.exists() {
+        return Ok(None);
+    }
+    Ok(Some(serde_json::from_slice(&fs::read(&path)?)?))
+}
+
+fn load_matches(repo_root: &Path) -> BTreeMap<String, u64> {
+    fs::read(matches_path(repo_root))
+        .ok()
+        .and_then(|data| serde_json::from_slice(&data).ok())
+        .unwrap_or_default()
+}
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+fn modified_secs(metadata: &fs::Metadata) -> Option<u64> {
+    metadata
+        .modified()
+        .ok()
+        .and_then(|m| m.duration_since(SystemTime::UNIX_EPOCH).ok())
+        .map(|d| d.as_secs())
+}
+
+/// The files of one repository that indexing passes over, loaded once per
+/// walk.
+pub(crate) struct EvictedFiles {
+    repo_root: PathBuf,
+    files: HashMap<String, (u64, u64)>,
+}
+
+impl EvictedFiles {
+    pub(crate) fn load(repo_root: &Path) -> Self {
+        let files = load_evicted_log(repo_root)
+            .ok()
+            .flatten()
+            .map(|log| {
+                log.files
+                    .into_iter()
+                    .map(|(file, evicted)| (file, (evicted.size, evicted.last_modified)))
+                    .collect()
+            })
+            .unwrap_or_default();
+        Self {
+            repo_root: repo_root.to_path_buf(),
+            files,
+        }
+    }
+
+    /// Whether `entry` was evicted and hasn't changed since.
+    pub(crate) fn contains(&self, entry: &ignore::DirEntry) -> bool {
+        if self.files.is_empty() {
+            return false;
+        }
+        let path = entry.path();
+        let key = cs_core::paths::to_slash(path.strip_prefix(&self.repo_root).unwrap_or(path));
+        let Some(&(size, last_modified)) = self.files.get(&key) else {
+            return false;
+        };
+        entry.metadata().is_ok_and(|metadata| {
+            metadata.len() == size && modified_secs(&metadata) == Some(last_modified)
+        })
+    }
+}
+
+/// Note that searches of the index at `repo_root` just matched `files`.
+pub fn record_matches<'a>(repo_root: &Path, files: impl Iterator<Item = &'a Path>) -> Result<()> {
+    let root = cs_core::paths::canonicalize_lossy(repo_root);
+    let mut matches = load_matches(repo_root);
+    let now = now();
+    let before = matches.clone();
+    for file in files {
+        let file = cs_core::paths::canonicalize_lossy(file);
+        if let Ok(relative) = file.strip_prefix(&root) {
+            matches.insert(cs_core::paths::to_slash(relative), now);
+        }
+    }
+    if matches == before {
+        return Ok(());
+    }
+    atomic_write(&matches_path(repo_root), &serde_json::to_vec(&matches)?)
+}
+
+/// Carry the match times of renamed files, from and to paths relative to
+/// `repo_root`, over to their new paths.
+pub(crate) fn rename_matches(repo_root: &Path, renames: &[(String, String)]) -> Result<()> {
+    let mut matches = load_matches(repo_root);
+    let mut changed = false;
+    for (from, to) in renames {
+        if let Some(matched) = matches.remove(from) {
+            matches.insert(to.clone(), matched);
+            changed = true;
+        }
+    }
+    if !changed {
+        return Ok(());
+    }
+    atomic_write(&matches_path(repo_root), &serde_json::to_vec(&matches)?)
+}
+
+/// What enforcing the budget did to one index.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct EvictionReport {
+    pub max_bytes: u64,
+    pub size_before: u64,
+    pub size_after: u64,
+    /// Evicted files, relative to the repository root
+    pub evicted: Vec<(String, EvictionPolicy, u64)>,
+}
+
+impl EvictionReport {
+    /// Whether the index is still over budget with nothing left to evict.
+    pub fn over_budget(&self) -> bool {
+        self.size_after > self.max_bytes
+    }
+}
+
+struct Candidate {
+    key: PathBuf,
+    relative: String,
+    sidecar: PathBuf,
+    bytes: u64,
+}
+
+/// Evict files from the index at `repo_root` until it fits the budget set
+/// with [`set_budget`], if one is and it doesn't. `manifest` is saved once
+/// anything is evicted.
+pub fn enforce(repo_root: &Path, manifest: &mut IndexManifest) -> Result<Option<EvictionReport>> {
+    match budget() {
+        Some(budget) => enforce_with(repo_root, manifest, &budget),
+        None => Ok(None),
+    }
+}
+
+fn enforce_with(
+    repo_root: &Path,
+    manifest: &mut IndexManifest,
+    budget: &Budget,
+) -> Result<Option<EvictionReport>> {
+    if bundle::is_sealed(repo_root) {
+        return Ok(None);
+    }
+    let index_dir = cs_core::locations::index_dir(repo_root);
+    let size_before = disk_usage(&index_dir);
+    if size_before <= budget.max_bytes {
+        return Ok(None);
+    }
+
+    let mut candidates: Vec<Candidate> = manifest
+        .files
+        .keys()
+        .map(|key| {
+            let standard = path_utils::from_manifest_path(key);
+            let sidecar = path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard);
+            let bytes = fs::metadata(&sidecar).map(|m| m.len()).unwrap_or(0);
+            Candidate {
+                key: key.clone(),
+                relative: cs_core::paths::to_slash(&standard),
+                sidecar,
+                bytes,
+            }
+        })
+        .collect();
+
+    let manifest_path = index_dir.join("manifest.json");
+    let mut journal = Journal::open(&manifest_path)?;
+    let mut removed = Vec::new();
+    let mut report = EvictionReport {
+        max_bytes: budget.max_bytes,
+        size_before,
+        size_after: size_before,
+        evicted: Vec::new(),
+    };
+    for &policy in &budget.policies {
+        if report.size_after <= budget.max_bytes {
+            break;
+        }
+        let order = rank(repo_root, policy, &candidates);
+        let mut evicted = vec![false; candidates.len()];
+        for i in order {
+            if report.size_after <= budget.max_bytes {
+                break;
+            }
+            let candidate = &candidates[i];
+            journal.removing(&candidate.key, &candidate.sidecar)?;
+            manifest.files.remove(&candidate.key);
+            let _ = fs::remove_file(&candidate.sidecar);
+            removed.push(candidate.key.clone());
+            report.size_after = report.size_after.saturating_sub(candidate.bytes);
+            report
+                .evicted
+                .push((candidate.relative.clone(), policy, candidate.bytes));
+            evicted[i] = true;
+        }
+        let mut positions = evicted.into_iter();
+        candidates.retain(|_| !positions.next().unwrap_or(false));
+    }
+    if report.evicted.is_empty() {
+        return Ok(Some(report));
+    }
+    save_manifest(&manifest_path, manifest)?;
+    journal.commit()?;
+    if let Err(e) = segments::remove_files(&index_dir, &removed) {
+        tracing::warn!(
+            "Failed to remove evicted files from the index segments: {}",
+            e
+        );
+    }
+    // Rebuilt from the files indexing collects, which pass over evicted ones
+    let tantivy_index = index_dir.join("tantivy_index");
+    if tantivy_index.exists()
+        && let Err(e) = fs::remove_dir_all(&tantivy_index)
+    {
+        tracing::warn!(
+            "Failed to drop the lexical index after evicting files: {}",
+            e
+        );
+    }
+
+    let now = now();
+    let mut log = load_evicted_log(repo_root)
+        .ok()
+        .flatten()
+        .unwrap_or_default();
+    for (relative, policy, bytes) in &report.evicted {
+        let metadata = fs::metadata(repo_root.join(relative)).ok();
+        log.files.insert(
+            relative.clone(),
+            EvictedFile {
+                policy: *policy,
+                bytes: *bytes,
+                size: metadata.as_ref().map(|m| m.len()).unwrap_or(0),
+                last_modified: metadata.as_ref().and_then(modified_secs).unwrap_or(0),
+                evicted: now,
+            },
+        );
+    }
+    // Files indexed again once they changed, or gone, aren't evicted any more
+    log.files.retain(|file, _| {
+        !manifest
+            .files
+            .contains_key(&path_utils::to_manifest_path(Path::new(file)))
+            && repo_root.join(file).exists()
+    });
+    atomic_write(&log_path(repo_root), &serde_json::to_vec_pretty(&log)?)?;
+
+    let mut matches = load_matches(repo_root);
+    if !matches.is_empty() {
+        matches.retain(|file, _| !log.files.contains_key(file));
+        atomic_write(&matches_path(repo_root), &serde_json::to_vec(&matches)?)?;
+    }
+    Ok(Some(report))
+}
+
+/// Positions in `candidates` in the order `policy` evicts them; files it
+/// would keep are left out.
+fn rank(repo_root: &Path, policy: EvictionPolicy, candidates: &[Candidate]) -> Vec<usize> {
+    // Ties go to the file that frees the most
+    let mut ranked: Vec<(u64, usize)> = match policy {
+        EvictionPolicy::LeastRecentlyMatched => {
+            let matches = load_matches(repo_root);
+            candidates
+                .iter()
+                .enumerate()
+                .map(|(i, candidate)| (matches.get(&candidate.relative).copied().unwrap_or(0), i))
+                .collect()
+        }
+        EvictionPolicy::OldestCommit => {
+            let committed = match last_commit_times(repo_root) {
+                Ok(committed) => committed,
+                Err(e) => {
+                    tracing::warn!("Skipping the oldest-commit eviction policy: {}", e);
+                    return Vec::new();
+                }
+            };
+            candidates
+                .iter()
+                .enumerate()
+                .filter_map(|(i, candidate)| Some((*committed.get(&candidate.relative)?, i)))
+                .collect()
+        }
+        EvictionPolicy::LargestGenerated => candidates
+            .iter()
+            .enumerate()
+            .filter(|(_, candidate)| {
+                generated::is_generated_file(&repo_root.join(&candidate.relative))
+            })
+            .map(|(i, _)| (0, i))
+            .collect(),
+    };
+    ranked.sort_by_key(|&(key, i)| (key, std::cmp::Reverse(candidates[i].bytes)));
+    ranked.into_iter().map(|(_, i)| i).collect()
+}
+
+/// When each committed file under `repo_root` was last committed.
+fn last_commit_times(repo_root: &Path) -> Result<HashMap<String, u64>> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(repo_root)
+        .args(["log", "--format=%x1e%ct", "--name-only", "--relative"])
+        .output()
+        .map_err(|e| anyhow::anyhow!("Failed to run git: {}", e))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "git log failed in {}: {}",
+            repo_root.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(parse_commit_times(&String::from_utf8_lossy(&output.stdout)))
+}
+
+/// Newest first, as `git log` lists them, so a file's first commit wins.
+fn parse_commit_times(log: &str) -> HashMap<String, u64> {
+    let mut committed = HashMap::new();
+    for record in log.split('\x1e') {
+        let mut lines = record.lines();
+        let Some(Ok(timestamp)) = lines.next().map(|line| line.trim().parse::<u64>()) else {
+            continue;
+        };
+        for file in lines.map(str::trim).filter(|line| !line.is_empty()) {
+            committed.entry(file.to_string()).or_insert(timestamp);
+        }
+    }
+    committed
+}
+
+/// Bytes of the files under `dir`.
+fn disk_usage(dir: &Path) -> u64 {
+    walkdir::WalkDir::new(dir)
+        .into_iter()
+        .filter_map(|entry| entry.ok())
+        .filter(|entry| entry.file_type().is_file())
+        .filter_map(|entry| entry.metadata().ok())
+        .map(|metadata| metadata.len())
+        .sum()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn policies_parse_in_order() {
+        let policies: Vec<EvictionPolicy> = DEFAULT_POLICIES
+            .split(',')
+            .map(|policy| policy.parse().unwrap())
+            .collect();
+        assert_eq!(
+            policies,
+            vec![
+                EvictionPolicy::LargestGenerated,
+                EvictionPolicy::LeastRecentlyMatched
+            ]
+        );
+        assert!("newest".parse::<EvictionPolicy>().is_err());
+    }
+
+    #[test]
+    fn a_file_keeps_its_newest_commit_time() {
+        let log = "\x1e300\n\nsrc/a.rs\n\x1e200\n\nsrc/a.rs\nsrc/b.rs\n\x1e100\n\nold.rs\n";
+        let committed = parse_commit_times(log);
+        assert_eq!(committed["src/a.rs"], 300);
+        assert_eq!(committed["src/b.rs"], 200);
+        assert_eq!(committed["old.rs"], 100);
+    }
+
+    #[tokio::test]
+    async fn an_index_over_budget_evicts_until_it_fits() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        let body = "fn work() -> u32 {\n    let total = 1 + 2;\n    total\n}\n".repeat(40);
+        fs::write(
+            root.join("gen.rs"),
+            format!("// Code generated by stringer. DO NOT EDIT.\n{}", body),
+        )
+        .unwrap();
+        fs::write(root.join("matched.rs"), &body).unwrap();
+        fs::write(root.join("stale.rs"), &body).unwrap();
+        let index_dir = cs_core::locations::index_dir(root);
+        fs::create_dir_all(index_dir.join(segments::SEGMENTS_DIR)).unwrap();
+        super::super::index_directory(root, false, true, &[], None)
+            .await
+            .unwrap();
+        record_matches(root, [root.join("matched.rs")].iter().map(PathBuf::as_path)).unwrap();
+        fs::create_dir_all(index_dir.join("tantivy_index")).unwrap();
+
+        let sidecar = |name: &str| {
+            fs::metadata(index_dir.join(format!("{}.cs", name)))
+                .unwrap()
+                .len()
+        };
+        // Evicting the generated file alone isn't enough
+        let max_bytes = disk_usage(&index_dir) - sidecar("gen.rs") - sidecar("stale.rs") / 2;
+        let budget = Budget {
+            max_bytes,
+            policies: vec![
+                EvictionPolicy::LargestGenerated,
+                EvictionPolicy::LeastRecentlyMatched,
+            ],
+        };
+        let manifest_path = index_dir.join("manifest.json");
+        let mut manifest = super::super::load_or_create_manifest(&manifest_path).unwrap();
+        let report = enforce_with(root, &mut manifest, &budget).unwrap().unwrap();
+
+        let evicted: Vec<(&str, EvictionPolicy)> = report
+            .evicted
+            .iter()
+            .map(|(file, policy, _)| (file.as_str(), *policy))
+            .collect();
+        assert_eq!(
+            evicted,
+            vec![
+                ("gen.rs", EvictionPolicy::LargestGenerated),
+                ("stale.rs", EvictionPolicy::LeastRecentlyMatched)
+            ]
+        );
+        assert!(!report.over_budget());
+        assert_eq!(manifest.files.len(), 1);
+        // Saved and journaled, and gone from the segments and lexical index
+        let saved = super::super::load_or_create_manifest(&manifest_path).unwrap();
+        assert_eq!(saved.files.len(), 1);
+        assert!(!index_dir.join("gen.rs.cs").exists());
+        assert!(!index_dir.join(super::super::journal::JOURNAL_FILE).exists());
+        let loaded = segments::load_entries(&index_dir).unwrap().unwrap();
+        let files: Vec<PathBuf> = loaded.entries.into_iter().map(|(file, _)| file).collect();
+        assert_eq!(files, vec![PathBuf::from("matched.rs")]);
+        assert!(!index_dir.join("tantivy_index").exists());
+        let log = load_evicted_log(root).unwrap().unwrap();
+        assert_eq!(log.files.len(), 2);
+
+        // Evicted files are passed over until they change
+        let collected = super::super::collect_files(root, true, &[]).unwrap();
+        assert_eq!(collected, vec![root.join("matched.rs")]);
+        fs::write(root.join("stale.rs"), "fn edited() {}\n").unwrap();
+        let mut collected = super::super::collect_files(root, true, &[]).unwrap();
+        collected.sort();
+        assert_eq!(
+            collected,
+            vec![root.join("matched.rs"), root.join("stale.rs")]
+        );
+    }
+}
@@ -0,0 +1,302 @@
+//! User-supplied metadata extractors: commands that see the chunks of each
+//! indexed file and tag them with key/value metadata (the internal service a
+//! file belongs to, a compliance tag), which `--meta KEY=VALUE` filters on.
+//!
+//! Extractors are `[[extractor]]` tables in a `.csextract.toml` at the
+//! repository root:
+//!
+//! ```toml
+//! [[extractor]]
+//! command = ["python3", "tools/tag_chunks.py"]
+//! # Only files in these languages; every file when left out
+//! languages = ["go", "python"]
+//! ```
+//!
+//! Each command runs once per indexed file, from the repository root, with
+//! the file's chunks as JSON on stdin:
+//!
+//! ```json
+//! {"path": "services/billing/api.go", "language": "go",
+//!  "chunks": [{"line_start": 1, "line_end": 20, "kind": "function", "text": "..."}]}
+//! ```
+//!
+//! and prints either one object per chunk, in order, or a single object for
+//! every chunk of the file. Values are strings (numbers and booleans are
+//! taken as written):
+//!
+//! ```json
+//! [{"service": "billing"}, {"service": "billing", "pii": "true"}]
+//! ```
+//!
+//! The commands come from the repository, so they only run for roots the
+//! user trusts: those under a `trusted_extractor_roots` path in the system or
+//! user config (a project `.cs.toml` can't set it), or any root when
+//! `--allow-extractors` is given. An untrusted `.csextract.toml` is logged
+//! and ignored, and its files are indexed without metadata.
+//!
+//! Later extractors override the keys of earlier ones. An extractor that
+//! exits with an error or prints something else is logged and skipped, so
+//! indexing carries on. Metadata is recorded when a file is indexed, so a
+//! changed `.csextract.toml` takes effect as files change, or everywhere
+//! after `cs --clean . && cs --index .`.
+
+use anyhow::{Context, Result, bail};
+use serde::Deserialize;
+use serde_json::Value;
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::sync::{Arc, LazyLock, Mutex};
+
+use super::ChunkEntry;
+
+pub const EXTRACT_FILE: &str = ".csextract.toml";
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct Extractor {
+    pub command: Vec<String>,
+    #[serde(default)]
+    pub languages: Vec<String>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct ExtractFile {
+    #[serde(default)]
+    extractor: Vec<Extractor>,
+}
+
+#[derive(Default)]
+struct Trust {
+    all: bool,
+    roots: Vec<PathBuf>,
+}
+
+static TRUST: LazyLock<Mutex<Trust>> = LazyLock::new(|| Mutex::new(Trust::default()));
+
+static EXTRACTORS: LazyLock<Mutex<HashMap<PathBuf, Arc<Vec<Extractor>>>>> =
+    LazyLock::new(|| Mutex::new(HashMap::new()));
+
+/// Run the extractors of every repository, as `--allow-extractors` asks.
+pub fn set_allow_all(allow: bool) {
+    TRUST.lock().unwrap_or_else(|e| e.into_inner()).all = allow;
+    EXTRACTORS.lock().unwrap_or_else(|e| e.into_inner()).clear();
+}
+
+/// Run the extractors of repositories at or under `roots`, the user
+/// config's `trusted_extractor_roots`.
+pub fn set_trusted_roots(roots: Vec<PathBuf>) {
+    let roots = roots
+        .into_iter()
+        .map(|root| fs::canonicalize(&root).unwrap_or(root))
+        .collect();
+    TRUST.lock().unwrap_or_else(|e| e.into_inner()).roots = roots;
+    EXTRACTORS.lock().unwrap_or_else(|e| e.into_inner()).clear();
+}
+
+fn is_trusted(repo_root: &Path) -> bool {
+    let trust = TRUST.lock().unwrap_or_else(|e| e.into_inner());
+    if trust.all {
+        return true;
+    }
+    let repo_root = fs::canonicalize(repo_root).unwrap_or_else(|_| repo_root.to_path_buf());
+    trust.roots.iter().any(|root| repo_root.starts_with(root))
+}
+
+/// The extractors configured for `repo_root`, read once per process; none
+/// unless the root is trusted.
+pub fn extractors_for(repo_root: &Path) -> Result<Arc<Vec<Extractor>>> {
+    let mut extractors = EXTRACTORS.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(configured) = extractors.get(repo_root) {
+        return Ok(configured.clone());
+    }
+    let path = repo_root.join(EXTRACT_FILE);
+    let configured = if path.exists() && !is_trusted(repo_root) {
+        tracing::warn!(
+            "Ignoring {}: add {} to trusted_extractor_roots in the user config, or pass --allow-extractors, to run its commands",
+            path.display(),
+            repo_root.display()
+        );
+        Vec::new()
+    } else if path.exists() {
+        let file: ExtractFile = toml::from_str(&fs::read_to_string(&path)?)
+            .map_err(|e| anyhow::anyhow!("Failed to parse {}: {}", path.display(), e))?;
+        if file.extractor.iter().any(|e| e.command.is_empty()) {
+            bail!(
+                "An [[extractor]] in {} has an empty command",
+                path.display()
+            );
+        }
+        file.extractor
+    } else {
+        Vec::new()
+    };
+    let configured = Arc::new(configured);
+    extractors.insert(repo_root.to_path_buf(), configured.clone());
+    Ok(configured)
+}
+
+/// Run the extractors of `repo_root` over the `chunks` of `file` (a path
+/// relative to the root) and record what they return on each chunk.
+pub fn tag_chunks(
+    repo_root: &Path,
+    file: &Path,
+    lang: Option<cs_core::Language>,
+    content: &str,
+    chunks: &mut [ChunkEntry],
+) -> Result<()> {
+    let extractors = extractors_for(repo_root)?;
+    if extractors.is_empty() || chunks.is_empty() {
+        return Ok(());
+    }
+    let language = lang.map(|lang| lang.to_string());
+    let input = serde_json::json!({
+        "path": file.to_string_lossy().replace('\\', "/"),
+        "language": language,
+        "chunks": chunks
+            .iter()
+            .map(|chunk| serde_json::json!({
+                "line_start": chunk.span.line_start,
+                "line_end": chunk.span.line_end,
+                "kind": chunk.chunk_type,
+                "text": content.get(chunk.span.byte_start..chunk.span.byte_end).unwrap_or_default(),
+            }))
+            .collect::<Vec<_>>(),
+    })
+    .to_string();
+
+    for extractor in extractors.iter() {
+        if !extractor.languages.is_empty()
+            && !language.as_ref().is_some_and(|language| {
+                extractor
+                    .languages
+                    .iter()
+                    .any(|wanted| wanted.eq_ignore_ascii_case(language))
+            })
+        {
+            continue;
+        }
+        let tags = run(extractor, repo_root, &input).and_then(|output| {
+            parse_output(&output, chunks.len())
+                .with_context(|| format!("{} printed unexpected output", extractor.command[0]))
+        });
+        match tags {
+            Ok(tags) => {
+                for (chunk, tags) in chunks.iter_mut().zip(tags) {
+                    chunk.metadata.extend(tags);
+                }
+            }
+            Err(e) => tracing::warn!(
+                "Metadata extractor {:?} failed on {}: {:#}",
+                extractor.command,
+                file.display(),
+                e
+            ),
+        }
+    }
+    Ok(())
+}
+
+fn run(extractor: &Extractor, repo_root: &Path, input: &str) -> Result<String> {
+    let mut child = Command::new(&extractor.command[0])
+        .args(&extractor.command[1..])
+        .current_dir(repo_root)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("Failed to start {}", extractor.command[0]))?;
+    // Written from a thread, so an extractor that answers before reading
+    // everything can't leave both sides waiting on a full pipe
+    let mut stdin = child.stdin.take().context("No stdin for the extractor")?;
+    let input = input.to_string();
+    let writer = std::thread::spawn(move || stdin.write_all(input.as_bytes()));
+    let output = child.wait_with_output()?;
+    // An extractor may exit without reading its input
+    let _ = writer.join();
+    if !output.status.success() {
+        bail!(
+            "exited with {}: {}",
+            output.status,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+/// Metadata per chunk from an extractor's output: an array with one object
+/// per chunk, or one object for all of them.
+fn parse_output(output: &str, chunks: usize) -> Result<Vec<BTreeMap<String, String>>> {
+    match serde_json::from_str::<Value>(output.trim())? {
+        Value::Array(items) => {
+            if items.len() != chunks {
+                bail!("{} objects for {} chunks", items.len(), chunks);
+            }
+            items.iter().map(tags).collect()
+        }
+        object @ Value::Object(_) => Ok(vec![tags(&object)?; chunks]),
+        _ => bail!("expected a JSON object or array"),
+    }
+}
+
+fn tags(value: &Value) -> Result<BTreeMap<String, String>> {
+    let Value::Object(object) = value else {
+        bail!("expected a JSON object per chunk");
+    };
+    Ok(object
+        .iter()
+        .filter_map(|(key, value)| {
+            let value = match value {
+                Value::String(value) => value.clone(),
+                Value::Number(_) | Value::Bool(_) => value.to_string(),
+                _ => return None,
+            };
+            Some((key.clone(), value))
+        })
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn output_tags_each_chunk_or_all_of_them() {
+        let per_chunk = parse_output(
+            r#"[{"service": "billing"}, {"service": "billing", "pii": true, "owner": null}]"#,
+            2,
+        )
+        .unwrap();
+        assert_eq!(per_chunk[0]["service"], "billing");
+        assert_eq!(per_chunk[1]["pii"], "true");
+        assert!(!per_chunk[1].contains_key("owner"));
+
+        let whole_file = parse_output(r#"{"tier": 1}"#, 3).unwrap();
+        assert_eq!(whole_file.len(), 3);
+        assert!(whole_file.iter().all(|tags| tags["tier"] == "1"));
+
+        assert!(parse_output("[{}]", 2).is_err());
+        assert!(parse_output("not json", 1).is_err());
+    }
+
+    #[test]
+    fn repository_extractors_run_only_for_trusted_roots() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let repo = temp_dir.path().join("cloned");
+        fs::create_dir_all(&repo).unwrap();
+        fs::write(
+            repo.join(EXTRACT_FILE),
+            "[[extractor]]\ncommand = [\"sh\", \"-c\", \"echo {}\"]\n",
+        )
+        .unwrap();
+
+        assert!(extractors_for(&repo).unwrap().is_empty());
+
+        set_trusted_roots(vec![temp_dir.path().to_path_buf()]);
+        assert_eq!(extractors_for(&repo).unwrap().len(), 1);
+
+        set_trusted_roots(vec![temp_dir.path().join("elsewhere")]);
+        assert!(extractors_for(&repo).unwrap().is_empty());
+    }
+}
@@ -0,0 +1,148 @@
+//! ripgrep-style file filters: `-g` globs and `-t`/`-T` file types.
+//!
+//! Globs follow ripgrep: a plain glob whitelists matching files, `!glob`
+//! excludes them, and the last matching glob wins. Globs are matched against
+//! paths relative to the filter root, and a directory excluded by a glob
+//! excludes everything under it. Globs and paths are compared as
+//! [`cs_core::paths::filter_path`] folds them, so `-g 'café/**'` matches
+//! however the filesystem spells `é`. Type names are ripgrep's built-in
+//! table (`go`, `rust`, `py`, `ts`, ...).
+
+use anyhow::{Result, anyhow};
+use ignore::overrides::{Override, OverrideBuilder};
+use ignore::types::{Types, TypesBuilder};
+use std::path::{Path, PathBuf};
+
+pub struct FileFilter {
+    root: PathBuf,
+    globs: Override,
+    types: Types,
+}
+
+impl FileFilter {
+    /// A filter matching `globs` relative to `root`, keeping files of the
+    /// `types` (if any) and dropping files of the `types_not`.
+    pub fn new(
+        root: &Path,
+        globs: &[String],
+        types: &[String],
+        types_not: &[String],
+    ) -> Result<Self> {
+        let root = cs_core::paths::canonicalize_lossy(root);
+
+        let mut glob_builder = OverrideBuilder::new(&root);
+        glob_builder.case_insensitive(cs_core::paths::filters_ignore_case())?;
+        for glob in globs {
+            glob_builder
+                .add(&cs_core::paths::filter_pattern(glob))
+                .map_err(|e| anyhow!("Invalid glob '{}': {}", glob, e))?;
+        }
+
+        let mut type_builder = TypesBuilder::new();
+        type_builder.add_defaults();
+        for name in types {
+            type_builder.select(name);
+        }
+        for name in types_not {
+            type_builder.negate(name);
+        }
+
+        Ok(Self {
+            root,
+            globs: glob_builder.build()?,
+            types: type_builder.build()?,
+        })
+    }
+
+    /// Whether `file` passes the globs and type filters.
+    pub fn matches(&self, file: &Path) -> bool {
+        let file = cs_core::paths::canonicalize_lossy(file);
+        let relative = file.strip_prefix(&self.root).unwrap_or(&file);
+        let folded = cs_core::paths::filter_path(relative);
+        let relative = &*folded;
+        if self.types.matched(relative, false).is_ignore()
+            || self.globs.matched(relative, false).is_ignore()
+        {
+            return false;
+        }
+        // ripgrep prunes excluded directories during the walk
+        relative
+            .ancestors()
+            .skip(1)
+            .filter(|dir| !dir.as_os_str().is_empty())
+            .all(|dir| !self.globs.matched(dir, true).is_ignore())
+    }
+}
+
+/// Names of the file types accepted by `-t`, sorted.
+pub fn type_names() -> Vec<String> {
+    let mut builder = TypesBuilder::new();
+    builder.add_defaults();
+    builder
+        .definitions()
+        .into_iter()
+        .map(|definition| definition.name().to_string())
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+
+    fn strings(values: &[&str]) -> Vec<String> {
+        values.iter().map(|value| value.to_string()).collect()
+    }
+
+    #[test]
+    fn globs_and_types_follow_ripgrep() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        for file in ["main.go", "vendor/dep.go", "lib.rs", "src/api.go"] {
+            let path = root.join(file);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, "").unwrap();
+        }
+        let kept = |filter: &FileFilter| -> Vec<String> {
+            let mut kept: Vec<String> = ["main.go", "vendor/dep.go", "lib.rs", "src/api.go"]
+                .into_iter()
+                .filter(|file| filter.matches(&root.join(file)))
+                .map(str::to_string)
+                .collect();
+            kept.sort();
+            kept
+        };
+
+        let go = FileFilter::new(root, &[], &strings(&["go"]), &[]).unwrap();
+        assert_eq!(kept(&go), ["main.go", "src/api.go", "vendor/dep.go"]);
+
+        let no_vendor =
+            FileFilter::new(root, &strings(&["!vendor"]), &strings(&["go"]), &[]).unwrap();
+        assert_eq!(kept(&no_vendor), ["main.go", "src/api.go"]);
+
+        let src = FileFilter::new(root, &strings(&["src/**"]), &[], &[]).unwrap();
+        assert_eq!(kept(&src), ["src/api.go"]);
+
+        let not_go = FileFilter::new(root, &[], &[], &strings(&["go"])).unwrap();
+        assert_eq!(kept(&not_go), ["lib.rs"]);
+
+        assert!(FileFilter::new(root, &[], &strings(&["no-such-type"]), &[]).is_err());
+        assert!(type_names().iter().any(|name| name == "rust"));
+    }
+
+    #[test]
+    fn globs_match_names_in_either_unicode_form() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        // Decomposed, as macOS hands names out
+        let menu = root.join("cafe\u{301}/menu.md");
+        fs::create_dir_all(menu.parent().unwrap()).unwrap();
+        fs::write(&menu, "").unwrap();
+
+        let cafe = FileFilter::new(root, &strings(&["caf\u{e9}/**"]), &[], &[]).unwrap();
+        assert!(cafe.matches(&menu));
+        let no_cafe = FileFilter::new(root, &strings(&["!caf\u{e9}"]), &[], &[]).unwrap();
+        assert!(!no_cafe.matches(&menu));
+    }
+}
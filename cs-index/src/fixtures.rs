@@ -0,0 +1,247 @@
+//! Size caps for test fixtures, golden files and other trees that hold some
+//! useful example code among a lot of bulk, declared as `[[fixture]]` rules
+//! in config (the project's `.cs.toml` included):
+//!
+//! ```toml
+//! [[fixture]]
+//! pattern = "**/testdata/"
+//! max_file_size = "64K"   # leave out larger files under it
+//! max_dir_size = "512K"   # index at most this much of each testdata/
+//! max_files = 50          # and at most this many of its files
+//! ```
+//!
+//! A directory a pattern matches is a fixture directory with a budget of its
+//! own, for everything under it; a pattern that matches only files, such as
+//! `*.golden`, gives each directory of them its own. The first rule that
+//! matches a file applies. Each directory's files are taken smallest first
+//! while they fit, so the small examples are indexed and the huge golden
+//! outputs left out, and the same files are chosen from one run to the next
+//! unless the directory changes. Files left out are logged to
+//! `.cs/skipped.json` like oversized ones, for `cs --skipped`.
+
+use super::read_limits::{self, SkipReason};
+use anyhow::{Result, anyhow};
+use cs_core::FixtureRule;
+use ignore::gitignore::{Gitignore, GitignoreBuilder};
+use std::collections::{BTreeMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{LazyLock, Mutex};
+
+static RULES: LazyLock<Mutex<Vec<FixtureRule>>> = LazyLock::new(Default::default);
+
+/// Rules from config, applied to every walk for the rest of the process.
+pub fn set_rules(rules: Vec<FixtureRule>) {
+    *RULES.lock().unwrap_or_else(|e| e.into_inner()) = rules;
+}
+
+/// A rule ready to match.
+struct Budget {
+    matcher: Gitignore,
+    max_file_size: Option<u64>,
+    max_dir_size: Option<u64>,
+    max_files: Option<usize>,
+}
+
+impl Budget {
+    fn new(rule: &FixtureRule) -> Result<Self> {
+        let invalid = |field: &str, e: String| {
+            anyhow!("Invalid {} of [[fixture]] '{}': {}", field, rule.pattern, e)
+        };
+        // Rooted nowhere: paths are matched relative to the walk root
+        let mut builder = GitignoreBuilder::new("");
+        builder.case_insensitive(cs_core::paths::CASE_INSENSITIVE)?;
+        builder
+            .add_line(None, &cs_core::paths::normalize_pattern(&rule.pattern))
+            .map_err(|e| invalid("pattern", e.to_string()))?;
+        let size = |field: &str, value: &Option<String>| {
+            value
+                .as_deref()
+                .map(read_limits::parse_size)
+                .transpose()
+                .map_err(|e| invalid(field, e))
+        };
+        Ok(Self {
+            matcher: builder.build()?,
+            max_file_size: size("max_file_size", &rule.max_file_size)?,
+            max_dir_size: size("max_dir_size", &rule.max_dir_size)?,
+            max_files: rule.max_files,
+        })
+    }
+
+    /// The fixture directory `relative` falls in under this rule, if any.
+    fn fixture_dir(&self, relative: &Path) -> Option<PathBuf> {
+        let mut dirs: Vec<&Path> = relative
+            .ancestors()
+            .skip(1)
+            .filter(|dir| !dir.as_os_str().is_empty())
+            .collect();
+        // The outermost matching directory budgets the whole tree under it
+        dirs.reverse();
+        dirs.into_iter()
+            .find(|dir| self.matcher.matched(dir, true).is_ignore())
+            .or_else(|| {
+                self.matcher
+                    .matched(relative, false)
+                    .is_ignore()
+                    .then(|| relative.parent().unwrap_or(Path::new("")))
+            })
+            .map(Path::to_path_buf)
+    }
+
+    /// Which of the `files` (with their sizes) of one fixture directory fit
+    /// its budget: the kept ones, then the rest.
+    fn select(&self, mut files: Vec<(PathBuf, u64)>) -> (Vec<PathBuf>, Vec<(PathBuf, u64)>) {
+        files.sort_by(|a, b| a.1.cmp(&b.1).then_with(|| a.0.cmp(&b.0)));
+        let mut kept = Vec::new();
+        let mut dropped = Vec::new();
+        let mut total = 0u64;
+        for (file, size) in files {
+            let fits = self.max_file_size.is_none_or(|max| size <= max)
+                && self.max_files.is_none_or(|max| kept.len() < max)
+                && self.max_dir_size.is_none_or(|max| total + size <= max);
+            if fits {
+                total += size;
+                kept.push(file);
+            } else {
+                dropped.push((file, size));
+            }
+        }
+        (kept, dropped)
+    }
+}
+
+/// Of the `files` a walk of `root` collected, those the fixture rules let
+/// through; the rest are logged as skipped. A walk pruned to the `within`
+/// paths may see only part of a fixture directory, so the budget of such a
+/// directory is taken from the files `walk_dir` collects under all of it.
+pub(crate) fn apply(
+    root: &Path,
+    files: Vec<PathBuf>,
+    within: Option<&[PathBuf]>,
+    walk_dir: impl Fn(&Path) -> Result<Vec<PathBuf>>,
+) -> Result<Vec<PathBuf>> {
+    let budgets = RULES
+        .lock()
+        .unwrap_or_else(|e| e.into_inner())
+        .iter()
+        .map(Budget::new)
+        .collect::<Result<Vec<_>>>()?;
+    if budgets.is_empty() {
+        return Ok(files);
+    }
+
+    let mut kept = Vec::new();
+    let mut fixture_dirs: BTreeMap<(usize, PathBuf), Vec<(PathBuf, u64)>> = BTreeMap::new();
+    for file in files {
+        let fixture = file.strip_prefix(root).ok().and_then(|relative| {
+            budgets
+                .iter()
+                .enumerate()
+                .find_map(|(rule, budget)| Some((rule, budget.fixture_dir(relative)?)))
+        });
+        match fixture {
+            Some(key) => {
+                let size = fs::metadata(&file).map(|m| m.len()).unwrap_or(0);
+                fixture_dirs.entry(key).or_default().push((file, size));
+            }
+            None => kept.push(file),
+        }
+    }
+
+    for ((rule, dir), files) in fixture_dirs {
+        let dir = root.join(dir);
+        let complete = within.is_none_or(|within| within.iter().any(|path| dir.starts_with(path)));
+        if complete {
+            let (fit, dropped) = budgets[rule].select(files);
+            kept.extend(fit);
+            for (file, size) in dropped {
+                read_limits::record(&file, size, root, SkipReason::FixtureBudget);
+            }
+        } else {
+            let fit: HashSet<PathBuf> = walk_dir(&dir)?.into_iter().collect();
+            kept.extend(
+                files
+                    .into_iter()
+                    .map(|(file, _)| file)
+                    .filter(|file| fit.contains(file)),
+            );
+        }
+    }
+    Ok(kept)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn budget(pattern: &str) -> Budget {
+        Budget::new(&FixtureRule {
+            pattern: pattern.to_string(),
+            max_file_size: Some("10K".to_string()),
+            max_dir_size: Some("12K".to_string()),
+            max_files: Some(3),
+        })
+        .unwrap()
+    }
+
+    #[test]
+    fn fixture_dirs_are_the_outermost_matching_directory() {
+        let testdata = budget("testdata/");
+        assert_eq!(
+            testdata.fixture_dir(Path::new("pkg/parser/testdata/json/deep.json")),
+            Some(PathBuf::from("pkg/parser/testdata"))
+        );
+        assert_eq!(testdata.fixture_dir(Path::new("pkg/parser/lexer.go")), None);
+
+        // Each directory of matching files gets a budget of its own
+        let golden = budget("*.golden");
+        assert_eq!(
+            golden.fixture_dir(Path::new("tests/fmt/output.golden")),
+            Some(PathBuf::from("tests/fmt"))
+        );
+        assert_eq!(
+            golden.fixture_dir(Path::new("top.golden")),
+            Some(PathBuf::new())
+        );
+        assert_eq!(golden.fixture_dir(Path::new("tests/fmt/input.rs")), None);
+    }
+
+    #[test]
+    fn fixture_dirs_keep_their_smallest_files_that_fit() {
+        let files = |sizes: &[(&str, u64)]| -> Vec<(PathBuf, u64)> {
+            sizes
+                .iter()
+                .map(|(name, size)| (PathBuf::from(name), size * 1024))
+                .collect()
+        };
+        let kept = |selected: (Vec<PathBuf>, Vec<(PathBuf, u64)>)| -> Vec<String> {
+            selected
+                .0
+                .iter()
+                .map(|file| file.display().to_string())
+                .collect()
+        };
+        let budget = budget("testdata/");
+
+        // Over the file cap, then over the directory's
+        assert_eq!(
+            kept(budget.select(files(&[
+                ("golden.out", 300),
+                ("c.rs", 6),
+                ("a.rs", 2),
+                ("b.rs", 2)
+            ]))),
+            ["a.rs", "b.rs", "c.rs"]
+        );
+        assert_eq!(
+            kept(budget.select(files(&[("big.rs", 9), ("a.rs", 2), ("b.rs", 2)]))),
+            ["a.rs", "b.rs"]
+        );
+        // At most three files
+        assert_eq!(
+            kept(budget.select(files(&[("d", 1), ("c", 1), ("b", 1), ("a", 1)]))),
+            ["a", "b", "c"]
+        );
+    }
+}
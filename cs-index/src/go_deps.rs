@@ -0,0 +1,515 @@
+//! Go module dependencies as a collection: `cs --index --with-deps` reads the
+//! repository's `go.mod`, finds the modules it requires in the module cache
+//! and indexes their Go sources into the [`DEPS_COLLECTION`] collection, so
+//! "how does the retry library back off" is answered from the library's own
+//! code next to the repository's.
+//!
+//! Only direct requirements are read unless the scope is
+//! [`DepsScope::All`], which adds the `// indirect` ones; since Go 1.17 a
+//! `go.mod` lists every module its packages need, so that is the whole
+//! build. `replace` directives that point at another module version are
+//! followed; ones that point at a local directory are left out, as that code
+//! is usually indexed already. Tests, `testdata`, `vendor` and nested modules
+//! are skipped. A module version in the cache never changes, so the
+//! collection is only embedded again when the set of modules does.
+
+use super::collections::{self, Collection, CollectionStats, Document};
+use anyhow::{Result, bail};
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use walkdir::WalkDir;
+
+/// The collection dependencies are indexed into.
+pub const DEPS_COLLECTION: &str = "deps";
+
+/// Prefix of the connector saved with a dependency collection:
+/// `gomod:<scope>:<path to go.mod>`.
+pub const GO_MOD_CONNECTOR: &str = "gomod:";
+
+/// Which of the `go.mod`'s requirements are indexed.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum DepsScope {
+    /// Modules the repository imports itself
+    #[default]
+    Direct,
+    /// Every required module, the `// indirect` ones too
+    All,
+}
+
+impl FromStr for DepsScope {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "direct" => Ok(DepsScope::Direct),
+            "all" | "transitive" => Ok(DepsScope::All),
+            other => Err(format!(
+                "Unknown dependency scope '{}': use direct or all",
+                other
+            )),
+        }
+    }
+}
+
+impl std::fmt::Display for DepsScope {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            DepsScope::Direct => "direct",
+            DepsScope::All => "all",
+        })
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Requirement {
+    path: String,
+    version: String,
+    indirect: bool,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Replacement {
+    path: String,
+    /// Only this version is replaced, when set
+    version: Option<String>,
+    /// The module and version used instead; `None` for a local directory
+    with: Option<(String, String)>,
+}
+
+#[derive(Debug, Default, PartialEq, Eq)]
+struct GoMod {
+    requires: Vec<Requirement>,
+    replaces: Vec<Replacement>,
+}
+
+/// A module version to index, as `path@version`, and where it's unpacked.
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Dependency {
+    name: String,
+    dir: PathBuf,
+}
+
+#[derive(Debug, Default)]
+pub struct DepsStats {
+    /// Modules read from the module cache
+    pub modules: usize,
+    /// `path@version` of required modules missing from the cache
+    pub missing: Vec<String>,
+    /// Requirements replaced with a local directory, which aren't indexed
+    pub local: Vec<String>,
+    /// What was embedded; `None` when the collection was up to date
+    pub collection: Option<CollectionStats>,
+}
+
+fn parse_go_mod(text: &str) -> GoMod {
+    let mut go_mod = GoMod::default();
+    // The directive of the block being read
+    let mut block: Option<&str> = None;
+    for line in text.lines() {
+        let (code, comment) = match line.split_once("//") {
+            Some((code, comment)) => (code.trim(), comment.trim()),
+            None => (line.trim(), ""),
+        };
+        if code.is_empty() {
+            continue;
+        }
+        let spec = match block {
+            Some(_) if code == ")" => {
+                block = None;
+                continue;
+            }
+            Some(directive) => Some((directive, code)),
+            None => {
+                let (directive, rest) = code.split_once(char::is_whitespace).unwrap_or((code, ""));
+                let rest = rest.trim();
+                if rest == "(" {
+                    block = Some(directive);
+                    None
+                } else {
+                    Some((directive, rest))
+                }
+            }
+        };
+        match spec {
+            Some(("require", spec)) => {
+                if let [path, version] = fields(spec).as_slice() {
+                    go_mod.requires.push(Requirement {
+                        path: path.clone(),
+                        version: version.clone(),
+                        indirect: comment == "indirect" || comment.starts_with("indirect;"),
+                    });
+                }
+            }
+            Some(("replace", spec)) => {
+                let Some((from, to)) = spec.split_once("=>") else {
+                    continue;
+                };
+                let (from, to) = (fields(from), fields(to));
+                let Some(path) = from.first().cloned() else {
+                    continue;
+                };
+                let with = match to.as_slice() {
+                    [path, version] => Some((path.clone(), version.clone())),
+                    _ => None,
+                };
+                go_mod.replaces.push(Replacement {
+                    path,
+                    version: from.get(1).cloned(),
+                    with,
+                });
+            }
+            _ => {}
+        }
+    }
+    go_mod
+}
+
+/// The whitespace-separated fields of `spec`, unquoted.
+fn fields(spec: &str) -> Vec<String> {
+    spec.split_whitespace()
+        .map(|field| field.trim_matches(|c| c == '"' || c == '`').to_string())
+        .collect()
+}
+
+/// The module cache: `GOMODCACHE`, else `pkg/mod` under the first `GOPATH`
+/// entry, which defaults to `~/go`.
+fn module_cache() -> Option<PathBuf> {
+    let env = |var: &str| std::env::var_os(var).filter(|value| !value.is_empty());
+    if let Some(cache) = env("GOMODCACHE") {
+        return Some(PathBuf::from(cache));
+    }
+    let gopath = match env("GOPATH") {
+        Some(gopath) => std::env::split_paths(&gopath).next()?,
+        None => PathBuf::from(env("HOME").or_else(|| env("USERPROFILE"))?).join("go"),
+    };
+    Some(gopath.join("pkg").join("mod"))
+}
+
+/// A module path or version as the module cache spells it: upper-case
+/// letters become `!` and the lower-case letter, so paths differing only in
+/// case don't collide on case-insensitive filesystems.
+fn escape(path: &str) -> String {
+    let mut escaped = String::with_capacity(path.len());
+    for c in path.chars() {
+        if c.is_ascii_uppercase() {
+            escaped.push('!');
+            escaped.push(c.to_ascii_lowercase());
+        } else {
+            escaped.push(c);
+        }
+    }
+    escaped
+}
+
+/// The modules `go_mod` requires in `scope`, found in `cache`, and what
+/// couldn't be.
+fn resolve(
+    go_mod: &GoMod,
+    scope: DepsScope,
+    cache: &Path,
+    stats: &mut DepsStats,
+) -> Vec<Dependency> {
+    let mut dependencies = Vec::new();
+    for requirement in &go_mod.requires {
+        if requirement.indirect && scope == DepsScope::Direct {
+            continue;
+        }
+        // A replacement of this version wins over one of every version
+        let replacement = go_mod
+            .replaces
+            .iter()
+            .filter(|replace| replace.path == requirement.path)
+            .filter(|replace| {
+                replace
+                    .version
+                    .as_ref()
+                    .is_none_or(|version| *version == requirement.version)
+            })
+            .max_by_key(|replace| replace.version.is_some());
+        let (path, version) = match replacement {
+            Some(Replacement { with: None, .. }) => {
+                stats.local.push(requirement.path.clone());
+                continue;
+            }
+            Some(Replacement {
+                with: Some((path, version)),
+                ..
+            }) => (path, version),
+            None => (&requirement.path, &requirement.version),
+        };
+        let name = format!("{}@{}", path, version);
+        let dir = cache.join(format!("{}@{}", escape(path), escape(version)));
+        if dir.is_dir() {
+            dependencies.push(Dependency { name, dir });
+        } else {
+            stats.missing.push(name);
+        }
+    }
+    dependencies.sort_by(|a, b| a.name.cmp(&b.name));
+    dependencies.dedup_by(|a, b| a.name == b.name);
+    dependencies
+}
+
+/// Whether `name` is a directory the Go tool never builds from.
+fn is_skipped_dir(name: &str) -> bool {
+    name == "testdata" || name == "vendor" || name.starts_with('.') || name.starts_with('_')
+}
+
+/// The Go sources of `dependency`, named `path@version/dir/file.go`.
+fn read_sources(dependency: &Dependency) -> Vec<Document> {
+    let mut documents = Vec::new();
+    let walker = WalkDir::new(&dependency.dir)
+        .sort_by_file_name()
+        .into_iter()
+        .filter_entry(|entry| {
+            if entry.depth() == 0 || !entry.file_type().is_dir() {
+                return true;
+            }
+            let name = entry.file_name().to_string_lossy();
+            // A directory with its own go.mod is another module
+            !is_skipped_dir(&name) && !entry.path().join("go.mod").exists()
+        });
+    for entry in walker.flatten() {
+        let name = entry.file_name().to_string_lossy();
+        if !entry.file_type().is_file() || !name.ends_with(".go") || name.ends_with("_test.go") {
+            continue;
+        }
+        let Ok(text) = fs::read_to_string(entry.path()) else {
+            continue;
+        };
+        let relative = entry
+            .path()
+            .strip_prefix(&dependency.dir)
+            .unwrap_or(entry.path());
+        documents.push(Document {
+            source: format!("{}/{}", dependency.name, cs_core::paths::to_slash(relative)),
+            url: None,
+            text,
+        });
+    }
+    documents
+}
+
+/// The `path@version` of each module `collection` holds sources of.
+fn indexed_modules(collection: &Collection) -> BTreeSet<&str> {
+    collection
+        .chunks
+        .iter()
+        .filter_map(|chunk| {
+            let (_, version_and_file) = chunk.source.split_once('@')?;
+            let version_len = version_and_file.find('/')?;
+            let end = chunk.source.len() - version_and_file.len() + version_len;
+            Some(&chunk.source[..end])
+        })
+        .collect()
+}
+
+/// The connector saved with a dependency collection.
+pub fn connector(go_mod: &Path, scope: DepsScope) -> String {
+    format!(
+        "{}{}:{}",
+        GO_MOD_CONNECTOR,
+        scope,
+        cs_core::paths::canonicalize_lossy(go_mod).display()
+    )
+}
+
+/// The scope and `go.mod` of a dependency collection's connector.
+pub fn parse_connector(connector: &str) -> Option<(DepsScope, PathBuf)> {
+    let (scope, go_mod) = connector.strip_prefix(GO_MOD_CONNECTOR)?.split_once(':')?;
+    Some((scope.parse().ok()?, PathBuf::from(go_mod)))
+}
+
+/// Index the modules `go_mod` requires in `scope` into the collection
+/// `name` of the index at `repo_root`, unless it holds those modules already.
+pub fn index_deps(
+    repo_root: &Path,
+    name: &str,
+    go_mod: &Path,
+    scope: DepsScope,
+    model: Option<&str>,
+) -> Result<DepsStats> {
+    let text = match fs::read_to_string(go_mod) {
+        Ok(text) => text,
+        Err(e) => bail!("Can't read {}: {}", go_mod.display(), e),
+    };
+    let Some(cache) = module_cache() else {
+        bail!("Can't find the Go module cache; set GOMODCACHE or GOPATH");
+    };
+    let mut stats = DepsStats::default();
+    let dependencies = resolve(&parse_go_mod(&text), scope, &cache, &mut stats);
+    stats.modules = dependencies.len();
+
+    let mut documents = Vec::new();
+    let mut wanted = BTreeSet::new();
+    for dependency in &dependencies {
+        let sources = read_sources(dependency);
+        if !sources.is_empty() {
+            wanted.insert(dependency.name.as_str());
+        }
+        documents.extend(sources);
+    }
+    let connector = connector(go_mod, scope);
+    let previous = collections::load_collection(repo_root, name)?;
+    let up_to_date = previous.as_ref().is_some_and(|previous| {
+        previous.connector.as_deref() == Some(connector.as_str())
+            && model.is_none_or(|model| previous.embedding_model.as_deref() == Some(model))
+            && indexed_modules(previous) == wanted
+    });
+    if !up_to_date {
+        stats.collection = Some(collections::index_collection_documents(
+            repo_root, name, &connector, &documents, model,
+        )?);
+    }
+    Ok(stats)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    const GO_MOD: &str = r#"module example.com/app
+
+go 1.22
+
+require github.com/cenkalti/backoff/v4 v4.3.0
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	golang.org/x/sync v0.7.0 // indirect
+	example.com/shared v0.1.0
+	"example.com/forked" v1.0.0
+)
+
+replace example.com/shared => ../shared
+
+replace (
+	example.com/forked v1.0.0 => github.com/someone/forked v1.0.1
+)
+"#;
+
+    fn write(path: &Path, text: &str) {
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, text).unwrap();
+    }
+
+    #[test]
+    fn go_mod_requirements_and_replacements_parse() {
+        let go_mod = parse_go_mod(GO_MOD);
+        let required: Vec<(&str, &str, bool)> = go_mod
+            .requires
+            .iter()
+            .map(|r| (r.path.as_str(), r.version.as_str(), r.indirect))
+            .collect();
+        assert_eq!(
+            required,
+            [
+                ("github.com/cenkalti/backoff/v4", "v4.3.0", false),
+                ("github.com/BurntSushi/toml", "v1.3.2", false),
+                ("golang.org/x/sync", "v0.7.0", true),
+                ("example.com/shared", "v0.1.0", false),
+                ("example.com/forked", "v1.0.0", false),
+            ]
+        );
+        assert_eq!(go_mod.replaces[0].with, None);
+        assert_eq!(
+            go_mod.replaces[1],
+            Replacement {
+                path: "example.com/forked".to_string(),
+                version: Some("v1.0.0".to_string()),
+                with: Some((
+                    "github.com/someone/forked".to_string(),
+                    "v1.0.1".to_string()
+                )),
+            }
+        );
+
+        assert_eq!(
+            escape("github.com/BurntSushi/toml"),
+            "github.com/!burnt!sushi/toml"
+        );
+        assert_eq!("ALL".parse::<DepsScope>(), Ok(DepsScope::All));
+        assert!("some".parse::<DepsScope>().is_err());
+        let connector = connector(Path::new("/src/app/go.mod"), DepsScope::All);
+        assert_eq!(
+            parse_connector(&connector),
+            Some((DepsScope::All, PathBuf::from("/src/app/go.mod")))
+        );
+    }
+
+    #[test]
+    fn requirements_resolve_to_the_module_cache() {
+        let cache = TempDir::new().unwrap();
+        let backoff = cache.path().join("github.com/cenkalti/backoff/v4@v4.3.0");
+        write(&backoff.join("retry.go"), "package backoff\n");
+        write(&backoff.join("retry_test.go"), "package backoff\n");
+        write(&backoff.join("testdata/fixture.go"), "package fixture\n");
+        write(&backoff.join("tools/go.mod"), "module tools\n");
+        write(&backoff.join("tools/gen.go"), "package tools\n");
+        write(&backoff.join("internal/timer.go"), "package internal\n");
+        write(
+            &cache
+                .path()
+                .join("github.com/!burnt!sushi/toml@v1.3.2/decode.go"),
+            "package toml\n",
+        );
+        write(
+            &cache
+                .path()
+                .join("golang.org/x/sync@v0.7.0/errgroup/errgroup.go"),
+            "package errgroup\n",
+        );
+
+        let go_mod = parse_go_mod(GO_MOD);
+        let mut stats = DepsStats::default();
+        let direct = resolve(&go_mod, DepsScope::Direct, cache.path(), &mut stats);
+        let names: Vec<&str> = direct.iter().map(|d| d.name.as_str()).collect();
+        assert_eq!(
+            names,
+            [
+                "github.com/BurntSushi/toml@v1.3.2",
+                "github.com/cenkalti/backoff/v4@v4.3.0"
+            ]
+        );
+        assert_eq!(stats.missing, ["github.com/someone/forked@v1.0.1"]);
+        assert_eq!(stats.local, ["example.com/shared"]);
+
+        let mut stats = DepsStats::default();
+        let all = resolve(&go_mod, DepsScope::All, cache.path(), &mut stats);
+        assert_eq!(all.len(), 3);
+
+        let sources: Vec<String> = read_sources(&direct[1])
+            .into_iter()
+            .map(|document| document.source)
+            .collect();
+        assert_eq!(
+            sources,
+            [
+                "github.com/cenkalti/backoff/v4@v4.3.0/internal/timer.go",
+                "github.com/cenkalti/backoff/v4@v4.3.0/retry.go",
+            ]
+        );
+
+        let collection = Collection {
+            chunks: sources
+                .iter()
+                .map(|source| collections::CollectionChunk {
+                    source: source.clone(),
+                    line_start: 1,
+                    line_end: 1,
+                    text: String::new().into(),
+                    url: None,
+                    embedding: Vec::new(),
+                })
+                .collect(),
+            ..Default::default()
+        };
+        assert_eq!(
+            indexed_modules(&collection).into_iter().collect::<Vec<_>>(),
+            ["github.com/cenkalti/backoff/v4@v4.3.0"]
+        );
+    }
+}
@@ -0,0 +1,472 @@
+//! The Go standard library as a collection: `cs --index --with-stdlib` reads
+//! the exported API of every package under `$GOROOT/src`, each declaration
+//! with its doc comment, into the [`STDLIB_COLLECTION`] collection, so a
+//! query like "parse RFC3339 timestamps" finds `time.Parse` next to the
+//! repository's own code.
+//!
+//! Each package is one document, read like `go doc -all` prints it: the
+//! package comment, then every exported function, method and type with its
+//! doc comment, function bodies left out; results link to the package on
+//! pkg.go.dev. Commands, `internal` and `vendor` packages, tests and
+//! `testdata` are skipped. The Go version is saved with the collection, so
+//! it's only embedded again after Go is upgraded.
+
+use super::collections::{self, CollectionStats, Document};
+use anyhow::{Result, bail};
+use std::collections::HashSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use walkdir::WalkDir;
+
+/// The collection the standard library is indexed into.
+pub const STDLIB_COLLECTION: &str = "stdlib";
+
+/// Prefix of the connector saved with the standard library collection:
+/// `goroot:<version>:<GOROOT>`.
+pub const GOROOT_CONNECTOR: &str = "goroot:";
+
+const PKG_GO_DEV: &str = "https://pkg.go.dev";
+
+/// Lines of a struct or interface type shown before the rest is elided.
+const MAX_TYPE_LINES: usize = 60;
+
+#[derive(Debug, Default)]
+pub struct StdlibStats {
+    /// Go version of the standard library, e.g. `go1.22.3`
+    pub version: String,
+    /// Packages with an exported API
+    pub packages: usize,
+    /// What was embedded; `None` when the collection was up to date
+    pub collection: Option<CollectionStats>,
+}
+
+/// The Go installation: `GOROOT`, else what `go env GOROOT` says.
+pub fn goroot() -> Option<PathBuf> {
+    if let Some(goroot) = std::env::var_os("GOROOT").filter(|value| !value.is_empty()) {
+        return Some(PathBuf::from(goroot));
+    }
+    let output = Command::new("go").args(["env", "GOROOT"]).output().ok()?;
+    let goroot = String::from_utf8(output.stdout).ok()?;
+    let goroot = goroot.trim();
+    (output.status.success() && !goroot.is_empty()).then(|| PathBuf::from(goroot))
+}
+
+/// The Go version of the installation at `goroot`, from its `VERSION` file.
+fn go_version(goroot: &Path) -> String {
+    fs::read_to_string(goroot.join("VERSION"))
+        .ok()
+        .and_then(|version| version.lines().next().map(|line| line.trim().to_string()))
+        .filter(|version| !version.is_empty())
+        .unwrap_or_else(|| "devel".to_string())
+}
+
+/// Whether the package directory `name` is left out of the collection.
+fn is_skipped_dir(name: &str) -> bool {
+    matches!(name, "internal" | "vendor" | "testdata")
+        || name.starts_with('.')
+        || name.starts_with('_')
+}
+
+/// Import path and directory of each standard library package under `src`.
+fn packages(src: &Path) -> Vec<(String, PathBuf)> {
+    WalkDir::new(src)
+        .sort_by_file_name()
+        .into_iter()
+        .filter_entry(|entry| {
+            if entry.depth() == 0 || !entry.file_type().is_dir() {
+                return true;
+            }
+            let name = entry.file_name().to_string_lossy();
+            // Commands aren't importable
+            let is_commands = entry.depth() == 1 && name == "cmd";
+            !is_skipped_dir(&name) && !is_commands
+        })
+        .flatten()
+        .filter(|entry| entry.depth() > 0 && entry.file_type().is_dir())
+        .map(|entry| {
+            let relative = entry.path().strip_prefix(src).unwrap_or(entry.path());
+            (cs_core::paths::to_slash(relative), entry.into_path())
+        })
+        .collect()
+}
+
+fn is_exported(name: &str) -> bool {
+    name.chars().next().is_some_and(char::is_uppercase)
+}
+
+/// The name a `func` or `type` line declares, with the receiver's type for a
+/// method: `Parse`, `Time.Format`.
+fn declared_name(line: &str) -> Option<String> {
+    let ident = |s: &str| -> String {
+        s.chars()
+            .take_while(|c| c.is_alphanumeric() || *c == '_')
+            .collect()
+    };
+    if let Some(rest) = line.strip_prefix("type ") {
+        return Some(ident(rest));
+    }
+    let rest = line.strip_prefix("func ")?;
+    let Some(receiver) = rest.strip_prefix('(') else {
+        return Some(ident(rest));
+    };
+    let (receiver, rest) = receiver.split_once(')')?;
+    // `t Time`, `r *Reader`, `s *Set[T]` or just `Time`
+    let receiver_type = receiver.split_whitespace().last()?.trim_start_matches('*');
+    Some(format!(
+        "{}.{}",
+        ident(receiver_type),
+        ident(rest.trim_start())
+    ))
+}
+
+/// The signature of the function declared from `lines[0]`, without its body,
+/// and how many lines it spans.
+fn signature(lines: &[&str]) -> (String, usize) {
+    let mut depth = 0i32;
+    let mut signature = String::new();
+    for (i, line) in lines.iter().enumerate() {
+        for (at, c) in line.char_indices() {
+            match c {
+                '(' | '[' => depth += 1,
+                ')' | ']' => depth -= 1,
+                '{' if depth == 0 => {
+                    signature.push_str(line[..at].trim_end());
+                    return (signature, i + 1);
+                }
+                _ => {}
+            }
+        }
+        signature.push_str(line);
+        // A function implemented in assembly has no body
+        if depth <= 0 {
+            return (signature, i + 1);
+        }
+        signature.push('\n');
+    }
+    (signature, lines.len())
+}
+
+/// The type declared from `lines[0]`, its fields or methods included, and
+/// how many lines it spans.
+fn type_declaration(lines: &[&str]) -> (String, usize) {
+    if !lines[0].ends_with('{') {
+        return (lines[0].to_string(), 1);
+    }
+    let end = lines
+        .iter()
+        .position(|line| *line == "}")
+        .unwrap_or(lines.len() - 1);
+    let mut shown: Vec<&str> = lines[..=end].to_vec();
+    if shown.len() > MAX_TYPE_LINES {
+        shown.truncate(MAX_TYPE_LINES - 1);
+        shown.extend(["\t// ...", "}"]);
+    }
+    (shown.join("\n"), end + 1)
+}
+
+/// The exported API of one Go source file.
+#[derive(Debug, Default)]
+struct FileApi {
+    /// The package comment, if this file has it
+    package_doc: Option<String>,
+    /// Name and text of each exported declaration, in order
+    declarations: Vec<(String, String)>,
+}
+
+/// The exported API of one Go source file, `None` for files that aren't part
+/// of an importable package.
+fn exported_api(source: &str) -> Option<FileApi> {
+    let lines: Vec<&str> = source.lines().collect();
+    let mut package_doc = None;
+    let mut declarations = Vec::new();
+    // The comment lines right above the current line
+    let mut doc: Vec<&str> = Vec::new();
+    let mut i = 0;
+    while i < lines.len() {
+        let line = lines[i];
+        if line.starts_with("//go:build ignore") {
+            return None;
+        }
+        if line.starts_with("//") {
+            doc.push(line);
+            i += 1;
+            continue;
+        }
+        if let Some(package) = line.strip_prefix("package ") {
+            if matches!(package.trim(), "main" | "documentation") {
+                return None;
+            }
+            if doc
+                .first()
+                .is_some_and(|first| first.starts_with("// Package "))
+            {
+                package_doc = Some(doc.join("\n"));
+            }
+        } else if line.starts_with("func ") || line.starts_with("type ") {
+            let (text, spans) = if line.starts_with("func ") {
+                signature(&lines[i..])
+            } else {
+                type_declaration(&lines[i..])
+            };
+            if let Some(name) = declared_name(line)
+                && name.split('.').all(is_exported)
+            {
+                let mut declaration = doc.join("\n");
+                if !declaration.is_empty() {
+                    declaration.push('\n');
+                }
+                declaration.push_str(&text);
+                declarations.push((name, declaration));
+            }
+            i += spans;
+            doc.clear();
+            continue;
+        }
+        doc.clear();
+        i += 1;
+    }
+    Some(FileApi {
+        package_doc,
+        declarations,
+    })
+}
+
+/// The document of the package `import_path` in `dir`, if it exports
+/// anything: its package comment, then its exported declarations file by
+/// file.
+fn package_document(import_path: &str, dir: &Path) -> Option<Document> {
+    let mut files: Vec<PathBuf> = fs::read_dir(dir)
+        .ok()?
+        .flatten()
+        .map(|entry| entry.path())
+        .filter(|path| {
+            path.extension().is_some_and(|ext| ext == "go")
+                && !path.to_string_lossy().ends_with("_test.go")
+        })
+        .collect();
+    files.sort();
+
+    let mut package_doc = None;
+    let mut declarations = Vec::new();
+    // Files for other platforms declare the same names again
+    let mut seen = HashSet::new();
+    for file in files {
+        let Ok(source) = fs::read_to_string(&file) else {
+            continue;
+        };
+        let Some(api) = exported_api(&source) else {
+            continue;
+        };
+        package_doc = package_doc.or(api.package_doc);
+        declarations.extend(
+            api.declarations
+                .into_iter()
+                .filter(|(name, _)| seen.insert(name.clone()))
+                .map(|(_, text)| text),
+        );
+    }
+    if declarations.is_empty() {
+        return None;
+    }
+    let mut text = format!("package {}", import_path);
+    for part in package_doc.iter().chain(&declarations) {
+        text.push_str("\n\n");
+        text.push_str(part);
+    }
+    Some(Document {
+        source: import_path.to_string(),
+        url: Some(format!("{}/{}", PKG_GO_DEV, import_path)),
+        text,
+    })
+}
+
+/// The connector saved with the standard library collection.
+fn connector(goroot: &Path, version: &str) -> String {
+    format!("{}{}:{}", GOROOT_CONNECTOR, version, goroot.display())
+}
+
+/// Index the standard library of the Go installation at `goroot` (else the
+/// one [`goroot`] finds) into the collection `name` of the index at
+/// `repo_root`, unless it holds that Go version's already.
+pub fn index_stdlib(
+    repo_root: &Path,
+    name: &str,
+    goroot: Option<&Path>,
+    model: Option<&str>,
+) -> Result<StdlibStats> {
+    let Some(goroot) = goroot.map(Path::to_path_buf).or_else(self::goroot) else {
+        bail!("Can't find the Go installation; install Go or set GOROOT");
+    };
+    let src = goroot.join("src");
+    if !src.is_dir() {
+        bail!("No standard library sources in {}", src.display());
+    }
+    let version = go_version(&goroot);
+    let connector = connector(&goroot, &version);
+    let previous = collections::load_collection(repo_root, name)?;
+    let up_to_date = previous.as_ref().is_some_and(|previous| {
+        previous.connector.as_deref() == Some(connector.as_str())
+            && model.is_none_or(|model| previous.embedding_model.as_deref() == Some(model))
+    });
+
+    let mut stats = StdlibStats {
+        version,
+        ..Default::default()
+    };
+    if up_to_date {
+        stats.packages = previous.map_or(0, |previous| {
+            previous
+                .chunks
+                .iter()
+                .map(|chunk| chunk.source.as_str())
+                .collect::<HashSet<_>>()
+                .len()
+        });
+        return Ok(stats);
+    }
+    let documents: Vec<Document> = packages(&src)
+        .iter()
+        .filter_map(|(import_path, dir)| package_document(import_path, dir))
+        .collect();
+    stats.packages = documents.len();
+    stats.collection = Some(collections::index_collection_documents(
+        repo_root, name, &connector, &documents, model,
+    )?);
+    Ok(stats)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    const FORMAT_GO: &str = r#"// Copyright 2010 The Go Authors. All rights reserved.
+
+package time
+
+import "errors"
+
+// Parse parses a formatted string and returns the time value it represents.
+// See the documentation for the constant called Layout.
+func Parse(layout, value string) (Time, error) {
+	return parse(layout, value, UTC, Local)
+}
+
+// parse is the unexported worker.
+func parse(layout, value string, defaultLocation, local *Location) (Time, error) {
+	return Time{}, errors.New("no")
+}
+
+// Format returns a textual representation of the time value.
+func (t Time) Format(layout string) string { return "" }
+
+func (t *Time) setLoc(loc *Location) {}
+
+// A Month specifies a month of the year (January = 1, ...).
+type Month int
+
+// A Time represents an instant in time with nanosecond precision.
+type Time struct {
+	wall uint64
+	ext  int64
+}
+
+// Sqrt is implemented in assembly.
+func Sqrt(x float64,
+	y float64) float64
+"#;
+
+    #[test]
+    fn exported_declarations_keep_doc_comments_without_bodies() {
+        let FileApi {
+            package_doc,
+            declarations: api,
+        } = exported_api(FORMAT_GO).unwrap();
+        assert_eq!(package_doc, None);
+        let names: Vec<&str> = api.iter().map(|(name, _)| name.as_str()).collect();
+        assert_eq!(names, ["Parse", "Time.Format", "Month", "Time", "Sqrt"]);
+        assert_eq!(
+            api[0].1,
+            "// Parse parses a formatted string and returns the time value it represents.\n// See the documentation for the constant called Layout.\nfunc Parse(layout, value string) (Time, error)"
+        );
+        assert_eq!(
+            api[1].1,
+            "// Format returns a textual representation of the time value.\nfunc (t Time) Format(layout string) string"
+        );
+        assert!(
+            api[3]
+                .1
+                .ends_with("type Time struct {\n\twall uint64\n\text  int64\n}")
+        );
+        assert!(
+            api[4]
+                .1
+                .ends_with("func Sqrt(x float64,\n\ty float64) float64")
+        );
+
+        let doc_go = "// Package time provides functionality for measuring time.\npackage time\n";
+        assert_eq!(
+            exported_api(doc_go).unwrap().package_doc.as_deref(),
+            Some("// Package time provides functionality for measuring time.")
+        );
+        assert!(exported_api("//go:build ignore\n\npackage main\n").is_none());
+        assert!(exported_api("package main\n\nfunc Main() {}\n").is_none());
+        assert_eq!(
+            declared_name("func (s *Set[T]) Add(v T) {"),
+            Some("Set.Add".to_string())
+        );
+    }
+
+    #[test]
+    fn packages_exclude_commands_internals_and_tests() {
+        let goroot = TempDir::new().unwrap();
+        let src = goroot.path().join("src");
+        let write = |path: &str, text: &str| {
+            let path = src.join(path);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, text).unwrap();
+        };
+        write("time/format.go", FORMAT_GO);
+        write(
+            "time/format_test.go",
+            "package time\n\nfunc TestParse() {}\n",
+        );
+        write("time/testdata/x.go", "package x\n\nfunc X() {}\n");
+        write("internal/abi/abi.go", "package abi\n\nfunc ABI() {}\n");
+        write(
+            "net/http/internal/chunked.go",
+            "package internal\n\nfunc Chunk() {}\n",
+        );
+        write("cmd/go/main.go", "package main\n\nfunc main() {}\n");
+        write(
+            "unicode/utf8/utf8.go",
+            "package utf8\n\nfunc RuneLen(r rune) int {\n}\n",
+        );
+        write("errors/wrap.go", "package errors\n\nfunc unwrap() {}\n");
+
+        let names: Vec<String> = packages(&src).into_iter().map(|(name, _)| name).collect();
+        assert_eq!(
+            names,
+            [
+                "errors",
+                "net",
+                "net/http",
+                "time",
+                "unicode",
+                "unicode/utf8"
+            ]
+        );
+
+        let time = package_document("time", &src.join("time")).unwrap();
+        assert_eq!(time.url.as_deref(), Some("https://pkg.go.dev/time"));
+        assert!(time.text.starts_with("package time\n\n// Parse parses"));
+        assert!(!time.text.contains("TestParse"));
+        assert!(!time.text.contains("return parse"));
+        assert!(package_document("errors", &src.join("errors")).is_none());
+
+        assert_eq!(go_version(goroot.path()), "devel");
+        fs::write(goroot.path().join("VERSION"), "go1.22.3\ntime 2024-05-01\n").unwrap();
+        assert_eq!(go_version(goroot.path()), "go1.22.3");
+    }
+}
@@ -0,0 +1,550 @@
+//! Go interface-implementation map, recorded in `.cs/go_types.json` at index
+//! time.
+//!
+//! Each indexed `.go` file contributes its interfaces, type declarations and
+//! methods. A type implements an interface when its package declares methods
+//! with every name in the interface's method set (embedded interfaces are
+//! resolved within the repository). Signatures and methods promoted through
+//! struct embedding are not checked, so the map identifies candidates the
+//! way a reader skimming method lists would.
+
+use super::{IndexManifest, atomic_write, path_utils};
+use anyhow::Result;
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+pub const GO_TYPES_FILE: &str = "go_types.json";
+
+const GO_TYPES_VERSION: u32 = 1;
+
+static PACKAGE: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"^package\s+(\w+)").unwrap());
+
+static TYPE_SPEC: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"^(\w+)(?:\[[^\]]*\])?\s+(=\s*)?(.*)$").unwrap());
+
+static METHOD_DECL: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"^func\s+\(\s*(?:\w+\s+)?(\*)?\s*(\w+)(?:\[[^\]]*\])?\s*\)\s*(\w+)\s*[\[(]")
+        .unwrap()
+});
+
+static INTERFACE_METHOD: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"^(\w+)\s*[\[(]").unwrap());
+
+static EMBEDDED: LazyLock<Regex> = LazyLock::new(|| Regex::new(r"^([\w.]+)$").unwrap());
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct GoInterface {
+    pub name: String,
+    pub line: usize,
+    pub methods: Vec<String>,
+    pub embeds: Vec<String>,
+    /// Has type-set terms (`~int | ~string`), so it is only usable as a constraint
+    #[serde(default)]
+    pub constraint: bool,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct GoTypeDecl {
+    pub name: String,
+    pub line: usize,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct GoMethod {
+    pub receiver: String,
+    pub pointer: bool,
+    pub name: String,
+}
+
+/// Type facts of one Go source file.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct GoFileTypes {
+    pub hash: String,
+    pub package: String,
+    pub interfaces: Vec<GoInterface>,
+    pub types: Vec<GoTypeDecl>,
+    pub methods: Vec<GoMethod>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Implementation {
+    pub type_name: String,
+    pub interface: String,
+    /// Declaring file, relative to the repository root
+    pub file: PathBuf,
+    pub line: usize,
+    /// Some required methods have pointer receivers, so only `*T` implements it
+    pub pointer_receiver: bool,
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct GoTypeIndex {
+    pub version: u32,
+    /// Keyed by path relative to the repository root
+    pub files: BTreeMap<String, GoFileTypes>,
+}
+
+/// Extract interfaces, type declarations and methods from gofmt'd Go source.
+pub fn parse_go_types(content: &str) -> GoFileTypes {
+    let mut types = GoFileTypes::default();
+    let lines: Vec<&str> = content.lines().collect();
+    let mut in_group = false;
+    let mut i = 0;
+
+    while i < lines.len() {
+        let line = lines[i];
+        if types.package.is_empty()
+            && let Some(caps) = PACKAGE.captures(line)
+        {
+            types.package = caps[1].to_string();
+        }
+
+        if line.trim_end() == "type (" {
+            in_group = true;
+            i += 1;
+            continue;
+        }
+        if in_group && line.starts_with(')') {
+            in_group = false;
+            i += 1;
+            continue;
+        }
+
+        if let Some(caps) = METHOD_DECL.captures(line) {
+            types.methods.push(GoMethod {
+                receiver: caps[2].to_string(),
+                pointer: caps.get(1).is_some(),
+                name: caps[3].to_string(),
+            });
+            i += 1;
+            continue;
+        }
+
+        // `type Name ...` at the top level, or one tab deep within `type ( ... )`
+        let (spec, closing) = if let Some(spec) = line.strip_prefix("type ") {
+            (spec.trim_start(), "}")
+        } else if in_group && let Some(spec) = line.strip_prefix('\t') {
+            (spec, "\t}")
+        } else {
+            i += 1;
+            continue;
+        };
+        let Some(caps) = TYPE_SPEC.captures(spec) else {
+            i += 1;
+            continue;
+        };
+        let name = caps[1].to_string();
+        let definition = caps[3].trim_end();
+        let line_number = i + 1;
+
+        if caps.get(2).is_none() && definition.starts_with("interface") {
+            let mut interface = GoInterface {
+                name,
+                line: line_number,
+                ..Default::default()
+            };
+            if definition.ends_with('{') {
+                while i + 1 < lines.len() {
+                    i += 1;
+                    if lines[i].starts_with(closing) {
+                        break;
+                    }
+                    let member = lines[i].trim();
+                    if member.is_empty() || member.starts_with("//") {
+                        continue;
+                    }
+                    if member.contains('~') || member.contains('|') {
+                        interface.constraint = true;
+                    } else if let Some(method) = INTERFACE_METHOD.captures(member) {
+                        interface.methods.push(method[1].to_string());
+                    } else if let Some(embed) = EMBEDDED.captures(member) {
+                        interface.embeds.push(embed[1].to_string());
+                    }
+                }
+            }
+            types.interfaces.push(interface);
+        } else {
+            types.types.push(GoTypeDecl {
+                name,
+                line: line_number,
+            });
+            // Skip struct fields so they aren't mistaken for grouped specs
+            if definition.ends_with('{') {
+                while i + 1 < lines.len() {
+                    i += 1;
+                    if lines[i].starts_with(closing) {
+                        break;
+                    }
+                }
+            }
+        }
+        i += 1;
+    }
+    types
+}
+
+fn go_types_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(GO_TYPES_FILE)
+}
+
+/// The recorded map, or `None` if the repository has no Go type index.
+pub fn load_go_types(repo_root: &Path) -> Result<Option<GoTypeIndex>> {
+    let path = go_types_path(repo_root);
+    if !path.exists() {
+        return Ok(None);
+    }
+    let data = super::encryption::open_from(&path, fs::read(&path)?)?;
+    let index: GoTypeIndex = serde_json::from_slice(&data)?;
+    if index.version != GO_TYPES_VERSION {
+        return Ok(None);
+    }
+    Ok(Some(index))
+}
+
+/// Bring `.cs/go_types.json` in line with the manifest, re-parsing only Go
+/// files whose hash changed.
+pub fn update_go_types(repo_root: &Path, manifest: &IndexManifest) -> Result<()> {
+    let existing = load_go_types(repo_root).ok().flatten();
+    let had_index = existing.is_some();
+    let mut previous = existing.map(|index| index.files).unwrap_or_default();
+
+    let mut files = BTreeMap::new();
+    let mut changed = false;
+    for (manifest_key, metadata) in &manifest.files {
+        if manifest_key.extension().and_then(|e| e.to_str()) != Some("go") {
+            continue;
+        }
+        let key = cs_core::paths::to_slash(&path_utils::from_manifest_path(manifest_key));
+
+        if let Some(types) = previous.remove(&key)
+            && types.hash == metadata.hash
+        {
+            files.insert(key, types);
+            continue;
+        }
+
+        let Ok(content) = fs::read_to_string(repo_root.join(&relative)) else {
+            continue;
+        };
+        let mut types = parse_go_types(&content);
+        types.hash = metadata.hash.clone();
+        files.insert(key, types);
+        changed = true;
+    }
+    changed |= !previous.is_empty();
+
+    if !changed && (had_index || files.is_empty()) {
+        return Ok(());
+    }
+    let index = GoTypeIndex {
+        version: GO_TYPES_VERSION,
+        files,
+    };
+    let path = go_types_path(repo_root);
+    atomic_write(
+        &path,
+        &super::encryption::seal_for(&path, serde_json::to_vec(&index)?)?,
+    )
+}
+
+fn package_dir(file: &str) -> &str {
+    file.rsplit_once('/').map_or("", |(dir, _)| dir)
+}
+
+impl GoTypeIndex {
+    /// Interfaces named `name` (`UserService` or `users.UserService`), keyed
+    /// by package directory.
+    fn find_interfaces(&self, name: &str) -> Vec<(&str, &str, &GoInterface)> {
+        let (package, name) = match name.rsplit_once('.') {
+            Some((package, name)) => (Some(package), name),
+            None => (None, name),
+        };
+        self.files
+            .iter()
+            .filter(|(_, types)| package.is_none_or(|p| types.package == p))
+            .flat_map(|(file, types)| {
+                types
+                    .interfaces
+                    .iter()
+                    .filter(move |interface| interface.name == name)
+                    .map(move |interface| (package_dir(file), types.package.as_str(), interface))
+            })
+            .collect()
+    }
+
+    /// Every method name an interface requires, following embedded
+    /// interfaces declared in the repository.
+    fn method_set(&self, dir: &str, interface: &GoInterface) -> HashSet<String> {
+        let mut methods = HashSet::new();
+        let mut visited = HashSet::new();
+        self.collect_methods(dir, interface, &mut methods, &mut visited);
+        methods
+    }
+
+    fn collect_methods(
+        &self,
+        dir: &str,
+        interface: &GoInterface,
+        methods: &mut HashSet<String>,
+        visited: &mut HashSet<(String, String)>,
+    ) {
+        if !visited.insert((dir.to_string(), interface.name.clone())) {
+            return;
+        }
+        methods.extend(interface.methods.iter().cloned());
+        for embed in &interface.embeds {
+            let candidates = if embed.contains('.') {
+                self.find_interfaces(embed)
+            } else {
+                self.find_interfaces(embed)
+                    .into_iter()
+                    .filter(|(embed_dir, _, _)| *embed_dir == dir)
+                    .collect()
+            };
+            for (embed_dir, _, embedded) in candidates {
+                self.collect_methods(embed_dir, embedded, methods, visited);
+            }
+        }
+    }
+
+    /// `(package dir, type) -> methods` across the repository.
+    fn methods_by_type(&self) -> HashMap<(&str, &str), Vec<&GoMethod>> {
+        let mut methods: HashMap<(&str, &str), Vec<&GoMethod>> = HashMap::new();
+        for (file, types) in &self.files {
+            for method in &types.methods {
+                methods
+                    .entry((package_dir(file), method.receiver.as_str()))
+                    .or_default()
+                    .push(method);
+            }
+        }
+        methods
+    }
+
+    fn implementors(
+        &self,
+        required: &HashSet<String>,
+        methods: &HashMap<(&str, &str), Vec<&GoMethod>>,
+    ) -> Vec<(String, &GoTypeDecl, bool)> {
+        let mut found = Vec::new();
+        for (file, types) in &self.files {
+            for decl in &types.types {
+                let Some(declared) = methods.get(&(package_dir(file), decl.name.as_str())) else {
+                    continue;
+                };
+                let implemented = required
+                    .iter()
+                    .all(|name| declared.iter().any(|m| &m.name == name));
+                if implemented {
+                    let pointer = declared
+                        .iter()
+                        .any(|m| m.pointer && required.contains(&m.name));
+                    found.push((file.clone(), decl, pointer));
+                }
+            }
+        }
+        found
+    }
+
+    /// Types implementing the interface `name`, ordered by file and line.
+    pub fn implementations(&self, name: &str) -> Vec<Implementation> {
+        let methods = self.methods_by_type();
+        let mut implementations = Vec::new();
+        for (dir, package, interface) in self.find_interfaces(name) {
+            if interface.constraint {
+                continue;
+            }
+            let required = self.method_set(dir, interface);
+            // Everything implements an empty interface
+            if required.is_empty() {
+                continue;
+            }
+            for (file, decl, pointer_receiver) in self.implementors(&required, &methods) {
+                let interface_name = if package_dir(&file) == dir {
+                    interface.name.clone()
+                } else {
+                    format!("{}.{}", package, interface.name)
+                };
+                implementations.push(Implementation {
+                    type_name: decl.name.clone(),
+                    interface: interface_name,
+                    file: PathBuf::from(file),
+                    line: decl.line,
+                    pointer_receiver,
+                });
+            }
+        }
+        implementations.sort_by(|a, b| a.file.cmp(&b.file).then(a.line.cmp(&b.line)));
+        implementations
+    }
+
+    /// Interfaces implemented by the types declared in `file` (relative to the
+    /// repository root) between `line_start` and `line_end`.
+    pub fn implemented_by(&self, file: &Path, line_start: usize, line_end: usize) -> Vec<String> {
+        let key = cs_core::paths::to_relative_slash(file);
+        let Some(types) = self.files.get(&key) else {
+            return Vec::new();
+        };
+        let dir = package_dir(&key);
+        let declared: Vec<&str> = types
+            .types
+            .iter()
+            .filter(|decl| (line_start..=line_end).contains(&decl.line))
+            .map(|decl| decl.name.as_str())
+            .collect();
+        if declared.is_empty() {
+            return Vec::new();
+        }
+
+        let methods = self.methods_by_type();
+        let mut interfaces = Vec::new();
+        for (interface_file, interface_types) in &self.files {
+            let interface_dir = package_dir(interface_file);
+            for interface in &interface_types.interfaces {
+                if interface.constraint {
+                    continue;
+                }
+                let required = self.method_set(interface_dir, interface);
+                if required.is_empty() {
+                    continue;
+                }
+                let implemented = declared.iter().any(|name| {
+                    methods.get(&(dir, *name)).is_some_and(|declared| {
+                        required
+                            .iter()
+                            .all(|r| declared.iter().any(|m| &m.name == r))
+                    })
+                });
+                if implemented {
+                    interfaces.push(if interface_dir == dir {
+                        interface.name.clone()
+                    } else {
+                        format!("{}.{}", interface_types.package, interface.name)
+                    });
+                }
+            }
+        }
+        interfaces.sort();
+        interfaces.dedup();
+        interfaces
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::FileMetadata;
+    use tempfile::TempDir;
+
+    const SERVICE: &str = "package users
+
+type Reader interface {
+	Get(id string) (*User, error)
+}
+
+// UserService manages users.
+type UserService interface {
+	Reader
+	Create(u *User) error
+}
+
+type (
+	ID string
+
+	Number interface {
+		~int | ~int64
+	}
+)
+
+type User struct {
+	ID   ID
+	Name string
+}
+";
+
+    const MEMORY: &str = "package users
+
+type InMemoryUserService struct {
+	users map[string]*User
+}
+
+func (s *InMemoryUserService) Get(id string) (*User, error) {
+	return s.users[id], nil
+}
+
+func (s *InMemoryUserService) Create(u *User) error {
+	s.users[string(u.ID)] = u
+	return nil
+}
+
+type readOnly struct{}
+
+func (readOnly) Get(id string) (*User, error) { return nil, nil }
+";
+
+    #[test]
+    fn parses_interfaces_types_and_methods() {
+        let types = parse_go_types(SERVICE);
+        assert_eq!(types.package, "users");
+        let names: Vec<&str> = types.interfaces.iter().map(|i| i.name.as_str()).collect();
+        assert_eq!(names, ["Reader", "UserService", "Number"]);
+        assert_eq!(types.interfaces[1].methods, ["Create"]);
+        assert_eq!(types.interfaces[1].embeds, ["Reader"]);
+        assert!(types.interfaces[2].constraint);
+        let declared: Vec<&str> = types.types.iter().map(|t| t.name.as_str()).collect();
+        assert_eq!(declared, ["ID", "User"]);
+
+        let memory = parse_go_types(MEMORY);
+        assert_eq!(memory.methods.len(), 3);
+        assert!(memory.methods[0].pointer);
+        assert_eq!(memory.methods[2].receiver, "readOnly");
+        assert!(!memory.methods[2].pointer);
+    }
+
+    #[test]
+    fn maps_implementations_through_embedded_interfaces() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join("users")).unwrap();
+        fs::write(root.join("users/service.go"), SERVICE).unwrap();
+        fs::write(root.join("users/memory.go"), MEMORY).unwrap();
+
+        let mut manifest = IndexManifest::default();
+        for (name, hash) in [("users/service.go", "a"), ("users/memory.go", "b")] {
+            manifest.files.insert(
+                PathBuf::from(".").join(name),
+                FileMetadata {
+                    path: PathBuf::from(".").join(name),
+                    hash: hash.to_string(),
+                    last_modified: 0,
+                    size: 0,
+                },
+            );
+        }
+        update_go_types(root, &manifest).unwrap();
+        let index = load_go_types(root).unwrap().unwrap();
+
+        let impls = index.implementations("UserService");
+        assert_eq!(impls.len(), 1);
+        assert_eq!(impls[0].type_name, "InMemoryUserService");
+        assert_eq!(impls[0].file, PathBuf::from("users/memory.go"));
+        assert_eq!(impls[0].line, 3);
+        assert!(impls[0].pointer_receiver);
+
+        let readers: Vec<String> = index
+            .implementations("users.Reader")
+            .into_iter()
+            .map(|i| i.type_name)
+            .collect();
+        assert_eq!(readers, ["InMemoryUserService", "readOnly"]);
+
+        assert_eq!(
+            index.implemented_by(Path::new("./users/memory.go"), 1, 5),
+            ["Reader", "UserService"]
+        );
+        assert!(index.implementations("Number").is_empty());
+    }
+}
@@ -0,0 +1,537 @@
+//! Hot chunks: the chunks searches keep matching, embedded again with a
+//! better, costlier model while the rest of the index stays on its own.
+//!
+//! `cs --index --hot-model <MODEL>` writes `.cs/hot_chunks.json`. From then
+//! on searches note the chunks of their top results in
+//! `.cs/chunk_matches.json` as a heat: one per match, halving every
+//! [`HEAT_HALF_LIFE_DAYS`] days. Each `cs --index` embeds the chunks with at
+//! least `min_matches` of heat, the hottest `max_chunks` at most, with the
+//! hot model into `.cs/hot_vectors.bin`, and drops the vectors of chunks
+//! that cooled off or whose code changed. Spend follows what people search
+//! for, and moves with it. In an encrypted index the vectors are sealed like
+//! the sidecars they were embedded from.
+//!
+//! Searches still rank every chunk by the index's model; the hot chunks
+//! among the top candidates are then ordered by the hot model (see
+//! `cs_engine::hot_search`).
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::hash_map::Entry;
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{LazyLock, Mutex};
+use std::time::SystemTime;
+
+use super::{atomic_write, encryption, load_index_entry, secrets, shards};
+
+pub const HOT_CHUNKS_FILE: &str = "hot_chunks.json";
+
+pub const CHUNK_MATCHES_FILE: &str = "chunk_matches.json";
+
+pub const HOT_VECTORS_FILE: &str = "hot_vectors.bin";
+
+const FORMAT_VERSION: u32 = 1;
+
+/// Heat a chunk needs before it's embedded with the hot model, unless
+/// `--hot-min-matches` says otherwise.
+pub const DEFAULT_MIN_MATCHES: u32 = 3;
+
+/// Chunks embedded with the hot model at most, unless `--hot-max-chunks`
+/// says otherwise.
+pub const DEFAULT_MAX_CHUNKS: usize = 2000;
+
+/// Days after which a chunk no search matched has half its heat left.
+pub const HEAT_HALF_LIFE_DAYS: f64 = 14.0;
+
+/// Results of a search whose chunks count as matched.
+pub const MATCHED_RESULTS: usize = 10;
+
+/// Heat below which a chunk's entry is forgotten.
+const MIN_KEPT_HEAT: f64 = 0.05;
+
+/// Chunks embedded with the hot model in one call.
+const EMBED_BATCH: usize = 32;
+
+/// Hot models loaded by this process, by name; loading one is slow.
+static EMBEDDERS: LazyLock<Mutex<HashMap<String, Box<dyn cs_embed::Embedder>>>> =
+    LazyLock::new(|| Mutex::new(HashMap::new()));
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct HotSettings {
+    format_version: u32,
+    /// Model the hot chunks are embedded with
+    pub model: String,
+    pub min_matches: u32,
+    pub max_chunks: usize,
+    /// When the hot vectors last changed, which makes cached results stale
+    #[serde(default)]
+    pub refreshed: u64,
+}
+
+/// A chunk's share of recent matches.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+struct Heat {
+    heat: f64,
+    updated: u64,
+}
+
+impl Heat {
+    /// The heat left at `now`.
+    fn at(&self, now: u64) -> f64 {
+        let days = now.saturating_sub(self.updated) as f64 / 86_400.0;
+        self.heat * 0.5f64.powf(days / HEAT_HALF_LIFE_DAYS)
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct HotVector {
+    /// Of the chunk's vector from the index's model, which changes with its
+    /// code
+    fingerprint: u64,
+    embedding: Vec<f32>,
+}
+
+/// The hot model's vectors of the hot chunks, by [`chunk_key`].
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct HotVectors {
+    pub model: String,
+    vectors: HashMap<String, HotVector>,
+}
+
+impl HotVectors {
+    /// The hot model's vector of the chunk `key` whose vector from the
+    /// index's model is `embedding`, unless its code changed since.
+    pub fn get(&self, key: &str, embedding: &[f32]) -> Option<&[f32]> {
+        self.vectors
+            .get(key)
+            .filter(|vector| vector.fingerprint == fingerprint(embedding))
+            .map(|vector| vector.embedding.as_slice())
+    }
+
+    pub fn len(&self) -> usize {
+        self.vectors.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.vectors.is_empty()
+    }
+}
+
+#[derive(Debug, Default)]
+pub struct HotRefresh {
+    pub model: String,
+    /// Chunks the hot model has vectors of now
+    pub hot: usize,
+    pub embedded: usize,
+    /// Hot before and still, with their code unchanged
+    pub unchanged: usize,
+    /// Cooled off or changed
+    pub dropped: usize,
+}
+
+fn settings_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(HOT_CHUNKS_FILE)
+}
+
+fn matches_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(CHUNK_MATCHES_FILE)
+}
+
+fn vectors_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(HOT_VECTORS_FILE)
+}
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+/// The hot chunk settings of the index at `index_root`, if it has a hot model.
+pub fn settings(index_root: &Path) -> Option<HotSettings> {
+    let data = fs::read(settings_path(index_root)).ok()?;
+    serde_json::from_slice(&data).ok()
+}
+
+pub fn is_enabled(index_root: &Path) -> bool {
+    settings_path(index_root).exists()
+}
+
+fn save_settings(index_root: &Path, settings: &HotSettings) -> Result<()> {
+    atomic_write(
+        &settings_path(index_root),
+        &serde_json::to_vec_pretty(settings)?,
+    )
+}
+
+/// Embed the hot chunks of the index at `index_root` with `model` from the
+/// next refresh on. Heat already recorded is kept.
+pub fn enable(index_root: &Path, model: &str, min_matches: u32, max_chunks: usize) -> Result<()> {
+    super::bundle::ensure_writable(index_root)?;
+    save_settings(
+        index_root,
+        &HotSettings {
+            format_version: FORMAT_VERSION,
+            model: model.to_string(),
+            min_matches: min_matches.max(1),
+            max_chunks,
+            refreshed: now(),
+        },
+    )
+}
+
+/// Stop embedding hot chunks, dropping their vectors and heat. Whether the
+/// index had a hot model.
+pub fn disable(index_root: &Path) -> Result<bool> {
+    let enabled = is_enabled(index_root);
+    for path in [
+        settings_path(index_root),
+        matches_path(index_root),
+        vectors_path(index_root),
+    ] {
+        match fs::remove_file(&path) {
+            Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+                return Err(e).with_context(|| format!("Failed to remove {}", path.display()));
+            }
+            _ => {}
+        }
+    }
+    Ok(enabled)
+}
+
+/// The key of the chunk of `relative` (with `/` separators) at `span`.
+pub fn chunk_key(relative: &str, span: &cs_core::Span) -> String {
+    format!("{}:{}-{}", relative, span.line_start, span.line_end)
+}
+
+/// The file and lines of a [`chunk_key`].
+fn parse_key(key: &str) -> Option<(&str, usize, usize)> {
+    let (file, lines) = key.rsplit_once(':')?;
+    let (start, end) = lines.split_once('-')?;
+    Some((file, start.parse().ok()?, end.parse().ok()?))
+}
+
+fn fingerprint(embedding: &[f32]) -> u64 {
+    let mut hasher = blake3::Hasher::new();
+    for value in embedding {
+        hasher.update(&value.to_le_bytes());
+    }
+    let hash = hasher.finalize();
+    u64::from_le_bytes(hash.as_bytes()[..8].try_into().unwrap_or_default())
+}
+
+fn load_heat(index_root: &Path) -> BTreeMap<String, Heat> {
+    fs::read(matches_path(index_root))
+        .ok()
+        .and_then(|data| serde_json::from_slice(&data).ok())
+        .unwrap_or_default()
+}
+
+/// Note that a search of the index at `index_root` matched `hits`, each a
+/// file and the span of its code.
+pub fn record_matches<'a>(
+    index_root: &Path,
+    hits: impl Iterator<Item = (&'a Path, &'a cs_core::Span)>,
+) -> Result<()> {
+    let root = cs_core::paths::canonicalize_lossy(index_root);
+    let mut heat = load_heat(index_root);
+    let now = now();
+    let mut changed = false;
+    for (file, span) in hits {
+        let file = cs_core::paths::canonicalize_lossy(file);
+        let Ok(relative) = file.strip_prefix(&root) else {
+            continue;
+        };
+        let key = chunk_key(&cs_core::paths::to_slash(relative), span);
+        let entry = heat.entry(key).or_insert(Heat {
+            heat: 0.0,
+            updated: now,
+        });
+        *entry = Heat {
+            heat: entry.at(now) + 1.0,
+            updated: now,
+        };
+        changed = true;
+    }
+    if !changed {
+        return Ok(());
+    }
+    atomic_write(&matches_path(index_root), &serde_json::to_vec(&heat)?)
+}
+
+/// The hot model's vectors for the index at `index_root`, if it has any.
+pub fn load_vectors(index_root: &Path) -> Option<HotVectors> {
+    let path = vectors_path(index_root);
+    let data = encryption::open_from(&path, fs::read(&path).ok()?).ok()?;
+    bincode::deserialize(&data).ok()
+}
+
+/// Run `f` with the embedder of `model`, loading it on first use.
+fn with_embedder<T>(
+    model: &str,
+    f: impl FnOnce(&mut dyn cs_embed::Embedder) -> Result<T>,
+) -> Result<T> {
+    let mut embedders = EMBEDDERS.lock().unwrap_or_else(|e| e.into_inner());
+    let embedder = match embedders.entry(model.to_string()) {
+        Entry::Occupied(entry) => entry.into_mut(),
+        Entry::Vacant(entry) => entry.insert(cs_embed::create_embedder(Some(model))?),
+    };
+    f(embedder.as_mut())
+}
+
+/// Embed `query` with the hot `model` of the index at `index_root`.
+pub fn embed_query(index_root: &Path, model: &str, query: &str) -> Result<Vec<f32>> {
+    with_embedder(model, |embedder| {
+        let query = super::redaction::prepare_query(&*embedder, index_root, query)?;
+        embedder
+            .embed(&[query])?
+            .pop()
+            .ok_or_else(|| anyhow::anyhow!("Hot model {} returned no query vector", model))
+    })
+}
+
+/// A chunk the hot model should have a vector of.
+struct Target {
+    key: String,
+    fingerprint: u64,
+    file: PathBuf,
+    span: cs_core::Span,
+    text: String,
+}
+
+/// The chunks at the `hottest` keys, at most `max_chunks`: each key's chunk,
+/// or the sections of the declaration a folded result covered.
+fn hot_targets(index_root: &Path, hottest: &[&str], max_chunks: usize) -> Vec<Target> {
+    let mut targets = Vec::new();
+    let mut seen = HashSet::new();
+    let mut files = HashMap::new();
+    for key in hottest {
+        if targets.len() >= max_chunks {
+            break;
+        }
+        let Some((relative, line_start, line_end)) = parse_key(key) else {
+            continue;
+        };
+        let file = files.entry(relative.to_string()).or_insert_with(|| {
+            let sidecar = shards::sidecar_path(index_root, Path::new(relative));
+            let entry = load_index_entry(&sidecar).ok()?;
+            let content = cs_core::text::read_text(&index_root.join(relative)).ok()?;
+            Some((entry, content))
+        });
+        let Some((entry, content)) = file else {
+            continue;
+        };
+        for chunk in &entry.chunks {
+            let Some(embedding) = chunk.embedding.as_deref() else {
+                continue;
+            };
+            if chunk.span.line_start < line_start || chunk.span.line_end > line_end {
+                continue;
+            }
+            let key = chunk_key(relative, &chunk.span);
+            let Some(text) = content.get(chunk.span.byte_start..chunk.span.byte_end) else {
+                continue;
+            };
+            if targets.len() < max_chunks && seen.insert(key.clone()) {
+                targets.push(Target {
+                    key,
+                    fingerprint: fingerprint(embedding),
+                    file: index_root.join(relative),
+                    span: chunk.span.clone(),
+                    text: text.to_string(),
+                });
+            }
+        }
+    }
+    targets
+}
+
+/// Bring the hot model's vectors of the index at `index_root` in line with
+/// the heat searches recorded. `None` when it has no hot model.
+pub fn refresh(index_root: &Path) -> Result<Option<HotRefresh>> {
+    let Some(mut settings) = settings(index_root) else {
+        return Ok(None);
+    };
+    let now = now();
+    let mut heat = load_heat(index_root);
+    let recorded = heat.len();
+    heat.retain(|_, heat| heat.at(now) >= MIN_KEPT_HEAT);
+    if heat.len() != recorded {
+        atomic_write(&matches_path(index_root), &serde_json::to_vec(&heat)?)?;
+    }
+
+    let mut hottest: Vec<(&str, f64)> = heat
+        .iter()
+        .map(|(key, heat)| (key.as_str(), heat.at(now)))
+        .filter(|(_, heat)| *heat >= f64::from(settings.min_matches))
+        .collect();
+    hottest.sort_by(|a, b| b.1.total_cmp(&a.1).then_with(|| a.0.cmp(b.0)));
+    let hottest: Vec<&str> = hottest.into_iter().map(|(key, _)| key).collect();
+    let targets = hot_targets(index_root, &hottest, settings.max_chunks);
+
+    // Vectors of another hot model can't be compared with this one's
+    let mut previous = load_vectors(index_root)
+        .filter(|vectors| vectors.model == settings.model)
+        .unwrap_or_default();
+    let model_changed = previous.model != settings.model;
+    let mut refresh = HotRefresh {
+        model: settings.model.clone(),
+        ..Default::default()
+    };
+    let mut vectors = HashMap::new();
+    let mut to_embed = Vec::new();
+    for target in targets {
+        match previous.vectors.remove(&target.key) {
+            Some(vector) if vector.fingerprint == target.fingerprint => {
+                vectors.insert(target.key, vector);
+                refresh.unchanged += 1;
+            }
+            _ => to_embed.push(target),
+        }
+    }
+    refresh.dropped = previous.vectors.len();
+
+    if !to_embed.is_empty() {
+        with_embedder(&settings.model, |embedder| {
+            for batch in to_embed.chunks(EMBED_BATCH) {
+                let mut embedded = Vec::new();
+                let mut texts = Vec::new();
+                for target in batch {
+                    if let Some(text) = secrets::screen_chunk(
+                        &*embedder,
+                        index_root,
+                        &target.file,
+                        &target.text,
+                        &target.span,
+                    )? {
+                        embedded.push(target);
+                        texts.push(text);
+                    }
+                }
+                if texts.is_empty() {
+                    continue;
+                }
+                let embeddings = embedder.embed(&texts)?;
+                if embeddings.len() != texts.len() {
+                    return Err(anyhow::anyhow!(
+                        "Hot model {} returned {} embeddings for {} chunks",
+                        settings.model,
+                        embeddings.len(),
+                        texts.len()
+                    ));
+                }
+                for (target, embedding) in embedded.into_iter().zip(embeddings) {
+                    vectors.insert(
+                        target.key.clone(),
+                        HotVector {
+                            fingerprint: target.fingerprint,
+                            embedding,
+                        },
+                    );
+                    refresh.embedded += 1;
+                }
+            }
+            Ok(())
+        })?;
+    }
+
+    refresh.hot = vectors.len();
+    if refresh.embedded > 0 || refresh.dropped > 0 || model_changed {
+        let vectors = HotVectors {
+            model: settings.model.clone(),
+            vectors,
+        };
+        let path = vectors_path(index_root);
+        atomic_write(
+            &path,
+            &encryption::seal_for(&path, bincode::serialize(&vectors)?)?,
+        )?;
+        settings.refreshed = now;
+        save_settings(index_root, &settings)?;
+    }
+    Ok(Some(refresh))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn heat_halves_without_matches() {
+        let heat = Heat {
+            heat: 4.0,
+            updated: 1_000,
+        };
+        assert_eq!(heat.at(1_000), 4.0);
+        let half_life = (HEAT_HALF_LIFE_DAYS * 86_400.0) as u64;
+        assert!((heat.at(1_000 + half_life) - 2.0).abs() < 1e-9);
+        assert!((heat.at(1_000 + 2 * half_life) - 1.0).abs() < 1e-9);
+        // A clock that went back doesn't heat anything up
+        assert_eq!(heat.at(0), 4.0);
+    }
+
+    #[test]
+    fn matches_heat_chunks_and_keys_roundtrip() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        fs::create_dir_all(cs_core::locations::index_dir(root)).unwrap();
+        let file = root.join("src/auth.rs");
+        let span = cs_core::Span {
+            byte_start: 0,
+            byte_end: 10,
+            line_start: 3,
+            line_end: 9,
+        };
+        let outside = PathBuf::from("/elsewhere/lib.rs");
+        for _ in 0..3 {
+            record_matches(
+                root,
+                [(file.as_path(), &span), (outside.as_path(), &span)].into_iter(),
+            )
+            .unwrap();
+        }
+        let heat = load_heat(root);
+        assert_eq!(heat.len(), 1);
+        let recorded = heat["src/auth.rs:3-9"];
+        assert!((recorded.heat - 3.0).abs() < 1e-6);
+
+        assert_eq!(chunk_key("src/auth.rs", &span), "src/auth.rs:3-9");
+        assert_eq!(parse_key("src/a:b.rs:3-9"), Some(("src/a:b.rs", 3, 9)));
+        assert_eq!(parse_key("src/auth.rs"), None);
+    }
+
+    #[test]
+    fn hot_vectors_go_stale_with_their_code() {
+        let embedding = vec![0.25, 0.5, 0.25];
+        let mut vectors = HotVectors {
+            model: "jina-code".to_string(),
+            vectors: HashMap::new(),
+        };
+        vectors.vectors.insert(
+            "src/auth.rs:3-9".to_string(),
+            HotVector {
+                fingerprint: fingerprint(&embedding),
+                embedding: vec![1.0, 0.0],
+            },
+        );
+        assert_eq!(
+            vectors.get("src/auth.rs:3-9", &embedding),
+            Some([1.0, 0.0].as_slice())
+        );
+        assert_eq!(vectors.get("src/auth.rs:3-9", &[0.25, 0.5, 0.3]), None);
+        assert_eq!(vectors.get("src/auth.rs:1-2", &embedding), None);
+
+        let dir = TempDir::new().unwrap();
+        assert!(refresh(dir.path()).unwrap().is_none());
+        fs::create_dir_all(cs_core::locations::index_dir(dir.path())).unwrap();
+        enable(dir.path(), "jina-code", 0, 10).unwrap();
+        assert_eq!(settings(dir.path()).unwrap().min_matches, 1);
+        assert!(disable(dir.path()).unwrap());
+        assert!(!is_enabled(dir.path()));
+        assert!(!disable(dir.path()).unwrap());
+    }
+}
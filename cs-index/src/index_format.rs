@@ -0,0 +1,357 @@
+//! Versions of the on-disk index format, and the upgrades between them.
+//!
+//! The manifest's `version` records the format an index was written in;
+//! indexes from before it did say `0.1.0` and are format 1. An index of an
+//! older format is upgraded in place the next time it's searched or updated
+//! when every step since allows that. Otherwise opening it fails with what
+//! changed and the command that rebuilds it, and an index written by a newer
+//! cs is refused rather than misread.
+//!
+//! A change to the manifest or the sidecars that older builds can't read,
+//! or that this build can't read from older indexes, adds a [`Step`].
+
+use anyhow::Result;
+use cs_core::context::{Operation, OperationContext};
+use std::fs;
+use std::path::Path;
+
+use super::{
+    IndexManifest, bundle, load_index_entry, load_or_create_manifest, path_utils, save_manifest,
+    shards,
+};
+
+/// Format of the indexes this build writes.
+pub const INDEX_FORMAT_VERSION: u32 = 5;
+
+/// What manifests said before the format was recorded.
+const LEGACY_VERSION: &str = "0.1.0";
+
+/// What brings an index from the version before `to` up to `to`.
+struct Step {
+    to: u32,
+    change: &'static str,
+    /// Upgrades one index directory of the repository in place, returning
+    /// how many of its files the next update re-embeds; `None` when only a
+    /// rebuild will do
+    upgrade: Option<fn(&Path, &Path, &mut IndexManifest) -> Result<usize>>,
+}
+
+const STEPS: &[Step] = &[
+    Step {
+        to: 2,
+        change: "the manifest records its format, and files whose sidecars don't load are re-embedded instead of skipped",
+        upgrade: Some(drop_unreadable_sidecars),
+    },
+    Step {
+        to: 3,
+        change: "chunks store function signatures and their embeddings",
+        upgrade: Some(drop_unreadable_sidecars),
+    },
+    Step {
+        to: 4,
+        change: "chunks store the intent tags they're about",
+        upgrade: Some(drop_unreadable_sidecars),
+    },
+    Step {
+        to: 5,
+        change: "chunk offsets are into text decoded to UTF-8 with LF line endings",
+        upgrade: Some(drop_normalized_files),
+    },
+];
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum FormatStatus {
+    Current,
+    /// Older, and every step since upgrades in place
+    Upgradable {
+        from: u32,
+    },
+    /// Older, and a step since needs the index rebuilt
+    NeedsRebuild {
+        from: u32,
+        changes: Vec<&'static str>,
+    },
+    /// Written by a newer cs
+    Newer {
+        found: u32,
+    },
+    Unknown {
+        found: String,
+    },
+}
+
+/// Upgrades applied to one index directory.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Upgrade {
+    pub from: u32,
+    pub to: u32,
+    /// Files dropped from the manifest so the next update re-embeds them
+    pub files_to_reindex: usize,
+}
+
+/// The format a manifest's `version` names, if it names one.
+pub fn format_of(version: &str) -> Option<u32> {
+    if version == LEGACY_VERSION {
+        return Some(1);
+    }
+    version.parse().ok()
+}
+
+pub fn status(version: &str) -> FormatStatus {
+    status_with(version, INDEX_FORMAT_VERSION, STEPS)
+}
+
+fn status_with(version: &str, current: u32, steps: &[Step]) -> FormatStatus {
+    let Some(found) = format_of(version) else {
+        return FormatStatus::Unknown {
+            found: version.to_string(),
+        };
+    };
+    if found == current {
+        return FormatStatus::Current;
+    }
+    if found > current {
+        return FormatStatus::Newer { found };
+    }
+    let since: Vec<&Step> = steps.iter().filter(|step| step.to > found).collect();
+    if since.iter().all(|step| step.upgrade.is_some()) {
+        FormatStatus::Upgradable { from: found }
+    } else {
+        FormatStatus::NeedsRebuild {
+            from: found,
+            changes: since
+                .iter()
+                .filter(|step| step.upgrade.is_none())
+                .map(|step| step.change)
+                .collect(),
+        }
+    }
+}
+
+/// Fail with what to do when an index of format `version` can't be read
+/// by this build, even after upgrading it.
+pub fn check(version: &str) -> Result<()> {
+    let rebuild = "cs --clean <path> && cs --index <path>";
+    match status(version) {
+        FormatStatus::Current | FormatStatus::Upgradable { .. } => Ok(()),
+        FormatStatus::NeedsRebuild { from, changes } => Err(anyhow::anyhow!(
+            "The index is in format v{} and this cs reads v{}; since v{}, {}. It can't be upgraded in place: rebuild it with '{}'.",
+            from,
+            INDEX_FORMAT_VERSION,
+            from,
+            changes.join("; "),
+            rebuild
+        )),
+        FormatStatus::Newer { found } => Err(anyhow::anyhow!(
+            "The index was written by a newer cs (index format v{}; this one reads up to v{}). Upgrade cs, or rebuild the index with '{}'.",
+            found,
+            INDEX_FORMAT_VERSION,
+            rebuild
+        )),
+        FormatStatus::Unknown { found } => Err(anyhow::anyhow!(
+            "The index manifest names an unknown format '{}'. Rebuild the index with '{}'.",
+            found,
+            rebuild
+        )),
+    }
+}
+
+/// Upgrade the index at `repo_root`, and each of its shards, to the current
+/// format where it's older and upgradable. Sealed indexes are left alone.
+pub fn upgrade(repo_root: &Path) -> Result<Vec<Upgrade>> {
+    upgrade_with_context(repo_root, &OperationContext::default())
+}
+
+/// [`upgrade`], reporting each index directory to `ctx` before upgrading it
+/// and stopping between them once it's cancelled. Each directory is
+/// upgraded completely or not at all.
+pub fn upgrade_with_context(repo_root: &Path, ctx: &OperationContext) -> Result<Vec<Upgrade>> {
+    if bundle::is_sealed(repo_root) {
+        return Ok(Vec::new());
+    }
+    let mut dirs = vec![cs_core::locations::index_dir(repo_root)];
+    dirs.extend(
+        shards::list_shards(repo_root)?
+            .into_iter()
+            .map(|shard| shard.dir),
+    );
+    let mut upgrades = Vec::new();
+    for (done, dir) in dirs.iter().enumerate() {
+        ctx.check()?;
+        ctx.report(
+            Operation::Migrate,
+            done,
+            dirs.len(),
+            Some(dir.display().to_string()),
+        );
+        if let Some(upgrade) = upgrade_dir(dir, repo_root)? {
+            upgrades.push(upgrade);
+        }
+    }
+    Ok(upgrades)
+}
+
+fn upgrade_dir(index_dir: &Path, repo_root: &Path) -> Result<Option<Upgrade>> {
+    let manifest_path = index_dir.join("manifest.json");
+    if !manifest_path.is_file() {
+        return Ok(None);
+    }
+    let mut manifest = load_or_create_manifest(&manifest_path)?;
+    let FormatStatus::Upgradable { from } = status(&manifest.version) else {
+        return Ok(None);
+    };
+    let _span = tracing::info_span!("upgrade_index", from, to = INDEX_FORMAT_VERSION).entered();
+    let mut files_to_reindex = 0;
+    for step in STEPS.iter().filter(|step| step.to > from) {
+        if let Some(upgrade) = step.upgrade {
+            files_to_reindex += upgrade(index_dir, repo_root, &mut manifest)?;
+        }
+    }
+    manifest.version = INDEX_FORMAT_VERSION.to_string();
+    save_manifest(&manifest_path, &manifest)?;
+    Ok(Some(Upgrade {
+        from,
+        to: INDEX_FORMAT_VERSION,
+        files_to_reindex,
+    }))
+}
+
+/// v2: sidecars are decoded by position, so ones written with fewer chunk
+/// fields than this build has don't load, and searches skipped their files.
+/// Dropping those files from the manifest makes the next update re-embed
+/// them. v3 and v4 added chunk fields, which older sidecars don't load for
+/// the same reason.
+fn drop_unreadable_sidecars(
+    index_dir: &Path,
+    _repo_root: &Path,
+    manifest: &mut IndexManifest,
+) -> Result<usize> {
+    let before = manifest.files.len();
+    manifest.files.retain(|key, _| {
+        let sidecar = path_utils::get_sidecar_path_for_standard_path(
+            index_dir,
+            &path_utils::from_manifest_path(key),
+        );
+        let readable = load_index_entry(&sidecar).is_ok();
+        if !readable {
+            let _ = fs::remove_file(&sidecar);
+        }
+        readable
+    });
+    Ok(before - manifest.files.len())
+}
+
+/// v5: files are decoded and their line endings normalized before chunking
+/// (see `cs_core::text`), and chunk byte offsets are into that text. The
+/// sidecars of files with a byte order mark, CRLF line endings or another
+/// encoding than UTF-8 have offsets into the raw bytes, so those files are
+/// re-embedded.
+fn drop_normalized_files(
+    index_dir: &Path,
+    repo_root: &Path,
+    manifest: &mut IndexManifest,
+) -> Result<usize> {
+    let before = manifest.files.len();
+    manifest.files.retain(|key, _| {
+        let standard_path = path_utils::from_manifest_path(key);
+        let file = repo_root.join(&standard_path);
+        // A PDF's text is extracted into a cache, which is UTF-8 already
+        let verbatim = cs_core::pdf::is_pdf_file(&file)
+            || fs::read(&file).map_or(true, |bytes| cs_core::text::decode(&bytes).is_verbatim());
+        if !verbatim {
+            let _ = fs::remove_file(path_utils::get_sidecar_path_for_standard_path(
+                index_dir,
+                &standard_path,
+            ));
+        }
+        verbatim
+    });
+    Ok(before - manifest.files.len())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn versions_map_to_formats() {
+        assert_eq!(format_of("0.1.0"), Some(1));
+        assert_eq!(format_of("2"), Some(2));
+        assert_eq!(format_of("next"), None);
+        assert_eq!(
+            status(&INDEX_FORMAT_VERSION.to_string()),
+            FormatStatus::Current
+        );
+        assert_eq!(
+            status(&(INDEX_FORMAT_VERSION + 1).to_string()),
+            FormatStatus::Newer {
+                found: INDEX_FORMAT_VERSION + 1
+            }
+        );
+        assert!(check("99").unwrap_err().to_string().contains("newer cs"));
+        assert!(check("0.1.0").is_ok());
+    }
+
+    #[test]
+    fn a_step_without_an_upgrade_asks_for_a_rebuild() {
+        let steps = [
+            Step {
+                to: 2,
+                change: "in place",
+                upgrade: Some(|_, _, _| Ok(0)),
+            },
+            Step {
+                to: 3,
+                change: "chunks are split differently",
+                upgrade: None,
+            },
+        ];
+        assert_eq!(
+            status_with("0.1.0", 3, &steps),
+            FormatStatus::NeedsRebuild {
+                from: 1,
+                changes: vec!["chunks are split differently"]
+            }
+        );
+        assert_eq!(
+            status_with("0.1.0", 2, &steps[..1]),
+            FormatStatus::Upgradable { from: 1 }
+        );
+    }
+
+    #[tokio::test]
+    async fn legacy_indexes_upgrade_in_place() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::write(root.join("kept.rs"), "fn kept() -> u32 {\n    1\n}\n").unwrap();
+        fs::write(root.join("stale.rs"), "fn stale() -> u32 {\n    2\n}\n").unwrap();
+        fs::write(root.join("crlf.rs"), "fn crlf() -> u32 {\r\n    3\r\n}\r\n").unwrap();
+        super::super::index_directory(root, false, true, &[], None)
+            .await
+            .unwrap();
+
+        let index_dir = cs_core::locations::index_dir(root);
+        let manifest_path = index_dir.join("manifest.json");
+        let mut manifest = load_or_create_manifest(&manifest_path).unwrap();
+        assert_eq!(manifest.version, INDEX_FORMAT_VERSION.to_string());
+        manifest.version = LEGACY_VERSION.to_string();
+        save_manifest(&manifest_path, &manifest).unwrap();
+        // A sidecar in a layout this build can't decode; crlf.rs an older
+        // build chunked from its raw bytes
+        fs::write(index_dir.join("stale.rs.cs"), b"\x01\x02").unwrap();
+
+        assert_eq!(
+            upgrade(root).unwrap(),
+            vec![Upgrade {
+                from: 1,
+                to: INDEX_FORMAT_VERSION,
+                files_to_reindex: 2
+            }]
+        );
+        let manifest = load_or_create_manifest(&manifest_path).unwrap();
+        assert_eq!(status(&manifest.version), FormatStatus::Current);
+        assert_eq!(manifest.files.len(), 1);
+        assert!(upgrade(root).unwrap().is_empty());
+    }
+}
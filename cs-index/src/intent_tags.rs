@@ -0,0 +1,246 @@
+//! Intent tags: descriptions of what code is for ("authentication",
+//! "billing", "feature flags") that every chunk is classified against at
+//! index time, so results show what they're about and `--tag billing` keeps
+//! only code about billing.
+//!
+//! Tags are `[[tag]]` tables in a `.cstags.toml` at the repository root:
+//!
+//! ```toml
+//! [[tag]]
+//! name = "billing"
+//! description = "invoices, payments, subscriptions and charging customers"
+//! # Similarity a chunk needs to carry the tag (default 0.5)
+//! threshold = 0.55
+//! ```
+//!
+//! Each description is embedded once per process with the index's model and
+//! compared with each chunk's embedding. A chunk carries the tags it's
+//! similar enough to, at most [`MAX_TAGS_PER_CHUNK`] of them, the closest
+//! first. Like extractor metadata, tags are recorded when a file is indexed,
+//! so a changed `.cstags.toml` takes effect as files change, or everywhere
+//! after `cs --clean . && cs --index .`.
+
+use anyhow::{Result, bail};
+use serde::Deserialize;
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+
+use super::{ChunkEntry, redaction};
+
+pub const TAGS_FILE: &str = ".cstags.toml";
+
+/// Similarity a chunk needs to a tag's description when the tag doesn't set
+/// its own threshold.
+pub const DEFAULT_TAG_THRESHOLD: f32 = 0.5;
+
+/// Tags kept per chunk, so a chunk close to many descriptions isn't tagged
+/// with all of them.
+pub const MAX_TAGS_PER_CHUNK: usize = 3;
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct IntentTag {
+    pub name: String,
+    pub description: String,
+    pub threshold: Option<f32>,
+}
+
+impl IntentTag {
+    fn threshold(&self) -> f32 {
+        self.threshold.unwrap_or(DEFAULT_TAG_THRESHOLD)
+    }
+
+    /// What's embedded for the tag: its name leads, as a heading would.
+    fn text(&self) -> String {
+        format!("{}: {}", self.name, self.description)
+    }
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct TagsFile {
+    #[serde(default)]
+    tag: Vec<IntentTag>,
+}
+
+static TAGS: LazyLock<Mutex<HashMap<PathBuf, Arc<Vec<IntentTag>>>>> =
+    LazyLock::new(|| Mutex::new(HashMap::new()));
+
+/// Description embeddings by repository and model, in the order of its tags.
+type TagEmbeddings = HashMap<(PathBuf, String), Arc<Vec<Vec<f32>>>>;
+
+static TAG_EMBEDDINGS: LazyLock<Mutex<TagEmbeddings>> =
+    LazyLock::new(|| Mutex::new(HashMap::new()));
+
+/// The tags configured for `repo_root`, read once per process.
+pub fn tags_for(repo_root: &Path) -> Result<Arc<Vec<IntentTag>>> {
+    let mut tags = TAGS.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(configured) = tags.get(repo_root) {
+        return Ok(configured.clone());
+    }
+    let path = repo_root.join(TAGS_FILE);
+    let configured = if path.exists() {
+        let file: TagsFile = toml::from_str(&fs::read_to_string(&path)?)
+            .map_err(|e| anyhow::anyhow!("Failed to parse {}: {}", path.display(), e))?;
+        validate(&file.tag).map_err(|e| anyhow::anyhow!("{} in {}", e, path.display()))?;
+        file.tag
+    } else {
+        Vec::new()
+    };
+    let configured = Arc::new(configured);
+    tags.insert(repo_root.to_path_buf(), configured.clone());
+    Ok(configured)
+}
+
+fn validate(tags: &[IntentTag]) -> Result<()> {
+    let mut names = HashSet::new();
+    for tag in tags {
+        if tag.name.trim().is_empty() || tag.description.trim().is_empty() {
+            bail!("A [[tag]] needs a name and a description");
+        }
+        if !names.insert(tag.name.as_str()) {
+            bail!("Tag '{}' is defined twice", tag.name);
+        }
+        if tag
+            .threshold
+            .is_some_and(|threshold| !(-1.0..=1.0).contains(&threshold))
+        {
+            bail!("Tag '{}' has a threshold outside -1 to 1", tag.name);
+        }
+    }
+    Ok(())
+}
+
+/// Tag each embedded chunk with the tags of `repo_root` whose descriptions
+/// its embedding is close to. Chunks keep no tags without an embedder.
+pub fn attach_tags(
+    chunk_entries: &mut [ChunkEntry],
+    embedder: Option<&mut dyn cs_embed::Embedder>,
+    repo_root: &Path,
+) -> Result<()> {
+    let tags = tags_for(repo_root)?;
+    let Some(embedder) = embedder else {
+        return Ok(());
+    };
+    if tags.is_empty() || chunk_entries.iter().all(|chunk| chunk.embedding.is_none()) {
+        return Ok(());
+    }
+    let embeddings = tag_embeddings(&tags, embedder, repo_root)?;
+    for chunk in chunk_entries.iter_mut() {
+        if let Some(embedding) = &chunk.embedding {
+            chunk.tags = classify(embedding, &tags, &embeddings);
+        }
+    }
+    Ok(())
+}
+
+fn tag_embeddings(
+    tags: &[IntentTag],
+    embedder: &mut dyn cs_embed::Embedder,
+    repo_root: &Path,
+) -> Result<Arc<Vec<Vec<f32>>>> {
+    let key = (repo_root.to_path_buf(), embedder.model_name().to_string());
+    if let Some(embeddings) = TAG_EMBEDDINGS
+        .lock()
+        .unwrap_or_else(|e| e.into_inner())
+        .get(&key)
+    {
+        return Ok(embeddings.clone());
+    }
+    let texts = tags
+        .iter()
+        .map(|tag| redaction::prepare_query(&*embedder, repo_root, &tag.text()))
+        .collect::<Result<Vec<_>>>()?;
+    let embeddings = Arc::new(embedder.embed(&texts)?);
+    TAG_EMBEDDINGS
+        .lock()
+        .unwrap_or_else(|e| e.into_inner())
+        .insert(key, embeddings.clone());
+    Ok(embeddings)
+}
+
+/// Names of the `tags` whose description `embedding` is close enough to,
+/// the closest first.
+pub fn classify(embedding: &[f32], tags: &[IntentTag], tag_embeddings: &[Vec<f32>]) -> Vec<String> {
+    let mut matched: Vec<(f32, &str)> = tags
+        .iter()
+        .zip(tag_embeddings)
+        .filter_map(|(tag, tag_embedding)| {
+            let similarity = super::diff::cosine(embedding, tag_embedding)?;
+            (similarity >= tag.threshold()).then_some((similarity, tag.name.as_str()))
+        })
+        .collect();
+    matched.sort_by(|a, b| b.0.total_cmp(&a.0));
+    matched
+        .into_iter()
+        .take(MAX_TAGS_PER_CHUNK)
+        .map(|(_, name)| name.to_string())
+        .collect()
+}
+
+/// Whether a chunk tagged `tags` carries every tag in `filters`, which
+/// match whatever their case.
+pub fn carries(tags: &[String], filters: &[String]) -> bool {
+    filters
+        .iter()
+        .all(|filter| tags.iter().any(|tag| tag.eq_ignore_ascii_case(filter)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn tag(name: &str, threshold: Option<f32>) -> IntentTag {
+        IntentTag {
+            name: name.to_string(),
+            description: format!("code about {}", name),
+            threshold,
+        }
+    }
+
+    #[test]
+    fn chunks_get_the_tags_they_are_close_to() {
+        let tags = [
+            tag("billing", None),
+            tag("authentication", Some(0.9)),
+            tag("feature flags", None),
+        ];
+        let tag_embeddings = [
+            vec![1.0, 0.0, 0.0],
+            vec![0.8, 0.6, 0.0],
+            vec![0.0, 0.0, 1.0],
+        ];
+
+        // Cosines 0.51 to billing, 0.72 to authentication (under its 0.9) and
+        // 0.69 to feature flags
+        let chunk = [0.6, 0.6, 0.8];
+        assert_eq!(
+            classify(&chunk, &tags, &tag_embeddings),
+            ["feature flags", "billing"]
+        );
+        assert!(classify(&[0.0, 1.0, 0.0], &tags, &tag_embeddings).is_empty());
+
+        let tagged = classify(&chunk, &tags, &tag_embeddings);
+        assert!(carries(&tagged, &["Billing".to_string()]));
+        assert!(!carries(
+            &tagged,
+            &["billing".to_string(), "authentication".to_string()]
+        ));
+    }
+
+    #[test]
+    fn tag_files_are_validated() {
+        let file: TagsFile = toml::from_str(
+            "[[tag]]\nname = \"billing\"\ndescription = \"payments\"\nthreshold = 0.6\n",
+        )
+        .unwrap();
+        assert!(validate(&file.tag).is_ok());
+        assert!(validate(&[tag("billing", None), tag("billing", None)]).is_err());
+        assert!(validate(&[tag("billing", Some(1.5))]).is_err());
+        assert!(
+            toml::from_str::<TagsFile>("[[tag]]\nname = \"x\"\ndescription = \"y\"\nweight = 2\n")
+                .is_err()
+        );
+    }
+}
@@ -0,0 +1,329 @@
+//! Update journal: an index update killed part way leaves a manifest that
+//! agrees with its sidecars.
+//!
+//! An update writes each file's sidecar and then the manifest naming it,
+//! every few files or once at the end. Killed in between, the manifest
+//! still has a file's old hash beside its new chunks, or names a sidecar
+//! that was removed. So before a sidecar is written or removed, the update
+//! appends what it's about to do to `update.journal` next to the manifest
+//! and syncs it; once the last manifest save lands the journal is deleted.
+//!
+//! A journal still there when the next update (or `--index`) opens the
+//! index is the record of one that didn't finish, and is replayed: a
+//! sidecar that was written in full goes into the manifest, one that wasn't
+//! leaves the manifest without the file so it's indexed again, and a
+//! removed sidecar takes its manifest entry with it. Sidecars and the
+//! manifest are each replaced with a rename, so neither is ever half
+//! written.
+
+use super::{load_index_entry, load_or_create_manifest, save_manifest};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fs::{self, File, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+pub const JOURNAL_FILE: &str = "update.journal";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+enum Op {
+    Write,
+    Remove,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Record {
+    op: Op,
+    /// Manifest key of the file
+    key: PathBuf,
+    /// Its sidecar, relative to the manifest's directory
+    sidecar: PathBuf,
+}
+
+/// What replaying an unfinished update changed in the manifest.
+#[derive(Debug, Default, Clone, PartialEq, Eq)]
+pub struct Recovery {
+    /// Files whose new sidecar was written, now in the manifest
+    pub replayed: usize,
+    /// Files whose sidecar wasn't written or was removed, now out of it
+    pub dropped: usize,
+}
+
+/// The journal of the update in progress on one manifest.
+#[derive(Debug)]
+pub struct Journal {
+    dir: PathBuf,
+    file: Option<File>,
+    /// Manifest keys of the files whose sidecars were written
+    written: Vec<PathBuf>,
+}
+
+impl Journal {
+    /// Replay what an unfinished update left of the manifest at
+    /// `manifest_path`, and start the journal of this one. The journal
+    /// file is only created with the first record.
+    pub fn open(manifest_path: &Path) -> Result<Self> {
+        if let Some(recovery) = recover(manifest_path)? {
+            tracing::warn!(
+                "The last index update didn't finish: replayed {} files, {} to index again",
+                recovery.replayed,
+                recovery.dropped
+            );
+        }
+        Ok(Self {
+            dir: manifest_dir(manifest_path).to_path_buf(),
+            file: None,
+            written: Vec::new(),
+        })
+    }
+
+    /// Record that the sidecar of the file with manifest key `key` is about
+    /// to be written.
+    pub fn writing(&mut self, key: &Path, sidecar: &Path) -> Result<()> {
+        self.append(Op::Write, key, sidecar)?;
+        self.written.push(key.to_path_buf());
+        Ok(())
+    }
+
+    /// Record that the sidecar of the file with manifest key `key` is about
+    /// to be removed, along with its manifest entry.
+    pub fn removing(&mut self, key: &Path, sidecar: &Path) -> Result<()> {
+        self.append(Op::Remove, key, sidecar)
+    }
+
+    /// The manifest saved last names everything recorded: the update is
+    /// done. Returns the manifest keys of the files it wrote.
+    pub fn commit(mut self) -> Result<Vec<PathBuf>> {
+        if self.file.take().is_some() {
+            remove_journal(&self.dir.join(JOURNAL_FILE))?;
+        }
+        Ok(self.written)
+    }
+
+    fn append(&mut self, op: Op, key: &Path, sidecar: &Path) -> Result<()> {
+        let record = Record {
+            op,
+            key: key.to_path_buf(),
+            sidecar: sidecar
+                .strip_prefix(&self.dir)
+                .unwrap_or(sidecar)
+                .to_path_buf(),
+        };
+        let mut line = serde_json::to_vec(&record)?;
+        line.push(b'\n');
+
+        let file = match &mut self.file {
+            Some(file) => file,
+            None => {
+                fs::create_dir_all(&self.dir)?;
+                let file = OpenOptions::new()
+                    .create(true)
+                    .append(true)
+                    .open(self.dir.join(JOURNAL_FILE))?;
+                self.file.insert(file)
+            }
+        };
+        file.write_all(&line)?;
+        // On disk before the sidecar it announces is touched
+        file.sync_data()?;
+        Ok(())
+    }
+}
+
+/// Bring the manifest at `manifest_path` in line with the sidecars an
+/// unfinished update wrote and removed. `None` when the last update
+/// finished.
+pub fn recover(manifest_path: &Path) -> Result<Option<Recovery>> {
+    let dir = manifest_dir(manifest_path);
+    let journal_path = dir.join(JOURNAL_FILE);
+    let data = match fs::read_to_string(&journal_path) {
+        Ok(data) => data,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+        Err(e) => return Err(e.into()),
+    };
+
+    let mut manifest = load_or_create_manifest(manifest_path)?;
+    let mut recovery = Recovery::default();
+    let mut swept = HashSet::new();
+    // A last line cut short by the crash announced a write that never began
+    for record in data
+        .lines()
+        .filter_map(|line| serde_json::from_str::<Record>(line).ok())
+    {
+        let sidecar = dir.join(&record.sidecar);
+        if let Some(parent) = sidecar.parent()
+            && swept.insert(parent.to_path_buf())
+        {
+            remove_temp_files(parent);
+        }
+
+        match record.op {
+            Op::Write => {
+                let written = load_index_entry(&sidecar)
+                    .ok()
+                    .map(|entry| entry.metadata)
+                    .filter(|metadata| metadata.path == record.key);
+                match written {
+                    Some(metadata) => {
+                        // The old sidecar, if the write never happened
+                        if manifest.files.get(&record.key) != Some(&metadata) {
+                            manifest.files.insert(record.key, metadata);
+                            recovery.replayed += 1;
+                        }
+                    }
+                    None => {
+                        if manifest.files.remove(&record.key).is_some() {
+                            recovery.dropped += 1;
+                        }
+                    }
+                }
+            }
+            Op::Remove => {
+                if !sidecar.exists() && manifest.files.remove(&record.key).is_some() {
+                    recovery.dropped += 1;
+                }
+            }
+        }
+    }
+
+    if recovery != Recovery::default() {
+        save_manifest(manifest_path, &manifest)?;
+    }
+    remove_journal(&journal_path)?;
+    Ok(Some(recovery))
+}
+
+fn manifest_dir(manifest_path: &Path) -> &Path {
+    manifest_path.parent().unwrap_or_else(|| Path::new("."))
+}
+
+fn remove_journal(path: &Path) -> Result<()> {
+    match fs::remove_file(path) {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => Err(e.into()),
+        _ => Ok(()),
+    }
+}
+
+/// Temporary files a killed write left behind; a rename never made them a
+/// sidecar.
+fn remove_temp_files(dir: &Path) {
+    let Ok(entries) = fs::read_dir(dir) else {
+        return;
+    };
+    for entry in entries.flatten() {
+        if entry.file_name().to_string_lossy().starts_with(".tmp")
+            && entry.file_type().is_ok_and(|t| t.is_file())
+        {
+            let _ = fs::remove_file(entry.path());
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::super::{IndexEntry, IndexManifest, save_index_entry};
+    use super::*;
+    use cs_core::FileMetadata;
+    use tempfile::TempDir;
+
+    fn entry(key: &str, hash: &str) -> IndexEntry {
+        IndexEntry {
+            metadata: FileMetadata {
+                path: PathBuf::from(key),
+                hash: hash.to_string(),
+                last_modified: 0,
+                size: 1,
+            },
+            chunks: Vec::new(),
+        }
+    }
+
+    fn manifest_with(dir: &Path, entries: &[&IndexEntry]) -> PathBuf {
+        let mut manifest = IndexManifest::default();
+        for entry in entries {
+            manifest
+                .files
+                .insert(entry.metadata.path.clone(), entry.metadata.clone());
+        }
+        let path = dir.join("manifest.json");
+        save_manifest(&path, &manifest).unwrap();
+        path
+    }
+
+    #[test]
+    fn an_interrupted_update_is_replayed() {
+        let dir = TempDir::new().unwrap();
+        let old = entry("src/a.rs", "old");
+        let gone = entry("src/b.rs", "b");
+        let manifest_path = manifest_with(dir.path(), &[&old, &gone]);
+        let a = dir.path().join("src/a.rs.cs");
+        let b = dir.path().join("src/b.rs.cs");
+        let c = dir.path().join("src/c.rs.cs");
+        save_index_entry(&a, &old).unwrap();
+        save_index_entry(&b, &gone).unwrap();
+
+        // Killed before any of it reached the manifest
+        let mut journal = Journal::open(&manifest_path).unwrap();
+        journal.writing(Path::new("src/a.rs"), &a).unwrap();
+        save_index_entry(&a, &entry("src/a.rs", "new")).unwrap();
+        journal.removing(Path::new("src/b.rs"), &b).unwrap();
+        fs::remove_file(&b).unwrap();
+        journal.writing(Path::new("src/c.rs"), &c).unwrap();
+        fs::write(dir.path().join("src/.tmpXyZ"), b"half a sidecar").unwrap();
+        drop(journal);
+
+        let recovery = recover(&manifest_path).unwrap().unwrap();
+        assert_eq!(
+            recovery,
+            Recovery {
+                replayed: 1,
+                dropped: 1
+            }
+        );
+        let manifest = load_or_create_manifest(&manifest_path).unwrap();
+        assert_eq!(manifest.files[Path::new("src/a.rs")].hash, "new");
+        assert!(!manifest.files.contains_key(Path::new("src/b.rs")));
+        assert!(!manifest.files.contains_key(Path::new("src/c.rs")));
+        assert!(!dir.path().join("src/.tmpXyZ").exists());
+        assert!(!dir.path().join(JOURNAL_FILE).exists());
+        assert_eq!(recover(&manifest_path).unwrap(), None);
+    }
+
+    #[test]
+    fn a_write_that_never_began_changes_nothing() {
+        let dir = TempDir::new().unwrap();
+        let old = entry("src/a.rs", "old");
+        let manifest_path = manifest_with(dir.path(), &[&old]);
+        let a = dir.path().join("src/a.rs.cs");
+        save_index_entry(&a, &old).unwrap();
+
+        let mut journal = Journal::open(&manifest_path).unwrap();
+        journal.writing(Path::new("src/a.rs"), &a).unwrap();
+        drop(journal);
+        // And a record torn off mid-line
+        let mut file = OpenOptions::new()
+            .append(true)
+            .open(dir.path().join(JOURNAL_FILE))
+            .unwrap();
+        file.write_all(b"{\"op\":\"write\",\"key\":\"src/").unwrap();
+
+        assert_eq!(recover(&manifest_path).unwrap(), Some(Recovery::default()));
+        let manifest = load_or_create_manifest(&manifest_path).unwrap();
+        assert_eq!(manifest.files[Path::new("src/a.rs")].hash, "old");
+    }
+
+    #[test]
+    fn a_finished_update_leaves_no_journal() {
+        let dir = TempDir::new().unwrap();
+        let manifest_path = manifest_with(dir.path(), &[]);
+        let a = dir.path().join("src/a.rs.cs");
+
+        let mut journal = Journal::open(&manifest_path).unwrap();
+        journal.writing(Path::new("src/a.rs"), &a).unwrap();
+        assert!(dir.path().join(JOURNAL_FILE).exists());
+        assert_eq!(journal.commit().unwrap(), vec![PathBuf::from("src/a.rs")]);
+        assert!(!dir.path().join(JOURNAL_FILE).exists());
+    }
+}
@@ -1,9 +1,10 @@
 use anyhow::Result;
+use cs_core::context::{Operation, OperationContext};
 use cs_core::{FileMetadata, Language, Span, compute_file_hash, get_sidecar_path};
 use ignore::{WalkBuilder, overrides::OverrideBuilder};
 use rayon::prelude::*;
 use serde::{Deserialize, Serialize};
-use std::collections::{HashMap, HashSet};
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::fs;
 use std::io::{Read, Write};
 use std::path::{Path, PathBuf};
@@ -13,6 +14,54 @@ use std::time::SystemTime;
 use tempfile::NamedTempFile;
 use walkdir::WalkDir;
 
+pub mod bundle;
+pub mod chats;
+pub mod collections;
+pub mod commits;
+pub mod compression;
+pub mod diff;
+pub mod distributed;
+pub mod dry_run;
+pub mod encryption;
+pub mod eviction;
+pub mod extractors;
+pub mod file_filter;
+pub mod fixtures;
+pub mod generated;
+pub mod go_deps;
+pub mod go_stdlib;
+pub mod go_types;
+pub mod hot_chunks;
+pub mod index_format;
+pub mod intent_tags;
+pub mod journal;
+pub mod licenses;
+pub mod literals;
+pub mod manifest_format;
+pub mod memories;
+pub mod model_migration;
+pub mod multi_vector;
+pub mod normalizers;
+#[cfg(feature = "remote")]
+pub mod oci;
+#[cfg(feature = "remote")]
+pub mod peer;
+pub mod policy;
+pub mod projects;
+pub mod read_limits;
+pub mod redaction;
+#[cfg(feature = "remote")]
+pub mod remote;
+pub mod renames;
+pub mod secrets;
+pub mod segments;
+pub mod shards;
+pub mod signatures;
+pub mod sparse;
+#[cfg(feature = "tickets")]
+pub mod tickets;
+pub mod traversal;
+
 pub type ProgressCallback = Box<dyn Fn(&str) + Send + Sync>;
 
 /// Detailed progress information for embedding operations
@@ -77,16 +126,30 @@ pub fn request_interrupt() {
     INTERRUPTED.store(true, Ordering::SeqCst);
 }
 
+/// Install the Ctrl-C handler (once per process) and clear the interrupt
+/// flag for a new indexing operation.
+fn reset_interrupt() {
+    HANDLER_INIT.call_once(|| {
+        let _ = ctrlc::set_handler(move || {
+            INTERRUPTED.store(true, Ordering::SeqCst);
+            eprintln!("\nIndexing interrupted by user. Cleaning up...");
+        });
+    });
+    INTERRUPTED.store(false, Ordering::SeqCst);
+}
+
 /// Build override patterns for excluding files during directory traversal
 fn build_overrides(
     base_path: &Path,
     exclude_patterns: &[String],
 ) -> Result<ignore::overrides::Override> {
     let mut builder = OverrideBuilder::new(base_path);
+    builder.case_insensitive(cs_core::paths::filters_ignore_case())?;
 
     for pattern in exclude_patterns {
+        let pattern = cs_core::paths::filter_pattern(pattern);
         if pattern.starts_with('!') {
-            builder.add(pattern)?;
+            builder.add(&pattern)?;
         } else {
             builder.add(&format!("!{}", pattern))?;
         }
@@ -95,12 +158,30 @@ fn build_overrides(
     Ok(builder.build()?)
 }
 
+/// Whether `overrides` built for `root` leave `path` out, as it's named or
+/// as path filters fold its name (see [`cs_core::paths::fold`]).
+fn overrides_exclude(
+    overrides: &ignore::overrides::Override,
+    root: &Path,
+    path: &Path,
+    is_dir: bool,
+) -> bool {
+    if overrides.matched(path, is_dir).is_ignore() {
+        return true;
+    }
+    let relative = path.strip_prefix(root).unwrap_or(path);
+    let folded = cs_core::paths::filter_path(relative);
+    matches!(folded, std::borrow::Cow::Owned(_)) && overrides.matched(&folded, is_dir).is_ignore()
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct IndexEntry {
     pub metadata: FileMetadata,
     pub chunks: Vec<ChunkEntry>,
 }
 
+// Sidecars are bincode, which has no field names, so no field may be
+// skipped when serializing
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct ChunkEntry {
     pub span: Span,
@@ -118,10 +199,58 @@ pub struct ChunkEntry {
     pub leading_trivia: Option<Vec<String>>,
     #[serde(default)]
     pub trailing_trivia: Option<Vec<String>>,
+    /// From a file with a generated-code header (see [`generated`])
+    #[serde(default)]
+    pub generated: bool,
+    /// Log and error messages in the chunk (see [`literals`])
+    #[serde(default)]
+    pub literals: Vec<String>,
+    /// Embedding of `literals`, scored next to `embedding`
+    #[serde(default)]
+    pub literal_embedding: Option<Vec<f32>>,
+    /// SPDX expression from the file's license header (see [`licenses`])
+    #[serde(default)]
+    pub license: Option<String>,
+    /// Key/values from the repo's metadata extractors (see [`extractors`])
+    #[serde(default)]
+    pub metadata: BTreeMap<String, String>,
+    /// Name of the function, method, class or module the chunk declares
+    #[serde(default)]
+    pub symbol: Option<String>,
+    /// One vector per statement group on a multi-vector index (see
+    /// [`multi_vector`]), scored next to `embedding`
+    #[serde(default)]
+    pub sub_embeddings: Vec<Vec<f32>>,
+    /// Learned sparse vector when the index has a sparse model (see [`sparse`])
+    #[serde(default)]
+    pub sparse: Option<cs_embed::SparseVector>,
+    /// Span of the whole declaration when a long one was split into an
+    /// outline chunk and sections; searches fold hits on them into one result
+    #[serde(default)]
+    pub parent: Option<Span>,
+    /// Declaration of a function or method chunk (see [`signatures`])
+    #[serde(default)]
+    pub signature: Option<String>,
+    /// Embedding of `signature`, scored next to `embedding`
+    #[serde(default)]
+    pub signature_embedding: Option<Vec<f32>>,
+    /// `.cstags.toml` tags the chunk is about, the closest first (see
+    /// [`intent_tags`])
+    #[serde(default)]
+    pub tags: Vec<String>,
+}
+
+impl ChunkEntry {
+    /// Whether this is the outline of a declaration split into sections,
+    /// which stands for the whole of it.
+    pub fn is_outline(&self) -> bool {
+        self.parent.as_ref() == Some(&self.span)
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct IndexManifest {
+    /// Index format (see [`index_format`])
     pub version: String,
     pub created: u64,
     pub updated: u64,
@@ -130,6 +259,9 @@ pub struct IndexManifest {
     pub embedding_model: Option<String>,
     /// Embedding model dimensions (for validation)
     pub embedding_dimensions: Option<usize>,
+    /// Embedding pipeline version the vectors were produced with
+    #[serde(default)]
+    pub embedding_model_version: Option<String>,
 }
 
 impl Default for IndexManifest {
@@ -140,29 +272,45 @@ impl Default for IndexManifest {
             .as_secs();
 
         Self {
-            version: "0.1.0".to_string(),
+            version: index_format::INDEX_FORMAT_VERSION.to_string(),
             created: now,
             updated: now,
             files: HashMap::new(),
             embedding_model: None, // Default to None for backward compatibility
             embedding_dimensions: None,
+            embedding_model_version: None,
         }
     }
 }
 
 /// Common filtering logic for directory traversal entries
-fn should_include_file(entry: &ignore::DirEntry, index_dir: &Path) -> bool {
+fn should_include_file(entry: &ignore::DirEntry, repo_root: &Path, index_dir: &Path) -> bool {
     let path = entry.path();
     entry.file_type().is_some_and(|ft| ft.is_file())
-        && is_text_file(path)
         && !path.starts_with(index_dir)
+        && is_text_file(path)
+        && within_read_limits(entry, repo_root)
+}
+
+/// Checked while collecting, so a skipped file isn't retried as dirty on
+/// every run.
+fn within_read_limits(entry: &ignore::DirEntry, repo_root: &Path) -> bool {
+    let size = entry.metadata().map(|m| m.len()).unwrap_or(0);
+    read_limits::check(entry.path(), size, repo_root).is_none()
 }
 
 /// Apply common filtering to a WalkBuilder iterator
-fn filter_and_collect_files(walker: ignore::Walk, index_dir: &Path) -> Vec<PathBuf> {
+fn filter_and_collect_files(
+    walker: ignore::Walk,
+    repo_root: &Path,
+    index_dir: &Path,
+) -> Vec<PathBuf> {
+    let evicted = eviction::EvictedFiles::load(repo_root);
     walker
         .filter_map(|entry| entry.ok())
-        .filter(|entry| should_include_file(entry, index_dir))
+        .filter(|entry| {
+            should_include_file(entry, repo_root, index_dir) && !evicted.contains(entry)
+        })
         .map(|entry| entry.path().to_path_buf())
         .collect()
 }
@@ -172,19 +320,89 @@ pub fn collect_files(
     respect_gitignore: bool,
     exclude_patterns: &[String],
 ) -> Result<Vec<PathBuf>> {
-    let index_dir = path.join(".cs");
+    walk_files(path, respect_gitignore, exclude_patterns, None)
+}
+
+/// Why [`collect_files`] left a file out.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Exclusion {
+    /// A `.gitignore`, `.ignore` or git exclude file
+    Gitignore,
+    /// The exclude pattern that matched: `--exclude`, `.csignore` or a default
+    Pattern(String),
+}
+
+/// The files under `path` that [`collect_files`] leaves out with these
+/// settings, and why. Files no setting brings in (binaries, the default
+/// excludes, the organization policy's) aren't listed.
+pub fn excluded_files(
+    path: &Path,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+) -> Result<Vec<(PathBuf, Exclusion)>> {
+    let included = collect_files_as_hashset(path, respect_gitignore, exclude_patterns)?;
+    let unignored = if respect_gitignore {
+        Some(collect_files_as_hashset(path, true, &[])?)
+    } else {
+        None
+    };
+    let mut excluded = Vec::new();
+    for file in collect_files(path, false, &[])? {
+        if included.contains(&file) {
+            continue;
+        }
+        if unignored
+            .as_ref()
+            .is_some_and(|files| !files.contains(&file))
+        {
+            excluded.push((file, Exclusion::Gitignore));
+        } else if let Some(pattern) = matching_exclude_pattern(path, &file, exclude_patterns) {
+            excluded.push((file, Exclusion::Pattern(pattern)));
+        }
+    }
+    Ok(excluded)
+}
+
+/// The first of `exclude_patterns` that leaves `file` out, by itself or by
+/// a directory above it.
+fn matching_exclude_pattern(
+    root: &Path,
+    file: &Path,
+    exclude_patterns: &[String],
+) -> Option<String> {
+    exclude_patterns
+        .iter()
+        .find(|pattern| {
+            let Ok(overrides) = build_overrides(root, std::slice::from_ref(pattern)) else {
+                return false;
+            };
+            file.ancestors()
+                .take_while(|ancestor| *ancestor != root && ancestor.starts_with(root))
+                .any(|ancestor| overrides_exclude(&overrides, root, ancestor, ancestor != file))
+        })
+        .cloned()
+}
+
+/// The files under `path` that [`collect_files`] collects, only descending
+/// towards and into the `within` paths when there are some.
+fn walk_files(
+    path: &Path,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+    within: Option<&[PathBuf]>,
+) -> Result<Vec<PathBuf>> {
+    let index_dir = cs_core::locations::index_dir(path);
 
-    if respect_gitignore {
+    let mut walker = if respect_gitignore {
         let overrides = build_overrides(path, exclude_patterns)?;
-        let walker = WalkBuilder::new(path)
+        let mut walker = WalkBuilder::new(path);
+        walker
             .git_ignore(true)
             .git_global(true)
             .git_exclude(true)
             .hidden(true)
-            .overrides(overrides)
-            .build();
-
-        Ok(filter_and_collect_files(walker, &index_dir))
+            .overrides(overrides);
+        walker
     } else {
         // Use WalkBuilder without gitignore support, but still apply overrides
         use cs_core::get_default_exclude_patterns;
@@ -195,14 +413,60 @@ pub fn collect_files(
         all_patterns.extend(exclude_patterns.iter().cloned());
         let combined_overrides = build_overrides(path, &all_patterns)?;
 
-        let walker = WalkBuilder::new(path)
+        let mut walker = WalkBuilder::new(path);
+        walker
             .git_ignore(false)
             .hidden(true)
-            .overrides(combined_overrides)
-            .build();
+            .overrides(combined_overrides);
+        walker
+    };
+    let follow_links = traversal::symlink_policy() == traversal::SymlinkPolicy::Follow;
+    walker.follow_links(follow_links);
+    let within = within.map(<[PathBuf]>::to_vec);
+    // The walker compares names as they are on disk
+    let folded = if cs_core::paths::folding_matters(exclude_patterns) {
+        Some(build_overrides(path, exclude_patterns)?)
+    } else {
+        None
+    };
+    let root = path.to_path_buf();
+    walker.filter_entry(move |entry| {
+        let is_dir = entry.file_type().is_some_and(|ft| ft.is_dir());
+        let is_nested_dir = entry.depth() > 0 && is_dir;
+        if is_nested_dir && !traversal::descends_into(entry.path()) {
+            return false;
+        }
+        if let Some(overrides) = &folded
+            && entry.depth() > 0
+            && overrides_exclude(overrides, &root, entry.path(), is_dir)
+        {
+            return false;
+        }
+        let entry = entry.path();
+        within.as_ref().is_none_or(|within| {
+            within
+                .iter()
+                .any(|path| path.starts_with(entry) || entry.starts_with(path))
+        })
+    });
 
-        Ok(filter_and_collect_files(walker, &index_dir))
-    }
+    let mut files = filter_and_collect_files(walker.build(), path, &index_dir);
+    // The organization policy applies whatever the gitignore switch says
+    let policy = policy::current()?;
+    files.retain(|file| !policy.excludes(path, file));
+    let files = if follow_links {
+        traversal::dedupe_linked(path, files)
+    } else {
+        files
+    };
+    fixtures::apply(path, files, within.as_deref(), |dir| {
+        walk_files(
+            path,
+            respect_gitignore,
+            exclude_patterns,
+            Some(&[dir.to_path_buf()]),
+        )
+    })
 }
 
 fn collect_files_as_hashset(
@@ -215,6 +479,7 @@ fn collect_files_as_hashset(
         .collect())
 }
 
+#[tracing::instrument(name = "index_directory", skip_all, fields(path = %path.display()))]
 pub async fn index_directory(
     path: &Path,
     compute_embeddings: bool,
@@ -226,10 +491,12 @@ pub async fn index_directory(
         "index_directory called with compute_embeddings={}",
         compute_embeddings
     );
-    let index_dir = path.join(".cs");
+    bundle::ensure_writable(path)?;
+    let index_dir = cs_core::locations::index_dir(path);
     fs::create_dir_all(&index_dir)?;
 
     let manifest_path = index_dir.join("manifest.json");
+    let mut journal = journal::Journal::open(&manifest_path)?;
     let mut manifest = load_or_create_manifest(&manifest_path)?;
     normalize_manifest_paths(&mut manifest, path);
 
@@ -257,6 +524,7 @@ pub async fn index_directory(
 
         // Set the model info in the manifest for new indexes
         manifest.embedding_model = Some(selected_model.clone());
+        manifest.embedding_model_version = Some(cs_embed::EMBEDDING_PIPELINE_VERSION.to_string());
         if let Some(model_name) = model {
             if let Some(model_config) = model_registry.get_model(model_name) {
                 manifest.embedding_dimensions = Some(model_config.dimensions);
@@ -280,8 +548,10 @@ pub async fn index_directory(
         for file_path in files.iter() {
             match index_single_file(file_path, path, Some(&mut embedder)) {
                 Ok(entry) => {
+                    let _span = tracing::info_span!("store").entered();
                     // Write sidecar immediately
                     let sidecar_path = get_sidecar_path(path, file_path);
+                    journal.writing(&entry.metadata.path, &sidecar_path)?;
                     save_index_entry(&sidecar_path, &entry)?;
 
                     // Update and save manifest immediately
@@ -294,13 +564,13 @@ pub async fn index_directory(
                     save_manifest(&manifest_path, &manifest)?;
                 }
                 Err(e) => {
-                    // Suppress warnings for binary files and UTF-8 errors in .git directories
+                    // Suppress warnings for skipped files and UTF-8 errors in .git directories
                     let error_msg = e.to_string();
-                    let is_binary_skip = error_msg.contains("Binary file, skipping");
+                    let is_skip = read_limits::is_skip(&error_msg);
                     let is_utf8_error = error_msg.contains("stream did not contain valid UTF-8");
                     let is_git_file = file_path.components().any(|c| c.as_os_str() == ".git");
 
-                    if !(is_binary_skip || is_utf8_error && is_git_file) {
+                    if !(is_skip || is_utf8_error && is_git_file) {
                         tracing::warn!("Failed to index {:?}: {}", file_path, e);
                     }
                 }
@@ -314,10 +584,13 @@ pub async fn index_directory(
         let (tx, rx) = mpsc::channel();
         let files_clone = files.clone();
         let path_clone = path.to_path_buf();
+        // Workers' file spans belong to this run
+        let index_span = tracing::Span::current();
 
         // Spawn worker thread for parallel processing
         let worker_handle = thread::spawn(move || {
             files_clone.par_iter().for_each(|file_path| {
+                let _index = index_span.enter();
                 match index_single_file(file_path, &path_clone, None) {
                     Ok(entry) => {
                         if tx.send((file_path.clone(), entry)).is_err() {
@@ -325,14 +598,14 @@ pub async fn index_directory(
                         }
                     }
                     Err(e) => {
-                        // Suppress warnings for binary files and UTF-8 errors in .git directories
+                        // Suppress warnings for skipped files and UTF-8 errors in .git directories
                         let error_msg = e.to_string();
-                        let is_binary_skip = error_msg.contains("Binary file, skipping");
+                        let is_skip = read_limits::is_skip(&error_msg);
                         let is_utf8_error =
                             error_msg.contains("stream did not contain valid UTF-8");
                         let is_git_file = file_path.components().any(|c| c.as_os_str() == ".git");
 
-                        if !(is_binary_skip || is_utf8_error && is_git_file) {
+                        if !(is_skip || is_utf8_error && is_git_file) {
                             tracing::warn!("Failed to index {:?}: {}", file_path, e);
                         }
                     }
@@ -342,8 +615,10 @@ pub async fn index_directory(
 
         // Main thread: stream results as they arrive
         while let Ok((file_path, entry)) = rx.recv() {
+            let _span = tracing::info_span!("store").entered();
             // Write sidecar immediately
             let sidecar_path = get_sidecar_path(path, &file_path);
+            journal.writing(&entry.metadata.path, &sidecar_path)?;
             save_index_entry(&sidecar_path, &entry)?;
 
             // Update and save manifest immediately
@@ -371,16 +646,22 @@ pub async fn index_directory(
             .as_secs();
         save_manifest(&manifest_path, &manifest)?;
     }
+    let written = journal.commit()?;
+    enforce_size_budget(path, &mut manifest);
+    segments::add(&index_dir, &manifest, &written);
+    refresh_derived_data(path, &manifest);
 
     Ok(())
 }
 
 pub async fn index_file(file_path: &Path, compute_embeddings: bool) -> Result<()> {
     let repo_root = find_repo_root(file_path)?;
-    let index_dir = repo_root.join(".cs");
+    bundle::ensure_writable(&repo_root)?;
+    let index_dir = cs_core::locations::index_dir(&repo_root);
     fs::create_dir_all(&index_dir)?;
 
     let manifest_path = index_dir.join("manifest.json");
+    let mut journal = journal::Journal::open(&manifest_path)?;
     let mut manifest = load_or_create_manifest(&manifest_path)?;
 
     let entry = if compute_embeddings {
@@ -393,6 +674,7 @@ pub async fn index_file(file_path: &Path, compute_embeddings: bool) -> Result<()
     };
     let sidecar_path = get_sidecar_path(&repo_root, file_path);
 
+    journal.writing(&entry.metadata.path, &sidecar_path)?;
     save_index_entry(&sidecar_path, &entry)?;
     let manifest_key = entry.metadata.path.clone();
     manifest.files.insert(manifest_key, entry.metadata);
@@ -402,6 +684,8 @@ pub async fn index_file(file_path: &Path, compute_embeddings: bool) -> Result<()
         .as_secs();
 
     save_manifest(&manifest_path, &manifest)?;
+    let written = journal.commit()?;
+    segments::add(&index_dir, &manifest, &written);
 
     Ok(())
 }
@@ -412,7 +696,8 @@ pub async fn update_index(
     respect_gitignore: bool,
     exclude_patterns: &[String],
 ) -> Result<()> {
-    let index_dir = path.join(".cs");
+    bundle::ensure_writable(path)?;
+    let index_dir = cs_core::locations::index_dir(path);
     if !index_dir.exists() {
         return index_directory(
             path,
@@ -425,6 +710,7 @@ pub async fn update_index(
     }
 
     let manifest_path = index_dir.join("manifest.json");
+    let mut journal = journal::Journal::open(&manifest_path)?;
     let mut manifest = load_or_create_manifest(&manifest_path)?;
 
     let files = collect_files(path, respect_gitignore, exclude_patterns)?;
@@ -450,15 +736,15 @@ pub async fn update_index(
                     match index_single_file(file_path, path, Some(&mut embedder)) {
                         Ok(entry) => Some((file_path.clone(), entry)),
                         Err(e) => {
-                            // Suppress warnings for binary files and UTF-8 errors in .git directories
+                            // Suppress warnings for skipped files and UTF-8 errors in .git directories
                             let error_msg = e.to_string();
-                            let is_binary_skip = error_msg.contains("Binary file, skipping");
+                            let is_skip = read_limits::is_skip(&error_msg);
                             let is_utf8_error =
                                 error_msg.contains("stream did not contain valid UTF-8");
                             let is_git_file =
                                 file_path.components().any(|c| c.as_os_str() == ".git");
 
-                            if !(is_binary_skip || is_utf8_error && is_git_file) {
+                            if !(is_skip || is_utf8_error && is_git_file) {
                                 tracing::warn!("Failed to index {:?}: {}", file_path, e);
                             }
                             None
@@ -489,15 +775,15 @@ pub async fn update_index(
                     match index_single_file(file_path, path, None) {
                         Ok(entry) => Some((file_path.clone(), entry)),
                         Err(e) => {
-                            // Suppress warnings for binary files and UTF-8 errors in .git directories
+                            // Suppress warnings for skipped files and UTF-8 errors in .git directories
                             let error_msg = e.to_string();
-                            let is_binary_skip = error_msg.contains("Binary file, skipping");
+                            let is_skip = read_limits::is_skip(&error_msg);
                             let is_utf8_error =
                                 error_msg.contains("stream did not contain valid UTF-8");
                             let is_git_file =
                                 file_path.components().any(|c| c.as_os_str() == ".git");
 
-                            if !(is_binary_skip || is_utf8_error && is_git_file) {
+                            if !(is_skip || is_utf8_error && is_git_file) {
                                 tracing::warn!("Failed to index {:?}: {}", file_path, e);
                             }
                             None
@@ -512,6 +798,7 @@ pub async fn update_index(
 
     for (file_path, entry) in updates {
         let sidecar_path = get_sidecar_path(path, &file_path);
+        journal.writing(&entry.metadata.path, &sidecar_path)?;
         save_index_entry(&sidecar_path, &entry)?;
         let manifest_key = entry.metadata.path.clone();
         manifest.files.insert(manifest_key, entry.metadata);
@@ -524,12 +811,21 @@ pub async fn update_index(
             .as_secs();
         save_manifest(&manifest_path, &manifest)?;
     }
+    let written = journal.commit()?;
+    enforce_size_budget(path, &mut manifest);
+    segments::add(&index_dir, &manifest, &written);
+    refresh_derived_data(path, &manifest);
 
     Ok(())
 }
 
+/// What to tell someone whose search skipped part of an unreadable index.
+pub const REPAIR_HINT: &str =
+    "run `cs --doctor` to check the index, then `cs --clean-orphans` and `cs --index` to repair it";
+
 pub fn clean_index(path: &Path) -> Result<()> {
-    let index_dir = path.join(".cs");
+    bundle::ensure_writable(path)?;
+    let index_dir = cs_core::locations::index_dir(path);
     if index_dir.exists() {
         fs::remove_dir_all(&index_dir)?;
     }
@@ -541,7 +837,8 @@ pub fn cleanup_index(
     respect_gitignore: bool,
     exclude_patterns: &[String],
 ) -> Result<CleanupStats> {
-    let index_dir = path.join(".cs");
+    bundle::ensure_writable(path)?;
+    let index_dir = cs_core::locations::index_dir(path);
     if !index_dir.exists() {
         return Ok(CleanupStats::default());
     }
@@ -561,6 +858,9 @@ pub fn cleanup_index(
 
     // Content cache cleanup is now handled by the unified cleanup validation
 
+    // Searches read what a damaged segment held from the sidecars
+    stats.damaged_segments_removed = segments::remove_damaged(&index_dir)?;
+
     // Remove empty directories in .cc
     remove_empty_dirs(&index_dir)?;
 
@@ -577,13 +877,17 @@ pub fn cleanup_index(
 }
 
 pub fn get_index_stats(path: &Path) -> Result<IndexStats> {
-    let index_dir = path.join(".cs");
+    let index_dir = cs_core::locations::index_dir(path);
     if !index_dir.exists() {
         return Ok(IndexStats::default());
     }
 
     let manifest_path = index_dir.join("manifest.json");
-    let mut manifest = load_or_create_manifest(&manifest_path)?;
+    let mut manifest = if !manifest_path.exists() && shards::is_sharded(path) {
+        shards::combined_manifest(path)?
+    } else {
+        load_or_create_manifest(&manifest_path)?
+    };
     normalize_manifest_paths(&mut manifest, path);
 
     let mut stats = IndexStats {
@@ -595,9 +899,7 @@ pub fn get_index_stats(path: &Path) -> Result<IndexStats> {
 
     // Calculate total chunks and size
     for file_path in manifest.files.keys() {
-        let standard_path = path_utils::from_manifest_path(file_path);
-        let sidecar_path =
-            path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path);
+        let sidecar_path = shards::sidecar_path(path, file_path);
         if sidecar_path.exists()
             && let Ok(entry) = load_index_entry(&sidecar_path)
         {
@@ -631,6 +933,63 @@ pub fn get_index_stats(path: &Path) -> Result<IndexStats> {
     Ok(stats)
 }
 
+/// Check the index at `path` against its manifest without changing anything.
+pub fn check_index_consistency(path: &Path) -> Result<IndexConsistency> {
+    let index_dir = cs_core::locations::index_dir(path);
+    let manifest_path = index_dir.join("manifest.json");
+    let mut manifest = if !manifest_path.exists() && shards::is_sharded(path) {
+        shards::combined_manifest(path)?
+    } else {
+        load_or_create_manifest(&manifest_path)?
+    };
+    normalize_manifest_paths(&mut manifest, path);
+
+    let mut consistency = IndexConsistency {
+        manifest_entries: manifest.files.len(),
+        ..Default::default()
+    };
+    for file_path in manifest.files.keys() {
+        if !path
+            .join(path_utils::from_manifest_path(file_path))
+            .exists()
+        {
+            consistency.missing_files += 1;
+        }
+        let sidecar_path = shards::sidecar_path(path, file_path);
+        if !sidecar_path.exists() || load_index_entry(&sidecar_path).is_err() {
+            consistency.broken_entries += 1;
+        }
+    }
+
+    // Shards keep their own manifests
+    let shards_dir = index_dir.join(shards::SHARDS_DIR);
+    for entry in WalkDir::new(&index_dir)
+        .into_iter()
+        .filter_entry(|e| e.path() != shards_dir)
+        .flatten()
+    {
+        if entry.file_type().is_file()
+            && entry.path().extension().and_then(|s| s.to_str()) == Some("cs")
+            && let Some(standard_path) =
+                path_utils::sidecar_to_standard_path(entry.path(), &index_dir)
+            && !manifest
+                .files
+                .contains_key(&path_utils::to_manifest_path(&standard_path))
+        {
+            consistency.orphaned_sidecars += 1;
+        }
+    }
+
+    consistency.damaged_segments = segments::damaged(&index_dir).len();
+    if shards::is_sharded(path) {
+        for shard in shards::list_shards(path)? {
+            consistency.damaged_segments += segments::damaged(&shard.dir).len();
+        }
+    }
+
+    Ok(consistency)
+}
+
 pub async fn smart_update_index(
     path: &Path,
     compute_embeddings: bool,
@@ -683,19 +1042,69 @@ pub async fn smart_update_index_with_detailed_progress(
     exclude_patterns: &[String],
     model: Option<&str>,
 ) -> Result<UpdateStats> {
-    let index_dir = path.join(".cs");
+    smart_update_index_with_context(
+        path,
+        force_rebuild,
+        progress_callback,
+        detailed_progress_callback,
+        compute_embeddings,
+        respect_gitignore,
+        exclude_patterns,
+        model,
+        &OperationContext::default(),
+    )
+    .await
+}
+
+/// Indexing that reports each file to be indexed to `ctx` and stops between
+/// files once it's cancelled, with `CcError::Cancelled`. Files indexed by
+/// then stay in the index. A rebuild or a sharded index is only checked for
+/// cancellation before it starts.
+#[allow(clippy::too_many_arguments)]
+#[tracing::instrument(name = "index_update", skip_all, fields(path = %path.display()))]
+pub async fn smart_update_index_with_context(
+    path: &Path,
+    force_rebuild: bool,
+    progress_callback: Option<ProgressCallback>,
+    detailed_progress_callback: Option<DetailedProgressCallback>,
+    compute_embeddings: bool,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+    model: Option<&str>,
+    ctx: &OperationContext,
+) -> Result<UpdateStats> {
+    bundle::ensure_writable(path)?;
+    let index_dir = cs_core::locations::index_dir(path);
     let mut stats = UpdateStats::default();
 
-    // Set up interrupt handler (only once per process)
-    HANDLER_INIT.call_once(|| {
-        let _ = ctrlc::set_handler(move || {
-            INTERRUPTED.store(true, Ordering::SeqCst);
-            eprintln!("\nIndexing interrupted by user. Cleaning up...");
-        });
-    });
+    reset_interrupt();
+    ctx.check()?;
+    upgrade_index_format(path)?;
 
-    // Reset interrupt flag for this indexing operation
-    INTERRUPTED.store(false, Ordering::SeqCst);
+    // A sharded index is refreshed shard by shard
+    if shards::is_sharded(path) && !index_dir.join("manifest.json").exists() {
+        let shard_stats = shards::build_shards(
+            path,
+            &shards::ShardBuildOptions {
+                only: &[],
+                compute_embeddings,
+                respect_gitignore,
+                exclude_patterns,
+                model,
+                jobs: 1,
+                // Search-time updates may use narrower excludes than the build did
+                prune: force_rebuild,
+                by_project: false,
+            },
+        )?;
+        for shard in shard_stats {
+            stats.files_indexed += shard.files_indexed;
+            stats.files_up_to_date += shard.files_up_to_date;
+            stats.files_errored += shard.files_errored;
+            stats.orphaned_files_removed += shard.files_removed;
+        }
+        return Ok(stats);
+    }
 
     if force_rebuild {
         clean_index(path)?;
@@ -722,9 +1131,14 @@ pub async fn smart_update_index_with_detailed_progress(
     // Then perform incremental update
     fs::create_dir_all(&index_dir)?;
     let manifest_path = index_dir.join("manifest.json");
+    let mut journal = journal::Journal::open(&manifest_path)?;
     let mut manifest = load_or_create_manifest(&manifest_path)?;
     normalize_manifest_paths(&mut manifest, &repo_root);
 
+    if compute_embeddings {
+        validate_manifest_model(&manifest)?;
+    }
+
     // Handle model configuration for embeddings
     let (resolved_model, _model_dimensions) = if compute_embeddings {
         // Resolve the model name and get its dimensions
@@ -763,7 +1177,7 @@ pub async fn smart_update_index_with_detailed_progress(
                 if model_dims != existing_dims {
                     return Err(anyhow::anyhow!(
                         "Model mismatch: Index was created with '{}' ({} dims), but you're trying to use '{}' ({} dims). \
-                        Dimension mismatch prevents cross-model queries. Please run 'cc --clean .' to remove the old index, then 'cc --index --model {}' to rebuild with the new model.",
+                        Dimension mismatch prevents cross-model queries. Run 'cs --switch-model {}' to re-index with the new model, or drop '--model' to keep using the existing index.",
                         existing_model,
                         existing_dims,
                         selected_model,
@@ -791,6 +1205,8 @@ pub async fn smart_update_index_with_detailed_progress(
             // Set the model info in the manifest
             manifest.embedding_model = Some(selected_model.clone());
             manifest.embedding_dimensions = Some(model_dims);
+            manifest.embedding_model_version =
+                Some(cs_embed::EMBEDDING_PIPELINE_VERSION.to_string());
             (selected_model, model_dims)
         };
 
@@ -805,6 +1221,7 @@ pub async fn smart_update_index_with_detailed_progress(
 
     // First pass: determine which files need updating and collect stats
     let mut files_to_update = Vec::new();
+    let mut new_files = Vec::new();
     let mut manifest_changed = false;
 
     for file_path in current_files {
@@ -813,6 +1230,7 @@ pub async fn smart_update_index_with_detailed_progress(
             eprintln!("Indexing interrupted during file scanning.");
             return Ok(stats);
         }
+        ctx.check()?;
 
         let manifest_key =
             path_utils::to_manifest_path(&path_utils::to_standard_path(&file_path, &repo_root));
@@ -869,8 +1287,44 @@ pub async fn smart_update_index_with_detailed_progress(
                 manifest_changed = true;
             }
         } else {
-            stats.files_added += 1;
-            files_to_update.push(file_path);
+            new_files.push(file_path);
+        }
+    }
+
+    // A new file with the contents of one that's gone was renamed: its
+    // sidecar moves with it instead of being indexed again
+    let mut vanished = if new_files.is_empty() {
+        HashMap::new()
+    } else {
+        renames::vanished_files(&manifest, &repo_root)
+    };
+    let mut renamed = Vec::new();
+    for file_path in new_files {
+        if let Some(metadata) = (!vanished.is_empty())
+            .then(|| current_metadata(&file_path, &repo_root))
+            .flatten()
+            && let Some(from) = vanished
+                .get_mut(&metadata.hash)
+                .and_then(|candidates| renames::take_source(candidates, &metadata.path))
+        {
+            let to = metadata.path.clone();
+            match renames::carry_over(path, &mut manifest, &mut journal, &from, metadata) {
+                Ok(()) => {
+                    stats.files_renamed += 1;
+                    renamed.push((from, to));
+                    manifest_changed = true;
+                    continue;
+                }
+                Err(e) => tracing::debug!("Indexing {:?} afresh: {}", file_path, e),
+            }
+        }
+        stats.files_added += 1;
+        files_to_update.push(file_path);
+    }
+    if !renamed.is_empty() {
+        save_manifest(&manifest_path, &manifest)?;
+        if let Err(e) = renames::record_renames(&repo_root, &renamed) {
+            tracing::warn!("Failed to log renamed files: {}", e);
         }
     }
 
@@ -880,7 +1334,10 @@ pub async fn smart_update_index_with_detailed_progress(
         let mut embedder = cs_embed::create_embedder(resolved_model.as_deref())?;
         let mut _processed_count = 0;
 
-        for file_path in files_to_update.iter() {
+        for (file_number, file_path) in files_to_update.iter().enumerate() {
+            if ctx.is_cancelled() {
+                break;
+            }
             // Check for interrupt
             if INTERRUPTED.load(Ordering::SeqCst) {
                 eprintln!(
@@ -889,6 +1346,12 @@ pub async fn smart_update_index_with_detailed_progress(
                 );
                 break;
             }
+            ctx.report(
+                Operation::Index,
+                file_number,
+                files_to_update.len(),
+                Some(file_path.display().to_string()),
+            );
 
             if let Some(ref callback) = progress_callback
                 && let Some(file_name) = file_path.file_name()
@@ -912,8 +1375,10 @@ pub async fn smart_update_index_with_detailed_progress(
 
             match result {
                 Ok(entry) => {
+                    let _span = tracing::info_span!("store").entered();
                     // Write sidecar immediately
                     let sidecar_path = get_sidecar_path(path, file_path);
+                    journal.writing(&entry.metadata.path, &sidecar_path)?;
                     save_index_entry(&sidecar_path, &entry)?;
 
                     // Update and save manifest immediately
@@ -927,13 +1392,13 @@ pub async fn smart_update_index_with_detailed_progress(
                     _processed_count += 1;
                 }
                 Err(e) => {
-                    // Suppress warnings for binary files and UTF-8 errors in .git directories
+                    // Suppress warnings for skipped files and UTF-8 errors in .git directories
                     let error_msg = e.to_string();
-                    let is_binary_skip = error_msg.contains("Binary file, skipping");
+                    let is_skip = read_limits::is_skip(&error_msg);
                     let is_utf8_error = error_msg.contains("stream did not contain valid UTF-8");
                     let is_git_file = file_path.components().any(|c| c.as_os_str() == ".git");
 
-                    if !(is_binary_skip || is_utf8_error && is_git_file) {
+                    if !(is_skip || is_utf8_error && is_git_file) {
                         tracing::warn!("Failed to index {:?}: {}", file_path, e);
                     }
                     stats.files_errored += 1;
@@ -950,6 +1415,9 @@ pub async fn smart_update_index_with_detailed_progress(
         let (tx, rx) = mpsc::channel();
         let files_clone = files_to_update.clone();
         let path_clone = path.to_path_buf();
+        // Workers' file spans belong to this update
+        let update_span = tracing::Span::current();
+        let cancel = ctx.cancel_token().clone();
 
         // Spawn worker thread for parallel processing
         let worker_handle = thread::spawn(move || {
@@ -961,6 +1429,10 @@ pub async fn smart_update_index_with_detailed_progress(
                 if INTERRUPTED.load(Ordering::SeqCst) {
                     return Err("interrupted");
                 }
+                if cancel.is_cancelled() {
+                    return Err("cancelled");
+                }
+                let _update = update_span.enter();
 
                 match index_single_file(file_path, &path_clone, None) {
                     Ok(entry) => {
@@ -970,14 +1442,14 @@ pub async fn smart_update_index_with_detailed_progress(
                         }
                     }
                     Err(e) => {
-                        // Suppress warnings for binary files and UTF-8 errors in .git directories
+                        // Suppress warnings for skipped files and UTF-8 errors in .git directories
                         let error_msg = e.to_string();
-                        let is_binary_skip = error_msg.contains("Binary file, skipping");
+                        let is_skip = read_limits::is_skip(&error_msg);
                         let is_utf8_error =
                             error_msg.contains("stream did not contain valid UTF-8");
                         let is_git_file = file_path.components().any(|c| c.as_os_str() == ".git");
 
-                        if !(is_binary_skip || is_utf8_error && is_git_file) {
+                        if !(is_skip || is_utf8_error && is_git_file) {
                             tracing::warn!("Failed to index {:?}: {}", file_path, e);
                         }
                     }
@@ -994,6 +1466,11 @@ pub async fn smart_update_index_with_detailed_progress(
         // Main thread: stream results as they arrive
         let mut _processed_count = 0;
         while let Ok((file_path, entry)) = rx.recv() {
+            let _span = tracing::info_span!("store").entered();
+            if ctx.is_cancelled() {
+                drop(rx);
+                break;
+            }
             // Check for interrupt
             if INTERRUPTED.load(Ordering::SeqCst) {
                 eprintln!(
@@ -1003,6 +1480,12 @@ pub async fn smart_update_index_with_detailed_progress(
                 drop(rx); // Drop receiver to signal worker to stop
                 break;
             }
+            ctx.report(
+                Operation::Index,
+                _processed_count,
+                files_to_update.len(),
+                Some(file_path.display().to_string()),
+            );
 
             if let Some(ref callback) = progress_callback
                 && let Some(file_name) = file_path.file_name()
@@ -1012,6 +1495,7 @@ pub async fn smart_update_index_with_detailed_progress(
 
             // Write sidecar immediately
             let sidecar_path = get_sidecar_path(path, &file_path);
+            journal.writing(&entry.metadata.path, &sidecar_path)?;
             save_index_entry(&sidecar_path, &entry)?;
 
             // Update and save manifest immediately
@@ -1044,10 +1528,76 @@ pub async fn smart_update_index_with_detailed_progress(
             .as_secs();
         save_manifest(&manifest_path, &manifest)?;
     }
+    let written = journal.commit()?;
+    enforce_size_budget(path, &mut manifest);
+    segments::add(&index_dir, &manifest, &written);
+    refresh_derived_data(path, &manifest);
 
+    ctx.check()?;
     Ok(stats)
 }
 
+/// The manifest metadata of `file` as it is now.
+fn current_metadata(file: &Path, repo_root: &Path) -> Option<FileMetadata> {
+    let fs_meta = fs::metadata(file).ok()?;
+    Some(FileMetadata {
+        path: path_utils::to_manifest_path(&path_utils::to_standard_path(file, repo_root)),
+        hash: compute_file_hash(file).ok()?,
+        last_modified: fs_meta
+            .modified()
+            .ok()?
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .ok()?
+            .as_secs(),
+        size: fs_meta.len(),
+    })
+}
+
+/// Evict files from an index over the size budget once a run finishes.
+/// Failing to doesn't fail indexing.
+fn enforce_size_budget(repo_root: &Path, manifest: &mut IndexManifest) {
+    let report = match eviction::enforce(repo_root, manifest) {
+        Ok(Some(report)) => report,
+        Ok(None) => return,
+        Err(e) => {
+            tracing::warn!("Failed to enforce the index size budget: {}", e);
+            return;
+        }
+    };
+    if !report.evicted.is_empty() {
+        tracing::info!(
+            "Evicted {} files to keep the index under {} bytes",
+            report.evicted.len(),
+            report.max_bytes
+        );
+    }
+    if report.over_budget() {
+        tracing::warn!(
+            "The index takes {} bytes, over its {} byte budget, with nothing left to evict; add an eviction policy with --evict-policy",
+            report.size_after,
+            report.max_bytes
+        );
+    }
+}
+
+/// Refresh data derived from the manifest once a run finishes: the Go type
+/// map, the log of chunks withheld from remote embedders and the log of
+/// skipped files. None should fail indexing.
+fn refresh_derived_data(repo_root: &Path, manifest: &IndexManifest) {
+    if let Err(e) = go_types::update_go_types(repo_root, manifest) {
+        tracing::warn!("Failed to update Go type index: {}", e);
+    }
+    if let Err(e) = secrets::flush_secrets_log(repo_root, manifest) {
+        tracing::warn!("Failed to update secrets log: {}", e);
+    }
+    if let Err(e) = redaction::save_redaction_map(repo_root) {
+        tracing::warn!("Failed to update redaction map: {}", e);
+    }
+    if let Err(e) = read_limits::flush_skipped_log(repo_root, manifest) {
+        tracing::warn!("Failed to update skipped files log: {}", e);
+    }
+}
+
 fn index_single_file(
     file_path: &Path,
     repo_root: &Path,
@@ -1056,6 +1606,100 @@ fn index_single_file(
     index_single_file_with_progress(file_path, repo_root, embedder, None, 0, 1)
 }
 
+/// Files under `path` that are newer than the index: modified since they were
+/// indexed, or not in the manifest at all. Nothing is written to disk.
+pub fn find_dirty_files(
+    path: &Path,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+) -> Result<Vec<PathBuf>> {
+    let repo_root = find_repo_root(path)?;
+    let manifest_path = cs_core::locations::index_dir(&repo_root).join("manifest.json");
+    if !manifest_path.exists() {
+        return Ok(Vec::new());
+    }
+    let mut manifest = load_or_create_manifest(&manifest_path)?;
+    normalize_manifest_paths(&mut manifest, &repo_root);
+
+    Ok(collect_files(path, respect_gitignore, exclude_patterns)?
+        .into_iter()
+        .filter(|file_path| is_dirty(&manifest, &repo_root, file_path))
+        .collect())
+}
+
+/// Of the `changed` paths under the index at `repo_root`, the files an
+/// update would index that are newer than the index, like
+/// [`find_dirty_files`] would find them. A changed directory stands for
+/// every file under it; paths that are gone are left out.
+pub fn find_dirty_among(
+    repo_root: &Path,
+    changed: &[PathBuf],
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+) -> Result<Vec<PathBuf>> {
+    let manifest_path = cs_core::locations::index_dir(repo_root).join("manifest.json");
+    if !manifest_path.exists() {
+        return Ok(Vec::new());
+    }
+    let mut manifest = load_or_create_manifest(&manifest_path)?;
+    normalize_manifest_paths(&mut manifest, repo_root);
+
+    // One walk pruned to the changed paths applies the same ignore rules and
+    // exclude patterns as a full one, those of their directories included
+    let changed: Vec<PathBuf> = changed
+        .iter()
+        .filter(|path| path.starts_with(repo_root) && path.exists())
+        .cloned()
+        .collect();
+    if changed.is_empty() {
+        return Ok(Vec::new());
+    }
+    Ok(walk_files(
+        repo_root,
+        respect_gitignore,
+        exclude_patterns,
+        Some(&changed),
+    )?
+    .into_iter()
+    .filter(|file_path| is_dirty(&manifest, repo_root, file_path))
+    .collect())
+}
+
+/// Whether `file_path` isn't in `manifest`, or changed since it was indexed.
+fn is_dirty(manifest: &IndexManifest, repo_root: &Path, file_path: &Path) -> bool {
+    let manifest_key =
+        path_utils::to_manifest_path(&path_utils::to_standard_path(file_path, repo_root));
+
+    let Some(metadata) = manifest.files.get(&manifest_key) else {
+        return true;
+    };
+
+    let Ok(fs_meta) = fs::metadata(file_path) else {
+        return false;
+    };
+    let fs_last_modified = fs_meta
+        .modified()
+        .ok()
+        .and_then(|m| m.duration_since(SystemTime::UNIX_EPOCH).ok())
+        .map(|d| d.as_secs());
+
+    if fs_last_modified == Some(metadata.last_modified) && fs_meta.len() == metadata.size {
+        return false;
+    }
+
+    compute_file_hash(file_path).is_ok_and(|hash| hash != metadata.hash)
+}
+
+/// Chunk and embed a single file without touching the on-disk index.
+pub fn index_file_in_memory(
+    file_path: &Path,
+    repo_root: &Path,
+    embedder: &mut Box<dyn cs_embed::Embedder>,
+) -> Result<IndexEntry> {
+    index_single_file_with_progress(file_path, repo_root, Some(embedder), None, 0, 1)
+}
+
+#[tracing::instrument(name = "index_file", skip_all, fields(path = %file_path.display()))]
 fn index_single_file_with_progress(
     file_path: &Path,
     repo_root: &Path,
@@ -1068,10 +1712,16 @@ fn index_single_file_with_progress(
     if !is_text_file(file_path) {
         return Err(anyhow::anyhow!("Binary file, skipping"));
     }
+    let size = fs::metadata(file_path).map(|m| m.len()).unwrap_or(0);
+    if let Some(reason) = read_limits::check(file_path, size, repo_root) {
+        return Err(reason.error());
+    }
 
     // Preprocess file (extracts PDFs to cache, returns path to readable content)
-    let content_path = preprocess_file(file_path, repo_root)?;
-    let content = fs::read_to_string(&content_path)?;
+    let content = tracing::info_span!("read").in_scope(|| -> Result<String> {
+        let content_path = preprocess_file(file_path, repo_root)?;
+        Ok(cs_core::text::read_text(&content_path)?)
+    })?;
 
     // Always use the ORIGINAL file for hash and metadata
     let hash = compute_file_hash(file_path)?;
@@ -1099,8 +1749,11 @@ fn index_single_file_with_progress(
 
     let model_name = embedder.as_ref().map(|e| e.model_name());
     let chunks = cs_chunk::chunk_text_with_model(&content, lang, model_name)?;
+    let generated = generated::is_generated(&content);
+    let license = licenses::detect(&content);
 
-    let chunk_entries: Vec<ChunkEntry> = if let Some(embedder) = embedder {
+    let mut embedder = embedder;
+    let mut chunk_entries: Vec<ChunkEntry> = if let Some(embedder) = embedder.as_mut() {
         let total_chunks = chunks.len();
         let file_name = file_path
             .file_name()
@@ -1131,15 +1784,27 @@ fn index_single_file_with_progress(
                     chunk_size: chunk.text.len(),
                 });
 
-                // Embed single chunk
-                let embeddings = embedder.embed(std::slice::from_ref(&chunk.text))?;
-                let embedding = embeddings.into_iter().next().ok_or_else(|| {
-                    anyhow::anyhow!(
-                        "Embedder returned empty results for chunk {} in file {:?}. This may indicate an issue with the embedding model or chunk content.",
-                        chunk_index,
-                        file_path
-                    )
-                })?;
+                // Embed single chunk, unless it holds secrets that must not leave the machine
+                let embedding = match secrets::screen_chunk(
+                    &**embedder,
+                    repo_root,
+                    &file_metadata.path,
+                    &chunk.text,
+                    &chunk.span,
+                )? {
+                    Some(text) => {
+                        let embeddings = tracing::info_span!("embed", chunks = 1)
+                            .in_scope(|| embedder.embed(std::slice::from_ref(&text)))?;
+                        Some(embeddings.into_iter().next().ok_or_else(|| {
+                            anyhow::anyhow!(
+                                "Embedder returned empty results for chunk {} in file {:?}. This may indicate an issue with the embedding model or chunk content.",
+                                chunk_index,
+                                file_path
+                            )
+                        })?)
+                    }
+                    None => None,
+                };
 
                 let chunk_type_str = match chunk.chunk_type {
                     cs_chunk::ChunkType::Function => Some("function".to_string()),
@@ -1168,7 +1833,7 @@ fn index_single_file_with_progress(
 
                 chunk_entries.push(ChunkEntry {
                     span: chunk.span,
-                    embedding: Some(embedding),
+                    embedding,
                     chunk_type: chunk_type_str,
                     breadcrumb,
                     ancestry,
@@ -1176,33 +1841,61 @@ fn index_single_file_with_progress(
                     estimated_tokens: Some(chunk.metadata.estimated_tokens),
                     leading_trivia,
                     trailing_trivia,
+                    generated,
+                    literals: Vec::new(),
+                    literal_embedding: None,
+                    license: license.clone(),
+                    metadata: BTreeMap::new(),
+                    symbol: chunk.metadata.name.clone(),
+                    sub_embeddings: Vec::new(),
+                    sparse: None,
+                    parent: chunk.metadata.parent.clone(),
+                    signature: None,
+                    signature_embedding: None,
+                    tags: Vec::new(),
                 });
             }
             chunk_entries
         } else {
             // Fallback to batch processing for backward compatibility
-            let chunk_texts: Vec<String> = chunks.iter().map(|c| c.text.clone()).collect();
+            let screened: Vec<Option<String>> = chunks
+                .iter()
+                .map(|c| {
+                    secrets::screen_chunk(
+                        &**embedder,
+                        repo_root,
+                        &file_metadata.path,
+                        &c.text,
+                        &c.span,
+                    )
+                })
+                .collect::<Result<_>>()?;
+            let chunk_texts: Vec<String> = screened.iter().flatten().cloned().collect();
             tracing::info!(
                 "Computing embeddings for {} chunks in {:?}",
                 chunk_texts.len(),
                 file_path
             );
-            let embeddings = embedder.embed(&chunk_texts)?;
+            let embeddings = tracing::info_span!("embed", chunks = chunk_texts.len())
+                .in_scope(|| embedder.embed(&chunk_texts))?;
 
             // Validate that embedder returned the expected number of embeddings
-            if embeddings.len() != chunks.len() {
+            if embeddings.len() != chunk_texts.len() {
                 return Err(anyhow::anyhow!(
                     "Embedder returned {} embeddings for {} chunks in file {:?}. Expected equal counts.",
                     embeddings.len(),
-                    chunks.len(),
+                    chunk_texts.len(),
                     file_path
                 ));
             }
 
+            // Withheld chunks keep their span but get no embedding
+            let mut embeddings = embeddings.into_iter();
             chunks
                 .into_iter()
-                .zip(embeddings)
-                .map(|(chunk, embedding)| {
+                .zip(screened)
+                .map(|(chunk, screened)| {
+                    let embedding = screened.and_then(|_| embeddings.next());
                     let chunk_type_str = match chunk.chunk_type {
                         cs_chunk::ChunkType::Function => Some("function".to_string()),
                         cs_chunk::ChunkType::Class => Some("class".to_string()),
@@ -1228,7 +1921,7 @@ fn index_single_file_with_progress(
                     };
                     ChunkEntry {
                         span: chunk.span,
-                        embedding: Some(embedding),
+                        embedding,
                         chunk_type: chunk_type_str,
                         breadcrumb,
                         ancestry,
@@ -1236,6 +1929,18 @@ fn index_single_file_with_progress(
                         estimated_tokens: Some(chunk.metadata.estimated_tokens),
                         leading_trivia,
                         trailing_trivia,
+                        generated,
+                        literals: Vec::new(),
+                        literal_embedding: None,
+                        license: license.clone(),
+                        metadata: BTreeMap::new(),
+                        symbol: chunk.metadata.name.clone(),
+                        sub_embeddings: Vec::new(),
+                        sparse: None,
+                        parent: chunk.metadata.parent.clone(),
+                        signature: None,
+                        signature_embedding: None,
+                        tags: Vec::new(),
                     }
                 })
                 .collect()
@@ -1278,10 +1983,55 @@ fn index_single_file_with_progress(
                     estimated_tokens: Some(chunk.metadata.estimated_tokens),
                     leading_trivia,
                     trailing_trivia,
+                    generated,
+                    literals: Vec::new(),
+                    literal_embedding: None,
+                    license: license.clone(),
+                    metadata: BTreeMap::new(),
+                    symbol: chunk.metadata.name.clone(),
+                    sub_embeddings: Vec::new(),
+                    sparse: None,
+                    parent: chunk.metadata.parent.clone(),
+                    signature: None,
+                    signature_embedding: None,
+                    tags: Vec::new(),
                 }
             })
             .collect()
     };
+    attach_literals(
+        &mut chunk_entries,
+        &content,
+        lang,
+        embedder.as_deref_mut().map(|e| &mut **e as _),
+        repo_root,
+    )?;
+    multi_vector::attach_sub_embeddings(
+        &mut chunk_entries,
+        &content,
+        embedder.as_deref_mut().map(|e| &mut **e as _),
+        repo_root,
+    )?;
+    signatures::attach_signatures(
+        &mut chunk_entries,
+        &content,
+        lang,
+        embedder.as_deref_mut().map(|e| &mut **e as _),
+        repo_root,
+    )?;
+    intent_tags::attach_tags(
+        &mut chunk_entries,
+        embedder.as_deref_mut().map(|e| &mut **e as _),
+        repo_root,
+    )?;
+    sparse::attach_sparse(&mut chunk_entries, &content, repo_root)?;
+    extractors::tag_chunks(
+        repo_root,
+        file_path.strip_prefix(repo_root).unwrap_or(file_path),
+        lang,
+        &content,
+        &mut chunk_entries,
+    )?;
 
     Ok(IndexEntry {
         metadata: file_metadata,
@@ -1289,10 +2039,186 @@ fn index_single_file_with_progress(
     })
 }
 
+/// Store each chunk's log and error messages, embedding them in one batch
+/// when the chunk itself was embedded.
+fn attach_literals(
+    chunk_entries: &mut [ChunkEntry],
+    content: &str,
+    lang: Option<Language>,
+    embedder: Option<&mut dyn cs_embed::Embedder>,
+    repo_root: &Path,
+) -> Result<()> {
+    for chunk in chunk_entries.iter_mut() {
+        if let Some(text) = content.get(chunk.span.byte_start..chunk.span.byte_end) {
+            chunk.literals = literals::extract_literals(text, lang);
+        }
+    }
+    let Some(embedder) = embedder else {
+        return Ok(());
+    };
+
+    let mut targets = Vec::new();
+    let mut texts = Vec::new();
+    for (i, chunk) in chunk_entries.iter().enumerate() {
+        if chunk.embedding.is_none() || chunk.literals.is_empty() {
+            continue;
+        }
+        if let Some(text) = secrets::screen(
+            &*embedder,
+            repo_root,
+            &literals::literal_text(&chunk.literals),
+        )? {
+            targets.push(i);
+            texts.push(text);
+        }
+    }
+    if texts.is_empty() {
+        return Ok(());
+    }
+    let embeddings = embedder.embed(&texts)?;
+    if embeddings.len() != texts.len() {
+        return Err(anyhow::anyhow!(
+            "Embedder returned {} embeddings for {} sets of string literals",
+            embeddings.len(),
+            texts.len()
+        ));
+    }
+    for (i, embedding) in targets.into_iter().zip(embeddings) {
+        chunk_entries[i].literal_embedding = Some(embedding);
+    }
+    Ok(())
+}
+
+/// Sidecar file holding the chunks of manifest entry `manifest_key` (e.g. "./src/lib.rs").
+pub fn sidecar_path_for_manifest_key(index_dir: &Path, manifest_key: &Path) -> PathBuf {
+    path_utils::get_sidecar_path_for_standard_path(
+        index_dir,
+        &path_utils::from_manifest_path(manifest_key),
+    )
+}
+
+/// Load the manifest of the index at `repo_root`, if one exists.
+pub fn load_manifest(repo_root: &Path) -> Result<Option<IndexManifest>> {
+    let manifest_path = cs_core::locations::index_dir(repo_root).join("manifest.json");
+    if !manifest_path.exists() {
+        return Ok(None);
+    }
+    load_or_create_manifest(&manifest_path).map(Some)
+}
+
+/// Files in the index at `repo_root`, shards included, or `None` if there's
+/// no index.
+pub fn indexed_files(repo_root: &Path) -> Result<Option<Vec<PathBuf>>> {
+    let mut manifest = match load_manifest(repo_root)? {
+        Some(manifest) => manifest,
+        None if shards::is_sharded(repo_root) => shards::combined_manifest(repo_root)?,
+        None => return Ok(None),
+    };
+    normalize_manifest_paths(&mut manifest, repo_root);
+
+    let mut files: Vec<PathBuf> = manifest
+        .files
+        .keys()
+        .map(|key| repo_root.join(path_utils::from_manifest_path(key)))
+        .collect();
+    files.sort();
+    Ok(Some(files))
+}
+
+/// Identifies the current contents of the index at `repo_root`: a hash of
+/// its manifests, commit index, collections and memories, which every update
+/// rewrites. Data derived from search results is valid for as long as the
+/// generation is unchanged.
+pub fn index_generation(repo_root: &Path) -> String {
+    let index_dir = cs_core::locations::index_dir(repo_root);
+    let mut shard_manifests: Vec<PathBuf> = fs::read_dir(index_dir.join(shards::SHARDS_DIR))
+        .into_iter()
+        .flatten()
+        .flatten()
+        .map(|entry| entry.path().join("manifest.json"))
+        .collect();
+    shard_manifests.sort();
+    let mut files = vec![
+        index_dir.join("manifest.json"),
+        index_dir.join(commits::COMMITS_FILE),
+        // Hot chunks are scored by the hot model's vectors, which it tracks
+        index_dir.join(hot_chunks::HOT_CHUNKS_FILE),
+        // Each batch of a model migration changes the chunks some files are
+        // scored by, and rewrites it
+        index_dir.join(model_migration::MIGRATION_FILE),
+    ];
+    files.extend(shard_manifests);
+    files.extend(collections::collection_files(repo_root));
+    files.push(index_dir.join(memories::MEMORIES_FILE));
+
+    let mut hasher = blake3::Hasher::new();
+    for file in files {
+        if let Ok(data) = fs::read(&file) {
+            hasher.update(file.to_string_lossy().as_bytes());
+            hasher.update(&(data.len() as u64).to_le_bytes());
+            hasher.update(&data);
+        }
+    }
+    // Memories stop being searched when they expire, not when the file changes
+    hasher.update(&(memories::expired(repo_root) as u64).to_le_bytes());
+    hasher.finalize().to_hex().to_string()
+}
+
+/// Fail fast when this build can't read the index's format, or the stored
+/// vectors can't be compared with vectors it produces.
+///
+/// Indexes written before the pipeline version was recorded are assumed compatible.
+pub fn validate_manifest_model(manifest: &IndexManifest) -> Result<()> {
+    index_format::check(&manifest.version)?;
+    validate_model_version(
+        manifest.embedding_model.as_deref(),
+        manifest.embedding_model_version.as_deref(),
+    )
+}
+
+fn validate_model_version(model: Option<&str>, version: Option<&str>) -> Result<()> {
+    let (Some(model), Some(version)) = (model, version) else {
+        return Ok(());
+    };
+
+    if version != cs_embed::EMBEDDING_PIPELINE_VERSION {
+        return Err(anyhow::anyhow!(
+            "Index embeddings were produced by embedding pipeline v{} (model '{}'), but this version of cs uses v{}. \
+            Stored vectors are not comparable with new queries. Run 'cs --switch-model {} --force' to re-index.",
+            version,
+            model,
+            cs_embed::EMBEDDING_PIPELINE_VERSION,
+            model
+        ));
+    }
+
+    Ok(())
+}
+
+/// Bring the index at `repo_root` up to the current format, when it's older
+/// and can be upgraded in place.
+pub fn upgrade_index_format(repo_root: &Path) -> Result<()> {
+    for upgrade in index_format::upgrade(repo_root)? {
+        tracing::info!(
+            "Upgraded the index at {} from format v{} to v{}",
+            repo_root.display(),
+            upgrade.from,
+            upgrade.to
+        );
+        if upgrade.files_to_reindex > 0 {
+            tracing::warn!(
+                "{} files of the index at {} were in an older layout and will be re-embedded on the next update",
+                upgrade.files_to_reindex,
+                repo_root.display()
+            );
+        }
+    }
+    Ok(())
+}
+
 fn load_or_create_manifest(path: &Path) -> Result<IndexManifest> {
     if path.exists() {
-        let data = fs::read(path)?;
-        Ok(serde_json::from_slice(&data)?)
+        manifest_format::decode(&fs::read(path)?)
     } else {
         Ok(IndexManifest::default())
     }
@@ -1324,12 +2250,11 @@ fn normalize_manifest_paths(manifest: &mut IndexManifest, repo_root: &Path) {
 }
 
 fn save_manifest(path: &Path, manifest: &IndexManifest) -> Result<()> {
-    let data = serde_json::to_vec_pretty(manifest)?;
-    atomic_write(path, &data)
+    atomic_write(path, &manifest_format::encode(manifest)?)
 }
 
 fn save_index_entry(path: &Path, entry: &IndexEntry) -> Result<()> {
-    let data = bincode::serialize(entry)?;
+    let data = encryption::seal_for(path, bincode::serialize(entry)?)?;
     atomic_write(path, &data)
 }
 
@@ -1341,34 +2266,48 @@ fn atomic_write(path: &Path, data: &[u8]) -> Result<()> {
     tmp.write_all(data)?;
     tmp.as_file().sync_all()?;
 
-    if path.exists() {
-        fs::remove_file(path)?;
-    }
-
+    // The rename replaces `path` in one step: a crash leaves the old
+    // contents or the new, never neither.
     tmp.persist(path)?;
+    #[cfg(unix)]
+    fs::File::open(parent)?.sync_all()?;
     Ok(())
 }
 
 pub fn load_index_entry(path: &Path) -> Result<IndexEntry> {
-    let data = fs::read(path)?;
+    let data = encryption::open_from(path, fs::read(path)?)?;
     Ok(bincode::deserialize(&data)?)
 }
 
-fn find_repo_root(path: &Path) -> Result<PathBuf> {
+/// Nearest ancestor of `path` containing `.cs` or `.git` (or `path` itself).
+pub fn find_repo_root(path: &Path) -> Result<PathBuf> {
     let mut current = if path.is_file() {
         path.parent().unwrap_or(path)
     } else {
         path
     };
 
+    // A submodule or worktree indexed with an enclosing checkout is only
+    // the root when there's no enclosing checkout after all
+    let mut nested = None;
     loop {
-        if current.join(".cs").exists() || current.join(".git").exists() {
+        if cs_core::locations::index_dir(current).exists() {
             return Ok(current.to_path_buf());
         }
+        match traversal::checkout_at(current) {
+            Some(traversal::Checkout::Repository) => return Ok(current.to_path_buf()),
+            Some(checkout) if !traversal::part_of_enclosing(checkout) => {
+                return Ok(current.to_path_buf());
+            }
+            Some(_) => {
+                nested.get_or_insert(current);
+            }
+            None => {}
+        }
 
         match current.parent() {
             Some(parent) => current = parent,
-            None => return Ok(path.to_path_buf()),
+            None => return Ok(nested.unwrap_or(path).to_path_buf()),
         }
     }
 }
@@ -1428,12 +2367,10 @@ fn is_text_file(path: &Path) -> bool {
         return true;
     }
 
-    // Use NUL byte heuristic like ripgrep - read first 8KB and check for NUL bytes
-    const BUFFER_SIZE: usize = 8192;
-
+    // NUL byte heuristic like ripgrep on the first 8KB, plus control bytes
     match std::fs::File::open(path) {
         Ok(mut file) => {
-            let mut buffer = vec![0; BUFFER_SIZE];
+            let mut buffer = vec![0; read_limits::SNIFF_BYTES];
             match file.read(&mut buffer) {
                 Ok(bytes_read) => {
                     // If file is empty, consider it text
@@ -1441,8 +2378,9 @@ fn is_text_file(path: &Path) -> bool {
                         return true;
                     }
 
-                    // Check for NUL bytes in the read portion
-                    !buffer[..bytes_read].contains(&0)
+                    let prefix = &buffer[..bytes_read];
+                    cs_core::text::detect_utf16(prefix).is_some()
+                        || !read_limits::looks_binary(prefix)
                 }
                 Err(_) => false, // If we can't read, assume binary
             }
@@ -1497,6 +2435,8 @@ fn remove_empty_dirs(dir: &Path) -> Result<()> {
 pub struct CleanupStats {
     pub orphaned_entries_removed: usize,
     pub orphaned_sidecars_removed: usize,
+    /// Index segments that couldn't be read
+    pub damaged_segments_removed: usize,
 }
 
 #[derive(Debug, Clone, Default, Serialize, Deserialize)]
@@ -1510,6 +2450,20 @@ pub struct IndexStats {
     pub index_updated: u64,
 }
 
+/// Problems found by [`check_index_consistency`].
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct IndexConsistency {
+    pub manifest_entries: usize,
+    /// Manifest entries whose sidecar is missing or unreadable
+    pub broken_entries: usize,
+    /// Sidecars with no manifest entry
+    pub orphaned_sidecars: usize,
+    /// Manifest entries whose source file is gone
+    pub missing_files: usize,
+    /// Index segments that can't be read
+    pub damaged_segments: usize,
+}
+
 #[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct UpdateStats {
     pub files_indexed: usize,
@@ -1518,6 +2472,8 @@ pub struct UpdateStats {
     pub files_up_to_date: usize,
     pub files_errored: usize,
     pub orphaned_files_removed: usize,
+    /// New files that were renamed from indexed ones, keeping their chunks
+    pub files_renamed: usize,
 }
 
 #[cfg(test)]
@@ -1722,6 +2678,174 @@ mod tests {
         assert_eq!(stats4.files_indexed, 1);
     }
 
+    #[tokio::test]
+    async fn test_update_with_context() {
+        let temp_dir = TempDir::new().unwrap();
+        let test_path = temp_dir.path();
+        fs::write(test_path.join("file1.txt"), "initial content").unwrap();
+
+        let cancel = cs_core::context::CancelToken::new();
+        cancel.cancel();
+        let cancelled = OperationContext::new().with_cancel(cancel);
+        let err = smart_update_index_with_context(
+            test_path,
+            false,
+            None,
+            None,
+            false,
+            true,
+            &[],
+            None,
+            &cancelled,
+        )
+        .await
+        .unwrap_err();
+        assert!(matches!(
+            err.downcast_ref::<cs_core::CcError>(),
+            Some(cs_core::CcError::Cancelled)
+        ));
+        assert!(load_manifest(test_path).unwrap().is_none());
+
+        let reported = std::sync::Arc::new(std::sync::Mutex::new(Vec::new()));
+        let seen = reported.clone();
+        let ctx = OperationContext::new().with_progress(move |progress| {
+            seen.lock().unwrap().push((progress.done, progress.total));
+        });
+        let stats = smart_update_index_with_context(
+            test_path,
+            false,
+            None,
+            None,
+            false,
+            true,
+            &[],
+            None,
+            &ctx,
+        )
+        .await
+        .unwrap();
+        assert_eq!(stats.files_indexed, 1);
+        assert_eq!(*reported.lock().unwrap(), [(0, 1)]);
+    }
+
+    #[tokio::test]
+    async fn test_renamed_files_keep_their_chunks() {
+        let temp_dir = TempDir::new().unwrap();
+        let test_path = temp_dir.path();
+        fs::create_dir_all(test_path.join("src")).unwrap();
+        fs::write(test_path.join("src/auth.rs"), "fn login() {}\n").unwrap();
+        fs::write(test_path.join("src/db.rs"), "fn connect() {}\n").unwrap();
+        smart_update_index(test_path, false, true, &[])
+            .await
+            .unwrap();
+
+        fs::create_dir_all(test_path.join("src/auth")).unwrap();
+        fs::rename(
+            test_path.join("src/auth.rs"),
+            test_path.join("src/auth/mod.rs"),
+        )
+        .unwrap();
+        fs::rename(test_path.join("src/db.rs"), test_path.join("src/store.rs")).unwrap();
+        fs::write(test_path.join("src/store.rs"), "fn connect(url: &str) {}\n").unwrap();
+        let stats = smart_update_index(test_path, false, true, &[])
+            .await
+            .unwrap();
+
+        // Moved as it was, the file keeps its sidecar; edited too, it's new
+        assert_eq!(stats.files_renamed, 1);
+        assert_eq!(stats.files_added, 1);
+        assert_eq!(stats.files_indexed, 1);
+        let index_dir = cs_core::locations::index_dir(test_path);
+        assert!(!index_dir.join("src/auth.rs.cs").exists());
+        let moved = load_index_entry(&index_dir.join("src/auth/mod.rs.cs")).unwrap();
+        assert_eq!(
+            moved.metadata.path,
+            path_utils::to_manifest_path(Path::new("src/auth/mod.rs"))
+        );
+        let manifest = load_manifest(test_path).unwrap().unwrap();
+        assert!(
+            !manifest
+                .files
+                .contains_key(&path_utils::to_manifest_path(Path::new("src/auth.rs")))
+        );
+
+        let log = renames::RenameLog::load(test_path);
+        assert_eq!(
+            log.current_path("src/auth.rs").as_deref(),
+            Some("src/auth/mod.rs")
+        );
+        assert_eq!(log.current_path("src/db.rs"), None);
+    }
+
+    #[tokio::test]
+    async fn test_find_dirty_files() {
+        let temp_dir = TempDir::new().unwrap();
+        let test_path = temp_dir.path();
+
+        fs::write(test_path.join("clean.txt"), "unchanged").unwrap();
+        fs::write(test_path.join("edited.txt"), "before").unwrap();
+        smart_update_index(test_path, false, true, &[])
+            .await
+            .unwrap();
+        assert!(find_dirty_files(test_path, true, &[]).unwrap().is_empty());
+
+        fs::write(test_path.join("edited.txt"), "after the edit").unwrap();
+        fs::write(test_path.join("new.txt"), "brand new").unwrap();
+
+        let mut dirty: Vec<String> = find_dirty_files(test_path, true, &[])
+            .unwrap()
+            .iter()
+            .map(|p| p.file_name().unwrap().to_string_lossy().to_string())
+            .collect();
+        dirty.sort();
+        assert_eq!(dirty, vec!["edited.txt", "new.txt"]);
+
+        // Detection is read-only: the files stay dirty until the index is updated
+        assert_eq!(find_dirty_files(test_path, true, &[]).unwrap().len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_find_dirty_among() {
+        let temp_dir = TempDir::new().unwrap();
+        let test_path = temp_dir.path();
+
+        fs::write(test_path.join(".ignore"), "build/\n").unwrap();
+        fs::write(test_path.join("clean.txt"), "unchanged").unwrap();
+        fs::write(test_path.join("edited.txt"), "before").unwrap();
+        smart_update_index(test_path, false, true, &[])
+            .await
+            .unwrap();
+
+        fs::write(test_path.join("edited.txt"), "after the edit").unwrap();
+        fs::create_dir_all(test_path.join("build")).unwrap();
+        fs::write(test_path.join("build/out.txt"), "generated").unwrap();
+        fs::create_dir_all(test_path.join("src/nested")).unwrap();
+        fs::write(test_path.join("src/nested/new.txt"), "brand new").unwrap();
+        fs::write(test_path.join("untouched.txt"), "not in the batch").unwrap();
+
+        let changed = [
+            "clean.txt",
+            "edited.txt",
+            "build/out.txt",
+            "src",
+            "deleted.txt",
+        ]
+        .map(|name| test_path.join(name));
+        let mut dirty: Vec<PathBuf> = find_dirty_among(test_path, &changed, true, &[])
+            .unwrap()
+            .iter()
+            .map(|p| p.strip_prefix(test_path).unwrap().to_path_buf())
+            .collect();
+        dirty.sort();
+        assert_eq!(
+            dirty,
+            vec![
+                PathBuf::from("edited.txt"),
+                PathBuf::from("src/nested/new.txt")
+            ]
+        );
+    }
+
     #[test]
     fn test_cleanup_index() {
         let temp_dir = TempDir::new().unwrap();
@@ -1867,6 +2991,109 @@ mod tests {
         assert!(!test_path.join("level1").join("level2").exists());
         assert!(!test_path.join("level1").exists());
     }
+
+    #[test]
+    fn test_validate_manifest_model() {
+        let mut manifest = IndexManifest {
+            embedding_model: Some("BAAI/bge-small-en-v1.5".to_string()),
+            embedding_dimensions: Some(384),
+            ..Default::default()
+        };
+
+        // Legacy manifests without a pipeline version are accepted
+        assert!(validate_manifest_model(&manifest).is_ok());
+
+        manifest.embedding_model_version = Some(cs_embed::EMBEDDING_PIPELINE_VERSION.to_string());
+        assert!(validate_manifest_model(&manifest).is_ok());
+
+        manifest.embedding_model_version = Some("0-legacy".to_string());
+        let err = validate_manifest_model(&manifest).unwrap_err().to_string();
+        assert!(err.contains("--switch-model"));
+
+        // Old manifest JSON without the new field still deserializes
+        let legacy = r#"{"version":"0.1.0","created":0,"updated":0,"files":{},"embedding_model":null,"embedding_dimensions":null}"#;
+        let parsed: IndexManifest = serde_json::from_str(legacy).unwrap();
+        assert!(parsed.embedding_model_version.is_none());
+    }
+
+    #[test]
+    fn test_collect_files_exclude_patterns() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join("Generated").join("api")).unwrap();
+        fs::write(root.join("Generated").join("api").join("client.rs"), "fn a() {}").unwrap();
+        fs::write(root.join("main.rs"), "fn main() {}").unwrap();
+
+        let names = |patterns: &[&str]| -> Vec<String> {
+            let patterns: Vec<String> = patterns.iter().map(|p| p.to_string()).collect();
+            let mut names: Vec<String> = collect_files(root, false, &patterns)
+                .unwrap()
+                .iter()
+                .map(|f| cs_core::paths::to_slash(f.strip_prefix(root).unwrap()))
+                .collect();
+            names.sort();
+            names
+        };
+
+        assert_eq!(names(&[]), ["Generated/api/client.rs", "main.rs"]);
+        assert_eq!(names(&["Generated/**"]), ["main.rs"]);
+        if cfg!(windows) {
+            // Windows users write either separator and any case
+            assert_eq!(names(&[r"generated\**"]), ["main.rs"]);
+        } else {
+            assert_eq!(names(&["generated/**"]).len(), 2);
+        }
+    }
+
+    #[test]
+    fn test_excluded_files_say_why() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join(".git")).unwrap();
+        fs::write(root.join(".gitignore"), "fixtures/\n").unwrap();
+        for dir in ["fixtures", "third_party/acme", "src"] {
+            fs::create_dir_all(root.join(dir)).unwrap();
+        }
+        fs::write(root.join("fixtures").join("retry.rs"), "fn retry() {}").unwrap();
+        fs::write(root.join("third_party/acme/retry.rs"), "fn retry() {}").unwrap();
+        fs::write(root.join("src").join("main.rs"), "fn main() {}").unwrap();
+
+        let relative = |file: PathBuf| cs_core::paths::to_slash(file.strip_prefix(root).unwrap());
+        let mut excluded: Vec<(String, Exclusion)> =
+            excluded_files(root, true, &["third_party/".to_string()])
+                .unwrap()
+                .into_iter()
+                .map(|(file, why)| (relative(file), why))
+                .collect();
+        excluded.sort_by(|a, b| a.0.cmp(&b.0));
+        assert_eq!(
+            excluded,
+            [
+                ("fixtures/retry.rs".to_string(), Exclusion::Gitignore),
+                (
+                    "third_party/acme/retry.rs".to_string(),
+                    Exclusion::Pattern("third_party/".to_string())
+                ),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_index_generation_tracks_manifest_changes() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join(".cs")).unwrap();
+        let manifest_path = root.join(".cs").join("manifest.json");
+
+        let mut manifest = IndexManifest::default();
+        save_manifest(&manifest_path, &manifest).unwrap();
+        let first = index_generation(root);
+        assert_eq!(index_generation(root), first);
+
+        manifest.updated += 1;
+        save_manifest(&manifest_path, &manifest).unwrap();
+        assert_ne!(index_generation(root), first);
+    }
 }
 
 // ============================================================================
@@ -1911,7 +3138,8 @@ mod cleanup_validation {
             // Check if sidecar file exists
             let sidecar_path =
                 path_utils::get_sidecar_path_for_standard_path(index_dir, &standard_path);
-            if !sidecar_path.exists() {
+            // Dropped from the manifest, an unreadable sidecar is indexed again
+            if !sidecar_path.exists() || load_index_entry(&sidecar_path).is_err() {
                 remove_manifest_entry(manifest, &manifest_path, repo_root, index_dir, &mut stats)?;
                 continue;
             }
@@ -1968,7 +3196,12 @@ mod cleanup_validation {
             return Ok(());
         }
 
-        for entry in WalkDir::new(index_dir) {
+        // Shards keep their own manifests
+        let shards_dir = index_dir.join(shards::SHARDS_DIR);
+        for entry in WalkDir::new(index_dir)
+            .into_iter()
+            .filter_entry(|e| e.path() != shards_dir)
+        {
             let entry = entry?;
             if entry.file_type().is_file() {
                 let sidecar_path = entry.path();
@@ -2026,6 +3259,31 @@ mod path_utils {
         }
     }
 
+    /// The standardized path of a manifest key read from elsewhere (a
+    /// remote, a peer or a registry), refused if it's absolute or leads out
+    /// of the index, as bundle entries are.
+    pub fn checked_manifest_key(manifest_key: &Path) -> Result<PathBuf> {
+        let standard_path = from_manifest_path(manifest_key);
+        if standard_path.as_os_str().is_empty()
+            || super::bundle::safe_relative_path(&standard_path.to_string_lossy()).is_err()
+        {
+            return Err(anyhow::anyhow!(
+                "Manifest entry '{}' escapes the index",
+                manifest_key.display()
+            ));
+        }
+        Ok(standard_path)
+    }
+
+    /// Refuse `manifest` if any of its keys fails [`checked_manifest_key`],
+    /// before any of them is used to name a file.
+    pub fn check_manifest_keys(manifest: &IndexManifest) -> Result<()> {
+        for manifest_key in manifest.files.keys() {
+            checked_manifest_key(manifest_key)?;
+        }
+        Ok(())
+    }
+
     /// Get the sidecar path for a standardized file path
     pub fn get_sidecar_path_for_standard_path(index_dir: &Path, standard_path: &Path) -> PathBuf {
         let sidecar_name = format!("{}.cs", standard_path.display());
@@ -0,0 +1,242 @@
+//! Recognizes the license a source file is under from its header, so its
+//! chunks can be tagged at index time and `--license` can keep code under
+//! incompatible licenses out of results.
+//!
+//! An `SPDX-License-Identifier:` tag near the top of a file wins; otherwise
+//! the opening words of these notices are recognized: GPL, LGPL and AGPL
+//! (version 2 or 3), Apache 2.0, MPL 2.0, MIT, BSD 2- and 3-clause, ISC and
+//! the Unlicense.
+//!
+//! `--license` filters name SPDX identifiers, `!` excluding one. A filter
+//! matches an identifier exactly or as a prefix up to a `-`, so `GPL-3.0`
+//! matches `GPL-3.0-only` and `GPL` matches every GPL version but not LGPL.
+//! A file is kept if one way of satisfying its license expression passes:
+//! every license of that alternative is allowed and none is excluded. Files
+//! without a recognized license are kept unless a license is required.
+
+use std::fs;
+use std::io::Read;
+use std::path::Path;
+
+/// Lines of the header searched for a license.
+const HEADER_LINES: usize = 40;
+
+/// Bytes read from a file to check its header.
+const HEADER_BYTES: usize = 4096;
+
+const SPDX_TAG: &str = "SPDX-License-Identifier:";
+
+/// The SPDX license expression of `content`, from its header.
+pub fn detect(content: &str) -> Option<String> {
+    let header: Vec<&str> = content.lines().take(HEADER_LINES).collect();
+    if let Some(tag) = header.iter().find_map(|line| {
+        let (_, tag) = line.split_once(SPDX_TAG)?;
+        let tag = tag.trim();
+        let tag = tag
+            .strip_suffix("*/")
+            .or_else(|| tag.strip_suffix("-->"))
+            .unwrap_or(tag)
+            .trim();
+        (!tag.is_empty()).then(|| tag.to_string())
+    }) {
+        return Some(tag);
+    }
+
+    // Notices wrap across comment lines, so match on the header's words
+    let words = header
+        .iter()
+        .flat_map(|line| line.split_whitespace())
+        .filter(|word| !matches!(*word, "//" | "#" | "*" | "/*" | "*/" | "--" | ";" | "!"))
+        .collect::<Vec<_>>()
+        .join(" ")
+        .to_lowercase();
+    notice_license(&words).map(str::to_string)
+}
+
+/// Like [`detect`], reading only the start of `path`. Unreadable files have
+/// no license.
+pub fn detect_file(path: &Path) -> Option<String> {
+    let mut buffer = vec![0; HEADER_BYTES];
+    let bytes_read = fs::File::open(path)
+        .and_then(|mut file| file.read(&mut buffer))
+        .ok()?;
+    detect(&String::from_utf8_lossy(&buffer[..bytes_read]))
+}
+
+fn notice_license(words: &str) -> Option<&'static str> {
+    let version_3 = words.contains("version 3");
+    if words.contains("gnu affero general public license") {
+        Some("AGPL-3.0")
+    } else if words.contains("gnu lesser general public license")
+        || words.contains("gnu library general public license")
+    {
+        Some(if version_3 { "LGPL-3.0" } else { "LGPL-2.1" })
+    } else if words.contains("gnu general public license") {
+        Some(if version_3 { "GPL-3.0" } else { "GPL-2.0" })
+    } else if words.contains("apache license, version 2.0")
+        || words.contains("apache license version 2.0")
+    {
+        Some("Apache-2.0")
+    } else if words.contains("mozilla public license, v. 2.0")
+        || words.contains("mozilla public license version 2.0")
+    {
+        Some("MPL-2.0")
+    } else if words.contains("permission is hereby granted, free of charge") {
+        Some("MIT")
+    } else if words.contains("redistribution and use in source and binary forms") {
+        Some(if words.contains("neither the name") {
+            "BSD-3-Clause"
+        } else {
+            "BSD-2-Clause"
+        })
+    } else if words.contains("permission to use, copy, modify, and/or distribute this software") {
+        Some("ISC")
+    } else if words.contains("free and unencumbered software released into the public domain") {
+        Some("Unlicense")
+    } else {
+        None
+    }
+}
+
+/// Whether code under `license` passes the `--license` `filters`.
+pub fn permits(license: Option<&str>, filters: &[String]) -> bool {
+    let (excluded, required): (Vec<&str>, Vec<&str>) = filters
+        .iter()
+        .map(|filter| filter.trim())
+        .partition(|filter| filter.starts_with('!'));
+    let excluded: Vec<&str> = excluded.iter().map(|filter| filter[1..].trim()).collect();
+    let Some(license) = license else {
+        return required.is_empty();
+    };
+    alternatives(license).iter().any(|alternative| {
+        alternative.iter().all(|id| {
+            !excluded.iter().any(|filter| id_matches(filter, id))
+                && (required.is_empty() || required.iter().any(|filter| id_matches(filter, id)))
+        })
+    })
+}
+
+fn id_matches(filter: &str, id: &str) -> bool {
+    let (filter, id) = (filter.to_lowercase(), id.to_lowercase());
+    !filter.is_empty()
+        && id
+            .strip_prefix(filter.as_str())
+            .is_some_and(|rest| rest.is_empty() || rest.starts_with('-'))
+}
+
+/// The ways a license expression can be satisfied:
+/// `MIT OR (Apache-2.0 AND BSD-3-Clause)` is `[[MIT], [Apache-2.0, BSD-3-Clause]]`.
+fn alternatives(expression: &str) -> Vec<Vec<String>> {
+    let spaced = expression.replace('(', " ( ").replace(')', " ) ");
+    let tokens: Vec<&str> = spaced.split_whitespace().collect();
+    any_of(&tokens, &mut 0)
+}
+
+fn any_of(tokens: &[&str], position: &mut usize) -> Vec<Vec<String>> {
+    let mut alternatives = all_of(tokens, position);
+    while tokens
+        .get(*position)
+        .is_some_and(|token| token.eq_ignore_ascii_case("OR"))
+    {
+        *position += 1;
+        alternatives.extend(all_of(tokens, position));
+    }
+    alternatives
+}
+
+fn all_of(tokens: &[&str], position: &mut usize) -> Vec<Vec<String>> {
+    let mut alternatives = license_term(tokens, position);
+    while tokens
+        .get(*position)
+        .is_some_and(|token| token.eq_ignore_ascii_case("AND"))
+    {
+        *position += 1;
+        let right = license_term(tokens, position);
+        alternatives = alternatives
+            .iter()
+            .flat_map(|left| {
+                right
+                    .iter()
+                    .map(move |right| [left.clone(), right.clone()].concat())
+            })
+            .collect();
+    }
+    alternatives
+}
+
+fn license_term(tokens: &[&str], position: &mut usize) -> Vec<Vec<String>> {
+    match tokens.get(*position) {
+        None => vec![Vec::new()],
+        Some(&"(") => {
+            *position += 1;
+            let inner = any_of(tokens, position);
+            if tokens.get(*position) == Some(&")") {
+                *position += 1;
+            }
+            inner
+        }
+        Some(id) => {
+            *position += 1;
+            // An exception narrows the license rather than adding one
+            if tokens
+                .get(*position)
+                .is_some_and(|token| token.eq_ignore_ascii_case("WITH"))
+            {
+                *position += 2;
+            }
+            // `GPL-2.0+` is the deprecated spelling of `GPL-2.0-or-later`
+            vec![vec![id.trim_end_matches('+').to_string()]]
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn licenses_are_read_from_spdx_tags_and_notices() {
+        assert_eq!(
+            detect("// SPDX-License-Identifier: GPL-3.0-only\npackage main\n").as_deref(),
+            Some("GPL-3.0-only")
+        );
+        assert_eq!(
+            detect("/* SPDX-License-Identifier: MIT OR Apache-2.0 */\n").as_deref(),
+            Some("MIT OR Apache-2.0")
+        );
+        let apache = "\
+// Copyright 2024 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the \"License\");
+// you may not use this file except in compliance with the License.
+";
+        assert_eq!(detect(apache).as_deref(), Some("Apache-2.0"));
+        let gpl = "\
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU General Public License as published by
+# the Free Software Foundation, either version 3 of the License, or
+";
+        assert_eq!(detect(gpl).as_deref(), Some("GPL-3.0"));
+        assert_eq!(detect("fn main() {}\n"), None);
+    }
+
+    #[test]
+    fn filters_match_license_expressions() {
+        let exclude_gpl = ["!GPL-3.0".to_string()];
+        assert!(!permits(Some("GPL-3.0-only"), &exclude_gpl));
+        assert!(!permits(Some("GPL-3.0+"), &exclude_gpl));
+        assert!(permits(Some("LGPL-3.0"), &exclude_gpl));
+        assert!(permits(Some("MIT OR GPL-3.0-only"), &exclude_gpl));
+        assert!(!permits(Some("MIT AND GPL-3.0-only"), &exclude_gpl));
+        assert!(permits(None, &exclude_gpl));
+
+        let permissive = ["MIT".to_string(), "Apache-2.0".to_string()];
+        assert!(permits(
+            Some("(MIT OR Apache-2.0) AND Apache-2.0 WITH LLVM-exception"),
+            &permissive
+        ));
+        assert!(!permits(Some("BSD-3-Clause"), &permissive));
+        assert!(!permits(None, &permissive));
+        assert!(permits(Some("GPL-2.0"), &[]));
+    }
+}
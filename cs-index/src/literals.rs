@@ -0,0 +1,292 @@
+//! String literals in code, mostly log and error messages, indexed with the
+//! chunk that holds them so a message pasted from production finds the
+//! function that emitted it.
+//!
+//! Each chunk keeps its message-like literals and, when embedded, one more
+//! embedding of those literals together, which semantic search scores next
+//! to the chunk's own. A query that reads like a literal with its
+//! placeholders (`%s`, `%w`, `{}`, `{name}`, `${name}`, `#{name}`) filled
+//! in matches that literal outright.
+
+use cs_core::Language;
+use regex::Regex;
+use serde::Serialize;
+use std::sync::LazyLock;
+
+/// Literals kept per chunk.
+const MAX_LITERALS: usize = 16;
+
+/// Shortest and longest literal that can be a message, in characters.
+const MIN_LENGTH: usize = 8;
+const MAX_LENGTH: usize = 400;
+
+/// Text a literal needs outside its placeholders to match a query by itself.
+const MIN_FIXED_LENGTH: usize = 12;
+
+/// printf verbs, `{}`-style holes and `${}`/`#{}` interpolation.
+static PLACEHOLDER: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"%[-+ #0]*(?:\d+|\*)?(?:\.(?:\d+|\*))?[a-zA-Z]|[$#]?\{[^{}]*\}").unwrap()
+});
+
+/// The message-like string literals in `code`, in order and without repeats.
+pub fn extract_literals(code: &str, lang: Option<Language>) -> Vec<String> {
+    let Some(lang) = lang.filter(|lang| *lang != Language::Pdf) else {
+        return Vec::new();
+    };
+    let hash_comments = matches!(lang, Language::Python | Language::Ruby | Language::Php);
+    let slash_comments = !matches!(lang, Language::Python | Language::Ruby | Language::Haskell);
+    let single_quotes = matches!(
+        lang,
+        Language::Python
+            | Language::JavaScript
+            | Language::TypeScript
+            | Language::Ruby
+            | Language::Php
+    );
+    let backticks = matches!(
+        lang,
+        Language::Go | Language::JavaScript | Language::TypeScript
+    );
+
+    let bytes = code.as_bytes();
+    let mut literals: Vec<String> = Vec::new();
+    let mut i = 0;
+    while i < bytes.len() && literals.len() < MAX_LITERALS {
+        let rest = &code[i..];
+        if (hash_comments && rest.starts_with('#'))
+            || (slash_comments && rest.starts_with("//"))
+            || (lang == Language::Haskell && rest.starts_with("--"))
+        {
+            i += rest.find('\n').unwrap_or(rest.len());
+            continue;
+        }
+        if slash_comments && rest.starts_with("/*") {
+            i += rest[2..].find("*/").map_or(rest.len(), |end| end + 4);
+            continue;
+        }
+        // Docstrings and text blocks are prose, already embedded with the code
+        if rest.starts_with("\"\"\"") || rest.starts_with("'''") {
+            let fence = &rest[..3];
+            i += rest[3..].find(fence).map_or(rest.len(), |end| end + 6);
+            continue;
+        }
+
+        let quote = bytes[i];
+        // A character literal such as '"' elsewhere
+        if !single_quotes && quote == b'\'' {
+            let length = if bytes.get(i + 1) == Some(&b'\\') {
+                4
+            } else {
+                3
+            };
+            if bytes.get(i + length - 1) == Some(&b'\'') {
+                i += length;
+                continue;
+            }
+        }
+        let is_quote =
+            quote == b'"' || (single_quotes && quote == b'\'') || (backticks && quote == b'`');
+        if !is_quote {
+            i += rest.chars().next().map_or(1, char::len_utf8);
+            continue;
+        }
+
+        let (literal, end) = scan_literal(code, i + 1, quote);
+        i = end;
+        if let Some(literal) = literal.filter(|literal| is_message(literal))
+            && !literals.contains(&literal)
+        {
+            literals.push(literal);
+        }
+    }
+    literals
+}
+
+/// The literal starting at `start` (just past its opening `quote`),
+/// unescaped, and where scanning resumes. Only backticks span lines.
+fn scan_literal(code: &str, start: usize, quote: u8) -> (Option<String>, usize) {
+    let mut literal = String::new();
+    let mut chars = code[start..].char_indices();
+    while let Some((offset, c)) = chars.next() {
+        match c {
+            _ if c as u32 == quote as u32 => return (Some(literal), start + offset + 1),
+            '\n' if quote != b'`' => return (None, start + offset),
+            '\\' if quote != b'`' => match chars.next() {
+                Some((_, 'n' | 't' | 'r')) => literal.push(' '),
+                Some((_, escaped)) => literal.push(escaped),
+                None => break,
+            },
+            _ => literal.push(c),
+        }
+    }
+    (None, code.len())
+}
+
+fn is_message(literal: &str) -> bool {
+    let literal = literal.trim();
+    let length = literal.chars().count();
+    (MIN_LENGTH..=MAX_LENGTH).contains(&length)
+        && literal
+            .split_whitespace()
+            .filter(|word| word.chars().any(char::is_alphabetic))
+            .count()
+            >= 2
+}
+
+/// The text embedded for a chunk's literals.
+pub fn literal_text(literals: &[String]) -> String {
+    literals.join("\n")
+}
+
+/// The text of `literal` around its placeholders, trimmed.
+pub fn fixed_segments(literal: &str) -> Vec<&str> {
+    PLACEHOLDER
+        .split(literal)
+        .map(str::trim)
+        .filter(|segment| !segment.is_empty())
+        .collect()
+}
+
+/// Whether `query` reads like `literal` with its placeholders filled in: the
+/// text around them appears in `query` in order, regardless of case.
+pub fn matches_message(literal: &str, query: &str) -> bool {
+    let fixed: Vec<String> = fixed_segments(literal)
+        .into_iter()
+        .map(str::to_lowercase)
+        .collect();
+    fixed.iter().map(|segment| segment.len()).sum::<usize>() >= MIN_FIXED_LENGTH
+        && contains_in_order(&query.to_lowercase(), &fixed)
+}
+
+fn contains_in_order(text: &str, segments: &[String]) -> bool {
+    let mut rest = text;
+    for segment in segments {
+        match rest.find(segment.as_str()) {
+            Some(position) => rest = &rest[position + segment.len()..],
+            None => return false,
+        }
+    }
+    true
+}
+
+/// How a literal matched a message or format string, best first.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum FormatMatch {
+    /// The same format, whatever the placeholder style: `%d` stands for `{}`
+    Exact,
+    /// The message is the literal with its placeholders filled in
+    Filled,
+    /// The message is part of the literal
+    Partial,
+}
+
+/// How `literal` matches `message`, which may be a format string itself
+/// (`user with ID %d not found`) or a message as it was printed.
+pub fn match_format(literal: &str, message: &str) -> Option<FormatMatch> {
+    if shape(literal) == shape(message) {
+        return Some(FormatMatch::Exact);
+    }
+    if matches_message(literal, message) {
+        return Some(FormatMatch::Filled);
+    }
+    let fixed: Vec<String> = fixed_segments(message)
+        .into_iter()
+        .map(|segment| shape(segment))
+        .collect();
+    (fixed.iter().map(|segment| segment.len()).sum::<usize>() >= MIN_FIXED_LENGTH
+        && contains_in_order(&shape(literal), &fixed))
+    .then_some(FormatMatch::Partial)
+}
+
+/// `text` lowercased, with runs of whitespace as one space and every
+/// placeholder as NUL.
+fn shape(text: &str) -> String {
+    PLACEHOLDER
+        .replace_all(text, "\0")
+        .to_lowercase()
+        .split_whitespace()
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn extracts_message_literals() {
+        let go = r#"
+// Open reads "the config file" from disk
+func Open(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config %s: %w", path, err)
+	}
+	log.Info("opened config file", "path", path)
+	log.Info("opened config file")
+	return parse(`multi
+line message`)
+}
+"#;
+        assert_eq!(
+            extract_literals(go, Some(Language::Go)),
+            [
+                "failed to open config %s: %w",
+                "opened config file",
+                "multi\nline message",
+            ]
+        );
+
+        let python = "def f(x):\n    \"\"\"Docs \"quoted\" here.\"\"\"\n    # don't count 'this'\n    raise ValueError(f'invalid value {x!r} for limit')\n";
+        assert_eq!(
+            extract_literals(python, Some(Language::Python)),
+            ["invalid value {x!r} for limit"]
+        );
+
+        let rust = "fn f<'a>(s: &'a str) { bail!(\"can't parse \\\"{}\\\" as a number\", s) }";
+        assert_eq!(
+            extract_literals(rust, Some(Language::Rust)),
+            ["can't parse \"{}\" as a number"]
+        );
+        assert!(extract_literals(go, None).is_empty());
+    }
+
+    #[test]
+    fn filled_in_messages_match_their_literal() {
+        let literal = "failed to open config %s: %w";
+        assert!(matches_message(
+            literal,
+            "Error: Failed to open config /etc/app.yaml: permission denied"
+        ));
+        assert!(!matches_message(
+            literal,
+            "failed to parse config /etc/app.yaml"
+        ));
+        assert!(matches_message(
+            "user {} not found in {tenant}",
+            "user 42 not found in acme"
+        ));
+        // Too little fixed text to say
+        assert!(!matches_message("error: %v", "error: timeout"));
+    }
+
+    #[test]
+    fn format_strings_match_across_placeholder_styles() {
+        let literal = "user with ID %d not found";
+        assert_eq!(
+            match_format("user with ID {} not found", literal),
+            Some(FormatMatch::Exact)
+        );
+        assert_eq!(
+            match_format(literal, "User with ID 42 not found"),
+            Some(FormatMatch::Filled)
+        );
+        assert_eq!(
+            match_format("user with ID %d not found in org %s", literal),
+            Some(FormatMatch::Partial)
+        );
+        assert_eq!(match_format("user %d deleted", literal), None);
+        assert!(FormatMatch::Exact < FormatMatch::Partial);
+    }
+}
@@ -0,0 +1,445 @@
+//! On-disk format of the index manifest. Parsing a JSON manifest of a few
+//! hundred thousand files took seconds on every open, so manifests are
+//! written in a compact binary form instead: a header with the index's
+//! model and timestamps, readable on its own, then the file entries sorted by
+//! path. Each path is stored as the bytes it shares with the previous one
+//! plus the rest, hashes as raw bytes, and modification times as the
+//! difference from the previous entry's, all as varints.
+//!
+//! The file keeps its `manifest.json` name, which tools and published
+//! remote indexes locate the index by. Manifests written as JSON by earlier
+//! versions still load, and are rewritten in the binary form on the next
+//! update.
+
+use super::IndexManifest;
+use anyhow::{Context, Result};
+use cs_core::FileMetadata;
+use std::collections::HashMap;
+use std::io::Read;
+use std::path::{Path, PathBuf};
+
+/// Starts every binary manifest, followed by the format version.
+const MAGIC: &[u8] = b"CSMF";
+const FORMAT_VERSION: u8 = 1;
+
+/// Hash kinds: a 64-digit hex blake3 hash as its 32 bytes, or any other
+/// string as is.
+const HASH_BLAKE3: u8 = 0;
+const HASH_STRING: u8 = 1;
+
+/// An entry's `path` as the same as its key, or stored after it.
+const PATH_SAME_AS_KEY: u8 = 0;
+const PATH_STORED: u8 = 1;
+
+/// Everything in a manifest but its file entries.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Header {
+    pub version: String,
+    pub created: u64,
+    pub updated: u64,
+    pub embedding_model: Option<String>,
+    pub embedding_dimensions: Option<usize>,
+    pub embedding_model_version: Option<String>,
+    pub files: usize,
+}
+
+impl Header {
+    /// Like [`super::validate_manifest_model`].
+    pub fn validate(&self) -> Result<()> {
+        super::index_format::check(&self.version)?;
+        super::validate_model_version(
+            self.embedding_model.as_deref(),
+            self.embedding_model_version.as_deref(),
+        )
+    }
+
+    pub fn of(manifest: &IndexManifest) -> Self {
+        Header {
+            version: manifest.version.clone(),
+            created: manifest.created,
+            updated: manifest.updated,
+            embedding_model: manifest.embedding_model.clone(),
+            embedding_dimensions: manifest.embedding_dimensions,
+            embedding_model_version: manifest.embedding_model_version.clone(),
+            files: manifest.files.len(),
+        }
+    }
+}
+
+pub fn is_binary(data: &[u8]) -> bool {
+    data.starts_with(MAGIC)
+}
+
+pub fn encode(manifest: &IndexManifest) -> Result<Vec<u8>> {
+    let mut out = MAGIC.to_vec();
+    out.push(FORMAT_VERSION);
+
+    let header = Header::of(manifest);
+    let mut block = Vec::new();
+    put_str(&mut block, &header.version);
+    put_varint(&mut block, header.created);
+    put_varint(&mut block, header.updated);
+    put_opt_str(&mut block, header.embedding_model.as_deref());
+    put_varint(
+        &mut block,
+        header
+            .embedding_dimensions
+            .map_or(0, |dims| dims as u64 + 1),
+    );
+    put_opt_str(&mut block, header.embedding_model_version.as_deref());
+    put_varint(&mut block, header.files as u64);
+    put_varint(&mut out, block.len() as u64);
+    out.extend(block);
+
+    let mut entries: Vec<(&str, &FileMetadata)> = manifest
+        .files
+        .iter()
+        .map(|(key, metadata)| Ok((path_str(key)?, metadata)))
+        .collect::<Result<_>>()?;
+    entries.sort_unstable_by(|a, b| a.0.cmp(b.0));
+
+    let mut previous_key: &[u8] = &[];
+    let mut previous_modified = 0u64;
+    for (key, metadata) in entries {
+        let key = key.as_bytes();
+        let shared = previous_key
+            .iter()
+            .zip(key)
+            .take_while(|(a, b)| a == b)
+            .count();
+        put_varint(&mut out, shared as u64);
+        put_bytes(&mut out, &key[shared..]);
+        previous_key = key;
+
+        if metadata.path.as_os_str().as_encoded_bytes() == key {
+            out.push(PATH_SAME_AS_KEY);
+        } else {
+            out.push(PATH_STORED);
+            put_str(&mut out, path_str(&metadata.path)?);
+        }
+
+        match blake3::Hash::from_hex(&metadata.hash) {
+            Ok(hash) if metadata.hash == hash.to_hex().as_str() => {
+                out.push(HASH_BLAKE3);
+                out.extend(hash.as_bytes());
+            }
+            _ => {
+                out.push(HASH_STRING);
+                put_str(&mut out, &metadata.hash);
+            }
+        }
+
+        put_varint(
+            &mut out,
+            zigzag(metadata.last_modified.wrapping_sub(previous_modified) as i64),
+        );
+        previous_modified = metadata.last_modified;
+        put_varint(&mut out, metadata.size);
+    }
+    Ok(out)
+}
+
+/// A manifest in either the binary or the JSON form.
+pub fn decode(data: &[u8]) -> Result<IndexManifest> {
+    if !is_binary(data) {
+        return Ok(serde_json::from_slice(data)?);
+    }
+    let mut reader = Reader::new(data);
+    let header = reader.header()?;
+
+    // A corrupt count mustn't reserve more than the entries could fill
+    let mut files = HashMap::with_capacity(header.files.min(data.len()));
+    let mut key: Vec<u8> = Vec::new();
+    let mut modified = 0u64;
+    for _ in 0..header.files {
+        let shared = reader.varint()? as usize;
+        if shared > key.len() {
+            anyhow::bail!("Corrupt manifest: entry shares more of its path than there is");
+        }
+        key.truncate(shared);
+        key.extend_from_slice(reader.bytes()?);
+        let key_str = std::str::from_utf8(&key).context("Corrupt manifest: path isn't UTF-8")?;
+
+        let path = match reader.byte()? {
+            PATH_SAME_AS_KEY => PathBuf::from(key_str),
+            PATH_STORED => PathBuf::from(reader.str()?),
+            kind => anyhow::bail!("Corrupt manifest: unknown path kind {}", kind),
+        };
+        let hash = match reader.byte()? {
+            HASH_BLAKE3 => {
+                let bytes: [u8; 32] = reader.take(32)?.try_into()?;
+                blake3::Hash::from_bytes(bytes).to_hex().to_string()
+            }
+            HASH_STRING => reader.str()?.to_string(),
+            kind => anyhow::bail!("Corrupt manifest: unknown hash kind {}", kind),
+        };
+        modified = modified.wrapping_add(unzigzag(reader.varint()?) as u64);
+        let size = reader.varint()?;
+
+        files.insert(
+            PathBuf::from(key_str),
+            FileMetadata {
+                path,
+                hash,
+                last_modified: modified,
+                size,
+            },
+        );
+    }
+
+    Ok(IndexManifest {
+        version: header.version,
+        created: header.created,
+        updated: header.updated,
+        files,
+        embedding_model: header.embedding_model,
+        embedding_dimensions: header.embedding_dimensions,
+        embedding_model_version: header.embedding_model_version,
+    })
+}
+
+/// The header of the manifest at `path`, without reading its entries when
+/// it's in the binary form.
+pub fn read_header(path: &Path) -> Result<Header> {
+    let mut file = std::fs::File::open(path)?;
+    let mut start = vec![0u8; MAGIC.len() + 1 + 10];
+    let read = read_up_to(&mut file, &mut start)?;
+    start.truncate(read);
+    if !is_binary(&start) {
+        file.read_to_end(&mut start)?;
+        return Ok(Header::of(&decode(&start)?));
+    }
+
+    // The magic, the version, then the header's length
+    let mut reader = Reader::new(&start);
+    reader.take(MAGIC.len() + 1)?;
+    let length = reader.varint()? as usize;
+    let needed = reader.position.saturating_add(length);
+    if start.len() < needed {
+        let have = start.len();
+        start.resize(needed, 0);
+        file.read_exact(&mut start[have..])
+            .context("Corrupt manifest: header is cut off")?;
+    }
+    Reader::new(&start).header()
+}
+
+fn read_up_to(file: &mut std::fs::File, buffer: &mut [u8]) -> Result<usize> {
+    let mut read = 0;
+    while read < buffer.len() {
+        match file.read(&mut buffer[read..])? {
+            0 => break,
+            n => read += n,
+        }
+    }
+    Ok(read)
+}
+
+fn path_str(path: &Path) -> Result<&str> {
+    path.to_str()
+        .ok_or_else(|| anyhow::anyhow!("Path {} isn't valid UTF-8", path.display()))
+}
+
+fn zigzag(value: i64) -> u64 {
+    ((value << 1) ^ (value >> 63)) as u64
+}
+
+fn unzigzag(value: u64) -> i64 {
+    ((value >> 1) as i64) ^ -((value & 1) as i64)
+}
+
+fn put_varint(out: &mut Vec<u8>, mut value: u64) {
+    while value >= 0x80 {
+        out.push(value as u8 | 0x80);
+        value >>= 7;
+    }
+    out.push(value as u8);
+}
+
+fn put_bytes(out: &mut Vec<u8>, bytes: &[u8]) {
+    put_varint(out, bytes.len() as u64);
+    out.extend_from_slice(bytes);
+}
+
+fn put_str(out: &mut Vec<u8>, value: &str) {
+    put_bytes(out, value.as_bytes());
+}
+
+/// `None` as length 0, otherwise the length plus one.
+fn put_opt_str(out: &mut Vec<u8>, value: Option<&str>) {
+    match value {
+        Some(value) => {
+            put_varint(out, value.len() as u64 + 1);
+            out.extend_from_slice(value.as_bytes());
+        }
+        None => put_varint(out, 0),
+    }
+}
+
+struct Reader<'a> {
+    data: &'a [u8],
+    position: usize,
+}
+
+impl<'a> Reader<'a> {
+    fn new(data: &'a [u8]) -> Self {
+        Reader { data, position: 0 }
+    }
+
+    fn take(&mut self, len: usize) -> Result<&'a [u8]> {
+        let end = self
+            .position
+            .checked_add(len)
+            .filter(|&end| end <= self.data.len())
+            .ok_or_else(|| anyhow::anyhow!("Corrupt manifest: it ends early"))?;
+        let bytes = &self.data[self.position..end];
+        self.position = end;
+        Ok(bytes)
+    }
+
+    fn byte(&mut self) -> Result<u8> {
+        Ok(self.take(1)?[0])
+    }
+
+    fn varint(&mut self) -> Result<u64> {
+        let mut value = 0u64;
+        for shift in (0..64).step_by(7) {
+            let byte = self.byte()?;
+            value |= u64::from(byte & 0x7f) << shift;
+            if byte & 0x80 == 0 {
+                return Ok(value);
+            }
+        }
+        anyhow::bail!("Corrupt manifest: varint too long")
+    }
+
+    fn bytes(&mut self) -> Result<&'a [u8]> {
+        let len = self.varint()? as usize;
+        self.take(len)
+    }
+
+    fn str(&mut self) -> Result<&'a str> {
+        std::str::from_utf8(self.bytes()?).context("Corrupt manifest: string isn't UTF-8")
+    }
+
+    fn opt_str(&mut self) -> Result<Option<&'a str>> {
+        match self.varint()? as usize {
+            0 => Ok(None),
+            len => Ok(Some(
+                std::str::from_utf8(self.take(len - 1)?)
+                    .context("Corrupt manifest: string isn't UTF-8")?,
+            )),
+        }
+    }
+
+    /// The magic, version and header at the start of a binary manifest,
+    /// leaving the reader at the first entry.
+    fn header(&mut self) -> Result<Header> {
+        self.take(MAGIC.len())?;
+        let version = self.byte()?;
+        if version != FORMAT_VERSION {
+            anyhow::bail!(
+                "Manifest format v{} is newer than this version of cs reads; upgrade cs or run cs --index --force",
+                version
+            );
+        }
+        let length = self.varint()? as usize;
+        let end = self.position.saturating_add(length);
+        let header = Header {
+            version: self.str()?.to_string(),
+            created: self.varint()?,
+            updated: self.varint()?,
+            embedding_model: self.opt_str()?.map(str::to_string),
+            embedding_dimensions: match self.varint()? {
+                0 => None,
+                dims => Some(dims as usize - 1),
+            },
+            embedding_model_version: self.opt_str()?.map(str::to_string),
+            files: self.varint()? as usize,
+        };
+        // Fields a later version appends to the header are skipped
+        if self.position > end {
+            anyhow::bail!("Corrupt manifest: header overruns its length");
+        }
+        self.position = end;
+        Ok(header)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn manifest() -> IndexManifest {
+        let mut manifest = IndexManifest {
+            embedding_model: Some("jina-code-1.5b".to_string()),
+            embedding_dimensions: Some(1536),
+            ..IndexManifest::default()
+        };
+        for (i, name) in [
+            "./src/lib.rs",
+            "./src/main.rs",
+            "./src/ünïcode.rs",
+            "./README.md",
+        ]
+        .iter()
+        .enumerate()
+        {
+            manifest.files.insert(
+                PathBuf::from(name),
+                FileMetadata {
+                    path: PathBuf::from(name),
+                    hash: blake3::hash(name.as_bytes()).to_hex().to_string(),
+                    last_modified: 1_760_000_000 - i as u64 * 90,
+                    size: 1000 * i as u64,
+                },
+            );
+        }
+        // Entries written by old versions may hold anything here
+        manifest.files.insert(
+            PathBuf::from("./old.rs"),
+            FileMetadata {
+                path: PathBuf::from("/abs/old.rs"),
+                hash: "legacy".to_string(),
+                last_modified: 0,
+                size: 1,
+            },
+        );
+        manifest
+    }
+
+    #[test]
+    fn manifests_round_trip_smaller_than_json() {
+        let manifest = manifest();
+        let data = encode(&manifest).unwrap();
+        assert!(data.len() * 2 < serde_json::to_vec_pretty(&manifest).unwrap().len());
+
+        let decoded = decode(&data).unwrap();
+        assert_eq!(decoded.files, manifest.files);
+        assert_eq!(decoded.updated, manifest.updated);
+        assert_eq!(decoded.embedding_model, manifest.embedding_model);
+        assert_eq!(decoded.embedding_dimensions, Some(1536));
+        assert_eq!(decoded.embedding_model_version, None);
+
+        assert!(decode(&data[..data.len() - 3]).is_err());
+    }
+
+    #[test]
+    fn headers_read_without_entries_and_json_still_loads() {
+        let dir = tempfile::tempdir().unwrap();
+        let manifest = manifest();
+
+        let binary = dir.path().join("binary.json");
+        std::fs::write(&binary, encode(&manifest).unwrap()).unwrap();
+        let json = dir.path().join("legacy.json");
+        std::fs::write(&json, serde_json::to_vec_pretty(&manifest).unwrap()).unwrap();
+
+        for path in [&binary, &json] {
+            let header = read_header(path).unwrap();
+            assert_eq!(header, Header::of(&manifest));
+            assert_eq!(header.files, 5);
+        }
+        let legacy = decode(&std::fs::read(&json).unwrap()).unwrap();
+        assert_eq!(legacy.files, manifest.files);
+    }
+}
@@ -0,0 +1,294 @@
+//! Memories agents keep about a repository between sessions: short notes such
+//! as "the integration tests need `make db` first" or "auth tokens are
+//! refreshed in middleware, not the client", written with the MCP `remember`
+//! tool or `cs --remember "text"`.
+//!
+//! They're stored in `.cs/memories.json`, embedded with the index's model,
+//! and searched with the code as the collection [`MEMORY_COLLECTION`], so
+//! the next session's searches turn up what earlier ones learned. Each
+//! memory records where it came from: the agent and session that wrote it,
+//! the files it's about and the commit checked out at the time. A memory
+//! expires after its TTL ([`DEFAULT_TTL_SECS`] unless given), so advice about
+//! code long since changed doesn't linger; expired memories are no longer
+//! searched and are dropped the next time one is written.
+
+use anyhow::{Result, bail};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::time::SystemTime;
+
+use super::{atomic_write, bundle, secrets};
+
+pub const MEMORIES_FILE: &str = "memories.json";
+
+/// The collection searches know memories by.
+pub const MEMORY_COLLECTION: &str = "memory";
+
+/// How long a memory is kept unless its writer says otherwise: 30 days.
+pub const DEFAULT_TTL_SECS: u64 = 30 * 86_400;
+
+/// Longest memory text; memories are notes, not documents.
+pub const MAX_MEMORY_BYTES: usize = 2000;
+
+/// Who wrote a memory, and about what.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct Provenance {
+    /// The agent or MCP client, like `claude-desktop`
+    pub agent: Option<String>,
+    pub session: Option<String>,
+    /// Files the memory is about, relative to the repository root
+    #[serde(default)]
+    pub files: Vec<String>,
+    /// Commit checked out when it was written
+    pub commit: Option<String>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Memory {
+    pub id: String,
+    pub text: String,
+    pub created: u64,
+    /// When it stops being searched; `None` keeps it until it's forgotten
+    pub expires: Option<u64>,
+    #[serde(default)]
+    pub provenance: Provenance,
+    pub embedding: Vec<f32>,
+}
+
+impl Memory {
+    pub fn is_live(&self, now: u64) -> bool {
+        self.expires.is_none_or(|expires| expires > now)
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct MemoryStore {
+    /// Model every memory is embedded with
+    pub embedding_model: Option<String>,
+    pub memories: Vec<Memory>,
+}
+
+impl MemoryStore {
+    /// The memories not yet expired, oldest first.
+    pub fn live(&self) -> impl Iterator<Item = &Memory> {
+        let now = now();
+        self.memories
+            .iter()
+            .filter(move |memory| memory.is_live(now))
+    }
+}
+
+fn memories_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(MEMORIES_FILE)
+}
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+/// Parse a TTL such as `30d`, `12h`, `90m`, `2w` or a number of seconds;
+/// `never` keeps a memory until it's forgotten.
+pub fn parse_ttl(text: &str) -> std::result::Result<Option<u64>, String> {
+    let text = text.trim();
+    if text.eq_ignore_ascii_case("never") {
+        return Ok(None);
+    }
+    let lower = text.to_ascii_lowercase();
+    let (number, unit) = match lower.chars().last() {
+        Some('s') => (&lower[..lower.len() - 1], 1),
+        Some('m') => (&lower[..lower.len() - 1], 60),
+        Some('h') => (&lower[..lower.len() - 1], 3600),
+        Some('d') => (&lower[..lower.len() - 1], 86_400),
+        Some('w') => (&lower[..lower.len() - 1], 7 * 86_400),
+        _ => (lower.as_str(), 1),
+    };
+    match number.trim().parse::<u64>() {
+        Ok(number) if number > 0 => Ok(Some(number.saturating_mul(unit))),
+        _ => Err(format!(
+            "Invalid TTL '{}'; expected e.g. 30d, 12h, 90m or never",
+            text
+        )),
+    }
+}
+
+/// The memories of the index at `repo_root`, expired ones included.
+pub fn load(repo_root: &Path) -> Result<MemoryStore> {
+    let path = memories_path(repo_root);
+    if !path.exists() {
+        return Ok(MemoryStore::default());
+    }
+    let data = super::encryption::open_from(&path, fs::read(&path)?)?;
+    Ok(serde_json::from_slice(&data)?)
+}
+
+fn save(repo_root: &Path, store: &MemoryStore) -> Result<()> {
+    let path = memories_path(repo_root);
+    let data = super::encryption::seal_for(&path, serde_json::to_vec_pretty(store)?)?;
+    atomic_write(&path, &data)
+}
+
+/// Memories of `repo_root` past their TTL but not yet dropped, which makes
+/// results cached while they were live stale.
+pub fn expired(repo_root: &Path) -> usize {
+    let now = now();
+    load(repo_root).map_or(0, |store| {
+        store
+            .memories
+            .iter()
+            .filter(|memory| !memory.is_live(now))
+            .count()
+    })
+}
+
+/// The commit checked out at `repo_root`, if it's a git checkout.
+fn head_commit(repo_root: &Path) -> Option<String> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(repo_root)
+        .args(["rev-parse", "HEAD"])
+        .output()
+        .ok()?;
+    output
+        .status
+        .success()
+        .then(|| String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+/// Embed `text` as a memory of `repo_root` that expires after `ttl` seconds
+/// (never, for `None`), dropping the memories that have expired. Memories are
+/// embedded with `model`, else the model they were embedded with before,
+/// else the index's; changing it embeds the live ones again.
+pub fn remember(
+    repo_root: &Path,
+    text: &str,
+    ttl: Option<u64>,
+    mut provenance: Provenance,
+    model: Option<&str>,
+) -> Result<Memory> {
+    let text = text.trim();
+    if text.is_empty() {
+        bail!("A memory needs some text");
+    }
+    if text.len() > MAX_MEMORY_BYTES {
+        bail!(
+            "Memory is {} bytes; keep it under {} and index longer text as a collection",
+            text.len(),
+            MAX_MEMORY_BYTES
+        );
+    }
+    bundle::ensure_writable(repo_root)?;
+    let mut store = load(repo_root)?;
+    let model = super::collections::collection_model(
+        repo_root,
+        None,
+        model.or(store.embedding_model.as_deref()),
+    )?;
+    let mut embedder = cs_embed::create_embedder(Some(&model))?;
+
+    let created = now();
+    store.memories.retain(|memory| memory.is_live(created));
+    if store.embedding_model.as_deref() != Some(model.as_str()) && !store.memories.is_empty() {
+        let mut texts = Vec::new();
+        let mut kept = Vec::new();
+        for memory in std::mem::take(&mut store.memories) {
+            // Memories a local model was trusted with may not go to a remote one
+            if let Some(text) = secrets::screen(&*embedder, repo_root, &memory.text)? {
+                texts.push(text);
+                kept.push(memory);
+            }
+        }
+        let embeddings = if texts.is_empty() {
+            Vec::new()
+        } else {
+            embedder.embed(&texts)?
+        };
+        for (mut memory, embedding) in kept.into_iter().zip(embeddings) {
+            memory.embedding = embedding;
+            store.memories.push(memory);
+        }
+    }
+
+    let Some(screened) = secrets::screen(&*embedder, repo_root, text)? else {
+        bail!("The memory looks like it holds a secret; not sending it to the remote embedder");
+    };
+    let Some(embedding) = embedder.embed(&[screened])?.pop() else {
+        bail!("Model '{}' returned no embedding for the memory", model);
+    };
+    if provenance.commit.is_none() {
+        provenance.commit = head_commit(repo_root);
+    }
+    let digest = blake3::hash(format!("{}\0{}", text, created).as_bytes());
+    let memory = Memory {
+        id: digest.to_hex()[..8].to_string(),
+        text: text.to_string(),
+        created,
+        expires: ttl.map(|ttl| created.saturating_add(ttl)),
+        provenance,
+        embedding,
+    };
+    store.embedding_model = Some(model);
+    store.memories.push(memory.clone());
+    save(repo_root, &store)?;
+    Ok(memory)
+}
+
+/// Remove the memory whose id is or starts with `id`.
+pub fn forget(repo_root: &Path, id: &str) -> Result<Memory> {
+    bundle::ensure_writable(repo_root)?;
+    let mut store = load(repo_root)?;
+    let matching: Vec<usize> = (0..store.memories.len())
+        .filter(|&i| store.memories[i].id.starts_with(id))
+        .collect();
+    let memory = match matching.as_slice() {
+        [] => bail!("No memory with id {}", id),
+        [index] => store.memories.remove(*index),
+        _ => bail!("Memory id {} is ambiguous; give more of it", id),
+    };
+    save(repo_root, &store)?;
+    Ok(memory)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ttls_take_units_or_never() {
+        assert_eq!(parse_ttl("30d"), Ok(Some(30 * 86_400)));
+        assert_eq!(parse_ttl("12h"), Ok(Some(12 * 3600)));
+        assert_eq!(parse_ttl("90M"), Ok(Some(90 * 60)));
+        assert_eq!(parse_ttl("2w"), Ok(Some(14 * 86_400)));
+        assert_eq!(parse_ttl("45"), Ok(Some(45)));
+        assert_eq!(parse_ttl("never"), Ok(None));
+        assert!(parse_ttl("0d").is_err());
+        assert!(parse_ttl("soon").is_err());
+    }
+
+    #[test]
+    fn expired_memories_are_not_live() {
+        let memory = |expires: Option<u64>| Memory {
+            id: "a1b2c3d4".to_string(),
+            text: "run make db before the integration tests".to_string(),
+            created: 100,
+            expires,
+            provenance: Provenance::default(),
+            embedding: Vec::new(),
+        };
+        assert!(memory(None).is_live(u64::MAX));
+        assert!(memory(Some(200)).is_live(199));
+        assert!(!memory(Some(200)).is_live(200));
+
+        // Stores without provenance, or expiry, still load
+        let store: MemoryStore = serde_json::from_str(
+            r#"{"embedding_model":"bge-small","memories":[{"id":"a1","text":"t","created":1,"expires":null,"embedding":[]}]}"#,
+        )
+        .unwrap();
+        assert_eq!(store.live().count(), 1);
+        assert_eq!(store.memories[0].provenance, Provenance::default());
+    }
+}
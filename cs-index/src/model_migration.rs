@@ -0,0 +1,544 @@
+//! Gradual model migration: an index moves to a new embedding model a batch
+//! of files at a time, and stays searchable under both models meanwhile, so
+//! a huge index never needs a rebuild that blocks every search.
+//!
+//! `cs --migrate-model <MODEL>` writes `.cs/model_migration.json` and
+//! embeds the next `--migrate-batch` files with the new model into a batch
+//! under `.cs/model_migration/`, leaving their sidecars on the index's own
+//! model. Run it again (by hand, from cron or in CI) until every file is
+//! migrated; the run that migrates the last one switches the index over:
+//! the new chunks replace the sidecars, the manifest records the new model,
+//! and the migration's files are removed.
+//!
+//! A batch's entry for a file is used while its hash matches the manifest's,
+//! as a segment's is. Updates keep embedding with the index's model, so a
+//! file edited since it was migrated is searched by its old-model chunks
+//! until a later run migrates it again. Searches embed the query with both
+//! models and score each file against its own (see
+//! `cs_engine::model_migration`).
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+use super::{
+    IndexEntry, IndexManifest, atomic_write, encryption, load_manifest, path_utils,
+    save_index_entry, save_manifest, segments, shards, sidecar_path_for_manifest_key,
+};
+
+pub const MIGRATION_FILE: &str = "model_migration.json";
+
+pub const MIGRATION_DIR: &str = "model_migration";
+
+const BATCH_EXTENSION: &str = "batch";
+
+const FORMAT_VERSION: u32 = 1;
+
+/// Files a `cs --migrate-model` run embeds, unless `--migrate-batch` says
+/// otherwise.
+pub const DEFAULT_BATCH_FILES: usize = 500;
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ModelMigration {
+    format_version: u32,
+    /// The index's model, which its sidecars are embedded with
+    pub from: String,
+    pub to: String,
+    pub to_dimensions: usize,
+    pub started: u64,
+    /// When a batch was last added, which makes cached results stale
+    pub updated: u64,
+    /// Set while the new chunks replace the sidecars
+    #[serde(default)]
+    pub switching: bool,
+}
+
+/// New-model entries of files, as one run embedded them.
+#[derive(Serialize, Deserialize)]
+struct Batch {
+    model: String,
+    entries: Vec<IndexEntry>,
+}
+
+/// What a search of a migrating index needs: the files migrated so far.
+#[derive(Debug)]
+pub struct Migrated {
+    pub migration: ModelMigration,
+    /// The up-to-date new-model entry of each migrated file, with its path
+    /// relative to the repository root
+    pub entries: Vec<(PathBuf, IndexEntry)>,
+    /// Files in the index
+    pub total: usize,
+}
+
+/// What a [`migrate`] run did.
+#[derive(Debug, Default)]
+pub struct MigrationProgress {
+    pub from: String,
+    pub to: String,
+    /// Files embedded with the new model by this run
+    pub migrated: usize,
+    /// Files that couldn't be embedded, because they changed or went away
+    /// since the last update
+    pub skipped: usize,
+    /// Files on the new model now, of `total`
+    pub done: usize,
+    pub total: usize,
+    /// The index was switched over to the new model
+    pub switched: bool,
+}
+
+fn settings_path(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(MIGRATION_FILE)
+}
+
+fn batches_dir(index_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(index_root).join(MIGRATION_DIR)
+}
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+/// The migration of the index at `index_root`, if one is in progress.
+pub fn settings(index_root: &Path) -> Option<ModelMigration> {
+    let data = fs::read(settings_path(index_root)).ok()?;
+    serde_json::from_slice(&data).ok()
+}
+
+pub fn is_migrating(index_root: &Path) -> bool {
+    settings_path(index_root).exists()
+}
+
+fn save_settings(index_root: &Path, migration: &ModelMigration) -> Result<()> {
+    atomic_write(
+        &settings_path(index_root),
+        &serde_json::to_vec_pretty(migration)?,
+    )
+}
+
+/// Start migrating the index at `index_root` to `model`, whose vectors have
+/// `dimensions`, or return the migration to it already in progress.
+pub fn start(index_root: &Path, model: &str, dimensions: usize) -> Result<ModelMigration> {
+    super::bundle::ensure_writable(index_root)?;
+    if shards::is_sharded(index_root) {
+        anyhow::bail!(
+            "A sharded index can't be migrated gradually yet; run `cs --switch-model {}` to re-index it",
+            model
+        );
+    }
+    let Some(from) = load_manifest(index_root)?.and_then(|manifest| manifest.embedding_model)
+    else {
+        anyhow::bail!("No embedded index to migrate. Run 'cs --index' first with embeddings.");
+    };
+    if from == model {
+        anyhow::bail!("The index already uses {}", model);
+    }
+    if let Some(migration) = settings(index_root) {
+        if migration.to == model && migration.from == from {
+            return Ok(migration);
+        }
+        anyhow::bail!(
+            "The index is migrating to {} already; finish that with `cs --migrate-model {}` or drop it with `cs --migrate-model off`",
+            migration.to,
+            migration.to
+        );
+    }
+    let migration = ModelMigration {
+        format_version: FORMAT_VERSION,
+        from,
+        to: model.to_string(),
+        to_dimensions: dimensions,
+        started: now(),
+        updated: now(),
+        switching: false,
+    };
+    save_settings(index_root, &migration)?;
+    Ok(migration)
+}
+
+/// Drop the migration in progress and the files it embedded. Whether there
+/// was one.
+pub fn abort(index_root: &Path) -> Result<bool> {
+    let migrating = is_migrating(index_root);
+    if let Some(migration) = settings(index_root).filter(|migration| migration.switching) {
+        anyhow::bail!(
+            "The index is part way through switching to {}; run `cs --migrate-model {}` to finish",
+            migration.to,
+            migration.to
+        );
+    }
+    remove_files(index_root)?;
+    Ok(migrating)
+}
+
+fn remove_files(index_root: &Path) -> Result<()> {
+    let dir = batches_dir(index_root);
+    match fs::remove_dir_all(&dir) {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+            return Err(e).with_context(|| format!("Failed to remove {}", dir.display()));
+        }
+        _ => {}
+    }
+    let path = settings_path(index_root);
+    match fs::remove_file(&path) {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+            Err(e).with_context(|| format!("Failed to remove {}", path.display()))
+        }
+        _ => Ok(()),
+    }
+}
+
+/// The batches of the index at `index_root`, oldest first.
+fn list_batches(index_root: &Path) -> Vec<(u64, PathBuf)> {
+    let Ok(entries) = fs::read_dir(batches_dir(index_root)) else {
+        return Vec::new();
+    };
+    let mut batches: Vec<(u64, PathBuf)> = entries
+        .flatten()
+        .filter_map(|entry| {
+            let path = entry.path();
+            if path.extension().is_none_or(|e| e != BATCH_EXTENSION) {
+                return None;
+            }
+            Some((path.file_stem()?.to_str()?.parse().ok()?, path))
+        })
+        .collect();
+    batches.sort();
+    batches
+}
+
+fn save_batch(index_root: &Path, id: u64, batch: &Batch) -> Result<()> {
+    let path = batches_dir(index_root).join(format!("{:010}.{}", id, BATCH_EXTENSION));
+    let data = encryption::seal_for(&path, bincode::serialize(batch)?)?;
+    atomic_write(&path, &data)
+}
+
+fn load_batch(path: &Path) -> Result<Batch> {
+    let data = encryption::open_from(path, fs::read(path)?)?;
+    Ok(bincode::deserialize(&data)?)
+}
+
+/// The newest new-model entry of each file in `manifest` whose hash still
+/// matches, by manifest key. Unreadable batches are skipped; their files
+/// count as not migrated.
+fn current_entries(
+    index_root: &Path,
+    migration: &ModelMigration,
+    manifest: &IndexManifest,
+) -> HashMap<PathBuf, IndexEntry> {
+    let mut entries = HashMap::new();
+    for (_, path) in list_batches(index_root).into_iter().rev() {
+        let batch = match load_batch(&path) {
+            Ok(batch) if batch.model == migration.to => batch,
+            Ok(_) => continue,
+            Err(e) => {
+                tracing::warn!("Skipping migration batch {}: {}", path.display(), e);
+                continue;
+            }
+        };
+        for entry in batch.entries {
+            let current = manifest
+                .files
+                .get(&entry.metadata.path)
+                .is_some_and(|metadata| metadata.hash == entry.metadata.hash);
+            if current && !entries.contains_key(&entry.metadata.path) {
+                entries.insert(entry.metadata.path.clone(), entry);
+            }
+        }
+    }
+    entries
+}
+
+/// The files of the index at `index_root` migrated so far, for a search.
+/// `None` when it isn't migrating, or its model changed since the migration
+/// started (`--switch-model`), which leaves the migration moot.
+pub fn load_migrated(index_root: &Path) -> Result<Option<Migrated>> {
+    let Some(migration) = settings(index_root) else {
+        return Ok(None);
+    };
+    if migration.switching {
+        anyhow::bail!(
+            "The index is switching to {}, or a run switching it was interrupted; run `cs --migrate-model {}` to finish",
+            migration.to,
+            migration.to
+        );
+    }
+    let Some(manifest) = load_manifest(index_root)? else {
+        return Ok(None);
+    };
+    if manifest.embedding_model.as_deref() != Some(migration.from.as_str()) {
+        tracing::debug!(
+            "Ignoring the migration to {}: the index is on {:?} now",
+            migration.to,
+            manifest.embedding_model
+        );
+        return Ok(None);
+    }
+    let entries = current_entries(index_root, &migration, &manifest)
+        .into_iter()
+        .map(|(key, entry)| (path_utils::from_manifest_path(&key), entry))
+        .collect();
+    Ok(Some(Migrated {
+        migration,
+        entries,
+        total: manifest.files.len(),
+    }))
+}
+
+/// Embed up to `batch_files` more files of the index at `index_root` with
+/// the new model of its migration, and switch it over once every file is.
+/// `progress` is told the files done of those this run embeds.
+pub fn migrate(
+    index_root: &Path,
+    batch_files: usize,
+    progress: Option<&dyn Fn(usize, usize)>,
+) -> Result<MigrationProgress> {
+    let Some(migration) = settings(index_root) else {
+        anyhow::bail!("The index isn't migrating; start with `cs --migrate-model <MODEL>`");
+    };
+    let mut embedder = cs_embed::create_embedder(Some(&migration.to))?;
+    migrate_with(index_root, migration, &mut embedder, batch_files, progress)
+}
+
+fn migrate_with(
+    index_root: &Path,
+    mut migration: ModelMigration,
+    embedder: &mut Box<dyn cs_embed::Embedder>,
+    batch_files: usize,
+    progress: Option<&dyn Fn(usize, usize)>,
+) -> Result<MigrationProgress> {
+    super::bundle::ensure_writable(index_root)?;
+    let Some(manifest) = load_manifest(index_root)? else {
+        anyhow::bail!("No index to migrate. Run 'cs --index' first with embeddings.");
+    };
+    let mut stats = MigrationProgress {
+        from: migration.from.clone(),
+        to: migration.to.clone(),
+        total: manifest.files.len(),
+        ..Default::default()
+    };
+    if migration.switching {
+        // A run switching the index was interrupted; finish what it started
+        let entries = current_entries(index_root, &migration, &manifest);
+        stats.done = manifest.files.len();
+        switch_over(index_root, &mut migration, manifest, entries)?;
+        stats.switched = true;
+        return Ok(stats);
+    }
+    if manifest.embedding_model.as_deref() != Some(migration.from.as_str()) {
+        anyhow::bail!(
+            "The index's model changed to {} since it began migrating to {}; drop the migration with `cs --migrate-model off`",
+            manifest.embedding_model.as_deref().unwrap_or("none"),
+            migration.to
+        );
+    }
+
+    let mut entries = current_entries(index_root, &migration, &manifest);
+    let mut pending: Vec<&PathBuf> = manifest
+        .files
+        .keys()
+        .filter(|key| !entries.contains_key(*key))
+        .collect();
+    pending.sort();
+    pending.truncate(batch_files);
+
+    let mut batch = Vec::new();
+    for (done, key) in pending.iter().enumerate() {
+        if let Some(progress) = progress {
+            progress(done, pending.len());
+        }
+        let file = index_root.join(path_utils::from_manifest_path(key));
+        match super::index_file_in_memory(&file, index_root, embedder) {
+            // Changed since the last update, which indexes it anew
+            Ok(entry) if entry.metadata.hash != manifest.files[*key].hash => stats.skipped += 1,
+            Ok(entry) => batch.push(entry),
+            Err(e) => {
+                tracing::debug!("Skipping {} in the model migration: {}", file.display(), e);
+                stats.skipped += 1;
+            }
+        }
+    }
+    if let Some(progress) = progress {
+        progress(pending.len(), pending.len());
+    }
+    stats.migrated = batch.len();
+    if !batch.is_empty() {
+        let id = list_batches(index_root).last().map_or(1, |(id, _)| id + 1);
+        for entry in &batch {
+            entries.insert(entry.metadata.path.clone(), entry.clone());
+        }
+        save_batch(
+            index_root,
+            id,
+            &Batch {
+                model: migration.to.clone(),
+                entries: batch,
+            },
+        )?;
+        migration.updated = now();
+        save_settings(index_root, &migration)?;
+    }
+
+    stats.done = entries.len();
+    if stats.done == stats.total {
+        switch_over(index_root, &mut migration, manifest, entries)?;
+        stats.switched = true;
+    }
+    Ok(stats)
+}
+
+/// Make the new model the index's: its chunks replace the sidecars and the
+/// manifest records it. The `switching` flag is saved first, so a run that
+/// dies part way is resumed by the next one rather than leaving sidecars of
+/// both models behind a manifest that names one.
+fn switch_over(
+    index_root: &Path,
+    migration: &mut ModelMigration,
+    mut manifest: IndexManifest,
+    entries: HashMap<PathBuf, IndexEntry>,
+) -> Result<()> {
+    migration.switching = true;
+    save_settings(index_root, migration)?;
+
+    let index_dir = cs_core::locations::index_dir(index_root);
+    if manifest.embedding_model.as_deref() != Some(migration.to.as_str()) {
+        for (key, entry) in &entries {
+            save_index_entry(&sidecar_path_for_manifest_key(&index_dir, key), entry)?;
+        }
+        manifest.embedding_model = Some(migration.to.clone());
+        manifest.embedding_dimensions = Some(migration.to_dimensions);
+        manifest.embedding_model_version = Some(cs_embed::EMBEDDING_PIPELINE_VERSION.to_string());
+        manifest.updated = now();
+        save_manifest(&index_dir.join("manifest.json"), &manifest)?;
+    }
+
+    // The segments hold the old model's chunks; a fresh one packs the new
+    let segments_dir = index_dir.join(segments::SEGMENTS_DIR);
+    if segments_dir.is_dir() {
+        fs::remove_dir_all(&segments_dir)
+            .with_context(|| format!("Failed to remove {}", segments_dir.display()))?;
+        fs::create_dir_all(&segments_dir)?;
+    }
+    segments::add(&index_dir, &manifest, &[]);
+    remove_files(index_root)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use cs_core::FileMetadata;
+    use tempfile::TempDir;
+
+    fn entry(file: &str, hash: &str) -> IndexEntry {
+        IndexEntry {
+            metadata: FileMetadata {
+                path: path_utils::to_manifest_path(Path::new(file)),
+                hash: hash.to_string(),
+                last_modified: 0,
+                size: 1,
+            },
+            chunks: Vec::new(),
+        }
+    }
+
+    fn index(root: &Path, files: &[(&str, &str)]) -> IndexManifest {
+        let index_dir = cs_core::locations::index_dir(root);
+        let mut manifest = IndexManifest {
+            embedding_model: Some("old-model".to_string()),
+            embedding_dimensions: Some(384),
+            ..Default::default()
+        };
+        for (file, hash) in files {
+            let entry = entry(file, hash);
+            save_index_entry(
+                &sidecar_path_for_manifest_key(&index_dir, &entry.metadata.path),
+                &entry,
+            )
+            .unwrap();
+            manifest
+                .files
+                .insert(entry.metadata.path.clone(), entry.metadata);
+        }
+        save_manifest(&index_dir.join("manifest.json"), &manifest).unwrap();
+        manifest
+    }
+
+    #[test]
+    fn batches_count_while_their_files_are_unchanged() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        index(root, &[("a.rs", "a1"), ("b.rs", "b1"), ("c.rs", "c1")]);
+        let migration = start(root, "new-model", 768).unwrap();
+        assert_eq!(start(root, "new-model", 768).unwrap(), migration);
+        assert!(start(root, "other-model", 768).is_err());
+
+        let old = Batch {
+            model: "new-model".to_string(),
+            entries: vec![entry("a.rs", "a0"), entry("b.rs", "b1")],
+        };
+        save_batch(root, 1, &old).unwrap();
+        // The newer entry of a.rs is the one for its indexed contents
+        let new = Batch {
+            model: "new-model".to_string(),
+            entries: vec![entry("a.rs", "a1"), entry("c.rs", "c0")],
+        };
+        save_batch(root, 2, &new).unwrap();
+
+        let migrated = load_migrated(root).unwrap().unwrap();
+        assert_eq!(migrated.total, 3);
+        let mut files: Vec<(PathBuf, String)> = migrated
+            .entries
+            .into_iter()
+            .map(|(path, entry)| (path, entry.metadata.hash))
+            .collect();
+        files.sort();
+        assert_eq!(
+            files,
+            [
+                (PathBuf::from("a.rs"), "a1".to_string()),
+                (PathBuf::from("b.rs"), "b1".to_string())
+            ]
+        );
+
+        assert!(abort(root).unwrap());
+        assert!(!is_migrating(root));
+        assert!(list_batches(root).is_empty());
+        assert!(load_migrated(root).unwrap().is_none());
+    }
+
+    #[test]
+    fn switching_over_puts_the_index_on_the_new_model() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        let manifest = index(root, &[("a.rs", "a1"), ("b.rs", "b1")]);
+        let index_dir = cs_core::locations::index_dir(root);
+        fs::create_dir_all(index_dir.join(segments::SEGMENTS_DIR)).unwrap();
+        let mut migration = start(root, "new-model", 768).unwrap();
+        let mut migrated = entry("a.rs", "a1");
+        migrated.metadata.size = 2;
+        let entries = HashMap::from([(migrated.metadata.path.clone(), migrated)]);
+
+        switch_over(root, &mut migration, manifest, entries).unwrap();
+        let manifest = load_manifest(root).unwrap().unwrap();
+        assert_eq!(manifest.embedding_model.as_deref(), Some("new-model"));
+        assert_eq!(manifest.embedding_dimensions, Some(768));
+        let sidecar = sidecar_path_for_manifest_key(&index_dir, Path::new("./a.rs"));
+        assert_eq!(
+            super::super::load_index_entry(&sidecar)
+                .unwrap()
+                .metadata
+                .size,
+            2
+        );
+        assert!(!is_migrating(root));
+        assert!(!batches_dir(root).exists());
+        assert!(segments::load_entries(&index_dir).unwrap().is_some());
+    }
+}
@@ -0,0 +1,196 @@
+//! Opt-in multi-vector indexing, for teams that trade storage for
+//! fine-grained matching.
+//!
+//! `cs --index --multi-vector` marks an index by writing
+//! `.cs/multi_vector.json`. From then on every embedded chunk also stores one
+//! sub-vector per statement group: a run of at most [`MAX_SEGMENT_LINES`]
+//! lines, ended early by a blank line or a line closing a statement or block.
+//! A search scores a chunk by the best of all its vectors (MaxSim, as in
+//! late-interaction retrievers like ColBERT), so the one line of a long
+//! function that answers the query is no longer averaged away by the rest of
+//! it. Sub-vectors cost up to [`MAX_SUB_VECTORS`] times the storage of the
+//! chunk vectors and as many more embedding calls; `cs --clean` drops the
+//! marker along with the index.
+
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+
+use super::{ChunkEntry, atomic_write, secrets};
+
+pub const MULTI_VECTOR_FILE: &str = "multi_vector.json";
+
+const FORMAT_VERSION: u32 = 1;
+
+/// Lines embedded together in one sub-vector at most.
+pub const MAX_SEGMENT_LINES: usize = 4;
+
+/// Sub-vectors per chunk at most; longer chunks get wider segments.
+pub const MAX_SUB_VECTORS: usize = 16;
+
+/// Segments with fewer letters and digits than this, like a lone `}` or
+/// `end`, say nothing worth a vector.
+const MIN_SEGMENT_CHARS: usize = 12;
+
+#[derive(Serialize, Deserialize)]
+struct MultiVectorInfo {
+    format_version: u32,
+    max_segment_lines: usize,
+    max_sub_vectors: usize,
+}
+
+fn info_path(index_dir: &Path) -> PathBuf {
+    index_dir.join(MULTI_VECTOR_FILE)
+}
+
+/// Whether the index at `index_root` stores sub-vectors.
+pub fn is_enabled(index_root: &Path) -> bool {
+    info_path(&cs_core::locations::index_dir(index_root)).exists()
+}
+
+/// Mark the index at `index_root` as multi-vector. Files indexed before keep
+/// their single vector until they are indexed again.
+pub fn enable(index_root: &Path) -> Result<()> {
+    super::bundle::ensure_writable(index_root)?;
+    let info = MultiVectorInfo {
+        format_version: FORMAT_VERSION,
+        max_segment_lines: MAX_SEGMENT_LINES,
+        max_sub_vectors: MAX_SUB_VECTORS,
+    };
+    atomic_write(
+        &info_path(&cs_core::locations::index_dir(index_root)),
+        &serde_json::to_vec_pretty(&info)?,
+    )
+}
+
+/// The statement groups of a chunk's `text` that get their own vector.
+/// Empty when the chunk is a single group, which its own vector covers.
+pub fn segments(text: &str) -> Vec<String> {
+    let mut segments: Vec<Vec<&str>> = Vec::new();
+    let mut current: Vec<&str> = Vec::new();
+    for line in text.lines() {
+        let trimmed = line.trim();
+        if trimmed.is_empty() {
+            if !current.is_empty() {
+                segments.push(std::mem::take(&mut current));
+            }
+            continue;
+        }
+        current.push(trimmed);
+        if current.len() >= MAX_SEGMENT_LINES || ends_statement(trimmed) {
+            segments.push(std::mem::take(&mut current));
+        }
+    }
+    if !current.is_empty() {
+        segments.push(current);
+    }
+    segments.retain(|lines| {
+        lines
+            .iter()
+            .flat_map(|line| line.chars())
+            .filter(|c| c.is_alphanumeric())
+            .count()
+            >= MIN_SEGMENT_CHARS
+    });
+    if segments.len() <= 1 {
+        return Vec::new();
+    }
+    // Merge neighbors rather than drop the tail of a long chunk
+    let per_vector = segments.len().div_ceil(MAX_SUB_VECTORS);
+    segments
+        .chunks(per_vector)
+        .map(|group| group.concat().join("\n"))
+        .collect()
+}
+
+fn ends_statement(line: &str) -> bool {
+    line.ends_with(';') || line.ends_with('{') || line.ends_with('}')
+}
+
+/// Embed the statement groups of each embedded chunk in one batch, when the
+/// index at `repo_root` is multi-vector.
+pub fn attach_sub_embeddings(
+    chunk_entries: &mut [ChunkEntry],
+    content: &str,
+    embedder: Option<&mut dyn cs_embed::Embedder>,
+    repo_root: &Path,
+) -> Result<()> {
+    let Some(embedder) = embedder else {
+        return Ok(());
+    };
+    if !is_enabled(repo_root) {
+        return Ok(());
+    }
+
+    let mut targets = Vec::new();
+    let mut texts = Vec::new();
+    for (i, chunk) in chunk_entries.iter().enumerate() {
+        // An outline's statements already have vectors on its sections
+        if chunk.embedding.is_none() || chunk.is_outline() {
+            continue;
+        }
+        let Some(text) = content.get(chunk.span.byte_start..chunk.span.byte_end) else {
+            continue;
+        };
+        for segment in segments(text) {
+            if let Some(segment) = secrets::screen(&*embedder, repo_root, &segment)? {
+                targets.push(i);
+                texts.push(segment);
+            }
+        }
+    }
+    if texts.is_empty() {
+        return Ok(());
+    }
+    let embeddings = embedder.embed(&texts)?;
+    if embeddings.len() != texts.len() {
+        return Err(anyhow::anyhow!(
+            "Embedder returned {} embeddings for {} statement groups",
+            embeddings.len(),
+            texts.len()
+        ));
+    }
+    for (i, embedding) in targets.into_iter().zip(embeddings) {
+        chunk_entries[i].sub_embeddings.push(embedding);
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn chunks_split_into_statement_groups() {
+        let text = "\
+fn refresh(token: &str) -> Result<String> {
+    let claims = decode(token)?;
+    if claims.expired() {
+        return Err(anyhow!(\"token expired\"));
+    }
+
+    let fresh = sign(claims.renewed());
+    Ok(fresh)
+}
+";
+        let segments = segments(text);
+        assert_eq!(segments[0], "fn refresh(token: &str) -> Result<String> {");
+        assert_eq!(segments[1], "let claims = decode(token)?;");
+        assert!(segments.iter().any(|s| s.contains("token expired")));
+        // The closing braces have nothing to say on their own
+        assert!(segments.iter().all(|s| s != "}"));
+        assert_eq!(
+            segments.last().unwrap(),
+            "let fresh = sign(claims.renewed());"
+        );
+
+        assert!(super::segments("let only = one_statement();").is_empty());
+
+        let long: String = (0..100)
+            .map(|i| format!("total += compute_value({});\n", i))
+            .collect();
+        let segments = super::segments(&long);
+        assert_eq!(segments.len(), 15);
+        assert_eq!(segments.concat().matches("compute_value").count(), 100);
+    }
+}
@@ -0,0 +1,412 @@
+//! Normalizers: rewrites of a chunk's text before it's embedded, so the
+//! embedding is about the code rather than the boilerplate around it. Which
+//! ones help depends on the codebase, so none run unless a
+//! `.csnormalize.toml` at the repository root lists them:
+//!
+//! ```toml
+//! # Applied in this order
+//! normalizers = ["strip-license-header", "strip-generated-markers", "demote-imports", "collapse-whitespace"]
+//!
+//! # Then these, in order
+//! [[replace]]
+//! pattern = '(?m)^\s*//\s*nolint\b.*$'
+//! replacement = ""
+//! ```
+//!
+//! - `strip-license-header`: drops a leading comment block that mentions a
+//!   license or copyright
+//! - `strip-generated-markers`: drops `Code generated ... DO NOT EDIT.`,
+//!   `@generated` and similar lines (see [`crate::generated`])
+//! - `demote-imports`: moves import blocks (`import`, `use`, `using`,
+//!   `#include`, `require`) to the end, so the code leads
+//! - `collapse-whitespace`: trailing whitespace goes, runs of spaces and
+//!   tabs become one space and runs of blank lines one blank line
+//!
+//! Only the embedded text changes: spans, previews and snippets are the
+//! source as written. A chunk the normalizers would empty is embedded as it
+//! is. Like intent tags, normalized embeddings are recorded when a file is
+//! indexed, so a changed `.csnormalize.toml` takes effect as files change,
+//! or everywhere after `cs --clean . && cs --index .`.
+
+use anyhow::Result;
+use regex::Regex;
+use serde::Deserialize;
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+
+pub const NORMALIZE_FILE: &str = ".csnormalize.toml";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Normalizer {
+    StripLicenseHeader,
+    StripGeneratedMarkers,
+    DemoteImports,
+    CollapseWhitespace,
+}
+
+impl Normalizer {
+    fn apply(self, text: &str) -> String {
+        match self {
+            Normalizer::StripLicenseHeader => strip_license_header(text),
+            Normalizer::StripGeneratedMarkers => text
+                .lines()
+                .filter(|line| !super::generated::is_marker(line))
+                .collect::<Vec<_>>()
+                .join("\n"),
+            Normalizer::DemoteImports => demote_imports(text),
+            Normalizer::CollapseWhitespace => collapse_whitespace(text),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Replacement {
+    pub pattern: String,
+    #[serde(default)]
+    pub replacement: String,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct NormalizeFile {
+    #[serde(default)]
+    normalizers: Vec<Normalizer>,
+    #[serde(default)]
+    replace: Vec<Replacement>,
+}
+
+/// The normalizers of one repository, compiled.
+#[derive(Default)]
+pub struct Pipeline {
+    normalizers: Vec<Normalizer>,
+    replacements: Vec<(Regex, String)>,
+}
+
+impl Pipeline {
+    pub fn new(normalizers: Vec<Normalizer>, replacements: &[Replacement]) -> Result<Self> {
+        let replacements = replacements
+            .iter()
+            .map(|replace| {
+                let regex = Regex::new(&replace.pattern).map_err(|e| {
+                    anyhow::anyhow!("Invalid [[replace]] pattern '{}': {}", replace.pattern, e)
+                })?;
+                Ok((regex, replace.replacement.clone()))
+            })
+            .collect::<Result<_>>()?;
+        Ok(Self {
+            normalizers,
+            replacements,
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.normalizers.is_empty() && self.replacements.is_empty()
+    }
+
+    /// `text` as it's embedded.
+    pub fn apply<'a>(&self, text: &'a str) -> Cow<'a, str> {
+        if self.is_empty() {
+            return Cow::Borrowed(text);
+        }
+        let mut normalized = text.to_string();
+        for normalizer in &self.normalizers {
+            normalized = normalizer.apply(&normalized);
+        }
+        for (regex, replacement) in &self.replacements {
+            normalized = regex
+                .replace_all(&normalized, replacement.as_str())
+                .into_owned();
+        }
+        if normalized.trim().is_empty() {
+            Cow::Borrowed(text)
+        } else {
+            Cow::Owned(normalized)
+        }
+    }
+}
+
+static PIPELINES: LazyLock<Mutex<HashMap<PathBuf, Arc<Pipeline>>>> =
+    LazyLock::new(Default::default);
+
+/// The normalizers `.csnormalize.toml` at `repo_root` lists, compiled once
+/// per process; none if the file is absent.
+pub fn pipeline_for(repo_root: &Path) -> Result<Arc<Pipeline>> {
+    let mut pipelines = PIPELINES.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(pipeline) = pipelines.get(repo_root) {
+        return Ok(pipeline.clone());
+    }
+    let path = repo_root.join(NORMALIZE_FILE);
+    let pipeline = if path.exists() {
+        let file: NormalizeFile = toml::from_str(&fs::read_to_string(&path)?)
+            .map_err(|e| anyhow::anyhow!("Failed to parse {}: {}", path.display(), e))?;
+        Pipeline::new(file.normalizers, &file.replace)
+            .map_err(|e| anyhow::anyhow!("{} in {}", e, path.display()))?
+    } else {
+        Pipeline::default()
+    };
+    let pipeline = Arc::new(pipeline);
+    pipelines.insert(repo_root.to_path_buf(), pipeline.clone());
+    Ok(pipeline)
+}
+
+/// `text` from a chunk of `repo_root` as it's embedded.
+pub fn normalize<'a>(repo_root: &Path, text: &'a str) -> Result<Cow<'a, str>> {
+    Ok(pipeline_for(repo_root)?.apply(text))
+}
+
+static LICENSE_WORDS: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?i)\b(?:licen[sc]ed?|copyright|spdx-license-identifier|all rights reserved)\b")
+        .unwrap()
+});
+
+/// Whether `line` (trimmed) is a line comment in one of the usual syntaxes.
+/// `#` only counts before a space or another `#`, so `#include` and
+/// `#[derive]` don't.
+fn is_line_comment(line: &str) -> bool {
+    line.starts_with("//")
+        || line.starts_with("--")
+        || line.starts_with(';')
+        || line == "#"
+        || line.starts_with("# ")
+        || line.starts_with("##")
+}
+
+fn strip_license_header(text: &str) -> String {
+    let lines: Vec<&str> = text.lines().collect();
+    let mut start = 0;
+    while start < lines.len() && lines[start].trim().is_empty() {
+        start += 1;
+    }
+    // A shebang stays
+    if lines.get(start).is_some_and(|line| line.starts_with("#!")) {
+        start += 1;
+    }
+
+    let mut end = start;
+    let mut in_block = false;
+    while end < lines.len() {
+        let line = lines[end].trim();
+        if in_block {
+            in_block = !line.contains("*/");
+        } else if let Some(rest) = line.strip_prefix("/*") {
+            in_block = !rest.contains("*/");
+        } else if !is_line_comment(line) {
+            break;
+        }
+        end += 1;
+    }
+    if end == start
+        || !lines[start..end]
+            .iter()
+            .any(|line| LICENSE_WORDS.is_match(line))
+    {
+        return text.to_string();
+    }
+    while end < lines.len() && lines[end].trim().is_empty() {
+        end += 1;
+    }
+    lines[..start]
+        .iter()
+        .chain(&lines[end..])
+        .copied()
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+static IMPORT_START: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r#"^(?:import\b|from\s+[\w.]+\s+import\b|(?:pub(?:\([^)]*\))?\s+)?use\s+[\w:{]|using\s+[\w.=\s]+;|#\s*include\b|require(?:_relative)?[\s('"]|(?:const|let|var)\s+[\w{}\s,]+=\s*require\()"#,
+    )
+    .unwrap()
+});
+
+/// Lines from `start` that make up the import statement starting there.
+fn import_len(lines: &[&str], start: usize) -> usize {
+    let first = lines[start].trim_end();
+    // Go's `import (` and Python's `from x import (` run to the closing paren
+    let closing = if first.ends_with('(') {
+        ')'
+    } else if first.contains('{') && !first.contains('}') {
+        '}'
+    } else {
+        return 1;
+    };
+    lines[start + 1..]
+        .iter()
+        .position(|line| line.contains(closing))
+        .map_or(lines.len() - start, |i| i + 2)
+}
+
+fn demote_imports(text: &str) -> String {
+    let lines: Vec<&str> = text.lines().collect();
+    let mut code = Vec::new();
+    let mut imports = Vec::new();
+    let mut i = 0;
+    while i < lines.len() {
+        // Top-level statements only; indented ones are code
+        if IMPORT_START.is_match(lines[i]) {
+            let len = import_len(&lines, i);
+            imports.extend_from_slice(&lines[i..i + len]);
+            i += len;
+        } else {
+            code.push(lines[i]);
+            i += 1;
+        }
+    }
+    if imports.is_empty() || code.iter().all(|line| line.trim().is_empty()) {
+        return text.to_string();
+    }
+    let code = code.join("\n");
+    format!("{}\n\n{}", code.trim(), imports.join("\n"))
+}
+
+fn collapse_whitespace(text: &str) -> String {
+    let mut collapsed = String::with_capacity(text.len());
+    let mut blank_run = false;
+    for line in text.lines() {
+        let words: Vec<&str> = line.split([' ', '\t']).filter(|w| !w.is_empty()).collect();
+        if words.is_empty() {
+            if !blank_run && !collapsed.is_empty() {
+                collapsed.push('\n');
+            }
+            blank_run = true;
+            continue;
+        }
+        blank_run = false;
+        if line.starts_with([' ', '\t']) {
+            collapsed.push(' ');
+        }
+        collapsed.push_str(&words.join(" "));
+        collapsed.push('\n');
+    }
+    collapsed.trim_end().to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn license_headers_go_and_other_comments_stay() {
+        let go = "// Copyright 2024 Acme Inc.\n// Licensed under the Apache License, Version 2.0.\n\n// Package retry retries.\npackage retry\n";
+        assert_eq!(
+            strip_license_header(go),
+            "// Package retry retries.\npackage retry"
+        );
+
+        let c = "/*\n * SPDX-License-Identifier: MIT\n */\n#include <stdio.h>\n";
+        assert_eq!(strip_license_header(c), "#include <stdio.h>");
+
+        let python = "#!/usr/bin/env python3\n# Copyright (c) Acme\n\nimport os\n";
+        assert_eq!(
+            strip_license_header(python),
+            "#!/usr/bin/env python3\nimport os"
+        );
+
+        let doc = "// Retry calls f until it succeeds.\nfunc Retry(f func() error) {}\n";
+        assert_eq!(strip_license_header(doc), doc);
+    }
+
+    #[test]
+    fn imports_move_after_the_code() {
+        let go = "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n\tfmt.Println(os.Args)\n}\n";
+        assert_eq!(
+            demote_imports(go),
+            "package main\n\n\nfunc main() {\n\tfmt.Println(os.Args)\n}\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)"
+        );
+
+        let rust = "use std::collections::{\n    HashMap,\n    HashSet,\n};\nuse std::fs;\n\npub fn load() {}\n";
+        assert_eq!(
+            demote_imports(rust),
+            "pub fn load() {}\n\nuse std::collections::{\n    HashMap,\n    HashSet,\n};\nuse std::fs;"
+        );
+
+        let python =
+            "from typing import (\n    List,\n)\nimport os\n\ndef main():\n    import sys\n";
+        assert_eq!(
+            demote_imports(python),
+            "def main():\n    import sys\n\nfrom typing import (\n    List,\n)\nimport os"
+        );
+
+        // Nothing but imports stays as it is
+        let only = "import os\nimport sys\n";
+        assert_eq!(demote_imports(only), only);
+    }
+
+    #[test]
+    fn whitespace_collapses_and_markers_go() {
+        assert_eq!(
+            collapse_whitespace("fn  main() {   \n\n\n\n\tlet x  =\t1;\n}\n"),
+            "fn main() {\n\n let x = 1;\n}"
+        );
+        assert_eq!(
+            Normalizer::StripGeneratedMarkers
+                .apply("// Code generated by mockgen. DO NOT EDIT.\npackage mocks"),
+            "package mocks"
+        );
+    }
+
+    #[test]
+    fn pipelines_run_in_order_and_never_empty_a_chunk() {
+        let pipeline = Pipeline::new(
+            vec![
+                Normalizer::StripLicenseHeader,
+                Normalizer::CollapseWhitespace,
+            ],
+            &[Replacement {
+                pattern: r"\s*//\s*nolint\S*".to_string(),
+                replacement: String::new(),
+            }],
+        )
+        .unwrap();
+        assert_eq!(
+            pipeline.apply("// Copyright Acme\n\nfunc  f() {} //nolint:errcheck\n"),
+            "func f() {}"
+        );
+        let header_only = "// Copyright Acme\n";
+        assert!(matches!(pipeline.apply(header_only), Cow::Borrowed(_)));
+        assert!(matches!(
+            Pipeline::default().apply("func f() {}"),
+            Cow::Borrowed(_)
+        ));
+        assert!(
+            Pipeline::new(
+                Vec::new(),
+                &[Replacement {
+                    pattern: "(".to_string(),
+                    replacement: String::new(),
+                }],
+            )
+            .is_err()
+        );
+    }
+
+    #[test]
+    fn repositories_list_their_normalizers() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        assert!(pipeline_for(root).unwrap().is_empty());
+
+        let configured = TempDir::new().unwrap();
+        fs::write(
+            configured.path().join(NORMALIZE_FILE),
+            "normalizers = [\"collapse-whitespace\"]\n",
+        )
+        .unwrap();
+        assert_eq!(normalize(configured.path(), "a   b\n").unwrap(), "a b");
+
+        let unknown = TempDir::new().unwrap();
+        fs::write(
+            unknown.path().join(NORMALIZE_FILE),
+            "normalizers = [\"strip-everything\"]\n",
+        )
+        .unwrap();
+        assert!(pipeline_for(unknown.path()).is_err());
+    }
+}
@@ -0,0 +1,807 @@
+//! Index snapshots in OCI registries: `cs --publish-index oci://ghcr.io/org/repo-index`
+//! pushes the index as an artifact tagged with the commit it was built at,
+//! and `cs --fetch-index oci://ghcr.io/org/repo-index` pulls it the way a
+//! peer's index is fetched, so snapshots travel through the registries CI
+//! already pushes images to.
+//!
+//! The artifact is an OCI image manifest of artifact type [`ARTIFACT_TYPE`]
+//! with the empty config and one layer: the index manifest and sidecars,
+//! bincode-encoded and zstd-compressed. Blobs are addressed by digest, so
+//! publishing an index already in the repository only uploads the manifest.
+//! Without a `:tag` in the reference, the tag is the checkout's commit
+//! (`git rev-parse HEAD`), on both ends. An encrypted index isn't
+//! published: its sidecars can't be read without the key, which doesn't
+//! travel with them.
+//!
+//! A pulled layer is trusted no more than a peer: one whose descriptor or
+//! `Content-Length` says more than [`MAX_LAYER_BYTES`] isn't downloaded, the
+//! download goes to a temporary file through the digest check, and it's
+//! decompressed a sidecar at a time up to [`MAX_SNAPSHOT_BYTES`]. Manifest
+//! keys that lead out of the index fail the pull.
+//!
+//! Registries are spoken to with the distribution API, over HTTPS except on
+//! localhost. Public repositories pull anonymously; otherwise
+//! `CS_REGISTRY_USER` and `CS_REGISTRY_PASSWORD` are exchanged for a token
+//! when the registry asks for one, or `CS_REGISTRY_TOKEN` is sent as is.
+
+use super::peer::{FetchStats, decode_sidecar, describes, local_metadata};
+use super::{atomic_write, path_utils, save_manifest};
+use anyhow::{Context, Result, bail};
+use bincode::Options;
+use cs_core::FileMetadata;
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::io::{BufReader, Read, Seek, Write};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::time::SystemTime;
+
+/// Artifact type of published index snapshots.
+pub const ARTIFACT_TYPE: &str = "application/vnd.semcs.index.v1";
+const LAYER_MEDIA_TYPE: &str = "application/vnd.semcs.index.layer.v1.bincode+zstd";
+const MANIFEST_MEDIA_TYPE: &str = "application/vnd.oci.image.manifest.v1+json";
+const EMPTY_MEDIA_TYPE: &str = "application/vnd.oci.empty.v1+json";
+const EMPTY_CONFIG: &[u8] = b"{}";
+const REVISION_ANNOTATION: &str = "org.opencontainers.image.revision";
+const MODEL_ANNOTATION: &str = "dev.semcs.index.model";
+const FORMAT_VERSION: u32 = 1;
+const LEVEL: i32 = zstd::DEFAULT_COMPRESSION_LEVEL;
+
+/// Largest snapshot a layer is decompressed to.
+pub const MAX_SNAPSHOT_BYTES: u64 = 4 * 1024 * 1024 * 1024;
+
+/// Largest compressed layer that's downloaded.
+pub const MAX_LAYER_BYTES: u64 = 1024 * 1024 * 1024;
+
+/// `oci://registry/repository[:tag]`, parsed.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct OciReference {
+    pub registry: String,
+    pub repository: String,
+    pub tag: Option<String>,
+}
+
+impl OciReference {
+    pub fn parse(location: &str) -> Result<Self> {
+        let Some(rest) = location.trim().strip_prefix("oci://") else {
+            bail!(
+                "'{}' isn't an OCI reference; use oci://registry/repository[:tag]",
+                location
+            );
+        };
+        let Some((registry, name)) = rest.split_once('/') else {
+            bail!(
+                "'{}' names no repository; use oci://registry/repository[:tag]",
+                location
+            );
+        };
+        // A colon after the last slash starts the tag; one before it is a port
+        let (repository, tag) = match name.rsplit_once(':') {
+            Some((repository, tag)) if !tag.contains('/') => (repository, Some(tag)),
+            _ => (name, None),
+        };
+        let repository = repository.trim_end_matches('/');
+        let valid = |c: char| {
+            c.is_ascii_lowercase() || c.is_ascii_digit() || matches!(c, '.' | '_' | '-' | '/')
+        };
+        if registry.is_empty() || repository.is_empty() || !repository.chars().all(valid) {
+            bail!(
+                "'{}' isn't a valid OCI reference: repositories are lowercase letters, digits and ._-/",
+                location
+            );
+        }
+        if tag.is_some_and(|tag| tag.is_empty() || tag.len() > 128) {
+            bail!("'{}' has an empty or overlong tag", location);
+        }
+        Ok(Self {
+            registry: registry.to_string(),
+            repository: repository.to_string(),
+            tag: tag.map(str::to_string),
+        })
+    }
+
+    /// The reference with `tag`.
+    pub fn display_with(&self, tag: &str) -> String {
+        format!("oci://{}/{}:{}", self.registry, self.repository, tag)
+    }
+
+    fn origin(&self) -> String {
+        let host = self.registry.split(':').next().unwrap_or_default();
+        let scheme = if matches!(host, "localhost" | "127.0.0.1" | "[::1]") {
+            "http"
+        } else {
+            "https"
+        };
+        format!("{}://{}", scheme, self.registry)
+    }
+
+    fn api(&self, path: &str) -> String {
+        format!("{}/v2/{}/{}", self.origin(), self.repository, path)
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Descriptor {
+    media_type: String,
+    digest: String,
+    size: u64,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    annotations: BTreeMap<String, String>,
+}
+
+impl Descriptor {
+    fn of(media_type: &str, data: &[u8]) -> Self {
+        Self {
+            media_type: media_type.to_string(),
+            digest: digest(data),
+            size: data.len() as u64,
+            annotations: BTreeMap::new(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct ImageManifest {
+    schema_version: u32,
+    #[serde(default)]
+    media_type: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    artifact_type: Option<String>,
+    config: Descriptor,
+    layers: Vec<Descriptor>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    annotations: BTreeMap<String, String>,
+}
+
+/// The layer's contents.
+#[derive(Serialize, Deserialize)]
+struct Snapshot {
+    format_version: u32,
+    /// `manifest.json` as stored
+    manifest: Vec<u8>,
+    sidecars: Vec<SnapshotSidecar>,
+}
+
+#[derive(Serialize, Deserialize)]
+struct SnapshotSidecar {
+    /// Of the indexed file, relative to the repository root, `/`-separated
+    path: String,
+    data: Vec<u8>,
+}
+
+#[derive(Debug, Clone)]
+pub struct PublishStats {
+    /// `oci://registry/repository:tag`
+    pub reference: String,
+    /// Digest of the artifact manifest
+    pub digest: String,
+    pub files: usize,
+    /// Size of the compressed layer
+    pub bytes: u64,
+    /// False when the registry already had the layer
+    pub uploaded: bool,
+}
+
+/// `sha256:<hex>` of `data`, as registries address blobs.
+fn digest(data: &[u8]) -> String {
+    format_digest(ring::digest::digest(&ring::digest::SHA256, data))
+}
+
+fn format_digest(hash: ring::digest::Digest) -> String {
+    let hex: String = hash.as_ref().iter().map(|b| format!("{:02x}", b)).collect();
+    format!("sha256:{}", hex)
+}
+
+/// The commit checked out at `repo_root`.
+fn head_commit(repo_root: &Path) -> Result<String> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(repo_root)
+        .args(["rev-parse", "HEAD"])
+        .output()
+        .context("Failed to run git")?;
+    if !output.status.success() {
+        bail!(
+            "{} isn't a git checkout with a commit; name a tag, e.g. oci://registry/repository:latest",
+            repo_root.display()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+fn tag_for(reference: &OciReference, repo_root: &Path) -> Result<String> {
+    match &reference.tag {
+        Some(tag) => Ok(tag.clone()),
+        None => head_commit(repo_root),
+    }
+}
+
+fn now_secs() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+/// The layer for the index at `repo_root`, the number of sidecars in it and
+/// the index's model.
+fn pack(repo_root: &Path) -> Result<(Vec<u8>, usize, Option<String>)> {
+    if super::encryption::is_encrypted(repo_root) {
+        bail!(
+            "The index at {} is encrypted, and its sidecars can't be read without its key; publish an unencrypted index instead, such as one built in CI",
+            repo_root.display()
+        );
+    }
+    let index_dir = cs_core::locations::index_dir(repo_root);
+    let manifest = super::load_manifest(repo_root)?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No index found at {}. Run 'cs --index' before publishing.",
+            repo_root.display()
+        )
+    })?;
+    let mut sidecars = Vec::with_capacity(manifest.files.len());
+    for manifest_key in manifest.files.keys() {
+        let standard_path = path_utils::from_manifest_path(manifest_key);
+        let sidecar = path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path);
+        // Evicted or pending; the fetching side indexes it
+        let Ok(data) = fs::read(&sidecar) else {
+            continue;
+        };
+        sidecars.push(SnapshotSidecar {
+            path: cs_core::paths::to_slash(&standard_path),
+            data,
+        });
+    }
+    let files = sidecars.len();
+    let snapshot = bincode::serialize(&Snapshot {
+        format_version: FORMAT_VERSION,
+        manifest: fs::read(index_dir.join("manifest.json"))?,
+        sidecars,
+    })?;
+    Ok((
+        zstd::encode_all(snapshot.as_slice(), LEVEL)?,
+        files,
+        manifest.embedding_model,
+    ))
+}
+
+/// A layer's [`Snapshot`], read a sidecar at a time so a large one is
+/// never held in memory whole. Fields are read in the order bincode wrote
+/// them.
+struct SnapshotReader<R: Read> {
+    decoder: std::io::Take<zstd::Decoder<'static, BufReader<R>>>,
+    limit: u64,
+    /// Sidecars not read yet
+    remaining: u64,
+}
+
+impl<R: Read> SnapshotReader<R> {
+    /// Start reading the snapshot in `layer`, failing once it passes
+    /// `limit` bytes. Returns its `manifest.json` as stored.
+    fn open(layer: R, limit: u64) -> Result<(Vec<u8>, Self)> {
+        let mut reader = Self {
+            decoder: zstd::Decoder::new(layer)?.take(limit + 1),
+            limit,
+            remaining: 0,
+        };
+        let format_version: u32 = reader.read()?;
+        if format_version != FORMAT_VERSION {
+            bail!(
+                "The index artifact has snapshot format {}; this cs reads format {}",
+                format_version,
+                FORMAT_VERSION
+            );
+        }
+        let manifest: Vec<u8> = reader.read()?;
+        reader.remaining = reader.read()?;
+        Ok((manifest, reader))
+    }
+
+    fn next_sidecar(&mut self) -> Result<Option<SnapshotSidecar>> {
+        if self.remaining == 0 {
+            return Ok(None);
+        }
+        self.remaining -= 1;
+        self.read().map(Some)
+    }
+
+    fn read<T: DeserializeOwned>(&mut self) -> Result<T> {
+        // What's left of the limit also bounds what a length may allocate
+        let left = self.decoder.limit();
+        match bincode::options()
+            .with_fixint_encoding()
+            .allow_trailing_bytes()
+            .with_limit(left)
+            .deserialize_from(&mut self.decoder)
+        {
+            Ok(value) => Ok(value),
+            Err(e) if self.decoder.limit() == 0 || matches!(*e, bincode::ErrorKind::SizeLimit) => {
+                bail!(
+                    "The index artifact's layer unpacks to more than {} bytes",
+                    self.limit
+                )
+            }
+            Err(e) => Err(anyhow::Error::from(e)
+                .context("The index artifact's layer isn't a cs index snapshot")),
+        }
+    }
+}
+
+/// The realm and service of a `WWW-Authenticate: Bearer ...` challenge.
+fn parse_challenge(header: &str) -> Option<(String, Option<String>)> {
+    let params = header.trim().strip_prefix("Bearer ")?;
+    let mut realm = None;
+    let mut service = None;
+    for param in params.split(',') {
+        let Some((key, value)) = param.trim().split_once('=') else {
+            continue;
+        };
+        let value = value.trim_matches('"').to_string();
+        match key.trim() {
+            "realm" => realm = Some(value),
+            "service" => service = Some(value),
+            _ => {}
+        }
+    }
+    Some((realm?, service))
+}
+
+struct Registry {
+    client: reqwest::Client,
+    reference: OciReference,
+    /// `repository:<name>:pull` or `:pull,push`
+    scope: String,
+    token: Option<String>,
+}
+
+impl Registry {
+    fn new(reference: &OciReference, push: bool) -> Result<Self> {
+        let client = cs_core::network::client_builder()?
+            .user_agent(concat!("cs/", env!("CARGO_PKG_VERSION")))
+            .build()?;
+        Ok(Self {
+            client,
+            scope: format!(
+                "repository:{}:{}",
+                reference.repository,
+                if push { "pull,push" } else { "pull" }
+            ),
+            reference: reference.clone(),
+            token: std::env::var("CS_REGISTRY_TOKEN").ok(),
+        })
+    }
+
+    /// Send the request `build` makes, logging in once if the registry asks.
+    async fn send(
+        &mut self,
+        build: impl Fn(&reqwest::Client) -> reqwest::RequestBuilder,
+    ) -> Result<reqwest::Response> {
+        let response = self.authorized(build(&self.client)).send().await?;
+        if response.status() != reqwest::StatusCode::UNAUTHORIZED || self.token.is_some() {
+            return Ok(response);
+        }
+        let challenge = response
+            .headers()
+            .get(reqwest::header::WWW_AUTHENTICATE)
+            .and_then(|value| value.to_str().ok())
+            .and_then(parse_challenge);
+        let Some((realm, service)) = challenge else {
+            return Ok(response);
+        };
+        self.token = Some(self.login(&realm, service.as_deref()).await?);
+        Ok(self.authorized(build(&self.client)).send().await?)
+    }
+
+    fn authorized(&self, request: reqwest::RequestBuilder) -> reqwest::RequestBuilder {
+        match &self.token {
+            Some(token) => request.bearer_auth(token),
+            None => request,
+        }
+    }
+
+    async fn login(&self, realm: &str, service: Option<&str>) -> Result<String> {
+        #[derive(Deserialize)]
+        struct TokenResponse {
+            token: Option<String>,
+            access_token: Option<String>,
+        }
+
+        let mut request = self.client.get(realm).query(&[("scope", &self.scope)]);
+        if let Some(service) = service {
+            request = request.query(&[("service", service)]);
+        }
+        if let Ok(user) = std::env::var("CS_REGISTRY_USER") {
+            request = request.basic_auth(user, std::env::var("CS_REGISTRY_PASSWORD").ok());
+        }
+        let response = request.send().await?;
+        if !response.status().is_success() {
+            bail!(
+                "{} refused a token for {} ({}). Set CS_REGISTRY_USER and CS_REGISTRY_PASSWORD, or CS_REGISTRY_TOKEN.",
+                self.reference.registry,
+                self.scope,
+                response.status()
+            );
+        }
+        let body: TokenResponse = serde_json::from_slice(&response.bytes().await?)?;
+        body.token
+            .or(body.access_token)
+            .ok_or_else(|| anyhow::anyhow!("{} sent no token", realm))
+    }
+
+    fn failed(&self, what: &str, status: reqwest::StatusCode) -> anyhow::Error {
+        anyhow::anyhow!(
+            "{} failed for oci://{}/{} ({}). Check CS_REGISTRY_USER / CS_REGISTRY_PASSWORD and the repository's permissions.",
+            what,
+            self.reference.registry,
+            self.reference.repository,
+            status
+        )
+    }
+
+    async fn has_blob(&mut self, digest: &str) -> Result<bool> {
+        let url = self.reference.api(&format!("blobs/{}", digest));
+        let response = self.send(|client| client.head(&url)).await?;
+        Ok(response.status().is_success())
+    }
+
+    /// Upload `data` as the blob `descriptor` describes, unless the
+    /// repository has it. Returns whether it was uploaded.
+    async fn push_blob(&mut self, descriptor: &Descriptor, data: &[u8]) -> Result<bool> {
+        if self.has_blob(&descriptor.digest).await? {
+            return Ok(false);
+        }
+        let start = self.reference.api("blobs/uploads/");
+        let response = self.send(|client| client.post(&start)).await?;
+        if !response.status().is_success() {
+            return Err(self.failed("Starting a blob upload", response.status()));
+        }
+        let location = response
+            .headers()
+            .get(reqwest::header::LOCATION)
+            .and_then(|value| value.to_str().ok())
+            .ok_or_else(|| anyhow::anyhow!("The registry didn't say where to upload the blob"))?;
+        let mut upload = if location.starts_with('/') {
+            format!("{}{}", self.reference.origin(), location)
+        } else {
+            location.to_string()
+        };
+        upload.push(if upload.contains('?') { '&' } else { '?' });
+        upload.push_str(&format!("digest={}", descriptor.digest));
+        let response = self
+            .send(|client| {
+                client
+                    .put(&upload)
+                    .header(reqwest::header::CONTENT_TYPE, "application/octet-stream")
+                    .body(data.to_vec())
+            })
+            .await?;
+        if !response.status().is_success() {
+            return Err(self.failed("Uploading a blob", response.status()));
+        }
+        Ok(true)
+    }
+
+    async fn put_manifest(&mut self, tag: &str, manifest: &[u8]) -> Result<()> {
+        let url = self.reference.api(&format!("manifests/{}", tag));
+        let response = self
+            .send(|client| {
+                client
+                    .put(&url)
+                    .header(reqwest::header::CONTENT_TYPE, MANIFEST_MEDIA_TYPE)
+                    .body(manifest.to_vec())
+            })
+            .await?;
+        if !response.status().is_success() {
+            return Err(self.failed("Tagging the index artifact", response.status()));
+        }
+        Ok(())
+    }
+
+    async fn get_manifest(&mut self, tag: &str) -> Result<Option<ImageManifest>> {
+        let url = self.reference.api(&format!("manifests/{}", tag));
+        let response = self
+            .send(|client| {
+                client
+                    .get(&url)
+                    .header(reqwest::header::ACCEPT, MANIFEST_MEDIA_TYPE)
+            })
+            .await?;
+        match response.status() {
+            status if status.is_success() => {
+                Ok(Some(serde_json::from_slice(&response.bytes().await?)?))
+            }
+            reqwest::StatusCode::NOT_FOUND => Ok(None),
+            status => Err(self.failed("Reading the index artifact", status)),
+        }
+    }
+
+    /// Download the blob `descriptor` describes into `file`, checking its
+    /// size and digest as it comes.
+    async fn get_blob(&mut self, descriptor: &Descriptor, file: &mut fs::File) -> Result<()> {
+        if descriptor.size > MAX_LAYER_BYTES {
+            bail!(
+                "The index layer of oci://{}/{} is {} bytes, more than the {} a pull downloads",
+                self.reference.registry,
+                self.reference.repository,
+                descriptor.size,
+                MAX_LAYER_BYTES
+            );
+        }
+        let url = self.reference.api(&format!("blobs/{}", descriptor.digest));
+        let mut response = self.send(|client| client.get(&url)).await?;
+        if !response.status().is_success() {
+            return Err(self.failed("Downloading the index layer", response.status()));
+        }
+        if let Some(length) = response.content_length()
+            && length != descriptor.size
+        {
+            bail!(
+                "The registry sent {} bytes for an index layer of {}",
+                length,
+                descriptor.size
+            );
+        }
+        let mut hasher = ring::digest::Context::new(&ring::digest::SHA256);
+        let mut received = 0u64;
+        while let Some(chunk) = response.chunk().await? {
+            received += chunk.len() as u64;
+            if received > descriptor.size {
+                bail!(
+                    "The registry sent more than the {} bytes of the index layer",
+                    descriptor.size
+                );
+            }
+            hasher.update(&chunk);
+            file.write_all(&chunk)?;
+        }
+        if received != descriptor.size || format_digest(hasher.finish()) != descriptor.digest {
+            bail!(
+                "The index layer from oci://{}/{} doesn't match its digest {}",
+                self.reference.registry,
+                self.reference.repository,
+                descriptor.digest
+            );
+        }
+        file.rewind()?;
+        Ok(())
+    }
+}
+
+/// The artifact manifest for `layer`, built at `revision` with `model`.
+fn artifact_manifest(layer: &Descriptor, revision: &str, model: Option<&str>) -> ImageManifest {
+    let mut annotations = BTreeMap::from([(REVISION_ANNOTATION.to_string(), revision.to_string())]);
+    if let Some(model) = model {
+        annotations.insert(MODEL_ANNOTATION.to_string(), model.to_string());
+    }
+    ImageManifest {
+        schema_version: 2,
+        media_type: Some(MANIFEST_MEDIA_TYPE.to_string()),
+        artifact_type: Some(ARTIFACT_TYPE.to_string()),
+        config: Descriptor::of(EMPTY_MEDIA_TYPE, EMPTY_CONFIG),
+        layers: vec![layer.clone()],
+        annotations,
+    }
+}
+
+/// Push the index of `repo_root` to the OCI reference `location`, tagged
+/// with its tag or the checkout's commit.
+pub async fn publish_index(location: &str, repo_root: &Path) -> Result<PublishStats> {
+    let reference = OciReference::parse(location)?;
+    let tag = tag_for(&reference, repo_root)?;
+    let (layer, files, model) = pack(repo_root)?;
+    let revision = head_commit(repo_root).unwrap_or_else(|_| tag.clone());
+
+    let mut registry = Registry::new(&reference, true)?;
+    let config = Descriptor::of(EMPTY_MEDIA_TYPE, EMPTY_CONFIG);
+    registry.push_blob(&config, EMPTY_CONFIG).await?;
+    let layer_descriptor = Descriptor::of(LAYER_MEDIA_TYPE, &layer);
+    let uploaded = registry.push_blob(&layer_descriptor, &layer).await?;
+    let manifest = serde_json::to_vec(&artifact_manifest(
+        &layer_descriptor,
+        &revision,
+        model.as_deref(),
+    ))?;
+    registry.put_manifest(&tag, &manifest).await?;
+
+    Ok(PublishStats {
+        reference: reference.display_with(&tag),
+        digest: digest(&manifest),
+        files,
+        bytes: layer.len() as u64,
+        uploaded,
+    })
+}
+
+/// Seed the index of `repo_root` from the snapshot at the OCI reference
+/// `location`, keeping sidecars the way [`super::peer::fetch_index`] does.
+/// Fails if `repo_root` already has an index.
+pub async fn pull_index(location: &str, repo_root: &Path) -> Result<FetchStats> {
+    let reference = OciReference::parse(location)?;
+    let index_dir = cs_core::locations::index_dir(repo_root);
+    let manifest_path = index_dir.join("manifest.json");
+    if manifest_path.exists() {
+        bail!(
+            "{} already has an index; run cs --clean there first to replace it with a fetched one",
+            repo_root.display()
+        );
+    }
+    let tag = tag_for(&reference, repo_root)?;
+
+    let mut registry = Registry::new(&reference, false)?;
+    let artifact = registry.get_manifest(&tag).await?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "{} doesn't exist; publish it with cs --publish-index {}",
+            reference.display_with(&tag),
+            location
+        )
+    })?;
+    let layer = artifact
+        .layers
+        .iter()
+        .find(|layer| layer.media_type == LAYER_MEDIA_TYPE)
+        .ok_or_else(|| {
+            anyhow::anyhow!("{} isn't a cs index artifact", reference.display_with(&tag))
+        })?
+        .clone();
+    let mut file = tempfile::tempfile()?;
+    registry.get_blob(&layer, &mut file).await?;
+    let (stored_manifest, mut snapshot) = SnapshotReader::open(file, MAX_SNAPSHOT_BYTES)?;
+
+    let mut manifest = super::manifest_format::decode(&stored_manifest)?;
+    path_utils::check_manifest_keys(&manifest)?;
+    super::validate_manifest_model(&manifest)?;
+    let mut stats = FetchStats {
+        bytes_downloaded: layer.size,
+        embedding_model: manifest.embedding_model.clone(),
+        ..FetchStats::default()
+    };
+
+    // Sidecars are named by the path they index
+    let mut published: HashMap<String, (&PathBuf, &FileMetadata, PathBuf)> = HashMap::new();
+    for (manifest_key, metadata) in &manifest.files {
+        let standard_path = path_utils::checked_manifest_key(manifest_key)?;
+        published.insert(
+            cs_core::paths::to_slash(&standard_path),
+            (manifest_key, metadata, standard_path),
+        );
+    }
+    let mut wanted: HashMap<PathBuf, FileMetadata> = HashMap::new();
+    while let Some(sidecar) = snapshot.next_sidecar()? {
+        let Some((manifest_key, metadata, standard_path)) = published.get(&sidecar.path) else {
+            continue;
+        };
+        if wanted.contains_key(*manifest_key) {
+            continue;
+        }
+        let Some(local) = local_metadata(repo_root, manifest_key) else {
+            continue;
+        };
+        // A sidecar is only valid for the contents it was built from
+        if local.hash != metadata.hash
+            || !decode_sidecar(&sidecar.data).is_ok_and(|entry| describes(&entry, &local))
+        {
+            continue;
+        }
+        let path = path_utils::get_sidecar_path_for_standard_path(&index_dir, standard_path);
+        atomic_write(&path, &sidecar.data)?;
+        stats.files_downloaded += 1;
+        wanted.insert((*manifest_key).clone(), local);
+    }
+    for manifest_key in manifest.files.keys() {
+        if wanted.contains_key(manifest_key) {
+            continue;
+        }
+        match local_metadata(repo_root, manifest_key) {
+            Some(_) => stats.files_changed += 1,
+            None => stats.files_missing += 1,
+        }
+    }
+
+    manifest.files = wanted;
+    manifest.updated = now_secs();
+    save_manifest(&manifest_path, &manifest)?;
+    Ok(stats)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_references() {
+        assert_eq!(
+            OciReference::parse("oci://ghcr.io/acme/shop-index:3f2a").unwrap(),
+            OciReference {
+                registry: "ghcr.io".to_string(),
+                repository: "acme/shop-index".to_string(),
+                tag: Some("3f2a".to_string()),
+            }
+        );
+        let local = OciReference::parse("oci://localhost:5000/shop-index").unwrap();
+        assert_eq!(local.registry, "localhost:5000");
+        assert_eq!(local.tag, None);
+        assert_eq!(
+            local.api("manifests/main"),
+            "http://localhost:5000/v2/shop-index/manifests/main"
+        );
+        assert!(OciReference::parse("oci://ghcr.io").is_err());
+        assert!(OciReference::parse("oci://ghcr.io/Acme/Index").is_err());
+        assert!(OciReference::parse("https://ghcr.io/acme/index").is_err());
+    }
+
+    #[test]
+    fn parses_bearer_challenges() {
+        assert_eq!(
+            parse_challenge(
+                r#"Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:acme/index:pull""#
+            ),
+            Some((
+                "https://ghcr.io/token".to_string(),
+                Some("ghcr.io".to_string())
+            ))
+        );
+        assert_eq!(parse_challenge(r#"Basic realm="registry""#), None);
+    }
+
+    #[test]
+    fn artifacts_describe_their_layer() {
+        let layer = Descriptor::of(LAYER_MEDIA_TYPE, b"layer");
+        let manifest = artifact_manifest(&layer, "3f2a", Some("jina-code"));
+        let json: serde_json::Value = serde_json::to_value(&manifest).unwrap();
+        assert_eq!(json["artifactType"], ARTIFACT_TYPE);
+        assert_eq!(
+            json["config"]["digest"],
+            // The OCI empty descriptor's well-known digest
+            "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+        );
+        assert_eq!(json["layers"][0]["size"], 5);
+        assert_eq!(json["annotations"][REVISION_ANNOTATION], "3f2a");
+    }
+
+    #[test]
+    fn layers_unpack_within_their_limit() {
+        let snapshot = bincode::serialize(&Snapshot {
+            format_version: FORMAT_VERSION,
+            manifest: b"{}".to_vec(),
+            sidecars: vec![SnapshotSidecar {
+                path: "src/lib.rs".to_string(),
+                data: vec![0; 64 * 1024],
+            }],
+        })
+        .unwrap();
+        let layer = zstd::encode_all(snapshot.as_slice(), LEVEL).unwrap();
+        let (manifest, mut reader) =
+            SnapshotReader::open(layer.as_slice(), MAX_SNAPSHOT_BYTES).unwrap();
+        assert_eq!(manifest, b"{}");
+        let sidecar = reader.next_sidecar().unwrap().unwrap();
+        assert_eq!(sidecar.path, "src/lib.rs");
+        assert_eq!(sidecar.data.len(), 64 * 1024);
+        assert!(reader.next_sidecar().unwrap().is_none());
+
+        // Zeros compress far below the limit they unpack past
+        assert!(layer.len() < 1024);
+        let (_, mut reader) = SnapshotReader::open(layer.as_slice(), 1024).unwrap();
+        let error = reader.next_sidecar().unwrap_err().to_string();
+        assert!(error.contains("more than 1024 bytes"), "{}", error);
+        assert!(SnapshotReader::open(&b"not zstd"[..], 1024).is_err());
+    }
+
+    #[test]
+    fn encrypted_indexes_are_not_published() {
+        let repo = tempfile::TempDir::new().unwrap();
+        let index_dir = cs_core::locations::index_dir(repo.path());
+        fs::create_dir_all(&index_dir).unwrap();
+        fs::write(index_dir.join("manifest.json"), "{}").unwrap();
+        fs::write(
+            index_dir.join(super::super::encryption::ENCRYPTION_FILE),
+            "{}",
+        )
+        .unwrap();
+        let error = pack(repo.path()).unwrap_err().to_string();
+        assert!(error.contains("encrypted"), "{}", error);
+    }
+}
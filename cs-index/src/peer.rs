@@ -0,0 +1,334 @@
+//! Warm start from a peer's index: `cs --fetch-index <url>` downloads the
+//! index a teammate's machine or CI already built, so a fresh checkout
+//! doesn't embed the whole repository from scratch.
+//!
+//! The peer serves its `.cs/` directory over HTTP (any static file server
+//! will do) or publishes it to object storage as for `--remote-index`.
+//! Unlike a remote index, the fetched copy becomes the checkout's own index.
+//! A sidecar is only taken for a file whose local contents hash the same as
+//! the peer's, and a downloaded sidecar must record that hash too, so
+//! nothing fetched describes code that isn't here; the usual incremental
+//! update indexes the rest afterwards.
+//!
+//! The peer is not trusted with paths: a manifest key that is absolute or
+//! leads out of the index fails the fetch before anything is read or
+//! written. Downloads are written to `.part` files in `.cs/fetch_staging/`
+//! and continued with range requests where they stopped, and only moved
+//! next to the index once they decode as the sidecar of a file with the
+//! local contents and size. Sidecars already fetched are kept, so running
+//! an interrupted fetch again picks up where it left off. The manifest is
+//! written last: until then the directory isn't an index.
+//!
+//! `oci://` locations are index snapshots published to a registry, pulled
+//! by [`super::oci`].
+
+use super::remote::{build_client, fetch, join_url, resolve_remote_url};
+use super::{IndexEntry, path_utils, save_manifest};
+use anyhow::{Result, bail};
+use cs_core::{FileMetadata, compute_file_hash};
+use rayon::prelude::*;
+use std::collections::HashMap;
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+const CONCURRENT_DOWNLOADS: usize = 16;
+
+/// Where downloads wait until they check out, in the index directory.
+const STAGING_DIR: &str = "fetch_staging";
+
+/// Largest sidecar taken from a peer.
+pub(super) const MAX_SIDECAR_BYTES: u64 = 256 * 1024 * 1024;
+
+#[derive(Debug, Default, Clone)]
+pub struct FetchStats {
+    pub files_downloaded: usize,
+    /// Sidecars an earlier, interrupted fetch already downloaded
+    pub files_resumed: usize,
+    /// Files whose contents differ from the peer's, or whose peer sidecar
+    /// didn't match, left for the update to index
+    pub files_changed: usize,
+    /// Files in the peer's index that aren't in this checkout
+    pub files_missing: usize,
+    pub bytes_downloaded: u64,
+    /// Model the peer's index was built with
+    pub embedding_model: Option<String>,
+}
+
+/// Seed the index of `repo_root` from the published `.cs/` at `location`.
+/// Fails if `repo_root` already has an index.
+pub async fn fetch_index(location: &str, repo_root: &Path) -> Result<FetchStats> {
+    if location.trim().starts_with("oci://") {
+        return super::oci::pull_index(location, repo_root).await;
+    }
+    let base_url = resolve_remote_url(location)?;
+    let index_dir = cs_core::locations::index_dir(repo_root);
+    let manifest_path = index_dir.join("manifest.json");
+    if manifest_path.exists() {
+        bail!(
+            "{} already has an index; run cs --clean there first to replace it with a fetched one",
+            repo_root.display()
+        );
+    }
+    let client = build_client()?;
+
+    let manifest_url = format!("{}/manifest.json", base_url);
+    let manifest_bytes = fetch(&client, &manifest_url).await?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No manifest.json found at {}. Serve the peer's .cs/ directory, e.g. `python3 -m http.server --directory .cs`.",
+            manifest_url
+        )
+    })?;
+    let mut manifest = super::manifest_format::decode(&manifest_bytes)?;
+    path_utils::check_manifest_keys(&manifest)?;
+    super::validate_manifest_model(&manifest)?;
+    let mut stats = FetchStats {
+        embedding_model: manifest.embedding_model.clone(),
+        ..FetchStats::default()
+    };
+
+    // A sidecar is only valid for the contents it was built from
+    let local: Vec<(PathBuf, Option<FileMetadata>)> = manifest
+        .files
+        .par_iter()
+        .map(|(manifest_key, _)| {
+            (
+                manifest_key.clone(),
+                local_metadata(repo_root, manifest_key),
+            )
+        })
+        .collect();
+    let mut wanted: HashMap<PathBuf, FileMetadata> = HashMap::new();
+    for (manifest_key, local) in local {
+        match local {
+            None => stats.files_missing += 1,
+            Some(local) if local.hash != manifest.files[&manifest_key].hash => {
+                stats.files_changed += 1
+            }
+            Some(local) => {
+                wanted.insert(manifest_key, local);
+            }
+        }
+    }
+
+    let mut to_download: Vec<PathBuf> = Vec::new();
+    for (manifest_key, local) in &wanted {
+        let standard_path = path_utils::checked_manifest_key(manifest_key)?;
+        let sidecar = path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path);
+        let resumed = fs::read(&sidecar)
+            .ok()
+            .and_then(|bytes| decode_sidecar(&bytes).ok())
+            .is_some_and(|entry| describes(&entry, local));
+        if resumed {
+            stats.files_resumed += 1;
+        } else {
+            to_download.push(manifest_key.clone());
+        }
+    }
+
+    let staging = index_dir.join(STAGING_DIR);
+    for batch in to_download.chunks(CONCURRENT_DOWNLOADS) {
+        let mut tasks = tokio::task::JoinSet::new();
+        for manifest_key in batch {
+            let client = client.clone();
+            let standard_path = path_utils::checked_manifest_key(manifest_key)?;
+            let url = join_url(
+                &base_url,
+                &format!("{}.cs", cs_core::paths::to_slash(&standard_path)),
+            );
+            let sidecar =
+                path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path);
+            let part = part_path(&staging, &standard_path);
+            let manifest_key = manifest_key.clone();
+            tasks.spawn(async move {
+                let result = download(&client, &url, &part).await;
+                (manifest_key, sidecar, part, result)
+            });
+        }
+
+        while let Some(joined) = tasks.join_next().await {
+            let (manifest_key, sidecar, part, result) = joined?;
+            let Some((bytes, downloaded)) = result? else {
+                stats.files_missing += 1;
+                wanted.remove(&manifest_key);
+                continue;
+            };
+            stats.bytes_downloaded += downloaded;
+            match decode_sidecar(&bytes) {
+                Ok(entry) if describes(&entry, &wanted[&manifest_key]) => {
+                    if let Some(parent) = sidecar.parent() {
+                        fs::create_dir_all(parent)?;
+                    }
+                    fs::rename(&part, &sidecar)?;
+                    stats.files_downloaded += 1;
+                }
+                // Rebuilt on the peer since its manifest was written, or torn
+                _ => {
+                    let _ = fs::remove_file(&part);
+                    stats.files_changed += 1;
+                    wanted.remove(&manifest_key);
+                }
+            }
+        }
+    }
+
+    let _ = fs::remove_dir_all(&staging);
+    manifest.files = wanted;
+    manifest.updated = SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0);
+    save_manifest(&manifest_path, &manifest)?;
+    Ok(stats)
+}
+
+/// The manifest metadata of the local file at `manifest_key`, if it exists.
+/// Keys that lead out of the checkout have none.
+pub(super) fn local_metadata(repo_root: &Path, manifest_key: &Path) -> Option<FileMetadata> {
+    let file = repo_root.join(path_utils::checked_manifest_key(manifest_key).ok()?);
+    let metadata = fs::metadata(&file).ok()?;
+    Some(FileMetadata {
+        path: manifest_key.to_path_buf(),
+        hash: compute_file_hash(&file).ok()?,
+        last_modified: metadata
+            .modified()
+            .ok()?
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .ok()?
+            .as_secs(),
+        size: metadata.len(),
+    })
+}
+
+/// Where the sidecar of `standard_path` is downloaded to in `staging`.
+fn part_path(staging: &Path, standard_path: &Path) -> PathBuf {
+    staging.join(format!(
+        "{}.cs.part",
+        cs_core::paths::to_slash(standard_path)
+    ))
+}
+
+/// `bytes` decoded as a sidecar, as `bincode::deserialize` would, but never
+/// reading past them whatever lengths they claim.
+pub(super) fn decode_sidecar(bytes: &[u8]) -> Result<IndexEntry> {
+    use bincode::Options;
+    Ok(bincode::options()
+        .with_fixint_encoding()
+        .allow_trailing_bytes()
+        .with_limit(bytes.len() as u64)
+        .deserialize(bytes)?)
+}
+
+/// Whether `entry` was built from the local file described by `local`.
+pub(super) fn describes(entry: &IndexEntry, local: &FileMetadata) -> bool {
+    entry.metadata.hash == local.hash && entry.metadata.size == local.size
+}
+
+/// Download `url` into `part`, continuing what an interrupted download left
+/// there with a range request. Returns the whole file and the bytes
+/// transferred this time, or `None` if the peer doesn't have it.
+async fn download(
+    client: &reqwest::Client,
+    url: &str,
+    part: &Path,
+) -> Result<Option<(Vec<u8>, u64)>> {
+    let offset = fs::metadata(part).map(|m| m.len()).unwrap_or(0);
+    let mut request = client.get(url);
+    if offset > 0 {
+        request = request.header(reqwest::header::RANGE, format!("bytes={}-", offset));
+    }
+    let mut response = request.send().await?;
+    let (mut data, mut file) = match response.status() {
+        reqwest::StatusCode::PARTIAL_CONTENT => {
+            (fs::read(part)?, OpenOptions::new().append(true).open(part)?)
+        }
+        // Servers without range support send the whole file again
+        status if status.is_success() => {
+            if let Some(parent) = part.parent() {
+                fs::create_dir_all(parent)?;
+            }
+            (Vec::new(), fs::File::create(part)?)
+        }
+        // The earlier download had finished
+        reqwest::StatusCode::RANGE_NOT_SATISFIABLE if offset > 0 => {
+            return Ok(Some((fs::read(part)?, 0)));
+        }
+        reqwest::StatusCode::NOT_FOUND => return Ok(None),
+        status => bail!("Peer index request failed ({}) for {}", status, url),
+    };
+    let mut downloaded = 0;
+    while let Some(chunk) = response.chunk().await? {
+        if (data.len() + chunk.len()) as u64 > MAX_SIDECAR_BYTES {
+            drop(file);
+            let _ = fs::remove_file(part);
+            bail!(
+                "Peer sidecar at {} is larger than {} bytes",
+                url,
+                MAX_SIDECAR_BYTES
+            );
+        }
+        file.write_all(&chunk)?;
+        data.extend_from_slice(&chunk);
+        downloaded += chunk.len() as u64;
+    }
+    file.sync_all()?;
+    Ok(Some((data, downloaded)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn local_files_are_described_as_a_manifest_would() {
+        let repo = TempDir::new().unwrap();
+        fs::create_dir_all(repo.path().join("src")).unwrap();
+        fs::write(repo.path().join("src/lib.rs"), "fn main() {}\n").unwrap();
+
+        let key = path_utils::to_manifest_path(Path::new("src/lib.rs"));
+        let local = local_metadata(repo.path(), &key).unwrap();
+        assert_eq!(local.path, key);
+        assert_eq!(local.size, 13);
+        assert_eq!(
+            local.hash,
+            compute_file_hash(&repo.path().join("src/lib.rs")).unwrap()
+        );
+        assert!(local_metadata(repo.path(), Path::new("src/gone.rs")).is_none());
+
+        assert_eq!(
+            part_path(Path::new(".cs/fetch_staging"), Path::new("src/lib.rs")),
+            Path::new(".cs/fetch_staging/src/lib.rs.cs.part")
+        );
+        for hostile in ["../../.bashrc", "/etc/passwd", "src/../../x.rs"] {
+            let key = path_utils::to_manifest_path(Path::new(hostile));
+            assert!(local_metadata(repo.path(), &key).is_none(), "{}", hostile);
+        }
+    }
+
+    #[test]
+    fn sidecars_decode_within_their_own_bytes() {
+        let entry = IndexEntry {
+            metadata: FileMetadata {
+                path: PathBuf::from("src/lib.rs"),
+                hash: "abc".to_string(),
+                last_modified: 1,
+                size: 13,
+            },
+            chunks: Vec::new(),
+        };
+        let bytes = bincode::serialize(&entry).unwrap();
+        assert_eq!(decode_sidecar(&bytes).unwrap().metadata.hash, "abc");
+
+        let mut local = entry.metadata.clone();
+        assert!(describes(&entry, &local));
+        local.size = 14;
+        assert!(!describes(&entry, &local));
+
+        // A length prefix claiming far more than the file holds
+        let mut bomb = u64::MAX.to_le_bytes().to_vec();
+        bomb.extend_from_slice(b"short");
+        assert!(decode_sidecar(&bomb).is_err());
+    }
+}
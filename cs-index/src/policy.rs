@@ -0,0 +1,207 @@
+//! The organization policy: rules an administrator sets for every
+//! repository on a machine, which no config file, environment variable or
+//! flag can relax.
+//!
+//! It is `/etc/cs/policy.toml` (`%ProgramData%\cs\policy.toml` on Windows),
+//! a file of its own rather than a layer of the config, so that it can be
+//! made writable by administrators only:
+//!
+//! ```toml
+//! # Never indexed, whatever the repository's config says
+//! exclude = ["secrets/", "*.pem"]
+//! # Indexed, but never sent to a remote embedder
+//! local_only = ["internal/crypto/**"]
+//! # Forbid remote embedders altogether
+//! remote_embedders = false
+//! ```
+//!
+//! Patterns are `.gitignore` lines, relative to the repository root. A
+//! policy that can't be read or parsed fails closed: indexing and remote
+//! embedding stop with an error rather than run unrestricted.
+
+use anyhow::{Result, anyhow, bail};
+use ignore::gitignore::{Gitignore, GitignoreBuilder};
+use serde::Deserialize;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::OnceLock;
+
+pub const POLICY_FILE_NAME: &str = "policy.toml";
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct PolicyFile {
+    #[serde(default)]
+    exclude: Vec<String>,
+    #[serde(default)]
+    local_only: Vec<String>,
+    #[serde(default = "allowed")]
+    remote_embedders: bool,
+}
+
+fn allowed() -> bool {
+    true
+}
+
+#[derive(Debug)]
+pub struct Policy {
+    /// The file the policy was read from; `None` when there is none
+    pub source: Option<PathBuf>,
+    exclude: Gitignore,
+    local_only: Gitignore,
+    remote_embedders: bool,
+}
+
+impl Default for Policy {
+    fn default() -> Self {
+        Self {
+            source: None,
+            exclude: Gitignore::empty(),
+            local_only: Gitignore::empty(),
+            remote_embedders: true,
+        }
+    }
+}
+
+impl Policy {
+    /// The policy in `content`, read from `source`.
+    pub fn parse(content: &str, source: &Path) -> Result<Self> {
+        let file: PolicyFile = toml::from_str(content)
+            .map_err(|e| anyhow!("Invalid organization policy {}: {}", source.display(), e))?;
+        Ok(Self {
+            source: Some(source.to_path_buf()),
+            exclude: matcher(&file.exclude, source)?,
+            local_only: matcher(&file.local_only, source)?,
+            remote_embedders: file.remote_embedders,
+        })
+    }
+
+    /// Whether the policy says anything at all.
+    pub fn is_empty(&self) -> bool {
+        self.exclude.is_empty() && self.local_only.is_empty() && self.remote_embedders
+    }
+
+    /// Whether `file` in the repository at `repo_root` must never be indexed.
+    pub fn excludes(&self, repo_root: &Path, file: &Path) -> bool {
+        matches(&self.exclude, repo_root, file)
+    }
+
+    /// Whether `file` in the repository at `repo_root` may only be embedded
+    /// locally.
+    pub fn is_local_only(&self, repo_root: &Path, file: &Path) -> bool {
+        matches(&self.local_only, repo_root, file)
+    }
+
+    /// Text may go to a remote embedder at all; errors naming the policy if not.
+    pub fn check_remote_embedder(&self) -> Result<()> {
+        if !self.remote_embedders {
+            bail!(
+                "The organization policy ({}) forbids remote embedders; index with a local model",
+                self.source
+                    .as_deref()
+                    .map(Path::display)
+                    .map(|path| path.to_string())
+                    .unwrap_or_default()
+            );
+        }
+        Ok(())
+    }
+}
+
+fn matcher(patterns: &[String], source: &Path) -> Result<Gitignore> {
+    // Rooted nowhere: paths are matched relative to their repository
+    let mut builder = GitignoreBuilder::new("");
+    builder.case_insensitive(cs_core::paths::CASE_INSENSITIVE)?;
+    for pattern in patterns {
+        builder
+            .add_line(None, &cs_core::paths::normalize_pattern(pattern))
+            .map_err(|e| {
+                anyhow!(
+                    "Invalid pattern '{}' in {}: {}",
+                    pattern,
+                    source.display(),
+                    e
+                )
+            })?;
+    }
+    Ok(builder.build()?)
+}
+
+fn matches(matcher: &Gitignore, repo_root: &Path, file: &Path) -> bool {
+    if matcher.is_empty() {
+        return false;
+    }
+    // Patterns are relative to the repository; nothing outside it matches
+    let Ok(relative) = file.strip_prefix(repo_root) else {
+        return false;
+    };
+    matcher
+        .matched_path_or_any_parents(relative, false)
+        .is_ignore()
+}
+
+/// Where the organization policy is read from.
+pub fn policy_path() -> Option<PathBuf> {
+    if cfg!(windows) {
+        std::env::var_os("ProgramData")
+            .map(|dir| PathBuf::from(dir).join("cs").join(POLICY_FILE_NAME))
+    } else {
+        Some(PathBuf::from("/etc/cs").join(POLICY_FILE_NAME))
+    }
+}
+
+static POLICY: OnceLock<std::result::Result<Policy, String>> = OnceLock::new();
+
+/// The organization policy, read once per process; an empty policy if there
+/// is no policy file.
+pub fn current() -> Result<&'static Policy> {
+    POLICY
+        .get_or_init(|| {
+            let Some(path) = policy_path().filter(|path| path.exists()) else {
+                return Ok(Policy::default());
+            };
+            fs::read_to_string(&path)
+                .map_err(|e| anyhow!("Can't read organization policy {}: {}", path.display(), e))
+                .and_then(|content| Policy::parse(&content, &path))
+                .map_err(|e| e.to_string())
+        })
+        .as_ref()
+        .map_err(|e| anyhow!("{}", e))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn policy_excludes_and_restricts_by_path() {
+        let policy = Policy::parse(
+            "exclude = [\"secrets/\", \"*.pem\"]\nlocal_only = [\"internal/crypto/**\"]\n",
+            Path::new("/etc/cs/policy.toml"),
+        )
+        .unwrap();
+        let root = Path::new("/work/app");
+
+        assert!(policy.excludes(root, &root.join("secrets/prod.env")));
+        assert!(policy.excludes(root, &root.join("deploy/secrets/key.txt")));
+        assert!(policy.excludes(root, &root.join("certs/server.pem")));
+        assert!(!policy.excludes(root, &root.join("src/secrets.rs")));
+
+        assert!(policy.is_local_only(root, &root.join("internal/crypto/aes/gcm.go")));
+        assert!(!policy.is_local_only(root, &root.join("internal/http/client.go")));
+        assert!(policy.check_remote_embedder().is_ok());
+        assert!(!policy.is_empty());
+    }
+
+    #[test]
+    fn remote_embedders_can_be_forbidden_and_typos_fail_closed() {
+        let source = Path::new("/etc/cs/policy.toml");
+        let policy = Policy::parse("remote_embedders = false\n", source).unwrap();
+        let error = policy.check_remote_embedder().unwrap_err().to_string();
+        assert!(error.contains("/etc/cs/policy.toml"));
+
+        // A misspelled key must not silently leave everything allowed
+        assert!(Policy::parse("exclude_paths = [\"secrets/\"]\n", source).is_err());
+        assert!(Policy::default().is_empty());
+    }
+}
@@ -0,0 +1,234 @@
+//! Projects inside a monorepo, found by their build manifests (`go.mod`,
+//! `Cargo.toml`, `package.json`).
+//!
+//! Searches cover every project by default; `cs --project <name>` scopes one
+//! to a single project, and `cs --index --project-shards` keeps a shard per
+//! project (see [`crate::shards`]) so each can be rebuilt on its own. The
+//! projects a sharded index was built with are saved next to its shards, so
+//! files keep landing in the same shard until the next build.
+
+use super::{collect_files, path_utils};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::path::{Component, Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+use std::time::SystemTime;
+
+/// Files marking the directory they're in as a project root, by preference.
+pub const PROJECT_MARKERS: &[&str] = &["go.mod", "Cargo.toml", "package.json"];
+
+/// Saved projects of an index sharded by project.
+pub const PROJECTS_FILE: &str = "projects.json";
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Project {
+    /// Directory name, or the whole path with `-` separators when two
+    /// projects share a directory name
+    pub name: String,
+    /// Relative to the repository root, with `/` separators
+    pub path: String,
+    /// The manifest it was found by
+    pub marker: String,
+}
+
+impl Project {
+    /// Whether `standard_path` (relative to the repository root) is in this project.
+    pub fn contains(&self, standard_path: &Path) -> bool {
+        path_contains(&self.path, standard_path)
+    }
+}
+
+/// Whether `standard_path` is `dir` or under it, with `dir` relative to the
+/// repository root in `/` form.
+pub fn path_contains(dir: &str, standard_path: &Path) -> bool {
+    let mut relative = normal_components(standard_path);
+    dir.split('/')
+        .filter(|part| !part.is_empty() && *part != ".")
+        .all(|part| relative.next().is_some_and(|c| c == part))
+}
+
+fn normal_components(path: &Path) -> impl Iterator<Item = String> + '_ {
+    path.components().filter_map(|c| match c {
+        Component::Normal(part) => Some(part.to_string_lossy().into_owned()),
+        _ => None,
+    })
+}
+
+/// Projects under `repo_root`, sorted by path. A manifest at the root itself
+/// describes the whole repository, so it isn't a project.
+pub fn discover_projects(
+    repo_root: &Path,
+    respect_gitignore: bool,
+    exclude_patterns: &[String],
+) -> Result<Vec<Project>> {
+    let files = collect_files(repo_root, respect_gitignore, exclude_patterns)?;
+    Ok(projects_among(repo_root, &files))
+}
+
+/// Like [`discover_projects`], from files already collected under `repo_root`.
+pub fn projects_among(repo_root: &Path, files: &[PathBuf]) -> Vec<Project> {
+    let mut roots: BTreeMap<String, &'static str> = BTreeMap::new();
+    for file in files {
+        let Some(marker) = file
+            .file_name()
+            .and_then(|name| name.to_str())
+            .and_then(|name| PROJECT_MARKERS.iter().find(|marker| **marker == name))
+        else {
+            continue;
+        };
+        let Some(dir) = path_utils::to_standard_path(file, repo_root)
+            .parent()
+            .map(|dir| normal_components(dir).collect::<Vec<_>>().join("/"))
+        else {
+            continue;
+        };
+        if dir.is_empty() {
+            continue;
+        }
+        let rank = |marker: &str| PROJECT_MARKERS.iter().position(|m| *m == marker);
+        let preferred = roots
+            .get(&dir)
+            .is_none_or(|existing| rank(marker) < rank(existing));
+        if preferred {
+            roots.insert(dir, marker);
+        }
+    }
+
+    let mut name_counts: HashMap<&str, usize> = HashMap::new();
+    for dir in roots.keys() {
+        *name_counts.entry(base_name(dir)).or_default() += 1;
+    }
+    roots
+        .iter()
+        .map(|(dir, marker)| Project {
+            name: if name_counts[base_name(dir)] > 1 {
+                dir.replace('/', "-")
+            } else {
+                base_name(dir).to_string()
+            },
+            path: dir.clone(),
+            marker: marker.to_string(),
+        })
+        .collect()
+}
+
+fn base_name(dir: &str) -> &str {
+    dir.rsplit('/').next().unwrap_or(dir)
+}
+
+/// The innermost project holding `standard_path`, if any.
+pub fn project_of<'a>(projects: &'a [Project], standard_path: &Path) -> Option<&'a Project> {
+    projects
+        .iter()
+        .filter(|project| project.contains(standard_path))
+        .max_by_key(|project| project.path.len())
+}
+
+/// The project called `name`, or at path `name`.
+pub fn find_project<'a>(projects: &'a [Project], name: &str) -> Option<&'a Project> {
+    let path = name.trim_start_matches("./").trim_end_matches(['/', '\\']);
+    projects
+        .iter()
+        .find(|project| project.name == name)
+        .or_else(|| projects.iter().find(|project| project.path == path))
+}
+
+fn projects_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(PROJECTS_FILE)
+}
+
+pub fn save_projects(repo_root: &Path, projects: &[Project]) -> Result<()> {
+    let path = projects_path(repo_root);
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    fs::write(&path, serde_json::to_vec_pretty(projects)?)?;
+    Ok(())
+}
+
+/// Saved projects by file, with the modification time they were read at.
+type SavedProjects = HashMap<PathBuf, (SystemTime, Arc<Vec<Project>>)>;
+
+static SAVED: LazyLock<Mutex<SavedProjects>> = LazyLock::new(|| Mutex::new(HashMap::new()));
+
+/// The projects saved in the index at `repo_root`, if it's sharded by project.
+/// Reads are cached until the file changes, since every sidecar lookup asks.
+pub fn saved_projects(repo_root: &Path) -> Option<Arc<Vec<Project>>> {
+    let path = projects_path(repo_root);
+    let modified = fs::metadata(&path).and_then(|m| m.modified()).ok()?;
+    let mut saved = SAVED.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some((read_at, projects)) = saved.get(&path)
+        && *read_at == modified
+    {
+        return Some(projects.clone());
+    }
+    let projects = match fs::read(&path)
+        .map_err(anyhow::Error::from)
+        .and_then(|data| Ok(serde_json::from_slice::<Vec<Project>>(&data)?))
+    {
+        Ok(projects) => Arc::new(projects),
+        Err(e) => {
+            tracing::warn!("Ignoring unreadable {}: {}", path.display(), e);
+            return None;
+        }
+    };
+    saved.insert(path, (modified, projects.clone()));
+    Some(projects)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn write(root: &Path, relative: &str) {
+        let path = root.join(relative);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, "").unwrap();
+    }
+
+    #[test]
+    fn discovers_projects_by_manifest() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        for file in [
+            "package.json",
+            "services/api-server/go.mod",
+            "services/api-server/package.json",
+            "services/web/package.json",
+            "libs/web/Cargo.toml",
+            "libs/web/src/lib.rs",
+        ] {
+            write(root, file);
+        }
+
+        let projects = discover_projects(root, false, &[]).unwrap();
+        let summary: Vec<(&str, &str, &str)> = projects
+            .iter()
+            .map(|p| (p.name.as_str(), p.path.as_str(), p.marker.as_str()))
+            .collect();
+        assert_eq!(
+            summary,
+            [
+                ("libs-web", "libs/web", "Cargo.toml"),
+                ("api-server", "services/api-server", "go.mod"),
+                ("services-web", "services/web", "package.json"),
+            ]
+        );
+
+        let lib = Path::new("libs/web/src/lib.rs");
+        assert_eq!(project_of(&projects, lib).unwrap().name, "libs-web");
+        assert!(project_of(&projects, Path::new("libs/webapp/a.rs")).is_none());
+        assert_eq!(
+            find_project(&projects, "./services/web/").unwrap().name,
+            "services-web"
+        );
+        assert!(find_project(&projects, "web").is_none());
+
+        assert!(saved_projects(root).is_none());
+        save_projects(root, &projects).unwrap();
+        assert_eq!(*saved_projects(root).unwrap(), projects);
+    }
+}
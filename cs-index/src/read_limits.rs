@@ -0,0 +1,315 @@
+//! Limits on what indexing reads, so one huge or unreadable file can't take
+//! the whole run down.
+//!
+//! Files are checked as they are collected, before anything reads them whole:
+//!
+//! - larger than the [`max_file_size`] (2 MiB unless configured; PDFs get
+//!   [`PDF_SIZE_FACTOR`] times as much, since their text is a fraction of
+//!   the file)
+//! - minified: named like `app.min.js`, or lines averaging over
+//!   [`MINIFIED_AVG_LINE_LENGTH`] bytes in the first 8 KiB
+//!
+//! Skipped files are logged to `.cs/skipped.json` for review with
+//! `cs --skipped`, instead of failing or exhausting memory mid-index.
+//! Binary files (a NUL byte, or mostly control bytes, in the first 8 KiB)
+//! are never indexed and aren't logged.
+
+use super::{IndexManifest, atomic_write, path_utils};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashSet};
+use std::fmt;
+use std::fs;
+use std::io::Read;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::{LazyLock, Mutex};
+
+pub const SKIPPED_LOG_FILE: &str = "skipped.json";
+
+pub const DEFAULT_MAX_FILE_SIZE: u64 = 2 * 1024 * 1024;
+
+pub const PDF_SIZE_FACTOR: u64 = 8;
+
+/// Average line length of the sniffed prefix above which a file is minified.
+pub const MINIFIED_AVG_LINE_LENGTH: usize = 1000;
+
+/// Bytes read to sniff a file, like ripgrep's binary detection.
+pub(crate) const SNIFF_BYTES: usize = 8192;
+
+/// Share of control bytes in the sniffed prefix above which a file is binary.
+const MAX_CONTROL_BYTE_RATIO: f32 = 0.3;
+
+/// Ends every skip error, so callers can tell skips from failures.
+const SKIP_SUFFIX: &str = ", skipping";
+
+static MAX_FILE_SIZE: AtomicU64 = AtomicU64::new(DEFAULT_MAX_FILE_SIZE);
+static SKIP_MINIFIED: AtomicBool = AtomicBool::new(true);
+
+/// Set the largest file indexed for the rest of the process; 0 means no limit.
+pub fn set_max_file_size(bytes: u64) {
+    MAX_FILE_SIZE.store(bytes, Ordering::SeqCst);
+}
+
+pub fn max_file_size() -> u64 {
+    MAX_FILE_SIZE.load(Ordering::SeqCst)
+}
+
+/// Set whether minified files are skipped for the rest of the process.
+pub fn set_skip_minified(skip: bool) {
+    SKIP_MINIFIED.store(skip, Ordering::SeqCst);
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum SkipReason {
+    TooLarge,
+    Minified,
+    /// Left out by a `[[fixture]]` rule (see [`crate::fixtures`])
+    FixtureBudget,
+}
+
+impl fmt::Display for SkipReason {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::TooLarge => "File too large",
+            Self::Minified => "Minified file",
+            Self::FixtureBudget => "Over the fixture budget",
+        })
+    }
+}
+
+impl SkipReason {
+    /// The error indexing reports for a file skipped for this reason.
+    pub fn error(self) -> anyhow::Error {
+        anyhow::anyhow!("{}{}", self, SKIP_SUFFIX)
+    }
+}
+
+/// Whether an indexing error is a skip rather than a failure.
+pub fn is_skip(error_msg: &str) -> bool {
+    error_msg.ends_with(SKIP_SUFFIX)
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SkippedFile {
+    pub reason: SkipReason,
+    pub size: u64,
+}
+
+/// Skipped files by path (relative to the repository root).
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SkippedLog {
+    pub files: BTreeMap<String, SkippedFile>,
+}
+
+impl SkippedLog {
+    /// Number of files skipped for each reason.
+    pub fn counts(&self) -> BTreeMap<SkipReason, usize> {
+        let mut counts = BTreeMap::new();
+        for file in self.files.values() {
+            *counts.entry(file.reason).or_insert(0) += 1;
+        }
+        counts
+    }
+}
+
+/// Skips seen since the last flush: (repository root, path, reason, size)
+static PENDING: LazyLock<Mutex<HashSet<(PathBuf, String, SkipReason, u64)>>> =
+    LazyLock::new(Default::default);
+
+/// Why text file `path` (of `size` bytes) must not be indexed, if it
+/// mustn't. A skip is recorded for the log of `repo_root`.
+pub fn check(path: &Path, size: u64, repo_root: &Path) -> Option<SkipReason> {
+    let reason = sniff(path, size)?;
+    record(path, size, repo_root, reason);
+    Some(reason)
+}
+
+/// Note for the log of `repo_root` that `path` (of `size` bytes) is skipped.
+pub(crate) fn record(path: &Path, size: u64, repo_root: &Path, reason: SkipReason) {
+    let key = cs_core::paths::to_slash(path.strip_prefix(repo_root).unwrap_or(path));
+    tracing::debug!("Skipping {} ({:?}, {} bytes)", key, reason, size);
+    PENDING.lock().unwrap_or_else(|e| e.into_inner()).insert((
+        repo_root.to_path_buf(),
+        key,
+        reason,
+        size,
+    ));
+}
+
+fn sniff(path: &Path, size: u64) -> Option<SkipReason> {
+    let is_pdf = cs_core::pdf::is_pdf_file(path);
+    let limit = max_file_size();
+    let limit = if is_pdf {
+        limit.saturating_mul(PDF_SIZE_FACTOR)
+    } else {
+        limit
+    };
+    if limit > 0 && size > limit {
+        return Some(SkipReason::TooLarge);
+    }
+    if is_pdf {
+        return None;
+    }
+
+    let skip_minified = SKIP_MINIFIED.load(Ordering::SeqCst);
+    if skip_minified
+        && path
+            .file_name()
+            .is_some_and(|name| is_minified_name(&name.to_string_lossy()))
+    {
+        return Some(SkipReason::Minified);
+    }
+
+    // A short file can't blow up chunking however long its lines
+    if !skip_minified || size < SNIFF_BYTES as u64 {
+        return None;
+    }
+    let mut buffer = vec![0; SNIFF_BYTES];
+    // Unreadable files fail indexing with the read error instead
+    let bytes_read = fs::File::open(path)
+        .and_then(|mut file| file.read(&mut buffer))
+        .ok()?;
+    looks_minified(&buffer[..bytes_read]).then_some(SkipReason::Minified)
+}
+
+fn is_minified_name(name: &str) -> bool {
+    let name = name.to_ascii_lowercase();
+    [".min.js", ".min.css", ".min.mjs", "-min.js"]
+        .iter()
+        .any(|suffix| name.ends_with(suffix))
+}
+
+/// Whether the first bytes of a file mark it as binary.
+pub(crate) fn looks_binary(prefix: &[u8]) -> bool {
+    if prefix.is_empty() {
+        return false;
+    }
+    if prefix.contains(&0) {
+        return true;
+    }
+    let control = prefix
+        .iter()
+        .filter(|&&b| b < 0x20 && !matches!(b, b'\n' | b'\r' | b'\t' | 0x0c))
+        .count();
+    control as f32 / prefix.len() as f32 > MAX_CONTROL_BYTE_RATIO
+}
+
+fn looks_minified(prefix: &[u8]) -> bool {
+    let lines = prefix.iter().filter(|&&b| b == b'\n').count() + 1;
+    prefix.len() / lines > MINIFIED_AVG_LINE_LENGTH
+}
+
+fn log_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(SKIPPED_LOG_FILE)
+}
+
+pub fn load_skipped_log(repo_root: &Path) -> Result<Option<SkippedLog>> {
+    let path = log_path(repo_root);
+    if !path.exists() {
+        return Ok(None);
+    }
+    Ok(Some(serde_json::from_slice(&fs::read(&path)?)?))
+}
+
+/// Merge the skips seen for `repo_root` since the last flush into
+/// `.cs/skipped.json`, dropping files that were indexed since or are gone.
+pub fn flush_skipped_log(repo_root: &Path, manifest: &IndexManifest) -> Result<()> {
+    let skipped: Vec<(String, SkippedFile)> = {
+        let mut pending = PENDING.lock().unwrap_or_else(|e| e.into_inner());
+        let (ours, others): (HashSet<_>, HashSet<_>) = std::mem::take(&mut *pending)
+            .into_iter()
+            .partition(|(root, _, _, _)| root == repo_root);
+        *pending = others;
+        ours.into_iter()
+            .map(|(_, key, reason, size)| (key, SkippedFile { reason, size }))
+            .collect()
+    };
+
+    let existing = load_skipped_log(repo_root).ok().flatten();
+    if skipped.is_empty() && existing.is_none() {
+        return Ok(());
+    }
+
+    let mut log = existing.unwrap_or_default();
+    log.files.extend(skipped);
+    let indexed: HashSet<String> = manifest
+        .files
+        .keys()
+        .map(|key| cs_core::paths::to_slash(&path_utils::from_manifest_path(key)))
+        .collect();
+    log.files
+        .retain(|file, _| !indexed.contains(file) && repo_root.join(file).exists());
+    atomic_write(&log_path(repo_root), &serde_json::to_vec_pretty(&log)?)
+}
+
+/// Parse a size such as `2M`, `512K`, `1G` or a byte count.
+pub fn parse_size(text: &str) -> std::result::Result<u64, String> {
+    let text = text.trim();
+    let upper = text.to_ascii_uppercase();
+    let digits = upper.trim_end_matches(['B', 'I']);
+    let (number, multiplier) = match digits.chars().last() {
+        Some('K') => (&digits[..digits.len() - 1], 1024),
+        Some('M') => (&digits[..digits.len() - 1], 1024 * 1024),
+        Some('G') => (&digits[..digits.len() - 1], 1024 * 1024 * 1024),
+        _ => (digits, 1),
+    };
+    number
+        .trim()
+        .parse::<u64>()
+        .map(|number| number.saturating_mul(multiplier))
+        .map_err(|_| format!("Invalid size '{}'; expected e.g. 2M, 512K or 1048576", text))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn oversized_and_minified_files_are_skipped_and_logged() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        let write = |name: &str, data: &[u8]| {
+            let path = root.join(name);
+            fs::write(&path, data).unwrap();
+            (path, data.len() as u64)
+        };
+
+        let (source, size) = write("lib.rs", "fn main() {}\n".repeat(1000).as_bytes());
+        assert_eq!(check(&source, size, root), None);
+
+        let (bundle, size) = write("bundle.js", "var a=1;".repeat(2000).as_bytes());
+        assert_eq!(check(&bundle, size, root), Some(SkipReason::Minified));
+        let (named, size) = write("app.min.js", b"var a = 1;\n");
+        assert_eq!(check(&named, size, root), Some(SkipReason::Minified));
+
+        assert_eq!(
+            check(&source, DEFAULT_MAX_FILE_SIZE + 1, root),
+            Some(SkipReason::TooLarge)
+        );
+
+        fs::create_dir_all(root.join(".cs")).unwrap();
+        flush_skipped_log(root, &IndexManifest::default()).unwrap();
+        let log = load_skipped_log(root).unwrap().unwrap();
+        assert_eq!(log.files.len(), 3);
+        assert_eq!(log.files["bundle.js"].reason, SkipReason::Minified);
+        assert_eq!(log.counts()[&SkipReason::Minified], 2);
+
+        assert!(is_skip(&SkipReason::TooLarge.error().to_string()));
+        assert!(looks_binary(b"Hello\0World"));
+        assert!(looks_binary(&[1, 2, 3, 4, b'a']));
+        assert!(!looks_binary(b"fn main() {\n\tok();\n}\n"));
+    }
+
+    #[test]
+    fn sizes_parse_with_binary_suffixes() {
+        assert_eq!(parse_size("2M"), Ok(2 * 1024 * 1024));
+        assert_eq!(parse_size("512k"), Ok(512 * 1024));
+        assert_eq!(parse_size("1GiB"), Ok(1024 * 1024 * 1024));
+        assert_eq!(parse_size("1048576"), Ok(1048576));
+        assert_eq!(parse_size("0"), Ok(0));
+        assert!(parse_size("big").is_err());
+    }
+}
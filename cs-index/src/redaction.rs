@@ -0,0 +1,468 @@
+//! Configurable redaction of text sent to remote embedders.
+//!
+//! Rules come from `[[redact]]` tables in the user config and in a
+//! `.csredact.toml` at the repository root:
+//!
+//! ```toml
+//! [[redact]]
+//! pattern = '[a-z0-9-]+\.corp\.example\.com'
+//! replacement = "internal.host"
+//!
+//! [[redact]]
+//! identifiers = ["AcmeBank", "Globex"]
+//! placeholder = "CUSTOMER"
+//! ```
+//!
+//! Identifiers map to stable placeholders (`CUSTOMER_3f9a2b1c`), so chunks
+//! and queries that mention the same name still embed alike. A placeholder is
+//! a hash of its identifier keyed with `.cs/redaction_key`, a random key made
+//! for the index: editing the rules doesn't renumber the names already
+//! indexed, and the embedder can't recover a name by hashing guesses. Only
+//! the text handed to the embedder changes: sidecars point at the original
+//! source, and the placeholder mapping is kept locally in
+//! `.cs/redaction_map.json`.
+//!
+//! An identifier matches where it isn't part of a longer word: the character
+//! before it can't be a letter, digit or `_` if the identifier starts with
+//! one, nor the character after it if the identifier ends with one. Names
+//! such as `C++` or `@acme/sdk` match as written.
+
+use anyhow::{Result, bail};
+use cs_core::RedactionRule;
+use regex::Regex;
+use serde::Deserialize;
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+
+use super::atomic_write;
+use super::encryption::{self, from_hex, to_hex};
+
+pub const REDACT_FILE: &str = ".csredact.toml";
+pub const REDACTION_MAP_FILE: &str = "redaction_map.json";
+pub const REDACTION_KEY_FILE: &str = "redaction_key";
+
+/// Hex digits of the keyed hash in a placeholder.
+const PLACEHOLDER_HASH_LEN: usize = 8;
+
+const DEFAULT_REPLACEMENT: &str = "[REDACTED]";
+const DEFAULT_PLACEHOLDER: &str = "ENTITY";
+
+#[derive(Debug, Default, Deserialize)]
+struct RedactFile {
+    #[serde(default)]
+    redact: Vec<RedactionRule>,
+}
+
+enum Step {
+    Pattern {
+        regex: Regex,
+        replacement: String,
+    },
+    Identifiers {
+        /// Finds where an identifier may start
+        regex: Regex,
+        /// Longest first, so `AcmeBank` wins over `Acme`
+        names: Vec<String>,
+        placeholders: HashMap<String, String>,
+    },
+}
+
+/// Compiled redaction rules for one repository.
+#[derive(Default)]
+pub struct Redactor {
+    steps: Vec<Step>,
+}
+
+impl Redactor {
+    /// `rules` compiled in order; identifiers become placeholders keyed with `key`.
+    pub fn new(rules: &[RedactionRule], key: &[u8; 32]) -> Result<Self> {
+        let mut steps = Vec::new();
+        // Which identifier each placeholder stands for, to catch two sharing one
+        let mut taken: HashMap<String, &str> = HashMap::new();
+        for rule in rules {
+            match (&rule.pattern, rule.identifiers.is_empty()) {
+                (Some(pattern), true) => steps.push(Step::Pattern {
+                    regex: Regex::new(pattern).map_err(|e| {
+                        anyhow::anyhow!("Invalid redaction pattern '{}': {}", pattern, e)
+                    })?,
+                    replacement: rule
+                        .replacement
+                        .clone()
+                        .unwrap_or_else(|| DEFAULT_REPLACEMENT.to_string()),
+                }),
+                (None, false) => {
+                    let prefix = rule.placeholder.as_deref().unwrap_or(DEFAULT_PLACEHOLDER);
+                    let mut placeholders = HashMap::new();
+                    for identifier in rule.identifiers.iter().filter(|i| !i.is_empty()) {
+                        let placeholder = placeholder_for(key, prefix, identifier);
+                        match taken.insert(placeholder.clone(), identifier) {
+                            Some(other) if other != identifier.as_str() => bail!(
+                                "Redacted identifiers '{}' and '{}' hash to the same placeholder; \
+                                 give one of them a different `placeholder`",
+                                other,
+                                identifier
+                            ),
+                            _ => {}
+                        }
+                        placeholders.insert(identifier.clone(), placeholder);
+                    }
+                    let mut names: Vec<String> = placeholders.keys().cloned().collect();
+                    names.sort_by(|a, b| b.len().cmp(&a.len()).then_with(|| a.cmp(b)));
+                    if names.is_empty() {
+                        continue;
+                    }
+                    let alternation: Vec<String> =
+                        names.iter().map(|name| regex::escape(name)).collect();
+                    steps.push(Step::Identifiers {
+                        regex: Regex::new(&alternation.join("|"))?,
+                        names,
+                        placeholders,
+                    });
+                }
+                (Some(_), false) => {
+                    bail!("A [[redact]] rule sets either `pattern` or `identifiers`, not both")
+                }
+                (None, true) => bail!("A [[redact]] rule needs `pattern` or `identifiers`"),
+            }
+        }
+        Ok(Self { steps })
+    }
+
+    /// `text` as a remote embedder should see it.
+    pub fn apply(&self, text: &str) -> String {
+        let mut redacted = text.to_string();
+        for step in &self.steps {
+            redacted = match step {
+                Step::Pattern { regex, replacement } => regex
+                    .replace_all(&redacted, replacement.as_str())
+                    .into_owned(),
+                Step::Identifiers {
+                    regex,
+                    names,
+                    placeholders,
+                } => replace_identifiers(&redacted, regex, names, placeholders),
+            };
+        }
+        redacted
+    }
+
+    /// `placeholder -> original identifier`, for display.
+    pub fn mapping(&self) -> BTreeMap<String, String> {
+        self.steps
+            .iter()
+            .filter_map(|step| match step {
+                Step::Identifiers { placeholders, .. } => Some(placeholders),
+                Step::Pattern { .. } => None,
+            })
+            .flatten()
+            .map(|(original, placeholder)| (placeholder.clone(), original.clone()))
+            .collect()
+    }
+}
+
+/// `prefix` and the first hex digits of `identifier` hashed with `key`.
+fn placeholder_for(key: &[u8; 32], prefix: &str, identifier: &str) -> String {
+    let hash = blake3::keyed_hash(key, identifier.as_bytes()).to_hex();
+    format!("{}_{}", prefix, &hash[..PLACEHOLDER_HASH_LEN])
+}
+
+fn is_word_char(c: char) -> bool {
+    c.is_alphanumeric() || c == '_'
+}
+
+/// Whether `name` at `start` of `text` stands on its own rather than being
+/// part of a longer word.
+fn is_whole(text: &str, start: usize, name: &str) -> bool {
+    let before = text[..start].chars().next_back();
+    let after = text[start + name.len()..].chars().next();
+    !(name.starts_with(is_word_char) && before.is_some_and(is_word_char))
+        && !(name.ends_with(is_word_char) && after.is_some_and(is_word_char))
+}
+
+/// `text` with each whole occurrence of `names` replaced by its placeholder.
+fn replace_identifiers(
+    text: &str,
+    regex: &Regex,
+    names: &[String],
+    placeholders: &HashMap<String, String>,
+) -> String {
+    let mut redacted = String::with_capacity(text.len());
+    let mut copied = 0;
+    let mut at = 0;
+    while let Some(found) = regex.find_at(text, at) {
+        let start = found.start();
+        // The regex prefers the longest name; a shorter one may still be whole
+        match names
+            .iter()
+            .find(|name| text[start..].starts_with(name.as_str()) && is_whole(text, start, name))
+        {
+            Some(name) => {
+                redacted.push_str(&text[copied..start]);
+                redacted.push_str(&placeholders[name]);
+                copied = start + name.len();
+                at = copied;
+            }
+            None => at = start + text[start..].chars().next().map_or(1, char::len_utf8),
+        }
+    }
+    redacted.push_str(&text[copied..]);
+    redacted
+}
+
+static USER_RULES: LazyLock<Mutex<Vec<RedactionRule>>> = LazyLock::new(Default::default);
+
+static REDACTORS: LazyLock<Mutex<HashMap<PathBuf, Arc<Redactor>>>> =
+    LazyLock::new(Default::default);
+
+/// Rules from the user config, applied in every repository ahead of its own.
+pub fn set_user_rules(rules: Vec<RedactionRule>) {
+    *USER_RULES.lock().unwrap_or_else(|e| e.into_inner()) = rules;
+    REDACTORS.lock().unwrap_or_else(|e| e.into_inner()).clear();
+}
+
+/// Rules from `.csredact.toml` at `repo_root`, or none if the file is absent.
+pub fn load_repo_redaction_rules(repo_root: &Path) -> Result<Vec<RedactionRule>> {
+    let path = repo_root.join(REDACT_FILE);
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+    let file: RedactFile = toml::from_str(&fs::read_to_string(&path)?)
+        .map_err(|e| anyhow::anyhow!("Failed to parse {}: {}", path.display(), e))?;
+    Ok(file.redact)
+}
+
+/// The user and repository rules for `repo_root`, compiled once per process.
+pub fn redactor_for(repo_root: &Path) -> Result<Arc<Redactor>> {
+    let mut redactors = REDACTORS.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(redactor) = redactors.get(repo_root) {
+        return Ok(redactor.clone());
+    }
+    let mut rules = USER_RULES.lock().unwrap_or_else(|e| e.into_inner()).clone();
+    rules.extend(load_repo_redaction_rules(repo_root)?);
+    // Pattern rules alone need no key, so none is made for them
+    let key = if rules.iter().any(|rule| !rule.identifiers.is_empty()) {
+        redaction_key(repo_root)?
+    } else {
+        [0u8; 32]
+    };
+    let redactor = Arc::new(Redactor::new(&rules, &key)?);
+    redactors.insert(repo_root.to_path_buf(), redactor.clone());
+    Ok(redactor)
+}
+
+/// A search query as `embedder` should see it, so placeholders in the index
+/// line up with names typed by the user.
+pub fn prepare_query(
+    embedder: &dyn cs_embed::Embedder,
+    repo_root: &Path,
+    query: &str,
+) -> Result<String> {
+    if !embedder.is_remote() {
+        return Ok(query.to_string());
+    }
+    crate::policy::current()?.check_remote_embedder()?;
+    Ok(redactor_for(repo_root)?.apply(query))
+}
+
+/// The placeholder key of the index at `repo_root`, made on first use.
+fn redaction_key(repo_root: &Path) -> Result<[u8; 32]> {
+    use ring::rand::SecureRandom;
+
+    let path = cs_core::locations::index_dir(repo_root).join(REDACTION_KEY_FILE);
+    if let Ok(data) = fs::read(&path) {
+        let hex = String::from_utf8(encryption::open_from(&path, data)?)?;
+        return from_hex(hex.trim())
+            .and_then(|bytes| bytes.try_into().ok())
+            .ok_or_else(|| anyhow::anyhow!("{} is not a 32-byte hex key", path.display()));
+    }
+    let mut key = [0u8; 32];
+    ring::rand::SystemRandom::new()
+        .fill(&mut key)
+        .map_err(|_| anyhow::anyhow!("Failed to generate a redaction key"))?;
+    atomic_write(
+        &path,
+        &encryption::seal_for(&path, to_hex(&key).into_bytes())?,
+    )?;
+    Ok(key)
+}
+
+fn map_path(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(REDACTION_MAP_FILE)
+}
+
+/// The placeholder mapping last written for `repo_root`.
+pub fn load_redaction_map(repo_root: &Path) -> Result<BTreeMap<String, String>> {
+    let path = map_path(repo_root);
+    if !path.exists() {
+        return Ok(BTreeMap::new());
+    }
+    Ok(serde_json::from_slice(&encryption::open_from(
+        &path,
+        fs::read(&path)?,
+    )?)?)
+}
+
+/// Record the current placeholder mapping in `.cs/redaction_map.json`.
+pub fn save_redaction_map(repo_root: &Path) -> Result<()> {
+    let mapping = redactor_for(repo_root)?.mapping();
+    let path = map_path(repo_root);
+    if mapping.is_empty() {
+        if path.exists() {
+            fs::remove_file(&path)?;
+        }
+        return Ok(());
+    }
+    atomic_write(
+        &path,
+        &encryption::seal_for(&path, serde_json::to_vec_pretty(&mapping)?)?,
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn identifiers(names: &[&str], placeholder: &str) -> RedactionRule {
+        RedactionRule {
+            identifiers: names.iter().map(|n| n.to_string()).collect(),
+            placeholder: Some(placeholder.to_string()),
+            ..Default::default()
+        }
+    }
+
+    const KEY: [u8; 32] = [7; 32];
+
+    #[test]
+    fn applies_patterns_and_stable_placeholders() {
+        let redactor = Redactor::new(
+            &[
+                RedactionRule {
+                    pattern: Some(r"[a-z0-9-]+\.corp\.example\.com".to_string()),
+                    replacement: Some("internal.host".to_string()),
+                    ..Default::default()
+                },
+                identifiers(&["Acme", "AcmeBank", "Globex"], "CUSTOMER"),
+            ],
+            &KEY,
+        )
+        .unwrap();
+        let customer = |name| placeholder_for(&KEY, "CUSTOMER", name);
+
+        assert_eq!(
+            redactor.apply("// AcmeBank and Globex call db-1.corp.example.com; Acme too"),
+            format!(
+                "// {} and {} call internal.host; {} too",
+                customer("AcmeBank"),
+                customer("Globex"),
+                customer("Acme")
+            )
+        );
+        // Whole words only, though a shorter name can still match where a longer one doesn't
+        assert_eq!(redactor.apply("AcmeBankClient"), "AcmeBankClient");
+        assert_eq!(
+            redactor.apply("Acme-Bank"),
+            format!("{}-Bank", customer("Acme"))
+        );
+        assert_eq!(redactor.mapping()[&customer("AcmeBank")], "AcmeBank");
+    }
+
+    #[test]
+    fn identifiers_may_start_or_end_with_punctuation() {
+        let redactor =
+            Redactor::new(&[identifiers(&["C++", "@acme/sdk", ".NET"], "TECH")], &KEY).unwrap();
+        let tech = |name| placeholder_for(&KEY, "TECH", name);
+
+        assert_eq!(
+            redactor.apply("C++ bindings for @acme/sdk, and ASP.NET"),
+            format!(
+                "{} bindings for {}, and ASP{}",
+                tech("C++"),
+                tech("@acme/sdk"),
+                tech(".NET")
+            )
+        );
+        // The word character at either end still has to stand alone
+        assert_eq!(
+            redactor.apply("ObjC++ and x@acme/sdks"),
+            "ObjC++ and x@acme/sdks"
+        );
+    }
+
+    #[test]
+    fn placeholders_depend_on_the_identifier_not_its_position() {
+        let redactor = Redactor::new(
+            &[
+                identifiers(&["AcmeBank", "Globex"], "CUSTOMER"),
+                identifiers(&["Initech", "Globex"], "CUSTOMER"),
+                identifiers(&["Hooli"], "VENDOR"),
+            ],
+            &KEY,
+        )
+        .unwrap();
+        let reordered = Redactor::new(
+            &[
+                identifiers(&["Zorg"], "CUSTOMER"),
+                identifiers(&["Hooli"], "VENDOR"),
+                identifiers(&["Initech", "Globex", "AcmeBank"], "CUSTOMER"),
+            ],
+            &KEY,
+        )
+        .unwrap();
+
+        let text = "AcmeBank, Globex, Initech and Hooli";
+        assert_eq!(redactor.apply(text), reordered.apply(text));
+        assert!(
+            redactor
+                .apply(text)
+                .ends_with(&placeholder_for(&KEY, "VENDOR", "Hooli"))
+        );
+        assert_eq!(redactor.mapping().len(), 4);
+        // Only the key's holder can tell which name a placeholder stands for
+        assert_ne!(
+            Redactor::new(&[identifiers(&["Hooli"], "VENDOR")], &[8; 32])
+                .unwrap()
+                .apply("Hooli"),
+            reordered.apply("Hooli")
+        );
+    }
+
+    #[test]
+    fn rejects_ambiguous_rules() {
+        assert!(Redactor::new(&[RedactionRule::default()], &KEY).is_err());
+        let mut both = identifiers(&["Acme"], "CUSTOMER");
+        both.pattern = Some("x".to_string());
+        assert!(Redactor::new(&[both], &KEY).is_err());
+    }
+
+    #[test]
+    fn repo_rules_and_map_round_trip() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        fs::create_dir_all(root.join(".cs")).unwrap();
+        fs::write(
+            root.join(REDACT_FILE),
+            "[[redact]]\nidentifiers = [\"Globex\"]\nplaceholder = \"CUSTOMER\"\n",
+        )
+        .unwrap();
+
+        let embedder = cs_embed::DummyEmbedder::new();
+        // Local embedders see the query unchanged
+        assert_eq!(
+            prepare_query(&embedder, root, "Globex invoices").unwrap(),
+            "Globex invoices"
+        );
+        let key = redaction_key(root).unwrap();
+        assert_eq!(redaction_key(root).unwrap(), key);
+        let customer = placeholder_for(&key, "CUSTOMER", "Globex");
+        assert_eq!(
+            redactor_for(root).unwrap().apply("Globex invoices"),
+            format!("{} invoices", customer)
+        );
+
+        save_redaction_map(root).unwrap();
+        assert_eq!(load_redaction_map(root).unwrap()[&customer], "Globex");
+    }
+}
@@ -0,0 +1,404 @@
+//! Team-shared remote index backend (S3 / GCS / HTTPS object storage).
+//!
+//! A remote index is simply a published `.cs/` directory: `manifest.json` plus
+//! one `<path>.cs` sidecar per file. CI publishes it with the usual tooling
+//! (`aws s3 sync .cs s3://bucket/prefix`, `gsutil -m rsync -r .cs gs://bucket/prefix`);
+//! `cs --remote-index <url>` pulls it into the local `.cs/` as a read-through
+//! cache, downloading only sidecars whose source hash changed.
+//!
+//! Requests are plain HTTPS GETs: the only credential is `CS_REMOTE_TOKEN`,
+//! sent as a bearer token. Requests aren't signed with AWS SigV4, so an
+//! `s3://` index has to be publicly readable, or served through a proxy or
+//! CDN that authenticates the bearer token and signs for it.
+
+use super::peer::decode_sidecar;
+use super::{atomic_write, path_utils, save_manifest};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+const REMOTE_STATE_FILE: &str = "remote.json";
+const CONCURRENT_DOWNLOADS: usize = 16;
+
+/// Where the remote index was synced from and which manifest revision is cached.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct RemoteState {
+    pub url: String,
+    pub manifest_updated: u64,
+    pub synced_at: u64,
+}
+
+#[derive(Debug, Default, Clone)]
+pub struct RemoteSyncStats {
+    pub files_downloaded: usize,
+    pub files_unchanged: usize,
+    pub files_removed: usize,
+    /// Sidecars that couldn't be downloaded; their files are left out of the
+    /// cached manifest, so they are indexed locally like unindexed files
+    pub files_missing: usize,
+    /// True when the cached manifest revision was already current
+    pub up_to_date: bool,
+}
+
+/// Map `s3://`, `gs://` and `http(s)://` locations to an HTTPS base URL.
+///
+/// S3 honours `CS_S3_ENDPOINT` (path-style, for MinIO/R2/other S3-compatible
+/// stores) and `AWS_REGION`.
+pub fn resolve_remote_url(location: &str) -> Result<String> {
+    let location = location.trim().trim_end_matches('/');
+
+    if let Some(rest) = location.strip_prefix("s3://") {
+        let (bucket, prefix) = split_bucket(rest)?;
+        let base = if let Ok(endpoint) = std::env::var("CS_S3_ENDPOINT") {
+            format!("{}/{}", endpoint.trim_end_matches('/'), bucket)
+        } else if let Ok(region) = std::env::var("AWS_REGION") {
+            format!("https://{}.s3.{}.amazonaws.com", bucket, region)
+        } else {
+            format!("https://{}.s3.amazonaws.com", bucket)
+        };
+        return Ok(join_url(&base, prefix));
+    }
+
+    if let Some(rest) = location.strip_prefix("gs://") {
+        let (bucket, prefix) = split_bucket(rest)?;
+        return Ok(join_url(
+            &format!("https://storage.googleapis.com/{}", bucket),
+            prefix,
+        ));
+    }
+
+    if location.starts_with("https://") || location.starts_with("http://") {
+        return Ok(location.to_string());
+    }
+
+    Err(anyhow::anyhow!(
+        "Unsupported remote index location '{}'. Use s3://bucket/prefix, gs://bucket/prefix or an https:// URL.",
+        location
+    ))
+}
+
+fn split_bucket(rest: &str) -> Result<(&str, &str)> {
+    let (bucket, prefix) = rest.split_once('/').unwrap_or((rest, ""));
+    if bucket.is_empty() {
+        return Err(anyhow::anyhow!(
+            "Remote index location is missing a bucket name"
+        ));
+    }
+    Ok((bucket, prefix))
+}
+
+pub(super) fn join_url(base: &str, key: &str) -> String {
+    let key = key.trim_matches('/');
+    if key.is_empty() {
+        base.to_string()
+    } else {
+        format!("{}/{}", base, encode_key(key))
+    }
+}
+
+/// Percent-encode an object key, keeping `/` separators.
+fn encode_key(key: &str) -> String {
+    let mut encoded = String::with_capacity(key.len());
+    for byte in key.bytes() {
+        match byte {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' | b'/' => {
+                encoded.push(byte as char)
+            }
+            _ => encoded.push_str(&format!("%{:02X}", byte)),
+        }
+    }
+    encoded
+}
+
+fn now_secs() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+pub(super) fn build_client() -> Result<reqwest::Client> {
+    let mut headers = reqwest::header::HeaderMap::new();
+    // GCS (and most HTTPS gateways) accept OAuth bearer tokens, e.g. `gcloud auth print-access-token`
+    if let Ok(token) = std::env::var("CS_REMOTE_TOKEN") {
+        let value = reqwest::header::HeaderValue::from_str(&format!("Bearer {}", token.trim()))
+            .map_err(|_| anyhow::anyhow!("CS_REMOTE_TOKEN contains invalid characters"))?;
+        headers.insert(reqwest::header::AUTHORIZATION, value);
+    }
+    Ok(cs_core::network::client_builder()?
+        .default_headers(headers)
+        .user_agent(concat!("cs/", env!("CARGO_PKG_VERSION")))
+        .build()?)
+}
+
+pub(super) async fn fetch(client: &reqwest::Client, url: &str) -> Result<Option<Vec<u8>>> {
+    let response = client.get(url).send().await?;
+    match response.status() {
+        status if status.is_success() => Ok(Some(response.bytes().await?.to_vec())),
+        reqwest::StatusCode::NOT_FOUND => Ok(None),
+        status => Err(anyhow::anyhow!(
+            "Remote index request failed ({}) for {}. Check CS_REMOTE_TOKEN / bucket permissions.",
+            status,
+            url
+        )),
+    }
+}
+
+pub fn load_remote_state(repo_root: &Path) -> Option<RemoteState> {
+    let data = fs::read(cs_core::locations::index_dir(repo_root).join(REMOTE_STATE_FILE)).ok()?;
+    serde_json::from_slice(&data).ok()
+}
+
+/// Pull the remote index at `location` into `repo_root/.cs`.
+///
+/// Only changed sidecars are downloaded; local entries dropped from the remote
+/// manifest are removed so the cache mirrors the published index. A sidecar
+/// that is missing, fails to download or doesn't decode is left out of the
+/// cached manifest, and the next sync tries it again.
+pub async fn sync_remote_index(location: &str, repo_root: &Path) -> Result<RemoteSyncStats> {
+    let base_url = resolve_remote_url(location)?;
+    let client = build_client()?;
+    let index_dir = cs_core::locations::index_dir(repo_root);
+    fs::create_dir_all(&index_dir)?;
+
+    let mut stats = RemoteSyncStats::default();
+
+    let manifest_url = format!("{}/manifest.json", base_url);
+    let manifest_bytes = fetch(&client, &manifest_url).await?.ok_or_else(|| {
+        anyhow::anyhow!(
+            "No manifest.json found at {}. Publish the index with e.g. `aws s3 sync .cs {}`.",
+            manifest_url,
+            location
+        )
+    })?;
+    let mut remote_manifest = super::manifest_format::decode(&manifest_bytes)?;
+    path_utils::check_manifest_keys(&remote_manifest)?;
+    super::validate_manifest_model(&remote_manifest)?;
+
+    let manifest_path = index_dir.join("manifest.json");
+    let local_manifest = if manifest_path.exists() {
+        super::load_or_create_manifest(&manifest_path).ok()
+    } else {
+        None
+    };
+
+    if let Some(state) = load_remote_state(repo_root)
+        && state.url == base_url
+        && state.manifest_updated == remote_manifest.updated
+        // A local index update since the last sync rewrites `updated`
+        && local_manifest
+            .as_ref()
+            .is_some_and(|m| m.updated == remote_manifest.updated)
+    {
+        stats.up_to_date = true;
+        stats.files_unchanged = remote_manifest.files.len();
+        return Ok(stats);
+    }
+
+    // Decide which sidecars need downloading
+    let mut to_download: Vec<(PathBuf, PathBuf)> = Vec::new();
+    for (manifest_key, metadata) in &remote_manifest.files {
+        let standard_path = path_utils::from_manifest_path(manifest_key);
+        let sidecar = path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path);
+        let unchanged = local_manifest
+            .as_ref()
+            .and_then(|m| m.files.get(manifest_key))
+            .is_some_and(|local| local.hash == metadata.hash)
+            && sidecar.exists();
+        if unchanged {
+            stats.files_unchanged += 1;
+        } else {
+            to_download.push((manifest_key.clone(), standard_path));
+        }
+    }
+
+    for batch in to_download.chunks(CONCURRENT_DOWNLOADS) {
+        let mut tasks = tokio::task::JoinSet::new();
+        for (manifest_key, standard_path) in batch {
+            let client = client.clone();
+            let key = format!("{}.cs", cs_core::paths::to_slash(standard_path));
+            let url = join_url(&base_url, &key);
+            let (manifest_key, standard_path) = (manifest_key.clone(), standard_path.clone());
+            tasks.spawn(async move { (manifest_key, standard_path, fetch(&client, &url).await) });
+        }
+
+        while let Some(joined) = tasks.join_next().await {
+            let (manifest_key, standard_path, result) = joined?;
+            let sidecar =
+                path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path);
+            // Corrupt downloads count as missing rather than being cached
+            match result
+                .ok()
+                .flatten()
+                .filter(|bytes| decode_sidecar(bytes).is_ok())
+            {
+                Some(bytes) => {
+                    atomic_write(&sidecar, &bytes)?;
+                    stats.files_downloaded += 1;
+                }
+                None => {
+                    // The cached sidecar, if any, is of an older revision
+                    let _ = fs::remove_file(&sidecar);
+                    remote_manifest.files.remove(&manifest_key);
+                    stats.files_missing += 1;
+                }
+            }
+        }
+    }
+
+    // Drop cached sidecars the remote no longer has
+    if let Some(local) = &local_manifest {
+        let remote_keys: HashSet<&PathBuf> = remote_manifest.files.keys().collect();
+        for manifest_key in local.files.keys().filter(|k| !remote_keys.contains(k)) {
+            // Keys a manifest synced before they were checked may hold
+            let Ok(standard_path) = path_utils::checked_manifest_key(manifest_key) else {
+                continue;
+            };
+            let sidecar =
+                path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path);
+            if fs::remove_file(&sidecar).is_ok() {
+                stats.files_removed += 1;
+            }
+        }
+    }
+
+    save_manifest(&manifest_path, &remote_manifest)?;
+    if stats.files_missing > 0 {
+        // Not a full copy of this revision, so the next sync isn't skipped
+        let _ = fs::remove_file(index_dir.join(REMOTE_STATE_FILE));
+        return Ok(stats);
+    }
+    let state = RemoteState {
+        url: base_url,
+        manifest_updated: remote_manifest.updated,
+        synced_at: now_secs(),
+    };
+    atomic_write(
+        &index_dir.join(REMOTE_STATE_FILE),
+        &serde_json::to_vec_pretty(&state)?,
+    )?;
+
+    Ok(stats)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn resolves_object_store_locations() {
+        assert_eq!(
+            resolve_remote_url("gs://team-index/semcs/main/").unwrap(),
+            "https://storage.googleapis.com/team-index/semcs/main"
+        );
+        assert_eq!(
+            resolve_remote_url("https://cdn.example.com/index").unwrap(),
+            "https://cdn.example.com/index"
+        );
+        assert!(resolve_remote_url("ftp://nope").is_err());
+        assert!(resolve_remote_url("s3:///prefix").is_err());
+    }
+
+    #[test]
+    fn encodes_object_keys() {
+        assert_eq!(
+            join_url("https://h/b", "src/my file.rs.cs"),
+            "https://h/b/src/my%20file.rs.cs"
+        );
+        assert_eq!(join_url("https://h/b", ""), "https://h/b");
+    }
+
+    /// Answer every request with `body`, as a static file server would.
+    fn serve(body: Vec<u8>) -> String {
+        use std::io::{Read, Write};
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        std::thread::spawn(move || {
+            for mut stream in listener.incoming().flatten() {
+                let mut request = [0u8; 4096];
+                let _ = stream.read(&mut request);
+                let head = format!(
+                    "HTTP/1.1 200 OK\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+                    body.len()
+                );
+                let _ = stream.write_all(head.as_bytes());
+                let _ = stream.write_all(&body);
+            }
+        });
+        format!("http://{}", address)
+    }
+
+    #[tokio::test]
+    async fn sidecars_that_fail_to_download_are_left_out_of_the_manifest() {
+        let repo = tempfile::TempDir::new().unwrap();
+        let mut manifest = crate::IndexManifest {
+            embedding_model: Some("bge-small".to_string()),
+            embedding_dimensions: Some(384),
+            updated: 7,
+            ..crate::IndexManifest::default()
+        };
+        let key = PathBuf::from("./src/lib.rs");
+        manifest.files.insert(
+            key.clone(),
+            cs_core::FileMetadata {
+                path: key.clone(),
+                hash: "0".repeat(64),
+                last_modified: 0,
+                size: 1,
+            },
+        );
+        // Every request, the sidecar's included, is answered with the manifest
+        let url = serve(serde_json::to_vec(&manifest).unwrap());
+        let stale = repo.path().join(".cs/src/lib.rs.cs");
+        fs::create_dir_all(stale.parent().unwrap()).unwrap();
+        fs::write(&stale, b"an older revision").unwrap();
+
+        let stats = sync_remote_index(&url, repo.path()).await.unwrap();
+        assert_eq!((stats.files_downloaded, stats.files_missing), (0, 1));
+        assert!(!stale.exists());
+        let cached =
+            crate::load_or_create_manifest(&repo.path().join(".cs/manifest.json")).unwrap();
+        assert!(!cached.files.contains_key(&key));
+        assert!(load_remote_state(repo.path()).is_none());
+    }
+
+    #[tokio::test]
+    async fn hostile_manifest_keys_are_refused() {
+        let workspace = tempfile::TempDir::new().unwrap();
+        let repo = workspace.path().join("repo");
+        fs::create_dir_all(&repo).unwrap();
+
+        let mut manifest = crate::IndexManifest {
+            embedding_model: Some("bge-small".to_string()),
+            embedding_dimensions: Some(384),
+            ..crate::IndexManifest::default()
+        };
+        let key = PathBuf::from("./../../outside.rs");
+        manifest.files.insert(
+            key.clone(),
+            cs_core::FileMetadata {
+                path: key,
+                hash: "0".repeat(64),
+                last_modified: 0,
+                size: 1,
+            },
+        );
+        let url = serve(serde_json::to_vec(&manifest).unwrap());
+
+        let error = sync_remote_index(&url, &repo).await.unwrap_err();
+        assert!(error.to_string().contains("escapes the index"), "{}", error);
+        assert!(!workspace.path().join("outside.rs.cs").exists());
+        assert!(!repo.join(".cs/manifest.json").exists());
+
+        for key in ["/etc/passwd", "./src/../../x.rs", ".", "../x.rs"] {
+            assert!(path_utils::checked_manifest_key(Path::new(key)).is_err());
+        }
+        assert_eq!(
+            path_utils::checked_manifest_key(Path::new("./src/lib.rs")).unwrap(),
+            PathBuf::from("src/lib.rs")
+        );
+    }
+}
@@ -0,0 +1,217 @@
+//! Rename detection: a file that was moved keeps its chunks, embeddings and
+//! attachments instead of being indexed from scratch under its new path.
+//!
+//! An incremental update hashes each file the manifest doesn't know. One
+//! with the same contents as a manifest entry whose file is gone is the same
+//! file renamed: its sidecar is moved to the new path, and the rename is
+//! logged in `.cs/renames.json`. What's attached to a path elsewhere (notes,
+//! feedback, anchors) follows the log with [`RenameLog::current_path`], so
+//! it finds the file where it went. A file renamed and edited in one go
+//! hashes differently and is indexed as new.
+
+use super::journal::Journal;
+use super::{FileMetadata, IndexManifest, atomic_write, eviction, path_utils};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+pub const RENAMES_LOG_FILE: &str = "renames.json";
+
+/// Renames kept in the log; the oldest go first.
+const MAX_LOGGED_RENAMES: usize = 1000;
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Rename {
+    /// Relative to the repository root, with `/` separators
+    pub from: String,
+    pub to: String,
+    pub renamed: u64,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct RenameLog {
+    pub renames: Vec<Rename>,
+}
+
+impl RenameLog {
+    fn path(repo_root: &Path) -> PathBuf {
+        cs_core::locations::index_dir(repo_root).join(RENAMES_LOG_FILE)
+    }
+
+    /// The renames recorded for the index at `repo_root`; none if there's
+    /// no log or it can't be read.
+    pub fn load(repo_root: &Path) -> Self {
+        fs::read(Self::path(repo_root))
+            .ok()
+            .and_then(|data| serde_json::from_slice(&data).ok())
+            .unwrap_or_default()
+    }
+
+    fn save(&self, repo_root: &Path) -> Result<()> {
+        atomic_write(&Self::path(repo_root), &serde_json::to_vec_pretty(self)?)
+    }
+
+    fn record(&mut self, from: String, to: String) {
+        let renamed = SystemTime::now()
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        self.renames.push(Rename { from, to, renamed });
+        let excess = self.renames.len().saturating_sub(MAX_LOGGED_RENAMES);
+        self.renames.drain(..excess);
+    }
+
+    /// Where the file at `path` was renamed to, following later renames of
+    /// the new path too, or `None` if it wasn't.
+    pub fn current_path(&self, path: &str) -> Option<String> {
+        let mut current = path;
+        // Renamed back and forth is where it started
+        for rename in &self.renames {
+            if rename.from == current {
+                current = &rename.to;
+            }
+        }
+        (current != path).then(|| current.to_string())
+    }
+}
+
+/// Manifest entries whose files are gone, by content hash: what a new file
+/// with the same hash may have been renamed from.
+pub(crate) fn vanished_files(
+    manifest: &IndexManifest,
+    repo_root: &Path,
+) -> HashMap<String, Vec<PathBuf>> {
+    let mut vanished: HashMap<String, Vec<PathBuf>> = HashMap::new();
+    for (manifest_key, metadata) in &manifest.files {
+        if !repo_root
+            .join(path_utils::from_manifest_path(manifest_key))
+            .exists()
+        {
+            vanished
+                .entry(metadata.hash.clone())
+                .or_default()
+                .push(manifest_key.clone());
+        }
+    }
+    for keys in vanished.values_mut() {
+        keys.sort();
+    }
+    vanished
+}
+
+/// Which of `candidates` the new file at `manifest_key` was renamed from:
+/// one with the same file name if there is one, as a move between
+/// directories keeps it.
+pub(crate) fn take_source(candidates: &mut Vec<PathBuf>, manifest_key: &Path) -> Option<PathBuf> {
+    let index = candidates
+        .iter()
+        .position(|candidate| candidate.file_name() == manifest_key.file_name())
+        .or((!candidates.is_empty()).then_some(0))?;
+    Some(candidates.remove(index))
+}
+
+/// Move the sidecar of `from` in the index at `index_root` to the new file
+/// `metadata` describes, and its manifest entry with it.
+pub(crate) fn carry_over(
+    index_root: &Path,
+    manifest: &mut IndexManifest,
+    journal: &mut Journal,
+    from: &Path,
+    metadata: FileMetadata,
+) -> Result<()> {
+    let index_dir = cs_core::locations::index_dir(index_root);
+    let old_sidecar = path_utils::get_sidecar_path_for_standard_path(
+        &index_dir,
+        &path_utils::from_manifest_path(from),
+    );
+    let new_sidecar = path_utils::get_sidecar_path_for_standard_path(
+        &index_dir,
+        &path_utils::from_manifest_path(&metadata.path),
+    );
+    let mut entry = super::load_index_entry(&old_sidecar)?;
+    entry.metadata = metadata.clone();
+    journal.writing(&metadata.path, &new_sidecar)?;
+    super::save_index_entry(&new_sidecar, &entry)?;
+    journal.removing(from, &old_sidecar)?;
+    let _ = fs::remove_file(&old_sidecar);
+    manifest.files.remove(from);
+    manifest.files.insert(metadata.path.clone(), metadata);
+    Ok(())
+}
+
+/// Log the renames an update found, from and to manifest keys, and move
+/// what the index itself keeps by path along with them.
+pub(crate) fn record_renames(repo_root: &Path, renames: &[(PathBuf, PathBuf)]) -> Result<()> {
+    if renames.is_empty() {
+        return Ok(());
+    }
+    let renames: Vec<(String, String)> = renames
+        .iter()
+        .map(|(from, to)| {
+            (
+                cs_core::paths::to_slash(&path_utils::from_manifest_path(from)),
+                cs_core::paths::to_slash(&path_utils::from_manifest_path(to)),
+            )
+        })
+        .collect();
+    eviction::rename_matches(repo_root, &renames)?;
+    let mut log = RenameLog::load(repo_root);
+    for (from, to) in renames {
+        log.record(from, to);
+    }
+    log.save(repo_root)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn rename(from: &str, to: &str) -> Rename {
+        Rename {
+            from: from.to_string(),
+            to: to.to_string(),
+            renamed: 0,
+        }
+    }
+
+    #[test]
+    fn renames_are_followed_to_the_latest_path() {
+        let log = RenameLog {
+            renames: vec![
+                rename("src/auth.rs", "src/auth/mod.rs"),
+                rename("src/db.rs", "src/store.rs"),
+                rename("src/auth/mod.rs", "src/auth/session.rs"),
+                rename("src/a.rs", "src/b.rs"),
+                rename("src/b.rs", "src/a.rs"),
+            ],
+        };
+        assert_eq!(
+            log.current_path("src/auth.rs").as_deref(),
+            Some("src/auth/session.rs")
+        );
+        assert_eq!(
+            log.current_path("src/db.rs").as_deref(),
+            Some("src/store.rs")
+        );
+        // Renamed and back again is where it started
+        assert_eq!(log.current_path("src/a.rs"), None);
+        assert_eq!(log.current_path("src/main.rs"), None);
+    }
+
+    #[test]
+    fn a_move_prefers_the_source_with_the_same_name() {
+        let mut candidates = vec![PathBuf::from("old/lib.rs"), PathBuf::from("old/util.rs")];
+        assert_eq!(
+            take_source(&mut candidates, Path::new("new/util.rs")),
+            Some(PathBuf::from("old/util.rs"))
+        );
+        assert_eq!(
+            take_source(&mut candidates, Path::new("new/other.rs")),
+            Some(PathBuf::from("old/lib.rs"))
+        );
+        assert_eq!(take_source(&mut candidates, Path::new("new/more.rs")), None);
+    }
+}
@@ -0,0 +1,560 @@
+//! Index segments: a read-side cache of the sidecars packed into a few
+//! files, so a search reads a handful of files instead of one per source
+//! file. Updates still write every sidecar; segments only copy them.
+//!
+//! Each update appends a segment of the files it wrote to
+//! `.cs/segments/<id>-<level>.seg`; the first one packs the whole index.
+//! Segments are merged LSM-style: once [`FANOUT`] of them share a level they
+//! become one segment of the next level up, keeping each file's newest entry
+//! and dropping files that left the index. Long-running processes (`cs
+//! --serve`, the editor daemon) merge on a background thread, so an update
+//! from watch mode returns once its sidecars and segment are written;
+//! one-shot commands merge before returning.
+//!
+//! The manifest stays the record of what's indexed. A segment's entry for a
+//! file is only used while its hash matches the manifest's, and files no
+//! segment has an up-to-date entry for are read from their sidecars, so a
+//! segment lost to a crash or a concurrent merge costs some sidecar reads,
+//! never a stale result.
+//!
+//! Segments are a second copy of what the sidecars hold, so an index only
+//! gets them once asked to: with `index_segments = true` in the user config
+//! ([`set_enabled`]) the next update packs the first one. After that the
+//! index keeps its segments whatever the config says, as long as
+//! `.cs/segments/` exists; deleting that directory goes back to sidecars
+//! alone.
+
+use super::{
+    IndexEntry, IndexManifest, atomic_write, encryption, load_index_entry, load_or_create_manifest,
+    path_utils, sidecar_path_for_manifest_key,
+};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+
+pub const SEGMENTS_DIR: &str = "segments";
+pub const SEGMENT_EXTENSION: &str = "seg";
+
+/// Segments of one level merged into one of the next.
+const FANOUT: usize = 4;
+
+/// Files a level-0 segment holds at most; each level up holds [`FANOUT`]
+/// times more.
+const LEVEL_ZERO_FILES: usize = 256;
+
+/// Updates start packing segments for indexes that have none.
+static ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// Merges run on a background thread instead of in the update.
+static BACKGROUND_MERGES: AtomicBool = AtomicBool::new(false);
+
+/// A background merge is running.
+static MERGING: AtomicBool = AtomicBool::new(false);
+
+#[derive(Serialize, Deserialize)]
+struct Segment {
+    /// Model of the embeddings, which must match the manifest's
+    embedding_model: Option<String>,
+    entries: Vec<IndexEntry>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct SegmentFile {
+    /// Newer segments have higher ids
+    id: u64,
+    level: u32,
+    path: PathBuf,
+}
+
+/// Merge segments on a background thread from now on, for processes that
+/// outlive their updates.
+pub fn merge_in_background() {
+    BACKGROUND_MERGES.store(true, Ordering::SeqCst);
+}
+
+/// Whether updates give indexes without segments their first one, from
+/// `index_segments` in the user config.
+pub fn set_enabled(enabled: bool) {
+    ENABLED.store(enabled, Ordering::SeqCst);
+}
+
+/// Whether updates of the index in `index_dir` write segments: it has them,
+/// or they're enabled.
+pub fn in_use(index_dir: &Path) -> bool {
+    ENABLED.load(Ordering::SeqCst) || index_dir.join(SEGMENTS_DIR).is_dir()
+}
+
+/// Append a segment of the files with manifest keys `written` to the index in
+/// `index_dir`, whose manifest is now `manifest`, then merge what's due.
+/// Failing to doesn't fail the update: searches read what the segments
+/// miss from the sidecars. Does nothing unless segments are [`in_use`].
+pub fn add(index_dir: &Path, manifest: &IndexManifest, written: &[PathBuf]) {
+    if !in_use(index_dir) {
+        return;
+    }
+    if let Err(e) = append(index_dir, manifest, written) {
+        tracing::warn!("Failed to write an index segment: {}", e);
+        return;
+    }
+    if !BACKGROUND_MERGES.load(Ordering::SeqCst) {
+        if let Err(e) = merge(index_dir) {
+            tracing::warn!("Failed to merge index segments: {}", e);
+        }
+        return;
+    }
+    // The running merge picks up this segment by listing them again
+    if MERGING.swap(true, Ordering::SeqCst) {
+        return;
+    }
+    let index_dir = index_dir.to_path_buf();
+    std::thread::spawn(move || {
+        if let Err(e) = merge(&index_dir) {
+            tracing::warn!("Failed to merge index segments: {}", e);
+        }
+        MERGING.store(false, Ordering::SeqCst);
+    });
+}
+
+fn append(index_dir: &Path, manifest: &IndexManifest, written: &[PathBuf]) -> Result<()> {
+    let segments = list(index_dir);
+    let keys: Vec<&PathBuf> = if segments.is_empty() {
+        manifest.files.keys().collect()
+    } else {
+        let mut seen = HashSet::new();
+        written.iter().filter(|key| seen.insert(*key)).collect()
+    };
+    let entries: Vec<IndexEntry> = keys
+        .into_iter()
+        .filter_map(|key| load_index_entry(&sidecar_path_for_manifest_key(index_dir, key)).ok())
+        .filter(|entry| is_current(manifest, entry))
+        .collect();
+    if entries.is_empty() {
+        return Ok(());
+    }
+    let id = segments.last().map_or(1, |segment| segment.id + 1);
+    let level = level_for(entries.len());
+    save(
+        index_dir,
+        id,
+        level,
+        &Segment {
+            embedding_model: manifest.embedding_model.clone(),
+            entries,
+        },
+    )
+}
+
+/// Merge every level of the segments in `index_dir` that holds [`FANOUT`] or
+/// more, lowest first. Returns how many segments were merged.
+pub fn merge(index_dir: &Path) -> Result<usize> {
+    let manifest_path = index_dir.join("manifest.json");
+    let mut merged = 0;
+    loop {
+        let segments = list(index_dir);
+        let Some(level) = full_level(&segments) else {
+            return Ok(merged);
+        };
+        // Read per merge: a background merge outlives the update that started it
+        let manifest = load_or_create_manifest(&manifest_path)?;
+        let inputs: Vec<&SegmentFile> = segments
+            .iter()
+            .filter(|segment| segment.level == level)
+            .collect();
+        let mut seen = HashSet::new();
+        let mut entries = Vec::new();
+        // Newest first, so each file keeps its latest entry
+        for input in inputs.iter().rev() {
+            // Merged by another process in the meantime
+            let Ok(segment) = load(&input.path) else {
+                continue;
+            };
+            if segment.embedding_model != manifest.embedding_model {
+                continue;
+            }
+            for entry in segment.entries {
+                if is_current(&manifest, &entry) && seen.insert(entry.metadata.path.clone()) {
+                    entries.push(entry);
+                }
+            }
+        }
+
+        // Taking the newest input's id keeps newer segments newer than it
+        let id = inputs.iter().map(|input| input.id).max().unwrap_or(1);
+        let output_level = level_for(entries.len()).max(level + 1);
+        save(
+            index_dir,
+            id,
+            output_level,
+            &Segment {
+                embedding_model: manifest.embedding_model.clone(),
+                entries,
+            },
+        )?;
+        for input in &inputs {
+            let _ = fs::remove_file(&input.path);
+        }
+        merged += inputs.len();
+    }
+}
+
+/// Drop the entries of the files with manifest keys `removed` from the
+/// segments in `index_dir`, so files evicted from the index stop taking
+/// space there too. Only segments holding one are rewritten.
+pub fn remove_files(index_dir: &Path, removed: &[PathBuf]) -> Result<()> {
+    let removed: HashSet<&PathBuf> = removed.iter().collect();
+    for segment_file in list(index_dir) {
+        // Merged by another process in the meantime, or damaged
+        let Ok(mut segment) = load(&segment_file.path) else {
+            continue;
+        };
+        let before = segment.entries.len();
+        segment
+            .entries
+            .retain(|entry| !removed.contains(&entry.metadata.path));
+        if segment.entries.len() == before {
+            continue;
+        }
+        if segment.entries.is_empty() {
+            fs::remove_file(&segment_file.path)?;
+        } else {
+            save(index_dir, segment_file.id, segment_file.level, &segment)?;
+        }
+    }
+    Ok(())
+}
+
+/// What [`load_entries`] read of an index.
+#[derive(Debug, Default)]
+pub struct Loaded {
+    /// The up-to-date entry of every file that could be read, with its path
+    /// relative to the repository root
+    pub entries: Vec<(PathBuf, IndexEntry)>,
+    /// Segments that couldn't be read; their files came from the sidecars
+    pub damaged_segments: Vec<PathBuf>,
+    /// Manifest keys of files with neither a segment entry nor a readable
+    /// sidecar, which searches miss until they're indexed again
+    pub unreadable: Vec<PathBuf>,
+}
+
+/// The up-to-date entry of every file in the index in `index_dir`: from the
+/// segments where they have one, from the sidecars otherwise. A segment or
+/// sidecar that can't be read is skipped and reported rather than failing
+/// the load. `None` when the index has no segments yet, or no manifest.
+pub fn load_entries(index_dir: &Path) -> Result<Option<Loaded>> {
+    let segments = list(index_dir);
+    let manifest_path = index_dir.join("manifest.json");
+    if segments.is_empty() || !manifest_path.exists() {
+        return Ok(None);
+    }
+    let manifest = load_or_create_manifest(&manifest_path)?;
+
+    let mut loaded = Loaded::default();
+    let mut found = HashSet::new();
+    let mut entries = Vec::with_capacity(manifest.files.len());
+    for segment_file in segments.iter().rev() {
+        let segment = match load(&segment_file.path) {
+            Ok(segment) => segment,
+            // Merged by another process in the meantime
+            Err(_) if !segment_file.path.exists() => continue,
+            Err(e) => {
+                tracing::debug!("Skipping segment {}: {}", segment_file.path.display(), e);
+                loaded.damaged_segments.push(segment_file.path.clone());
+                continue;
+            }
+        };
+        if segment.embedding_model != manifest.embedding_model {
+            continue;
+        }
+        for entry in segment.entries {
+            if is_current(&manifest, &entry) && found.insert(entry.metadata.path.clone()) {
+                entries.push(entry);
+            }
+        }
+    }
+    for key in manifest.files.keys().filter(|key| !found.contains(*key)) {
+        match load_index_entry(&sidecar_path_for_manifest_key(index_dir, key)) {
+            Ok(entry) => entries.push(entry),
+            Err(_) => loaded.unreadable.push(key.clone()),
+        }
+    }
+
+    loaded.entries = entries
+        .into_iter()
+        .map(|entry| (path_utils::from_manifest_path(&entry.metadata.path), entry))
+        .collect();
+    Ok(Some(loaded))
+}
+
+/// The segments in `index_dir` that can't be read.
+pub fn damaged(index_dir: &Path) -> Vec<PathBuf> {
+    list(index_dir)
+        .into_iter()
+        .filter(|segment| load(&segment.path).is_err() && segment.path.exists())
+        .map(|segment| segment.path)
+        .collect()
+}
+
+/// Delete the segments in `index_dir` that can't be read, returning how many.
+/// Searches read their files from the sidecars instead.
+pub fn remove_damaged(index_dir: &Path) -> Result<usize> {
+    let damaged = damaged(index_dir);
+    for path in &damaged {
+        fs::remove_file(path)?;
+        tracing::warn!("Removed unreadable index segment: {:?}", path);
+    }
+    Ok(damaged.len())
+}
+
+fn is_current(manifest: &IndexManifest, entry: &IndexEntry) -> bool {
+    manifest
+        .files
+        .get(&entry.metadata.path)
+        .is_some_and(|metadata| metadata.hash == entry.metadata.hash)
+}
+
+/// Level of a segment of `files` files.
+fn level_for(files: usize) -> u32 {
+    let mut level = 0;
+    let mut capacity = LEVEL_ZERO_FILES;
+    while files > capacity {
+        level += 1;
+        capacity = capacity.saturating_mul(FANOUT);
+    }
+    level
+}
+
+/// The lowest level with [`FANOUT`] segments or more.
+fn full_level(segments: &[SegmentFile]) -> Option<u32> {
+    let mut levels: Vec<u32> = segments.iter().map(|segment| segment.level).collect();
+    levels.sort_unstable();
+    levels
+        .chunk_by(|a, b| a == b)
+        .find(|same| same.len() >= FANOUT)
+        .map(|same| same[0])
+}
+
+pub fn is_segment(path: &Path) -> bool {
+    path.extension().is_some_and(|e| e == SEGMENT_EXTENSION)
+}
+
+/// The segments in `index_dir`, oldest first.
+fn list(index_dir: &Path) -> Vec<SegmentFile> {
+    let Ok(entries) = fs::read_dir(index_dir.join(SEGMENTS_DIR)) else {
+        return Vec::new();
+    };
+    let mut segments: Vec<SegmentFile> = entries
+        .flatten()
+        .filter_map(|entry| {
+            let path = entry.path();
+            if !is_segment(&path) {
+                return None;
+            }
+            let (id, level) = path.file_stem()?.to_str()?.split_once('-')?;
+            Some(SegmentFile {
+                id: id.parse().ok()?,
+                level: level.parse().ok()?,
+                path,
+            })
+        })
+        .collect();
+    segments.sort_by_key(|segment| (segment.id, std::cmp::Reverse(segment.level)));
+    segments
+}
+
+fn save(index_dir: &Path, id: u64, level: u32, segment: &Segment) -> Result<()> {
+    let path = index_dir
+        .join(SEGMENTS_DIR)
+        .join(format!("{:010}-{}.{}", id, level, SEGMENT_EXTENSION));
+    let data = encryption::seal_for(&path, bincode::serialize(segment)?)?;
+    atomic_write(&path, &data)
+}
+
+fn load(path: &Path) -> Result<Segment> {
+    let data = encryption::open_from(path, fs::read(path)?)?;
+    Ok(bincode::deserialize(&data)?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::super::save_index_entry;
+    use super::*;
+    use cs_core::FileMetadata;
+    use tempfile::TempDir;
+
+    fn write(index_dir: &Path, manifest: &mut IndexManifest, file: &str, hash: &str) -> PathBuf {
+        let key = path_utils::to_manifest_path(Path::new(file));
+        let metadata = FileMetadata {
+            path: key.clone(),
+            hash: hash.to_string(),
+            last_modified: 0,
+            size: 1,
+        };
+        let entry = IndexEntry {
+            metadata: metadata.clone(),
+            chunks: Vec::new(),
+        };
+        save_index_entry(&sidecar_path_for_manifest_key(index_dir, &key), &entry).unwrap();
+        manifest.files.insert(key.clone(), metadata);
+        super::super::save_manifest(&index_dir.join("manifest.json"), manifest).unwrap();
+        key
+    }
+
+    /// The index directory in `dir`, with its segments directory so updates
+    /// write segments whatever the config says.
+    fn opted_in(dir: &TempDir) -> PathBuf {
+        let index_dir = dir.path().join(".cs");
+        fs::create_dir_all(index_dir.join(SEGMENTS_DIR)).unwrap();
+        index_dir
+    }
+
+    fn hashes(index_dir: &Path) -> Vec<(String, String)> {
+        let mut hashes: Vec<(String, String)> = load_entries(index_dir)
+            .unwrap()
+            .unwrap()
+            .entries
+            .into_iter()
+            .map(|(path, entry)| (path.to_string_lossy().to_string(), entry.metadata.hash))
+            .collect();
+        hashes.sort();
+        hashes
+    }
+
+    #[test]
+    fn levels_grow_by_the_fanout() {
+        assert_eq!(level_for(1), 0);
+        assert_eq!(level_for(LEVEL_ZERO_FILES), 0);
+        assert_eq!(level_for(LEVEL_ZERO_FILES + 1), 1);
+        assert_eq!(level_for(LEVEL_ZERO_FILES * FANOUT * FANOUT), 2);
+    }
+
+    #[test]
+    fn indexes_get_segments_only_once_asked() {
+        let dir = TempDir::new().unwrap();
+        let index_dir = dir.path().join(".cs");
+        let mut manifest = IndexManifest::default();
+        write(&index_dir, &mut manifest, "a.rs", "a1");
+        add(&index_dir, &manifest, &[]);
+        assert!(!index_dir.join(SEGMENTS_DIR).exists());
+        assert!(load_entries(&index_dir).unwrap().is_none());
+    }
+
+    #[test]
+    fn updates_append_segments_that_merge_once_a_level_fills() {
+        let dir = TempDir::new().unwrap();
+        let index_dir = opted_in(&dir);
+        let mut manifest = IndexManifest::default();
+        write(&index_dir, &mut manifest, "a.rs", "a1");
+        write(&index_dir, &mut manifest, "b.rs", "b1");
+        assert!(load_entries(&index_dir).unwrap().is_none());
+
+        // The first segment packs the whole index
+        add(&index_dir, &manifest, &[]);
+        assert_eq!(list(&index_dir).len(), 1);
+
+        for round in 2..=FANOUT {
+            let key = write(&index_dir, &mut manifest, "a.rs", &format!("a{}", round));
+            add(&index_dir, &manifest, &[key]);
+        }
+        let segments = list(&index_dir);
+        assert_eq!(segments.len(), 1, "{:?}", segments);
+        assert_eq!(segments[0].level, 1);
+        assert_eq!(
+            hashes(&index_dir),
+            vec![
+                ("a.rs".to_string(), format!("a{}", FANOUT)),
+                ("b.rs".to_string(), "b1".to_string())
+            ]
+        );
+    }
+
+    #[test]
+    fn files_the_segments_are_behind_on_come_from_their_sidecars() {
+        let dir = TempDir::new().unwrap();
+        let index_dir = opted_in(&dir);
+        let mut manifest = IndexManifest::default();
+        write(&index_dir, &mut manifest, "a.rs", "a1");
+        write(&index_dir, &mut manifest, "gone.rs", "g");
+        add(&index_dir, &manifest, &[]);
+
+        // Written after the segment, without one of its own
+        write(&index_dir, &mut manifest, "a.rs", "a2");
+        write(&index_dir, &mut manifest, "new.rs", "n");
+        manifest.files.remove(Path::new("./gone.rs"));
+        super::super::save_manifest(&index_dir.join("manifest.json"), &manifest).unwrap();
+
+        assert_eq!(
+            hashes(&index_dir),
+            vec![
+                ("a.rs".to_string(), "a2".to_string()),
+                ("new.rs".to_string(), "n".to_string())
+            ]
+        );
+    }
+
+    #[test]
+    fn removed_files_leave_the_segments() {
+        let dir = TempDir::new().unwrap();
+        let index_dir = opted_in(&dir);
+        let mut manifest = IndexManifest::default();
+        let a = write(&index_dir, &mut manifest, "a.rs", "a1");
+        let b = write(&index_dir, &mut manifest, "b.rs", "b1");
+        add(&index_dir, &manifest, &[]);
+        let key = write(&index_dir, &mut manifest, "b.rs", "b2");
+        add(&index_dir, &manifest, &[key]);
+        assert_eq!(list(&index_dir).len(), 2);
+
+        remove_files(&index_dir, &[b]).unwrap();
+        // The segment that only held b.rs is gone, the other keeps a.rs
+        let segments = list(&index_dir);
+        assert_eq!(segments.len(), 1);
+        let entries = load(&segments[0].path).unwrap().entries;
+        assert_eq!(entries.len(), 1);
+        assert_eq!(entries[0].metadata.path, a);
+    }
+
+    #[test]
+    fn damaged_segments_are_skipped_and_reported() {
+        let dir = TempDir::new().unwrap();
+        let index_dir = opted_in(&dir);
+        let mut manifest = IndexManifest::default();
+        write(&index_dir, &mut manifest, "a.rs", "a1");
+        write(&index_dir, &mut manifest, "b.rs", "b1");
+        add(&index_dir, &manifest, &[]);
+        let key = write(&index_dir, &mut manifest, "a.rs", "a2");
+        add(&index_dir, &manifest, &[key]);
+
+        // The newest segment is cut short, and b.rs's sidecar is garbage
+        let segments = list(&index_dir);
+        assert_eq!(segments.len(), 2);
+        let newest = segments[1].path.clone();
+        let data = fs::read(&newest).unwrap();
+        fs::write(&newest, &data[..data.len() / 2]).unwrap();
+        let b = sidecar_path_for_manifest_key(&index_dir, Path::new("./b.rs"));
+        fs::write(&b, b"not an entry").unwrap();
+
+        let loaded = load_entries(&index_dir).unwrap().unwrap();
+        assert_eq!(loaded.damaged_segments, vec![newest.clone()]);
+        assert!(loaded.unreadable.is_empty(), "{:?}", loaded.unreadable);
+        // a.rs is read from its sidecar, b.rs from the older segment
+        assert_eq!(
+            hashes(&index_dir),
+            vec![
+                ("a.rs".to_string(), "a2".to_string()),
+                ("b.rs".to_string(), "b1".to_string())
+            ]
+        );
+
+        assert_eq!(damaged(&index_dir), vec![newest.clone()]);
+        assert_eq!(remove_damaged(&index_dir).unwrap(), 1);
+        assert!(!newest.exists());
+        assert!(damaged(&index_dir).is_empty());
+        // Without the older segment, b.rs has nothing readable left
+        fs::remove_file(&segments[0].path).unwrap();
+        add(&index_dir, &manifest, &[]);
+        let loaded = load_entries(&index_dir).unwrap().unwrap();
+        assert_eq!(loaded.unreadable, vec![PathBuf::from("./b.rs")]);
+    }
+}
@@ -0,0 +1,770 @@
+//! Sharded indexes for very large repositories.
+//!
+//! A sharded index splits `.cs/` by top-level directory, or with
+//! `--project-shards` by project (see [`crate::projects`]): each shard is a
+//! self-contained manifest plus sidecars under `.cs/shards/<name>/`, keyed by
+//! the same repository-relative paths as an unsharded index. Shards build
+//! independently, several at once locally (`cs --index --shards`) or on
+//! separate machines (`cs --index --shard services`) and collected with
+//! `cs --merge-shards`. Searches only load the shards overlapping their
+//! scope, in parallel.
+
+use super::{
+    INTERRUPTED, IndexManifest, bundle, collect_files, index_single_file, journal::Journal,
+    load_or_create_manifest, path_utils, projects, refresh_derived_data, save_index_entry,
+    save_manifest, segments, validate_manifest_model,
+};
+use anyhow::{Result, bail};
+use std::collections::{BTreeMap, HashSet};
+use std::fs;
+use std::path::{Component, Path, PathBuf};
+use std::sync::Mutex;
+use std::sync::atomic::Ordering;
+use std::time::SystemTime;
+use walkdir::WalkDir;
+
+pub const SHARDS_DIR: &str = "shards";
+
+/// Shard holding the files directly at the repository root.
+pub const ROOT_SHARD: &str = "_root";
+
+/// Files indexed between manifest saves, so an interrupted build keeps its work.
+pub(crate) const SAVE_EVERY: usize = 100;
+
+pub struct Shard {
+    pub name: String,
+    pub dir: PathBuf,
+    pub manifest: IndexManifest,
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct ShardBuildStats {
+    pub name: String,
+    pub files_indexed: usize,
+    pub files_up_to_date: usize,
+    pub files_removed: usize,
+    pub files_errored: usize,
+}
+
+pub struct ShardBuildOptions<'a> {
+    /// Shards to build; empty builds every top-level directory or project
+    pub only: &'a [String],
+    pub compute_embeddings: bool,
+    pub respect_gitignore: bool,
+    pub exclude_patterns: &'a [String],
+    pub model: Option<&'a str>,
+    /// Shards built at once, each with its own embedder
+    pub jobs: usize,
+    /// Drop entries for files that are no longer collected
+    pub prune: bool,
+    /// Shard by project rather than top-level directory. An index already
+    /// sharded by project stays that way without it.
+    pub by_project: bool,
+}
+
+/// The shard a file belongs to, from its path relative to the repository root.
+pub fn shard_name(standard_path: &Path) -> String {
+    let mut components = standard_path
+        .components()
+        .filter(|c| matches!(c, Component::Normal(_)));
+    match (components.next(), components.next()) {
+        (Some(first), Some(_)) => first.as_os_str().to_string_lossy().into_owned(),
+        _ => ROOT_SHARD.to_string(),
+    }
+}
+
+fn shards_root(repo_root: &Path) -> PathBuf {
+    cs_core::locations::index_dir(repo_root).join(SHARDS_DIR)
+}
+
+pub fn shard_dir(repo_root: &Path, name: &str) -> PathBuf {
+    shards_root(repo_root).join(name)
+}
+
+/// Whether the index at `repo_root` is split into shards.
+pub fn is_sharded(repo_root: &Path) -> bool {
+    shards_root(repo_root).is_dir()
+}
+
+/// The shard of a file in the index at `repo_root`: its project's when the
+/// index is sharded by project, else its top-level directory's.
+pub fn shard_of(repo_root: &Path, standard_path: &Path) -> String {
+    match projects::saved_projects(repo_root) {
+        Some(saved) => project_shard_name(&saved, standard_path),
+        None => shard_name(standard_path),
+    }
+}
+
+fn project_shard_name(saved: &[projects::Project], standard_path: &Path) -> String {
+    projects::project_of(saved, standard_path)
+        .map(|project| project.name.clone())
+        .unwrap_or_else(|| ROOT_SHARD.to_string())
+}
+
+/// Sidecar for `standard_path` (relative to `repo_root`), in its shard when
+/// the index is sharded.
+pub fn sidecar_path(repo_root: &Path, standard_path: &Path) -> PathBuf {
+    let standard_path = path_utils::from_manifest_path(standard_path);
+    let index_dir = if is_sharded(repo_root) {
+        shard_dir(repo_root, &shard_of(repo_root, &standard_path))
+    } else {
+        cs_core::locations::index_dir(repo_root)
+    };
+    path_utils::get_sidecar_path_for_standard_path(&index_dir, &standard_path)
+}
+
+/// The shards of the index at `repo_root`, by name.
+pub fn list_shards(repo_root: &Path) -> Result<Vec<Shard>> {
+    let mut shards = Vec::new();
+    for (name, dir) in shard_dirs(repo_root)? {
+        shards.push(Shard {
+            name,
+            manifest: load_or_create_manifest(&dir.join("manifest.json"))?,
+            dir,
+        });
+    }
+    Ok(shards)
+}
+
+/// Like [`list_shards`], for readers that can do without part of the index:
+/// shards whose manifest can't be read are left out, and their names
+/// returned alongside.
+pub fn list_readable_shards(repo_root: &Path) -> Result<(Vec<Shard>, Vec<String>)> {
+    let mut shards = Vec::new();
+    let mut unreadable = Vec::new();
+    for (name, dir) in shard_dirs(repo_root)? {
+        match load_or_create_manifest(&dir.join("manifest.json")) {
+            Ok(manifest) => shards.push(Shard {
+                name,
+                manifest,
+                dir,
+            }),
+            Err(e) => {
+                tracing::debug!("Skipping shard {}: {}", name, e);
+                unreadable.push(name);
+            }
+        }
+    }
+    Ok((shards, unreadable))
+}
+
+/// The name and directory of each shard with a manifest, by name.
+fn shard_dirs(repo_root: &Path) -> Result<Vec<(String, PathBuf)>> {
+    let root = shards_root(repo_root);
+    if !root.is_dir() {
+        return Ok(Vec::new());
+    }
+    let mut shards = Vec::new();
+    for entry in fs::read_dir(&root)? {
+        let dir = entry?.path();
+        if !dir.join("manifest.json").is_file() {
+            continue;
+        }
+        let Some(name) = dir.file_name().map(|n| n.to_string_lossy().into_owned()) else {
+            continue;
+        };
+        shards.push((name, dir));
+    }
+    shards.sort();
+    Ok(shards)
+}
+
+/// Whether files in shard `name` can fall under a search scoped to `scope`.
+pub fn shard_in_scope(repo_root: &Path, name: &str, scope: &Path) -> bool {
+    let root = cs_core::paths::canonicalize_lossy(repo_root);
+    let scope_abs = cs_core::paths::canonicalize_lossy(scope);
+    let Ok(relative) = scope_abs.strip_prefix(&root) else {
+        // Outside the repository, or spelled differently; let path filters decide
+        return true;
+    };
+    if let Some(saved) = projects::saved_projects(repo_root) {
+        return project_shard_in_scope(&saved, name, relative, scope_abs.is_file());
+    }
+    let mut components = relative.components();
+    match components.next() {
+        None => true,
+        Some(_) if components.next().is_none() && scope_abs.is_file() => name == ROOT_SHARD,
+        Some(first) => cs_core::paths::paths_equal(Path::new(first.as_os_str()), Path::new(name)),
+    }
+}
+
+/// Like [`shard_in_scope`] for an index sharded by project, with `relative`
+/// the scope relative to the repository root.
+fn project_shard_in_scope(
+    saved: &[projects::Project],
+    name: &str,
+    relative: &Path,
+    is_file: bool,
+) -> bool {
+    if relative.as_os_str().is_empty() {
+        return true;
+    }
+    // Scoped inside a project, only its own shard has files there
+    if let Some(project) = projects::project_of(saved, relative) {
+        return project.name == name;
+    }
+    if name == ROOT_SHARD {
+        return true;
+    }
+    // Scoped above projects, their shards
+    let scope = relative.to_string_lossy().replace('\\', "/");
+    !is_file
+        && saved.iter().any(|project| {
+            project.name == name && projects::path_contains(&scope, Path::new(&project.path))
+        })
+}
+
+/// Build or refresh the shards of `repo_root` incrementally, `options.jobs`
+/// at a time. Shards that fail are reported after the others finish.
+pub fn build_shards(repo_root: &Path, options: &ShardBuildOptions) -> Result<Vec<ShardBuildStats>> {
+    bundle::ensure_writable(repo_root)?;
+    if cs_core::locations::index_dir(repo_root)
+        .join("manifest.json")
+        .exists()
+    {
+        bail!(
+            "{} already has an unsharded index; run 'cs --clean' before building shards",
+            repo_root.display()
+        );
+    }
+
+    let existing = list_shards(repo_root)?;
+    let model = resolve_shard_model(&existing, options)?;
+
+    let by_project = projects::saved_projects(repo_root).is_some();
+    if options.by_project && !by_project && !existing.is_empty() {
+        bail!(
+            "{} is sharded by top-level directory; run 'cs --clean' before sharding it by project",
+            repo_root.display()
+        );
+    }
+    let files = collect_files(
+        repo_root,
+        options.respect_gitignore,
+        options.exclude_patterns,
+    )?;
+    // Projects are rediscovered on every build, so new ones get their own shard
+    let saved = if options.by_project || by_project {
+        let mut discovered = projects::projects_among(repo_root, &files);
+        if !options.prune
+            && let Some(previous) = projects::saved_projects(repo_root)
+        {
+            // Files of projects this build doesn't see stay where they are
+            discovered.retain(|project| !previous.iter().any(|p| p.path == project.path));
+            discovered.extend(previous.iter().cloned());
+            discovered.sort_by(|a, b| a.path.cmp(&b.path));
+        }
+        projects::save_projects(repo_root, &discovered)?;
+        Some(discovered)
+    } else {
+        None
+    };
+
+    let mut groups: BTreeMap<String, Vec<PathBuf>> = BTreeMap::new();
+    for file in files {
+        let standard = path_utils::to_standard_path(&file, repo_root);
+        let name = match &saved {
+            Some(saved) => project_shard_name(saved, &standard),
+            None => shard_name(&standard),
+        };
+        groups.entry(name).or_default().push(file);
+    }
+    // Shards whose directory is gone still need their entries dropped
+    for shard in &existing {
+        groups.entry(shard.name.clone()).or_default();
+    }
+    if !options.only.is_empty() {
+        for name in options.only {
+            if !groups.contains_key(name) {
+                bail!("No files to index under '{}'", name);
+            }
+        }
+        groups.retain(|name, _| options.only.contains(name));
+    }
+
+    let queue = Mutex::new(groups.into_iter().collect::<Vec<_>>());
+    let results = Mutex::new(Vec::new());
+    let jobs = options.jobs.max(1);
+    std::thread::scope(|scope| {
+        for _ in 0..jobs {
+            scope.spawn(|| {
+                let mut embedder = None;
+                loop {
+                    let Some((name, files)) = queue.lock().unwrap_or_else(|e| e.into_inner()).pop()
+                    else {
+                        break;
+                    };
+                    let result = (|| {
+                        if options.compute_embeddings && embedder.is_none() {
+                            embedder = Some(cs_embed::create_embedder(
+                                model.as_ref().map(|(name, _)| name.as_str()),
+                            )?);
+                        }
+                        build_shard(
+                            repo_root,
+                            &name,
+                            &files,
+                            embedder.as_mut(),
+                            model.as_ref(),
+                            options.prune,
+                        )
+                    })();
+                    results
+                        .lock()
+                        .unwrap_or_else(|e| e.into_inner())
+                        .push((name, result));
+                }
+            });
+        }
+    });
+
+    let mut results = results.into_inner().unwrap_or_else(|e| e.into_inner());
+    results.sort_by(|a, b| a.0.cmp(&b.0));
+    let mut stats = Vec::new();
+    let mut failures = Vec::new();
+    for (name, result) in results {
+        match result {
+            Ok(shard_stats) => stats.push(shard_stats),
+            Err(e) => failures.push(format!("{}: {}", name, e)),
+        }
+    }
+
+    refresh_derived_data(repo_root, &combined_manifest(repo_root)?);
+    if !failures.is_empty() {
+        bail!("Failed to build shards:\n  {}", failures.join("\n  "));
+    }
+    Ok(stats)
+}
+
+/// The embedding model (name, dimensions) every shard is built with: the
+/// requested one, else the one existing shards use, else the default.
+fn resolve_shard_model(
+    existing: &[Shard],
+    options: &ShardBuildOptions,
+) -> Result<Option<(String, usize)>> {
+    if !options.compute_embeddings {
+        return Ok(None);
+    }
+    let registry = cs_models::ModelRegistry::default();
+    let existing_model = existing.iter().find_map(|shard| {
+        let model = shard.manifest.embedding_model.clone()?;
+        Some((
+            model,
+            shard.manifest.embedding_dimensions.unwrap_or(384),
+            &shard.name,
+        ))
+    });
+    for shard in existing {
+        validate_manifest_model(&shard.manifest)?;
+    }
+
+    let requested = match options.model {
+        Some(model_name) => {
+            let config = registry.get_model(model_name).ok_or_else(|| {
+                anyhow::anyhow!(
+                    "Unknown model '{}'. Available models: bge-small, nomic-v1.5, jina-code",
+                    model_name
+                )
+            })?;
+            Some((config.name.clone(), config.dimensions))
+        }
+        None => None,
+    };
+
+    match (requested, existing_model) {
+        (Some(requested), Some((model, _, shard))) if requested.0 != model => bail!(
+            "Shard '{}' was built with '{}', not '{}'; all shards must share a model. Run 'cs --clean' to rebuild with the new one.",
+            shard,
+            model,
+            requested.0
+        ),
+        (Some(requested), _) => Ok(Some(requested)),
+        (None, Some((model, dims, _))) => Ok(Some((model, dims))),
+        (None, None) => {
+            let config = registry
+                .get_default_model()
+                .ok_or_else(|| anyhow::anyhow!("No default model available"))?;
+            Ok(Some((config.name.clone(), config.dimensions)))
+        }
+    }
+}
+
+/// Whether `file` still matches its manifest entry, by mtime and size or hash.
+pub(crate) fn is_unchanged(file: &Path, metadata: &cs_core::FileMetadata) -> bool {
+    let Ok(fs_meta) = fs::metadata(file) else {
+        return false;
+    };
+    let modified = fs_meta
+        .modified()
+        .ok()
+        .and_then(|m| m.duration_since(SystemTime::UNIX_EPOCH).ok())
+        .map(|d| d.as_secs());
+    if modified == Some(metadata.last_modified) && fs_meta.len() == metadata.size {
+        return true;
+    }
+    cs_core::compute_file_hash(file).is_ok_and(|hash| hash == metadata.hash)
+}
+
+fn build_shard(
+    repo_root: &Path,
+    name: &str,
+    files: &[PathBuf],
+    mut embedder: Option<&mut Box<dyn cs_embed::Embedder>>,
+    model: Option<&(String, usize)>,
+    prune: bool,
+) -> Result<ShardBuildStats> {
+    let dir = shard_dir(repo_root, name);
+    let manifest_path = dir.join("manifest.json");
+    let mut journal = Journal::open(&manifest_path)?;
+    let mut manifest = load_or_create_manifest(&manifest_path)?;
+    if let Some((model, dims)) = model {
+        manifest.embedding_model = Some(model.clone());
+        manifest.embedding_dimensions = Some(*dims);
+        manifest.embedding_model_version = Some(cs_embed::EMBEDDING_PIPELINE_VERSION.to_string());
+    }
+
+    let mut stats = ShardBuildStats {
+        name: name.to_string(),
+        ..Default::default()
+    };
+    let mut seen = HashSet::new();
+    let mut interrupted = false;
+    for file in files {
+        if INTERRUPTED.load(Ordering::SeqCst) {
+            interrupted = true;
+            break;
+        }
+        let standard = path_utils::to_standard_path(file, repo_root);
+        let key = path_utils::to_manifest_path(&standard);
+        seen.insert(key.clone());
+        if manifest
+            .files
+            .get(&key)
+            .is_some_and(|metadata| is_unchanged(file, metadata))
+        {
+            stats.files_up_to_date += 1;
+            continue;
+        }
+
+        match index_single_file(file, repo_root, embedder.as_deref_mut()) {
+            Ok(entry) => {
+                let sidecar = path_utils::get_sidecar_path_for_standard_path(&dir, &standard);
+                journal.writing(&key, &sidecar)?;
+                save_index_entry(&sidecar, &entry)?;
+                manifest.files.insert(key, entry.metadata);
+                stats.files_indexed += 1;
+                if stats.files_indexed % SAVE_EVERY == 0 {
+                    save_manifest(&manifest_path, &manifest)?;
+                }
+            }
+            Err(e) => {
+                if !e.to_string().contains("Binary file, skipping") {
+                    tracing::warn!("Failed to index {:?}: {}", file, e);
+                }
+                stats.files_errored += 1;
+            }
+        }
+    }
+
+    if prune && !interrupted {
+        let stale: Vec<PathBuf> = manifest
+            .files
+            .keys()
+            .filter(|key| !seen.contains(*key))
+            .cloned()
+            .collect();
+        for key in stale {
+            manifest.files.remove(&key);
+            let sidecar = path_utils::get_sidecar_path_for_standard_path(
+                &dir,
+                &path_utils::from_manifest_path(&key),
+            );
+            if sidecar.exists() {
+                journal.removing(&key, &sidecar)?;
+                fs::remove_file(&sidecar)?;
+            }
+            stats.files_removed += 1;
+        }
+    }
+
+    if manifest.files.is_empty() {
+        if dir.exists() {
+            fs::remove_dir_all(&dir)?;
+        }
+        return Ok(stats);
+    }
+    manifest.updated = SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .unwrap()
+        .as_secs();
+    save_manifest(&manifest_path, &manifest)?;
+    let written = journal.commit()?;
+    segments::add(&dir, &manifest, &written);
+    Ok(stats)
+}
+
+/// Every shard's files in one manifest, for data derived across the repository.
+pub fn combined_manifest(repo_root: &Path) -> Result<IndexManifest> {
+    let mut combined = IndexManifest::default();
+    for shard in list_shards(repo_root)? {
+        if combined.embedding_model.is_none() {
+            combined.embedding_model = shard.manifest.embedding_model.clone();
+            combined.embedding_dimensions = shard.manifest.embedding_dimensions;
+            combined.embedding_model_version = shard.manifest.embedding_model_version.clone();
+        }
+        combined.files.extend(shard.manifest.files);
+    }
+    Ok(combined)
+}
+
+/// Copy shards built elsewhere into the index at `repo_root`, replacing
+/// shards of the same name. Each source is a checkout with a sharded index or
+/// a single `.cs/shards/<name>` directory. Returns the merged shard names.
+pub fn merge_shards(repo_root: &Path, sources: &[PathBuf]) -> Result<Vec<String>> {
+    bundle::ensure_writable(repo_root)?;
+    if cs_core::locations::index_dir(repo_root)
+        .join("manifest.json")
+        .exists()
+    {
+        bail!(
+            "{} has an unsharded index; run 'cs --clean' before merging shards into it",
+            repo_root.display()
+        );
+    }
+
+    let mut incoming: Vec<Shard> = Vec::new();
+    for source in sources {
+        let manifest_path = source.join("manifest.json");
+        if manifest_path.is_file()
+            && let Some(name) = source.file_name()
+        {
+            incoming.push(Shard {
+                name: name.to_string_lossy().into_owned(),
+                dir: source.clone(),
+                manifest: load_or_create_manifest(&manifest_path)?,
+            });
+        } else if is_sharded(source) {
+            incoming.extend(list_shards(source)?);
+        } else {
+            bail!(
+                "No shards found at {}; expected a checkout with .cs/shards or a shard directory",
+                source.display()
+            );
+        }
+    }
+
+    let existing = list_shards(repo_root)?;
+    let reference = existing
+        .iter()
+        .chain(&incoming)
+        .find(|shard| shard.manifest.embedding_model.is_some())
+        .map(|shard| (shard.name.clone(), shard.manifest.clone()));
+    for shard in &incoming {
+        validate_manifest_model(&shard.manifest)?;
+        if let Some((reference_name, reference)) = &reference
+            && (shard.manifest.embedding_model != reference.embedding_model
+                || shard.manifest.embedding_dimensions != reference.embedding_dimensions)
+        {
+            bail!(
+                "Shard '{}' from {} uses {:?}, but shard '{}' uses {:?}; all shards must share a model",
+                shard.name,
+                shard.dir.display(),
+                shard.manifest.embedding_model,
+                reference_name,
+                reference.embedding_model
+            );
+        }
+    }
+
+    let root = shards_root(repo_root);
+    fs::create_dir_all(&root)?;
+    let mut merged = Vec::new();
+    for shard in incoming {
+        let dest = shard_dir(repo_root, &shard.name);
+        if cs_core::paths::paths_equal(
+            &cs_core::paths::canonicalize_lossy(&shard.dir),
+            &cs_core::paths::canonicalize_lossy(&dest),
+        ) {
+            continue;
+        }
+        let staging = root.join(format!(".{}.merging", shard.name));
+        if staging.exists() {
+            fs::remove_dir_all(&staging)?;
+        }
+        copy_dir(&shard.dir, &staging)?;
+        if dest.exists() {
+            fs::remove_dir_all(&dest)?;
+        }
+        fs::rename(&staging, &dest)?;
+        merged.push(shard.name);
+    }
+
+    refresh_derived_data(repo_root, &combined_manifest(repo_root)?);
+    Ok(merged)
+}
+
+fn copy_dir(from: &Path, to: &Path) -> Result<()> {
+    for entry in WalkDir::new(from) {
+        let entry = entry?;
+        let target = to.join(entry.path().strip_prefix(from)?);
+        if entry.file_type().is_dir() {
+            fs::create_dir_all(&target)?;
+        } else if entry.file_type().is_file() {
+            fs::copy(entry.path(), &target)?;
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn write(root: &Path, relative: &str, contents: &str) {
+        let path = root.join(relative);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, contents).unwrap();
+    }
+
+    fn options(only: &[String]) -> ShardBuildOptions<'_> {
+        ShardBuildOptions {
+            only,
+            compute_embeddings: false,
+            respect_gitignore: false,
+            exclude_patterns: &[],
+            model: None,
+            jobs: 2,
+            prune: true,
+            by_project: false,
+        }
+    }
+
+    #[test]
+    fn names_shards_by_top_level_directory() {
+        assert_eq!(shard_name(Path::new("services/api/main.go")), "services");
+        assert_eq!(shard_name(Path::new("./libs/a.rs")), "libs");
+        assert_eq!(shard_name(Path::new("README.md")), ROOT_SHARD);
+    }
+
+    #[test]
+    fn builds_refreshes_and_merges_shards() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        write(root, "services/api.rs", "fn serve() {}");
+        write(root, "libs/util.rs", "fn helper() {}");
+        write(root, "main.rs", "fn main() {}");
+
+        let stats = build_shards(root, &options(&[])).unwrap();
+        let names: Vec<&str> = stats.iter().map(|s| s.name.as_str()).collect();
+        assert_eq!(names, [ROOT_SHARD, "libs", "services"]);
+        assert!(
+            shard_dir(root, "services")
+                .join("services")
+                .join("api.rs.cs")
+                .exists()
+        );
+
+        // Only the touched shard is rebuilt; removed files are pruned
+        fs::remove_file(root.join("libs/util.rs")).unwrap();
+        write(root, "libs/other.rs", "fn other() {}");
+        let stats = build_shards(root, &options(&["libs".to_string()])).unwrap();
+        assert_eq!(stats.len(), 1);
+        assert_eq!((stats[0].files_indexed, stats[0].files_removed), (1, 1));
+        assert!(build_shards(root, &options(&["missing".to_string()])).is_err());
+
+        // A shard built on another machine is copied in
+        let other = TempDir::new().unwrap();
+        write(other.path(), "tools/gen.rs", "fn generate() {}");
+        build_shards(other.path(), &options(&[])).unwrap();
+        let merged = merge_shards(root, &[shard_dir(other.path(), "tools")]).unwrap();
+        assert_eq!(merged, ["tools"]);
+        let shards: Vec<String> = list_shards(root)
+            .unwrap()
+            .into_iter()
+            .map(|s| s.name)
+            .collect();
+        assert_eq!(shards, [ROOT_SHARD, "libs", "services", "tools"]);
+        assert_eq!(combined_manifest(root).unwrap().files.len(), 4);
+
+        // Searches skip a shard whose manifest is damaged
+        fs::write(shard_dir(root, "tools").join("manifest.json"), "{ not json").unwrap();
+        assert!(list_shards(root).is_err());
+        let (readable, unreadable) = list_readable_shards(root).unwrap();
+        let names: Vec<&str> = readable.iter().map(|s| s.name.as_str()).collect();
+        assert_eq!(names, [ROOT_SHARD, "libs", "services"]);
+        assert_eq!(unreadable, ["tools"]);
+    }
+
+    #[test]
+    fn prunes_shards_outside_the_search_scope() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        write(root, "services/api.rs", "fn serve() {}");
+        write(root, "main.rs", "fn main() {}");
+
+        assert!(shard_in_scope(root, "services", root));
+        assert!(shard_in_scope(root, "services", &root.join("services")));
+        assert!(!shard_in_scope(root, "libs", &root.join("services")));
+        assert!(shard_in_scope(root, ROOT_SHARD, &root.join("main.rs")));
+        assert!(!shard_in_scope(root, "services", &root.join("main.rs")));
+    }
+
+    #[test]
+    fn shards_by_project() {
+        let temp_dir = TempDir::new().unwrap();
+        let root = temp_dir.path();
+        write(root, "services/api-server/go.mod", "module api");
+        write(root, "services/api-server/main.go", "package main");
+        write(root, "services/README.md", "# Services");
+        write(root, "web/package.json", "{}");
+        write(root, "web/app.js", "go()");
+
+        let only: Vec<String> = Vec::new();
+        let stats = build_shards(
+            root,
+            &ShardBuildOptions {
+                by_project: true,
+                ..options(&only)
+            },
+        )
+        .unwrap();
+        let names: Vec<&str> = stats.iter().map(|s| s.name.as_str()).collect();
+        assert_eq!(names, [ROOT_SHARD, "api-server", "web"]);
+        assert_eq!(
+            sidecar_path(root, Path::new("services/api-server/main.go")),
+            shard_dir(root, "api-server")
+                .join("services")
+                .join("api-server")
+                .join("main.go.cs")
+        );
+        assert!(
+            shard_dir(root, ROOT_SHARD)
+                .join("services/README.md.cs")
+                .exists()
+        );
+
+        // The layout sticks without asking again
+        write(root, "web/index.js", "start()");
+        let stats = build_shards(root, &options(&["web".to_string()])).unwrap();
+        assert_eq!(stats[0].files_indexed, 1);
+
+        let api = root.join("services/api-server");
+        assert!(shard_in_scope(root, "api-server", &api));
+        assert!(!shard_in_scope(root, ROOT_SHARD, &api));
+        assert!(!shard_in_scope(root, "web", &api));
+        assert!(shard_in_scope(root, "api-server", &root.join("services")));
+        assert!(shard_in_scope(root, ROOT_SHARD, &root.join("services")));
+        assert!(!shard_in_scope(root, "web", &root.join("services")));
+
+        // A directory-sharded index isn't silently re-sharded
+        let other = TempDir::new().unwrap();
+        write(other.path(), "web/package.json", "{}");
+        build_shards(other.path(), &options(&only)).unwrap();
+        let by_project = ShardBuildOptions {
+            by_project: true,
+            ..options(&only)
+        };
+        assert!(build_shards(other.path(), &by_project).is_err());
+    }
+}
@@ -0,0 +1,550 @@
+//! Function signatures, indexed as a field of their own so a query about a
+//! function's shape ("takes an int and returns a user and an error") finds
+//! it by its parameters and results rather than only by its name and body.
+//!
+//! Each function and method chunk keeps its declaration with whitespace
+//! collapsed and, when embedded, one more embedding of that signature with a
+//! plain-language reading of it. Semantic search scores the signature
+//! embedding next to the chunk's own, weighted by [`SIGNATURE_WEIGHT`] so a
+//! body that answers the query still ranks above a signature that only
+//! resembles it.
+
+use anyhow::Result;
+use cs_core::Language;
+use std::path::Path;
+
+use super::{ChunkEntry, secrets};
+
+/// Factor on the signature embedding's similarity when it's scored next to
+/// the chunk's own.
+pub const SIGNATURE_WEIGHT: f32 = 0.9;
+
+/// Longest signature kept, in bytes; past that it's mostly a parameter list
+/// nobody describes in a query.
+const MAX_SIGNATURE_LENGTH: usize = 400;
+
+/// Words before a name that say nothing about what a function returns.
+const MODIFIERS: &[&str] = &[
+    "abstract",
+    "async",
+    "const",
+    "def",
+    "default",
+    "export",
+    "extern",
+    "final",
+    "fn",
+    "fun",
+    "func",
+    "function",
+    "inline",
+    "internal",
+    "native",
+    "override",
+    "private",
+    "protected",
+    "pub",
+    "pub(crate)",
+    "public",
+    "sealed",
+    "static",
+    "synchronized",
+    "unsafe",
+    "virtual",
+];
+
+/// Parameters that are the receiver rather than an input.
+const RECEIVERS: &[&str] = &["self", "&self", "&mut self", "mut self", "this", "cls"];
+
+/// Doc comments, comments, attributes and decorators ahead of a declaration.
+fn is_trivia(line: &str, lang: Language) -> bool {
+    let line = line.trim_start();
+    if line.is_empty() {
+        return true;
+    }
+    match lang {
+        Language::Python | Language::Ruby => line.starts_with('#') || line.starts_with('@'),
+        Language::Rust => line.starts_with("//") || line.starts_with("#["),
+        _ => {
+            line.starts_with("//")
+                || line.starts_with("/*")
+                || line.starts_with('*')
+                || line.starts_with('@')
+                || line.starts_with('[')
+        }
+    }
+}
+
+/// The declaration `text` opens with, up to its body, with whitespace
+/// collapsed: `func (s *Store) Get(id int) (*User, error)`. `None` when
+/// `text` doesn't open with one.
+pub fn extract_signature(text: &str, lang: Option<Language>) -> Option<String> {
+    let lang = lang.filter(|lang| !matches!(lang, Language::Pdf | Language::Haskell))?;
+    let start = text
+        .split_inclusive('\n')
+        .take_while(|line| is_trivia(line, lang))
+        .map(str::len)
+        .sum::<usize>();
+    let declaration = &text[start..];
+
+    let mut depth = 0usize;
+    let mut end = None;
+    for (i, c) in declaration.char_indices() {
+        if i > MAX_SIGNATURE_LENGTH * 2 {
+            break;
+        }
+        match c {
+            '(' | '[' => depth += 1,
+            ')' | ']' => depth = depth.saturating_sub(1),
+            _ if depth > 0 => {}
+            '{' | ';' if !matches!(lang, Language::Python | Language::Ruby) => {
+                end = Some(i);
+                break;
+            }
+            ':' if lang == Language::Python => {
+                end = Some(i);
+                break;
+            }
+            '\n' if lang == Language::Ruby => {
+                end = Some(i);
+                break;
+            }
+            '=' if lang == Language::Kotlin
+                && declaration[..i].contains(')')
+                && !declaration[i..].starts_with("=>") =>
+            {
+                end = Some(i);
+                break;
+            }
+            _ => {}
+        }
+    }
+    let end = match end {
+        Some(end) => end,
+        None if lang == Language::Ruby => declaration.len(),
+        None => return None,
+    };
+    let signature = normalize(&declaration[..end]);
+    (signature.contains('(') && signature.len() <= MAX_SIGNATURE_LENGTH).then_some(signature)
+}
+
+fn normalize(declaration: &str) -> String {
+    declaration
+        .split_whitespace()
+        .collect::<Vec<_>>()
+        .join(" ")
+        .replace("( ", "(")
+        .replace(" )", ")")
+        .replace(",)", ")")
+        .replace("[ ", "[")
+        .replace(" ]", "]")
+        .trim_end_matches(',')
+        .to_string()
+}
+
+/// Top-level parenthesized groups of `signature`, as byte ranges of what's
+/// inside them.
+fn paren_groups(signature: &str) -> Vec<(usize, usize)> {
+    let mut groups = Vec::new();
+    let mut depth = 0usize;
+    let mut open = 0;
+    for (i, c) in signature.char_indices() {
+        match c {
+            '(' => {
+                if depth == 0 {
+                    open = i + 1;
+                }
+                depth += 1;
+            }
+            ')' if depth > 0 => {
+                depth -= 1;
+                if depth == 0 {
+                    groups.push((open, i));
+                }
+            }
+            _ => {}
+        }
+    }
+    groups
+}
+
+/// Comma-separated items at the top level of `list`.
+fn split_list(list: &str) -> Vec<&str> {
+    let mut items = Vec::new();
+    let mut depth = 0usize;
+    let mut start = 0;
+    for (i, c) in list.char_indices() {
+        match c {
+            '(' | '[' | '<' | '{' => depth += 1,
+            ')' | ']' | '>' | '}' => depth = depth.saturating_sub(1),
+            ',' if depth == 0 => {
+                items.push(list[start..i].trim());
+                start = i + 1;
+            }
+            _ => {}
+        }
+    }
+    items.push(list[start..].trim());
+    items.retain(|item| !item.is_empty());
+    items
+}
+
+/// A signature taken apart.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SignatureParts {
+    pub name: String,
+    /// The type a Go method is declared on
+    pub receiver: Option<String>,
+    /// Parameters as written, without a `self` or `this`
+    pub params: Vec<String>,
+    /// Results as written, `*User, error`; empty when there are none
+    pub results: String,
+    /// The type of each parameter, with the names dropped
+    pub param_types: Vec<String>,
+    pub result_types: Vec<String>,
+}
+
+/// Take `signature` apart, `None` when it has no parameter list. Without a
+/// language it's read as Go, the syntax `cs --sig` queries are written in.
+pub fn signature_parts(signature: &str, lang: Option<Language>) -> Option<SignatureParts> {
+    let go = matches!(lang, Some(Language::Go) | None);
+    let groups = paren_groups(signature);
+    // The parameter list directly follows a name, or a generic parameter
+    // list after one; Go's receiver follows `func `
+    let params = groups.iter().position(|&(open, _)| {
+        signature[..open - 1]
+            .chars()
+            .last()
+            .is_some_and(|c| c.is_alphanumeric() || c == '_' || c == '>' || c == ']')
+    });
+    let params = params.or((!groups.is_empty()).then_some(0))?;
+    let (open, close) = groups[params];
+
+    let head = signature[..open - 1].trim_end();
+    let head = head
+        .rfind(['<', '['])
+        .filter(|_| head.ends_with(['>', ']']))
+        .map_or(head, |generics| head[..generics].trim_end());
+    // `const load = async (…) =>` is named before the `=`
+    let mut words: Vec<&str> = head.split_whitespace().collect();
+    while words
+        .last()
+        .is_some_and(|word| *word == "=" || MODIFIERS.contains(word))
+    {
+        words.pop();
+    }
+    let name = words
+        .pop()
+        .map(|word| word.rsplit(['.', ')']).next().unwrap_or(word))
+        .unwrap_or_default();
+    let before = words.join(" ");
+
+    let receiver = (go && params > 0)
+        .then(|| {
+            let (open, close) = groups[0];
+            signature[open..close]
+                .split_whitespace()
+                .last()
+                .map(|receiver| receiver.trim_start_matches('*').to_string())
+        })
+        .flatten();
+
+    let params: Vec<String> = split_list(&signature[open..close])
+        .into_iter()
+        .filter(|param| !RECEIVERS.contains(param))
+        .map(str::to_string)
+        .collect();
+
+    let rest = signature[close + 1..].trim();
+    let results = if let Some((_, results)) = rest.split_once("->") {
+        results.split(" where ").next().unwrap_or_default().trim()
+    } else if let Some(results) = rest.strip_prefix(':') {
+        results.trim()
+    } else if go {
+        rest.strip_prefix('(')
+            .and_then(|rest| rest.strip_suffix(')'))
+            .unwrap_or(rest)
+    } else if matches!(
+        lang,
+        Some(Language::Java | Language::C | Language::Cpp | Language::CSharp)
+    ) {
+        before.trim()
+    } else {
+        ""
+    };
+    let results = results
+        .split_whitespace()
+        .filter(|word| !MODIFIERS.contains(word))
+        .collect::<Vec<_>>()
+        .join(" ");
+    let results = match results.as_str() {
+        "void" | "()" | "None" | "Unit" => String::new(),
+        _ => results,
+    };
+
+    // Go lists results like parameters; elsewhere one type is returned
+    let result_types = if go {
+        types_of(&split_list(&results), lang)
+    } else if results.is_empty() {
+        Vec::new()
+    } else {
+        vec![results.clone()]
+    };
+    Some(SignatureParts {
+        name: name.to_string(),
+        receiver,
+        param_types: types_of(&params.iter().map(String::as_str).collect::<Vec<_>>(), lang),
+        params,
+        results,
+        result_types,
+    })
+}
+
+/// The types of a parameter list: what follows the `:` where there is one,
+/// the last words in Go (where `a, b int` gives both `int`) and what comes
+/// before the name in the C family, Java and PHP. Empty where a parameter
+/// isn't annotated.
+fn types_of(params: &[&str], lang: Option<Language>) -> Vec<String> {
+    let named = |param: &str| param.split_whitespace().count() > 1;
+    let any_named = params.iter().any(|param| named(param));
+    let mut types: Vec<String> = Vec::with_capacity(params.len());
+    for (i, param) in params.iter().enumerate() {
+        let param = param.split('=').next().unwrap_or(param).trim();
+        let ty = if let Some((_, ty)) = param
+            .split_once(':')
+            .filter(|(name, ty)| !name.ends_with(':') && !ty.starts_with(':'))
+        {
+            ty.trim().to_string()
+        } else if matches!(lang, Some(Language::Go) | None) {
+            match param.split_once(char::is_whitespace) {
+                Some((_, ty)) if any_named => ty.trim().to_string(),
+                // `a` in `a, b int`
+                None if any_named => params[i + 1..]
+                    .iter()
+                    .find_map(|next| next.split_once(char::is_whitespace))
+                    .map(|(_, ty)| ty.trim().to_string())
+                    .unwrap_or_else(|| param.to_string()),
+                _ => param.to_string(),
+            }
+        } else if matches!(
+            lang,
+            Some(Language::Java | Language::C | Language::Cpp | Language::CSharp | Language::Php)
+        ) {
+            match param.rsplit_once(char::is_whitespace) {
+                Some((ty, _)) => ty.trim().to_string(),
+                None => param.to_string(),
+            }
+        } else {
+            // An unannotated parameter, `user_id` in Python
+            String::new()
+        };
+        types.push(ty);
+    }
+    types
+}
+
+/// The signature followed by a reading of it an embedding model relates to
+/// how people describe functions: `GetUser, a method of Store, takes id int
+/// and returns *User, error`.
+pub fn signature_text(signature: &str, lang: Option<Language>) -> String {
+    let Some(parts) = signature_parts(signature, lang) else {
+        return signature.to_string();
+    };
+    let mut reading = parts.name;
+    if let Some(receiver) = parts.receiver {
+        reading.push_str(&format!(", a method of {},", receiver));
+    }
+    if parts.params.is_empty() {
+        reading.push_str(" takes no arguments");
+    } else {
+        reading.push_str(&format!(" takes {}", parts.params.join(", ")));
+    }
+    if !parts.results.is_empty() {
+        reading.push_str(&format!(" and returns {}", parts.results));
+    }
+    format!("{}\n{}", signature, reading)
+}
+
+/// Store each function and method chunk's signature, embedding them in one
+/// batch when the chunk itself was embedded.
+pub fn attach_signatures(
+    chunk_entries: &mut [ChunkEntry],
+    content: &str,
+    lang: Option<Language>,
+    embedder: Option<&mut dyn cs_embed::Embedder>,
+    repo_root: &Path,
+) -> Result<()> {
+    for chunk in chunk_entries.iter_mut() {
+        let declares = matches!(chunk.chunk_type.as_deref(), Some("function" | "method"));
+        // Sections of a split declaration don't start with it
+        if !declares || (chunk.parent.is_some() && !chunk.is_outline()) {
+            continue;
+        }
+        if let Some(text) = content.get(chunk.span.byte_start..chunk.span.byte_end) {
+            // Later strides of a long function open with a statement instead
+            chunk.signature = extract_signature(text, lang).filter(|signature| {
+                chunk
+                    .symbol
+                    .as_deref()
+                    .is_none_or(|symbol| signature.contains(symbol))
+            });
+        }
+    }
+    let Some(embedder) = embedder else {
+        return Ok(());
+    };
+
+    let mut targets = Vec::new();
+    let mut texts = Vec::new();
+    for (i, chunk) in chunk_entries.iter().enumerate() {
+        let (Some(_), Some(signature)) = (&chunk.embedding, &chunk.signature) else {
+            continue;
+        };
+        if let Some(text) =
+            secrets::screen(&*embedder, repo_root, &signature_text(signature, lang))?
+        {
+            targets.push(i);
+            texts.push(text);
+        }
+    }
+    if texts.is_empty() {
+        return Ok(());
+    }
+    let embeddings = embedder.embed(&texts)?;
+    if embeddings.len() != texts.len() {
+        return Err(anyhow::anyhow!(
+            "Embedder returned {} embeddings for {} signatures",
+            embeddings.len(),
+            texts.len()
+        ));
+    }
+    for (i, embedding) in targets.into_iter().zip(embeddings) {
+        chunk_entries[i].signature_embedding = Some(embedding);
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn signatures_stop_at_the_body() {
+        let go = "// GetUser loads a user.\nfunc (s *InMemoryUserService) GetUser(\n\tid int,\n) (*User, error) {\n\treturn nil, nil\n}\n";
+        assert_eq!(
+            extract_signature(go, Some(Language::Go)).as_deref(),
+            Some("func (s *InMemoryUserService) GetUser(id int) (*User, error)")
+        );
+
+        let rust = "/// Loads a user.\n#[inline]\npub fn get_user<T>(&self, id: u64) -> Result<User, Error>\nwhere\n    T: Store,\n{\n    todo!()\n}\n";
+        assert_eq!(
+            extract_signature(rust, Some(Language::Rust)).as_deref(),
+            Some("pub fn get_user<T>(&self, id: u64) -> Result<User, Error> where T: Store")
+        );
+
+        let python = "@cache\ndef get_user(self, user_id: int) -> dict[str, str]:\n    return {}\n";
+        assert_eq!(
+            extract_signature(python, Some(Language::Python)).as_deref(),
+            Some("def get_user(self, user_id: int) -> dict[str, str]")
+        );
+
+        assert_eq!(
+            extract_signature("let x = 1;\n", Some(Language::Rust)),
+            None
+        );
+        assert_eq!(
+            extract_signature("def run\n  go\nend\n", Some(Language::Ruby)),
+            None
+        );
+    }
+
+    #[test]
+    fn signatures_read_as_inputs_and_outputs() {
+        let reading = |signature: &str, lang: Language| {
+            signature_text(signature, Some(lang))
+                .lines()
+                .nth(1)
+                .unwrap()
+                .to_string()
+        };
+        assert_eq!(
+            reading(
+                "func (s *InMemoryUserService) GetUser(id int) (*User, error)",
+                Language::Go
+            ),
+            "GetUser, a method of InMemoryUserService, takes id int and returns *User, error"
+        );
+        assert_eq!(
+            reading(
+                "pub fn get_user<T>(&self, id: u64) -> Result<User, Error> where T: Store",
+                Language::Rust
+            ),
+            "get_user takes id: u64 and returns Result<User, Error>"
+        );
+        assert_eq!(
+            reading(
+                "public static List<User> findAll(int limit)",
+                Language::Java
+            ),
+            "findAll takes int limit and returns List<User>"
+        );
+        assert_eq!(
+            reading("async function load(): Promise<void>", Language::TypeScript),
+            "load takes no arguments and returns Promise<void>"
+        );
+        assert_eq!(
+            reading(
+                "export const load = async (id: string) =>",
+                Language::TypeScript
+            ),
+            "load takes id: string"
+        );
+        assert_eq!(
+            reading("def close(self)", Language::Python),
+            "close takes no arguments"
+        );
+    }
+
+    #[test]
+    fn parameter_and_result_types() {
+        let go = signature_parts(
+            "func (s *Store) Find(ctx context.Context, a, b int, opts ...Option) (u *User, err error)",
+            Some(Language::Go),
+        )
+        .unwrap();
+        assert_eq!(go.receiver.as_deref(), Some("Store"));
+        assert_eq!(
+            go.param_types,
+            ["context.Context", "int", "int", "...Option"]
+        );
+        assert_eq!(go.result_types, ["*User", "error"]);
+
+        let unnamed = signature_parts("func(context.Context, int) (*User, error)", None).unwrap();
+        assert_eq!(unnamed.param_types, ["context.Context", "int"]);
+        assert_eq!(unnamed.result_types, ["*User", "error"]);
+
+        let rust = signature_parts(
+            "fn open(&self, path: &std::path::Path) -> Result<File>",
+            Some(Language::Rust),
+        )
+        .unwrap();
+        assert_eq!(rust.param_types, ["&std::path::Path"]);
+        assert_eq!(rust.result_types, ["Result<File>"]);
+
+        let java = signature_parts(
+            "public User find(long id, String name)",
+            Some(Language::Java),
+        )
+        .unwrap();
+        assert_eq!(java.param_types, ["long", "String"]);
+        assert_eq!(java.result_types, ["User"]);
+
+        let python = signature_parts(
+            "def run(self, job, retries: int = 3)",
+            Some(Language::Python),
+        )
+        .unwrap();
+        assert_eq!(python.param_types, ["", "int"]);
+        assert!(python.result_types.is_empty());
+    }
+}
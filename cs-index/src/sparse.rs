@@ -0,0 +1,108 @@
+//! Optional learned sparse embeddings (SPLADE-style) kept next to the dense
+//! vectors.
+//!
+//! `cs --index --sparse` marks an index by writing `.cs/sparse.json` with the
+//! sparse model's name. From then on each chunk also stores weights over the
+//! model's vocabulary: the terms it contains, and related ones it doesn't, so
+//! a rare identifier or a misspelled one still finds its code without an
+//! exact lexical match. Searches gather them into an inverted index and fuse
+//! its scores with the dense ones. The sparse model runs locally, whatever
+//! the dense one is.
+
+use anyhow::Result;
+use cs_embed::SparseEmbedder;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::collections::hash_map::Entry;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{LazyLock, Mutex};
+
+use super::{ChunkEntry, atomic_write};
+
+pub const SPARSE_FILE: &str = "sparse.json";
+
+const FORMAT_VERSION: u32 = 1;
+
+/// Sparse models loaded by this process, by name; loading one is slow.
+static EMBEDDERS: LazyLock<Mutex<HashMap<String, Box<dyn SparseEmbedder>>>> =
+    LazyLock::new(|| Mutex::new(HashMap::new()));
+
+#[derive(Serialize, Deserialize)]
+struct SparseInfo {
+    format_version: u32,
+    model: String,
+}
+
+fn info_path(index_dir: &Path) -> PathBuf {
+    index_dir.join(SPARSE_FILE)
+}
+
+/// The sparse model of the index at `index_root`, if it stores sparse vectors.
+pub fn sparse_model(index_root: &Path) -> Option<String> {
+    let data = fs::read(info_path(&cs_core::locations::index_dir(index_root))).ok()?;
+    let info: SparseInfo = serde_json::from_slice(&data).ok()?;
+    Some(info.model)
+}
+
+/// Mark the index at `index_root` as storing sparse vectors from `model`.
+/// Files indexed before get theirs when they are indexed again.
+pub fn enable(index_root: &Path, model: &str) -> Result<()> {
+    super::bundle::ensure_writable(index_root)?;
+    let info = SparseInfo {
+        format_version: FORMAT_VERSION,
+        model: model.to_string(),
+    };
+    atomic_write(
+        &info_path(&cs_core::locations::index_dir(index_root)),
+        &serde_json::to_vec_pretty(&info)?,
+    )
+}
+
+/// Embed `texts` with the sparse `model`, loading it on first use.
+pub fn embed(model: &str, texts: &[String]) -> Result<Vec<cs_embed::SparseVector>> {
+    let mut embedders = EMBEDDERS.lock().unwrap_or_else(|e| e.into_inner());
+    let embedder = match embedders.entry(model.to_string()) {
+        Entry::Occupied(entry) => entry.into_mut(),
+        Entry::Vacant(entry) => entry.insert(cs_embed::create_sparse_embedder(Some(model))?),
+    };
+    let vectors = embedder.embed(texts)?;
+    if vectors.len() != texts.len() {
+        return Err(anyhow::anyhow!(
+            "Sparse model {} returned {} vectors for {} texts",
+            model,
+            vectors.len(),
+            texts.len()
+        ));
+    }
+    Ok(vectors)
+}
+
+/// Store a sparse vector on each chunk in one batch, when the index at
+/// `repo_root` has a sparse model.
+pub fn attach_sparse(
+    chunk_entries: &mut [ChunkEntry],
+    content: &str,
+    repo_root: &Path,
+) -> Result<()> {
+    let Some(model) = sparse_model(repo_root) else {
+        return Ok(());
+    };
+    let mut targets = Vec::new();
+    let mut texts = Vec::new();
+    for (i, chunk) in chunk_entries.iter().enumerate() {
+        if let Some(text) = content.get(chunk.span.byte_start..chunk.span.byte_end) {
+            targets.push(i);
+            texts.push(text.to_string());
+        }
+    }
+    if texts.is_empty() {
+        return Ok(());
+    }
+    for (i, vector) in targets.into_iter().zip(embed(&model, &texts)?) {
+        if !vector.is_empty() {
+            chunk_entries[i].sparse = Some(vector);
+        }
+    }
+    Ok(())
+}
@@ -0,0 +1,328 @@
+//! Issue tracker connectors for ticket collections:
+//! `cs --index --collection tickets --issues github:owner/repo` pulls every
+//! issue's title, body and comments through the tracker's API, one document
+//! per issue linking back to it, so a search for a flaky test turns up the
+//! issue discussing it next to the code.
+//!
+//! Supported trackers:
+//! - `github:owner/repo`, authenticated with `GITHUB_TOKEN` (or `GH_TOKEN`);
+//!   `GITHUB_API_URL` points at a GitHub Enterprise server
+//! - `jira:https://site.atlassian.net/PROJ`, authenticated with `JIRA_EMAIL`
+//!   and `JIRA_API_TOKEN` on Jira Cloud, or a personal access token in
+//!   `JIRA_TOKEN` on Jira Server
+
+use super::collections::Document;
+use anyhow::{Result, bail};
+use serde::Deserialize;
+use serde::de::DeserializeOwned;
+use std::collections::HashMap;
+
+const GITHUB_API: &str = "https://api.github.com";
+
+/// Results requested per page; the most either API returns.
+const PAGE_SIZE: usize = 100;
+
+#[derive(Debug, Clone, PartialEq)]
+enum Tracker {
+    GitHub { repo: String },
+    Jira { site: String, project: String },
+}
+
+fn parse_tracker(spec: &str) -> Result<Tracker> {
+    let spec = spec.trim().trim_end_matches('/');
+    if let Some(repo) = spec.strip_prefix("github:") {
+        if repo.split('/').filter(|part| !part.is_empty()).count() != 2 {
+            bail!("Expected github:OWNER/REPO, got '{}'", spec);
+        }
+        return Ok(Tracker::GitHub {
+            repo: repo.to_string(),
+        });
+    }
+    if let Some(url) = spec.strip_prefix("jira:") {
+        if let Some((site, project)) = url.rsplit_once('/')
+            && site.contains("://")
+            && !project.is_empty()
+        {
+            return Ok(Tracker::Jira {
+                site: site.to_string(),
+                project: project.to_string(),
+            });
+        }
+        bail!("Expected jira:https://SITE/PROJECT, got '{}'", spec);
+    }
+    bail!(
+        "Unsupported issue tracker '{}'. Use github:OWNER/REPO or jira:https://SITE/PROJECT.",
+        spec
+    )
+}
+
+/// Every issue of the tracker `spec` names, with its comments.
+pub async fn fetch_issues(spec: &str) -> Result<Vec<Document>> {
+    let client = cs_core::network::client_builder()?
+        .user_agent(concat!("cs/", env!("CARGO_PKG_VERSION")))
+        .build()?;
+    match parse_tracker(spec)? {
+        Tracker::GitHub { repo } => fetch_github(&client, &repo).await,
+        Tracker::Jira { site, project } => fetch_jira(&client, &site, &project).await,
+    }
+}
+
+async fn get<T: DeserializeOwned>(request: reqwest::RequestBuilder, what: &str) -> Result<T> {
+    let response = request.send().await?;
+    let status = response.status();
+    if !status.is_success() {
+        bail!(
+            "Fetching {} failed ({}). Check the tracker's token and permissions.",
+            what,
+            status
+        );
+    }
+    Ok(serde_json::from_slice(&response.bytes().await?)?)
+}
+
+/// The text indexed for an issue: its title, then its body, then each comment
+/// as its own paragraph.
+fn issue_text(title: &str, body: &str, comments: &[(String, String)]) -> String {
+    let mut text = title.trim().to_string();
+    let comments = comments
+        .iter()
+        .filter(|(_, comment)| !comment.trim().is_empty())
+        .map(|(author, comment)| format!("{}: {}", author, comment.trim()));
+    for paragraph in std::iter::once(body.trim().to_string()).chain(comments) {
+        if !paragraph.is_empty() {
+            text.push_str("\n\n");
+            text.push_str(&paragraph);
+        }
+    }
+    text
+}
+
+#[derive(Deserialize)]
+struct GitHubUser {
+    login: String,
+}
+
+#[derive(Deserialize)]
+struct GitHubIssue {
+    number: u64,
+    title: String,
+    body: Option<String>,
+    html_url: String,
+    /// Set on pull requests, which the issues API lists too
+    pull_request: Option<serde_json::Value>,
+}
+
+#[derive(Deserialize)]
+struct GitHubComment {
+    /// `.../repos/owner/repo/issues/42`
+    issue_url: String,
+    user: Option<GitHubUser>,
+    body: Option<String>,
+}
+
+fn github_request(client: &reqwest::Client, url: &str) -> reqwest::RequestBuilder {
+    let request = client
+        .get(url)
+        .header(reqwest::header::ACCEPT, "application/vnd.github+json");
+    match std::env::var("GITHUB_TOKEN").or_else(|_| std::env::var("GH_TOKEN")) {
+        Ok(token) => request.bearer_auth(token.trim()),
+        Err(_) => request,
+    }
+}
+
+/// Every page of a GitHub listing.
+async fn github_pages<T: DeserializeOwned>(
+    client: &reqwest::Client,
+    url: &str,
+    what: &str,
+) -> Result<Vec<T>> {
+    let mut items = Vec::new();
+    for page in 1.. {
+        let url = format!("{}&per_page={}&page={}", url, PAGE_SIZE, page);
+        let batch: Vec<T> = get(github_request(client, &url), what).await?;
+        let last = batch.len() < PAGE_SIZE;
+        items.extend(batch);
+        if last {
+            break;
+        }
+    }
+    Ok(items)
+}
+
+async fn fetch_github(client: &reqwest::Client, repo: &str) -> Result<Vec<Document>> {
+    let api = std::env::var("GITHUB_API_URL").unwrap_or_else(|_| GITHUB_API.to_string());
+    let base = format!("{}/repos/{}", api.trim_end_matches('/'), repo);
+    let what = format!("issues of {}", repo);
+    let issues: Vec<GitHubIssue> =
+        github_pages(client, &format!("{}/issues?state=all", base), &what).await?;
+    // One listing of the repository's comments beats a request per issue
+    let comments: Vec<GitHubComment> = github_pages(
+        client,
+        &format!("{}/issues/comments?sort=created", base),
+        &what,
+    )
+    .await?;
+
+    let mut by_issue: HashMap<u64, Vec<(String, String)>> = HashMap::new();
+    for comment in comments {
+        let Some(number) = comment
+            .issue_url
+            .rsplit('/')
+            .next()
+            .and_then(|n| n.parse().ok())
+        else {
+            continue;
+        };
+        let author = comment.user.map(|user| user.login).unwrap_or_default();
+        by_issue
+            .entry(number)
+            .or_default()
+            .push((author, comment.body.unwrap_or_default()));
+    }
+
+    Ok(issues
+        .into_iter()
+        .filter(|issue| issue.pull_request.is_none())
+        .map(|issue| Document {
+            source: format!("{}#{}", repo, issue.number),
+            text: issue_text(
+                &format!("#{} {}", issue.number, issue.title),
+                issue.body.as_deref().unwrap_or(""),
+                by_issue.get(&issue.number).map_or(&[], Vec::as_slice),
+            ),
+            url: Some(issue.html_url),
+        })
+        .collect())
+}
+
+#[derive(Deserialize)]
+struct JiraSearch {
+    #[serde(default)]
+    issues: Vec<JiraIssue>,
+    #[serde(default)]
+    total: usize,
+}
+
+#[derive(Deserialize)]
+struct JiraIssue {
+    key: String,
+    fields: JiraFields,
+}
+
+#[derive(Deserialize)]
+struct JiraFields {
+    #[serde(default)]
+    summary: String,
+    description: Option<String>,
+    comment: Option<JiraComments>,
+}
+
+#[derive(Deserialize)]
+struct JiraComments {
+    #[serde(default)]
+    comments: Vec<JiraComment>,
+}
+
+#[derive(Deserialize)]
+struct JiraComment {
+    author: Option<JiraUser>,
+    #[serde(default)]
+    body: String,
+}
+
+#[derive(Deserialize)]
+struct JiraUser {
+    #[serde(rename = "displayName")]
+    display_name: String,
+}
+
+fn jira_request(client: &reqwest::Client, url: &str) -> reqwest::RequestBuilder {
+    let request = client.get(url);
+    if let (Ok(email), Ok(token)) = (std::env::var("JIRA_EMAIL"), std::env::var("JIRA_API_TOKEN")) {
+        request.basic_auth(email.trim(), Some(token.trim()))
+    } else if let Ok(token) = std::env::var("JIRA_TOKEN") {
+        request.bearer_auth(token.trim())
+    } else {
+        request
+    }
+}
+
+async fn fetch_jira(client: &reqwest::Client, site: &str, project: &str) -> Result<Vec<Document>> {
+    let what = format!("issues of {} on {}", project, site);
+    let mut documents = Vec::new();
+    loop {
+        // The v2 API returns descriptions and comments as plain text
+        let url = format!(
+            "{}/rest/api/2/search?jql=project%3D%22{}%22%20ORDER%20BY%20key&fields=summary,description,comment&startAt={}&maxResults={}",
+            site,
+            project,
+            documents.len(),
+            PAGE_SIZE
+        );
+        let page: JiraSearch = get(jira_request(client, &url), &what).await?;
+        let last = page.issues.is_empty();
+        for issue in page.issues {
+            let comments: Vec<(String, String)> = issue
+                .fields
+                .comment
+                .map(|c| c.comments)
+                .unwrap_or_default()
+                .into_iter()
+                .map(|comment| {
+                    let author = comment.author.map(|a| a.display_name).unwrap_or_default();
+                    (author, comment.body)
+                })
+                .collect();
+            documents.push(Document {
+                text: issue_text(
+                    &format!("{} {}", issue.key, issue.fields.summary),
+                    issue.fields.description.as_deref().unwrap_or(""),
+                    &comments,
+                ),
+                url: Some(format!("{}/browse/{}", site, issue.key)),
+                source: issue.key,
+            });
+        }
+        if last || documents.len() >= page.total {
+            break;
+        }
+    }
+    Ok(documents)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn trackers_parse_from_specs() {
+        assert_eq!(
+            parse_tracker("github:acme/api").unwrap(),
+            Tracker::GitHub {
+                repo: "acme/api".to_string()
+            }
+        );
+        assert_eq!(
+            parse_tracker("jira:https://acme.atlassian.net/OPS/").unwrap(),
+            Tracker::Jira {
+                site: "https://acme.atlassian.net".to_string(),
+                project: "OPS".to_string()
+            }
+        );
+        assert!(parse_tracker("github:acme").is_err());
+        assert!(parse_tracker("jira:OPS").is_err());
+        assert!(parse_tracker("gitlab:acme/api").is_err());
+    }
+
+    #[test]
+    fn issues_read_as_paragraphs() {
+        let comments = vec![
+            ("dana".to_string(), "Fails on CI only.\n".to_string()),
+            ("lee".to_string(), String::new()),
+        ];
+        assert_eq!(
+            issue_text("#7 Flaky user deletion test", "  ", &comments),
+            "#7 Flaky user deletion test\n\ndana: Fails on CI only."
+        );
+    }
+}
@@ -0,0 +1,294 @@
+//! How indexing walks what a checkout links to or nests: symlinks, git
+//! submodules and linked worktrees, each with its own policy.
+//!
+//! - Symlinks are skipped unless [`SymlinkPolicy::Follow`]; followed, every
+//!   real file is indexed once, under its own path when the walk reaches it
+//!   there too, and a link back up the tree is a loop the walk stops at.
+//! - Submodules (a directory with a `.git` file pointing into the
+//!   superproject's `.git/modules/`, or with a `.git` directory of its own)
+//!   are part of the superproject's index unless [`SubmodulePolicy::Skip`].
+//!   Searching from inside one then finds the superproject as its
+//!   repository root, not the submodule's `.git` file.
+//! - A linked worktree (`git worktree add`) is its own repository root and
+//!   isn't walked into from an enclosing checkout, since it's another copy
+//!   of the same code, unless [`WorktreePolicy::Include`].
+
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::atomic::{AtomicU8, Ordering};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SymlinkPolicy {
+    #[default]
+    Skip,
+    /// Follow links to files and directories, inside the repository or not
+    Follow,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SubmodulePolicy {
+    /// Index submodules with the superproject
+    #[default]
+    Include,
+    /// Leave each submodule to an index of its own
+    Skip,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum WorktreePolicy {
+    /// A worktree is a repository root of its own
+    #[default]
+    Separate,
+    /// Index a worktree nested in a checkout with that checkout
+    Include,
+}
+
+impl FromStr for SymlinkPolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "skip" => Ok(Self::Skip),
+            "follow" => Ok(Self::Follow),
+            other => Err(format!(
+                "Unknown symlink policy '{}'; expected skip or follow",
+                other
+            )),
+        }
+    }
+}
+
+impl FromStr for SubmodulePolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "include" => Ok(Self::Include),
+            "skip" => Ok(Self::Skip),
+            other => Err(format!(
+                "Unknown submodule policy '{}'; expected include or skip",
+                other
+            )),
+        }
+    }
+}
+
+impl FromStr for WorktreePolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "separate" => Ok(Self::Separate),
+            "include" => Ok(Self::Include),
+            other => Err(format!(
+                "Unknown worktree policy '{}'; expected separate or include",
+                other
+            )),
+        }
+    }
+}
+
+static SYMLINKS: AtomicU8 = AtomicU8::new(0);
+static SUBMODULES: AtomicU8 = AtomicU8::new(0);
+static WORKTREES: AtomicU8 = AtomicU8::new(0);
+
+/// Set how symlinks are walked for the rest of the process.
+pub fn set_symlink_policy(policy: SymlinkPolicy) {
+    SYMLINKS.store(policy as u8, Ordering::SeqCst);
+}
+
+pub fn symlink_policy() -> SymlinkPolicy {
+    match SYMLINKS.load(Ordering::SeqCst) {
+        1 => SymlinkPolicy::Follow,
+        _ => SymlinkPolicy::Skip,
+    }
+}
+
+/// Set whether submodules are indexed for the rest of the process.
+pub fn set_submodule_policy(policy: SubmodulePolicy) {
+    SUBMODULES.store(policy as u8, Ordering::SeqCst);
+}
+
+pub fn submodule_policy() -> SubmodulePolicy {
+    match SUBMODULES.load(Ordering::SeqCst) {
+        1 => SubmodulePolicy::Skip,
+        _ => SubmodulePolicy::Include,
+    }
+}
+
+/// Set whether nested worktrees are indexed for the rest of the process.
+pub fn set_worktree_policy(policy: WorktreePolicy) {
+    WORKTREES.store(policy as u8, Ordering::SeqCst);
+}
+
+pub fn worktree_policy() -> WorktreePolicy {
+    match WORKTREES.load(Ordering::SeqCst) {
+        1 => WorktreePolicy::Include,
+        _ => WorktreePolicy::Separate,
+    }
+}
+
+/// What kind of git checkout a directory is the top of.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Checkout {
+    /// A `.git` directory: a repository, or a submodule nested the old way
+    Repository,
+    /// A `.git` file pointing into a superproject's `.git/modules/`
+    Submodule,
+    /// A `.git` file pointing into a repository's `.git/worktrees/`
+    Worktree,
+}
+
+/// The checkout `dir` is the top of, if any.
+pub fn checkout_at(dir: &Path) -> Option<Checkout> {
+    let git = dir.join(".git");
+    let metadata = fs::metadata(&git).ok()?;
+    if metadata.is_dir() {
+        return Some(Checkout::Repository);
+    }
+    let content = fs::read_to_string(&git).ok()?;
+    let gitdir = content.strip_prefix("gitdir:")?.trim();
+    let is_worktree = Path::new(gitdir)
+        .parent()
+        .and_then(Path::file_name)
+        .is_some_and(|name| name == "worktrees");
+    Some(if is_worktree {
+        Checkout::Worktree
+    } else {
+        Checkout::Submodule
+    })
+}
+
+/// Whether a checkout nested in another is indexed with the enclosing one,
+/// by the current policies.
+pub fn part_of_enclosing(checkout: Checkout) -> bool {
+    match checkout {
+        Checkout::Repository | Checkout::Submodule => {
+            submodule_policy() == SubmodulePolicy::Include
+        }
+        Checkout::Worktree => worktree_policy() == WorktreePolicy::Include,
+    }
+}
+
+/// Whether a walk of an enclosing checkout descends into `dir`, which is
+/// below where the walk started.
+pub fn descends_into(dir: &Path) -> bool {
+    checkout_at(dir).is_none_or(part_of_enclosing)
+}
+
+/// `files` walked from `root` with symlinks followed, keeping one path per
+/// real file: its own path if the walk reached it there, otherwise the
+/// first path it was reached by.
+pub fn dedupe_linked(root: &Path, files: Vec<PathBuf>) -> Vec<PathBuf> {
+    let real_root = cs_core::paths::canonicalize_lossy(root);
+    let mut chosen: HashMap<PathBuf, usize> = HashMap::new();
+    let mut kept: Vec<Option<PathBuf>> = Vec::with_capacity(files.len());
+    for file in files {
+        let Ok(real) = cs_core::paths::canonicalize(&file) else {
+            continue;
+        };
+        let is_own_path = file
+            .strip_prefix(root)
+            .is_ok_and(|relative| real_root.join(relative) == real);
+        match chosen.get(&real) {
+            Some(&index) if is_own_path => {
+                kept[index] = None;
+                chosen.insert(real, kept.len());
+                kept.push(Some(file));
+            }
+            Some(_) => {}
+            None => {
+                chosen.insert(real, kept.len());
+                kept.push(Some(file));
+            }
+        }
+    }
+    kept.into_iter().flatten().collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn checkout(root: &Path, relative: &str, git: Option<&str>) -> PathBuf {
+        let dir = root.join(relative);
+        fs::create_dir_all(&dir).unwrap();
+        match git {
+            Some(gitdir) => fs::write(dir.join(".git"), format!("gitdir: {}\n", gitdir)).unwrap(),
+            None => fs::create_dir_all(dir.join(".git")).unwrap(),
+        }
+        dir
+    }
+
+    #[test]
+    fn checkouts_are_told_apart_by_their_git_entry() {
+        let repo = TempDir::new().unwrap();
+        let root = checkout(repo.path(), "app", None);
+        let submodule = checkout(&root, "vendor/lib", Some("../../.git/modules/vendor/lib"));
+        let worktree = checkout(
+            &root,
+            ".worktrees/feature",
+            Some("/src/app/.git/worktrees/feature"),
+        );
+
+        assert_eq!(checkout_at(&root), Some(Checkout::Repository));
+        assert_eq!(checkout_at(&submodule), Some(Checkout::Submodule));
+        assert_eq!(checkout_at(&worktree), Some(Checkout::Worktree));
+        assert_eq!(checkout_at(&root.join("vendor")), None);
+
+        // By default submodules are walked and worktrees aren't
+        assert!(descends_into(&submodule));
+        assert!(!descends_into(&worktree));
+        assert!(descends_into(&root.join("vendor")));
+
+        // A submodule's files belong to the superproject, a worktree's don't
+        fs::create_dir_all(submodule.join("src")).unwrap();
+        let real = |path: &Path| cs_core::paths::canonicalize_lossy(path);
+        assert_eq!(
+            real(&crate::find_repo_root(&submodule.join("src")).unwrap()),
+            real(&root)
+        );
+        assert_eq!(
+            real(&crate::find_repo_root(&worktree).unwrap()),
+            real(&worktree)
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn linked_files_are_kept_once_under_their_own_path() {
+        let repo = TempDir::new().unwrap();
+        let root = repo.path();
+        fs::create_dir_all(root.join("src/docs")).unwrap();
+        fs::write(root.join("src/docs/guide.md"), "# Guide\n").unwrap();
+        std::os::unix::fs::symlink(root.join("src/docs"), root.join("docs")).unwrap();
+        std::os::unix::fs::symlink("guide.md", root.join("src/docs/readme.md")).unwrap();
+
+        // The walk reached the file through the link first
+        let walked = vec![
+            root.join("docs/guide.md"),
+            root.join("docs/readme.md"),
+            root.join("src/docs/guide.md"),
+            root.join("src/docs/readme.md"),
+        ];
+        assert_eq!(
+            dedupe_linked(root, walked),
+            [root.join("src/docs/guide.md")]
+        );
+
+        let outside = TempDir::new().unwrap();
+        fs::write(outside.path().join("shared.rs"), "fn shared() {}\n").unwrap();
+        std::os::unix::fs::symlink(outside.path(), root.join("shared")).unwrap();
+        assert_eq!(
+            dedupe_linked(root, vec![root.join("shared/shared.rs")]),
+            [root.join("shared/shared.rs")]
+        );
+    }
+}
@@ -4,7 +4,9 @@ use std::collections::HashMap;
 use std::path::Path;
 
 mod user_config;
-pub use user_config::UserConfig;
+pub use user_config::{
+    ConfigOrigin, LayeredConfig, PROJECT_CONFIG_FILE, SYSTEM_CONFIG_ENV, UserConfig,
+};
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct ModelConfig {
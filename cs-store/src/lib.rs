@@ -0,0 +1,352 @@
+//! External vector store backends.
+//!
+//! The local `.cs/` sidecar index stays the source of truth for indexing and
+//! chunking; a store receives a copy of its chunks and embeddings so many
+//! machines and repositories can query one centralized index.
+//!
+//! Backends implement [`VectorStore`]; [`connect`] picks one from the URL scheme.
+
+use anyhow::Result;
+use cs_core::Span;
+use std::fs;
+use std::future::Future;
+use std::path::{Path, PathBuf};
+
+#[cfg(any(feature = "qdrant", feature = "milvus"))]
+mod http;
+#[cfg(feature = "milvus")]
+pub mod milvus;
+#[cfg(feature = "pgvector")]
+pub mod pgvector;
+#[cfg(feature = "qdrant")]
+pub mod qdrant;
+
+/// A vector database that can hold the chunks and embeddings of many repositories.
+pub trait VectorStore: Send + Sync {
+    /// Embedding model recorded for `repo`, or `None` if the repo was never pushed.
+    fn repo_model(&self, repo: &str) -> impl Future<Output = Result<Option<RepoModel>>> + Send;
+
+    /// Make the store's copy of `repo` match `files`: upload changed files,
+    /// skip unchanged ones, and delete files that are gone.
+    fn sync_repo(
+        &self,
+        repo: &str,
+        model: &RepoModel,
+        files: &[StoredFile],
+    ) -> impl Future<Output = Result<StoreSyncStats>> + Send;
+
+    /// Cosine nearest neighbours of `query` across `repos`.
+    fn search(
+        &self,
+        query: &[f32],
+        model: &RepoModel,
+        repos: &[String],
+        limit: usize,
+    ) -> impl Future<Output = Result<Vec<StoreHit>>> + Send;
+}
+
+/// A connected backend, selected by [`connect`].
+pub enum Store {
+    #[cfg(feature = "pgvector")]
+    PgVector(pgvector::PgVectorStore),
+    #[cfg(feature = "qdrant")]
+    Qdrant(qdrant::QdrantStore),
+    #[cfg(feature = "milvus")]
+    Milvus(milvus::MilvusStore),
+}
+
+impl VectorStore for Store {
+    async fn repo_model(&self, repo: &str) -> Result<Option<RepoModel>> {
+        match self {
+            #[cfg(feature = "pgvector")]
+            Store::PgVector(store) => store.repo_model(repo).await,
+            #[cfg(feature = "qdrant")]
+            Store::Qdrant(store) => store.repo_model(repo).await,
+            #[cfg(feature = "milvus")]
+            Store::Milvus(store) => store.repo_model(repo).await,
+        }
+    }
+
+    async fn sync_repo(
+        &self,
+        repo: &str,
+        model: &RepoModel,
+        files: &[StoredFile],
+    ) -> Result<StoreSyncStats> {
+        match self {
+            #[cfg(feature = "pgvector")]
+            Store::PgVector(store) => store.sync_repo(repo, model, files).await,
+            #[cfg(feature = "qdrant")]
+            Store::Qdrant(store) => store.sync_repo(repo, model, files).await,
+            #[cfg(feature = "milvus")]
+            Store::Milvus(store) => store.sync_repo(repo, model, files).await,
+        }
+    }
+
+    async fn search(
+        &self,
+        query: &[f32],
+        model: &RepoModel,
+        repos: &[String],
+        limit: usize,
+    ) -> Result<Vec<StoreHit>> {
+        match self {
+            #[cfg(feature = "pgvector")]
+            Store::PgVector(store) => store.search(query, model, repos, limit).await,
+            #[cfg(feature = "qdrant")]
+            Store::Qdrant(store) => store.search(query, model, repos, limit).await,
+            #[cfg(feature = "milvus")]
+            Store::Milvus(store) => store.search(query, model, repos, limit).await,
+        }
+    }
+}
+
+/// A chunk as written to an external store.
+#[derive(Debug, Clone)]
+pub struct StoredChunk {
+    pub span: Span,
+    pub chunk_type: Option<String>,
+    pub breadcrumb: Option<String>,
+    pub content: String,
+    pub embedding: Vec<f32>,
+}
+
+/// All chunks of one source file. `path` is the manifest key without "./".
+#[derive(Debug, Clone)]
+pub struct StoredFile {
+    pub path: String,
+    pub hash: String,
+    pub chunks: Vec<StoredChunk>,
+}
+
+/// A nearest-neighbour hit returned by a store.
+#[derive(Debug, Clone)]
+pub struct StoreHit {
+    pub repo: String,
+    pub path: PathBuf,
+    pub span: Span,
+    pub score: f32,
+    pub content: String,
+}
+
+#[derive(Debug, Default, Clone)]
+pub struct StoreSyncStats {
+    pub files_uploaded: usize,
+    pub files_unchanged: usize,
+    pub files_removed: usize,
+    pub chunks_uploaded: usize,
+}
+
+/// Embedding model recorded for a repository in a store.
+#[derive(Debug, Clone, PartialEq)]
+pub struct RepoModel {
+    pub embedding_model: String,
+    pub embedding_dimensions: usize,
+}
+
+/// Connect to the store named by `url`:
+///
+/// - `postgres://` / `postgresql://` — PostgreSQL with pgvector
+/// - `qdrant://host:6333` (`qdrant+https://` for TLS) — Qdrant REST API
+/// - `milvus://host:19530` (`milvus+https://` for TLS) — Milvus REST API v2
+///
+/// Qdrant and Milvus send `CS_STORE_API_KEY` as their API key / token when set.
+pub async fn connect(url: &str) -> Result<Store> {
+    #[cfg(feature = "pgvector")]
+    if url.starts_with("postgres://") || url.starts_with("postgresql://") {
+        return Ok(Store::PgVector(
+            pgvector::PgVectorStore::connect(url).await?,
+        ));
+    }
+    #[cfg(feature = "qdrant")]
+    if let Some(base) = http::base_url(url, "qdrant") {
+        return Ok(Store::Qdrant(qdrant::QdrantStore::connect(&base).await?));
+    }
+    #[cfg(feature = "milvus")]
+    if let Some(base) = http::base_url(url, "milvus") {
+        return Ok(Store::Milvus(milvus::MilvusStore::connect(&base).await?));
+    }
+    Err(anyhow::anyhow!(
+        "Unsupported or disabled vector store '{}'. Use a postgres://, qdrant:// or milvus:// URL.",
+        url
+    ))
+}
+
+/// Collection name for `repo` in stores that keep one collection per repository.
+///
+/// Qdrant and Milvus both accept `[A-Za-z0-9_]` names starting with a letter or underscore.
+/// Names that had to be changed get a hash of the original, so `org/a` and
+/// `org_a` don't share a collection.
+pub fn collection_name(repo: &str) -> String {
+    let sanitized: String = repo
+        .chars()
+        .map(|c| if c.is_ascii_alphanumeric() { c } else { '_' })
+        .collect();
+    if sanitized == repo {
+        format!("cs_{}", sanitized)
+    } else {
+        format!("cs_{}_{:08x}", sanitized, fnv1a(repo.bytes()) as u32)
+    }
+}
+
+/// Stable 63-bit id for a chunk, usable as a Qdrant point id or Milvus Int64 key.
+pub fn chunk_id(path: &str, chunk_index: usize) -> u64 {
+    fnv1a(path.bytes().chain(chunk_index.to_le_bytes())) & (i64::MAX as u64)
+}
+
+/// FNV-1a: unlike `DefaultHasher`, stable across Rust releases.
+fn fnv1a(bytes: impl IntoIterator<Item = u8>) -> u64 {
+    let mut hash: u64 = 0xcbf29ce484222325;
+    for byte in bytes {
+        hash ^= byte as u64;
+        hash = hash.wrapping_mul(0x100000001b3);
+    }
+    hash
+}
+
+/// Refuse to mix embedding models within one stored repository.
+pub(crate) fn check_repo_model(repo: &str, existing: &RepoModel, model: &RepoModel) -> Result<()> {
+    if existing == model {
+        return Ok(());
+    }
+    Err(anyhow::anyhow!(
+        "Repository '{}' in the store was indexed with '{}' ({} dims), but the local index uses '{}' ({} dims). \
+        Re-index locally with '--switch-model' to match, or push under a different --store-repo name.",
+        repo,
+        existing.embedding_model,
+        existing.embedding_dimensions,
+        model.embedding_model,
+        model.embedding_dimensions
+    ))
+}
+
+/// Repository name used when none is given: the index root's directory name.
+pub fn default_repo_name(repo_root: &Path) -> String {
+    cs_core::paths::canonicalize(repo_root)
+        .ok()
+        .and_then(|p| p.file_name().map(|n| n.to_string_lossy().to_string()))
+        .unwrap_or_else(|| "default".to_string())
+}
+
+/// The local index's embedding model plus every file that has embedded chunks.
+pub struct LocalIndex {
+    pub model: RepoModel,
+    pub files: Vec<StoredFile>,
+}
+
+/// Read the local index at `repo_root` into store-ready records.
+///
+/// Chunk text is read from the working tree (or the PDF text cache), so the
+/// store can serve previews without a checkout.
+pub fn read_local_index(repo_root: &Path) -> Result<LocalIndex> {
+    let manifest = match cs_index::load_manifest(repo_root)? {
+        Some(manifest) => manifest,
+        None if cs_index::shards::is_sharded(repo_root) => {
+            cs_index::shards::combined_manifest(repo_root)?
+        }
+        None => {
+            return Err(anyhow::anyhow!(
+                "No index found at {}. Run 'cs --index' first.",
+                repo_root.display()
+            ));
+        }
+    };
+    cs_index::validate_manifest_model(&manifest)?;
+
+    let (Some(embedding_model), Some(embedding_dimensions)) = (
+        manifest.embedding_model.clone(),
+        manifest.embedding_dimensions,
+    ) else {
+        return Err(anyhow::anyhow!(
+            "The index at {} has no embeddings. Run 'cs --index' to compute them before syncing to a store.",
+            repo_root.display()
+        ));
+    };
+
+    let mut files = Vec::new();
+
+    for (manifest_key, metadata) in &manifest.files {
+        let sidecar = cs_index::shards::sidecar_path(repo_root, manifest_key);
+        let Ok(entry) = cs_index::load_index_entry(&sidecar) else {
+            continue;
+        };
+
+        let source = repo_root.join(manifest_key);
+        let content_path = if cs_core::pdf::is_pdf_file(&source) {
+            cs_core::pdf::get_content_cache_path(repo_root, &source)
+        } else {
+            source
+        };
+        let Ok(bytes) = fs::read(&content_path) else {
+            continue;
+        };
+
+        let chunks: Vec<StoredChunk> = entry
+            .chunks
+            .into_iter()
+            .filter_map(|chunk| {
+                let embedding = chunk.embedding?;
+                let end = chunk.span.byte_end.min(bytes.len());
+                let start = chunk.span.byte_start.min(end);
+                Some(StoredChunk {
+                    content: String::from_utf8_lossy(&bytes[start..end]).into_owned(),
+                    span: chunk.span,
+                    chunk_type: chunk.chunk_type,
+                    breadcrumb: chunk.breadcrumb,
+                    embedding,
+                })
+            })
+            .collect();
+
+        if chunks.is_empty() {
+            continue;
+        }
+
+        files.push(StoredFile {
+            path: cs_core::paths::to_relative_slash(manifest_key),
+            hash: metadata.hash.clone(),
+            chunks,
+        });
+    }
+
+    Ok(LocalIndex {
+        model: RepoModel {
+            embedding_model,
+            embedding_dimensions,
+        },
+        files,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn default_repo_name_uses_directory_name() {
+        let temp_dir = TempDir::new().unwrap();
+        let repo = temp_dir.path().join("billing-service");
+        fs::create_dir_all(&repo).unwrap();
+        assert_eq!(default_repo_name(&repo), "billing-service");
+    }
+
+    #[test]
+    fn collection_names_and_chunk_ids_are_stable() {
+        assert_eq!(collection_name("billing_service"), "cs_billing_service");
+        assert!(collection_name("org/billing-service").starts_with("cs_org_billing_service_"));
+        // Names that sanitize alike still get collections of their own
+        assert_ne!(collection_name("org/a"), collection_name("org_a"));
+        assert_ne!(collection_name("org/a"), collection_name("org-a"));
+        assert_eq!(collection_name("org/a"), collection_name("org/a"));
+        assert_eq!(chunk_id("src/a.rs", 0), chunk_id("src/a.rs", 0));
+        assert_ne!(chunk_id("src/a.rs", 0), chunk_id("src/a.rs", 1));
+        assert!(chunk_id("src/b.rs", 3) <= i64::MAX as u64);
+    }
+
+    #[test]
+    fn read_local_index_requires_an_index() {
+        let temp_dir = TempDir::new().unwrap();
+        assert!(read_local_index(temp_dir.path()).is_err());
+    }
+}
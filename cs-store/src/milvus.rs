@@ -0,0 +1,293 @@
+//! Milvus backend over the REST API (v2).
+//!
+//! Each repository is one quick-setup collection (see [`collection_name`]):
+//! an Int64 `id`, a cosine `vector` field, and chunk metadata stored as
+//! dynamic fields.
+
+use super::http::{self, HIT_FIELDS};
+use super::{
+    RepoModel, StoreHit, StoreSyncStats, StoredFile, VectorStore, check_repo_model, chunk_id,
+    collection_name,
+};
+use anyhow::{Result, bail};
+use reqwest::Method;
+use serde_json::{Value, json};
+use std::collections::{HashMap, HashSet};
+
+const UPSERT_BATCH: usize = 256;
+const QUERY_PAGE: usize = 1000;
+/// Milvus caps `offset + limit` for a single query.
+const QUERY_WINDOW: usize = 16384;
+
+pub struct MilvusStore {
+    client: reqwest::Client,
+    base_url: String,
+}
+
+impl MilvusStore {
+    /// Connect to the Milvus REST API at `base_url` (e.g. `http://localhost:19530`).
+    /// `CS_STORE_API_KEY` is sent as the token (`user:password` or a Zilliz API key).
+    pub async fn connect(base_url: &str) -> Result<Self> {
+        let store = Self {
+            client: http::build_client(reqwest::header::AUTHORIZATION)?,
+            base_url: base_url.to_string(),
+        };
+        // Fail early on a wrong URL or token rather than mid-sync
+        store
+            .call("/v2/vectordb/collections/list", json!({}))
+            .await?;
+        Ok(store)
+    }
+
+    /// POST to a v2 endpoint and return `data`; Milvus reports errors in the body.
+    async fn call(&self, endpoint: &str, body: Value) -> Result<Value> {
+        let url = format!("{}{}", self.base_url, endpoint);
+        let response = http::send(&self.client, Method::POST, &url, Some(&body))
+            .await?
+            .ok_or_else(|| anyhow::anyhow!("No Milvus REST API found at {}", self.base_url))?;
+
+        let code = response["code"].as_i64().unwrap_or(0);
+        if code != 0 {
+            bail!(
+                "Milvus request to {} failed ({}): {}",
+                endpoint,
+                code,
+                response["message"].as_str().unwrap_or("unknown error")
+            );
+        }
+        Ok(response["data"].clone())
+    }
+
+    async fn has_collection(&self, collection: &str) -> Result<bool> {
+        let data = self
+            .call(
+                "/v2/vectordb/collections/has",
+                json!({ "collectionName": collection }),
+            )
+            .await?;
+        Ok(data["has"].as_bool().unwrap_or(false))
+    }
+
+    async fn ensure_collection(&self, collection: &str, model: &RepoModel) -> Result<()> {
+        if self.has_collection(collection).await? {
+            return Ok(());
+        }
+        self.call(
+            "/v2/vectordb/collections/create",
+            json!({
+                "collectionName": collection,
+                "dimension": model.embedding_dimensions,
+                "metricType": "COSINE",
+                "idType": "Int64",
+                "autoId": false,
+                "primaryFieldName": "id",
+                "vectorFieldName": "vector",
+            }),
+        )
+        .await?;
+        Ok(())
+    }
+
+    /// `path -> hash` for every file in `collection`. One query can't page
+    /// past [`QUERY_WINDOW`] rows, so id ranges holding more files than that
+    /// are split in half until each fits.
+    async fn stored_files(&self, collection: &str) -> Result<HashMap<String, String>> {
+        let mut files = HashMap::new();
+        let mut ranges = vec![(0, i64::MAX as u64)];
+        while let Some((low, high)) = ranges.pop() {
+            match self.files_in_range(collection, low, high).await? {
+                Some(found) => files.extend(found),
+                None => {
+                    let middle = low + (high - low) / 2;
+                    ranges.push((low, middle));
+                    ranges.push((middle + 1, high));
+                }
+            }
+        }
+        Ok(files)
+    }
+
+    /// `path -> hash` for the files whose first chunk's id is in
+    /// `low..=high`, or `None` if there are more than a query pages through.
+    async fn files_in_range(
+        &self,
+        collection: &str,
+        low: u64,
+        high: u64,
+    ) -> Result<Option<HashMap<String, String>>> {
+        let mut files = HashMap::new();
+        let mut offset = 0;
+        while offset < QUERY_WINDOW {
+            let limit = QUERY_PAGE.min(QUERY_WINDOW - offset);
+            let rows = self
+                .call(
+                    "/v2/vectordb/entities/query",
+                    json!({
+                        "collectionName": collection,
+                        "filter": format!("chunk_index == 0 && id >= {} && id <= {}", low, high),
+                        "outputFields": ["path", "hash"],
+                        "offset": offset,
+                        "limit": limit,
+                    }),
+                )
+                .await?;
+            let rows = rows.as_array().cloned().unwrap_or_default();
+            for row in &rows {
+                if let (Some(path), Some(hash)) = (row["path"].as_str(), row["hash"].as_str()) {
+                    files.insert(path.to_string(), hash.to_string());
+                }
+            }
+            if rows.len() < limit {
+                return Ok(Some(files));
+            }
+            offset += rows.len();
+        }
+        // A single id is a single file, so a range this narrow can't be split
+        Ok((low == high).then_some(files))
+    }
+
+    async fn delete_paths(&self, collection: &str, paths: &[String]) -> Result<()> {
+        self.call(
+            "/v2/vectordb/entities/delete",
+            json!({
+                "collectionName": collection,
+                "filter": format!("path in {}", serde_json::to_string(paths)?),
+            }),
+        )
+        .await?;
+        Ok(())
+    }
+}
+
+impl VectorStore for MilvusStore {
+    async fn repo_model(&self, repo: &str) -> Result<Option<RepoModel>> {
+        let collection = collection_name(repo);
+        if !self.has_collection(&collection).await? {
+            return Ok(None);
+        }
+        let rows = self
+            .call(
+                "/v2/vectordb/entities/query",
+                json!({
+                    "collectionName": collection,
+                    "filter": "chunk_index == 0",
+                    "outputFields": ["model", "dims"],
+                    "limit": 1,
+                }),
+            )
+            .await?;
+        Ok(rows.get(0).and_then(http::model_from_fields))
+    }
+
+    async fn sync_repo(
+        &self,
+        repo: &str,
+        model: &RepoModel,
+        files: &[StoredFile],
+    ) -> Result<StoreSyncStats> {
+        if let Some(existing) = self.repo_model(repo).await? {
+            check_repo_model(repo, &existing, model)?;
+        }
+        let collection = collection_name(repo);
+        self.ensure_collection(&collection, model).await?;
+
+        let mut stats = StoreSyncStats::default();
+        let stored = self.stored_files(&collection).await?;
+
+        for file in files {
+            if stored.get(&file.path) == Some(&file.hash) {
+                stats.files_unchanged += 1;
+                continue;
+            }
+
+            // Replace the file's chunks wholesale; the chunk count may have changed
+            self.delete_paths(&collection, std::slice::from_ref(&file.path))
+                .await?;
+
+            let rows: Vec<Value> = file
+                .chunks
+                .iter()
+                .enumerate()
+                .map(|(index, chunk)| {
+                    let mut row = http::chunk_fields(&file.path, &file.hash, index, chunk, model);
+                    row["id"] = json!(chunk_id(&file.path, index));
+                    row["vector"] = json!(chunk.embedding);
+                    row
+                })
+                .collect();
+            for batch in rows.chunks(UPSERT_BATCH) {
+                self.call(
+                    "/v2/vectordb/entities/upsert",
+                    json!({ "collectionName": collection, "data": batch }),
+                )
+                .await?;
+            }
+
+            stats.files_uploaded += 1;
+            stats.chunks_uploaded += file.chunks.len();
+        }
+
+        let current: HashSet<&str> = files.iter().map(|f| f.path.as_str()).collect();
+        let removed: Vec<String> = stored
+            .keys()
+            .filter(|path| !current.contains(path.as_str()))
+            .cloned()
+            .collect();
+        if !removed.is_empty() {
+            self.delete_paths(&collection, &removed).await?;
+            stats.files_removed = removed.len();
+        }
+
+        Ok(stats)
+    }
+
+    async fn search(
+        &self,
+        query: &[f32],
+        model: &RepoModel,
+        repos: &[String],
+        limit: usize,
+    ) -> Result<Vec<StoreHit>> {
+        if repos.is_empty() {
+            bail!("Milvus searches need at least one --store-repo");
+        }
+        if query.len() != model.embedding_dimensions {
+            bail!(
+                "Query embedding has {} dims but the store's '{}' vectors have {}.",
+                query.len(),
+                model.embedding_model,
+                model.embedding_dimensions
+            );
+        }
+
+        let mut hits = Vec::new();
+        for repo in repos {
+            let collection = collection_name(repo);
+            if !self.has_collection(&collection).await? {
+                continue;
+            }
+            let rows = self
+                .call(
+                    "/v2/vectordb/entities/search",
+                    json!({
+                        "collectionName": collection,
+                        "data": [query],
+                        "annsField": "vector",
+                        "limit": limit,
+                        "outputFields": HIT_FIELDS,
+                    }),
+                )
+                .await?;
+
+            // With the COSINE metric, `distance` is the similarity (higher is closer)
+            for row in rows.as_array().into_iter().flatten() {
+                let score = row["distance"].as_f64().unwrap_or(0.0) as f32;
+                if let Some(hit) = http::hit_from_fields(repo, score, row) {
+                    hits.push(hit);
+                }
+            }
+        }
+
+        Ok(http::merge_hits(hits, limit))
+    }
+}
@@ -0,0 +1,337 @@
+//! PostgreSQL + pgvector backend.
+//!
+//! One database can hold many repositories (`cs_repos`), so access can be
+//! managed with ordinary SQL grants or row-level security on `repo_id`.
+//! Similarity uses per-dimension HNSW expression indexes, which lets repos
+//! indexed with different models share the `cs_chunks` table.
+
+use super::{RepoModel, StoreHit, StoreSyncStats, StoredFile, VectorStore};
+use anyhow::{Result, bail};
+use cs_core::Span;
+use deadpool_postgres::{Config, ManagerConfig, Pool, PoolConfig, RecyclingMethod, Runtime};
+use pgvector::Vector;
+use std::collections::{HashMap, HashSet};
+use std::path::PathBuf;
+
+const DEFAULT_POOL_SIZE: usize = 8;
+
+/// Ordered schema migrations; each runs once inside a transaction.
+const MIGRATIONS: &[(i32, &str)] = &[(
+    1,
+    r#"
+    CREATE EXTENSION IF NOT EXISTS vector;
+
+    CREATE TABLE IF NOT EXISTS cs_repos (
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL UNIQUE,
+        embedding_model TEXT NOT NULL,
+        embedding_dimensions INTEGER NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+
+    CREATE TABLE IF NOT EXISTS cs_files (
+        repo_id INTEGER NOT NULL REFERENCES cs_repos(id) ON DELETE CASCADE,
+        path TEXT NOT NULL,
+        hash TEXT NOT NULL,
+        PRIMARY KEY (repo_id, path)
+    );
+
+    CREATE TABLE IF NOT EXISTS cs_chunks (
+        id BIGSERIAL PRIMARY KEY,
+        repo_id INTEGER NOT NULL,
+        path TEXT NOT NULL,
+        byte_start BIGINT NOT NULL,
+        byte_end BIGINT NOT NULL,
+        line_start BIGINT NOT NULL,
+        line_end BIGINT NOT NULL,
+        chunk_type TEXT,
+        breadcrumb TEXT,
+        content TEXT NOT NULL,
+        dims INTEGER NOT NULL,
+        embedding vector NOT NULL,
+        FOREIGN KEY (repo_id, path) REFERENCES cs_files(repo_id, path) ON DELETE CASCADE
+    );
+
+    CREATE INDEX IF NOT EXISTS cs_chunks_repo_path ON cs_chunks (repo_id, path);
+    "#,
+)];
+
+pub struct PgVectorStore {
+    pool: Pool,
+}
+
+impl PgVectorStore {
+    /// Connect with a pooled client and apply pending migrations.
+    ///
+    /// TLS is negotiated according to the URL's `sslmode` (default `prefer`).
+    /// Pool size comes from `CS_STORE_POOL_SIZE` (default 8).
+    pub async fn connect(url: &str) -> Result<Self> {
+        let pool_size = std::env::var("CS_STORE_POOL_SIZE")
+            .ok()
+            .and_then(|v| v.parse().ok())
+            .unwrap_or(DEFAULT_POOL_SIZE);
+
+        let mut config = Config::new();
+        config.url = Some(url.to_string());
+        config.manager = Some(ManagerConfig {
+            recycling_method: RecyclingMethod::Fast,
+        });
+        config.pool = Some(PoolConfig::new(pool_size));
+
+        let tls = postgres_native_tls::MakeTlsConnector::new(native_tls::TlsConnector::new()?);
+        let pool = config.create_pool(Some(Runtime::Tokio1), tls)?;
+
+        let store = Self { pool };
+        store.migrate().await?;
+        Ok(store)
+    }
+
+    async fn migrate(&self) -> Result<()> {
+        let mut client = self.pool.get().await?;
+        client
+            .batch_execute(
+                "CREATE TABLE IF NOT EXISTS cs_schema_migrations (
+                    version INTEGER PRIMARY KEY,
+                    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+                )",
+            )
+            .await?;
+
+        let applied: HashSet<i32> = client
+            .query("SELECT version FROM cs_schema_migrations", &[])
+            .await?
+            .iter()
+            .map(|row| row.get(0))
+            .collect();
+
+        for (version, sql) in MIGRATIONS {
+            if applied.contains(version) {
+                continue;
+            }
+            let tx = client.transaction().await?;
+            tx.batch_execute(sql).await?;
+            tx.execute(
+                "INSERT INTO cs_schema_migrations (version) VALUES ($1)",
+                &[version],
+            )
+            .await?;
+            tx.commit().await?;
+            tracing::info!("Applied pgvector schema migration {}", version);
+        }
+        Ok(())
+    }
+
+    /// Register `repo` (or verify its model) and return its id.
+    async fn ensure_repo(&self, repo: &str, model: &RepoModel) -> Result<i32> {
+        if let Some(existing) = self.repo_model(repo).await? {
+            super::check_repo_model(repo, &existing, model)?;
+        }
+
+        let dims = model.embedding_dimensions as i32;
+        let client = self.pool.get().await?;
+        let row = client
+            .query_one(
+                "INSERT INTO cs_repos (name, embedding_model, embedding_dimensions)
+                 VALUES ($1, $2, $3)
+                 ON CONFLICT (name) DO UPDATE SET updated_at = now()
+                 RETURNING id",
+                &[&repo, &model.embedding_model, &dims],
+            )
+            .await?;
+
+        // Dimension is baked into the index expression, so one index per dimension
+        client
+            .batch_execute(&format!(
+                "CREATE INDEX IF NOT EXISTS cs_chunks_hnsw_{dims} ON cs_chunks \
+                 USING hnsw ((embedding::vector({dims})) vector_cosine_ops) WHERE dims = {dims}"
+            ))
+            .await?;
+
+        Ok(row.get(0))
+    }
+}
+
+impl VectorStore for PgVectorStore {
+    async fn repo_model(&self, repo: &str) -> Result<Option<RepoModel>> {
+        let client = self.pool.get().await?;
+        let row = client
+            .query_opt(
+                "SELECT embedding_model, embedding_dimensions FROM cs_repos WHERE name = $1",
+                &[&repo],
+            )
+            .await?;
+        Ok(row.map(|row| RepoModel {
+            embedding_model: row.get(0),
+            embedding_dimensions: row.get::<_, i32>(1) as usize,
+        }))
+    }
+
+    async fn sync_repo(
+        &self,
+        repo: &str,
+        model: &RepoModel,
+        files: &[StoredFile],
+    ) -> Result<StoreSyncStats> {
+        let repo_id = self.ensure_repo(repo, model).await?;
+        let mut stats = StoreSyncStats::default();
+        let dims = model.embedding_dimensions as i32;
+
+        let mut client = self.pool.get().await?;
+        let stored: HashMap<String, String> = client
+            .query(
+                "SELECT path, hash FROM cs_files WHERE repo_id = $1",
+                &[&repo_id],
+            )
+            .await?
+            .iter()
+            .map(|row| (row.get(0), row.get(1)))
+            .collect();
+
+        for file in files {
+            if stored.get(&file.path) == Some(&file.hash) {
+                stats.files_unchanged += 1;
+                continue;
+            }
+
+            let tx = client.transaction().await?;
+            tx.execute(
+                "INSERT INTO cs_files (repo_id, path, hash) VALUES ($1, $2, $3)
+                 ON CONFLICT (repo_id, path) DO UPDATE SET hash = EXCLUDED.hash",
+                &[&repo_id, &file.path, &file.hash],
+            )
+            .await?;
+            tx.execute(
+                "DELETE FROM cs_chunks WHERE repo_id = $1 AND path = $2",
+                &[&repo_id, &file.path],
+            )
+            .await?;
+
+            let insert = tx
+                .prepare(
+                    "INSERT INTO cs_chunks (repo_id, path, byte_start, byte_end, line_start, line_end,
+                                            chunk_type, breadcrumb, content, dims, embedding)
+                     VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+                )
+                .await?;
+            for chunk in &file.chunks {
+                let embedding = Vector::from(chunk.embedding.clone());
+                tx.execute(
+                    &insert,
+                    &[
+                        &repo_id,
+                        &file.path,
+                        &(chunk.span.byte_start as i64),
+                        &(chunk.span.byte_end as i64),
+                        &(chunk.span.line_start as i64),
+                        &(chunk.span.line_end as i64),
+                        &chunk.chunk_type,
+                        &chunk.breadcrumb,
+                        &chunk.content,
+                        &dims,
+                        &embedding,
+                    ],
+                )
+                .await?;
+            }
+            tx.commit().await?;
+
+            stats.files_uploaded += 1;
+            stats.chunks_uploaded += file.chunks.len();
+        }
+
+        let current: HashSet<&str> = files.iter().map(|f| f.path.as_str()).collect();
+        let removed: Vec<String> = stored
+            .keys()
+            .filter(|path| !current.contains(path.as_str()))
+            .cloned()
+            .collect();
+        if !removed.is_empty() {
+            stats.files_removed = client
+                .execute(
+                    "DELETE FROM cs_files WHERE repo_id = $1 AND path = ANY($2)",
+                    &[&repo_id, &removed],
+                )
+                .await? as usize;
+        }
+
+        Ok(stats)
+    }
+
+    /// Cosine nearest neighbours across `repos` (all repos using `model` when empty).
+    async fn search(
+        &self,
+        query: &[f32],
+        model: &RepoModel,
+        repos: &[String],
+        limit: usize,
+    ) -> Result<Vec<StoreHit>> {
+        if query.len() != model.embedding_dimensions {
+            bail!(
+                "Query embedding has {} dims but the store's '{}' vectors have {}.",
+                query.len(),
+                model.embedding_model,
+                model.embedding_dimensions
+            );
+        }
+
+        let dims = model.embedding_dimensions;
+        let sql = format!(
+            "SELECT r.name, c.path, c.byte_start, c.byte_end, c.line_start, c.line_end, c.content,
+                    1 - (c.embedding::vector({dims}) <=> $1::vector({dims})) AS score
+             FROM cs_chunks c JOIN cs_repos r ON r.id = c.repo_id
+             WHERE c.dims = {dims} AND r.embedding_model = $2
+               AND (cardinality($3::text[]) = 0 OR r.name = ANY($3))
+             ORDER BY c.embedding::vector({dims}) <=> $1::vector({dims})
+             LIMIT $4"
+        );
+
+        let client = self.pool.get().await?;
+        let query_vector = Vector::from(query.to_vec());
+        let rows = client
+            .query(
+                &sql,
+                &[
+                    &query_vector,
+                    &model.embedding_model,
+                    &repos,
+                    &(limit as i64),
+                ],
+            )
+            .await?;
+
+        Ok(rows
+            .iter()
+            .map(|row| StoreHit {
+                repo: row.get(0),
+                path: PathBuf::from(row.get::<_, String>(1)),
+                span: Span {
+                    byte_start: row.get::<_, i64>(2) as usize,
+                    byte_end: row.get::<_, i64>(3) as usize,
+                    line_start: row.get::<_, i64>(4) as usize,
+                    line_end: row.get::<_, i64>(5) as usize,
+                },
+                content: row.get(6),
+                score: row.get::<_, f64>(7) as f32,
+            })
+            .collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn migrations_are_ordered_and_unique() {
+        let versions: Vec<i32> = MIGRATIONS.iter().map(|(v, _)| *v).collect();
+        let mut sorted = versions.clone();
+        sorted.sort_unstable();
+        sorted.dedup();
+        assert_eq!(versions, sorted);
+        assert!(
+            MIGRATIONS[0]
+                .1
+                .contains("CREATE EXTENSION IF NOT EXISTS vector")
+        );
+    }
+}
@@ -0,0 +1,260 @@
+//! Qdrant backend over the REST API.
+//!
+//! Each repository is one collection (see [`collection_name`]) with cosine
+//! distance; chunk metadata and text live in the point payload.
+
+use super::http::{self, HIT_FIELDS};
+use super::{
+    RepoModel, StoreHit, StoreSyncStats, StoredFile, VectorStore, check_repo_model, chunk_id,
+    collection_name,
+};
+use anyhow::{Result, bail};
+use reqwest::Method;
+use reqwest::header::HeaderName;
+use serde_json::{Value, json};
+use std::collections::{HashMap, HashSet};
+
+const UPSERT_BATCH: usize = 256;
+const SCROLL_PAGE: usize = 1000;
+
+pub struct QdrantStore {
+    client: reqwest::Client,
+    base_url: String,
+}
+
+impl QdrantStore {
+    /// Connect to the Qdrant REST API at `base_url` (e.g. `http://localhost:6333`).
+    pub async fn connect(base_url: &str) -> Result<Self> {
+        let store = Self {
+            client: http::build_client(HeaderName::from_static("api-key"))?,
+            base_url: base_url.to_string(),
+        };
+        // Fail early on a wrong URL or API key rather than mid-sync
+        store
+            .send(Method::GET, "/collections", None)
+            .await?
+            .ok_or_else(|| anyhow::anyhow!("No Qdrant API found at {}", base_url))?;
+        Ok(store)
+    }
+
+    async fn send(
+        &self,
+        method: Method,
+        path: &str,
+        body: Option<&Value>,
+    ) -> Result<Option<Value>> {
+        http::send(
+            &self.client,
+            method,
+            &format!("{}{}", self.base_url, path),
+            body,
+        )
+        .await
+    }
+
+    async fn ensure_collection(&self, collection: &str, model: &RepoModel) -> Result<()> {
+        let path = format!("/collections/{}", collection);
+        if self.send(Method::GET, &path, None).await?.is_some() {
+            return Ok(());
+        }
+
+        self.send(
+            Method::PUT,
+            &path,
+            Some(&json!({
+                "vectors": { "size": model.embedding_dimensions, "distance": "Cosine" }
+            })),
+        )
+        .await?;
+        for (field, schema) in [("path", "keyword"), ("chunk_index", "integer")] {
+            self.send(
+                Method::PUT,
+                &format!("{}/index?wait=true", path),
+                Some(&json!({ "field_name": field, "field_schema": schema })),
+            )
+            .await?;
+        }
+        Ok(())
+    }
+
+    /// `path -> hash` for every file in `collection`.
+    async fn stored_files(&self, collection: &str) -> Result<HashMap<String, String>> {
+        let mut files = HashMap::new();
+        let mut offset = Value::Null;
+        loop {
+            let response = self
+                .send(
+                    Method::POST,
+                    &format!("/collections/{}/points/scroll", collection),
+                    Some(&json!({
+                        "filter": { "must": [{ "key": "chunk_index", "match": { "value": 0 } }] },
+                        "with_payload": ["path", "hash"],
+                        "with_vector": false,
+                        "limit": SCROLL_PAGE,
+                        "offset": offset,
+                    })),
+                )
+                .await?
+                .unwrap_or_default();
+
+            let result = &response["result"];
+            for point in result["points"].as_array().into_iter().flatten() {
+                let payload = &point["payload"];
+                if let (Some(path), Some(hash)) =
+                    (payload["path"].as_str(), payload["hash"].as_str())
+                {
+                    files.insert(path.to_string(), hash.to_string());
+                }
+            }
+
+            offset = result["next_page_offset"].clone();
+            if offset.is_null() {
+                return Ok(files);
+            }
+        }
+    }
+
+    async fn delete_paths(&self, collection: &str, paths: &[String]) -> Result<()> {
+        self.send(
+            Method::POST,
+            &format!("/collections/{}/points/delete?wait=true", collection),
+            Some(&json!({
+                "filter": { "must": [{ "key": "path", "match": { "any": paths } }] }
+            })),
+        )
+        .await?;
+        Ok(())
+    }
+}
+
+impl VectorStore for QdrantStore {
+    async fn repo_model(&self, repo: &str) -> Result<Option<RepoModel>> {
+        let Some(response) = self
+            .send(
+                Method::POST,
+                &format!("/collections/{}/points/scroll", collection_name(repo)),
+                Some(&json!({
+                    "with_payload": ["model", "dims"],
+                    "with_vector": false,
+                    "limit": 1,
+                })),
+            )
+            .await?
+        else {
+            return Ok(None);
+        };
+        Ok(response["result"]["points"]
+            .get(0)
+            .and_then(|point| http::model_from_fields(&point["payload"])))
+    }
+
+    async fn sync_repo(
+        &self,
+        repo: &str,
+        model: &RepoModel,
+        files: &[StoredFile],
+    ) -> Result<StoreSyncStats> {
+        if let Some(existing) = self.repo_model(repo).await? {
+            check_repo_model(repo, &existing, model)?;
+        }
+        let collection = collection_name(repo);
+        self.ensure_collection(&collection, model).await?;
+
+        let mut stats = StoreSyncStats::default();
+        let stored = self.stored_files(&collection).await?;
+
+        for file in files {
+            if stored.get(&file.path) == Some(&file.hash) {
+                stats.files_unchanged += 1;
+                continue;
+            }
+
+            self.delete_paths(&collection, std::slice::from_ref(&file.path))
+                .await?;
+
+            let points: Vec<Value> = file
+                .chunks
+                .iter()
+                .enumerate()
+                .map(|(index, chunk)| {
+                    json!({
+                        "id": chunk_id(&file.path, index),
+                        "vector": chunk.embedding,
+                        "payload": http::chunk_fields(&file.path, &file.hash, index, chunk, model),
+                    })
+                })
+                .collect();
+            for batch in points.chunks(UPSERT_BATCH) {
+                self.send(
+                    Method::PUT,
+                    &format!("/collections/{}/points?wait=true", collection),
+                    Some(&json!({ "points": batch })),
+                )
+                .await?;
+            }
+
+            stats.files_uploaded += 1;
+            stats.chunks_uploaded += file.chunks.len();
+        }
+
+        let current: HashSet<&str> = files.iter().map(|f| f.path.as_str()).collect();
+        let removed: Vec<String> = stored
+            .keys()
+            .filter(|path| !current.contains(path.as_str()))
+            .cloned()
+            .collect();
+        if !removed.is_empty() {
+            self.delete_paths(&collection, &removed).await?;
+            stats.files_removed = removed.len();
+        }
+
+        Ok(stats)
+    }
+
+    async fn search(
+        &self,
+        query: &[f32],
+        model: &RepoModel,
+        repos: &[String],
+        limit: usize,
+    ) -> Result<Vec<StoreHit>> {
+        if repos.is_empty() {
+            bail!("Qdrant searches need at least one --store-repo");
+        }
+        if query.len() != model.embedding_dimensions {
+            bail!(
+                "Query embedding has {} dims but the store's '{}' vectors have {}.",
+                query.len(),
+                model.embedding_model,
+                model.embedding_dimensions
+            );
+        }
+
+        let mut hits = Vec::new();
+        for repo in repos {
+            let Some(response) = self
+                .send(
+                    Method::POST,
+                    &format!("/collections/{}/points/search", collection_name(repo)),
+                    Some(&json!({
+                        "vector": query,
+                        "limit": limit,
+                        "with_payload": HIT_FIELDS,
+                    })),
+                )
+                .await?
+            else {
+                continue;
+            };
+
+            for point in response["result"].as_array().into_iter().flatten() {
+                let score = point["score"].as_f64().unwrap_or(0.0) as f32;
+                if let Some(hit) = http::hit_from_fields(repo, score, &point["payload"]) {
+                    hits.push(hit);
+                }
+            }
+        }
+
+        Ok(http::merge_hits(hits, limit))
+    }
+}
@@ -9,6 +9,7 @@ use crate::rendering::{draw_preview, draw_query_input, draw_results_list, draw_s
 use crate::state::{PreviewCache, TuiState};
 use anyhow::Result;
 use cs_core::{SearchMode, SearchOptions};
+use cs_engine::conversation::Conversation;
 use cs_index::get_index_stats;
 use crossterm::{
     event::{self, DisableMouseCapture, EnableMouseCapture, Event, KeyCode, KeyEventKind},
@@ -21,9 +22,8 @@ use ratatui::{
     layout::{Constraint, Direction, Layout},
     widgets::ListState,
 };
-use shlex::split;
 use std::io;
-use std::path::{Path, PathBuf};
+use std::path::PathBuf;
 use std::sync::{Arc, Mutex};
 use std::time::{Duration, Instant};
 use tokio::sync::mpsc::{UnboundedReceiver, UnboundedSender, unbounded_channel};
@@ -77,6 +77,7 @@ impl TuiApp {
                 indexing_started_at: None,
                 last_indexing_update: None,
                 search_in_progress: false,
+                conversation: Conversation::default(),
             },
             list_state: ListState::default(),
             last_search_time: Instant::now(),
@@ -414,6 +415,7 @@ impl TuiApp {
                 results,
                 summary,
                 query,
+                search_query,
             } => {
                 if generation != current_generation {
                     return;
@@ -426,6 +428,12 @@ impl TuiApp {
                 self.state.indexing_started_at = None;
                 self.state.last_indexing_update = None;
                 self.state.selected_files.clear();
+                // Follow-ups relate to the last standalone search
+                if search_query == query {
+                    self.state
+                        .conversation
+                        .record(&query, &search_query, &results, None);
+                }
                 self.state.results = results;
                 self.state.selected_idx = 0;
                 self.state.scroll_offset = 0;
@@ -553,9 +561,16 @@ impl TuiApp {
             true, // Use defaults
         );
 
+        // Regex patterns are taken literally; other modes resolve follow-ups
+        let search_query = match self.state.mode {
+            SearchMode::Regex | SearchMode::Ast => None,
+            _ => self.state.conversation.rewrite(&self.state.query),
+        }
+        .unwrap_or_else(|| self.state.query.clone());
+
         let options = SearchOptions {
             mode: self.state.mode.clone(),
-            query: self.state.query.clone(),
+            query: search_query,
             path: self.state.search_path.clone(),
             top_k: Some(50),
             threshold,
@@ -586,13 +601,36 @@ impl TuiApp {
             ast_lang: None,
             ast_selector: None,
             ast_strictness: None,
+            truncate_dims: None,
+            no_index_update: false,
+            vector_store: None,
+            store_repos: Vec::new(),
+            boost_rules: Vec::new(),
+            stop_symbol_rules: Vec::new(),
+            include_generated: false,
+            facet_filters: Vec::new(),
+            facet_summary: false,
+            no_query_cache: false,
+            explain_plan: false,
+            collections: Vec::new(),
+            license_filters: Vec::new(),
+            metadata_filters: Vec::new(),
+            must_match: None,
+            explain_scores: false,
+            tag_filters: Vec::new(),
+            max_typos: cs_core::DEFAULT_MAX_TYPOS,
+            fusion: cs_core::FusionConfig::default(),
+            snippet: None,
+            focus: None,
+            sub_queries: Vec::new(),
+            infer_language: cs_core::LanguageInference::default(),
         };
 
         let progress_tx = self.progress_tx.clone();
         let started_at = Instant::now();
+        let query_for_history = self.state.query.clone();
 
         let handle = tokio::spawn(async move {
-            let query_for_history = options.query.clone();
             let search_progress_sender = progress_tx.clone();
             let detailed_sender = progress_tx.clone();
             let completion_sender = progress_tx.clone();
@@ -655,7 +693,7 @@ impl TuiApp {
             match result {
                 Ok(search_results) => {
                     let elapsed_ms = started_at.elapsed().as_millis();
-                    let summary = if search_results.matches.is_empty() {
+                    let mut summary = if search_results.matches.is_empty() {
                         format!("No results ({} ms)", elapsed_ms)
                     } else {
                         format!(
@@ -664,11 +702,18 @@ impl TuiApp {
                             elapsed_ms
                         )
                     };
+                    if options.query != query_for_history {
+                        summary.push_str(&format!(" for \"{}\"", options.query));
+                    }
+                    if !search_results.warnings.is_empty() {
+                        summary.push_str(" - part of the index couldn't be read; run cs --doctor");
+                    }
                     let _ = completion_sender.send(UiEvent::SearchCompleted {
                         generation,
                         results: search_results.matches,
                         summary,
                         query: query_for_history,
+                        search_query: options.query,
                     });
                 }
                 Err(err) => {
@@ -923,68 +968,12 @@ impl TuiApp {
             return Ok(());
         }
 
-        let editor = std::env::var("EDITOR")
-            .or_else(|_| std::env::var("VISUAL"))
-            .unwrap_or_else(|_| "vim".to_string());
-        let editor_parts = split(&editor).unwrap_or_else(|| vec![editor.clone()]);
-        let (command_name, command_args) = match editor_parts.split_first() {
-            Some((command, args)) => (command.to_string(), args.to_vec()),
-            None => (editor.clone(), Vec::new()),
-        };
-
         // Need to restore terminal before opening editor
         disable_raw_mode()?;
         execute!(io::stdout(), LeaveAlternateScreen, DisableMouseCapture)?;
 
-        let mut command = std::process::Command::new(&command_name);
-        command.args(&command_args);
-
-        let editor_basename = Path::new(&command_name)
-            .file_name()
-            .and_then(|n| n.to_str())
-            .unwrap_or(&command_name);
-
-        // Open files based on editor type
-        let status = if editor_basename.contains("cursor") || editor_basename.contains("code") {
-            // Cursor/VS Code: can open multiple files with -g
-            for (file, line) in &files_to_open {
-                command
-                    .arg("-g")
-                    .arg(format!("{}:{}", file.display(), line));
-            }
-            command.status()?
-        } else if editor_basename.contains("subl") {
-            // Sublime: can open multiple files
-            for (file, line) in &files_to_open {
-                command.arg(format!("{}:{}", file.display(), line));
-            }
-            command.status()?
-        } else if editor_basename.contains("emacs") {
-            // Emacs: open first file only (multi-file is complex)
-            let (file, line) = &files_to_open[0];
-            command
-                .arg(format!("+{}", line))
-                .arg(file.display().to_string())
-                .status()?
-        } else if editor_basename.contains("nano") {
-            // Nano: open first file only
-            let (file, line) = &files_to_open[0];
-            command
-                .arg(format!("+{}", line))
-                .arg(file.display().to_string())
-                .status()?
-        } else {
-            // Vim/Neovim: can open multiple files with -p (tabs)
-            for (file, line) in &files_to_open {
-                command
-                    .arg(format!("+{}", line))
-                    .arg(file.display().to_string());
-            }
-            if files_to_open.len() > 1 {
-                command.arg("-p"); // Open in tabs
-            }
-            command.status()?
-        };
+        let template = std::env::var(crate::editor::OPEN_COMMAND_ENV).ok();
+        let status = crate::editor::open_in_editor(&files_to_open, template.as_deref())?;
 
         if !status.success() {
             eprintln!("Editor exited with error");
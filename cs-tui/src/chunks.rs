@@ -400,14 +400,12 @@ pub fn convert_chunks_to_meta(chunks: Vec<cs_chunk::Chunk>) -> Vec<IndexedChunkM
 
 /// Shared function to perform live chunking on a file (used by both --dump-chunks and TUI)
 pub fn chunk_file_live(file_path: &Path) -> Result<(Vec<String>, Vec<IndexedChunkMeta>), String> {
-    use std::fs;
-
     if !file_path.exists() {
         return Err(format!("File does not exist: {}", file_path.display()));
     }
 
     let detected_lang = Language::from_path(file_path);
-    let content = fs::read_to_string(file_path)
+    let content = cs_core::text::read_text(file_path)
         .map_err(|err| format!("Could not read {}: {}", file_path.display(), err))?;
     let lines: Vec<String> = content.lines().map(String::from).collect();
 
@@ -269,8 +269,7 @@ fn load_chunk_spans(repo_root: &Path, file_path: &Path) -> Result<Vec<IndexedChu
         .strip_prefix(repo_root)
         .unwrap_or(file_path)
         .to_path_buf();
-    let index_dir = repo_root.join(".cs");
-    let sidecar_path = index_dir.join(format!("{}.cs", standard_path.display()));
+    let sidecar_path = cs_index::shards::sidecar_path(repo_root, &standard_path);
 
     if !sidecar_path.exists() {
         return Ok(Vec::new());
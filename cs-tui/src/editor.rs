@@ -0,0 +1,107 @@
+//! Opening search results in an editor, for the TUI's Enter key and
+//! `cs --open`.
+
+use anyhow::{Result, bail};
+use shlex::split;
+use std::path::{Path, PathBuf};
+use std::process::{Command, ExitStatus};
+
+/// Command template used instead of `$EDITOR`, e.g. `idea --line {line} {file}`.
+pub const OPEN_COMMAND_ENV: &str = "CS_OPEN_COMMAND";
+
+/// Open `files` (each with a 1-based line) and wait for the editor to exit.
+///
+/// A `template` runs once per file, with `{file}` and `{line}` replaced; a
+/// template without `{file}` gets the path appended. Otherwise `$EDITOR` or
+/// `$VISUAL` opens them all, falling back to VS Code in its terminal and vim
+/// elsewhere.
+pub fn open_in_editor(files: &[(PathBuf, usize)], template: Option<&str>) -> Result<ExitStatus> {
+    if files.is_empty() {
+        bail!("Nothing to open");
+    }
+    let Some(template) = template.filter(|t| !t.trim().is_empty()) else {
+        return Ok(editor_command(&default_editor(), files).status()?);
+    };
+
+    let parts = split(template)
+        .filter(|parts| !parts.is_empty())
+        .ok_or_else(|| anyhow::anyhow!("Invalid open command: {}", template))?;
+    let mut status = None;
+    for (file, line) in files {
+        let file = file.display().to_string();
+        let line = line.to_string();
+        let mut args: Vec<String> = parts
+            .iter()
+            .map(|part| part.replace("{file}", &file).replace("{line}", &line))
+            .collect();
+        if !parts.iter().any(|part| part.contains("{file}")) {
+            args.push(file);
+        }
+        let exit = Command::new(&args[0]).args(&args[1..]).status()?;
+        if !exit.success() {
+            return Ok(exit);
+        }
+        status = Some(exit);
+    }
+    Ok(status.expect("at least one file was opened"))
+}
+
+fn default_editor() -> String {
+    std::env::var("EDITOR")
+        .or_else(|_| std::env::var("VISUAL"))
+        .unwrap_or_else(|_| {
+            if std::env::var("TERM_PROGRAM").is_ok_and(|term| term == "vscode") {
+                "code".to_string()
+            } else {
+                "vim".to_string()
+            }
+        })
+}
+
+/// The command line opening `files` in `editor`, in the way it understands.
+fn editor_command(editor: &str, files: &[(PathBuf, usize)]) -> Command {
+    let editor_parts = split(editor).unwrap_or_else(|| vec![editor.to_string()]);
+    let (command_name, command_args) = match editor_parts.split_first() {
+        Some((command, args)) => (command.to_string(), args.to_vec()),
+        None => (editor.to_string(), Vec::new()),
+    };
+
+    let mut command = Command::new(&command_name);
+    command.args(&command_args);
+
+    let editor_basename = Path::new(&command_name)
+        .file_name()
+        .and_then(|n| n.to_str())
+        .unwrap_or(&command_name);
+
+    if editor_basename.contains("cursor") || editor_basename.contains("code") {
+        // Cursor/VS Code: can open multiple files with -g
+        for (file, line) in files {
+            command
+                .arg("-g")
+                .arg(format!("{}:{}", file.display(), line));
+        }
+    } else if editor_basename.contains("subl") {
+        // Sublime: can open multiple files
+        for (file, line) in files {
+            command.arg(format!("{}:{}", file.display(), line));
+        }
+    } else if editor_basename.contains("emacs") || editor_basename.contains("nano") {
+        // Emacs/Nano: open first file only (multi-file is complex)
+        let (file, line) = &files[0];
+        command
+            .arg(format!("+{}", line))
+            .arg(file.display().to_string());
+    } else {
+        // Vim/Neovim: can open multiple files with -p (tabs)
+        for (file, line) in files {
+            command
+                .arg(format!("+{}", line))
+                .arg(file.display().to_string());
+        }
+        if files.len() > 1 {
+            command.arg("-p"); // Open in tabs
+        }
+    }
+    command
+}
@@ -19,6 +19,8 @@ pub enum UiEvent {
         results: Vec<SearchResult>,
         summary: String,
         query: String,
+        /// `query`, or its rewrite when it was a follow-up
+        search_query: String,
     },
     SearchFailed {
         generation: u64,
@@ -3,6 +3,7 @@ pub mod chunks;
 pub mod colors;
 pub mod commands;
 pub mod config;
+pub mod editor;
 pub mod events;
 pub mod preview;
 pub mod rendering;
@@ -36,7 +36,7 @@ pub fn load_preview_lines(
         let lines: Vec<String> = content.lines().map(|line| line.to_string()).collect();
         (content, lines)
     } else {
-        let content = fs::read_to_string(&resolved_path)
+        let content = cs_core::text::read_text(&resolved_path)
             .map_err(|err| format!("Could not read {}: {}", resolved_path.display(), err))?;
         let lines: Vec<String> = content.lines().map(|line| line.to_string()).collect();
         (content, lines)
@@ -73,8 +73,7 @@ fn load_chunk_spans(repo_root: &Path, file_path: &Path) -> Result<Vec<IndexedChu
         .strip_prefix(repo_root)
         .unwrap_or(file_path)
         .to_path_buf();
-    let index_dir = repo_root.join(".cs");
-    let sidecar_path = index_dir.join(format!("{}.cs", standard_path.display()));
+    let sidecar_path = cs_index::shards::sidecar_path(repo_root, &standard_path);
 
     if !sidecar_path.exists() {
         return Ok(Vec::new());
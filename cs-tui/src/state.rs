@@ -2,6 +2,7 @@ use crate::chunks::IndexedChunkMeta;
 use crate::config::PreviewMode;
 use cs_core::SearchMode;
 use cs_core::SearchResult;
+use cs_engine::conversation::Conversation;
 use cs_index::IndexStats;
 use ratatui::text::Line;
 use std::collections::HashSet;
@@ -34,6 +35,8 @@ pub struct TuiState {
     pub indexing_started_at: Option<Instant>,
     pub last_indexing_update: Option<Instant>,
     pub search_in_progress: bool,
+    /// Subject that follow-up queries are rewritten with
+    pub conversation: Conversation,
 }
 
 pub struct PreviewCache {
@@ -50,7 +50,7 @@ pub fn find_repo_root(path: &Path) -> Option<PathBuf> {
     };
 
     loop {
-        if current.join(".cs").exists() {
+        if cs_core::locations::index_dir(current).exists() {
             return Some(current.to_path_buf());
         }
         match current.parent() {